@@ -0,0 +1,94 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Archived conversations. Archiving hides the subscription from the chat
+ *    list without muting, leaving or deleting it: the user remains subscribed,
+ *    messages are delivered and searchable, but no push notifications are sent
+ *    from an archived topic.
+ *
+ *    - {set topic="grpX" archive={archived: true, unarchive: true}} archives
+ *      the subscription. With unarchive=true the subscription is unarchived
+ *      by the next message the user can read. User's sessions are notified
+ *      of changes with {pres topic="me" what="upd" src="grpX"}.
+ *    - {get topic="me" what="sub"} skips archived subscriptions unless the
+ *      topic or ims is given; {get topic="me" what="sub" sub={archived: true}}
+ *      lists only archived subscriptions.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// replySetArchive archives or unarchives the user's subscription to the topic.
+func (t *Topic) replySetArchive(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for archiving")
+	}
+
+	pud, ok := t.perUser[asUid]
+	if asChan || !ok || pud.deleted {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to archive topic by non-subscriber")
+	}
+
+	req := msg.Set.Archive
+	// Unarchiving on a new message makes sense only for archived subscriptions.
+	autoUnarchive := req.Archived && req.Unarchive
+	if req.Archived == pud.archived && autoUnarchive == pud.autoUnarchive {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	update := map[string]any{"AutoUnarchive": autoUnarchive}
+	if req.Archived != pud.archived {
+		update["ArchivedAt"] = nil
+		if req.Archived {
+			update["ArchivedAt"] = now
+		}
+	}
+	if err := store.Subs.Update(t.name, asUid, update); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	pud.archived = req.Archived
+	pud.autoUnarchive = autoUnarchive
+	t.perUser[asUid] = pud
+
+	// Notify user's other sessions.
+	t.presSingleUserOffline(asUid, pud.modeWant&pud.modeGiven, "upd", nilPresParams, sess.sid, false)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// unarchiveOnMessage unarchives subscriptions of readers of the new message who asked for it.
+func (t *Topic) unarchiveOnMessage(head map[string]any) {
+	scope := msgScope(head)
+	for uid, pud := range t.perUser {
+		if !pud.archived || !pud.autoUnarchive || pud.deleted || pud.isChan ||
+			!(pud.modeGiven & pud.modeWant).IsReader() || !t.userInMsgScope(scope, uid) {
+			continue
+		}
+
+		if err := store.Subs.Update(t.name, uid,
+			map[string]any{"ArchivedAt": nil, "AutoUnarchive": false}); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to unarchive subscription: %v", t.name, err)
+			continue
+		}
+		pud.archived = false
+		pud.autoUnarchive = false
+		t.perUser[uid] = pud
+
+		t.presSingleUserOffline(uid, pud.modeWant&pud.modeGiven, "upd", nilPresParams, "", false)
+	}
+}
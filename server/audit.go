@@ -0,0 +1,69 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Audit log of security-relevant events: logins, failed authentication,
+ *    changes of access permissions, transfers of topic ownership, account
+ *    deletions and admin API requests. The log is queried through the admin
+ *    API. Records older than the retention period are deleted by a background
+ *    reaper.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// auditLog saves the record to the audit log if the log is enabled.
+func auditLog(rec *types.AuditRecord) {
+	if !globals.auditEnabled {
+		return
+	}
+	if err := store.Audit.Log(rec); err != nil {
+		logs.Warn.Println("audit: failed to save record", rec.Event, err)
+	}
+}
+
+// auditUserId returns the user ID in the form suitable for the audit log: "usrXXX" or blank if the user is unknown.
+func auditUserId(uid types.Uid) string {
+	if uid.IsZero() {
+		return ""
+	}
+	return uid.UserId()
+}
+
+// auditRunReaper deletes audit records older than 'retention' every 'period'.
+// Returns channel which can be used to stop the process.
+func auditRunReaper(period, retention time.Duration) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the reaper must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Reaper of audit log started with period %s, retention %s",
+			period.Round(time.Second), retention)
+		for {
+			select {
+			case <-ticker.C:
+				if count, err := store.Audit.Expire(types.TimeNow().Add(-retention)); err != nil {
+					logs.Warn.Println("audit: failed to delete expired records", err)
+				} else if count > 0 {
+					logs.Info.Println("audit: deleted expired records", count)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
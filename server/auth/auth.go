@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tinode/chat/server/store/types"
@@ -204,6 +205,13 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	}
 }
 
+// UidToHex formats user ID as a fixed-length hex string. Authenticators use it in tokens and in
+// keys of the persistent cache, where all keys of the user share the prefix.
+func UidToHex(uid types.Uid) string {
+	s := strconv.FormatUint(uint64(uid), 16)
+	return strings.Repeat("0", 16-len(s)) + s
+}
+
 // Rec is an authentication record.
 type Rec struct {
 	// User ID.
@@ -226,6 +234,9 @@ type Rec struct {
 	DefAcs  *types.DefaultAccess `json:"defacs,omitempty"`
 	Public  any                  `json:"public,omitempty"`
 	Private any                  `json:"private,omitempty"`
+
+	// Authenticator-specific parameters to be returned to the client, such as enrollment secrets.
+	Params map[string]any `json:"params,omitempty"`
 }
 
 // AuthHandler is the interface which auth providers must implement.
@@ -278,3 +289,12 @@ type AuthHandler interface {
 	// GetRealName returns the hardcoded name of the authenticator.
 	GetRealName() string
 }
+
+// SecondFactor is an optional interface implemented by authenticators which provide a second step
+// of authentication by other authenticators.
+type SecondFactor interface {
+	// Challenge returns a challenge which must be answered with this authenticator in order to
+	// complete authentication of the user who was authenticated by the given scheme.
+	// Returns nil if the second step is not required.
+	Challenge(scheme string, rec *Rec) ([]byte, error)
+}
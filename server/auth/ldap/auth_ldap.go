@@ -0,0 +1,680 @@
+// Package ldap implements authentication against an LDAP directory or Active Directory.
+//
+// The secret is "login:password" as in the basic scheme. The user is found in the directory by the
+// login using the service account, then the password is verified by binding as the user. Directory
+// groups of the user, optionally including nested groups, are mapped to tags. Accounts can be
+// created automatically on the first login. Display names and avatars of users are copied from the
+// directory on login and, optionally, periodically.
+package ldap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Placeholder of the login in the user filter.
+	loginPlaceholder = "{login}"
+	// Maximum depth of nested groups.
+	maxGroupDepth = 8
+	// Maximum number of groups of one user.
+	maxGroups = 500
+	// Maximum size of the avatar copied from the directory.
+	maxAvatarSize = 64 << 10
+	// Maximum length of a tag created from an attribute.
+	maxTagLength = 96
+	// Number of users synchronized in one batch.
+	syncBatchSize = 100
+
+	defaultUserFilter = "(uid={login})"
+	defaultPoolSize   = 4
+	defaultTimeout    = 10
+)
+
+// authenticator is the type to map authentication methods to.
+type authenticator struct {
+	name string
+	pool *pool
+	// Configuration of connections for binding as the user.
+	dialCfg    *dialConfig
+	baseDN     string
+	userFilter string
+	nameAttr   string
+	avatarAttr string
+	// Mapping of tag namespaces to attributes.
+	tagAttrs map[string]string
+	// Mapping of lowercase group DNs to tags.
+	groupTags    map[string]string
+	nestedGroups bool
+	autoCreate   bool
+	defAuth      types.AccessMode
+	defAnon      types.AccessMode
+}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (la *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_ldap: authenticator name cannot be blank")
+	}
+
+	if la.name != "" {
+		return errors.New("auth_ldap: already initialized as " + la.name + "; " + name)
+	}
+
+	type configType struct {
+		// Server URL, ldap://host:port or ldaps://host:port.
+		URL string `json:"url"`
+		// Upgrade ldap:// connections to TLS with StartTLS.
+		StartTLS bool `json:"start_tls"`
+		// PEM file with CA certificates to verify the server. System CAs are used if missing.
+		CAFile string `json:"ca_file"`
+		// Do not verify the server certificate. For testing only.
+		InsecureSkipVerify bool `json:"insecure_skip_verify"`
+		// Service account for searching users.
+		BindDN       string `json:"bind_dn"`
+		BindPassword string `json:"bind_password"`
+		// Where to search for users.
+		BaseDN string `json:"base_dn"`
+		// Filter to find the user by login, "(uid={login})" by default.
+		UserFilter string `json:"user_filter"`
+		// Attribute with the full name of the user.
+		NameAttribute string `json:"name_attribute"`
+		// Attribute with the JPEG or PNG photo of the user.
+		AvatarAttribute string `json:"avatar_attribute"`
+		// Mapping of tag namespaces to attributes, e.g. {"email": "mail"}.
+		TagAttributes map[string]string `json:"tag_attributes"`
+		// Mapping of group DNs to tags, e.g. {"CN=Sales,OU=Groups,DC=example,DC=com": "dept:sales"}.
+		GroupTags map[string]string `json:"group_tags"`
+		// Resolve nested group membership.
+		NestedGroups bool `json:"nested_groups"`
+		// Create accounts for unknown users on the first login.
+		AutoCreate bool `json:"auto_create"`
+		// Default access mode of the created accounts.
+		DefaultAccess struct {
+			Auth string `json:"auth"`
+			Anon string `json:"anon"`
+		} `json:"default_access"`
+		// Maximum number of idle connections of the service account.
+		PoolSize int `json:"pool_size"`
+		// Network timeout, seconds.
+		Timeout int `json:"timeout"`
+		// Period of synchronization of names, avatars and tags, seconds. Disabled if 0.
+		SyncInterval int `json:"sync_interval"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_ldap: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	serverURL, err := url.Parse(config.URL)
+	if err != nil || (serverURL.Scheme != "ldap" && serverURL.Scheme != "ldaps") || serverURL.Hostname() == "" {
+		return errors.New("auth_ldap: invalid server url '" + config.URL + "'")
+	}
+	if config.BaseDN == "" {
+		return errors.New("auth_ldap: base_dn is required")
+	}
+	if config.UserFilter == "" {
+		config.UserFilter = defaultUserFilter
+	}
+	if !strings.Contains(config.UserFilter, loginPlaceholder) {
+		return errors.New("auth_ldap: user_filter must contain " + loginPlaceholder)
+	}
+	if _, err := compileFilter(strings.ReplaceAll(config.UserFilter, loginPlaceholder, "x")); err != nil {
+		return errors.New("auth_ldap: invalid user_filter: " + err.Error())
+	}
+	for ns := range config.TagAttributes {
+		if ns == "" || strings.Contains(ns, ":") {
+			return errors.New("auth_ldap: invalid tag namespace '" + ns + "'")
+		}
+	}
+	la.groupTags = make(map[string]string)
+	for dn, tag := range config.GroupTags {
+		if ns, value, ok := strings.Cut(tag, ":"); !ok || ns == "" || value == "" {
+			return errors.New("auth_ldap: group tag must be 'namespace:value', got '" + tag + "'")
+		}
+		la.groupTags[strings.ToLower(dn)] = strings.ToLower(tag)
+	}
+
+	if config.DefaultAccess.Auth == "" {
+		config.DefaultAccess.Auth = "JRWPAS"
+	}
+	if config.DefaultAccess.Anon == "" {
+		config.DefaultAccess.Anon = "N"
+	}
+	if err := la.defAuth.UnmarshalText([]byte(config.DefaultAccess.Auth)); err != nil {
+		return errors.New("auth_ldap: invalid default_access: " + err.Error())
+	}
+	if err := la.defAnon.UnmarshalText([]byte(config.DefaultAccess.Anon)); err != nil {
+		return errors.New("auth_ldap: invalid default_access: " + err.Error())
+	}
+	if config.PoolSize < 0 || config.Timeout < 0 || config.SyncInterval < 0 {
+		return errors.New("auth_ldap: invalid config value")
+	}
+	if config.PoolSize == 0 {
+		config.PoolSize = defaultPoolSize
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         serverURL.Hostname(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return errors.New("auth_ldap: failed to read ca_file: " + err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("auth_ldap: no certificates in ca_file")
+		}
+	}
+	if serverURL.Scheme == "ldap" && !config.StartTLS {
+		logs.Warn.Println("auth_ldap: passwords are sent to the directory server unencrypted, use ldaps or start_tls")
+	}
+
+	la.dialCfg = &dialConfig{
+		url:       serverURL,
+		startTLS:  config.StartTLS,
+		tlsConfig: tlsConfig,
+		timeout:   time.Duration(config.Timeout) * time.Second,
+	}
+	la.pool = newPool(la.dialCfg, config.PoolSize, config.BindDN, config.BindPassword)
+	la.baseDN = config.BaseDN
+	la.userFilter = config.UserFilter
+	la.nameAttr = config.NameAttribute
+	la.avatarAttr = config.AvatarAttribute
+	la.tagAttrs = config.TagAttributes
+	la.nestedGroups = config.NestedGroups
+	la.autoCreate = config.AutoCreate
+	la.name = name
+
+	if config.SyncInterval > 0 {
+		go la.syncLoop(time.Duration(config.SyncInterval) * time.Second)
+	}
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (la *authenticator) IsInitialized() bool {
+	return la.name != ""
+}
+
+// AddRecord links the directory user to a new account.
+func (la *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	login, e, groups, err := la.verify(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	authLevel := rec.AuthLevel
+	if authLevel == auth.LevelNone {
+		authLevel = auth.LevelAuth
+	}
+	if err = store.Users.AddAuthRecord(rec.Uid, authLevel, la.name, login, []byte(e.dn), time.Time{}); err != nil {
+		return nil, err
+	}
+
+	rec.AuthLevel = authLevel
+	rec.Tags = append(rec.Tags, la.tags(e, groups)...)
+	return rec, nil
+}
+
+// UpdateRecord links the directory user to the existing account replacing the previously linked
+// user, if any.
+func (la *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	login, e, groups, err := la.verify(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(la.name, login)
+	if err != nil {
+		return nil, err
+	}
+	if !uid.IsZero() && uid != rec.Uid {
+		// The directory user is linked to another account.
+		return nil, types.ErrDuplicate
+	}
+
+	_, authLevel, _, _, err := store.Users.GetAuthRecord(rec.Uid, la.name)
+	if err == types.ErrNotFound {
+		err = store.Users.AddAuthRecord(rec.Uid, auth.LevelAuth, la.name, login, []byte(e.dn), time.Time{})
+	} else if err == nil {
+		err = store.Users.UpdateAuthRecord(rec.Uid, authLevel, la.name, login, []byte(e.dn), time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range la.tags(e, groups) {
+		if !slices.Contains(rec.Tags, tag) {
+			rec.Tags = append(rec.Tags, tag)
+		}
+	}
+	return rec, nil
+}
+
+// Authenticate checks the login and the password against the directory and finds the account linked
+// to the directory user. If there is no such account and automatic account creation is enabled,
+// creates a new account.
+func (la *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	login, e, groups, err := la.verify(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, authLvl, dn, _, err := store.Users.GetAuthUniqueRecord(la.name, login)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !uid.IsZero() {
+		if string(dn) != e.dn {
+			// The user was renamed or moved in the directory.
+			la.updateDN(uid, login, e.dn)
+		}
+		if err := la.syncUser(uid, e, groups); err != nil {
+			logs.Warn.Println("ldap_auth: failed to sync user", uid.UserId(), err)
+		}
+		return &auth.Rec{
+			Uid:       uid,
+			AuthLevel: authLvl,
+			State:     types.StateUndefined}, nil, nil
+	}
+
+	if !la.autoCreate {
+		return nil, nil, types.ErrFailed
+	}
+
+	// Create a new account.
+	user := types.User{
+		Public: la.public(nil, e),
+		Tags:   la.tags(e, groups),
+	}
+	user.Access.Auth = la.defAuth
+	user.Access.Anon = la.defAnon
+	if _, err = store.Users.Create(&user, nil); err != nil {
+		return nil, nil, err
+	}
+	err = store.Users.AddAuthRecord(user.Uid(), auth.LevelAuth, la.name, login, []byte(e.dn), time.Time{})
+	if err != nil {
+		// Attempt to delete incomplete user record.
+		if err := store.Users.Delete(user.Uid(), true); err != nil {
+			logs.Warn.Println("ldap_auth: failed to delete incomplete user record", err)
+		}
+		return nil, nil, err
+	}
+	logs.Info.Println("ldap_auth: created account", user.Uid().UserId(), "for", login)
+
+	return &auth.Rec{
+		Uid:       user.Uid(),
+		AuthLevel: auth.LevelAuth,
+		Tags:      user.Tags,
+		State:     types.StateOK}, nil, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique checks the login and the password and that the directory user is not linked to any account.
+func (la *authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	login, _, _, err := la.verify(secret)
+	if err != nil {
+		return false, err
+	}
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(la.name, login)
+	if err != nil {
+		return false, err
+	}
+	if !uid.IsZero() {
+		return false, types.ErrDuplicate
+	}
+	return true, nil
+}
+
+// GenSecret is not supported, will produce an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes the link between the user and the directory.
+func (la *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, la.name)
+}
+
+// RestrictedTags returns tag namespaces managed by the directory.
+func (la *authenticator) RestrictedTags() ([]string, error) {
+	return la.namespaces(), nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for LDAP: passwords are managed by the directory).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// verify parses the secret, finds the user in the directory and checks the password. Returns the
+// normalized login, the directory entry and the DNs of user's groups.
+func (la *authenticator) verify(secret []byte) (string, *entry, []string, error) {
+	login, password, found := strings.Cut(string(secret), ":")
+	login = strings.ToLower(strings.TrimSpace(login))
+	// An empty password would be accepted by the server as an unauthenticated bind.
+	if !found || login == "" || password == "" {
+		return "", nil, nil, types.ErrMalformed
+	}
+
+	e, groups, err := la.findUser(login)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// Bind as the user on a separate connection: pooled connections are bound as the service account.
+	c, err := dial(la.dialCfg)
+	if err != nil {
+		logs.Warn.Println("ldap_auth: failed to connect", err)
+		return "", nil, nil, types.ErrInternal
+	}
+	defer c.close()
+	if err = c.bind(e.dn, password); err != nil {
+		if isResult(err, resultInvalidCredentials) {
+			return "", nil, nil, types.ErrFailed
+		}
+		logs.Warn.Println("ldap_auth: bind failed", err)
+		return "", nil, nil, types.ErrInternal
+	}
+	return login, e, groups, nil
+}
+
+// findUser finds the user by login and resolves user's groups.
+func (la *authenticator) findUser(login string) (*entry, []string, error) {
+	var e *entry
+	var groups []string
+	err := la.pool.do(func(c *conn) error {
+		entries, err := c.search(la.baseDN, scopeSubtree,
+			strings.ReplaceAll(la.userFilter, loginPlaceholder, escapeFilter(login)), la.attributes(), 2)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 1 {
+			// Not found or ambiguous.
+			return nil
+		}
+		e = entries[0]
+		groups, err = la.groups(c, e)
+		return err
+	})
+	if err != nil {
+		logs.Warn.Println("ldap_auth: search failed", err)
+		return nil, nil, types.ErrInternal
+	}
+	if e == nil {
+		return nil, nil, types.ErrFailed
+	}
+	return e, groups, nil
+}
+
+// findByDN reads the user's entry by DN.
+func (la *authenticator) findByDN(dn string) (*entry, []string, error) {
+	var e *entry
+	var groups []string
+	err := la.pool.do(func(c *conn) error {
+		entries, err := c.search(dn, scopeBase, "(objectClass=*)", la.attributes(), 1)
+		if err != nil || len(entries) == 0 {
+			return err
+		}
+		e = entries[0]
+		groups, err = la.groups(c, e)
+		return err
+	})
+	if isResult(err, resultNoSuchObject) {
+		return nil, nil, nil
+	}
+	return e, groups, err
+}
+
+// attributes returns the attributes of users to fetch.
+func (la *authenticator) attributes() []string {
+	attrs := []string{"memberOf"}
+	for _, a := range append([]string{la.nameAttr, la.avatarAttr}, slices.Collect(maps.Values(la.tagAttrs))...) {
+		if a != "" && !slices.Contains(attrs, a) {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs
+}
+
+// groups returns DNs of user's groups. Nested groups are resolved by following memberOf of groups.
+func (la *authenticator) groups(c *conn, e *entry) ([]string, error) {
+	direct := e.values("memberOf")
+	if !la.nestedGroups {
+		return direct, nil
+	}
+
+	seen := make(map[string]bool)
+	var all []string
+	level := direct
+	for depth := 0; depth < maxGroupDepth && len(level) > 0; depth++ {
+		var next []string
+		for _, dn := range level {
+			key := strings.ToLower(dn)
+			if seen[key] {
+				continue
+			}
+			if len(all) >= maxGroups {
+				return all, nil
+			}
+			seen[key] = true
+			all = append(all, dn)
+
+			entries, err := c.search(dn, scopeBase, "(objectClass=*)", []string{"memberOf"}, 1)
+			if err != nil {
+				if isResult(err, resultNoSuchObject) {
+					continue
+				}
+				return nil, err
+			}
+			for _, ge := range entries {
+				next = append(next, ge.values("memberOf")...)
+			}
+		}
+		level = next
+	}
+	return all, nil
+}
+
+// tags converts attributes and groups of the user to tags.
+func (la *authenticator) tags(e *entry, groups []string) []string {
+	var tags []string
+	for ns, attr := range la.tagAttrs {
+		value := strings.ToLower(strings.TrimSpace(e.value(attr)))
+		if value == "" {
+			continue
+		}
+		if tag := ns + ":" + value; len(tag) <= maxTagLength {
+			tags = append(tags, tag)
+		}
+	}
+	for _, dn := range groups {
+		if tag, ok := la.groupTags[strings.ToLower(dn)]; ok && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// namespaces returns tag namespaces managed by the directory.
+func (la *authenticator) namespaces() []string {
+	var nss []string
+	for ns := range la.tagAttrs {
+		nss = append(nss, ns)
+	}
+	for _, tag := range la.groupTags {
+		if ns, _, _ := strings.Cut(tag, ":"); !slices.Contains(nss, ns) {
+			nss = append(nss, ns)
+		}
+	}
+	return nss
+}
+
+// public updates public data of the user with the name and the avatar from the directory.
+// Returns nil if there is nothing to set.
+func (la *authenticator) public(public any, e *entry) any {
+	card, _ := public.(map[string]any)
+	updated := make(map[string]any, len(card)+2)
+	for k, v := range card {
+		updated[k] = v
+	}
+	if la.nameAttr != "" {
+		if name := strings.TrimSpace(e.value(la.nameAttr)); name != "" {
+			updated["fn"] = name
+		}
+	}
+	if la.avatarAttr != "" {
+		if photo := []byte(e.value(la.avatarAttr)); len(photo) > 0 && len(photo) <= maxAvatarSize {
+			if mime := http.DetectContentType(photo); mime == "image/jpeg" || mime == "image/png" {
+				updated["photo"] = map[string]any{"type": strings.TrimPrefix(mime, "image/"), "data": photo}
+			}
+		}
+	}
+	if len(updated) == 0 {
+		return nil
+	}
+	return updated
+}
+
+// syncUser copies the name, the avatar and tags of the user from the directory to the account.
+func (la *authenticator) syncUser(uid types.Uid, e *entry, groups []string) error {
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return types.ErrUserNotFound
+	}
+
+	// Replace tags in namespaces managed by the directory, keep other tags.
+	nss := la.namespaces()
+	tags := la.tags(e, groups)
+	for _, tag := range user.Tags {
+		if ns, _, _ := strings.Cut(tag, ":"); !slices.Contains(nss, ns) {
+			tags = append(tags, tag)
+		}
+	}
+	if !sameTags(user.Tags, tags) {
+		if _, err = store.Users.UpdateTags(uid, nil, nil, tags); err != nil {
+			return err
+		}
+	}
+
+	if public := la.public(user.Public, e); public != nil {
+		before, _ := json.Marshal(user.Public)
+		after, _ := json.Marshal(public)
+		if !bytes.Equal(before, after) {
+			return store.Users.Update(uid, map[string]any{"Public": public})
+		}
+	}
+	return nil
+}
+
+// syncLoop periodically synchronizes all users linked to the directory.
+func (la *authenticator) syncLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		la.syncAll()
+	}
+}
+
+// syncAll synchronizes all users linked to the directory.
+func (la *authenticator) syncAll() {
+	var count int
+	after := ""
+	for {
+		records, err := store.Users.GetAuthRecords(la.name, after, syncBatchSize)
+		if err != nil {
+			logs.Warn.Println("ldap_auth: sync failed to read accounts", err)
+			return
+		}
+		for _, rec := range records {
+			e, groups, err := la.findByDN(string(rec.Secret))
+			if err == nil && e == nil {
+				// The user was renamed or moved: search by login.
+				e, groups, err = la.findUser(rec.Unique)
+				if err == types.ErrFailed {
+					// The user is no longer in the directory.
+					continue
+				}
+				if err == nil {
+					la.updateDN(rec.Uid, rec.Unique, e.dn)
+				}
+			}
+			if err != nil {
+				logs.Warn.Println("ldap_auth: sync failed to read", rec.Unique, err)
+				return
+			}
+			if err = la.syncUser(rec.Uid, e, groups); err != nil {
+				logs.Warn.Println("ldap_auth: failed to sync user", rec.Uid.UserId(), err)
+				continue
+			}
+			count++
+		}
+		if len(records) < syncBatchSize {
+			break
+		}
+		after = records[len(records)-1].Unique
+	}
+	logs.Info.Println("ldap_auth: synchronized", count, "users")
+}
+
+// updateDN saves the new DN of the user.
+func (la *authenticator) updateDN(uid types.Uid, login, dn string) {
+	_, authLvl, _, _, err := store.Users.GetAuthRecord(uid, la.name)
+	if err == nil {
+		err = store.Users.UpdateAuthRecord(uid, authLvl, la.name, login, []byte(dn), time.Time{})
+	}
+	if err != nil {
+		logs.Warn.Println("ldap_auth: failed to update DN of", login, err)
+	}
+}
+
+// sameTags checks if two lists contain the same tags.
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+const realName = "ldap"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
@@ -0,0 +1,238 @@
+package ldap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+func TestBerInt(t *testing.T) {
+	for v, expected := range map[int64]string{
+		0:    "020100",
+		127:  "02017f",
+		128:  "02020080",
+		256:  "02020100",
+		-1:   "0201ff",
+		-128: "020180",
+		-129: "0202ff7f",
+	} {
+		enc := berInt(tagInteger, v)
+		if hex.EncodeToString(enc) != expected {
+			t.Errorf("%d encoded as %x, expected %s", v, enc, expected)
+		}
+		el, _, err := berDecode(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dec, err := el.int(); err != nil || dec != v {
+			t.Errorf("%x decoded as %d, expected %d", enc, dec, v)
+		}
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	for filter, expected := range map[string]string{
+		"(cn=Babs)":                           "a30a0402636e040442616273",
+		"(!(cn=Tim))":                         "a20ba309040263 6e0403 54696d",
+		"(cn=*)":                              "8702636e",
+		"(cn=a*b*c)":                          "a40f0402636e30098001618101628201 63",
+		"(&(a=1)(|(b=2)(c>=3)))":              "a01aa306040161040131a110a306040162040132a506040163040133",
+		"(member:1.2.840.113556.1.4.1941:=x)": "a924" + "8117" + "312e322e3834302e3131333535362e312e342e31393431" + "82066d656d626572830178",
+		`(cn=a\2ab)`:                          "a3090402636e0403612a62",
+	} {
+		enc, err := compileFilter(filter)
+		if err != nil {
+			t.Errorf("%s: %v", filter, err)
+			continue
+		}
+		if hex.EncodeToString(enc) != strings.ReplaceAll(expected, " ", "") {
+			t.Errorf("%s encoded as %x, expected %s", filter, enc, expected)
+		}
+	}
+
+	for _, bad := range []string{"", "(cn=a", "(cn=a))", "(=a)", "(!(a=1)(b=2))", "(&)", `(cn=\2)`, "(c n=a)"} {
+		if _, err := compileFilter(bad); err == nil {
+			t.Errorf("invalid filter '%s' accepted", bad)
+		}
+	}
+
+	if escaped := escapeFilter(`a*(b)\c` + "\x00"); escaped != `a\2a\28b\29\5cc\00` {
+		t.Error("wrong escaping", escaped)
+	}
+}
+
+// fakeDirectory is a minimal LDAP server for tests.
+type fakeDirectory struct {
+	// Entries by lowercase DN.
+	entries map[string]map[string][]string
+	// Passwords by lowercase DN.
+	passwords map[string]string
+}
+
+func (fd *fakeDirectory) serve(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fd.handle(nc)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func (fd *fakeDirectory) handle(nc net.Conn) {
+	defer nc.Close()
+	for {
+		data, err := berReadMessage(nc)
+		if err != nil {
+			return
+		}
+		msg, _, _ := berDecode(data)
+		parts, _ := msg.children()
+		id, _ := parts[0].int()
+		reply := func(op []byte) {
+			nc.Write(berSeq(tagSequence, berInt(tagInteger, id), op))
+		}
+		result := func(tag byte, code int64) {
+			reply(berSeq(tag, berInt(tagEnumerated, code), berString(tagOctetString, ""),
+				berString(tagOctetString, "")))
+		}
+
+		req, _ := parts[1].children()
+		switch parts[1].tag {
+		case opBindRequest:
+			dn, password := strings.ToLower(string(req[1].content)), string(req[2].content)
+			if pwd, ok := fd.passwords[dn]; ok && pwd == password {
+				result(opBindResponse, resultSuccess)
+			} else {
+				result(opBindResponse, resultInvalidCredentials)
+			}
+		case opSearchRequest:
+			base := strings.ToLower(string(req[0].content))
+			scope, _ := req[1].int()
+			if scope == scopeBase {
+				attrs, ok := fd.entries[base]
+				if !ok {
+					result(opSearchDone, resultNoSuchObject)
+					continue
+				}
+				reply(encodeEntry(base, attrs))
+			} else {
+				// Subtree search: entries with the uid found in the filter.
+				for dn, attrs := range fd.entries {
+					if uid := attrs["uid"]; len(uid) > 0 && bytes.Contains(req[6].content, []byte(uid[0])) {
+						reply(encodeEntry(dn, attrs))
+					}
+				}
+			}
+			result(opSearchDone, resultSuccess)
+		default:
+			return
+		}
+	}
+}
+
+func encodeEntry(dn string, attrs map[string][]string) []byte {
+	var list [][]byte
+	for name, values := range attrs {
+		var vals [][]byte
+		for _, v := range values {
+			vals = append(vals, berString(tagOctetString, v))
+		}
+		list = append(list, berSeq(tagSequence, berString(tagOctetString, name), berSeq(tagSet, vals...)))
+	}
+	return berSeq(opSearchEntry, berString(tagOctetString, dn), berSeq(tagSequence, list...))
+}
+
+func TestVerify(t *testing.T) {
+	const (
+		userDN   = "uid=alice,ou=people,dc=example,dc=com"
+		sales    = "cn=sales,ou=groups,dc=example,dc=com"
+		emea     = "cn=emea,ou=groups,dc=example,dc=com"
+		everyone = "cn=everyone,ou=groups,dc=example,dc=com"
+		service  = "cn=service,dc=example,dc=com"
+	)
+	fd := &fakeDirectory{
+		entries: map[string]map[string][]string{
+			userDN: {"uid": {"alice"}, "displayName": {"Alice Johnson"}, "mail": {"Alice@Example.com"},
+				"memberOf": {sales}},
+			sales:    {"memberOf": {emea}},
+			emea:     {"memberOf": {everyone, sales}},
+			everyone: {},
+		},
+		passwords: map[string]string{userDN: "secret", service: "service-secret"},
+	}
+	conf, _ := json.Marshal(map[string]any{
+		"url":            fd.serve(t),
+		"bind_dn":        service,
+		"bind_password":  "service-secret",
+		"base_dn":        "dc=example,dc=com",
+		"name_attribute": "displayName",
+		"tag_attributes": map[string]string{"email": "mail"},
+		"group_tags": map[string]string{
+			"CN=EMEA,OU=Groups,DC=example,DC=com": "region:emea",
+			sales:                                 "dept:sales",
+		},
+		"nested_groups": true,
+	})
+	la := &authenticator{}
+	if err := la.Init(conf, "ldap"); err != nil {
+		t.Fatal(err)
+	}
+
+	login, e, groups, err := la.verify([]byte("Alice:secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login != "alice" || e.dn != userDN {
+		t.Error("wrong user", login, e.dn)
+	}
+	if !slices.Equal(groups, []string{sales, emea, everyone}) {
+		t.Error("wrong groups", groups)
+	}
+	if tags := la.tags(e, groups); !slices.Equal(tags, []string{"dept:sales", "email:alice@example.com", "region:emea"}) {
+		t.Error("wrong tags", tags)
+	}
+	if pub, _ := la.public(map[string]any{"fn": "Alice", "note": "x"}, e).(map[string]any); pub["fn"] != "Alice Johnson" ||
+		pub["note"] != "x" {
+		t.Error("wrong public", pub)
+	}
+
+	for secret, expected := range map[string]error{
+		"alice:wrong":    types.ErrFailed,
+		"alice:":         types.ErrMalformed,
+		"bob:secret":     types.ErrFailed,
+		"*:secret":       types.ErrFailed,
+		"no-password":    types.ErrMalformed,
+		"ALICE :wrong  ": types.ErrFailed,
+	} {
+		if _, _, _, err := la.verify([]byte(secret)); err != expected {
+			t.Errorf("%s: expected %v, got %v", secret, expected, err)
+		}
+	}
+
+	// Pooled connections are reused.
+	if len(la.pool.idle) != 1 {
+		t.Error("expected one idle connection, got", len(la.pool.idle))
+	}
+}
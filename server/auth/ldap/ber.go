@@ -0,0 +1,184 @@
+package ldap
+
+import (
+	"errors"
+	"io"
+)
+
+// Minimal BER (X.690) encoder and decoder sufficient for LDAPv3 messages (RFC 4511).
+// Only definite lengths and single-byte tags are supported.
+
+// Tag classes and the constructed flag.
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+)
+
+// Universal tags.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10 | constructed
+	tagSet         = 0x11 | constructed
+)
+
+// Maximum size of a message received from the server.
+const maxMessageSize = 16 << 20
+
+var errBER = errors.New("invalid or unsupported BER")
+
+// berTLV encodes an element with the tag and the content.
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n <= 0xff:
+		out = append(out, 0x81, byte(n))
+	case n <= 0xffff:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+// berSeq encodes a constructed element from encoded children.
+func berSeq(tag byte, children ...[]byte) []byte {
+	var content []byte
+	for _, c := range children {
+		content = append(content, c...)
+	}
+	return berTLV(tag, content)
+}
+
+func berInt(tag byte, v int64) []byte {
+	// Minimal two's complement big-endian encoding.
+	var content []byte
+	for {
+		content = append([]byte{byte(v)}, content...)
+		if (v < 0x80 && v >= -0x80) || len(content) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berTLV(tag, content)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berBool(tag byte, b bool) []byte {
+	if b {
+		return berTLV(tag, []byte{0xff})
+	}
+	return berTLV(tag, []byte{0})
+}
+
+// berElem is a decoded element: the tag and the content.
+type berElem struct {
+	tag     byte
+	content []byte
+}
+
+// berDecode decodes one element. Returns the element and the remaining bytes.
+func berDecode(data []byte) (berElem, []byte, error) {
+	if len(data) < 2 || data[0]&0x1f == 0x1f {
+		return berElem{}, nil, errBER
+	}
+	tag := data[0]
+	n, hdr, err := berLength(data[1:])
+	if err != nil || n > len(data)-1-hdr {
+		return berElem{}, nil, errBER
+	}
+	start := 1 + hdr
+	return berElem{tag: tag, content: data[start : start+n]}, data[start+n:], nil
+}
+
+// berLength decodes the length. Returns the length and the number of bytes it takes.
+func berLength(data []byte) (int, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errBER
+	}
+	if data[0] < 0x80 {
+		return int(data[0]), 1, nil
+	}
+	count := int(data[0] & 0x7f)
+	if count == 0 || count > 4 || len(data) < 1+count {
+		// Indefinite or too long.
+		return 0, 0, errBER
+	}
+	n := 0
+	for _, b := range data[1 : 1+count] {
+		n = n<<8 | int(b)
+	}
+	if n < 0 || n > maxMessageSize {
+		return 0, 0, errBER
+	}
+	return n, 1 + count, nil
+}
+
+// children decodes the content of a constructed element.
+func (e berElem) children() ([]berElem, error) {
+	if e.tag&constructed == 0 {
+		return nil, errBER
+	}
+	var out []berElem
+	data := e.content
+	for len(data) > 0 {
+		var child berElem
+		var err error
+		if child, data, err = berDecode(data); err != nil {
+			return nil, err
+		}
+		out = append(out, child)
+	}
+	return out, nil
+}
+
+// int decodes the content as an integer.
+func (e berElem) int() (int64, error) {
+	if len(e.content) == 0 || len(e.content) > 8 {
+		return 0, errBER
+	}
+	// Sign extension.
+	v := int64(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+// berReadMessage reads one complete element from the stream.
+func berReadMessage(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[1]&0x80 != 0 {
+		count := int(hdr[1] & 0x7f)
+		if count == 0 || count > 4 {
+			return nil, errBER
+		}
+		hdr = hdr[:2+count]
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+			return nil, err
+		}
+	}
+	n, _, err := berLength(hdr[1:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, len(hdr)+n)
+	copy(msg, hdr)
+	if _, err := io.ReadFull(r, msg[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
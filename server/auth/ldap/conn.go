@@ -0,0 +1,397 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Minimal synchronous LDAPv3 client (RFC 4511): simple bind, search and StartTLS.
+
+// Protocol operations.
+const (
+	opBindRequest      = classApplication | constructed | 0
+	opBindResponse     = classApplication | constructed | 1
+	opUnbindRequest    = classApplication | 2
+	opSearchRequest    = classApplication | constructed | 3
+	opSearchEntry      = classApplication | constructed | 4
+	opSearchDone       = classApplication | constructed | 5
+	opSearchReference  = classApplication | constructed | 19
+	opExtendedRequest  = classApplication | constructed | 23
+	opExtendedResponse = classApplication | constructed | 24
+)
+
+// Search scopes.
+const (
+	scopeBase    = 0
+	scopeSubtree = 2
+)
+
+// Result codes.
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+)
+
+const (
+	oidStartTLS      = "1.3.6.1.4.1.1466.20037"
+	defaultPortLDAP  = "389"
+	defaultPortLDAPS = "636"
+	// Maximum number of entries returned by one search.
+	maxSearchEntries = 1000
+	// Maximum length of the diagnostic message of the server kept in errors.
+	maxDiagnosticMessage = 256
+)
+
+// resultError is an error returned by the server.
+type resultError struct {
+	code    int64
+	message string
+}
+
+func (e *resultError) Error() string {
+	msg := "ldap: result code " + strconv.FormatInt(e.code, 10)
+	if e.message != "" {
+		msg += ": " + e.message
+	}
+	return msg
+}
+
+// isResult checks if the error is the server's response with the given result code.
+func isResult(err error, code int64) bool {
+	var re *resultError
+	return errors.As(err, &re) && re.code == code
+}
+
+// entry is a search result.
+type entry struct {
+	dn string
+	// Attribute values by lowercase attribute names.
+	attrs map[string][][]byte
+}
+
+// value returns the first value of the attribute.
+func (e *entry) value(attr string) string {
+	if vals := e.attrs[strings.ToLower(attr)]; len(vals) > 0 {
+		return string(vals[0])
+	}
+	return ""
+}
+
+// values returns all values of the attribute as strings.
+func (e *entry) values(attr string) []string {
+	var out []string
+	for _, v := range e.attrs[strings.ToLower(attr)] {
+		out = append(out, string(v))
+	}
+	return out
+}
+
+// conn is a connection to the directory server.
+type conn struct {
+	nc      net.Conn
+	msgID   int64
+	timeout time.Duration
+}
+
+// dialConfig is the configuration of connections.
+type dialConfig struct {
+	url       *url.URL
+	startTLS  bool
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// dial connects to the server, upgrading the connection to TLS if configured.
+func dial(cfg *dialConfig) (*conn, error) {
+	host := cfg.url.Host
+	secure := cfg.url.Scheme == "ldaps"
+	if cfg.url.Port() == "" {
+		if secure {
+			host = net.JoinHostPort(cfg.url.Hostname(), defaultPortLDAPS)
+		} else {
+			host = net.JoinHostPort(cfg.url.Hostname(), defaultPortLDAP)
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.timeout}
+	var nc net.Conn
+	var err error
+	if secure {
+		nc, err = tls.DialWithDialer(dialer, "tcp", host, cfg.tlsConfig)
+	} else {
+		nc, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{nc: nc, timeout: cfg.timeout}
+
+	if !secure && cfg.startTLS {
+		if err := c.startTLS(cfg.tlsConfig); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// startTLS sends StartTLS extended request and performs the TLS handshake.
+func (c *conn) startTLS(config *tls.Config) error {
+	resp, err := c.roundTrip(berSeq(opExtendedRequest, berString(classContext|0, oidStartTLS)), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err = checkResult(resp); err != nil {
+		return err
+	}
+	tc := tls.Client(c.nc, config)
+	tc.SetDeadline(time.Now().Add(c.timeout))
+	if err = tc.Handshake(); err != nil {
+		return err
+	}
+	c.nc = tc
+	return nil
+}
+
+// bind authenticates the connection with the DN and the password.
+func (c *conn) bind(dn, password string) error {
+	resp, err := c.roundTrip(berSeq(opBindRequest,
+		berInt(tagInteger, 3),
+		berString(tagOctetString, dn),
+		berString(classContext|0, password)), opBindResponse)
+	if err != nil {
+		return err
+	}
+	return checkResult(resp)
+}
+
+// search performs a search and returns the found entries.
+func (c *conn) search(base string, scope int, filter string, attrs []string, sizeLimit int) ([]*entry, error) {
+	compiled, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList [][]byte
+	for _, a := range attrs {
+		attrList = append(attrList, berString(tagOctetString, a))
+	}
+	if len(attrList) == 0 {
+		// Request no attributes.
+		attrList = append(attrList, berString(tagOctetString, "1.1"))
+	}
+	req := berSeq(opSearchRequest,
+		berString(tagOctetString, base),
+		berInt(tagEnumerated, int64(scope)),
+		// Never dereference aliases.
+		berInt(tagEnumerated, 0),
+		berInt(tagInteger, int64(sizeLimit)),
+		berInt(tagInteger, int64(c.timeout/time.Second)),
+		berBool(tagBoolean, false),
+		compiled,
+		berSeq(tagSequence, attrList...))
+
+	id, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case opSearchEntry:
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) >= maxSearchEntries {
+				return nil, errors.New("ldap: too many search results")
+			}
+			entries = append(entries, e)
+		case opSearchReference:
+			// Referrals are not followed.
+		case opSearchDone:
+			if err := checkResult(op); err != nil && !isResult(err, resultSizeLimitExceeded) {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, errBER
+		}
+	}
+}
+
+// close sends unbind request and closes the connection.
+func (c *conn) close() {
+	c.send(berTLV(opUnbindRequest, nil))
+	c.nc.Close()
+}
+
+// roundTrip sends the request and receives the response of the expected type.
+func (c *conn) roundTrip(req []byte, respTag byte) (berElem, error) {
+	id, err := c.send(req)
+	if err != nil {
+		return berElem{}, err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return berElem{}, err
+	}
+	if op.tag != respTag {
+		return berElem{}, errBER
+	}
+	return op, nil
+}
+
+// send sends the protocol operation. Returns the message ID.
+func (c *conn) send(op []byte) (int64, error) {
+	c.msgID++
+	msg := berSeq(tagSequence, berInt(tagInteger, c.msgID), op)
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.nc.Write(msg); err != nil {
+		return 0, err
+	}
+	return c.msgID, nil
+}
+
+// receive reads the next message and returns its protocol operation.
+func (c *conn) receive(id int64) (berElem, error) {
+	c.nc.SetDeadline(time.Now().Add(c.timeout))
+	data, err := berReadMessage(c.nc)
+	if err != nil {
+		return berElem{}, err
+	}
+	msg, _, err := berDecode(data)
+	if err != nil || msg.tag != tagSequence {
+		return berElem{}, errBER
+	}
+	parts, err := msg.children()
+	if err != nil || len(parts) < 2 {
+		return berElem{}, errBER
+	}
+	if msgID, err := parts[0].int(); err != nil || msgID != id {
+		// Unsolicited notifications, such as notice of disconnection, are not supported.
+		return berElem{}, errBER
+	}
+	return parts[1], nil
+}
+
+// checkResult returns an error if the LDAPResult is not a success.
+func checkResult(op berElem) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 || parts[0].tag != tagEnumerated {
+		return errBER
+	}
+	code, err := parts[0].int()
+	if err != nil {
+		return errBER
+	}
+	if code == resultSuccess {
+		return nil
+	}
+	msg := parts[2].content
+	if len(msg) > maxDiagnosticMessage {
+		msg = msg[:maxDiagnosticMessage]
+	}
+	return &resultError{code: code, message: string(msg)}
+}
+
+// parseEntry parses SearchResultEntry.
+func parseEntry(op berElem) (*entry, error) {
+	parts, err := op.children()
+	if err != nil || len(parts) != 2 {
+		return nil, errBER
+	}
+	e := &entry{dn: string(parts[0].content), attrs: make(map[string][][]byte)}
+	attrs, err := parts[1].children()
+	if err != nil {
+		return nil, errBER
+	}
+	for _, a := range attrs {
+		av, err := a.children()
+		if err != nil || len(av) != 2 {
+			return nil, errBER
+		}
+		vals, err := av[1].children()
+		if err != nil {
+			return nil, errBER
+		}
+		name := strings.ToLower(string(av[0].content))
+		for _, v := range vals {
+			e.attrs[name] = append(e.attrs[name], v.content)
+		}
+	}
+	return e, nil
+}
+
+// pool keeps idle connections bound as the service account.
+type pool struct {
+	idle         chan *conn
+	cfg          *dialConfig
+	bindDN       string
+	bindPassword string
+}
+
+func newPool(cfg *dialConfig, size int, bindDN, bindPassword string) *pool {
+	return &pool{idle: make(chan *conn, size), cfg: cfg, bindDN: bindDN, bindPassword: bindPassword}
+}
+
+// get returns an idle connection or opens a new one. Returns true if the connection is new.
+func (p *pool) get() (*conn, bool, error) {
+	select {
+	case c := <-p.idle:
+		return c, false, nil
+	default:
+	}
+	c, err := dial(p.cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.bindDN != "" {
+		if err = c.bind(p.bindDN, p.bindPassword); err != nil {
+			c.close()
+			return nil, false, err
+		}
+	}
+	return c, true, nil
+}
+
+// put returns the connection to the pool or closes it if the pool is full.
+func (p *pool) put(c *conn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+// do calls fn with a pooled connection. If an idle connection turns out to be broken, e.g. closed by
+// the server, fn is retried once with a new connection.
+func (p *pool) do(fn func(c *conn) error) error {
+	for {
+		c, fresh, err := p.get()
+		if err != nil {
+			return err
+		}
+		err = fn(c)
+		var re *resultError
+		if err == nil || errors.As(err, &re) || err == errFilter {
+			p.put(c)
+			return err
+		}
+		c.nc.Close()
+		if fresh {
+			return err
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Compiler of search filters in the string form (RFC 4515) to BER.
+
+// Maximum nesting level of filters.
+const filterMaxDepth = 16
+
+var errFilter = errors.New("invalid search filter")
+
+// Filter choices (RFC 4511, section 4.5.1.7).
+const (
+	filterAnd            = classContext | constructed | 0
+	filterOr             = classContext | constructed | 1
+	filterNot            = classContext | constructed | 2
+	filterEqualityMatch  = classContext | constructed | 3
+	filterSubstrings     = classContext | constructed | 4
+	filterGreaterOrEqual = classContext | constructed | 5
+	filterLessOrEqual    = classContext | constructed | 6
+	filterPresent        = classContext | 7
+	filterApproxMatch    = classContext | constructed | 8
+	filterExtensible     = classContext | constructed | 9
+)
+
+// compileFilter converts the filter to BER.
+func compileFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	out, rest, err := compileItem(filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errFilter
+	}
+	return out, nil
+}
+
+// compileItem compiles one parenthesized filter. Returns the encoded filter and the remaining string.
+func compileItem(s string, depth int) ([]byte, string, error) {
+	if depth > filterMaxDepth || len(s) < 3 || s[0] != '(' {
+		return nil, "", errFilter
+	}
+	s = s[1:]
+
+	switch s[0] {
+	case '&', '|', '!':
+		op := s[0]
+		s = s[1:]
+		var items [][]byte
+		for len(s) > 0 && s[0] == '(' {
+			item, rest, err := compileItem(s, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			items = append(items, item)
+			s = rest
+		}
+		if len(s) == 0 || s[0] != ')' || len(items) == 0 {
+			return nil, "", errFilter
+		}
+		switch op {
+		case '&':
+			return berSeq(filterAnd, items...), s[1:], nil
+		case '|':
+			return berSeq(filterOr, items...), s[1:], nil
+		}
+		if len(items) != 1 {
+			return nil, "", errFilter
+		}
+		return berSeq(filterNot, items[0]), s[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errFilter
+	}
+	item, err := compileSimple(s[:end])
+	return item, s[end+1:], err
+}
+
+// compileSimple compiles a filter which is not a combination of other filters.
+func compileSimple(s string) ([]byte, error) {
+	eq := strings.IndexByte(s, '=')
+	if eq < 1 {
+		return nil, errFilter
+	}
+	attr, value := s[:eq], s[eq+1:]
+
+	switch attr[len(attr)-1] {
+	case '>':
+		return compileAssertion(filterGreaterOrEqual, attr[:len(attr)-1], value)
+	case '<':
+		return compileAssertion(filterLessOrEqual, attr[:len(attr)-1], value)
+	case '~':
+		return compileAssertion(filterApproxMatch, attr[:len(attr)-1], value)
+	case ':':
+		return compileExtensible(attr[:len(attr)-1], value)
+	}
+	if !validAttr(attr) {
+		return nil, errFilter
+	}
+
+	if value == "*" {
+		return berString(filterPresent, attr), nil
+	}
+	if !strings.Contains(value, "*") {
+		return compileAssertion(filterEqualityMatch, attr, value)
+	}
+
+	// Substrings: initial*any*...*final.
+	parts := strings.Split(value, "*")
+	var subs [][]byte
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		v, err := unescapeValue(part)
+		if err != nil {
+			return nil, err
+		}
+		switch i {
+		case 0:
+			subs = append(subs, berString(classContext|0, v))
+		case len(parts) - 1:
+			subs = append(subs, berString(classContext|2, v))
+		default:
+			subs = append(subs, berString(classContext|1, v))
+		}
+	}
+	return berSeq(filterSubstrings, berString(tagOctetString, attr), berSeq(tagSequence, subs...)), nil
+}
+
+func compileAssertion(tag byte, attr, value string) ([]byte, error) {
+	if !validAttr(attr) {
+		return nil, errFilter
+	}
+	v, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return berSeq(tag, berString(tagOctetString, attr), berString(tagOctetString, v)), nil
+}
+
+// compileExtensible compiles attr[:dn][:rule]:=value.
+func compileExtensible(spec, value string) ([]byte, error) {
+	parts := strings.Split(spec, ":")
+	attr := parts[0]
+	var rule string
+	var dnAttrs bool
+	for _, p := range parts[1:] {
+		switch {
+		case strings.EqualFold(p, "dn"):
+			dnAttrs = true
+		case p != "" && rule == "":
+			rule = p
+		default:
+			return nil, errFilter
+		}
+	}
+	if (attr == "" && rule == "") || (attr != "" && !validAttr(attr)) {
+		return nil, errFilter
+	}
+	v, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var items [][]byte
+	if rule != "" {
+		items = append(items, berString(classContext|1, rule))
+	}
+	if attr != "" {
+		items = append(items, berString(classContext|2, attr))
+	}
+	items = append(items, berString(classContext|3, v))
+	if dnAttrs {
+		items = append(items, berBool(classContext|4, true))
+	}
+	return berSeq(filterExtensible, items...), nil
+}
+
+// validAttr checks the attribute description: a name or an OID with optional options.
+func validAttr(attr string) bool {
+	if attr == "" {
+		return false
+	}
+	for _, r := range attr {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == ';') {
+			return false
+		}
+	}
+	return true
+}
+
+// unescapeValue replaces \XX escapes with bytes.
+func unescapeValue(s string) (string, error) {
+	if strings.ContainsAny(s, "()*") {
+		return "", errFilter
+	}
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", errFilter
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", errFilter
+		}
+		sb.WriteByte(b[0])
+		i += 2
+	}
+	return sb.String(), nil
+}
+
+// escapeFilter escapes the value to be inserted into a filter.
+func escapeFilter(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			sb.WriteString(`\` + hex.EncodeToString([]byte{c}))
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
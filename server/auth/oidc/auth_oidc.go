@@ -0,0 +1,580 @@
+// Package oidc implements authentication by OpenID Connect ID tokens issued by external identity
+// providers such as Google, Azure AD or Keycloak.
+//
+// The client obtains the ID token from the provider and sends it as the secret of {login scheme="oidc"}.
+// The token is verified with the provider's signing keys (JWKS) which are discovered from the issuer's
+// metadata and cached. The account linked to the identity is logged in. If there is no such account,
+// it's created automatically when enabled by the config. The token can be also used to create an account
+// with {acc scheme="oidc"} or to link the identity to an existing account.
+//
+// If the email verified by the provider is a credential of another account, the identity is not linked
+// and no account is created for it: the user must log in to that account and link the identity to it.
+package oidc
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	// Path of the provider's metadata relative to the issuer URL.
+	discoveryPath = "/.well-known/openid-configuration"
+	// Maximum size of the metadata and JWKS documents.
+	maxResponseSize = 1 << 20
+	// Keys are not re-fetched more often than this when a token is signed by an unknown key.
+	minRefreshInterval = time.Minute
+	// Maximum length of a tag created from a claim.
+	maxTagLength = 96
+
+	defaultJWKSTTL = 3600
+	defaultLeeway  = 60
+)
+
+// Signature algorithms accepted in ID tokens.
+var signatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512, jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// provider is an identity provider.
+type provider struct {
+	// Short name of the provider used in authentication records.
+	name      string
+	issuer    string
+	clientIDs []string
+	jwksURL   string
+	nameClaim string
+	// Mapping of tag namespaces to claims.
+	tagClaims map[string]string
+
+	lock      sync.Mutex
+	keys      map[string]*jose.JSONWebKey
+	fetchedAt time.Time
+}
+
+// idClaims are the claims of the ID token used by the authenticator.
+type idClaims struct {
+	jwt.Claims
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"`
+	// All claims, for mapping to name and tags.
+	all map[string]any
+}
+
+// authenticator is the type to map authentication methods to.
+type authenticator struct {
+	name       string
+	providers  []*provider
+	autoCreate bool
+	defAuth    types.AccessMode
+	defAnon    types.AccessMode
+	jwksTTL    time.Duration
+	leeway     time.Duration
+	maxAge     time.Duration
+	client     *http.Client
+}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (oa *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_oidc: authenticator name cannot be blank")
+	}
+
+	if oa.name != "" {
+		return errors.New("auth_oidc: already initialized as " + oa.name + "; " + name)
+	}
+
+	type providerConfig struct {
+		// Short name of the provider, e.g. "google". Must not be changed once users have logged in.
+		Name string `json:"name"`
+		// Issuer identifier, e.g. "https://accounts.google.com".
+		Issuer string `json:"issuer"`
+		// Client IDs of the apps registered with the provider. Tokens must be issued to one of them.
+		ClientIDs []string `json:"client_ids"`
+		// Optional URL of the JWKS. Discovered from the issuer's metadata if missing.
+		JWKSURL string `json:"jwks_url"`
+		// Claim with the full name of the user, "name" by default.
+		NameClaim string `json:"name_claim"`
+		// Mapping of tag namespaces to claims, e.g. {"email": "email"}.
+		TagClaims map[string]string `json:"tag_claims"`
+	}
+	type configType struct {
+		Providers []providerConfig `json:"providers"`
+		// Create accounts for unknown users on the first login.
+		AutoCreate bool `json:"auto_create"`
+		// Default access mode of the created accounts.
+		DefaultAccess struct {
+			Auth string `json:"auth"`
+			Anon string `json:"anon"`
+		} `json:"default_access"`
+		// How long the signing keys are cached, seconds.
+		JWKSTTL int `json:"jwks_ttl"`
+		// Allowed clock skew, seconds.
+		Leeway int `json:"leeway"`
+		// Maximum age of the token since it was issued, seconds. Not limited if 0.
+		MaxAge int `json:"max_age"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_oidc: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if len(config.Providers) == 0 {
+		return errors.New("auth_oidc: no providers configured")
+	}
+	for _, pc := range config.Providers {
+		if pc.Name == "" || strings.ContainsAny(pc.Name, ":/") || pc.Issuer == "" || len(pc.ClientIDs) == 0 {
+			return errors.New("auth_oidc: provider must have a valid name, issuer and client_ids")
+		}
+		for _, p := range oa.providers {
+			if p.name == pc.Name || p.issuer == pc.Issuer {
+				return errors.New("auth_oidc: duplicate provider '" + pc.Name + "'")
+			}
+		}
+		if pc.NameClaim == "" {
+			pc.NameClaim = "name"
+		}
+		for ns := range pc.TagClaims {
+			if ns == "" || strings.Contains(ns, ":") {
+				return errors.New("auth_oidc: invalid tag namespace '" + ns + "'")
+			}
+		}
+		oa.providers = append(oa.providers, &provider{
+			name:      pc.Name,
+			issuer:    pc.Issuer,
+			clientIDs: pc.ClientIDs,
+			jwksURL:   pc.JWKSURL,
+			nameClaim: pc.NameClaim,
+			tagClaims: pc.TagClaims,
+		})
+	}
+
+	if config.DefaultAccess.Auth == "" {
+		config.DefaultAccess.Auth = "JRWPAS"
+	}
+	if config.DefaultAccess.Anon == "" {
+		config.DefaultAccess.Anon = "N"
+	}
+	if err := oa.defAuth.UnmarshalText([]byte(config.DefaultAccess.Auth)); err != nil {
+		return errors.New("auth_oidc: invalid default_access: " + err.Error())
+	}
+	if err := oa.defAnon.UnmarshalText([]byte(config.DefaultAccess.Anon)); err != nil {
+		return errors.New("auth_oidc: invalid default_access: " + err.Error())
+	}
+	if config.JWKSTTL < 0 || config.Leeway < 0 || config.MaxAge < 0 {
+		return errors.New("auth_oidc: invalid config value")
+	}
+	oa.jwksTTL = time.Duration(config.JWKSTTL) * time.Second
+	if oa.jwksTTL == 0 {
+		oa.jwksTTL = defaultJWKSTTL * time.Second
+	}
+	oa.leeway = time.Duration(config.Leeway) * time.Second
+	if oa.leeway == 0 {
+		oa.leeway = defaultLeeway * time.Second
+	}
+	oa.maxAge = time.Duration(config.MaxAge) * time.Second
+	oa.autoCreate = config.AutoCreate
+	oa.client = &http.Client{Timeout: 10 * time.Second}
+	oa.name = name
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (oa *authenticator) IsInitialized() bool {
+	return oa.name != ""
+}
+
+// AddRecord links the identity from the ID token to a new account.
+func (oa *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	prov, claims, err := oa.verify(string(secret))
+	if err != nil {
+		return nil, err
+	}
+	if err = checkConflict(claims, rec.Uid); err != nil {
+		return nil, err
+	}
+
+	authLevel := rec.AuthLevel
+	if authLevel == auth.LevelNone {
+		authLevel = auth.LevelAuth
+	}
+	err = store.Users.AddAuthRecord(rec.Uid, authLevel, oa.name, prov.identity(claims), []byte(prov.issuer), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	rec.AuthLevel = authLevel
+	rec.Tags = append(rec.Tags, prov.tags(claims)...)
+	return rec, nil
+}
+
+// UpdateRecord links the identity from the ID token to the existing account replacing the previously
+// linked identity, if any.
+func (oa *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	prov, claims, err := oa.verify(string(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	identity := prov.identity(claims)
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(oa.name, identity)
+	if err != nil {
+		return nil, err
+	}
+	if !uid.IsZero() {
+		if uid != rec.Uid {
+			// The identity is linked to another account.
+			return nil, types.ErrDuplicate
+		}
+		return rec, nil
+	}
+	if err = checkConflict(claims, rec.Uid); err != nil {
+		return nil, err
+	}
+
+	_, authLevel, _, _, err := store.Users.GetAuthRecord(rec.Uid, oa.name)
+	if err == types.ErrNotFound {
+		err = store.Users.AddAuthRecord(rec.Uid, auth.LevelAuth, oa.name, identity, []byte(prov.issuer), time.Time{})
+	} else if err == nil {
+		err = store.Users.UpdateAuthRecord(rec.Uid, authLevel, oa.name, identity, []byte(prov.issuer), time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range prov.tags(claims) {
+		if !slices.Contains(rec.Tags, tag) {
+			rec.Tags = append(rec.Tags, tag)
+		}
+	}
+	return rec, nil
+}
+
+// Authenticate verifies the ID token and finds the account linked to the identity. If there is no such
+// account and automatic account creation is enabled, creates a new account.
+func (oa *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	prov, claims, err := oa.verify(string(secret))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identity := prov.identity(claims)
+	uid, authLvl, _, _, err := store.Users.GetAuthUniqueRecord(oa.name, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !uid.IsZero() {
+		return &auth.Rec{
+			Uid:       uid,
+			AuthLevel: authLvl,
+			State:     types.StateUndefined}, nil, nil
+	}
+
+	if !oa.autoCreate {
+		return nil, nil, types.ErrFailed
+	}
+	if err = checkConflict(claims, types.ZeroUid); err != nil {
+		logs.Info.Println("oidc_auth: account not created for", identity, err)
+		return nil, nil, err
+	}
+
+	// Create a new account.
+	user := types.User{
+		Public: prov.public(claims),
+		Tags:   prov.tags(claims),
+	}
+	user.Access.Auth = oa.defAuth
+	user.Access.Anon = oa.defAnon
+	if _, err = store.Users.Create(&user, nil); err != nil {
+		return nil, nil, err
+	}
+	err = store.Users.AddAuthRecord(user.Uid(), auth.LevelAuth, oa.name, identity, []byte(prov.issuer), time.Time{})
+	if err != nil {
+		// Attempt to delete incomplete user record.
+		if err := store.Users.Delete(user.Uid(), true); err != nil {
+			logs.Warn.Println("oidc_auth: failed to delete incomplete user record", err)
+		}
+		return nil, nil, err
+	}
+	logs.Info.Println("oidc_auth: created account", user.Uid().UserId(), "for", identity)
+
+	return &auth.Rec{
+		Uid:       user.Uid(),
+		AuthLevel: auth.LevelAuth,
+		Tags:      user.Tags,
+		State:     types.StateOK}, nil, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique checks that the ID token is valid and the identity is not linked to any account yet.
+func (oa *authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	prov, claims, err := oa.verify(string(secret))
+	if err != nil {
+		return false, err
+	}
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(oa.name, prov.identity(claims))
+	if err != nil {
+		return false, err
+	}
+	if !uid.IsZero() {
+		return false, types.ErrDuplicate
+	}
+	return true, nil
+}
+
+// GenSecret is not supported, will produce an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes the link between the user and the identity.
+func (oa *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, oa.name)
+}
+
+// RestrictedTags returns tag namespaces populated from the claims.
+func (oa *authenticator) RestrictedTags() ([]string, error) {
+	var tags []string
+	for _, p := range oa.providers {
+		for ns := range p.tagClaims {
+			if !slices.Contains(tags, ns) {
+				tags = append(tags, ns)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for OIDC).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// verify checks the signature and the claims of the ID token. Returns the provider which issued it
+// and the claims.
+func (oa *authenticator) verify(token string) (*provider, *idClaims, error) {
+	tok, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil || len(tok.Headers) != 1 {
+		return nil, nil, types.ErrMalformed
+	}
+
+	// Find the provider by the issuer before the signature is checked.
+	var unverified jwt.Claims
+	if err = tok.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	idx := slices.IndexFunc(oa.providers, func(p *provider) bool { return p.issuer == unverified.Issuer })
+	if idx < 0 {
+		return nil, nil, types.ErrFailed
+	}
+	prov := oa.providers[idx]
+
+	key, err := oa.signingKey(prov, tok.Headers[0].KeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims := &idClaims{}
+	if err = tok.Claims(key.Key, claims, &claims.all); err != nil {
+		return nil, nil, types.ErrFailed
+	}
+
+	now := time.Now()
+	if claims.Expiry == nil || claims.Subject == "" {
+		return nil, nil, types.ErrMalformed
+	}
+	if err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      prov.issuer,
+		AnyAudience: prov.clientIDs,
+		Time:        now,
+	}, oa.leeway); err != nil {
+		if errors.Is(err, jwt.ErrExpired) {
+			return nil, nil, types.ErrExpired
+		}
+		return nil, nil, types.ErrFailed
+	}
+	if oa.maxAge > 0 && (claims.IssuedAt == nil || claims.IssuedAt.Time().Add(oa.maxAge+oa.leeway).Before(now)) {
+		return nil, nil, types.ErrExpired
+	}
+
+	return prov, claims, nil
+}
+
+// signingKey returns the provider's key with the given ID. Keys are fetched if they are not cached,
+// expired, or the key is not found.
+func (oa *authenticator) signingKey(prov *provider, kid string) (*jose.JSONWebKey, error) {
+	prov.lock.Lock()
+	defer prov.lock.Unlock()
+
+	now := time.Now()
+	key := prov.keys[kid]
+	if key != nil && prov.fetchedAt.Add(oa.jwksTTL).After(now) {
+		return key, nil
+	}
+	if key == nil && prov.fetchedAt.Add(minRefreshInterval).After(now) {
+		// Keys were refreshed recently, the key is unknown.
+		return nil, types.ErrFailed
+	}
+
+	keys, err := oa.fetchKeys(prov)
+	if err != nil {
+		logs.Warn.Println("oidc_auth: failed to fetch keys of", prov.name, err)
+		if key != nil {
+			// Use the stale key while the provider is unavailable.
+			return key, nil
+		}
+		return nil, types.ErrInternal
+	}
+	prov.keys = keys
+	prov.fetchedAt = now
+
+	if key = prov.keys[kid]; key == nil {
+		return nil, types.ErrFailed
+	}
+	return key, nil
+}
+
+// fetchKeys downloads the provider's signing keys. The URL of the key set is discovered from the
+// issuer's metadata unless it's configured.
+func (oa *authenticator) fetchKeys(prov *provider) (map[string]*jose.JSONWebKey, error) {
+	jwksURL := prov.jwksURL
+	if jwksURL == "" {
+		var meta struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := oa.getJSON(strings.TrimSuffix(prov.issuer, "/")+discoveryPath, &meta); err != nil {
+			return nil, err
+		}
+		if meta.Issuer != prov.issuer || meta.JWKSURI == "" {
+			return nil, errors.New("invalid provider metadata")
+		}
+		jwksURL = meta.JWKSURI
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := oa.getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*jose.JSONWebKey)
+	for _, raw := range set.Keys {
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(raw); err != nil {
+			// Skip keys of unsupported types.
+			continue
+		}
+		if key.IsPublic() && (key.Use == "" || key.Use == "sig") {
+			keys[key.KeyID] = &key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+// getJSON fetches a JSON document.
+func (oa *authenticator) getJSON(url string, dst any) error {
+	resp, err := oa.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status + " from " + url)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(dst)
+}
+
+// identity returns the unique identifier of the user at the provider.
+func (p *provider) identity(claims *idClaims) string {
+	return p.name + "/" + claims.Subject
+}
+
+// verifiedEmail returns the email of the user if it's verified by the provider.
+func (claims *idClaims) verifiedEmail() string {
+	if claims.EmailVerified != true && claims.EmailVerified != "true" {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(claims.Email))
+}
+
+// checkConflict returns types.ErrDuplicate if the verified email of the user is a credential of an account
+// other than uid.
+func checkConflict(claims *idClaims, uid types.Uid) error {
+	email := claims.verifiedEmail()
+	if email == "" {
+		return nil
+	}
+	owner, err := store.Users.GetByCred("email", email)
+	if err != nil {
+		return err
+	}
+	if !owner.IsZero() && owner != uid {
+		return types.ErrDuplicate
+	}
+	return nil
+}
+
+// public returns public data of a new account.
+func (p *provider) public(claims *idClaims) any {
+	if name, _ := claims.all[p.nameClaim].(string); name != "" {
+		return map[string]any{"fn": name}
+	}
+	return nil
+}
+
+// tags converts claims to tags. The email is used only if it's verified by the provider.
+func (p *provider) tags(claims *idClaims) []string {
+	var tags []string
+	for ns, claim := range p.tagClaims {
+		value, _ := claims.all[claim].(string)
+		if claim == "email" && claims.EmailVerified != true && claims.EmailVerified != "true" {
+			value = ""
+		}
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		tag := ns + ":" + value
+		if len(tag) <= maxTagLength {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+const realName = "oidc"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
@@ -0,0 +1,177 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testProvider serves the provider metadata and signing keys.
+type testProvider struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	fetches int
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   tp.server.URL,
+			"jwks_uri": tp.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		tp.fetches++
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "k1", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	tp.server = httptest.NewServer(mux)
+	t.Cleanup(tp.server.Close)
+	return tp
+}
+
+func (tp *testProvider) sign(t *testing.T, kid string, claims any) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: tp.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	tp := newTestProvider(t)
+	oa := &authenticator{}
+	conf := `{"providers": [{"name": "test", "issuer": "` + tp.server.URL + `", "client_ids": ["app"],
+		"tag_claims": {"email": "email", "dept": "department"}}]}`
+	if err := oa.Init(json.RawMessage(conf), "oidc"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            tp.server.URL,
+		"sub":            "12345",
+		"aud":            "app",
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"name":           "Alice Johnson",
+		"email":          "Alice@Example.com",
+		"email_verified": true,
+		"department":     "Sales",
+	}
+	prov, idc, err := oa.verify(tp.sign(t, "k1", claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := prov.identity(idc); id != "test/12345" {
+		t.Error("wrong identity", id)
+	}
+	if tags := prov.tags(idc); !reflect.DeepEqual(tags, []string{"dept:sales", "email:alice@example.com"}) {
+		t.Error("wrong tags", tags)
+	}
+	if pub := prov.public(idc); !reflect.DeepEqual(pub, map[string]any{"fn": "Alice Johnson"}) {
+		t.Error("wrong public", pub)
+	}
+
+	// Unverified email is not used.
+	claims["email_verified"] = false
+	if _, idc, err = oa.verify(tp.sign(t, "k1", claims)); err != nil {
+		t.Fatal(err)
+	}
+	if tags := prov.tags(idc); !reflect.DeepEqual(tags, []string{"dept:sales"}) {
+		t.Error("unverified email used", tags)
+	}
+
+	// Keys are cached.
+	if tp.fetches != 1 {
+		t.Error("keys fetched", tp.fetches, "times")
+	}
+
+	for _, tc := range []struct {
+		name  string
+		claim string
+		value any
+		kid   string
+		err   error
+	}{
+		{"wrong audience", "aud", "other", "k1", types.ErrFailed},
+		{"expired", "exp", now.Add(-time.Hour).Unix(), "k1", types.ErrExpired},
+		{"unknown issuer", "iss", "https://issuer.example.com", "k1", types.ErrFailed},
+		{"no subject", "sub", "", "k1", types.ErrMalformed},
+		{"unknown key", "", nil, "k2", types.ErrFailed},
+	} {
+		bad := map[string]any{}
+		for k, v := range claims {
+			bad[k] = v
+		}
+		if tc.claim != "" {
+			bad[tc.claim] = tc.value
+		}
+		if _, _, err := oa.verify(tp.sign(t, tc.kid, bad)); err != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// Token signed by another key.
+	other := newTestProvider(t)
+	if _, _, err := oa.verify(other.sign(t, "k1", claims)); err != types.ErrFailed {
+		t.Error("token with invalid signature accepted", err)
+	}
+	if _, _, err := oa.verify("not a token"); err != types.ErrMalformed {
+		t.Error("malformed token accepted", err)
+	}
+}
+
+func TestCheckConflict(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	users := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.Users = users
+	defer func() {
+		store.Users = nil
+		ctrl.Finish()
+	}()
+
+	alice, bob := types.Uid(1), types.Uid(2)
+	claims := &idClaims{Email: " Alice@Example.com", EmailVerified: "true"}
+	users.EXPECT().GetByCred("email", "alice@example.com").Return(alice, nil).Times(3)
+	if err := checkConflict(claims, alice); err != nil {
+		t.Error("identity of the account owner rejected:", err)
+	}
+	if err := checkConflict(claims, bob); err != types.ErrDuplicate {
+		t.Error("email of another account accepted:", err)
+	}
+	if err := checkConflict(claims, types.ZeroUid); err != types.ErrDuplicate {
+		t.Error("new account created for email of another account:", err)
+	}
+
+	// Unverified email is not checked.
+	claims.EmailVerified = false
+	if err := checkConflict(claims, bob); err != nil {
+		t.Error(err)
+	}
+}
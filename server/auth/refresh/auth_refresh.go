@@ -0,0 +1,242 @@
+// Package refresh implements authentication by long-lived refresh tokens.
+//
+// A refresh token is issued on login together with a short-lived access "token". The client
+// logs in with the refresh token to obtain a new access token once the old one expires. A refresh
+// token can be used only once: each use issues a new refresh token. Using a refresh token again
+// means it was stolen, then all refresh tokens of the user are revoked. Tokens are persisted in the
+// persistent cache so they are shared by all cluster nodes and can be revoked at any time.
+package refresh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Length of the random part of the token in bytes.
+const tokenIdLength = 24
+
+// Value of a token which has been used already.
+const usedTokenValue = "used"
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name           string
+	lifetime       time.Duration
+	accessLifetime time.Duration
+}
+
+var handler authenticator
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (ra *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_refresh: authenticator name cannot be blank")
+	}
+
+	if ra.name != "" {
+		return errors.New("auth_refresh: already initialized as " + ra.name + "; " + name)
+	}
+
+	type configType struct {
+		// Lifetime of refresh tokens in seconds.
+		ExpireIn int `json:"expire_in"`
+		// Lifetime in seconds of access tokens issued together with refresh tokens.
+		AccessExpireIn int `json:"access_expire_in"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_refresh: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.ExpireIn <= 0 {
+		return errors.New("auth_refresh: invalid expiration value")
+	}
+	if config.AccessExpireIn <= 0 || config.AccessExpireIn > config.ExpireIn {
+		return errors.New("auth_refresh: invalid access token expiration value")
+	}
+
+	ra.name = name
+	ra.lifetime = time.Duration(config.ExpireIn) * time.Second
+	ra.accessLifetime = time.Duration(config.AccessExpireIn) * time.Second
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (ra *authenticator) IsInitialized() bool {
+	return ra.name != ""
+}
+
+// AddRecord is not supported, will produce an error.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord is not supported, will produce an error.
+func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// Authenticate checks validity of the refresh token and marks it as used.
+// The token is structured as <uid>.<random id>, both parts hex-encoded.
+func (ra *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	key, uid, err := parseToken(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err := store.PCache.Get(key)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return nil, nil, err
+	}
+
+	if value == usedTokenValue {
+		// The token is reused: either the client or the attacker has a stolen copy of it.
+		logs.Warn.Println("refresh_auth: token reused, revoking all tokens of", uid.UserId(), remoteAddr)
+		if err = ra.DelRecords(uid); err != nil {
+			logs.Warn.Println("refresh_auth: failed to revoke tokens", uid.UserId(), err)
+		}
+		return nil, nil, types.ErrFailed
+	}
+
+	// issued:authLevel:features
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, nil, types.ErrInternal
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	authLvl, err := strconv.Atoi(parts[1])
+	if err != nil || auth.Level(authLvl) > auth.LevelRoot {
+		return nil, nil, types.ErrInternal
+	}
+	features, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+
+	expires := time.Unix(issued, 0).Add(ra.lifetime)
+	if !time.Now().Before(expires) {
+		if err = store.PCache.Delete(key); err != nil {
+			logs.Warn.Println("refresh_auth: error deleting key", key, err)
+		}
+		return nil, nil, types.ErrExpired
+	}
+
+	// The used token is kept until it would have expired to detect reuse. Used tokens are
+	// removed by GenSecret.
+	if err = store.PCache.Upsert(key, usedTokenValue, false); err != nil {
+		return nil, nil, err
+	}
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.Level(authLvl),
+		Lifetime:  auth.Duration(time.Until(expires)),
+		Features:  auth.Feature(features),
+		State:     types.StateUndefined}, nil, nil
+}
+
+// GenSecret generates a new refresh token.
+func (ra *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	// Run garbage collection of expired and used tokens.
+	store.PCache.Expire(realName+"_", time.Now().UTC().Add(-ra.lifetime))
+
+	if rec.Uid.IsZero() {
+		return nil, time.Time{}, types.ErrMalformed
+	}
+
+	id := make([]byte, tokenIdLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, time.Time{}, types.ErrInternal
+	}
+
+	token := auth.UidToHex(rec.Uid) + "." + hex.EncodeToString(id)
+	now := time.Now().UTC()
+	value := strconv.FormatInt(now.Unix(), 10) + ":" + strconv.Itoa(int(rec.AuthLevel)) + ":" +
+		strconv.Itoa(int(rec.Features))
+	if err := store.PCache.Upsert(keyForToken(token), value, true); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return []byte(token), now.Add(ra.lifetime).Round(time.Millisecond), nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords revokes all refresh tokens issued to the given user.
+func (authenticator) DelRecords(uid types.Uid) error {
+	// Expire all entries of the user, including those touched just now.
+	return store.PCache.Expire(realName+"_"+auth.UidToHex(uid)+".", time.Now().UTC().Add(time.Second))
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for refresh).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for refresh).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// AccessLifetime returns the lifetime of access tokens issued together with refresh tokens
+// or 0 if refresh tokens are not enabled.
+func AccessLifetime() time.Duration {
+	return handler.accessLifetime
+}
+
+// parseToken validates token format and returns the cache key and the user ID.
+func parseToken(secret []byte) (string, types.Uid, error) {
+	parts := strings.Split(string(secret), ".")
+	if len(parts) != 2 || len(parts[0]) != 16 || len(parts[1]) != tokenIdLength*2 {
+		return "", types.ZeroUid, types.ErrMalformed
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", types.ZeroUid, types.ErrMalformed
+	}
+	val, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil || val == 0 {
+		return "", types.ZeroUid, types.ErrMalformed
+	}
+	return keyForToken(string(secret)), types.Uid(val), nil
+}
+
+func keyForToken(token string) string {
+	return realName + "_" + token
+}
+
+const realName = "refresh"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &handler)
+}
@@ -0,0 +1,91 @@
+package refresh
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// memCache is an in-memory persistent cache which ignores the age of entries.
+type memCache map[string]string
+
+func (mc memCache) Get(key string) (string, error) {
+	if val, ok := mc[key]; ok {
+		return val, nil
+	}
+	return "", types.ErrNotFound
+}
+
+func (mc memCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	if _, ok := mc[key]; ok && failOnDuplicate {
+		return types.ErrDuplicate
+	}
+	mc[key] = value
+	return nil
+}
+
+func (mc memCache) Delete(key string) error {
+	delete(mc, key)
+	return nil
+}
+
+func (mc memCache) Expire(keyPrefix string, olderThan time.Time) error {
+	if olderThan.After(time.Now()) {
+		for key := range mc {
+			if strings.HasPrefix(key, keyPrefix) {
+				delete(mc, key)
+			}
+		}
+	}
+	return nil
+}
+
+func TestRotation(t *testing.T) {
+	mc := memCache{}
+	store.PCache = mc
+	defer func() { store.PCache = nil }()
+
+	conf, _ := json.Marshal(map[string]any{"expire_in": 86400, "access_expire_in": 600})
+	ra := &authenticator{}
+	if err := ra.Init(conf, "refresh"); err != nil {
+		t.Fatal(err)
+	}
+
+	uid := types.Uid(12345)
+	first, _, err := ra.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, _, err := ra.Authenticate(first, "")
+	if err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+	if rec.Uid != uid || rec.AuthLevel != auth.LevelAuth {
+		t.Error("wrong record", rec)
+	}
+	second, _, _ := ra.GenSecret(rec)
+
+	// Reuse of the first token revokes the second one.
+	if _, _, err := ra.Authenticate(first, ""); err != types.ErrFailed {
+		t.Error("used token accepted", err)
+	}
+	if _, _, err := ra.Authenticate(second, ""); err != types.ErrFailed {
+		t.Error("token not revoked", err)
+	}
+
+	if _, _, err := ra.Authenticate([]byte("0000000000003039.abc"), ""); err != types.ErrMalformed {
+		t.Error("malformed token accepted", err)
+	}
+}
@@ -0,0 +1,253 @@
+// Package resume implements fast session resumption by short-lived reconnection tokens.
+//
+// A reconnection token is issued on successful login. It expires if it's not used for `idle_timeout`
+// seconds; every use extends it by another `idle_timeout` but no longer than `max_lifetime` since
+// issue. Token state is kept in the persistent cache so it's shared by all cluster nodes and can be
+// revoked at any time. The token entry is written once and never updated, the time of the last use
+// is kept in a separate entry: a use of the token concurrent with revocation cannot restore it.
+package resume
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Length of the random part of the token in bytes.
+const tokenIdLength = 16
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name        string
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (ra *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_resume: authenticator name cannot be blank")
+	}
+
+	if ra.name != "" {
+		return errors.New("auth_resume: already initialized as " + ra.name + "; " + name)
+	}
+
+	type configType struct {
+		// Token expires if not used for this many seconds.
+		IdleTimeout int `json:"idle_timeout"`
+		// Absolute token lifetime in seconds regardless of use.
+		MaxLifetime int `json:"max_lifetime"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_resume: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.IdleTimeout <= 0 {
+		return errors.New("auth_resume: invalid idle timeout")
+	}
+	if config.MaxLifetime < config.IdleTimeout {
+		return errors.New("auth_resume: max lifetime must not be shorter than idle timeout")
+	}
+
+	ra.name = name
+	ra.idleTimeout = time.Duration(config.IdleTimeout) * time.Second
+	ra.maxLifetime = time.Duration(config.MaxLifetime) * time.Second
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (ra *authenticator) IsInitialized() bool {
+	return ra.name != ""
+}
+
+// AddRecord is not supported, will produce an error.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord is not supported, will produce an error.
+func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// Authenticate checks validity of the reconnection token and extends its expiration time.
+// The token is structured as <uid>.<random id>, both parts hex-encoded.
+func (ra *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	key, uid, err := parseToken(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	value, err := store.PCache.Get(key)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return nil, nil, err
+	}
+
+	// issued:authLevel:features
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, nil, types.ErrInternal
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	authLvl, err := strconv.Atoi(parts[1])
+	if err != nil || auth.Level(authLvl) > auth.LevelRoot {
+		return nil, nil, types.ErrInternal
+	}
+	features, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+
+	now := time.Now().UTC()
+	maxExpires := time.Unix(issued, 0).Add(ra.maxLifetime)
+	lastUsed := issued
+	if used, err := store.PCache.Get(usedKeyForToken(key)); err == nil {
+		if lastUsed, err = strconv.ParseInt(used, 10, 64); err != nil {
+			return nil, nil, types.ErrInternal
+		}
+	} else if err != types.ErrNotFound {
+		return nil, nil, err
+	}
+	if !now.Before(maxExpires) || !now.Before(time.Unix(lastUsed, 0).Add(ra.idleTimeout)) {
+		if err = store.PCache.Delete(key); err != nil && err != types.ErrNotFound {
+			logs.Warn.Println("resume_auth: error deleting key", key, err)
+		}
+		return nil, nil, types.ErrExpired
+	}
+
+	// Slide expiration. The token entry itself is not touched: if the token is revoked concurrently,
+	// only the orphaned record of use remains, to be removed by GenSecret.
+	if err = store.PCache.Upsert(usedKeyForToken(key), strconv.FormatInt(now.Unix(), 10), false); err != nil {
+		return nil, nil, err
+	}
+
+	expires := now.Add(ra.idleTimeout)
+	if expires.After(maxExpires) {
+		expires = maxExpires
+	}
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.Level(authLvl),
+		Lifetime:  auth.Duration(time.Until(expires)),
+		Features:  auth.Feature(features),
+		State:     types.StateUndefined}, nil, nil
+}
+
+// GenSecret generates a new reconnection token.
+func (ra *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	// Run garbage collection of expired tokens and records of their use.
+	now := time.Now().UTC()
+	store.PCache.Expire(realName+"_", now.Add(-ra.maxLifetime))
+	store.PCache.Expire(usedKeyPrefix, now.Add(-ra.idleTimeout))
+
+	if rec.Uid.IsZero() {
+		return nil, time.Time{}, types.ErrMalformed
+	}
+
+	id := make([]byte, tokenIdLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, time.Time{}, types.ErrInternal
+	}
+
+	token := auth.UidToHex(rec.Uid) + "." + hex.EncodeToString(id)
+	value := strconv.FormatInt(now.Unix(), 10) + ":" + strconv.Itoa(int(rec.AuthLevel)) + ":" +
+		strconv.Itoa(int(rec.Features))
+	if err := store.PCache.Upsert(keyForToken(token), value, true); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return []byte(token), now.Add(ra.idleTimeout).Round(time.Millisecond), nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords revokes all reconnection tokens issued to the given user.
+func (authenticator) DelRecords(uid types.Uid) error {
+	// Expire all entries of the user, including those touched just now.
+	return store.PCache.Expire(realName+"_"+auth.UidToHex(uid)+".", time.Now().UTC().Add(time.Second))
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for resume).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for resume).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// Revoke invalidates a single reconnection token.
+func Revoke(secret []byte) error {
+	key, _, err := parseToken(secret)
+	if err != nil {
+		return err
+	}
+	return store.PCache.Delete(key)
+}
+
+// parseToken validates token format and returns the cache key and the user ID.
+func parseToken(secret []byte) (string, types.Uid, error) {
+	parts := strings.Split(string(secret), ".")
+	if len(parts) != 2 || len(parts[0]) != 16 || len(parts[1]) != tokenIdLength*2 {
+		return "", types.ZeroUid, types.ErrMalformed
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", types.ZeroUid, types.ErrMalformed
+	}
+	val, err := strconv.ParseUint(parts[0], 16, 64)
+	if err != nil || val == 0 {
+		return "", types.ZeroUid, types.ErrMalformed
+	}
+	return keyForToken(string(secret)), types.Uid(val), nil
+}
+
+func keyForToken(token string) string {
+	return realName + "_" + token
+}
+
+// Prefix of keys of entries with the time of the last use of tokens.
+const usedKeyPrefix = realName + "-used_"
+
+func usedKeyForToken(key string) string {
+	return usedKeyPrefix + strings.TrimPrefix(key, realName+"_")
+}
+
+const realName = "resume"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
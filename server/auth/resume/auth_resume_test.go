@@ -0,0 +1,221 @@
+package resume
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// memCache is an in-memory persistent cache which ignores the age of entries.
+type memCache map[string]string
+
+func (mc memCache) Get(key string) (string, error) {
+	if val, ok := mc[key]; ok {
+		return val, nil
+	}
+	return "", types.ErrNotFound
+}
+
+func (mc memCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	if _, ok := mc[key]; ok && failOnDuplicate {
+		return types.ErrDuplicate
+	}
+	mc[key] = value
+	return nil
+}
+
+func (mc memCache) Delete(key string) error {
+	if _, ok := mc[key]; !ok {
+		return types.ErrNotFound
+	}
+	delete(mc, key)
+	return nil
+}
+
+func (mc memCache) Expire(keyPrefix string, olderThan time.Time) error {
+	if olderThan.After(time.Now()) {
+		for key := range mc {
+			if strings.HasPrefix(key, keyPrefix) {
+				delete(mc, key)
+			}
+		}
+	}
+	return nil
+}
+
+func newTestAuthenticator(t *testing.T) (*authenticator, memCache) {
+	t.Helper()
+	mc := memCache{}
+	store.PCache = mc
+	t.Cleanup(func() { store.PCache = nil })
+
+	conf, _ := json.Marshal(map[string]any{"idle_timeout": 600, "max_lifetime": 86400})
+	ra := &authenticator{}
+	if err := ra.Init(conf, "resume"); err != nil {
+		t.Fatal(err)
+	}
+	return ra, mc
+}
+
+func TestInit(t *testing.T) {
+	for _, conf := range []string{
+		`{"idle_timeout": 0, "max_lifetime": 86400}`,
+		`{"idle_timeout": 600, "max_lifetime": 60}`,
+		`{"idle_timeout": "600"}`,
+	} {
+		ra := &authenticator{}
+		if err := ra.Init(json.RawMessage(conf), "resume"); err == nil {
+			t.Errorf("invalid config accepted: %s", conf)
+		}
+	}
+
+	ra := &authenticator{}
+	if err := ra.Init(json.RawMessage(`{"idle_timeout": 600, "max_lifetime": 600}`), "resume"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ra.Init(json.RawMessage(`{"idle_timeout": 600, "max_lifetime": 600}`), "resume"); err == nil {
+		t.Error("repeated initialization accepted")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ra, mc := newTestAuthenticator(t)
+
+	uid := types.Uid(12345)
+	token, expires, err := ra.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth, Features: auth.FeatureValidated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(expires) > ra.idleTimeout+time.Second {
+		t.Error("token expires after idle timeout", expires)
+	}
+
+	rec, _, err := ra.Authenticate(token, "")
+	if err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+	if rec.Uid != uid || rec.AuthLevel != auth.LevelAuth || rec.Features != auth.FeatureValidated {
+		t.Error("wrong record", rec)
+	}
+	if lifetime := time.Duration(rec.Lifetime); lifetime <= 0 || lifetime > ra.idleTimeout {
+		t.Error("wrong lifetime", lifetime)
+	}
+	if _, err := mc.Get(usedKeyForToken(keyForToken(string(token)))); err != nil {
+		t.Error("time of use not recorded", err)
+	}
+
+	for _, bad := range []string{"", "abc", string(token[:len(token)-2]), "0000000000000000." + strings.Repeat("0", 32)} {
+		if _, _, err := ra.Authenticate([]byte(bad), ""); err != types.ErrMalformed {
+			t.Errorf("malformed token '%s': expected ErrMalformed, got %v", bad, err)
+		}
+	}
+
+	// Unknown token.
+	other := auth.UidToHex(uid) + "." + strings.Repeat("a", tokenIdLength*2)
+	if _, _, err := ra.Authenticate([]byte(other), ""); err != types.ErrFailed {
+		t.Error("unknown token: expected ErrFailed, got", err)
+	}
+}
+
+func TestAuthenticateIdle(t *testing.T) {
+	ra, mc := newTestAuthenticator(t)
+
+	uid := types.Uid(12345)
+	token, _, _ := ra.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+	key := keyForToken(string(token))
+	if _, _, err := ra.Authenticate(token, ""); err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+
+	// The token was used and remains valid for idle timeout since the use, even if it was issued earlier.
+	now := time.Now().UTC()
+	mc[key] = strconv.FormatInt(now.Add(-2*ra.idleTimeout).Unix(), 10) + ":20:0"
+	mc[usedKeyForToken(key)] = strconv.FormatInt(now.Add(-ra.idleTimeout/2).Unix(), 10)
+	if _, _, err := ra.Authenticate(token, ""); err != nil {
+		t.Fatal("recently used token rejected", err)
+	}
+
+	// Not used for longer than idle timeout.
+	mc[usedKeyForToken(key)] = strconv.FormatInt(now.Add(-ra.idleTimeout-time.Second).Unix(), 10)
+	if _, _, err := ra.Authenticate(token, ""); err != types.ErrExpired {
+		t.Fatal("idle token: expected ErrExpired, got", err)
+	}
+	if _, ok := mc[key]; ok {
+		t.Error("expired token not deleted")
+	}
+
+	// Never used and issued earlier than idle timeout, e.g. the record of use was removed by GenSecret.
+	token, _, _ = ra.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+	mc[keyForToken(string(token))] = strconv.FormatInt(now.Add(-ra.idleTimeout-time.Second).Unix(), 10) + ":20:0"
+	if _, _, err := ra.Authenticate(token, ""); err != types.ErrExpired {
+		t.Fatal("unused token: expected ErrExpired, got", err)
+	}
+}
+
+func TestAuthenticateMaxLifetime(t *testing.T) {
+	ra, mc := newTestAuthenticator(t)
+
+	token, _, _ := ra.GenSecret(&auth.Rec{Uid: types.Uid(12345), AuthLevel: auth.LevelAuth})
+	key := keyForToken(string(token))
+
+	// Issued almost max lifetime ago and used recently: valid until max lifetime only.
+	now := time.Now().UTC()
+	mc[key] = strconv.FormatInt(now.Add(-ra.maxLifetime+time.Minute).Unix(), 10) + ":20:0"
+	mc[usedKeyForToken(key)] = strconv.FormatInt(now.Unix(), 10)
+	rec, _, err := ra.Authenticate(token, "")
+	if err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+	if time.Duration(rec.Lifetime) > time.Minute {
+		t.Error("lifetime exceeds max lifetime", time.Duration(rec.Lifetime))
+	}
+
+	mc[key] = strconv.FormatInt(now.Add(-ra.maxLifetime).Unix(), 10) + ":20:0"
+	if _, _, err := ra.Authenticate(token, ""); err != types.ErrExpired {
+		t.Fatal("expected ErrExpired, got", err)
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	ra, mc := newTestAuthenticator(t)
+
+	uid := types.Uid(12345)
+	first, _, _ := ra.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+	second, _, _ := ra.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+	other, _, _ := ra.GenSecret(&auth.Rec{Uid: types.Uid(54321), AuthLevel: auth.LevelAuth})
+
+	if err := Revoke(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ra.Authenticate(first, ""); err != types.ErrFailed {
+		t.Error("revoked token: expected ErrFailed, got", err)
+	}
+	if _, _, err := ra.Authenticate(second, ""); err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+
+	if err := ra.DelRecords(uid); err != nil {
+		t.Fatal(err)
+	}
+	// The record of use written by a concurrent authentication must not restore the token.
+	mc[usedKeyForToken(keyForToken(string(second)))] = strconv.FormatInt(time.Now().Unix(), 10)
+	if _, _, err := ra.Authenticate(second, ""); err != types.ErrFailed {
+		t.Error("revoked token: expected ErrFailed, got", err)
+	}
+	if _, _, err := ra.Authenticate(other, ""); err != nil {
+		t.Error("token of another user revoked", err)
+	}
+}
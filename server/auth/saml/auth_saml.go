@@ -0,0 +1,658 @@
+// Package saml implements single sign-on by SAML 2.0 identity providers.
+//
+// The server acts as a service provider (SP). The browser is sent to the identity provider (IdP) by
+// the login endpoint, the IdP posts the signed response back to the assertion consumer service (ACS)
+// endpoint. The server verifies the response, finds or creates the account linked to the subject of
+// the assertion and redirects the browser to the app with a token for {login scheme="token"}.
+// The SAML response can be also used as the secret of {login scheme="saml"} directly.
+//
+// Only signed assertions are accepted, encrypted assertions are not supported.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bindingPOST   = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	methodBearer  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	defaultNameIDFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+
+	// Maximum length of RelayState allowed by the SAML binding.
+	maxRelayState = 80
+	// Maximum length of a tag created from an attribute.
+	maxTagLength = 96
+
+	defaultMaxAge = 300
+	defaultLeeway = 60
+)
+
+// authenticator is the type to map authentication methods to.
+type authenticator struct {
+	name string
+	// Entity ID of the service provider.
+	entityID string
+	// URL of the assertion consumer service.
+	acsURL string
+	// URL of the app where the browser is redirected after login.
+	redirectURL  string
+	idpEntityID  string
+	idpSSOURL    string
+	idpCerts     []*x509.Certificate
+	nameIDFormat string
+	// Attribute with the full name of the user.
+	nameAttr string
+	// Mapping of tag namespaces to attributes.
+	tagAttrs          map[string]string
+	allowIdpInitiated bool
+	autoCreate        bool
+	defAuth           types.AccessMode
+	defAnon           types.AccessMode
+	maxAge            time.Duration
+	leeway            time.Duration
+}
+
+// assertion is the verified content of a SAML assertion.
+type assertion struct {
+	id           string
+	nameID       string
+	inResponseTo string
+	notOnOrAfter time.Time
+	// Attribute name -> first value.
+	attrs map[string]string
+}
+
+// Singleton instance of the authenticator.
+var handler = &authenticator{}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (sa *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_saml: authenticator name cannot be blank")
+	}
+
+	if sa.name != "" {
+		return errors.New("auth_saml: already initialized as " + sa.name + "; " + name)
+	}
+
+	type configType struct {
+		// Entity ID of the service, usually the URL of the metadata.
+		EntityID string `json:"entity_id"`
+		// Public URL of the assertion consumer service: <api path>/v0/saml/acs.
+		AcsURL string `json:"acs_url"`
+		// URL of the app where the browser is redirected with the token after login.
+		RedirectURL string `json:"redirect_url"`
+		Idp         struct {
+			EntityID string `json:"entity_id"`
+			// URL of the single sign-on service (HTTP-Redirect binding).
+			SSOURL string `json:"sso_url"`
+			// Signing certificates, PEM or base64-encoded DER.
+			Certificates []string `json:"certificates"`
+		} `json:"idp"`
+		NameIDFormat string `json:"name_id_format"`
+		// Attribute with the full name of the user.
+		NameAttribute string `json:"name_attribute"`
+		// Mapping of tag namespaces to attributes, e.g. {"email": "mail"}.
+		TagAttributes map[string]string `json:"tag_attributes"`
+		// Accept responses not solicited by the service.
+		AllowIdpInitiated bool `json:"allow_idp_initiated"`
+		// Create accounts for unknown users on the first login.
+		AutoCreate bool `json:"auto_create"`
+		// Default access mode of the created accounts.
+		DefaultAccess struct {
+			Auth string `json:"auth"`
+			Anon string `json:"anon"`
+		} `json:"default_access"`
+		// Maximum age of the assertion and of the login request, seconds.
+		MaxAge int `json:"max_age"`
+		// Allowed clock skew, seconds.
+		Leeway int `json:"leeway"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_saml: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.EntityID == "" || config.AcsURL == "" || config.RedirectURL == "" {
+		return errors.New("auth_saml: entity_id, acs_url and redirect_url are required")
+	}
+	if config.Idp.EntityID == "" || config.Idp.SSOURL == "" || len(config.Idp.Certificates) == 0 {
+		return errors.New("auth_saml: idp entity_id, sso_url and certificates are required")
+	}
+	if _, err := url.Parse(config.Idp.SSOURL); err != nil {
+		return errors.New("auth_saml: invalid idp sso_url: " + err.Error())
+	}
+	for _, text := range config.Idp.Certificates {
+		cert, err := parseCertificate(text)
+		if err != nil {
+			return errors.New("auth_saml: invalid idp certificate: " + err.Error())
+		}
+		sa.idpCerts = append(sa.idpCerts, cert)
+	}
+	for ns := range config.TagAttributes {
+		if ns == "" || strings.Contains(ns, ":") {
+			return errors.New("auth_saml: invalid tag namespace '" + ns + "'")
+		}
+	}
+
+	if config.DefaultAccess.Auth == "" {
+		config.DefaultAccess.Auth = "JRWPAS"
+	}
+	if config.DefaultAccess.Anon == "" {
+		config.DefaultAccess.Anon = "N"
+	}
+	if err := sa.defAuth.UnmarshalText([]byte(config.DefaultAccess.Auth)); err != nil {
+		return errors.New("auth_saml: invalid default_access: " + err.Error())
+	}
+	if err := sa.defAnon.UnmarshalText([]byte(config.DefaultAccess.Anon)); err != nil {
+		return errors.New("auth_saml: invalid default_access: " + err.Error())
+	}
+	if config.MaxAge < 0 || config.Leeway < 0 {
+		return errors.New("auth_saml: invalid config value")
+	}
+	sa.maxAge = time.Duration(config.MaxAge) * time.Second
+	if sa.maxAge == 0 {
+		sa.maxAge = defaultMaxAge * time.Second
+	}
+	sa.leeway = time.Duration(config.Leeway) * time.Second
+	if sa.leeway == 0 {
+		sa.leeway = defaultLeeway * time.Second
+	}
+
+	sa.entityID = config.EntityID
+	sa.acsURL = config.AcsURL
+	sa.redirectURL = config.RedirectURL
+	sa.idpEntityID = config.Idp.EntityID
+	sa.idpSSOURL = config.Idp.SSOURL
+	sa.nameIDFormat = config.NameIDFormat
+	if sa.nameIDFormat == "" {
+		sa.nameIDFormat = defaultNameIDFormat
+	}
+	sa.nameAttr = config.NameAttribute
+	sa.tagAttrs = config.TagAttributes
+	sa.allowIdpInitiated = config.AllowIdpInitiated
+	sa.autoCreate = config.AutoCreate
+	sa.name = name
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (sa *authenticator) IsInitialized() bool {
+	return sa.name != ""
+}
+
+// AddRecord links the subject of the SAML response to a new account.
+func (sa *authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	asr, err := sa.consume(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	authLevel := rec.AuthLevel
+	if authLevel == auth.LevelNone {
+		authLevel = auth.LevelAuth
+	}
+	err = store.Users.AddAuthRecord(rec.Uid, authLevel, sa.name, asr.nameID, []byte(sa.idpEntityID), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	rec.AuthLevel = authLevel
+	rec.Tags = append(rec.Tags, sa.tags(asr)...)
+	return rec, nil
+}
+
+// UpdateRecord links the subject of the SAML response to the existing account replacing the
+// previously linked subject, if any.
+func (sa *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	asr, err := sa.consume(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	uid, _, _, _, err := store.Users.GetAuthUniqueRecord(sa.name, asr.nameID)
+	if err != nil {
+		return nil, err
+	}
+	if !uid.IsZero() {
+		if uid != rec.Uid {
+			// The subject is linked to another account.
+			return nil, types.ErrDuplicate
+		}
+		return rec, nil
+	}
+
+	_, authLevel, _, _, err := store.Users.GetAuthRecord(rec.Uid, sa.name)
+	if err == types.ErrNotFound {
+		err = store.Users.AddAuthRecord(rec.Uid, auth.LevelAuth, sa.name, asr.nameID, []byte(sa.idpEntityID), time.Time{})
+	} else if err == nil {
+		err = store.Users.UpdateAuthRecord(rec.Uid, authLevel, sa.name, asr.nameID, []byte(sa.idpEntityID), time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range sa.tags(asr) {
+		if !slices.Contains(rec.Tags, tag) {
+			rec.Tags = append(rec.Tags, tag)
+		}
+	}
+	return rec, nil
+}
+
+// Authenticate verifies the SAML response and finds the account linked to the subject. If there is
+// no such account and automatic account creation is enabled, creates a new account.
+func (sa *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	asr, err := sa.consume(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	uid, authLvl, _, _, err := store.Users.GetAuthUniqueRecord(sa.name, asr.nameID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !uid.IsZero() {
+		return &auth.Rec{
+			Uid:       uid,
+			AuthLevel: authLvl,
+			State:     types.StateUndefined}, nil, nil
+	}
+
+	if !sa.autoCreate {
+		return nil, nil, types.ErrFailed
+	}
+
+	// Create a new account.
+	user := types.User{Tags: sa.tags(asr)}
+	if name := asr.attrs[sa.nameAttr]; sa.nameAttr != "" && name != "" {
+		user.Public = map[string]any{"fn": name}
+	}
+	user.Access.Auth = sa.defAuth
+	user.Access.Anon = sa.defAnon
+	if _, err = store.Users.Create(&user, nil); err != nil {
+		return nil, nil, err
+	}
+	err = store.Users.AddAuthRecord(user.Uid(), auth.LevelAuth, sa.name, asr.nameID, []byte(sa.idpEntityID), time.Time{})
+	if err != nil {
+		// Attempt to delete incomplete user record.
+		if err := store.Users.Delete(user.Uid(), true); err != nil {
+			logs.Warn.Println("saml_auth: failed to delete incomplete user record", err)
+		}
+		return nil, nil, err
+	}
+	logs.Info.Println("saml_auth: created account", user.Uid().UserId(), "for", asr.nameID)
+
+	return &auth.Rec{
+		Uid:       user.Uid(),
+		AuthLevel: auth.LevelAuth,
+		Tags:      user.Tags,
+		State:     types.StateOK}, nil, nil
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported: the SAML response can be used only once.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// GenSecret is not supported, will produce an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// DelRecords deletes the link between the user and the SAML subject.
+func (sa *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, sa.name)
+}
+
+// RestrictedTags returns tag namespaces populated from the attributes.
+func (sa *authenticator) RestrictedTags() ([]string, error) {
+	var tags []string
+	for ns := range sa.tagAttrs {
+		tags = append(tags, ns)
+	}
+	return tags, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for SAML).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// consume verifies the SAML response, checks that it was requested by this service and was not
+// used before.
+func (sa *authenticator) consume(data []byte) (*assertion, error) {
+	asr, err := sa.verify(data, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if asr.inResponseTo != "" {
+		key := keyForRequest(asr.inResponseTo)
+		if _, err := store.PCache.Get(key); err != nil {
+			if err == types.ErrNotFound {
+				return nil, types.ErrFailed
+			}
+			return nil, err
+		}
+		if err := store.PCache.Delete(key); err != nil {
+			logs.Warn.Println("saml_auth: error deleting key", key, err)
+		}
+	} else if !sa.allowIdpInitiated {
+		return nil, types.ErrFailed
+	}
+
+	// Reject replayed assertions. Assertions older than maxAge are rejected by verify.
+	store.PCache.Expire(realName+"_a_", time.Now().UTC().Add(-sa.maxAge-sa.leeway))
+	if err := store.PCache.Upsert(keyForAssertion(asr.id), asr.notOnOrAfter.UTC().Format(time.RFC3339), true); err != nil {
+		if err == types.ErrDuplicate {
+			return nil, types.ErrFailed
+		}
+		return nil, err
+	}
+	return asr, nil
+}
+
+// verify checks the signature of the SAML response and validates the assertion.
+func (sa *authenticator) verify(data []byte, now time.Time) (*assertion, error) {
+	root, err := parseXML(data)
+	if err != nil || !root.is(nsProtocol, "Response") || root.attr("Version") != "2.0" {
+		return nil, types.ErrMalformed
+	}
+
+	status := root.element(nsProtocol, "Status")
+	if status == nil {
+		return nil, types.ErrMalformed
+	}
+	if code := status.element(nsProtocol, "StatusCode"); code == nil || code.attr("Value") != statusSuccess {
+		return nil, types.ErrFailed
+	}
+	if dest := root.attr("Destination"); dest != "" && dest != sa.acsURL {
+		return nil, types.ErrFailed
+	}
+	if issuer := root.element(nsAssertion, "Issuer"); issuer != nil && issuer.text() != sa.idpEntityID {
+		return nil, types.ErrFailed
+	}
+	if root.element(nsAssertion, "EncryptedAssertion") != nil {
+		return nil, types.ErrUnsupported
+	}
+	assertions := root.elements(nsAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, types.ErrMalformed
+	}
+	el := assertions[0]
+
+	// Either the response or the assertion must be signed.
+	respErr := verifyEnveloped(root, sa.idpCerts)
+	if respErr != nil && respErr != errNotSigned {
+		return nil, types.ErrFailed
+	}
+	if err := verifyEnveloped(el, sa.idpCerts); err != nil && (err != errNotSigned || respErr != nil) {
+		return nil, types.ErrFailed
+	}
+
+	if el.attr("Version") != "2.0" || el.attr("ID") == "" || el.element(nsAssertion, "Issuer").text() != sa.idpEntityID {
+		return nil, types.ErrMalformed
+	}
+	issued, err := time.Parse(time.RFC3339, el.attr("IssueInstant"))
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	if issued.After(now.Add(sa.leeway)) || issued.Add(sa.maxAge+sa.leeway).Before(now) {
+		return nil, types.ErrExpired
+	}
+
+	asr := &assertion{id: el.attr("ID"), attrs: make(map[string]string)}
+
+	subject := el.element(nsAssertion, "Subject")
+	if subject == nil {
+		return nil, types.ErrMalformed
+	}
+	asr.nameID = subject.element(nsAssertion, "NameID").text()
+	if asr.nameID == "" {
+		return nil, types.ErrMalformed
+	}
+	// At least one bearer confirmation must be valid.
+	confirmed := false
+	for _, sc := range subject.elements(nsAssertion, "SubjectConfirmation") {
+		data := sc.element(nsAssertion, "SubjectConfirmationData")
+		if sc.attr("Method") != methodBearer || data == nil || data.attr("Recipient") != sa.acsURL ||
+			data.attr("NotBefore") != "" {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, data.attr("NotOnOrAfter"))
+		if err != nil || !expires.Add(sa.leeway).After(now) {
+			continue
+		}
+		asr.inResponseTo = data.attr("InResponseTo")
+		asr.notOnOrAfter = expires
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		return nil, types.ErrFailed
+	}
+	if irt := root.attr("InResponseTo"); irt != "" && irt != asr.inResponseTo {
+		return nil, types.ErrFailed
+	}
+
+	if cond := el.element(nsAssertion, "Conditions"); cond != nil {
+		if nb := cond.attr("NotBefore"); nb != "" {
+			notBefore, err := time.Parse(time.RFC3339, nb)
+			if err != nil {
+				return nil, types.ErrMalformed
+			}
+			if notBefore.After(now.Add(sa.leeway)) {
+				return nil, types.ErrFailed
+			}
+		}
+		if noa := cond.attr("NotOnOrAfter"); noa != "" {
+			notOnOrAfter, err := time.Parse(time.RFC3339, noa)
+			if err != nil {
+				return nil, types.ErrMalformed
+			}
+			if !notOnOrAfter.Add(sa.leeway).After(now) {
+				return nil, types.ErrExpired
+			}
+		}
+		// Each audience restriction must include this service.
+		for _, ar := range cond.elements(nsAssertion, "AudienceRestriction") {
+			if !slices.ContainsFunc(ar.elements(nsAssertion, "Audience"), func(a *node) bool {
+				return a.text() == sa.entityID
+			}) {
+				return nil, types.ErrFailed
+			}
+		}
+	}
+
+	for _, stmt := range el.elements(nsAssertion, "AttributeStatement") {
+		for _, attr := range stmt.elements(nsAssertion, "Attribute") {
+			value := attr.element(nsAssertion, "AttributeValue").text()
+			if value == "" {
+				continue
+			}
+			for _, name := range []string{attr.attr("Name"), attr.attr("FriendlyName")} {
+				if _, ok := asr.attrs[name]; name != "" && !ok {
+					asr.attrs[name] = value
+				}
+			}
+		}
+	}
+
+	return asr, nil
+}
+
+// tags converts attributes to tags.
+func (sa *authenticator) tags(asr *assertion) []string {
+	var tags []string
+	for ns, attr := range sa.tagAttrs {
+		value := strings.ToLower(strings.TrimSpace(asr.attrs[attr]))
+		if value == "" {
+			continue
+		}
+		tag := ns + ":" + value
+		if len(tag) <= maxTagLength {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// loginURL creates an authentication request and returns the URL of the identity provider
+// to send the browser to.
+func (sa *authenticator) loginURL(state string) (string, error) {
+	if len(state) > maxRelayState {
+		return "", types.ErrMalformed
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	// IDs must not start with a digit.
+	id := "_" + hex.EncodeToString(buf)
+	now := time.Now().UTC()
+
+	store.PCache.Expire(realName+"_r_", now.Add(-sa.maxAge))
+	if err := store.PCache.Upsert(keyForRequest(id), now.Format(time.RFC3339), true); err != nil {
+		return "", err
+	}
+
+	var req bytes.Buffer
+	req.WriteString(`<samlp:AuthnRequest xmlns:samlp="` + nsProtocol + `" xmlns:saml="` + nsAssertion + `"`)
+	req.WriteString(` ID="` + id + `" Version="2.0" IssueInstant="` + now.Format(time.RFC3339) + `"`)
+	req.WriteString(` Destination="`)
+	xml.EscapeText(&req, []byte(sa.idpSSOURL))
+	req.WriteString(`" AssertionConsumerServiceURL="`)
+	xml.EscapeText(&req, []byte(sa.acsURL))
+	req.WriteString(`" ProtocolBinding="` + bindingPOST + `"><saml:Issuer>`)
+	xml.EscapeText(&req, []byte(sa.entityID))
+	req.WriteString(`</saml:Issuer><samlp:NameIDPolicy Format="`)
+	xml.EscapeText(&req, []byte(sa.nameIDFormat))
+	req.WriteString(`" AllowCreate="true"/></samlp:AuthnRequest>`)
+
+	// HTTP-Redirect binding: deflated and base64-encoded.
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write(req.Bytes())
+	fw.Close()
+
+	query := url.Values{}
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if state != "" {
+		query.Set("RelayState", state)
+	}
+	sep := "?"
+	if strings.Contains(sa.idpSSOURL, "?") {
+		sep = "&"
+	}
+	return sa.idpSSOURL + sep + query.Encode(), nil
+}
+
+// metadata returns the service provider metadata.
+func (sa *authenticator) metadata() []byte {
+	var md bytes.Buffer
+	md.WriteString(xml.Header)
+	md.WriteString(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="`)
+	xml.EscapeText(&md, []byte(sa.entityID))
+	md.WriteString(`">` + "\n")
+	md.WriteString(`  <md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true"`)
+	md.WriteString(` protocolSupportEnumeration="` + nsProtocol + `">` + "\n")
+	md.WriteString(`    <md:NameIDFormat>`)
+	xml.EscapeText(&md, []byte(sa.nameIDFormat))
+	md.WriteString(`</md:NameIDFormat>` + "\n")
+	md.WriteString(`    <md:AssertionConsumerService Binding="` + bindingPOST + `" Location="`)
+	xml.EscapeText(&md, []byte(sa.acsURL))
+	md.WriteString(`" index="0" isDefault="true"/>` + "\n")
+	md.WriteString("  </md:SPSSODescriptor>\n</md:EntityDescriptor>\n")
+	return md.Bytes()
+}
+
+// parseCertificate parses a PEM or base64-encoded DER certificate.
+func parseCertificate(text string) (*x509.Certificate, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(text)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		if der, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), "")); err != nil {
+			return nil, err
+		}
+	}
+	return x509.ParseCertificate(der)
+}
+
+func keyForRequest(id string) string {
+	return realName + "_r_" + id
+}
+
+// keyForAssertion returns the cache key of the assertion ID. IDs assigned by the identity provider
+// may be too long for the key.
+func keyForAssertion(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return realName + "_a_" + hex.EncodeToString(sum[:20])
+}
+
+// Enabled returns true if SAML authentication is configured.
+func Enabled() bool {
+	return handler.IsInitialized()
+}
+
+// Metadata returns the metadata of the service to be registered with the identity provider.
+func Metadata() []byte {
+	return handler.metadata()
+}
+
+// LoginURL starts the login. It returns the URL of the identity provider where the browser should be
+// redirected. The state is returned to the app unchanged after login.
+func LoginURL(state string) (string, error) {
+	return handler.loginURL(state)
+}
+
+// RedirectURL returns the URL of the app where the browser is sent after login.
+func RedirectURL() string {
+	return handler.redirectURL
+}
+
+const realName = "saml"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, handler)
+}
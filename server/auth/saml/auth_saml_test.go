@@ -0,0 +1,254 @@
+package saml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestCanonicalize(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<a:Root xmlns:a="urn:a" xmlns:b="urn:b" xmlns="urn:d" z="1" a:y="2" b="3">
+  <Child attr="x &amp; &quot;y&quot;">text &lt; &gt; &amp;</Child><!-- comment -->
+  <b:Empty/>
+  <b:Outer xmlns=""><Inner/></b:Outer>
+</a:Root>`
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	root.canonicalize(&buf, nil, nil)
+	expected := `<a:Root xmlns:a="urn:a" b="3" z="1" a:y="2">
+  <Child xmlns="urn:d" attr="x &amp; &quot;y&quot;">text &lt; &gt; &amp;</Child>
+  <b:Empty xmlns:b="urn:b"></b:Empty>
+  <b:Outer xmlns:b="urn:b"><Inner></Inner></b:Outer>
+</a:Root>`
+	if buf.String() != expected {
+		t.Errorf("canonical form:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	// Subtree, omitted element, inclusive prefix.
+	buf.Reset()
+	root.canonicalize(&buf, root.elements("urn:b", "Empty")[0], []string{"b"})
+	if !strings.HasPrefix(buf.String(), `<a:Root xmlns:a="urn:a" xmlns:b="urn:b" b="3"`) ||
+		strings.Contains(buf.String(), "Empty") || strings.Contains(buf.String(), `<b:Outer xmlns:b`) {
+		t.Error("wrong canonical form with omitted element", buf.String())
+	}
+	buf.Reset()
+	root.element("urn:d", "Child").canonicalize(&buf, nil, nil)
+	if buf.String() != `<Child xmlns="urn:d" attr="x &amp; &quot;y&quot;">text &lt; &gt; &amp;</Child>` {
+		t.Error("wrong canonical form of subtree", buf.String())
+	}
+
+	for _, bad := range []string{
+		`<!DOCTYPE a [<!ENTITY x "y">]><a>&x;</a>`,
+		`<a><b></a></b>`,
+		`<x:a/>`,
+		`<a/><b/>`,
+	} {
+		if _, err := parseXML([]byte(bad)); err == nil {
+			t.Errorf("invalid XML accepted: %s", bad)
+		}
+	}
+}
+
+const (
+	testIdp = "https://idp.example.com"
+	testSP  = "https://chat.example.com/saml"
+	testAcs = "https://chat.example.com/v0/saml/acs"
+)
+
+func newTestAuthenticator(t *testing.T) (*authenticator, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, _ := json.Marshal(map[string]any{
+		"entity_id":    testSP,
+		"acs_url":      testAcs,
+		"redirect_url": "https://chat.example.com/",
+		"idp": map[string]any{
+			"entity_id":    testIdp,
+			"sso_url":      testIdp + "/sso",
+			"certificates": []string{base64.StdEncoding.EncodeToString(der)},
+		},
+		"name_attribute": "displayName",
+		"tag_attributes": map[string]string{"email": "mail"},
+	})
+	sa := &authenticator{}
+	if err := sa.Init(conf, "saml"); err != nil {
+		t.Fatal(err)
+	}
+	return sa, key
+}
+
+// testResponse creates a SAML response. The signature of the element with the ID is inserted in place
+// of the <!--sig:ID--> comment.
+func testResponse(nameID, audience, recipient string, issued time.Time) string {
+	ts := issued.UTC().Format(time.RFC3339)
+	expires := issued.Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	return `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_resp1" Version="2.0"
+ IssueInstant="` + ts + `" Destination="` + testAcs + `" InResponseTo="_req1">
+ <saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` + testIdp + `</saml:Issuer><!--sig:_resp1-->
+ <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+ <saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xs="http://www.w3.org/2001/XMLSchema"
+  xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" ID="_asr1" Version="2.0" IssueInstant="` + ts + `">
+  <saml:Issuer>` + testIdp + `</saml:Issuer><!--sig:_asr1-->
+  <saml:Subject>
+   <saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">` + nameID + `</saml:NameID>
+   <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+    <saml:SubjectConfirmationData InResponseTo="_req1" NotOnOrAfter="` + expires + `" Recipient="` + recipient + `"/>
+   </saml:SubjectConfirmation>
+  </saml:Subject>
+  <saml:Conditions NotBefore="` + ts + `" NotOnOrAfter="` + expires + `">
+   <saml:AudienceRestriction><saml:Audience>` + audience + `</saml:Audience></saml:AudienceRestriction>
+  </saml:Conditions>
+  <saml:AttributeStatement>
+   <saml:Attribute Name="displayName"><saml:AttributeValue xsi:type="xs:string">Alice Johnson</saml:AttributeValue></saml:Attribute>
+   <saml:Attribute Name="mail"><saml:AttributeValue xsi:type="xs:string">Alice@Example.com</saml:AttributeValue></saml:Attribute>
+  </saml:AttributeStatement>
+ </saml:Assertion>
+</samlp:Response>`
+}
+
+// findByID returns the element with the ID attribute.
+func findByID(n *node, id string) *node {
+	if n.attr("ID") == id {
+		return n
+	}
+	for _, c := range n.children {
+		if el, ok := c.(*node); ok {
+			if found := findByID(el, id); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// sign signs the element with the ID using exclusive canonicalization and RSA-SHA256.
+func sign(t *testing.T, doc, id string, key *rsa.PrivateKey) string {
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	findByID(root, id).canonicalize(&buf, nil, nil)
+	digest := sha256.Sum256(buf.Bytes())
+
+	sig := `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue>` +
+		`</ds:Reference></ds:SignedInfo><ds:SignatureValue></ds:SignatureValue></ds:Signature>`
+	doc = strings.Replace(doc, "<!--sig:"+id+"-->", sig, 1)
+
+	root, err = parseXML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	findByID(root, id).element(nsDSig, "Signature").element(nsDSig, "SignedInfo").canonicalize(&buf, nil, nil)
+	hashed := sha256.Sum256(buf.Bytes())
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(doc, "<ds:SignatureValue></ds:SignatureValue>",
+		"<ds:SignatureValue>"+base64.StdEncoding.EncodeToString(value)+"</ds:SignatureValue>", 1)
+}
+
+func TestVerify(t *testing.T) {
+	sa, key := newTestAuthenticator(t)
+	now := time.Now()
+
+	// Signed assertion.
+	doc := sign(t, testResponse("alice", testSP, testAcs, now), "_asr1", key)
+	asr, err := sa.verify([]byte(doc), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asr.id != "_asr1" || asr.nameID != "alice" || asr.inResponseTo != "_req1" {
+		t.Error("wrong assertion", asr)
+	}
+	if tags := sa.tags(asr); len(tags) != 1 || tags[0] != "email:alice@example.com" {
+		t.Error("wrong tags", tags)
+	}
+	if asr.attrs["displayName"] != "Alice Johnson" {
+		t.Error("wrong attributes", asr.attrs)
+	}
+
+	// Signed response.
+	if _, err = sa.verify([]byte(sign(t, testResponse("alice", testSP, testAcs, now), "_resp1", key)), now); err != nil {
+		t.Error("signed response rejected", err)
+	}
+
+	// Altered assertion.
+	if _, err = sa.verify([]byte(strings.Replace(doc, ">alice<", ">mallory<", 1)), now); err != types.ErrFailed {
+		t.Error("altered assertion accepted", err)
+	}
+
+	// Second unsigned assertion.
+	unsigned := testResponse("mallory", testSP, testAcs, now)
+	injected := unsigned[strings.Index(unsigned, "<saml:Assertion"):strings.Index(unsigned, "</saml:Assertion>")] +
+		"</saml:Assertion>"
+	i := strings.Index(doc, "<saml:Assertion")
+	wrapped := doc[:i] + injected + doc[i:]
+	if _, err = sa.verify([]byte(wrapped), now); err != types.ErrMalformed {
+		t.Error("response with two assertions accepted", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		doc  string
+		at   time.Time
+		err  error
+	}{
+		{"unsigned", testResponse("alice", testSP, testAcs, now), now, types.ErrFailed},
+		{"wrong audience", sign(t, testResponse("alice", "https://other.example.com", testAcs, now), "_asr1", key),
+			now, types.ErrFailed},
+		{"wrong recipient", sign(t, testResponse("alice", testSP, "https://other.example.com/acs", now), "_asr1", key),
+			now, types.ErrFailed},
+		{"expired", doc, now.Add(time.Hour), types.ErrExpired},
+		{"not XML", "alice", now, types.ErrMalformed},
+	} {
+		if _, err := sa.verify([]byte(tc.doc), tc.at); err != tc.err {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	// Signed by another key.
+	other, _ := newTestAuthenticator(t)
+	if _, err = other.verify([]byte(doc), now); err != types.ErrFailed {
+		t.Error("assertion signed by unknown key accepted", err)
+	}
+}
@@ -0,0 +1,182 @@
+package saml
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+
+	// Hash functions used by signatures.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Verification of enveloped XML signatures (https://www.w3.org/TR/xmldsig-core1/) of SAML messages.
+// Only the subset used by SAML is supported: one reference to the signed element by its ID,
+// enveloped signature and exclusive canonicalization transforms.
+
+const (
+	nsDSig      = "http://www.w3.org/2000/09/xmldsig#"
+	nsExcC14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnvelope = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+// Supported digest algorithms. SHA-1 is not accepted.
+var digestAlgorithms = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256":       crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#sha384": crypto.SHA384,
+	"http://www.w3.org/2001/04/xmlenc#sha512":       crypto.SHA512,
+}
+
+// Supported signature algorithms.
+var signatureAlgorithms = map[string]struct {
+	hash  crypto.Hash
+	ecdsa bool
+}{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":   {crypto.SHA256, false},
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha384":   {crypto.SHA384, false},
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512":   {crypto.SHA512, false},
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256": {crypto.SHA256, true},
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384": {crypto.SHA384, true},
+	"http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512": {crypto.SHA512, true},
+}
+
+var (
+	// The element has no signature.
+	errNotSigned = errors.New("not signed")
+	// The signature is invalid or uses unsupported features.
+	errSignature = errors.New("invalid signature")
+)
+
+// verifyEnveloped verifies the signature which is a child of the element and signs the element.
+// The signature must be made by one of the certificates.
+func verifyEnveloped(el *node, certs []*x509.Certificate) error {
+	sigs := el.elements(nsDSig, "Signature")
+	if len(sigs) == 0 {
+		return errNotSigned
+	}
+	if len(sigs) > 1 {
+		return errSignature
+	}
+	sig := sigs[0]
+
+	signedInfo := sig.element(nsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return errSignature
+	}
+	cm := signedInfo.element(nsDSig, "CanonicalizationMethod")
+	if cm == nil || cm.attr("Algorithm") != nsExcC14N {
+		return errSignature
+	}
+	sm := signedInfo.element(nsDSig, "SignatureMethod")
+	if sm == nil {
+		return errSignature
+	}
+	sigAlg, ok := signatureAlgorithms[sm.attr("Algorithm")]
+	if !ok {
+		return errSignature
+	}
+
+	// The only reference must point to the element itself.
+	refs := signedInfo.elements(nsDSig, "Reference")
+	if len(refs) != 1 {
+		return errSignature
+	}
+	ref := refs[0]
+	if id := el.attr("ID"); id == "" || ref.attr("URI") != "#"+id {
+		return errSignature
+	}
+
+	var enveloped, canonical bool
+	var inclusive []string
+	if transforms := ref.element(nsDSig, "Transforms"); transforms != nil {
+		for _, tr := range transforms.elements(nsDSig, "Transform") {
+			switch tr.attr("Algorithm") {
+			case algEnvelope:
+				enveloped = true
+			case nsExcC14N:
+				canonical = true
+				inclusive = inclusivePrefixes(tr)
+			default:
+				return errSignature
+			}
+		}
+	}
+	if !enveloped || !canonical {
+		return errSignature
+	}
+
+	dm := ref.element(nsDSig, "DigestMethod")
+	if dm == nil {
+		return errSignature
+	}
+	digestAlg, ok := digestAlgorithms[dm.attr("Algorithm")]
+	if !ok {
+		return errSignature
+	}
+	digest, err := decodeBase64(ref.element(nsDSig, "DigestValue").text())
+	if err != nil {
+		return errSignature
+	}
+
+	var buf bytes.Buffer
+	el.canonicalize(&buf, sig, inclusive)
+	hasher := digestAlg.New()
+	hasher.Write(buf.Bytes())
+	if subtle.ConstantTimeCompare(hasher.Sum(nil), digest) != 1 {
+		return errSignature
+	}
+
+	signature, err := decodeBase64(sig.element(nsDSig, "SignatureValue").text())
+	if err != nil {
+		return errSignature
+	}
+	buf.Reset()
+	signedInfo.canonicalize(&buf, nil, inclusivePrefixes(cm))
+	hasher = sigAlg.hash.New()
+	hasher.Write(buf.Bytes())
+	hashed := hasher.Sum(nil)
+
+	for _, cert := range certs {
+		switch key := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			if !sigAlg.ecdsa && rsa.VerifyPKCS1v15(key, sigAlg.hash, hashed, signature) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			// XML signatures use concatenated r and s rather than ASN.1.
+			if sigAlg.ecdsa && len(signature)%2 == 0 {
+				half := len(signature) / 2
+				r := new(big.Int).SetBytes(signature[:half])
+				s := new(big.Int).SetBytes(signature[half:])
+				if ecdsa.Verify(key, hashed, r, s) {
+					return nil
+				}
+			}
+		}
+	}
+	return errSignature
+}
+
+// inclusivePrefixes returns the prefix list of the exclusive canonicalization method.
+func inclusivePrefixes(method *node) []string {
+	if in := method.element(nsExcC14N, "InclusiveNamespaces"); in != nil {
+		return strings.Fields(in.attr("PrefixList"))
+	}
+	return nil
+}
+
+// decodeBase64 decodes base64 text which may contain line breaks.
+func decodeBase64(text string) ([]byte, error) {
+	text = strings.Join(strings.Fields(text), "")
+	if text == "" {
+		return nil, errSignature
+	}
+	return base64.StdEncoding.DecodeString(text)
+}
@@ -0,0 +1,326 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Minimal XML tree which preserves namespace prefixes as required for canonicalization of signed
+// elements. Encoding/xml does not keep prefixes of parsed elements.
+
+const (
+	nsXML = "http://www.w3.org/XML/1998/namespace"
+
+	// Maximum nesting level of elements.
+	xmlMaxDepth = 32
+)
+
+var errXML = errors.New("invalid or unsupported XML")
+
+// xmlAttr is an attribute or a namespace declaration. The local name of a declaration is the
+// declared prefix, empty for the default namespace.
+type xmlAttr struct {
+	prefix string
+	local  string
+	value  string
+}
+
+// node is an XML element.
+type node struct {
+	prefix string
+	local  string
+	attrs  []xmlAttr
+	ns     []xmlAttr
+	// Child elements as *node and text as string.
+	children []any
+	parent   *node
+}
+
+// parseXML parses the document and returns the root element. Document type declarations and
+// processing instructions inside the document are rejected, comments are dropped.
+func parseXML(data []byte) (*node, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = true
+
+	var root, cur *node
+	depth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errXML
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if (cur == nil && root != nil) || depth >= xmlMaxDepth {
+				return nil, errXML
+			}
+			n := &node{prefix: t.Name.Space, local: t.Name.Local, parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.ns = append(n.ns, xmlAttr{local: "", value: a.Value})
+				case a.Name.Space == "xmlns":
+					if a.Value == "" {
+						return nil, errXML
+					}
+					n.ns = append(n.ns, xmlAttr{local: a.Name.Local, value: a.Value})
+				default:
+					n.attrs = append(n.attrs, xmlAttr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value})
+				}
+			}
+			// All prefixes must be declared.
+			if n.prefix != "" && n.lookupNS(n.prefix) == "" {
+				return nil, errXML
+			}
+			for _, a := range n.attrs {
+				if a.prefix != "" && n.lookupNS(a.prefix) == "" {
+					return nil, errXML
+				}
+			}
+			if cur == nil {
+				root = n
+			} else {
+				cur.children = append(cur.children, n)
+			}
+			cur = n
+			depth++
+		case xml.EndElement:
+			if cur == nil || cur.prefix != t.Name.Space || cur.local != t.Name.Local {
+				return nil, errXML
+			}
+			cur = cur.parent
+			depth--
+		case xml.CharData:
+			if cur == nil {
+				if len(bytes.TrimSpace(t)) != 0 {
+					return nil, errXML
+				}
+				continue
+			}
+			if last := len(cur.children) - 1; last >= 0 {
+				if text, ok := cur.children[last].(string); ok {
+					cur.children[last] = text + string(t)
+					continue
+				}
+			}
+			cur.children = append(cur.children, string(t))
+		case xml.ProcInst:
+			// Only the XML declaration is allowed.
+			if root != nil || t.Target != "xml" {
+				return nil, errXML
+			}
+		case xml.Directive:
+			return nil, errXML
+		}
+	}
+
+	if root == nil || cur != nil {
+		return nil, errXML
+	}
+	return root, nil
+}
+
+// lookupNS returns the namespace URI bound to the prefix in the scope of the element.
+func (n *node) lookupNS(prefix string) string {
+	if prefix == "xml" {
+		return nsXML
+	}
+	for el := n; el != nil; el = el.parent {
+		for _, ns := range el.ns {
+			if ns.local == prefix {
+				return ns.value
+			}
+		}
+	}
+	return ""
+}
+
+// attrNS returns the namespace URI of the attribute of the element.
+func (n *node) attrNS(a xmlAttr) string {
+	if a.prefix == "" {
+		return ""
+	}
+	return n.lookupNS(a.prefix)
+}
+
+// is checks the namespace and the local name of the element.
+func (n *node) is(space, local string) bool {
+	return n.local == local && n.lookupNS(n.prefix) == space
+}
+
+// elements returns child elements with the given namespace and local name.
+func (n *node) elements(space, local string) []*node {
+	var found []*node
+	for _, c := range n.children {
+		if el, ok := c.(*node); ok && el.is(space, local) {
+			found = append(found, el)
+		}
+	}
+	return found
+}
+
+// element returns the first child element with the given namespace and local name or nil.
+func (n *node) element(space, local string) *node {
+	if found := n.elements(space, local); len(found) > 0 {
+		return found[0]
+	}
+	return nil
+}
+
+// attr returns the value of an attribute without a namespace.
+func (n *node) attr(local string) string {
+	for _, a := range n.attrs {
+		if a.prefix == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// text returns the text content of the element with leading and trailing white space removed.
+// Nil element has no text.
+func (n *node) text() string {
+	if n == nil {
+		return ""
+	}
+	var sb strings.Builder
+	for _, c := range n.children {
+		if text, ok := c.(string); ok {
+			sb.WriteString(text)
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// canonicalize writes the element in Exclusive XML Canonicalization form without comments
+// (https://www.w3.org/TR/xml-exc-c14n/). The omitted element is skipped, as required by the
+// enveloped signature transform. The inclusive prefixes are treated as in the inclusive
+// canonicalization, "#default" stands for the default namespace.
+func (n *node) canonicalize(w *bytes.Buffer, omit *node, inclusive []string) {
+	n.c14n(w, map[string]string{}, omit, inclusive)
+}
+
+func (n *node) c14n(w *bytes.Buffer, rendered map[string]string, omit *node, inclusive []string) {
+	// Namespace prefixes visibly utilized by the element.
+	used := []string{n.prefix}
+	for _, a := range n.attrs {
+		if a.prefix != "" && !slices.Contains(used, a.prefix) {
+			used = append(used, a.prefix)
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if !slices.Contains(used, p) && (p == "" || n.lookupNS(p) != "") {
+			used = append(used, p)
+		}
+	}
+
+	var decls []xmlAttr
+	for _, p := range used {
+		if p == "xml" {
+			continue
+		}
+		uri := n.lookupNS(p)
+		if prev, ok := rendered[p]; (ok && prev == uri) || (!ok && uri == "") {
+			continue
+		}
+		decls = append(decls, xmlAttr{local: p, value: uri})
+	}
+	if len(decls) > 0 {
+		scope := make(map[string]string, len(rendered)+len(decls))
+		for p, uri := range rendered {
+			scope[p] = uri
+		}
+		for _, d := range decls {
+			scope[d.local] = d.value
+		}
+		rendered = scope
+	}
+	slices.SortFunc(decls, func(a, b xmlAttr) int { return strings.Compare(a.local, b.local) })
+
+	attrs := slices.Clone(n.attrs)
+	slices.SortFunc(attrs, func(a, b xmlAttr) int {
+		// Attributes without a prefix have no namespace.
+		if c := strings.Compare(n.attrNS(a), n.attrNS(b)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.local, b.local)
+	})
+
+	w.WriteByte('<')
+	writeQName(w, n.prefix, n.local)
+	for _, d := range decls {
+		if d.local == "" {
+			w.WriteString(` xmlns="`)
+		} else {
+			w.WriteString(` xmlns:` + d.local + `="`)
+		}
+		escapeC14N(w, d.value, true)
+		w.WriteByte('"')
+	}
+	for _, a := range attrs {
+		w.WriteByte(' ')
+		writeQName(w, a.prefix, a.local)
+		w.WriteString(`="`)
+		escapeC14N(w, a.value, true)
+		w.WriteByte('"')
+	}
+	w.WriteByte('>')
+
+	for _, c := range n.children {
+		switch child := c.(type) {
+		case string:
+			escapeC14N(w, child, false)
+		case *node:
+			if child != omit {
+				child.c14n(w, rendered, omit, inclusive)
+			}
+		}
+	}
+
+	w.WriteString("</")
+	writeQName(w, n.prefix, n.local)
+	w.WriteByte('>')
+}
+
+func writeQName(w *bytes.Buffer, prefix, local string) {
+	if prefix != "" {
+		w.WriteString(prefix)
+		w.WriteByte(':')
+	}
+	w.WriteString(local)
+}
+
+// escapeC14N escapes text or an attribute value as required by the canonical form.
+func escapeC14N(w *bytes.Buffer, s string, attr bool) {
+	for _, r := range s {
+		switch {
+		case r == '&':
+			w.WriteString("&amp;")
+		case r == '<':
+			w.WriteString("&lt;")
+		case r == '>' && !attr:
+			w.WriteString("&gt;")
+		case r == '"' && attr:
+			w.WriteString("&quot;")
+		case r == '\t' && attr:
+			w.WriteString("&#x9;")
+		case r == '\n' && attr:
+			w.WriteString("&#xA;")
+		case r == '\r':
+			w.WriteString("&#xD;")
+		default:
+			w.WriteRune(r)
+		}
+	}
+}
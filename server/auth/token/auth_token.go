@@ -1,4 +1,8 @@
 // Package token implements authentication by HMAC-signed security token.
+//
+// Tokens are not stored. All tokens of a user issued until a given moment are revoked
+// by saving the time of revocation in the persistent cache. Times of revocation are cached
+// in memory for a short time because the check is performed on every token login.
 package token
 
 import (
@@ -8,6 +12,8 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
@@ -21,11 +27,50 @@ type authenticator struct {
 	hmacSalt     []byte
 	lifetime     time.Duration
 	serialNumber int
+
+	// How long the time of revocation of user's tokens is cached.
+	revocationTTL time.Duration
+	// Cached times of revocation by user ID.
+	revocations map[types.Uid]revocation
+	// Last time expired revocations were removed from the cache.
+	revocationsPurged time.Time
+	revocationLock    sync.Mutex
+}
+
+// revocation is a cached time of revocation of user's tokens.
+type revocation struct {
+	// Tokens issued at or before this Unix time are revoked; 0 if none.
+	at int64
+	// When the value was read from the persistent cache.
+	checked time.Time
 }
 
+// Prefix of persistent cache keys with times of revocation.
+const revocationPrefix = "token_revoked_"
+
+// Default value of revocation_cache.
+const defaultRevocationTTL = 30 * time.Second
+
 // tokenLayout defines positioning of various bytes in token.
-// [8:UID][4:expires][2:authLevel][2:serial-number][2:feature-bits][32:signature] = 50 bytes
+// [8:UID][4:expires][2:authLevel][2:serial-number][2:feature-bits][4:issued][32:signature] = 54 bytes
 type tokenLayout struct {
+	// User ID.
+	Uid uint64
+	// Token expiration time.
+	Expires uint32
+	// User's authentication level.
+	AuthLevel uint16
+	// Serial number - to invalidate all issued tokens if needed.
+	SerialNumber uint16
+	// Bitmap with feature bits.
+	Features uint16
+	// Token issue time.
+	Issued uint32
+}
+
+// legacyTokenLayout is the layout of tokens issued before the issue time was added.
+// [8:UID][4:expires][2:authLevel][2:serial-number][2:feature-bits][32:signature] = 50 bytes
+type legacyTokenLayout struct {
 	// User ID.
 	Uid uint64
 	// Token expiration time.
@@ -55,6 +100,8 @@ func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
 		SerialNum int `json:"serial_num"`
 		// Token expiration time
 		ExpireIn int `json:"expire_in"`
+		// How long in seconds to cache the time of revocation of user's tokens.
+		RevocationCache int `json:"revocation_cache"`
 	}
 	var config configType
 	if err := json.Unmarshal(jsonconf, &config); err != nil {
@@ -67,11 +114,19 @@ func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
 	if config.ExpireIn <= 0 {
 		return errors.New("auth_token: invalid expiration value")
 	}
+	if config.RevocationCache < 0 {
+		return errors.New("auth_token: invalid revocation cache value")
+	}
 
 	ta.name = name
 	ta.hmacSalt = config.Key
 	ta.lifetime = time.Duration(config.ExpireIn) * time.Second
 	ta.serialNumber = config.SerialNum
+	ta.revocationTTL = time.Duration(config.RevocationCache) * time.Second
+	if ta.revocationTTL == 0 {
+		ta.revocationTTL = defaultRevocationTTL
+	}
+	ta.revocations = make(map[types.Uid]revocation)
 
 	return nil
 }
@@ -82,12 +137,12 @@ func (ta *authenticator) IsInitialized() bool {
 }
 
 // AddRecord is not supported, will produce an error.
-func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+func (*authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
 	return nil, types.ErrUnsupported
 }
 
 // UpdateRecord is not supported, will produce an error.
-func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+func (*authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
 	return nil, types.ErrUnsupported
 }
 
@@ -95,23 +150,30 @@ func (authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr strin
 func (ta *authenticator) Authenticate(token []byte, remoteAddr string) (*auth.Rec, []byte, error) {
 	var tl tokenLayout
 	dataSize := binary.Size(&tl)
-	if len(token) < dataSize+sha256.Size {
+	if legacySize := binary.Size(&legacyTokenLayout{}); len(token) == legacySize+sha256.Size {
+		// Token issued before the issue time was added. It has no issue time.
+		var lt legacyTokenLayout
+		if err := binary.Read(bytes.NewReader(token), binary.LittleEndian, &lt); err != nil {
+			return nil, nil, types.ErrMalformed
+		}
+		tl = tokenLayout{
+			Uid:          lt.Uid,
+			Expires:      lt.Expires,
+			AuthLevel:    lt.AuthLevel,
+			SerialNumber: lt.SerialNumber,
+			Features:     lt.Features,
+		}
+		dataSize = legacySize
+	} else if len(token) < dataSize+sha256.Size {
 		// Token is too short
 		return nil, nil, types.ErrMalformed
-	}
-
-	buf := bytes.NewBuffer(token)
-	err := binary.Read(buf, binary.LittleEndian, &tl)
-	if err != nil {
+	} else if err := binary.Read(bytes.NewReader(token), binary.LittleEndian, &tl); err != nil {
 		return nil, nil, types.ErrMalformed
 	}
 
-	hbuf := new(bytes.Buffer)
-	binary.Write(hbuf, binary.LittleEndian, &tl)
-
 	// Check signature.
 	hasher := hmac.New(sha256.New, ta.hmacSalt)
-	hasher.Write(hbuf.Bytes())
+	hasher.Write(token[:dataSize])
 	if !hmac.Equal(token[dataSize:dataSize+sha256.Size], hasher.Sum(nil)) {
 		return nil, nil, types.ErrFailed
 	}
@@ -132,6 +194,15 @@ func (ta *authenticator) Authenticate(token []byte, remoteAddr string) (*auth.Re
 		return nil, nil, types.ErrExpired
 	}
 
+	// Check if the token was revoked.
+	revokedAt, err := ta.revokedAt(types.Uid(tl.Uid))
+	if err != nil {
+		return nil, nil, err
+	}
+	if revokedAt > 0 && int64(tl.Issued) <= revokedAt {
+		return nil, nil, types.ErrFailed
+	}
+
 	return &auth.Rec{
 		Uid:       types.Uid(tl.Uid),
 		AuthLevel: auth.Level(tl.AuthLevel),
@@ -148,7 +219,8 @@ func (ta *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
 	} else if rec.Lifetime < 0 {
 		return nil, time.Time{}, types.ErrExpired
 	}
-	expires := time.Now().Add(time.Duration(rec.Lifetime)).UTC().Round(time.Millisecond)
+	now := time.Now().UTC()
+	expires := now.Add(time.Duration(rec.Lifetime)).Round(time.Millisecond)
 
 	tl := tokenLayout{
 		Uid:          uint64(rec.Uid),
@@ -156,6 +228,7 @@ func (ta *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
 		AuthLevel:    uint16(rec.AuthLevel),
 		SerialNumber: uint16(ta.serialNumber),
 		Features:     uint16(rec.Features),
+		Issued:       uint32(now.Unix()),
 	}
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.LittleEndian, &tl)
@@ -167,35 +240,84 @@ func (ta *authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
 }
 
 // AsTag is not supported, will produce an empty string.
-func (authenticator) AsTag(token string) string {
+func (*authenticator) AsTag(token string) string {
 	return ""
 }
 
 // IsUnique is not supported, will produce an error.
-func (authenticator) IsUnique(token []byte, remoteAddr string) (bool, error) {
+func (*authenticator) IsUnique(token []byte, remoteAddr string) (bool, error) {
 	return false, types.ErrUnsupported
 }
 
-// DelRecords adds disabled user ID to a stop list.
-func (authenticator) DelRecords(uid types.Uid) error {
+// DelRecords revokes all tokens issued to the user until now.
+func (ta *authenticator) DelRecords(uid types.Uid) error {
+	now := time.Now().UTC()
+	// Remove times of revocation which outlived the tokens they revoke.
+	store.PCache.Expire(revocationPrefix, now.Add(-ta.lifetime))
+
+	if err := store.PCache.Upsert(revocationPrefix+auth.UidToHex(uid), strconv.FormatInt(now.Unix(), 10), false); err != nil {
+		return err
+	}
+
+	ta.revocationLock.Lock()
+	ta.revocations[uid] = revocation{at: now.Unix(), checked: now}
+	ta.revocationLock.Unlock()
+
 	return nil
 }
 
+// revokedAt returns the Unix time when user's tokens were last revoked or 0 if they were not.
+func (ta *authenticator) revokedAt(uid types.Uid) (int64, error) {
+	now := time.Now()
+
+	ta.revocationLock.Lock()
+	if now.Sub(ta.revocationsPurged) > ta.revocationTTL {
+		for id, rev := range ta.revocations {
+			if now.Sub(rev.checked) > ta.revocationTTL {
+				delete(ta.revocations, id)
+			}
+		}
+		ta.revocationsPurged = now
+	}
+	rev, ok := ta.revocations[uid]
+	ta.revocationLock.Unlock()
+
+	if ok && now.Sub(rev.checked) <= ta.revocationTTL {
+		return rev.at, nil
+	}
+
+	rev = revocation{checked: now}
+	value, err := store.PCache.Get(revocationPrefix + auth.UidToHex(uid))
+	if err == nil {
+		if rev.at, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, types.ErrInternal
+		}
+	} else if err != types.ErrNotFound {
+		return 0, err
+	}
+
+	ta.revocationLock.Lock()
+	ta.revocations[uid] = rev
+	ta.revocationLock.Unlock()
+
+	return rev.at, nil
+}
+
 // RestrictedTags returns tag namespaces restricted by this authenticator (none for token).
-func (authenticator) RestrictedTags() ([]string, error) {
+func (*authenticator) RestrictedTags() ([]string, error) {
 	return nil, nil
 }
 
 // GetResetParams returns authenticator parameters passed to password reset handler
 // (none for token).
-func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+func (*authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
 	return nil, nil
 }
 
 const realName = "token"
 
 // GetRealName returns the hardcoded name of the authenticator.
-func (authenticator) GetRealName() string {
+func (*authenticator) GetRealName() string {
 	return realName
 }
 
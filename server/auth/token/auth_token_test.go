@@ -0,0 +1,144 @@
+package token
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// memCache is an in-memory persistent cache.
+type memCache struct {
+	entries map[string]string
+	gets    int
+}
+
+func (mc *memCache) Get(key string) (string, error) {
+	mc.gets++
+	if val, ok := mc.entries[key]; ok {
+		return val, nil
+	}
+	return "", types.ErrNotFound
+}
+
+func (mc *memCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	mc.entries[key] = value
+	return nil
+}
+
+func (mc *memCache) Delete(key string) error {
+	delete(mc.entries, key)
+	return nil
+}
+
+func (mc *memCache) Expire(keyPrefix string, olderThan time.Time) error {
+	return nil
+}
+
+func newAuthenticator(t *testing.T) (*authenticator, *memCache) {
+	t.Helper()
+
+	mc := &memCache{entries: make(map[string]string)}
+	store.PCache = mc
+	t.Cleanup(func() { store.PCache = nil })
+
+	conf, _ := json.Marshal(map[string]any{
+		"key":              bytes.Repeat([]byte{7}, 32),
+		"serial_num":       1,
+		"expire_in":        3600,
+		"revocation_cache": 60,
+	})
+	ta := &authenticator{}
+	if err := ta.Init(conf, "token"); err != nil {
+		t.Fatal(err)
+	}
+	return ta, mc
+}
+
+func TestRevocation(t *testing.T) {
+	ta, mc := newAuthenticator(t)
+	uid := types.Uid(12345)
+
+	token, _, err := ta.GenSecret(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ta.Authenticate(token, ""); err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+	// The result of the revocation check is cached.
+	if _, _, err := ta.Authenticate(token, ""); err != nil || mc.gets != 1 {
+		t.Error("expected one cache lookup, got", mc.gets, err)
+	}
+
+	if err := ta.DelRecords(uid); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ta.Authenticate(token, ""); err != types.ErrFailed {
+		t.Error("revoked token accepted", err)
+	}
+
+	// Revocation by another cluster node is noticed when the cache expires.
+	other := types.Uid(777)
+	token, _, _ = ta.GenSecret(&auth.Rec{Uid: other, AuthLevel: auth.LevelAuth})
+	if _, _, err := ta.Authenticate(token, ""); err != nil {
+		t.Fatal("valid token rejected", err)
+	}
+	mc.entries[revocationPrefix+auth.UidToHex(other)] = "9999999999"
+	if _, _, err := ta.Authenticate(token, ""); err != nil {
+		t.Error("cached revocation status not used", err)
+	}
+	ta.revocations[other] = revocation{checked: time.Now().Add(-time.Hour)}
+	if _, _, err := ta.Authenticate(token, ""); err != types.ErrFailed {
+		t.Error("revoked token accepted", err)
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	ta, _ := newAuthenticator(t)
+	uid := types.Uid(12345)
+
+	lt := legacyTokenLayout{
+		Uid:          uint64(uid),
+		Expires:      uint32(time.Now().Add(time.Hour).Unix()),
+		AuthLevel:    uint16(auth.LevelAuth),
+		SerialNumber: 1,
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &lt)
+	hasher := hmac.New(sha256.New, ta.hmacSalt)
+	hasher.Write(buf.Bytes())
+	buf.Write(hasher.Sum(nil))
+	token := buf.Bytes()
+
+	rec, _, err := ta.Authenticate(token, "")
+	if err != nil {
+		t.Fatal("legacy token rejected", err)
+	}
+	if rec.Uid != uid || rec.AuthLevel != auth.LevelAuth {
+		t.Error("wrong record", rec)
+	}
+
+	// Legacy tokens have no issue time, they are revoked by any revocation.
+	ta.DelRecords(uid)
+	if _, _, err := ta.Authenticate(token, ""); err != types.ErrFailed {
+		t.Error("revoked legacy token accepted", err)
+	}
+
+	// Tampered token.
+	token[0] ^= 1
+	if _, _, err := ta.Authenticate(token, ""); err != types.ErrFailed {
+		t.Error("tampered token accepted", err)
+	}
+	if _, _, err := ta.Authenticate([]byte(strings.Repeat("x", 20)), ""); err != types.ErrMalformed {
+		t.Error("short token accepted", err)
+	}
+}
@@ -0,0 +1,604 @@
+// Package totp implements two-factor authentication by time-based one-time passwords (RFC 6238).
+//
+// TOTP is a second factor for other authenticators, "basic" by default. When a user with TOTP enabled
+// logs in using the primary scheme, the login is not completed. Instead the server issues a challenge
+// with a short-lived ticket. The login is completed by {login scheme="totp" secret="<ticket>:<code>"}
+// where the code is generated by the authenticator app or is one of the backup codes.
+//
+// The user enrolls by {acc scheme="totp"} with the secret "enroll", then confirms enrollment with
+// "confirm:<code>". The secret "backup:<code>" generates new backup codes, "disable:<code>" disables
+// TOTP. The administrator may make TOTP mandatory for the account. Such users cannot disable TOTP
+// and must enroll at the next login.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Length of the shared key in bytes.
+	keyLength = 20
+	// Duration of one time step.
+	timeStep = 30
+	// Number of digits in a code.
+	codeDigits = 6
+	// Length of the random part of the login ticket in bytes.
+	ticketLength = 16
+	// Length of a backup code in characters.
+	backupCodeLength = 10
+
+	defaultIssuer         = "Tinode"
+	defaultTicketLifetime = 300
+	defaultMaxRetries     = 5
+	defaultBackupCodes    = 10
+	defaultSkew           = 1
+)
+
+// Alphabet of backup codes: lowercase letters and digits without easily confused 0, 1, l, o.
+const backupAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+// record is the TOTP state of the account saved as the secret of the auth record.
+type record struct {
+	// Shared key.
+	Key []byte `json:"key,omitempty"`
+	// Enrollment is completed by entering a valid code.
+	Confirmed bool `json:"confirmed,omitempty"`
+	// Bcrypt hashes of unused backup codes.
+	Backup [][]byte `json:"backup,omitempty"`
+	// TOTP is mandatory for the account.
+	Required bool `json:"required,omitempty"`
+	// The last accepted time step. Codes cannot be used twice.
+	LastStep int64 `json:"last,omitempty"`
+}
+
+// challenge is sent to the client when the second step of the login is required.
+type challenge struct {
+	// Scheme to use for the second step.
+	Scheme string `json:"scheme"`
+	// Ticket to include into the secret of the second step.
+	Ticket string `json:"ticket"`
+	// Ticket expiration time.
+	Expires time.Time `json:"expires"`
+	// Enrollment parameters if the user must enroll before completing the login.
+	Enroll map[string]any `json:"enroll,omitempty"`
+}
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name           string
+	issuer         string
+	schemes        map[string]bool
+	ticketLifetime time.Duration
+	maxRetries     int
+	backupCodes    int
+	skew           int
+}
+
+var handler = &authenticator{}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (ta *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_totp: authenticator name cannot be blank")
+	}
+
+	if ta.name != "" {
+		return errors.New("auth_totp: already initialized as " + ta.name + "; " + name)
+	}
+
+	type configType struct {
+		// Name of the service shown by authenticator apps.
+		Issuer string `json:"issuer"`
+		// Authentication schemes which require the second factor, ["basic"] by default.
+		Schemes []string `json:"schemes"`
+		// Lifetime of the login ticket in seconds.
+		TicketLifetime int `json:"ticket_lifetime"`
+		// Maximum number of attempts to enter the code per ticket.
+		MaxRetries int `json:"max_retries"`
+		// Number of backup codes.
+		BackupCodes int `json:"backup_codes"`
+		// Number of time steps before and after the current one which are accepted to compensate clock drift.
+		Skew *int `json:"skew"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_totp: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.TicketLifetime < 0 || config.MaxRetries < 0 || config.BackupCodes < 0 {
+		return errors.New("auth_totp: invalid config value")
+	}
+	if config.Skew != nil && (*config.Skew < 0 || *config.Skew > 10) {
+		return errors.New("auth_totp: invalid skew")
+	}
+
+	ta.issuer = config.Issuer
+	if ta.issuer == "" {
+		ta.issuer = defaultIssuer
+	}
+	if len(config.Schemes) == 0 {
+		config.Schemes = []string{"basic"}
+	}
+	ta.schemes = make(map[string]bool)
+	for _, scheme := range config.Schemes {
+		if scheme == name {
+			return errors.New("auth_totp: cannot be a second factor for itself")
+		}
+		ta.schemes[strings.ToLower(scheme)] = true
+	}
+	ta.ticketLifetime = time.Duration(config.TicketLifetime) * time.Second
+	if ta.ticketLifetime == 0 {
+		ta.ticketLifetime = defaultTicketLifetime * time.Second
+	}
+	ta.maxRetries = config.MaxRetries
+	if ta.maxRetries == 0 {
+		ta.maxRetries = defaultMaxRetries
+	}
+	ta.backupCodes = config.BackupCodes
+	if ta.backupCodes == 0 {
+		ta.backupCodes = defaultBackupCodes
+	}
+	ta.skew = defaultSkew
+	if config.Skew != nil {
+		ta.skew = *config.Skew
+	}
+	ta.name = name
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (ta *authenticator) IsInitialized() bool {
+	return ta.name != ""
+}
+
+// AddRecord is not supported, will produce an error. TOTP cannot be the only authentication scheme of an account.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord manages the user's enrollment. The secret is one of "enroll", "confirm:<code>",
+// "backup:<code>", "disable:<code>". Enrollment parameters and new backup codes are returned in rec.Params.
+func (ta *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	action, code, _ := strings.Cut(string(secret), ":")
+
+	tr, err := ta.loadRecord(rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case "enroll":
+		if tr != nil && tr.Confirmed {
+			// Must disable TOTP first.
+			return nil, types.ErrDuplicate
+		}
+		isNew := tr == nil
+		if isNew {
+			tr = &record{}
+		}
+		if rec.Params, err = ta.enroll(rec.Uid, tr); err != nil {
+			return nil, err
+		}
+		err = ta.saveRecord(rec.Uid, tr, isNew)
+	case "confirm":
+		if tr == nil || tr.Key == nil {
+			return nil, types.ErrNotFound
+		}
+		if tr.Confirmed {
+			return nil, types.ErrDuplicate
+		}
+		step, ok := ta.verifyCode(tr, code, time.Now())
+		if !ok {
+			return nil, types.ErrFailed
+		}
+		tr.Confirmed = true
+		tr.LastStep = step
+		err = ta.saveRecord(rec.Uid, tr, false)
+	case "backup":
+		if tr == nil || !tr.Confirmed {
+			return nil, types.ErrNotFound
+		}
+		step, ok := ta.verifyCode(tr, code, time.Now())
+		if !ok {
+			return nil, types.ErrFailed
+		}
+		tr.LastStep = step
+		var codes []string
+		if codes, tr.Backup, err = ta.newBackupCodes(); err != nil {
+			return nil, err
+		}
+		rec.Params = map[string]any{"backup": codes}
+		err = ta.saveRecord(rec.Uid, tr, false)
+	case "disable":
+		if tr == nil || !tr.Confirmed {
+			return nil, types.ErrNotFound
+		}
+		if tr.Required {
+			return nil, types.ErrPolicy
+		}
+		if _, ok := ta.verifyCode(tr, code, time.Now()); !ok && !ta.useBackupCode(tr, code) {
+			return nil, types.ErrFailed
+		}
+		err = store.Users.DelAuthRecords(rec.Uid, ta.name)
+	default:
+		return nil, types.ErrMalformed
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Authenticate completes the login started with another scheme.
+// The secret is structured as <ticket>:<code> where the code is either a TOTP code or a backup code.
+func (ta *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	ticket, code, found := strings.Cut(string(secret), ":")
+	if !found || len(ticket) != ticketLength*2 {
+		return nil, nil, types.ErrMalformed
+	}
+	if _, err := hex.DecodeString(ticket); err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+
+	key := realName + "_" + ticket
+	value, err := store.PCache.Get(key)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return nil, nil, err
+	}
+
+	// issued:uid:authLevel:features:count
+	parts := strings.Split(value, ":")
+	if len(parts) != 5 {
+		return nil, nil, types.ErrInternal
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	uid := types.ParseUid(parts[1])
+	authLvl, err := strconv.Atoi(parts[2])
+	if err != nil || uid.IsZero() || auth.Level(authLvl) > auth.LevelRoot {
+		return nil, nil, types.ErrInternal
+	}
+	features, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	count, err := strconv.Atoi(parts[4])
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+
+	now := time.Now()
+	if !now.Before(time.Unix(issued, 0).Add(ta.ticketLifetime)) || count >= ta.maxRetries {
+		if err = store.PCache.Delete(key); err != nil {
+			logs.Warn.Println("totp_auth: error deleting key", key, err)
+		}
+		return nil, nil, types.ErrExpired
+	}
+
+	tr, err := ta.loadRecord(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tr == nil || tr.Key == nil {
+		// TOTP was disabled or reset after the ticket was issued.
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+
+	if step, ok := ta.verifyCode(tr, code, now); ok {
+		tr.LastStep = step
+	} else if !ta.useBackupCode(tr, code) {
+		// Update count of attempts. If the update fails, the error is ignored.
+		store.PCache.Upsert(key, strings.Join(parts[:4], ":")+":"+strconv.Itoa(count+1), false)
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+
+	// The user who was required to enroll at login has completed the enrollment.
+	tr.Confirmed = true
+	if err = ta.saveRecord(uid, tr, false); err != nil {
+		return nil, nil, err
+	}
+
+	// Success. The ticket cannot be used again.
+	if err = store.PCache.Delete(key); err != nil {
+		logs.Warn.Println("totp_auth: error deleting key", key, err)
+	}
+
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: auth.Level(authLvl),
+		Features:  auth.Feature(features),
+		State:     types.StateUndefined}, nil, nil
+}
+
+// Challenge issues a login ticket if the user authenticated by the given scheme has enabled TOTP or
+// is required to use it. Implements auth.SecondFactor.
+func (ta *authenticator) Challenge(scheme string, rec *auth.Rec) ([]byte, error) {
+	if !ta.schemes[strings.ToLower(scheme)] {
+		return nil, nil
+	}
+
+	tr, err := ta.loadRecord(rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if tr == nil || (!tr.Confirmed && !tr.Required) {
+		return nil, nil
+	}
+
+	// Run garbage collection of expired tickets.
+	store.PCache.Expire(realName+"_", time.Now().UTC().Add(-ta.ticketLifetime))
+
+	id := make([]byte, ticketLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, types.ErrInternal
+	}
+	now := time.Now().UTC()
+	ch := challenge{
+		Scheme:  ta.name,
+		Ticket:  hex.EncodeToString(id),
+		Expires: now.Add(ta.ticketLifetime).Round(time.Millisecond),
+	}
+
+	if !tr.Confirmed {
+		// Enrollment is mandatory: start it now, it's completed by the second step of the login.
+		if ch.Enroll, err = ta.enroll(rec.Uid, tr); err != nil {
+			return nil, err
+		}
+		if err = ta.saveRecord(rec.Uid, tr, false); err != nil {
+			return nil, err
+		}
+	}
+
+	value := strconv.FormatInt(now.Unix(), 10) + ":" + rec.Uid.String() + ":" +
+		strconv.Itoa(int(rec.AuthLevel)) + ":" + strconv.Itoa(int(rec.Features)) + ":0"
+	if err = store.PCache.Upsert(realName+"_"+ch.Ticket, value, true); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&ch)
+}
+
+// GenSecret is not supported, will produce an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords deletes the TOTP record of the user.
+func (ta *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, ta.name)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for TOTP).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for TOTP).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// SetRequired makes TOTP mandatory or optional for the user.
+func SetRequired(uid types.Uid, required bool) error {
+	if !handler.IsInitialized() {
+		return types.ErrUnsupported
+	}
+
+	tr, err := handler.loadRecord(uid)
+	if err != nil {
+		return err
+	}
+	if tr == nil {
+		if !required {
+			return nil
+		}
+		return handler.saveRecord(uid, &record{Required: true}, true)
+	}
+	tr.Required = required
+	if !tr.Required && !tr.Confirmed {
+		// Enrollment was never completed.
+		return store.Users.DelAuthRecords(uid, handler.name)
+	}
+	return handler.saveRecord(uid, tr, false)
+}
+
+// Reset removes the user's enrollment, i.e. when the user has lost the device and the backup codes.
+// If TOTP is mandatory for the user, the user will have to enroll again at the next login.
+func Reset(uid types.Uid) error {
+	if !handler.IsInitialized() {
+		return types.ErrUnsupported
+	}
+
+	tr, err := handler.loadRecord(uid)
+	if err != nil || tr == nil {
+		return err
+	}
+	if !tr.Required {
+		return store.Users.DelAuthRecords(uid, handler.name)
+	}
+	return handler.saveRecord(uid, &record{Required: true}, false)
+}
+
+// loadRecord reads the user's TOTP record. Returns nil if the user has no record.
+func (ta *authenticator) loadRecord(uid types.Uid) (*record, error) {
+	_, _, secret, _, err := store.Users.GetAuthRecord(uid, ta.name)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = nil
+		}
+		return nil, err
+	}
+
+	var tr record
+	if err = json.Unmarshal(secret, &tr); err != nil {
+		return nil, types.ErrInternal
+	}
+	return &tr, nil
+}
+
+// saveRecord creates or updates the user's TOTP record.
+func (ta *authenticator) saveRecord(uid types.Uid, tr *record, isNew bool) error {
+	secret, err := json.Marshal(tr)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		return store.Users.AddAuthRecord(uid, auth.LevelAuth, ta.name, uid.String(), secret, time.Time{})
+	}
+	return store.Users.UpdateAuthRecord(uid, auth.LevelAuth, ta.name, uid.String(), secret, time.Time{})
+}
+
+// enroll generates a new key and backup codes. Returns enrollment parameters for the client.
+func (ta *authenticator) enroll(uid types.Uid, tr *record) (map[string]any, error) {
+	tr.Key = make([]byte, keyLength)
+	if _, err := rand.Read(tr.Key); err != nil {
+		return nil, types.ErrInternal
+	}
+	tr.Confirmed = false
+	tr.LastStep = 0
+
+	codes, hashes, err := ta.newBackupCodes()
+	if err != nil {
+		return nil, err
+	}
+	tr.Backup = hashes
+
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(tr.Key)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", ta.issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(codeDigits))
+	query.Set("period", strconv.Itoa(timeStep))
+	otpauth := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + ta.issuer + ":" + uid.UserId(),
+		RawQuery: query.Encode(),
+	}
+
+	return map[string]any{
+		"url":    otpauth.String(),
+		"secret": secret,
+		"backup": codes,
+	}, nil
+}
+
+// verifyCode checks the TOTP code against the current time step and the steps within the allowed skew.
+// Returns the matched time step.
+func (ta *authenticator) verifyCode(tr *record, code string, now time.Time) (int64, bool) {
+	if len(code) != codeDigits || tr.Key == nil {
+		return 0, false
+	}
+
+	current := now.Unix() / timeStep
+	for step := current - int64(ta.skew); step <= current+int64(ta.skew); step++ {
+		if step <= tr.LastStep {
+			// Already used.
+			continue
+		}
+		if hmac.Equal([]byte(generateCode(tr.Key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useBackupCode checks the backup code and removes it from the record if it's valid.
+func (ta *authenticator) useBackupCode(tr *record, code string) bool {
+	code = strings.ToLower(strings.ReplaceAll(code, "-", ""))
+	if len(code) != backupCodeLength {
+		return false
+	}
+	for i, hash := range tr.Backup {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) == nil {
+			tr.Backup = append(tr.Backup[:i], tr.Backup[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// newBackupCodes generates backup codes. Returns codes formatted for the user and their hashes.
+func (ta *authenticator) newBackupCodes() ([]string, [][]byte, error) {
+	codes := make([]string, ta.backupCodes)
+	hashes := make([][]byte, ta.backupCodes)
+	buf := make([]byte, backupCodeLength)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, types.ErrInternal
+		}
+		for j := range buf {
+			// The alphabet has 32 characters, so the distribution is uniform.
+			buf[j] = backupAlphabet[buf[j]%byte(len(backupAlphabet))]
+		}
+		hash, err := bcrypt.GenerateFromPassword(buf, bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, types.ErrInternal
+		}
+		codes[i] = string(buf[:backupCodeLength/2]) + "-" + string(buf[backupCodeLength/2:])
+		hashes[i] = hash
+	}
+	return codes, hashes, nil
+}
+
+// generateCode calculates the TOTP code for the given time step (RFC 6238, RFC 4226).
+func generateCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	hasher := hmac.New(sha1.New, key)
+	hasher.Write(msg[:])
+	sum := hasher.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.FormatUint(uint64(value%1000000), 10)
+	return strings.Repeat("0", codeDigits-len(code)) + code
+}
+
+const realName = "totp"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, handler)
+}
@@ -0,0 +1,75 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestGenerateCode(t *testing.T) {
+	// Test vectors from RFC 6238, Appendix B, truncated to 6 digits.
+	key := []byte("12345678901234567890")
+	cases := []struct {
+		ts   int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tc := range cases {
+		if code := generateCode(key, tc.ts/timeStep); code != tc.code {
+			t.Errorf("generateCode(%d) = %s, expected %s", tc.ts, code, tc.code)
+		}
+	}
+}
+
+func TestVerifyCode(t *testing.T) {
+	ta := &authenticator{skew: 1}
+	tr := &record{Key: []byte("12345678901234567890")}
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / timeStep
+
+	if _, ok := ta.verifyCode(tr, generateCode(tr.Key, current+2), now); ok {
+		t.Error("code outside of the allowed skew accepted")
+	}
+	if _, ok := ta.verifyCode(tr, "12345", now); ok {
+		t.Error("short code accepted")
+	}
+	step, ok := ta.verifyCode(tr, generateCode(tr.Key, current-1), now)
+	if !ok || step != current-1 {
+		t.Fatal("valid code rejected", step, ok)
+	}
+
+	// Codes of the used and the earlier steps are not accepted again.
+	tr.LastStep = step
+	if _, ok := ta.verifyCode(tr, generateCode(tr.Key, current-1), now); ok {
+		t.Error("used code accepted again")
+	}
+	if _, ok := ta.verifyCode(tr, generateCode(tr.Key, current), now); !ok {
+		t.Error("code of the next step rejected")
+	}
+}
+
+func TestUseBackupCode(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("abcdefghij"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := &authenticator{}
+	tr := &record{Backup: [][]byte{hash}}
+
+	if ta.useBackupCode(tr, "abcde-fghik") {
+		t.Error("invalid backup code accepted")
+	}
+	if !ta.useBackupCode(tr, "ABCDE-FGHIJ") {
+		t.Fatal("valid backup code rejected")
+	}
+	if ta.useBackupCode(tr, "abcdefghij") {
+		t.Error("backup code accepted twice")
+	}
+}
@@ -0,0 +1,684 @@
+// Package webauthn implements passwordless authentication by WebAuthn credentials (passkeys).
+//
+// A logged in user registers a passkey in two steps: {acc scheme="webauthn"} with the secret
+// {"op":"register"} returns credential creation options for navigator.credentials.create() in
+// params.options; then the secret {"op":"finish","credential":<PublicKeyCredential>} saves the new
+// credential. The login starts with {login scheme="webauthn"} with an empty secret. The server responds
+// with a challenge containing credential request options for navigator.credentials.get(). The login is
+// completed by {login scheme="webauthn"} with the resulting PublicKeyCredential as the secret.
+// Credentials and binary fields are JSON-serialized with base64url-encoded binary fields.
+//
+// Credentials are discoverable (resident) keys, so the user is identified by the authenticator without
+// entering a login. All user's credentials are kept in a single authentication record.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Length of the challenge in bytes.
+	challengeLength = 32
+
+	defaultTimeout        = 300
+	defaultMaxCredentials = 10
+
+	// Authenticator data flags.
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+
+	// Purposes of the challenges.
+	purposeRegister = "reg"
+	purposeLogin    = "login"
+)
+
+// credential is a registered WebAuthn credential.
+type credential struct {
+	// Credential ID.
+	Id []byte `json:"id"`
+	// User-provided name of the credential.
+	Name string `json:"name,omitempty"`
+	// Public key in COSE format.
+	PublicKey []byte `json:"key"`
+	// Signature counter.
+	SignCount uint32 `json:"count,omitempty"`
+	// Authenticator model.
+	AAGUID    []byte     `json:"aaguid,omitempty"`
+	CreatedAt time.Time  `json:"created"`
+	UsedAt    *time.Time `json:"used,omitempty"`
+}
+
+// request is the secret of {acc} requests.
+type request struct {
+	// Operation: "register", "finish", "list", "delete".
+	Op string `json:"op"`
+	// Name of the credential for "register".
+	Name string `json:"name,omitempty"`
+	// New credential for "finish".
+	Credential *publicKeyCredential `json:"credential,omitempty"`
+	// Credential ID for "delete", base64url-encoded.
+	Id string `json:"id,omitempty"`
+}
+
+// publicKeyCredential is the PublicKeyCredential created by the client with binary fields base64url-encoded.
+type publicKeyCredential struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON string `json:"clientDataJSON"`
+		// Registration only.
+		AttestationObject string `json:"attestationObject,omitempty"`
+		// Login only.
+		AuthenticatorData string `json:"authenticatorData,omitempty"`
+		Signature         string `json:"signature,omitempty"`
+		UserHandle        string `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+// clientData is the parsed clientDataJSON.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// authenticator is a singleton instance of the authenticator.
+type authenticator struct {
+	name             string
+	rpId             string
+	rpName           string
+	origins          []string
+	attestation      string
+	userVerification string
+	timeout          time.Duration
+	maxCredentials   int
+}
+
+// Init initializes the authenticator: parses the config and sets internal state.
+func (wa *authenticator) Init(jsonconf json.RawMessage, name string) error {
+	if name == "" {
+		return errors.New("auth_webauthn: authenticator name cannot be blank")
+	}
+
+	if wa.name != "" {
+		return errors.New("auth_webauthn: already initialized as " + wa.name + "; " + name)
+	}
+
+	type configType struct {
+		// Relying party ID: the domain of the web app, e.g. "example.com".
+		RPID string `json:"rp_id"`
+		// Human-readable name of the service.
+		RPName string `json:"rp_name"`
+		// Origins of the apps allowed to use the credentials, e.g. "https://web.example.com".
+		Origins []string `json:"origins"`
+		// Attestation conveyance preference: "none" (default), "indirect" or "direct".
+		Attestation string `json:"attestation"`
+		// User verification requirement: "required", "preferred" (default) or "discouraged".
+		UserVerification string `json:"user_verification"`
+		// Time in seconds given to the user to complete the registration or the login.
+		Timeout int `json:"timeout"`
+		// Maximum number of credentials of one user.
+		MaxCredentials int `json:"max_credentials"`
+	}
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("auth_webauthn: failed to parse config: " + err.Error() + "(" + string(jsonconf) + ")")
+	}
+
+	if config.RPID == "" || len(config.Origins) == 0 {
+		return errors.New("auth_webauthn: rp_id and origins are required")
+	}
+	switch config.Attestation {
+	case "":
+		config.Attestation = "none"
+	case "none", "indirect", "direct":
+	default:
+		return errors.New("auth_webauthn: invalid attestation '" + config.Attestation + "'")
+	}
+	switch config.UserVerification {
+	case "":
+		config.UserVerification = "preferred"
+	case "required", "preferred", "discouraged":
+	default:
+		return errors.New("auth_webauthn: invalid user_verification '" + config.UserVerification + "'")
+	}
+	if config.Timeout < 0 || config.MaxCredentials < 0 {
+		return errors.New("auth_webauthn: invalid config value")
+	}
+
+	wa.rpId = config.RPID
+	wa.rpName = config.RPName
+	if wa.rpName == "" {
+		wa.rpName = wa.rpId
+	}
+	wa.origins = config.Origins
+	wa.attestation = config.Attestation
+	wa.userVerification = config.UserVerification
+	wa.timeout = time.Duration(config.Timeout) * time.Second
+	if wa.timeout == 0 {
+		wa.timeout = defaultTimeout * time.Second
+	}
+	wa.maxCredentials = config.MaxCredentials
+	if wa.maxCredentials == 0 {
+		wa.maxCredentials = defaultMaxCredentials
+	}
+	wa.name = name
+
+	return nil
+}
+
+// IsInitialized returns true if the handler is initialized.
+func (wa *authenticator) IsInitialized() bool {
+	return wa.name != ""
+}
+
+// AddRecord is not supported, will produce an error. Passkeys are added to existing accounts.
+func (authenticator) AddRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	return nil, types.ErrUnsupported
+}
+
+// UpdateRecord registers, lists and deletes user's credentials. The secret is a JSON-encoded request.
+// Credential creation options and the list of credentials are returned in rec.Params.
+func (wa *authenticator) UpdateRecord(rec *auth.Rec, secret []byte, remoteAddr string) (*auth.Rec, error) {
+	var req request
+	if err := json.Unmarshal(secret, &req); err != nil {
+		return nil, types.ErrMalformed
+	}
+
+	creds, isNew, err := wa.loadCredentials(rec.Uid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Op {
+	case "register":
+		if len(creds) >= wa.maxCredentials {
+			return nil, types.ErrPolicy
+		}
+		challenge, err := wa.newChallenge(rec.Uid, purposeRegister)
+		if err != nil {
+			return nil, err
+		}
+		rec.Params = map[string]any{"options": wa.creationOptions(rec.Uid, req.Name, challenge, creds)}
+		return rec, nil
+	case "finish":
+		if req.Credential == nil {
+			return nil, types.ErrMalformed
+		}
+		if len(creds) >= wa.maxCredentials {
+			return nil, types.ErrPolicy
+		}
+		cred, err := wa.verifyRegistration(rec.Uid, req.Credential)
+		if err != nil {
+			return nil, err
+		}
+		for i := range creds {
+			if bytes.Equal(creds[i].Id, cred.Id) {
+				return nil, types.ErrDuplicate
+			}
+		}
+		cred.Name = req.Name
+		creds = append(creds, *cred)
+	case "list":
+		rec.Params = map[string]any{"credentials": credentialList(creds)}
+		return rec, nil
+	case "delete":
+		id, err := decodeB64(req.Id)
+		if err != nil {
+			return nil, types.ErrMalformed
+		}
+		idx := slices.IndexFunc(creds, func(cr credential) bool { return bytes.Equal(cr.Id, id) })
+		if idx < 0 {
+			return nil, types.ErrNotFound
+		}
+		creds = slices.Delete(creds, idx, idx+1)
+		if len(creds) == 0 {
+			return rec, store.Users.DelAuthRecords(rec.Uid, wa.name)
+		}
+	default:
+		return nil, types.ErrMalformed
+	}
+
+	if err = wa.saveCredentials(rec.Uid, creds, isNew); err != nil {
+		return nil, err
+	}
+	rec.Params = map[string]any{"credentials": credentialList(creds)}
+	return rec, nil
+}
+
+// Authenticate starts the login if the secret is empty: issues a challenge with credential request options.
+// Otherwise verifies the secret which is a JSON-encoded assertion created by the client.
+func (wa *authenticator) Authenticate(secret []byte, remoteAddr string) (*auth.Rec, []byte, error) {
+	if len(secret) == 0 {
+		challenge, err := wa.newChallenge(types.ZeroUid, purposeLogin)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := json.Marshal(wa.requestOptions(challenge))
+		return nil, resp, err
+	}
+
+	var assertion publicKeyCredential
+	if err := json.Unmarshal(secret, &assertion); err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+
+	cdJSON, err := decodeB64(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	if _, err = wa.checkClientData(cdJSON, "webauthn.get", types.ZeroUid, purposeLogin); err != nil {
+		return nil, nil, err
+	}
+
+	// User handle is the user ID set at registration.
+	userHandle, err := decodeB64(assertion.Response.UserHandle)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	uid := types.ParseUid(string(userHandle))
+	id, err := decodeB64(assertion.RawId)
+	if uid.IsZero() || err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+
+	_, authLvl, raw, _, err := store.Users.GetAuthRecord(uid, wa.name)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return nil, nil, err
+	}
+	var creds []credential
+	if err = json.Unmarshal(raw, &creds); err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	idx := slices.IndexFunc(creds, func(cr credential) bool { return bytes.Equal(cr.Id, id) })
+	if idx < 0 {
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+	cred := &creds[idx]
+
+	authData, err := decodeB64(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	signature, err := decodeB64(assertion.Response.Signature)
+	if err != nil {
+		return nil, nil, types.ErrMalformed
+	}
+	_, count, err := wa.checkAuthData(authData)
+	if err != nil {
+		return &auth.Rec{Uid: uid}, nil, err
+	}
+
+	pub, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, nil, types.ErrInternal
+	}
+	cdHash := sha256.Sum256(cdJSON)
+	if err = verifySignature(alg, pub, slices.Concat(authData, cdHash[:]), signature); err != nil {
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+
+	// A counter which does not increase means the authenticator may have been cloned.
+	if (count != 0 || cred.SignCount != 0) && count <= cred.SignCount {
+		logs.Warn.Println("webauthn_auth: signature counter did not increase", uid, count, cred.SignCount)
+		return &auth.Rec{Uid: uid}, nil, types.ErrFailed
+	}
+	now := types.TimeNow()
+	cred.SignCount = count
+	cred.UsedAt = &now
+	if err = wa.saveCredentials(uid, creds, false); err != nil {
+		return nil, nil, err
+	}
+
+	if authLvl == auth.LevelNone {
+		authLvl = auth.LevelAuth
+	}
+	return &auth.Rec{
+		Uid:       uid,
+		AuthLevel: authLvl,
+		State:     types.StateUndefined}, nil, nil
+}
+
+// GenSecret is not supported, will produce an error.
+func (authenticator) GenSecret(rec *auth.Rec) ([]byte, time.Time, error) {
+	return nil, time.Time{}, types.ErrUnsupported
+}
+
+// AsTag is not supported, will produce an empty string.
+func (authenticator) AsTag(token string) string {
+	return ""
+}
+
+// IsUnique is not supported, will produce an error.
+func (authenticator) IsUnique(secret []byte, remoteAddr string) (bool, error) {
+	return false, types.ErrUnsupported
+}
+
+// DelRecords deletes all credentials of the user.
+func (wa *authenticator) DelRecords(uid types.Uid) error {
+	return store.Users.DelAuthRecords(uid, wa.name)
+}
+
+// RestrictedTags returns tag namespaces restricted by this authenticator (none for WebAuthn).
+func (authenticator) RestrictedTags() ([]string, error) {
+	return nil, nil
+}
+
+// GetResetParams returns authenticator parameters passed to password reset handler
+// (none for WebAuthn).
+func (authenticator) GetResetParams(uid types.Uid) (map[string]any, error) {
+	return nil, nil
+}
+
+// loadCredentials reads the user's credentials. Returns true if the user has no record yet.
+func (wa *authenticator) loadCredentials(uid types.Uid) ([]credential, bool, error) {
+	_, _, raw, _, err := store.Users.GetAuthRecord(uid, wa.name)
+	if err != nil {
+		if err == types.ErrNotFound {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	var creds []credential
+	if err = json.Unmarshal(raw, &creds); err != nil {
+		return nil, false, types.ErrInternal
+	}
+	return creds, false, nil
+}
+
+// saveCredentials creates or updates the user's authentication record.
+func (wa *authenticator) saveCredentials(uid types.Uid, creds []credential, isNew bool) error {
+	raw, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		return store.Users.AddAuthRecord(uid, auth.LevelAuth, wa.name, uid.String(), raw, time.Time{})
+	}
+	return store.Users.UpdateAuthRecord(uid, auth.LevelAuth, wa.name, uid.String(), raw, time.Time{})
+}
+
+// newChallenge generates a random challenge and saves it for verification. Registration challenges
+// are bound to the user.
+func (wa *authenticator) newChallenge(uid types.Uid, purpose string) ([]byte, error) {
+	// Run garbage collection of expired challenges.
+	store.PCache.Expire(realName+"_", time.Now().UTC().Add(-wa.timeout))
+
+	challenge := make([]byte, challengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, types.ErrInternal
+	}
+
+	// issued:purpose:uid
+	value := strconv.FormatInt(time.Now().Unix(), 10) + ":" + purpose + ":" + uid.String()
+	if err := store.PCache.Upsert(keyForChallenge(challenge), value, true); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// useChallenge checks that the challenge was issued for the purpose and the user, and has not expired.
+// The challenge is removed: it cannot be used twice.
+func (wa *authenticator) useChallenge(challenge []byte, uid types.Uid, purpose string) error {
+	if len(challenge) != challengeLength {
+		return types.ErrMalformed
+	}
+
+	key := keyForChallenge(challenge)
+	value, err := store.PCache.Get(key)
+	if err != nil {
+		if err == types.ErrNotFound {
+			err = types.ErrFailed
+		}
+		return err
+	}
+	if err = store.PCache.Delete(key); err != nil {
+		logs.Warn.Println("webauthn_auth: error deleting key", key, err)
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return types.ErrInternal
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return types.ErrInternal
+	}
+	if !time.Now().Before(time.Unix(issued, 0).Add(wa.timeout)) {
+		return types.ErrExpired
+	}
+	if parts[1] != purpose || types.ParseUid(parts[2]) != uid {
+		return types.ErrFailed
+	}
+	return nil
+}
+
+// checkClientData verifies the client data: the type of the ceremony, the challenge and the origin.
+func (wa *authenticator) checkClientData(cdJSON []byte, ceremony string, uid types.Uid, purpose string) (*clientData, error) {
+	var cd clientData
+	if err := json.Unmarshal(cdJSON, &cd); err != nil {
+		return nil, types.ErrMalformed
+	}
+	if cd.Type != ceremony {
+		return nil, types.ErrMalformed
+	}
+	challenge, err := decodeB64(cd.Challenge)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	if err = wa.useChallenge(challenge, uid, purpose); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(wa.origins, cd.Origin) {
+		return nil, types.ErrFailed
+	}
+	return &cd, nil
+}
+
+// checkAuthData verifies the relying party ID hash and the flags of the authenticator data.
+// Returns the flags and the signature counter.
+func (wa *authenticator) checkAuthData(authData []byte) (byte, uint32, error) {
+	if len(authData) < 37 {
+		return 0, 0, types.ErrMalformed
+	}
+	rpIdHash := sha256.Sum256([]byte(wa.rpId))
+	if subtle.ConstantTimeCompare(authData[:32], rpIdHash[:]) != 1 {
+		return 0, 0, types.ErrFailed
+	}
+	flags := authData[32]
+	if flags&flagUserPresent == 0 {
+		return 0, 0, types.ErrFailed
+	}
+	if wa.userVerification == "required" && flags&flagUserVerified == 0 {
+		return 0, 0, types.ErrFailed
+	}
+	return flags, binary.BigEndian.Uint32(authData[33:37]), nil
+}
+
+// verifyRegistration verifies the new credential created by the client.
+func (wa *authenticator) verifyRegistration(uid types.Uid, pkc *publicKeyCredential) (*credential, error) {
+	cdJSON, err := decodeB64(pkc.Response.ClientDataJSON)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	if _, err = wa.checkClientData(cdJSON, "webauthn.create", uid, purposeRegister); err != nil {
+		return nil, err
+	}
+
+	attObj, err := decodeB64(pkc.Response.AttestationObject)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	val, _, err := decodeCBOR(attObj)
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	att, _ := val.(map[any]any)
+	format, _ := att["fmt"].(string)
+	attStmt, _ := att["attStmt"].(map[any]any)
+	authData, _ := att["authData"].([]byte)
+	if format == "" || attStmt == nil || authData == nil {
+		return nil, types.ErrMalformed
+	}
+
+	flags, count, err := wa.checkAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if flags&flagAttested == 0 {
+		return nil, types.ErrMalformed
+	}
+
+	// Attested credential data: [16:aaguid][2:length][length:credential ID][COSE public key].
+	data := authData[37:]
+	if len(data) < 18 {
+		return nil, types.ErrMalformed
+	}
+	aaguid := data[:16]
+	idLen := int(binary.BigEndian.Uint16(data[16:18]))
+	data = data[18:]
+	if idLen == 0 || len(data) < idLen {
+		return nil, types.ErrMalformed
+	}
+	id := data[:idLen]
+	if rawId, err := decodeB64(pkc.RawId); err != nil || !bytes.Equal(rawId, id) {
+		return nil, types.ErrMalformed
+	}
+	_, rest, err := decodeCBOR(data[idLen:])
+	if err != nil {
+		return nil, types.ErrMalformed
+	}
+	coseKey := data[idLen : len(data)-len(rest)]
+	pub, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if wa.attestation != "none" {
+		cdHash := sha256.Sum256(cdJSON)
+		if err = verifyAttestation(format, attStmt, slices.Concat(authData, cdHash[:]), pub, alg); err != nil {
+			return nil, err
+		}
+	}
+
+	return &credential{
+		Id:        append([]byte(nil), id...),
+		PublicKey: append([]byte(nil), coseKey...),
+		SignCount: count,
+		AAGUID:    append([]byte(nil), aaguid...),
+		CreatedAt: types.TimeNow(),
+	}, nil
+}
+
+// creationOptions returns options for navigator.credentials.create().
+func (wa *authenticator) creationOptions(uid types.Uid, name string, challenge []byte, creds []credential) map[string]any {
+	if name == "" {
+		name = uid.UserId()
+	}
+	exclude := []map[string]any{}
+	for i := range creds {
+		exclude = append(exclude, map[string]any{"type": "public-key", "id": encodeB64(creds[i].Id)})
+	}
+	params := []map[string]any{}
+	for _, alg := range supportedAlgorithms {
+		params = append(params, map[string]any{"type": "public-key", "alg": alg})
+	}
+	return map[string]any{
+		"rp": map[string]any{"id": wa.rpId, "name": wa.rpName},
+		"user": map[string]any{
+			"id":          encodeB64([]byte(uid.String())),
+			"name":        name,
+			"displayName": name,
+		},
+		"challenge":          encodeB64(challenge),
+		"pubKeyCredParams":   params,
+		"timeout":            wa.timeout.Milliseconds(),
+		"excludeCredentials": exclude,
+		"authenticatorSelection": map[string]any{
+			"residentKey":        "required",
+			"requireResidentKey": true,
+			"userVerification":   wa.userVerification,
+		},
+		"attestation": wa.attestation,
+	}
+}
+
+// requestOptions returns options for navigator.credentials.get().
+func (wa *authenticator) requestOptions(challenge []byte) map[string]any {
+	return map[string]any{
+		"challenge":        encodeB64(challenge),
+		"rpId":             wa.rpId,
+		"timeout":          wa.timeout.Milliseconds(),
+		"userVerification": wa.userVerification,
+	}
+}
+
+// credentialList formats user's credentials for the client.
+func credentialList(creds []credential) []map[string]any {
+	list := []map[string]any{}
+	for i := range creds {
+		cr := &creds[i]
+		entry := map[string]any{
+			"id":      encodeB64(cr.Id),
+			"created": cr.CreatedAt,
+		}
+		if cr.Name != "" {
+			entry["name"] = cr.Name
+		}
+		if cr.UsedAt != nil {
+			entry["used"] = *cr.UsedAt
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// decodeB64 decodes base64url with or without padding.
+func decodeB64(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("empty value")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func encodeB64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Challenges are hex-encoded in keys: '_' and '-' of base64url could be misinterpreted by SQL LIKE.
+func keyForChallenge(challenge []byte) string {
+	return realName + "_" + hex.EncodeToString(challenge)
+}
+
+const realName = "webauthn"
+
+// GetRealName returns the hardcoded name of the authenticator.
+func (authenticator) GetRealName() string {
+	return realName
+}
+
+func init() {
+	store.RegisterAuthScheme(realName, &authenticator{})
+}
@@ -0,0 +1,143 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"math/big"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// COSE algorithms (RFC 9053).
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+// Supported algorithms in the order of preference.
+var supportedAlgorithms = []int64{algES256, algEdDSA, algRS256}
+
+// COSE key types and parameters.
+const (
+	coseKeyType = 1
+	coseAlg     = 3
+
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+
+	// EC2 and OKP.
+	coseCrv = -1
+	coseX   = -2
+	coseY   = -3
+	// RSA.
+	coseN = -1
+	coseE = -2
+
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+)
+
+// parseCOSEKey parses a public key in COSE format. Returns the key and the algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	val, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, types.ErrMalformed
+	}
+	key, _ := val.(map[any]any)
+	kty, _ := key[int64(coseKeyType)].(int64)
+	alg, _ := key[int64(coseAlg)].(int64)
+
+	switch {
+	case kty == coseKtyEC2 && alg == algES256:
+		crv, _ := key[int64(coseCrv)].(int64)
+		x, _ := key[int64(coseX)].([]byte)
+		y, _ := key[int64(coseY)].([]byte)
+		if crv != coseCrvP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, types.ErrMalformed
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, types.ErrMalformed
+		}
+		return pub, alg, nil
+	case kty == coseKtyOKP && alg == algEdDSA:
+		crv, _ := key[int64(coseCrv)].(int64)
+		x, _ := key[int64(coseX)].([]byte)
+		if crv != coseCrvEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, types.ErrMalformed
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == coseKtyRSA && alg == algRS256:
+		n, _ := key[int64(coseN)].([]byte)
+		e, _ := key[int64(coseE)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, types.ErrMalformed
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, alg, nil
+	}
+	return nil, 0, types.ErrUnsupported
+}
+
+// verifySignature verifies the signature of the data made by the algorithm.
+func verifySignature(alg int64, pub crypto.PublicKey, data, sig []byte) error {
+	switch alg {
+	case algES256:
+		if key, ok := pub.(*ecdsa.PublicKey); ok {
+			hash := sha256.Sum256(data)
+			if ecdsa.VerifyASN1(key, hash[:], sig) {
+				return nil
+			}
+		}
+	case algEdDSA:
+		if key, ok := pub.(ed25519.PublicKey); ok && ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	case algRS256:
+		if key, ok := pub.(*rsa.PublicKey); ok {
+			hash := sha256.Sum256(data)
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil {
+				return nil
+			}
+		}
+	default:
+		return types.ErrUnsupported
+	}
+	return types.ErrFailed
+}
+
+// verifyAttestation verifies the attestation statement. Only "none" and "packed" formats are supported.
+// The certificate chain of the "packed" attestation is not validated against trust anchors.
+func verifyAttestation(format string, attStmt map[any]any, signed []byte, credKey crypto.PublicKey, credAlg int64) error {
+	switch format {
+	case "none":
+		return nil
+	case "packed":
+		alg, _ := attStmt["alg"].(int64)
+		sig, _ := attStmt["sig"].([]byte)
+		if sig == nil {
+			return types.ErrMalformed
+		}
+		x5c, _ := attStmt["x5c"].([]any)
+		if len(x5c) == 0 {
+			// Self attestation: signed by the credential key itself.
+			if alg != credAlg {
+				return types.ErrMalformed
+			}
+			return verifySignature(alg, credKey, signed, sig)
+		}
+		der, _ := x5c[0].([]byte)
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return types.ErrMalformed
+		}
+		return verifySignature(alg, cert.PublicKey, signed, sig)
+	}
+	return types.ErrUnsupported
+}
@@ -0,0 +1,131 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// cborHead encodes the head of a CBOR item with a one or two-byte argument.
+func cborHead(major byte, arg int) []byte {
+	if arg < 24 {
+		return []byte{major<<5 | byte(arg)}
+	}
+	return []byte{major<<5 | 24, byte(arg)}
+}
+
+func cborInt(v int) []byte {
+	if v < 0 {
+		return cborHead(1, -1-v)
+	}
+	return cborHead(0, v)
+}
+
+func cborBytes(b []byte) []byte {
+	return append(cborHead(2, len(b)), b...)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// {"fmt": "none", 1: [-7, true, h'0102'], "x": null}
+	data := []byte{0xa3,
+		0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e',
+		0x01, 0x83, 0x26, 0xf5, 0x42, 0x01, 0x02,
+		0x61, 'x', 0xf6,
+		0xff}
+	val, rest, err := decodeCBOR(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[any]any{
+		"fmt":    "none",
+		int64(1): []any{int64(-7), true, []byte{1, 2}},
+		"x":      nil,
+	}
+	if !reflect.DeepEqual(val, expected) {
+		t.Errorf("decoded %v, expected %v", val, expected)
+	}
+	if len(rest) != 1 || rest[0] != 0xff {
+		t.Error("remaining bytes are wrong", rest)
+	}
+
+	// Truncated byte string, nesting too deep, indefinite length.
+	for _, bad := range [][]byte{
+		{0x45, 0x01, 0x02},
+		{0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x00},
+		{0x9f, 0x01, 0xff},
+	} {
+		if _, _, err := decodeCBOR(bad); err == nil {
+			t.Errorf("invalid CBOR %x accepted", bad)
+		}
+	}
+}
+
+func TestES256Signature(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	priv.X.FillBytes(x)
+	priv.Y.FillBytes(y)
+
+	var coseKey []byte
+	coseKey = append(coseKey, cborHead(5, 5)...)
+	coseKey = append(coseKey, cborInt(coseKeyType)...)
+	coseKey = append(coseKey, cborInt(coseKtyEC2)...)
+	coseKey = append(coseKey, cborInt(coseAlg)...)
+	coseKey = append(coseKey, cborInt(algES256)...)
+	coseKey = append(coseKey, cborInt(coseCrv)...)
+	coseKey = append(coseKey, cborInt(coseCrvP256)...)
+	coseKey = append(coseKey, cborInt(coseX)...)
+	coseKey = append(coseKey, cborBytes(x)...)
+	coseKey = append(coseKey, cborInt(coseY)...)
+	coseKey = append(coseKey, cborBytes(y)...)
+
+	pub, alg, err := parseCOSEKey(coseKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg != algES256 {
+		t.Fatal("unexpected algorithm", alg)
+	}
+
+	// Authenticator data signed together with the hash of the client data.
+	wa := &authenticator{rpId: "example.com", userVerification: "required"}
+	rpIdHash := sha256.Sum256([]byte(wa.rpId))
+	authData := append(rpIdHash[:], flagUserPresent|flagUserVerified, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], 7)
+	cdHash := sha256.Sum256([]byte(`{"type":"webauthn.get"}`))
+	signed := append(authData, cdHash[:]...)
+	hash := sha256.Sum256(signed)
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifySignature(alg, pub, signed, sig); err != nil {
+		t.Error("valid signature rejected", err)
+	}
+	signed[0] ^= 0xff
+	if err = verifySignature(alg, pub, signed, sig); err == nil {
+		t.Error("signature of altered data accepted")
+	}
+
+	flags, count, err := wa.checkAuthData(authData)
+	if err != nil || count != 7 || flags&flagUserVerified == 0 {
+		t.Error("valid authenticator data rejected", flags, count, err)
+	}
+	authData[32] = flagUserPresent
+	if _, _, err = wa.checkAuthData(authData); err == nil {
+		t.Error("authenticator data without user verification accepted")
+	}
+	wa.rpId = "example.org"
+	if _, _, err = wa.checkAuthData(authData); err == nil {
+		t.Error("authenticator data of another relying party accepted")
+	}
+}
@@ -0,0 +1,288 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Users blocked across all topics. Unlike a ban in a p2p topic, a block
+ *    is enforced everywhere the two users may meet:
+ *
+ *    - {set topic="me" block={user: "usrX"}} blocks the user, unblock=true
+ *      unblocks. User's other sessions are notified with
+ *      {info topic="me" what="block" src="usrX" event="add"|"del"}.
+ *    - {get topic="me" what="blocks"} lists users blocked by the user.
+ *    - Users who blocked each other are not found by 'fnd', cannot start a
+ *      p2p topic or publish in an existing one, cannot add each other to
+ *      group topics and always see each other offline.
+ *    - Messages of either user in group topics are not delivered to the
+ *      other one, neither live nor from history, and are not pushed.
+ *
+ *    Blocks between users of a topic are cached by the topic. The cache is
+ *    dropped when blocks change on this node and expires after blockListTTL
+ *    to pick up changes made on other cluster nodes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Blocks cached by a topic are reloaded after this time.
+const blockListTTL = time.Minute
+
+// Version of blocks on this node, incremented on every change.
+var blocksVersion atomic.Int64
+
+// blockList is a cache of blocks between users of a topic.
+type blockList struct {
+	// Users in both directions of every block: either user blocked the other.
+	pairs map[types.Uid]map[types.Uid]bool
+	// Users the blocks were loaded for. Nil if the list includes all blocks of the owner of 'me'.
+	users map[types.Uid]bool
+	// Value of blocksVersion when the list was loaded.
+	version  int64
+	loadedAt time.Time
+}
+
+// newBlockList creates a block list from the blocks loaded for the given users.
+func newBlockList(blocks []types.Block, users map[types.Uid]bool, version int64) *blockList {
+	bl := &blockList{
+		pairs:    make(map[types.Uid]map[types.Uid]bool),
+		users:    users,
+		version:  version,
+		loadedAt: time.Now(),
+	}
+	add := func(one, two types.Uid) {
+		if bl.pairs[one] == nil {
+			bl.pairs[one] = make(map[types.Uid]bool)
+		}
+		bl.pairs[one][two] = true
+	}
+	for i := range blocks {
+		user, target := types.ParseUid(blocks[i].User), types.ParseUid(blocks[i].Target)
+		add(user, target)
+		add(target, user)
+	}
+	return bl
+}
+
+// between checks if either user blocked the other. Safe to call on nil and concurrently.
+func (bl *blockList) between(one, two types.Uid) bool {
+	return bl != nil && bl.pairs[one][two]
+}
+
+// blocksFor returns blocks between subscribers of the topic, loading them if needed. The given
+// users are loaded too even if they are not subscribed anymore, such as senders of old messages.
+// In 'me' the list includes all blocks of the owner.
+func (t *Topic) blocksFor(uids ...types.Uid) *blockList {
+	version := blocksVersion.Load()
+	bl := t.blocks
+	if bl != nil && bl.version == version && time.Since(bl.loadedAt) < blockListTTL {
+		missing := false
+		for _, uid := range uids {
+			if bl.users != nil && !bl.users[uid] {
+				missing = true
+				break
+			}
+		}
+		if !missing {
+			return bl
+		}
+	}
+
+	var blocks []types.Block
+	var users map[types.Uid]bool
+	var err error
+	if t.cat == types.TopicCatMe {
+		blocks, err = store.Blocks.GetAll(types.ParseUserId(t.name))
+	} else {
+		users = make(map[types.Uid]bool, len(t.perUser)+len(uids))
+		for uid := range t.perUser {
+			users[uid] = true
+		}
+		if bl != nil {
+			for uid := range bl.users {
+				users[uid] = true
+			}
+		}
+		for _, uid := range uids {
+			users[uid] = true
+		}
+		list := make([]types.Uid, 0, len(users))
+		for uid := range users {
+			list = append(list, uid)
+		}
+		blocks, err = store.Blocks.GetBetween(list)
+	}
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load blocks: %v", t.name, err)
+		return bl
+	}
+	t.blocks = newBlockList(blocks, users, version)
+	return t.blocks
+}
+
+// blockedBetween checks if either user blocked the other.
+func (t *Topic) blockedBetween(one, two types.Uid) bool {
+	if one == two || one.IsZero() || two.IsZero() {
+		return false
+	}
+	return t.blocksFor(one, two).between(one, two)
+}
+
+// filterBlockedMessages removes messages of users who blocked the user or were blocked by the user.
+func (t *Topic) filterBlockedMessages(messages []types.Message, uid types.Uid) []types.Message {
+	if t.cat != types.TopicCatGrp || len(messages) == 0 {
+		return messages
+	}
+	senders := []types.Uid{uid}
+	for i := range messages {
+		senders = append(senders, types.ParseUid(messages[i].From))
+	}
+	bl := t.blocksFor(senders...)
+	filtered := messages[:0]
+	for i := range messages {
+		if !bl.between(uid, types.ParseUid(messages[i].From)) {
+			filtered = append(filtered, messages[i])
+		}
+	}
+	return filtered
+}
+
+// filterBlockedSubs removes users who blocked the user or were blocked by the user from results of 'fnd'.
+func filterBlockedSubs(asUid types.Uid, subs []types.Subscription) ([]types.Subscription, error) {
+	users := []types.Uid{asUid}
+	for i := range subs {
+		if uid := types.ParseUserId(subs[i].Topic); !uid.IsZero() {
+			users = append(users, uid)
+		}
+	}
+	blocks, err := store.Blocks.GetBetween(users)
+	if err != nil || len(blocks) == 0 {
+		return subs, err
+	}
+
+	bl := newBlockList(blocks, nil, 0)
+	filtered := subs[:0]
+	for i := range subs {
+		if !bl.between(asUid, types.ParseUserId(subs[i].Topic)) {
+			filtered = append(filtered, subs[i])
+		}
+	}
+	return filtered, nil
+}
+
+// replySetBlock blocks or unblocks a user.
+func (t *Topic) replySetBlock(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for blocking")
+	}
+
+	req := msg.Set.Block
+	target := types.ParseUserId(req.User)
+	if target.IsZero() || target == asUid {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.block: invalid user")
+	}
+
+	var changed bool
+	var err error
+	what := "del"
+	if req.Unblock {
+		changed, err = store.Blocks.Delete(asUid, target)
+	} else {
+		changed, err = store.Blocks.Add(asUid, target)
+		what = "add"
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if !changed {
+		// The user is already blocked or is not blocked.
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+	blocksVersion.Add(1)
+
+	if req.Unblock {
+		// Restart exchange of online status: the other user replies if online.
+		globals.hub.routeSrv <- &ServerComMessage{
+			Pres:   &MsgServerPres{Topic: "me", What: "on", Src: t.name, WantReply: true},
+			RcptTo: target.UserId(),
+		}
+	} else {
+		// The users now see each other offline.
+		globals.hub.routeSrv <- &ServerComMessage{
+			Pres:   &MsgServerPres{Topic: "me", What: "off", Src: t.name},
+			RcptTo: target.UserId(),
+		}
+		globals.hub.routeSrv <- &ServerComMessage{
+			Pres:   &MsgServerPres{Topic: "me", What: "off", Src: target.UserId()},
+			RcptTo: t.name,
+		}
+	}
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: "me",
+			Src:   target.UserId(),
+			From:  asUid.UserId(),
+			What:  "block",
+			Event: what,
+		},
+		SkipSid: sess.sid,
+	})
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetBlocks returns users blocked by the user, the most recently blocked first.
+func (t *Topic) replyGetBlocks(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for blocked users")
+	}
+
+	blocks, err := store.Blocks.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	user := asUid.String()
+	var result []MsgBlock
+	for i := range blocks {
+		b := &blocks[i]
+		// Blocks of the user by others are not disclosed.
+		if b.User == user {
+			result = append(result, MsgBlock{User: types.ParseUid(b.Target).UserId(), Timestamp: b.CreatedAt})
+		}
+	}
+
+	if len(result) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "blocks"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Blocks:    result,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,288 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Bots are plugins which handle slash commands and button callbacks. A bot
+ *    registers them in its plugin config:
+ *
+ *      "commands": [{"name": "weather", "description": "Weather forecast",
+ *                    "usage": "/weather <city>", "topics": "grp,p2p"}],
+ *      "callbacks": ["weather-refresh"]
+ *
+ *    - {get topic="grpX" what="commands"} lists commands available in the
+ *      topic.
+ *    - {pub topic="grpX" head={cmd: "weather"} content="Paris"} invokes the
+ *      command.
+ *    - {pub topic="grpX" head={callback: "weather-refresh", reply: ":123"}
+ *      content={...}} reports a button pressed by the user.
+ *
+ *    Invocations are not saved and not delivered to other subscribers. The
+ *    server calls FireHose of the bot which registered the command or the
+ *    callback with the {pub} of the invoker, regardless of the FireHose filter
+ *    of the bot. The bot responds with:
+ *
+ *    - RESPOND: a {data} or {ctrl} delivered to the invoking session only.
+ *      {data} has no seq and is marked head.ephemeral=true.
+ *    - DROP: the invocation is accepted without a response.
+ *    - CONTINUE: the invocation is published as a regular message.
+ *    - REPLACE: a message replacing the invocation is published.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Message header with the name of the invoked slash command.
+	msgHeadCmd = "cmd"
+	// Message header with the name of the button callback.
+	msgHeadCallback = "callback"
+	// Message header which marks responses of bots visible only to the invoker.
+	msgHeadEphemeral = "ephemeral"
+
+	// Maximum length of a name of a command or a callback.
+	maxBotCommandLength = 32
+	// Maximum length of a description or usage of a command.
+	maxBotCommandDescriptionLength = 256
+)
+
+// botCommandConfig is a slash command in the config of a plugin.
+type botCommandConfig struct {
+	// Name of the command without the leading slash.
+	Name string `json:"name"`
+	// Human-readable description of the command.
+	Description string `json:"description"`
+	// Syntax of the command, like "/weather <city>".
+	Usage string `json:"usage"`
+	// Comma separated list of topic types where the command is available, all if missing: "grp,p2p".
+	Topics *string `json:"topics"`
+}
+
+// botCommand is a slash command handled by a bot.
+type botCommand struct {
+	name        string
+	description string
+	usage       string
+	// Topic types where the command is available.
+	topics int
+}
+
+// isBotCommandName checks if the name of a command or a callback consists of lowercase ASCII letters, digits, '-' and '_'.
+func isBotCommandName(name string) bool {
+	if name == "" || len(name) > maxBotCommandLength {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// botParseConfig parses commands and callbacks of a plugin. Names must be unique across all plugins.
+func botParseConfig(conf *pluginConfig, index map[string]bool) ([]botCommand, map[string]bool, error) {
+	var commands []botCommand
+	for i := range conf.Commands {
+		cc := &conf.Commands[i]
+		if !isBotCommandName(cc.Name) || len(cc.Description) > maxBotCommandDescriptionLength ||
+			len(cc.Usage) > maxBotCommandDescriptionLength {
+			return nil, nil, errors.New("invalid command '" + cc.Name + "'")
+		}
+		if index["/"+cc.Name] {
+			return nil, nil, errors.New("duplicate command '" + cc.Name + "'")
+		}
+		filter, err := ParsePluginFilter(cc.Topics, plgFilterByTopicType)
+		if err != nil {
+			return nil, nil, err
+		}
+		topics := plgTopicCatMask
+		if filter != nil {
+			topics = filter.byTopicType
+		}
+		commands = append(commands, botCommand{
+			name:        cc.Name,
+			description: cc.Description,
+			usage:       cc.Usage,
+			topics:      topics,
+		})
+		index["/"+cc.Name] = true
+	}
+
+	var callbacks map[string]bool
+	for _, name := range conf.Callbacks {
+		if !isBotCommandName(name) {
+			return nil, nil, errors.New("invalid callback '" + name + "'")
+		}
+		if index[name] {
+			return nil, nil, errors.New("duplicate callback '" + name + "'")
+		}
+		if callbacks == nil {
+			callbacks = make(map[string]bool)
+		}
+		callbacks[name] = true
+		index[name] = true
+	}
+
+	return commands, callbacks, nil
+}
+
+// botInvocation returns the name of the command or the callback invoked by the message and true if it's a callback.
+func botInvocation(head map[string]any) (string, bool) {
+	if name, ok := head[msgHeadCmd].(string); ok && name != "" {
+		return name, false
+	}
+	if name, ok := head[msgHeadCallback].(string); ok && name != "" {
+		return name, true
+	}
+	return "", false
+}
+
+// botFind returns the bot which handles the command or the callback in the topic or nil.
+func botFind(name string, callback bool, topic string) *Plugin {
+	for i := range globals.plugins {
+		p := &globals.plugins[i]
+		if callback {
+			if p.callbacks[name] {
+				return p
+			}
+			continue
+		}
+		for j := range p.commands {
+			if p.commands[j].name == name && pluginFilterByTopic(topic, p.commands[j].topics) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// botCommands returns commands available in the topic.
+func botCommands(topic string) []MsgBotCommand {
+	var result []MsgBotCommand
+	for i := range globals.plugins {
+		p := &globals.plugins[i]
+		for j := range p.commands {
+			cmd := &p.commands[j]
+			if pluginFilterByTopic(topic, cmd.topics) {
+				result = append(result, MsgBotCommand{
+					Name:        cmd.name,
+					Description: cmd.description,
+					Usage:       cmd.usage,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// invokeBot routes the command or the callback to the bot. Returns the message to publish or nil if
+// the bot has handled the invocation.
+func (s *Session) invokeBot(msg *ClientComMessage, name string, callback bool) *ClientComMessage {
+	if s.getSub(msg.RcptTo) == nil {
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		return nil
+	}
+
+	bot := botFind(name, callback, msg.Original)
+	if bot == nil {
+		s.queueOut(ErrNotFoundReply(msg, msg.Timestamp))
+		return nil
+	}
+
+	req := pluginGenerateClientReq(s, msg)
+	if req == nil {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		return nil
+	}
+
+	ctx := context.Background()
+	if bot.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bot.timeout)
+		defer cancel()
+	}
+	resp, err := bot.client.FireHose(ctx, req)
+	if err != nil {
+		logs.Warn.Println("plugins: bot call failed", bot.name, err)
+		if bot.failureCode != 0 {
+			s.queueOut(&ServerComMessage{
+				Ctrl: &MsgServerCtrl{
+					Id:        msg.Id,
+					Code:      bot.failureCode,
+					Text:      bot.failureText,
+					Topic:     msg.Original,
+					Timestamp: msg.Timestamp,
+				},
+			})
+		} else {
+			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+		}
+		return nil
+	}
+
+	switch resp.GetStatus() {
+	case pbx.RespCode_CONTINUE:
+		return msg
+	case pbx.RespCode_REPLACE:
+		repl := pbCliDeserialize(resp.GetClmsg())
+		if repl == nil || repl.Pub == nil {
+			s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			return nil
+		}
+		msg.Pub.Head, msg.Pub.Content = repl.Pub.Head, repl.Pub.Content
+		return msg
+	case pbx.RespCode_DROP:
+		s.queueOut(NoErrReply(msg, msg.Timestamp))
+		return nil
+	}
+
+	// RESPOND: deliver the response to the invoker only.
+	now := types.TimeNow()
+	srvmsg := pbServDeserialize(resp.GetSrvmsg())
+	if srvmsg != nil && srvmsg.Data != nil {
+		data := srvmsg.Data
+		data.Topic, data.SeqId, data.Timestamp = msg.Original, 0, now
+		if data.Head == nil {
+			data.Head = make(map[string]any)
+		}
+		data.Head[msgHeadEphemeral] = true
+		s.queueOut(&ServerComMessage{Data: data})
+	}
+	if srvmsg != nil && srvmsg.Ctrl != nil {
+		ctrl := srvmsg.Ctrl
+		ctrl.Id, ctrl.Topic, ctrl.Timestamp = msg.Id, msg.Original, now
+		s.queueOut(&ServerComMessage{Ctrl: ctrl})
+	} else {
+		s.queueOut(NoErrReply(msg, now))
+	}
+	return nil
+}
+
+// replyGetCommands lists slash commands available in the topic.
+func (t *Topic) replyGetCommands(sess *Session, asUid types.Uid, msg *ClientComMessage) {
+	now := types.TimeNow()
+	topic := t.original(asUid)
+
+	commands := botCommands(topic)
+	if len(commands) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "commands"}))
+		return
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     topic,
+			Timestamp: &now,
+			Commands:  commands,
+		},
+	})
+}
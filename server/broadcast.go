@@ -0,0 +1,58 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Broadcast channels with very large audiences. A channel created with
+ *    {sub topic="nch" set={desc={broadcast:true}}} keeps no per-reader state
+ *    beyond the read cursor: readers are not notified on 'me', their unread
+ *    counts are not maintained on every message, {note recv} is ignored.
+ *    Readers catch up from the cursor with {get what="data" data={since:read+1}}.
+ *
+ *    Sessions on other cluster nodes are attached to the master topic through
+ *    one multiplexing session per node, so the fanout is split between the
+ *    nodes. Hot topics forward messages to the nodes in batches, see
+ *    cluster_fanout.go. Topics with many attached sessions deliver {data}
+ *    in parallel shards.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"sync"
+)
+
+// sessionShardEntry is a session attached to the topic together with its per-session data.
+type sessionShardEntry struct {
+	sess *Session
+	pssd perSessionData
+}
+
+// broadcastSharded writes message to attached sessions in parallel, globals.fanoutShardSize sessions per shard.
+// The topic is not modified until all shards are done. Returns sessions which must be dropped.
+func (t *Topic) broadcastSharded(msg *ServerComMessage) []*Session {
+	entries := make([]sessionShardEntry, 0, len(t.sessions))
+	for sess, pssd := range t.sessions {
+		entries = append(entries, sessionShardEntry{sess: sess, pssd: pssd})
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var dropSessions []*Session
+	for start := 0; start < len(entries); start += globals.fanoutShardSize {
+		shard := entries[start:min(start+globals.fanoutShardSize, len(entries))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, entry := range shard {
+				if !t.broadcastToSession(entry.sess, entry.pssd, msg) {
+					lock.Lock()
+					dropSessions = append(dropSessions, entry.sess)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return dropSessions
+}
@@ -0,0 +1,350 @@
+// Package cache implements the cache of frequent reads of the store in Redis, see store/cache.go.
+// The same client keeps counters shared by cluster nodes, such as rate limits.
+package cache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTTL      = 300
+	defaultPoolSize = 8
+	defaultTimeout  = 2
+
+	// Maximum size of a value read from the server.
+	maxValueSize = 64 << 20
+)
+
+// Redis keeps values in Redis. Connections are pooled, commands are sent one at a time per connection.
+type Redis struct {
+	config *redisConfig
+	// Idle connections.
+	pool chan *redisConn
+}
+
+type redisConfig struct {
+	// URL of the server: "redis://[user:password@]host:6379/0" or "rediss://..." for TLS.
+	URL string `json:"url"`
+	// Prefix of keys, e.g. "tinode:".
+	Prefix string `json:"prefix"`
+	// Maximum number of idle connections.
+	PoolSize int `json:"pool_size"`
+	// Timeout of connecting and of commands (seconds).
+	Timeout int `json:"timeout"`
+
+	host     string
+	tls      bool
+	user     string
+	password string
+	db       int
+	ttl      string
+	timeout  time.Duration
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply of the server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedis creates the cache in Redis from the config. Values expire after ttl seconds.
+func NewRedis(jsconfig json.RawMessage, ttl int) (*Redis, error) {
+	var config redisConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return nil, errors.New("failed to parse redis config: " + err.Error())
+		}
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("redis: invalid url")
+	}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		config.tls = true
+	default:
+		return nil, errors.New("redis: unsupported url scheme '" + u.Scheme + "'")
+	}
+	config.host = u.Host
+	if u.Port() == "" {
+		config.host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		config.user = u.User.Username()
+		config.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if config.db, err = strconv.Atoi(path); err != nil {
+			return nil, errors.New("redis: invalid database number '" + path + "'")
+		}
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	config.ttl = strconv.Itoa(ttl)
+	if config.PoolSize <= 0 {
+		config.PoolSize = defaultPoolSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	config.timeout = time.Second * time.Duration(config.Timeout)
+
+	return &Redis{config: &config, pool: make(chan *redisConn, config.PoolSize)}, nil
+}
+
+// Get returns the value of the key, nil if the key is not found.
+func (r *Redis) Get(key string) ([]byte, error) {
+	val, err := r.do("GET", r.config.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := val.([]byte)
+	return data, nil
+}
+
+// Set stores the value of the key.
+func (r *Redis) Set(key string, value []byte) error {
+	_, err := r.do("SET", r.config.Prefix+key, value, "EX", r.config.ttl)
+	return err
+}
+
+// HGet returns the value of the field of the hash, nil if not found.
+func (r *Redis) HGet(key, field string) ([]byte, error) {
+	val, err := r.do("HGET", r.config.Prefix+key, field)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := val.([]byte)
+	return data, nil
+}
+
+// HSet stores the value of the field of the hash. The hash expires as a whole when its first field
+// expires.
+func (r *Redis) HSet(key, field string, value []byte) error {
+	if _, err := r.do("HSET", r.config.Prefix+key, field, value); err != nil {
+		return err
+	}
+	_, err := r.do("EXPIRE", r.config.Prefix+key, r.config.ttl, "NX")
+	return err
+}
+
+// Delete removes the keys.
+func (r *Redis) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([]any, len(keys)+1)
+	args[0] = "DEL"
+	for i, key := range keys {
+		args[i+1] = r.config.Prefix + key
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+// Incr increments the counter and returns its new value. The counter expires after 'ttl' since it's created.
+func (r *Redis) Incr(key string, ttl time.Duration) (int64, error) {
+	val, err := r.do("INCR", r.config.Prefix+key)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := val.(int64)
+	if count == 1 {
+		_, err = r.do("PEXPIRE", r.config.Prefix+key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	return count, err
+}
+
+// ZAdd adds the member to the sorted set or updates its score. The set expires after 'ttl' since
+// the last update.
+func (r *Redis) ZAdd(key, member string, score int64, ttl time.Duration) error {
+	if _, err := r.do("ZADD", r.config.Prefix+key, strconv.FormatInt(score, 10), member); err != nil {
+		return err
+	}
+	_, err := r.do("PEXPIRE", r.config.Prefix+key, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// ZRem removes the member from the sorted set.
+func (r *Redis) ZRem(key, member string) error {
+	_, err := r.do("ZREM", r.config.Prefix+key, member)
+	return err
+}
+
+// ZCard removes members with scores lower than 'min' from the sorted set and returns the number
+// of remaining members.
+func (r *Redis) ZCard(key string, min int64) (int64, error) {
+	if _, err := r.do("ZREMRANGEBYSCORE", r.config.Prefix+key, "-inf", "("+strconv.FormatInt(min, 10)); err != nil {
+		return 0, err
+	}
+	val, err := r.do("ZCARD", r.config.Prefix+key)
+	count, _ := val.(int64)
+	return count, err
+}
+
+// Close closes idle connections.
+func (r *Redis) Close() {
+	for {
+		select {
+		case c := <-r.pool:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do sends the command and returns the reply.
+func (r *Redis) do(args ...any) (any, error) {
+	c, err := r.getConn()
+	if err != nil {
+		return nil, err
+	}
+	val, err := c.do(r.config.timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection may be broken.
+		c.conn.Close()
+		return nil, err
+	}
+	r.putConn(c)
+	return val, err
+}
+
+func (r *Redis) getConn() (*redisConn, error) {
+	select {
+	case c := <-r.pool:
+		return c, nil
+	default:
+	}
+
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: r.config.timeout}
+	if r.config.tls {
+		host, _, _ := net.SplitHostPort(r.config.host)
+		conn, err = tls.DialWithDialer(dialer, "tcp", r.config.host, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", r.config.host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if r.config.password != "" {
+		args := []any{"AUTH", r.config.password}
+		if r.config.user != "" {
+			args = []any{"AUTH", r.config.user, r.config.password}
+		}
+		if _, err = c.do(r.config.timeout, args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.config.db != 0 {
+		if _, err = c.do(r.config.timeout, "SELECT", strconv.Itoa(r.config.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *Redis) putConn(c *redisConn) {
+	select {
+	case r.pool <- c:
+	default:
+		// The pool is full.
+		c.conn.Close()
+	}
+}
+
+// do writes the command as an array of bulk strings and reads the reply.
+func (c *redisConn) do(timeout time.Duration, args ...any) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	c.w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		var data []byte
+		switch a := arg.(type) {
+		case string:
+			data = []byte(a)
+		case []byte:
+			data = a
+		}
+		c.w.WriteString("$" + strconv.Itoa(len(data)) + "\r\n")
+		c.w.Write(data)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads one reply of the server. Bulk strings are returned as []byte, nil bulk strings
+// as nil, simple strings as string, integers as int64.
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: invalid reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size > maxValueSize {
+			return nil, errors.New("redis: invalid bulk string size")
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("redis: invalid array size")
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("redis: unsupported reply type '" + line[:1] + "'")
+}
@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a server which implements a few commands of Redis.
+type fakeRedis struct {
+	ln   net.Listener
+	lock sync.Mutex
+	data map[string]string
+	// Sorted sets: key -> member -> score.
+	zsets map[string]map[string]int64
+	// Received commands.
+	commands []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, data: make(map[string]string), zsets: make(map[string]map[string]int64)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			line, _ = r.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			data := make([]byte, size+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+
+		f.lock.Lock()
+		f.commands = append(f.commands, strings.Join(args, " "))
+		reply := "+OK\r\n"
+		switch args[0] {
+		case "GET", "HGET":
+			key := strings.Join(args[1:], "|")
+			if val, ok := f.data[key]; ok {
+				reply = "$" + strconv.Itoa(len(val)) + "\r\n" + val + "\r\n"
+			} else {
+				reply = "$-1\r\n"
+			}
+		case "SET":
+			f.data[args[1]] = args[2]
+		case "HSET":
+			f.data[args[1]+"|"+args[2]] = args[3]
+			reply = ":1\r\n"
+		case "EXPIRE", "PEXPIRE":
+			reply = ":1\r\n"
+		case "INCR":
+			count, _ := strconv.Atoi(f.data[args[1]])
+			f.data[args[1]] = strconv.Itoa(count + 1)
+			reply = ":" + f.data[args[1]] + "\r\n"
+		case "ZADD":
+			if f.zsets[args[1]] == nil {
+				f.zsets[args[1]] = make(map[string]int64)
+			}
+			f.zsets[args[1]][args[3]], _ = strconv.ParseInt(args[2], 10, 64)
+			reply = ":1\r\n"
+		case "ZREM":
+			delete(f.zsets[args[1]], args[2])
+			reply = ":1\r\n"
+		case "ZREMRANGEBYSCORE":
+			// Only "-inf (max" is supported.
+			max, _ := strconv.ParseInt(strings.TrimPrefix(args[3], "("), 10, 64)
+			for member, score := range f.zsets[args[1]] {
+				if score < max {
+					delete(f.zsets[args[1]], member)
+				}
+			}
+			reply = ":0\r\n"
+		case "ZCARD":
+			reply = ":" + strconv.Itoa(len(f.zsets[args[1]])) + "\r\n"
+		case "DEL":
+			for key := range f.data {
+				for _, del := range args[1:] {
+					if key == del || strings.HasPrefix(key, del+"|") {
+						delete(f.data, key)
+					}
+				}
+			}
+			reply = ":" + strconv.Itoa(len(args)-1) + "\r\n"
+		case "AUTH":
+			if args[len(args)-1] != "secret" {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.lock.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+func TestRedis(t *testing.T) {
+	f := newFakeRedis(t)
+	r, err := NewRedis([]byte(`{"url":"redis://:secret@`+f.ln.Addr().String()+`","prefix":"t:"}`), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if val, err := r.Get("usr:a"); err != nil || val != nil {
+		t.Fatalf("Get of missing key: expected nil, got %q, %v", val, err)
+	}
+	if err = r.Set("usr:a", []byte(`{"Id":"a"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := r.Get("usr:a"); err != nil || string(val) != `{"Id":"a"}` {
+		t.Errorf("Get: unexpected %q, %v", val, err)
+	}
+	if err = r.HSet("msg:grp", "u1", []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := r.HGet("msg:grp", "u1"); err != nil || string(val) != "[]" {
+		t.Errorf("HGet: unexpected %q, %v", val, err)
+	}
+	if err = r.Delete("usr:a", "msg:grp"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := r.HGet("msg:grp", "u1"); val != nil {
+		t.Errorf("Hash not deleted: %q", val)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.commands[0] != "AUTH secret" {
+		t.Errorf("Expected AUTH first, got %q", f.commands[0])
+	}
+	if f.commands[2] != `SET t:usr:a {"Id":"a"} EX 60` {
+		t.Errorf("Unexpected SET: %q", f.commands[2])
+	}
+	if f.commands[5] != "EXPIRE t:msg:grp 60 NX" {
+		t.Errorf("Unexpected EXPIRE: %q", f.commands[5])
+	}
+}
+
+func TestRedisError(t *testing.T) {
+	f := newFakeRedis(t)
+	r, err := NewRedis([]byte(`{"url":"redis://:wrong@`+f.ln.Addr().String()+`"}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Get("a"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Expected auth error, got %v", err)
+	}
+
+	if _, err = NewRedis([]byte(`{"url":"http://localhost"}`), 0); err == nil {
+		t.Error("Expected error of unsupported scheme")
+	}
+}
+
+func TestRedisCounters(t *testing.T) {
+	f := newFakeRedis(t)
+	r, err := NewRedis([]byte(`{"url":"redis://`+f.ln.Addr().String()+`","prefix":"t:"}`), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		if count, err := r.Incr("rl:a", 10*time.Second); err != nil || count != i {
+			t.Fatalf("Incr: expected %d, got %d, %v", i, count, err)
+		}
+	}
+	for i, member := range []string{"s1", "s2", "s3"} {
+		if err = r.ZAdd("conn:a", member, int64(100+i), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.ZRem("conn:a", "s3"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := r.ZCard("conn:a", 101); err != nil || count != 1 {
+		t.Errorf("ZCard: expected 1, got %d, %v", count, err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// The counter is given expiration time once.
+	if f.commands[1] != "PEXPIRE t:rl:a 10000" || strings.HasPrefix(f.commands[3], "PEXPIRE") {
+		t.Errorf("Unexpected commands %q", f.commands[:4])
+	}
+	if f.commands[len(f.commands)-2] != "ZREMRANGEBYSCORE t:conn:a -inf (101" {
+		t.Errorf("Unexpected ZREMRANGEBYSCORE: %q", f.commands[len(f.commands)-2])
+	}
+}
@@ -2,6 +2,10 @@
  *
  *  Description :
  *    Video call handling (establishment, metadata exhange and termination).
+ *    Calls between two users in P2P topics are peer-to-peer: the server only
+ *    forwards signaling messages. Group calls go through an SFU: the server
+ *    provisions a room for the call and issues access tokens to participants.
+ *    Every call is recorded in the call history with its final outcome.
  *
  *****************************************************************************/
 package main
@@ -11,10 +15,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/sfu"
+	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 	jcr "github.com/tinode/jsonco"
 )
@@ -34,6 +41,18 @@ const (
 	// Call finished by either side or server.
 	constCallEventHangUp = "hang-up"
 
+	// Events of group calls.
+	//
+	// Client requests to join the call.
+	constCallEventJoin = "join"
+	// Server issued an access token to the joining session.
+	constCallEventToken = "token"
+	// Server rejected the request to join because the call is full.
+	constCallEventFull = "full"
+	// A user joined or left the call.
+	constCallEventJoined = "joined"
+	constCallEventLeft   = "left"
+
 	// Message headers representing call states.
 	// Call is established.
 	constCallMsgAccepted = "accepted"
@@ -56,6 +75,10 @@ type callConfig struct {
 	ICEServers []iceServer `json:"ice_servers"`
 	// Alternative config as an external file.
 	ICEServersFile string `json:"ice_servers_file"`
+	// Time-limited TURN credentials minted for authenticated users.
+	TURN *turnConfig `json:"turn"`
+	// SFU for group calls.
+	SFU json.RawMessage `json:"sfu"`
 }
 
 // ICE server config.
@@ -88,6 +111,26 @@ type videoCall struct {
 	contentMime any
 	// Time when the call was accepted.
 	acceptedAt time.Time
+	// Name of the SFU room of a group call, blank for calls between two users.
+	room string
+	// User who started the group call.
+	owner types.Uid
+	// IDs of users who joined the group call, without the 'usr' prefix.
+	participants []string
+}
+
+// isGroup checks if the call is a group call.
+func (call *videoCall) isGroup() bool {
+	return call.room != ""
+}
+
+// duration returns the duration of the established call in milliseconds, 0 if the call was never
+// established.
+func (call *videoCall) duration() int64 {
+	if call.acceptedAt.IsZero() {
+		return 0
+	}
+	return time.Since(call.acceptedAt).Milliseconds()
 }
 
 // callPartySession returns a session to be stored in the call party data.
@@ -158,7 +201,15 @@ func initVideoCalls(jsconfig json.RawMessage) error {
 		globals.iceServers = iceConfig
 	}
 
-	if len(globals.iceServers) == 0 {
+	if config.TURN != nil {
+		turn, err := newTurnCredentials(config.TURN)
+		if err != nil {
+			return err
+		}
+		globals.turn = turn
+	}
+
+	if len(globals.iceServers) == 0 && globals.turn == nil {
 		return errors.New("no valid ICE cervers found")
 	}
 
@@ -168,6 +219,15 @@ func initVideoCalls(jsconfig json.RawMessage) error {
 	}
 
 	logs.Info.Println("Video calls enabled with", len(globals.iceServers), "ICE servers")
+	if globals.turn != nil {
+		logs.Info.Println("TURN credentials are issued for", globals.turn.urls)
+	}
+
+	if name, err := sfu.Init(config.SFU); err != nil {
+		return fmt.Errorf("failed to initialize SFU: %w", err)
+	} else if name != "" {
+		logs.Info.Println("Group calls enabled with SFU", name)
+	}
 	return nil
 }
 
@@ -227,11 +287,23 @@ func (t *Topic) handleCallInvite(msg *ClientComMessage, asUid types.Uid) {
 		content:     msg.Pub.Content,
 		contentMime: msg.Pub.Head["mime"],
 	}
+	if t.cat == types.TopicCatGrp {
+		t.handleGroupCallInvite(msg, asUid)
+		return
+	}
 	t.currentCall.parties[msg.sess.sid] = callPartyData{
 		uid:          asUid,
 		isOriginator: true,
 		sess:         callPartySession(msg.sess),
 	}
+	if err := store.Calls.Create(&types.CallRecord{
+		Topic:        t.name,
+		SeqId:        t.currentCall.seq,
+		Owner:        asUid.String(),
+		Participants: []string{asUid.String()},
+	}); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to save record of call seq %d - '%s'", t.name, t.currentCall.seq, err)
+	}
 	// Wait for constCallEstablishmentTimeout for the other side to accept the call.
 	t.callEstablishmentTimer.Reset(time.Duration(globals.callEstablishmentTimeout) * time.Second)
 }
@@ -264,6 +336,11 @@ func (t *Topic) handleCallEvent(msg *ClientComMessage) {
 		return
 	}
 
+	if t.currentCall.isGroup() {
+		t.handleGroupCallEvent(msg, asUid)
+		return
+	}
+
 	switch call.Event {
 	case constCallEventRinging, constCallEventAccept:
 		// Invariants:
@@ -385,7 +462,7 @@ func (t *Topic) maybeEndCallInProgress(from string, msg *ClientComMessage, callD
 	if from != "" && len(t.currentCall.parties) == 2 {
 		// This is a call in progress.
 		replaceWith = constCallMsgFinished
-		callDuration = time.Since(t.currentCall.acceptedAt).Milliseconds()
+		callDuration = t.currentCall.duration()
 	} else {
 		if from != "" {
 			// User originated hang-up.
@@ -426,6 +503,7 @@ func (t *Topic) maybeEndCallInProgress(from string, msg *ClientComMessage, callD
 	for tgt := range t.perUser {
 		t.infoCallSubsOffline(from, tgt, constCallEventHangUp, t.currentCall.seq, nil, "", true)
 	}
+	t.saveCallOutcome(t.currentCall, replaceWith, callDuration)
 	t.currentCall = nil
 }
 
@@ -434,10 +512,19 @@ func (t *Topic) terminateCallInProgress(callDidTimeout bool) {
 	if t.currentCall == nil {
 		return
 	}
+	if t.currentCall.isGroup() {
+		state := constCallMsgDisconnected
+		if callDidTimeout {
+			state = constCallMsgMissed
+		}
+		t.endGroupCall(state)
+		return
+	}
 	uid, sess := t.getCallOriginator()
 	if sess == nil || uid.IsZero() {
 		// Just drop the call.
 		logs.Warn.Printf("topic[%s]: video call seq %d has no originator, terminating.", t.name, t.currentCall.seq)
+		t.saveCallOutcome(t.currentCall, constCallMsgDisconnected, 0)
 		t.currentCall = nil
 		return
 	}
@@ -453,3 +540,272 @@ func (t *Topic) terminateCallInProgress(callDidTimeout bool) {
 	logs.Info.Printf("topic[%s]: terminating call seq %d, timeout: %t", t.name, t.currentCall.seq, callDidTimeout)
 	t.maybeEndCallInProgress("", dummy, callDidTimeout)
 }
+
+// Starts a group call in response to msg = {pub head=[webrtc: started]}: provisions the SFU room
+// and lets the originator join the call.
+func (t *Topic) handleGroupCallInvite(msg *ClientComMessage, asUid types.Uid) {
+	call := t.currentCall
+	call.room = t.name + "-" + strconv.Itoa(call.seq)
+	call.owner = asUid
+	if err := sfu.CreateRoom(call.room); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to create room for call seq %d - '%s'", t.name, call.seq, err)
+		t.endGroupCall(constCallMsgDisconnected)
+		return
+	}
+	if err := store.Calls.Create(&types.CallRecord{
+		Topic:        t.name,
+		SeqId:        call.seq,
+		Room:         call.room,
+		Owner:        asUid.String(),
+		Participants: []string{},
+	}); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to save record of call seq %d - '%s'", t.name, call.seq, err)
+	}
+
+	t.joinGroupCall(msg.sess, asUid, true)
+	// Wait for constCallEstablishmentTimeout for someone else to join the call.
+	t.callEstablishmentTimer.Reset(time.Duration(globals.callEstablishmentTimeout) * time.Second)
+}
+
+// Handles events of the group call (in response to msg = {note what=call}).
+func (t *Topic) handleGroupCallEvent(msg *ClientComMessage, asUid types.Uid) {
+	switch msg.Note.Event {
+	case constCallEventJoin:
+		pud := t.perUser[asUid]
+		if !(pud.modeGiven & pud.modeWant).IsWriter() {
+			// Only those who can publish can take part in the call.
+			return
+		}
+		if meterCheck(asUid, types.UsageCallMinutes, true) != nil {
+			msg.sess.queueOut(ErrQuotaExceededExplicitTs(msg.Id, t.original(asUid), types.TimeNow(), msg.Timestamp))
+			return
+		}
+		t.joinGroupCall(msg.sess, asUid, false)
+
+	case constCallEventHangUp:
+		// Hangup may arrive only from a call participant session.
+		if _, ok := t.currentCall.parties[msg.sess.sid]; !ok {
+			return
+		}
+		t.leaveGroupCall(msg.sess.sid)
+
+	default:
+		logs.Warn.Printf("topic[%s]: group call (seq %d) received unexpected call event: %s", t.name, t.currentCall.seq, msg.Note.Event)
+	}
+}
+
+// Issues an SFU access token to the session and lets other sessions know the user joined the call.
+func (t *Topic) joinGroupCall(sess *Session, asUid types.Uid, isOriginator bool) {
+	call := t.currentCall
+	_, rejoin := call.parties[sess.sid]
+	if !rejoin && len(call.parties) >= sfu.MaxParticipants() {
+		reply := call.infoMessage(constCallEventFull)
+		reply.Info.Topic = t.original(asUid)
+		sess.queueOut(reply)
+		return
+	}
+
+	token, err := sfu.Token(call.room, asUid.UserId(), "")
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to issue token for call seq %d - '%s'", t.name, call.seq, err)
+		return
+	}
+	payload, _ := json.Marshal(map[string]string{"url": sfu.URL(), "room": call.room, "token": token})
+	reply := call.infoMessage(constCallEventToken)
+	reply.Info.Topic = t.original(asUid)
+	reply.Info.Payload = payload
+	sess.queueOut(reply)
+
+	if rejoin {
+		// Token refresh.
+		return
+	}
+
+	call.parties[sess.sid] = callPartyData{
+		uid:          asUid,
+		isOriginator: isOriginator,
+		sess:         callPartySession(sess),
+	}
+	if !slices.Contains(call.participants, asUid.String()) {
+		call.participants = append(call.participants, asUid.String())
+		if len(call.participants) == 2 {
+			// The call is established when the second user joins.
+			call.acceptedAt = time.Now()
+			t.callEstablishmentTimer.Stop()
+		}
+	}
+
+	joined := call.infoMessage(constCallEventJoined)
+	joined.Info.Topic = t.xoriginal
+	joined.Info.From = asUid.UserId()
+	joined.SkipSid = sess.sid
+	t.broadcastToSessions(joined)
+}
+
+// Removes the session from the group call. The call ends when the last participant leaves.
+func (t *Topic) leaveGroupCall(sid string) {
+	call := t.currentCall
+	party, ok := call.parties[sid]
+	if !ok {
+		return
+	}
+	delete(call.parties, sid)
+
+	left := call.infoMessage(constCallEventLeft)
+	left.Info.Topic = t.xoriginal
+	left.Info.From = party.uid.UserId()
+	t.broadcastToSessions(left)
+
+	// The call could have ended while broadcasting if a stuck session was dropped.
+	if t.currentCall == call && len(call.parties) == 0 {
+		t.endGroupCall("")
+	}
+}
+
+// Ends the group call: replaces the call message with the final state of the call, disconnects
+// remaining participants and deletes the room. If state is blank, the call is either finished or
+// missed depending on whether anyone joined the originator.
+func (t *Topic) endGroupCall(state string) {
+	call := t.currentCall
+	if call == nil {
+		return
+	}
+	t.currentCall = nil
+	t.callEstablishmentTimer.Stop()
+
+	var callDuration int64
+	if state == "" {
+		if call.acceptedAt.IsZero() {
+			state = constCallMsgMissed
+		} else {
+			state = constCallMsgFinished
+			callDuration = call.duration()
+		}
+	}
+
+	dummy := &ClientComMessage{
+		Original:  t.xoriginal,
+		RcptTo:    t.name,
+		AsUser:    call.owner.UserId(),
+		Timestamp: types.TimeNow(),
+	}
+	head := call.messageHead(nil, state, int(callDuration))
+	if err := t.saveAndBroadcastMessage(dummy, call.owner, false, nil, head, call.content); err != nil {
+		logs.Err.Printf("topic[%s]: failed to write finalizing message for call seq id %d - '%s'", t.name, call.seq, err)
+	}
+
+	hangUp := call.infoMessage(constCallEventHangUp)
+	hangUp.Info.Topic = t.xoriginal
+	t.broadcastToSessions(hangUp)
+
+	t.closeGroupCall(call, state, callDuration)
+}
+
+// Deletes the room of the group call and saves the outcome of the call.
+func (t *Topic) closeGroupCall(call *videoCall, outcome string, duration int64) {
+	if err := sfu.DeleteRoom(call.room); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to delete room of call seq %d - '%s'", t.name, call.seq, err)
+	}
+	t.saveCallOutcome(call, outcome, duration)
+}
+
+// Saves the final state of the call to the call history.
+func (t *Topic) saveCallOutcome(call *videoCall, outcome string, duration int64) {
+	participants := call.participants
+	if !call.isGroup() {
+		// Parties of a P2P call are the caller and the callee if the call was accepted.
+		participants = make([]string, 0, 2)
+		for _, p := range call.parties {
+			if !slices.Contains(participants, p.uid.String()) {
+				participants = append(participants, p.uid.String())
+			}
+		}
+	}
+	if err := store.Calls.End(&types.CallRecord{
+		Topic:        t.name,
+		SeqId:        call.seq,
+		Outcome:      outcome,
+		Duration:     int(duration),
+		Participants: participants,
+	}); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to update record of call seq %d - '%s'", t.name, call.seq, err)
+	}
+	meterCall(participants, duration)
+}
+
+// replyGetCalls returns the call history of the user across topics the user is subscribed to, the most
+// recent calls first.
+func (t *Topic) replyGetCalls(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for call history")
+	}
+
+	if req != nil && (req.User != "" || req.IfModifiedSince != nil || req.SinceId != 0 || req.BeforeId != 0 ||
+		len(req.IdRanges) > 0 || req.Search != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid call history query")
+	}
+
+	var topic string
+	var opts MsgGetOpts
+	if req != nil {
+		opts = *req
+		topic = req.Topic
+	}
+	scopes, err := msgSearchScopes(asUid, topic)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	topics := make([]string, 0, len(scopes))
+	for name, scope := range scopes {
+		// Channel readers don't take part in calls.
+		if !scope.asChan {
+			topics = append(topics, name)
+		}
+	}
+
+	calls, err := store.Calls.GetAll(topics, opts.Until, opts.Limit)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(calls) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "calls"}))
+		return nil
+	}
+
+	result := make([]MsgCall, len(calls))
+	for i := range calls {
+		call := &calls[i]
+		participants := make([]string, len(call.Participants))
+		for j, userId := range call.Participants {
+			participants[j] = types.ParseUid(userId).UserId()
+		}
+		result[i] = MsgCall{
+			Topic:        scopes[call.Topic].name,
+			SeqId:        call.SeqId,
+			From:         types.ParseUid(call.Owner).UserId(),
+			Timestamp:    call.CreatedAt,
+			Ended:        call.EndedAt,
+			Outcome:      call.Outcome,
+			Duration:     call.Duration,
+			Participants: participants,
+			Group:        call.Room != "",
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Calls:     result,
+		},
+	})
+	return nil
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"net"
 	"net/rpc"
-	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -61,6 +60,10 @@ type clusterConfig struct {
 	NumProxyEventGoRoutines int `json:"-"`
 	// Failover configuration
 	Failover *clusterFailoverConfig
+	// This node is not a member of the cluster yet: ask the nodes listed in Nodes to add it.
+	Join bool `json:"join"`
+	// Sharded fanout of topics with many attached sessions.
+	Sharding *clusterShardingConfig `json:"sharding"`
 }
 
 // ClusterNode is a client's connection to another node.
@@ -82,6 +85,8 @@ type ClusterNode struct {
 
 	// A number of times this node has failed in a row
 	failCount int
+	// The node is draining and must not own topics.
+	draining bool
 
 	// Channel for shutting down the runner; buffered, 1.
 	done chan bool
@@ -149,6 +154,9 @@ type ClusterSess struct {
 
 	// Background session
 	Background bool
+
+	// Drafty formats supported by the client, nil if all are supported.
+	DraftyCaps []string
 }
 
 // ClusterSessUpdate represents a request to update a session.
@@ -190,6 +198,8 @@ type ClusterReq struct {
 	Sess *ClusterSess
 	// True when the topic proxy is gone.
 	Gone bool
+	// Tracing context of the client message in W3C Trace Context format. Nil if not traced.
+	Trace map[string]string
 }
 
 // ClusterRoute is intra-cluster routing request message.
@@ -208,6 +218,9 @@ type ClusterRoute struct {
 
 	// Message to be routed. Set for intra-cluster route requests.
 	SrvMsg *ServerComMessage
+	// Message published by the server without a session, e.g. by an incoming webhook. Set when
+	// the message is forwarded to the master node of the topic.
+	CliMsg *ClientComMessage
 
 	// Originating session
 	Sess *ClusterSess
@@ -431,6 +444,8 @@ type Cluster struct {
 	inbound *net.TCPListener
 	// Ring hash for mapping topic names to nodes
 	ring *rh.Ring
+	// Nodes which are members of the cluster, including nodes not currently active.
+	membership *ClusterMembership
 
 	// Failover parameters. Could be nil if failover is not enabled
 	fo *clusterFailover
@@ -441,6 +456,12 @@ type Cluster struct {
 	// running a separate event processing goroutine for each proxy session
 	// leads to a rather large memory usage and excessive scheduling overhead.
 	proxyEventQueue *concurrency.GoRoutinePool
+
+	// Topics with at least this many attached sessions send messages to proxy nodes in batches.
+	// 0 if sharded fanout is disabled.
+	shardMinSessions int
+	// Maximum number of messages in one batch.
+	shardBatchSize int
 }
 
 func (n *ClusterNode) stopMultiplexingSession(msess *Session) {
@@ -529,12 +550,14 @@ func (c *Cluster) TopicMaster(msg *ClusterReq, rejected *bool) error {
 			proxyReq:    msg.ReqType,
 			background:  msg.Sess.Background,
 			uid:         msg.Sess.Uid,
+			draftyCaps:  draftyCapsFromList(msg.Sess.DraftyCaps),
 		}
 	}
 
 	if msg.CliMsg != nil {
 		msg.CliMsg.sess = sess
 		msg.CliMsg.init = true
+		msg.CliMsg.ctx = traceExtract(msg.Trace)
 	}
 
 	switch msg.ReqType {
@@ -632,6 +655,15 @@ func (c *Cluster) Route(msg *ClusterRoute, rejected *bool) error {
 		return nil
 	}
 
+	if msg.CliMsg != nil {
+		select {
+		case globals.hub.routeCli <- msg.CliMsg:
+		default:
+			logError("cluster Route: server busy")
+		}
+		return nil
+	}
+
 	if msg.SrvMsg == nil {
 		// TODO: maybe panic here.
 		logError("cluster Route: nil server message")
@@ -651,10 +683,27 @@ func (c *Cluster) Route(msg *ClusterRoute, rejected *bool) error {
 
 // UserCacheUpdate endpoint receives updates to user's cached values as well as sends push notifications.
 func (c *Cluster) UserCacheUpdate(msg *UserCacheReq, rejected *bool) error {
+	if len(msg.Evict) > 0 {
+		// User's sessions are revoked.
+		globals.sessionStore.EvictSessions(msg.UserId, msg.Evict)
+		return nil
+	}
+
+	if msg.EvictAll {
+		// User logged out everywhere.
+		globals.sessionStore.EvictUser(msg.UserId, msg.SkipSid)
+		return nil
+	}
+
 	if msg.Gone {
 		// User is deleted. Evict all user's sessions.
 		globals.sessionStore.EvictUser(msg.UserId, "")
 
+		if msg.Erase {
+			// User's data is erased. Unload local topics with the user so they are reloaded without it.
+			globals.hub.unreg <- &topicUnreg{forUser: msg.UserId, erase: true}
+		}
+
 		if globals.cluster.isRemoteTopic(msg.UserId.UserId()) {
 			// No need to delete user's cache if user is remote.
 			return nil
@@ -728,7 +777,18 @@ func (c *Cluster) routeUserReq(req *UserCacheReq) error {
 		}
 	} else if req.Gone {
 		// Message that the user is deleted is sent to all nodes.
-		r := &UserCacheReq{Node: c.thisNodeName, UserIdList: req.UserIdList, Gone: true}
+		r := &UserCacheReq{Node: c.thisNodeName, UserId: req.UserId, Gone: true, Erase: req.Erase}
+		for _, n := range c.nodes {
+			reqByNode[n.name] = r
+		}
+	} else if len(req.Evict) > 0 {
+		// Sessions may be connected to any node.
+		r := &UserCacheReq{Node: c.thisNodeName, UserId: req.UserId, Evict: req.Evict}
+		for _, n := range c.nodes {
+			reqByNode[n.name] = r
+		}
+	} else if req.EvictAll {
+		r := &UserCacheReq{Node: c.thisNodeName, UserId: req.UserId, EvictAll: true, SkipSid: req.SkipSid}
 		for _, n := range c.nodes {
 			reqByNode[n.name] = r
 		}
@@ -831,6 +891,7 @@ func (c *Cluster) makeClusterReq(reqType ProxyReqType, msg *ClientComMessage, to
 
 	if msg != nil {
 		req.CliMsg = msg
+		req.Trace = traceInject(msg.ctx)
 		uid = types.ParseUserId(req.CliMsg.AsUser)
 	}
 
@@ -851,6 +912,7 @@ func (c *Cluster) makeClusterReq(reqType ProxyReqType, msg *ClientComMessage, to
 			Platform:    sess.platf,
 			Sid:         sess.sid,
 			Background:  sess.background,
+			DraftyCaps:  draftyCapsToList(sess.draftyCaps),
 		}
 	}
 	return req
@@ -906,6 +968,26 @@ func (c *Cluster) routeToTopicIntraCluster(topic string, msg *ServerComMessage,
 	return n.route(route)
 }
 
+// Forward the message published by the server without a session to the node that owns the topic.
+func (c *Cluster) routeServerPub(msg *ClientComMessage) error {
+	n := c.nodeForTopic(msg.RcptTo)
+	if n == nil {
+		return errors.New("node for topic not found (pub)")
+	}
+
+	var rejected bool
+	err := n.call("Cluster.Route", &ClusterRoute{
+		Node:        c.thisNodeName,
+		Signature:   c.ring.Signature(),
+		Fingerprint: c.fingerprint,
+		CliMsg:      msg,
+	}, &rejected)
+	if err == nil && rejected {
+		err = errors.New("cluster: message rejected by topic master node")
+	}
+	return err
+}
+
 // Topic proxy terminated. Inform remote Master node that the proxy is gone.
 func (c *Cluster) topicProxyGone(topicName string) error {
 	if c == nil {
@@ -979,10 +1061,7 @@ func clusterInit(configString json.RawMessage, self *string) int {
 		proxyEventQueue: concurrency.NewGoRoutinePool(len(config.Nodes) * 5),
 	}
 
-	var nodeNames []string
 	for _, host := range config.Nodes {
-		nodeNames = append(nodeNames, host.Name)
-
 		if host.Name == thisName {
 			globals.cluster.listenOn = host.Addr
 			// Don't create a cluster member for this local instance
@@ -997,6 +1076,23 @@ func clusterInit(configString json.RawMessage, self *string) int {
 		}
 	}
 
+	globals.cluster.membership = newClusterMembership(config.Nodes)
+	workerId := 0
+	if config.Join {
+		var seeds []string
+		for _, n := range globals.cluster.nodes {
+			seeds = append(seeds, n.address)
+		}
+		membership, assignedId, err := joinCluster(thisName, globals.cluster.listenOn, seeds)
+		if err != nil {
+			logs.Err.Fatal(err)
+		}
+		globals.cluster.applyMembership(membership)
+		workerId = assignedId
+	} else if me := globals.cluster.membership.member(thisName); me != nil {
+		workerId = me.WorkerId
+	}
+
 	if len(globals.cluster.nodes) == 0 {
 		// Cluster needs at least two nodes.
 		logs.Err.Fatal("Cluster: invalid cluster size: 1")
@@ -1007,13 +1103,12 @@ func clusterInit(configString json.RawMessage, self *string) int {
 		logs.Warn.Println("Cluster: use odd number of cluster nodes")
 	}
 
+	globals.cluster.shardingInit(config.Sharding)
+
 	if !globals.cluster.failoverInit(config.Failover) {
 		globals.cluster.rehash(nil)
 	}
 
-	sort.Strings(nodeNames)
-	workerId := sort.SearchStrings(nodeNames, thisName) + 1
-
 	statsSet("TotalClusterNodes", int64(len(globals.cluster.nodes)+1))
 
 	return workerId
@@ -1040,11 +1135,7 @@ func (c *Cluster) start() {
 	}
 
 	for _, n := range c.nodes {
-		go n.reconnect()
-		n.rpcDone = make(chan *rpc.Call, len(c.nodes)*clusterRpcCompletionBuffer)
-		n.p2mSender = make(chan *ClusterReq, clusterProxyToMasterBuffer)
-		go n.asyncRpcLoop()
-		go n.p2mSenderLoop()
+		c.startNode(n)
 	}
 
 	if c.fo != nil {
@@ -1062,6 +1153,15 @@ func (c *Cluster) start() {
 		globals.cluster.thisNodeName, c.listenOn)
 }
 
+// startNode connects to the node and starts processing calls to it.
+func (c *Cluster) startNode(n *ClusterNode) {
+	go n.reconnect()
+	n.rpcDone = make(chan *rpc.Call, len(c.nodes)*clusterRpcCompletionBuffer)
+	n.p2mSender = make(chan *ClusterReq, clusterProxyToMasterBuffer)
+	go n.asyncRpcLoop()
+	go n.p2mSenderLoop()
+}
+
 func (c *Cluster) shutdown() {
 	if globals.cluster == nil {
 		return
@@ -1186,6 +1286,8 @@ func (sess *Session) clusterWriteLoop(forTopic string) {
 		}
 	}()
 
+	// Responses accumulated for sending in one batch.
+	var batch []*ClusterResp
 	for {
 		select {
 		case msg, ok := <-sess.send:
@@ -1220,6 +1322,23 @@ func (sess *Session) clusterWriteLoop(forTopic string) {
 			srvMsg.RcptTo = forTopic
 			response.RcptTo = forTopic
 
+			if sess.batchFanout.Load() {
+				// Topic is in sharded mode: accumulate responses and send them in one call.
+				batch = append(batch, response)
+				if len(batch) >= globals.cluster.shardBatchSize {
+					if !sess.flushFanoutBatch(batch) {
+						return
+					}
+					batch = nil
+				}
+				continue
+			}
+			// Responses must be delivered in order: send the pending batch first.
+			if !sess.flushFanoutBatch(batch) {
+				return
+			}
+			batch = nil
+
 			if err := sess.clnode.masterToProxyAsync(response); err != nil {
 				logs.Warn.Printf("cluster: response to proxy failed \"%s\": %s", sess.sid, err.Error())
 				return
@@ -1237,6 +1356,10 @@ func (sess *Session) clusterWriteLoop(forTopic string) {
 		case <-sess.detach:
 			return
 		default:
+			// No more messages: send what's been accumulated.
+			if !sess.flushFanoutBatch(batch) {
+				return
+			}
 			terminate = false
 			return
 		}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/tinode/chat/server/logs"
+)
+
+// Sharded fanout of hot topics. The topic is owned by one cluster node which assigns
+// sequential IDs to messages and persists them. Sessions connected to other nodes are attached
+// to the master topic through one multiplexing session per node, and the node hosting the
+// sessions delivers messages to them. Once the number of attached sessions reaches the
+// configured threshold, the topic switches to sharded mode: the multiplexing sessions forward
+// messages to their nodes in batches instead of one RPC per message.
+
+const (
+	// Default number of messages sent to a node in one batch.
+	defaultShardBatchSize = 64
+)
+
+// Sharded fanout config.
+type clusterShardingConfig struct {
+	// Switch topic to sharded mode when it has this many attached sessions, including sessions
+	// at other nodes. 0 disables sharded mode.
+	MinSessions int `json:"min_sessions"`
+	// Maximum number of messages sent to a node in one batch.
+	BatchSize int `json:"batch_size"`
+}
+
+// ClusterRespBatch is a batch of Master to Proxy responses.
+type ClusterRespBatch struct {
+	Resps []*ClusterResp
+}
+
+func (c *Cluster) shardingInit(config *clusterShardingConfig) {
+	if config == nil || config.MinSessions <= 0 {
+		return
+	}
+	c.shardMinSessions = config.MinSessions
+	c.shardBatchSize = config.BatchSize
+	if c.shardBatchSize <= 1 {
+		c.shardBatchSize = defaultShardBatchSize
+	}
+	logs.Info.Printf("Cluster: sharded fanout for topics with %d+ sessions, batch size %d",
+		c.shardMinSessions, c.shardBatchSize)
+}
+
+// masterToProxyBatchAsync forwards a batch of responses from topic master to topic proxy
+// in a fire-and-forget manner.
+func (n *ClusterNode) masterToProxyBatchAsync(msg *ClusterRespBatch) error {
+	var unused bool
+	if c := n.callAsync("Cluster.TopicProxyBatch", msg, &unused, nil); c.Error != nil {
+		return c.Error
+	}
+	return nil
+}
+
+// TopicProxyBatch is a gRPC endpoint at topic proxy which receives a batch of topic master
+// responses. Responses are processed in order.
+func (c Cluster) TopicProxyBatch(msg *ClusterRespBatch, unused *bool) error {
+	for _, resp := range msg.Resps {
+		c.TopicProxy(resp, unused)
+	}
+	return nil
+}
+
+// attachedSessionCount returns the number of sessions attached to the topic including
+// sessions attached through multiplexing sessions.
+func (t *Topic) attachedSessionCount() int {
+	count := 0
+	for sess, pssd := range t.sessions {
+		if sess.isMultiplex() {
+			count += len(pssd.muids)
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// updateFanoutMode switches the master topic in and out of sharded mode depending on the number
+// of attached sessions and tells multiplexing sessions whether to batch messages.
+func (t *Topic) updateFanoutMode() {
+	if globals.cluster == nil || globals.cluster.shardMinSessions <= 0 || t.isProxy {
+		return
+	}
+
+	count := t.attachedSessionCount()
+	sharded := count >= globals.cluster.shardMinSessions
+	// Don't flip back and forth around the threshold.
+	if t.shardedFanout && !sharded {
+		sharded = count > globals.cluster.shardMinSessions*3/4
+	}
+	if sharded != t.shardedFanout {
+		t.shardedFanout = sharded
+		if sharded {
+			logs.Info.Printf("topic[%s]: sharded fanout on, %d sessions", t.name, count)
+		} else {
+			logs.Info.Printf("topic[%s]: sharded fanout off, %d sessions", t.name, count)
+		}
+	}
+
+	// Multiplexing sessions could be attached after the mode has changed, update all of them.
+	for sess := range t.sessions {
+		if sess.isMultiplex() {
+			sess.batchFanout.Store(sharded)
+		}
+	}
+}
+
+// flushFanoutBatch sends accumulated responses to the proxy node. Returns false if the session
+// must be terminated.
+func (sess *Session) flushFanoutBatch(batch []*ClusterResp) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	var err error
+	if len(batch) == 1 {
+		err = sess.clnode.masterToProxyAsync(batch[0])
+	} else {
+		err = sess.clnode.masterToProxyBatchAsync(&ClusterRespBatch{Resps: batch})
+	}
+	if err != nil {
+		logs.Warn.Printf("cluster: batch response to proxy failed \"%s\": %s", sess.sid, err.Error())
+		return false
+	}
+	return true
+}
@@ -14,6 +14,7 @@ import (
 // times, the leader node annouces it dead and initiates rehashing: it regenerates ring hash with
 // only live nodes and communicates the new list of nodes to followers. They in turn do their
 // rehashing using the new list. When the dead node is revived, rehashing happens again.
+// The leader also maintains cluster membership, see cluster_membership.go.
 
 // Failover config.
 type clusterFailover struct {
@@ -31,11 +32,17 @@ type clusterFailover struct {
 	activeNodesLock sync.RWMutex
 	// The number of heartbeats a node can fail before being declared dead
 	nodeFailCountLimit int
+	// This node is draining and is excluded from the ring hash while it's the leader.
+	draining bool
 
 	// Channel for processing leader health checks.
 	healthCheck chan *ClusterHealth
 	// Channel for processing election votes.
 	electionVote chan *ClusterVote
+	// Channel for processing requests of new nodes to join the cluster.
+	joinRequest chan *clusterJoin
+	// Channel for processing membership changes sent by the leader.
+	membershipChange chan *clusterMembershipChange
 	// Channel for stopping the failover runner.
 	done chan bool
 }
@@ -61,6 +68,8 @@ type ClusterHealth struct {
 	Signature string
 	// Names of nodes currently active in the cluster
 	Nodes []string
+	// Membership known to the leader
+	Membership *ClusterMembership
 }
 
 // ClusterVoteRequest is a request from a leader candidate to a node to vote for the candidate.
@@ -69,6 +78,8 @@ type ClusterVoteRequest struct {
 	Node string
 	// Election term
 	Term int
+	// Version of membership known to the candidate
+	MembershipVersion int
 }
 
 // ClusterVoteResponse is a vote from a node.
@@ -115,6 +126,8 @@ func (c *Cluster) failoverInit(config *clusterFailoverConfig) bool {
 		nodeFailCountLimit: config.NodeFailAfter,
 		healthCheck:        make(chan *ClusterHealth, config.VoteAfter),
 		electionVote:       make(chan *ClusterVote, len(c.nodes)),
+		joinRequest:        make(chan *clusterJoin, 1),
+		membershipChange:   make(chan *clusterMembershipChange, 1),
 		done:               make(chan bool, 1),
 	}
 
@@ -124,8 +137,9 @@ func (c *Cluster) failoverInit(config *clusterFailoverConfig) bool {
 }
 
 // Health is called by the leader node to assert leadership and check status
-// of the followers.
-func (c *Cluster) Health(health *ClusterHealth, unused *bool) error {
+// of the followers. The follower responds if it's draining.
+func (c *Cluster) Health(health *ClusterHealth, draining *bool) error {
+	*draining = globals.draining.Load()
 	select {
 	case c.fo.healthCheck <- health:
 	default:
@@ -151,15 +165,22 @@ func (c *Cluster) Vote(vreq *ClusterVoteRequest, response *ClusterVoteResponse)
 func (c *Cluster) sendHealthChecks() {
 	rehash := false
 
+	if draining := globals.draining.Load(); draining != c.fo.draining {
+		// The leader itself is being drained.
+		c.fo.draining = draining
+		rehash = true
+	}
+
 	for _, node := range c.nodes {
-		unused := false
+		draining := false
 		err := node.call("Cluster.Health",
 			&ClusterHealth{
-				Leader:    c.thisNodeName,
-				Term:      c.fo.term,
-				Signature: c.ring.Signature(),
-				Nodes:     c.fo.activeNodes,
-			}, &unused)
+				Leader:     c.thisNodeName,
+				Term:       c.fo.term,
+				Signature:  c.ring.Signature(),
+				Nodes:      c.fo.activeNodes,
+				Membership: c.membership,
+			}, &draining)
 
 		if err != nil {
 			node.failCount++
@@ -173,13 +194,20 @@ func (c *Cluster) sendHealthChecks() {
 				rehash = true
 			}
 			node.failCount = 0
+			if node.draining != draining {
+				node.draining = draining
+				rehash = true
+			}
 		}
 	}
 
 	if rehash {
-		activeNodes := []string{c.thisNodeName}
+		var activeNodes []string
+		if !c.fo.draining {
+			activeNodes = append(activeNodes, c.thisNodeName)
+		}
 		for _, node := range c.nodes {
-			if node.failCount < c.fo.nodeFailCountLimit {
+			if node.failCount < c.fo.nodeFailCountLimit && !node.draining {
 				activeNodes = append(activeNodes, node.name)
 			}
 		}
@@ -215,8 +243,9 @@ func (c *Cluster) electLeader() {
 		response := ClusterVoteResponse{}
 		node.callAsync("Cluster.Vote",
 			&ClusterVoteRequest{
-				Node: c.thisNodeName,
-				Term: c.fo.term,
+				Node:              c.thisNodeName,
+				Term:              c.fo.term,
+				MembershipVersion: c.membership.Version,
 			}, &response, done)
 	}
 
@@ -310,6 +339,10 @@ func (c *Cluster) run() {
 			statsSet("ClusterLeader", 0)
 
 			missed = 0
+			if health.Membership != nil && health.Membership.Version > c.membership.Version {
+				// This node missed a membership change.
+				c.applyMembership(health.Membership)
+			}
 			if health.Signature != c.ring.Signature() {
 				if rehashSkipped {
 					logs.Info.Println("cluster: rehashing at a request of",
@@ -326,7 +359,16 @@ func (c *Cluster) run() {
 			}
 
 		case vreq := <-c.fo.electionVote:
-			if c.fo.term < vreq.req.Term {
+			if c.fo.term < vreq.req.Term && vreq.req.MembershipVersion < c.membership.Version {
+				// The candidate does not know all members of the cluster, reject. Catch up with
+				// the term so this node can be elected itself.
+				logs.Info.Printf("Voting NO for %s, stale membership %d, mine %d", vreq.req.Node,
+					vreq.req.MembershipVersion, c.membership.Version)
+				c.fo.term = vreq.req.Term
+				c.fo.leader = ""
+				statsSet("ClusterLeader", 0)
+				vreq.resp <- ClusterVoteResponse{Result: false, Term: c.fo.term}
+			} else if c.fo.term < vreq.req.Term {
 				// This is a new election. This node has not voted yet. Vote for the requestor and
 				// clear the current leader.
 				logs.Info.Printf("Voting YES for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
@@ -340,6 +382,11 @@ func (c *Cluster) run() {
 				logs.Info.Printf("Voting NO for %s, my term %d, vote term %d", vreq.req.Node, c.fo.term, vreq.req.Term)
 				vreq.resp <- ClusterVoteResponse{Result: false, Term: c.fo.term}
 			}
+		case join := <-c.fo.joinRequest:
+			resp, err := c.addMember(join.req)
+			join.result <- clusterJoinResult{resp: resp, err: err}
+		case change := <-c.fo.membershipChange:
+			change.resp <- c.acceptMembership(change.req)
 		case <-c.fo.done:
 			return
 		}
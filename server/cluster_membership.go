@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sort"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Cluster membership. The list of nodes is replicated by the leader in the manner of Raft
+// configuration changes: every change increments the membership version and is committed
+// once the majority of nodes accept it. Nodes don't vote for candidates with an older
+// membership, so the newly elected leader always knows all committed members. Leader's health
+// checks carry the membership too, so nodes which missed the change or restarted catch up.
+//
+// A new node is added without restarting the cluster: it's started with "join": true and
+// the list of nodes which includes at least one existing member. The node asks the
+// leader to add it to the membership and receives the committed list of nodes together with
+// the worker ID to use for generating unique IDs. The new node becomes active in the ring hash
+// once it passes the leader's health check, at which point topics are rebalanced.
+
+const (
+	// Number of rounds of join requests to the cluster nodes before giving up.
+	clusterJoinAttempts = 10
+)
+
+// ClusterMember is a node in the cluster membership.
+type ClusterMember struct {
+	// Name of the node.
+	Name string
+	// TCP address of the node in the form host:port.
+	Addr string
+	// ID of the node for generating unique IDs.
+	WorkerId int
+}
+
+// ClusterMembership is the list of nodes in the cluster.
+type ClusterMembership struct {
+	// Version of the membership, incremented on every change.
+	Version int
+	// Cluster nodes, including the current one.
+	Members []ClusterMember
+}
+
+// ClusterMembershipUpdate is a request from the leader to accept a new membership.
+type ClusterMembershipUpdate struct {
+	// Name of the leader node
+	Leader string
+	// Election term
+	Term int
+	// New membership
+	Membership *ClusterMembership
+}
+
+// ClusterJoinRequest is a request from a new node to be added to the cluster.
+type ClusterJoinRequest struct {
+	// Name of the new node.
+	Node string
+	// TCP address of the new node.
+	Addr string
+}
+
+// ClusterJoinResponse is a response to a join request.
+type ClusterJoinResponse struct {
+	// Address of the leader if the request was sent to a follower.
+	LeaderAddr string
+	// Committed membership which includes the new node. Nil if the node was not added.
+	Membership *ClusterMembership
+	// Worker ID assigned to the new node.
+	WorkerId int
+}
+
+// clusterJoin is a join request and a response.
+type clusterJoin struct {
+	req    *ClusterJoinRequest
+	result chan clusterJoinResult
+}
+
+type clusterJoinResult struct {
+	resp ClusterJoinResponse
+	err  error
+}
+
+// clusterMembershipChange is a membership update and a response.
+type clusterMembershipChange struct {
+	req  *ClusterMembershipUpdate
+	resp chan bool
+}
+
+// newClusterMembership creates the initial membership from the configured list of nodes.
+// Worker IDs are assigned in the order of node names.
+func newClusterMembership(nodes []clusterNodeConfig) *ClusterMembership {
+	m := &ClusterMembership{}
+	for _, node := range nodes {
+		m.Members = append(m.Members, ClusterMember{Name: node.Name, Addr: node.Addr})
+	}
+	sort.Slice(m.Members, func(i, j int) bool {
+		return m.Members[i].Name < m.Members[j].Name
+	})
+	for i := range m.Members {
+		m.Members[i].WorkerId = i + 1
+	}
+	return m
+}
+
+// member finds the node by name.
+func (m *ClusterMembership) member(name string) *ClusterMember {
+	for i := range m.Members {
+		if m.Members[i].Name == name {
+			return &m.Members[i]
+		}
+	}
+	return nil
+}
+
+// withMember returns a copy of the membership with the node added at the next version.
+// The node gets a worker ID not used by any other node.
+func (m *ClusterMembership) withMember(name, addr string) *ClusterMembership {
+	next := &ClusterMembership{Version: m.Version + 1}
+	workerId := 0
+	for _, mm := range m.Members {
+		next.Members = append(next.Members, mm)
+		workerId = max(workerId, mm.WorkerId)
+	}
+	next.Members = append(next.Members, ClusterMember{Name: name, Addr: addr, WorkerId: workerId + 1})
+	return next
+}
+
+// applyMembership adds nodes which are not known yet. New nodes are considered failed until
+// they pass the leader's health check.
+func (c *Cluster) applyMembership(m *ClusterMembership) {
+	// The map of nodes is read without locking: replace it instead of modifying.
+	nodes := make(map[string]*ClusterNode, len(m.Members))
+	for name, node := range c.nodes {
+		nodes[name] = node
+	}
+	var added []*ClusterNode
+	for _, mm := range m.Members {
+		if mm.Name == c.thisNodeName || nodes[mm.Name] != nil {
+			continue
+		}
+		node := &ClusterNode{
+			address: mm.Addr,
+			name:    mm.Name,
+			done:    make(chan bool, 1),
+			msess:   make(map[string]struct{}),
+		}
+		if c.fo != nil {
+			node.failCount = c.fo.nodeFailCountLimit
+		}
+		nodes[mm.Name] = node
+		added = append(added, node)
+	}
+	c.nodes = nodes
+	c.membership = m
+
+	if c.inbound != nil {
+		// Cluster is running, connect to the new nodes.
+		for _, node := range added {
+			c.startNode(node)
+		}
+	}
+	for _, node := range added {
+		logs.Info.Printf("cluster: node '%s' [%s] joined, membership version %d", node.name, node.address, m.Version)
+	}
+	statsSet("TotalClusterNodes", int64(len(c.nodes)+1))
+}
+
+// addMember is called by the leader to add a new node to the cluster. The membership is
+// committed when the majority of nodes accept it.
+func (c *Cluster) addMember(req *ClusterJoinRequest) (ClusterJoinResponse, error) {
+	if c.fo.leader != c.thisNodeName {
+		var resp ClusterJoinResponse
+		if leader := c.membership.member(c.fo.leader); leader != nil {
+			resp.LeaderAddr = leader.Addr
+		}
+		return resp, nil
+	}
+
+	if mm := c.membership.member(req.Node); mm != nil {
+		if mm.Addr != req.Addr {
+			return ClusterJoinResponse{}, errors.New("cluster: node name '" + req.Node + "' is already taken")
+		}
+		// The node is restarted or retries the request.
+		return ClusterJoinResponse{Membership: c.membership, WorkerId: mm.WorkerId}, nil
+	}
+
+	next := c.membership.withMember(req.Node, req.Addr)
+	update := &ClusterMembershipUpdate{Leader: c.thisNodeName, Term: c.fo.term, Membership: next}
+	// One vote for self.
+	accepted := 1
+	for _, node := range c.nodes {
+		var ok bool
+		if err := node.call("Cluster.Membership", update, &ok); err == nil && ok {
+			accepted++
+		}
+	}
+	if accepted < (len(c.nodes)+1)>>1+1 {
+		return ClusterJoinResponse{}, errors.New("cluster: membership change not accepted by the majority")
+	}
+
+	c.applyMembership(next)
+	return ClusterJoinResponse{Membership: next, WorkerId: next.member(req.Node).WorkerId}, nil
+}
+
+// acceptMembership is called by a follower to accept membership sent by the leader.
+func (c *Cluster) acceptMembership(update *ClusterMembershipUpdate) bool {
+	if update.Term < c.fo.term {
+		logs.Warn.Println("cluster: membership from a stale leader", update.Leader, update.Term, c.fo.term)
+		return false
+	}
+	if update.Membership.Version > c.membership.Version {
+		c.applyMembership(update.Membership)
+	}
+	return true
+}
+
+// Join is called by a new node to be added to the cluster.
+func (c *Cluster) Join(req *ClusterJoinRequest, resp *ClusterJoinResponse) error {
+	if c.fo == nil {
+		return errors.New("cluster: failover is disabled, cannot join")
+	}
+
+	join := &clusterJoin{req: req, result: make(chan clusterJoinResult, 1)}
+	select {
+	case c.fo.joinRequest <- join:
+	default:
+		return errors.New("cluster: busy, try again")
+	}
+
+	result := <-join.result
+	*resp = result.resp
+	return result.err
+}
+
+// Membership is called by the leader to replicate a membership change.
+func (c *Cluster) Membership(update *ClusterMembershipUpdate, accepted *bool) error {
+	*accepted = false
+	if c.fo == nil {
+		return nil
+	}
+
+	change := &clusterMembershipChange{req: update, resp: make(chan bool, 1)}
+	// Don't block the leader for too long if this node is busy, e.g. it's a stale leader adding
+	// a node of its own.
+	timeout := time.NewTimer(c.fo.heartBeat * time.Duration(c.fo.voteTimeout))
+	defer timeout.Stop()
+	select {
+	case c.fo.membershipChange <- change:
+	case <-timeout.C:
+		return nil
+	}
+	select {
+	case *accepted = <-change.resp:
+	case <-timeout.C:
+	}
+	return nil
+}
+
+// requestJoin sends the join request to one node.
+func requestJoin(addr string, req *ClusterJoinRequest) (*ClusterJoinResponse, error) {
+	conn, err := net.DialTimeout("tcp", addr, clusterNetworkTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var resp ClusterJoinResponse
+	if err = client.Call("Cluster.Join", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// joinCluster asks existing nodes to add this node to the cluster. Nodes which are not the leader
+// respond with the address of the leader. Returns the committed membership and the worker ID
+// assigned to this node.
+func joinCluster(thisName, thisAddr string, seeds []string) (*ClusterMembership, int, error) {
+	req := &ClusterJoinRequest{Node: thisName, Addr: thisAddr}
+	for attempt := 1; attempt <= clusterJoinAttempts; attempt++ {
+		for _, addr := range seeds {
+			resp, err := requestJoin(addr, req)
+			if err == nil && resp.Membership == nil && resp.LeaderAddr != "" {
+				// Not the leader, ask the leader.
+				addr = resp.LeaderAddr
+				resp, err = requestJoin(addr, req)
+			}
+			if err != nil {
+				logs.Warn.Println("cluster: join request failed", addr, err)
+				continue
+			}
+			if resp.Membership != nil {
+				return resp.Membership, resp.WorkerId, nil
+			}
+		}
+		// The leader may be in the middle of election.
+		time.Sleep(clusterDefaultReconnectTime * time.Duration(attempt))
+	}
+	return nil, 0, errors.New("cluster: failed to join, no leader accepted the request")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClusterMembership(t *testing.T) {
+	m := newClusterMembership([]clusterNodeConfig{
+		{Name: "two", Addr: "localhost:12002"},
+		{Name: "one", Addr: "localhost:12001"},
+		{Name: "three", Addr: "localhost:12003"},
+	})
+	for name, workerId := range map[string]int{"one": 1, "three": 2, "two": 3} {
+		if mm := m.member(name); mm == nil || mm.WorkerId != workerId {
+			t.Errorf("Node '%s': expected worker ID %d, got %+v", name, workerId, mm)
+		}
+	}
+
+	next := m.withMember("four", "localhost:12004")
+	if next.Version != 1 || len(next.Members) != 4 || len(m.Members) != 3 {
+		t.Fatalf("Unexpected membership %+v", next)
+	}
+	if mm := next.member("four"); mm == nil || mm.WorkerId != 4 {
+		t.Errorf("Unexpected new member %+v", mm)
+	}
+
+	c := &Cluster{
+		thisNodeName: "one",
+		nodes:        map[string]*ClusterNode{"two": {name: "two"}, "three": {name: "three"}},
+		membership:   m,
+		fo:           &clusterFailover{leader: "two", term: 5, nodeFailCountLimit: 16},
+	}
+
+	// Follower redirects join requests to the leader.
+	resp, err := c.addMember(&ClusterJoinRequest{Node: "four", Addr: "localhost:12004"})
+	if err != nil || resp.Membership != nil || resp.LeaderAddr != "localhost:12002" {
+		t.Errorf("Expected redirect to the leader, got %+v, %v", resp, err)
+	}
+
+	// Membership from a stale leader is rejected.
+	if c.acceptMembership(&ClusterMembershipUpdate{Leader: "three", Term: 4, Membership: next}) {
+		t.Error("Accepted membership from a stale leader")
+	}
+	if !c.acceptMembership(&ClusterMembershipUpdate{Leader: "two", Term: 5, Membership: next}) {
+		t.Fatal("Membership from the leader rejected")
+	}
+	if c.membership.Version != 1 || len(c.nodes) != 3 {
+		t.Fatalf("Membership not applied: %+v", c.membership)
+	}
+	if node := c.nodes["four"]; node == nil || node.address != "localhost:12004" || node.failCount != 16 {
+		t.Errorf("Unexpected new node %+v", node)
+	}
+}
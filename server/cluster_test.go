@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	rh "github.com/tinode/chat/server/ringhash"
+)
+
+func TestClusterRouteServerPub(t *testing.T) {
+	ring := rh.New(clusterHashReplicas, nil)
+	ring.Add("one", "two")
+	c := &Cluster{thisNodeName: "one", ring: ring}
+
+	hub := &Hub{routeCli: make(chan *ClientComMessage, 1)}
+	prevHub := globals.hub
+	globals.hub = hub
+	defer func() { globals.hub = prevHub }()
+
+	pub := &ClientComMessage{
+		Pub:    &MsgClientPub{Topic: "grpAAAAAAAAAAA", Content: "Build passed"},
+		AsUser: "usrAAAAAAAAAAA",
+		RcptTo: "grpAAAAAAAAAAA",
+	}
+	var rejected bool
+	if err := c.Route(&ClusterRoute{Node: "two", Signature: ring.Signature(), CliMsg: pub}, &rejected); err != nil || rejected {
+		t.Fatalf("Message rejected: %v", err)
+	}
+	if msg := <-hub.routeCli; msg != pub {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+
+	// The message is rejected when the hub is busy or the ring is out of sync.
+	hub.routeCli <- &ClientComMessage{}
+	if c.Route(&ClusterRoute{Node: "two", Signature: ring.Signature(), CliMsg: pub}, &rejected); !rejected {
+		t.Error("Busy hub: message accepted")
+	}
+	<-hub.routeCli
+	if c.Route(&ClusterRoute{Node: "two", Signature: "stale", CliMsg: pub}, &rejected); !rejected {
+		t.Error("Signature mismatch: message accepted")
+	}
+	if len(hub.routeCli) != 0 {
+		t.Error("Unexpected message routed")
+	}
+}
@@ -0,0 +1,269 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Encodings of client and server messages. Websocket clients choose the
+ *    encoding with the subprotocol of the connection: "tinode.cbor" for CBOR
+ *    (RFC 8949), "tinode.msgpack" for MessagePack, JSON when no subprotocol
+ *    is requested. Other transports use JSON, gRPC uses protobuf with JSON
+ *    encoded free-form fields.
+ *
+ *    Binary encodings use the same field names as JSON. Free-form values,
+ *    such as content, head and public, are converted to the types produced
+ *    by the JSON decoder: the server sees the same message regardless of the
+ *    encoding. Timestamps are RFC 3339 strings in CBOR and timestamp extension
+ *    values in MessagePack. Raw JSON fields, such as the payload of {note}
+ *    and {info}, are byte strings containing JSON.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// wireCodec encodes and decodes messages.
+type wireCodec interface {
+	// Name of the websocket subprotocol, blank for JSON.
+	Name() string
+	// Binary encodings are sent in binary websocket frames.
+	Binary() bool
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// Batch combines encoded messages into an array.
+	Batch(msgs [][]byte) []byte
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return ""
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Batch(msgs [][]byte) []byte {
+	out := append([]byte{'['}, bytes.Join(msgs, []byte{','})...)
+	return append(out, ']')
+}
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func (*cborCodec) Name() string {
+	return "tinode.cbor"
+}
+
+func (*cborCodec) Binary() bool {
+	return true
+}
+
+func (c *cborCodec) Marshal(v any) ([]byte, error) {
+	return c.enc.Marshal(v)
+}
+
+func (c *cborCodec) Unmarshal(data []byte, v any) error {
+	if err := c.dec.Unmarshal(data, v); err != nil {
+		return err
+	}
+	jsonCompatible(reflect.ValueOf(v))
+	return nil
+}
+
+func (*cborCodec) Batch(msgs [][]byte) []byte {
+	// Header of an array: major type 4.
+	var out []byte
+	switch n := len(msgs); {
+	case n < 24:
+		out = []byte{0x80 | byte(n)}
+	case n <= math.MaxUint16:
+		out = binary.BigEndian.AppendUint16([]byte{0x99}, uint16(n))
+	default:
+		out = binary.BigEndian.AppendUint32([]byte{0x9a}, uint32(n))
+	}
+	return append(out, bytes.Join(msgs, nil)...)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "tinode.msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.GetEncoder()
+	defer msgpack.PutEncoder(enc)
+
+	enc.Reset(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.GetDecoder()
+	defer msgpack.PutDecoder(dec)
+
+	dec.Reset(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	jsonCompatible(reflect.ValueOf(v))
+	return nil
+}
+
+func (msgpackCodec) Batch(msgs [][]byte) []byte {
+	var out []byte
+	switch n := len(msgs); {
+	case n < 16:
+		out = []byte{0x90 | byte(n)}
+	case n <= math.MaxUint16:
+		out = binary.BigEndian.AppendUint16([]byte{0xdc}, uint16(n))
+	default:
+		out = binary.BigEndian.AppendUint32([]byte{0xdd}, uint32(n))
+	}
+	return append(out, bytes.Join(msgs, nil)...)
+}
+
+// jsonWire is the default encoding.
+var jsonWire wireCodec = jsonCodec{}
+
+// Encodings by websocket subprotocol.
+var wireCodecs = func() map[string]wireCodec {
+	encMode, err := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	decMode, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	codecs := map[string]wireCodec{}
+	for _, c := range []wireCodec{&cborCodec{enc: encMode, dec: decMode}, msgpackCodec{}} {
+		codecs[c.Name()] = c
+	}
+	return codecs
+}()
+
+// wireSubprotocols lists websocket subprotocols in the order of preference.
+var wireSubprotocols = []string{"tinode.cbor", "tinode.msgpack"}
+
+// jsonCompatible converts free-form values, i.e. values of 'any' type, of the decoded message to
+// the types produced by the JSON decoder.
+func jsonCompatible(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			jsonCompatible(v.Elem())
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Type().Field(i).IsExported() {
+				jsonCompatible(v.Field(i))
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		switch v.Type().Elem().Kind() {
+		case reflect.Pointer, reflect.Struct, reflect.Interface, reflect.Map:
+			for i := range v.Len() {
+				jsonCompatible(v.Index(i))
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.Interface {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			val := reflect.Zero(v.Type().Elem())
+			if x := jsonValue(iter.Value().Interface()); x != nil {
+				val = reflect.ValueOf(x)
+			}
+			v.SetMapIndex(iter.Key(), val)
+		}
+	case reflect.Interface:
+		if !v.IsNil() && v.CanSet() {
+			if x := jsonValue(v.Interface()); x != nil {
+				v.Set(reflect.ValueOf(x))
+			}
+		}
+	}
+}
+
+// jsonValue converts a free-form value to the type the JSON decoder would produce for it.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case nil, string, bool, float64:
+		return v
+	case map[string]any:
+		for key, val := range v {
+			v[key] = jsonValue(val)
+		}
+		return v
+	case map[any]any:
+		out := make(map[string]any, len(v))
+		for key, val := range v {
+			out[fmt.Sprint(key)] = jsonValue(val)
+		}
+		return out
+	case []any:
+		for i, val := range v {
+			v[i] = jsonValue(val)
+		}
+		return v
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32:
+		return rv.Float()
+	}
+	// Unknown type, e.g. a CBOR tag: use whatever JSON makes of it.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out any
+	json.Unmarshal(data, &out)
+	return out
+}
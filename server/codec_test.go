@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestWireCodecs(t *testing.T) {
+	in := &ClientComMessage{
+		Pub: &MsgClientPub{
+			Id:      "1",
+			Topic:   "grpX",
+			Head:    map[string]any{"mime": "text/x-drafty", "reply": 12},
+			Content: map[string]any{"txt": "hi", "fmt": []any{map[string]any{"at": 0, "len": 2, "tp": "ST"}}},
+		},
+		Get: &MsgClientGet{Id: "2", Topic: "grpX", MsgGetQuery: MsgGetQuery{What: "data",
+			Data: &MsgGetOpts{SinceId: 5, Limit: 10}}},
+		Note: &MsgClientNote{Topic: "grpX", What: "call", Payload: json.RawMessage(`{"sdp":"x"}`)},
+	}
+
+	// Messages decoded from binary encodings must be the same as decoded from JSON.
+	data, _ := json.Marshal(in)
+	var expected ClientComMessage
+	if err := json.Unmarshal(data, &expected); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range wireSubprotocols {
+		codec := wireCodecs[name]
+		data, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var msg ClientComMessage
+		if err = codec.Unmarshal(data, &msg); err != nil {
+			t.Fatal(name, err)
+		}
+		if !reflect.DeepEqual(&msg, &expected) {
+			t.Errorf("%s: got %+v, expected %+v", name, msg.Pub, expected.Pub)
+		}
+	}
+
+	// Server messages use JSON field names and omit empty fields.
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	data, err := wireCodecs["tinode.cbor"].Marshal(&ServerComMessage{Data: &MsgServerData{Topic: "grpX", From: "usrA",
+		Timestamp: ts, SeqId: 3, Content: "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]map[string]any
+	if err = cbor.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out["data"]["ts"] != "2024-05-01T10:00:00Z" || out["data"]["seq"] != uint64(3) {
+		t.Errorf("Unexpected CBOR server message %v", out)
+	}
+	if _, ok := out["data"]["head"]; ok {
+		t.Error("Empty head is not omitted")
+	}
+}
+
+func TestWireBatch(t *testing.T) {
+	msgs := []*ServerComMessage{
+		{Data: &MsgServerData{Topic: "grpX", SeqId: 1, Content: "a"}},
+		{Data: &MsgServerData{Topic: "grpX", SeqId: 2, Content: "b"}},
+	}
+	for _, codec := range []wireCodec{jsonWire, wireCodecs["tinode.cbor"], wireCodecs["tinode.msgpack"]} {
+		var encoded [][]byte
+		for _, msg := range msgs {
+			data, err := codec.Marshal(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encoded = append(encoded, data)
+		}
+		var out []map[string]any
+		if err := codec.Unmarshal(codec.Batch(encoded), &out); err != nil {
+			t.Fatal(codec.Name(), err)
+		}
+		if len(out) != 2 || out[0]["data"].(map[string]any)["seq"] != float64(1) ||
+			out[1]["data"].(map[string]any)["content"] != "b" {
+			t.Errorf("%s: unexpected batch %v", codec.Name(), out)
+		}
+	}
+
+	// Long batches use longer array headers.
+	encoded := make([][]byte, 300)
+	for i := range encoded {
+		encoded[i] = []byte{0x01}
+	}
+	for _, codec := range []wireCodec{wireCodecs["tinode.cbor"], wireCodecs["tinode.msgpack"]} {
+		var out []int
+		if err := codec.Unmarshal(codec.Batch(encoded), &out); err != nil || len(out) != 300 {
+			t.Errorf("%s: failed to decode long batch: %v, %d", codec.Name(), err, len(out))
+		}
+	}
+}
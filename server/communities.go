@@ -0,0 +1,314 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Communities group group topics under one umbrella. A community is a
+ *    group topic without messages: its subscribers are the members of the
+ *    community, their roles apply in all topics of the community.
+ *
+ *    - {sub topic="ncmXXX"} creates a community, just like "new" creates a
+ *      group topic.
+ *    - {sub topic="newXXX" set={desc={parent: "grpX"}}} creates a topic in
+ *      the community grpX. Only owners and admins of the community do it.
+ *    - {get topic="grpX" what="topics"} returns the directory of the topics
+ *      of the community with the requester's unread counts. Topics which
+ *      members cannot join are listed only to their subscribers.
+ *    - {get topic="me" what="unread"} reports the community of every topic
+ *      and the total counts of every community.
+ *
+ *    Only members of the community join its topics or are invited to them.
+ *    Members who leave the community or are removed or banned from it leave
+ *    all its topics. Members without their own role in a topic have their
+ *    role in the community, the owner of the community acts as an admin.
+ *
+ *    Members of the community are cached by its topics. The cache is dropped
+ *    when members change on this node and expires after communityMembersTTL
+ *    to pick up changes made on other cluster nodes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of topics in a community.
+	maxCommunityTopics = 64
+	// Members of the community cached by a topic are reloaded after this time.
+	communityMembersTTL = time.Minute
+	// Internal 'what' of server-generated {del} of the subscription of a user who left the community.
+	delWhatCommunity = "community"
+)
+
+// Version of members of communities on this node, incremented on every change.
+var communityVersion atomic.Int64
+
+// communityMembers is a cache of members of the community of a topic.
+type communityMembers struct {
+	// Roles of members in the community, an empty string if the member has no role.
+	roles map[types.Uid]string
+	// Value of communityVersion when the members were loaded.
+	version  int64
+	loadedAt time.Time
+}
+
+// communityRoleOf returns the role of the subscriber of a community in its topics and false if the
+// subscriber is not a member: banned or waiting for approval.
+func communityRoleOf(sub *types.Subscription) (string, bool) {
+	mode := sub.ModeGiven & sub.ModeWant
+	if sub.DeletedAt != nil || !mode.IsJoiner() || isJoinRequest(sub.ModeWant, sub.ModeGiven) {
+		return "", false
+	}
+	if mode.IsOwner() || (sub.Role == "" && mode.IsAdmin()) {
+		return roleAdmin, true
+	}
+	return sub.Role, true
+}
+
+// checkCommunityParent checks if the user may create a topic in the community.
+func checkCommunityParent(parent string, uid types.Uid) error {
+	if !strings.HasPrefix(parent, "grp") {
+		return types.ErrMalformed
+	}
+
+	stopic, err := store.Topics.Get(parent)
+	if err != nil {
+		return err
+	}
+	if stopic == nil || !stopic.Community || stopic.State == types.StateDeleted {
+		return types.ErrTopicNotFound
+	}
+
+	sub, err := store.Subs.Get(parent, uid, false)
+	if err != nil {
+		return err
+	}
+	if sub == nil {
+		return types.ErrPermissionDenied
+	}
+	if role, ok := communityRoleOf(sub); !ok || roleRanks[role] < roleRanks[roleAdmin] {
+		return types.ErrPermissionDenied
+	}
+
+	children, err := store.Topics.GetChildren(parent)
+	if err != nil {
+		return err
+	}
+	if len(children) >= maxCommunityTopics {
+		return types.ErrPolicy
+	}
+	return nil
+}
+
+// communityMembers returns members of the community of the topic, loading them if needed.
+// Returns nil if the topic does not belong to a community or the members cannot be loaded.
+func (t *Topic) communityMembers() *communityMembers {
+	if t.parent == "" {
+		return nil
+	}
+	version := communityVersion.Load()
+	cm := t.members
+	if cm != nil && cm.version == version && time.Since(cm.loadedAt) < communityMembersTTL {
+		return cm
+	}
+
+	// The community may have been deleted on another node.
+	stopic, err := store.Topics.Get(t.parent)
+	if err == nil && (stopic == nil || stopic.State == types.StateDeleted) {
+		t.parent = ""
+		t.members = nil
+		return nil
+	}
+
+	var subs []types.Subscription
+	if err == nil {
+		subs, err = store.Topics.GetSubs(t.parent, nil)
+	}
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load members of community %s: %v", t.name, t.parent, err)
+		return cm
+	}
+
+	cm = &communityMembers{
+		roles:    make(map[types.Uid]string, len(subs)),
+		version:  version,
+		loadedAt: time.Now(),
+	}
+	for i := range subs {
+		if role, ok := communityRoleOf(&subs[i]); ok {
+			cm.roles[types.ParseUid(subs[i].User)] = role
+		}
+	}
+	t.members = cm
+	return cm
+}
+
+// isCommunityMember checks if the user may join the topic: topics outside of communities are open to everyone.
+func (t *Topic) isCommunityMember(uid types.Uid) bool {
+	if t.parent == "" {
+		return true
+	}
+	cm := t.communityMembers()
+	if cm == nil {
+		// The community was deleted.
+		return t.parent == ""
+	}
+	_, ok := cm.roles[uid]
+	return ok
+}
+
+// communityRole returns the role of the user in the community of the topic.
+func (t *Topic) communityRole(uid types.Uid) string {
+	if cm := t.communityMembers(); cm != nil {
+		return cm.roles[uid]
+	}
+	return ""
+}
+
+// communityMembersChanged is called by the community when a member joins, leaves or changes.
+func (t *Topic) communityMembersChanged(uid types.Uid, left bool) {
+	// Topics of the community reload members.
+	communityVersion.Add(1)
+	if left {
+		go leaveCommunityTopics(t.name, uid)
+	}
+}
+
+// leaveCommunityTopics asks topics of the community to remove subscriptions of the user who left the community.
+func leaveCommunityTopics(community string, uid types.Uid) {
+	children, err := store.Topics.GetChildren(community)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load topics of the community: %v", community, err)
+		return
+	}
+
+	for i := range children {
+		topic := children[i].Id
+		if sub, err := store.Subs.Get(topic, uid, false); err != nil || sub == nil {
+			continue
+		}
+
+		msg := &ClientComMessage{
+			Del: &MsgClientDel{
+				Topic: topic,
+				What:  delWhatCommunity,
+				User:  uid.UserId(),
+			},
+			RcptTo:    topic,
+			Original:  topic,
+			Timestamp: types.TimeNow(),
+		}
+		select {
+		case globals.hub.routeCli <- msg:
+		default:
+			logs.Err.Printf("topic[%s]: hub.route channel full, %s not removed", topic, uid.UserId())
+		}
+	}
+}
+
+// handleCommunityLeave removes the subscription of the user who left the community.
+func (t *Topic) handleCommunityLeave(msg *ClientComMessage) {
+	uid := types.ParseUserId(msg.Del.User)
+	pud, ok := t.perUser[uid]
+	if t.isInactive() || !ok || pud.deleted || t.isOwner(uid) {
+		// Owners keep the topic.
+		return
+	}
+
+	if err := store.Subs.Delete(t.name, uid); err != nil {
+		if err != types.ErrNotFound {
+			logs.Warn.Printf("topic[%s]: failed to remove %s who left the community: %v", t.name, uid.UserId(), err)
+		}
+		return
+	}
+
+	if (pud.modeWant & pud.modeGiven).IsReader() {
+		usersUpdateUnread(uid, pud.readID-t.lastID, true)
+	}
+	t.notifySubChange(uid, types.ZeroUid, false,
+		pud.modeWant, pud.modeGiven, types.ModeUnset, types.ModeUnset, "")
+	t.evictUser(uid, true, "")
+	pluginSubscription(&types.Subscription{Topic: t.name, User: uid.String()}, plgActDel)
+}
+
+// replyGetTopics returns the directory of topics of the community.
+func (t *Topic) replyGetTopics(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if !t.community {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("the topic is not a community")
+	}
+
+	pud, ok := t.perUser[asUid]
+	mode := pud.modeGiven & pud.modeWant
+	if asChan || !ok || pud.deleted || !mode.IsJoiner() || isJoinRequest(pud.modeWant, pud.modeGiven) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to list topics of the community by non-member")
+	}
+
+	children, err := store.Topics.GetChildren(t.name)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	counts, err := store.Users.GetUnreadByTopic(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	unread := make(map[string]*types.TopicUnread)
+	for i := range counts {
+		if counts[i].Parent == t.name {
+			unread[counts[i].Topic] = &counts[i]
+		}
+	}
+
+	var result []MsgCommunityTopic
+	for i := range children {
+		child := &children[i]
+		tu := unread[child.Id]
+		if !child.Access.Auth.IsJoiner() && tu == nil {
+			// Private topics are listed to their subscribers only.
+			if sub, err := store.Subs.Get(child.Id, asUid, false); err != nil || sub == nil {
+				continue
+			}
+		}
+		mct := MsgCommunityTopic{
+			Topic:   child.Id,
+			SubCnt:  child.SubCnt,
+			Public:  child.Public,
+			Trusted: child.Trusted,
+		}
+		if !child.TouchedAt.IsZero() {
+			mct.Touched = &child.TouchedAt
+		}
+		if tu != nil {
+			mct.Unread, mct.Mentions = tu.Unread, tu.Mentions
+		}
+		result = append(result, mct)
+	}
+
+	if len(result) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "topics"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Topics:    result,
+		},
+	})
+	return nil
+}
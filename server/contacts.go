@@ -0,0 +1,172 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Discovery of contacts. Clients find users by phone numbers and emails
+ *    from the address book without sending them in plain text: the client
+ *    computes hex-encoded SHA-256 hashes of the salt (sent in response to {hi})
+ *    followed by the tag, such as "tel:+17025550001" or "email:alice@example.com".
+ *
+ *    - {get topic="fnd" what="contacts" contacts={hashes}} returns users with
+ *      matching validated phone numbers and emails as {hash, user}.
+ *    - {get topic="fnd" what="contacts" contacts={prefixes}} is the private set
+ *      intersection mode: the client sends only prefixes of hashes and the
+ *      server returns every candidate as {prefix, sealed} where sealed is the
+ *      user ID encrypted by AES-256-GCM with the full hash as the key. Only
+ *      the client which knows the phone number or email can decrypt it.
+ *
+ *    Requests are rate-limited as "contacts" to prevent enumeration.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Length of hex-encoded SHA-256 hashes of contacts.
+	contactHashLength = 64
+	// Minimum and maximum lengths of hash prefixes in hex digits. Shorter prefixes match too many users,
+	// longer prefixes disclose too much of the hash.
+	minContactPrefixLength = 4
+	maxContactPrefixLength = 16
+)
+
+// isContactHex checks if the string is a lowercase hex string of the given length.
+func isContactHex(str string, length int) bool {
+	if len(str) != length {
+		return false
+	}
+	for _, c := range str {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// sealContact encrypts the user ID with the hex-encoded hash of the contact as the key.
+// The result is the nonce followed by the ciphertext.
+func sealContact(hash, userId string) ([]byte, error) {
+	key, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(userId), nil), nil
+}
+
+// replyGetContacts finds users by hashes or prefixes of hashes of phone numbers and emails.
+func (t *Topic) replyGetContacts(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatFnd {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for contacts")
+	}
+
+	if !store.IsContactDiscoveryEnabled() {
+		sess.queueOut(ErrNotImplementedReply(msg, now))
+		return errors.New("contact discovery is disabled")
+	}
+
+	if req == nil || (len(req.Hashes) == 0) == (len(req.Prefixes) == 0) ||
+		len(req.Hashes)+len(req.Prefixes) > globals.maxContactHashes {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid contacts query")
+	}
+
+	byPrefix := len(req.Prefixes) > 0
+	query, length := req.Hashes, contactHashLength
+	if byPrefix {
+		if globals.contactPrefixLength == 0 {
+			sess.queueOut(ErrNotImplementedReply(msg, now))
+			return errors.New("contact discovery by prefix is disabled")
+		}
+		query, length = req.Prefixes, globals.contactPrefixLength
+	}
+	for _, str := range query {
+		if !isContactHex(str, length) {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("invalid hash of contact")
+		}
+	}
+
+	var found []types.ContactHash
+	var err error
+	if byPrefix {
+		found, err = store.Contacts.FindByPrefix(t.tenant, query)
+	} else {
+		found, err = store.Contacts.Find(t.tenant, query)
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Users who blocked each other cannot find one another.
+	users := []types.Uid{asUid}
+	for i := range found {
+		users = append(users, types.ParseUid(found[i].User))
+	}
+	blocks, err := store.Blocks.GetBetween(users)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	bl := newBlockList(blocks, nil, 0)
+
+	result := make([]MsgContact, 0, len(found))
+	for i := range found {
+		c := &found[i]
+		uid := types.ParseUid(c.User)
+		if uid == asUid || bl.between(asUid, uid) {
+			continue
+		}
+		userId := types.ParseUid(c.User).UserId()
+		if !byPrefix {
+			result = append(result, MsgContact{Hash: c.Hash, User: userId})
+			continue
+		}
+		sealed, err := sealContact(c.Hash, userId)
+		if err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		}
+		result = append(result, MsgContact{Prefix: c.Hash[:length], Sealed: sealed})
+	}
+
+	if len(result) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "contacts"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Contacts:  result,
+		},
+	})
+	return nil
+}
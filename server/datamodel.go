@@ -9,6 +9,7 @@ package main
  *****************************************************************************/
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strconv"
@@ -34,6 +35,32 @@ type MsgGetOpts struct {
 	Limit int `json:"limit,omitempty"`
 	// Fetch messages with IDs in these ranges.
 	IdRanges []MsgRange `json:"ranges,omitempty"`
+	// Fetch messages which contain all words of this query.
+	Search string `json:"search,omitempty"`
+	// Load messages sent before this timestamp (exclusive or open).
+	Until *time.Time `json:"until,omitempty"`
+	// Load the root message and replies of the thread with this root ID.
+	Thread int `json:"thread,omitempty"`
+	// Report receipts of the message with this ID.
+	SeqId int `json:"seq,omitempty"`
+	// Deliver messages with translations of their text to this language (BCP 47 tag).
+	Translate string `json:"translate,omitempty"`
+	// Client-assigned ID of the user's device for end-to-end encryption.
+	Dev string `json:"dev,omitempty"`
+	// Load subscriptions with this label ('me' only).
+	Label string `json:"label,omitempty"`
+	// Load archived subscriptions instead of not archived ('me' only).
+	Archived bool `json:"archived,omitempty"`
+	// Find users by these hex-encoded hashes of phone numbers or emails ('fnd' only).
+	Hashes []string `json:"hashes,omitempty"`
+	// Find users with hashes of phone numbers or emails starting with these prefixes ('fnd' only).
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Load only subscriptions waiting for approval (group topics only).
+	Pending bool `json:"pending,omitempty"`
+	// Load topics of this category of the directory ('fnd' only).
+	Category string `json:"category,omitempty"`
+	// Skip this many results.
+	Offset int `json:"offset,omitempty"`
 }
 
 // MsgGetQuery is a topic metadata or data query.
@@ -42,12 +69,37 @@ type MsgGetQuery struct {
 
 	// Parameters of "desc" request: IfModifiedSince
 	Desc *MsgGetOpts `json:"desc,omitempty"`
-	// Parameters of "sub" request: User, Topic, IfModifiedSince, Limit.
+	// Parameters of "sub" request: User, Topic, IfModifiedSince, Limit, Label and Archived ('me' only),
+	// Pending (group topics only).
 	Sub *MsgGetOpts `json:"sub,omitempty"`
-	// Parameters of "data" request: Since, Before, Limit.
+	// Parameters of "data" request: Since, Before, Limit, IdRanges, Search, Thread, Translate.
 	Data *MsgGetOpts `json:"data,omitempty"`
 	// Parameters of "del" request: Since, Before, Limit.
 	Del *MsgGetOpts `json:"del,omitempty"`
+	// Parameters of "msg" (message search) request: Search, Topic ('me' only), Until, Limit.
+	Msg *MsgGetOpts `json:"msg,omitempty"`
+	// Parameters of "edits" (edit history) request: Since, Before, IdRanges, Limit.
+	Edits *MsgGetOpts `json:"edits,omitempty"`
+	// Parameters of "threads" request: Since, Before, IdRanges, Limit; IDs are IDs of thread roots.
+	Threads *MsgGetOpts `json:"threads,omitempty"`
+	// Parameters of "receipts" request: SeqId, Limit.
+	Receipts *MsgGetOpts `json:"receipts,omitempty"`
+	// Parameters of "keys" request: User (group topics only).
+	Keys *MsgGetOpts `json:"keys,omitempty"`
+	// Parameters of "skey" request: Dev.
+	SKey *MsgGetOpts `json:"skey,omitempty"`
+	// Parameters of "mentions" request: Topic, Until, Limit ('me' only).
+	Mentions *MsgGetOpts `json:"mentions,omitempty"`
+	// Parameters of "calls" (call history) request: Topic, Until, Limit ('me' only).
+	Calls *MsgGetOpts `json:"calls,omitempty"`
+	// Parameters of "drafts" request: IfModifiedSince ('me' only).
+	Drafts *MsgGetOpts `json:"drafts,omitempty"`
+	// Parameters of "starred" request: Topic, Until, Limit ('me' only).
+	Starred *MsgGetOpts `json:"starred,omitempty"`
+	// Parameters of "contacts" request: Hashes or Prefixes ('fnd' only).
+	Contacts *MsgGetOpts `json:"contacts,omitempty"`
+	// Parameters of "directory" request: Category, Offset, Limit ('fnd' only).
+	Directory *MsgGetOpts `json:"directory,omitempty"`
 }
 
 // MsgSetSub is a payload in set.sub request to update current subscription or invite another user, {sub.what} == "sub".
@@ -69,6 +121,18 @@ type MsgSetDesc struct {
 	Trusted any `json:"trusted,omitempty"`
 	// Per-subscription private data.
 	Private any `json:"private,omitempty"`
+	// Time to live of messages in seconds, 0 to keep messages forever.
+	MsgTTL *int `json:"ttl,omitempty"`
+	// Minimum interval between messages of a user in seconds, 0 to turn slow mode off.
+	SlowMode *int `json:"slow,omitempty"`
+	// Freeze the topic: only managers may publish.
+	Frozen *bool `json:"frozen,omitempty"`
+	// Custom status of the user, 'me' only. Empty status clears it.
+	Status *MsgUserStatus `json:"status,omitempty"`
+	// Create the channel in broadcast mode. Used only when the channel is created.
+	Broadcast *bool `json:"broadcast,omitempty"`
+	// Community of the group topic. Used only when the topic is created.
+	Parent string `json:"parent,omitempty"`
 }
 
 // MsgCredClient is an account credential such as email or phone number.
@@ -95,6 +159,248 @@ type MsgSetQuery struct {
 	Cred *MsgCredClient `json:"cred,omitempty"`
 	// Update auxiliary data
 	Aux map[string]any
+	// Per-user thread settings.
+	Thread *MsgSetThread `json:"thread,omitempty"`
+	// Pin or unpin a message.
+	Pin *MsgSetPin `json:"pin,omitempty"`
+	// Public keys of the user's device for end-to-end encryption, 'me' only.
+	Keys *MsgKeyBundle `json:"keys,omitempty"`
+	// Sender key distribution messages for other members of a group topic.
+	SKey *MsgSetSenderKeys `json:"skey,omitempty"`
+	// Register a device or update its settings, 'me' only.
+	Device *MsgSetDevice `json:"device,omitempty"`
+	// Settings of push notifications of the user in 'me' or of the subscription in other topics.
+	Notify *MsgNotifySettings `json:"notify,omitempty"`
+	// Presence settings of the user in 'me' or the override of sharing presence in other topics.
+	Presence *MsgPresenceSettings `json:"presence,omitempty"`
+	// Save or delete a draft of a message, 'me' only.
+	Draft *MsgDraft `json:"draft,omitempty"`
+	// Star or unstar a message.
+	Star *MsgSetStar `json:"star,omitempty"`
+	// Block or unblock a user, 'me' only.
+	Block *MsgSetBlock `json:"block,omitempty"`
+	// Replace labels of a subscription, 'me' only.
+	Labels *MsgSetLabels `json:"labels,omitempty"`
+	// Archive or unarchive the subscription.
+	Archive *MsgSetArchive `json:"archive,omitempty"`
+	// Assign a role to a subscriber of a group topic.
+	Role *MsgSetRole `json:"role,omitempty"`
+	// Create or revoke an invite link to a group topic.
+	Invite *MsgSetInvite `json:"invite,omitempty"`
+	// Approve or deny a request to join a group topic.
+	Request *MsgSetRequest `json:"request,omitempty"`
+	// Publish a group topic in the directory or remove it.
+	Directory *MsgSetDirectory `json:"directory,omitempty"`
+}
+
+// MsgDraft is a draft of a message the user is composing in a topic.
+type MsgDraft struct {
+	// Topic of the draft as seen by the user.
+	Topic string `json:"topic"`
+	// Content of the draft. Missing content deletes the draft.
+	Content any `json:"content,omitempty"`
+	// Time of the change on the client. The latest change wins.
+	Timestamp *time.Time `json:"ts,omitempty"`
+}
+
+// MsgNotifySettings are the user's settings of push notifications. In set.notify requests missing fields
+// are left unchanged.
+type MsgNotifySettings struct {
+	// User's settings, 'me' only.
+
+	// BCP 47 tag of the language of notification texts. Empty string means the language of the device.
+	Lang *string `json:"lang,omitempty"`
+	// Include previews of message content into notifications.
+	Preview *bool `json:"preview,omitempty"`
+	// Quiet hours when notifications are silent.
+	Quiet *MsgQuietHours `json:"quiet,omitempty"`
+	// Words which alert the user like mentions when found in messages. Empty array removes all keywords.
+	Keywords *[]string `json:"keywords,omitempty"`
+	// Notify by SMS of messages received while the user is offline.
+	Sms *bool `json:"sms,omitempty"`
+
+	// Settings of the subscription, p2p and group topics only.
+
+	// Notifications from the topic are muted until this time. Time in the past unmutes the topic.
+	MuteUntil *time.Time `json:"until,omitempty"`
+	// Notify only of messages which mention the user.
+	Mentions *bool `json:"mentions,omitempty"`
+}
+
+// MsgPresenceSettings are the user's settings of presence privacy. In set.presence requests missing fields
+// are left unchanged.
+type MsgPresenceSettings struct {
+	// User's settings, 'me' only.
+
+	// Appear offline to everyone.
+	Invisible *bool `json:"invisible,omitempty"`
+	// Who sees the time when the user was last online: "everyone", "contacts" or "nobody".
+	Seen *string `json:"seen,omitempty"`
+
+	// Settings of the subscription, p2p and group topics only.
+
+	// Share presence in the topic: "show" even if invisible, "hide" to appear offline, "" to follow
+	// the user's settings.
+	Share *string `json:"share,omitempty"`
+}
+
+// MsgQuietHours are daily hours when push notifications are silent.
+type MsgQuietHours struct {
+	// Start and end of quiet hours as "HH:MM" in the user's time zone. Equal values disable quiet hours.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// IANA name of the time zone, e.g. "Europe/Berlin". UTC if missing.
+	Tz string `json:"tz,omitempty"`
+}
+
+// MsgSetDevice is a payload in set.device request to register a device of the user or to change its settings.
+type MsgSetDevice struct {
+	// Client-assigned ID of the device.
+	Id string `json:"id"`
+	// Human-readable name of the device, e.g. "Work laptop".
+	Name string `json:"name,omitempty"`
+	// Platform and the version of the client app. The platform defaults to the one reported in {hi}.
+	Platform string `json:"platf,omitempty"`
+	Version  string `json:"ver,omitempty"`
+	// Public key of the device.
+	PublicKey []byte `json:"pk,omitempty"`
+	// Enable or disable push notifications to the device.
+	Push *bool `json:"push,omitempty"`
+	// Register the device of the current session. Otherwise update an already registered device.
+	Current bool `json:"current,omitempty"`
+}
+
+// MsgKeyBundle is a set of public keys of a device used to establish end-to-end encrypted sessions.
+// The keys are opaque to the server.
+type MsgKeyBundle struct {
+	// Owner of the device, set by the server.
+	User string `json:"user,omitempty"`
+	// Client-assigned ID of the device.
+	Dev string `json:"dev"`
+	// Identity key.
+	IdentityKey []byte `json:"ik"`
+	// Signed prekey and its signature.
+	SignedPreKey []byte `json:"spk"`
+	Signature    []byte `json:"sig"`
+	// One-time prekeys: new keys to add when uploading, at most one key when fetching the bundle
+	// of another user.
+	OneTimeKeys [][]byte `json:"otk,omitempty"`
+	// Number of one-time prekeys left on the server ('me' only).
+	OneTimeCount int `json:"otkcnt,omitempty"`
+	// Time of the last upload.
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// MsgSetSenderKeys is a payload in set.skey request to distribute the sender key of a device to other
+// devices of topic members.
+type MsgSetSenderKeys struct {
+	// ID of the sender's device.
+	Dev string `json:"dev"`
+	// The sender key encrypted for each recipient device.
+	Keys []MsgSenderKey `json:"keys"`
+}
+
+// MsgSenderKey is a sender key distribution message for one device.
+type MsgSenderKey struct {
+	// Recipient when sending, sender when fetching.
+	User string `json:"user"`
+	// Recipient's device when sending, sender's device when fetching.
+	Dev string `json:"dev"`
+	// Encrypted sender key.
+	Data []byte `json:"data"`
+	// Time when the message was sent, set by the server.
+	Timestamp *time.Time `json:"ts,omitempty"`
+}
+
+// MsgSetThread is a payload in set.thread request to change user's settings of a thread.
+type MsgSetThread struct {
+	// ID of the root message of the thread.
+	SeqId int `json:"seq"`
+	// Mute notifications of replies in the thread.
+	Muted bool `json:"muted"`
+}
+
+// MsgSetPin is a payload in set.pin request to pin or unpin a message.
+type MsgSetPin struct {
+	// ID of the message to pin or unpin.
+	SeqId int `json:"seq"`
+	// Unpin the message instead of pinning it.
+	Unpin bool `json:"unpin,omitempty"`
+}
+
+// MsgSetStar is a payload in set.star request to star or unstar a message.
+type MsgSetStar struct {
+	// Topic of the message to unstar, 'me' only.
+	Topic string `json:"topic,omitempty"`
+	// ID of the message to star or unstar.
+	SeqId int `json:"seq"`
+	// Unstar the message instead of starring it.
+	Unstar bool `json:"unstar,omitempty"`
+}
+
+// MsgSetBlock is a payload in set.block request to block or unblock a user across all topics.
+type MsgSetBlock struct {
+	// ID of the user to block or unblock.
+	User string `json:"user"`
+	// Unblock the user instead of blocking.
+	Unblock bool `json:"unblock,omitempty"`
+}
+
+// MsgSetLabels is a payload in set.labels request to replace user-defined labels of a subscription.
+type MsgSetLabels struct {
+	// Topic of the subscription as seen by the user.
+	Topic string `json:"topic"`
+	// New labels of the subscription. Empty list removes all labels.
+	Labels []string `json:"labels"`
+}
+
+// MsgSetArchive is a payload in set.archive request to archive or unarchive the subscription.
+type MsgSetArchive struct {
+	// Archive the subscription if true, unarchive if false.
+	Archived bool `json:"archived"`
+	// Unarchive the subscription when a new message arrives.
+	Unarchive bool `json:"unarchive,omitempty"`
+}
+
+// MsgSetInvite is a payload in set.invite request to create or revoke an invite link to a group topic.
+type MsgSetInvite struct {
+	// Token of the link to revoke.
+	Token string `json:"token,omitempty"`
+	// Revoke the link instead of creating a new one.
+	Revoke bool `json:"revoke,omitempty"`
+
+	// Time when the new link expires, never if missing.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Maximum number of users who may join by the new link, unlimited if 0.
+	MaxUses int `json:"maxuses,omitempty"`
+	// Users who join by the new link wait for approval.
+	Approval bool `json:"approval,omitempty"`
+}
+
+// MsgSetRequest is a payload in set.request request to approve or deny a request to join a group topic.
+type MsgSetRequest struct {
+	// ID of the user who asked to join.
+	User string `json:"user"`
+	// Deny the request instead of approving it.
+	Deny bool `json:"deny,omitempty"`
+}
+
+// MsgSetDirectory is a payload in set.directory request to publish a group topic in the directory.
+type MsgSetDirectory struct {
+	// Category of the topic.
+	Category string `json:"category,omitempty"`
+	// Short description of the topic.
+	Description string `json:"description,omitempty"`
+	// Remove the topic from the directory.
+	Unlist bool `json:"unlist,omitempty"`
+}
+
+// MsgSetRole is a payload in set.role request to assign a role to a subscriber of a group topic.
+type MsgSetRole struct {
+	// ID of the subscriber.
+	User string `json:"user"`
+	// New role: "admin", "moderator", "member" or an empty string to manage the user by the access mode only.
+	Role string `json:"role"`
 }
 
 // MsgRange is either an individual ID (HiId=0) or a randge of IDs, low end inclusive (closed),
@@ -124,6 +430,9 @@ type MsgClientHi struct {
 	Platform string `json:"platf,omitempty"`
 	// Session is initially in non-iteractive, i.e. issued by a service. Presence notifications are delayed.
 	Background bool `json:"bkg,omitempty"`
+	// Drafty inline styles and entities supported by the client, i.e. ["ST", "EM", "LN", "IM"].
+	// If missing, the client is assumed to support all of them.
+	Drafty []string `json:"drafty,omitempty"`
 }
 
 // MsgClientAcc is an {acc} message for creating or updating a user account.
@@ -152,6 +461,18 @@ type MsgClientAcc struct {
 	Desc *MsgSetDesc `json:"desc,omitempty"`
 	// Credentials to verify (email or phone or captcha)
 	Cred []MsgCredClient `json:"cred,omitempty"`
+	// Change of login methods of an existing account.
+	Auth *MsgAccAuth `json:"auth,omitempty"`
+}
+
+// MsgAccAuth lists, adds or removes login methods of an account: {acc auth}.
+type MsgAccAuth struct {
+	// "list", "add" or "del".
+	What string `json:"what"`
+	// Authentication scheme to add or remove.
+	Scheme string `json:"scheme,omitempty"`
+	// Secret of the added scheme, verified by its authenticator.
+	Secret []byte `json:"secret,omitempty"`
 }
 
 // MsgClientLogin is a login {login} message.
@@ -177,6 +498,11 @@ type MsgClientSub struct {
 	// Mirrors {get}.
 	Get *MsgGetQuery `json:"get,omitempty"`
 
+	// Token of an invite link to join a group topic.
+	Token string `json:"token,omitempty"`
+	// Message to managers of a group topic if the request to join waits for approval.
+	Request string `json:"request,omitempty"`
+
 	// Intra-cluster fields.
 
 	// True if this subscription created a new topic.
@@ -195,6 +521,34 @@ const (
 	constMsgMetaDel
 	constMsgMetaCred
 	constMsgMetaAux
+	constMsgMetaMsg
+	constMsgMetaEdits
+	constMsgMetaThreads
+	constMsgMetaSched
+	constMsgMetaPin
+	constMsgMetaReceipts
+	constMsgMetaSess
+	constMsgMetaKeys
+	constMsgMetaSKey
+	constMsgMetaDevices
+	constMsgMetaNotify
+	constMsgMetaMentions
+	constMsgMetaUnread
+	constMsgMetaDrafts
+	constMsgMetaStarred
+	constMsgMetaLabels
+	constMsgMetaArchive
+	constMsgMetaContacts
+	constMsgMetaBlocks
+	constMsgMetaRoles
+	constMsgMetaInvites
+	constMsgMetaRequest
+	constMsgMetaTopics
+	constMsgMetaDirectory
+	constMsgMetaCommands
+	constMsgMetaUsage
+	constMsgMetaCalls
+	constMsgMetaPresence
 )
 
 const (
@@ -203,11 +557,15 @@ const (
 	constMsgDelSub
 	constMsgDelUser
 	constMsgDelCred
+	constMsgDelSched
+	constMsgDelSess
+	constMsgDelKeys
+	constMsgDelDevice
 )
 
 func parseMsgClientMeta(params string) int {
 	var bits int
-	parts := strings.SplitN(params, " ", 8)
+	parts := strings.SplitN(params, " ", 16)
 	for _, p := range parts {
 		switch p {
 		case "desc":
@@ -224,6 +582,52 @@ func parseMsgClientMeta(params string) int {
 			bits |= constMsgMetaCred
 		case "aux":
 			bits |= constMsgMetaAux
+		case "msg":
+			bits |= constMsgMetaMsg
+		case "edits":
+			bits |= constMsgMetaEdits
+		case "threads":
+			bits |= constMsgMetaThreads
+		case "sched":
+			bits |= constMsgMetaSched
+		case "receipts":
+			bits |= constMsgMetaReceipts
+		case "sess":
+			bits |= constMsgMetaSess
+		case "keys":
+			bits |= constMsgMetaKeys
+		case "skey":
+			bits |= constMsgMetaSKey
+		case "devices":
+			bits |= constMsgMetaDevices
+		case "notify":
+			bits |= constMsgMetaNotify
+		case "mentions":
+			bits |= constMsgMetaMentions
+		case "unread":
+			bits |= constMsgMetaUnread
+		case "drafts":
+			bits |= constMsgMetaDrafts
+		case "starred":
+			bits |= constMsgMetaStarred
+		case "contacts":
+			bits |= constMsgMetaContacts
+		case "blocks":
+			bits |= constMsgMetaBlocks
+		case "invites":
+			bits |= constMsgMetaInvites
+		case "topics":
+			bits |= constMsgMetaTopics
+		case "directory":
+			bits |= constMsgMetaDirectory
+		case "commands":
+			bits |= constMsgMetaCommands
+		case "usage":
+			bits |= constMsgMetaUsage
+		case "calls":
+			bits |= constMsgMetaCalls
+		case "presence":
+			bits |= constMsgMetaPresence
 		default:
 			// ignore unknown
 		}
@@ -243,6 +647,14 @@ func parseMsgClientDel(params string) int {
 		return constMsgDelUser
 	case "cred":
 		return constMsgDelCred
+	case "sched":
+		return constMsgDelSched
+	case "sess":
+		return constMsgDelSess
+	case "keys":
+		return constMsgDelKeys
+	case "device":
+		return constMsgDelDevice
 	default:
 		// ignore
 	}
@@ -295,6 +707,10 @@ type MsgClientDel struct {
 	// * "sub" to delete a subscription to topic.
 	// * "user" to delete or disable user.
 	// * "cred" to delete credential (email or phone)
+	// * "sched" to cancel a scheduled message
+	// * "sess" to revoke a session of the user
+	// * "keys" to delete public keys of a device
+	// * "device" to delete a registered device
 	What string `json:"what"`
 	// Delete messages with these IDs (either one by one or a set of ranges)
 	DelSeq []MsgRange `json:"delseq,omitempty"`
@@ -302,6 +718,12 @@ type MsgClientDel struct {
 	User string `json:"user,omitempty"`
 	// Credential to delete
 	Cred *MsgCredClient `json:"cred,omitempty"`
+	// ID of the scheduled message to cancel
+	Sched string `json:"sched,omitempty"`
+	// ID of the session to revoke or "*" to revoke all sessions except the current one
+	Sess string `json:"sess,omitempty"`
+	// ID of the device to delete or to delete keys of, "*" to delete keys of all devices
+	Dev string `json:"dev,omitempty"`
 	// Request to hard-delete objects (i.e. delete messages for all users), if such option is available.
 	Hard bool `json:"hard,omitempty"`
 }
@@ -324,6 +746,68 @@ type MsgClientNote struct {
 	Reaction string `json:"reaction,omitempty"`
 	// New content for message edit (used with what="edit").
 	Content any `json:"content,omitempty"`
+	// Root ID of the thread the read or recv marker is reported for.
+	Thread int `json:"thread,omitempty"`
+}
+
+// MsgClientReact is a request to add or remove an emoji reaction to a message {react}.
+type MsgClientReact struct {
+	Id    string `json:"id,omitempty"`
+	Topic string `json:"topic"`
+	// Server-issued ID of the message to react to.
+	SeqId int `json:"seq"`
+	// Action: "add" (default) - add reaction, "del" - remove reaction.
+	What string `json:"what,omitempty"`
+	// Emoji reaction.
+	Reaction string `json:"reaction"`
+}
+
+// MsgClientVote is a request to vote in a poll or to close the poll {vote}.
+type MsgClientVote struct {
+	Id    string `json:"id,omitempty"`
+	Topic string `json:"topic"`
+	// Server-issued ID of the message with the poll.
+	SeqId int `json:"seq"`
+	// Action: "vote" (default) - cast or replace the vote, "close" - close the poll.
+	What string `json:"what,omitempty"`
+	// Indexes of the chosen options. Empty list retracts the vote.
+	Options []int `json:"options,omitempty"`
+}
+
+// MsgClientFwd is a request to forward a message from another topic {fwd}.
+type MsgClientFwd struct {
+	Id string `json:"id,omitempty"`
+	// Topic to forward the message to.
+	Topic string `json:"topic"`
+	// Topic to forward the message from.
+	Src string `json:"src"`
+	// Server-issued ID of the message to forward.
+	SeqId int `json:"seq"`
+	// Don't echo the message to the session which forwarded it.
+	NoEcho bool `json:"noecho,omitempty"`
+}
+
+// MsgClientReport is a request to report a message or a user to moderators or, in the 'rpt' topic,
+// to act on a report {report}.
+type MsgClientReport struct {
+	Id string `json:"id,omitempty"`
+	// Topic of the reported message or 'rpt'. Blank when reporting a user.
+	Topic string `json:"topic,omitempty"`
+	// Server-issued ID of the reported message or, in 'rpt' topic, of the message with the report.
+	SeqId int `json:"seq,omitempty"`
+	// ID of the reported user.
+	User string `json:"user,omitempty"`
+	// Reason of the report: "spam", "abuse", "illegal" or "other".
+	Reason string `json:"reason,omitempty"`
+	// Optional free-form comment of the reporter.
+	Comment string `json:"comment,omitempty"`
+	// Moderator's action in the 'rpt' topic: "dismiss", "delete" (the message) or "suspend" (the user).
+	What string `json:"what,omitempty"`
+}
+
+// MsgClientTakeout is a request to export all data of the user's account {takeout}.
+type MsgClientTakeout struct {
+	Id string `json:"id,omitempty"`
 }
 
 // MsgClientExtra is not a stand-alone message but extra data which augments the main payload.
@@ -334,6 +818,17 @@ type MsgClientExtra struct {
 	AsUser string `json:"obo,omitempty"`
 	// Altered authentication level set by the root user.
 	AuthLevel string `json:"authlevel,omitempty"`
+	// Content moderation decision on {pub}. Set by the server only.
+	Moderation *MsgModeration `json:"moderation,omitempty"`
+}
+
+// MsgModeration is a decision of the content moderation filters on a message.
+type MsgModeration struct {
+	// Action to take: "flag" or "quarantine".
+	Action string `json:"action"`
+	// Name of the filter which made the decision.
+	Filter string `json:"filter,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
 // ClientComMessage is a wrapper for client messages.
@@ -348,6 +843,13 @@ type ClientComMessage struct {
 	Set   *MsgClientSet   `json:"set"`
 	Del   *MsgClientDel   `json:"del"`
 	Note  *MsgClientNote  `json:"note"`
+	React *MsgClientReact `json:"react"`
+	Vote  *MsgClientVote  `json:"vote"`
+	Fwd   *MsgClientFwd   `json:"fwd"`
+	// Report of a message or user.
+	Report *MsgClientReport `json:"report"`
+	// Export of account data.
+	Takeout *MsgClientTakeout `json:"takeout"`
 	// Optional data.
 	Extra *MsgClientExtra `json:"extra"`
 
@@ -370,6 +872,8 @@ type ClientComMessage struct {
 
 	// Originating session to send an aknowledgement to.
 	sess *Session
+	// Context of the tracing span of the message, nil if not traced.
+	ctx context.Context
 	// The message is initialized (true) as opposite to being used as a wrapper for session.
 	init bool
 }
@@ -390,6 +894,16 @@ func (src *MsgLastSeenInfo) describe() string {
 	return "'" + src.UserAgent + "' @ " + src.When.String()
 }
 
+// MsgUserStatus is a custom status of the user such as "On vacation until Friday".
+type MsgUserStatus struct {
+	// Emoji shown next to the text.
+	Emoji string `json:"emoji,omitempty"`
+	// Text of the status.
+	Text string `json:"text,omitempty"`
+	// Time when the status expires.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
 // MsgCredServer is an account credential such as email or phone number.
 type MsgCredServer struct {
 	// Credential type, i.e. `email` or `tel`.
@@ -439,6 +953,12 @@ type MsgTopicDesc struct {
 
 	// If the topic can be accessed as a channel
 	IsChan bool `json:"chan,omitempty"`
+	// If the channel is in broadcast mode.
+	IsBroadcast bool `json:"broadcast,omitempty"`
+	// If the group topic is a community.
+	IsCommunity bool `json:"community,omitempty"`
+	// Community the group topic belongs to.
+	Parent string `json:"parent,omitempty"`
 
 	// P2P other user's last online timestamp & user agent
 	LastSeen *MsgLastSeenInfo `json:"seen,omitempty"`
@@ -457,6 +977,16 @@ type MsgTopicDesc struct {
 	Trusted any `json:"trusted,omitempty"`
 	// Per-subscription private data
 	Private any `json:"private,omitempty"`
+	// Time to live of messages in seconds.
+	MsgTTL int `json:"ttl,omitempty"`
+	// Minimum interval between messages of a user in seconds.
+	SlowMode int `json:"slow,omitempty"`
+	// Topic is frozen: only managers may publish.
+	Frozen bool `json:"frozen,omitempty"`
+	// IDs of pinned messages.
+	Pinned []int `json:"pinned,omitempty"`
+	// Custom status of the user, 'me' only.
+	Status *MsgUserStatus `json:"status,omitempty"`
 }
 
 func (src *MsgTopicDesc) describe() string {
@@ -520,6 +1050,16 @@ type MsgTopicSub struct {
 	Trusted any `json:"trusted,omitempty"`
 	// User's own private data per topic
 	Private any `json:"private,omitempty"`
+	// User-defined labels of the subscription, 'me' only.
+	Labels []string `json:"labels,omitempty"`
+	// Timestamp when the user archived the subscription.
+	Archived *time.Time `json:"archived,omitempty"`
+	// The subscription is unarchived by a new message.
+	Unarchive bool `json:"unarchive,omitempty"`
+	// Role of the subscriber in a group topic.
+	Role string `json:"role,omitempty"`
+	// Message of the user who asked to join a group topic, reported to managers until the request is approved.
+	Request string `json:"request,omitempty"`
 
 	// Response to non-'me' topic
 
@@ -543,6 +1083,9 @@ type MsgTopicSub struct {
 
 	// Other user's last online timestamp & user agent
 	LastSeen *MsgLastSeenInfo `json:"seen,omitempty"`
+
+	// Custom status of the subscribed user or of the other user of a P2P topic.
+	Status *MsgUserStatus `json:"status,omitempty"`
 }
 
 func (src *MsgTopicSub) describe() string {
@@ -618,6 +1161,44 @@ type MsgServerData struct {
 	SeqId     int            `json:"seq"`
 	Head      map[string]any `json:"head,omitempty"`
 	Content   any            `json:"content"`
+	// Emoji reactions to the message, only in response to {get what="data"}.
+	Reactions []MsgReaction `json:"reactions,omitempty"`
+	// Tally of the poll attached to the message, only in response to {get what="data"}.
+	Poll *MsgPoll `json:"poll,omitempty"`
+	// Machine translation of the message, only in response to {get what="data"} with translate.
+	Translation *MsgTranslation `json:"translation,omitempty"`
+	// Position of the event in the outbox of a resumable session.
+	Cursor int64 `json:"cursor,omitempty"`
+}
+
+// MsgReaction is a count of identical emoji reactions to a message.
+type MsgReaction struct {
+	// Emoji.
+	Val string `json:"val"`
+	// Number of users who reacted with the emoji.
+	Count int `json:"count"`
+	// The requesting user is one of them.
+	Mine bool `json:"mine,omitempty"`
+}
+
+// MsgTranslation is a machine translation of the text of a message.
+type MsgTranslation struct {
+	// Language of the translation.
+	Lang string `json:"lang"`
+	// Language of the message as detected by the translation provider.
+	Src string `json:"src,omitempty"`
+	// Translated text of the message as plain text.
+	Txt string `json:"txt"`
+}
+
+// MsgPoll is the current state of a poll.
+type MsgPoll struct {
+	// Number of votes for each option.
+	Tally []int `json:"tally"`
+	// Options chosen by the requesting user.
+	Mine []int `json:"mine,omitempty"`
+	// Poll is closed, no more votes are accepted.
+	Closed bool `json:"closed,omitempty"`
 }
 
 // Deep-shallow copy.
@@ -656,6 +1237,14 @@ type MsgServerPres struct {
 	// Acs or a delta Acs. Need to marshal it to json under a name different than 'acs'
 	// to allow different handling on the client
 	Acs *MsgAccessMode `json:"dacs,omitempty"`
+	// Number of unread messages in the topic after the change, what="msg" and "read" on 'me'.
+	Unread int `json:"unread,omitempty"`
+	// Number of unread messages which mention the user, what="read" on 'me'.
+	Mentions int `json:"mentions,omitempty"`
+	// The new message mentions the user, what="msg" on 'me'.
+	Mention bool `json:"mention,omitempty"`
+	// Position of the event in the outbox of a resumable session.
+	Cursor int64 `json:"cursor,omitempty"`
 
 	// UNroutable params. All marked with `json:"-"` to exclude from json marshaling.
 	// They are still serialized for intra-cluster communication.
@@ -740,6 +1329,283 @@ type MsgServerMeta struct {
 	Cred []*MsgCredServer `json:"cred,omitempty"`
 	// Auxiliary data
 	Aux map[string]any `json:"aux,omitempty"`
+	// Messages found by search.
+	Msgs []*MsgServerData `json:"msgs,omitempty"`
+	// Previous versions of edited messages.
+	Edits []MsgMessageVersion `json:"edits,omitempty"`
+	// Summaries of threads.
+	Threads []MsgThread `json:"threads,omitempty"`
+	// Messages waiting to be published.
+	Sched []MsgScheduled `json:"sched,omitempty"`
+	// Read and received receipts of a message.
+	Receipts *MsgReceipts `json:"receipts,omitempty"`
+	// Sessions of the user, 'me' only.
+	Sess []MsgSession `json:"sess,omitempty"`
+	// Public keys of devices for end-to-end encryption.
+	Keys []MsgKeyBundle `json:"keys,omitempty"`
+	// Sender key distribution messages waiting for the device.
+	SKey []MsgSenderKey `json:"skey,omitempty"`
+	// Registered devices of the user, 'me' only.
+	Devices []MsgDevice `json:"devices,omitempty"`
+	// Settings of push notifications of the user in 'me' or of the subscription in other topics.
+	Notify *MsgNotifySettings `json:"notify,omitempty"`
+	// Presence settings of the user in 'me' or the override of sharing presence in other topics.
+	Presence *MsgPresenceSettings `json:"presence,omitempty"`
+	// Messages which mention the user, 'me' only.
+	Mentions []MsgMention `json:"mentions,omitempty"`
+	// Counts of unread messages in topics, 'me' only.
+	Unread []MsgTopicUnread `json:"unread,omitempty"`
+	// Drafts of messages, 'me' only.
+	Drafts []MsgDraft `json:"drafts,omitempty"`
+	// Messages starred by the user, 'me' only.
+	Starred []MsgStarred `json:"starred,omitempty"`
+	// Users found by hashes of phone numbers or emails, 'fnd' only.
+	Contacts []MsgContact `json:"contacts,omitempty"`
+	// Users blocked by the user, 'me' only.
+	Blocks []MsgBlock `json:"blocks,omitempty"`
+	// Invite links to a group topic.
+	Invites []MsgInvite `json:"invites,omitempty"`
+	// Topics of a community.
+	Topics []MsgCommunityTopic `json:"topics,omitempty"`
+	// Topics of the directory, 'fnd' only.
+	Directory []MsgDirectoryTopic `json:"directory,omitempty"`
+	// Slash commands of bots available in the topic.
+	Commands []MsgBotCommand `json:"commands,omitempty"`
+	// Storage used by files of the user in 'me' or of the topic.
+	Usage *MsgStorageUsage `json:"usage,omitempty"`
+	// Call history, 'me' only.
+	Calls []MsgCall `json:"calls,omitempty"`
+}
+
+// MsgStorageUsage is the storage used by uploaded files and the quota.
+type MsgStorageUsage struct {
+	// Number of bytes used.
+	Used int64 `json:"used"`
+	// Quota in bytes, 0 if unlimited.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// MsgTopicUnread is the number of unread messages of the user in a topic.
+type MsgTopicUnread struct {
+	// Topic name as seen by the user.
+	Topic string `json:"topic"`
+	// Community the topic belongs to.
+	Parent string `json:"parent,omitempty"`
+	Unread int    `json:"unread"`
+	// Number of unread messages which mention the user.
+	Mentions int `json:"mentions,omitempty"`
+}
+
+// MsgMention is a message which mentions the user.
+type MsgMention struct {
+	// Topic name as seen by the user.
+	Topic string `json:"topic"`
+	SeqId int    `json:"seq"`
+	// Sender of the message.
+	From string `json:"from,omitempty"`
+	// Keyword of the user found in the message, empty for @mentions.
+	Keyword   string    `json:"kw,omitempty"`
+	Timestamp time.Time `json:"ts"`
+}
+
+// MsgCall is a record of a video call in the call history.
+type MsgCall struct {
+	// Topic name as seen by the user.
+	Topic string `json:"topic"`
+	// ID of the message which started the call.
+	SeqId int `json:"seq"`
+	// User who started the call.
+	From      string    `json:"from"`
+	Timestamp time.Time `json:"ts"`
+	// Time when the call ended, missing while the call is in progress.
+	Ended *time.Time `json:"ended,omitempty"`
+	// Final state of the call: "finished", "missed", "declined" or "disconnected".
+	Outcome string `json:"outcome,omitempty"`
+	// Duration of the established call in milliseconds.
+	Duration int `json:"duration,omitempty"`
+	// Users who took part in the call.
+	Participants []string `json:"participants,omitempty"`
+	// True for group calls.
+	Group bool `json:"group,omitempty"`
+}
+
+// MsgStarred is a copy of a message starred by the user.
+type MsgStarred struct {
+	// Topic name as seen by the user.
+	Topic string `json:"topic"`
+	SeqId int    `json:"seq"`
+	// Sender of the message.
+	From    string         `json:"from,omitempty"`
+	Head    map[string]any `json:"head,omitempty"`
+	Content any            `json:"content,omitempty"`
+	// Time when the message was sent.
+	Timestamp time.Time `json:"ts"`
+	// Time when the message was starred.
+	StarredAt time.Time `json:"starred"`
+}
+
+// MsgBlock is a user blocked by the user.
+type MsgBlock struct {
+	User string `json:"user"`
+	// Time when the user was blocked.
+	Timestamp time.Time `json:"ts"`
+}
+
+// MsgInvite is an invite link to a group topic.
+type MsgInvite struct {
+	Token string `json:"token"`
+	// User who created the link.
+	User    string     `json:"user"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// Maximum number of users who may join by the link, unlimited if 0.
+	MaxUses int `json:"maxuses,omitempty"`
+	// Number of users who joined by the link.
+	Uses     int  `json:"uses,omitempty"`
+	Approval bool `json:"approval,omitempty"`
+}
+
+// MsgCommunityTopic is a group topic in the directory of a community.
+type MsgCommunityTopic struct {
+	Topic   string     `json:"topic"`
+	Touched *time.Time `json:"touched,omitempty"`
+	SubCnt  int        `json:"subcnt,omitempty"`
+	Public  any        `json:"public,omitempty"`
+	Trusted any        `json:"trusted,omitempty"`
+	// Numbers of unread messages and of unread mentions of the requester.
+	Unread   int `json:"unread,omitempty"`
+	Mentions int `json:"mentions,omitempty"`
+}
+
+// MsgBotCommand is a slash command handled by a bot.
+type MsgBotCommand struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Usage       string `json:"usage,omitempty"`
+}
+
+// MsgDirectoryTopic is a group topic listed in the directory.
+type MsgDirectoryTopic struct {
+	// Topic name, 'chn' for channels.
+	Topic       string     `json:"topic"`
+	Category    string     `json:"category"`
+	Description string     `json:"description,omitempty"`
+	Public      any        `json:"public,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	SubCnt      int        `json:"subcnt,omitempty"`
+	Touched     *time.Time `json:"touched,omitempty"`
+}
+
+// MsgContact is a user found by the hash of a phone number or email.
+type MsgContact struct {
+	// Hash of the phone number or email in response to a request by hashes.
+	Hash string `json:"hash,omitempty"`
+	// ID of the user in response to a request by hashes.
+	User string `json:"user,omitempty"`
+	// Prefix of the hash in response to a request by prefixes.
+	Prefix string `json:"prefix,omitempty"`
+	// ID of the user encrypted with the full hash as the key in response to a request by prefixes.
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// MsgDevice is a registered device of the user together with its delivery state.
+type MsgDevice struct {
+	// Client-assigned ID of the device.
+	Id        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Platform  string `json:"platf,omitempty"`
+	Version   string `json:"ver,omitempty"`
+	PublicKey []byte `json:"pk,omitempty"`
+	// Time of registration.
+	CreatedAt time.Time `json:"created"`
+	// Time when the device was last active.
+	LastSeen time.Time `json:"seen"`
+	// Push notifications are enabled.
+	Push bool `json:"push"`
+	// The device has a push token.
+	Token bool `json:"token,omitempty"`
+	// Public keys for end-to-end encryption are uploaded.
+	Keys bool `json:"keys,omitempty"`
+	// Number of one-time prekeys left on the server.
+	OneTimeCount int `json:"otkcnt,omitempty"`
+	// Number of sender keys waiting for the device.
+	SenderKeys int `json:"skey,omitempty"`
+	// The device of the session which made the request.
+	Current bool `json:"current,omitempty"`
+}
+
+// MsgSession is a session where the user is or was logged in.
+type MsgSession struct {
+	// ID of the session.
+	Id string `json:"id"`
+	// IP address of the client.
+	RemoteAddr string `json:"ip,omitempty"`
+	UserAgent  string `json:"ua,omitempty"`
+	Platform   string `json:"platf,omitempty"`
+	// Time of login.
+	CreatedAt time.Time `json:"created"`
+	// Time when the session was last active.
+	LastSeen time.Time `json:"seen"`
+	// The session which made the request.
+	Current bool `json:"current,omitempty"`
+}
+
+// MsgThread is a summary of a thread of replies as seen by the user.
+type MsgThread struct {
+	// ID of the root message.
+	SeqId int `json:"seq"`
+	// Number of replies.
+	Count int `json:"count"`
+	// ID of the latest reply.
+	LastSeqId int `json:"last"`
+	// Timestamp of the latest reply.
+	TouchedAt time.Time `json:"touched"`
+	// ID of the latest reply read by the user.
+	ReadSeqId int `json:"read,omitempty"`
+	// Number of unread replies by other users.
+	Unread int `json:"unread,omitempty"`
+	// The user muted the thread.
+	Muted bool `json:"muted,omitempty"`
+}
+
+// MsgScheduled is a message waiting to be published at a later time.
+type MsgScheduled struct {
+	// ID of the scheduled message.
+	Id string `json:"id"`
+	// Time when the message will be published.
+	SendAt time.Time `json:"sendAt"`
+	// Time when the message was scheduled.
+	Timestamp time.Time      `json:"ts"`
+	Head      map[string]any `json:"head,omitempty"`
+	Content   any            `json:"content,omitempty"`
+}
+
+// MsgReceipts lists subscribers who have read or received a message.
+type MsgReceipts struct {
+	// ID of the message.
+	SeqId int `json:"seq"`
+	// Count of subscribers who have read the message.
+	ReadCount int `json:"read"`
+	// Count of subscribers who have received but not read the message.
+	RecvCount int `json:"recv"`
+	// Subscribers who have read the message.
+	ReadBy []string `json:"readBy,omitempty"`
+	// Subscribers who have received but not read the message.
+	RecvBy []string `json:"recvBy,omitempty"`
+}
+
+// MsgMessageVersion is a previous version of an edited message.
+type MsgMessageVersion struct {
+	// Server-issued ID of the message.
+	SeqId int `json:"seq"`
+	// Version number, the original message is version 0.
+	Version int `json:"ver"`
+	// Time when this version was written.
+	Timestamp time.Time `json:"ts"`
+	// Time when this version was replaced by an edit.
+	ReplacedAt time.Time `json:"replaced"`
+	// Content of this version.
+	Content any `json:"content,omitempty"`
 }
 
 // Deep-shallow copy of meta message. Deep copy of Id and Topic fields, shallow copy of payload.
@@ -779,6 +1645,12 @@ func (src *MsgServerMeta) describe() string {
 		x, _ := json.Marshal(src.Aux)
 		s += " aux=[" + string(x) + "]"
 	}
+	if src.Msgs != nil {
+		s += " msgs=" + strconv.Itoa(len(src.Msgs))
+	}
+	if src.Edits != nil {
+		s += " edits=" + strconv.Itoa(len(src.Edits))
+	}
 	return s
 }
 
@@ -790,20 +1662,31 @@ type MsgServerInfo struct {
 	Src string `json:"src,omitempty"`
 	// ID of the user who originated the message.
 	From string `json:"from,omitempty"`
-	// The event being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification, "call" - video call, "react" - emoji reaction, "edit" - message edit, "unsend" - message unsend.
+	// The event being reported: "rcpt" - message received, "read" - message read, "kp" - typing notification, "typing" - aggregated typing notifications, "call" - video call, "react" - emoji reaction, "poll" - poll tally change, "edit" - message edit, "unsend" - message unsend, "takeout" - progress of account data export, "skey" - sender keys are waiting to be fetched, "draft" - a draft was changed in another session, "star" - a message was starred or unstarred in another session.
 	What string `json:"what"`
 	// Server-issued message ID being reported.
 	SeqId int `json:"seq,omitempty"`
-	// Call event.
+	// Call event or reaction change: "add" or "del" (used with what="react"), poll change:
+	// "vote" or "close" (used with what="poll"), export progress: "progress", "ready" or "failed"
+	// (used with what="takeout"), starring: "add" or "del" (used with what="star").
 	Event string `json:"event,omitempty"`
-	// Arbitrary json payload (used by video calls).
+	// Arbitrary json payload (used by video calls and takeouts).
 	Payload json.RawMessage `json:"payload,omitempty"`
 	// Emoji reaction (used with what="react").
 	Reaction string `json:"reaction,omitempty"`
+	// Number of users who reacted with the emoji after the change (used with what="react")
+	// or who have been typing (used with what="typing").
+	Count int `json:"count,omitempty"`
+	// Number of votes for each option of the poll (used with what="poll").
+	Tally []int `json:"tally,omitempty"`
 	// New content for message edit (used with what="edit").
 	Content any `json:"content,omitempty"`
 	// Timestamp when message was edited (used with what="edit").
 	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Root ID of the thread (used with what="read" and "recv").
+	Thread int `json:"thread,omitempty"`
+	// Position of the event in the outbox of a resumable session.
+	Cursor int64 `json:"cursor,omitempty"`
 
 	// UNroutable params. All marked with `json:"-"` to exclude from json marshaling.
 	// They are still serialized for intra-cluster communication.
@@ -861,6 +1744,9 @@ type ServerComMessage struct {
 	// Session ID to skip when sendng packet to sessions. Used to skip sending to original session.
 	// Could be either empty.
 	SkipSid string `json:"-"`
+	// IDs of users the message (or an event related to it) should be delivered to.
+	// Empty if the message is not restricted.
+	Scope []string `json:"-"`
 	// User id affected by this message.
 	uid types.Uid
 }
@@ -878,6 +1764,7 @@ func (src *ServerComMessage) copy() *ServerComMessage {
 		Timestamp: src.Timestamp,
 		sess:      src.sess,
 		SkipSid:   src.SkipSid,
+		Scope:     src.Scope,
 		uid:       src.uid,
 	}
 
@@ -1525,6 +2412,21 @@ func ErrAttachFirst(msg *ClientComMessage, ts time.Time) *ServerComMessage {
 	}
 }
 
+// ErrOutdatedReply the change is older than the stored state (409).
+func ErrOutdatedReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        msg.Id,
+			Code:      http.StatusConflict, // 409
+			Text:      "outdated",
+			Topic:     msg.Original,
+			Timestamp: ts,
+		},
+		Id:        msg.Id,
+		Timestamp: msg.Timestamp,
+	}
+}
+
 // ErrAlreadyExists the object already exists (409).
 func ErrAlreadyExists(id, topic string, ts time.Time) *ServerComMessage {
 	return &ServerComMessage{
@@ -1611,6 +2513,43 @@ func ErrPolicyReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
 	return ErrPolicyExplicitTs(msg.Id, msg.Original, ts, msg.Timestamp)
 }
 
+// ErrQuotaExceededExplicitTs storage quota of the user or topic is exhausted with explicit server and
+// incoming request timestamps (413).
+func ErrQuotaExceededExplicitTs(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        id,
+			Code:      http.StatusRequestEntityTooLarge, // 413
+			Text:      "quota exceeded",
+			Topic:     topic,
+			Timestamp: serverTs,
+		},
+		Id:        id,
+		Timestamp: incomingReqTs,
+	}
+}
+
+// ErrTooManyRequestsExplicitTs the client sends requests too often with explicit server and incoming
+// request timestamps (429).
+func ErrTooManyRequestsExplicitTs(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        id,
+			Code:      http.StatusTooManyRequests, // 429
+			Text:      "too many requests",
+			Topic:     topic,
+			Timestamp: serverTs,
+		},
+		Id:        id,
+		Timestamp: incomingReqTs,
+	}
+}
+
+// ErrTooManyRequestsReply the client sends requests too often in response to a client request (429).
+func ErrTooManyRequestsReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
+	return ErrTooManyRequestsExplicitTs(msg.Id, msg.Original, ts, msg.Timestamp)
+}
+
 // ErrCallBusyExplicitTs indicates a "busy" reply to a video call request (486).
 func ErrCallBusyExplicitTs(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
 	return &ServerComMessage{
@@ -1719,6 +2658,17 @@ func ErrServiceUnavailableExplicitTs(id, topic string, serverTs, incomingReqTs t
 	}
 }
 
+// ErrDraining means the server is being taken out of service, the client should reconnect to another server (503).
+func ErrDraining(ts time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Code:      http.StatusServiceUnavailable, // 503
+			Text:      "draining",
+			Timestamp: ts,
+		},
+	}
+}
+
 // ErrLocked operation rejected because the topic is being deleted (503).
 func ErrLocked(id, topic string, ts time.Time) *ServerComMessage {
 	return ErrLockedExplicitTs(id, topic, ts, ts)
@@ -47,6 +47,11 @@ type Adapter interface {
 	UserGetAll(ids ...t.Uid) ([]t.User, error)
 	// UserDelete deletes user record
 	UserDelete(uid t.Uid, hard bool) error
+	// UserErase hard-deletes or anonymizes data derived from the user which is left intact by UserDelete:
+	// messages in other users' topics, reactions, votes, files, reports, logs. Records deleted by UserDelete
+	// are counted but not deleted. Returns the report and locations of user's files to be deleted
+	// from the media store. If dryRun is true, the data is only counted.
+	UserErase(uid t.Uid, dryRun bool) (t.ErasureReport, []string, error)
 	// UserUpdate updates user record
 	UserUpdate(uid t.Uid, update map[string]any) error
 	// UserUpdateTags adds, removes, or resets user's tags
@@ -57,6 +62,9 @@ type Adapter interface {
 	// the R permission. If read fails, the counts are still returned with the original
 	// user IDs but with the unread count undefined and non-nil error.
 	UserUnreadCount(ids ...t.Uid) (map[t.Uid]int, error)
+	// UserUnreadByTopic returns the numbers of unread messages and of unread mentions of the user
+	// in each topic with the R permission which has unread messages.
+	UserUnreadByTopic(uid t.Uid) ([]t.TopicUnread, error)
 	// UserGetUnvalidated returns a list of no more than 'limit' uids who never logged in,
 	// have no validated credentials and which haven't been updated since 'lastUpdatedBefore'.
 	UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]t.Uid, error)
@@ -91,6 +99,9 @@ type Adapter interface {
 	AuthDelAllRecords(uid t.Uid) (int, error)
 	// AuthUpdRecord modifies an authentication record. Only non-default/non-zero values are updated.
 	AuthUpdRecord(user t.Uid, scheme, unique string, authLvl auth.Level, secret []byte, expires time.Time) error
+	// AuthGetAllRecords returns up to 'limit' records of the scheme ordered by the unique value which is
+	// greater than 'after'. Used to iterate over all users of the scheme.
+	AuthGetAllRecords(scheme, after string, limit int) ([]t.AuthRecord, error)
 
 	// Topic management
 
@@ -100,6 +111,8 @@ type Adapter interface {
 	TopicCreateP2P(initiator, invited *t.Subscription) error
 	// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
 	TopicGet(topic string) (*t.Topic, error)
+	// TopicsForParent loads group topics of the community.
+	TopicsForParent(parent string) ([]t.Topic, error)
 	// TopicsForUser loads subscriptions for a given user. Reads public value.
 	// When the 'opts.IfModifiedSince' query is not nil the subscriptions with UpdatedAt > opts.IfModifiedSince
 	// are returned, where UpdatedAt can be either a subscription, a topic, or a user update timestamp.
@@ -127,6 +140,12 @@ type Adapter interface {
 	TopicUpdate(topic string, update map[string]any) error
 	// TopicOwnerChange updates topic's owner
 	TopicOwnerChange(topic string, newOwner t.Uid) error
+	// TopicNamesByPrefix returns names of all topics which start with the given prefix.
+	TopicNamesByPrefix(prefix string) ([]string, error)
+	// TopicMerge moves messages and subscriptions of topic src into topic dst, re-sequencing messages
+	// of both topics chronologically, then deletes src. Content of src is replaced with the result of
+	// rewrite if it's not nil.
+	TopicMerge(dst, src string, rewrite func(content any) (any, bool, error)) error
 
 	// Topic subscriptions
 
@@ -146,14 +165,15 @@ type Adapter interface {
 
 	// Find searches for users or topics given a list of tags.
 	// - caller is the user or topic who is doing the searching, it will be skipped from results.
+	// - tenant limits the search to users and topics of the tenant.
 	// - prefix if present will cause match rank highest in the results.
 	// - req is a list of required tag sets. Each set is a list of tags. The search will return
 	//   all users/topics which have at least one tag from each set.
 	// - opt is a list of optional tags; if present the result will rank higher.
 	// - activeOnly if true will return only active subscriptions.
-	Find(caller, prefix string, req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error)
-	// FindOne returns topic or user which matches the given tag.
-	FindOne(tag string) (string, error)
+	Find(caller, tenant, prefix string, req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error)
+	// FindOne returns topic or user of the tenant which matches the given tag.
+	FindOne(tenant, tag string) (string, error)
 
 	// Messages
 
@@ -166,14 +186,387 @@ type Adapter interface {
 	MessageDeleteList(topic string, toDel *t.DelMessage) error
 	// MessageGetDeleted returns a list of deleted message Ids.
 	MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error)
-	// MessageAddReaction adds or removes an emoji reaction to a message.
-	MessageAddReaction(topic string, seqId int, oderId string, reaction string) error
 	// MessageGetBySeqId retrieves a single message by topic and sequence ID.
 	MessageGetBySeqId(topic string, seqId int) (*t.Message, error)
-	// MessageEdit updates a message's content and marks it as edited.
+	// MessageEdit updates a message's content and marks it as edited. The previous content is saved
+	// in the edit history.
 	MessageEdit(topic string, seqId int, content any, editedAt time.Time, editCount int) error
+	// MessageGetEdits returns previous versions of edited messages matching the query, newest first.
+	MessageGetEdits(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.MessageVersion, error)
 	// MessageMarkUnsent marks a message as unsent (tombstone).
 	MessageMarkUnsent(topic string, seqId int, unsentAt time.Time) error
+	// MessageRewriteContent replaces content of up to limit messages with ID greater than afterId
+	// in the given topic or in all topics if topic is empty with the result of rewrite.
+	// Returns ID of the last message read and the number of updated messages.
+	MessageRewriteContent(topic string, afterId int64, limit int,
+		rewrite func(topic string, content any) (any, bool, error)) (int64, int, error)
+	// MessageSearch returns messages matching the full-text query, newest first.
+	MessageSearch(forUser t.Uid, query *t.MessageSearchQuery) ([]t.Message, error)
+	// MessageSetSearchTokens replaces blind index tokens of the message. Empty tokens remove the message from the index.
+	MessageSetSearchTokens(topic string, seqId int, tokens []string) error
+	// MessageGetExpired finds up to limit topics with messages older than the time to live of the topic.
+	// Returns the largest expired message ID keyed by topic name.
+	MessageGetExpired(now time.Time, limit int) (map[string]int, error)
+	// MessageGetOlder finds up to limit topics of the retention category cat (t.RetentionP2P, t.RetentionGrp or
+	// t.RetentionChn) with messages created before the given time. If anonymized is false, messages which are
+	// already anonymized are skipped. If tenants is not empty, only topics of the listed tenants are checked or,
+	// if exclude is true, topics of all other tenants.
+	MessageGetOlder(cat string, tenants []string, exclude bool, before time.Time, anonymized bool, limit int) ([]t.RetentionBatch, error)
+	// MessageAnonymize removes the sender and all headers except mime from up to limit messages with
+	// IDs up to upto inclusive. Returns the number of anonymized messages.
+	MessageAnonymize(topic string, upto, limit int) (int, error)
+	// MessageGetColdTopics finds up to limit topics with messages created before the given time which can be
+	// moved to cold storage. Topics with the time to live of messages and topics of the retention categories
+	// listed in skipCats are skipped.
+	MessageGetColdTopics(before time.Time, skipCats []string, limit int) ([]string, error)
+	// MessageGetCold returns up to limit oldest messages of the topic created before the given time which
+	// can be moved to cold storage: not deleted and without attachments. Messages are ordered by ID.
+	MessageGetCold(topic string, before time.Time, limit int) ([]t.Message, error)
+	// MessageTierCreate records the range of messages moved to cold storage and deletes the messages with
+	// the given IDs from the database. Fails with t.ErrFailed if any of the messages was changed or deleted
+	// at or after readAt.
+	MessageTierCreate(tier *t.MessageTier, seqIds []int, readAt time.Time) error
+	// MessageGetTiers returns ranges of messages in cold storage which overlap [low, hi), ordered by Low
+	// descending, and ranges of messages deleted for all users or for forUser which overlap the same IDs.
+	MessageGetTiers(topic string, forUser t.Uid, low, hi int) ([]t.MessageTier, []t.Range, error)
+	// MessageTierGetOrphaned returns up to limit ranges of messages in cold storage of deleted topics.
+	MessageTierGetOrphaned(limit int) ([]t.MessageTier, error)
+	// MessageTierDelete deletes the record of the range of messages in cold storage.
+	MessageTierDelete(topic string, low int) error
+	// MessageTierGetTopics returns topics with messages in cold storage which the user is or was subscribed to.
+	MessageTierGetTopics(uid t.Uid) ([]string, error)
+	// MessageTierUpdate replaces the blob of the range of messages in cold storage with a blob of count messages
+	// under the given key.
+	MessageTierUpdate(topic string, low int, key string, count int) error
+	// MessageGetAllBySender returns up to limit messages sent by the user with ID greater than afterId
+	// in all topics, ordered by ID. Messages deleted for all users are skipped.
+	// Returns ID of the last message read.
+	MessageGetAllBySender(from t.Uid, afterId int64, limit int) ([]t.Message, int64, error)
+
+	// Reactions
+
+	// ReactionAdd adds user's emoji reaction to a message. Returns false if the user already has
+	// the reaction.
+	ReactionAdd(topic string, seqId int, user t.Uid, reaction string) (bool, error)
+	// ReactionDelete removes user's emoji reaction to a message. Returns false if the user has
+	// no such reaction.
+	ReactionDelete(topic string, seqId int, user t.Uid, reaction string) (bool, error)
+	// ReactionCount returns the number of users who reacted to the message with the emoji.
+	ReactionCount(topic string, seqId int, reaction string) (int, error)
+	// ReactionGetAll returns reactions to the given messages aggregated by message and emoji.
+	ReactionGetAll(topic string, forUser t.Uid, seqIds []int) ([]t.Reaction, error)
+
+	// Polls
+
+	// PollCreate saves a new poll attached to the message topic:seqId.
+	PollCreate(topic string, poll *t.Poll) error
+	// PollVote atomically replaces the votes of the user in the poll with the given options.
+	// Returns ErrNotFound if the poll does not exist, ErrPolicy if the poll is closed.
+	PollVote(topic string, seqId int, user t.Uid, options []int) error
+	// PollClose closes the poll to new votes. Returns false if the poll is already closed or not found.
+	PollClose(topic string, seqId int) (bool, error)
+	// PollGetAll returns polls attached to the given messages with their tallies.
+	PollGetAll(topic string, forUser t.Uid, seqIds []int) ([]t.Poll, error)
+
+	// Translations
+
+	// TranslationGetAll returns cached translations of the given messages to the language.
+	TranslationGetAll(topic, lang string, seqIds []int) ([]t.Translation, error)
+	// TranslationSave creates or replaces cached translations of messages.
+	TranslationSave(topic string, translations []t.Translation) error
+
+	// Moderation
+
+	// ModerationLogAdd saves a content moderation decision.
+	ModerationLogAdd(rec *t.ModerationRecord) error
+	// ModerationLogGetAll returns the most recent moderation decisions in the topic, newest first.
+	// Decisions in all topics are returned if topic is blank.
+	ModerationLogGetAll(topic string, limit int) ([]t.ModerationRecord, error)
+
+	// Takeouts
+
+	// TakeoutCreate saves a new export of user's data.
+	TakeoutCreate(tk *t.Takeout) error
+	// TakeoutGetLast returns the most recent export of user's data or nil if the user has none.
+	TakeoutGetLast(uid t.Uid) (*t.Takeout, error)
+	// TakeoutFinish sets the final status of the export and, if the export is ready, the archive.
+	TakeoutFinish(tk *t.Takeout) error
+
+	// Audit log
+
+	// AuditLogAdd saves a record of a security-relevant event.
+	AuditLogAdd(rec *t.AuditRecord) error
+	// AuditLogGetAll returns the most recent audit records matching the query, newest first.
+	AuditLogGetAll(query *t.AuditQuery) ([]t.AuditRecord, error)
+	// AuditLogExpire deletes audit records created before the given time. Returns the number of deleted records.
+	AuditLogExpire(before time.Time) (int, error)
+
+	// Reports
+
+	// ReportCreate saves a new report. Returns ErrDuplicate if the reporter has an open report about the
+	// same message or user.
+	ReportCreate(rpt *t.Report) error
+	// ReportGet returns the report by ID or nil if not found.
+	ReportGet(id t.Uid) (*t.Report, error)
+	// ReportClaim marks the report as posted to the 'rpt' topic. Returns false if it's already posted.
+	ReportClaim(id t.Uid) (bool, error)
+	// ReportGetUnposted returns up to 'limit' open reports not yet posted to the 'rpt' topic, oldest first.
+	ReportGetUnposted(limit int) ([]t.Report, error)
+	// ReportResolve closes an open report. Returns false if the report is not found or not open.
+	ReportResolve(id t.Uid, status, action string, by t.Uid) (bool, error)
+
+	// Threads
+
+	// ThreadGetAll returns summaries of threads in the topic as seen by the user, the most recently
+	// updated first. The query must use IDs of thread roots.
+	ThreadGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Thread, error)
+	// ThreadSetRead advances user's read marker in the thread.
+	ThreadSetRead(topic string, user t.Uid, threadId, readSeqId int) error
+	// ThreadSetMuted mutes or unmutes notifications of the thread for the user.
+	ThreadSetMuted(topic string, user t.Uid, threadId int, muted bool) error
+	// ThreadGetMuted returns users who muted the thread.
+	ThreadGetMuted(topic string, threadId int) ([]t.Uid, error)
+
+	// Scheduled messages
+
+	// ScheduledAdd saves a message to be published later. The attachments are listed as file IDs
+	// to exempt them from garbage collection.
+	ScheduledAdd(msg *t.ScheduledMessage, fids []string) error
+	// ScheduledGetDue returns up to 'limit' messages due at or before the given time, the earliest first.
+	ScheduledGetDue(before time.Time, limit int) ([]t.ScheduledMessage, error)
+	// ScheduledGetAll returns pending messages of the user in the topic, the earliest first.
+	ScheduledGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error)
+	// ScheduledDelete deletes a pending message. If the user is not zero the message must belong to the user.
+	// Returns false if the message was not found, e.g. it was delivered or deleted by someone else.
+	ScheduledDelete(topic string, user, id t.Uid) (bool, error)
+
+	// Session records
+
+	// SessionUpsert creates or replaces a record of the user's session.
+	SessionUpsert(sess *t.SessionRecord) error
+	// SessionTouch updates the time when the session was last active. A missing record is not an error.
+	SessionTouch(id string, lastSeen time.Time) error
+	// SessionGetAll returns records of the user's sessions, the most recently active first.
+	SessionGetAll(user t.Uid) ([]t.SessionRecord, error)
+	// SessionDelete deletes a record of the user's session. Returns false if the record was not found.
+	SessionDelete(user t.Uid, id string) (bool, error)
+
+	// Group call records
+
+	// CallCreate creates a record of a group call.
+	CallCreate(call *t.CallRecord) error
+	// CallEnd saves the end time, outcome, duration and participants of the call.
+	CallEnd(call *t.CallRecord) error
+	// CallGet returns the record of the call started by the message seqId, nil if not found.
+	CallGet(topic string, seqId int) (*t.CallRecord, error)
+	// CallGetAll returns records of calls in the given topics started before the given time, the most
+	// recent first.
+	CallGetAll(topics []string, before *time.Time, limit int) ([]t.CallRecord, error)
+
+	// End-to-end encryption keys
+
+	// KeyBundleUpsert creates or replaces the public keys of the user's device. One-time prekeys are
+	// added to those already stored, keeping at most maxOneTime most recent keys.
+	KeyBundleUpsert(kb *t.KeyBundle, maxOneTime int) error
+	// KeyBundleGetAll returns key bundles of all devices of the user. If consume is true, each bundle
+	// contains at most one one-time prekey which is deleted, otherwise one-time prekeys are only counted.
+	KeyBundleGetAll(user t.Uid, consume bool) ([]t.KeyBundle, error)
+	// KeyBundleDelete deletes the key bundle of the user's device or of all devices if deviceId is empty.
+	// Returns false if nothing was deleted.
+	KeyBundleDelete(user t.Uid, deviceId string) (bool, error)
+	// SenderKeyAdd saves sender key distribution messages. A message replaces an earlier message
+	// from the same sender's device to the same recipient's device in the same topic.
+	SenderKeyAdd(keys []t.SenderKey) error
+	// SenderKeyPopAll returns and deletes sender key distribution messages for the user's device in the topic.
+	SenderKeyPopAll(topic string, user t.Uid, deviceId string) ([]t.SenderKey, error)
+
+	// Registered devices
+
+	// UserDeviceUpsert creates or updates the record of the user's device. Empty name and nil public key
+	// do not replace existing values. Push setting and creation time of existing records are not changed.
+	UserDeviceUpsert(dev *t.UserDevice) error
+	// UserDeviceUpdate updates the record of the user's device. Returns false if the record was not found.
+	UserDeviceUpdate(user t.Uid, id string, update map[string]any) (bool, error)
+	// UserDeviceGetAll returns records of the user's devices with their delivery state, the most recently
+	// active first.
+	UserDeviceGetAll(user t.Uid) ([]t.UserDevice, error)
+	// UserDeviceDelete deletes the record of the user's device together with its encryption keys.
+	// Returns false if the record was not found.
+	UserDeviceDelete(user t.Uid, id string) (bool, error)
+
+	// Notification settings
+
+	// NotifySettingsGet returns notification settings of the given users. Users without settings are skipped.
+	NotifySettingsGet(users []t.Uid) ([]t.NotifySettings, error)
+	// NotifySettingsUpsert creates or replaces notification settings of the user.
+	NotifySettingsUpsert(settings *t.NotifySettings) error
+	// TopicNotifyGet returns settings of notifications from the topic of its subscribers who changed them.
+	TopicNotifyGet(topic string) ([]t.TopicNotifySettings, error)
+	// TopicNotifyUpsert creates or replaces settings of notifications from a topic of one user.
+	TopicNotifyUpsert(settings *t.TopicNotifySettings) error
+
+	// Presence settings
+
+	// PresenceSettingsGet returns presence settings of the given users. Users without settings are skipped.
+	PresenceSettingsGet(users []t.Uid) ([]t.PresenceSettings, error)
+	// PresenceSettingsUpsert creates or replaces presence settings of the user.
+	PresenceSettingsUpsert(settings *t.PresenceSettings) error
+	// TopicPresenceGet returns overrides of sharing presence in the topic if topic is not blank, otherwise
+	// overrides of the user in all topics.
+	TopicPresenceGet(topic string, user t.Uid) ([]t.TopicPresenceSettings, error)
+	// TopicPresenceUpsert creates or replaces the override of sharing presence in a topic of one user.
+	TopicPresenceUpsert(settings *t.TopicPresenceSettings) error
+
+	// SMS notifications
+
+	// SmsCreate saves a record of a new SMS notification.
+	SmsCreate(msg *t.SmsMessage) error
+	// SmsUpdate changes the provider ID and the status of the SMS notification. Empty provider ID is not
+	// changed. Returns false if the record does not exist.
+	SmsUpdate(id, providerId, status, errText string, updatedAt time.Time) (bool, error)
+	// SmsCount returns the number of SMS notifications sent to the user, or to all users if the user is zero,
+	// since the given time.
+	SmsCount(user t.Uid, since time.Time) (int, error)
+	// SmsGetAll returns the most recent SMS notifications sent to the user, newest first.
+	SmsGetAll(user t.Uid, limit int) ([]t.SmsMessage, error)
+
+	// Mentions
+
+	// MentionAdd adds messages to the index of mentions of users.
+	MentionAdd(mentions []t.Mention) error
+	// MentionGetAll returns mentions of the user in the given topics, the most recent first. Mentions in
+	// messages deleted for the user are skipped.
+	MentionGetAll(forUser t.Uid, topics []string, before *time.Time, limit int) ([]t.Mention, error)
+	// MentionCount returns the number of mentions of the user in the topic in messages with IDs greater than since.
+	MentionCount(forUser t.Uid, topic string, since int) (int, error)
+
+	// Drafts
+
+	// DraftUpsert saves the draft unless the stored draft of the user in the topic has the same
+	// or a later timestamp. Returns false if the draft was not saved.
+	DraftUpsert(draft *t.Draft) (bool, error)
+	// DraftGetAll returns drafts of the user updated after the given time including deleted ones,
+	// or all drafts which are not deleted if the time is nil.
+	DraftGetAll(user t.Uid, since *time.Time) ([]t.Draft, error)
+
+	// Starred messages
+
+	// StarredAdd saves a copy of the message starred by the user. Returns false if the message is already starred.
+	StarredAdd(msg *t.StarredMessage) (bool, error)
+	// StarredDelete deletes the starred message of the user. Returns false if the message was not starred.
+	StarredDelete(user t.Uid, topic string, seqId int) (bool, error)
+	// StarredGetAll returns messages starred by the user before the given time, optionally in one topic only,
+	// the most recently starred first.
+	StarredGetAll(user t.Uid, topic string, before *time.Time, limit int) ([]t.StarredMessage, error)
+
+	// Blocked users
+
+	// BlocksAdd blocks the target user on behalf of the user. Returns false if the target is already blocked.
+	BlocksAdd(block *t.Block) (bool, error)
+	// BlocksDelete unblocks the target user. Returns false if the target was not blocked.
+	BlocksDelete(user, target t.Uid) (bool, error)
+	// BlocksGetAll returns blocks made by the user and blocks of the user by others.
+	BlocksGetAll(user t.Uid) ([]t.Block, error)
+	// BlocksGetBetween returns blocks where both the blocker and the blocked user are in the list.
+	BlocksGetBetween(users []t.Uid) ([]t.Block, error)
+
+	// Invite links
+
+	// InvitesCreate saves a new invite link to a topic.
+	InvitesCreate(invite *t.Invite) error
+	// InvitesGetAll returns invite links to the topic, the most recent first.
+	InvitesGetAll(topic string) ([]t.Invite, error)
+	// InvitesUse counts a use of the invite link to the topic and returns the link. Returns nil if the
+	// link does not exist, has expired or has been used the maximum number of times.
+	InvitesUse(topic, token string, now time.Time) (*t.Invite, error)
+	// InvitesDelete revokes the invite link to the topic. Returns false if the link does not exist.
+	InvitesDelete(topic, token string) (bool, error)
+
+	// Public directory of topics
+
+	// DirectoryUpsert publishes the topic in the directory or updates its entry.
+	DirectoryUpsert(entry *t.DirectoryEntry) error
+	// DirectoryDelete removes the topic from the directory. Returns false if the topic is not listed.
+	DirectoryDelete(topic string) (bool, error)
+	// DirectoryList returns active listed topics of the tenant in the category or in all categories if the
+	// category is empty, the most popular first as of the given time.
+	DirectoryList(tenant, category string, now time.Time, offset, limit int) ([]t.DirectoryEntry, error)
+
+	// Outgoing webhooks
+
+	// WebhooksCreate saves a new webhook.
+	WebhooksCreate(hook *t.Webhook) error
+	// WebhooksGetAll returns webhooks of the topic or server-wide webhooks if the topic is empty.
+	WebhooksGetAll(topic string) ([]t.Webhook, error)
+	// WebhooksDelete deletes the webhook. Returns false if the webhook does not exist.
+	WebhooksDelete(id string) (bool, error)
+
+	// Incoming webhooks
+
+	// InWebhooksCreate saves a new incoming webhook.
+	InWebhooksCreate(hook *t.IncomingWebhook) error
+	// InWebhooksGet returns the incoming webhook with the token or nil if not found.
+	InWebhooksGet(token string) (*t.IncomingWebhook, error)
+	// InWebhooksGetAll returns incoming webhooks of the topic.
+	InWebhooksGetAll(topic string) ([]t.IncomingWebhook, error)
+	// InWebhooksDelete deletes the incoming webhook. Returns false if the webhook does not exist.
+	InWebhooksDelete(token string) (bool, error)
+
+	// Matrix bridge
+
+	// MatrixRoomsLink bridges the topic to the room replacing the previous room of the topic.
+	MatrixRoomsLink(link *t.MatrixRoom) error
+	// MatrixRoomsGet returns the link by the topic or, if the topic is empty, by the room. Returns nil
+	// if not found.
+	MatrixRoomsGet(topic, room string) (*t.MatrixRoom, error)
+	// MatrixRoomsUnlink removes the bridge of the topic. Returns false if the topic is not bridged.
+	MatrixRoomsUnlink(topic string) (bool, error)
+
+	// Email gateway
+
+	// MailboxesCreate saves a new mailbox. Returns ErrDuplicate if the address is taken.
+	MailboxesCreate(box *t.Mailbox) error
+	// MailboxesGet returns the mailbox with the address or nil if not found.
+	MailboxesGet(address string) (*t.Mailbox, error)
+	// MailboxesGetAll returns mailboxes of the topic.
+	MailboxesGetAll(topic string) ([]t.Mailbox, error)
+	// MailboxesDelete deletes the mailbox. Returns false if the mailbox does not exist.
+	MailboxesDelete(address string) (bool, error)
+
+	// Contact discovery
+
+	// ContactsInit sets the salt of hashes of users' phone numbers and emails and rebuilds the index of
+	// hashes if the salt has changed. Empty salt disables the index.
+	ContactsInit(salt string) error
+	// ContactsFind returns active users of the tenant with the given hashes of phone numbers or emails.
+	ContactsFind(tenant string, hashes []string) ([]t.ContactHash, error)
+	// ContactsFindByPrefix returns active users of the tenant with hashes of phone numbers or emails
+	// starting with any of the given prefixes.
+	ContactsFindByPrefix(tenant string, prefixes []string) ([]t.ContactHash, error)
+
+	// Tenants
+
+	// TenantsCreate saves a new tenant. Returns ErrDuplicate if the ID is taken.
+	TenantsCreate(tenant *t.Tenant) error
+	// TenantsGetAll returns all tenants.
+	TenantsGetAll() ([]t.Tenant, error)
+	// TenantsUpdate replaces the name, hosts and config of the tenant. Returns false if the tenant does not exist.
+	TenantsUpdate(tenant *t.Tenant) (bool, error)
+	// TenantsDelete deletes the tenant which has no users. Returns false if the tenant does not exist
+	// or has users.
+	TenantsDelete(id string) (bool, error)
+
+	// Usage metering
+
+	// UsageAdd adds counts of the records to the usage of the users in the billing periods.
+	UsageAdd(records []t.UsageRecord) error
+	// UsageGet returns usage of the user in the billing period.
+	UsageGet(period string, uid t.Uid) (*t.UsageRecord, error)
+	// UsageTotal returns the total usage of all users of the tenant in the billing period.
+	UsageTotal(period, tenant string) (*t.UsageRecord, error)
+	// UsageList returns usage of users of the tenants in the billing period, of users of all tenants
+	// if tenants is nil. Users without usage in the period and without uploaded files are omitted.
+	UsageList(period string, tenants []string) ([]t.UsageRecord, error)
 
 	// Devices (for push notifications)
 
@@ -192,8 +585,15 @@ type Adapter interface {
 	FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.FileDef, error)
 	// FileGet fetches a record of a specific file
 	FileGet(fid string) (*t.FileDef, error)
+	// FileGetAllByUser returns records of all completed uploads by the user.
+	FileGetAllByUser(uid t.Uid) ([]t.FileDef, error)
+	// FileUsageByUser returns the total size of completed uploads by the user.
+	FileUsageByUser(uid t.Uid) (int64, error)
+	// FileUsageByTopic returns the total size of completed uploads attached to the topic or its messages
+	// together with the files fids which may not be attached yet.
+	FileUsageByTopic(topic string, fids []string) (int64, error)
 	// FileDeleteUnused deletes records where UseCount is zero. If olderThan is non-zero, deletes
-	// unused records with UpdatedAt before olderThan.
+	// unused records with UpdatedAt before olderThan. Archives of unexpired takeouts are kept.
 	// Returns array of FileDef.Location of deleted filerecords so actual files can be deleted too.
 	FileDeleteUnused(olderThan time.Time, limit int) ([]string, error)
 	// FileLinkAttachments connects given topic or message to the file record IDs from the list.
@@ -207,7 +607,7 @@ type Adapter interface {
 	PCacheUpsert(key string, value string, failOnDuplicate bool) error
 	// PCacheDelete deletes a single persistent cache entry.
 	PCacheDelete(key string) error
-	// PCacheExpire expires older entries with the specified key prefix.
+	// PCacheExpire expires older entries with the specified key prefix. The prefix is matched literally.
 	PCacheExpire(keyPrefix string, olderThan time.Time) error
 
 	// Testing
@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"regexp"
 	"slices"
 	"sort"
 	"strconv"
@@ -3051,7 +3052,7 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	}
 
 	_, err := a.db.Collection("kvmeta").DeleteMany(a.ctx, b.M{"createdat": b.M{"$lt": olderThan},
-		"_id": primitive.Regex{Pattern: "^" + keyPrefix}})
+		"_id": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(keyPrefix)}})
 	return err
 }
 
@@ -1,3 +1,5 @@
+//go:build mongodb
+
 // To test another db backend:
 // 1) Create GetAdapter function inside your db backend adapter package (like one inside mongodb adapter)
 // 2) Uncomment your db backend package ('backend' named package)
@@ -520,7 +522,7 @@ func TestSubsForTopic(t *testing.T) {
 
 func TestFind(t *testing.T) {
 	reqTags := [][]string{{"alice", "bob", "carol", "travel", "qwer", "asdf", "zxcv"}}
-	gotSubs, err := adp.Find("usr"+testData.Users[2].Id, "", reqTags, nil, true)
+	gotSubs, err := adp.Find("usr"+testData.Users[2].Id, "", "", reqTags, nil, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -3629,10 +3629,14 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 		defer cancel()
 	}
 
-	_, err := a.db.ExecContext(ctx, "DELETE FROM kvmeta WHERE `key` LIKE ? AND createdat<?", keyPrefix+"%", olderThan)
+	_, err := a.db.ExecContext(ctx, "DELETE FROM kvmeta WHERE `key` LIKE ? AND createdat<?",
+		likeEscaper.Replace(keyPrefix)+"%", olderThan)
 	return err
 }
 
+// Escapes wildcards of LIKE patterns. Backslash is the default escape character of MySQL.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 // GetTestDB returns a currently open database connection.
 func (a *adapter) GetTestDB() any {
 	return a.db
@@ -1,3 +1,5 @@
+//go:build mysql
+
 // To test another db backend:
 // 1) Create GetAdapter function inside your db backend adapter package (like one inside mysql adapter)
 // 2) Uncomment your db backend package ('backend' named package)
@@ -562,7 +564,7 @@ func TestSubsForTopic(t *testing.T) {
 
 func TestFind(t *testing.T) {
 	reqTags := [][]string{{"alice", "bob", "carol", "travel", "qwer", "asdf", "zxcv"}}
-	got, err := adp.Find("usr"+testData.Users[2].Id, "", reqTags, nil, true)
+	got, err := adp.Find("usr"+testData.Users[2].Id, "", "", reqTags, nil, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,95 @@
+//go:build postgres
+// +build postgres
+
+package postgres
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// testTx counts commits and rollbacks of the transaction.
+type testTx struct {
+	pgx.Tx
+	commitErr error
+	commits   *int
+	rollbacks *int
+}
+
+func (tx *testTx) Commit(ctx context.Context) error {
+	*tx.commits++
+	return tx.commitErr
+}
+
+func (tx *testTx) Rollback(ctx context.Context) error {
+	*tx.rollbacks++
+	return nil
+}
+
+func TestIsRetryable(t *testing.T) {
+	if !isRetryable(&pgconn.PgError{Code: "40001", Message: "restart transaction"}) {
+		t.Error("Serialization failure is not retryable")
+	}
+	for _, err := range []error{nil, &pgconn.PgError{Code: "23505"}, errors.New("connection reset")} {
+		if isRetryable(err) {
+			t.Errorf("Error %v is retryable", err)
+		}
+	}
+}
+
+func TestRetryTx(t *testing.T) {
+	ctx := context.Background()
+	conflict := &pgconn.PgError{Code: "40001"}
+
+	testCases := []struct {
+		name string
+		// Errors returned by fn and by commit in consecutive attempts.
+		fnErrs, commitErrs []error
+		retries            int
+		err                error
+		attempts, commits  int
+	}{
+		{"success", []error{nil}, []error{nil}, 5, nil, 1, 1},
+		{"conflict in fn", []error{conflict, nil}, []error{nil, nil}, 5, nil, 2, 1},
+		{"conflict on commit", []error{nil, nil, nil}, []error{conflict, conflict, nil}, 5, nil, 3, 3},
+		{"no retries", []error{conflict}, []error{nil}, 0, conflict, 1, 0},
+		{"retries exhausted", []error{conflict, conflict, conflict}, []error{nil, nil, nil}, 2, conflict, 3, 0},
+		{"other error", []error{errors.New("failed"), nil}, []error{nil, nil}, 5, errors.New("failed"), 1, 0},
+	}
+	for _, tc := range testCases {
+		attempts, commits, rollbacks := 0, 0, 0
+		begin := func() (pgx.Tx, error) {
+			tx := &testTx{commitErr: tc.commitErrs[attempts], commits: &commits, rollbacks: &rollbacks}
+			attempts++
+			return tx, nil
+		}
+		err := retryTx(ctx, begin, tc.retries, func(tx pgx.Tx) error {
+			return tc.fnErrs[attempts-1]
+		})
+		if (err == nil) != (tc.err == nil) || (err != nil && err.Error() != tc.err.Error()) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+		// Every failed attempt is rolled back.
+		failures := attempts
+		if err == nil {
+			failures--
+		}
+		if attempts != tc.attempts || commits != tc.commits || rollbacks != failures {
+			t.Errorf("%s: unexpected attempts %d, commits %d, rollbacks %d", tc.name, attempts, commits, rollbacks)
+		}
+	}
+
+	// Failure to start a transaction is not retried.
+	failed := errors.New("no connection")
+	attempts := 0
+	if err := retryTx(ctx, func() (pgx.Tx, error) {
+		attempts++
+		return nil, failed
+	}, 5, func(tx pgx.Tx) error { return nil }); err != failed || attempts != 1 {
+		t.Errorf("Expected one failed attempt, got %d %v", attempts, err)
+	}
+}
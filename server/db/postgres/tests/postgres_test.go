@@ -1,3 +1,5 @@
+//go:build postgres
+
 // To test another db backend:
 // 1) Create GetAdapter function inside your db backend adapter package (like one inside postgres adapter)
 // 2) Uncomment your db backend package ('backend' named package)
@@ -16,7 +18,9 @@ import (
 	"log"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -585,7 +589,7 @@ func TestSubsForTopic(t *testing.T) {
 
 func TestFind(t *testing.T) {
 	reqTags := [][]string{{"alice", "bob", "carol", "travel", "qwer", "asdf", "zxcv"}}
-	got, err := adp.Find("usr"+testData.Users[2].Id, "", reqTags, nil, true)
+	got, err := adp.Find("usr"+testData.Users[2].Id, "", "", reqTags, nil, true)
 	if err != nil {
 		t.Error(err)
 	} else if len(got) != 3 {
@@ -595,7 +599,7 @@ func TestFind(t *testing.T) {
 
 func TestFindOne(t *testing.T) {
 	// Test PostgreSQL specific FindOne method
-	found, err := adp.FindOne("alice")
+	found, err := adp.FindOne("", "alice")
 	if err != nil {
 		t.Error(err)
 	}
@@ -605,7 +609,7 @@ func TestFindOne(t *testing.T) {
 	}
 
 	// Test not found
-	found, err = adp.FindOne("nonexistent")
+	found, err = adp.FindOne("", "nonexistent")
 	if err != nil {
 		t.Error(err)
 	}
@@ -614,6 +618,80 @@ func TestFindOne(t *testing.T) {
 	}
 }
 
+func TestTenants(t *testing.T) {
+	tenant := &types.Tenant{Id: "acme", Name: "Acme", Hosts: types.StringSlice{"chat.acme.com"},
+		Config: types.TenantConfig{AuthSchemes: []string{"basic"}, UserQuota: 10}}
+	tenant.CreatedAt = types.TimeNow()
+	tenant.UpdatedAt = tenant.CreatedAt
+	if err := adp.TenantsCreate(tenant); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.TenantsCreate(tenant); err != types.ErrDuplicate {
+		t.Error(mismatchErrorString("duplicate", err, types.ErrDuplicate))
+	}
+
+	tenant.Config.UserQuota = 20
+	if ok, err := adp.TenantsUpdate(tenant); err != nil || !ok {
+		t.Error("Failed to update tenant", err)
+	}
+	got, err := adp.TenantsGetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Hosts[0] != "chat.acme.com" || got[0].Config.UserQuota != 20 {
+		t.Error(mismatchErrorString("Tenants", got, tenant))
+	}
+
+	// Users of the default tenant are not visible in other tenants.
+	if found, err := adp.FindOne("acme", "alice"); err != nil || found != "" {
+		t.Error("Found user of another tenant", found, err)
+	}
+
+	if ok, err := adp.TenantsDelete("acme"); err != nil || !ok {
+		t.Error("Failed to delete tenant", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	uid := types.ParseUserId("usr" + testData.Users[0].Id)
+	for i := 0; i < 2; i++ {
+		if err := adp.UsageAdd([]types.UsageRecord{
+			{Period: "2026-10", User: testData.Users[0].Id, Messages: 2, Pushes: 1, CallSeconds: 60},
+			{Period: "2026-10", User: testData.Users[1].Id, Messages: 1},
+			{Period: "2026-09", User: testData.Users[0].Id, Messages: 5},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := adp.UsageGet("2026-10", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Messages != 4 || got.Pushes != 2 || got.CallSeconds != 120 {
+		t.Error(mismatchErrorString("Usage", got, "messages 4, pushes 2, call seconds 120"))
+	}
+
+	total, err := adp.UsageTotal("2026-10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Messages != 6 || total.Pushes != 2 {
+		t.Error(mismatchErrorString("Total usage", total, "messages 6, pushes 2"))
+	}
+
+	list, err := adp.UsageList("2026-09", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].User != testData.Users[0].Id || list[0].Messages != 10 {
+		t.Error(mismatchErrorString("Usage list", list, "messages 10 of the first user"))
+	}
+	if list, err = adp.UsageList("2026-10", []string{"acme"}); err != nil || len(list) != 0 {
+		t.Error(mismatchErrorString("Usage of tenant", list, "none"), err)
+	}
+}
+
 func TestMessageGetAll(t *testing.T) {
 	opts := types.QueryOpt{
 		Since:  1,
@@ -719,6 +797,44 @@ func TestUserUpdateTags(t *testing.T) {
 	}
 }
 
+func TestUserStatus(t *testing.T) {
+	uid := types.ParseUserId("usr" + testData.Users[0].Id)
+	expires := testData.Now.Add(time.Hour).Round(time.Millisecond)
+	status := &types.UserStatus{Emoji: "🏖", Text: "On vacation", ExpiresAt: &expires}
+	if err := adp.UserUpdate(uid, map[string]any{"Status": status}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := adp.UserGet(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status == nil || got.Status.Text != status.Text || !got.Status.ExpiresAt.Equal(expires) {
+		t.Error(mismatchErrorString("Status", got.Status, status))
+	}
+
+	// In p2p topics the status of the other user is reported.
+	subs, err := adp.UsersForTopic("p2p9AVDamaNCRbfKzGSh3mE0w", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range subs {
+		other := types.ParseUid(subs[i].User) != uid
+		if reported := subs[i].GetStatus() != nil; reported != other {
+			t.Error(mismatchErrorString("Status of "+subs[i].User, reported, other))
+		}
+	}
+
+	if err = adp.UserUpdate(uid, map[string]any{"Status": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = adp.UserGet(uid); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != nil {
+		t.Error(mismatchErrorString("Status", got.Status, nil))
+	}
+}
+
 func TestUserGetUnvalidated(t *testing.T) {
 	// Test PostgreSQL specific method
 	cutoff := time.Now().Add(-24 * time.Hour)
@@ -1024,7 +1140,566 @@ func TestFileFinishUpload(t *testing.T) {
 	}
 }
 
+func TestFileUsage(t *testing.T) {
+	// Only completed uploads are counted.
+	size, err := adp.FileUsageByUser(types.ParseUserId("usr" + testData.Users[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 22222 {
+		t.Error(mismatchErrorString("User usage", size, 22222))
+	}
+
+	size, err = adp.FileUsageByTopic(testData.Msgs[1].Topic, []string{testData.Files[0].Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 22222 {
+		t.Error(mismatchErrorString("Topic usage", size, 22222))
+	}
+}
+
+func TestCalls(t *testing.T) {
+	now := types.TimeNow()
+	topic := testData.Topics[1].Id
+	call := &types.CallRecord{
+		Topic:     topic,
+		SeqId:     7,
+		Room:      topic + "-7",
+		Owner:     testData.Users[0].Id,
+		CreatedAt: now,
+	}
+	if err := adp.CallCreate(call); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.CallCreate(call); err != types.ErrDuplicate {
+		t.Error(mismatchErrorString("Duplicate call", err, types.ErrDuplicate))
+	}
+
+	got, err := adp.CallGet(topic, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Room != call.Room || got.Owner != call.Owner || got.EndedAt != nil {
+		t.Fatal(mismatchErrorString("Call", got, call))
+	}
+
+	participants := []string{testData.Users[0].Id, testData.Users[1].Id}
+	endedAt := now.Add(time.Minute)
+	call.EndedAt = &endedAt
+	call.Outcome = "finished"
+	call.Duration = 45000
+	call.Participants = participants
+	if err = adp.CallEnd(call); err != nil {
+		t.Fatal(err)
+	}
+	got, err = adp.CallGet(topic, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EndedAt == nil || got.Outcome != "finished" || got.Duration != 45000 ||
+		!reflect.DeepEqual(got.Participants, participants) {
+		t.Error(mismatchErrorString("Ended call", got, call))
+	}
+
+	if got, err = adp.CallGet(topic, 8); err != nil || got != nil {
+		t.Error(mismatchErrorString("Missing call", got, nil))
+	}
+
+	// P2P call without a room.
+	if err = adp.CallCreate(&types.CallRecord{
+		Topic:     topic,
+		SeqId:     9,
+		Owner:     testData.Users[1].Id,
+		CreatedAt: now.Add(2 * time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := adp.CallGetAll([]string{topic, "grpMissing"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0].SeqId != 9 || calls[1].SeqId != 7 || calls[1].Outcome != "finished" {
+		t.Fatal(mismatchErrorString("Calls", calls, 2))
+	}
+	before := now.Add(time.Minute)
+	if calls, err = adp.CallGetAll([]string{topic}, &before, 10); err != nil || len(calls) != 1 || calls[0].SeqId != 7 {
+		t.Error(mismatchErrorString("Calls before", calls, 1))
+	}
+	if calls, err = adp.CallGetAll(nil, nil, 10); err != nil || len(calls) != 0 {
+		t.Error(mismatchErrorString("Calls in no topics", calls, 0))
+	}
+}
+
+func TestInWebhooks(t *testing.T) {
+	topic := testData.Topics[0].Id
+	bot := types.ParseUid(testData.Users[0].Id)
+	for i, token := range []string{"hookToken1", "hookToken2"} {
+		if err := adp.InWebhooksCreate(&types.IncomingWebhook{
+			Token:     token,
+			Topic:     topic,
+			User:      bot.UserId(),
+			Format:    types.InWebhookText,
+			Template:  "{{.text}}",
+			CreatedAt: testData.Now.Add(time.Duration(i) * time.Minute),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := adp.InWebhooksCreate(&types.IncomingWebhook{Token: "hookToken1", Topic: topic,
+		User: bot.UserId(), Format: types.InWebhookText, CreatedAt: testData.Now}); err == nil {
+		t.Error("Duplicate token accepted")
+	}
+
+	hook, err := adp.InWebhooksGet("hookToken1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook == nil || hook.Topic != topic || hook.User != bot.UserId() || hook.Format != types.InWebhookText ||
+		hook.Template != "{{.text}}" {
+		t.Error(mismatchErrorString("Webhook", hook, "hookToken1"))
+	}
+	if hook, err = adp.InWebhooksGet("missing"); err != nil || hook != nil {
+		t.Error("Missing webhook found", hook, err)
+	}
+
+	hooks, err := adp.InWebhooksGetAll(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0].Token != "hookToken1" || hooks[1].Token != "hookToken2" {
+		t.Error(mismatchErrorString("Webhooks", hooks, "hookToken1, hookToken2"))
+	}
+
+	if deleted, err := adp.InWebhooksDelete("hookToken1"); err != nil || !deleted {
+		t.Error("Webhook not deleted", err)
+	}
+	if deleted, err := adp.InWebhooksDelete("hookToken1"); err != nil || deleted {
+		t.Error("Deleted webhook deleted again", err)
+	}
+	if hooks, _ = adp.InWebhooksGetAll(topic); len(hooks) != 1 {
+		t.Error(mismatchErrorString("Webhooks after delete", len(hooks), 1))
+	}
+}
+
+func TestMessageRetention(t *testing.T) {
+	topic := "grpRetentionTopic"
+	now := testData.Now
+	if err := adp.TopicCreate(&types.Topic{
+		ObjHeader: types.ObjHeader{Id: topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     testData.Users[0].Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Messages 1-3 are a day old, message 4 is new.
+	for i := 1; i <= 4; i++ {
+		created := now.Add(-24 * time.Hour)
+		if i == 4 {
+			created = now
+		}
+		if err := adp.MessageSave(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: created, UpdatedAt: created},
+			SeqId:     i,
+			Topic:     topic,
+			From:      testData.Users[0].Id,
+			Head:      types.KVMap{"mime": "text/x-drafty", "webrtc": "accepted"},
+			Content:   "message " + strconv.Itoa(i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(cat string, tenants []string, exclude, anonymized bool) *types.RetentionBatch {
+		older, err := adp.MessageGetOlder(cat, tenants, exclude, now.Add(-time.Hour), anonymized, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range older {
+			if older[i].Topic == topic {
+				return &older[i]
+			}
+		}
+		return nil
+	}
+
+	if batch := find(types.RetentionGrp, nil, false, false); batch == nil || batch.SeqId != 3 || batch.Count != 3 {
+		t.Error(mismatchErrorString("Old messages", batch, types.RetentionBatch{Topic: topic, SeqId: 3, Count: 3}))
+	}
+	if batch := find(types.RetentionGrp, []string{"acme"}, true, false); batch == nil {
+		t.Error("Topic of the default tenant not found")
+	}
+	if batch := find(types.RetentionGrp, []string{"acme"}, false, false); batch != nil {
+		t.Error("Topic of another tenant found")
+	}
+	if batch := find(types.RetentionChn, nil, false, false); batch != nil {
+		t.Error("Group topic found as a channel")
+	}
+	if _, err := adp.MessageGetOlder("usr", nil, false, now, false, 100); err != types.ErrMalformed {
+		t.Error("Invalid category accepted", err)
+	}
+
+	count, err := adp.MessageAnonymize(topic, 3, 2)
+	if err != nil || count != 2 {
+		t.Fatal(mismatchErrorString("Anonymized", count, 2), err)
+	}
+	if count, err = adp.MessageAnonymize(topic, 3, 10); err != nil || count != 1 {
+		t.Fatal(mismatchErrorString("Anonymized", count, 1), err)
+	}
+	msgs, err := adp.MessageGetAll(topic, types.ZeroUid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if msg.SeqId <= 3 && (msg.From != "" || !reflect.DeepEqual(msg.Head, types.KVMap{"mime": "text/x-drafty"}) ||
+			msg.Content != "message "+strconv.Itoa(msg.SeqId)) {
+			t.Errorf("Message %d not anonymized: %+v", msg.SeqId, msg)
+		} else if msg.SeqId == 4 && msg.From != testData.Users[0].Id {
+			t.Error("New message anonymized", msg)
+		}
+	}
+
+	// Anonymized messages are skipped unless requested.
+	if batch := find(types.RetentionGrp, nil, false, false); batch != nil {
+		t.Error("Anonymized messages found", batch)
+	}
+	if batch := find(types.RetentionGrp, nil, false, true); batch == nil || batch.Count != 3 {
+		t.Error(mismatchErrorString("Anonymized messages", batch, 3))
+	}
+}
+
+func TestMessageTiers(t *testing.T) {
+	topic := "grpTieringTopic"
+	now := testData.Now
+	if err := adp.TopicCreate(&types.Topic{
+		ObjHeader: types.ObjHeader{Id: topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     testData.Users[0].Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-24 * time.Hour)
+	for i := 1; i <= 3; i++ {
+		if err := adp.MessageSave(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: old, UpdatedAt: old},
+			SeqId:     i,
+			Topic:     topic,
+			From:      testData.Users[0].Id,
+			Content:   "message " + strconv.Itoa(i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found := func(skipCats []string) bool {
+		topics, err := adp.MessageGetColdTopics(now.Add(-time.Hour), skipCats, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range topics {
+			if name == topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !found(nil) || !found([]string{types.RetentionChn}) {
+		t.Error("Topic with old messages not found")
+	}
+	// Topics of retention categories and topics with the time to live of messages are skipped.
+	if found([]string{types.RetentionP2P, types.RetentionGrp}) {
+		t.Error("Topic of retention category found")
+	}
+	if _, err := adp.MessageGetColdTopics(now, []string{"usr"}, 100); err != types.ErrMalformed {
+		t.Error("Invalid category accepted", err)
+	}
+	if err := adp.TopicUpdate(topic, map[string]any{"MsgTTL": 3600}); err != nil {
+		t.Fatal(err)
+	}
+	if found(nil) {
+		t.Error("Topic with time to live found")
+	}
+	if err := adp.TopicUpdate(topic, map[string]any{"MsgTTL": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := adp.MessageGetCold(topic, now.Add(-time.Hour), 100)
+	if err != nil || len(msgs) != 3 {
+		t.Fatal(mismatchErrorString("Cold messages", len(msgs), 3), err)
+	}
+	tier := &types.MessageTier{Topic: topic, Low: 1, Hi: 4, Count: 3, Key: topic + "/1-4", CreatedAt: now}
+	if err = adp.MessageTierCreate(tier, []int{1, 2, 3}, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if found(nil) {
+		t.Error("Moved messages found")
+	}
+
+	// The blob is replaced after removal of messages.
+	if err = adp.MessageTierUpdate(topic, 1, topic+"/1-4-1", 2); err != nil {
+		t.Fatal(err)
+	}
+	tiers, _, err := adp.MessageGetTiers(topic, types.ZeroUid, 1, 10)
+	if err != nil || len(tiers) != 1 {
+		t.Fatal(mismatchErrorString("Tiers", len(tiers), 1), err)
+	}
+	if tiers[0].Key != topic+"/1-4-1" || tiers[0].Count != 2 || tiers[0].Low != 1 || tiers[0].Hi != 4 {
+		t.Error(mismatchErrorString("Tier", tiers[0], types.MessageTier{Key: topic + "/1-4-1", Count: 2}))
+	}
+
+	// Topics with cold messages are found by the subscriptions of the user.
+	if topics, err := adp.MessageTierGetTopics(types.ParseUid(testData.Users[1].Id)); err != nil || len(topics) != 0 {
+		t.Error(mismatchErrorString("Tiered topics", topics, []string{}), err)
+	}
+	if err = adp.TopicShare(topic, []*types.Subscription{{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		User:      testData.Users[1].Id,
+		Topic:     topic,
+		ModeWant:  types.ModeCPublic,
+		ModeGiven: types.ModeCPublic,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if topics, err := adp.MessageTierGetTopics(types.ParseUid(testData.Users[1].Id)); err != nil ||
+		len(topics) != 1 || topics[0] != topic {
+		t.Error(mismatchErrorString("Tiered topics", topics, []string{topic}), err)
+	}
+
+	if err = adp.MessageTierDelete(topic, 1); err != nil {
+		t.Fatal(err)
+	}
+	if tiers, _, err = adp.MessageGetTiers(topic, types.ZeroUid, 1, 10); err != nil || len(tiers) != 0 {
+		t.Error(mismatchErrorString("Tiers", len(tiers), 0), err)
+	}
+}
+
+func TestTopicMerge(t *testing.T) {
+	dst, src := "grpMergeDstTopic", "grpMergeSrcTopic"
+	now := testData.Now
+	users := testData.Users
+	for _, name := range []string{dst, src} {
+		if err := adp.TopicCreate(&types.Topic{
+			ObjHeader: types.ObjHeader{Id: name, CreatedAt: now, UpdatedAt: now},
+			TouchedAt: now,
+			Owner:     users[0].Id,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subs := []struct {
+		topic      string
+		user       string
+		recv, read int
+	}{
+		{dst, users[0].Id, 2, 1},
+		{dst, users[1].Id, 2, 2},
+		{src, users[0].Id, 2, 2},
+		{src, users[2].Id, 1, 1},
+	}
+	for _, s := range subs {
+		if err := adp.TopicShare(s.topic, []*types.Subscription{{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			User:      s.user,
+			Topic:     s.topic,
+			ModeWant:  types.ModeCPublic,
+			ModeGiven: types.ModeCPublic,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := adp.SubsUpdate(s.topic, types.ParseUid(s.user), map[string]any{
+			"recvseqid": s.recv,
+			"readseqid": s.read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages of the topics interleave: dst:1, src:1, dst:2, src:2 which replies in the thread of src:1.
+	msgs := []*types.Message{
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(time.Minute)}, SeqId: 1, Topic: dst, From: users[0].Id,
+			Content: "dst1"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(2 * time.Minute)}, SeqId: 1, Topic: src, From: users[2].Id,
+			Content: "src1"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(3 * time.Minute)}, SeqId: 2, Topic: dst, From: users[1].Id,
+			Content: "dst2"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(4 * time.Minute)}, SeqId: 2, Topic: src, From: users[0].Id,
+			Content: "src2", Head: types.KVMap{"thread": ":1"}, ThreadId: 1},
+	}
+	for _, msg := range msgs {
+		msg.UpdatedAt = msg.CreatedAt
+		if err := adp.MessageSave(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := adp.MessageDeleteList(dst, &types.DelMessage{Topic: dst, DeletedFor: users[1].Id, DelId: 1,
+		SeqIdRanges: []types.Range{{Low: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.MessageDeleteList(src, &types.DelMessage{Topic: src, DeletedFor: users[2].Id, DelId: 1,
+		SeqIdRanges: []types.Range{{Low: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.TopicUpdate(dst, map[string]any{"seqid": 2, "delid": 1, "pinned": []int{2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.TopicUpdate(src, map[string]any{"seqid": 2, "delid": 1, "pinned": []int{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adp.StarredAdd(&types.StarredMessage{User: users[2].Id, Topic: src, SeqId: 2, From: users[0].Id,
+		Content: "src2", SentAt: now, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.FileLinkAttachments(src, types.ZeroUid, types.ZeroUid, []string{testData.Files[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Content of src is rewritten, content of dst is not.
+	rewrite := func(content any) (any, bool, error) {
+		if str, ok := content.(string); ok && strings.HasPrefix(str, "src") {
+			return "rewritten " + str, true, nil
+		}
+		return content, false, nil
+	}
+	if err := adp.TopicMerge(dst, src, rewrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are re-sequenced chronologically.
+	got, err := adp.MessageGetAll(dst, types.ZeroUid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for i := range got {
+		contents = append(contents, fmt.Sprintf("%d:%v", got[i].SeqId, got[i].Content))
+	}
+	sort.Strings(contents)
+	want := []string{"1:dst1", "2:rewritten src1", "3:dst2", "4:rewritten src2"}
+	if !reflect.DeepEqual(contents, want) {
+		t.Error(mismatchErrorString("Merged messages", contents, want))
+	}
+	for i := range got {
+		if got[i].SeqId == 4 && (got[i].ThreadId != 2 || got[i].Head["thread"] != ":2") {
+			t.Error(mismatchErrorString("Thread reference", got[i].Head, ":2"))
+		}
+	}
+
+	// Deletion log: dst first, then src.
+	rows, err := db.Query(ctx, "SELECT deletedfor,delid,low,hi FROM dellog WHERE topic=$1 ORDER BY delid", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dellog []string
+	for rows.Next() {
+		var deletedFor int64
+		var delId, low, hi int
+		if err = rows.Scan(&deletedFor, &delId, &low, &hi); err != nil {
+			t.Fatal(err)
+		}
+		dellog = append(dellog, fmt.Sprintf("%s:%d:%d-%d", store.EncodeUid(deletedFor).String(), delId, low, hi))
+	}
+	rows.Close()
+	want = []string{users[1].Id + ":1:3-4", users[2].Id + ":2:2-3"}
+	if !reflect.DeepEqual(dellog, want) {
+		t.Error(mismatchErrorString("Deletion log", dellog, want))
+	}
+
+	// Read and recv markers point to the latest message at or before the old markers.
+	for i, marks := range [][2]int{{4, 4}, {3, 3}, {2, 2}} {
+		sub, err := adp.SubscriptionGet(dst, types.ParseUid(users[i].Id), false)
+		if err != nil || sub == nil {
+			t.Fatal("Missing subscription", users[i].Id, err)
+		}
+		if sub.RecvSeqId != marks[0] || sub.ReadSeqId != marks[1] {
+			t.Error(mismatchErrorString("Markers of "+users[i].Id, [2]int{sub.RecvSeqId, sub.ReadSeqId}, marks))
+		}
+	}
+	if sub, err := adp.SubscriptionGet(src, types.ParseUid(users[0].Id), true); err != nil || sub != nil {
+		t.Error(mismatchErrorString("Subscription to src", sub, nil))
+	}
+
+	topic, err := adp.TopicGet(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic.SeqId != 4 || topic.DelId != 2 || !reflect.DeepEqual(topic.Pinned, []int{3, 2}) {
+		t.Error(mismatchErrorString("Merged topic", []any{topic.SeqId, topic.DelId, topic.Pinned},
+			[]any{4, 2, []int{3, 2}}))
+	}
+	if topic, err = adp.TopicGet(src); err != nil || topic != nil {
+		t.Error(mismatchErrorString("Merged topic", topic, nil))
+	}
+
+	starred, err := adp.StarredGetAll(types.ParseUid(users[2].Id), dst, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starred) != 1 || starred[0].SeqId != 4 || starred[0].Content != "rewritten src2" {
+		t.Error(mismatchErrorString("Starred", starred, 1))
+	}
+
+	var count int
+	if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM filemsglinks WHERE topic=$1", dst).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error(mismatchErrorString("File links", count, 1))
+	}
+}
+
 // ================== Other tests =================================
+func TestPresenceSettings(t *testing.T) {
+	uid0, uid1 := types.ParseUserId("usr"+testData.Users[0].Id), types.ParseUserId("usr"+testData.Users[1].Id)
+	if err := adp.PresenceSettingsUpsert(&types.PresenceSettings{
+		User:      testData.Users[0].Id,
+		Invisible: true,
+		UpdatedAt: types.TimeNow(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.PresenceSettingsUpsert(&types.PresenceSettings{
+		User:      testData.Users[0].Id,
+		Invisible: true,
+		LastSeen:  types.PresenceSeenContacts,
+		UpdatedAt: types.TimeNow(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := adp.PresenceSettingsGet([]types.Uid{uid0, uid1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].User != testData.Users[0].Id || !got[0].Invisible ||
+		got[0].LastSeen != types.PresenceSeenContacts {
+		t.Error(mismatchErrorString("Presence settings", got, testData.Users[0].Id))
+	}
+
+	topic := testData.Topics[1].Id
+	for _, tps := range []*types.TopicPresenceSettings{
+		{Topic: topic, User: testData.Users[0].Id, Share: types.PresenceShareHide},
+		{Topic: topic, User: testData.Users[0].Id, Share: types.PresenceShareShow},
+		{Topic: topic, User: testData.Users[1].Id, Share: types.PresenceShareHide},
+	} {
+		tps.UpdatedAt = types.TimeNow()
+		if err = adp.TopicPresenceUpsert(tps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overrides, err := adp.TopicPresenceGet(topic, types.ZeroUid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 2 {
+		t.Error(mismatchErrorString("Overrides in topic", len(overrides), 2))
+	}
+	overrides, err = adp.TopicPresenceGet("", uid0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 1 || overrides[0].Topic != topic || overrides[0].Share != types.PresenceShareShow {
+		t.Error(mismatchErrorString("Overrides of user", overrides, types.PresenceShareShow))
+	}
+}
+
 func TestDeviceGetAll(t *testing.T) {
 	uid0 := types.ParseUserId("usr" + testData.Users[0].Id)
 	uid1 := types.ParseUserId("usr" + testData.Users[1].Id)
@@ -1124,11 +1799,20 @@ func TestPCacheExpire(t *testing.T) {
 	adp.PCacheUpsert("prefix_key1", "value1", false)
 	adp.PCacheUpsert("prefix_key2", "value2", false)
 
+	// '_' in the prefix is not a wildcard.
+	adp.PCacheUpsert("prefixAkey3", "value3", false)
+
 	// Expire keys older than now (should delete all test keys)
 	err := adp.PCacheExpire("prefix_", time.Now().Add(1*time.Minute))
 	if err != nil {
 		t.Fatal(err)
 	}
+	if _, err = adp.PCacheGet("prefix_key1"); err != types.ErrNotFound {
+		t.Error("Key should be expired")
+	}
+	if _, err = adp.PCacheGet("prefixAkey3"); err != nil {
+		t.Error("Key without the prefix expired", err)
+	}
 }
 
 // ================== Delete tests ================================
@@ -1296,6 +1980,104 @@ func TestFileDeleteUnused(t *testing.T) {
 	}
 }
 
+func TestUserErase(t *testing.T) {
+	now := testData.Now
+	erased := types.Uid(777777)
+	user := &types.User{ObjHeader: types.ObjHeader{Id: erased.String(), CreatedAt: now, UpdatedAt: now}}
+	if err := adp.UserCreate(user); err != nil {
+		t.Fatal(err)
+	}
+	topic := "grpEraseTopic"
+	if err := adp.TopicCreate(&types.Topic{
+		ObjHeader: types.ObjHeader{Id: topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     testData.Users[0].Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, from := range []string{testData.Users[0].Id, user.Id} {
+		if err := adp.MessageSave(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			SeqId:     i + 1,
+			Topic:     topic,
+			From:      from,
+			Content:   "message " + strconv.Itoa(i+1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := adp.ReactionAdd(topic, 1, erased, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	file := &types.FileDef{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		Status:    types.UploadCompleted,
+		User:      user.Id,
+		MimeType:  "image/png",
+		Location:  "uploads/erased.png",
+		Size:      100,
+	}
+	file.SetUid(types.Uid(777778))
+	if err := adp.FileStartUpload(file); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.ErasureReport{"account": 1, "messages": 1, "reactions": 1, "files": 1}
+	report, locations, err := adp.UserErase(erased, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) || len(locations) != 0 {
+		t.Error(mismatchErrorString("Dry run report", report, expected))
+	}
+	var count int
+	if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM reactions WHERE userid=$1",
+		store.DecodeUid(erased)).Scan(&count); err != nil || count != 1 {
+		t.Error("Dry run deleted reactions", count, err)
+	}
+
+	report, locations, err = adp.UserErase(erased, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Error(mismatchErrorString("Report", report, expected))
+	}
+	if !reflect.DeepEqual(locations, []string{"uploads/erased.png"}) {
+		t.Error(mismatchErrorString("Locations", locations, []string{"uploads/erased.png"}))
+	}
+	// Content of user's message is erased, messages of other users are intact.
+	msgs, err := adp.MessageGetAll(topic, types.ZeroUid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatal(mismatchErrorString("Messages", len(msgs), 2))
+	}
+	for _, msg := range msgs {
+		if msg.SeqId == 1 && msg.Content != "message 1" {
+			t.Error("Message of another user modified", msg.Content)
+		} else if msg.SeqId == 2 && (msg.Content != nil || msg.DeletedAt == nil) {
+			t.Error("Message content not erased", msg.Content)
+		}
+	}
+	for _, table := range []string{"reactions", "fileuploads"} {
+		if err = db.QueryRow(ctx, "SELECT COUNT(*) FROM "+table+" WHERE userid=$1",
+			store.DecodeUid(erased)).Scan(&count); err != nil || count != 0 {
+			t.Error("Records not deleted", table, count, err)
+		}
+	}
+
+	// The account is deleted by UserDelete.
+	report, _, err = adp.UserErase(erased, true)
+	if err != nil || !reflect.DeepEqual(report, types.ErasureReport{"account": 1}) {
+		t.Error(mismatchErrorString("Report after erasure", report, types.ErasureReport{"account": 1}))
+	}
+	if err = adp.UserDelete(erased, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestUserDelete(t *testing.T) {
 	err := adp.UserDelete(types.ParseUserId("usr"+testData.Users[0].Id), false)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"hash/fnv"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -3067,7 +3068,7 @@ func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
 	}
 
 	_, err := rdb.DB(a.dbName).Table("kvmeta").
-		Filter(rdb.Row.Field("CreatedAt").Lt(olderThan).And(rdb.Row.Field("key").Match("^" + keyPrefix))).
+		Filter(rdb.Row.Field("CreatedAt").Lt(olderThan).And(rdb.Row.Field("key").Match("^" + regexp.QuoteMeta(keyPrefix)))).
 		Delete().
 		RunWrite(a.conn)
 
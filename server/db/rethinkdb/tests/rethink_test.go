@@ -1,3 +1,5 @@
+//go:build rethinkdb
+
 package tests
 
 // To test another db backend:
@@ -578,7 +580,7 @@ func TestSubsForTopic(t *testing.T) {
 
 func TestFind(t *testing.T) {
 	reqTags := [][]string{{"alice", "bob", "carol", "travel", "qwer", "asdf", "zxcv"}}
-	got, err := adp.Find("usr"+testData.Users[2].Id, "", reqTags, nil, true)
+	got, err := adp.Find("usr"+testData.Users[2].Id, "", "", reqTags, nil, true)
 	if err != nil {
 		t.Error(err)
 	}
@@ -589,7 +591,7 @@ func TestFind(t *testing.T) {
 
 func TestFindOne(t *testing.T) {
 	// Test RethinkDB specific FindOne method
-	found, err := adp.FindOne("alice")
+	found, err := adp.FindOne("", "alice")
 	if err != nil {
 		t.Error(err)
 	}
@@ -599,7 +601,7 @@ func TestFindOne(t *testing.T) {
 	}
 
 	// Test not found
-	found, err = adp.FindOne("nonexistent")
+	found, err = adp.FindOne("", "nonexistent")
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,8706 @@
+//go:build sqlite
+// +build sqlite
+
+// Package sqlite is a database adapter for SQLite. It's meant for small self-hosted and embedded
+// deployments: the database is a single file, no database server is needed.
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/db/common"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// adapter holds SQLite connection data.
+type adapter struct {
+	db     *pool
+	dsn    string
+	dbPath string
+	// Maximum number of records to return
+	maxResults int
+	// Maximum number of message records to return
+	maxMessageResults int
+	version           int
+
+	// Connection pool settings.
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+
+	// Single query timeout.
+	sqlTimeout time.Duration
+	// DB transaction timeout.
+	txTimeout time.Duration
+
+	// Salt of hashes of contacts, empty if contact discovery is disabled.
+	contactSalt string
+}
+
+const (
+	adpVersion  = 165
+	adapterName = "sqlite"
+
+	defaultMaxResults = 1024
+	// This is capped by the Session's send queue limit (128).
+	defaultMaxMessageResults = 100
+
+	// If DB request timeout is specified,
+	// we allocate txTimeoutMultiplier times more time for transactions.
+	txTimeoutMultiplier = 1.5
+
+	// Default time to wait for a lock on the database (in milliseconds).
+	defaultBusyTimeout = 5000
+)
+
+type configType struct {
+	// Path to the database file, e.g. "./tinode.db".
+	Path string `json:"path,omitempty"`
+	// Time to wait for a lock held by another connection (in milliseconds).
+	BusyTimeout int `json:"busy_timeout,omitempty"`
+
+	// Connection pool settings.
+	//
+	// Maximum number of open connections to the database.
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	// Maximum number of connections in the idle connection pool.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// Maximum amount of time a connection may be reused (in seconds).
+	ConnMaxLifetime int `json:"conn_max_lifetime,omitempty"`
+
+	// DB request timeout (in seconds).
+	// If 0 (or negative), no timeout is applied.
+	SqlTimeout int `json:"sql_timeout,omitempty"`
+}
+
+func (a *adapter) getContext() (context.Context, context.CancelFunc) {
+	if a.sqlTimeout > 0 {
+		return context.WithTimeout(context.Background(), a.sqlTimeout)
+	}
+	return context.Background(), nil
+}
+
+func (a *adapter) getContextForTx() (context.Context, context.CancelFunc) {
+	if a.txTimeout > 0 {
+		return context.WithTimeout(context.Background(), a.txTimeout)
+	}
+	return context.Background(), nil
+}
+
+// Open initializes database session
+func (a *adapter) Open(jsonconfig json.RawMessage) error {
+	if a.db != nil {
+		return errors.New("sqlite adapter is already connected")
+	}
+
+	if len(jsonconfig) < 2 {
+		return errors.New("sqlite adapter missing config")
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconfig, &config); err != nil {
+		return errors.New("sqlite adapter failed to parse config: " + err.Error())
+	}
+
+	if config.Path == "" {
+		return errors.New("sqlite adapter missing database path")
+	}
+	a.dbPath = config.Path
+	a.dsn = setConnStr(config)
+
+	if a.maxResults <= 0 {
+		a.maxResults = defaultMaxResults
+	}
+
+	if a.maxMessageResults <= 0 {
+		a.maxMessageResults = defaultMaxMessageResults
+	}
+
+	a.maxOpenConns = config.MaxOpenConns
+	a.maxIdleConns = config.MaxIdleConns
+	if config.ConnMaxLifetime > 0 {
+		a.connMaxLifetime = time.Duration(config.ConnMaxLifetime) * time.Second
+	}
+	if config.SqlTimeout > 0 {
+		a.sqlTimeout = time.Duration(config.SqlTimeout) * time.Second
+		// We allocate txTimeoutMultiplier times sqlTimeout for transactions.
+		a.txTimeout = time.Duration(float64(config.SqlTimeout)*txTimeoutMultiplier) * time.Second
+	}
+
+	return a.connect()
+}
+
+// connect opens the database file. The file is created if it does not exist.
+func (a *adapter) connect() error {
+	db, err := sql.Open(driverName, a.dsn)
+	if err != nil {
+		return err
+	}
+	if a.maxOpenConns > 0 {
+		db.SetMaxOpenConns(a.maxOpenConns)
+	}
+	if a.maxIdleConns > 0 {
+		db.SetMaxIdleConns(a.maxIdleConns)
+	}
+	if a.connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(a.connMaxLifetime)
+	}
+
+	a.db = &pool{db}
+	if err = a.db.Ping(context.Background()); err != nil {
+		a.db.Close()
+		a.db = nil
+	}
+	return err
+}
+
+// Close closes the underlying database connection
+func (a *adapter) Close() error {
+	var err error
+	if a.db != nil {
+		err = a.db.Close()
+		a.db = nil
+		a.version = -1
+	}
+	return err
+}
+
+// IsOpen returns true if connection to database has been established. It does not check if
+// connection is actually live.
+func (a *adapter) IsOpen() bool {
+	return a.db != nil
+}
+
+// GetDbVersion returns current database version.
+func (a *adapter) GetDbVersion() (int, error) {
+	if a.version > 0 {
+		return a.version, nil
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var vers string
+	err := a.db.QueryRow(ctx, "SELECT value FROM kvmeta WHERE key='version'").Scan(&vers)
+	if err != nil {
+		if isMissingTable(err) || err == sql.ErrNoRows {
+			err = errors.New("Database not initialized")
+		}
+		return -1, err
+	}
+
+	a.version, _ = strconv.Atoi(vers)
+
+	return a.version, nil
+}
+
+func (a *adapter) updateDbVersion(v int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	a.version = -1
+	if _, err := a.db.Exec(ctx, `UPDATE kvmeta SET "value"=$1 WHERE "key"='version'`, strconv.Itoa(v)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// CheckDbVersion checks whether the actual DB version matches the expected version of this adapter.
+func (a *adapter) CheckDbVersion() error {
+	version, err := a.GetDbVersion()
+	if err != nil {
+		return err
+	}
+
+	if version != adpVersion {
+		return errors.New("Invalid database version " + strconv.Itoa(version) +
+			". Expected " + strconv.Itoa(adpVersion))
+	}
+
+	return nil
+}
+
+// Version returns adapter version.
+func (adapter) Version() int {
+	return adpVersion
+}
+
+// DB connection stats object.
+func (a *adapter) Stats() any {
+	if a.db == nil {
+		return nil
+	}
+	return a.db.Stat()
+}
+
+// GetName returns string that adapter uses to register itself with store.
+func (a *adapter) GetName() string {
+	return adapterName
+}
+
+// SetMaxResults configures how many results can be returned in a single DB call.
+func (a *adapter) SetMaxResults(val int) error {
+	if val <= 0 {
+		a.maxResults = defaultMaxResults
+	} else {
+		a.maxResults = val
+	}
+
+	return nil
+}
+
+// CreateDb initializes the storage.
+func (a *adapter) CreateDb(reset bool) error {
+	var err error
+	var tx *txn
+
+	if reset {
+		// The database is the file: remove it together with the write-ahead log.
+		if a.db != nil {
+			a.db.Close()
+			a.db = nil
+		}
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err = os.Remove(a.dbPath + suffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err = a.connect(); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if tx, err = a.db.Begin(ctx); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// Indexed users.
+	if _, err := tx.Exec(ctx,
+		`CREATE TABLE users(
+			id        BIGINT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			state     SMALLINT NOT NULL DEFAULT 0,
+			stateat   TIMESTAMP,
+			access    TEXT,
+			lastseen  TIMESTAMP,
+			useragent VARCHAR(255) DEFAULT '',
+			public    TEXT,
+			trusted   TEXT,
+			tags      TEXT,
+			status    TEXT,
+			tenant    VARCHAR(32) NOT NULL DEFAULT '',
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX users_state_stateat ON users(state, stateat);
+		CREATE INDEX users_lastseen_updatedat ON users(lastseen, updatedat);
+		CREATE INDEX users_tenant ON users(tenant);`); err != nil {
+		return err
+	}
+
+	// Indexed user tags.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE usertags(
+			id     INTEGER NOT NULL,
+			userid BIGINT NOT NULL,
+			tag    VARCHAR(96) NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		);
+		CREATE INDEX usertags_tag ON usertags(tag);
+		CREATE UNIQUE INDEX usertags_userid_tag ON usertags(userid, tag);`); err != nil {
+		return err
+	}
+
+	// Indexed devices. Normalized into a separate table.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE devices(
+			id       INTEGER NOT NULL,
+			userid   BIGINT NOT NULL,
+			hash     CHAR(16) NOT NULL,
+			deviceid TEXT NOT NULL,
+			platform VARCHAR(32),
+			lastseen TIMESTAMP NOT NULL,
+			lang     VARCHAR(8),
+			PRIMARY KEY(id),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		);
+		CREATE UNIQUE INDEX devices_hash ON devices(hash);`); err != nil {
+		return err
+	}
+
+	// Authentication records for the basic authentication scheme.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE auth(
+			id      INTEGER NOT NULL,
+			uname   VARCHAR(255) NOT NULL,
+			userid  BIGINT NOT NULL,
+			scheme  VARCHAR(16) NOT NULL,
+			authlvl INT NOT NULL,
+			secret  TEXT NOT NULL,
+			expires TIMESTAMP,
+			PRIMARY KEY(id),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		);
+		CREATE UNIQUE INDEX auth_userid_scheme ON auth(userid, scheme);
+		CREATE UNIQUE INDEX auth_uname ON auth(uname);`); err != nil {
+		return err
+	}
+
+	// Topics
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE topics(
+			id        INTEGER NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			state     SMALLINT NOT NULL DEFAULT 0,
+			stateat   TIMESTAMP,
+			touchedat TIMESTAMP,
+			name      VARCHAR(25) NOT NULL,
+			usebt     BOOLEAN DEFAULT FALSE,
+			owner     BIGINT NOT NULL DEFAULT 0,
+			access    TEXT,
+			seqid     INT NOT NULL DEFAULT 0,
+			delid     INT DEFAULT 0,
+			subcnt    INT DEFAULT 0,
+			public    TEXT,
+			trusted   TEXT,
+			tags      TEXT,
+			aux				TEXT,
+			msgttl    INT NOT NULL DEFAULT 0,
+			slowmode  INT NOT NULL DEFAULT 0,
+			pinned    TEXT,
+			broadcast BOOLEAN NOT NULL DEFAULT FALSE,
+			community BOOLEAN NOT NULL DEFAULT FALSE,
+			parent    VARCHAR(25) NOT NULL DEFAULT '',
+			tenant    VARCHAR(32) NOT NULL DEFAULT '',
+			frozen    BOOLEAN NOT NULL DEFAULT FALSE,
+			PRIMARY KEY(id)
+		);
+		CREATE UNIQUE INDEX topics_name ON topics(name);
+		CREATE INDEX topics_parent ON topics(parent);
+		CREATE INDEX topics_tenant ON topics(tenant);
+		CREATE INDEX topics_owner ON topics(owner);
+		CREATE INDEX topics_state_stateat ON topics(state, stateat);
+		CREATE INDEX topics_name_state_seqid ON topics(name, state, seqid);`); err != nil {
+		return err
+	}
+
+	// Create system topic 'sys'.
+	if err = createSystemTopic(tx); err != nil {
+		return err
+	}
+
+	// Indexed topic tags.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE topictags(
+			id    INTEGER NOT NULL,
+			topic VARCHAR(25) NOT NULL,
+			tag   VARCHAR(96) NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		);
+		CREATE INDEX topictags_tag ON topictags(tag);
+		CREATE UNIQUE INDEX topictags_topic_tag ON topictags(topic, tag);`); err != nil {
+		return err
+	}
+
+	// Subscriptions
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE subscriptions(
+			id        INTEGER NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			deletedat TIMESTAMP,
+			userid    BIGINT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			delid     INT DEFAULT 0,
+			recvseqid INT DEFAULT 0,
+			readseqid INT DEFAULT 0,
+			modewant  VARCHAR(8),
+			modegiven VARCHAR(8),
+			private   TEXT,
+			labels    TEXT,
+			archivedat    TIMESTAMP,
+			autounarchive BOOLEAN NOT NULL DEFAULT FALSE,
+			role      VARCHAR(16) NOT NULL DEFAULT '',
+			request   VARCHAR(256) NOT NULL DEFAULT '',
+			PRIMARY KEY(id),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		);
+		CREATE UNIQUE INDEX subscriptions_topic_userid ON subscriptions(topic, userid);
+		CREATE INDEX subscriptions_topic ON subscriptions(topic);
+		CREATE INDEX subscriptions_deletedat ON subscriptions(deletedat);
+		CREATE INDEX subscriptions_userid_topic_deletedat ON subscriptions(userid, topic, deletedat);`); err != nil {
+		return err
+	}
+
+	// Messages
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE messages(
+			id        INTEGER NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			deletedat TIMESTAMP,
+			delid     INT DEFAULT 0,
+			seqid     INT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			"from"    BIGINT NOT NULL,
+			head      TEXT,
+			content   TEXT,
+			threadid  INT NOT NULL DEFAULT 0,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		);
+		CREATE UNIQUE INDEX messages_topic_seqid ON messages(topic, seqid);
+		CREATE INDEX messages_topic_threadid ON messages(topic, threadid);
+		CREATE INDEX messages_from_id ON messages("from", id);`); err != nil {
+		return err
+	}
+
+	// Deletion log
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE dellog(
+			id         INTEGER NOT NULL,
+			topic      VARCHAR(25) NOT NULL,
+			deletedfor BIGINT NOT NULL DEFAULT 0,
+			delid      INT NOT NULL,
+			low        INT NOT NULL,
+			hi         INT NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(topic) REFERENCES topics(name)
+		);
+		CREATE INDEX dellog_topic_delid_deletedfor ON dellog(topic,delid,deletedfor);
+		CREATE INDEX dellog_topic_deletedfor_low_hi ON dellog(topic,deletedfor,low,hi);
+		CREATE INDEX dellog_deletedfor ON dellog(deletedfor);`); err != nil {
+		return err
+	}
+
+	// User credentials
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE credentials(
+			id        INTEGER NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			deletedat TIMESTAMP,
+			method    VARCHAR(16) NOT NULL,
+			value     VARCHAR(128) NOT NULL,
+			synthetic VARCHAR(192) NOT NULL,
+			userid    BIGINT NOT NULL,
+			resp      VARCHAR(255),
+			done      BOOLEAN NOT NULL DEFAULT FALSE,
+			retries   INT NOT NULL DEFAULT 0,
+			PRIMARY KEY(id),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		);
+		CREATE UNIQUE INDEX credentials_uniqueness ON credentials(synthetic);`); err != nil {
+		return err
+	}
+
+	// Records of uploaded files.
+	// Don't add FOREIGN KEY on userid. It's not needed and it will break user deletion.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE fileuploads(
+			id        BIGINT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			userid    BIGINT,
+			status    INT NOT NULL,
+			mimetype  VARCHAR(255) NOT NULL,
+			size      BIGINT NOT NULL,
+			etag      VARCHAR(128),
+			location  VARCHAR(2048) NOT NULL,
+			scan      TEXT,
+			media     TEXT,
+			tenant    VARCHAR(32) NOT NULL DEFAULT '',
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX fileuploads_status ON fileuploads(status);
+		CREATE INDEX fileuploads_userid ON fileuploads(userid);`); err != nil {
+		return err
+	}
+
+	// Links between uploaded files and the topics, users or messages they are attached to.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE filemsglinks(
+			id        INTEGER NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			fileid    BIGINT NOT NULL,
+			msgid     INT,
+			topic     VARCHAR(25),
+			userid    BIGINT,
+			PRIMARY KEY(id),
+			FOREIGN KEY(fileid) REFERENCES fileuploads(id) ON DELETE CASCADE,
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY(topic) REFERENCES topics(name) ON DELETE CASCADE,
+			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE
+		);`); err != nil {
+		return err
+	}
+
+	// Previous versions of edited messages.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE msgedits(
+			id         INTEGER NOT NULL,
+			topic      VARCHAR(25) NOT NULL,
+			seqid      INT NOT NULL,
+			version    INT NOT NULL,
+			createdat  TIMESTAMP NOT NULL,
+			replacedat TIMESTAMP NOT NULL,
+			content    TEXT,
+			PRIMARY KEY(id)
+		);
+		CREATE UNIQUE INDEX msgedits_topic_seqid_version ON msgedits(topic, seqid, version);`); err != nil {
+		return err
+	}
+
+	// Emoji reactions to messages.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE reactions(
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			reaction  VARCHAR(32) NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, seqid, userid, reaction)
+		);`); err != nil {
+		return err
+	}
+
+	// Polls attached to messages and votes in them.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE polls(
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			options   INT NOT NULL,
+			multi     BOOLEAN NOT NULL DEFAULT FALSE,
+			createdat TIMESTAMP NOT NULL,
+			closedat  TIMESTAMP,
+			PRIMARY KEY(topic, seqid)
+		);
+		CREATE TABLE pollvotes(
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			userid    BIGINT NOT NULL,
+			opt       INT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, seqid, userid, opt)
+		);`); err != nil {
+		return err
+	}
+
+	// Cached machine translations of messages.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE translations(
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			lang      VARCHAR(35) NOT NULL,
+			srclang   VARCHAR(35),
+			content   TEXT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, seqid, lang)
+		);`); err != nil {
+		return err
+	}
+
+	// Log of content moderation decisions.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE moderationlog(
+			id        INTEGER PRIMARY KEY,
+			createdat TIMESTAMP NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL DEFAULT 0,
+			userid    BIGINT NOT NULL,
+			action    VARCHAR(16) NOT NULL,
+			filter    VARCHAR(64) NOT NULL,
+			reason    VARCHAR(512)
+		);
+		CREATE INDEX moderationlog_topic_createdat ON moderationlog(topic, createdat);
+		CREATE INDEX moderationlog_createdat ON moderationlog(createdat);`); err != nil {
+		return err
+	}
+
+	// Exports of users' data.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE takeouts(
+			id        BIGINT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			userid    BIGINT NOT NULL,
+			status    VARCHAR(16) NOT NULL,
+			fileid    BIGINT,
+			url       VARCHAR(2048),
+			expiresat TIMESTAMP,
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX takeouts_userid_createdat ON takeouts(userid, createdat);
+		CREATE INDEX takeouts_fileid ON takeouts(fileid);`); err != nil {
+		return err
+	}
+
+	// Audit log of security-relevant events.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE auditlog(
+			id         INTEGER PRIMARY KEY,
+			createdat  TIMESTAMP NOT NULL,
+			event      VARCHAR(16) NOT NULL,
+			actor      BIGINT,
+			target     BIGINT,
+			topic      VARCHAR(25) NOT NULL DEFAULT '',
+			remoteaddr VARCHAR(64) NOT NULL DEFAULT '',
+			details    VARCHAR(512)
+		);
+		CREATE INDEX auditlog_createdat ON auditlog(createdat);
+		CREATE INDEX auditlog_actor_createdat ON auditlog(actor, createdat);
+		CREATE INDEX auditlog_target_createdat ON auditlog(target, createdat);`); err != nil {
+		return err
+	}
+
+	// Reports of messages and users.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE reports(
+			id         BIGINT NOT NULL,
+			createdat  TIMESTAMP NOT NULL,
+			updatedat  TIMESTAMP NOT NULL,
+			reporter   BIGINT NOT NULL,
+			target     BIGINT NOT NULL,
+			topic      VARCHAR(25) NOT NULL DEFAULT '',
+			seqid      INT NOT NULL DEFAULT 0,
+			reason     VARCHAR(32) NOT NULL,
+			comment    VARCHAR(512),
+			evidence   TEXT,
+			status     VARCHAR(16) NOT NULL,
+			posted     BOOLEAN NOT NULL DEFAULT FALSE,
+			resolvedby BIGINT,
+			action     VARCHAR(16),
+			PRIMARY KEY(id)
+		);
+		CREATE UNIQUE INDEX reports_open ON reports(reporter, target, topic, seqid) WHERE status='open';
+		CREATE INDEX reports_status_posted ON reports(status, posted, createdat);`); err != nil {
+		return err
+	}
+
+	// Per-user state of threads.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE threadsubs(
+			topic     VARCHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			threadid  INT NOT NULL,
+			readseqid INT NOT NULL DEFAULT 0,
+			muted     BOOLEAN NOT NULL DEFAULT FALSE,
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, userid, threadid)
+		);
+		CREATE INDEX threadsubs_topic_threadid ON threadsubs(topic, threadid);`); err != nil {
+		return err
+	}
+
+	// Messages scheduled for publishing at a later time.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE scheduled(
+			id          BIGINT NOT NULL,
+			createdat   TIMESTAMP NOT NULL,
+			updatedat   TIMESTAMP NOT NULL,
+			sendat      TIMESTAMP NOT NULL,
+			topic       VARCHAR(25) NOT NULL,
+			"from"      BIGINT NOT NULL,
+			head        TEXT,
+			content     TEXT,
+			attachments TEXT,
+			fileids     TEXT,
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX scheduled_sendat ON scheduled(sendat);
+		CREATE INDEX scheduled_topic_from ON scheduled(topic, "from");`); err != nil {
+		return err
+	}
+
+	// Sessions where users logged in.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE usersessions(
+			id         VARCHAR(32) NOT NULL,
+			userid     BIGINT NOT NULL,
+			createdat  TIMESTAMP NOT NULL,
+			lastseen   TIMESTAMP NOT NULL,
+			remoteaddr VARCHAR(64) NOT NULL DEFAULT '',
+			useragent  VARCHAR(255) NOT NULL DEFAULT '',
+			platform   VARCHAR(32) NOT NULL DEFAULT '',
+			deviceid   TEXT NOT NULL DEFAULT '',
+			resume     VARCHAR(64) NOT NULL DEFAULT '',
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX usersessions_userid_lastseen ON usersessions(userid, lastseen);`); err != nil {
+		return err
+	}
+
+	// Public keys of users' devices for end-to-end encryption.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE keybundles(
+			userid    BIGINT NOT NULL,
+			deviceid  VARCHAR(64) NOT NULL,
+			identkey  BLOB NOT NULL,
+			signedkey BLOB NOT NULL,
+			signature BLOB NOT NULL,
+			onetime   TEXT NOT NULL DEFAULT '[]',
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid, deviceid)
+		);`); err != nil {
+		return err
+	}
+
+	// Sender key distribution messages waiting to be fetched by recipients.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE senderkeys(
+			topic      VARCHAR(25) NOT NULL,
+			userid     BIGINT NOT NULL,
+			deviceid   VARCHAR(64) NOT NULL,
+			"from"     BIGINT NOT NULL,
+			fromdevice VARCHAR(64) NOT NULL,
+			data       BLOB NOT NULL,
+			createdat  TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, userid, deviceid, "from", fromdevice)
+		);
+		CREATE INDEX senderkeys_userid ON senderkeys(userid);`); err != nil {
+		return err
+	}
+
+	// Devices registered by users.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE userdevices(
+			userid     BIGINT NOT NULL,
+			id         VARCHAR(64) NOT NULL,
+			name       VARCHAR(64) NOT NULL DEFAULT '',
+			platform   VARCHAR(32) NOT NULL DEFAULT '',
+			appversion VARCHAR(32) NOT NULL DEFAULT '',
+			publickey  BLOB,
+			pushtoken  TEXT NOT NULL DEFAULT '',
+			push       BOOLEAN NOT NULL DEFAULT TRUE,
+			createdat  TIMESTAMP NOT NULL,
+			lastseen   TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid, id)
+		);`); err != nil {
+		return err
+	}
+
+	// Users' settings of push notifications.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE notifysettings(
+			userid     BIGINT NOT NULL,
+			lang       VARCHAR(16) NOT NULL DEFAULT '',
+			nopreview  BOOLEAN NOT NULL DEFAULT FALSE,
+			quietstart SMALLINT NOT NULL DEFAULT 0,
+			quietend   SMALLINT NOT NULL DEFAULT 0,
+			timezone   VARCHAR(64) NOT NULL DEFAULT '',
+			keywords   TEXT,
+			sms        BOOLEAN NOT NULL DEFAULT FALSE,
+			updatedat  TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid)
+		);`); err != nil {
+		return err
+	}
+
+	// Users' settings of push notifications from topics.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE topicnotify(
+			topic     VARCHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			muteuntil TIMESTAMP,
+			mentions  BOOLEAN NOT NULL DEFAULT FALSE,
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, userid)
+		);
+		CREATE INDEX topicnotify_userid ON topicnotify(userid);`); err != nil {
+		return err
+	}
+
+	// Users' settings of presence privacy.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE presencesettings(
+			userid    BIGINT NOT NULL,
+			invisible BOOLEAN NOT NULL DEFAULT FALSE,
+			lastseen  VARCHAR(16) NOT NULL DEFAULT '',
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid)
+		);`); err != nil {
+		return err
+	}
+
+	// Users' overrides of sharing presence in topics.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE topicpresence(
+			topic     VARCHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			share     VARCHAR(8) NOT NULL DEFAULT '',
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, userid)
+		);
+		CREATE INDEX topicpresence_userid ON topicpresence(userid);`); err != nil {
+		return err
+	}
+
+	// Index of messages which mention users or contain their keywords.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE mentions(
+			userid    BIGINT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			"from"    BIGINT NOT NULL,
+			keyword   VARCHAR(64) NOT NULL DEFAULT '',
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid, topic, seqid)
+		);
+		CREATE INDEX mentions_userid_createdat ON mentions(userid, createdat);
+		CREATE INDEX mentions_topic_seqid ON mentions(topic, seqid);`); err != nil {
+		return err
+	}
+
+	// Drafts of messages shared between users' devices.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE drafts(
+			userid    BIGINT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			content   TEXT,
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid, topic)
+		);
+		CREATE INDEX drafts_topic ON drafts(topic);`); err != nil {
+		return err
+	}
+
+	// Copies of messages starred by users.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE starred(
+			userid    BIGINT NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			seqid     INT NOT NULL,
+			"from"    BIGINT NOT NULL,
+			head      TEXT,
+			content   TEXT,
+			sentat    TIMESTAMP NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid, topic, seqid)
+		);
+		CREATE INDEX starred_userid_createdat ON starred(userid, createdat);`); err != nil {
+		return err
+	}
+
+	// Users blocked by other users.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE blocks(
+			userid    BIGINT NOT NULL,
+			target    BIGINT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(userid, target)
+		);
+		CREATE INDEX blocks_target ON blocks(target);`); err != nil {
+		return err
+	}
+
+	// Links to join group topics.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE invites(
+			token     VARCHAR(32) NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			createdby BIGINT NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			expiresat TIMESTAMP,
+			maxuses   INT NOT NULL DEFAULT 0,
+			uses      INT NOT NULL DEFAULT 0,
+			approval  BOOLEAN NOT NULL DEFAULT FALSE,
+			PRIMARY KEY(token)
+		);
+		CREATE INDEX invites_topic ON invites(topic);`); err != nil {
+		return err
+	}
+
+	// Public directory of group topics.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE directory(
+			topic       VARCHAR(25) NOT NULL,
+			category    VARCHAR(32) NOT NULL,
+			description VARCHAR(256) NOT NULL DEFAULT '',
+			createdat   TIMESTAMP NOT NULL,
+			updatedat   TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic)
+		);
+		CREATE INDEX directory_category ON directory(category);`); err != nil {
+		return err
+	}
+
+	// Outgoing webhooks.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE webhooks(
+			id        VARCHAR(32) NOT NULL,
+			topic     VARCHAR(25) NOT NULL DEFAULT '',
+			url       VARCHAR(2048) NOT NULL,
+			secret    VARCHAR(256) NOT NULL,
+			events    TEXT,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX webhooks_topic ON webhooks(topic);`); err != nil {
+		return err
+	}
+
+	// Incoming webhooks.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE inwebhooks(
+			token     VARCHAR(32) NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			format    VARCHAR(8) NOT NULL,
+			template  TEXT NOT NULL DEFAULT '',
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(token)
+		);
+		CREATE INDEX inwebhooks_topic ON inwebhooks(topic);`); err != nil {
+		return err
+	}
+
+	// Topics bridged to Matrix rooms.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE matrixrooms(
+			topic     VARCHAR(25) NOT NULL,
+			room      VARCHAR(255) NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic)
+		);
+		CREATE UNIQUE INDEX matrixrooms_room ON matrixrooms(room);`); err != nil {
+		return err
+	}
+
+	// Email addresses of the email gateway.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE mailboxes(
+			address   VARCHAR(254) NOT NULL,
+			topic     VARCHAR(25) NOT NULL,
+			userid    BIGINT NOT NULL,
+			reply     BOOLEAN NOT NULL DEFAULT FALSE,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(address)
+		);
+		CREATE INDEX mailboxes_topic ON mailboxes(topic);`); err != nil {
+		return err
+	}
+
+	// SMS notifications and their delivery statuses.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE smsmessages(
+			id         BIGINT NOT NULL,
+			createdat  TIMESTAMP NOT NULL,
+			updatedat  TIMESTAMP NOT NULL,
+			userid     BIGINT NOT NULL,
+			topic      VARCHAR(25) NOT NULL,
+			seqid      INT NOT NULL DEFAULT 0,
+			phone      VARCHAR(32) NOT NULL,
+			provider   VARCHAR(16) NOT NULL,
+			providerid VARCHAR(64) NOT NULL DEFAULT '',
+			status     VARCHAR(16) NOT NULL,
+			error      TEXT,
+			PRIMARY KEY(id)
+		);
+		CREATE INDEX smsmessages_userid_createdat ON smsmessages(userid, createdat);
+		CREATE INDEX smsmessages_createdat ON smsmessages(createdat);`); err != nil {
+		return err
+	}
+
+	// Hashes of users' phone numbers and emails for contact discovery.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE contacts(
+			hash   VARCHAR(64) NOT NULL,
+			userid BIGINT NOT NULL,
+			PRIMARY KEY(hash, userid),
+			FOREIGN KEY(userid) REFERENCES users(id)
+		);
+		CREATE INDEX contacts_hash_prefix ON contacts(hash);
+		CREATE INDEX contacts_userid ON contacts(userid);`); err != nil {
+		return err
+	}
+
+	// Blind index of message content for searching encrypted messages.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE msgtokens(
+			topic VARCHAR(25) NOT NULL,
+			seqid INT NOT NULL,
+			token VARCHAR(32) NOT NULL,
+			PRIMARY KEY(topic, token, seqid)
+		);
+		CREATE INDEX msgtokens_topic_seqid ON msgtokens(topic, seqid);`); err != nil {
+		return err
+	}
+
+	// Ranges of messages moved to cold storage. Not linked to topics: blobs of deleted topics are
+	// removed by the tiering job.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE msgtiers(
+			topic     VARCHAR(25) NOT NULL,
+			low       INT NOT NULL,
+			hi        INT NOT NULL,
+			msgcount  INT NOT NULL,
+			blobkey   VARCHAR(255) NOT NULL,
+			createdat TIMESTAMP NOT NULL,
+			PRIMARY KEY(topic, low)
+		);`); err != nil {
+		return err
+	}
+
+	// Records of group calls.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE calls(
+			topic        VARCHAR(25) NOT NULL,
+			seqid        INT NOT NULL,
+			room         VARCHAR(255) NOT NULL,
+			owner        BIGINT NOT NULL,
+			createdat    TIMESTAMP NOT NULL,
+			endedat      TIMESTAMP,
+			outcome      VARCHAR(16) NOT NULL DEFAULT '',
+			duration     INT NOT NULL DEFAULT 0,
+			participants TEXT,
+			PRIMARY KEY(topic, seqid)
+		);`); err != nil {
+		return err
+	}
+
+	// Tenants with their own users, topics and files.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE tenants(
+			id        VARCHAR(32) NOT NULL,
+			name      VARCHAR(255) NOT NULL DEFAULT '',
+			hosts     TEXT,
+			config    TEXT,
+			createdat TIMESTAMP NOT NULL,
+			updatedat TIMESTAMP NOT NULL,
+			PRIMARY KEY(id)
+		);`); err != nil {
+		return err
+	}
+
+	// Metered usage of users by billing period.
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE usage(
+			period   CHAR(7) NOT NULL,
+			userid   BIGINT NOT NULL,
+			tenant   VARCHAR(32) NOT NULL DEFAULT '',
+			messages BIGINT NOT NULL DEFAULT 0,
+			pushes   BIGINT NOT NULL DEFAULT 0,
+			callsecs BIGINT NOT NULL DEFAULT 0,
+			PRIMARY KEY(period, userid)
+		);
+		CREATE INDEX usage_period_tenant ON usage(period, tenant);`); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(ctx,
+		`CREATE TABLE kvmeta(
+			"key"     VARCHAR(64) NOT NULL,
+			createdat TIMESTAMP,
+			"value"   TEXT,
+			PRIMARY KEY("key")
+		);
+		CREATE INDEX kvmeta_createdat_key ON kvmeta(createdat, "key");`); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, `INSERT INTO kvmeta("key", "value") VALUES($1, $2)`, "version", strconv.Itoa(adpVersion)); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UpgradeDb upgrades the database, if necessary.
+func (a *adapter) UpgradeDb() error {
+	bumpVersion := func(a *adapter, x int) error {
+		if err := a.updateDbVersion(x); err != nil {
+			return err
+		}
+		_, err := a.GetDbVersion()
+		return err
+	}
+
+	if _, err := a.GetDbVersion(); err != nil {
+		return err
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// The adapter was introduced at version 156. Upgrades to later versions go here.
+
+	if a.version == 156 {
+		// Perform database upgrade from version 156 to version 157.
+
+		// Results of malware scans of uploaded files.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE fileuploads ADD COLUMN scan TEXT"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 157); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 157 {
+		// Perform database upgrade from version 157 to version 158.
+
+		// Duration and waveform of uploaded audio files.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE fileuploads ADD COLUMN media TEXT"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 158); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 158 {
+		// Perform database upgrade from version 158 to version 159.
+
+		// Records of group calls.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE IF NOT EXISTS calls(
+				topic        VARCHAR(25) NOT NULL,
+				seqid        INT NOT NULL,
+				room         VARCHAR(255) NOT NULL,
+				owner        BIGINT NOT NULL,
+				createdat    TIMESTAMP NOT NULL,
+				endedat      TIMESTAMP,
+				participants TEXT,
+				PRIMARY KEY(topic, seqid)
+			);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 159); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 159 {
+		// Perform database upgrade from version 159 to version 160.
+
+		// Outcomes of calls.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE calls ADD COLUMN outcome VARCHAR(16) NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+		if _, err := a.db.Exec(ctx, "ALTER TABLE calls ADD COLUMN duration INT NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 160); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 160 {
+		// Perform database upgrade from version 160 to version 161.
+
+		// Users' settings of presence privacy.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE presencesettings(
+				userid    BIGINT NOT NULL,
+				invisible BOOLEAN NOT NULL DEFAULT FALSE,
+				lastseen  VARCHAR(16) NOT NULL DEFAULT '',
+				updatedat TIMESTAMP NOT NULL,
+				PRIMARY KEY(userid)
+			);`); err != nil {
+			return err
+		}
+
+		// Users' overrides of sharing presence in topics.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE topicpresence(
+				topic     VARCHAR(25) NOT NULL,
+				userid    BIGINT NOT NULL,
+				share     VARCHAR(8) NOT NULL DEFAULT '',
+				updatedat TIMESTAMP NOT NULL,
+				PRIMARY KEY(topic, userid)
+			);
+			CREATE INDEX topicpresence_userid ON topicpresence(userid);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 161); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 161 {
+		// Perform database upgrade from version 161 to version 162.
+
+		// Custom status of the user.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE users ADD COLUMN status TEXT"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 162); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 162 {
+		// Perform database upgrade from version 162 to version 163.
+
+		// Tenants with their own users, topics and files.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE tenants(
+				id        VARCHAR(32) NOT NULL,
+				name      VARCHAR(255) NOT NULL DEFAULT '',
+				hosts     TEXT,
+				config    TEXT,
+				createdat TIMESTAMP NOT NULL,
+				updatedat TIMESTAMP NOT NULL,
+				PRIMARY KEY(id)
+			);`); err != nil {
+			return err
+		}
+
+		for _, table := range []string{"users", "topics", "fileuploads"} {
+			if _, err := a.db.Exec(ctx, "ALTER TABLE "+table+" ADD COLUMN tenant VARCHAR(32) NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+		}
+		if _, err := a.db.Exec(ctx, "CREATE INDEX users_tenant ON users(tenant);"+
+			"CREATE INDEX topics_tenant ON topics(tenant);"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 163); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 163 {
+		// Perform database upgrade from version 163 to version 164.
+
+		// Metered usage of users by billing period.
+		if _, err := a.db.Exec(ctx,
+			`CREATE TABLE usage(
+				period   CHAR(7) NOT NULL,
+				userid   BIGINT NOT NULL,
+				tenant   VARCHAR(32) NOT NULL DEFAULT '',
+				messages BIGINT NOT NULL DEFAULT 0,
+				pushes   BIGINT NOT NULL DEFAULT 0,
+				callsecs BIGINT NOT NULL DEFAULT 0,
+				PRIMARY KEY(period, userid)
+			);
+			CREATE INDEX usage_period_tenant ON usage(period, tenant);`); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 164); err != nil {
+			return err
+		}
+	}
+
+	if a.version == 164 {
+		// Perform database upgrade from version 164 to version 165.
+
+		// Frozen topics.
+		if _, err := a.db.Exec(ctx, "ALTER TABLE topics ADD COLUMN frozen BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+			return err
+		}
+
+		if err := bumpVersion(a, 165); err != nil {
+			return err
+		}
+	}
+
+	if a.version != adpVersion {
+		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
+			". DB is still at " + strconv.Itoa(a.version))
+	}
+	return nil
+}
+
+func createSystemTopic(tx *txn) error {
+	now := t.TimeNow()
+	query := `INSERT INTO topics(createdat,updatedat,state,touchedat,name,access,public)
+				VALUES($1,$2,$3,$4,'sys','{"Auth": "N","Anon": "N"}','{"fn": "System"}'),
+				($1,$2,$3,$4,'rpt','{"Auth": "N","Anon": "N"}','{"fn": "Reports"}')`
+	_, err := tx.Exec(context.Background(), query, now, now, t.StateOK, now)
+	return err
+}
+
+func addTags(ctx context.Context, tx *txn, table, keyName string, keyVal any, tags []string, ignoreDups bool) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	//addTags(ctx, tx, "usertags", "userid", decoded_uid, add, reset == nil)
+	sql := "INSERT INTO " + table + " (" + keyName + ",tag) VALUES($1,$2)"
+	if ignoreDups {
+		sql += " ON CONFLICT DO NOTHING"
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec(ctx, sql, keyVal, tag); err != nil {
+			if isDupe(err) {
+				return t.ErrDuplicate
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeTags(ctx context.Context, tx *txn, table, keyName string, keyVal any, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	sql, args := expandQuery("DELETE FROM "+table+" WHERE "+keyName+"=? AND tag IN (?)", keyVal, tags)
+	_, err := tx.Exec(ctx, sql, args...)
+
+	return err
+}
+
+// UserCreate creates a new user. Returns error and true if error is due to duplicate user name,
+// false for any other error
+func (a *adapter) UserCreate(user *t.User) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(user.Uid())
+	if _, err = tx.Exec(ctx,
+		"INSERT INTO users(id,createdat,updatedat,state,access,public,trusted,tags,tenant) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9);",
+		decoded_uid,
+		user.CreatedAt,
+		user.UpdatedAt,
+		user.State,
+		user.Access,
+		toJSON(user.Public),
+		toJSON(user.Trusted),
+		user.Tags,
+		user.Tenant); err != nil {
+		return err
+	}
+
+	// Save user's tags to a separate table to make user findable.
+	if err = addTags(ctx, tx, "usertags", "userid", decoded_uid, user.Tags, false); err != nil {
+		return err
+	}
+	if err = a.contactsRefresh(ctx, tx, decoded_uid); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Add user's authentication record
+func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	var exp *time.Time
+	if !expires.IsZero() {
+		exp = &expires
+	}
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if _, err := a.db.Exec(ctx, "INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires) VALUES($1,$2,$3,$4,$5,$6)",
+		unique, store.DecodeUid(uid), scheme, authLvl, secret, exp); err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	return nil
+}
+
+// AuthDelScheme deletes an existing authentication scheme for the user.
+func (a *adapter) AuthDelScheme(user t.Uid, scheme string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "DELETE FROM auth WHERE userid=$1 AND scheme=$2", store.DecodeUid(user), scheme)
+	return err
+}
+
+// AuthDelAllRecords deletes all authentication records for the user.
+func (a *adapter) AuthDelAllRecords(user t.Uid) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	res, err := a.db.Exec(ctx, "DELETE FROM auth WHERE userid=$1", store.DecodeUid(user))
+	if err != nil {
+		return 0, err
+	}
+	count := res.RowsAffected()
+
+	return int(count), nil
+}
+
+// Update user's authentication unique, secret, auth level.
+func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
+	secret []byte, expires time.Time) error {
+
+	parapg := []string{"authLvl=?"}
+	args := []any{authLvl}
+	if unique != "" {
+		parapg = append(parapg, "uname=?")
+		args = append(args, unique)
+	}
+	if len(secret) > 0 {
+		parapg = append(parapg, "secret=?")
+		args = append(args, secret)
+	}
+	if !expires.IsZero() {
+		parapg = append(parapg, "expires=?")
+		args = append(args, expires)
+	}
+	args = append(args, store.DecodeUid(uid), scheme)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	sql, args := expandQuery("UPDATE auth SET "+strings.Join(parapg, ",")+" WHERE userid=? AND scheme=?", args...)
+	resp, err := a.db.Exec(ctx, sql, args...)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+
+	if count := resp.RowsAffected(); count <= 0 {
+		return t.ErrNotFound
+	}
+
+	return err
+}
+
+// Retrieve user's authentication record
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var record struct {
+		Uname   string
+		Authlvl auth.Level
+		Secret  []byte
+		Expires *time.Time
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	if err := a.db.QueryRow(ctx, "SELECT uname,secret,expires,authlvl FROM auth WHERE userid=$1 AND scheme=$2",
+		store.DecodeUid(uid), scheme).Scan(
+		&record.Uname, &record.Secret, &record.Expires, &record.Authlvl); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - use standard error.
+			err = t.ErrNotFound
+		}
+		return "", 0, nil, expires, err
+	}
+
+	if record.Expires != nil {
+		expires = *record.Expires
+	}
+
+	return record.Uname, record.Authlvl, record.Secret, expires, nil
+}
+
+// Retrieve user's authentication record
+func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
+	var expires time.Time
+
+	var record struct {
+		Userid  int64
+		Authlvl auth.Level
+		Secret  []byte
+		Expires *time.Time
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	if err := a.db.QueryRow(ctx, "SELECT userid,secret,expires,authlvl FROM auth WHERE uname=$1", unique).Scan(
+		&record.Userid, &record.Secret, &record.Expires, &record.Authlvl); err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return t.ZeroUid, 0, nil, expires, err
+	}
+
+	if record.Expires != nil {
+		expires = *record.Expires
+	}
+
+	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
+}
+
+// AuthGetAllRecords returns a page of authentication records of the scheme ordered by the unique value.
+func (a *adapter) AuthGetAllRecords(scheme, after string, limit int) ([]t.AuthRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT userid,uname,secret FROM auth WHERE scheme=$1 AND uname>$2 ORDER BY uname LIMIT $3",
+		scheme, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []t.AuthRecord
+	for rows.Next() {
+		var userid int64
+		var rec t.AuthRecord
+		if err = rows.Scan(&userid, &rec.Unique, &rec.Secret); err != nil {
+			return nil, err
+		}
+		rec.Uid = store.EncodeUid(userid)
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
+func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var user t.User
+	var id int64
+	row, err := a.db.Query(ctx, "SELECT * FROM users WHERE id=$1 AND state!=$2", store.DecodeUid(uid), t.StateDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer row.Close()
+
+	if !row.Next() {
+		// Nothing found: user does not exist or marked as soft-deleted
+		return nil, nil
+	}
+
+	err = row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags, &user.Status, &user.Tenant)
+	if err == nil {
+		user.SetUid(uid)
+		return &user, nil
+	}
+
+	return nil, err
+}
+
+func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
+	uids := make([]any, len(ids))
+	for i, id := range ids {
+		uids[i] = store.DecodeUid(id)
+	}
+
+	users := []t.User{}
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT * FROM users WHERE id IN (SELECT value FROM json_each($1)) AND state!=$2", uids, t.StateDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user t.User
+		var id int64
+		if err = rows.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.State, &user.StateAt, &user.Access, &user.LastSeen, &user.UserAgent, &user.Public, &user.Trusted, &user.Tags, &user.Status, &user.Tenant); err != nil {
+			users = nil
+			break
+		}
+		user.SetUid(store.EncodeUid(id))
+
+		users = append(users, user)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return users, err
+}
+
+// UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
+// TODO: report when the user is not found.
+func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
+	query := "SELECT name FROM topics WHERE owner=$1"
+	args := []any{store.DecodeUid(uid)}
+	// In case of hard delete, delete all topics, even those which were
+	// soft-deleted previsously.
+	if !hard {
+		query += " AND state!=$2"
+		args = append(args, t.StateDeleted)
+	}
+	// Get a list of topic names owned by the user (as 'grp' and 'chn').
+	ownTopics, err := a.topicNamesForUser(query, false, args...)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	now := t.TimeNow()
+	decoded_uid := store.DecodeUid(uid)
+
+	if hard {
+		// Delete user's devices
+		// t.ErrNotFound = user has no devices.
+		if err = deviceDelete(ctx, tx, uid, ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		// Delete user's subscriptions in all topics.
+		if err = subsDelForUser(ctx, tx, decoded_uid, true); err != nil {
+			return err
+		}
+
+		// Delete records of messages soft-deleted for the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM dellog WHERE deletedfor=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's read markers and mute flags of threads.
+		if _, err = tx.Exec(ctx, "DELETE FROM threadsubs WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's messages waiting to be published.
+		if _, err = tx.Exec(ctx, `DELETE FROM scheduled WHERE "from"=$1`, decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete records of user's sessions.
+		if _, err = tx.Exec(ctx, "DELETE FROM usersessions WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's registered devices.
+		if _, err = tx.Exec(ctx, "DELETE FROM userdevices WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's notification settings.
+		if _, err = tx.Exec(ctx, "DELETE FROM notifysettings WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM topicnotify WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's presence settings.
+		if _, err = tx.Exec(ctx, "DELETE FROM presencesettings WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM topicpresence WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM mentions WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's drafts and starred messages.
+		if _, err = tx.Exec(ctx, "DELETE FROM drafts WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM starred WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete blocks made by the user and of the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM blocks WHERE userid=$1 OR target=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete invite links created by the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM invites WHERE createdby=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete incoming webhooks posting as the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM inwebhooks WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete mailboxes posting as the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM mailboxes WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete records of SMS notifications sent to the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM smsmessages WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete user's encryption keys and pending sender keys sent by and to the user.
+		if _, err = tx.Exec(ctx, "DELETE FROM keybundles WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, `DELETE FROM senderkeys WHERE userid=$1 OR "from"=$1`, decoded_uid); err != nil {
+			return err
+		}
+
+		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+		// Just leave the messages there marked as sent by "not found" user.
+
+		// Delete topics where the user is the owner.
+
+		if len(ownTopics) > 0 {
+			// First delete all messages in those topics.
+			if _, err = tx.Exec(ctx, "DELETE FROM dellog WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+
+			// Deletion of messages will cascade to filemsglinks and so to fileuploads.
+			if _, err = tx.Exec(ctx, "DELETE FROM messages WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, "DELETE FROM scheduled WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, "DELETE FROM calls WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+			// Delete subscriptions for all users where the user is the owner of the topic.
+			sql, args, _ := sqlx.In("DELETE FROM subscriptions AS s WHERE topic IN (?)", ownTopics)
+			if _, err = tx.Exec(ctx, sqlx.Rebind(sqlx.DOLLAR, sql), args...); err != nil {
+				return err
+			}
+
+			// Delete topic tags.
+			if _, err = tx.Exec(ctx, "DELETE FROM topictags WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+
+			// Remove the topics from the directory.
+			if _, err = tx.Exec(ctx, "DELETE FROM directory WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+
+			// Delete webhooks of the topics.
+			if _, err = tx.Exec(ctx, "DELETE FROM webhooks WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, "DELETE FROM inwebhooks WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, "DELETE FROM matrixrooms WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec(ctx, "DELETE FROM mailboxes WHERE topic IN (SELECT name FROM topics WHERE owner=$1)",
+				decoded_uid); err != nil {
+				return err
+			}
+
+			// And finally delete the topics.
+			if _, err = tx.Exec(ctx, "DELETE FROM topics WHERE owner=$1", decoded_uid); err != nil {
+				return err
+			}
+		}
+
+		// Delete user's authentication records.
+		if _, err = tx.Exec(ctx, "DELETE FROM auth WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		// Delete all credentials.
+		if err = credDel(ctx, tx, uid, "", ""); err != nil && err != t.ErrNotFound {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM usertags WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(ctx, "DELETE FROM contacts WHERE userid=$1", decoded_uid); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM users WHERE id=$1", decoded_uid); err != nil {
+			return err
+		}
+	} else {
+		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+		if err = subsDelForUser(ctx, tx, decoded_uid, false); err != nil {
+			return err
+		}
+
+		if len(ownTopics) > 0 {
+			// Disable all subscriptions to topics where the user is the owner.
+			sql, args, _ := sqlx.In("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic IN (?)", now, now, ownTopics)
+			if _, err = tx.Exec(ctx, sqlx.Rebind(sqlx.DOLLAR, sql), args...); err != nil {
+				return err
+			}
+
+			// Disable group topics where the user is the owner.
+			if _, err = tx.Exec(ctx, "UPDATE topics SET updatedat=$1,touchedat=$1,state=$2,stateat=$1 WHERE owner=$3",
+				now, t.StateDeleted, decoded_uid); err != nil {
+				return err
+			}
+		}
+
+		// Disable p2p topics with the user (p2p topic's owner is 0).
+		if _, err = tx.Exec(ctx, "UPDATE topics SET updatedat=$1,touchedat=$1,state=$2,stateat=$1 "+
+			"FROM subscriptions WHERE topics.name=subscriptions.topic "+
+			"AND topics.owner=0 AND subscriptions.userid=$3",
+			now, t.StateDeleted, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable the other user's subscription to a disabled p2p topic.
+		if _, err = tx.Exec(ctx, "UPDATE subscriptions AS s_one SET updatedat=$1,deletedat=$1 "+
+			"FROM subscriptions AS s_two WHERE s_one.topic=s_two.topic "+
+			"AND s_two.userid=$2 AND s_two.topic LIKE 'p2p%'",
+			now, decoded_uid); err != nil {
+			return err
+		}
+
+		// Disable user.
+		if _, err = tx.Exec(ctx, "UPDATE users SET updatedat=$1,state=$2,stateat=$1 WHERE id=$3",
+			now, t.StateDeleted, decoded_uid); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UserErase deletes or anonymizes user's data left intact by UserDelete.
+func (a *adapter) UserErase(uid t.Uid, dryRun bool) (t.ErasureReport, []string, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil || dryRun {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+	report := t.ErasureReport{}
+	count := func(kind, query string) {
+		if err != nil {
+			return
+		}
+		var n int
+		if err = tx.QueryRow(ctx, query, decoded_uid).Scan(&n); err == nil && n > 0 {
+			report[kind] = n
+		}
+	}
+
+	// Records deleted by UserDelete.
+	count("account", "SELECT COUNT(*) FROM users WHERE id=$1")
+	count("auth", "SELECT COUNT(*) FROM auth WHERE userid=$1")
+	count("credentials", "SELECT COUNT(*) FROM credentials WHERE userid=$1")
+	count("devices", "SELECT COUNT(*) FROM devices WHERE userid=$1")
+	count("tags", "SELECT COUNT(*) FROM usertags WHERE userid=$1")
+	count("subscriptions", "SELECT COUNT(*) FROM subscriptions WHERE userid=$1")
+	count("topics", "SELECT COUNT(*) FROM topics WHERE owner=$1")
+	count("scheduled", `SELECT COUNT(*) FROM scheduled WHERE "from"=$1`)
+	count("threads", "SELECT COUNT(*) FROM threadsubs WHERE userid=$1")
+	count("sessions", "SELECT COUNT(*) FROM usersessions WHERE userid=$1")
+	// Records deleted or anonymized here.
+	count("messages", `SELECT COUNT(*) FROM messages WHERE "from"=$1 AND (deletedat IS NULL OR content IS NOT NULL)`)
+	count("reactions", "SELECT COUNT(*) FROM reactions WHERE userid=$1")
+	count("polls", "SELECT COUNT(*) FROM polls WHERE userid=$1")
+	count("votes", "SELECT COUNT(*) FROM pollvotes WHERE userid=$1")
+	count("files", "SELECT COUNT(*) FROM fileuploads WHERE userid=$1")
+	count("takeouts", "SELECT COUNT(*) FROM takeouts WHERE userid=$1")
+	count("reports", "SELECT COUNT(*) FROM reports WHERE reporter=$1 OR target=$1")
+	count("moderation", "SELECT COUNT(*) FROM moderationlog WHERE userid=$1")
+	count("audit", "SELECT COUNT(*) FROM auditlog WHERE actor=$1 OR target=$1")
+	if err != nil || dryRun {
+		return report, nil, err
+	}
+
+	// Content of user's messages is erased, the messages are marked as deleted. Edit history, translations,
+	// search tokens and attached polls with votes are deleted together with the content.
+	for _, table := range []string{"msgedits", "translations", "msgtokens", "pollvotes", "polls"} {
+		if _, err = tx.Exec(ctx, "DELETE FROM "+table+` AS x WHERE EXISTS (SELECT 1 FROM messages AS m WHERE m.topic=x.topic
+			AND m.seqid=x.seqid AND m."from"=$1)`, decoded_uid); err != nil {
+			return nil, nil, err
+		}
+	}
+	now := t.TimeNow()
+	if _, err = tx.Exec(ctx, `UPDATE messages SET updatedat=$1,deletedat=COALESCE(deletedat,$1),head=NULL,content=NULL
+		WHERE "from"=$2 AND (deletedat IS NULL OR content IS NOT NULL)`, now, decoded_uid); err != nil {
+		return nil, nil, err
+	}
+
+	// User's reactions and votes in other users' messages.
+	if _, err = tx.Exec(ctx, "DELETE FROM reactions WHERE userid=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM pollvotes WHERE userid=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+
+	// Reports filed by the user are deleted, evidence collected against the user is erased.
+	if _, err = tx.Exec(ctx, "DELETE FROM reports WHERE reporter=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+	if _, err = tx.Exec(ctx, "UPDATE reports SET evidence=NULL WHERE target=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM moderationlog WHERE userid=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+	// Audit records are kept without the reference to the user.
+	if _, err = tx.Exec(ctx, "UPDATE auditlog SET actor=NULL WHERE actor=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+	if _, err = tx.Exec(ctx, "UPDATE auditlog SET target=NULL WHERE target=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM takeouts WHERE userid=$1", decoded_uid); err != nil {
+		return nil, nil, err
+	}
+
+	// Files uploaded by the user, including avatars and attachments in other users' topics.
+	// Links to messages are deleted by ON DELETE CASCADE.
+	rows, err := tx.Query(ctx, "DELETE FROM fileuploads WHERE userid=$1 RETURNING location", decoded_uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	var locations []string
+	for rows.Next() {
+		var loc string
+		if err = rows.Scan(&loc); err != nil {
+			break
+		}
+		if loc != "" {
+			locations = append(locations, loc)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return report, locations, tx.Commit(ctx)
+}
+
+// topicStateForUser is called by UserUpdate when the update contains state change.
+// Soft-deleted topics remain soft-deleted.
+func (a *adapter) topicStateForUser(ctx context.Context, tx *txn, decoded_uid int64, now time.Time, update any) error {
+	var err error
+
+	state, ok := update.(t.ObjState)
+	if !ok {
+		return t.ErrMalformed
+	}
+
+	if now.IsZero() {
+		now = t.TimeNow()
+	}
+
+	// Change state of all topics where the user is the owner.
+	if _, err = tx.Exec(ctx, "UPDATE topics SET state=$1, stateat=$2 WHERE owner=$3 AND state!=$4",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Change state of p2p topics with the user (p2p topic's owner is 0)
+	if _, err = tx.Exec(ctx, "UPDATE topics SET state=$1, stateat=$2 "+
+		"FROM subscriptions WHERE topics.name=subscriptions.topic AND "+
+		"topics.owner=0 AND subscriptions.userid=$3 AND topics.state!=$4",
+		state, now, decoded_uid, t.StateDeleted); err != nil {
+		return err
+	}
+
+	// Subscriptions don't need to be updated:
+	// subscriptions of a disabled user are not disabled and still can be manipulated.
+
+	return nil
+}
+
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]any) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	cols, args := common.UpdateByMap(update)
+	decoded_uid := store.DecodeUid(uid)
+	args = append(args, decoded_uid)
+	sql, args := expandQuery("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
+	_, err = tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+
+	if state, ok := update["State"]; ok {
+		now, _ := update["StateAt"].(time.Time)
+		err = a.topicStateForUser(ctx, tx, decoded_uid, now, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tags are also stored in a separate table
+	if tags := common.ExtractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec(ctx, "DELETE FROM usertags WHERE userid=$1", decoded_uid)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(ctx, tx, "usertags", "userid", decoded_uid, tags, false)
+		if err != nil {
+			return err
+		}
+		if err = a.contactsRefresh(ctx, tx, decoded_uid); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func tempFetchTags(ctx context.Context, tx *txn, decoded_uid int64) ([]string, error) {
+	var allTags []string
+	rows, err := tx.Query(ctx, "SELECT tag FROM usertags WHERE userid=$1", decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		allTags = append(allTags, tag)
+	}
+	return allTags, nil
+}
+
+// UserUpdateTags adds or resets user's tags
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(uid)
+
+	if reset != nil {
+		// Delete all tags first if resetting.
+		_, err = tx.Exec(ctx, "DELETE FROM usertags WHERE userid=$1", decoded_uid)
+		if err != nil {
+			return nil, err
+		}
+		add = reset
+		remove = nil
+	}
+
+	// Now insert new tags. Ignore duplicates if resetting.
+	err = addTags(ctx, tx, "usertags", "userid", decoded_uid, add, reset == nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete tags.
+	err = removeTags(ctx, tx, "usertags", "userid", decoded_uid, remove)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = a.contactsRefresh(ctx, tx, decoded_uid); err != nil {
+		return nil, err
+	}
+
+	var allTags []string
+	rows, err := tx.Query(ctx, "SELECT tag FROM usertags WHERE userid=$1", decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		allTags = append(allTags, tag)
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE users SET tags=$1 WHERE id=$2", t.StringSlice(allTags), decoded_uid)
+	if err != nil {
+		return nil, err
+	}
+
+	return allTags, tx.Commit(ctx)
+}
+
+// UserGetByCred returns user ID for the given validated credential.
+func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var decoded_uid int64
+	err := a.db.QueryRow(ctx, "SELECT userid FROM credentials WHERE synthetic=$1", method+":"+value).Scan(&decoded_uid)
+	if err == nil {
+		return store.EncodeUid(decoded_uid), nil
+	}
+
+	if err == sql.ErrNoRows {
+		// Clear the error if user does not exist
+		return t.ZeroUid, nil
+	}
+	return t.ZeroUid, err
+}
+
+// UserUnreadCount returns the total number of unread messages in all topics with
+// the R permission. If read fails, the counts are still returned with the original
+// user IDs but with the unread count undefined and non-nil error.
+// UserUnreadCount does not count unread messages in channels although it should.
+func (a *adapter) UserUnreadCount(ids ...t.Uid) (map[t.Uid]int, error) {
+	uids := make([]any, len(ids))
+	counts := make(map[t.Uid]int, len(ids))
+	for i, id := range ids {
+		uids[i] = store.DecodeUid(id)
+		// Ensure all original uids are always present.
+		counts[id] = 0
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// FIXME: support channels.
+	query, uids := expandQuery("SELECT s.userid, SUM(t.seqid)-SUM(s.readseqid) AS unreadcount FROM topics AS t, subscriptions AS s "+
+		"WHERE s.userid IN (?) AND t.name=s.topic AND s.deletedat IS NULL AND t.state!=? AND "+
+		"instr(s.modewant,'R')>0 AND instr(s.modegiven,'R')>0 GROUP BY s.userid", uids, t.StateDeleted)
+	rows, err := a.db.Query(ctx, query, uids...)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	var userId int64
+	var unreadCount int
+	for rows.Next() {
+		if err = rows.Scan(&userId, &unreadCount); err != nil {
+			break
+		}
+		counts[store.EncodeUid(userId)] = unreadCount
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return counts, err
+}
+
+// UserUnreadByTopic returns the numbers of unread messages and of unread mentions of the user in each topic.
+func (a *adapter) UserUnreadByTopic(uid t.Uid) ([]t.TopicUnread, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Channels are not supported, same as UserUnreadCount.
+	userId := store.DecodeUid(uid)
+	rows, err := a.db.Query(ctx, "SELECT s.topic,t.parent,t.seqid-s.readseqid,"+
+		"(SELECT COUNT(*) FROM mentions AS mn WHERE mn.userid=s.userid AND mn.topic=s.topic AND mn.seqid>s.readseqid) "+
+		"FROM subscriptions AS s JOIN topics AS t ON t.name=s.topic "+
+		"WHERE s.userid=$1 AND s.deletedat IS NULL AND t.state!=$2 AND t.seqid>s.readseqid AND "+
+		"instr(s.modewant,'R')>0 AND instr(s.modegiven,'R')>0", userId, t.StateDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.TopicUnread
+	for rows.Next() {
+		var tu t.TopicUnread
+		if err = rows.Scan(&tu.Topic, &tu.Parent, &tu.Unread, &tu.Mentions); err != nil {
+			return nil, err
+		}
+		result = append(result, tu)
+	}
+	return result, rows.Err()
+}
+
+// UserGetUnvalidated returns a list of uids which have never logged in, have no
+// validated credentials and haven't been updated since lastUpdatedBefore.
+func (a *adapter) UserGetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]t.Uid, error) {
+	var uids []t.Uid
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx,
+		"SELECT u.id, COALESCE(SUM(CASE WHEN c.done THEN 1 ELSE 0 END), 0) AS total "+
+			"FROM users u LEFT JOIN credentials c ON u.id = c.userid "+
+			"WHERE u.lastseen IS NULL AND u.updatedat < $1 GROUP BY u.id, u.updatedat "+
+			"HAVING COALESCE(SUM(CASE WHEN c.done THEN 1 ELSE 0 END), 0) = 0 ORDER BY u.updatedat ASC LIMIT $2",
+		lastUpdatedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId int64
+		var unused int
+		if err = rows.Scan(&userId, &unused); err != nil {
+			break
+		}
+		uids = append(uids, store.EncodeUid(userId))
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return uids, err
+}
+
+// *****************************
+
+func (a *adapter) topicCreate(ctx context.Context, tx *txn, topic *t.Topic) error {
+	_, err := tx.Exec(ctx, "INSERT INTO topics(createdat,updatedat,touchedat,state,name,usebt,owner,access,public,trusted,tags,aux,"+
+		"broadcast,community,parent,tenant) VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16)",
+		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.State, topic.Id, topic.UseBt,
+		store.DecodeUid(t.ParseUid(topic.Owner)), topic.Access, toJSON(topic.Public), toJSON(topic.Trusted),
+		topic.Tags, toJSON(topic.Aux), topic.Broadcast, topic.Community, topic.Parent, topic.Tenant)
+	if err != nil {
+		return err
+	}
+
+	// Save topic's tags to a separate table to make topic findable.
+	return addTags(ctx, tx, "topictags", "topic", topic.Id, topic.Tags, false)
+}
+
+// TopicCreate saves topic object to database.
+func (a *adapter) TopicCreate(topic *t.Topic) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	err = a.topicCreate(ctx, tx, topic)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// If undelete = true - update subscription on duplicate key, otherwise ignore the duplicate.
+func createSubscription(ctx context.Context, tx *txn, sub *t.Subscription, undelete bool) error {
+
+	isOwner := (sub.ModeGiven & sub.ModeWant).IsOwner()
+
+	jpriv := toJSON(sub.Private)
+	decoded_uid := store.DecodeUid(t.ParseUid(sub.User))
+	_, err2 := tx.Exec(ctx, "SAVEPOINT createSub")
+	if err2 != nil {
+		log.Println("Error: Failed to create savepoint: ", err2.Error())
+	}
+	_, err := tx.Exec(ctx,
+		"INSERT INTO subscriptions(createdat,updatedat,deletedat,userid,topic,modeWant,modeGiven,private,request) "+
+			"VALUES($1,$2,NULL,$3,$4,$5,$6,$7,$8)",
+		sub.CreatedAt, sub.UpdatedAt, decoded_uid, sub.Topic, sub.ModeWant.String(), sub.ModeGiven.String(), jpriv,
+		sub.Request)
+
+	if err != nil && isDupe(err) {
+		_, err2 = tx.Exec(ctx, "ROLLBACK TO SAVEPOINT createSub")
+		if err2 != nil {
+			log.Println("Error: Failed to rollback savepoint: ", err2.Error())
+		}
+		if undelete {
+			_, err = tx.Exec(ctx, "UPDATE subscriptions SET createdat=$1,updatedat=$2,deletedat=NULL,modeWant=$3,modeGiven=$4,"+
+				"delid=0,recvseqid=0,readseqid=0,role='',request=$5 WHERE topic=$6 AND userid=$7",
+				sub.CreatedAt, sub.UpdatedAt, sub.ModeWant.String(), sub.ModeGiven.String(), sub.Request,
+				sub.Topic, decoded_uid)
+		} else {
+			_, err = tx.Exec(ctx, "UPDATE subscriptions SET createdat=$1,updatedat=$2,deletedat=NULL,modeWant=$3,modeGiven=$4,"+
+				"delid=0,recvseqid=0,readseqid=0,role='',private=$5,request=$6 WHERE topic=$7 AND userid=$8",
+				sub.CreatedAt, sub.UpdatedAt, sub.ModeWant.String(), sub.ModeGiven.String(), jpriv, sub.Request,
+				sub.Topic, decoded_uid)
+		}
+	} else {
+		_, err2 = tx.Exec(ctx, "RELEASE SAVEPOINT createSub")
+		if err2 != nil {
+			log.Println("Error: Failed to release savepoint: ", err2.Error())
+		}
+	}
+	if err == nil && isOwner {
+		_, err = tx.Exec(ctx, "UPDATE topics SET owner=$1 WHERE name=$2", decoded_uid, sub.Topic)
+	}
+	return err
+}
+
+// TopicCreateP2P given two users creates a p2p topic
+func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	err = createSubscription(ctx, tx, initiator, false)
+	if err != nil {
+		return err
+	}
+
+	err = createSubscription(ctx, tx, invited, true)
+	if err != nil {
+		return err
+	}
+
+	topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
+	topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
+	topic.TouchedAt = initiator.GetTouchedAt()
+	// The topic belongs to the tenant of the users.
+	if err = tx.QueryRow(ctx, "SELECT tenant FROM users WHERE id=$1",
+		store.DecodeUid(t.ParseUid(initiator.User))).Scan(&topic.Tenant); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	err = a.topicCreate(ctx, tx, topic)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
+func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Fetch topic by name
+	var tt = new(t.Topic)
+	var owner int64
+	err := a.db.QueryRow(ctx,
+		"SELECT createdat,updatedat,state,stateat,touchedat,name AS id,usebt,access,owner,seqid,delid,subcnt,public,trusted,tags,aux,msgttl,slowmode,pinned,"+
+			"broadcast,community,parent,tenant,frozen FROM topics WHERE name=$1",
+		topic).Scan(&tt.CreatedAt, &tt.UpdatedAt, &tt.State, &tt.StateAt, &tt.TouchedAt, &tt.Id,
+		&tt.UseBt, &tt.Access, &owner, &tt.SeqId, &tt.DelId, &tt.SubCnt, &tt.Public, &tt.Trusted, &tt.Tags, &tt.Aux, &tt.MsgTTL, &tt.SlowMode, &tt.Pinned,
+		&tt.Broadcast, &tt.Community, &tt.Parent, &tt.Tenant, &tt.Frozen)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return nil, err
+	}
+
+	if t.GetTopicCat(topic) == t.TopicCatGrp {
+		// Topic found, get subsription count. Try both topic and channel names.
+		var subCnt int
+		if err = a.db.QueryRow(ctx,
+			"SELECT COUNT(*) FROM subscriptions WHERE topic IN ($1,$2) AND deletedat IS NULL", topic, t.GrpToChn(topic)).
+			Scan(&subCnt); err != nil {
+			return nil, err
+		}
+
+		if subCnt != tt.SubCnt {
+			// Update the topic with the correct subscription count.
+			tt.SubCnt = subCnt
+			if _, err = a.db.Exec(ctx, "UPDATE topics SET subcnt=$1 WHERE name=$2", subCnt, topic); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	tt.Owner = store.EncodeUid(owner).String()
+
+	return tt, err
+}
+
+// TopicsForParent loads group topics of the community, the oldest first.
+func (a *adapter) TopicsForParent(parent string) ([]t.Topic, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx,
+		"SELECT createdat,updatedat,touchedat,name,usebt,access,owner,seqid,subcnt,public,trusted,parent "+
+			"FROM topics WHERE parent=$1 AND state!=$2 ORDER BY createdat LIMIT $3",
+		parent, t.StateDeleted, a.maxResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []t.Topic
+	for rows.Next() {
+		var tt t.Topic
+		var owner int64
+		if err = rows.Scan(&tt.CreatedAt, &tt.UpdatedAt, &tt.TouchedAt, &tt.Id, &tt.UseBt, &tt.Access, &owner,
+			&tt.SeqId, &tt.SubCnt, &tt.Public, &tt.Trusted, &tt.Parent); err != nil {
+			return nil, err
+		}
+		tt.Owner = store.EncodeUid(owner).String()
+		topics = append(topics, tt)
+	}
+	return topics, rows.Err()
+}
+
+// TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
+// Reads and denormalizes Public value.
+func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	// Fetch ALL user's subscriptions, even those which has not been modified recently.
+	// We are going to use these subscriptions to fetch topics and users which may have been modified recently.
+	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private,labels,archivedat,autounarchive FROM subscriptions WHERE userid=?`
+	args := []any{store.DecodeUid(uid)}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+
+	limit := 0
+	ims := time.Time{}
+	if opts != nil {
+		if opts.Topic != "" {
+			q += " AND topic=?"
+			args = append(args, opts.Topic)
+		}
+		if opts.Label != "" {
+			q += " AND EXISTS (SELECT 1 FROM json_each(labels) WHERE value=?)"
+			args = append(args, opts.Label)
+		}
+		if opts.Archived != nil {
+			if *opts.Archived {
+				q += " AND archivedat IS NOT NULL"
+			} else {
+				q += " AND archivedat IS NULL"
+			}
+		}
+
+		// Apply the limit only when the client does not manage the cache (or cold start).
+		// Otherwise have to get all subscriptions and do a manual join with users/topics.
+		if opts.IfModifiedSince == nil {
+			if opts.Limit > 0 && opts.Limit < a.maxResults {
+				limit = opts.Limit
+			} else {
+				limit = a.maxResults
+			}
+		} else {
+			ims = *opts.IfModifiedSince
+		}
+	} else {
+		limit = a.maxResults
+	}
+
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+
+	q, args = expandQuery(q, args...)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	// Must close rows manually as we will be reusing it.
+
+	// Fetch subscriptions. Two queries are needed: users table (p2p) and topics table (grp).
+	// Prepare a list of separate subscriptions to users vs topics
+	join := make(map[string]t.Subscription) // Keeping these to make a join with table for .private and .access
+	topq := make([]any, 0, 16)
+	usrq := make([]any, 0, 16)
+	for rows.Next() {
+		var sub t.Subscription
+		var modeWant, modeGiven []byte
+		if err = rows.Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &sub.Topic, &sub.DelId,
+			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private, &sub.Labels,
+			&sub.ArchivedAt, &sub.AutoUnarchive); err != nil {
+			break
+		}
+		sub.ModeWant.Scan(modeWant)
+		sub.ModeGiven.Scan(modeGiven)
+		tname := sub.Topic
+		sub.User = uid.String()
+		tcat := t.GetTopicCat(tname)
+
+		if tcat == t.TopicCatMe || tcat == t.TopicCatFnd {
+			// One of 'me', 'fnd' subscriptions, skip.
+			// Don't skip 'sys' subscription.
+			continue
+		} else if tcat == t.TopicCatP2P {
+			// P2P subscription, find the other user to get user.Public and user.Trusted.
+			uid1, uid2, _ := t.ParseP2P(tname)
+			if uid1 == uid {
+				usrq = append(usrq, store.DecodeUid(uid2))
+				sub.SetWith(uid2.UserId())
+			} else {
+				usrq = append(usrq, store.DecodeUid(uid1))
+				sub.SetWith(uid1.UserId())
+			}
+		} else if tcat == t.TopicCatGrp {
+			// Maybe convert channel name to topic name.
+			tname = t.ChnToGrp(tname)
+		}
+		// No special handling needed for 'slf', 'sys' subscriptions.
+
+		topq = append(topq, tname)
+		sub.Private = common.FromJSON(sub.Private)
+		join[tname] = sub
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []t.Subscription
+	if len(join) == 0 {
+		return subs, nil
+	}
+
+	// Fetch grp topics and join to subscriptions.
+	if len(topq) > 0 {
+		q = "SELECT updatedat,state,touchedat,name AS id,usebt,access,seqid,delid,subcnt,public,trusted " +
+			"FROM topics WHERE name IN (?)"
+		newargs := []any{topq}
+
+		if !keepDeleted {
+			// Optionally skip deleted topics.
+			q += " AND state!=?"
+			newargs = append(newargs, t.StateDeleted)
+		}
+
+		if !ims.IsZero() {
+			// Use cache timestamp if provided: get newer entries only.
+			q += " AND touchedat>?"
+			newargs = append(newargs, ims)
+
+			if limit > 0 && limit < len(topq) {
+				// No point in fetching more than the requested limit.
+				q += " ORDER BY touchedat LIMIT ?"
+				newargs = append(newargs, limit)
+			}
+		}
+		q, newargs = expandQuery(q, newargs...)
+
+		ctx2, cancel2 := a.getContext()
+		if cancel2 != nil {
+			defer cancel2()
+		}
+		rows, err = a.db.Query(ctx2, q, newargs...)
+		if err != nil {
+			return nil, err
+		}
+
+		var top t.Topic
+		for rows.Next() {
+			if err = rows.Scan(&top.UpdatedAt, &top.State, &top.TouchedAt, &top.Id, &top.UseBt,
+				&top.Access, &top.SeqId, &top.DelId, &top.SubCnt, &top.Public, &top.Trusted); err != nil {
+				break
+			}
+
+			sub := join[top.Id]
+			// Check if sub.UpdatedAt needs to be adjusted to earlier or later time.
+			sub.UpdatedAt = common.SelectLatestTime(sub.UpdatedAt, top.UpdatedAt)
+			sub.SetState(top.State)
+			sub.SetTouchedAt(top.TouchedAt)
+			sub.SetSeqId(top.SeqId)
+			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
+				sub.SetSubCnt(top.SubCnt)
+				sub.SetPublic(top.Public)
+				sub.SetTrusted(top.Trusted)
+			}
+			// Put back the updated value of a subsription, will process further below
+			join[top.Id] = sub
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch p2p users and join to p2p subscriptions.
+	if len(usrq) > 0 {
+		q = "SELECT id,updatedat,state,access,lastseen,useragent,public,trusted,status " +
+			"FROM users WHERE id IN (?)"
+		newargs := []any{usrq}
+		if !keepDeleted {
+			// Optionally skip deleted users.
+			q += " AND state!=?"
+			newargs = append(newargs, t.StateDeleted)
+		}
+
+		// Ignoring ipg: we need all users to get LastSeen and UserAgent.
+
+		q, newargs = expandQuery(q, newargs...)
+
+		ctx3, cancel3 := a.getContext()
+		if cancel3 != nil {
+			defer cancel3()
+		}
+		rows, err = a.db.Query(ctx3, q, newargs...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var usr2 t.User
+			var id int64
+			if err = rows.Scan(&id, &usr2.UpdatedAt, &usr2.State, &usr2.Access, &usr2.LastSeen, &usr2.UserAgent,
+				&usr2.Public, &usr2.Trusted, &usr2.Status); err != nil {
+				break
+			}
+
+			usr2.Id = store.EncodeUid(id).String()
+			joinOn := uid.P2PName(t.ParseUid(usr2.Id))
+			if sub, ok := join[joinOn]; ok {
+				sub.UpdatedAt = common.SelectLatestTime(sub.UpdatedAt, usr2.UpdatedAt)
+				sub.SetState(usr2.State)
+				sub.SetPublic(usr2.Public)
+				sub.SetTrusted(usr2.Trusted)
+				sub.SetDefaultAccess(usr2.Access.Auth, usr2.Access.Anon)
+				sub.SetLastSeenAndUA(usr2.LastSeen, usr2.UserAgent)
+				sub.SetStatus(usr2.Status)
+				join[joinOn] = sub
+			}
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	subs = make([]t.Subscription, 0, len(join))
+	for _, sub := range join {
+		subs = append(subs, sub)
+	}
+
+	return common.SelectEarliestUpdatedSubs(subs, opts, a.maxResults), nil
+}
+
+// UsersForTopic loads users subscribed to the given topic.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.Public,
+// the latter does not.
+func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	tcat := t.GetTopicCat(topic)
+
+	// Fetch all subscribed users. The number of users is not large
+	q := `SELECT s.createdat,s.updatedat,s.deletedat,s.userid,s.topic,s.delid,s.recvseqid,
+		s.readseqid,s.modewant,s.modegiven,u.public,u.trusted,u.lastseen,u.useragent,u.status,s.private,
+		s.archivedat,s.autounarchive,s.role,s.request
+		FROM subscriptions AS s JOIN users AS u ON s.userid=u.id
+		WHERE s.topic=?`
+	args := []any{topic}
+	if !keepDeleted {
+		// Filter out rows with users deleted
+		q += " AND u.state!=?"
+		args = append(args, t.StateDeleted)
+
+		// For p2p topics we must load all subscriptions including deleted.
+		// Otherwise it will be impossible to swipe Public values.
+		if tcat != t.TopicCatP2P {
+			// Filter out deleted subscriptions.
+			q += " AND s.deletedat IS NULL"
+		}
+	}
+
+	limit := a.maxResults
+	var oneUser t.Uid
+	if opts != nil {
+		// Ignore IfModifiedSince: loading all entries because a topic cannot have too many subscribers.
+		// Those unmodified will be stripped of Public & Private.
+
+		if !opts.User.IsZero() {
+			// For p2p topics we have to fetch both users otherwise public cannot be swapped.
+			if tcat != t.TopicCatP2P {
+				q += " AND s.userid=?"
+				args = append(args, store.DecodeUid(opts.User))
+			}
+			oneUser = opts.User
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	q += " LIMIT ?"
+	args = append(args, limit)
+	q, args = expandQuery(q, args...)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Fetch subscriptions
+	var sub t.Subscription
+	var subs []t.Subscription
+	var userId int64
+	var modeWant, modeGiven []byte
+	var lastSeen *time.Time = nil
+	var userAgent string
+	var public, trusted any
+	for rows.Next() {
+		var status *t.UserStatus
+		if err = rows.Scan(
+			&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt,
+			&userId, &sub.Topic, &sub.DelId, &sub.RecvSeqId,
+			&sub.ReadSeqId, &modeWant, &modeGiven,
+			&public, &trusted, &lastSeen, &userAgent, &status, &sub.Private,
+			&sub.ArchivedAt, &sub.AutoUnarchive, &sub.Role, &sub.Request); err != nil {
+			break
+		}
+
+		sub.User = store.EncodeUid(userId).String()
+		sub.SetPublic(public)
+		sub.SetTrusted(trusted)
+		sub.SetLastSeenAndUA(lastSeen, userAgent)
+		sub.SetStatus(status)
+		sub.ModeWant.Scan(modeWant)
+		sub.ModeGiven.Scan(modeGiven)
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	if err == nil && tcat == t.TopicCatP2P && len(subs) > 0 {
+		// Swap public, lastSeen & status values of P2P topics as expected.
+		if len(subs) == 1 {
+			// The other user is deleted, nothing we can do.
+			subs[0].SetPublic(nil)
+			subs[0].SetTrusted(nil)
+			subs[0].SetLastSeenAndUA(nil, "")
+			subs[0].SetStatus(nil)
+		} else {
+			tmp := subs[0].GetPublic()
+			subs[0].SetPublic(subs[1].GetPublic())
+			subs[1].SetPublic(tmp)
+
+			tmp = subs[0].GetTrusted()
+			subs[0].SetTrusted(subs[1].GetTrusted())
+			subs[1].SetTrusted(tmp)
+
+			lastSeen := subs[0].GetLastSeen()
+			userAgent = subs[0].GetUserAgent()
+			subs[0].SetLastSeenAndUA(subs[1].GetLastSeen(), subs[1].GetUserAgent())
+			subs[1].SetLastSeenAndUA(lastSeen, userAgent)
+
+			status := subs[0].GetStatus()
+			subs[0].SetStatus(subs[1].GetStatus())
+			subs[1].SetStatus(status)
+		}
+
+		// Remove deleted and unneeded subscriptions
+		if !keepDeleted || !oneUser.IsZero() {
+			var xsubs []t.Subscription
+			for i := range subs {
+				if (subs[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && subs[i].Uid() != oneUser) {
+					continue
+				}
+				xsubs = append(xsubs, subs[i])
+			}
+			subs = xsubs
+		}
+	}
+
+	return subs, err
+}
+
+// topicNamesForUser reads a slice of strings using provided query.
+func (a *adapter) topicNamesForUser(sqlQuery string, includeChan bool, args ...any) ([]string, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+		names = append(names, name)
+		// If the name is a group topic, also add the channel name if requested.
+		if includeChan {
+			if channel := t.GrpToChn(name); channel != "" {
+				names = append(names, channel)
+			}
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return names, err
+}
+
+// OwnTopics loads a slice of topic names where the user is the owner.
+func (a *adapter) OwnTopics(uid t.Uid) ([]string, error) {
+	return a.topicNamesForUser("SELECT name FROM topics WHERE owner=$1 AND state!=$2",
+		false, store.DecodeUid(uid), t.StateDeleted)
+}
+
+// ChannelsForUser loads a slice of topic names where the user is a channel reader and notifications (P) are enabled.
+func (a *adapter) ChannelsForUser(uid t.Uid) ([]string, error) {
+	return a.topicNamesForUser("SELECT topic FROM subscriptions WHERE userid=$1 AND topic LIKE 'chn%' "+
+		"AND instr(modewant,'P')>0 AND instr(modegiven,'P')>0 AND deletedat IS NULL",
+		false, store.DecodeUid(uid))
+}
+
+// TopicShare creates topic subscriptions and increments the topic's subcnt.
+func (a *adapter) TopicShare(topic string, shares []*t.Subscription) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	for _, sub := range shares {
+		err = createSubscription(ctx, tx, sub, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	if topic != "" {
+		if _, err = tx.Exec(ctx, "UPDATE topics SET subcnt=subcnt+$1 WHERE name=$2", len(shares), topic); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// TopicDelete deletes topic, subscriptions, messages.
+func (a *adapter) TopicDelete(topic string, isChan, hard bool) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// If the topic is a channel, must try to delete subscriptions under both grpXXX and chnXXX names.
+	args := []any{topic}
+	if isChan {
+		args = append(args, t.GrpToChn(topic))
+	}
+
+	// Topics of a deleted community become standalone.
+	if _, err = tx.Exec(ctx, "UPDATE topics SET parent='' WHERE parent=$1", topic); err != nil {
+		return err
+	}
+
+	if hard {
+		// Delete subscriptions. If this is a channel, delete both group subscriptions and channel subscriptions.
+		q, args := expandQuery("DELETE FROM subscriptions WHERE topic IN (?)", args)
+		if _, err = tx.Exec(ctx, q, args...); err != nil {
+			return err
+		}
+
+		if err = messageDeleteList(ctx, tx, topic, nil); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM topictags WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM senderkeys WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM topicnotify WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM topicpresence WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM drafts WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM invites WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM directory WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM webhooks WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM inwebhooks WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM matrixrooms WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM mailboxes WHERE topic=$1", topic); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "DELETE FROM topics WHERE name=$1", topic); err != nil {
+			return err
+		}
+	} else {
+		now := t.TimeNow()
+
+		q, args := expandQuery("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic IN (?)", now, now, args)
+		if _, err = tx.Exec(ctx, q, args...); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, "UPDATE topics SET updatedat=$1,touchedat=$1,state=$2,stateat=$1 WHERE name=$3",
+			now, t.StateDeleted, topic); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE topics SET seqid=$1,touchedat=$2 WHERE name=$3", msg.SeqId, msg.CreatedAt, topic)
+
+	return err
+}
+
+// TopicUpdateSubCnt updates subscriber count denormalized in topic.
+func (a *adapter) TopicUpdateSubCnt(topic string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"UPDATE topics SET subcnt=(SELECT COUNT(*) FROM subscriptions WHERE topic IN ($1,$2) AND deletedat IS NULL) WHERE name=$1",
+		topic, t.GrpToChn(topic))
+	return err
+}
+
+func (a *adapter) TopicUpdate(topic string, update map[string]any) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if t, u := update["TouchedAt"], update["UpdatedAt"]; t == nil && u != nil {
+		update["TouchedAt"] = u
+	}
+	cols, args := common.UpdateByMap(update)
+	q, args := expandQuery("UPDATE topics SET "+strings.Join(cols, ",")+" WHERE name=?", args, topic)
+	_, err = tx.Exec(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+
+	// Tags are also stored in a separate table
+	if tags := common.ExtractTags(update); tags != nil {
+		// First delete all user tags
+		_, err = tx.Exec(ctx, "DELETE FROM topictags WHERE topic=$1", topic)
+		if err != nil {
+			return err
+		}
+		// Now insert new tags
+		err = addTags(ctx, tx, "topictags", "topic", topic, tags, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (a *adapter) TopicOwnerChange(topic string, newOwner t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE topics SET owner=$1 WHERE name=$2", store.DecodeUid(newOwner), topic)
+	return err
+}
+
+// TopicNamesByPrefix returns names of all topics which start with the given prefix.
+func (a *adapter) TopicNamesByPrefix(prefix string) ([]string, error) {
+	if strings.ContainsAny(prefix, "%_") {
+		// Do not allow wildcards in the prefix.
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT name FROM topics WHERE name LIKE $1 ORDER BY name", prefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+		names = append(names, name)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	return names, err
+}
+
+// TopicMerge moves messages and subscriptions of topic src into topic dst, re-sequencing messages
+// of both topics chronologically, then deletes src. If rewrite is not nil, content of messages, edit
+// history, scheduled and starred messages of src is replaced with the result of rewrite.
+func (a *adapter) TopicMerge(dst, src string, rewrite func(content any) (any, bool, error)) error {
+	if dst == src {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if rewrite != nil {
+		for _, table := range []string{"messages", "msgedits", "scheduled", "starred"} {
+			if err = rewriteTopicContent(ctx, tx, table, src, rewrite); err != nil {
+				return err
+			}
+		}
+	}
+
+	type msgRef struct {
+		id       int
+		topic    string
+		seqId    int
+		delId    int
+		threadId int
+		head     t.KVMap
+	}
+
+	// Load messages of both topics in chronological order.
+	rows, err := tx.Query(ctx, "SELECT id,topic,seqid,delid,threadid,head FROM messages WHERE topic IN ($1,$2) "+
+		"ORDER BY createdat,id", dst, src)
+	if err != nil {
+		return err
+	}
+	var msgs []msgRef
+	for rows.Next() {
+		var m msgRef
+		if err = rows.Scan(&m.id, &m.topic, &m.seqId, &m.delId, &m.threadId, &m.head); err != nil {
+			break
+		}
+		msgs = append(msgs, m)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	// Old seq ID -> new seq ID for each topic.
+	newSeq := map[string]map[int]int{dst: {}, src: {}}
+	for i := range msgs {
+		newSeq[msgs[i].topic][msgs[i].seqId] = i + 1
+	}
+	// Sorted old seq IDs for each topic.
+	oldSeqs := map[string][]int{}
+	for topic, seqs := range newSeq {
+		list := make([]int, 0, len(seqs))
+		for seq := range seqs {
+			list = append(list, seq)
+		}
+		sort.Ints(list)
+		oldSeqs[topic] = list
+	}
+	// mapUpTo converts a read or recv marker: the new seq ID of the latest message at or before the old marker.
+	mapUpTo := func(topic string, marker int) int {
+		result := 0
+		for _, seq := range oldSeqs[topic] {
+			if seq > marker {
+				break
+			}
+			if n := newSeq[topic][seq]; n > result {
+				result = n
+			}
+		}
+		return result
+	}
+
+	// Load deletion log of both topics and assign new deletion IDs: first dst, then src.
+	type delKey struct {
+		topic string
+		delId int
+	}
+	type delRec struct {
+		deletedFor int64
+		seqs       []int
+	}
+	rows, err = tx.Query(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic IN ($1,$2) "+
+		"ORDER BY topic=$1 DESC,delid", dst, src)
+	if err != nil {
+		return err
+	}
+	newDelId := map[delKey]int{}
+	var dellog []*delRec
+	for rows.Next() {
+		var key delKey
+		var deletedFor int64
+		var low, hi int
+		if err = rows.Scan(&key.topic, &deletedFor, &key.delId, &low, &hi); err != nil {
+			break
+		}
+		id, ok := newDelId[key]
+		if !ok {
+			dellog = append(dellog, &delRec{deletedFor: deletedFor})
+			id = len(dellog)
+			newDelId[key] = id
+		}
+		if hi <= low {
+			hi = low + 1
+		}
+		for _, seq := range oldSeqs[key.topic] {
+			if seq >= hi {
+				break
+			}
+			if seq >= low {
+				dellog[id-1].seqs = append(dellog[id-1].seqs, newSeq[key.topic][seq])
+			}
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	// Move messages out of the way of the unique (topic,seqid) index, then assign new seq IDs.
+	if _, err = tx.Exec(ctx, "UPDATE messages SET topic=$1,seqid=-id WHERE topic IN ($1,$2)", dst, src); err != nil {
+		return err
+	}
+	for i := range msgs {
+		m := &msgs[i]
+		remapHeadSeqRefs(m.head, newSeq[m.topic])
+		delId := 0
+		if m.delId > 0 {
+			delId = newDelId[delKey{m.topic, m.delId}]
+		}
+		if _, err = tx.Exec(ctx, "UPDATE messages SET seqid=$1,delid=$2,head=$3,threadid=$4 WHERE id=$5",
+			i+1, delId, m.head, newSeq[m.topic][m.threadId], m.id); err != nil {
+			return err
+		}
+	}
+
+	// Blind index tokens are bound to the topic name, so tokens of src are not valid in dst.
+	// Tokens of dst are moved to the new seq IDs.
+	if _, err = tx.Exec(ctx, "DELETE FROM msgtokens WHERE topic=$1", src); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "UPDATE msgtokens SET seqid=-seqid WHERE topic=$1", dst); err != nil {
+		return err
+	}
+	for oldSeq, seq := range newSeq[dst] {
+		if _, err = tx.Exec(ctx, "UPDATE msgtokens SET seqid=$1 WHERE topic=$2 AND seqid=$3",
+			seq, dst, -oldSeq); err != nil {
+			return err
+		}
+	}
+
+	// Cached translations are not moved: content of src is re-encrypted with the key of dst.
+	if _, err = tx.Exec(ctx, "DELETE FROM translations WHERE topic IN ($1,$2)", dst, src); err != nil {
+		return err
+	}
+
+	// Move edit history, reactions, polls, mentions and starred messages to the new seq IDs.
+	for _, table := range []string{"msgedits", "reactions", "polls", "pollvotes", "mentions", "starred"} {
+		if _, err = tx.Exec(ctx, "UPDATE "+table+" SET seqid=-seqid WHERE topic IN ($1,$2)", dst, src); err != nil {
+			return err
+		}
+		for topic, seqs := range newSeq {
+			for oldSeq, seq := range seqs {
+				if _, err = tx.Exec(ctx, "UPDATE "+table+" SET topic=$1,seqid=$2 WHERE topic=$3 AND seqid=$4",
+					dst, seq, topic, -oldSeq); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Move per-user state of threads to the new thread roots.
+	type threadSubRef struct {
+		topic     string
+		userId    int64
+		threadId  int
+		readSeqId int
+		muted     bool
+	}
+	rows, err = tx.Query(ctx, "SELECT topic,userid,threadid,readseqid,muted FROM threadsubs WHERE topic IN ($1,$2)",
+		dst, src)
+	if err != nil {
+		return err
+	}
+	var threadSubs []threadSubRef
+	for rows.Next() {
+		var ts threadSubRef
+		if err = rows.Scan(&ts.topic, &ts.userId, &ts.threadId, &ts.readSeqId, &ts.muted); err != nil {
+			break
+		}
+		threadSubs = append(threadSubs, ts)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM threadsubs WHERE topic IN ($1,$2)", dst, src); err != nil {
+		return err
+	}
+	for _, ts := range threadSubs {
+		threadId, ok := newSeq[ts.topic][ts.threadId]
+		if !ok {
+			continue
+		}
+		if _, err = tx.Exec(ctx, "INSERT INTO threadsubs(topic,userid,threadid,readseqid,muted,updatedat) "+
+			"VALUES($1,$2,$3,$4,$5,$6)", dst, ts.userId, threadId, mapUpTo(ts.topic, ts.readSeqId), ts.muted,
+			t.TimeNow()); err != nil {
+			return err
+		}
+	}
+
+	// Move scheduled messages to dst, updating references to messages in their headers.
+	type schedRef struct {
+		id    int64
+		topic string
+		head  t.KVMap
+	}
+	rows, err = tx.Query(ctx, "SELECT id,topic,head FROM scheduled WHERE topic IN ($1,$2)", dst, src)
+	if err != nil {
+		return err
+	}
+	var scheduled []schedRef
+	for rows.Next() {
+		var sr schedRef
+		if err = rows.Scan(&sr.id, &sr.topic, &sr.head); err != nil {
+			break
+		}
+		scheduled = append(scheduled, sr)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for i := range scheduled {
+		sr := &scheduled[i]
+		remapHeadSeqRefs(sr.head, newSeq[sr.topic])
+		if _, err = tx.Exec(ctx, "UPDATE scheduled SET topic=$1,head=$2 WHERE id=$3", dst, sr.head, sr.id); err != nil {
+			return err
+		}
+	}
+
+	// Rewrite deletion log.
+	if _, err = tx.Exec(ctx, "DELETE FROM dellog WHERE topic IN ($1,$2)", dst, src); err != nil {
+		return err
+	}
+	for i, rec := range dellog {
+		sort.Ints(rec.seqs)
+		for j := 0; j < len(rec.seqs); {
+			low := rec.seqs[j]
+			hi := low + 1
+			for j++; j < len(rec.seqs) && rec.seqs[j] <= hi; j++ {
+				hi = rec.seqs[j] + 1
+			}
+			if _, err = tx.Exec(ctx, "INSERT INTO dellog(topic,deletedfor,delid,low,hi) VALUES($1,$2,$3,$4,$5)",
+				dst, rec.deletedFor, i+1, low, hi); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Reconcile subscriptions: keep one subscription per user, convert read and recv markers.
+	// Deletion IDs are reset to make clients re-fetch the log of deletions.
+	type subRef struct {
+		id        int
+		topic     string
+		recvSeqId int
+		readSeqId int
+		deleted   bool
+	}
+	rows, err = tx.Query(ctx, "SELECT id,userid,topic,recvseqid,readseqid,deletedat IS NOT NULL FROM subscriptions "+
+		"WHERE topic IN ($1,$2) ORDER BY topic=$1 DESC", dst, src)
+	if err != nil {
+		return err
+	}
+	subs := map[int64][]subRef{}
+	for rows.Next() {
+		var s subRef
+		var userId int64
+		if err = rows.Scan(&s.id, &userId, &s.topic, &s.recvSeqId, &s.readSeqId, &s.deleted); err != nil {
+			break
+		}
+		subs[userId] = append(subs[userId], s)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	now := t.TimeNow()
+	for _, list := range subs {
+		keep := list[0]
+		recv, read, deleted := 0, 0, true
+		for _, s := range list {
+			recv = max(recv, mapUpTo(s.topic, s.recvSeqId))
+			read = max(read, mapUpTo(s.topic, s.readSeqId))
+			deleted = deleted && s.deleted
+		}
+		var deletedAt *time.Time
+		if deleted {
+			deletedAt = &now
+		}
+		if _, err = tx.Exec(ctx, "UPDATE subscriptions SET topic=$1,updatedat=$2,recvseqid=$3,readseqid=$4,"+
+			"delid=0,deletedat=CASE WHEN $5 IS NULL THEN NULL ELSE COALESCE(deletedat,$5) END WHERE id=$6",
+			dst, now, recv, read, deletedAt, keep.id); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM subscriptions WHERE topic=$1", src); err != nil {
+		return err
+	}
+
+	// Messages pinned in either topic remain pinned, those of dst first.
+	var pinned []int
+	rows, err = tx.Query(ctx, "SELECT name,pinned FROM topics WHERE name IN ($1,$2) ORDER BY name=$1 DESC", dst, src)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		var list []int
+		if err = rows.Scan(&name, &list); err != nil {
+			break
+		}
+		for _, seq := range list {
+			if n, ok := newSeq[name][seq]; ok && !slices.Contains(pinned, n) {
+				pinned = append(pinned, n)
+			}
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	// Update the surviving topic and remove the merged one.
+	if _, err = tx.Exec(ctx, "UPDATE topics SET seqid=$1,delid=$2,updatedat=$3,pinned=$6,"+
+		"touchedat=(SELECT MAX(touchedat) FROM topics WHERE name IN ($4,$5)),"+
+		"subcnt=(SELECT COUNT(*) FROM subscriptions WHERE topic=$5 AND deletedat IS NULL) WHERE name=$5",
+		len(msgs), len(dellog), now, src, dst, pinned); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "UPDATE filemsglinks SET topic=$1 WHERE topic=$2", dst, src); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM topictags WHERE topic=$1", src); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM topics WHERE name=$1", src); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// rewriteTopicContent replaces content of rows of the table which belong to the topic with the result of rewrite.
+func rewriteTopicContent(ctx context.Context, tx *txn, table, topic string,
+	rewrite func(content any) (any, bool, error)) error {
+	rows, err := tx.Query(ctx, "SELECT rowid,content FROM "+table+" WHERE topic=$1 AND content IS NOT NULL", topic)
+	if err != nil {
+		return err
+	}
+
+	type update struct {
+		rowid   int64
+		content string
+	}
+	var updates []update
+	for rows.Next() {
+		var rowid int64
+		var content any
+		if err = rows.Scan(&rowid, &content); err != nil {
+			break
+		}
+		newContent, changed, rerr := rewrite(content)
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		if !changed {
+			continue
+		}
+		data, merr := json.Marshal(newContent)
+		if merr != nil {
+			err = merr
+			break
+		}
+		updates = append(updates, update{rowid: rowid, content: string(data)})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, upd := range updates {
+		if _, err = tx.Exec(ctx, "UPDATE "+table+" SET content=$1 WHERE rowid=$2", upd.content, upd.rowid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remapHeadSeqRefs rewrites references to messages of the same topic in the message header
+// using the provided map of old to new seq IDs.
+func remapHeadSeqRefs(head t.KVMap, newSeq map[int]int) {
+	if head == nil {
+		return
+	}
+	if reply, ok := head["reply"].(map[string]any); ok {
+		if seq, ok := reply["seq"].(float64); ok {
+			if n, ok := newSeq[int(seq)]; ok {
+				reply["seq"] = n
+			}
+		}
+	}
+	for _, key := range []string{"replace", "thread"} {
+		if ref, ok := head[key].(string); ok && strings.HasPrefix(ref, ":") {
+			if seq, err := strconv.Atoi(ref[1:]); err == nil {
+				if n, ok := newSeq[seq]; ok {
+					head[key] = ":" + strconv.Itoa(n)
+				}
+			}
+		}
+	}
+}
+
+// Get a subscription of a user to a topic.
+func (a *adapter) SubscriptionGet(topic string, user t.Uid, keepDeleted bool) (*t.Subscription, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private,labels,archivedat,autounarchive,role,request FROM subscriptions
+		WHERE topic=$1 AND userid=$2`
+	if !keepDeleted {
+		query += " AND deletedat IS NULL"
+	}
+	var sub t.Subscription
+	var userId int64
+	var modeWant, modeGiven []byte
+	err := a.db.QueryRow(ctx, query, topic, store.DecodeUid(user)).Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &userId,
+		&sub.Topic, &sub.DelId, &sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private, &sub.Labels,
+		&sub.ArchivedAt, &sub.AutoUnarchive, &sub.Role, &sub.Request)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return nil, err
+	}
+
+	sub.User = store.EncodeUid(userId).String()
+	sub.ModeWant.Scan(modeWant)
+	sub.ModeGiven.Scan(modeGiven)
+
+	return &sub, nil
+}
+
+// SubsForUser loads all user's subscriptions. Does NOT load Public or Private values and does
+// not load deleted subscriptions.
+func (a *adapter) SubsForUser(forUser t.Uid) ([]t.Subscription, error) {
+	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven FROM subscriptions WHERE userid=$1 AND deletedat IS NULL`
+	args := []any{store.DecodeUid(forUser)}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []t.Subscription
+	var sub t.Subscription
+	var userId int64
+	var modeWant, modeGiven []byte
+	for rows.Next() {
+		if err = rows.Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &userId, &sub.Topic, &sub.DelId,
+			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven); err != nil {
+			break
+		}
+
+		sub.User = store.EncodeUid(userId).String()
+		sub.ModeWant.Scan(modeWant)
+		sub.ModeGiven.Scan(modeGiven)
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return subs, err
+}
+
+// SubsForTopic fetches all subsciptions for a topic. Does NOT load Public value.
+// The difference between UsersForTopic vs SubsForTopic is that the former loads user.public+trusted,
+// the latter does not.
+func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private,archivedat,autounarchive,role,request FROM subscriptions WHERE topic=?`
+
+	args := []any{topic}
+	if !keepDeleted {
+		// Filter out deleted rows.
+		q += " AND deletedat IS NULL"
+	}
+	limit := a.maxResults
+	if opts != nil {
+		// Ignore IfModifiedSince - we must return all entries
+		// Those unmodified will be stripped of Public & Private.
+
+		if !opts.User.IsZero() {
+			q += " AND userid=?"
+			args = append(args, store.DecodeUid(opts.User))
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	q += " LIMIT ?"
+	args = append(args, limit)
+	q, args = expandQuery(q, args...)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []t.Subscription
+	var sub t.Subscription
+	var userId int64
+	var modeWant, modeGiven []byte
+	for rows.Next() {
+		if err = rows.Scan(&sub.CreatedAt, &sub.UpdatedAt, &sub.DeletedAt, &userId, &sub.Topic, &sub.DelId,
+			&sub.RecvSeqId, &sub.ReadSeqId, &modeWant, &modeGiven, &sub.Private,
+			&sub.ArchivedAt, &sub.AutoUnarchive, &sub.Role, &sub.Request); err != nil {
+			break
+		}
+
+		sub.User = store.EncodeUid(userId).String()
+		sub.ModeWant.Scan(modeWant)
+		sub.ModeGiven.Scan(modeGiven)
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return subs, err
+}
+
+// SubsUpdate updates one or multiple subscriptions to a topic.
+func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]any) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	cols, args := common.UpdateByMap(update)
+	q := "UPDATE subscriptions SET " + strings.Join(cols, ",") + " WHERE topic=?"
+	args = append(args, topic)
+	if !user.IsZero() {
+		// Update just one topic subscription
+		q += " AND userid=?"
+		args = append(args, store.DecodeUid(user))
+	}
+	q, args = expandQuery(q, args...)
+
+	if _, err = tx.Exec(ctx, q, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// SubsDelete marks at most one subscription as deleted.
+func (a *adapter) SubsDelete(topic string, user t.Uid) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_id := store.DecodeUid(user)
+	now := t.TimeNow()
+	res, err := tx.Exec(ctx,
+		"UPDATE subscriptions SET updatedat=$1,deletedat=$2 WHERE topic=$3 AND userid=$4 AND deletedat IS NULL",
+		now, now, topic, decoded_id)
+	if err != nil {
+		return err
+	}
+
+	affected := res.RowsAffected()
+	if affected == 0 {
+		// ensure tx.Rollback() above is ran
+		err = t.ErrNotFound
+		return err
+	}
+
+	// Channel readers cannot delete messages.
+	if !t.IsChannel(topic) {
+		// Remove records of messages soft-deleted by this user.
+		_, err = tx.Exec(ctx, "DELETE FROM dellog WHERE topic=$1 AND deletedfor=$2", topic, decoded_id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.GetTopicCat(topic) == t.TopicCatGrp {
+		// Decrement topic subscription count (only one subscription is	deleted).
+		_, err = tx.Exec(ctx, "UPDATE topics SET subcnt=subcnt-1 WHERE name=$1", topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// subsDelForUser marks user's subscriptions as deleted.
+func subsDelForUser(ctx context.Context, tx *txn, decoded_uid int64, hard bool) error {
+	// Decrement subscription count for all topics the user is subscribed to.
+	rows, err := tx.Query(ctx, "SELECT topic FROM subscriptions WHERE userid=$1 AND deletedat IS NULL", decoded_uid)
+	if err != nil {
+		return err
+	}
+	var topics []any
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			break
+		}
+		if t.IsChannel(name) {
+			// Convert channel name to group name.
+			name = t.ChnToGrp(name)
+		}
+		topics = append(topics, name)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	if len(topics) > 0 {
+		sql, args, _ := sqlx.In("UPDATE topics SET subcnt=subcnt-1 WHERE name IN (?)", topics)
+		_, err = tx.Exec(ctx, sqlx.Rebind(sqlx.DOLLAR, sql), args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if hard {
+		// Hard delete: remove all subscriptions for the user.
+		_, err = tx.Exec(ctx, "DELETE FROM subscriptions WHERE userid=$1", decoded_uid)
+	} else {
+		now := t.TimeNow()
+		_, err = tx.Exec(ctx, "UPDATE subscriptions SET updatedat=$1,deletedat=$2 WHERE userid=$3 AND deletedat IS NULL;",
+			now, now, decoded_uid)
+	}
+	return err
+}
+
+// SubsDelForUser marks user's subscriptions as deleted.
+func (a *adapter) SubsDelForUser(user t.Uid, hard bool) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if err = subsDelForUser(ctx, tx, store.DecodeUid(user), hard); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+
+}
+
+// Find returns a list of users and group topics which match the given tags, such as "email:jdoe@example.com" or "tel:+18003287448".
+func (a *adapter) Find(caller, tenant, promoPrefix string, req [][]string, opt []string, activeOnly bool) ([]t.Subscription, error) {
+	index := make(map[string]struct{})
+	var args []any
+	constraint := ""
+	allReq := t.FlattenDoubleSlice(req)
+	for _, tag := range append(allReq, opt...) {
+		args = append(args, tag)
+		index[tag] = struct{}{}
+	}
+	if len(args) == 0 {
+		// Nothing to search for.
+		return nil, nil
+	}
+	constraint += "tg.tag IN (?) "
+	constraint, args, err := sqlx.In(constraint, args)
+	if err != nil {
+		return nil, err
+	}
+	if activeOnly {
+		args = append(args, t.StateOK)
+		constraint += "AND state=? "
+	}
+	args = append(args, tenant)
+	constraint += "AND tenant=? "
+	constraint = sqlx.Rebind(sqlx.DOLLAR, constraint)
+
+	var matcher string
+	if promoPrefix != "" {
+		// The max number of tags is 16. Using 20 to make sure one prefix match is greater than all non-prefix matches.
+		matcher = "SUM(CASE WHEN instr(tg.tag, '" + promoPrefix + "')=1 THEN 20 ELSE 1 END)"
+	} else {
+		matcher = "COUNT(*)"
+	}
+
+	query := "SELECT CAST(u.id AS VARCHAR) AS topic,u.createdat,u.updatedat,FALSE,u.access,0 AS subcnt,u.public,u.trusted,u.tags," +
+		matcher + " AS matches " +
+		"FROM users AS u JOIN usertags AS tg ON tg.userid=u.id " +
+		"WHERE " + constraint +
+		"GROUP BY u.id,u.createdat,u.updatedat,u.access,u.public,u.trusted,u.tags "
+
+	having := ""
+	if len(allReq) > 0 {
+		var a []any
+		having, a = common.DisjunctionSql(req, "tg.tag")
+		having = rebindWithStart(having, len(args)+1)
+		query += having
+		args = append(args, a...)
+	}
+
+	query += "UNION ALL "
+
+	query += "SELECT t.name AS topic,t.createdat,t.updatedat,t.usebt,t.access,t.subcnt,t.public,t.trusted,t.tags," +
+		matcher + " AS matches " +
+		"FROM topics AS t JOIN topictags AS tg ON t.name=tg.topic " +
+		"WHERE " + constraint +
+		"GROUP BY t.name,t.createdat,t.updatedat,t.usebt,t.access,t.subcnt,t.public,t.trusted,t.tags "
+	if having != "" {
+		query += having
+	}
+	args = append(args, a.maxResults)
+	query += "ORDER BY matches DESC, subcnt DESC LIMIT $" + strconv.Itoa(len(args))
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Get users matched by tags, sort by number of matches from high to low.
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Fetch subscriptions
+	var public, trusted any
+	var access t.DefaultAccess
+	var subcnt int
+	var setTags t.StringSlice
+	var ignored int
+	var isChan bool
+	var sub t.Subscription
+	var subs []t.Subscription
+	for rows.Next() {
+		if err = rows.Scan(&sub.Topic, &sub.CreatedAt, &sub.UpdatedAt, &isChan, &access, &subcnt,
+			&public, &trusted, &setTags, &ignored); err != nil {
+			subs = nil
+			break
+		}
+
+		if id, err := strconv.ParseInt(sub.Topic, 10, 64); err == nil {
+			sub.Topic = store.EncodeUid(id).UserId()
+			if sub.Topic == caller {
+				// Skip the caller.
+				continue
+			}
+		}
+
+		if isChan {
+			// This is a channel, convert grp to chn name.
+			sub.Topic = t.GrpToChn(sub.Topic)
+		}
+
+		sub.SetSubCnt(subcnt)
+		sub.SetPublic(public)
+		sub.SetTrusted(trusted)
+		sub.SetDefaultAccess(access.Auth, access.Anon)
+		// Indicating that the mode is not set, not 'N'.
+		sub.ModeGiven = t.ModeUnset
+		sub.ModeWant = t.ModeUnset
+		sub.Private = common.FilterFoundTags(setTags, index)
+		subs = append(subs, sub)
+	}
+
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return subs, err
+
+}
+
+// FindOne returns topic or user of the tenant which matches the given tag.
+func (a *adapter) FindOne(tenant, tag string) (string, error) {
+	var args []any
+	query := "SELECT t.name AS topic FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic " +
+		"WHERE tt.tag=? AND t.tenant=?"
+	args = append(args, tag, tenant)
+
+	query += " UNION ALL "
+
+	query += "SELECT CAST(u.id AS VARCHAR) AS topic FROM users AS u LEFT JOIN usertags AS ut ON ut.userid=u.id " +
+		"WHERE ut.tag=? AND u.tenant=?"
+	args = append(args, tag, tenant)
+
+	// LIMIT is applied to all resultant rows.
+	query += " LIMIT 1"
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query, args = expandQuery(query, args)
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var found string
+	if rows.Next() {
+		if err = rows.Scan(&found); err != nil {
+			return "", err
+		}
+
+		// Check if the found value is a topic name or a user ID.
+		// User IDs are returned as decoded decimal strings.
+		if id, err := strconv.ParseInt(found, 10, 64); err == nil {
+			found = store.EncodeUid(id).UserId()
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return found, err
+}
+
+// Messages
+func (a *adapter) MessageSave(msg *t.Message) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	// store assignes message ID, but we don't use it. Message IDs are not used anywhere.
+	// Using a sequential ID provided by the database.
+	var id int
+	err := a.db.QueryRow(ctx,
+		`INSERT INTO messages(createdAt,updatedAt,seqid,topic,"from",head,content,threadid) VALUES($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id`,
+		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content), msg.ThreadId).Scan(&id)
+	if err == nil {
+		// Replacing ID given by store by ID given by the DB.
+		msg.SetUid(t.Uid(id))
+	}
+	return err
+}
+
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	var limit = a.maxMessageResults
+
+	args := []any{store.DecodeUid(forUser), topic}
+	seqIdConstraint := ""
+	if opts != nil {
+		seqIdConstraint = "AND m.seqid "
+		if len(opts.IdRanges) > 0 {
+			constr, newargs := common.RangesToSql(opts.IdRanges)
+			seqIdConstraint += constr
+			args = append(args, newargs...)
+		} else {
+			seqIdConstraint += "BETWEEN ? AND ?"
+			if opts.Since > 0 {
+				args = append(args, opts.Since)
+			} else {
+				args = append(args, 0)
+			}
+			if opts.Before > 0 {
+				// BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
+				args = append(args, opts.Before-1)
+			} else {
+				args = append(args, 1<<31-1)
+			}
+		}
+
+		if opts.Thread > 0 {
+			// The root and replies of the thread.
+			seqIdConstraint += " AND (m.threadid=? OR m.seqid=?)"
+			args = append(args, opts.Thread, opts.Thread)
+		}
+
+		if len(opts.SearchTokens) > 0 {
+			// Messages which have all the tokens.
+			seqIdConstraint += " AND m.seqid IN (SELECT seqid FROM msgtokens WHERE topic=? AND token IN (?)" +
+				" GROUP BY seqid HAVING COUNT(*)=?)"
+			args = append(args, topic, opts.SearchTokens, len(opts.SearchTokens))
+		} else if opts.Search != "" {
+			match, matchArgs := msgContentMatch("m.content", opts.Search)
+			seqIdConstraint += match
+			args = append(args, matchArgs...)
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query, args := expandQuery(`SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m."from",m.head,m.content,`+
+		"m.threadid FROM messages AS m LEFT JOIN dellog AS d"+
+		" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+		" WHERE m.delid=0 AND m.topic=? "+seqIdConstraint+" AND d.deletedfor IS NULL"+
+		" ORDER BY m.seqid DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := make([]t.Message, 0, limit)
+	for rows.Next() {
+		var msg t.Message
+		var from int64
+		if err = rows.Scan(&msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt, &msg.DelId, &msg.SeqId,
+			&msg.Topic, &from, &msg.Head, &msg.Content, &msg.ThreadId); err != nil {
+			break
+		}
+		msg.From = store.EncodeUid(from).String()
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return msgs, err
+}
+
+// Lowercase text of message content for search: content itself if it's a string, or 'txt' of Drafty.
+const msgContentText = `lower(COALESCE(content->>'txt',` +
+	` CASE WHEN json_type(content)='text' THEN content->>'$' END))`
+
+// msgContentMatch returns the condition which matches messages containing all words of the query and
+// its arguments. SQLite has no full-text search without an extension: words are matched as substrings.
+func msgContentMatch(column, query string) (string, []any) {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return " AND FALSE", nil
+	}
+
+	text := strings.ReplaceAll(msgContentText, "content", column)
+	var conds []string
+	var args []any
+	for _, word := range words {
+		conds = append(conds, text+` LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(word)+"%")
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+// Escapes wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// MessageSearch returns messages matching the full-text query, newest first.
+func (a *adapter) MessageSearch(forUser t.Uid, query *t.MessageSearchQuery) ([]t.Message, error) {
+	if len(query.Topics) == 0 {
+		return nil, nil
+	}
+
+	limit := a.maxMessageResults
+	if query.Limit > 0 && query.Limit < limit {
+		limit = query.Limit
+	}
+
+	var args []any
+	join := ""
+	where := ""
+	var whereArgs []any
+	if len(query.Tokens) > 0 {
+		// Messages which have all the tokens of their topic. Tokens of different topics don't collide.
+		join = " JOIN (SELECT topic,seqid FROM msgtokens WHERE topic IN (?) AND token IN (?)" +
+			" GROUP BY topic,seqid HAVING COUNT(*)=?) AS mt ON mt.topic=m.topic AND mt.seqid=m.seqid"
+		args = append(args, query.Topics, query.Tokens, query.TokenCount)
+	} else {
+		where, whereArgs = msgContentMatch("m.content", query.Query)
+	}
+
+	args = append(args, store.DecodeUid(forUser), query.Topics)
+	args = append(args, whereArgs...)
+	if query.Before != nil {
+		where += " AND m.createdat<?"
+		args = append(args, *query.Before)
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	sql, args := expandQuery(`SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m."from",m.head,m.content`+
+		" FROM messages AS m"+join+" LEFT JOIN dellog AS d"+
+		" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+		" WHERE m.delid=0 AND m.topic IN (?)"+where+" AND d.deletedfor IS NULL"+
+		" ORDER BY m.createdat DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		var from int64
+		if err = rows.Scan(&msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt, &msg.DelId, &msg.SeqId,
+			&msg.Topic, &from, &msg.Head, &msg.Content); err != nil {
+			break
+		}
+		msg.From = store.EncodeUid(from).String()
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return msgs, err
+}
+
+// MessageGetBySeqId retrieves a single message by topic and sequence ID.
+func (a *adapter) MessageGetBySeqId(topic string, seqId int) (*t.Message, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var msg t.Message
+	var from int64
+	err := a.db.QueryRow(ctx,
+		`SELECT topic, seqid, createdat, updatedat, deletedat, delid, "from", head, content 
+		 FROM messages WHERE topic=$1 AND seqid=$2 AND delid=0`,
+		topic, seqId).Scan(
+		&msg.Topic, &msg.SeqId, &msg.CreatedAt, &msg.UpdatedAt, &msg.DeletedAt,
+		&msg.DelId, &from, &msg.Head, &msg.Content)
+	if err == nil {
+		msg.From = store.EncodeUid(from).UserId()
+	}
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+// MessageEdit updates a message's content and marks it as edited.
+func (a *adapter) MessageEdit(topic string, seqId int, content any, editedAt time.Time, editCount int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Start a transaction
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Get current head and content
+	var head t.KVMap
+	var createdAt time.Time
+	var oldContent []byte
+	err = tx.QueryRow(ctx, `SELECT createdat,head,content FROM messages WHERE topic=$1 AND seqid=$2 AND delid=0`,
+		topic, seqId).Scan(&createdAt, &head, &oldContent)
+	if err != nil {
+		return err
+	}
+
+	if head == nil {
+		head = make(t.KVMap)
+	}
+
+	// Save the current content to edit history. It was written either when the message was
+	// created or when it was last edited.
+	if prevEdit, ok := head["edited_at"].(string); ok {
+		if ts, err := time.Parse(time.RFC3339, prevEdit); err == nil {
+			createdAt = ts
+		}
+	}
+	if _, err = tx.Exec(ctx,
+		`INSERT INTO msgedits(topic,seqid,version,createdat,replacedat,content) VALUES($1,$2,$3,$4,$5,$6)
+			ON CONFLICT (topic,seqid,version) DO NOTHING`,
+		topic, seqId, editCount-1, createdAt, editedAt, oldContent); err != nil {
+		return err
+	}
+
+	// Update head with edit metadata
+	head["edited"] = true
+	head["edited_at"] = editedAt.Format(time.RFC3339)
+	head["edit_count"] = editCount
+
+	// Serialize content
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	// Update message
+	_, err = tx.Exec(ctx,
+		`UPDATE messages SET content=$1, head=$2, updatedat=$3 WHERE topic=$4 AND seqid=$5`,
+		string(contentJSON), head, t.TimeNow(), topic, seqId)
+	if err != nil {
+		return err
+	}
+
+	// Translations of the previous content are stale.
+	if _, err = tx.Exec(ctx, `DELETE FROM translations WHERE topic=$1 AND seqid=$2`, topic, seqId); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// MessageGetEdits returns previous versions of edited messages, newest first.
+func (a *adapter) MessageGetEdits(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.MessageVersion, error) {
+	var limit = a.maxMessageResults
+
+	args := []any{store.DecodeUid(forUser), topic}
+	seqIdConstraint := ""
+	if opts != nil {
+		seqIdConstraint = "AND e.seqid "
+		if len(opts.IdRanges) > 0 {
+			constr, newargs := common.RangesToSql(opts.IdRanges)
+			seqIdConstraint += constr
+			args = append(args, newargs...)
+		} else {
+			seqIdConstraint += "BETWEEN ? AND ?"
+			if opts.Since > 0 {
+				args = append(args, opts.Since)
+			} else {
+				args = append(args, 0)
+			}
+			if opts.Before > 0 {
+				// BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
+				args = append(args, opts.Before-1)
+			} else {
+				args = append(args, 1<<31-1)
+			}
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Versions of messages which are not deleted for the user.
+	query, args := expandQuery("SELECT e.seqid,e.version,e.createdat,e.replacedat,e.content,m.head"+
+		" FROM msgedits AS e JOIN messages AS m ON m.topic=e.topic AND m.seqid=e.seqid LEFT JOIN dellog AS d"+
+		" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+		" WHERE m.delid=0 AND e.topic=? "+seqIdConstraint+" AND d.deletedfor IS NULL"+
+		" ORDER BY e.seqid DESC,e.version DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []t.MessageVersion
+	for rows.Next() {
+		ver := t.MessageVersion{Topic: topic}
+		if err = rows.Scan(&ver.SeqId, &ver.Version, &ver.CreatedAt, &ver.ReplacedAt, &ver.Content, &ver.Head); err != nil {
+			break
+		}
+		versions = append(versions, ver)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return versions, err
+}
+
+// MessageMarkUnsent marks a message as unsent (tombstone).
+func (a *adapter) MessageMarkUnsent(topic string, seqId int, unsentAt time.Time) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Start a transaction
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Get current head
+	var head t.KVMap
+	err = tx.QueryRow(ctx, `SELECT head FROM messages WHERE topic=$1 AND seqid=$2 AND delid=0`, topic, seqId).Scan(&head)
+	if err != nil {
+		return err
+	}
+
+	if head == nil {
+		head = make(t.KVMap)
+	}
+
+	// Mark as unsent in head
+	head["unsent"] = true
+	head["unsent_at"] = unsentAt.Format(time.RFC3339)
+
+	// Clear content and update head
+	_, err = tx.Exec(ctx,
+		`UPDATE messages SET content=NULL, head=$1, updatedat=$2 WHERE topic=$3 AND seqid=$4`,
+		head, t.TimeNow(), topic, seqId)
+	if err != nil {
+		return err
+	}
+
+	// Previous versions are unsent too.
+	if _, err = tx.Exec(ctx, `DELETE FROM msgedits WHERE topic=$1 AND seqid=$2`, topic, seqId); err != nil {
+		return err
+	}
+
+	// Reactions to unsent messages are removed.
+	if _, err = tx.Exec(ctx, `DELETE FROM reactions WHERE topic=$1 AND seqid=$2`, topic, seqId); err != nil {
+		return err
+	}
+
+	// So are polls and translations.
+	for _, table := range []string{"pollvotes", "polls", "translations"} {
+		if _, err = tx.Exec(ctx, "DELETE FROM "+table+" WHERE topic=$1 AND seqid=$2", topic, seqId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// MessageRewriteContent reads content of up to limit messages with ID greater than afterId in
+// ascending order of ID, and replaces it with the value returned by rewrite if it reports a change.
+// If topic is not empty, only messages of the topic are read.
+// Returns ID of the last message read (0 if none), and the number of messages updated.
+func (a *adapter) MessageRewriteContent(topic string, afterId int64, limit int,
+	rewrite func(topic string, content any) (any, bool, error)) (int64, int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	query := "SELECT id, topic, content FROM messages WHERE id>$1 AND content IS NOT NULL"
+	args := []any{afterId, limit}
+	if topic != "" {
+		query += " AND topic=$3"
+		args = append(args, topic)
+	}
+	rows, err := tx.Query(ctx, query+" ORDER BY id LIMIT $2", args...)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	type update struct {
+		id      int64
+		content string
+	}
+	var updates []update
+	var lastId int64
+	for rows.Next() {
+		var msgTopic string
+		var content any
+		if err = rows.Scan(&lastId, &msgTopic, &content); err != nil {
+			break
+		}
+		newContent, changed, rerr := rewrite(msgTopic, content)
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		if !changed {
+			continue
+		}
+		data, merr := json.Marshal(newContent)
+		if merr != nil {
+			err = merr
+			break
+		}
+		updates = append(updates, update{id: lastId, content: string(data)})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, upd := range updates {
+		if _, err = tx.Exec(ctx, "UPDATE messages SET content=$1 WHERE id=$2", upd.content, upd.id); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, 0, err
+	}
+	return lastId, len(updates), nil
+}
+
+// Get ranges of deleted messages
+func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.DelMessage, error) {
+	var limit = a.maxResults
+	var lower = 0
+	var upper = 1<<31 - 1
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 1 {
+			// DelRange is inclusive-exclusive, while BETWEEN is inclusive-inclisive.
+			upper = opts.Before - 1
+		}
+
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+
+	// Fetch log of deletions
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=$1 AND delid BETWEEN $2 AND $3"+
+		" AND (deletedFor=0 OR deletedFor=$4) ORDER BY delid LIMIT $5",
+		topic, lower, upper, store.DecodeUid(forUser), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dellog struct {
+		Topic      string
+		Deletedfor int64
+		Delid      int
+		Low        int
+		Hi         int
+	}
+	var dmsgs []t.DelMessage
+	var dmsg t.DelMessage
+	for rows.Next() {
+		if err = rows.Scan(&dellog.Topic, &dellog.Deletedfor, &dellog.Delid, &dellog.Low, &dellog.Hi); err != nil {
+			dmsgs = nil
+			break
+		}
+
+		if dellog.Delid != dmsg.DelId {
+			if dmsg.DelId > 0 {
+				dmsgs = append(dmsgs, dmsg)
+			}
+			dmsg.DelId = dellog.Delid
+			dmsg.Topic = dellog.Topic
+			if dellog.Deletedfor > 0 {
+				dmsg.DeletedFor = store.EncodeUid(dellog.Deletedfor).String()
+			} else {
+				dmsg.DeletedFor = ""
+			}
+			dmsg.SeqIdRanges = nil
+		}
+		if dellog.Hi <= dellog.Low+1 {
+			dellog.Hi = 0
+		}
+		dmsg.SeqIdRanges = append(dmsg.SeqIdRanges, t.Range{Low: dellog.Low, Hi: dellog.Hi})
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	if err == nil {
+		if dmsg.DelId > 0 {
+			dmsgs = append(dmsgs, dmsg)
+		}
+	}
+
+	return dmsgs, err
+}
+
+func messageDeleteList(ctx context.Context, tx *txn, topic string, toDel *t.DelMessage) error {
+	var err error
+
+	if toDel == nil {
+		// Whole topic is being deleted, thus also deleting all messages.
+		_, err = tx.Exec(ctx, "DELETE FROM dellog WHERE topic=$1", topic)
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM msgtokens WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM msgedits WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM reactions WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM pollvotes WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM polls WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM translations WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM threadsubs WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM mentions WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM scheduled WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM calls WHERE topic=$1", topic)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, "DELETE FROM messages WHERE topic=$1", topic)
+		}
+		// filemsglinks will be deleted because of ON DELETE CASCADE
+		return err
+	}
+
+	// Only some messages are being deleted
+
+	delRanges := toDel.SeqIdRanges
+
+	if toDel.DeletedFor == "" {
+		// Hard-deleting messages requires updates to the messages table.
+		where := "m.topic=? "
+		args := []any{topic}
+
+		if len(delRanges) > 0 {
+			rSql, rArgs := common.RangesToSql(delRanges)
+			where += " AND m.seqid " + rSql
+			args = append(args, rArgs...)
+		}
+
+		where += " AND m.deletedat IS NULL"
+
+		// We are asked to delete messages no older than newerThan.
+		if newerThan := toDel.GetNewerThan(); newerThan != nil {
+			where += " AND m.createdat>?"
+			args = append(args, newerThan)
+		}
+
+		// Find the actual IDs still present in the database.
+		var seqIDs []int
+		query, newargs := expandQuery("SELECT seqid FROM messages AS m WHERE "+where, args)
+		rows, err := tx.Query(ctx, query, newargs...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var seqID int
+			if err := rows.Scan(&seqID); err != nil {
+				return err
+			}
+			seqIDs = append(seqIDs, seqID)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		if len(seqIDs) == 0 {
+			// Nothing to delete. No need to make a log entry. All done.
+			return nil
+		}
+
+		// Recalculate the actual ranges to delete.
+		sort.Ints(seqIDs)
+		delRanges = t.SliceToRanges(seqIDs)
+
+		// Compose a new query with the new ranges.
+		where = "m.topic=?"
+		args = []any{topic}
+		rSql, rArgs := common.RangesToSql(delRanges)
+		where += " AND m.seqid " + rSql
+		args = append(args, rArgs...)
+
+		// No need to add anything else: deletedat etc is already accounted for.
+
+		query, newargs = expandQuery("DELETE FROM filemsglinks WHERE msgid IN (SELECT m.id FROM messages AS m WHERE "+
+			where+")", args...)
+		_, err = tx.Exec(ctx, query, newargs...)
+		if err != nil {
+			return err
+		}
+
+		// Deleted messages must not be found by search.
+		query, newargs = expandQuery("DELETE FROM msgtokens AS m WHERE "+where, args...)
+		_, err = tx.Exec(ctx, query, newargs...)
+		if err != nil {
+			return err
+		}
+
+		// Edit history is deleted with the message.
+		query, newargs = expandQuery("DELETE FROM msgedits AS m WHERE "+where, args...)
+		_, err = tx.Exec(ctx, query, newargs...)
+		if err != nil {
+			return err
+		}
+
+		// So are reactions, polls, translations and mentions.
+		for _, table := range []string{"reactions", "pollvotes", "polls", "translations", "mentions"} {
+			query, newargs = expandQuery("DELETE FROM "+table+" AS m WHERE "+where, args...)
+			_, err = tx.Exec(ctx, query, newargs...)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Soft delete: mark as deleted but retain content for server-side retention
+		query, newargs = expandQuery(`UPDATE messages AS m SET deletedat=?,delid=? WHERE `+
+			where, t.TimeNow(), toDel.DelId, args)
+		_, err = tx.Exec(ctx, query, newargs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Now make log entries. Needed for both hard- and soft-deleting.
+
+	// Prepare statement is not needed because the driver prepares the statement on first use then caches it.
+	forUser := common.DecodeUidString(toDel.DeletedFor)
+	for _, rng := range toDel.SeqIdRanges {
+		if rng.Hi == 0 {
+			// Dellog must contain valid Low and *Hi*.
+			rng.Hi = rng.Low + 1
+		}
+
+		if _, err = tx.Exec(ctx, "INSERT INTO dellog(topic,deletedfor,delid,low,hi) VALUES($1,$2,$3,$4,$5)",
+			topic, forUser, toDel.DelId, rng.Low, rng.Hi); err != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+// MessageSetSearchTokens replaces blind index tokens of the message.
+func (a *adapter) MessageSetSearchTokens(topic string, seqId int, tokens []string) (err error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, "DELETE FROM msgtokens WHERE topic=$1 AND seqid=$2", topic, seqId); err != nil {
+		return err
+	}
+
+	if len(tokens) > 0 {
+		if _, err = tx.Exec(ctx,
+			"INSERT INTO msgtokens(topic,seqid,token) SELECT $1,$2,value FROM json_each($3) WHERE TRUE ON CONFLICT DO NOTHING",
+			topic, seqId, tokens); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// MessageDeleteList deletes messages in the given topic with seqIds from the list.
+// MessageGetExpired finds up to limit topics with messages older than the time to live of the topic.
+func (a *adapter) MessageGetExpired(now time.Time, limit int) (map[string]int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT m.topic,MAX(m.seqid) FROM messages AS m JOIN topics AS t ON t.name=m.topic "+
+		"WHERE t.msgttl>0 AND t.state<>$1 AND m.deletedat IS NULL AND m.createdat<strftime('%Y-%m-%d %H:%M:%f',$2,-t.msgttl||' seconds') "+
+		"GROUP BY m.topic LIMIT $3", t.StateDeleted, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expired := make(map[string]int)
+	for rows.Next() {
+		var topic string
+		var seqId int
+		if err = rows.Scan(&topic, &seqId); err != nil {
+			return nil, err
+		}
+		expired[topic] = seqId
+	}
+	return expired, rows.Err()
+}
+
+// retentionCatCondition returns the condition on topics t of the retention category, empty if the category
+// is unknown.
+func retentionCatCondition(cat string) string {
+	switch cat {
+	case t.RetentionP2P:
+		return "t.name LIKE 'p2p%'"
+	case t.RetentionGrp:
+		return "t.name LIKE 'grp%' AND NOT COALESCE(t.usebt,FALSE)"
+	case t.RetentionChn:
+		return "t.name LIKE 'grp%' AND COALESCE(t.usebt,FALSE)"
+	}
+	return ""
+}
+
+// MessageGetOlder finds up to limit topics of the retention category with messages created before the given time.
+func (a *adapter) MessageGetOlder(cat string, tenants []string, exclude bool, before time.Time, anonymized bool, limit int) ([]t.RetentionBatch, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	where := retentionCatCondition(cat)
+	if where == "" {
+		return nil, t.ErrMalformed
+	}
+	if !anonymized {
+		where += ` AND m."from"<>0`
+	}
+	args := []any{t.StateDeleted, before, limit}
+	if len(tenants) > 0 {
+		if exclude {
+			where += " AND t.tenant NOT IN (SELECT value FROM json_each($4))"
+		} else {
+			where += " AND t.tenant IN (SELECT value FROM json_each($4))"
+		}
+		args = append(args, toJSON(tenants))
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT m.topic,MAX(m.seqid),COUNT(*) FROM messages AS m JOIN topics AS t ON t.name=m.topic "+
+		"WHERE "+where+" AND t.state<>$1 AND m.deletedat IS NULL AND m.createdat<$2 GROUP BY m.topic LIMIT $3",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var older []t.RetentionBatch
+	for rows.Next() {
+		var batch t.RetentionBatch
+		if err = rows.Scan(&batch.Topic, &batch.SeqId, &batch.Count); err != nil {
+			return nil, err
+		}
+		older = append(older, batch)
+	}
+	return older, rows.Err()
+}
+
+// MessageAnonymize removes the sender and headers other than mime from messages with IDs up to upto.
+func (a *adapter) MessageAnonymize(topic string, upto, limit int) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	res, err := a.db.Exec(ctx, `UPDATE messages SET "from"=0,updatedat=$1,`+
+		"head=CASE WHEN head->>'mime' IS NULL THEN NULL ELSE json_object('mime',head->>'mime') END "+
+		`WHERE id IN (SELECT id FROM messages WHERE topic=$2 AND seqid<=$3 AND "from"<>0 AND deletedat IS NULL LIMIT $4)`,
+		t.TimeNow(), topic, upto, limit)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
+
+// Condition on messages m which can be moved to cold storage: not deleted and without attachments.
+const msgColdCondition = "m.delid=0 AND m.deletedat IS NULL AND m.createdat<$1 " +
+	"AND NOT EXISTS (SELECT 1 FROM filemsglinks AS f WHERE f.msgid=m.id)"
+
+// MessageGetColdTopics finds up to limit topics with messages which can be moved to cold storage.
+func (a *adapter) MessageGetColdTopics(before time.Time, skipCats []string, limit int) ([]string, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	// Messages are deleted by the reapers only while they are in the database.
+	where := "t.msgttl=0"
+	for _, cat := range skipCats {
+		cond := retentionCatCondition(cat)
+		if cond == "" {
+			return nil, t.ErrMalformed
+		}
+		where += " AND NOT (" + cond + ")"
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT DISTINCT m.topic FROM messages AS m JOIN topics AS t ON t.name=m.topic "+
+		"WHERE "+msgColdCondition+" AND t.state<>$2 AND "+where+" LIMIT $3", before, t.StateDeleted, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []string
+	for rows.Next() {
+		var topic string
+		if err = rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+// MessageGetCold returns up to limit oldest messages of the topic which can be moved to cold storage.
+func (a *adapter) MessageGetCold(topic string, before time.Time, limit int) ([]t.Message, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, `SELECT m.createdat,m.updatedat,m.seqid,m.topic,m."from",m.head,m.content,m.threadid `+
+		"FROM messages AS m WHERE "+msgColdCondition+" AND m.topic=$2 ORDER BY m.seqid LIMIT $3", before, topic, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		var from int64
+		if err = rows.Scan(&msg.CreatedAt, &msg.UpdatedAt, &msg.SeqId, &msg.Topic, &from, &msg.Head, &msg.Content,
+			&msg.ThreadId); err != nil {
+			return nil, err
+		}
+		msg.From = store.EncodeUid(from).String()
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+// MessageTierCreate records the range of messages moved to cold storage and deletes the moved messages.
+func (a *adapter) MessageTierCreate(tier *t.MessageTier, seqIds []int, readAt time.Time) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, "INSERT INTO msgtiers(topic,low,hi,msgcount,blobkey,createdat) VALUES($1,$2,$3,$4,$5,$6)",
+		tier.Topic, tier.Low, tier.Hi, tier.Count, tier.Key, tier.CreatedAt); err != nil {
+		return err
+	}
+	res, err := tx.Exec(ctx, "DELETE FROM messages WHERE topic=$1 AND seqid IN (SELECT value FROM json_each($2)) AND delid=0 AND updatedat<$3",
+		tier.Topic, seqIds, readAt)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() != int64(len(seqIds)) {
+		// Some messages were edited or deleted after they were read.
+		return t.ErrFailed
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM msgtokens WHERE topic=$1 AND seqid IN (SELECT value FROM json_each($2))", tier.Topic, seqIds); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// MessageGetTiers returns ranges of messages in cold storage overlapping [low, hi) and deleted ranges
+// of messages overlapping the same IDs.
+func (a *adapter) MessageGetTiers(topic string, forUser t.Uid, low, hi int) ([]t.MessageTier, []t.Range, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT topic,low,hi,msgcount,blobkey,createdat FROM msgtiers "+
+		"WHERE topic=$1 AND low<$3 AND hi>$2 ORDER BY low DESC", topic, low, hi)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var tiers []t.MessageTier
+	for rows.Next() {
+		var tier t.MessageTier
+		if err = rows.Scan(&tier.Topic, &tier.Low, &tier.Hi, &tier.Count, &tier.Key, &tier.CreatedAt); err != nil {
+			return nil, nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+	if err = rows.Err(); err != nil || len(tiers) == 0 {
+		return nil, nil, err
+	}
+
+	// Deleted messages in the span of the tiers.
+	top := 0
+	for _, tier := range tiers {
+		top = max(top, tier.Hi)
+	}
+	low, hi = max(low, tiers[len(tiers)-1].Low), min(hi, top)
+	rows, err = a.db.Query(ctx, "SELECT low,hi FROM dellog WHERE topic=$1 AND (deletedfor=0 OR deletedfor=$2) "+
+		"AND low<$4 AND hi>$3", topic, store.DecodeUid(forUser), low, hi)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var deleted []t.Range
+	for rows.Next() {
+		var r t.Range
+		if err = rows.Scan(&r.Low, &r.Hi); err != nil {
+			return nil, nil, err
+		}
+		deleted = append(deleted, r)
+	}
+	return tiers, deleted, rows.Err()
+}
+
+// MessageTierGetOrphaned returns up to limit ranges of messages in cold storage of deleted topics.
+func (a *adapter) MessageTierGetOrphaned(limit int) ([]t.MessageTier, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT m.topic,m.low,m.hi,m.msgcount,m.blobkey,m.createdat FROM msgtiers AS m "+
+		"LEFT JOIN topics AS t ON t.name=m.topic WHERE t.name IS NULL LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tiers []t.MessageTier
+	for rows.Next() {
+		var tier t.MessageTier
+		if err = rows.Scan(&tier.Topic, &tier.Low, &tier.Hi, &tier.Count, &tier.Key, &tier.CreatedAt); err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, rows.Err()
+}
+
+// MessageTierDelete deletes the record of the range of messages in cold storage.
+func (a *adapter) MessageTierDelete(topic string, low int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.Exec(ctx, "DELETE FROM msgtiers WHERE topic=$1 AND low=$2", topic, low)
+	return err
+}
+
+// MessageTierGetTopics returns topics with messages in cold storage which the user is or was subscribed to.
+func (a *adapter) MessageTierGetTopics(uid t.Uid) ([]string, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	rows, err := a.db.Query(ctx, "SELECT DISTINCT m.topic FROM msgtiers AS m JOIN subscriptions AS s ON s.topic=m.topic "+
+		"WHERE s.userid=$1", store.DecodeUid(uid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var topics []string
+	for rows.Next() {
+		var topic string
+		if err = rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	return topics, rows.Err()
+}
+
+// MessageTierUpdate replaces the blob of the range of messages in cold storage.
+func (a *adapter) MessageTierUpdate(topic string, low int, key string, count int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.Exec(ctx, "UPDATE msgtiers SET blobkey=$1,msgcount=$2 WHERE topic=$3 AND low=$4", key, count, topic, low)
+	return err
+}
+
+// MessageGetAllBySender returns messages sent by the user in all topics ordered by ID.
+func (a *adapter) MessageGetAllBySender(from t.Uid, afterId int64, limit int) ([]t.Message, int64, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	if limit <= 0 || limit > a.maxMessageResults {
+		limit = a.maxMessageResults
+	}
+	rows, err := a.db.Query(ctx,
+		`SELECT id,createdat,updatedat,seqid,topic,head,content FROM messages WHERE "from"=$1 AND id>$2 AND delid=0 `+
+			"ORDER BY id LIMIT $3", store.DecodeUid(from), afterId, limit)
+	if err != nil {
+		return nil, afterId, err
+	}
+	defer rows.Close()
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.Scan(&afterId, &msg.CreatedAt, &msg.UpdatedAt, &msg.SeqId, &msg.Topic,
+			&msg.Head, &msg.Content); err != nil {
+			return nil, afterId, err
+		}
+		msg.From = from.String()
+		msgs = append(msgs, msg)
+	}
+	return msgs, afterId, rows.Err()
+}
+
+func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if err = messageDeleteList(ctx, tx, topic, toDel); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ThreadGetAll returns summaries of threads in the topic, the most recently updated first.
+func (a *adapter) ThreadGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Thread, error) {
+	limit := a.maxMessageResults
+	user := store.DecodeUid(forUser)
+	args := []any{user, user, topic}
+	constraint := ""
+	if opts != nil {
+		if len(opts.IdRanges) > 0 {
+			constr, newargs := common.RangesToSql(opts.IdRanges)
+			constraint = " AND m.threadid " + constr
+			args = append(args, newargs...)
+		} else {
+			if opts.Since > 0 {
+				constraint += " AND m.threadid>=?"
+				args = append(args, opts.Since)
+			}
+			if opts.Before > 0 {
+				constraint += " AND m.threadid<?"
+				args = append(args, opts.Before)
+			}
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query, args := expandQuery("SELECT m.threadid,COUNT(*),MAX(m.seqid),MAX(m.createdat),COALESCE(MAX(s.readseqid),0),"+
+		`COUNT(*) FILTER (WHERE m.seqid>COALESCE(s.readseqid,0) AND m."from"<>?),COALESCE(MAX(s.muted),FALSE)`+
+		" FROM messages AS m LEFT JOIN threadsubs AS s"+
+		" ON s.topic=m.topic AND s.threadid=m.threadid AND s.userid=?"+
+		" WHERE m.topic=? AND m.threadid>0 AND m.delid=0 AND m.deletedat IS NULL"+constraint+
+		" GROUP BY m.threadid ORDER BY MAX(m.seqid) DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threads []t.Thread
+	for rows.Next() {
+		var th t.Thread
+		if err = rows.Scan(&th.SeqId, &th.Count, &th.LastSeqId, &th.TouchedAt, &th.ReadSeqId,
+			&th.Unread, &th.Muted); err != nil {
+			return nil, err
+		}
+		threads = append(threads, th)
+	}
+	return threads, rows.Err()
+}
+
+// ThreadSetRead advances user's read marker in the thread.
+func (a *adapter) ThreadSetRead(topic string, user t.Uid, threadId, readSeqId int) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO threadsubs(topic,userid,threadid,readseqid,updatedat) VALUES($1,$2,$3,$4,$5) "+
+			"ON CONFLICT(topic,userid,threadid) DO UPDATE SET "+
+			"readseqid=MAX(threadsubs.readseqid,EXCLUDED.readseqid),updatedat=EXCLUDED.updatedat",
+		topic, store.DecodeUid(user), threadId, readSeqId, t.TimeNow())
+	return err
+}
+
+// ThreadSetMuted mutes or unmutes notifications of the thread for the user.
+func (a *adapter) ThreadSetMuted(topic string, user t.Uid, threadId int, muted bool) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO threadsubs(topic,userid,threadid,muted,updatedat) VALUES($1,$2,$3,$4,$5) "+
+			"ON CONFLICT(topic,userid,threadid) DO UPDATE SET muted=EXCLUDED.muted,updatedat=EXCLUDED.updatedat",
+		topic, store.DecodeUid(user), threadId, muted, t.TimeNow())
+	return err
+}
+
+// ThreadGetMuted returns users who muted the thread.
+func (a *adapter) ThreadGetMuted(topic string, threadId int) ([]t.Uid, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT userid FROM threadsubs WHERE topic=$1 AND threadid=$2 AND muted",
+		topic, threadId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []t.Uid
+	for rows.Next() {
+		var userId int64
+		if err = rows.Scan(&userId); err != nil {
+			return nil, err
+		}
+		uids = append(uids, store.EncodeUid(userId))
+	}
+	return uids, rows.Err()
+}
+
+// ScheduledAdd saves a message to be published later.
+func (a *adapter) ScheduledAdd(msg *t.ScheduledMessage, fids []string) error {
+	var fileIds []int64
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return t.ErrMalformed
+		}
+		fileIds = append(fileIds, store.DecodeUid(id))
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		`INSERT INTO scheduled(id,createdat,updatedat,sendat,topic,"from",head,content,attachments,fileids) `+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)",
+		store.DecodeUid(msg.Uid()), msg.CreatedAt, msg.UpdatedAt, msg.SendAt, msg.Topic,
+		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content),
+		toJSON(msg.Attachments), fileIds)
+	return err
+}
+
+func scheduledScan(rows *rows) ([]t.ScheduledMessage, error) {
+	var msgs []t.ScheduledMessage
+	var err error
+	for rows.Next() {
+		var msg t.ScheduledMessage
+		var id, from int64
+		if err = rows.Scan(&id, &msg.CreatedAt, &msg.UpdatedAt, &msg.SendAt, &msg.Topic, &from,
+			&msg.Head, &msg.Content, &msg.Attachments); err != nil {
+			break
+		}
+		msg.SetUid(store.EncodeUid(id))
+		msg.From = store.EncodeUid(from).String()
+		msgs = append(msgs, msg)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	return msgs, err
+}
+
+// ScheduledGetDue returns messages due at or before the given time, the earliest first.
+func (a *adapter) ScheduledGetDue(before time.Time, limit int) ([]t.ScheduledMessage, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		`SELECT id,createdat,updatedat,sendat,topic,"from",head,content,attachments FROM scheduled `+
+			"WHERE sendat<=$1 ORDER BY sendat LIMIT $2", before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scheduledScan(rows)
+}
+
+// ScheduledGetAll returns pending messages of the user in the topic, the earliest first.
+func (a *adapter) ScheduledGetAll(topic string, user t.Uid) ([]t.ScheduledMessage, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		`SELECT id,createdat,updatedat,sendat,topic,"from",head,content,attachments FROM scheduled `+
+			`WHERE topic=$1 AND "from"=$2 ORDER BY sendat LIMIT $3`, topic, store.DecodeUid(user), a.maxResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scheduledScan(rows)
+}
+
+// ScheduledDelete deletes a pending message. Deleting the message is also how a node claims it for
+// delivery: only one node succeeds.
+func (a *adapter) ScheduledDelete(topic string, user, id t.Uid) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query := "DELETE FROM scheduled WHERE id=$1 AND topic=$2"
+	args := []any{store.DecodeUid(id), topic}
+	if !user.IsZero() {
+		query += ` AND "from"=$3`
+		args = append(args, store.DecodeUid(user))
+	}
+	res, err := a.db.Exec(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// SessionUpsert creates or replaces a record of the user's session.
+func (a *adapter) SessionUpsert(sess *t.SessionRecord) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO usersessions(id,userid,createdat,lastseen,remoteaddr,useragent,platform,deviceid,resume) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT(id) DO UPDATE SET lastseen=EXCLUDED.lastseen,"+
+			"remoteaddr=EXCLUDED.remoteaddr,useragent=EXCLUDED.useragent,platform=EXCLUDED.platform,"+
+			"deviceid=EXCLUDED.deviceid,resume=EXCLUDED.resume",
+		sess.Id, store.DecodeUid(t.ParseUid(sess.User)), sess.CreatedAt, sess.LastSeen, sess.RemoteAddr,
+		sess.UserAgent, sess.Platform, sess.DeviceId, sess.Resume)
+	return err
+}
+
+// SessionTouch updates the time when the session was last active.
+func (a *adapter) SessionTouch(id string, lastSeen time.Time) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE usersessions SET lastseen=$1 WHERE id=$2", lastSeen, id)
+	return err
+}
+
+// SessionGetAll returns records of the user's sessions, the most recently active first.
+func (a *adapter) SessionGetAll(user t.Uid) ([]t.SessionRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT id,createdat,lastseen,remoteaddr,useragent,platform,deviceid,resume FROM usersessions "+
+			"WHERE userid=$1 ORDER BY lastseen DESC LIMIT $2", store.DecodeUid(user), a.maxResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []t.SessionRecord
+	for rows.Next() {
+		sess := t.SessionRecord{User: user.String()}
+		if err = rows.Scan(&sess.Id, &sess.CreatedAt, &sess.LastSeen, &sess.RemoteAddr, &sess.UserAgent,
+			&sess.Platform, &sess.DeviceId, &sess.Resume); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// SessionDelete deletes a record of the user's session.
+func (a *adapter) SessionDelete(user t.Uid, id string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM usersessions WHERE id=$1 AND userid=$2", id, store.DecodeUid(user))
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// CallCreate creates a record of a group call.
+func (a *adapter) CallCreate(call *t.CallRecord) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO calls(topic,seqid,room,owner,createdat,participants) VALUES($1,$2,$3,$4,$5,$6)",
+		call.Topic, call.SeqId, call.Room, store.DecodeUid(t.ParseUid(call.Owner)), call.CreatedAt,
+		common.ToJSON(call.Participants))
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// CallEnd saves the end time, outcome, duration and participants of the call.
+func (a *adapter) CallEnd(call *t.CallRecord) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"UPDATE calls SET endedat=$1,outcome=$2,duration=$3,participants=$4 WHERE topic=$5 AND seqid=$6",
+		call.EndedAt, call.Outcome, call.Duration, common.ToJSON(call.Participants), call.Topic, call.SeqId)
+	return err
+}
+
+// CallGet returns the record of the call started by the message seqId.
+func (a *adapter) CallGet(topic string, seqId int) (*t.CallRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	call := t.CallRecord{Topic: topic, SeqId: seqId}
+	var owner int64
+	var participants []byte
+	err := a.db.QueryRow(ctx, "SELECT room,owner,createdat,endedat,outcome,duration,participants FROM calls "+
+		"WHERE topic=$1 AND seqid=$2", topic, seqId).Scan(&call.Room, &owner, &call.CreatedAt, &call.EndedAt,
+		&call.Outcome, &call.Duration, &participants)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	call.Owner = store.EncodeUid(owner).String()
+	if len(participants) > 0 {
+		json.Unmarshal(participants, &call.Participants)
+	}
+	return &call, nil
+}
+
+// CallGetAll returns records of calls in the given topics, the most recent first.
+func (a *adapter) CallGetAll(topics []string, before *time.Time, limit int) ([]t.CallRecord, error) {
+	if len(topics) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+
+	args := []any{topics}
+	where := ""
+	if before != nil {
+		where = " AND createdat<?"
+		args = append(args, *before)
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	sql, args := expandQuery("SELECT topic,seqid,room,owner,createdat,endedat,outcome,duration,participants "+
+		"FROM calls WHERE topic IN (?)"+where+" ORDER BY createdat DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.CallRecord
+	for rows.Next() {
+		var call t.CallRecord
+		var owner int64
+		var participants []byte
+		if err = rows.Scan(&call.Topic, &call.SeqId, &call.Room, &owner, &call.CreatedAt, &call.EndedAt,
+			&call.Outcome, &call.Duration, &participants); err != nil {
+			return nil, err
+		}
+		call.Owner = store.EncodeUid(owner).String()
+		if len(participants) > 0 {
+			json.Unmarshal(participants, &call.Participants)
+		}
+		result = append(result, call)
+	}
+	return result, rows.Err()
+}
+
+// KeyBundleUpsert creates or replaces the public keys of the user's device.
+func (a *adapter) KeyBundleUpsert(kb *t.KeyBundle, maxOneTime int) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(t.ParseUid(kb.User))
+	var identKey []byte
+	var oneTime [][]byte
+	err = tx.QueryRow(ctx, "SELECT identkey,onetime FROM keybundles WHERE userid=$1 AND deviceid=$2",
+		decoded_uid, kb.DeviceId).Scan(&identKey, &oneTime)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if !bytes.Equal(identKey, kb.IdentityKey) {
+		// One-time prekeys of the old identity are useless.
+		oneTime = nil
+	}
+	oneTime = append(oneTime, kb.OneTimeKeys...)
+	if len(oneTime) > maxOneTime {
+		oneTime = oneTime[len(oneTime)-maxOneTime:]
+	}
+	if oneTime == nil {
+		oneTime = [][]byte{}
+	}
+
+	if _, err = tx.Exec(ctx,
+		"INSERT INTO keybundles(userid,deviceid,identkey,signedkey,signature,onetime,updatedat) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7) ON CONFLICT(userid,deviceid) DO UPDATE SET identkey=EXCLUDED.identkey,"+
+			"signedkey=EXCLUDED.signedkey,signature=EXCLUDED.signature,onetime=EXCLUDED.onetime,"+
+			"updatedat=EXCLUDED.updatedat",
+		decoded_uid, kb.DeviceId, kb.IdentityKey, kb.SignedPreKey, kb.Signature, oneTime, kb.UpdatedAt); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// KeyBundleGetAll returns key bundles of all devices of the user.
+func (a *adapter) KeyBundleGetAll(user t.Uid, consume bool) ([]t.KeyBundle, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(user)
+	rows, err := tx.Query(ctx, "SELECT deviceid,identkey,signedkey,signature,onetime,updatedat "+
+		"FROM keybundles WHERE userid=$1 ORDER BY deviceid LIMIT $2", decoded_uid, a.maxResults)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundles []t.KeyBundle
+	for rows.Next() {
+		kb := t.KeyBundle{User: user.String()}
+		var oneTime [][]byte
+		if err = rows.Scan(&kb.DeviceId, &kb.IdentityKey, &kb.SignedPreKey, &kb.Signature, &oneTime,
+			&kb.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		kb.OneTimeCount = len(oneTime)
+		if consume && len(oneTime) > 0 {
+			kb.OneTimeKeys = oneTime[:1]
+			kb.OneTimeCount--
+		}
+		bundles = append(bundles, kb)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if consume {
+		if _, err = tx.Exec(ctx,
+			"UPDATE keybundles SET onetime=json_remove(onetime,'$[0]') WHERE userid=$1 AND json_array_length(onetime)>0",
+			decoded_uid); err != nil {
+			return nil, err
+		}
+	}
+	return bundles, tx.Commit(ctx)
+}
+
+// KeyBundleDelete deletes the key bundle of the user's device or of all devices.
+func (a *adapter) KeyBundleDelete(user t.Uid, deviceId string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query := "DELETE FROM keybundles WHERE userid=$1"
+	args := []any{store.DecodeUid(user)}
+	if deviceId != "" {
+		query += " AND deviceid=$2"
+		args = append(args, deviceId)
+	}
+	res, err := a.db.Exec(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// SenderKeyAdd saves sender key distribution messages.
+func (a *adapter) SenderKeyAdd(keys []t.SenderKey) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	for i := range keys {
+		sk := &keys[i]
+		if _, err = tx.Exec(ctx,
+			`INSERT INTO senderkeys(topic,userid,deviceid,"from",fromdevice,data,createdat) VALUES($1,$2,$3,$4,$5,$6,$7) `+
+				`ON CONFLICT(topic,userid,deviceid,"from",fromdevice) DO UPDATE SET data=EXCLUDED.data,createdat=EXCLUDED.createdat`,
+			sk.Topic, store.DecodeUid(t.ParseUid(sk.User)), sk.DeviceId, store.DecodeUid(t.ParseUid(sk.From)),
+			sk.FromDevice, sk.Data, sk.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// SenderKeyPopAll returns and deletes sender key distribution messages for the user's device in the topic.
+func (a *adapter) SenderKeyPopAll(topic string, user t.Uid, deviceId string) ([]t.SenderKey, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		`DELETE FROM senderkeys WHERE topic=$1 AND userid=$2 AND deviceid=$3 RETURNING "from",fromdevice,data,createdat`,
+		topic, store.DecodeUid(user), deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []t.SenderKey
+	for rows.Next() {
+		sk := t.SenderKey{Topic: topic, User: user.String(), DeviceId: deviceId}
+		var from int64
+		if err = rows.Scan(&from, &sk.FromDevice, &sk.Data, &sk.CreatedAt); err != nil {
+			return nil, err
+		}
+		sk.From = store.EncodeUid(from).String()
+		keys = append(keys, sk)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+// UserDeviceUpsert creates or updates the record of the user's device.
+func (a *adapter) UserDeviceUpsert(dev *t.UserDevice) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO userdevices(userid,id,name,platform,appversion,publickey,pushtoken,push,createdat,lastseen) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) ON CONFLICT(userid,id) DO UPDATE SET "+
+			"name=COALESCE(NULLIF(EXCLUDED.name,''),userdevices.name),platform=EXCLUDED.platform,"+
+			"appversion=EXCLUDED.appversion,publickey=COALESCE(EXCLUDED.publickey,userdevices.publickey),"+
+			"pushtoken=EXCLUDED.pushtoken,lastseen=EXCLUDED.lastseen",
+		store.DecodeUid(t.ParseUid(dev.User)), dev.Id, dev.Name, dev.Platform, dev.AppVersion, dev.PublicKey,
+		dev.PushToken, dev.Push, dev.CreatedAt, dev.LastSeen)
+	return err
+}
+
+// UserDeviceUpdate updates the record of the user's device.
+func (a *adapter) UserDeviceUpdate(user t.Uid, id string, update map[string]any) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	cols, args := common.UpdateByMap(update)
+	q, args := expandQuery("UPDATE userdevices SET "+strings.Join(cols, ",")+" WHERE userid=? AND id=?",
+		args, store.DecodeUid(user), id)
+	res, err := a.db.Exec(ctx, q, args...)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// UserDeviceGetAll returns records of the user's devices with their delivery state, the most recently active first.
+func (a *adapter) UserDeviceGetAll(user t.Uid) ([]t.UserDevice, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT ud.id,ud.name,ud.platform,ud.appversion,ud.publickey,ud.pushtoken,ud.push,ud.createdat,ud.lastseen,"+
+			"COALESCE(json_array_length(kb.onetime),-1),"+
+			"(SELECT COUNT(*) FROM senderkeys sk WHERE sk.userid=ud.userid AND sk.deviceid=ud.id) "+
+			"FROM userdevices ud LEFT JOIN keybundles kb ON kb.userid=ud.userid AND kb.deviceid=ud.id "+
+			"WHERE ud.userid=$1 ORDER BY ud.lastseen DESC LIMIT $2", store.DecodeUid(user), a.maxResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []t.UserDevice
+	for rows.Next() {
+		dev := t.UserDevice{User: user.String()}
+		if err = rows.Scan(&dev.Id, &dev.Name, &dev.Platform, &dev.AppVersion, &dev.PublicKey, &dev.PushToken,
+			&dev.Push, &dev.CreatedAt, &dev.LastSeen, &dev.OneTimeKeys, &dev.SenderKeys); err != nil {
+			return nil, err
+		}
+		devices = append(devices, dev)
+	}
+	return devices, rows.Err()
+}
+
+// UserDeviceDelete deletes the record of the user's device together with its encryption keys.
+func (a *adapter) UserDeviceDelete(user t.Uid, id string) (bool, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	decoded_uid := store.DecodeUid(user)
+	res, err := tx.Exec(ctx, "DELETE FROM userdevices WHERE userid=$1 AND id=$2", decoded_uid, id)
+	if err != nil {
+		return false, err
+	}
+	if res.RowsAffected() == 0 {
+		return false, tx.Commit(ctx)
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM keybundles WHERE userid=$1 AND deviceid=$2", decoded_uid, id); err != nil {
+		return false, err
+	}
+	if _, err = tx.Exec(ctx, "DELETE FROM senderkeys WHERE userid=$1 AND deviceid=$2", decoded_uid, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// NotifySettingsGet returns notification settings of the given users.
+func (a *adapter) NotifySettingsGet(users []t.Uid) ([]t.NotifySettings, error) {
+	var unums []any
+	for _, uid := range users {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+	query, unums := expandQuery("SELECT userid,lang,nopreview,quietstart,quietend,timezone,keywords,sms,updatedat "+
+		"FROM notifysettings WHERE userid IN (?)", unums)
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, query, unums...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.NotifySettings
+	for rows.Next() {
+		var userId int64
+		var ns t.NotifySettings
+		if err = rows.Scan(&userId, &ns.Lang, &ns.NoPreview, &ns.QuietStart, &ns.QuietEnd, &ns.TimeZone,
+			&ns.Keywords, &ns.Sms, &ns.UpdatedAt); err != nil {
+			return nil, err
+		}
+		ns.User = store.EncodeUid(userId).String()
+		result = append(result, ns)
+	}
+	return result, rows.Err()
+}
+
+// NotifySettingsUpsert creates or replaces notification settings of the user.
+func (a *adapter) NotifySettingsUpsert(ns *t.NotifySettings) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO notifysettings(userid,lang,nopreview,quietstart,quietend,timezone,keywords,sms,updatedat) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9) "+
+			"ON CONFLICT(userid) DO UPDATE SET lang=EXCLUDED.lang,nopreview=EXCLUDED.nopreview,"+
+			"quietstart=EXCLUDED.quietstart,quietend=EXCLUDED.quietend,timezone=EXCLUDED.timezone,"+
+			"keywords=EXCLUDED.keywords,sms=EXCLUDED.sms,updatedat=EXCLUDED.updatedat",
+		store.DecodeUid(t.ParseUid(ns.User)), ns.Lang, ns.NoPreview, ns.QuietStart, ns.QuietEnd, ns.TimeZone,
+		ns.Keywords, ns.Sms, ns.UpdatedAt)
+	return err
+}
+
+// TopicNotifyGet returns settings of notifications from the topic of its subscribers who changed them.
+func (a *adapter) TopicNotifyGet(topic string) ([]t.TopicNotifySettings, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT userid,muteuntil,mentions,updatedat FROM topicnotify WHERE topic=$1", topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.TopicNotifySettings
+	for rows.Next() {
+		var userId int64
+		tns := t.TopicNotifySettings{Topic: topic}
+		if err = rows.Scan(&userId, &tns.MuteUntil, &tns.MentionsOnly, &tns.UpdatedAt); err != nil {
+			return nil, err
+		}
+		tns.User = store.EncodeUid(userId).String()
+		result = append(result, tns)
+	}
+	return result, rows.Err()
+}
+
+// TopicNotifyUpsert creates or replaces settings of notifications from a topic of one user.
+func (a *adapter) TopicNotifyUpsert(tns *t.TopicNotifySettings) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO topicnotify(topic,userid,muteuntil,mentions,updatedat) VALUES($1,$2,$3,$4,$5) "+
+			"ON CONFLICT(topic,userid) DO UPDATE SET muteuntil=EXCLUDED.muteuntil,mentions=EXCLUDED.mentions,"+
+			"updatedat=EXCLUDED.updatedat",
+		tns.Topic, store.DecodeUid(t.ParseUid(tns.User)), tns.MuteUntil, tns.MentionsOnly, tns.UpdatedAt)
+	return err
+}
+
+// PresenceSettingsGet returns presence settings of the given users.
+func (a *adapter) PresenceSettingsGet(users []t.Uid) ([]t.PresenceSettings, error) {
+	var unums []any
+	for _, uid := range users {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+	query, unums := expandQuery("SELECT userid,invisible,lastseen,updatedat FROM presencesettings WHERE userid IN (?)",
+		unums)
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, query, unums...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.PresenceSettings
+	for rows.Next() {
+		var userId int64
+		var ps t.PresenceSettings
+		if err = rows.Scan(&userId, &ps.Invisible, &ps.LastSeen, &ps.UpdatedAt); err != nil {
+			return nil, err
+		}
+		ps.User = store.EncodeUid(userId).String()
+		result = append(result, ps)
+	}
+	return result, rows.Err()
+}
+
+// PresenceSettingsUpsert creates or replaces presence settings of the user.
+func (a *adapter) PresenceSettingsUpsert(ps *t.PresenceSettings) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO presencesettings(userid,invisible,lastseen,updatedat) VALUES($1,$2,$3,$4) "+
+			"ON CONFLICT(userid) DO UPDATE SET invisible=EXCLUDED.invisible,lastseen=EXCLUDED.lastseen,"+
+			"updatedat=EXCLUDED.updatedat",
+		store.DecodeUid(t.ParseUid(ps.User)), ps.Invisible, ps.LastSeen, ps.UpdatedAt)
+	return err
+}
+
+// TopicPresenceGet returns overrides of sharing presence in the topic if topic is not blank, otherwise
+// overrides of the user in all topics.
+func (a *adapter) TopicPresenceGet(topic string, user t.Uid) ([]t.TopicPresenceSettings, error) {
+	query := "SELECT topic,userid,share,updatedat FROM topicpresence WHERE "
+	var arg any
+	if topic != "" {
+		query += "topic=$1"
+		arg = topic
+	} else {
+		query += "userid=$1"
+		arg = store.DecodeUid(user)
+	}
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, query, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.TopicPresenceSettings
+	for rows.Next() {
+		var userId int64
+		var tps t.TopicPresenceSettings
+		if err = rows.Scan(&tps.Topic, &userId, &tps.Share, &tps.UpdatedAt); err != nil {
+			return nil, err
+		}
+		tps.User = store.EncodeUid(userId).String()
+		result = append(result, tps)
+	}
+	return result, rows.Err()
+}
+
+// TopicPresenceUpsert creates or replaces the override of sharing presence in a topic of one user.
+func (a *adapter) TopicPresenceUpsert(tps *t.TopicPresenceSettings) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO topicpresence(topic,userid,share,updatedat) VALUES($1,$2,$3,$4) "+
+			"ON CONFLICT(topic,userid) DO UPDATE SET share=EXCLUDED.share,updatedat=EXCLUDED.updatedat",
+		tps.Topic, store.DecodeUid(t.ParseUid(tps.User)), tps.Share, tps.UpdatedAt)
+	return err
+}
+
+// MentionAdd adds messages to the index of mentions of users.
+func (a *adapter) MentionAdd(mentions []t.Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	for i := range mentions {
+		mn := &mentions[i]
+		if _, err = tx.Exec(ctx,
+			`INSERT INTO mentions(userid,topic,seqid,"from",keyword,createdat) VALUES($1,$2,$3,$4,$5,$6) `+
+				"ON CONFLICT DO NOTHING",
+			store.DecodeUid(t.ParseUid(mn.User)), mn.Topic, mn.SeqId, store.DecodeUid(t.ParseUid(mn.From)),
+			mn.Keyword, mn.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// MentionGetAll returns mentions of the user in the given topics, the most recent first.
+func (a *adapter) MentionGetAll(forUser t.Uid, topics []string, before *time.Time, limit int) ([]t.Mention, error) {
+	if len(topics) == 0 {
+		return nil, nil
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+
+	userId := store.DecodeUid(forUser)
+	args := []any{userId, userId, topics}
+	where := ""
+	if before != nil {
+		where = " AND mn.createdat<?"
+		args = append(args, *before)
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	sql, args := expandQuery(`SELECT mn.topic,mn.seqid,mn."from",mn.keyword,mn.createdat FROM mentions AS mn`+
+		" JOIN messages AS m ON m.topic=mn.topic AND m.seqid=mn.seqid AND m.delid=0"+
+		" LEFT JOIN dellog AS d ON d.topic=mn.topic AND mn.seqid BETWEEN d.low AND d.hi-1 AND d.deletedfor=?"+
+		" WHERE mn.userid=? AND mn.topic IN (?)"+where+" AND d.deletedfor IS NULL"+
+		" ORDER BY mn.createdat DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Mention
+	for rows.Next() {
+		var from int64
+		mn := t.Mention{User: forUser.String()}
+		if err = rows.Scan(&mn.Topic, &mn.SeqId, &from, &mn.Keyword, &mn.CreatedAt); err != nil {
+			return nil, err
+		}
+		mn.From = store.EncodeUid(from).String()
+		result = append(result, mn)
+	}
+	return result, rows.Err()
+}
+
+// MentionCount returns the number of mentions of the user in the topic in messages with IDs greater than since.
+func (a *adapter) MentionCount(forUser t.Uid, topic string, since int) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var count int
+	err := a.db.QueryRow(ctx, "SELECT COUNT(*) FROM mentions WHERE userid=$1 AND topic=$2 AND seqid>$3",
+		store.DecodeUid(forUser), topic, since).Scan(&count)
+	return count, err
+}
+
+// DraftUpsert saves the draft unless the stored draft has the same or a later timestamp.
+func (a *adapter) DraftUpsert(draft *t.Draft) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx,
+		"INSERT INTO drafts(userid,topic,content,updatedat) VALUES($1,$2,$3,$4) "+
+			"ON CONFLICT(userid,topic) DO UPDATE SET content=EXCLUDED.content,updatedat=EXCLUDED.updatedat "+
+			"WHERE drafts.updatedat<EXCLUDED.updatedat",
+		store.DecodeUid(t.ParseUid(draft.User)), draft.Topic, toJSON(draft.Content), draft.UpdatedAt)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// DraftGetAll returns drafts of the user updated after the given time, or all drafts which are not deleted.
+func (a *adapter) DraftGetAll(user t.Uid, since *time.Time) ([]t.Draft, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "SELECT topic,content,updatedat FROM drafts WHERE userid=$1"
+	args := []any{store.DecodeUid(user)}
+	if since != nil {
+		query += " AND updatedat>$2"
+		args = append(args, *since)
+	} else {
+		query += " AND content IS NOT NULL"
+	}
+	rows, err := a.db.Query(ctx, query+" ORDER BY updatedat", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Draft
+	for rows.Next() {
+		d := t.Draft{User: user.String()}
+		if err = rows.Scan(&d.Topic, &d.Content, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+// StarredAdd saves a copy of the message starred by the user.
+func (a *adapter) StarredAdd(msg *t.StarredMessage) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx,
+		`INSERT INTO starred(userid,topic,seqid,"from",head,content,sentat,createdat) VALUES($1,$2,$3,$4,$5,$6,$7,$8) `+
+			"ON CONFLICT DO NOTHING",
+		store.DecodeUid(t.ParseUid(msg.User)), msg.Topic, msg.SeqId, store.DecodeUid(t.ParseUid(msg.From)),
+		msg.Head, toJSON(msg.Content), msg.SentAt, msg.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// StarredDelete deletes the starred message of the user.
+func (a *adapter) StarredDelete(user t.Uid, topic string, seqId int) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM starred WHERE userid=$1 AND topic=$2 AND seqid=$3",
+		store.DecodeUid(user), topic, seqId)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// StarredGetAll returns messages starred by the user before the given time, the most recently starred first.
+func (a *adapter) StarredGetAll(user t.Uid, topic string, before *time.Time, limit int) ([]t.StarredMessage, error) {
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+
+	args := []any{store.DecodeUid(user)}
+	where := ""
+	if topic != "" {
+		where += " AND topic=?"
+		args = append(args, topic)
+	}
+	if before != nil {
+		where += " AND createdat<?"
+		args = append(args, *before)
+	}
+	args = append(args, limit)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	sql, args := expandQuery(`SELECT topic,seqid,"from",head,content,sentat,createdat FROM starred`+
+		" WHERE userid=?"+where+" ORDER BY createdat DESC LIMIT ?", args...)
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.StarredMessage
+	for rows.Next() {
+		var from int64
+		sm := t.StarredMessage{User: user.String()}
+		if err = rows.Scan(&sm.Topic, &sm.SeqId, &from, &sm.Head, &sm.Content, &sm.SentAt, &sm.CreatedAt); err != nil {
+			return nil, err
+		}
+		sm.From = store.EncodeUid(from).String()
+		result = append(result, sm)
+	}
+	return result, rows.Err()
+}
+
+// BlocksAdd blocks the target user on behalf of the user.
+func (a *adapter) BlocksAdd(block *t.Block) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "INSERT INTO blocks(userid,target,createdat) VALUES($1,$2,$3) ON CONFLICT DO NOTHING",
+		store.DecodeUid(t.ParseUid(block.User)), store.DecodeUid(t.ParseUid(block.Target)), block.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// BlocksDelete unblocks the target user.
+func (a *adapter) BlocksDelete(user, target t.Uid) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM blocks WHERE userid=$1 AND target=$2",
+		store.DecodeUid(user), store.DecodeUid(target))
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// BlocksGetAll returns blocks made by the user and blocks of the user by others, the most recent first.
+func (a *adapter) BlocksGetAll(user t.Uid) ([]t.Block, error) {
+	return a.blocksQuery("SELECT userid,target,createdat FROM blocks WHERE userid=$1 OR target=$1 "+
+		"ORDER BY createdat DESC", store.DecodeUid(user))
+}
+
+// BlocksGetBetween returns blocks where both the blocker and the blocked user are in the list.
+func (a *adapter) BlocksGetBetween(users []t.Uid) ([]t.Block, error) {
+	if len(users) < 2 {
+		return nil, nil
+	}
+	ids := make([]int64, len(users))
+	for i, uid := range users {
+		ids[i] = store.DecodeUid(uid)
+	}
+	return a.blocksQuery("SELECT userid,target,createdat FROM blocks WHERE userid IN (SELECT value FROM json_each($1)) AND target IN (SELECT value FROM json_each($1))", ids)
+}
+
+// blocksQuery runs the query which selects userid, target and createdat of blocks.
+func (a *adapter) blocksQuery(sql string, args ...any) ([]t.Block, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Block
+	for rows.Next() {
+		var user, target int64
+		var b t.Block
+		if err = rows.Scan(&user, &target, &b.CreatedAt); err != nil {
+			return nil, err
+		}
+		b.User = store.EncodeUid(user).String()
+		b.Target = store.EncodeUid(target).String()
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+// InvitesCreate saves a new invite link to a topic.
+func (a *adapter) InvitesCreate(inv *t.Invite) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO invites(token,topic,createdby,createdat,expiresat,maxuses,approval) "+
+		"VALUES($1,$2,$3,$4,$5,$6,$7)",
+		inv.Token, inv.Topic, store.DecodeUid(t.ParseUid(inv.CreatedBy)), inv.CreatedAt, inv.ExpiresAt,
+		inv.MaxUses, inv.Approval)
+	return err
+}
+
+// InvitesGetAll returns invite links to the topic, the most recent first.
+func (a *adapter) InvitesGetAll(topic string) ([]t.Invite, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT token,topic,createdby,createdat,expiresat,maxuses,uses,approval "+
+		"FROM invites WHERE topic=$1 ORDER BY createdat DESC", topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Invite
+	for rows.Next() {
+		var inv t.Invite
+		var createdBy int64
+		if err = rows.Scan(&inv.Token, &inv.Topic, &createdBy, &inv.CreatedAt, &inv.ExpiresAt,
+			&inv.MaxUses, &inv.Uses, &inv.Approval); err != nil {
+			return nil, err
+		}
+		inv.CreatedBy = store.EncodeUid(createdBy).String()
+		result = append(result, inv)
+	}
+	return result, rows.Err()
+}
+
+// InvitesUse counts a use of the invite link to the topic and returns the link. Returns nil if the
+// link does not exist, has expired or has been used the maximum number of times.
+func (a *adapter) InvitesUse(topic, token string, now time.Time) (*t.Invite, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var inv t.Invite
+	var createdBy int64
+	err := a.db.QueryRow(ctx, "UPDATE invites SET uses=uses+1 WHERE token=$1 AND topic=$2 "+
+		"AND (expiresat IS NULL OR expiresat>$3) AND (maxuses=0 OR uses<maxuses) "+
+		"RETURNING token,topic,createdby,createdat,expiresat,maxuses,uses,approval", token, topic, now).
+		Scan(&inv.Token, &inv.Topic, &createdBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.MaxUses, &inv.Uses, &inv.Approval)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	inv.CreatedBy = store.EncodeUid(createdBy).String()
+	return &inv, nil
+}
+
+// InvitesDelete revokes the invite link to the topic.
+func (a *adapter) InvitesDelete(topic, token string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM invites WHERE token=$1 AND topic=$2", token, topic)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// DirectoryUpsert publishes the topic in the directory or updates its entry.
+func (a *adapter) DirectoryUpsert(entry *t.DirectoryEntry) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO directory(topic,category,description,createdat,updatedat) "+
+		"VALUES($1,$2,$3,$4,$5) ON CONFLICT(topic) DO UPDATE SET "+
+		"category=EXCLUDED.category,description=EXCLUDED.description,updatedat=EXCLUDED.updatedat",
+		entry.Topic, entry.Category, entry.Description, entry.CreatedAt, entry.UpdatedAt)
+	return err
+}
+
+// DirectoryDelete removes the topic from the directory.
+func (a *adapter) DirectoryDelete(topic string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM directory WHERE topic=$1", topic)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// Popularity of a topic in the directory: the number of subscribers decayed by the number of days since
+// the last message. The time of the query is the first argument.
+const directoryRankSQL = `t.subcnt / POWER(MAX(julianday($1) - julianday(COALESCE(t.touchedat, t.createdat)), 0) + 2, 1.5)`
+
+// DirectoryList returns active listed topics of the category, the most popular first.
+func (a *adapter) DirectoryList(tenant, category string, now time.Time, offset, limit int) ([]t.DirectoryEntry, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+
+	query := "SELECT d.topic,d.category,d.description,d.createdat,d.updatedat," +
+		"t.usebt,t.public,t.tags,t.subcnt,COALESCE(t.touchedat,t.createdat) " +
+		"FROM directory AS d JOIN topics AS t ON t.name=d.topic WHERE t.state=$2 AND t.tenant=$3"
+	args := []any{now, t.StateOK, tenant}
+	if category != "" {
+		query += " AND d.category=$4"
+		args = append(args, category)
+	}
+	query += " ORDER BY " + directoryRankSQL + " DESC, d.topic" +
+		" LIMIT " + strconv.Itoa(limit) + " OFFSET " + strconv.Itoa(max(offset, 0))
+
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.DirectoryEntry
+	for rows.Next() {
+		var entry t.DirectoryEntry
+		if err = rows.Scan(&entry.Topic, &entry.Category, &entry.Description, &entry.CreatedAt, &entry.UpdatedAt,
+			&entry.UseBt, &entry.Public, &entry.Tags, &entry.SubCnt, &entry.TouchedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+// WebhooksCreate saves a new webhook.
+func (a *adapter) WebhooksCreate(hook *t.Webhook) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO webhooks(id,topic,url,secret,events,createdat) VALUES($1,$2,$3,$4,$5,$6)",
+		hook.Id, hook.Topic, hook.URL, hook.Secret, hook.Events, hook.CreatedAt)
+	return err
+}
+
+// WebhooksGetAll returns webhooks of the topic or server-wide webhooks if the topic is empty.
+func (a *adapter) WebhooksGetAll(topic string) ([]t.Webhook, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT id,topic,url,secret,events,createdat FROM webhooks WHERE topic=$1 "+
+		"ORDER BY createdat", topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Webhook
+	for rows.Next() {
+		var hook t.Webhook
+		if err = rows.Scan(&hook.Id, &hook.Topic, &hook.URL, &hook.Secret, &hook.Events, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, hook)
+	}
+	return result, rows.Err()
+}
+
+// WebhooksDelete deletes the webhook.
+func (a *adapter) WebhooksDelete(id string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM webhooks WHERE id=$1", id)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// InWebhooksCreate saves a new incoming webhook.
+func (a *adapter) InWebhooksCreate(hook *t.IncomingWebhook) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO inwebhooks(token,topic,userid,format,template,createdat) VALUES($1,$2,$3,$4,$5,$6)",
+		hook.Token, hook.Topic, store.DecodeUid(t.ParseUserId(hook.User)), hook.Format, hook.Template, hook.CreatedAt)
+	return err
+}
+
+// InWebhooksGet returns the incoming webhook with the token or nil if not found.
+func (a *adapter) InWebhooksGet(token string) (*t.IncomingWebhook, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var hook t.IncomingWebhook
+	var userId int64
+	if err := a.db.QueryRow(ctx, "SELECT token,topic,userid,format,template,createdat FROM inwebhooks WHERE token=$1",
+		token).Scan(&hook.Token, &hook.Topic, &userId, &hook.Format, &hook.Template, &hook.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	hook.User = store.EncodeUid(userId).UserId()
+	return &hook, nil
+}
+
+// InWebhooksGetAll returns incoming webhooks of the topic.
+func (a *adapter) InWebhooksGetAll(topic string) ([]t.IncomingWebhook, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT token,topic,userid,format,template,createdat FROM inwebhooks WHERE topic=$1 "+
+		"ORDER BY createdat", topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.IncomingWebhook
+	for rows.Next() {
+		var hook t.IncomingWebhook
+		var userId int64
+		if err = rows.Scan(&hook.Token, &hook.Topic, &userId, &hook.Format, &hook.Template, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hook.User = store.EncodeUid(userId).UserId()
+		result = append(result, hook)
+	}
+	return result, rows.Err()
+}
+
+// InWebhooksDelete deletes the incoming webhook.
+func (a *adapter) InWebhooksDelete(token string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM inwebhooks WHERE token=$1", token)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// MatrixRoomsLink bridges the topic to the room replacing the previous room of the topic.
+func (a *adapter) MatrixRoomsLink(link *t.MatrixRoom) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO matrixrooms(topic,room,createdat) VALUES($1,$2,$3) "+
+		"ON CONFLICT(topic) DO UPDATE SET room=EXCLUDED.room,createdat=EXCLUDED.createdat",
+		link.Topic, link.Room, link.CreatedAt)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// MatrixRoomsGet returns the link by the topic or, if the topic is empty, by the room.
+func (a *adapter) MatrixRoomsGet(topic, room string) (*t.MatrixRoom, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query, arg := "SELECT topic,room,createdat FROM matrixrooms WHERE topic=$1", topic
+	if topic == "" {
+		query, arg = "SELECT topic,room,createdat FROM matrixrooms WHERE room=$1", room
+	}
+	var link t.MatrixRoom
+	if err := a.db.QueryRow(ctx, query, arg).Scan(&link.Topic, &link.Room, &link.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &link, nil
+}
+
+// MatrixRoomsUnlink removes the bridge of the topic.
+func (a *adapter) MatrixRoomsUnlink(topic string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM matrixrooms WHERE topic=$1", topic)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// MailboxesCreate saves a new mailbox.
+func (a *adapter) MailboxesCreate(box *t.Mailbox) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO mailboxes(address,topic,userid,reply,createdat) VALUES($1,$2,$3,$4,$5)",
+		box.Address, box.Topic, store.DecodeUid(t.ParseUserId(box.User)), box.Reply, box.CreatedAt)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// MailboxesGet returns the mailbox with the address or nil if not found.
+func (a *adapter) MailboxesGet(address string) (*t.Mailbox, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var box t.Mailbox
+	var userId int64
+	if err := a.db.QueryRow(ctx, "SELECT address,topic,userid,reply,createdat FROM mailboxes WHERE address=$1",
+		address).Scan(&box.Address, &box.Topic, &userId, &box.Reply, &box.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	box.User = store.EncodeUid(userId).UserId()
+	return &box, nil
+}
+
+// MailboxesGetAll returns mailboxes of the topic.
+func (a *adapter) MailboxesGetAll(topic string) ([]t.Mailbox, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT address,topic,userid,reply,createdat FROM mailboxes WHERE topic=$1 "+
+		"ORDER BY createdat", topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Mailbox
+	for rows.Next() {
+		var box t.Mailbox
+		var userId int64
+		if err = rows.Scan(&box.Address, &box.Topic, &userId, &box.Reply, &box.CreatedAt); err != nil {
+			return nil, err
+		}
+		box.User = store.EncodeUid(userId).UserId()
+		result = append(result, box)
+	}
+	return result, rows.Err()
+}
+
+// MailboxesDelete deletes the mailbox.
+func (a *adapter) MailboxesDelete(address string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM mailboxes WHERE address=$1", address)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// TenantsCreate saves a new tenant.
+func (a *adapter) TenantsCreate(tenant *t.Tenant) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "INSERT INTO tenants(id,name,hosts,config,createdat,updatedat) VALUES($1,$2,$3,$4,$5,$6)",
+		tenant.Id, tenant.Name, tenant.Hosts, tenant.Config, tenant.CreatedAt, tenant.UpdatedAt)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// TenantsGetAll returns all tenants.
+func (a *adapter) TenantsGetAll() ([]t.Tenant, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT id,name,hosts,config,createdat,updatedat FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.Tenant
+	for rows.Next() {
+		var tenant t.Tenant
+		if err = rows.Scan(&tenant.Id, &tenant.Name, &tenant.Hosts, &tenant.Config, &tenant.CreatedAt,
+			&tenant.UpdatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, tenant)
+	}
+	return result, rows.Err()
+}
+
+// TenantsUpdate replaces the name, hosts and config of the tenant.
+func (a *adapter) TenantsUpdate(tenant *t.Tenant) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "UPDATE tenants SET name=$1,hosts=$2,config=$3,updatedat=$4 WHERE id=$5",
+		tenant.Name, tenant.Hosts, tenant.Config, tenant.UpdatedAt, tenant.Id)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// TenantsDelete deletes the tenant which has no users.
+func (a *adapter) TenantsDelete(id string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM tenants WHERE id=$1 AND NOT EXISTS (SELECT 1 FROM users WHERE tenant=$1)", id)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// UsageAdd adds counts of the records to the usage of the users in the billing periods.
+func (a *adapter) UsageAdd(records []t.UsageRecord) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	for _, rec := range records {
+		if _, err = tx.Exec(ctx, "INSERT INTO usage(period,userid,tenant,messages,pushes,callsecs) VALUES($1,$2,$3,$4,$5,$6) "+
+			"ON CONFLICT(period,userid) DO UPDATE SET messages=usage.messages+excluded.messages,"+
+			"pushes=usage.pushes+excluded.pushes,callsecs=usage.callsecs+excluded.callsecs",
+			rec.Period, store.DecodeUid(t.ParseUid(rec.User)), rec.Tenant, rec.Messages, rec.Pushes,
+			rec.CallSeconds); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Usage counters of the billing period $1 together with sizes of completed uploads (status $2) by user.
+const usageByUser = "SELECT userid,tenant,messages,pushes,callsecs,0 AS storage FROM usage WHERE period=$1 " +
+	"UNION ALL SELECT userid,tenant,0,0,0,size FROM fileuploads WHERE status=$2 AND userid IS NOT NULL"
+
+// UsageGet returns usage of the user in the billing period.
+func (a *adapter) UsageGet(period string, uid t.Uid) (*t.UsageRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rec := &t.UsageRecord{Period: period, User: uid.String()}
+	var tenant *string
+	err := a.db.QueryRow(ctx, "SELECT MAX(tenant),COALESCE(SUM(messages),0),COALESCE(SUM(pushes),0),"+
+		"COALESCE(SUM(callsecs),0),COALESCE(SUM(storage),0) FROM ("+usageByUser+") AS u WHERE userid=$3",
+		period, t.UploadCompleted, store.DecodeUid(uid)).Scan(&tenant, &rec.Messages, &rec.Pushes,
+		&rec.CallSeconds, &rec.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if tenant != nil {
+		rec.Tenant = *tenant
+	}
+	return rec, nil
+}
+
+// UsageTotal returns the total usage of all users of the tenant in the billing period.
+func (a *adapter) UsageTotal(period, tenant string) (*t.UsageRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rec := &t.UsageRecord{Period: period, Tenant: tenant}
+	err := a.db.QueryRow(ctx, "SELECT COALESCE(SUM(messages),0),COALESCE(SUM(pushes),0),COALESCE(SUM(callsecs),0),"+
+		"COALESCE(SUM(storage),0) FROM ("+usageByUser+") AS u WHERE tenant=$3",
+		period, t.UploadCompleted, tenant).Scan(&rec.Messages, &rec.Pushes, &rec.CallSeconds, &rec.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// UsageList returns usage of users of the tenants in the billing period, of users of all tenants
+// if tenants is nil.
+func (a *adapter) UsageList(period string, tenants []string) ([]t.UsageRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	query := "SELECT userid,tenant,SUM(messages),SUM(pushes),SUM(callsecs),SUM(storage) FROM (" + usageByUser + ") AS u"
+	args := []any{period, t.UploadCompleted}
+	if tenants != nil {
+		query += " WHERE tenant IN (SELECT value FROM json_each($3))"
+		args = append(args, toJSON(tenants))
+	}
+	rows, err := a.db.Query(ctx, query+" GROUP BY userid,tenant ORDER BY tenant,userid", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.UsageRecord
+	for rows.Next() {
+		var userId int64
+		rec := t.UsageRecord{Period: period}
+		if err = rows.Scan(&userId, &rec.Tenant, &rec.Messages, &rec.Pushes, &rec.CallSeconds, &rec.Storage); err != nil {
+			return nil, err
+		}
+		rec.User = store.EncodeUid(userId).String()
+		result = append(result, rec)
+	}
+	return result, rows.Err()
+}
+
+// SmsCreate saves a record of a new SMS notification.
+func (a *adapter) SmsCreate(msg *t.SmsMessage) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var errText any
+	if msg.Error != "" {
+		errText = msg.Error
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO smsmessages(id,createdat,updatedat,userid,topic,seqid,phone,provider,providerid,status,error) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)",
+		store.DecodeUid(msg.Uid()), msg.CreatedAt, msg.UpdatedAt, store.DecodeUid(t.ParseUid(msg.User)), msg.Topic,
+		msg.SeqId, msg.Phone, msg.Provider, msg.ProviderId, msg.Status, errText)
+	return err
+}
+
+// SmsUpdate changes the provider ID and the status of the SMS notification.
+func (a *adapter) SmsUpdate(id, providerId, status, errText string, updatedAt time.Time) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	uid := t.ParseUid(id)
+	if uid.IsZero() {
+		return false, nil
+	}
+	var errVal any
+	if errText != "" {
+		errVal = errText
+	}
+	res, err := a.db.Exec(ctx, "UPDATE smsmessages SET updatedat=$1,status=$2,error=$3,"+
+		"providerid=CASE WHEN $4='' THEN providerid ELSE $4 END WHERE id=$5",
+		updatedAt, status, errVal, providerId, store.DecodeUid(uid))
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// SmsCount returns the number of SMS notifications sent to the user or to all users since the given time.
+func (a *adapter) SmsCount(user t.Uid, since time.Time) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var count int
+	var err error
+	if user.IsZero() {
+		err = a.db.QueryRow(ctx, "SELECT COUNT(*) FROM smsmessages WHERE createdat>=$1", since).Scan(&count)
+	} else {
+		err = a.db.QueryRow(ctx, "SELECT COUNT(*) FROM smsmessages WHERE userid=$1 AND createdat>=$2",
+			store.DecodeUid(user), since).Scan(&count)
+	}
+	return count, err
+}
+
+// SmsGetAll returns the most recent SMS notifications sent to the user.
+func (a *adapter) SmsGetAll(user t.Uid, limit int) ([]t.SmsMessage, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT id,createdat,updatedat,topic,seqid,phone,provider,providerid,status,error "+
+		"FROM smsmessages WHERE userid=$1 ORDER BY createdat DESC LIMIT $2", store.DecodeUid(user), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.SmsMessage
+	for rows.Next() {
+		var id int64
+		var errText *string
+		msg := t.SmsMessage{User: user.String()}
+		if err = rows.Scan(&id, &msg.CreatedAt, &msg.UpdatedAt, &msg.Topic, &msg.SeqId, &msg.Phone, &msg.Provider,
+			&msg.ProviderId, &msg.Status, &errText); err != nil {
+			return nil, err
+		}
+		msg.SetUid(store.EncodeUid(id))
+		if errText != nil {
+			msg.Error = *errText
+		}
+		result = append(result, msg)
+	}
+	return result, rows.Err()
+}
+
+// Hash of a phone number or email tag, same as store.ContactHash. The salt is the first argument of the query.
+// The function sha256hex is registered with the driver.
+const contactHashSQL = `sha256hex($1 || tag)`
+
+// Tags of phone numbers and emails which make users discoverable by contacts.
+const contactTagsSQL = `(tag LIKE 'tel:%' OR tag LIKE 'email:%')`
+
+// contactsRefresh replaces hashes of the user's phone numbers and emails in the index of contacts.
+func (a *adapter) contactsRefresh(ctx context.Context, tx *txn, decodedUid int64) error {
+	if a.contactSalt == "" {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM contacts WHERE userid=$1", decodedUid); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "INSERT INTO contacts(hash,userid) SELECT "+contactHashSQL+",userid FROM usertags "+
+		"WHERE userid=$2 AND "+contactTagsSQL+" ON CONFLICT DO NOTHING", a.contactSalt, decodedUid)
+	return err
+}
+
+// ContactsInit sets the salt of hashes of contacts and rebuilds the index if the salt has changed.
+func (a *adapter) ContactsInit(salt string) error {
+	a.contactSalt = salt
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var current string
+	err := a.db.QueryRow(ctx, `SELECT "value" FROM kvmeta WHERE "key"='contact_salt'`).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && current == salt {
+		// The index is up to date.
+		return nil
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if _, err = tx.Exec(ctx, "DELETE FROM contacts"); err != nil {
+		return err
+	}
+	if salt != "" {
+		if _, err = tx.Exec(ctx, "INSERT INTO contacts(hash,userid) SELECT "+contactHashSQL+",userid FROM usertags "+
+			"WHERE "+contactTagsSQL+" ON CONFLICT DO NOTHING", salt); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(ctx, `INSERT INTO kvmeta("key","value") VALUES('contact_salt',$1) `+
+		`ON CONFLICT("key") DO UPDATE SET "value"=EXCLUDED."value"`, salt); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ContactsFind returns active users of the tenant with the given hashes of phone numbers or emails.
+func (a *adapter) ContactsFind(tenant string, hashes []string) ([]t.ContactHash, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	return a.contactsQuery(tenant, " AND c.hash IN (?)", hashes)
+}
+
+// ContactsFindByPrefix returns active users of the tenant with hashes of phone numbers or emails starting
+// with any of the given prefixes.
+func (a *adapter) ContactsFindByPrefix(tenant string, prefixes []string) ([]t.ContactHash, error) {
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+	var like []string
+	var args []any
+	for _, prefix := range prefixes {
+		like = append(like, "c.hash LIKE ?")
+		args = append(args, prefix+"%")
+	}
+	return a.contactsQuery(tenant, " AND ("+strings.Join(like, " OR ")+")", args...)
+}
+
+// contactsQuery returns active users of the tenant from the index of contacts matching the condition.
+func (a *adapter) contactsQuery(tenant, where string, args ...any) ([]t.ContactHash, error) {
+	args = append([]any{t.StateOK, tenant}, args...)
+	args = append(args, a.maxResults)
+	sql, args := expandQuery("SELECT c.hash,c.userid FROM contacts AS c JOIN users AS u ON u.id=c.userid "+
+		"WHERE u.state=? AND u.tenant=?"+where+" LIMIT ?", args...)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []t.ContactHash
+	for rows.Next() {
+		var c t.ContactHash
+		var userId int64
+		if err = rows.Scan(&c.Hash, &userId); err != nil {
+			return nil, err
+		}
+		c.User = store.EncodeUid(userId).String()
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+// ReactionAdd adds user's emoji reaction to a message.
+func (a *adapter) ReactionAdd(topic string, seqId int, user t.Uid, reaction string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx,
+		"INSERT INTO reactions(topic,seqid,userid,reaction,createdat) VALUES($1,$2,$3,$4,$5) ON CONFLICT DO NOTHING",
+		topic, seqId, store.DecodeUid(user), reaction, t.TimeNow())
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// ReactionDelete removes user's emoji reaction to a message.
+func (a *adapter) ReactionDelete(topic string, seqId int, user t.Uid, reaction string) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx,
+		"DELETE FROM reactions WHERE topic=$1 AND seqid=$2 AND userid=$3 AND reaction=$4",
+		topic, seqId, store.DecodeUid(user), reaction)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// ReactionCount returns the number of users who reacted to the message with the emoji.
+func (a *adapter) ReactionCount(topic string, seqId int, reaction string) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var count int
+	err := a.db.QueryRow(ctx,
+		"SELECT COUNT(*) FROM reactions WHERE topic=$1 AND seqid=$2 AND reaction=$3",
+		topic, seqId, reaction).Scan(&count)
+	return count, err
+}
+
+// ReactionGetAll returns reactions to the given messages aggregated by message and emoji.
+func (a *adapter) ReactionGetAll(topic string, forUser t.Uid, seqIds []int) ([]t.Reaction, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT seqid,reaction,COUNT(*),MAX(userid=$2) FROM reactions WHERE topic=$1 AND seqid IN (SELECT value FROM json_each($3)) "+
+			"GROUP BY seqid,reaction ORDER BY seqid,MIN(createdat)",
+		topic, store.DecodeUid(forUser), seqIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reactions []t.Reaction
+	for rows.Next() {
+		var r t.Reaction
+		if err = rows.Scan(&r.SeqId, &r.Reaction, &r.Count, &r.Mine); err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, r)
+	}
+	return reactions, rows.Err()
+}
+
+// PollCreate saves a new poll attached to the message topic:seqId.
+func (a *adapter) PollCreate(topic string, poll *t.Poll) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO polls(topic,seqid,userid,options,multi,createdat) VALUES($1,$2,$3,$4,$5,$6)",
+		topic, poll.SeqId, store.DecodeUid(t.ParseUid(poll.From)), poll.Options, poll.Multi, t.TimeNow())
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// PollVote atomically replaces the votes of the user in the poll.
+func (a *adapter) PollVote(topic string, seqId int, user t.Uid, options []int) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// Lock the poll so it cannot be closed while votes are counted.
+	var count int
+	var multi bool
+	var closedAt *time.Time
+	if err = tx.QueryRow(ctx, "SELECT options,multi,closedat FROM polls WHERE topic=$1 AND seqid=$2",
+		topic, seqId).Scan(&count, &multi, &closedAt); err != nil {
+		if err == sql.ErrNoRows {
+			err = t.ErrNotFound
+		}
+		return err
+	}
+	if closedAt != nil {
+		err = t.ErrPolicy
+		return err
+	}
+	if len(options) > 1 && !multi {
+		err = t.ErrMalformed
+		return err
+	}
+	for _, opt := range options {
+		if opt < 0 || opt >= count {
+			err = t.ErrMalformed
+			return err
+		}
+	}
+
+	userId := store.DecodeUid(user)
+	if _, err = tx.Exec(ctx, "DELETE FROM pollvotes WHERE topic=$1 AND seqid=$2 AND userid=$3",
+		topic, seqId, userId); err != nil {
+		return err
+	}
+	now := t.TimeNow()
+	for _, opt := range options {
+		if _, err = tx.Exec(ctx,
+			"INSERT INTO pollvotes(topic,seqid,userid,opt,createdat) VALUES($1,$2,$3,$4,$5) ON CONFLICT DO NOTHING",
+			topic, seqId, userId, opt, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// PollClose closes the poll to new votes.
+func (a *adapter) PollClose(topic string, seqId int) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "UPDATE polls SET closedat=$1 WHERE topic=$2 AND seqid=$3 AND closedat IS NULL",
+		t.TimeNow(), topic, seqId)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// PollGetAll returns polls attached to the given messages with their tallies.
+func (a *adapter) PollGetAll(topic string, forUser t.Uid, seqIds []int) ([]t.Poll, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT seqid,userid,options,multi,closedat FROM polls WHERE topic=$1 AND seqid IN (SELECT value FROM json_each($2)) ORDER BY seqid",
+		topic, seqIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var polls []t.Poll
+	index := map[int]int{}
+	for rows.Next() {
+		var p t.Poll
+		var from int64
+		if err = rows.Scan(&p.SeqId, &from, &p.Options, &p.Multi, &p.ClosedAt); err != nil {
+			break
+		}
+		p.From = store.EncodeUid(from).String()
+		p.Tally = make([]int, p.Options)
+		index[p.SeqId] = len(polls)
+		polls = append(polls, p)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil || len(polls) == 0 {
+		return nil, err
+	}
+
+	rows, err = a.db.Query(ctx,
+		"SELECT seqid,opt,COUNT(*),MAX(userid=$3) FROM pollvotes WHERE topic=$1 AND seqid IN (SELECT value FROM json_each($2)) "+
+			"GROUP BY seqid,opt ORDER BY seqid,opt",
+		topic, seqIds, store.DecodeUid(forUser))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seqId, opt, count int
+		var mine bool
+		if err = rows.Scan(&seqId, &opt, &count, &mine); err != nil {
+			return nil, err
+		}
+		i, ok := index[seqId]
+		if !ok || opt < 0 || opt >= polls[i].Options {
+			continue
+		}
+		p := &polls[i]
+		p.Tally[opt] = count
+		if mine {
+			p.Mine = append(p.Mine, opt)
+		}
+	}
+	return polls, rows.Err()
+}
+
+// TranslationGetAll returns cached translations of the given messages to the language.
+func (a *adapter) TranslationGetAll(topic, lang string, seqIds []int) ([]t.Translation, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT seqid,srclang,content FROM translations WHERE topic=$1 AND lang=$2 AND seqid IN (SELECT value FROM json_each($3)) ORDER BY seqid",
+		topic, lang, seqIds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var translations []t.Translation
+	for rows.Next() {
+		tr := t.Translation{Lang: lang}
+		var src *string
+		var content []byte
+		if err = rows.Scan(&tr.SeqId, &src, &content); err != nil {
+			return nil, err
+		}
+		if src != nil {
+			tr.Src = *src
+		}
+		if err = json.Unmarshal(content, &tr.Content); err != nil {
+			return nil, err
+		}
+		translations = append(translations, tr)
+	}
+	return translations, rows.Err()
+}
+
+// TranslationSave creates or replaces cached translations of messages.
+func (a *adapter) TranslationSave(topic string, translations []t.Translation) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	now := t.TimeNow()
+	for i := range translations {
+		tr := &translations[i]
+		content, err := json.Marshal(tr.Content)
+		if err != nil {
+			return err
+		}
+		var src any
+		if tr.Src != "" {
+			src = tr.Src
+		}
+		if _, err = a.db.Exec(ctx,
+			`INSERT INTO translations(topic,seqid,lang,srclang,content,createdat) VALUES($1,$2,$3,$4,$5,$6)
+				ON CONFLICT (topic,seqid,lang) DO UPDATE SET srclang=EXCLUDED.srclang,content=EXCLUDED.content,
+				createdat=EXCLUDED.createdat`,
+			topic, tr.SeqId, tr.Lang, src, string(content), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReportCreate saves a new report.
+func (a *adapter) ReportCreate(rpt *t.Report) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var comment any
+	if rpt.Comment != "" {
+		comment = rpt.Comment
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO reports(id,createdat,updatedat,reporter,target,topic,seqid,reason,comment,evidence,status) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)",
+		store.DecodeUid(rpt.Uid()), rpt.CreatedAt, rpt.UpdatedAt, store.DecodeUid(t.ParseUid(rpt.Reporter)),
+		store.DecodeUid(t.ParseUid(rpt.Target)), rpt.Topic, rpt.SeqId, rpt.Reason, comment,
+		toJSON(rpt.Evidence), rpt.Status)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+func reportScan(rows *rows) ([]t.Report, error) {
+	var reports []t.Report
+	var err error
+	for rows.Next() {
+		var rpt t.Report
+		var id, reporter, target int64
+		var resolvedBy *int64
+		var comment, action *string
+		if err = rows.Scan(&id, &rpt.CreatedAt, &rpt.UpdatedAt, &reporter, &target, &rpt.Topic, &rpt.SeqId,
+			&rpt.Reason, &comment, &rpt.Evidence, &rpt.Status, &rpt.Posted, &resolvedBy, &action); err != nil {
+			break
+		}
+		rpt.SetUid(store.EncodeUid(id))
+		rpt.Reporter = store.EncodeUid(reporter).String()
+		rpt.Target = store.EncodeUid(target).String()
+		if comment != nil {
+			rpt.Comment = *comment
+		}
+		if resolvedBy != nil {
+			rpt.ResolvedBy = store.EncodeUid(*resolvedBy).String()
+		}
+		if action != nil {
+			rpt.Action = *action
+		}
+		reports = append(reports, rpt)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	return reports, err
+}
+
+const reportFields = "id,createdat,updatedat,reporter,target,topic,seqid,reason,comment,evidence,status,posted," +
+	"resolvedby,action"
+
+// ReportGet returns the report by ID.
+func (a *adapter) ReportGet(id t.Uid) (*t.Report, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT "+reportFields+" FROM reports WHERE id=$1", store.DecodeUid(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports, err := reportScan(rows)
+	if err != nil || len(reports) == 0 {
+		return nil, err
+	}
+	return &reports[0], nil
+}
+
+// ReportClaim marks the report as posted to the 'rpt' topic. Only one caller succeeds.
+func (a *adapter) ReportClaim(id t.Uid) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "UPDATE reports SET posted=TRUE WHERE id=$1 AND posted=FALSE", store.DecodeUid(id))
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// ReportGetUnposted returns open reports not yet posted to the 'rpt' topic, oldest first.
+func (a *adapter) ReportGetUnposted(limit int) ([]t.Report, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx,
+		"SELECT "+reportFields+" FROM reports WHERE status=$1 AND posted=FALSE ORDER BY createdat LIMIT $2",
+		t.ReportOpen, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return reportScan(rows)
+}
+
+// ReportResolve closes an open report.
+func (a *adapter) ReportResolve(id t.Uid, status, action string, by t.Uid) (bool, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var act any
+	if action != "" {
+		act = action
+	}
+	res, err := a.db.Exec(ctx,
+		"UPDATE reports SET status=$1,action=$2,resolvedby=$3,updatedat=$4 WHERE id=$5 AND status=$6",
+		status, act, store.DecodeUid(by), t.TimeNow(), store.DecodeUid(id), t.ReportOpen)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// ModerationLogAdd saves a content moderation decision.
+func (a *adapter) ModerationLogAdd(rec *t.ModerationRecord) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var reason any
+	if rec.Reason != "" {
+		reason = rec.Reason
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO moderationlog(createdat,topic,seqid,userid,action,filter,reason) VALUES($1,$2,$3,$4,$5,$6,$7)",
+		rec.CreatedAt, rec.Topic, rec.SeqId, store.DecodeUid(t.ParseUserId(rec.From)), rec.Action, rec.Filter, reason)
+	return err
+}
+
+// ModerationLogGetAll returns the most recent moderation decisions, newest first.
+func (a *adapter) ModerationLogGetAll(topic string, limit int) ([]t.ModerationRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	query := "SELECT createdat,topic,seqid,userid,action,filter,reason FROM moderationlog"
+	args := []any{}
+	if topic != "" {
+		query += " WHERE topic=$1"
+		args = append(args, topic)
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	args = append(args, limit)
+	query += " ORDER BY createdat DESC,id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []t.ModerationRecord
+	for rows.Next() {
+		var rec t.ModerationRecord
+		var from int64
+		var reason *string
+		if err = rows.Scan(&rec.CreatedAt, &rec.Topic, &rec.SeqId, &from, &rec.Action, &rec.Filter, &reason); err != nil {
+			return nil, err
+		}
+		rec.From = store.EncodeUid(from).UserId()
+		if reason != nil {
+			rec.Reason = *reason
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// TakeoutCreate saves a new export of user's data.
+func (a *adapter) TakeoutCreate(tk *t.Takeout) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO takeouts(id,createdat,updatedat,userid,status) VALUES($1,$2,$3,$4,$5)",
+		store.DecodeUid(tk.Uid()), tk.CreatedAt, tk.UpdatedAt, store.DecodeUid(t.ParseUid(tk.User)), tk.Status)
+	return err
+}
+
+// TakeoutGetLast returns the most recent export of user's data.
+func (a *adapter) TakeoutGetLast(uid t.Uid) (*t.Takeout, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var tk t.Takeout
+	var id int64
+	var fileId *int64
+	var url *string
+	err := a.db.QueryRow(ctx, "SELECT id,createdat,updatedat,status,fileid,url,expiresat FROM takeouts "+
+		"WHERE userid=$1 ORDER BY createdat DESC LIMIT 1", store.DecodeUid(uid)).Scan(&id, &tk.CreatedAt,
+		&tk.UpdatedAt, &tk.Status, &fileId, &url, &tk.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tk.SetUid(store.EncodeUid(id))
+	tk.User = uid.String()
+	if fileId != nil {
+		tk.FileId = store.EncodeUid(*fileId).String()
+	}
+	if url != nil {
+		tk.Url = *url
+	}
+	return &tk, nil
+}
+
+// TakeoutFinish sets the final status of the export and the archive.
+func (a *adapter) TakeoutFinish(tk *t.Takeout) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var fileId, url any
+	if fid := t.ParseUid(tk.FileId); !fid.IsZero() {
+		fileId = store.DecodeUid(fid)
+		url = tk.Url
+	}
+	_, err := a.db.Exec(ctx, "UPDATE takeouts SET updatedat=$1,status=$2,fileid=$3,url=$4,expiresat=$5 WHERE id=$6",
+		tk.UpdatedAt, tk.Status, fileId, url, tk.ExpiresAt, store.DecodeUid(tk.Uid()))
+	return err
+}
+
+// auditUid converts user ID to a nullable DB value.
+func auditUid(userId string) any {
+	if uid := t.ParseUserId(userId); !uid.IsZero() {
+		return store.DecodeUid(uid)
+	}
+	return nil
+}
+
+// AuditLogAdd saves a record of a security-relevant event.
+func (a *adapter) AuditLogAdd(rec *t.AuditRecord) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var details any
+	if rec.Details != "" {
+		details = rec.Details
+	}
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO auditlog(createdat,event,actor,target,topic,remoteaddr,details) VALUES($1,$2,$3,$4,$5,$6,$7)",
+		rec.CreatedAt, rec.Event, auditUid(rec.Actor), auditUid(rec.Target), rec.Topic, rec.RemoteAddr, details)
+	return err
+}
+
+// AuditLogGetAll returns the most recent audit records matching the query, newest first.
+func (a *adapter) AuditLogGetAll(query *t.AuditQuery) ([]t.AuditRecord, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var where []string
+	var args []any
+	// Adds the condition with the value as the next positional argument '?'.
+	addCond := func(cond string, val any) {
+		args = append(args, val)
+		where = append(where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+	}
+	if query.Event != "" {
+		addCond("event=?", query.Event)
+	}
+	if uid := t.ParseUserId(query.User); !uid.IsZero() {
+		addCond("(actor=? OR target=?)", store.DecodeUid(uid))
+	}
+	if query.Topic != "" {
+		addCond("topic=?", query.Topic)
+	}
+	if !query.Since.IsZero() {
+		addCond("createdat>=?", query.Since)
+	}
+	if !query.Before.IsZero() {
+		addCond("createdat<?", query.Before)
+	}
+
+	sql := "SELECT createdat,event,actor,target,topic,remoteaddr,details FROM auditlog"
+	if len(where) > 0 {
+		sql += " WHERE " + strings.Join(where, " AND ")
+	}
+	limit := query.Limit
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	args = append(args, limit)
+	sql += " ORDER BY createdat DESC,id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []t.AuditRecord
+	for rows.Next() {
+		var rec t.AuditRecord
+		var actor, target *int64
+		var details *string
+		if err = rows.Scan(&rec.CreatedAt, &rec.Event, &actor, &target, &rec.Topic, &rec.RemoteAddr,
+			&details); err != nil {
+			return nil, err
+		}
+		if actor != nil {
+			rec.Actor = store.EncodeUid(*actor).UserId()
+		}
+		if target != nil {
+			rec.Target = store.EncodeUid(*target).UserId()
+		}
+		if details != nil {
+			rec.Details = *details
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// AuditLogExpire deletes audit records created before the given time.
+func (a *adapter) AuditLogExpire(before time.Time) (int, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(ctx, "DELETE FROM auditlog WHERE createdat<$1", before)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.RowsAffected()), nil
+}
+
+func deviceHasher(deviceID string) string {
+	// Generate custom key as [64-bit hash of device id] to ensure predictable
+	// length of the key
+	hasher := fnv.New64()
+	hasher.Write([]byte(deviceID))
+	return strconv.FormatUint(uint64(hasher.Sum64()), 16)
+}
+
+// Device management for push notifications
+func (a *adapter) DeviceUpsert(uid t.Uid, def *t.DeviceDef) error {
+	hash := deviceHasher(def.DeviceId)
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// Ensure uniqueness of the device ID: delete all records of the device ID
+	_, err = tx.Exec(ctx, "DELETE FROM devices WHERE hash=$1", hash)
+	if err != nil {
+		return err
+	}
+
+	// Actually add/update DeviceId for the new user
+	_, err = tx.Exec(ctx, "INSERT INTO devices(userid, hash, deviceId, platform, lastseen, lang) VALUES($1,$2,$3,$4,$5,$6)",
+		store.DecodeUid(uid), hash, def.DeviceId, def.Platform, def.LastSeen, def.Lang)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
+	var unums []any
+	for _, uid := range uids {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+
+	// Devices with disabled push notifications are skipped.
+	query, unums := expandQuery("SELECT userid,deviceid,platform,lastseen,lang FROM devices WHERE userid IN (?) "+
+		"AND NOT EXISTS (SELECT 1 FROM userdevices ud WHERE ud.userid=devices.userid AND "+
+		"ud.pushtoken=devices.deviceid AND NOT ud.push)", unums)
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, query, unums...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var device struct {
+		Userid   int64
+		Deviceid string
+		Platform string
+		Lastseen time.Time
+		Lang     string
+	}
+
+	result := make(map[t.Uid][]t.DeviceDef)
+	count := 0
+	for rows.Next() {
+		if err = rows.Scan(&device.Userid, &device.Deviceid, &device.Platform, &device.Lastseen, &device.Lang); err != nil {
+			break
+		}
+		uid := store.EncodeUid(device.Userid)
+		udev := result[uid]
+		udev = append(udev, t.DeviceDef{
+			DeviceId: device.Deviceid,
+			Platform: device.Platform,
+			LastSeen: device.Lastseen,
+			Lang:     device.Lang,
+		})
+		result[uid] = udev
+		count++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	return result, count, err
+}
+
+func deviceDelete(ctx context.Context, tx *txn, uid t.Uid, deviceID string) error {
+	var err error
+	var res result
+	if deviceID == "" {
+		res, err = tx.Exec(ctx, "DELETE FROM devices WHERE userid=$1", store.DecodeUid(uid))
+	} else {
+		res, err = tx.Exec(ctx, "DELETE FROM devices WHERE userid=$1 AND hash=$2", store.DecodeUid(uid), deviceHasher(deviceID))
+	}
+
+	if err == nil {
+		if count := res.RowsAffected(); count == 0 {
+			err = t.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	err = deviceDelete(ctx, tx, uid, deviceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Credential management
+
+// CredUpsert adds or updates a validation record. Returns true if inserted, false if updated.
+// 1. if credential is validated:
+// 1.1 Hard-delete unconfirmed equivalent record, if exists.
+// 1.2 Insert new. Report error if duplicate.
+// 2. if credential is not validated:
+// 2.1 Check if validated equivalent exist. If so, report an error.
+// 2.2 Soft-delete all unvalidated records of the same method.
+// 2.3 Undelete existing credential. Return if successful.
+// 2.4 Insert new credential record.
+func (a *adapter) CredUpsert(cred *t.Credential) (bool, error) {
+	var err error
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	now := t.TimeNow()
+	userId := common.DecodeUidString(cred.User)
+
+	// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
+	// if credential is not yet confirmed, "userid:method:value" is unique.
+	synth := cred.Method + ":" + cred.Value
+
+	if !cred.Done {
+		// Check if this credential is already validated.
+		var done bool
+		err = tx.QueryRow(ctx, "SELECT done FROM credentials WHERE synthetic=$1", synth).Scan(&done)
+		if err == nil {
+			// Assign err to ensure closing of a transaction.
+			err = t.ErrDuplicate
+			return false, err
+		}
+		if err != sql.ErrNoRows {
+			return false, err
+		}
+		// We are going to insert new record.
+		synth = cred.User + ":" + synth
+
+		// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
+		_, err = tx.Exec(ctx, "UPDATE credentials SET deletedat=$1 WHERE userid=$2 AND method=$3 AND done=FALSE",
+			now, userId, cred.Method)
+		if err != nil {
+			return false, err
+		}
+		// Assume that the record exists and try to update it: undelete, update timestamp and response value.
+		res, err := tx.Exec(ctx, "UPDATE credentials SET updatedat=$1,deletedat=NULL,resp=$2,done=FALSE WHERE synthetic=$3",
+			cred.UpdatedAt, cred.Resp, synth)
+		if err != nil {
+			return false, err
+		}
+		// If record was updated, then all is fine.
+		if numrows := res.RowsAffected(); numrows > 0 {
+			return false, tx.Commit(ctx)
+		}
+	} else {
+		// Hard-deleting unconformed record if it exists.
+		_, err = tx.Exec(ctx, "DELETE FROM credentials WHERE synthetic=$1", cred.User+":"+synth)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, "INSERT INTO credentials(createdat,updatedat,method,value,synthetic,userid,resp,done) "+
+		"VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+		cred.CreatedAt, cred.UpdatedAt, cred.Method, cred.Value, synth, userId, cred.Resp, cred.Done)
+	if err != nil {
+		if isDupe(err) {
+			return true, t.ErrDuplicate
+		}
+		return true, err
+	}
+	return true, tx.Commit(ctx)
+}
+
+// credDel deletes given validation method or all methods of the given user.
+// 1. If user is being deleted, hard-delete all records (method == "")
+// 2. If one value is being deleted:
+// 2.1 Delete it if it's valiated or if there were no attempts at validation
+// (otherwise it could be used to circumvent the limit on validation attempts).
+// 2.2 In that case mark it as soft-deleted.
+func credDel(ctx context.Context, tx *txn, uid t.Uid, method, value string) error {
+	constraints := " WHERE userid=?"
+	args := []any{store.DecodeUid(uid)}
+
+	if method != "" {
+		constraints += " AND method=?"
+		args = append(args, method)
+
+		if value != "" {
+			constraints += " AND value=?"
+			args = append(args, value)
+		}
+	}
+	where, _ := expandQuery(constraints, args...)
+
+	var err error
+	var res result
+	if method == "" {
+		// Case 1
+		res, err = tx.Exec(ctx, "DELETE FROM credentials"+where, args...)
+		if err == nil {
+			if count := res.RowsAffected(); count == 0 {
+				err = t.ErrNotFound
+			}
+		}
+		return err
+	}
+
+	// Case 2.1
+	res, err = tx.Exec(ctx, "DELETE FROM credentials"+where+" AND (done=TRUE OR retries=0)", args...)
+	if err != nil {
+		return err
+	}
+	if count := res.RowsAffected(); count > 0 {
+		return nil
+	}
+
+	// Case 2.2
+	query, args := expandQuery("UPDATE credentials SET deletedat=?"+constraints, t.TimeNow(), args)
+	res, err = tx.Exec(ctx, query, args...)
+	if err == nil {
+		if count := res.RowsAffected(); count >= 0 {
+			err = t.ErrNotFound
+		}
+	}
+
+	return err
+}
+
+// CredDel deletes either credentials of the given user. If method is blank all
+// credentials are removed. If value is blank all credentials of the given the
+// method are removed.
+func (a *adapter) CredDel(uid t.Uid, method, value string) error {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	err = credDel(ctx, tx, uid, method, value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// CredConfirm marks given credential method as confirmed.
+func (a *adapter) CredConfirm(uid t.Uid, method string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	res, err := a.db.Exec(
+		ctx,
+		"UPDATE credentials SET updatedat=$1,done=TRUE,synthetic=method||':'||value "+
+			"WHERE userid=$2 AND method=$3 AND deletedat IS NULL AND done=FALSE",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	if err != nil {
+		if isDupe(err) {
+			return t.ErrDuplicate
+		}
+		return err
+	}
+	if numrows := res.RowsAffected(); numrows < 1 {
+		return t.ErrNotFound
+	}
+	return nil
+}
+
+// CredFail increments failure count of the given validation method.
+func (a *adapter) CredFail(uid t.Uid, method string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	_, err := a.db.Exec(ctx, "UPDATE credentials SET updatedat=$1,retries=retries+1 WHERE userid=$2 AND method=$3 AND done=FALSE",
+		t.TimeNow(), store.DecodeUid(uid), method)
+	return err
+}
+
+// CredGetActive returns currently active unvalidated credential of the given user and method.
+func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var cred t.Credential
+
+	err := a.db.QueryRow(ctx, "SELECT createdat,updatedat,method,value,resp,done,retries "+
+		"FROM credentials WHERE userid=$1 AND deletedat IS NULL AND method=$2 AND done=FALSE",
+		store.DecodeUid(uid), method).Scan(&cred.CreatedAt, &cred.UpdatedAt, &cred.Method, &cred.Value, &cred.Resp, &cred.Done, &cred.Retries)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return nil, err
+	}
+	cred.User = uid.String()
+
+	return &cred, nil
+}
+
+// CredGetAll returns credential records for the given user and method, all or validated only.
+func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
+	query := "SELECT createdat,updatedat,method,value,resp,done,retries FROM credentials WHERE userid=$1 AND deletedat IS NULL"
+	args := []any{store.DecodeUid(uid)}
+	if method != "" {
+		query += " AND method=$2"
+		args = append(args, method)
+	}
+	if validatedOnly {
+		query += " AND done=TRUE"
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var credentials []t.Credential
+	rows, err := a.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cred t.Credential
+		if err = rows.Scan(&cred.CreatedAt, &cred.UpdatedAt, &cred.Method, &cred.Value, &cred.Resp, &cred.Done, &cred.Retries); err != nil {
+			credentials = nil
+			break
+		}
+
+		credentials = append(credentials, cred)
+	}
+
+	user := uid.String()
+	for i := range credentials {
+		credentials[i].User = user
+	}
+
+	return credentials, err
+}
+
+// FileUploads
+
+// FileStartUpload initializes a file upload
+func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var user any
+	if fd.User != "" {
+		user = store.DecodeUid(t.ParseUid(fd.User))
+	}
+	// The file belongs to the tenant of the uploader.
+	_, err := a.db.Exec(ctx,
+		"INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,etag,location,scan,media,tenant) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,COALESCE((SELECT tenant FROM users WHERE id=$4),''))",
+		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt, user,
+		fd.Status, fd.MimeType, fd.Size, fd.ETag, fd.Location, fileScanToJSON(fd.Scan), fileMediaToJSON(fd.Media))
+	return err
+}
+
+// FileFinishUpload marks file upload as completed, successfully or otherwise
+func (a *adapter) FileFinishUpload(fd *t.FileDef, success bool, size int64) (*t.FileDef, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	now := t.TimeNow()
+	if success {
+		status := t.UploadCompleted
+		if fd.Status == t.UploadQuarantined {
+			// Infected files are stored but not marked as completed.
+			status = t.UploadQuarantined
+		}
+		_, err = tx.Exec(ctx,
+			"UPDATE fileuploads SET updatedat=$1,status=$2,size=$3,etag=$4,location=$5,scan=$6,media=$7 WHERE id=$8",
+			now, status, size, fd.ETag, fd.Location, fileScanToJSON(fd.Scan), fileMediaToJSON(fd.Media),
+			store.DecodeUid(fd.Uid()))
+		if err != nil {
+			return nil, err
+		}
+
+		fd.Status = status
+		fd.Size = size
+	} else {
+		// Deleting the record: there is no value in keeping it in the DB.
+		_, err = tx.Exec(ctx, "DELETE FROM fileuploads WHERE id=$1", store.DecodeUid(fd.Uid()))
+		if err != nil {
+			return nil, err
+		}
+
+		fd.Status = t.UploadFailed
+		fd.Size = 0
+	}
+	fd.UpdatedAt = now
+
+	return fd, tx.Commit(ctx)
+}
+
+// fileScanToJSON serializes the result of a malware scan, nil if the file was not scanned.
+func fileScanToJSON(scan *t.FileScan) any {
+	if scan == nil {
+		return nil
+	}
+	return toJSON(scan)
+}
+
+// fileMediaToJSON serializes properties of the media file, nil if there are none.
+func fileMediaToJSON(media *t.MediaInfo) any {
+	if media == nil {
+		return nil
+	}
+	return toJSON(media)
+}
+
+// FileGet fetches a record of a specific file
+func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
+	id := t.ParseUid(fid)
+	if id.IsZero() {
+		return nil, t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var fd t.FileDef
+	var ID int64
+	var userId int64
+	var scan, media []byte
+	err := a.db.QueryRow(ctx, "SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,etag,location,scan,media,tenant "+
+		"FROM fileuploads WHERE id=$1", store.DecodeUid(id)).Scan(&ID, &fd.CreatedAt, &fd.UpdatedAt, &userId, &fd.Status,
+		&fd.MimeType, &fd.Size, &fd.ETag, &fd.Location, &scan, &media, &fd.Tenant)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fd.Id = common.EncodeUidString(fd.Id).String()
+	fd.User = store.EncodeUid(userId).String()
+	if len(scan) > 0 {
+		json.Unmarshal(scan, &fd.Scan)
+	}
+	if len(media) > 0 {
+		json.Unmarshal(media, &fd.Media)
+	}
+
+	return &fd, nil
+}
+
+// FileGetAllByUser returns records of all completed uploads by the user.
+func (a *adapter) FileGetAllByUser(uid t.Uid) ([]t.FileDef, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	rows, err := a.db.Query(ctx, "SELECT id,createdat,updatedat,status,mimetype,size,etag,location "+
+		"FROM fileuploads WHERE userid=$1 AND status=$2 ORDER BY id", store.DecodeUid(uid), t.UploadCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []t.FileDef
+	for rows.Next() {
+		var fd t.FileDef
+		var id int64
+		if err = rows.Scan(&id, &fd.CreatedAt, &fd.UpdatedAt, &fd.Status, &fd.MimeType, &fd.Size, &fd.ETag,
+			&fd.Location); err != nil {
+			return nil, err
+		}
+		fd.SetUid(store.EncodeUid(id))
+		fd.User = uid.String()
+		files = append(files, fd)
+	}
+	return files, rows.Err()
+}
+
+// FileUsageByUser returns the total size of completed uploads by the user.
+func (a *adapter) FileUsageByUser(uid t.Uid) (int64, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var size int64
+	err := a.db.QueryRow(ctx, "SELECT COALESCE(SUM(size),0) FROM fileuploads WHERE userid=$1 AND status=$2",
+		store.DecodeUid(uid), t.UploadCompleted).Scan(&size)
+	return size, err
+}
+
+// FileUsageByTopic returns the total size of completed uploads attached to the topic or its messages
+// together with the files fids which may not be attached yet. Files attached more than once are
+// counted once.
+func (a *adapter) FileUsageByTopic(topic string, fids []string) (int64, error) {
+	query := "SELECT COALESCE(SUM(size),0) FROM fileuploads WHERE status=? AND (id IN (" +
+		"SELECT fml.fileid FROM filemsglinks AS fml JOIN messages AS m ON m.id=fml.msgid WHERE m.topic=? " +
+		"UNION SELECT fileid FROM filemsglinks WHERE topic=?)"
+	args := []any{t.UploadCompleted, topic, topic}
+	var dids []any
+	for _, fid := range fids {
+		if id := t.ParseUid(fid); !id.IsZero() {
+			dids = append(dids, store.DecodeUid(id))
+		}
+	}
+	if len(dids) > 0 {
+		query += " OR id IN (?)"
+		args = append(args, dids)
+	}
+	query, args = expandQuery(query+")", args...)
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+	var size int64
+	err := a.db.QueryRow(ctx, query, args...).Scan(&size)
+	return size, err
+}
+
+// FileDeleteUnused deletes file upload records.
+func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// Garbage collecting entries which as either marked as deleted, or lack message references, or have no user assigned.
+	// Attachments of scheduled messages are kept until the messages are published, archives of takeouts
+	// until they expire. Quarantined files are kept for review.
+	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id " +
+		"WHERE fml.id IS NULL AND NOT EXISTS (SELECT 1 FROM scheduled AS s WHERE fu.id IN (SELECT value FROM json_each(s.fileids))) " +
+		"AND NOT EXISTS (SELECT 1 FROM takeouts AS tk WHERE tk.fileid=fu.id AND tk.expiresat>?) AND fu.status<>?"
+	args := []any{t.TimeNow(), t.UploadQuarantined}
+	if !olderThan.IsZero() {
+		query += " AND fu.updatedat<?"
+		args = append(args, olderThan)
+	}
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	query, _ = expandQuery(query, args...)
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var locations []string
+	var ids []any
+	for rows.Next() {
+		var id int
+		var loc string
+		if err = rows.Scan(&id, &loc); err != nil {
+			break
+		}
+		if loc != "" {
+			locations = append(locations, loc)
+		}
+		ids = append(ids, id)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ids) > 0 {
+		query, ids = expandQuery("DELETE FROM fileuploads WHERE id IN (?)", ids)
+		_, err = tx.Exec(ctx, query, ids...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return locations, tx.Commit(ctx)
+}
+
+// FileLinkAttachments connects given topic or message to the file record IDs from the list.
+func (a *adapter) FileLinkAttachments(topic string, userId, msgId t.Uid, fids []string) error {
+	if len(fids) == 0 || (topic == "" && msgId.IsZero() && userId.IsZero()) {
+		return t.ErrMalformed
+	}
+	now := t.TimeNow()
+
+	var args []any
+	var linkId any
+	var linkBy string
+	if !msgId.IsZero() {
+		linkBy = "msgid"
+		linkId = int64(msgId)
+	} else if topic != "" {
+		linkBy = "topic"
+		linkId = topic
+		// Only one attachment per topic is permitted at this time.
+		fids = fids[0:1]
+	} else {
+		linkBy = "userid"
+		linkId = store.DecodeUid(userId)
+		// Only one attachment per user is permitted at this time.
+		fids = fids[0:1]
+	}
+
+	// Decoded ids
+	var dids []any
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return t.ErrMalformed
+		}
+		dids = append(dids, store.DecodeUid(id))
+	}
+
+	for _, id := range dids {
+		// createdat,fileid,[msgid|topic|userid]
+		args = append(args, now, id, linkId)
+	}
+
+	ctx, cancel := a.getContextForTx()
+	if cancel != nil {
+		defer cancel()
+	}
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// Unlink earlier uploads on the same topic or user allowing them to be garbage-collected.
+	if msgId.IsZero() {
+		sql := "DELETE FROM filemsglinks WHERE " + linkBy + "=$1"
+		_, err = tx.Exec(ctx, sql, linkId)
+		if err != nil {
+			return err
+		}
+	}
+
+	query, args := expandQuery("INSERT INTO filemsglinks(createdat,fileid,"+linkBy+") VALUES (?,?,?)"+
+		strings.Repeat(",(?,?,?)", len(dids)-1), args...)
+	_, err = tx.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// PCacheGet reads a persistet cache entry.
+func (a *adapter) PCacheGet(key string) (string, error) {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var value string
+	if err := a.db.QueryRow(ctx, `SELECT "value" FROM kvmeta WHERE "key"=$1 LIMIT 1`, key).Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return "", t.ErrNotFound
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+// PCacheUpsert creates or updates a persistent cache entry.
+func (a *adapter) PCacheUpsert(key string, value string, failOnDuplicate bool) error {
+	if strings.Contains(key, "%") {
+		// Do not allow % in keys: it interferes with LIKE query.
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	var action string
+	if !failOnDuplicate {
+		action = ` ON CONFLICT ("key") DO UPDATE SET createdat=$2,"value"=$3`
+	}
+
+	_, err := a.db.Exec(ctx, `INSERT INTO kvmeta("key",createdat,"value") VALUES($1,$2,$3)`+action,
+		key, t.TimeNow(), value)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// PCacheDelete deletes one persistent cache entry.
+func (a *adapter) PCacheDelete(key string) error {
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.Exec(ctx, `DELETE FROM kvmeta WHERE "key"=$1`, key)
+	return err
+}
+
+// PCacheExpire expires old entries with the given key prefix.
+func (a *adapter) PCacheExpire(keyPrefix string, olderThan time.Time) error {
+	if keyPrefix == "" {
+		return t.ErrMalformed
+	}
+
+	ctx, cancel := a.getContext()
+	if cancel != nil {
+		defer cancel()
+	}
+
+	_, err := a.db.Exec(ctx, `DELETE FROM kvmeta WHERE "key" LIKE $1 ESCAPE '\' AND createdat<$2`,
+		likeEscaper.Replace(keyPrefix)+"%", olderThan)
+	return err
+}
+
+// GetTestDB returns a currently open database connection.
+func (a *adapter) GetTestDB() any {
+	return a.db.DB
+}
+
+// Helper functions
+
+// toJSON serializes the value as JSON text. SQLite treats blobs as binary JSON, so JSON is stored as text.
+func toJSON(src any) any {
+	if src == nil {
+		return nil
+	}
+	jval, _ := json.Marshal(src)
+	return string(jval)
+}
+
+// Check if SQLite error is a UNIQUE or PRIMARY KEY constraint violation.
+func isDupe(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed")
+}
+
+func isMissingTable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "no such table")
+}
+
+// setConnStr converts a config structure to a DSN connection string. Foreign keys are enforced,
+// LIKE is case-sensitive as in other databases, transactions take the write lock immediately to avoid
+// deadlocks between concurrent writers.
+func setConnStr(c configType) string {
+	busyTimeout := defaultBusyTimeout
+	if c.BusyTimeout > 0 {
+		busyTimeout = c.BusyTimeout
+	}
+
+	params := url.Values{}
+	params.Set("_fk", "1")
+	params.Set("_cslike", "1")
+	params.Set("_journal_mode", "WAL")
+	params.Set("_txlock", "immediate")
+	params.Set("_busy_timeout", strconv.Itoa(busyTimeout))
+	return "file:" + c.Path + "?" + params.Encode()
+}
+
+// expandQuery replaces the placeholders in the query with the actual values and returns
+// the expanded query and the arguments to be used in the query.
+func expandQuery(query string, args ...any) (string, []any) {
+	var expandedArgs []any
+	var expandedQuery string
+
+	if len(args) != strings.Count(query, "?") {
+		args = flattenSlice(args)
+	}
+	expandedQuery, expandedArgs, _ = sqlx.In(query, args...)
+	return sqlx.Rebind(sqlx.DOLLAR, expandedQuery), expandedArgs
+}
+
+// flatMap converts a slice of mixed values/slices into a flat slice.
+func flattenSlice(slice []any) []any {
+	var result []any
+	for _, v := range slice {
+		switch reflect.TypeOf(v).Kind() {
+		case reflect.Slice:
+			s := reflect.ValueOf(v)
+			for i := 0; i < s.Len(); i++ {
+				result = append(result, s.Index(i).Interface())
+			}
+		default:
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Rebind a query from ? to the target $ with custom initial value.
+func rebindWithStart(query string, startAt int) string {
+	// Add space enough for 10 params before we have to allocate
+	rqb := make([]byte, 0, len(query)+10)
+
+	var i, j = 0, startAt
+
+	for i = strings.Index(query, "?"); i != -1; i = strings.Index(query, "?") {
+		rqb = append(rqb, query[:i]...)
+		rqb = append(rqb, '$')
+
+		rqb = strconv.AppendInt(rqb, int64(j), 10)
+		j++
+
+		query = query[i+1:]
+	}
+
+	return string(append(rqb, query...))
+}
+
+// GetTestAdapter returns an adapter object. Useful for running tests.
+func GetTestAdapter() *adapter {
+	return &adapter{}
+}
+
+func init() {
+	store.RegisterAdapter(&adapter{})
+}
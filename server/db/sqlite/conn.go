@@ -0,0 +1,398 @@
+//go:build sqlite
+// +build sqlite
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thin wrappers of database/sql which convert values between Go and SQLite the way the PostgreSQL driver
+// does: maps, slices and structs are stored as JSON, times are stored as text and parsed on read.
+// Placeholders $1, $2 are rewritten as ?1, ?2.
+
+// Format of timestamps stored as text: fixed width, so that text order is the same as time order.
+// Millisecond precision is the same as in other adapters.
+const timestampFormat = "2006-01-02 15:04:05.000-07:00"
+
+// Formats of timestamps accepted on read.
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// querier is the common part of the database and a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// pool is the database.
+type pool struct {
+	*sql.DB
+}
+
+// txn is a transaction.
+type txn struct {
+	tx *sql.Tx
+}
+
+// rows is a result of a query.
+type rows struct {
+	*sql.Rows
+}
+
+// row is a result of a query which returns at most one row.
+type row struct {
+	rows *rows
+	err  error
+}
+
+// result is a result of a statement.
+type result struct {
+	sql.Result
+}
+
+// RowsAffected returns the number of rows changed by the statement.
+func (r result) RowsAffected() int64 {
+	n, _ := r.Result.RowsAffected()
+	return n
+}
+
+func (p *pool) Exec(ctx context.Context, query string, args ...any) (result, error) {
+	return exec(ctx, p.DB, query, args)
+}
+
+func (p *pool) Query(ctx context.Context, query string, args ...any) (*rows, error) {
+	return doQuery(ctx, p.DB, query, args)
+}
+
+func (p *pool) QueryRow(ctx context.Context, query string, args ...any) *row {
+	return queryRow(ctx, p.DB, query, args)
+}
+
+// Begin starts a transaction.
+func (p *pool) Begin(ctx context.Context) (*txn, error) {
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &txn{tx: tx}, nil
+}
+
+// Ping checks the connection to the database.
+func (p *pool) Ping(ctx context.Context) error {
+	return p.DB.PingContext(ctx)
+}
+
+// Stat returns statistics of the connection pool.
+func (p *pool) Stat() sql.DBStats {
+	return p.DB.Stats()
+}
+
+func (t *txn) Exec(ctx context.Context, query string, args ...any) (result, error) {
+	return exec(ctx, t.tx, query, args)
+}
+
+func (t *txn) Query(ctx context.Context, query string, args ...any) (*rows, error) {
+	return doQuery(ctx, t.tx, query, args)
+}
+
+func (t *txn) QueryRow(ctx context.Context, query string, args ...any) *row {
+	return queryRow(ctx, t.tx, query, args)
+}
+
+// Commit commits the transaction.
+func (t *txn) Commit(ctx context.Context) error {
+	return t.tx.Commit()
+}
+
+// Rollback aborts the transaction. It's a no-op if the transaction is already committed.
+func (t *txn) Rollback(ctx context.Context) error {
+	err := t.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	return err
+}
+
+func exec(ctx context.Context, q querier, query string, args []any) (result, error) {
+	args, err := convertArgs(args)
+	if err != nil {
+		return result{}, err
+	}
+	res, err := q.ExecContext(ctx, rebind(query), args...)
+	return result{res}, err
+}
+
+func doQuery(ctx context.Context, q querier, query string, args []any) (*rows, error) {
+	args, err := convertArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := q.QueryContext(ctx, rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{rs}, nil
+}
+
+func queryRow(ctx context.Context, q querier, query string, args []any) *row {
+	rs, err := doQuery(ctx, q, query, args)
+	return &row{rows: rs, err: err}
+}
+
+// Scan reads the first row of the result. Returns sql.ErrNoRows if the result is empty.
+func (r *row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	return r.rows.Scan(dest...)
+}
+
+// Close closes the result.
+func (r *rows) Close() {
+	r.Rows.Close()
+}
+
+// Scan reads values of the current row into dest. Values which database/sql can't convert are
+// read as is and converted here.
+func (r *rows) Scan(dest ...any) error {
+	tmp := make([]any, len(dest))
+	var convert []int
+	for i, d := range dest {
+		if isPlain(d) {
+			tmp[i] = d
+		} else {
+			tmp[i] = new(any)
+			convert = append(convert, i)
+		}
+	}
+	if err := r.Rows.Scan(tmp...); err != nil {
+		return err
+	}
+	for _, i := range convert {
+		if err := assign(dest[i], *(tmp[i].(*any))); err != nil {
+			return errors.New("sqlite: column " + strconv.Itoa(i) + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// isPlain checks if the destination is a pointer to a scalar which database/sql converts natively.
+func isPlain(dest any) bool {
+	if _, ok := dest.(sql.Scanner); ok {
+		return false
+	}
+	typ := reflect.TypeOf(dest)
+	if typ == nil || typ.Kind() != reflect.Pointer {
+		return false
+	}
+	typ = typ.Elem()
+	if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return typ.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+// assign converts the value read from the database and stores it in dest.
+func assign(dest, src any) error {
+	if s, ok := src.(string); ok {
+		src = []byte(s)
+	}
+
+	switch d := dest.(type) {
+	case *time.Time:
+		if src == nil {
+			*d = time.Time{}
+			return nil
+		}
+		ts, err := parseTime(src)
+		if err != nil {
+			return err
+		}
+		*d = ts
+		return nil
+	case **time.Time:
+		if src == nil {
+			*d = nil
+			return nil
+		}
+		ts, err := parseTime(src)
+		if err != nil {
+			return err
+		}
+		*d = &ts
+		return nil
+	case sql.Scanner:
+		return d.Scan(src)
+	}
+
+	// Everything else is JSON.
+	val := reflect.ValueOf(dest)
+	if val.Kind() != reflect.Pointer || val.IsNil() {
+		return errors.New("destination is not a pointer")
+	}
+	if src == nil {
+		val.Elem().Set(reflect.Zero(val.Elem().Type()))
+		return nil
+	}
+	var data []byte
+	switch s := src.(type) {
+	case []byte:
+		data = s
+	default:
+		// A number or a boolean.
+		var err error
+		if data, err = json.Marshal(s); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, dest)
+}
+
+// parseTime parses the timestamp stored as text. Times are returned in UTC.
+func parseTime(src any) (time.Time, error) {
+	switch s := src.(type) {
+	case time.Time:
+		return s.UTC(), nil
+	case []byte:
+		str := strings.TrimSuffix(string(s), "Z")
+		for _, format := range timestampFormats {
+			if ts, err := time.ParseInLocation(format, str, time.UTC); err == nil {
+				return ts.UTC(), nil
+			}
+		}
+		return time.Time{}, errors.New("invalid timestamp '" + str + "'")
+	case int64:
+		return time.Unix(s, 0).UTC(), nil
+	}
+	return time.Time{}, errors.New("unsupported timestamp type")
+}
+
+// formatTime formats the time for storing as text.
+func formatTime(ts time.Time) string {
+	return ts.UTC().Format(timestampFormat)
+}
+
+// convertArgs converts values which the driver does not support to JSON.
+func convertArgs(args []any) ([]any, error) {
+	out := make([]any, len(args))
+	for i, arg := range args {
+		val, err := convertArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = val
+	}
+	return out, nil
+}
+
+func convertArg(arg any) (any, error) {
+	switch v := arg.(type) {
+	case nil, string, bool, int, int32, int64, float64:
+		return v, nil
+	case []byte:
+		if v == nil {
+			return nil, nil
+		}
+		return v, nil
+	case time.Time:
+		return formatTime(v), nil
+	case *time.Time:
+		if v == nil {
+			return nil, nil
+		}
+		return formatTime(*v), nil
+	case driver.Valuer:
+		val := reflect.ValueOf(v)
+		if val.Kind() == reflect.Pointer && val.IsNil() {
+			return nil, nil
+		}
+		res, err := v.Value()
+		if b, ok := res.([]byte); ok {
+			// JSON produced by the value: stored as text.
+			return string(b), err
+		}
+		return res, err
+	}
+
+	val := reflect.ValueOf(arg)
+	switch val.Kind() {
+	case reflect.Pointer:
+		if val.IsNil() {
+			return nil, nil
+		}
+		return convertArg(val.Elem().Interface())
+	case reflect.String:
+		return val.String(), nil
+	case reflect.Bool:
+		return val.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(val.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), nil
+	case reflect.Map, reflect.Slice:
+		if val.IsNil() {
+			return nil, nil
+		}
+	}
+	data, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// rebind replaces placeholders $1, $2 with ?1, ?2 outside of string literals.
+func rebind(query string) string {
+	if !strings.Contains(query, "$") {
+		return query
+	}
+	out := make([]byte, 0, len(query))
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			quoted = !quoted
+		} else if c == '$' && !quoted && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+			c = '?'
+		}
+		out = append(out, c)
+	}
+	return string(out)
+}
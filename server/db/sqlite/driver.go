@@ -0,0 +1,33 @@
+//go:build sqlite
+// +build sqlite
+
+package sqlite
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"math"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Name of the SQLite driver with functions used by the adapter.
+const driverName = "sqlite3_tinode"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("power", math.Pow, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("sha256hex", sha256Hex, true)
+		},
+	})
+}
+
+// sha256Hex returns the SHA-256 hash of the string as a hex string.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
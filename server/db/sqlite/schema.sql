@@ -0,0 +1,2 @@
+# The SQLite schema is the same as the MySQL and PostgreSQL schemas save for differences in SQL flavors:
+# JSON and arrays are stored as TEXT, timestamps as TEXT in UTC. SEE ../mysql/schema.sql.
@@ -0,0 +1,2193 @@
+//go:build sqlite
+
+// To test another db backend:
+// 1) Create GetAdapter function inside your db backend adapter package (like one inside sqlite adapter)
+// 2) Uncomment your db backend package ('backend' named package)
+// 3) Write own initConnectionToDb and 'db' variable
+// 4) Replace sqlite specific db queries inside test to your own queries.
+// 5) Run.
+
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/store"
+	jcr "github.com/tinode/jsonco"
+
+	"github.com/tinode/chat/server/db/common/test_data"
+	backend "github.com/tinode/chat/server/db/sqlite"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+type configType struct {
+	// If Reset=true test will recreate database every time it runs
+	Reset bool `json:"reset_db_data"`
+	// Configurations for individual adapters.
+	Adapters map[string]json.RawMessage `json:"adapters"`
+}
+
+var config configType
+var adp adapter.Adapter
+var db *sql.DB
+var testData *test_data.TestData
+var ctx context.Context
+
+var dummyUid1 = types.Uid(12345)
+var dummyUid2 = types.Uid(54321)
+
+func TestCreateDb(t *testing.T) {
+	if err := adp.CreateDb(config.Reset); err != nil {
+		t.Fatal(err)
+	}
+	// Saved db is closed, get a fresh one.
+	db = adp.GetTestDB().(*sql.DB)
+}
+
+// ================== Create tests ================================
+func TestUserCreate(t *testing.T) {
+	for _, user := range testData.Users {
+		if err := adp.UserCreate(user); err != nil {
+			t.Error(err)
+		}
+	}
+	var count int
+
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
+	if err != nil {
+		t.Error(err)
+	}
+	if count == 0 {
+		t.Error("No users created!")
+	}
+}
+
+func TestCredUpsert(t *testing.T) {
+	// Test just inserts:
+	for i := 0; i < 2; i++ {
+		inserted, err := adp.CredUpsert(testData.Creds[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !inserted {
+			t.Error("Should be inserted, but updated")
+		}
+	}
+
+	// Test duplicate:
+	_, err := adp.CredUpsert(testData.Creds[1])
+	if err != types.ErrDuplicate {
+		t.Error("Should return duplicate error but got", err)
+	}
+	_, err = adp.CredUpsert(testData.Creds[2])
+	if err != types.ErrDuplicate {
+		t.Error("Should return duplicate error but got", err)
+	}
+
+	// Test add new unvalidated credentials
+	inserted, err := adp.CredUpsert(testData.Creds[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inserted {
+		t.Error("Should be inserted, but updated")
+	}
+	inserted, err = adp.CredUpsert(testData.Creds[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted {
+		t.Error("Should be updated, but inserted")
+	}
+
+	// Just insert other creds (used in other tests)
+	for _, cred := range testData.Creds[4:] {
+		_, err = adp.CredUpsert(cred)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuthAddRecord(t *testing.T) {
+	for _, rec := range testData.Recs {
+		err := adp.AuthAddRecord(types.ParseUserId("usr"+rec.UserId), rec.Scheme, rec.Unique,
+			rec.AuthLvl, rec.Secret, rec.Expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Test duplicate
+	err := adp.AuthAddRecord(types.ParseUserId("usr"+testData.Users[0].Id), testData.Recs[0].Scheme,
+		testData.Recs[0].Unique, testData.Recs[0].AuthLvl, testData.Recs[0].Secret, testData.Recs[0].Expires)
+	if err != types.ErrDuplicate {
+		t.Fatal("Should be duplicate error but got", err)
+	}
+}
+
+func TestTopicCreate(t *testing.T) {
+	err := adp.TopicCreate(testData.Topics[0])
+	if err != nil {
+		t.Error(err)
+	}
+	// Update topic SeqId because it's not saved at creation time but used by the tests.
+	err = adp.TopicUpdate(testData.Topics[0].Id, map[string]interface{}{
+		"seqid": testData.Topics[0].SeqId,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, tpc := range testData.Topics[3:] {
+		err = adp.TopicCreate(tpc)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func decodeUid(u string) int64 {
+	return store.DecodeUid(types.ParseUid(u))
+}
+
+func encodeUid(u string) types.Uid {
+	id, _ := strconv.ParseInt(u, 10, 64)
+	return store.EncodeUid(int64(id))
+}
+
+func TestTopicCreateP2P(t *testing.T) {
+	err := adp.TopicCreateP2P(testData.Subs[2], testData.Subs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldModeGiven := testData.Subs[2].ModeGiven
+	testData.Subs[2].ModeGiven = 255
+	err = adp.TopicCreateP2P(testData.Subs[4], testData.Subs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got types.Subscription
+	var userId int64
+	var modeWant, modeGiven []byte
+	err = db.QueryRowContext(ctx, "SELECT createdat,updatedat,deletedat,userid,topic,delid,recvseqid,readseqid,modewant,modegiven,private FROM subscriptions WHERE topic=$1 AND userid=$2",
+		testData.Subs[2].Topic, decodeUid(testData.Subs[2].User)).Scan(&got.CreatedAt,
+		&got.UpdatedAt, &got.DeletedAt, &userId, &got.Topic, &got.DelId, &got.RecvSeqId, &got.ReadSeqId,
+		&modeWant, &modeGiven, &got.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got.ModeGiven.Scan(modeGiven)
+	if got.ModeGiven == oldModeGiven {
+		t.Error("ModeGiven update failed")
+	}
+}
+
+func TestTopicShare(t *testing.T) {
+	if err := adp.TopicShare(testData.Subs[0].Topic, testData.Subs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Must save recvseqid and readseqid separately because TopicShare
+	// ignores them.
+	for _, sub := range testData.Subs {
+		adp.SubsUpdate(sub.Topic, types.ParseUid(sub.User), map[string]any{
+			"delid":     sub.DelId,
+			"recvseqid": sub.RecvSeqId,
+			"readseqid": sub.ReadSeqId,
+		})
+	}
+
+	// Update topic SeqId because it's not saved at creation time but used by the tests.
+	for _, tpc := range testData.Topics {
+		err := adp.TopicUpdate(tpc.Id, map[string]any{
+			"seqid": tpc.SeqId,
+			"delid": tpc.DelId,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMessageSave(t *testing.T) {
+	for _, msg := range testData.Msgs {
+		err := adp.MessageSave(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Some messages are soft deleted, but it's ignored by adp.MessageSave
+	for _, msg := range testData.Msgs {
+		if len(msg.DeletedFor) > 0 {
+			for _, del := range msg.DeletedFor {
+				toDel := types.DelMessage{
+					Topic:       msg.Topic,
+					DeletedFor:  del.User,
+					DelId:       del.DelId,
+					SeqIdRanges: []types.Range{{Low: msg.SeqId}},
+				}
+				adp.MessageDeleteList(msg.Topic, &toDel)
+			}
+		}
+	}
+}
+
+func TestFileStartUpload(t *testing.T) {
+	for _, f := range testData.Files {
+		err := adp.FileStartUpload(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ================== Read tests ==================================
+func TestUserGet(t *testing.T) {
+	// Test not found
+	got, err := adp.UserGet(dummyUid1)
+	if err == nil && got != nil {
+		t.Error("user should be nil.")
+	}
+
+	got, err = adp.UserGet(types.ParseUserId("usr" + testData.Users[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// User agent is not stored when creating a user. Make sure it's the same.
+	got.UserAgent = testData.Users[0].UserAgent
+
+	if !reflect.DeepEqual(got, testData.Users[0]) {
+		t.Error(mismatchErrorString("User", got, testData.Users[0]))
+	}
+}
+
+func TestUserGetAll(t *testing.T) {
+	// Test not found (dummy UIDs).
+	got, err := adp.UserGetAll(dummyUid1, dummyUid2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) > 0 {
+		t.Error("result users should be zero length, got", len(got))
+	}
+
+	got, err = adp.UserGetAll(types.ParseUserId("usr"+testData.Users[0].Id), types.ParseUserId("usr"+testData.Users[1].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatal(mismatchErrorString("resultUsers length", len(got), 2))
+	}
+	for i, usr := range got {
+		// User agent is not compared.
+		usr.UserAgent = testData.Users[i].UserAgent
+		if !reflect.DeepEqual(&usr, testData.Users[i]) {
+			t.Error(mismatchErrorString("User", &usr, testData.Users[i]))
+		}
+	}
+}
+
+func TestUserGetByCred(t *testing.T) {
+	// Test not found
+	got, err := adp.UserGetByCred("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != types.ZeroUid {
+		t.Error("result uid should be ZeroUid")
+	}
+
+	got, _ = adp.UserGetByCred(testData.Creds[0].Method, testData.Creds[0].Value)
+	if got != types.ParseUserId("usr"+testData.Creds[0].User) {
+		t.Error(mismatchErrorString("Uid", got, types.ParseUserId("usr"+testData.Creds[0].User)))
+	}
+}
+
+func TestCredGetActive(t *testing.T) {
+	got, err := adp.CredGetActive(types.ParseUserId("usr"+testData.Users[2].Id), "tel")
+	if err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(got, testData.Creds[3]) {
+		t.Error(mismatchErrorString("Credential", got, testData.Creds[3]))
+	}
+
+	// Test not found
+	got, err = adp.CredGetActive(dummyUid1, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if got != nil {
+		t.Error("result should be nil, but got", got)
+	}
+}
+
+func TestCredGetAll(t *testing.T) {
+	got, err := adp.CredGetAll(types.ParseUserId("usr"+testData.Users[2].Id), "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Error(mismatchErrorString("Credentials length", len(got), 3))
+	}
+
+	got, _ = adp.CredGetAll(types.ParseUserId("usr"+testData.Users[2].Id), "tel", false)
+	if len(got) != 2 {
+		t.Error(mismatchErrorString("Credentials length", len(got), 2))
+	}
+
+	got, _ = adp.CredGetAll(types.ParseUserId("usr"+testData.Users[2].Id), "", true)
+	if len(got) != 1 {
+		t.Error(mismatchErrorString("Credentials length", len(got), 1))
+	}
+
+	got, _ = adp.CredGetAll(types.ParseUserId("usr"+testData.Users[2].Id), "tel", true)
+	if len(got) != 1 {
+		t.Error(mismatchErrorString("Credentials length", len(got), 1))
+	}
+}
+
+func TestAuthGetUniqueRecord(t *testing.T) {
+	uid, authLvl, secret, expires, err := adp.AuthGetUniqueRecord("basic:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid != types.ParseUserId("usr"+testData.Recs[0].UserId) ||
+		authLvl != testData.Recs[0].AuthLvl ||
+		!reflect.DeepEqual(secret, testData.Recs[0].Secret) ||
+		expires != testData.Recs[0].Expires {
+
+		got := fmt.Sprintf("%v %v %v %v", uid, authLvl, secret, expires)
+		want := fmt.Sprintf("%v %v %v %v", testData.Recs[0].UserId, testData.Recs[0].AuthLvl, testData.Recs[0].Secret, testData.Recs[0].Expires)
+		t.Error(mismatchErrorString("Auth record", got, want))
+	}
+
+	// Test not found
+	uid, _, _, _, err = adp.AuthGetUniqueRecord("qwert:asdfg")
+	if err == nil && !uid.IsZero() {
+		t.Error("Auth record found but shouldn't. Uid:", uid.String())
+	}
+}
+
+func TestAuthGetRecord(t *testing.T) {
+	recId, authLvl, secret, expires, err := adp.AuthGetRecord(types.ParseUserId("usr"+testData.Recs[0].UserId), "basic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recId != testData.Recs[0].Unique ||
+		authLvl != testData.Recs[0].AuthLvl ||
+		!reflect.DeepEqual(secret, testData.Recs[0].Secret) ||
+		expires != testData.Recs[0].Expires {
+
+		got := fmt.Sprintf("%v %v %v %v", recId, authLvl, secret, expires)
+		want := fmt.Sprintf("%v %v %v %v", testData.Recs[0].Unique, testData.Recs[0].AuthLvl, testData.Recs[0].Secret, testData.Recs[0].Expires)
+		t.Error(mismatchErrorString("Auth record", got, want))
+	}
+
+	// Test not found
+	recId, _, _, _, err = adp.AuthGetRecord(types.Uid(123), "scheme")
+	if err != types.ErrNotFound {
+		t.Error("Auth record found but shouldn't. recId:", recId)
+	}
+}
+
+func TestTopicGet(t *testing.T) {
+	got, err := adp.TopicGet(testData.Topics[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, testData.Topics[0]) {
+		t.Error(mismatchErrorString("Topic", got, testData.Topics[0]))
+	}
+	// Test not found
+	got, err = adp.TopicGet("asdfasdfasdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Error("Topic should be nil but got:", got)
+	}
+}
+
+func TestTopicsForUser(t *testing.T) {
+	qOpts := types.QueryOpt{
+		Topic: "p2p9AVDamaNCRbfKzGSh3mE0w",
+		Limit: 999,
+	}
+	gotSubs, err := adp.TopicsForUser(types.ParseUserId("usr"+testData.Users[0].Id), false, &qOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 1 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 1))
+	}
+
+	gotSubs, err = adp.TopicsForUser(types.ParseUserId("usr"+testData.Users[1].Id), true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 2 {
+		t.Error(mismatchErrorString("Subs length (2)", len(gotSubs), 2))
+	}
+
+	qOpts.Topic = ""
+	ims := testData.Now.Add(15 * time.Minute)
+	qOpts.IfModifiedSince = &ims
+	gotSubs, err = adp.TopicsForUser(types.ParseUserId("usr"+testData.Users[0].Id), false, &qOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 1 {
+		t.Error(mismatchErrorString("Subs length (IMS)", len(gotSubs), 1))
+	}
+
+	ims = time.Now().Add(15 * time.Minute)
+	gotSubs, err = adp.TopicsForUser(types.ParseUserId("usr"+testData.Users[0].Id), false, &qOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 0 {
+		t.Error(mismatchErrorString("Subs length (IMS 2)", len(gotSubs), 0))
+	}
+}
+
+func TestUsersForTopic(t *testing.T) {
+	qOpts := types.QueryOpt{
+		User:  types.ParseUserId("usr" + testData.Users[0].Id),
+		Limit: 999,
+	}
+	gotSubs, err := adp.UsersForTopic("grpgRXf0rU4uR4", false, &qOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 1 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 1))
+	}
+
+	gotSubs, err = adp.UsersForTopic("grpgRXf0rU4uR4", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 2 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 2))
+	}
+
+	gotSubs, err = adp.UsersForTopic("p2p9AVDamaNCRbfKzGSh3mE0w", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 2 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 2))
+	}
+}
+
+func TestOwnTopics(t *testing.T) {
+	gotSubs, err := adp.OwnTopics(types.ParseUserId("usr" + testData.Users[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotSubs) != 1 {
+		t.Fatalf("Got topic length %v instead of %v", len(gotSubs), 1)
+	}
+	if gotSubs[0] != testData.Topics[0].Id {
+		t.Errorf("Got topic %v instead of %v", gotSubs[0], testData.Topics[0].Id)
+	}
+}
+
+func TestChannelsForUser(t *testing.T) {
+	// Test channels for user (PostgreSQL specific test)
+	channels, err := adp.ChannelsForUser(types.ParseUserId("usr" + testData.Users[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Should return empty slice since we don't have channel subscriptions in test data
+	if len(channels) != 0 {
+		t.Error(mismatchErrorString("Channels length", len(channels), 0))
+	}
+}
+
+func TestSubscriptionGet(t *testing.T) {
+	got, err := adp.SubscriptionGet(testData.Topics[0].Id, types.ParseUserId("usr"+testData.Users[0].Id), false)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if diff := cmp.Diff(got, testData.Subs[0],
+		cmpopts.IgnoreUnexported(types.Subscription{}, types.ObjHeader{})); diff != "" {
+		t.Error(mismatchErrorString("Subs", diff, ""))
+	}
+	// Test not found
+	got, err = adp.SubscriptionGet("dummytopic", dummyUid1, false)
+	if err != nil {
+		t.Error(err)
+	}
+	if got != nil {
+		t.Error("result sub should be nil.")
+	}
+}
+
+func TestSubsForUser(t *testing.T) {
+	gotSubs, err := adp.SubsForUser(types.ParseUserId("usr" + testData.Users[0].Id))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gotSubs) != 2 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 2))
+	}
+
+	// Test not found
+	gotSubs, err = adp.SubsForUser(types.ParseUserId("usr12345678"))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gotSubs) != 0 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 0))
+	}
+}
+
+func TestSubsForTopic(t *testing.T) {
+	qOpts := types.QueryOpt{
+		User:  types.ParseUserId("usr" + testData.Users[0].Id),
+		Limit: 999,
+	}
+	gotSubs, err := adp.SubsForTopic(testData.Topics[0].Id, false, &qOpts)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gotSubs) != 1 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 1))
+	}
+	// Test not found
+	gotSubs, err = adp.SubsForTopic("dummytopicid", false, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(gotSubs) != 0 {
+		t.Error(mismatchErrorString("Subs length", len(gotSubs), 0))
+	}
+}
+
+func TestFind(t *testing.T) {
+	reqTags := [][]string{{"alice", "bob", "carol", "travel", "qwer", "asdf", "zxcv"}}
+	got, err := adp.Find("usr"+testData.Users[2].Id, "", "", reqTags, nil, true)
+	if err != nil {
+		t.Error(err)
+	} else if len(got) != 3 {
+		t.Error(mismatchErrorString("result length", len(got), 3))
+	}
+}
+
+func TestFindOne(t *testing.T) {
+	// Test PostgreSQL specific FindOne method
+	found, err := adp.FindOne("", "alice")
+	if err != nil {
+		t.Error(err)
+	}
+	// Should find the user with alice tag
+	if found == "" {
+		t.Error("Expected to find user with alice tag")
+	}
+
+	// Test not found
+	found, err = adp.FindOne("", "nonexistent")
+	if err != nil {
+		t.Error(err)
+	}
+	if found != "" {
+		t.Error("Should not find nonexistent tag")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	tenant := &types.Tenant{Id: "acme", Name: "Acme", Hosts: types.StringSlice{"chat.acme.com"},
+		Config: types.TenantConfig{AuthSchemes: []string{"basic"}, UserQuota: 10}}
+	tenant.CreatedAt = types.TimeNow()
+	tenant.UpdatedAt = tenant.CreatedAt
+	if err := adp.TenantsCreate(tenant); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.TenantsCreate(tenant); err != types.ErrDuplicate {
+		t.Error(mismatchErrorString("duplicate", err, types.ErrDuplicate))
+	}
+
+	tenant.Config.UserQuota = 20
+	if ok, err := adp.TenantsUpdate(tenant); err != nil || !ok {
+		t.Error("Failed to update tenant", err)
+	}
+	got, err := adp.TenantsGetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Hosts[0] != "chat.acme.com" || got[0].Config.UserQuota != 20 {
+		t.Error(mismatchErrorString("Tenants", got, tenant))
+	}
+
+	// Users of the default tenant are not visible in other tenants.
+	if found, err := adp.FindOne("acme", "alice"); err != nil || found != "" {
+		t.Error("Found user of another tenant", found, err)
+	}
+
+	if ok, err := adp.TenantsDelete("acme"); err != nil || !ok {
+		t.Error("Failed to delete tenant", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	uid := types.ParseUserId("usr" + testData.Users[0].Id)
+	for i := 0; i < 2; i++ {
+		if err := adp.UsageAdd([]types.UsageRecord{
+			{Period: "2026-10", User: testData.Users[0].Id, Messages: 2, Pushes: 1, CallSeconds: 60},
+			{Period: "2026-10", User: testData.Users[1].Id, Messages: 1},
+			{Period: "2026-09", User: testData.Users[0].Id, Messages: 5},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := adp.UsageGet("2026-10", uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Messages != 4 || got.Pushes != 2 || got.CallSeconds != 120 {
+		t.Error(mismatchErrorString("Usage", got, "messages 4, pushes 2, call seconds 120"))
+	}
+
+	total, err := adp.UsageTotal("2026-10", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Messages != 6 || total.Pushes != 2 {
+		t.Error(mismatchErrorString("Total usage", total, "messages 6, pushes 2"))
+	}
+
+	list, err := adp.UsageList("2026-09", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].User != testData.Users[0].Id || list[0].Messages != 10 {
+		t.Error(mismatchErrorString("Usage list", list, "messages 10 of the first user"))
+	}
+	if list, err = adp.UsageList("2026-10", []string{"acme"}); err != nil || len(list) != 0 {
+		t.Error(mismatchErrorString("Usage of tenant", list, "none"), err)
+	}
+}
+
+func TestMessageGetAll(t *testing.T) {
+	opts := types.QueryOpt{
+		Since:  1,
+		Before: 2,
+		Limit:  999,
+	}
+	gotMsgs, err := adp.MessageGetAll(testData.Topics[0].Id, types.ParseUserId("usr"+testData.Users[0].Id), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotMsgs) != 1 {
+		t.Error(mismatchErrorString("Messages length opts", len(gotMsgs), 1))
+	}
+	gotMsgs, _ = adp.MessageGetAll(testData.Topics[0].Id, types.ParseUserId("usr"+testData.Users[0].Id), nil)
+	if len(gotMsgs) != 2 {
+		t.Error(mismatchErrorString("Messages length no opts", len(gotMsgs), 2))
+	}
+	gotMsgs, _ = adp.MessageGetAll(testData.Topics[0].Id, types.ZeroUid, nil)
+	if len(gotMsgs) != 3 {
+		t.Error(mismatchErrorString("Messages length zero uid", len(gotMsgs), 3))
+	}
+}
+
+func TestFileGet(t *testing.T) {
+	// General test done during TestFileFinishUpload().
+
+	// Test not found
+	got, err := adp.FileGet("dummyfileid")
+	if err != nil && got != nil {
+		t.Error("File found but shouldn't:", got)
+	}
+}
+
+// ================== Update tests ================================
+func TestUserUpdate(t *testing.T) {
+	update := map[string]any{
+		"UserAgent": "Test Agent v0.11",
+		"UpdatedAt": testData.Now.Add(30 * time.Minute),
+	}
+	err := adp.UserUpdate(types.ParseUserId("usr"+testData.Users[0].Id), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		UserAgent string
+		UpdatedAt time.Time
+		CreatedAt time.Time
+	}
+	err = db.QueryRowContext(ctx, "SELECT useragent, updatedat, createdat FROM users WHERE id=$1",
+		decodeUid(testData.Users[0].Id)).Scan(&got.UserAgent, &got.UpdatedAt, &got.CreatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserAgent != "Test Agent v0.11" {
+		t.Error(mismatchErrorString("UserAgent", got.UserAgent, "Test Agent v0.11"))
+	}
+	if got.UpdatedAt == got.CreatedAt {
+		t.Error("UpdatedAt field not updated")
+	}
+}
+
+func TestUserUpdateTags(t *testing.T) {
+	addTags := testData.Tags[0]
+	removeTags := testData.Tags[1]
+	resetTags := testData.Tags[2]
+	uid := types.ParseUserId("usr" + testData.Users[0].Id)
+
+	got, err := adp.UserUpdateTags(uid, addTags, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice", "tag1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Error(mismatchErrorString("Tags", got, want))
+	}
+
+	got, err = adp.UserUpdateTags(uid, nil, removeTags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Error(mismatchErrorString("Tags", got, want))
+	}
+
+	got, err = adp.UserUpdateTags(uid, nil, nil, resetTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"alice", "tag111", "tag333"}
+	if !reflect.DeepEqual(got, want) {
+		t.Error(mismatchErrorString("Tags", got, want))
+	}
+
+	got, err = adp.UserUpdateTags(uid, addTags, removeTags, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"tag111", "tag333"}
+	if !reflect.DeepEqual(got, want) {
+		t.Error(mismatchErrorString("Tags", got, want))
+	}
+}
+
+func TestUserStatus(t *testing.T) {
+	uid := types.ParseUserId("usr" + testData.Users[0].Id)
+	expires := testData.Now.Add(time.Hour).Round(time.Millisecond)
+	status := &types.UserStatus{Emoji: "🏖", Text: "On vacation", ExpiresAt: &expires}
+	if err := adp.UserUpdate(uid, map[string]any{"Status": status}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := adp.UserGet(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status == nil || got.Status.Text != status.Text || !got.Status.ExpiresAt.Equal(expires) {
+		t.Error(mismatchErrorString("Status", got.Status, status))
+	}
+
+	// In p2p topics the status of the other user is reported.
+	subs, err := adp.UsersForTopic("p2p9AVDamaNCRbfKzGSh3mE0w", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range subs {
+		other := types.ParseUid(subs[i].User) != uid
+		if reported := subs[i].GetStatus() != nil; reported != other {
+			t.Error(mismatchErrorString("Status of "+subs[i].User, reported, other))
+		}
+	}
+
+	if err = adp.UserUpdate(uid, map[string]any{"Status": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = adp.UserGet(uid); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != nil {
+		t.Error(mismatchErrorString("Status", got.Status, nil))
+	}
+}
+
+func TestUserGetUnvalidated(t *testing.T) {
+	// Test PostgreSQL specific method
+	cutoff := time.Now().Add(-24 * time.Hour)
+	uids, err := adp.UserGetUnvalidated(cutoff, 10)
+	if err != nil {
+		t.Error(err)
+	}
+	// Should return empty slice since all test users are considered validated
+	if len(uids) > 0 {
+		t.Error("Expected no unvalidated users in test data")
+	}
+}
+
+func TestCredFail(t *testing.T) {
+	err := adp.CredFail(types.ParseUserId("usr"+testData.Creds[3].User), "tel")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Check if fields updated
+	var got struct {
+		Retries   int
+		UpdatedAt time.Time
+		CreatedAt time.Time
+	}
+	err = db.QueryRowContext(ctx, "SELECT retries, updatedat, createdat FROM credentials WHERE userid=$1 AND method=$2 AND value=$3",
+		decodeUid(testData.Creds[3].User), "tel", testData.Creds[3].Value).Scan(&got.Retries, &got.UpdatedAt, &got.CreatedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Retries != 1 {
+		t.Error(mismatchErrorString("Retries count", got.Retries, 1))
+	}
+	if got.UpdatedAt == got.CreatedAt {
+		t.Error("UpdatedAt field not updated")
+	}
+}
+
+func TestCredConfirm(t *testing.T) {
+	err := adp.CredConfirm(types.ParseUserId("usr"+testData.Creds[3].User), "tel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test fields are updated
+	var got struct {
+		UpdatedAt time.Time
+		CreatedAt time.Time
+		Done      bool
+	}
+	err = db.QueryRowContext(ctx, "SELECT updatedat, createdat, done FROM credentials WHERE userid=$1 AND method=$2 AND value=$3",
+		decodeUid(testData.Creds[3].User), "tel", testData.Creds[3].Value).Scan(&got.UpdatedAt, &got.CreatedAt, &got.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UpdatedAt == got.CreatedAt {
+		t.Error("Credential not updated correctly")
+	}
+	if !got.Done {
+		t.Error("Credential should be marked as done")
+	}
+}
+
+func TestAuthUpdRecord(t *testing.T) {
+	rec := testData.Recs[1]
+	newSecret := []byte{'s', 'e', 'c', 'r', 'e', 't'}
+	err := adp.AuthUpdRecord(types.ParseUserId("usr"+rec.UserId), rec.Scheme, rec.Unique,
+		rec.AuthLvl, newSecret, rec.Expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	err = db.QueryRowContext(ctx, "SELECT secret FROM auth WHERE uname=$1", rec.Unique).Scan(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(got, rec.Secret) {
+		t.Error(mismatchErrorString("Secret", got, rec.Secret))
+	}
+
+	// Test with auth ID (unique) change
+	newId := "basic:bob12345"
+	err = adp.AuthUpdRecord(types.ParseUserId("usr"+rec.UserId), rec.Scheme, newId,
+		rec.AuthLvl, newSecret, rec.Expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Test if old ID deleted
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM auth WHERE uname=$1", rec.Unique).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Old auth record not deleted")
+	}
+}
+
+func TestTopicUpdateOnMessage(t *testing.T) {
+	msg := types.Message{
+		ObjHeader: types.ObjHeader{
+			CreatedAt: testData.Now.Add(33 * time.Minute),
+		},
+		SeqId: 66,
+	}
+	err := adp.TopicUpdateOnMessage(testData.Topics[2].Id, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		TouchedAt time.Time
+		SeqId     int
+	}
+	err = db.QueryRowContext(ctx, "SELECT touchedat, seqid FROM topics WHERE name=$1", testData.Topics[2].Id).
+		Scan(&got.TouchedAt, &got.SeqId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TouchedAt != msg.CreatedAt || got.SeqId != msg.SeqId {
+		t.Error(mismatchErrorString("TouchedAt", got.TouchedAt, msg.CreatedAt))
+		t.Error(mismatchErrorString("SeqId", got.SeqId, msg.SeqId))
+	}
+}
+
+func TestTopicUpdate(t *testing.T) {
+	update := map[string]any{
+		"UpdatedAt": testData.Now.Add(55 * time.Minute),
+	}
+	err := adp.TopicUpdate(testData.Topics[0].Id, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got time.Time
+	err = db.QueryRowContext(ctx, "SELECT updatedat FROM topics WHERE name=$1", testData.Topics[0].Id).Scan(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != update["UpdatedAt"] {
+		t.Error(mismatchErrorString("UpdatedAt", got, update["UpdatedAt"]))
+	}
+}
+
+func TestTopicUpdateSubCnt(t *testing.T) {
+	// Test PostgreSQL specific method
+	err := adp.TopicUpdateSubCnt(testData.Topics[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify the subscription count was updated correctly
+	var subcnt int
+	err = db.QueryRowContext(ctx, "SELECT subcnt FROM topics WHERE name=$1", testData.Topics[0].Id).Scan(&subcnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Should match the number of active subscriptions
+	if subcnt < 0 {
+		t.Error("Subscription count should be non-negative")
+	}
+}
+
+func TestTopicOwnerChange(t *testing.T) {
+	err := adp.TopicOwnerChange(testData.Topics[0].Id, types.ParseUserId("usr"+testData.Users[1].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got int64
+	err = db.QueryRowContext(ctx, "SELECT owner FROM topics WHERE name=$1", testData.Topics[0].Id).Scan(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedOwner := decodeUid(testData.Users[1].Id)
+	if got != expectedOwner {
+		t.Error(mismatchErrorString("Owner", got, expectedOwner))
+	}
+}
+
+func TestSubsUpdate(t *testing.T) {
+	update := map[string]any{
+		"UpdatedAt": testData.Now.Add(22 * time.Minute),
+	}
+	err := adp.SubsUpdate(testData.Topics[0].Id, types.ParseUserId("usr"+testData.Users[0].Id), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got time.Time
+	err = db.QueryRowContext(ctx, "SELECT updatedat FROM subscriptions WHERE topic=$1 AND userid=$2",
+		testData.Topics[0].Id, decodeUid(testData.Users[0].Id)).Scan(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != update["UpdatedAt"] {
+		t.Error(mismatchErrorString("UpdatedAt", got, update["UpdatedAt"]))
+	}
+
+	err = adp.SubsUpdate(testData.Topics[1].Id, types.ZeroUid, update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "SELECT updatedat FROM subscriptions WHERE topic=$1 LIMIT 1",
+		testData.Topics[1].Id).Scan(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != update["UpdatedAt"] {
+		t.Error(mismatchErrorString("UpdatedAt", got, update["UpdatedAt"]))
+	}
+}
+
+func TestSubsDelete(t *testing.T) {
+	err := adp.SubsDelete(testData.Topics[1].Id, types.ParseUserId("usr"+testData.Users[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deletedat sql.NullTime
+	err = db.QueryRowContext(ctx, "SELECT deletedat FROM subscriptions WHERE topic=$1 AND userid=$2",
+		testData.Topics[1].Id, decodeUid(testData.Users[0].Id)).Scan(&deletedat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deletedat.Valid {
+		t.Error("DeletedAt should not be null")
+	}
+}
+
+func TestSubsDelForUser(t *testing.T) {
+	// Tested during TestUserDelete (both hard and soft deletions)
+}
+
+func TestDeviceUpsert(t *testing.T) {
+	err := adp.DeviceUpsert(types.ParseUserId("usr"+testData.Users[0].Id), testData.Devs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		DeviceId string
+		Platform string
+	}
+	err = db.QueryRowContext(ctx, "SELECT deviceid, platform FROM devices WHERE userid=$1 LIMIT 1",
+		decodeUid(testData.Users[0].Id)).Scan(&got.DeviceId, &got.Platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DeviceId != testData.Devs[0].DeviceId || got.Platform != testData.Devs[0].Platform {
+		t.Error(mismatchErrorString("Device", got, testData.Devs[0]))
+	}
+
+	// Test update
+	testData.Devs[0].Platform = "Web"
+	err = adp.DeviceUpsert(types.ParseUserId("usr"+testData.Users[0].Id), testData.Devs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "SELECT platform FROM devices WHERE userid=$1 AND deviceid=$2",
+		decodeUid(testData.Users[0].Id), testData.Devs[0].DeviceId).Scan(&got.Platform)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Platform != "Web" {
+		t.Error("Device not updated.", got.Platform)
+	}
+
+	// Test add same device to another user
+	err = adp.DeviceUpsert(types.ParseUserId("usr"+testData.Users[1].Id), testData.Devs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = adp.DeviceUpsert(types.ParseUserId("usr"+testData.Users[2].Id), testData.Devs[1])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMessageAttachments(t *testing.T) {
+	fids := []string{testData.Files[0].Id, testData.Files[1].Id}
+	err := adp.FileLinkAttachments("", types.ZeroUid, types.ParseUid(testData.Msgs[1].Id), fids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Check if attachments were linked
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM filemsglinks WHERE msgid=$1",
+		int64(types.ParseUid(testData.Msgs[1].Id))).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(fids) {
+		t.Error(mismatchErrorString("Attachments count", count, len(fids)))
+	}
+}
+
+func TestFileFinishUpload(t *testing.T) {
+	got, err := adp.FileFinishUpload(testData.Files[0], true, 22222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != types.UploadCompleted {
+		t.Error(mismatchErrorString("Status", got.Status, types.UploadCompleted))
+	}
+	if got.Size != 22222 {
+		t.Error(mismatchErrorString("Size", got.Size, 22222))
+	}
+}
+
+func TestFileUsage(t *testing.T) {
+	// Only completed uploads are counted.
+	size, err := adp.FileUsageByUser(types.ParseUserId("usr" + testData.Users[0].Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 22222 {
+		t.Error(mismatchErrorString("User usage", size, 22222))
+	}
+
+	size, err = adp.FileUsageByTopic(testData.Msgs[1].Topic, []string{testData.Files[0].Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 22222 {
+		t.Error(mismatchErrorString("Topic usage", size, 22222))
+	}
+}
+
+func TestCalls(t *testing.T) {
+	now := types.TimeNow()
+	topic := testData.Topics[1].Id
+	call := &types.CallRecord{
+		Topic:     topic,
+		SeqId:     7,
+		Room:      topic + "-7",
+		Owner:     testData.Users[0].Id,
+		CreatedAt: now,
+	}
+	if err := adp.CallCreate(call); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.CallCreate(call); err != types.ErrDuplicate {
+		t.Error(mismatchErrorString("Duplicate call", err, types.ErrDuplicate))
+	}
+
+	got, err := adp.CallGet(topic, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Room != call.Room || got.Owner != call.Owner || got.EndedAt != nil {
+		t.Fatal(mismatchErrorString("Call", got, call))
+	}
+
+	participants := []string{testData.Users[0].Id, testData.Users[1].Id}
+	endedAt := now.Add(time.Minute)
+	call.EndedAt = &endedAt
+	call.Outcome = "finished"
+	call.Duration = 45000
+	call.Participants = participants
+	if err = adp.CallEnd(call); err != nil {
+		t.Fatal(err)
+	}
+	got, err = adp.CallGet(topic, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EndedAt == nil || got.Outcome != "finished" || got.Duration != 45000 ||
+		!reflect.DeepEqual(got.Participants, participants) {
+		t.Error(mismatchErrorString("Ended call", got, call))
+	}
+
+	if got, err = adp.CallGet(topic, 8); err != nil || got != nil {
+		t.Error(mismatchErrorString("Missing call", got, nil))
+	}
+
+	// P2P call without a room.
+	if err = adp.CallCreate(&types.CallRecord{
+		Topic:     topic,
+		SeqId:     9,
+		Owner:     testData.Users[1].Id,
+		CreatedAt: now.Add(2 * time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := adp.CallGetAll([]string{topic, "grpMissing"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0].SeqId != 9 || calls[1].SeqId != 7 || calls[1].Outcome != "finished" {
+		t.Fatal(mismatchErrorString("Calls", calls, 2))
+	}
+	before := now.Add(time.Minute)
+	if calls, err = adp.CallGetAll([]string{topic}, &before, 10); err != nil || len(calls) != 1 || calls[0].SeqId != 7 {
+		t.Error(mismatchErrorString("Calls before", calls, 1))
+	}
+	if calls, err = adp.CallGetAll(nil, nil, 10); err != nil || len(calls) != 0 {
+		t.Error(mismatchErrorString("Calls in no topics", calls, 0))
+	}
+}
+
+func TestInWebhooks(t *testing.T) {
+	topic := testData.Topics[0].Id
+	bot := types.ParseUid(testData.Users[0].Id)
+	for i, token := range []string{"hookToken1", "hookToken2"} {
+		if err := adp.InWebhooksCreate(&types.IncomingWebhook{
+			Token:     token,
+			Topic:     topic,
+			User:      bot.UserId(),
+			Format:    types.InWebhookText,
+			Template:  "{{.text}}",
+			CreatedAt: testData.Now.Add(time.Duration(i) * time.Minute),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := adp.InWebhooksCreate(&types.IncomingWebhook{Token: "hookToken1", Topic: topic,
+		User: bot.UserId(), Format: types.InWebhookText, CreatedAt: testData.Now}); err == nil {
+		t.Error("Duplicate token accepted")
+	}
+
+	hook, err := adp.InWebhooksGet("hookToken1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook == nil || hook.Topic != topic || hook.User != bot.UserId() || hook.Format != types.InWebhookText ||
+		hook.Template != "{{.text}}" {
+		t.Error(mismatchErrorString("Webhook", hook, "hookToken1"))
+	}
+	if hook, err = adp.InWebhooksGet("missing"); err != nil || hook != nil {
+		t.Error("Missing webhook found", hook, err)
+	}
+
+	hooks, err := adp.InWebhooksGetAll(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 2 || hooks[0].Token != "hookToken1" || hooks[1].Token != "hookToken2" {
+		t.Error(mismatchErrorString("Webhooks", hooks, "hookToken1, hookToken2"))
+	}
+
+	if deleted, err := adp.InWebhooksDelete("hookToken1"); err != nil || !deleted {
+		t.Error("Webhook not deleted", err)
+	}
+	if deleted, err := adp.InWebhooksDelete("hookToken1"); err != nil || deleted {
+		t.Error("Deleted webhook deleted again", err)
+	}
+	if hooks, _ = adp.InWebhooksGetAll(topic); len(hooks) != 1 {
+		t.Error(mismatchErrorString("Webhooks after delete", len(hooks), 1))
+	}
+}
+
+func TestMessageRetention(t *testing.T) {
+	topic := "grpRetentionTopic"
+	now := testData.Now
+	if err := adp.TopicCreate(&types.Topic{
+		ObjHeader: types.ObjHeader{Id: topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     testData.Users[0].Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Messages 1-3 are a day old, message 4 is new.
+	for i := 1; i <= 4; i++ {
+		created := now.Add(-24 * time.Hour)
+		if i == 4 {
+			created = now
+		}
+		if err := adp.MessageSave(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: created, UpdatedAt: created},
+			SeqId:     i,
+			Topic:     topic,
+			From:      testData.Users[0].Id,
+			Head:      types.KVMap{"mime": "text/x-drafty", "webrtc": "accepted"},
+			Content:   "message " + strconv.Itoa(i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(cat string, tenants []string, exclude, anonymized bool) *types.RetentionBatch {
+		older, err := adp.MessageGetOlder(cat, tenants, exclude, now.Add(-time.Hour), anonymized, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range older {
+			if older[i].Topic == topic {
+				return &older[i]
+			}
+		}
+		return nil
+	}
+
+	if batch := find(types.RetentionGrp, nil, false, false); batch == nil || batch.SeqId != 3 || batch.Count != 3 {
+		t.Error(mismatchErrorString("Old messages", batch, types.RetentionBatch{Topic: topic, SeqId: 3, Count: 3}))
+	}
+	if batch := find(types.RetentionGrp, []string{"acme"}, true, false); batch == nil {
+		t.Error("Topic of the default tenant not found")
+	}
+	if batch := find(types.RetentionGrp, []string{"acme"}, false, false); batch != nil {
+		t.Error("Topic of another tenant found")
+	}
+	if batch := find(types.RetentionChn, nil, false, false); batch != nil {
+		t.Error("Group topic found as a channel")
+	}
+	if _, err := adp.MessageGetOlder("usr", nil, false, now, false, 100); err != types.ErrMalformed {
+		t.Error("Invalid category accepted", err)
+	}
+
+	count, err := adp.MessageAnonymize(topic, 3, 2)
+	if err != nil || count != 2 {
+		t.Fatal(mismatchErrorString("Anonymized", count, 2), err)
+	}
+	if count, err = adp.MessageAnonymize(topic, 3, 10); err != nil || count != 1 {
+		t.Fatal(mismatchErrorString("Anonymized", count, 1), err)
+	}
+	msgs, err := adp.MessageGetAll(topic, types.ZeroUid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if msg.SeqId <= 3 && (msg.From != "" || !reflect.DeepEqual(msg.Head, types.KVMap{"mime": "text/x-drafty"}) ||
+			msg.Content != "message "+strconv.Itoa(msg.SeqId)) {
+			t.Errorf("Message %d not anonymized: %+v", msg.SeqId, msg)
+		} else if msg.SeqId == 4 && msg.From != testData.Users[0].Id {
+			t.Error("New message anonymized", msg)
+		}
+	}
+
+	// Anonymized messages are skipped unless requested.
+	if batch := find(types.RetentionGrp, nil, false, false); batch != nil {
+		t.Error("Anonymized messages found", batch)
+	}
+	if batch := find(types.RetentionGrp, nil, false, true); batch == nil || batch.Count != 3 {
+		t.Error(mismatchErrorString("Anonymized messages", batch, 3))
+	}
+}
+
+func TestMessageTiers(t *testing.T) {
+	topic := "grpTieringTopic"
+	now := testData.Now
+	if err := adp.TopicCreate(&types.Topic{
+		ObjHeader: types.ObjHeader{Id: topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     testData.Users[0].Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	old := now.Add(-24 * time.Hour)
+	for i := 1; i <= 3; i++ {
+		if err := adp.MessageSave(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: old, UpdatedAt: old},
+			SeqId:     i,
+			Topic:     topic,
+			From:      testData.Users[0].Id,
+			Content:   "message " + strconv.Itoa(i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found := func(skipCats []string) bool {
+		topics, err := adp.MessageGetColdTopics(now.Add(-time.Hour), skipCats, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range topics {
+			if name == topic {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !found(nil) || !found([]string{types.RetentionChn}) {
+		t.Error("Topic with old messages not found")
+	}
+	// Topics of retention categories and topics with the time to live of messages are skipped.
+	if found([]string{types.RetentionP2P, types.RetentionGrp}) {
+		t.Error("Topic of retention category found")
+	}
+	if _, err := adp.MessageGetColdTopics(now, []string{"usr"}, 100); err != types.ErrMalformed {
+		t.Error("Invalid category accepted", err)
+	}
+	if err := adp.TopicUpdate(topic, map[string]any{"MsgTTL": 3600}); err != nil {
+		t.Fatal(err)
+	}
+	if found(nil) {
+		t.Error("Topic with time to live found")
+	}
+	if err := adp.TopicUpdate(topic, map[string]any{"MsgTTL": 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := adp.MessageGetCold(topic, now.Add(-time.Hour), 100)
+	if err != nil || len(msgs) != 3 {
+		t.Fatal(mismatchErrorString("Cold messages", len(msgs), 3), err)
+	}
+	tier := &types.MessageTier{Topic: topic, Low: 1, Hi: 4, Count: 3, Key: topic + "/1-4", CreatedAt: now}
+	if err = adp.MessageTierCreate(tier, []int{1, 2, 3}, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if found(nil) {
+		t.Error("Moved messages found")
+	}
+
+	// The blob is replaced after removal of messages.
+	if err = adp.MessageTierUpdate(topic, 1, topic+"/1-4-1", 2); err != nil {
+		t.Fatal(err)
+	}
+	tiers, _, err := adp.MessageGetTiers(topic, types.ZeroUid, 1, 10)
+	if err != nil || len(tiers) != 1 {
+		t.Fatal(mismatchErrorString("Tiers", len(tiers), 1), err)
+	}
+	if tiers[0].Key != topic+"/1-4-1" || tiers[0].Count != 2 || tiers[0].Low != 1 || tiers[0].Hi != 4 {
+		t.Error(mismatchErrorString("Tier", tiers[0], types.MessageTier{Key: topic + "/1-4-1", Count: 2}))
+	}
+
+	// Topics with cold messages are found by the subscriptions of the user.
+	if topics, err := adp.MessageTierGetTopics(types.ParseUid(testData.Users[1].Id)); err != nil || len(topics) != 0 {
+		t.Error(mismatchErrorString("Tiered topics", topics, []string{}), err)
+	}
+	if err = adp.TopicShare(topic, []*types.Subscription{{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		User:      testData.Users[1].Id,
+		Topic:     topic,
+		ModeWant:  types.ModeCPublic,
+		ModeGiven: types.ModeCPublic,
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if topics, err := adp.MessageTierGetTopics(types.ParseUid(testData.Users[1].Id)); err != nil ||
+		len(topics) != 1 || topics[0] != topic {
+		t.Error(mismatchErrorString("Tiered topics", topics, []string{topic}), err)
+	}
+
+	if err = adp.MessageTierDelete(topic, 1); err != nil {
+		t.Fatal(err)
+	}
+	if tiers, _, err = adp.MessageGetTiers(topic, types.ZeroUid, 1, 10); err != nil || len(tiers) != 0 {
+		t.Error(mismatchErrorString("Tiers", len(tiers), 0), err)
+	}
+}
+
+func TestTopicMerge(t *testing.T) {
+	dst, src := "grpMergeDstTopic", "grpMergeSrcTopic"
+	now := testData.Now
+	users := testData.Users
+	for _, name := range []string{dst, src} {
+		if err := adp.TopicCreate(&types.Topic{
+			ObjHeader: types.ObjHeader{Id: name, CreatedAt: now, UpdatedAt: now},
+			TouchedAt: now,
+			Owner:     users[0].Id,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subs := []struct {
+		topic      string
+		user       string
+		recv, read int
+	}{
+		{dst, users[0].Id, 2, 1},
+		{dst, users[1].Id, 2, 2},
+		{src, users[0].Id, 2, 2},
+		{src, users[2].Id, 1, 1},
+	}
+	for _, s := range subs {
+		if err := adp.TopicShare(s.topic, []*types.Subscription{{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			User:      s.user,
+			Topic:     s.topic,
+			ModeWant:  types.ModeCPublic,
+			ModeGiven: types.ModeCPublic,
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := adp.SubsUpdate(s.topic, types.ParseUid(s.user), map[string]any{
+			"recvseqid": s.recv,
+			"readseqid": s.read,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages of the topics interleave: dst:1, src:1, dst:2, src:2 which replies in the thread of src:1.
+	msgs := []*types.Message{
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(time.Minute)}, SeqId: 1, Topic: dst, From: users[0].Id,
+			Content: "dst1"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(2 * time.Minute)}, SeqId: 1, Topic: src, From: users[2].Id,
+			Content: "src1"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(3 * time.Minute)}, SeqId: 2, Topic: dst, From: users[1].Id,
+			Content: "dst2"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now.Add(4 * time.Minute)}, SeqId: 2, Topic: src, From: users[0].Id,
+			Content: "src2", Head: types.KVMap{"thread": ":1"}, ThreadId: 1},
+	}
+	for _, msg := range msgs {
+		msg.UpdatedAt = msg.CreatedAt
+		if err := adp.MessageSave(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := adp.MessageDeleteList(dst, &types.DelMessage{Topic: dst, DeletedFor: users[1].Id, DelId: 1,
+		SeqIdRanges: []types.Range{{Low: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.MessageDeleteList(src, &types.DelMessage{Topic: src, DeletedFor: users[2].Id, DelId: 1,
+		SeqIdRanges: []types.Range{{Low: 1}}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, pinned := range map[string]string{dst: "[2]", src: "[1]"} {
+		if _, err := db.ExecContext(ctx, "UPDATE topics SET seqid=2,delid=1,pinned=$1 WHERE name=$2",
+			pinned, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := adp.StarredAdd(&types.StarredMessage{User: users[2].Id, Topic: src, SeqId: 2, From: users[0].Id,
+		Content: "src2", SentAt: now, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.FileLinkAttachments(src, types.ZeroUid, types.ZeroUid, []string{testData.Files[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Content of src is rewritten, content of dst is not.
+	rewrite := func(content any) (any, bool, error) {
+		if str, ok := content.(string); ok && strings.HasPrefix(str, "src") {
+			return "rewritten " + str, true, nil
+		}
+		return content, false, nil
+	}
+	if err := adp.TopicMerge(dst, src, rewrite); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are re-sequenced chronologically.
+	got, err := adp.MessageGetAll(dst, types.ZeroUid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for i := range got {
+		contents = append(contents, fmt.Sprintf("%d:%v", got[i].SeqId, got[i].Content))
+	}
+	sort.Strings(contents)
+	want := []string{"1:dst1", "2:rewritten src1", "3:dst2", "4:rewritten src2"}
+	if !reflect.DeepEqual(contents, want) {
+		t.Error(mismatchErrorString("Merged messages", contents, want))
+	}
+	for i := range got {
+		if got[i].SeqId == 4 && (got[i].ThreadId != 2 || got[i].Head["thread"] != ":2") {
+			t.Error(mismatchErrorString("Thread reference", got[i].Head, ":2"))
+		}
+	}
+
+	// Deletion log: dst first, then src.
+	rows, err := db.QueryContext(ctx, "SELECT deletedfor,delid,low,hi FROM dellog WHERE topic=$1 ORDER BY delid", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dellog []string
+	for rows.Next() {
+		var deletedFor int64
+		var delId, low, hi int
+		if err = rows.Scan(&deletedFor, &delId, &low, &hi); err != nil {
+			t.Fatal(err)
+		}
+		dellog = append(dellog, fmt.Sprintf("%s:%d:%d-%d", store.EncodeUid(deletedFor).String(), delId, low, hi))
+	}
+	rows.Close()
+	want = []string{users[1].Id + ":1:3-4", users[2].Id + ":2:2-3"}
+	if !reflect.DeepEqual(dellog, want) {
+		t.Error(mismatchErrorString("Deletion log", dellog, want))
+	}
+
+	// Read and recv markers point to the latest message at or before the old markers.
+	for i, marks := range [][2]int{{4, 4}, {3, 3}, {2, 2}} {
+		sub, err := adp.SubscriptionGet(dst, types.ParseUid(users[i].Id), false)
+		if err != nil || sub == nil {
+			t.Fatal("Missing subscription", users[i].Id, err)
+		}
+		if sub.RecvSeqId != marks[0] || sub.ReadSeqId != marks[1] {
+			t.Error(mismatchErrorString("Markers of "+users[i].Id, [2]int{sub.RecvSeqId, sub.ReadSeqId}, marks))
+		}
+	}
+	if sub, err := adp.SubscriptionGet(src, types.ParseUid(users[0].Id), true); err != nil || sub != nil {
+		t.Error(mismatchErrorString("Subscription to src", sub, nil))
+	}
+
+	topic, err := adp.TopicGet(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic.SeqId != 4 || topic.DelId != 2 || !reflect.DeepEqual(topic.Pinned, []int{3, 2}) {
+		t.Error(mismatchErrorString("Merged topic", []any{topic.SeqId, topic.DelId, topic.Pinned},
+			[]any{4, 2, []int{3, 2}}))
+	}
+	if topic, err = adp.TopicGet(src); err != nil || topic != nil {
+		t.Error(mismatchErrorString("Merged topic", topic, nil))
+	}
+
+	starred, err := adp.StarredGetAll(types.ParseUid(users[2].Id), dst, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starred) != 1 || starred[0].SeqId != 4 || starred[0].Content != "rewritten src2" {
+		t.Error(mismatchErrorString("Starred", starred, 1))
+	}
+
+	var count int
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM filemsglinks WHERE topic=$1", dst).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Error(mismatchErrorString("File links", count, 1))
+	}
+}
+
+// ================== Other tests =================================
+func TestPresenceSettings(t *testing.T) {
+	uid0, uid1 := types.ParseUserId("usr"+testData.Users[0].Id), types.ParseUserId("usr"+testData.Users[1].Id)
+	if err := adp.PresenceSettingsUpsert(&types.PresenceSettings{
+		User:      testData.Users[0].Id,
+		Invisible: true,
+		UpdatedAt: types.TimeNow(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := adp.PresenceSettingsUpsert(&types.PresenceSettings{
+		User:      testData.Users[0].Id,
+		Invisible: true,
+		LastSeen:  types.PresenceSeenContacts,
+		UpdatedAt: types.TimeNow(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := adp.PresenceSettingsGet([]types.Uid{uid0, uid1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].User != testData.Users[0].Id || !got[0].Invisible ||
+		got[0].LastSeen != types.PresenceSeenContacts {
+		t.Error(mismatchErrorString("Presence settings", got, testData.Users[0].Id))
+	}
+
+	topic := testData.Topics[1].Id
+	for _, tps := range []*types.TopicPresenceSettings{
+		{Topic: topic, User: testData.Users[0].Id, Share: types.PresenceShareHide},
+		{Topic: topic, User: testData.Users[0].Id, Share: types.PresenceShareShow},
+		{Topic: topic, User: testData.Users[1].Id, Share: types.PresenceShareHide},
+	} {
+		tps.UpdatedAt = types.TimeNow()
+		if err = adp.TopicPresenceUpsert(tps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	overrides, err := adp.TopicPresenceGet(topic, types.ZeroUid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 2 {
+		t.Error(mismatchErrorString("Overrides in topic", len(overrides), 2))
+	}
+	overrides, err = adp.TopicPresenceGet("", uid0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 1 || overrides[0].Topic != topic || overrides[0].Share != types.PresenceShareShow {
+		t.Error(mismatchErrorString("Overrides of user", overrides, types.PresenceShareShow))
+	}
+}
+
+func TestDeviceGetAll(t *testing.T) {
+	uid0 := types.ParseUserId("usr" + testData.Users[0].Id)
+	uid1 := types.ParseUserId("usr" + testData.Users[1].Id)
+	uid2 := types.ParseUserId("usr" + testData.Users[2].Id)
+	gotDevs, count, err := adp.DeviceGetAll(uid0, uid1, uid2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < 1 {
+		t.Fatal(mismatchErrorString("count", count, ">=1"))
+	}
+	// Test that devices exist for the users
+	if len(gotDevs) == 0 {
+		t.Error("Expected devices for users")
+	}
+}
+
+func TestDeviceDelete(t *testing.T) {
+	err := adp.DeviceDelete(types.ParseUserId("usr"+testData.Users[1].Id), testData.Devs[0].DeviceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM devices WHERE userid=$1 AND deviceid=$2",
+		decodeUid(testData.Users[1].Id), testData.Devs[0].DeviceId).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Device not deleted:", count)
+	}
+
+	err = adp.DeviceDelete(types.ParseUserId("usr"+testData.Users[2].Id), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM devices WHERE userid=$1",
+		decodeUid(testData.Users[2].Id)).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("All devices not deleted:", count)
+	}
+}
+
+// ================== Persistent Cache tests ======================
+func TestPCacheUpsert(t *testing.T) {
+	err := adp.PCacheUpsert("test_key", "test_value", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Test duplicate with failOnDuplicate = true
+	err = adp.PCacheUpsert("test_key2", "test_value2", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = adp.PCacheUpsert("test_key2", "new_value", true)
+	if err != types.ErrDuplicate {
+		t.Error("Expected duplicate error")
+	}
+}
+
+func TestPCacheGet(t *testing.T) {
+	value, err := adp.PCacheGet("test_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "test_value" {
+		t.Error(mismatchErrorString("Cache value", value, "test_value"))
+	}
+
+	// Test not found
+	_, err = adp.PCacheGet("nonexistent")
+	if err != types.ErrNotFound {
+		t.Error("Expected not found error")
+	}
+}
+
+func TestPCacheDelete(t *testing.T) {
+	err := adp.PCacheDelete("test_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify deleted
+	_, err = adp.PCacheGet("test_key")
+	if err != types.ErrNotFound {
+		t.Error("Key should be deleted")
+	}
+}
+
+func TestPCacheExpire(t *testing.T) {
+	// Insert some test keys with prefix
+	adp.PCacheUpsert("prefix_key1", "value1", false)
+	adp.PCacheUpsert("prefix_key2", "value2", false)
+
+	// '_' in the prefix is not a wildcard.
+	adp.PCacheUpsert("prefixAkey3", "value3", false)
+
+	// Expire keys older than now (should delete all test keys)
+	err := adp.PCacheExpire("prefix_", time.Now().Add(1*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = adp.PCacheGet("prefix_key1"); err != types.ErrNotFound {
+		t.Error("Key should be expired")
+	}
+	if _, err = adp.PCacheGet("prefixAkey3"); err != nil {
+		t.Error("Key without the prefix expired", err)
+	}
+}
+
+// ================== Delete tests ================================
+func TestCredDel(t *testing.T) {
+	err := adp.CredDel(types.ParseUserId("usr"+testData.Users[0].Id), "email", "alice@test.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM credentials WHERE method='email' AND value='alice@test.example.com'").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Got result but shouldn't", count)
+	}
+
+	err = adp.CredDel(types.ParseUserId("usr"+testData.Users[1].Id), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM credentials WHERE userid=$1",
+		decodeUid(testData.Users[1].Id)).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Got result but shouldn't", count)
+	}
+}
+
+func TestAuthDelScheme(t *testing.T) {
+	// Test deleting auth scheme
+	err := adp.AuthDelScheme(types.ParseUserId("usr"+testData.Recs[1].UserId), testData.Recs[1].Scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verify deleted
+	_, _, _, _, err = adp.AuthGetRecord(types.ParseUserId("usr"+testData.Recs[1].UserId), testData.Recs[1].Scheme)
+	if err != types.ErrNotFound {
+		t.Error("Auth record should be deleted")
+	}
+}
+
+func TestAuthDelAllRecords(t *testing.T) {
+	delCount, err := adp.AuthDelAllRecords(types.ParseUserId("usr" + testData.Recs[0].UserId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delCount != 1 {
+		t.Error(mismatchErrorString("delCount", delCount, 1))
+	}
+
+	// With dummy user
+	delCount, _ = adp.AuthDelAllRecords(dummyUid1)
+	if delCount != 0 {
+		t.Error(mismatchErrorString("delCount", delCount, 0))
+	}
+}
+
+func TestMessageDeleteList(t *testing.T) {
+	toDel := types.DelMessage{
+		ObjHeader: types.ObjHeader{
+			Id:        testData.UGen.GetStr(),
+			CreatedAt: testData.Now,
+			UpdatedAt: testData.Now,
+		},
+		Topic:       testData.Topics[1].Id,
+		DeletedFor:  testData.Users[2].Id,
+		DelId:       1,
+		SeqIdRanges: []types.Range{{Low: 9}, {Low: 3, Hi: 7}},
+	}
+	err := adp.MessageDeleteList(toDel.Topic, &toDel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check messages in dellog
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM dellog WHERE topic=$1 AND deletedfor=$2",
+		toDel.Topic, decodeUid(toDel.DeletedFor)).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Error("No dellog entries created")
+	}
+
+	// Hard delete test
+	toDel = types.DelMessage{
+		ObjHeader: types.ObjHeader{
+			Id:        testData.UGen.GetStr(),
+			CreatedAt: testData.Now,
+			UpdatedAt: testData.Now,
+		},
+		Topic:       testData.Topics[0].Id,
+		DelId:       3,
+		SeqIdRanges: []types.Range{{Low: 1, Hi: 3}},
+	}
+	err = adp.MessageDeleteList(toDel.Topic, &toDel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check if messages were marked as deleted. Content is retained.
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE topic=$1 AND seqid>=1 AND seqid<3 AND deletedat IS NULL",
+		toDel.Topic).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count > 0 {
+		t.Errorf("Messages not properly deleted %d, %s", count, toDel.Topic)
+	}
+
+	err = adp.MessageDeleteList(testData.Topics[0].Id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM messages WHERE topic=$1", testData.Topics[0].Id).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Result should be empty:", count)
+	}
+}
+
+func TestTopicDelete(t *testing.T) {
+	err := adp.TopicDelete(testData.Topics[1].Id, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state int
+	err = db.QueryRowContext(ctx, "SELECT state FROM topics WHERE name=$1", testData.Topics[1].Id).Scan(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != int(types.StateDeleted) {
+		t.Error("Soft delete failed:", state)
+	}
+
+	err = adp.TopicDelete(testData.Topics[0].Id, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM topics WHERE name=$1", testData.Topics[0].Id).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("Hard delete failed:", count)
+	}
+}
+
+func TestFileDeleteUnused(t *testing.T) {
+	locs, err := adp.FileDeleteUnused(time.Now().Add(1*time.Minute), 999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) < 1 {
+		t.Log("No unused files to delete - this is expected in test environment")
+	}
+}
+
+func TestUserErase(t *testing.T) {
+	now := testData.Now
+	erased := types.Uid(777777)
+	user := &types.User{ObjHeader: types.ObjHeader{Id: erased.String(), CreatedAt: now, UpdatedAt: now}}
+	if err := adp.UserCreate(user); err != nil {
+		t.Fatal(err)
+	}
+	topic := "grpEraseTopic"
+	if err := adp.TopicCreate(&types.Topic{
+		ObjHeader: types.ObjHeader{Id: topic, CreatedAt: now, UpdatedAt: now},
+		TouchedAt: now,
+		Owner:     testData.Users[0].Id,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, from := range []string{testData.Users[0].Id, user.Id} {
+		if err := adp.MessageSave(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+			SeqId:     i + 1,
+			Topic:     topic,
+			From:      from,
+			Content:   "message " + strconv.Itoa(i+1),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := adp.ReactionAdd(topic, 1, erased, "👍"); err != nil {
+		t.Fatal(err)
+	}
+	file := &types.FileDef{
+		ObjHeader: types.ObjHeader{CreatedAt: now, UpdatedAt: now},
+		Status:    types.UploadCompleted,
+		User:      user.Id,
+		MimeType:  "image/png",
+		Location:  "uploads/erased.png",
+		Size:      100,
+	}
+	file.SetUid(types.Uid(777778))
+	if err := adp.FileStartUpload(file); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := types.ErasureReport{"account": 1, "messages": 1, "reactions": 1, "files": 1}
+	report, locations, err := adp.UserErase(erased, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) || len(locations) != 0 {
+		t.Error(mismatchErrorString("Dry run report", report, expected))
+	}
+	var count int
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reactions WHERE userid=$1",
+		store.DecodeUid(erased)).Scan(&count); err != nil || count != 1 {
+		t.Error("Dry run deleted reactions", count, err)
+	}
+
+	report, locations, err = adp.UserErase(erased, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Error(mismatchErrorString("Report", report, expected))
+	}
+	if !reflect.DeepEqual(locations, []string{"uploads/erased.png"}) {
+		t.Error(mismatchErrorString("Locations", locations, []string{"uploads/erased.png"}))
+	}
+	// Content of user's message is erased, messages of other users are intact.
+	msgs, err := adp.MessageGetAll(topic, types.ZeroUid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatal(mismatchErrorString("Messages", len(msgs), 2))
+	}
+	for _, msg := range msgs {
+		if msg.SeqId == 1 && msg.Content != "message 1" {
+			t.Error("Message of another user modified", msg.Content)
+		} else if msg.SeqId == 2 && (msg.Content != nil || msg.DeletedAt == nil) {
+			t.Error("Message content not erased", msg.Content)
+		}
+	}
+	for _, table := range []string{"reactions", "fileuploads"} {
+		if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+" WHERE userid=$1",
+			store.DecodeUid(erased)).Scan(&count); err != nil || count != 0 {
+			t.Error("Records not deleted", table, count, err)
+		}
+	}
+
+	// The account is deleted by UserDelete.
+	report, _, err = adp.UserErase(erased, true)
+	if err != nil || !reflect.DeepEqual(report, types.ErasureReport{"account": 1}) {
+		t.Error(mismatchErrorString("Report after erasure", report, types.ErasureReport{"account": 1}))
+	}
+	if err = adp.UserDelete(erased, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUserDelete(t *testing.T) {
+	err := adp.UserDelete(types.ParseUserId("usr"+testData.Users[0].Id), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state int
+	err = db.QueryRowContext(ctx, "SELECT state FROM users WHERE id=$1",
+		decodeUid(testData.Users[0].Id)).Scan(&state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != int(types.StateDeleted) {
+		t.Error("User soft delete failed", state)
+	}
+
+	err = adp.UserDelete(types.ParseUserId("usr"+testData.Users[1].Id), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE id=$1",
+		decodeUid(testData.Users[1].Id)).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("User hard delete failed")
+	}
+}
+
+func TestUserUnreadCount(t *testing.T) {
+	uids := []types.Uid{
+		types.ParseUserId("usr" + testData.Users[1].Id),
+		types.ParseUserId("usr" + testData.Users[2].Id),
+	}
+	expected := map[types.Uid]int{uids[0]: 0, uids[1]: 166}
+	counts, err := adp.UserUnreadCount(uids...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Error(mismatchErrorString("UnreadCount length", len(counts), 2))
+	}
+
+	for uid, unread := range counts {
+		if expected[uid] != unread {
+			t.Error(mismatchErrorString("UnreadCount", unread, expected[uid]))
+		}
+	}
+
+	// Test not found (even if the account is not found, the call must return one record).
+	counts, err = adp.UserUnreadCount(dummyUid1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 {
+		t.Error(mismatchErrorString("UnreadCount length (dummy)", len(counts), 1))
+	}
+	if counts[dummyUid1] != 0 {
+		t.Error(mismatchErrorString("Non-zero UnreadCount (dummy)", counts[dummyUid1], 0))
+	}
+}
+
+func TestMessageGetDeleted(t *testing.T) {
+	qOpts := types.QueryOpt{
+		Since:  1,
+		Before: 10,
+		Limit:  999,
+	}
+	got, err := adp.MessageGetDeleted(testData.Topics[1].Id, types.ParseUserId("usr"+testData.Users[2].Id), &qOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Error(mismatchErrorString("result length", len(got), 1))
+	}
+}
+
+// ================================================================
+func mismatchErrorString(key string, got, want any) string {
+	return fmt.Sprintf("%s mismatch:\nGot  = %+v\nWant = %+v", key, got, want)
+}
+
+func init() {
+	ctx = context.Background()
+	logs.Init(os.Stderr, "stdFlags")
+	adp = backend.GetTestAdapter()
+	conffile := flag.String("config", "./test.conf", "config of the database connection")
+
+	if file, err := os.Open(*conffile); err != nil {
+		log.Fatal("Failed to read config file:", err)
+	} else if err = json.NewDecoder(jcr.New(file)).Decode(&config); err != nil {
+		log.Fatal("Failed to parse config file:", err)
+	}
+
+	if adp == nil {
+		log.Fatal("Database adapter is missing")
+	}
+	if adp.IsOpen() {
+		log.Print("Connection is already opened")
+	}
+
+	err := adp.Open(config.Adapters[adp.GetName()])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db = adp.GetTestDB().(*sql.DB)
+	testData = test_data.InitTestData()
+	if testData == nil {
+		log.Fatal("Failed to initialize test data")
+	}
+	store.SetTestUidGenerator(*testData.UGen)
+}
@@ -0,0 +1,276 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Registry of users' devices. Unlike push tokens which come and go with
+ *    {hi}, a registered device has a stable client-assigned ID, a name,
+ *    platform, app version and an optional public key:
+ *
+ *    - {set topic="me" device={id, name, ver, pk, current=true}} registers
+ *      the device of the current session. The push token of the session is
+ *      attached to the device and the device is bound to the session: the
+ *      time of last activity is updated when the session ends.
+ *      {set topic="me" device={id, name, push}} renames a device or enables
+ *      and disables push notifications to it.
+ *    - {get what="devices"} on 'me' lists the devices with their delivery
+ *      state: presence of a push token, of end-to-end encryption keys and
+ *      the number of sender keys waiting for the device.
+ *    - {del topic="me" what="device" dev="ID"} deletes the device with its
+ *      push token and encryption keys.
+ *
+ *    Push notifications are not sent to devices with disabled push.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of registered devices of a user.
+	maxUserDevices = 32
+	// Maximum length of a device name.
+	maxDeviceNameLength = 64
+	// Maximum length of the platform and of the app version.
+	maxDevicePlatformLength = 32
+)
+
+// registeredDevice returns the ID of the registered device of the session or an empty string.
+func (s *Session) registeredDevice() string {
+	id, _ := s.regDevice.Load().(string)
+	return id
+}
+
+func (s *Session) setRegisteredDevice(id string) {
+	s.regDevice.Store(id)
+}
+
+// touchDeviceRecord updates the time when the registered device of the session was last active.
+func (s *Session) touchDeviceRecord() {
+	id := s.registeredDevice()
+	if id == "" || s.uid.IsZero() || s.isCluster() {
+		return
+	}
+	if _, err := store.UserDevices.Update(s.uid, id, map[string]any{"LastSeen": types.TimeNow()}); err != nil {
+		logs.Warn.Println("s.touchDeviceRecord: failed to update device", err, s.sid)
+	}
+}
+
+// updateDevicePushToken attaches the new push token of the session to its registered device.
+func (s *Session) updateDevicePushToken(token string) {
+	id := s.registeredDevice()
+	if id == "" {
+		return
+	}
+	if token == types.NullValue {
+		token = ""
+	}
+	if _, err := store.UserDevices.Update(s.uid, id, map[string]any{"PushToken": token}); err != nil {
+		logs.Warn.Println("s.updateDevicePushToken: failed to update device", err, s.sid)
+	}
+}
+
+// replySetDevice registers the device of the current session or updates settings of a registered device.
+func (t *Topic) replySetDevice(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for registering devices")
+	}
+
+	dev := msg.Set.Device
+	if !validE2EEDeviceId(dev.Id) || len(dev.Name) > maxDeviceNameLength ||
+		len(dev.Platform) > maxDevicePlatformLength || len(dev.Version) > maxDevicePlatformLength ||
+		len(dev.PublicKey) > maxE2EEKeySize {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.device: invalid device")
+	}
+
+	if !dev.Current {
+		update := map[string]any{}
+		if dev.Name != "" {
+			update["Name"] = dev.Name
+		}
+		if dev.Push != nil {
+			update["Push"] = *dev.Push
+		}
+		if dev.PublicKey != nil {
+			update["PublicKey"] = dev.PublicKey
+		}
+		if len(update) == 0 {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.device: nothing to update")
+		}
+		found, err := store.UserDevices.Update(asUid, dev.Id, update)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		if !found {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return nil
+		}
+		sess.queueOut(NoErrReply(msg, now))
+		return nil
+	}
+
+	devices, err := store.UserDevices.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	exists := false
+	for i := range devices {
+		if devices[i].Id == dev.Id {
+			exists = true
+			break
+		}
+	}
+	if !exists && len(devices) >= maxUserDevices {
+		sess.queueOut(ErrPolicyReply(msg, now))
+		return errors.New("set.device: too many devices")
+	}
+
+	platform := dev.Platform
+	if platform == "" {
+		platform = sess.platf
+	}
+	push := dev.Push == nil || *dev.Push
+	if err := store.UserDevices.Register(&types.UserDevice{
+		Id:         dev.Id,
+		User:       asUid.String(),
+		Name:       dev.Name,
+		Platform:   platform,
+		AppVersion: dev.Version,
+		PublicKey:  dev.PublicKey,
+		PushToken:  sess.deviceID,
+		Push:       push,
+	}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if exists && dev.Push != nil {
+		// Settings of an existing device are not changed by registration.
+		if _, err := store.UserDevices.Update(asUid, dev.Id, map[string]any{"Push": push}); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+	}
+	sess.setRegisteredDevice(dev.Id)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetDevices lists registered devices of the user, the most recently active first.
+func (t *Topic) replyGetDevices(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting devices")
+	}
+
+	devices, err := store.UserDevices.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(devices) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "devices"}))
+		return nil
+	}
+
+	current := sess.registeredDevice()
+	result := make([]MsgDevice, 0, len(devices))
+	for i := range devices {
+		dev := &devices[i]
+		md := MsgDevice{
+			Id:         dev.Id,
+			Name:       dev.Name,
+			Platform:   dev.Platform,
+			Version:    dev.AppVersion,
+			PublicKey:  dev.PublicKey,
+			CreatedAt:  dev.CreatedAt,
+			LastSeen:   dev.LastSeen,
+			Push:       dev.Push,
+			Token:      dev.PushToken != "",
+			Keys:       dev.OneTimeKeys >= 0,
+			SenderKeys: dev.SenderKeys,
+			Current:    dev.Id == current,
+		}
+		if md.Keys {
+			md.OneTimeCount = dev.OneTimeKeys
+		}
+		if md.Current {
+			md.LastSeen = now
+		}
+		result = append(result, md)
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Devices:   result,
+		},
+	})
+	return nil
+}
+
+// replyDelDevice deletes the registered device of the user with its push token and encryption keys.
+func (t *Topic) replyDelDevice(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.device: invalid topic category")
+	}
+
+	id := msg.Del.Dev
+	if !validE2EEDeviceId(id) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.device: missing or invalid device ID")
+	}
+
+	devices, err := store.UserDevices.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	var dev *types.UserDevice
+	for i := range devices {
+		if devices[i].Id == id {
+			dev = &devices[i]
+			break
+		}
+	}
+	if dev == nil {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return nil
+	}
+
+	if _, err := store.UserDevices.Delete(asUid, id); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if dev.PushToken != "" {
+		if err := store.Devices.Delete(asUid, dev.PushToken); err != nil {
+			logs.Warn.Println("del.device: failed to delete push token", err, sess.sid)
+		}
+	}
+	if sess.registeredDevice() == id {
+		sess.setRegisteredDevice("")
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
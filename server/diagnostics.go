@@ -0,0 +1,282 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Diagnostics mode for finding the causes of slowdowns. While the mode is
+ *    on, the server records database queries slower than the threshold
+ *    together with the shape of the query and the topic, and samples the
+ *    queues of messages waiting to be broadcast by topics to find the hot
+ *    ones. The data is reported by the admin API and summarized in the log
+ *    periodically. The mode is switched on in the config file or at runtime
+ *    with POST /admin/v0/diagnostics.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default threshold of slow queries in milliseconds.
+	defaultDiagSlowQueryMs = 200
+	// Default interval between summaries in the log in seconds.
+	defaultDiagSummaryInterval = 300
+	// Default number of recent slow queries kept for reporting.
+	defaultDiagMaxSlowQueries = 100
+	// Number of hot topics reported.
+	diagHotTopics = 10
+	// Interval between samples of topic queues.
+	diagSampleInterval = time.Second
+)
+
+// Diagnostics config.
+type diagnosticsConfig struct {
+	// Start the server with diagnostics mode on.
+	Enabled bool `json:"enabled"`
+	// Queries which take longer than this many milliseconds are recorded.
+	SlowQueryMs int `json:"slow_query_ms"`
+	// Interval between summaries in the log in seconds.
+	SummaryInterval int `json:"summary_interval"`
+	// Number of recent slow queries kept for reporting.
+	MaxSlowQueries int `json:"max_slow_queries"`
+}
+
+// diagSlowQuery is a record of a slow database query.
+type diagSlowQuery struct {
+	Ts    time.Time `json:"ts"`
+	Query string    `json:"query"`
+	// Filters used by the query, without values, e.g. "since,limit".
+	Shape string `json:"shape,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	Ms    int64  `json:"ms"`
+}
+
+// diagHotTopic is a topic with a deep queue of messages waiting to be broadcast.
+type diagHotTopic struct {
+	Topic string `json:"topic"`
+	// Maximum number of queued messages seen since the last summary.
+	Depth int `json:"depth"`
+}
+
+type diagnostics struct {
+	active atomic.Bool
+
+	slowQuery       time.Duration
+	summaryInterval time.Duration
+	maxSlowQueries  int
+
+	lock sync.Mutex
+	// Recent slow queries, oldest first.
+	slowQueries []diagSlowQuery
+	// Number of slow queries by query name since the last summary.
+	slowCounts map[string]int
+	// Maximum queue depth of topics since the last summary.
+	queueDepth map[string]int
+	// Queue depths from the previous summary period, reported until the current period has data.
+	prevDepth map[string]int
+}
+
+// Diagnostics, always initialized by diagnosticsInit.
+var diag *diagnostics
+
+func diagnosticsInit(config *diagnosticsConfig) *diagnostics {
+	d := &diagnostics{
+		slowQuery:       defaultDiagSlowQueryMs * time.Millisecond,
+		summaryInterval: defaultDiagSummaryInterval * time.Second,
+		maxSlowQueries:  defaultDiagMaxSlowQueries,
+		slowCounts:      make(map[string]int),
+		queueDepth:      make(map[string]int),
+	}
+	if config != nil {
+		if config.SlowQueryMs > 0 {
+			d.slowQuery = time.Duration(config.SlowQueryMs) * time.Millisecond
+		}
+		if config.SummaryInterval > 0 {
+			d.summaryInterval = time.Duration(config.SummaryInterval) * time.Second
+		}
+		if config.MaxSlowQueries > 0 {
+			d.maxSlowQueries = config.MaxSlowQueries
+		}
+		if config.Enabled {
+			d.setActive(true)
+		}
+	}
+	return d
+}
+
+// setActive switches diagnostics mode on or off. Returns false if the mode is unchanged.
+func (d *diagnostics) setActive(on bool) bool {
+	if !d.active.CompareAndSwap(!on, on) {
+		return false
+	}
+	if on {
+		logs.Info.Printf("diagnostics: on, slow query threshold %s", d.slowQuery)
+	} else {
+		d.lock.Lock()
+		d.slowQueries = nil
+		clear(d.slowCounts)
+		clear(d.queueDepth)
+		d.prevDepth = nil
+		d.lock.Unlock()
+		logs.Info.Println("diagnostics: off")
+	}
+	return true
+}
+
+// run samples topic queues and logs summaries while diagnostics mode is on.
+func (d *diagnostics) run() chan<- bool {
+	// Unbuffered stop channel. Whomever stops the process must wait for it to finish.
+	stop := make(chan bool)
+	go func() {
+		sample := time.NewTicker(diagSampleInterval)
+		defer sample.Stop()
+		summary := time.NewTicker(d.summaryInterval)
+		defer summary.Stop()
+		for {
+			select {
+			case <-sample.C:
+				if d.active.Load() {
+					d.sampleQueues()
+				}
+			case <-summary.C:
+				if d.active.Load() {
+					d.logSummary()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
+
+// observeQuery records the query if it's slow.
+func (d *diagnostics) observeQuery(query, shape, topic string, took time.Duration) {
+	if d == nil || !d.active.Load() || took < d.slowQuery {
+		return
+	}
+
+	d.lock.Lock()
+	if len(d.slowQueries) >= d.maxSlowQueries {
+		d.slowQueries = slices.Delete(d.slowQueries, 0, len(d.slowQueries)-d.maxSlowQueries+1)
+	}
+	d.slowQueries = append(d.slowQueries, diagSlowQuery{
+		Ts:    types.TimeNow(),
+		Query: query,
+		Shape: shape,
+		Topic: topic,
+		Ms:    took.Milliseconds(),
+	})
+	d.slowCounts[query]++
+	d.lock.Unlock()
+}
+
+// sampleQueues records the depth of queues of topics with messages waiting to be broadcast.
+func (d *diagnostics) sampleQueues() {
+	depths := make(map[string]int)
+	globals.hub.topics.Range(func(_, val any) bool {
+		t := val.(*Topic)
+		if depth := len(t.clientMsg) + len(t.serverMsg); depth > 0 {
+			depths[t.name] = depth
+		}
+		return true
+	})
+
+	d.lock.Lock()
+	for name, depth := range depths {
+		d.queueDepth[name] = max(d.queueDepth[name], depth)
+	}
+	d.lock.Unlock()
+}
+
+// hotTopics returns topics with the deepest queues, deepest first.
+func hotTopics(depths map[string]int, limit int) []diagHotTopic {
+	topics := make([]diagHotTopic, 0, len(depths))
+	for name, depth := range depths {
+		topics = append(topics, diagHotTopic{Topic: name, Depth: depth})
+	}
+	slices.SortFunc(topics, func(a, b diagHotTopic) int {
+		if c := cmp.Compare(b.Depth, a.Depth); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	if len(topics) > limit {
+		topics = topics[:limit]
+	}
+	return topics
+}
+
+// report returns recent slow queries and the hot topics.
+func (d *diagnostics) report() map[string]any {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	depths := d.queueDepth
+	if len(depths) == 0 {
+		depths = d.prevDepth
+	}
+	return map[string]any{
+		"active":       d.active.Load(),
+		"slow_ms":      d.slowQuery.Milliseconds(),
+		"slow_queries": slices.Clone(d.slowQueries),
+		"hot_topics":   hotTopics(depths, diagHotTopics),
+	}
+}
+
+// logSummary writes the summary of the period to the log as a JSON object and starts a new period.
+func (d *diagnostics) logSummary() {
+	d.lock.Lock()
+	summary := struct {
+		SlowQueries map[string]int `json:"slow_queries"`
+		HotTopics   []diagHotTopic `json:"hot_topics"`
+	}{
+		SlowQueries: d.slowCounts,
+		HotTopics:   hotTopics(d.queueDepth, diagHotTopics),
+	}
+	d.prevDepth = d.queueDepth
+	d.slowCounts = make(map[string]int)
+	d.queueDepth = make(map[string]int)
+	d.lock.Unlock()
+
+	if data, err := json.Marshal(summary); err == nil {
+		logs.Info.Println("diagnostics: summary", string(data))
+	}
+}
+
+// queryShape describes the filters used by the query without their values, e.g. "since,limit".
+func queryShape(opts *types.QueryOpt) string {
+	if opts == nil {
+		return ""
+	}
+	var parts []string
+	if opts.Since > 0 {
+		parts = append(parts, "since")
+	}
+	if opts.Before > 0 {
+		parts = append(parts, "before")
+	}
+	if len(opts.IdRanges) > 0 {
+		parts = append(parts, "ranges")
+	}
+	if opts.Search != "" {
+		parts = append(parts, "search")
+	}
+	if opts.Thread > 0 {
+		parts = append(parts, "thread")
+	}
+	if opts.Limit > 0 {
+		parts = append(parts, "limit")
+	}
+	return strings.Join(parts, ",")
+}
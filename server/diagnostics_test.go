@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestDiagnostics(t *testing.T) {
+	d := diagnosticsInit(&diagnosticsConfig{SlowQueryMs: 100, MaxSlowQueries: 2})
+
+	// Nothing is recorded while the mode is off.
+	d.observeQuery("Messages.GetAll", "", "grpA", time.Second)
+	if len(d.slowQueries) != 0 {
+		t.Fatal("Query recorded while diagnostics is off")
+	}
+
+	d.setActive(true)
+	d.observeQuery("Messages.Save", "", "grpA", 50*time.Millisecond)
+	d.observeQuery("Messages.GetAll", queryShape(&types.QueryOpt{Since: 5, Limit: 10}), "grpA", 150*time.Millisecond)
+	d.observeQuery("Messages.GetAll", "", "grpB", 200*time.Millisecond)
+	d.observeQuery("Messages.GetDeleted", "", "grpC", 300*time.Millisecond)
+	if len(d.slowQueries) != 2 || d.slowQueries[0].Topic != "grpB" || d.slowQueries[1].Ms != 300 {
+		t.Errorf("Unexpected slow queries %+v", d.slowQueries)
+	}
+	if d.slowCounts["Messages.GetAll"] != 2 || d.slowCounts["Messages.Save"] != 0 {
+		t.Errorf("Unexpected slow query counts %v", d.slowCounts)
+	}
+	if shape := queryShape(&types.QueryOpt{Since: 5, Limit: 10}); shape != "since,limit" {
+		t.Errorf("Unexpected query shape '%s'", shape)
+	}
+
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		globals.hub = nil
+	}()
+	for name, depth := range map[string]int{"grpHot": 5, "grpWarm": 2, "grpIdle": 0} {
+		topic := &Topic{name: name, clientMsg: make(chan *ClientComMessage, 8), serverMsg: make(chan *ServerComMessage, 8)}
+		for range depth {
+			topic.clientMsg <- &ClientComMessage{}
+		}
+		globals.hub.topics.Store(name, topic)
+	}
+	d.sampleQueues()
+	hot := d.report()["hot_topics"].([]diagHotTopic)
+	if len(hot) != 2 || hot[0].Topic != "grpHot" || hot[0].Depth != 5 {
+		t.Errorf("Unexpected hot topics %+v", hot)
+	}
+
+	// Hot topics of the previous period are reported until new samples are taken.
+	d.logSummary()
+	if len(d.slowCounts) != 0 || len(d.queueDepth) != 0 {
+		t.Error("Summary did not start a new period")
+	}
+	if hot = d.report()["hot_topics"].([]diagHotTopic); len(hot) != 2 {
+		t.Errorf("Expected hot topics of the previous period, got %+v", hot)
+	}
+
+	if !d.setActive(false) || d.setActive(false) || len(d.slowQueries) != 0 {
+		t.Error("Failed to switch diagnostics off")
+	}
+}
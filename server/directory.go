@@ -0,0 +1,166 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Public directory of group topics. Unlike search by tags in 'fnd', the
+ *    directory is browsed without knowing what to look for:
+ *
+ *    - {set topic="grpX" directory={category, description}} publishes the
+ *      topic in the directory or updates its entry, unlist=true removes it.
+ *      Available to managers who can change the description of the topic.
+ *      Only topics which authenticated users can join are published.
+ *    - {get topic="fnd" what="directory" directory={category, offset, limit}}
+ *      lists published topics of the category or of all categories with
+ *      their public descriptions and tags, the most popular first.
+ *
+ *    Popularity is the number of subscribers decayed by the number of days
+ *    since the last message, so active topics rank above large abandoned ones.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum length of a category of the directory.
+	maxDirectoryCategoryLength = 32
+	// Maximum length of a description of a topic in the directory.
+	maxDirectoryDescriptionLength = 256
+	// Listings of the directory are not paginated beyond this many topics.
+	maxDirectoryOffset = 1000
+)
+
+// isDirectoryCategory checks if the category consists of lowercase ASCII letters, digits, '-' and '_'.
+func isDirectoryCategory(category string) bool {
+	if category == "" || len(category) > maxDirectoryCategoryLength {
+		return false
+	}
+	for _, c := range category {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// replySetDirectory publishes the group topic in the directory or removes it.
+func (t *Topic) replySetDirectory(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for the directory")
+	}
+
+	if asChan || !t.userCan(asUid, capDesc) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to publish the topic by non-manager")
+	}
+
+	req := msg.Set.Directory
+	if req.Unlist {
+		deleted, err := store.Directory.Unpublish(t.name)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		if !deleted {
+			// The topic is not listed.
+			sess.queueOut(InfoNotModifiedReply(msg, now))
+			return nil
+		}
+		sess.queueOut(NoErrReply(msg, now))
+		return nil
+	}
+
+	if !isDirectoryCategory(req.Category) || len(req.Description) > maxDirectoryDescriptionLength {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.directory: invalid category or description")
+	}
+
+	if !t.accessAuth.IsJoiner() || t.parent != "" {
+		// Users who find the topic must be able to join it or to ask to join. Topics of communities
+		// are open to members only.
+		sess.queueOut(ErrPolicyReply(msg, now))
+		return errors.New("set.directory: the topic cannot be joined")
+	}
+
+	if err := store.Directory.Publish(&types.DirectoryEntry{
+		Topic:       t.name,
+		Category:    req.Category,
+		Description: req.Description,
+	}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetDirectory lists topics of the directory, the most popular first.
+func (t *Topic) replyGetDirectory(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatFnd {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for the directory")
+	}
+
+	var opts MsgGetOpts
+	if req != nil {
+		opts = *req
+	}
+	if (opts.Category != "" && !isDirectoryCategory(opts.Category)) ||
+		opts.Offset < 0 || opts.Offset > maxDirectoryOffset || opts.Limit < 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid directory query")
+	}
+
+	entries, err := store.Directory.List(t.tenant, opts.Category, opts.Offset, opts.Limit)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(entries) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "directory"}))
+		return nil
+	}
+
+	result := make([]MsgDirectoryTopic, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		topic := entry.Topic
+		if entry.UseBt {
+			// Channels are found as 'chn' like in 'fnd'.
+			topic = types.GrpToChn(topic)
+		}
+		result[i] = MsgDirectoryTopic{
+			Topic:       topic,
+			Category:    entry.Category,
+			Description: entry.Description,
+			Public:      entry.Public,
+			Tags:        entry.Tags,
+			SubCnt:      entry.SubCnt,
+		}
+		if !entry.TouchedAt.IsZero() {
+			result[i].Touched = &entry.TouchedAt
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Directory: result,
+		},
+	})
+	return nil
+}
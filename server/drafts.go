@@ -0,0 +1,176 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Drafts of messages shared between user's devices:
+ *
+ *    - {set topic="me" draft={topic, content, ts}} saves the draft of a
+ *      message in the topic. Missing content deletes the draft. Changes are
+ *      ordered by the client timestamp ts: a change older than the stored one
+ *      is rejected with 409 so the device can fetch the newer draft.
+ *    - User's other sessions attached to 'me' are notified of the change
+ *      with {info topic="me" what="draft" src="grpX" content}.
+ *    - {get topic="me" what="drafts" drafts={ims}} returns drafts changed
+ *      since the given time, including deleted ones, or all current drafts.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum size of a draft in bytes, as JSON.
+	maxDraftSize = 1 << 13
+	// Timestamps of drafts later than this into the future are replaced with the current time.
+	maxDraftClockSkew = time.Minute
+)
+
+// draftTopicName converts the name of the topic as seen by the user to the name the draft is stored under.
+func draftTopicName(asUid types.Uid, topic string) (string, error) {
+	cat, ok := topicCatOf(topic)
+	if !ok {
+		return "", types.ErrMalformed
+	}
+	switch cat {
+	case types.TopicCatMe:
+		// P2P topic addressed by the ID of the other user.
+		uid := types.ParseUserId(topic)
+		if uid.IsZero() || uid == asUid {
+			return "", types.ErrMalformed
+		}
+		return asUid.P2PName(uid), nil
+	case types.TopicCatP2P:
+		if _, err := types.P2PNameForUser(asUid, topic); err != nil {
+			// Not a P2P topic of the user.
+			return "", types.ErrMalformed
+		}
+		return topic, nil
+	case types.TopicCatSlf:
+		return topic, nil
+	case types.TopicCatGrp:
+		if types.IsChannel(topic) {
+			// Channel readers cannot write.
+			return "", types.ErrMalformed
+		}
+		return topic, nil
+	}
+	return "", types.ErrMalformed
+}
+
+// draftTopicOriginal returns the name of the topic of the draft as seen by the user.
+func draftTopicOriginal(asUid types.Uid, topic string) string {
+	if types.GetTopicCat(topic) == types.TopicCatP2P {
+		topic, _ = types.P2PNameForUser(asUid, topic)
+	}
+	return topic
+}
+
+// replySetDraft saves or deletes a draft of the user and notifies user's other sessions.
+func (t *Topic) replySetDraft(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for drafts")
+	}
+
+	req := msg.Set.Draft
+	topic, err := draftTopicName(asUid, req.Topic)
+	if err != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.draft: invalid topic")
+	}
+	if req.Content != nil {
+		if data, err := json.Marshal(req.Content); err != nil || len(data) > maxDraftSize {
+			sess.queueOut(ErrTooLarge(msg.Id, msg.Original, now))
+			return errors.New("set.draft: draft too large")
+		}
+	}
+
+	ts := now
+	if req.Timestamp != nil && req.Timestamp.Before(now.Add(maxDraftClockSkew)) {
+		ts = req.Timestamp.UTC().Round(time.Millisecond)
+	}
+
+	saved, err := store.Drafts.Update(&types.Draft{
+		User:      asUid.String(),
+		Topic:     topic,
+		Content:   req.Content,
+		UpdatedAt: ts,
+	})
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if !saved {
+		// A later change was saved by another device.
+		sess.queueOut(ErrOutdatedReply(msg, now))
+		return nil
+	}
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic:   "me",
+			Src:     draftTopicOriginal(asUid, topic),
+			From:    asUid.UserId(),
+			What:    "draft",
+			Content: req.Content,
+		},
+		SkipSid: sess.sid,
+	})
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"ts": ts}))
+	return nil
+}
+
+// replyGetDrafts returns drafts of the user changed since the given time or all current drafts.
+func (t *Topic) replyGetDrafts(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for drafts")
+	}
+
+	var since *time.Time
+	if req != nil {
+		since = req.IfModifiedSince
+	}
+	drafts, err := store.Drafts.GetAll(asUid, since)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	result := make([]MsgDraft, 0, len(drafts))
+	for i := range drafts {
+		d := &drafts[i]
+		topic := draftTopicOriginal(asUid, d.Topic)
+		if topic == "" {
+			continue
+		}
+		result = append(result, MsgDraft{Topic: topic, Content: d.Content, Timestamp: &d.UpdatedAt})
+	}
+
+	if len(result) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "drafts"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Drafts:    result,
+		},
+	})
+	return nil
+}
@@ -130,6 +130,239 @@ func PlainText(content any) (string, error) {
 	return strings.TrimSpace(string(state.txt)), nil
 }
 
+// UnsupportedNote is appended to the text of a document by Downgrade when content without
+// a text representation is removed.
+const UnsupportedNote = "[unsupported content]"
+
+// Downgrade converts Drafty document to a form which uses only the inline styles and entities
+// for which isSupported returns true. Formatting by unsupported styles and entities is removed, the
+// text is retained. If an unsupported entity has no text representation, such as an image or an
+// attachment, UnsupportedNote is appended to the text.
+// The input is never modified. If no conversion is needed, or the content is not a Drafty document,
+// the input is returned unchanged. Otherwise the result is a new document as map[string]any.
+func Downgrade(content any, isSupported func(tp string) bool) (any, error) {
+	if _, ok := content.(map[string]any); !ok {
+		// Plain text and non-Drafty content need no conversion.
+		return content, nil
+	}
+
+	doc, err := decodeAsDrafty(content)
+	if err != nil {
+		return content, err
+	}
+
+	changed, noText := false, false
+	var fmts, ents []any
+	// Old entity key -> new entity key.
+	keymap := make(map[int]int)
+	for i := range doc.Fmt {
+		st := &doc.Fmt[i]
+		if st.Tp != "" {
+			// Inline style.
+			if !isSupported(st.Tp) {
+				changed = true
+				continue
+			}
+			fmts = append(fmts, map[string]any{"tp": st.Tp, "at": st.At, "len": st.Length})
+			continue
+		}
+
+		if st.Key >= len(doc.Ent) {
+			// Invalid reference.
+			changed = true
+			continue
+		}
+
+		ent := &doc.Ent[st.Key]
+		if !isSupported(ent.Tp) {
+			changed = true
+			if st.At < 0 || st.Length <= 0 || st.At+st.Length > doc.gc.length() ||
+				strings.TrimSpace(doc.gc.slice(st.At, st.At+st.Length).string()) == "" {
+				noText = true
+			}
+			continue
+		}
+
+		key, ok := keymap[st.Key]
+		if !ok {
+			key = len(ents)
+			keymap[st.Key] = key
+			ents = append(ents, map[string]any{"tp": ent.Tp, "data": ent.Data})
+		}
+		fmts = append(fmts, map[string]any{"at": st.At, "len": st.Length, "key": key})
+	}
+
+	if !changed {
+		return content, nil
+	}
+
+	txt := doc.Txt
+	if noText {
+		if txt != "" {
+			txt += " "
+		}
+		txt += UnsupportedNote
+	}
+
+	result := map[string]any{"txt": txt}
+	if len(fmts) > 0 {
+		result["fmt"] = fmts
+	}
+	if len(ents) > 0 {
+		result["ent"] = ents
+	}
+	return result, nil
+}
+
+// References returns unique references to out-of-band attachments, values of data.ref of
+// entities, in the order they appear in the document. Content which is not a Drafty document
+// has no references.
+func References(content any) ([]string, error) {
+	if _, ok := content.(map[string]any); !ok {
+		return nil, nil
+	}
+
+	doc, err := decodeAsDrafty(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []string
+	seen := map[string]bool{}
+	for i := range doc.Ent {
+		if ref, ok := nullableMapGet(doc.Ent[i].Data, "ref"); ok && ref != "" && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	return refs, nil
+}
+
+// Links returns unique URLs of links, values of data.url of LN entities, in the order they appear
+// in the document. Content which is not a Drafty document has no links.
+func Links(content any) ([]string, error) {
+	if _, ok := content.(map[string]any); !ok {
+		return nil, nil
+	}
+
+	doc, err := decodeAsDrafty(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []string
+	seen := map[string]bool{}
+	for i := range doc.Ent {
+		if doc.Ent[i].Tp != "LN" {
+			continue
+		}
+		if link, ok := nullableMapGet(doc.Ent[i].Data, "url"); ok && link != "" && !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+// Mentions returns unique IDs of mentioned users, values of data.val of MN entities, in the order
+// they appear in the document. Content which is not a Drafty document has no mentions.
+func Mentions(content any) ([]string, error) {
+	if _, ok := content.(map[string]any); !ok {
+		return nil, nil
+	}
+
+	doc, err := decodeAsDrafty(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var mentions []string
+	seen := map[string]bool{}
+	for i := range doc.Ent {
+		if doc.Ent[i].Tp != "MN" {
+			continue
+		}
+		if val, ok := nullableMapGet(doc.Ent[i].Data, "val"); ok && val != "" && !seen[val] {
+			seen[val] = true
+			mentions = append(mentions, val)
+		}
+	}
+	return mentions, nil
+}
+
+// Attach appends entities of type tp with the given data to the Drafty document as attachments,
+// i.e. entities not bound to any text. The input is never modified, the result is a new document
+// as map[string]any. Content which is not a Drafty document is returned unchanged.
+func Attach(content any, tp string, data []map[string]any) (any, error) {
+	src, ok := content.(map[string]any)
+	if !ok || len(data) == 0 {
+		return content, nil
+	}
+
+	if _, err := decodeAsDrafty(content); err != nil {
+		return content, err
+	}
+
+	result := make(map[string]any, len(src))
+	for key, val := range src {
+		result[key] = val
+	}
+	fmts, _ := src["fmt"].([]any)
+	ents, _ := src["ent"].([]any)
+	// Copy the slices: appending could otherwise modify the input.
+	fmts = append(make([]any, 0, len(fmts)+len(data)), fmts...)
+	ents = append(make([]any, 0, len(ents)+len(data)), ents...)
+	for _, dt := range data {
+		fmts = append(fmts, map[string]any{"at": -1, "len": 0, "key": len(ents)})
+		ents = append(ents, map[string]any{"tp": tp, "data": dt})
+	}
+	result["fmt"] = fmts
+	result["ent"] = ents
+	return result, nil
+}
+
+// UpdateEntities replaces data of entities of type tp with the result of update. Entities for which
+// update returns nil are not changed. The input is never modified, the result is a new document
+// as map[string]any. Content which is not a Drafty document is returned unchanged.
+func UpdateEntities(content any, tp string, update func(data map[string]any) map[string]any) (any, error) {
+	src, ok := content.(map[string]any)
+	if !ok {
+		return content, nil
+	}
+
+	if _, err := decodeAsDrafty(content); err != nil {
+		return content, err
+	}
+
+	ents, _ := src["ent"].([]any)
+	var updated []any
+	for i, ent := range ents {
+		ent, _ := ent.(map[string]any)
+		if ent == nil || ent["tp"] != tp {
+			continue
+		}
+		data, _ := ent["data"].(map[string]any)
+		if data = update(data); data == nil {
+			continue
+		}
+		if updated == nil {
+			// Copy the slice: changing it in place would modify the input.
+			updated = append([]any(nil), ents...)
+		}
+		updated[i] = map[string]any{"tp": tp, "data": data}
+	}
+	if updated == nil {
+		return content, nil
+	}
+
+	result := make(map[string]any, len(src))
+	for key, val := range src {
+		result[key] = val
+	}
+	result["ent"] = updated
+	return result, nil
+}
+
 // styleToSpan converts Drafty style to internal representation.
 func (s *span) styleToSpan(in *style) error {
 	s.tp = in.Tp
@@ -2,6 +2,8 @@ package drafty
 
 import (
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -181,3 +183,200 @@ func TestPreview(t *testing.T) {
 		}
 	}
 }
+
+func TestDowngrade(t *testing.T) {
+	supported := map[string]bool{"ST": true, "EM": true, "BR": true, "LN": true}
+	isSupported := func(tp string) bool { return supported[tp] }
+
+	// Empty string means the input is returned unchanged.
+	expect := []string{
+		``,
+		``,
+		`{"txt":"[unsupported content]"}`,
+		``,
+		``,
+		``,
+		`{"txt":"  [unsupported content]"}`,
+		``,
+		`{"fmt":[{"at":5,"len":4,"tp":"ST"},{"at":13,"len":9,"tp":"EM"},{"at":35,"len":3,"tp":"ST"}],"txt":"This text is formatted and deleted too"}`,
+		``,
+		`{"fmt":[{"at":13,"len":1,"tp":"BR"},{"at":16,"len":1,"tp":"BR"}],"txt":"Alice Johnson    This is a test [unsupported content]"}`,
+		``,
+	}
+	for i := range expect {
+		var val any
+		if err := json.Unmarshal([]byte(validInputs[i]), &val); err != nil {
+			t.Errorf("Failed to parse input %d '%s': %s", i, validInputs[i], err)
+		}
+		orig, _ := json.Marshal(val)
+		res, err := Downgrade(val, isSupported)
+		if err != nil {
+			t.Errorf("%d failed with error: %s", i, err)
+			continue
+		}
+		after, _ := json.Marshal(val)
+		if string(orig) != string(after) {
+			t.Errorf("%d input was modified: '%s'", i, after)
+		}
+		out, _ := json.Marshal(res)
+		if expect[i] == "" {
+			if string(out) != string(orig) {
+				t.Errorf("%d expected unchanged output, got '%s'", i, out)
+			}
+		} else if string(out) != expect[i] {
+			t.Errorf("%d output '%s' does not match '%s'", i, out, expect[i])
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	inputs := []string{
+		`"plain text"`,
+		`{"txt":"no attachments","fmt":[{"at":0,"len":2,"tp":"ST"}]}`,
+		`{"ent":[{"data":{"mime":"image/jpeg","ref":"/v0/file/s/abc.jpg"},"tp":"IM"},{"data":{"url":"https://example.com"},"tp":"LN"},` +
+			`{"data":{"ref":"/v0/file/s/def.pdf"},"tp":"EX"},{"data":{"ref":"/v0/file/s/abc.jpg"},"tp":"IM"}],"fmt":[{"len":1}]}`,
+	}
+	expect := [][]string{
+		nil,
+		nil,
+		{"/v0/file/s/abc.jpg", "/v0/file/s/def.pdf"},
+	}
+	for i := range inputs {
+		var val any
+		if err := json.Unmarshal([]byte(inputs[i]), &val); err != nil {
+			t.Fatalf("Failed to parse input %d '%s': %s", i, inputs[i], err)
+		}
+		refs, err := References(val)
+		if err != nil {
+			t.Errorf("%d failed with error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(refs, expect[i]) {
+			t.Errorf("%d references %v do not match %v", i, refs, expect[i])
+		}
+	}
+
+	var val any
+	json.Unmarshal([]byte(`{"ent":[{"data":{"ref":"/v0/file/s/abc.jpg"}}]}`), &val)
+	if _, err := References(val); err == nil {
+		t.Error("Invalid entity is expected to fail")
+	}
+}
+
+func TestLinks(t *testing.T) {
+	inputs := []string{
+		`"https://example.com"`,
+		`{"txt":"no links","fmt":[{"at":0,"len":2,"tp":"ST"}]}`,
+		`{"txt":"a b c","ent":[{"data":{"url":"https://example.com"},"tp":"LN"},{"data":{"ref":"/v0/file/s/abc.jpg","url":"x"},"tp":"IM"},` +
+			`{"data":{"url":"https://tinode.co"},"tp":"LN"},{"data":{"url":"https://example.com"},"tp":"LN"}],` +
+			`"fmt":[{"len":1},{"at":2,"len":1,"key":2},{"at":4,"len":1,"key":3}]}`,
+	}
+	expect := [][]string{
+		nil,
+		nil,
+		{"https://example.com", "https://tinode.co"},
+	}
+	for i := range inputs {
+		var val any
+		if err := json.Unmarshal([]byte(inputs[i]), &val); err != nil {
+			t.Fatalf("Failed to parse input %d '%s': %s", i, inputs[i], err)
+		}
+		links, err := Links(val)
+		if err != nil {
+			t.Errorf("%d failed with error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(links, expect[i]) {
+			t.Errorf("%d links %v do not match %v", i, links, expect[i])
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	inputs := []string{
+		`"@alice"`,
+		`{"txt":"@alice hi","fmt":[{"at":0,"len":6,"tp":"ST"}]}`,
+		`{"txt":"@alice @bob @alice","ent":[{"data":{"val":"usrAlice"},"tp":"MN"},{"data":{"url":"usrBob"},"tp":"LN"},` +
+			`{"data":{"val":"usrBob"},"tp":"MN"},{"data":{"val":"usrAlice"},"tp":"MN"}],` +
+			`"fmt":[{"len":6},{"at":7,"len":4,"key":2},{"at":12,"len":6,"key":3}]}`,
+	}
+	expect := [][]string{
+		nil,
+		nil,
+		{"usrAlice", "usrBob"},
+	}
+	for i := range inputs {
+		var val any
+		if err := json.Unmarshal([]byte(inputs[i]), &val); err != nil {
+			t.Fatalf("Failed to parse input %d '%s': %s", i, inputs[i], err)
+		}
+		mentions, err := Mentions(val)
+		if err != nil {
+			t.Errorf("%d failed with error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(mentions, expect[i]) {
+			t.Errorf("%d mentions %v do not match %v", i, mentions, expect[i])
+		}
+	}
+}
+
+func TestAttach(t *testing.T) {
+	var val any
+	input := `{"txt":"see this","fmt":[{"at":4,"len":4,"key":0}],"ent":[{"data":{"url":"https://example.com"},"tp":"LN"}]}`
+	if err := json.Unmarshal([]byte(input), &val); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Attach(val, "LP", []map[string]any{{"url": "https://example.com", "title": "Example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(result)
+	expect := `{"ent":[{"data":{"url":"https://example.com"},"tp":"LN"},{"data":{"title":"Example","url":"https://example.com"},"tp":"LP"}],` +
+		`"fmt":[{"at":4,"key":0,"len":4},{"at":-1,"key":1,"len":0}],"txt":"see this"}`
+	if string(out) != expect {
+		t.Errorf("Attach result '%s' does not match '%s'", out, expect)
+	}
+
+	// The input is not modified.
+	if orig, _ := json.Marshal(val); string(orig) != `{"ent":[{"data":{"url":"https://example.com"},"tp":"LN"}],"fmt":[{"at":4,"key":0,"len":4}],"txt":"see this"}` {
+		t.Errorf("Attach modified the input: '%s'", orig)
+	}
+
+	if result, _ := Attach("plain text", "LP", []map[string]any{{"url": "https://example.com"}}); result != "plain text" {
+		t.Errorf("Plain text is expected unchanged, got %v", result)
+	}
+}
+
+func TestUpdateEntities(t *testing.T) {
+	var val any
+	input := `{"txt":" ","fmt":[{"at":-1,"len":0,"key":0},{"at":-1,"len":0,"key":1}],` +
+		`"ent":[{"data":{"mime":"audio/webm","ref":"/v0/file/s/abc.webm"},"tp":"AU"},{"data":{"ref":"/v0/file/s/def.png"},"tp":"IM"}]}`
+	if err := json.Unmarshal([]byte(input), &val); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := UpdateEntities(val, "AU", func(data map[string]any) map[string]any {
+		return map[string]any{"mime": data["mime"], "ref": data["ref"], "duration": 1500}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(result)
+	expect := `{"ent":[{"data":{"duration":1500,"mime":"audio/webm","ref":"/v0/file/s/abc.webm"},"tp":"AU"},` +
+		`{"data":{"ref":"/v0/file/s/def.png"},"tp":"IM"}],"fmt":[{"at":-1,"key":0,"len":0},{"at":-1,"key":1,"len":0}],"txt":" "}`
+	if string(out) != expect {
+		t.Errorf("UpdateEntities result '%s' does not match '%s'", out, expect)
+	}
+
+	// The input is not modified.
+	if orig, _ := json.Marshal(val); strings.Contains(string(orig), "duration") {
+		t.Errorf("UpdateEntities modified the input: '%s'", orig)
+	}
+
+	// Nothing to update.
+	if result, _ = UpdateEntities(val, "AU", func(map[string]any) map[string]any { return nil }); !reflect.DeepEqual(result, val) {
+		t.Errorf("Expected content unchanged, got %v", result)
+	}
+}
@@ -0,0 +1,64 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Graceful drain of the node for rolling upgrades. The operator calls
+ *    POST /admin/v0/drain, the node stops accepting new sessions, the cluster
+ *    leader moves topics owned by the node to other nodes, then connected
+ *    clients are asked to reconnect with {ctrl code=503 text="draining"} in
+ *    batches. Once no client sessions are left, the node shuts down.
+ *
+ *    Topics are moved only if cluster failover is enabled: the node reports
+ *    draining in response to leader's health checks and the leader excludes
+ *    it from the ring hash.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	// Number of sessions asked to reconnect at once. Reconnecting all sessions at the same
+	// time would overload the remaining nodes.
+	drainBatchSize = 500
+	// Interval between batches of sessions asked to reconnect.
+	drainInterval = time.Second
+)
+
+// Closed when the draining node has no client sessions left.
+var drainDone = make(chan struct{})
+
+// drainStart puts the node into draining mode. Returns false if the node is draining already.
+func drainStart() bool {
+	if !globals.draining.CompareAndSwap(false, true) {
+		return false
+	}
+
+	logs.Info.Println("drain: node is draining")
+	if globals.cluster != nil && globals.cluster.fo == nil {
+		logs.Warn.Println("drain: cluster failover is disabled, topics are not moved to other nodes")
+	}
+	go drainSessions()
+	return true
+}
+
+// drainSessions asks client sessions to reconnect in batches and signals shutdown once none are left.
+func drainSessions() {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	// The first batch is sent after the interval: the leader has to move topics to other nodes
+	// before clients reconnect to them.
+	for range ticker.C {
+		left := globals.sessionStore.Drain(drainBatchSize)
+		if left == 0 {
+			break
+		}
+		logs.Info.Println("drain: sessions left", left)
+	}
+	close(drainDone)
+}
@@ -0,0 +1,341 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Server-side support of end-to-end encryption. The server never sees the
+ *    keys which encrypt messages, it only stores public keys of users' devices
+ *    (prekey bundles) and relays sender keys of group topics:
+ *
+ *    - {set topic="me" keys={...}} uploads the bundle of a device,
+ *      {get what="keys"} on 'me' lists bundles of the user's own devices,
+ *      on a p2p topic returns bundles of the peer, in a group topic bundles
+ *      of the member keys.user. Each bundle fetched by another user carries
+ *      one one-time prekey which is removed from the server.
+ *      {del topic="me" what="keys" dev="ID"} deletes the bundle.
+ *    - {set topic="grpX" skey={dev, keys=[...]}} sends the sender key of a
+ *      device encrypted for each device of the other members. The recipients
+ *      are notified with {info topic="me" what="skey" src="grpX"} and fetch
+ *      the keys with {get what="skey" skey={dev}}. Fetched keys are deleted.
+ *
+ *    Topics with aux.e2ee=true carry opaque payloads: their messages are
+ *    marked with head.e2ee and are not indexed for search, not transformed
+ *    on delivery (link previews, translations) and not previewed in pushes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Key of the flag in topic's aux which marks topics with end-to-end encrypted content.
+	auxE2EE = "e2ee"
+
+	// Maximum length of a device ID.
+	maxE2EEDeviceIdLength = 64
+	// Maximum size of a public key or a signature in bytes.
+	maxE2EEKeySize = 1024
+	// Maximum number of one-time prekeys of a device kept by the server.
+	maxE2EEOneTimeKeys = 100
+	// Maximum size of an encrypted sender key in bytes.
+	maxSenderKeySize = 4096
+	// Maximum number of sender keys in one request.
+	maxSenderKeysPerRequest = 256
+)
+
+// isE2EE returns true if content of the topic is encrypted end-to-end.
+func (t *Topic) isE2EE() bool {
+	e2ee, _ := t.aux[auxE2EE].(bool)
+	return e2ee
+}
+
+// normalizeMsgE2EE marks messages of end-to-end encrypted topics as opaque. The mark set by the client
+// in other topics is removed.
+func (t *Topic) normalizeMsgE2EE(head map[string]any) map[string]any {
+	if !t.isE2EE() {
+		delete(head, types.MsgHeadE2EE)
+		return head
+	}
+	if head == nil {
+		head = map[string]any{}
+	}
+	head[types.MsgHeadE2EE] = true
+	return head
+}
+
+// validE2EEDeviceId checks if the device ID is acceptable.
+func validE2EEDeviceId(dev string) bool {
+	return dev != "" && dev != "*" && len(dev) <= maxE2EEDeviceIdLength
+}
+
+// replySetKeys saves public keys of the user's device.
+func (t *Topic) replySetKeys(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for uploading keys")
+	}
+
+	keys := msg.Set.Keys
+	invalid := !validE2EEDeviceId(keys.Dev) ||
+		len(keys.IdentityKey) == 0 || len(keys.IdentityKey) > maxE2EEKeySize ||
+		len(keys.SignedPreKey) == 0 || len(keys.SignedPreKey) > maxE2EEKeySize ||
+		len(keys.Signature) > maxE2EEKeySize || len(keys.OneTimeKeys) > maxE2EEOneTimeKeys
+	for _, otk := range keys.OneTimeKeys {
+		if len(otk) == 0 || len(otk) > maxE2EEKeySize {
+			invalid = true
+		}
+	}
+	if invalid {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid key bundle")
+	}
+
+	if err := store.Keys.UpsertBundle(&types.KeyBundle{
+		User:         asUid.String(),
+		DeviceId:     keys.Dev,
+		IdentityKey:  keys.IdentityKey,
+		SignedPreKey: keys.SignedPreKey,
+		Signature:    keys.Signature,
+		OneTimeKeys:  keys.OneTimeKeys,
+	}, maxE2EEOneTimeKeys); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetKeys returns public keys of the user's own devices on 'me', of the peer in p2p topics,
+// or of the requested member in group topics.
+func (t *Topic) replyGetKeys(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	var owner types.Uid
+	switch t.cat {
+	case types.TopicCatMe:
+		owner = asUid
+	case types.TopicCatP2P:
+		owner = t.p2pOtherUser(asUid)
+	case types.TopicCatGrp:
+		if req != nil {
+			owner = types.ParseUserId(req.User)
+		}
+		if owner.IsZero() {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("get.keys: missing user")
+		}
+		if pud, ok := t.perUser[owner]; !ok || pud.deleted {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return nil
+		}
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting keys")
+	}
+
+	if t.cat != types.TopicCatMe {
+		if pud := t.perUser[asUid]; !(pud.modeGiven & pud.modeWant).IsReader() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("get.keys: no read access")
+		}
+	}
+
+	// One-time prekeys are used up by other users only.
+	bundles, err := store.Keys.GetBundles(owner, owner != asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(bundles) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "keys"}))
+		return nil
+	}
+
+	result := make([]MsgKeyBundle, 0, len(bundles))
+	for i := range bundles {
+		kb := &bundles[i]
+		mkb := MsgKeyBundle{
+			User:         owner.UserId(),
+			Dev:          kb.DeviceId,
+			IdentityKey:  kb.IdentityKey,
+			SignedPreKey: kb.SignedPreKey,
+			Signature:    kb.Signature,
+			OneTimeKeys:  kb.OneTimeKeys,
+			Updated:      &kb.UpdatedAt,
+		}
+		if owner == asUid {
+			mkb.OneTimeCount = kb.OneTimeCount
+		}
+		result = append(result, mkb)
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Keys:      result,
+		},
+	})
+	return nil
+}
+
+// replyDelKeys deletes public keys of the user's device or of all devices.
+func (t *Topic) replyDelKeys(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.keys: invalid topic category")
+	}
+
+	dev := msg.Del.Dev
+	if dev != "*" && !validE2EEDeviceId(dev) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.keys: missing or invalid device ID")
+	}
+	if dev == "*" {
+		dev = ""
+	}
+
+	deleted, err := store.Keys.DeleteBundle(asUid, dev)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if !deleted {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return nil
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replySetSenderKeys saves sender keys for devices of other members of the group topic and notifies
+// the recipients.
+func (t *Topic) replySetSenderKeys(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp || t.isChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for sender keys")
+	}
+
+	if pud := t.perUser[asUid]; !(pud.modeGiven & pud.modeWant).IsWriter() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.skey: no write access")
+	}
+
+	req := msg.Set.SKey
+	if !validE2EEDeviceId(req.Dev) || len(req.Keys) == 0 || len(req.Keys) > maxSenderKeysPerRequest {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.skey: invalid request")
+	}
+
+	keys := make([]types.SenderKey, 0, len(req.Keys))
+	var recipients []types.Uid
+	for _, sk := range req.Keys {
+		uid := types.ParseUserId(sk.User)
+		if uid.IsZero() || !validE2EEDeviceId(sk.Dev) || len(sk.Data) == 0 || len(sk.Data) > maxSenderKeySize {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.skey: invalid sender key")
+		}
+		if pud, ok := t.perUser[uid]; !ok || pud.deleted {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return errors.New("set.skey: recipient is not a member")
+		}
+		keys = append(keys, types.SenderKey{
+			Topic:      t.name,
+			From:       asUid.String(),
+			FromDevice: req.Dev,
+			User:       uid.String(),
+			DeviceId:   sk.Dev,
+			Data:       sk.Data,
+		})
+		if !slices.Contains(recipients, uid) {
+			recipients = append(recipients, uid)
+		}
+	}
+
+	if err := store.Keys.AddSenderKeys(keys); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	for _, uid := range recipients {
+		globals.hub.routeSrv <- &ServerComMessage{
+			Info: &MsgServerInfo{
+				Topic: "me",
+				Src:   t.original(uid),
+				From:  asUid.UserId(),
+				What:  "skey",
+			},
+			RcptTo: uid.UserId(),
+		}
+	}
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"count": len(keys)}))
+	return nil
+}
+
+// replyGetSenderKeys returns and deletes sender keys waiting for the user's device in the group topic.
+func (t *Topic) replyGetSenderKeys(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp || t.isChan {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for sender keys")
+	}
+
+	if req == nil || !validE2EEDeviceId(req.Dev) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("get.skey: missing or invalid device ID")
+	}
+
+	if pud := t.perUser[asUid]; !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("get.skey: no read access")
+	}
+
+	keys, err := store.Keys.PopSenderKeys(t.name, asUid, req.Dev)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(keys) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "skey"}))
+		return nil
+	}
+
+	result := make([]MsgSenderKey, 0, len(keys))
+	for i := range keys {
+		sk := &keys[i]
+		result = append(result, MsgSenderKey{
+			User:      types.ParseUid(sk.From).UserId(),
+			Dev:       sk.FromDevice,
+			Data:      sk.Data,
+			Timestamp: &sk.CreatedAt,
+		})
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			SKey:      result,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,103 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Periodic health check of message encryption at rest.
+ *
+ *    The check verifies that the key provider, if any, still returns the
+ *    current key, then encrypts and decrypts a canary value with the current
+ *    key and a per-topic key derived from it. It never reads or writes stored
+ *    messages. A failure is logged and counted; the server can also be
+ *    configured to stop accepting new messages (read-only) or to stop serving
+ *    and storing message content altogether (fail closed) until the check
+ *    passes again.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+)
+
+// Actions taken when encryption health check fails.
+const (
+	// Log the failure and update metrics only.
+	encCheckOnFailureLog = "log"
+	// Reject new messages while encryption is unhealthy.
+	encCheckOnFailureReadOnly = "read_only"
+	// Reject new messages and refuse to read or write message content.
+	encCheckOnFailureFailClosed = "fail_closed"
+)
+
+// parseEncCheckOnFailure validates the failure action, defaulting to 'log'.
+func parseEncCheckOnFailure(action string) (string, error) {
+	switch action {
+	case "", encCheckOnFailureLog:
+		return encCheckOnFailureLog, nil
+	case encCheckOnFailureReadOnly, encCheckOnFailureFailClosed:
+		return action, nil
+	}
+	return "", errors.New("invalid encryption check failure action '" + action + "'")
+}
+
+// runEncryptionCheck performs one health check and applies the failure action.
+// Returns true if encryption is healthy.
+func runEncryptionCheck(onFailure string) bool {
+	err := store.EncryptionSelfTest()
+	healthy := err == nil
+	wasHealthy := !globals.encryptionUnhealthy.Swap(!healthy)
+
+	if healthy {
+		statsSet("EncryptionHealthy", 1)
+		if !wasHealthy {
+			logs.Info.Println("Encryption health check passed, resuming normal operation")
+		}
+	} else {
+		statsSet("EncryptionHealthy", 0)
+		statsInc("EncryptionCheckFailures", 1)
+		logs.Err.Printf("ALERT: encryption health check failed (on_failure=%s): %s", onFailure, err)
+	}
+
+	switch onFailure {
+	case encCheckOnFailureReadOnly:
+		globals.encryptionReadOnly.Store(!healthy)
+	case encCheckOnFailureFailClosed:
+		globals.encryptionReadOnly.Store(!healthy)
+		store.SuspendEncryption(!healthy)
+	}
+	return healthy
+}
+
+// encryptionHealthCheck runs the encryption self-test every 'period'.
+// Returns channel which can be used to stop the process.
+func encryptionHealthCheck(period time.Duration, onFailure string) chan<- bool {
+	statsRegisterInt("EncryptionHealthy")
+	statsRegisterInt("EncryptionCheckFailures")
+	runEncryptionCheck(onFailure)
+
+	// Unbuffered stop channel. Whomever stops the check must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Encryption health check started with period %s, on failure: %s",
+			period.Round(time.Second), onFailure)
+		for {
+			select {
+			case <-ticker.C:
+				runEncryptionCheck(onFailure)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
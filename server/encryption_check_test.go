@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// memPCache is an in-memory persistent cache.
+type memPCache map[string]string
+
+func (mc memPCache) Get(key string) (string, error) {
+	if val, ok := mc[key]; ok {
+		return val, nil
+	}
+	return "", types.ErrNotFound
+}
+
+func (mc memPCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	if _, ok := mc[key]; ok && failOnDuplicate {
+		return types.ErrDuplicate
+	}
+	mc[key] = value
+	return nil
+}
+
+func (mc memPCache) Delete(key string) error {
+	delete(mc, key)
+	return nil
+}
+
+func (mc memPCache) Expire(keyPrefix string, olderThan time.Time) error {
+	return nil
+}
+
+// brokenPCache fails all operations, making per-topic keys unavailable.
+type brokenPCache struct{}
+
+func (brokenPCache) Get(key string) (string, error) {
+	return "", errors.New("cache unavailable")
+}
+
+func (brokenPCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	return errors.New("cache unavailable")
+}
+
+func (brokenPCache) Delete(key string) error {
+	return errors.New("cache unavailable")
+}
+
+func (brokenPCache) Expire(keyPrefix string, olderThan time.Time) error {
+	return errors.New("cache unavailable")
+}
+
+func TestRunEncryptionCheck(t *testing.T) {
+	key, _ := store.GenerateEncryptionKey()
+	if err := store.InitMessageEncryption(key, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnablePerTopicKeys(true); err != nil {
+		t.Fatal(err)
+	}
+	savedPCache := store.PCache
+	cache := memPCache{}
+	t.Cleanup(func() {
+		store.PCache = savedPCache
+		store.SuspendEncryption(false)
+		store.InitMessageEncryption("", 0)
+		globals.encryptionUnhealthy.Store(false)
+		globals.encryptionReadOnly.Store(false)
+	})
+	healthy := func(ok bool) {
+		if ok {
+			store.PCache = cache
+		} else {
+			store.PCache = brokenPCache{}
+		}
+	}
+
+	for _, onFailure := range []string{encCheckOnFailureLog, encCheckOnFailureReadOnly, encCheckOnFailureFailClosed} {
+		healthy(false)
+		if runEncryptionCheck(onFailure) {
+			t.Fatalf("%s: expected the check to fail", onFailure)
+		}
+		if !globals.encryptionUnhealthy.Load() {
+			t.Errorf("%s: expected encryption marked unhealthy", onFailure)
+		}
+		// Only 'log' keeps accepting messages.
+		if readOnly := globals.encryptionReadOnly.Load(); readOnly != (onFailure != encCheckOnFailureLog) {
+			t.Errorf("%s: unexpected read-only state %t", onFailure, readOnly)
+		}
+		if suspended := store.IsEncryptionSuspended(); suspended != (onFailure == encCheckOnFailureFailClosed) {
+			t.Errorf("%s: unexpected suspended state %t", onFailure, suspended)
+		}
+
+		// Recovery.
+		healthy(true)
+		if !runEncryptionCheck(onFailure) {
+			t.Fatalf("%s: expected the check to pass", onFailure)
+		}
+		if globals.encryptionUnhealthy.Load() || globals.encryptionReadOnly.Load() || store.IsEncryptionSuspended() {
+			t.Errorf("%s: expected normal operation after recovery", onFailure)
+		}
+	}
+}
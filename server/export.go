@@ -0,0 +1,105 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Export of events to a message broker (Kafka, NATS JetStream), see the
+ *    export package. Events:
+ *
+ *    - message.posted: a message is published to a topic.
+ *    - subscription.created, subscription.updated, subscription.deleted:
+ *      a subscription to a topic is created, its access mode is changed or
+ *      it's deleted.
+ *    - account.created, account.updated, account.deleted: a user account is
+ *      created, updated or suspended, or deleted.
+ *
+ *    Events are published by the cluster node where they happen.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"github.com/tinode/chat/server/export"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// exportMessage exports the message accepted for delivery.
+func (t *Topic) exportMessage(data *MsgServerData) {
+	if !export.Wants(export.EventMessagePosted) {
+		return
+	}
+	export.Publish(&export.Event{
+		Type:  export.EventMessagePosted,
+		Topic: t.name,
+		User:  data.From,
+		Data: map[string]any{
+			"seq":     data.SeqId,
+			"head":    data.Head,
+			"content": data.Content,
+		},
+	})
+}
+
+// exportSubscription exports creation, change or deletion of the subscription.
+func exportSubscription(sub *types.Subscription, action int) {
+	var event string
+	switch action {
+	case plgActCreate:
+		event = export.EventSubscriptionCreated
+	case plgActUpd:
+		event = export.EventSubscriptionUpdated
+	case plgActDel:
+		event = export.EventSubscriptionDeleted
+	}
+	if !export.Wants(event) {
+		return
+	}
+
+	ev := &export.Event{
+		Type:  event,
+		Topic: sub.Topic,
+		User:  types.ParseUid(sub.User).UserId(),
+	}
+	if action != plgActDel {
+		ev.Data = map[string]any{
+			"want":  sub.ModeWant.String(),
+			"given": sub.ModeGiven.String(),
+		}
+	}
+	export.Publish(ev)
+}
+
+// exportAccount exports creation, change or deletion of the account.
+func exportAccount(user *types.User, action int) {
+	var event string
+	switch action {
+	case plgActCreate:
+		event = export.EventAccountCreated
+	case plgActUpd:
+		event = export.EventAccountUpdated
+	case plgActDel:
+		event = export.EventAccountDeleted
+	}
+	if !export.Wants(event) {
+		return
+	}
+
+	ev := &export.Event{
+		Type: event,
+		User: user.Uid().UserId(),
+	}
+	if action != plgActDel {
+		ev.Data = map[string]any{
+			"state":  user.State.String(),
+			"public": user.Public,
+			"tags":   user.Tags,
+		}
+	}
+	export.Publish(ev)
+}
+
+// exportAccountDeleted exports deletion of the account.
+func exportAccountDeleted(uid types.Uid) {
+	user := &types.User{}
+	user.SetUid(uid)
+	exportAccount(user, plgActDel)
+}
@@ -0,0 +1,62 @@
+package export
+
+import (
+	"encoding/binary"
+	"encoding/json"
+)
+
+// AvroSchema is the Avro schema of events. Event-specific data is a JSON-encoded string.
+const AvroSchema = `{"type":"record","name":"Event","namespace":"co.tinode.export","fields":[` +
+	`{"name":"v","type":"int"},` +
+	`{"name":"id","type":"string"},` +
+	`{"name":"type","type":"string"},` +
+	`{"name":"ts","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"topic","type":"string","default":""},` +
+	`{"name":"user","type":"string","default":""},` +
+	`{"name":"data","type":"string","default":""}]}`
+
+// avroRecord is the event with fields of the Avro schema, used for Avro JSON encoding.
+type avroRecord struct {
+	V     int    `json:"v"`
+	Id    string `json:"id"`
+	Type  string `json:"type"`
+	Ts    int64  `json:"ts"`
+	Topic string `json:"topic"`
+	User  string `json:"user"`
+	Data  string `json:"data"`
+}
+
+func toAvroRecord(ev *Event) (*avroRecord, error) {
+	rec := &avroRecord{V: ev.V, Id: ev.Id, Type: ev.Type, Ts: ev.Ts, Topic: ev.Topic, User: ev.User}
+	if ev.Data != nil {
+		data, err := json.Marshal(ev.Data)
+		if err != nil {
+			return nil, err
+		}
+		rec.Data = string(data)
+	}
+	return rec, nil
+}
+
+// encodeAvro encodes the event in Avro binary encoding according to AvroSchema.
+func encodeAvro(ev *Event) ([]byte, error) {
+	rec, err := toAvroRecord(ev)
+	if err != nil {
+		return nil, err
+	}
+	buf := binary.AppendVarint(nil, int64(rec.V))
+	for _, str := range []string{rec.Id, rec.Type} {
+		buf = appendAvroString(buf, str)
+	}
+	buf = binary.AppendVarint(buf, rec.Ts)
+	for _, str := range []string{rec.Topic, rec.User, rec.Data} {
+		buf = appendAvroString(buf, str)
+	}
+	return buf, nil
+}
+
+// appendAvroString appends the string as Avro string: zigzag varint length followed by UTF-8 bytes.
+func appendAvroString(buf []byte, str string) []byte {
+	buf = binary.AppendVarint(buf, int64(len(str)))
+	return append(buf, str...)
+}
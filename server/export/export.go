@@ -0,0 +1,350 @@
+// Package export publishes events of messages, subscriptions and accounts to a message broker, Kafka or
+// NATS JetStream, for consumption by external systems. Events are partitioned by topic: events of one topic
+// are published in order by the same worker with the same partitioning key. Events are published at least
+// once: failed batches are retried until the broker acknowledges them. Consumers should deduplicate events
+// by ID. Events are queued in memory: events which have not been acknowledged when the server stops, or do
+// not fit into the queue, are lost and logged as dead letters.
+package export
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// SchemaVersion is the version of the schema of events. It's incremented on incompatible changes.
+const SchemaVersion = 1
+
+const (
+	defaultWorkers    = 4
+	defaultQueueSize  = 4096
+	defaultBatchSize  = 100
+	defaultBackoff    = 1
+	defaultMaxBackoff = 60
+	// Time given to workers to publish queued events when stopping (seconds).
+	defaultDrainTimeout = 5
+)
+
+// Formats of payloads.
+const (
+	FormatJSON = "json"
+	FormatAvro = "avro"
+)
+
+// Types of events.
+const (
+	EventMessagePosted       = "message.posted"
+	EventSubscriptionCreated = "subscription.created"
+	EventSubscriptionUpdated = "subscription.updated"
+	EventSubscriptionDeleted = "subscription.deleted"
+	EventAccountCreated      = "account.created"
+	EventAccountUpdated      = "account.updated"
+	EventAccountDeleted      = "account.deleted"
+)
+
+// Event is an exported event.
+type Event struct {
+	// Version of the schema of the event.
+	V int `json:"v"`
+	// Unique ID of the event, the same in all attempts to publish it.
+	Id string `json:"id"`
+	// Type of the event.
+	Type string `json:"type"`
+	// Time of the event, milliseconds since the epoch.
+	Ts int64 `json:"ts"`
+	// Topic of the event.
+	Topic string `json:"topic,omitempty"`
+	// User the event is about.
+	User string `json:"user,omitempty"`
+	// Event-specific data.
+	Data any `json:"data,omitempty"`
+}
+
+// Key returns the partitioning key of the event: the topic or the user if the event has no topic.
+func (ev *Event) Key() string {
+	if ev.Topic != "" {
+		return ev.Topic
+	}
+	return ev.User
+}
+
+// Sink is a message broker events are published to.
+type Sink interface {
+	// Publish publishes the events and waits for the broker to acknowledge them. Returns true if
+	// the failed batch may be retried.
+	Publish(events []*Event) (bool, error)
+	// Close releases the resources of the sink.
+	Close()
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Broker to publish events to: "kafka" or "nats".
+	Sink string `json:"sink"`
+	// Configs of the brokers.
+	Kafka json.RawMessage `json:"kafka,omitempty"`
+	Nats  json.RawMessage `json:"nats,omitempty"`
+	// Format of payloads: "json" (default) or "avro".
+	Format string `json:"format,omitempty"`
+	// Types of events to publish. All events are published if empty.
+	Events []string `json:"events,omitempty"`
+	// Number of workers publishing events. Events are distributed among workers by topic.
+	Workers int `json:"workers,omitempty"`
+	// Maximum number of events waiting to be published by one worker.
+	QueueSize int `json:"queue_size,omitempty"`
+	// Maximum number of events published at once.
+	BatchSize int `json:"batch_size,omitempty"`
+	// Delay before the first retry (seconds), doubled with every attempt.
+	Backoff int `json:"backoff,omitempty"`
+	// Maximum delay between retries (seconds).
+	MaxBackoff int `json:"max_backoff,omitempty"`
+}
+
+// exporter publishes events by a pool of workers, one queue per worker.
+type exporter struct {
+	sink       Sink
+	events     map[string]bool
+	batchSize  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	queues     []chan *Event
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+var exp *exporter
+
+// Init initializes the export. Returns false if the export is disabled in the config.
+func Init(jsconfig json.RawMessage) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	switch config.Format {
+	case "":
+		config.Format = FormatJSON
+	case FormatJSON, FormatAvro:
+	default:
+		return false, errors.New("export: unknown format '" + config.Format + "'")
+	}
+
+	var sink Sink
+	var err error
+	switch config.Sink {
+	case "kafka":
+		sink, err = newKafkaSink(config.Kafka, config.Format)
+	case "nats":
+		sink, err = newNatsSink(config.Nats, config.Format)
+	default:
+		return false, errors.New("export: unknown sink '" + config.Sink + "'")
+	}
+	if err != nil {
+		return false, errors.New("export: " + err.Error())
+	}
+
+	exp = newExporter(sink, &config)
+	return true, nil
+}
+
+// Enabled checks if the export is enabled.
+func Enabled() bool {
+	return exp != nil
+}
+
+// Wants checks if events of the given type are exported.
+func Wants(event string) bool {
+	return exp != nil && (exp.events == nil || exp.events[event])
+}
+
+// Publish queues the event for publishing. The event is dropped if the queue of its worker is full.
+func Publish(ev *Event) {
+	if !Wants(ev.Type) {
+		return
+	}
+	ev.V = SchemaVersion
+	if ev.Id == "" {
+		ev.Id = newEventId()
+	}
+	if ev.Ts == 0 {
+		ev.Ts = time.Now().UnixMilli()
+	}
+	exp.enqueue(ev)
+}
+
+// Stop publishes queued events, waiting up to a few seconds, and stops the workers.
+func Stop() {
+	if exp == nil {
+		return
+	}
+	exp.shutdown(time.Second * defaultDrainTimeout)
+	exp = nil
+}
+
+func newExporter(sink Sink, config *configType) *exporter {
+	e := &exporter{
+		sink:       sink,
+		batchSize:  valueOrDefault(config.BatchSize, defaultBatchSize),
+		backoff:    time.Second * time.Duration(valueOrDefault(config.Backoff, defaultBackoff)),
+		maxBackoff: time.Second * time.Duration(valueOrDefault(config.MaxBackoff, defaultMaxBackoff)),
+		queues:     make([]chan *Event, valueOrDefault(config.Workers, defaultWorkers)),
+		stop:       make(chan struct{}),
+	}
+	if len(config.Events) > 0 {
+		e.events = make(map[string]bool, len(config.Events))
+		for _, event := range config.Events {
+			e.events[event] = true
+		}
+	}
+
+	queueSize := valueOrDefault(config.QueueSize, defaultQueueSize)
+	e.wg.Add(len(e.queues))
+	for i := range e.queues {
+		e.queues[i] = make(chan *Event, queueSize)
+		go e.worker(e.queues[i])
+	}
+	return e
+}
+
+// Partition returns the partition of the key out of count partitions.
+func Partition(key string, count int) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	return int(hasher.Sum32() % uint32(count))
+}
+
+// enqueue adds the event to the queue of the worker responsible for its key.
+func (e *exporter) enqueue(ev *Event) {
+	select {
+	case e.queues[Partition(ev.Key(), len(e.queues))] <- ev:
+	default:
+		deadLetter(ev, errors.New("queue full"))
+	}
+}
+
+func (e *exporter) worker(queue chan *Event) {
+	defer e.wg.Done()
+	batch := make([]*Event, 0, e.batchSize)
+	for {
+		select {
+		case ev := <-queue:
+			batch = append(batch[:0], ev)
+		case <-e.stop:
+			return
+		}
+		// Collect events which are already waiting.
+	collect:
+		for len(batch) < e.batchSize {
+			select {
+			case ev := <-queue:
+				batch = append(batch, ev)
+			default:
+				break collect
+			}
+		}
+		if !e.publish(batch) {
+			return
+		}
+	}
+}
+
+// publish publishes the batch retrying failures until it succeeds. Returns false if stopped.
+func (e *exporter) publish(batch []*Event) bool {
+	for attempt := 1; ; attempt++ {
+		retry, err := e.sink.Publish(batch)
+		if err == nil {
+			return true
+		}
+		if !retry {
+			for _, ev := range batch {
+				deadLetter(ev, err)
+			}
+			return true
+		}
+
+		logs.Info.Printf("export: attempt %d to publish %d event(s) failed: %v", attempt, len(batch), err)
+		select {
+		case <-time.After(e.retryDelay(attempt)):
+		case <-e.stop:
+			for _, ev := range batch {
+				deadLetter(ev, errors.New("shutting down"))
+			}
+			return false
+		}
+	}
+}
+
+// retryDelay returns the delay before the next attempt: the backoff doubled with every attempt with
+// up to 10% of random jitter.
+func (e *exporter) retryDelay(attempt int) time.Duration {
+	delay := e.backoff << (attempt - 1)
+	if delay <= 0 || delay > e.maxBackoff {
+		delay = e.maxBackoff
+	}
+	return delay + time.Duration(mrand.Int64N(int64(delay)/10+1))
+}
+
+// shutdown waits for workers to empty the queues, then stops them.
+func (e *exporter) shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		pending := 0
+		for _, queue := range e.queues {
+			pending += len(queue)
+		}
+		if pending == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	close(e.stop)
+	e.wg.Wait()
+	e.sink.Close()
+
+	for _, queue := range e.queues {
+	drain:
+		for {
+			select {
+			case ev := <-queue:
+				deadLetter(ev, errors.New("shutting down"))
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// deadLetter logs the event which could not be published so it can be recovered from the log.
+func deadLetter(ev *Event, err error) {
+	payload, _ := json.Marshal(ev)
+	logs.Err.Printf("export: dead letter, event %s: %v; payload: %s", ev.Id, err, payload)
+}
+
+// newEventId generates a random ID of an event.
+func newEventId() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func valueOrDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
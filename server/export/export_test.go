@@ -0,0 +1,164 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+func TestEncodeAvro(t *testing.T) {
+	ev := &Event{V: 1, Id: "ab", Type: "t", Ts: 1000, Topic: "grp", Data: map[string]any{"seq": 1}}
+	got, err := encodeAvro(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// int 1, "ab", "t", long 1000, "grp", "", `{"seq":1}`.
+	expected := []byte{0x02, 0x04, 'a', 'b', 0x02, 't', 0xd0, 0x0f, 0x06, 'g', 'r', 'p', 0x00, 0x12}
+	expected = append(expected, `{"seq":1}`...)
+	if !bytes.Equal(got, expected) {
+		t.Errorf("encodeAvro: expected %x, got %x", expected, got)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	if Partition("grpX", 1) != 0 {
+		t.Error("single partition must be 0")
+	}
+	if Partition("grpX", 16) != Partition("grpX", 16) {
+		t.Error("partition is not stable")
+	}
+	if (&Event{User: "usrA"}).Key() != "usrA" || (&Event{Topic: "grpX", User: "usrA"}).Key() != "grpX" {
+		t.Error("unexpected key")
+	}
+}
+
+func TestKafkaPublish(t *testing.T) {
+	var body kafkaRequest
+	var contentType string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/events" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			w.Write([]byte(`{"error_code":50001,"message":"broker unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`))
+	}))
+	defer srv.Close()
+
+	sink, err := newKafkaSink(json.RawMessage(`{"rest_url":"`+srv.URL+`/","topic":"events"}`), FormatAvro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := []*Event{{V: 1, Id: "1", Type: EventMessagePosted, Topic: "grpX", Data: map[string]any{"seq": 5}}}
+	if retry, err := sink.Publish(events); err != nil {
+		t.Fatalf("Publish: %v %v", retry, err)
+	}
+	if contentType != "application/vnd.kafka.avro.v2+json" || body.ValueSchema != AvroSchema ||
+		len(body.Records) != 1 || body.Records[0].Key != "grpX" {
+		t.Errorf("unexpected request %s %+v", contentType, body)
+	}
+	if value, _ := body.Records[0].Value.(map[string]any); value["data"] != `{"seq":5}` || value["user"] != "" {
+		t.Errorf("unexpected record %+v", body.Records[0].Value)
+	}
+
+	status = http.StatusServiceUnavailable
+	if retry, err := sink.Publish(events); err == nil || !retry {
+		t.Errorf("expected retriable error, got %v %v", retry, err)
+	}
+	status = http.StatusUnprocessableEntity
+	if retry, err := sink.Publish(events); err == nil || retry {
+		t.Errorf("expected permanent error, got %v %v", retry, err)
+	}
+}
+
+// fakeNats is a NATS server which acknowledges published messages like JetStream.
+func fakeNats(t *testing.T, published chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("INFO {\"headers\":true}\r\n"))
+		seq := 0
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PING":
+				conn.Write([]byte("PONG\r\n"))
+			case "HPUB":
+				size, _ := strconv.Atoi(fields[4])
+				msg := make([]byte, size+2)
+				if _, err := io.ReadFull(r, msg); err != nil {
+					return
+				}
+				published <- fields[1] + " " + string(msg[:size])
+				seq++
+				ack := `{"stream":"EVENTS","seq":` + strconv.Itoa(seq) + `}`
+				conn.Write([]byte("MSG " + fields[2] + " 1 " + strconv.Itoa(len(ack)) + "\r\n" + ack + "\r\n"))
+			}
+		}
+	}()
+	return ln
+}
+
+func TestNatsPublish(t *testing.T) {
+	published := make(chan string, 10)
+	ln := fakeNats(t, published)
+	defer ln.Close()
+
+	sink, err := newNatsSink(json.RawMessage(`{"url":"nats://`+ln.Addr().String()+`","subject":"chat","timeout":2}`),
+		FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	events := []*Event{{V: 1, Id: "e1", Type: EventAccountCreated, User: "usrA"},
+		{V: 1, Id: "e2", Type: EventMessagePosted, Topic: "grpX"}}
+	if retry, err := sink.Publish(events); err != nil {
+		t.Fatalf("Publish: %v %v", retry, err)
+	}
+	for _, ev := range events {
+		select {
+		case msg := <-published:
+			if !strings.HasPrefix(msg, "chat.0 NATS/1.0\r\nNats-Msg-Id: "+ev.Id+"\r\n") ||
+				!strings.Contains(msg, `"type":"`+ev.Type+`"`) {
+				t.Errorf("unexpected message %q", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not published")
+		}
+	}
+}
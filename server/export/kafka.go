@@ -0,0 +1,153 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultKafkaTimeout = 10
+
+	// Maximum number of bytes of the response to read.
+	maxKafkaResponseSize = 1 << 20
+)
+
+// kafkaSink publishes events to Kafka through the Confluent REST Proxy (API v2). Records are keyed by topic,
+// so events of one topic go to the same partition. Avro records are sent with the schema, the proxy
+// registers it in the schema registry.
+type kafkaSink struct {
+	client   *http.Client
+	url      string
+	username string
+	password string
+	format   string
+}
+
+type kafkaConfig struct {
+	// URL of the REST Proxy, e.g. "http://localhost:8082".
+	RestURL string `json:"rest_url"`
+	// Kafka topic to publish events to.
+	Topic string `json:"topic"`
+	// Credentials for HTTP basic authentication with the proxy.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Timeout of one request (seconds).
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+type kafkaRequest struct {
+	KeySchema   string        `json:"key_schema,omitempty"`
+	ValueSchema string        `json:"value_schema,omitempty"`
+	Records     []kafkaRecord `json:"records"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+	ErrorCode int    `json:"error_code"`
+	Message   string `json:"message"`
+}
+
+func newKafkaSink(jsconfig json.RawMessage, format string) (*kafkaSink, error) {
+	var config kafkaConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return nil, errors.New("failed to parse kafka config: " + err.Error())
+		}
+	}
+	if config.RestURL == "" || config.Topic == "" {
+		return nil, errors.New("kafka: rest_url and topic are required")
+	}
+	if _, err := url.Parse(config.RestURL); err != nil {
+		return nil, errors.New("kafka: invalid rest_url")
+	}
+	return &kafkaSink{
+		client: &http.Client{
+			Timeout: time.Second * time.Duration(valueOrDefault(config.Timeout, defaultKafkaTimeout)),
+		},
+		url:      strings.TrimSuffix(config.RestURL, "/") + "/topics/" + url.PathEscape(config.Topic),
+		username: config.Username,
+		password: config.Password,
+		format:   format,
+	}, nil
+}
+
+// Publish posts the events to the REST Proxy.
+func (k *kafkaSink) Publish(events []*Event) (bool, error) {
+	req := kafkaRequest{Records: make([]kafkaRecord, 0, len(events))}
+	contentType := "application/vnd.kafka.json.v2+json"
+	if k.format == FormatAvro {
+		contentType = "application/vnd.kafka.avro.v2+json"
+		req.KeySchema = `{"type":"string"}`
+		req.ValueSchema = AvroSchema
+	}
+	for _, ev := range events {
+		var value any = ev
+		if k.format == FormatAvro {
+			rec, err := toAvroRecord(ev)
+			if err != nil {
+				return false, err
+			}
+			value = rec
+		}
+		req.Records = append(req.Records, kafkaRecord{Key: ev.Key(), Value: value})
+	}
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return false, err
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	hreq.Header.Set("Content-Type", contentType)
+	hreq.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if k.username != "" {
+		hreq.SetBasicAuth(k.username, k.password)
+	}
+
+	resp, err := k.client.Do(hreq)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	var result kafkaResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxKafkaResponseSize)).Decode(&result); err != nil &&
+		resp.StatusCode == http.StatusOK {
+		// The proxy may have published the records: retry, consumers drop duplicates.
+		return true, errors.New("kafka: invalid response: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Server errors and throttling are temporary, other errors are not.
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+				resp.StatusCode == http.StatusRequestTimeout,
+			errors.New("kafka: unexpected status " + resp.Status + ": " + result.Message)
+	}
+	for i, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			// Error code 2 is retriable, 1 is not. The whole batch is retried: consumers drop duplicates.
+			return *offset.ErrorCode == 2,
+				errors.New("kafka: record " + strconv.Itoa(i) + " rejected: " + offset.Error)
+		}
+	}
+	return false, nil
+}
+
+// Close does nothing: the sink has no connections to close.
+func (k *kafkaSink) Close() {}
@@ -0,0 +1,390 @@
+package export
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	defaultNatsSubject    = "tinode.events"
+	defaultNatsPartitions = 1
+	defaultNatsTimeout    = 5
+
+	// Maximum size of a protocol line or a message received from the server.
+	maxNatsMessageSize = 1 << 20
+)
+
+// natsSink publishes events to NATS JetStream. Events are published to subjects "<subject>.<partition>",
+// the partition is computed from the topic. The stream which captures the subjects must be created by
+// the operator. Every event is acknowledged by JetStream, the ID of the event is passed in the
+// Nats-Msg-Id header so JetStream drops duplicates of retried events.
+type natsSink struct {
+	config *natsConfig
+	format string
+
+	// Guards the connection and the writer.
+	lock  sync.Mutex
+	conn  net.Conn
+	w     *bufio.Writer
+	inbox string
+	// Sequential number of the last request.
+	seq uint64
+
+	// Acknowledgements waited for by reply subject.
+	ackLock sync.Mutex
+	acks    map[string]chan error
+}
+
+type natsConfig struct {
+	// URL of the server: "nats://host:4222" or "tls://host:4222".
+	URL string `json:"url"`
+	// Credentials: user and password or a token.
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// Prefix of subjects to publish events to.
+	Subject string `json:"subject,omitempty"`
+	// Number of partitions of the subject.
+	Partitions int `json:"partitions,omitempty"`
+	// Timeout of connecting and of waiting for acknowledgements (seconds).
+	Timeout int `json:"timeout,omitempty"`
+
+	host    string
+	tls     bool
+	timeout time.Duration
+}
+
+// JetStream acknowledgement of a published message.
+type natsAck struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+	Error  *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func newNatsSink(jsconfig json.RawMessage, format string) (*natsSink, error) {
+	var config natsConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return nil, errors.New("failed to parse nats config: " + err.Error())
+		}
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.New("nats: invalid url")
+	}
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		config.tls = true
+	default:
+		return nil, errors.New("nats: unsupported url scheme '" + u.Scheme + "'")
+	}
+	config.host = u.Host
+	if u.Port() == "" {
+		config.host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if config.Subject == "" {
+		config.Subject = defaultNatsSubject
+	}
+	config.Partitions = valueOrDefault(config.Partitions, defaultNatsPartitions)
+	config.timeout = time.Second * time.Duration(valueOrDefault(config.Timeout, defaultNatsTimeout))
+
+	return &natsSink{config: &config, format: format, acks: make(map[string]chan error)}, nil
+}
+
+// Subject returns the subject the event is published to.
+func (n *natsSink) Subject(ev *Event) string {
+	return n.config.Subject + "." + strconv.Itoa(Partition(ev.Key(), n.config.Partitions))
+}
+
+// Publish publishes the events and waits for JetStream to acknowledge all of them.
+func (n *natsSink) Publish(events []*Event) (bool, error) {
+	contentType := "application/json"
+	if n.format == FormatAvro {
+		contentType = "avro/binary"
+	}
+
+	n.lock.Lock()
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			n.lock.Unlock()
+			return true, err
+		}
+	}
+
+	replies := make([]string, 0, len(events))
+	waits := make([]chan error, 0, len(events))
+	defer func() {
+		// Drop acknowledgements which have not arrived.
+		n.ackLock.Lock()
+		for _, reply := range replies {
+			delete(n.acks, reply)
+		}
+		n.ackLock.Unlock()
+	}()
+
+	for _, ev := range events {
+		var payload []byte
+		var err error
+		if n.format == FormatAvro {
+			payload, err = encodeAvro(ev)
+		} else {
+			payload, err = json.Marshal(ev)
+		}
+		if err != nil {
+			n.lock.Unlock()
+			return false, err
+		}
+
+		n.seq++
+		reply := n.inbox + "." + strconv.FormatUint(n.seq, 10)
+		wait := make(chan error, 1)
+		n.ackLock.Lock()
+		n.acks[reply] = wait
+		n.ackLock.Unlock()
+		replies = append(replies, reply)
+		waits = append(waits, wait)
+
+		header := "NATS/1.0\r\nNats-Msg-Id: " + ev.Id + "\r\nContent-Type: " + contentType +
+			"\r\nTinode-Schema-Version: " + strconv.Itoa(ev.V) + "\r\n\r\n"
+		n.w.WriteString("HPUB " + n.Subject(ev) + " " + reply + " " + strconv.Itoa(len(header)) + " " +
+			strconv.Itoa(len(header)+len(payload)) + "\r\n")
+		n.w.WriteString(header)
+		n.w.Write(payload)
+		n.w.WriteString("\r\n")
+	}
+	conn := n.conn
+	if err := n.w.Flush(); err != nil {
+		n.disconnect(conn)
+		n.lock.Unlock()
+		return true, err
+	}
+	n.lock.Unlock()
+
+	timeout := time.NewTimer(n.config.timeout)
+	defer timeout.Stop()
+	for _, wait := range waits {
+		select {
+		case err := <-wait:
+			if err != nil {
+				return true, err
+			}
+		case <-timeout.C:
+			// The connection may be broken: reconnect on the next attempt.
+			n.lock.Lock()
+			n.disconnect(conn)
+			n.lock.Unlock()
+			return true, errors.New("nats: acknowledgement timeout")
+		}
+	}
+	return false, nil
+}
+
+// Close closes the connection.
+func (n *natsSink) Close() {
+	n.lock.Lock()
+	n.disconnect(n.conn)
+	n.lock.Unlock()
+}
+
+// connect opens the connection to the server and subscribes to acknowledgements. Called with the lock held.
+func (n *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", n.config.host, n.config.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(n.config.timeout))
+
+	// The server starts with INFO, TLS handshake follows it.
+	r := bufio.NewReaderSize(conn, 4096)
+	line, err := readNatsLine(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return errors.New("nats: unexpected greeting")
+	}
+	if n.config.tls {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: strings.Split(n.config.host, ":")[0]})
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		r = bufio.NewReaderSize(conn, 4096)
+	}
+
+	options := map[string]any{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"tls_required":  n.config.tls,
+		"name":          "tinode-export",
+		"lang":          "go",
+		"version":       "1.0",
+		"protocol":      1,
+	}
+	if n.config.User != "" {
+		options["user"], options["pass"] = n.config.User, n.config.Password
+	}
+	if n.config.Token != "" {
+		options["auth_token"] = n.config.Token
+	}
+	connect, _ := json.Marshal(options)
+	inbox := "_INBOX." + newEventId()
+	w := bufio.NewWriter(conn)
+	w.WriteString("CONNECT " + string(connect) + "\r\nPING\r\nSUB " + inbox + ".* 1\r\n")
+	if err = w.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	for {
+		if line, err = readNatsLine(r); err != nil {
+			conn.Close()
+			return err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return errors.New("nats: " + line)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	n.conn, n.w, n.inbox = conn, w, inbox
+	go n.reader(conn, r)
+	return nil
+}
+
+// disconnect closes the connection if it's still the current one. Called with the lock held.
+func (n *natsSink) disconnect(conn net.Conn) {
+	if conn == nil || conn != n.conn {
+		return
+	}
+	conn.Close()
+	n.conn, n.w = nil, nil
+}
+
+// reader reads messages from the server until the connection is closed.
+func (n *natsSink) reader(conn net.Conn, r *bufio.Reader) {
+	err := n.read(conn, r)
+	n.lock.Lock()
+	if conn == n.conn {
+		logs.Warn.Println("export: nats connection lost:", err)
+	}
+	n.disconnect(conn)
+	n.lock.Unlock()
+
+	// Fail acknowledgements which will not arrive.
+	n.ackLock.Lock()
+	for reply, wait := range n.acks {
+		wait <- errors.New("nats: connection lost")
+		delete(n.acks, reply)
+	}
+	n.ackLock.Unlock()
+}
+
+func (n *natsSink) read(conn net.Conn, r *bufio.Reader) error {
+	for {
+		line, err := readNatsLine(r)
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			n.lock.Lock()
+			if n.conn == conn {
+				n.w.WriteString("PONG\r\n")
+				err = n.w.Flush()
+			}
+			n.lock.Unlock()
+			if err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New(line)
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size>, HMSG <subject> <sid> [reply] <header size> <total size>.
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return errors.New("nats: malformed " + op)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || size < 0 || size > maxNatsMessageSize {
+				return errors.New("nats: malformed " + op)
+			}
+			hdrSize := 0
+			if op == "HMSG" {
+				if hdrSize, err = strconv.Atoi(fields[len(fields)-2]); err != nil || hdrSize > size {
+					return errors.New("nats: malformed " + op)
+				}
+			}
+			msg := make([]byte, size+2)
+			if _, err = io.ReadFull(r, msg); err != nil {
+				return err
+			}
+			n.acknowledge(fields[0], msg[:hdrSize], msg[hdrSize:size])
+		}
+		// INFO, PONG, +OK are ignored.
+	}
+}
+
+// acknowledge passes the result of publishing to the waiting publisher.
+func (n *natsSink) acknowledge(reply string, header, payload []byte) {
+	var err error
+	if len(header) > 0 {
+		// Status header "NATS/1.0 503", e.g. no stream captures the subject.
+		status, _, _ := strings.Cut(string(header), "\r\n")
+		if code := strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0")); code != "" {
+			err = errors.New("nats: status " + code)
+		}
+	}
+	if err == nil {
+		var ack natsAck
+		if jerr := json.Unmarshal(payload, &ack); jerr != nil {
+			err = errors.New("nats: invalid acknowledgement")
+		} else if ack.Error != nil {
+			err = errors.New("nats: " + ack.Error.Description)
+		}
+	}
+
+	n.ackLock.Lock()
+	wait := n.acks[reply]
+	delete(n.acks, reply)
+	n.ackLock.Unlock()
+	if wait != nil {
+		wait <- err
+	}
+}
+
+// readNatsLine reads one line of the protocol without the trailing CRLF.
+func readNatsLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) > maxNatsMessageSize {
+		return "", errors.New("nats: line too long")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
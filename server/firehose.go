@@ -0,0 +1,302 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Firehose: gRPC stream of message and presence events for backend
+ *    services, such as analytics and archiving, which should not pretend to
+ *    be chat clients. Services authenticate with a token passed in gRPC
+ *    metadata as 'authorization: Bearer <token>'.
+ *
+ *    Recent events are kept in memory. Every event has a cursor. A service
+ *    which reconnects passes the cursor of the last received event and gets
+ *    the events it missed. Cursors are valid on the node which issued them
+ *    until it restarts. In a cluster, events are streamed by the node which
+ *    hosts the topic or the user's 'me' topic: subscribe to all nodes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Default number of recent events kept for resuming streams.
+	defaultFirehoseBufferSize = 10000
+	// Maximum number of events read from the buffer at once.
+	firehoseBatchSize = 256
+)
+
+// Firehose config.
+type firehoseConfig struct {
+	Enabled bool `json:"enabled"`
+	// Number of recent events kept in memory for resuming streams.
+	BufferSize int `json:"buffer_size"`
+	// Backend services allowed to subscribe.
+	Services []struct {
+		// Name of the service for logging.
+		Name string `json:"name"`
+		// Secret token of the service.
+		Token string `json:"token"`
+	} `json:"services"`
+}
+
+// firehoseEntry is an event in the buffer.
+type firehoseEntry struct {
+	seq   uint64
+	topic string
+	user  string
+	event *pbx.FirehoseEvent
+}
+
+// firehose keeps recent events and wakes up subscribers when new events arrive.
+type firehose struct {
+	lock sync.Mutex
+	// Prefix of cursors issued by this node: name of the node and its start time.
+	epoch string
+	// Ring buffer of recent events.
+	buffer []firehoseEntry
+	// Sequential number of the last event.
+	last uint64
+	// Closed and replaced when a new event is added.
+	notify chan struct{}
+
+	// Tokens of services by service name.
+	tokens map[string][]byte
+}
+
+// firehoseInit initializes the firehose from config. Returns nil if the firehose is disabled.
+func firehoseInit(jsconfig json.RawMessage) (*firehose, error) {
+	if len(jsconfig) == 0 {
+		return nil, nil
+	}
+	var config firehoseConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return nil, errors.New("firehose: failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil, nil
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultFirehoseBufferSize
+	}
+
+	fh := &firehose{
+		epoch:  strconv.FormatInt(time.Now().UnixMilli(), 32),
+		buffer: make([]firehoseEntry, config.BufferSize),
+		notify: make(chan struct{}),
+		tokens: make(map[string][]byte),
+	}
+	if globals.cluster != nil {
+		fh.epoch = globals.cluster.thisNodeName + "-" + fh.epoch
+	}
+	for _, svc := range config.Services {
+		if svc.Name == "" || len(svc.Token) < 16 {
+			return nil, errors.New("firehose: service name is missing or token is too short")
+		}
+		fh.tokens[svc.Name] = []byte(svc.Token)
+	}
+	if len(fh.tokens) == 0 {
+		return nil, errors.New("firehose: no services configured")
+	}
+	return fh, nil
+}
+
+// authenticate returns the name of the service which made the call or an empty string.
+func (fh *firehose) authenticate(md metadata.MD) string {
+	for _, auth := range md.Get("authorization") {
+		token, found := strings.CutPrefix(auth, "Bearer ")
+		if !found {
+			continue
+		}
+		for name, expected := range fh.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), expected) == 1 {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// publish adds the event to the buffer and wakes up subscribers.
+func (fh *firehose) publish(topic, user string, event *pbx.FirehoseEvent) {
+	event.Timestamp = time.Now().UnixMilli()
+
+	fh.lock.Lock()
+	fh.last++
+	event.Cursor = fh.epoch + "." + strconv.FormatUint(fh.last, 10)
+	fh.buffer[fh.last%uint64(len(fh.buffer))] = firehoseEntry{seq: fh.last, topic: topic, user: user, event: event}
+	close(fh.notify)
+	fh.notify = make(chan struct{})
+	fh.lock.Unlock()
+}
+
+// position converts the cursor to the sequential number of the event. Blank cursor is the last event.
+func (fh *firehose) position(cursor string) (uint64, error) {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+
+	if cursor == "" {
+		return fh.last, nil
+	}
+	epoch, seqStr, found := strings.Cut(cursor, ".")
+	if !found {
+		return 0, status.Error(codes.InvalidArgument, "invalid cursor")
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, "invalid cursor")
+	}
+	if epoch != fh.epoch {
+		return 0, status.Error(codes.OutOfRange, "cursor issued by another node or before restart")
+	}
+	if seq > fh.last {
+		return 0, status.Error(codes.InvalidArgument, "invalid cursor")
+	}
+	return seq, nil
+}
+
+// read returns events after the given one. If there are no such events, returns a channel which is closed
+// when they arrive.
+func (fh *firehose) read(after uint64) ([]firehoseEntry, <-chan struct{}, error) {
+	fh.lock.Lock()
+	defer fh.lock.Unlock()
+
+	if fh.last == after {
+		return nil, fh.notify, nil
+	}
+	if fh.last-after > uint64(len(fh.buffer)) {
+		// The events were overwritten: the subscriber is too slow or the cursor is too old.
+		return nil, nil, status.Error(codes.OutOfRange, "events after cursor are no longer available")
+	}
+	count := min(fh.last-after, firehoseBatchSize)
+	entries := make([]firehoseEntry, 0, count)
+	for seq := after + 1; seq <= after+count; seq++ {
+		entries = append(entries, fh.buffer[seq%uint64(len(fh.buffer))])
+	}
+	return entries, nil, nil
+}
+
+// firehoseFilter selects events requested by the subscriber.
+type firehoseFilter struct {
+	data   bool
+	pres   bool
+	topics map[string]bool
+	users  map[string]bool
+}
+
+func newFirehoseFilter(req *pbx.FirehoseReq) *firehoseFilter {
+	filter := &firehoseFilter{data: req.Data, pres: req.Pres}
+	if !filter.data && !filter.pres {
+		filter.data, filter.pres = true, true
+	}
+	if len(req.Topics) > 0 {
+		filter.topics = make(map[string]bool, len(req.Topics))
+		for _, topic := range req.Topics {
+			filter.topics[topic] = true
+		}
+	}
+	if len(req.Users) > 0 {
+		filter.users = make(map[string]bool, len(req.Users))
+		for _, user := range req.Users {
+			filter.users[user] = true
+		}
+	}
+	return filter
+}
+
+// match checks if the event is requested by the subscriber.
+func (f *firehoseFilter) match(entry *firehoseEntry) bool {
+	switch entry.event.Event.(type) {
+	case *pbx.FirehoseEvent_Data:
+		if !f.data || (f.topics != nil && !f.topics[entry.topic]) {
+			return false
+		}
+	case *pbx.FirehoseEvent_Pres:
+		if !f.pres {
+			return false
+		}
+	}
+	return f.users == nil || f.users[entry.user]
+}
+
+type grpcFirehoseServer struct {
+	pbx.UnimplementedFirehoseServer
+}
+
+// Subscribe streams events to a backend service until the call is canceled.
+func (*grpcFirehoseServer) Subscribe(req *pbx.FirehoseReq, stream pbx.Firehose_SubscribeServer) error {
+	fh := globals.firehose
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	service := fh.authenticate(md)
+	if service == "" {
+		return status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	after, err := fh.position(req.Cursor)
+	if err != nil {
+		return err
+	}
+	filter := newFirehoseFilter(req)
+	logs.Info.Println("firehose: subscribed", service, req.Cursor)
+	defer logs.Info.Println("firehose: unsubscribed", service)
+
+	for {
+		entries, wait, err := fh.read(after)
+		if err != nil {
+			logs.Warn.Println("firehose:", service, err)
+			return err
+		}
+		if wait != nil {
+			select {
+			case <-wait:
+				continue
+			case <-stream.Context().Done():
+				return nil
+			}
+		}
+		for i := range entries {
+			entry := &entries[i]
+			after = entry.seq
+			if !filter.match(entry) {
+				continue
+			}
+			if err := stream.Send(entry.event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// firehoseMessage publishes the message to the firehose.
+func (t *Topic) firehoseMessage(data *MsgServerData) {
+	if globals.firehose == nil {
+		return
+	}
+	pbdata := pbServDataSerialize(data).Data
+	pbdata.Topic = t.name
+	globals.firehose.publish(t.name, data.From, &pbx.FirehoseEvent{Event: &pbx.FirehoseEvent_Data{Data: pbdata}})
+}
+
+// firehosePres publishes the change of user's presence to the firehose: "on", "off", "ua", "upd".
+func (t *Topic) firehosePres(what, ua string) {
+	if globals.firehose == nil || t.cat != types.TopicCatMe {
+		return
+	}
+	pres := pbServPresSerialize(&MsgServerPres{Topic: "me", Src: t.name, What: what, UserAgent: ua}).Pres
+	globals.firehose.publish("me", t.name, &pbx.FirehoseEvent{Event: &pbx.FirehoseEvent_Pres{Pres: pres}})
+}
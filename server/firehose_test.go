@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/pbx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testFirehoseToken = "0123456789abcdef"
+
+func newTestFirehose(t *testing.T, bufferSize int) *firehose {
+	t.Helper()
+	conf, _ := json.Marshal(map[string]any{
+		"enabled":     true,
+		"buffer_size": bufferSize,
+		"services":    []map[string]string{{"name": "archive", "token": testFirehoseToken}},
+	})
+	fh, err := firehoseInit(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fh
+}
+
+func firehoseData(topic, from string) *pbx.FirehoseEvent {
+	return &pbx.FirehoseEvent{Event: &pbx.FirehoseEvent_Data{Data: &pbx.ServerData{Topic: topic, FromUserId: from}}}
+}
+
+func firehosePres(user string) *pbx.FirehoseEvent {
+	return &pbx.FirehoseEvent{Event: &pbx.FirehoseEvent_Pres{Pres: &pbx.ServerPres{Topic: "me", Src: user}}}
+}
+
+func TestFirehoseInit(t *testing.T) {
+	for _, conf := range []string{"", `{"enabled": false}`} {
+		if fh, err := firehoseInit(json.RawMessage(conf)); fh != nil || err != nil {
+			t.Errorf("Config '%s': expected disabled firehose, got %v %v", conf, fh, err)
+		}
+	}
+	for _, conf := range []string{
+		`{"enabled": true}`,
+		`{"enabled": true, "services": [{"name": "archive", "token": "short"}]}`,
+		`{"enabled": true, "services": [{"token": "0123456789abcdef"}]}`,
+		`{"enabled": "yes"}`,
+	} {
+		if _, err := firehoseInit(json.RawMessage(conf)); err == nil {
+			t.Errorf("Invalid config '%s' accepted", conf)
+		}
+	}
+
+	fh := newTestFirehose(t, 0)
+	if len(fh.buffer) != defaultFirehoseBufferSize {
+		t.Errorf("Expected default buffer size, got %d", len(fh.buffer))
+	}
+	if name := fh.authenticate(metadata.Pairs("authorization", "Bearer "+testFirehoseToken)); name != "archive" {
+		t.Errorf("Valid token rejected: '%s'", name)
+	}
+	for _, md := range []metadata.MD{
+		{},
+		metadata.Pairs("authorization", testFirehoseToken),
+		metadata.Pairs("authorization", "Bearer "+testFirehoseToken+"0"),
+	} {
+		if name := fh.authenticate(md); name != "" {
+			t.Errorf("Invalid token %v accepted", md)
+		}
+	}
+}
+
+func TestFirehoseBuffer(t *testing.T) {
+	fh := newTestFirehose(t, 4)
+
+	start, err := fh.position("")
+	if err != nil || start != 0 {
+		t.Fatalf("Unexpected start position %d %v", start, err)
+	}
+	entries, wait, err := fh.read(start)
+	if err != nil || len(entries) != 0 || wait == nil {
+		t.Fatalf("Expected to wait for events, got %v %v", entries, err)
+	}
+
+	fh.publish("grpA", "usrA", firehoseData("grpA", "usrA"))
+	select {
+	case <-wait:
+	default:
+		t.Error("Subscriber not notified")
+	}
+	fh.publish("grpB", "usrB", firehoseData("grpB", "usrB"))
+
+	entries, wait, err = fh.read(start)
+	if err != nil || wait != nil || len(entries) != 2 || entries[0].topic != "grpA" || entries[1].topic != "grpB" {
+		t.Fatalf("Unexpected events %v %v", entries, err)
+	}
+	// Resuming from the cursor of the first event.
+	after, err := fh.position(entries[0].event.Cursor)
+	if err != nil || after != entries[0].seq {
+		t.Fatalf("Unexpected position %d %v", after, err)
+	}
+	if entries, _, _ = fh.read(after); len(entries) != 1 || entries[0].topic != "grpB" {
+		t.Errorf("Unexpected events after cursor %v", entries)
+	}
+
+	for _, cursor := range []string{"abc", fh.epoch + ".x", fh.epoch + ".100"} {
+		if _, err := fh.position(cursor); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Cursor '%s': expected InvalidArgument, got %v", cursor, err)
+		}
+	}
+	if _, err := fh.position("other.1"); status.Code(err) != codes.OutOfRange {
+		t.Errorf("Cursor of another epoch: expected OutOfRange, got %v", err)
+	}
+
+	// Events are overwritten.
+	for range 4 {
+		fh.publish("grpC", "usrC", firehoseData("grpC", "usrC"))
+	}
+	if _, _, err = fh.read(start); status.Code(err) != codes.OutOfRange {
+		t.Errorf("Overwritten events: expected OutOfRange, got %v", err)
+	}
+	if entries, _, err = fh.read(fh.last - 4); err != nil || len(entries) != 4 {
+		t.Errorf("Expected 4 events, got %d %v", len(entries), err)
+	}
+}
+
+func TestFirehoseFilter(t *testing.T) {
+	data := &firehoseEntry{topic: "grpA", user: "usrA", event: firehoseData("grpA", "usrA")}
+	pres := &firehoseEntry{topic: "me", user: "usrB", event: firehosePres("usrB")}
+
+	testCases := []struct {
+		req        *pbx.FirehoseReq
+		data, pres bool
+	}{
+		{&pbx.FirehoseReq{}, true, true},
+		{&pbx.FirehoseReq{Data: true}, true, false},
+		{&pbx.FirehoseReq{Pres: true}, false, true},
+		{&pbx.FirehoseReq{Topics: []string{"grpA"}}, true, true},
+		{&pbx.FirehoseReq{Topics: []string{"grpB"}}, false, true},
+		{&pbx.FirehoseReq{Users: []string{"usrA"}}, true, false},
+		{&pbx.FirehoseReq{Users: []string{"usrB"}, Data: true}, false, false},
+	}
+	for i, tc := range testCases {
+		filter := newFirehoseFilter(tc.req)
+		if filter.match(data) != tc.data || filter.match(pres) != tc.pres {
+			t.Errorf("Case %d: expected %t %t, got %t %t", i, tc.data, tc.pres, filter.match(data), filter.match(pres))
+		}
+	}
+}
+
+// testFirehoseStream collects events sent to the subscriber.
+type testFirehoseStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *pbx.FirehoseEvent
+}
+
+func (s *testFirehoseStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testFirehoseStream) Send(event *pbx.FirehoseEvent) error {
+	s.events <- event
+	return nil
+}
+
+func TestFirehoseSubscribe(t *testing.T) {
+	fh := newTestFirehose(t, 16)
+	prev := globals.firehose
+	globals.firehose = fh
+	defer func() { globals.firehose = prev }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &testFirehoseStream{ctx: ctx, events: make(chan *pbx.FirehoseEvent, 16)}
+	srv := &grpcFirehoseServer{}
+
+	if err := srv.Subscribe(&pbx.FirehoseReq{}, stream); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Expected Unauthenticated, got %v", err)
+	}
+
+	fh.publish("grpA", "usrA", firehoseData("grpA", "usrA"))
+	cursor := fh.buffer[fh.last%uint64(len(fh.buffer))].event.Cursor
+	fh.publish("grpB", "usrA", firehoseData("grpB", "usrA"))
+
+	stream.ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+testFirehoseToken))
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Subscribe(&pbx.FirehoseReq{Cursor: cursor, Topics: []string{"grpB"}}, stream)
+	}()
+
+	// Missed event is delivered, events not matching the filter are skipped.
+	fh.publish("grpA", "usrA", firehoseData("grpA", "usrA"))
+	fh.publish("grpB", "usrB", firehoseData("grpB", "usrB"))
+	for _, from := range []string{"usrA", "usrB"} {
+		select {
+		case event := <-stream.events:
+			if data := event.GetData(); data == nil || data.Topic != "grpB" || data.FromUserId != from {
+				t.Errorf("Unexpected event %v", event)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Event not delivered")
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscription not terminated")
+	}
+	if len(stream.events) != 0 {
+		t.Error("Unexpected events", len(stream.events))
+	}
+}
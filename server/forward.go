@@ -0,0 +1,172 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Forwarding of messages. {fwd topic="dest" src="source" seq=123} copies
+ *    the message 123 of the source topic into the destination topic. The
+ *    copy is published on behalf of the forwarding user with the origin of
+ *    the message recorded by the server in head.forwarded. Clients cannot set
+ *    head.forwarded in {pub}. Attachments of the original message are linked
+ *    to the copy, they are not uploaded again.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Header of a message which records the origin of a forwarded message.
+const msgHeadForwarded = "forwarded"
+
+var errForwardCall = errors.New("calls cannot be forwarded")
+
+// forward publishes a copy of a message from another topic.
+func (s *Session) forward(msg *ClientComMessage) {
+	if globals.encryptionReadOnly.Load() {
+		s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+		return
+	}
+
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	if msg.Fwd.Src == "" || msg.Fwd.SeqId <= 0 {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		return
+	}
+
+	sub := s.getSub(msg.RcptTo)
+	if sub == nil {
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		logs.Warn.Printf("s.forward[%s]: must attach first %s", msg.RcptTo, s.sid)
+		return
+	}
+
+	// Source topic name is expanded the same way as the destination.
+	srcTopic, resp := s.expandTopicName(&ClientComMessage{
+		Original:  msg.Fwd.Src,
+		AsUser:    msg.AsUser,
+		Id:        msg.Id,
+		Timestamp: msg.Timestamp,
+	})
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+	if !strings.HasPrefix(srcTopic, "p2p") && !strings.HasPrefix(srcTopic, "grp") &&
+		!strings.HasPrefix(srcTopic, "slf") {
+		s.queueOut(ErrOperationNotAllowedReply(msg, msg.Timestamp))
+		return
+	}
+
+	head, content, attachments, err := forwardedMessage(types.ParseUserId(msg.AsUser), srcTopic, msg.Fwd.Src, msg.Fwd.SeqId)
+	if err != nil {
+		if err == errForwardCall {
+			s.queueOut(ErrOperationNotAllowedReply(msg, msg.Timestamp))
+		} else {
+			s.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, msg.Timestamp, msg.Timestamp, nil))
+		}
+		return
+	}
+
+	// The copy is published as a regular message.
+	msg.Pub = &MsgClientPub{
+		Id:      msg.Fwd.Id,
+		Topic:   msg.Fwd.Topic,
+		NoEcho:  msg.Fwd.NoEcho,
+		Head:    head,
+		Content: content,
+	}
+	msg.Fwd = nil
+	if msg.Extra == nil {
+		msg.Extra = &MsgClientExtra{}
+	}
+	msg.Extra.Attachments = attachments
+
+	select {
+	case sub.broadcast <- msg:
+	default:
+		// Reply with a 503 to the user.
+		s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+		logs.Err.Println("s.forward: sub.broadcast channel full, topic ", msg.RcptTo, s.sid)
+	}
+}
+
+// forwardedMessage fetches the message 'seqId' of the topic 'srcTopic' on behalf of the user
+// and returns the header, content and attachments of its copy. The 'srcOriginal' is the name of the topic
+// as addressed by the user: channels are addressed as 'chnXXX'.
+func forwardedMessage(asUid types.Uid, srcTopic, srcOriginal string, seqId int) (map[string]any, any, []string, error) {
+	// Channel readers are subscribed to the channel, not to the group topic.
+	subTopic, origin := srcTopic, srcTopic
+	isChan := types.IsChannel(srcOriginal)
+	if isChan {
+		subTopic, origin = srcOriginal, srcOriginal
+	}
+
+	sub, err := store.Subs.Get(subTopic, asUid, false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if sub == nil {
+		return nil, nil, nil, types.ErrNotFound
+	}
+	mode := sub.ModeWant & sub.ModeGiven
+	if !mode.IsReader() {
+		return nil, nil, nil, types.ErrPermissionDenied
+	}
+
+	origMsg, err := store.Messages.GetBySeqId(srcTopic, seqId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if origMsg == nil || origMsg.DeletedAt != nil || origMsg.Head["unsent"] == true {
+		return nil, nil, nil, types.ErrNotFound
+	}
+	if scope := msgScope(origMsg.Head); len(scope) > 0 && !mode.IsAdmin() && !slices.Contains(scope, asUid.UserId()) {
+		// Don't disclose the existence of the message.
+		return nil, nil, nil, types.ErrNotFound
+	}
+	if origMsg.Head["webrtc"] != nil {
+		return nil, nil, nil, errForwardCall
+	}
+
+	head := map[string]any{}
+	if mime, ok := origMsg.Head["mime"]; ok {
+		head["mime"] = mime
+	}
+	if forwarded, ok := origMsg.Head[msgHeadForwarded].(map[string]any); ok {
+		// Forwarding a forwarded message: keep the origin.
+		head[msgHeadForwarded] = forwarded
+	} else {
+		forwarded = map[string]any{
+			"topic": origin,
+			"seq":   seqId,
+			"ts":    origMsg.CreatedAt,
+		}
+		if !isChan {
+			// Channel messages are anonymous.
+			forwarded["from"] = types.ParseUid(origMsg.From).UserId()
+		}
+		head[msgHeadForwarded] = forwarded
+	}
+
+	attachments, err := drafty.References(origMsg.Content)
+	if err != nil {
+		// Not a valid Drafty document: forward the content without attachments.
+		logs.Warn.Printf("topic[%s]: failed to extract attachments of forwarded message %d: %v", srcTopic, seqId, err)
+	}
+
+	return head, origMsg.Content, attachments, nil
+}
@@ -0,0 +1,1529 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  Admin REST API: management of users and topics by the server operator.
+ *  The API is served on a separate listener and is protected by a secret
+ *  token passed as 'Authorization: Bearer <token>'. Every request is logged,
+ *  requests other than queries are also saved to the audit log.
+ *
+ *    POST   /admin/v0/users/{user}/suspend        suspend the account
+ *    POST   /admin/v0/users/{user}/unsuspend      restore the account
+ *    POST   /admin/v0/users/{user}/logout         terminate user's sessions
+ *    PUT    /admin/v0/users/{user}/tags           replace user's tags
+ *    PUT    /admin/v0/users/{user}/auth/{scheme}  reset authentication secret
+ *    DELETE /admin/v0/users/{user}/cred/{method}  delete credential to be validated again
+ *    PUT    /admin/v0/users/{user}/totp           make two-factor authentication mandatory or optional
+ *    DELETE /admin/v0/users/{user}/totp           reset two-factor authentication
+ *    GET    /admin/v0/users/{user}/erase          report data to be erased with the account
+ *    POST   /admin/v0/users/{user}/erase          delete the account and erase all user's data
+ *    GET    /admin/v0/users/{user}/sms            list SMS notifications sent to the user
+ *    GET    /admin/v0/sessions                    list sessions
+ *    GET    /admin/v0/topics                      list the busiest topics
+ *    GET    /admin/v0/drain                       report if the node is draining
+ *    POST   /admin/v0/drain                       drain the node and shut it down
+ *    GET    /admin/v0/diagnostics                 report slow queries and hot topics
+ *    POST   /admin/v0/diagnostics                 switch diagnostics mode on or off
+ *    GET    /admin/v0/maintenance                 report if the node is in maintenance mode
+ *    POST   /admin/v0/maintenance                 switch maintenance mode on or off
+ *    DELETE /admin/v0/topics/{topic}              delete a group topic or channel
+ *    GET    /admin/v0/webhooks                    list server-wide webhooks
+ *    POST   /admin/v0/webhooks                    add a server-wide webhook
+ *    GET    /admin/v0/topics/{topic}/webhooks     list webhooks of the topic
+ *    POST   /admin/v0/topics/{topic}/webhooks     add a webhook of the topic
+ *    DELETE /admin/v0/webhooks/{id}               delete a webhook
+ *    GET    /admin/v0/topics/{topic}/inwebhooks   list incoming webhooks of the topic
+ *    POST   /admin/v0/topics/{topic}/inwebhooks   add an incoming webhook of the topic
+ *    DELETE /admin/v0/inwebhooks/{token}          delete an incoming webhook
+ *    GET    /admin/v0/topics/{topic}/matrix       get the Matrix room bridged to the topic
+ *    PUT    /admin/v0/topics/{topic}/matrix       bridge the topic to a Matrix room
+ *    DELETE /admin/v0/topics/{topic}/matrix       remove the bridge of the topic
+ *    GET    /admin/v0/topics/{topic}/mailboxes    list email addresses of the topic
+ *    POST   /admin/v0/topics/{topic}/mailboxes    add an email address of the topic
+ *    DELETE /admin/v0/mailboxes/{address}         delete an email address
+ *    GET    /admin/v0/tenants                     list tenants
+ *    POST   /admin/v0/tenants                     add a tenant
+ *    PUT    /admin/v0/tenants/{tenant}            replace the name, hosts and config of the tenant
+ *    DELETE /admin/v0/tenants/{tenant}            delete a tenant which has no users
+ *    GET    /admin/v0/tenants/{tenant}/usage      report total usage of users of the tenant
+ *    GET    /admin/v0/users/{user}/usage          report usage of the user
+ *    GET    /admin/v0/usage                       report usage of all users
+ *    GET    /admin/v0/audit                       query the audit log
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth/totp"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/mailgate"
+	"github.com/tinode/chat/server/matrix"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Path prefix of the admin API.
+	adminApiPath = "/admin/v0/"
+	// Maximum size of a request body.
+	maxAdminRequestSize = 1 << 16
+
+	// Default and maximum numbers of SMS notifications listed by the admin API.
+	adminSmsDefaultLimit = 50
+	adminSmsMaxLimit     = 1000
+
+	// Default and maximum numbers of the busiest topics listed by the admin API.
+	adminTopicsDefaultLimit = 10
+	adminTopicsMaxLimit     = 1000
+)
+
+// Admin API config.
+type adminConfig struct {
+	// Address to listen on for admin API requests, e.g. "localhost:6070" or a unix socket. Blank disables the API.
+	Listen string `json:"listen"`
+	// Secret token to be passed in the 'Authorization: Bearer <token>' header.
+	Token string `json:"token"`
+}
+
+// adminSession is a session as reported by the admin API.
+type adminSession struct {
+	Sid        string `json:"sid"`
+	User       string `json:"user,omitempty"`
+	AuthLevel  string `json:"authlvl,omitempty"`
+	Proto      string `json:"proto"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"ua,omitempty"`
+	Lang       string `json:"lang,omitempty"`
+	Platform   string `json:"platf,omitempty"`
+	Topics     int    `json:"topics"`
+}
+
+// adminTopic is a topic loaded at this node as reported by the admin API.
+type adminTopic struct {
+	Topic    string    `json:"topic"`
+	Category string    `json:"cat"`
+	Messages int64     `json:"messages"`
+	Sessions int64     `json:"sessions"`
+	Loaded   time.Time `json:"loaded"`
+}
+
+// adminAuditRecord is a record of the audit log as reported by the admin API.
+type adminAuditRecord struct {
+	Ts         time.Time `json:"ts"`
+	Event      string    `json:"event"`
+	Actor      string    `json:"actor,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Details    string    `json:"details,omitempty"`
+}
+
+// adminHandler checks the token and logs the request processed by 'handle'. The handler returns
+// the response and a description of the action taken for the log.
+type adminHandler struct {
+	token  []byte
+	handle func(req *http.Request) (*ServerComMessage, string)
+}
+
+func (h adminHandler) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+	wrt.Header().Set("Cache-Control", "no-store")
+
+	var resp *ServerComMessage
+	var action string
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), h.token) != 1 {
+		resp, action = ErrAuthRequired("", "", types.TimeNow(), types.TimeNow()), "unauthorized"
+	} else {
+		req.Body = http.MaxBytesReader(wrt, req.Body, maxAdminRequestSize)
+		resp, action = h.handle(req)
+	}
+
+	logs.Info.Printf("admin: %s %s -> %d %s [%s]", req.Method, req.URL.Path, resp.Ctrl.Code, action,
+		getRemoteAddr(req))
+	if req.Method != http.MethodGet || resp.Ctrl.Code == http.StatusUnauthorized {
+		auditLog(&types.AuditRecord{
+			Event:      types.AuditAdmin,
+			Target:     auditUserId(types.ParseUserId(req.PathValue("user"))),
+			Topic:      req.PathValue("topic"),
+			RemoteAddr: getRemoteAddr(req),
+			Details:    req.Method + " " + req.URL.Path + " -> " + strconv.Itoa(resp.Ctrl.Code) + " " + action,
+		})
+	}
+
+	wrt.WriteHeader(resp.Ctrl.Code)
+	json.NewEncoder(wrt).Encode(resp)
+}
+
+// adminServe starts the admin API server. Returns nil if the API is disabled.
+func adminServe(config *adminConfig) (*http.Server, error) {
+	if config == nil || config.Listen == "" {
+		return nil, nil
+	}
+	if len(config.Token) < 16 {
+		return nil, errors.New("admin API token is missing or too short")
+	}
+
+	mux := http.NewServeMux()
+	route := func(pattern string, handle func(req *http.Request) (*ServerComMessage, string)) {
+		mux.Handle(pattern, adminHandler{token: []byte(config.Token), handle: handle})
+	}
+	route("POST "+adminApiPath+"users/{user}/suspend", adminSetUserState(types.StateSuspended))
+	route("POST "+adminApiPath+"users/{user}/unsuspend", adminSetUserState(types.StateOK))
+	route("POST "+adminApiPath+"users/{user}/logout", adminLogout)
+	route("PUT "+adminApiPath+"users/{user}/tags", adminSetTags)
+	route("PUT "+adminApiPath+"users/{user}/auth/{scheme}", adminResetAuth)
+	route("DELETE "+adminApiPath+"users/{user}/cred/{method}", adminDeleteCred)
+	route("PUT "+adminApiPath+"users/{user}/totp", adminSetTotp)
+	route("DELETE "+adminApiPath+"users/{user}/totp", adminResetTotp)
+	route("GET "+adminApiPath+"users/{user}/erase", adminEraseUser(true))
+	route("POST "+adminApiPath+"users/{user}/erase", adminEraseUser(false))
+	route("GET "+adminApiPath+"users/{user}/sms", adminListSms)
+	route("GET "+adminApiPath+"sessions", adminListSessions)
+	route("GET "+adminApiPath+"topics", adminBusiestTopics)
+	route("GET "+adminApiPath+"drain", adminDrainStatus)
+	route("POST "+adminApiPath+"drain", adminDrain)
+	route("GET "+adminApiPath+"diagnostics", adminDiagnostics)
+	route("POST "+adminApiPath+"diagnostics", adminSetDiagnostics)
+	route("GET "+adminApiPath+"maintenance", adminMaintenanceStatus)
+	route("POST "+adminApiPath+"maintenance", adminSetMaintenance)
+	route("DELETE "+adminApiPath+"topics/{topic}", adminDeleteTopic)
+	route("GET "+adminApiPath+"webhooks", adminListWebhooks)
+	route("POST "+adminApiPath+"webhooks", adminCreateWebhook)
+	route("GET "+adminApiPath+"topics/{topic}/webhooks", adminListWebhooks)
+	route("POST "+adminApiPath+"topics/{topic}/webhooks", adminCreateWebhook)
+	route("DELETE "+adminApiPath+"webhooks/{id}", adminDeleteWebhook)
+	route("GET "+adminApiPath+"topics/{topic}/inwebhooks", adminListInWebhooks)
+	route("POST "+adminApiPath+"topics/{topic}/inwebhooks", adminCreateInWebhook)
+	route("DELETE "+adminApiPath+"inwebhooks/{token}", adminDeleteInWebhook)
+	route("GET "+adminApiPath+"topics/{topic}/matrix", adminGetMatrixRoom)
+	route("PUT "+adminApiPath+"topics/{topic}/matrix", adminLinkMatrixRoom)
+	route("DELETE "+adminApiPath+"topics/{topic}/matrix", adminUnlinkMatrixRoom)
+	route("GET "+adminApiPath+"topics/{topic}/mailboxes", adminListMailboxes)
+	route("POST "+adminApiPath+"topics/{topic}/mailboxes", adminCreateMailbox)
+	route("DELETE "+adminApiPath+"mailboxes/{address}", adminDeleteMailbox)
+	route("GET "+adminApiPath+"tenants", adminListTenants)
+	route("POST "+adminApiPath+"tenants", adminCreateTenant)
+	route("PUT "+adminApiPath+"tenants/{tenant}", adminUpdateTenant)
+	route("DELETE "+adminApiPath+"tenants/{tenant}", adminDeleteTenant)
+	route("GET "+adminApiPath+"tenants/{tenant}/usage", adminTenantUsage)
+	route("GET "+adminApiPath+"users/{user}/usage", adminUserUsage)
+	route("GET "+adminApiPath+"usage", adminListUsage)
+	route("GET "+adminApiPath+"audit", adminQueryAudit)
+	route(adminApiPath, func(req *http.Request) (*ServerComMessage, string) {
+		return ErrNotFound("", "", types.TimeNow()), "unknown endpoint"
+	})
+
+	lis, err := netListener(config.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		MaxHeaderBytes:    1 << 14,
+	}
+	go func() {
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			logs.Err.Println("admin API: failed", err)
+		}
+	}()
+	logs.Info.Printf("Listening for admin API requests on [%s]", config.Listen)
+	return server, nil
+}
+
+// adminWebhook is a webhook as reported by the admin API.
+type adminWebhook struct {
+	Id      string    `json:"id"`
+	Topic   string    `json:"topic,omitempty"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events,omitempty"`
+	Created time.Time `json:"created"`
+	// The secret is reported only when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// adminInWebhook is an incoming webhook as reported by the admin API.
+type adminInWebhook struct {
+	Token    string    `json:"token"`
+	Topic    string    `json:"topic"`
+	User     string    `json:"user"`
+	Format   string    `json:"format"`
+	Template string    `json:"template,omitempty"`
+	Created  time.Time `json:"created"`
+	// Path to POST messages to.
+	Path string `json:"path"`
+}
+
+func adminInWebhookOf(hook *types.IncomingWebhook) adminInWebhook {
+	return adminInWebhook{
+		Token:    hook.Token,
+		Topic:    hook.Topic,
+		User:     hook.User,
+		Format:   hook.Format,
+		Template: hook.Template,
+		Created:  hook.CreatedAt,
+		Path:     inWebhooksPath + hook.Token,
+	}
+}
+
+// adminMailbox is an email address of the email gateway as reported by the admin API.
+type adminMailbox struct {
+	Address string    `json:"address"`
+	Topic   string    `json:"topic"`
+	User    string    `json:"user"`
+	Reply   bool      `json:"reply,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func adminMailboxOf(box *types.Mailbox) adminMailbox {
+	return adminMailbox{
+		Address: box.Address,
+		Topic:   box.Topic,
+		User:    box.User,
+		Reply:   box.Reply,
+		Created: box.CreatedAt,
+	}
+}
+
+// adminTenant is a tenant as reported and accepted by the admin API.
+type adminTenant struct {
+	Id      string            `json:"id"`
+	Name    string            `json:"name,omitempty"`
+	Hosts   []string          `json:"hosts,omitempty"`
+	Config  adminTenantConfig `json:"config"`
+	Created time.Time         `json:"created"`
+	Updated time.Time         `json:"updated"`
+}
+
+// adminTenantConfig contains overrides of the server configuration for the tenant.
+type adminTenantConfig struct {
+	AuthSchemes   []string                   `json:"auth_schemes,omitempty"`
+	RetentionDays int                        `json:"retention_days,omitempty"`
+	UserQuota     int64                      `json:"user_quota,omitempty"`
+	TopicQuota    int64                      `json:"topic_quota,omitempty"`
+	AccountLimits map[string]adminUsageLimit `json:"account_limits,omitempty"`
+	Limits        map[string]adminUsageLimit `json:"limits,omitempty"`
+}
+
+// adminUsageLimit is a monthly limit of a usage metric.
+type adminUsageLimit struct {
+	Soft int64 `json:"soft,omitempty"`
+	Hard int64 `json:"hard,omitempty"`
+}
+
+// adminUsageLimitsOf converts usage limits from the admin API.
+func adminUsageLimitsOf(limits map[string]adminUsageLimit) map[string]types.UsageLimit {
+	if len(limits) == 0 {
+		return nil
+	}
+	result := make(map[string]types.UsageLimit, len(limits))
+	for metric, limit := range limits {
+		result[metric] = types.UsageLimit{Soft: limit.Soft, Hard: limit.Hard}
+	}
+	return result
+}
+
+// adminUsageLimits converts usage limits to the admin API.
+func adminUsageLimits(limits map[string]types.UsageLimit) map[string]adminUsageLimit {
+	if len(limits) == 0 {
+		return nil
+	}
+	result := make(map[string]adminUsageLimit, len(limits))
+	for metric, limit := range limits {
+		result[metric] = adminUsageLimit{Soft: limit.Soft, Hard: limit.Hard}
+	}
+	return result
+}
+
+func adminTenantOf(tenant *types.Tenant) adminTenant {
+	return adminTenant{
+		Id:    tenant.Id,
+		Name:  tenant.Name,
+		Hosts: tenant.Hosts,
+		Config: adminTenantConfig{
+			AuthSchemes:   tenant.Config.AuthSchemes,
+			RetentionDays: tenant.Config.RetentionDays,
+			UserQuota:     tenant.Config.UserQuota,
+			TopicQuota:    tenant.Config.TopicQuota,
+			AccountLimits: adminUsageLimits(tenant.Config.AccountLimits),
+			Limits:        adminUsageLimits(tenant.Config.Limits),
+		},
+		Created: tenant.CreatedAt,
+		Updated: tenant.UpdatedAt,
+	}
+}
+
+// adminUsage is usage of a user or of all users of a tenant in a billing period as reported by the
+// admin API.
+type adminUsage struct {
+	Period      string `json:"period"`
+	Tenant      string `json:"tenant,omitempty"`
+	User        string `json:"user,omitempty"`
+	Messages    int64  `json:"messages"`
+	Pushes      int64  `json:"pushes"`
+	CallMinutes int64  `json:"call_minutes"`
+	Storage     int64  `json:"storage"`
+	// Reached limits by metric: "soft" or "hard".
+	Reached map[string]string `json:"reached,omitempty"`
+}
+
+func adminUsageOf(usage *types.UsageRecord, limits map[string]types.UsageLimit) adminUsage {
+	result := adminUsage{
+		Period:      usage.Period,
+		Tenant:      usage.Tenant,
+		Messages:    usage.Messages,
+		Pushes:      usage.Pushes,
+		CallMinutes: meterValue(usage, types.UsageCallMinutes),
+		Storage:     usage.Storage,
+	}
+	if usage.User != "" {
+		result.User = types.ParseUid(usage.User).UserId()
+	}
+	for metric, limit := range limits {
+		value := meterValue(usage, metric)
+		reached := ""
+		if limit.Hard > 0 && value >= limit.Hard {
+			reached = "hard"
+		} else if limit.Soft > 0 && value >= limit.Soft {
+			reached = "soft"
+		}
+		if reached != "" {
+			if result.Reached == nil {
+				result.Reached = make(map[string]string)
+			}
+			result.Reached[metric] = reached
+		}
+	}
+	return result
+}
+
+// adminSms is an SMS notification as reported by the admin API.
+type adminSms struct {
+	Id         string    `json:"id"`
+	Topic      string    `json:"topic"`
+	SeqId      int       `json:"seq,omitempty"`
+	Phone      string    `json:"phone"`
+	Provider   string    `json:"provider"`
+	ProviderId string    `json:"provider_id,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Created    time.Time `json:"created"`
+	Updated    time.Time `json:"updated"`
+}
+
+// adminGetUser loads the user addressed by the request.
+func adminGetUser(req *http.Request) (types.Uid, *types.User, *ServerComMessage) {
+	now := types.TimeNow()
+	uid := types.ParseUserId(req.PathValue("user"))
+	if uid.IsZero() {
+		return uid, nil, ErrMalformed("", "", now)
+	}
+	user, err := store.Users.Get(uid)
+	if err == nil && user == nil {
+		err = types.ErrUserNotFound
+	}
+	if err != nil {
+		return uid, nil, decodeStoreError(err, "", now, nil)
+	}
+	return uid, user, nil
+}
+
+// adminSetUserState returns a handler which changes the state of the user account.
+func adminSetUserState(state types.ObjState) func(req *http.Request) (*ServerComMessage, string) {
+	return func(req *http.Request) (*ServerComMessage, string) {
+		uid, user, resp := adminGetUser(req)
+		if resp != nil {
+			return resp, ""
+		}
+
+		now := types.TimeNow()
+		changed, err := setUserState(uid, user, state)
+		if err != nil {
+			return decodeStoreError(err, "", now, nil), err.Error()
+		}
+		if !changed {
+			return InfoNotModified("", "", now), "state unchanged"
+		}
+		exportAccount(user, plgActUpd)
+		return NoErr("", "", now), "state " + state.String()
+	}
+}
+
+// adminLogout terminates all sessions of the user and revokes all tokens.
+func adminLogout(req *http.Request) (*ServerComMessage, string) {
+	uid, _, resp := adminGetUser(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	sessionsEvictAll(uid, "")
+	if err := revokeUserTokens(uid, true); err != nil {
+		return decodeStoreError(err, "", types.TimeNow(), nil), "sessions evicted, tokens not revoked: " +
+			err.Error()
+	}
+	return NoErr("", "", types.TimeNow()), "sessions evicted"
+}
+
+// adminSetTags replaces the tags of the user with {"tags": ["tag1", "tag2"]} from the request body.
+func adminSetTags(req *http.Request) (*ServerComMessage, string) {
+	uid, _, resp := adminGetUser(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Tags == nil {
+		return ErrMalformed("", "", now), ""
+	}
+
+	tags := normalizeTags(body.Tags, globals.maxTagCount)
+	if tags == nil {
+		// All tags are removed.
+		tags = []string{}
+	}
+	updated, err := store.Users.UpdateTags(uid, nil, nil, tags)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	return NoErrParams("", "", now, map[string]any{"tags": updated}), "tags " + strings.Join(updated, ",")
+}
+
+// adminResetAuth replaces the secret of the authentication scheme with {"secret": "..."} from the request body,
+// e.g. "login:password" for "basic".
+func adminResetAuth(req *http.Request) (*ServerComMessage, string) {
+	_, user, resp := adminGetUser(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		Secret string `json:"secret"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Secret == "" {
+		return ErrMalformed("", "", now), ""
+	}
+
+	scheme := req.PathValue("scheme")
+	params, err := updateUserAuth(&ClientComMessage{Acc: &MsgClientAcc{Scheme: scheme, Secret: []byte(body.Secret)}},
+		user, nil, getRemoteAddr(req))
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	return NoErrParams("", "", now, params), "auth " + scheme + " reset"
+}
+
+// adminSetTotp makes two-factor authentication by TOTP mandatory or optional for the user
+// with {"required": true|false} from the request body.
+func adminSetTotp(req *http.Request) (*ServerComMessage, string) {
+	uid, _, resp := adminGetUser(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		Required *bool `json:"required"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Required == nil {
+		return ErrMalformed("", "", now), ""
+	}
+	if err := totp.SetRequired(uid, *body.Required); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	return NoErr("", "", now), "totp required " + strconv.FormatBool(*body.Required)
+}
+
+// adminResetTotp removes the user's TOTP enrollment, i.e. when the user has lost the device and the backup codes.
+func adminResetTotp(req *http.Request) (*ServerComMessage, string) {
+	uid, _, resp := adminGetUser(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	if err := totp.Reset(uid); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	return NoErr("", "", now), "totp reset"
+}
+
+// adminDeleteCred deletes user's credential of the given method and optional value. The user will have
+// to add and validate it again.
+func adminDeleteCred(req *http.Request) (*ServerComMessage, string) {
+	uid, _, resp := adminGetUser(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	method := req.PathValue("method")
+	creds, err := store.Users.GetAllCreds(uid, method, false)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+
+	value := req.URL.Query().Get("value")
+	var deleted []string
+	for _, cr := range creds {
+		if value != "" && cr.Value != value {
+			continue
+		}
+		// Credentials are not required at LevelNone: any credential can be deleted.
+		if _, err = deleteCred(uid, auth.LevelNone, &MsgCredClient{Method: method, Value: cr.Value}); err != nil {
+			return decodeStoreError(err, "", now, nil), err.Error()
+		}
+		deleted = append(deleted, cr.Value)
+	}
+	if len(deleted) == 0 {
+		return ErrNotFound("", "", now), ""
+	}
+	return NoErr("", "", now), "deleted " + method + " " + strings.Join(deleted, ",")
+}
+
+// adminEraseUser returns a handler which hard-deletes the user account and erases all data derived from
+// the user. In a dry run the handler only reports the number of records to be erased.
+func adminEraseUser(dryRun bool) func(req *http.Request) (*ServerComMessage, string) {
+	return func(req *http.Request) (*ServerComMessage, string) {
+		now := types.TimeNow()
+		uid := types.ParseUserId(req.PathValue("user"))
+		if uid.IsZero() {
+			return ErrMalformed("", "", now), ""
+		}
+
+		var report types.ErasureReport
+		var err error
+		if dryRun {
+			report, err = store.Users.Erase(uid, true)
+		} else {
+			report, err = deleteUser(uid, true, true, "")
+		}
+		if err != nil {
+			return decodeStoreError(err, "", now, nil), err.Error()
+		}
+		if len(report) == 0 {
+			// Nothing is found: the user does not exist or was already erased.
+			return ErrUserNotFound("", "", now, now), ""
+		}
+		var action string
+		if !dryRun {
+			action = "account erased"
+		}
+		return NoErrParams("", "", now, map[string]any{"report": report}), action
+	}
+}
+
+// adminListSessions lists sessions connected to this node, optionally only those of ?user=usrXXX.
+func adminListSessions(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	var uid types.Uid
+	if user := req.URL.Query().Get("user"); user != "" {
+		if uid = types.ParseUserId(user); uid.IsZero() {
+			return ErrMalformed("", "", now), ""
+		}
+	}
+
+	protos := map[SessionProto]string{WEBSOCK: "ws", LPOLL: "lp", GRPC: "grpc", PROXY: "proxy", MULTIPLEX: "mux", XMPP: "xmpp", MQTT: "mqtt", SSE: "sse"}
+	sessions := []adminSession{}
+	globals.sessionStore.Range(func(sid string, s *Session) bool {
+		if s.isMultiplex() || (!uid.IsZero() && s.uid != uid) {
+			return true
+		}
+		var user string
+		if !s.uid.IsZero() {
+			user = s.uid.UserId()
+		}
+		s.subsLock.RLock()
+		topics := len(s.subs)
+		s.subsLock.RUnlock()
+		sessions = append(sessions, adminSession{
+			Sid:        sid,
+			User:       user,
+			AuthLevel:  s.authLvl.String(),
+			Proto:      protos[s.proto],
+			RemoteAddr: s.remoteAddr,
+			UserAgent:  s.userAgent,
+			Lang:       s.lang,
+			Platform:   s.platf,
+			Topics:     topics,
+		})
+		return true
+	})
+	return NoErrParams("", "", now, map[string]any{"sessions": sessions}), ""
+}
+
+// adminBusiestTopics lists topics loaded at this node with the most messages published since the
+// topic was loaded or, with ?by=sessions, with the most attached sessions. The number of topics is
+// limited by ?limit=N.
+func adminBusiestTopics(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	query := req.URL.Query()
+	limit := adminTopicsDefaultLimit
+	if val := query.Get("limit"); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 {
+			return ErrMalformed("", "", now), ""
+		}
+		limit = min(limit, adminTopicsMaxLimit)
+	}
+	by := query.Get("by")
+	if by != "" && by != "messages" && by != "sessions" {
+		return ErrMalformed("", "", now), ""
+	}
+
+	topics := []adminTopic{}
+	globals.hub.topics.Range(func(_, val any) bool {
+		t := val.(*Topic)
+		if t.isProxy {
+			// Messages are counted by the master topic.
+			return true
+		}
+		topics = append(topics, adminTopic{
+			Topic:    t.name,
+			Category: topicCatName(t.name),
+			Messages: t.pubCount.Load(),
+			Sessions: t.sessCount.Load(),
+			Loaded:   t.loadedAt,
+		})
+		return true
+	})
+	slices.SortFunc(topics, func(a, b adminTopic) int {
+		if by == "sessions" {
+			return cmp.Compare(b.Sessions, a.Sessions)
+		}
+		return cmp.Compare(b.Messages, a.Messages)
+	})
+	if len(topics) > limit {
+		topics = topics[:limit]
+	}
+	return NoErrParams("", "", now, map[string]any{"topics": topics}), ""
+}
+
+// adminDrainStatus reports if the node is draining and the number of client sessions left.
+func adminDrainStatus(req *http.Request) (*ServerComMessage, string) {
+	sessions := 0
+	globals.sessionStore.Range(func(_ string, s *Session) bool {
+		if !s.isMultiplex() {
+			sessions++
+		}
+		return true
+	})
+	return NoErrParams("", "", types.TimeNow(), map[string]any{
+		"draining": globals.draining.Load(),
+		"sessions": sessions,
+	}), ""
+}
+
+// adminDrain starts draining the node: the node stops accepting sessions, asks clients to reconnect
+// and shuts down once no sessions are left.
+func adminDrain(req *http.Request) (*ServerComMessage, string) {
+	if !drainStart() {
+		now := types.TimeNow()
+		return InfoNoAction("", "", now, now), "draining already"
+	}
+	return NoErrAccepted("", "", types.TimeNow()), "draining"
+}
+
+// adminDiagnostics reports recent slow queries and topics with the deepest queues of messages.
+func adminDiagnostics(req *http.Request) (*ServerComMessage, string) {
+	return NoErrParams("", "", types.TimeNow(), diag.report()), ""
+}
+
+// adminSetDiagnostics switches diagnostics mode on or off with {"enabled": true|false} from the request body.
+func adminSetDiagnostics(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+		return ErrMalformed("", "", now), ""
+	}
+	action := "diagnostics " + strconv.FormatBool(*body.Enabled)
+	if !diag.setActive(*body.Enabled) {
+		return InfoNoAction("", "", now, now), action
+	}
+	return NoErr("", "", now), action
+}
+
+// adminMaintenanceStatus reports if the node is in read-only maintenance mode.
+func adminMaintenanceStatus(req *http.Request) (*ServerComMessage, string) {
+	return NoErrParams("", "", types.TimeNow(), map[string]any{"enabled": globals.maintenance.Load()}), ""
+}
+
+// adminSetMaintenance switches maintenance mode on or off with {"enabled": true|false} from the request body.
+func adminSetMaintenance(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+		return ErrMalformed("", "", now), ""
+	}
+	action := "maintenance " + strconv.FormatBool(*body.Enabled)
+	if !maintenanceSet(*body.Enabled) {
+		return InfoNoAction("", "", now, now), action
+	}
+	return NoErr("", "", now), action
+}
+
+// adminDeleteTopic hard-deletes a group topic or a channel on behalf of its owner.
+func adminDeleteTopic(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	name := req.PathValue("topic")
+	if chn := types.ChnToGrp(name); chn != "" {
+		name = chn
+	}
+	if cat, ok := topicCatOf(name); !ok || cat != types.TopicCatGrp {
+		// Other topics are deleted together with their users.
+		return ErrMalformed("", "", now), ""
+	}
+	if globals.cluster.isRemoteTopic(name) {
+		return ErrClusterUnreachableExplicitTs("", "", now, now), "topic mastered by another node"
+	}
+
+	topic, err := store.Topics.Get(name)
+	if err == nil && topic == nil {
+		err = types.ErrTopicNotFound
+	}
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), ""
+	}
+	if topic.Owner == "" {
+		// Topics without an owner cannot be deleted.
+		return ErrPermissionDenied("", "", now), "topic has no owner"
+	}
+
+	// The request is processed by the hub as if made by the owner.
+	globals.hub.unreg <- &topicUnreg{
+		rcptTo: name,
+		pkt: &ClientComMessage{
+			Del:       &MsgClientDel{Topic: name, What: "topic", Hard: true},
+			AsUser:    types.ParseUid(topic.Owner).UserId(),
+			RcptTo:    name,
+			Original:  name,
+			MetaWhat:  constMsgDelTopic,
+			Timestamp: now,
+		},
+		del: true,
+	}
+	return NoErrAccepted("", "", now), "topic deletion requested"
+}
+
+// adminWebhookTopic returns the name of the p2p or group topic addressed by the request or an empty string
+// for server-wide webhooks.
+func adminWebhookTopic(req *http.Request) (string, *ServerComMessage) {
+	now := types.TimeNow()
+	name := req.PathValue("topic")
+	if name == "" {
+		return "", nil
+	}
+	if chn := types.ChnToGrp(name); chn != "" {
+		name = chn
+	}
+	if cat, ok := topicCatOf(name); !ok || (cat != types.TopicCatP2P && cat != types.TopicCatGrp) {
+		return "", ErrMalformed("", "", now)
+	}
+	topic, err := store.Topics.Get(name)
+	if err == nil && (topic == nil || topic.State == types.StateDeleted) {
+		err = types.ErrTopicNotFound
+	}
+	if err != nil {
+		return "", decodeStoreError(err, "", now, nil)
+	}
+	return name, nil
+}
+
+// adminListWebhooks lists server-wide webhooks or webhooks of the topic.
+func adminListWebhooks(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminWebhookTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	hooks, err := store.Webhooks.GetAll(topic)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	result := make([]adminWebhook, 0, len(hooks))
+	for i := range hooks {
+		hook := &hooks[i]
+		result = append(result, adminWebhook{
+			Id:      hook.Id,
+			Topic:   hook.Topic,
+			URL:     hook.URL,
+			Events:  hook.Events,
+			Created: hook.CreatedAt,
+		})
+	}
+	return NoErrParams("", "", now, map[string]any{"webhooks": result}), ""
+}
+
+// adminCreateWebhook adds a server-wide webhook or a webhook of the topic with
+// {"url": "https://...", "secret": "...", "events": ["message.posted", ...]} from the request body.
+// A random secret is generated if the secret is missing. Missing events mean all events.
+func adminCreateWebhook(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminWebhookTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		URL    string   `json:"url"`
+		Secret string   `json:"secret"`
+		Events []string `json:"events"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.URL) > maxWebhookURLLength ||
+		len(body.Secret) > maxWebhookSecretLength {
+		return ErrMalformed("", "", now), ""
+	}
+	if u, err := url.Parse(body.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrMalformed("", "", now), "invalid url"
+	}
+	for _, event := range body.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return ErrMalformed("", "", now), "unknown event " + event
+		}
+	}
+	if body.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return ErrUnknown("", "", now), err.Error()
+		}
+		body.Secret = base64.RawURLEncoding.EncodeToString(secret)
+	}
+
+	hook := &types.Webhook{
+		Topic:  topic,
+		URL:    body.URL,
+		Secret: body.Secret,
+		Events: body.Events,
+	}
+	if err := store.Webhooks.Create(hook); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	webhooksInvalidate(topic)
+
+	return NoErrParams("", "", now, map[string]any{"webhook": adminWebhook{
+		Id:      hook.Id,
+		Topic:   hook.Topic,
+		URL:     hook.URL,
+		Events:  hook.Events,
+		Created: hook.CreatedAt,
+		Secret:  hook.Secret,
+	}}), "webhook " + hook.Id + " " + hook.URL
+}
+
+// adminDeleteWebhook deletes the webhook.
+func adminDeleteWebhook(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	id := req.PathValue("id")
+	deleted, err := store.Webhooks.Delete(id)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if !deleted {
+		return ErrNotFound("", "", now), ""
+	}
+	webhooksReset()
+	return NoErr("", "", now), "webhook " + id + " deleted"
+}
+
+// adminListInWebhooks lists incoming webhooks of the topic.
+func adminListInWebhooks(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminWebhookTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	hooks, err := store.InWebhooks.GetAll(topic)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	result := make([]adminInWebhook, 0, len(hooks))
+	for i := range hooks {
+		result = append(result, adminInWebhookOf(&hooks[i]))
+	}
+	return NoErrParams("", "", now, map[string]any{"inwebhooks": result}), ""
+}
+
+// adminCreateInWebhook adds an incoming webhook of the topic with
+// {"user": "usrXXX", "format": "text", "template": "..."} from the request body. The user posting
+// messages must be subscribed to the topic with the 'W' permission. The format is "text" if missing.
+func adminCreateInWebhook(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminWebhookTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		User     string `json:"user"`
+		Format   string `json:"format"`
+		Template string `json:"template"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil ||
+		len(body.Template) > maxInWebhookTemplateLength {
+		return ErrMalformed("", "", now), ""
+	}
+	switch body.Format {
+	case "":
+		body.Format = types.InWebhookText
+	case types.InWebhookText, types.InWebhookDrafty, types.InWebhookJSON:
+	default:
+		return ErrMalformed("", "", now), "unknown format " + body.Format
+	}
+	if _, err := inWebhookTemplate(body.Template); err != nil {
+		return ErrMalformed("", "", now), "invalid template: " + err.Error()
+	}
+
+	uid := types.ParseUserId(body.User)
+	if uid.IsZero() {
+		return ErrMalformed("", "", now), ""
+	}
+	sub, err := store.Subs.Get(topic, uid, false)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if sub == nil || !(sub.ModeWant & sub.ModeGiven).IsWriter() {
+		return ErrPermissionDenied("", "", now), "user " + body.User + " cannot post to " + topic
+	}
+
+	hook := &types.IncomingWebhook{
+		Topic:    topic,
+		User:     uid.UserId(),
+		Format:   body.Format,
+		Template: body.Template,
+	}
+	if err := store.InWebhooks.Create(hook); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	return NoErrParams("", "", now, map[string]any{"inwebhook": adminInWebhookOf(hook)}),
+		"incoming webhook of " + topic + " as " + hook.User
+}
+
+// adminDeleteInWebhook deletes the incoming webhook.
+func adminDeleteInWebhook(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	deleted, err := store.InWebhooks.Delete(req.PathValue("token"))
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if !deleted {
+		return ErrNotFound("", "", now), ""
+	}
+	return NoErr("", "", now), "incoming webhook deleted"
+}
+
+// adminMatrixTopic returns the name of the group topic addressed by the request if the Matrix bridge is enabled.
+func adminMatrixTopic(req *http.Request) (string, *ServerComMessage) {
+	now := types.TimeNow()
+	if !matrix.Enabled() {
+		return "", ErrNotImplemented("", "", now, now)
+	}
+	topic, resp := adminWebhookTopic(req)
+	if resp != nil {
+		return "", resp
+	}
+	if cat, ok := topicCatOf(topic); !ok || cat != types.TopicCatGrp {
+		return "", ErrMalformed("", "", now)
+	}
+	return topic, nil
+}
+
+// adminGetMatrixRoom reports the Matrix room bridged to the topic in params.room.
+func adminGetMatrixRoom(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminMatrixTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	link, err := store.MatrixRooms.Get(topic)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if link == nil {
+		return ErrNotFound("", "", now), ""
+	}
+	return NoErrParams("", "", now, map[string]any{"room": link.Room, "created": link.CreatedAt}), ""
+}
+
+// adminLinkMatrixRoom bridges the topic to the room with {"room": "!id:example.com"} or
+// {"room": "#alias:example.com"} from the request body. The bot of the bridge joins the room,
+// then puppets of the members of the topic join it too.
+func adminLinkMatrixRoom(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminMatrixTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		Room string `json:"room"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Room) > 255 ||
+		(!strings.HasPrefix(body.Room, "!") && !strings.HasPrefix(body.Room, "#")) {
+		return ErrMalformed("", "", now), ""
+	}
+
+	mc := matrix.Get()
+	room, err := mc.Join(mc.Bot(), body.Room)
+	if err != nil {
+		var merr *matrix.Error
+		if errors.As(err, &merr) && merr.Status == http.StatusNotFound {
+			return ErrNotFound("", "", now), err.Error()
+		}
+		if errors.As(err, &merr) && merr.Status == http.StatusForbidden {
+			return ErrPermissionDenied("", "", now), err.Error()
+		}
+		return ErrServiceUnavailableExplicitTs("", "", now, now), err.Error()
+	}
+
+	if link, err := store.MatrixRooms.GetByRoom(room); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	} else if link != nil && link.Topic != topic {
+		return ErrAlreadyExists("", "", now), room + " is bridged to " + link.Topic
+	}
+	if err := store.MatrixRooms.Link(topic, room); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	matrixRoomInvalidate(topic)
+	matrixSyncMembers(mc, topic, room)
+
+	return NoErrParams("", "", now, map[string]any{"room": room}), "topic " + topic + " bridged to " + room
+}
+
+// adminUnlinkMatrixRoom removes the bridge of the topic. The room is not changed.
+func adminUnlinkMatrixRoom(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminMatrixTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	deleted, err := store.MatrixRooms.Unlink(topic)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if !deleted {
+		return ErrNotFound("", "", now), ""
+	}
+	matrixRoomInvalidate(topic)
+	return NoErr("", "", now), "bridge of topic " + topic + " removed"
+}
+
+// adminMailboxTopic returns the name of the topic addressed by the request if the email gateway is enabled.
+func adminMailboxTopic(req *http.Request) (string, *ServerComMessage) {
+	if !mailgate.Enabled() {
+		now := types.TimeNow()
+		return "", ErrNotImplemented("", "", now, now)
+	}
+	return adminWebhookTopic(req)
+}
+
+// adminListMailboxes lists email addresses of the topic.
+func adminListMailboxes(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminMailboxTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	boxes, err := store.Mailboxes.GetAll(topic)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	result := make([]adminMailbox, 0, len(boxes))
+	for i := range boxes {
+		result = append(result, adminMailboxOf(&boxes[i]))
+	}
+	return NoErrParams("", "", now, map[string]any{"mailboxes": result}), ""
+}
+
+// adminCreateMailbox adds an email address of the topic with {"address": "support@example.com",
+// "user": "usrXXX", "reply": true} from the request body. The user posting emails must be subscribed
+// to the topic with the 'W' permission. If reply is true, replies to emails are sent back by email.
+func adminCreateMailbox(req *http.Request) (*ServerComMessage, string) {
+	topic, resp := adminMailboxTopic(req)
+	if resp != nil {
+		return resp, ""
+	}
+
+	now := types.TimeNow()
+	var body struct {
+		Address string `json:"address"`
+		User    string `json:"user"`
+		Reply   bool   `json:"reply"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Address) > 254 {
+		return ErrMalformed("", "", now), ""
+	}
+	if addr, err := mail.ParseAddress(body.Address); err != nil || addr.Address != body.Address {
+		return ErrMalformed("", "", now), "invalid address " + body.Address
+	}
+
+	uid := types.ParseUserId(body.User)
+	if uid.IsZero() {
+		return ErrMalformed("", "", now), ""
+	}
+	sub, err := store.Subs.Get(topic, uid, false)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if sub == nil || !(sub.ModeWant & sub.ModeGiven).IsWriter() {
+		return ErrPermissionDenied("", "", now), "user " + body.User + " cannot post to " + topic
+	}
+
+	box := &types.Mailbox{
+		Address: body.Address,
+		Topic:   topic,
+		User:    uid.UserId(),
+		Reply:   body.Reply,
+	}
+	if err := store.Mailboxes.Create(box); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	mailboxInvalidate(topic)
+	return NoErrParams("", "", now, map[string]any{"mailbox": adminMailboxOf(box)}),
+		"mailbox " + box.Address + " of " + topic + " as " + box.User
+}
+
+// adminDeleteMailbox deletes the email address.
+func adminDeleteMailbox(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	address := req.PathValue("address")
+	box, err := store.Mailboxes.Get(address)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if box == nil {
+		return ErrNotFound("", "", now), ""
+	}
+	if _, err = store.Mailboxes.Delete(address); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	mailboxInvalidate(box.Topic)
+	return NoErr("", "", now), "mailbox " + box.Address + " deleted"
+}
+
+// adminTenantBody parses the tenant from the request body if multi-tenancy is enabled.
+func adminTenantBody(req *http.Request, id string) (*types.Tenant, *ServerComMessage, string) {
+	now := types.TimeNow()
+	if !globals.tenantsEnabled {
+		return nil, ErrNotImplemented("", "", now, now), ""
+	}
+	var body adminTenant
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || len(body.Name) > 255 {
+		return nil, ErrMalformed("", "", now), ""
+	}
+	if id == "" {
+		id = body.Id
+	}
+	tenant := &types.Tenant{
+		Id:    id,
+		Name:  body.Name,
+		Hosts: body.Hosts,
+		Config: types.TenantConfig{
+			AuthSchemes:   body.Config.AuthSchemes,
+			RetentionDays: body.Config.RetentionDays,
+			UserQuota:     body.Config.UserQuota,
+			TopicQuota:    body.Config.TopicQuota,
+			AccountLimits: adminUsageLimitsOf(body.Config.AccountLimits),
+			Limits:        adminUsageLimitsOf(body.Config.Limits),
+		},
+	}
+	if err := tenantValidate(tenant); err != nil {
+		return nil, ErrMalformed("", "", now), err.Error()
+	}
+	return tenant, nil, ""
+}
+
+// adminListTenants lists all tenants.
+func adminListTenants(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	if !globals.tenantsEnabled {
+		return ErrNotImplemented("", "", now, now), ""
+	}
+	tenants, err := store.Tenants.GetAll()
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	result := make([]adminTenant, 0, len(tenants))
+	for i := range tenants {
+		result = append(result, adminTenantOf(&tenants[i]))
+	}
+	return NoErrParams("", "", now, map[string]any{"tenants": result}), ""
+}
+
+// adminCreateTenant adds a tenant with {"id": "acme", "name": "Acme Inc.", "hosts": ["chat.acme.com"],
+// "config": {"auth_schemes": ["basic"], "retention_days": 90, "user_quota": 1073741824}} from the request
+// body. Fields of the config are optional: server defaults apply to missing fields, negative retention
+// and quotas mean forever and unlimited.
+func adminCreateTenant(req *http.Request) (*ServerComMessage, string) {
+	tenant, resp, reason := adminTenantBody(req, "")
+	if resp != nil {
+		return resp, reason
+	}
+
+	now := types.TimeNow()
+	if err := store.Tenants.Create(tenant); err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	tenantsInvalidate()
+	return NoErrParams("", "", now, map[string]any{"tenant": adminTenantOf(tenant)}), "tenant " + tenant.Id + " added"
+}
+
+// adminUpdateTenant replaces the name, hosts and config of the tenant with those from the request body.
+func adminUpdateTenant(req *http.Request) (*ServerComMessage, string) {
+	tenant, resp, reason := adminTenantBody(req, req.PathValue("tenant"))
+	if resp != nil {
+		return resp, reason
+	}
+
+	now := types.TimeNow()
+	ok, err := store.Tenants.Update(tenant)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if !ok {
+		return ErrNotFound("", "", now), ""
+	}
+	tenantsInvalidate()
+	return NoErr("", "", now), "tenant " + tenant.Id + " updated"
+}
+
+// adminDeleteTenant deletes the tenant. Tenants with users cannot be deleted.
+func adminDeleteTenant(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	if !globals.tenantsEnabled {
+		return ErrNotImplemented("", "", now, now), ""
+	}
+	id := req.PathValue("tenant")
+	tenants, err := store.Tenants.GetAll()
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if !slices.ContainsFunc(tenants, func(t types.Tenant) bool { return t.Id == id }) {
+		return ErrNotFound("", "", now), ""
+	}
+	ok, err := store.Tenants.Delete(id)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	if !ok {
+		return ErrPermissionDenied("", "", now), "tenant " + id + " has users"
+	}
+	tenantsInvalidate()
+	return NoErr("", "", now), "tenant " + id + " deleted"
+}
+
+// adminUsagePeriod returns the billing period from the optional query parameter period (YYYY-MM),
+// the current period by default. Returns an error reply if metering is disabled or the period is invalid.
+func adminUsagePeriod(req *http.Request) (string, *ServerComMessage) {
+	now := types.TimeNow()
+	if !globals.meteringEnabled {
+		return "", ErrNotImplemented("", "", now, now)
+	}
+	period := req.URL.Query().Get("period")
+	if period == "" {
+		return meterPeriod(now), nil
+	}
+	if _, err := time.Parse(meterPeriodLayout, period); err != nil {
+		return "", ErrMalformed("", "", now)
+	}
+	return period, nil
+}
+
+// adminUserUsage reports usage of the user in the billing period given by the optional query parameter
+// period (YYYY-MM) together with reached limits.
+func adminUserUsage(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	period, errReply := adminUsagePeriod(req)
+	if errReply != nil {
+		return errReply, ""
+	}
+	uid := types.ParseUserId(req.PathValue("user"))
+	if uid.IsZero() {
+		return ErrMalformed("", "", now), ""
+	}
+	usage, err := store.Usage.Get(period, uid)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	// Usage of deleted users keeps the tenant it was saved with.
+	if tenant, err := userTenant(uid); err == nil {
+		usage.Tenant = tenant
+	} else if err != types.ErrUserNotFound {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	limits, _ := meterLimits(usage.Tenant)
+	return NoErrParams("", "", now, map[string]any{"usage": adminUsageOf(usage, limits)}), ""
+}
+
+// adminTenantUsage reports total usage of users of the tenant in the billing period given by the optional
+// query parameter period (YYYY-MM) together with reached limits of the tenant.
+func adminTenantUsage(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	period, errReply := adminUsagePeriod(req)
+	if errReply != nil {
+		return errReply, ""
+	}
+	if !globals.tenantsEnabled {
+		return ErrNotImplemented("", "", now, now), ""
+	}
+	tenant := tenantGet(req.PathValue("tenant"))
+	if tenant == nil {
+		return ErrNotFound("", "", now), ""
+	}
+	usage, err := store.Usage.Total(period, tenant.Id)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	return NoErrParams("", "", now, map[string]any{"usage": adminUsageOf(usage, tenant.Config.Limits)}), ""
+}
+
+// adminListUsage reports usage of users in the billing period given by the optional query parameter
+// period (YYYY-MM), of users of one tenant if the query parameter tenant is given. Users without usage
+// in the period and without uploaded files are omitted.
+func adminListUsage(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	period, errReply := adminUsagePeriod(req)
+	if errReply != nil {
+		return errReply, ""
+	}
+	var tenants []string
+	if query := req.URL.Query(); query.Has("tenant") {
+		tenants = []string{query.Get("tenant")}
+	}
+	found, err := store.Usage.List(period, tenants)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	result := make([]adminUsage, 0, len(found))
+	for i := range found {
+		limits, _ := meterLimits(found[i].Tenant)
+		result = append(result, adminUsageOf(&found[i], limits))
+	}
+	return NoErrParams("", "", now, map[string]any{"usage": result}), ""
+}
+
+// adminListSms lists the most recent SMS notifications sent to the user and their delivery statuses,
+// newest first. The number of notifications is limited by the optional query parameter limit.
+func adminListSms(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	uid := types.ParseUserId(req.PathValue("user"))
+	if uid.IsZero() {
+		return ErrMalformed("", "", now), ""
+	}
+	limit := adminSmsDefaultLimit
+	if val := req.URL.Query().Get("limit"); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 {
+			return ErrMalformed("", "", now), ""
+		}
+		limit = min(limit, adminSmsMaxLimit)
+	}
+
+	found, err := store.SmsMessages.GetAll(uid, limit)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	result := make([]adminSms, 0, len(found))
+	for i := range found {
+		msg := &found[i]
+		result = append(result, adminSms{
+			Id:         msg.Id,
+			Topic:      msg.Topic,
+			SeqId:      msg.SeqId,
+			Phone:      msg.Phone,
+			Provider:   msg.Provider,
+			ProviderId: msg.ProviderId,
+			Status:     msg.Status,
+			Error:      msg.Error,
+			Created:    msg.CreatedAt,
+			Updated:    msg.UpdatedAt,
+		})
+	}
+	return NoErrParams("", "", now, map[string]any{"sms": result}), ""
+}
+
+// adminQueryAudit returns the most recent records of the audit log, newest first, filtered by optional
+// query parameters: event, user (either the actor or the target), topic, since, before (RFC 3339), limit.
+func adminQueryAudit(req *http.Request) (*ServerComMessage, string) {
+	now := types.TimeNow()
+	if !globals.auditEnabled {
+		return ErrNotImplemented("", "", now, now), "audit log disabled"
+	}
+
+	params := req.URL.Query()
+	query := &types.AuditQuery{
+		Event: params.Get("event"),
+		Topic: params.Get("topic"),
+	}
+	var err error
+	if user := params.Get("user"); user != "" {
+		if types.ParseUserId(user).IsZero() {
+			return ErrMalformed("", "", now), ""
+		}
+		query.User = user
+	}
+	if since := params.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return ErrMalformed("", "", now), ""
+		}
+	}
+	if before := params.Get("before"); before != "" {
+		if query.Before, err = time.Parse(time.RFC3339, before); err != nil {
+			return ErrMalformed("", "", now), ""
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return ErrMalformed("", "", now), ""
+		}
+	}
+
+	found, err := store.Audit.Query(query)
+	if err != nil {
+		return decodeStoreError(err, "", now, nil), err.Error()
+	}
+	records := make([]adminAuditRecord, 0, len(found))
+	for i := range found {
+		rec := &found[i]
+		records = append(records, adminAuditRecord{
+			Ts:         rec.CreatedAt,
+			Event:      rec.Event,
+			Actor:      rec.Actor,
+			Target:     rec.Target,
+			Topic:      rec.Topic,
+			RemoteAddr: rec.RemoteAddr,
+			Details:    rec.Details,
+		})
+	}
+	return NoErrParams("", "", now, map[string]any{"records": records}), ""
+}
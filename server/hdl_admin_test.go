@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth/mock_auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+// serveAdmin makes an authorized admin API request with the given path values and returns the response.
+func serveAdmin(handle func(req *http.Request) (*ServerComMessage, string), method, token string,
+	values map[string]string) *MsgServerCtrl {
+	req := httptest.NewRequest(method, adminApiPath, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range values {
+		req.SetPathValue(name, value)
+	}
+	rec := httptest.NewRecorder()
+	adminHandler{token: []byte(testAdminToken), handle: handle}.ServeHTTP(rec, req)
+
+	var resp ServerComMessage
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Ctrl == nil || resp.Ctrl.Code != rec.Code {
+		return &MsgServerCtrl{Code: -1}
+	}
+	return resp.Ctrl
+}
+
+// setTestAdminHub replaces the hub with one which collects requests to topics.
+func setTestAdminHub(t *testing.T) *Hub {
+	prevHub, prevSessions := globals.hub, globals.sessionStore
+	hub := &Hub{
+		unreg:      make(chan *topicUnreg, 8),
+		userStatus: make(chan *userStatusReq, 8),
+	}
+	globals.hub = hub
+	globals.sessionStore = &SessionStore{sessCache: make(map[string]*Session)}
+	t.Cleanup(func() {
+		globals.hub, globals.sessionStore = prevHub, prevSessions
+	})
+	return hub
+}
+
+func TestAdminHandlerAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	al := mock_store.NewMockAuditPersistenceInterface(ctrl)
+	prevAudit, prevEnabled := store.Audit, globals.auditEnabled
+	store.Audit, globals.auditEnabled = al, true
+	defer func() {
+		store.Audit, globals.auditEnabled = prevAudit, prevEnabled
+		ctrl.Finish()
+	}()
+
+	called := 0
+	handle := func(req *http.Request) (*ServerComMessage, string) {
+		called++
+		return NoErr("", "", types.TimeNow()), "done"
+	}
+
+	// Rejected requests are audited, including queries.
+	al.EXPECT().Log(gomock.Any()).DoAndReturn(func(rec *types.AuditRecord) error {
+		if rec.Event != types.AuditAdmin || rec.Details != "GET "+adminApiPath+" -> 401 unauthorized" {
+			t.Errorf("Unexpected audit record: %+v", rec)
+		}
+		return nil
+	}).Times(3)
+	for _, token := range []string{"", "wrong-token", testAdminToken + "0"} {
+		if resp := serveAdmin(handle, http.MethodGet, token, nil); resp.Code != http.StatusUnauthorized {
+			t.Errorf("Token '%s': expected 401, got %d", token, resp.Code)
+		}
+	}
+	if called != 0 {
+		t.Fatal("Handler called without a valid token")
+	}
+
+	// Accepted queries are not audited.
+	if resp := serveAdmin(handle, http.MethodGet, testAdminToken, nil); resp.Code != http.StatusOK || called != 1 {
+		t.Errorf("Valid token: expected 200, got %d", resp.Code)
+	}
+	al.EXPECT().Log(gomock.Any()).Return(nil)
+	if resp := serveAdmin(handle, http.MethodPost, testAdminToken, nil); resp.Code != http.StatusOK || called != 2 {
+		t.Errorf("Valid token: expected 200, got %d", resp.Code)
+	}
+}
+
+func TestAdminSuspendUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	prevUsers := store.Users
+	store.Users = uu
+	defer func() {
+		store.Users = prevUsers
+		ctrl.Finish()
+	}()
+	hub := setTestAdminHub(t)
+
+	uid := types.Uid(1)
+	sess := &Session{sid: "sid1", uid: uid, proto: WEBSOCK, stop: make(chan any, 1)}
+	globals.sessionStore.sessCache[sess.sid] = sess
+
+	user := &types.User{}
+	user.SetUid(uid)
+	user.State = types.StateOK
+	uu.EXPECT().Get(uid).Return(user, nil).Times(2)
+	uu.EXPECT().UpdateState(uid, types.StateSuspended).Return(nil)
+
+	suspend := adminSetUserState(types.StateSuspended)
+	if resp := serveAdmin(suspend, http.MethodPost, testAdminToken, map[string]string{"user": uid.UserId()}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.Code)
+	}
+	if len(sess.stop) != 1 || len(globals.sessionStore.sessCache) != 0 {
+		t.Error("Session of the suspended user not terminated")
+	}
+	if status := <-hub.userStatus; status.forUser != uid || status.state != types.StateSuspended {
+		t.Errorf("Unexpected user status request %+v", status)
+	}
+
+	// Already suspended.
+	if resp := serveAdmin(suspend, http.MethodPost, testAdminToken, map[string]string{"user": uid.UserId()}); resp.Code != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", resp.Code)
+	}
+
+	uu.EXPECT().Get(types.Uid(2)).Return(nil, nil)
+	if resp := serveAdmin(suspend, http.MethodPost, testAdminToken, map[string]string{"user": types.Uid(2).UserId()}); resp.Code != http.StatusNotFound {
+		t.Errorf("Unknown user: expected 404, got %d", resp.Code)
+	}
+	if resp := serveAdmin(suspend, http.MethodPost, testAdminToken, map[string]string{"user": "invalid"}); resp.Code != http.StatusBadRequest {
+		t.Errorf("Invalid user ID: expected 400, got %d", resp.Code)
+	}
+}
+
+func TestAdminLogout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+	prevStore, prevUsers := store.Store, store.Users
+	store.Store, store.Users = ss, uu
+	defer func() {
+		store.Store, store.Users = prevStore, prevUsers
+		ctrl.Finish()
+	}()
+	setTestAdminHub(t)
+
+	uid := types.Uid(1)
+	sessions := []*Session{
+		{sid: "sid1", uid: uid, proto: WEBSOCK, stop: make(chan any, 1)},
+		{sid: "sid2", uid: uid, proto: WEBSOCK, stop: make(chan any, 1)},
+		{sid: "sid3", uid: types.Uid(2), proto: WEBSOCK, stop: make(chan any, 1)},
+	}
+	for _, s := range sessions {
+		globals.sessionStore.sessCache[s.sid] = s
+	}
+
+	user := &types.User{}
+	user.SetUid(uid)
+	uu.EXPECT().Get(uid).Return(user, nil)
+	// All tokens of the user are revoked, access tokens included.
+	for _, scheme := range []string{"resume", "refresh", "token"} {
+		ss.EXPECT().GetLogicalAuthHandler(scheme).Return(aa)
+	}
+	aa.EXPECT().IsInitialized().Return(true).Times(3)
+	aa.EXPECT().DelRecords(uid).Return(nil).Times(3)
+
+	if resp := serveAdmin(adminLogout, http.MethodPost, testAdminToken, map[string]string{"user": uid.UserId()}); resp.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.Code)
+	}
+	if len(sessions[0].stop) != 1 || len(sessions[1].stop) != 1 {
+		t.Error("Sessions of the user not terminated")
+	}
+	if len(sessions[2].stop) != 0 || len(globals.sessionStore.sessCache) != 1 {
+		t.Error("Session of another user terminated")
+	}
+
+	// Failure to revoke tokens is reported.
+	uu.EXPECT().Get(uid).Return(user, nil)
+	ss.EXPECT().GetLogicalAuthHandler("resume").Return(aa)
+	aa.EXPECT().IsInitialized().Return(true)
+	aa.EXPECT().DelRecords(uid).Return(types.ErrInternal)
+	if resp := serveAdmin(adminLogout, http.MethodPost, testAdminToken, map[string]string{"user": uid.UserId()}); resp.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", resp.Code)
+	}
+}
+
+func TestAdminDeleteTopic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	tt := mock_store.NewMockTopicsPersistenceInterface(ctrl)
+	prevTopics := store.Topics
+	store.Topics = tt
+	defer func() {
+		store.Topics = prevTopics
+		ctrl.Finish()
+	}()
+	hub := setTestAdminHub(t)
+
+	// Only group topics and channels can be deleted; invalid names are rejected without a panic.
+	for _, name := range []string{"", "g", "xyzABC", "usrAAAAAAAAAAA", "p2pAAAAAAAAAAAAAAAAAAAAAA", "me", "fnd"} {
+		if resp := serveAdmin(adminDeleteTopic, http.MethodDelete, testAdminToken, map[string]string{"topic": name}); resp.Code != http.StatusBadRequest {
+			t.Errorf("Topic '%s': expected 400, got %d", name, resp.Code)
+		}
+	}
+
+	owner := types.Uid(1)
+	tt.EXPECT().Get("grpAAAAAAAAAAA").Return(&types.Topic{Owner: owner.String()}, nil).Times(2)
+	for _, name := range []string{"grpAAAAAAAAAAA", "chnAAAAAAAAAAA"} {
+		if resp := serveAdmin(adminDeleteTopic, http.MethodDelete, testAdminToken, map[string]string{"topic": name}); resp.Code != http.StatusAccepted {
+			t.Fatalf("Topic '%s': expected 202, got %d", name, resp.Code)
+		}
+		// Deleted on behalf of the owner.
+		unreg := <-hub.unreg
+		if unreg.rcptTo != "grpAAAAAAAAAAA" || !unreg.del || unreg.pkt.AsUser != owner.UserId() ||
+			unreg.pkt.Del == nil || !unreg.pkt.Del.Hard {
+			t.Errorf("Unexpected delete request %+v", unreg)
+		}
+	}
+
+	tt.EXPECT().Get("grpBBBBBBBBBBB").Return(&types.Topic{}, nil)
+	if resp := serveAdmin(adminDeleteTopic, http.MethodDelete, testAdminToken, map[string]string{"topic": "grpBBBBBBBBBBB"}); resp.Code != http.StatusForbidden {
+		t.Errorf("Topic without owner: expected 403, got %d", resp.Code)
+	}
+	tt.EXPECT().Get("grpCCCCCCCCCCC").Return(nil, nil)
+	if resp := serveAdmin(adminDeleteTopic, http.MethodDelete, testAdminToken, map[string]string{"topic": "grpCCCCCCCCCCC"}); resp.Code != http.StatusNotFound {
+		t.Errorf("Missing topic: expected 404, got %d", resp.Code)
+	}
+	if len(hub.unreg) != 0 {
+		t.Error("Unexpected delete request")
+	}
+}
+
+func TestAdminEraseUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	dd := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	prevStore, prevUsers, prevDevices := store.Store, store.Users, store.Devices
+	store.Store, store.Users, store.Devices = ss, uu, dd
+	defer func() {
+		store.Store, store.Users, store.Devices = prevStore, prevUsers, prevDevices
+		ctrl.Finish()
+	}()
+	hub := setTestAdminHub(t)
+
+	uid := types.Uid(1)
+	report := types.ErasureReport{"account": 1, "messages": 5}
+	values := map[string]string{"user": uid.UserId()}
+
+	// Dry run only reports the data.
+	uu.EXPECT().Erase(uid, true).Return(report, nil)
+	if resp := serveAdmin(adminEraseUser(true), http.MethodGet, testAdminToken, values); resp.Code != http.StatusOK {
+		t.Fatalf("Dry run: expected 200, got %d", resp.Code)
+	} else if params, _ := resp.Params.(map[string]any); params["report"].(map[string]any)["messages"] != float64(5) {
+		t.Errorf("Dry run: unexpected report %v", resp.Params)
+	}
+	uu.EXPECT().Erase(uid, true).Return(types.ErasureReport{}, nil)
+	if resp := serveAdmin(adminEraseUser(true), http.MethodGet, testAdminToken, values); resp.Code != http.StatusNotFound {
+		t.Errorf("Missing user: expected 404, got %d", resp.Code)
+	}
+
+	// The data is erased before the account is hard-deleted.
+	ss.EXPECT().GetAuthNames().Return(nil)
+	dd.EXPECT().GetAll(uid).Return(nil, 0, nil)
+	uu.EXPECT().GetSubs(uid).Return(nil, nil)
+	// Called once to promote new owners and once to notify subscribers.
+	uu.EXPECT().GetOwnTopics(uid).Return(nil, nil).Times(2)
+	gomock.InOrder(
+		uu.EXPECT().Erase(uid, false).Return(report, nil),
+		uu.EXPECT().Delete(uid, true).Return(nil),
+	)
+	go func() {
+		unreg := <-hub.unreg
+		if unreg.forUser != uid || !unreg.del || !unreg.erase {
+			t.Errorf("Unexpected request to stop topics %+v", unreg)
+		}
+		unreg.done <- true
+	}()
+	if resp := serveAdmin(adminEraseUser(false), http.MethodPost, testAdminToken, values); resp.Code != http.StatusOK {
+		t.Errorf("Erase: expected 200, got %d", resp.Code)
+	}
+}
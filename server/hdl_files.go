@@ -18,12 +18,14 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/scan"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 	"google.golang.org/grpc/peer"
@@ -144,6 +146,24 @@ func largeFileServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 
 	defer rsc.Close()
 
+	if fd.MimeType == takeoutMimeType && fd.User != uid.String() {
+		// Archives with exported data are available to the owner only.
+		writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("takeout archive of another user"))
+		return
+	}
+	if tenant, err := userTenant(uid); err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	} else if fd.Tenant != tenant {
+		// Files are not shared across tenants.
+		writeHttpResponse(ErrPermissionDenied("", "", now), errors.New("file of another tenant"))
+		return
+	}
+	if fd.Status == types.UploadQuarantined {
+		writeHttpResponse(ErrPolicy("", "", now), errors.New("quarantined file"))
+		return
+	}
+
 	wrt.Header().Set("Content-Type", fd.MimeType)
 	asAttachment, _ := strconv.ParseBool(req.URL.Query().Get("asatt"))
 	// Force download for html files as a security measure.
@@ -210,6 +230,11 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.Method != http.MethodHead && globals.maintenance.Load() {
+		writeHttpResponse(ErrMaintenance("", "", now, now), nil)
+		return
+	}
+
 	if globals.maxFileUploadSize > 0 {
 		// Enforce maximum upload size.
 		req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxFileUploadSize)
@@ -286,27 +311,18 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err = checkUserQuota(uid, header.Size); err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+		return
+	}
+
 	buff := make([]byte, 512)
 	if _, err = file.Read(buff); err != nil {
 		writeHttpResponse(ErrUnknown(msgID, "", now), err)
 		return
 	}
 
-	mimeType := http.DetectContentType(buff)
-	// If DetectContentType fails, see if client-provided content type can be used.
-	if mimeType == "application/octet-stream" {
-		if userContentType, params, err := mime.ParseMediaType(header.Header.Get("Content-Type")); err == nil {
-			// Make sure the content-type is legit.
-			for _, allowed := range allowedMimeTypes {
-				if strings.HasPrefix(userContentType, allowed) {
-					if userContentType = mime.FormatMediaType(userContentType, params); userContentType != "" {
-						mimeType = userContentType
-					}
-					break
-				}
-			}
-		}
-	}
+	mimeType := detectMimeType(buff, header.Header.Get("Content-Type"))
 
 	fdef := &types.FileDef{
 		ObjHeader: types.ObjHeader{
@@ -322,6 +338,15 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err = scanUpload(fdef, file); err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+		return
+	}
+	if err = analyzeAudio(fdef, file); err != nil {
+		writeHttpResponse(ErrUnknown(msgID, "", now), err)
+		return
+	}
+
 	url, size, err := mh.Upload(fdef, file)
 	if err != nil {
 		logs.Info.Println("media upload: failed", file, "key", fdef.Location, err)
@@ -338,12 +363,22 @@ func largeFileReceiveHTTP(wrt http.ResponseWriter, req *http.Request) {
 		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
 		return
 	}
+	if fdef.Status == types.UploadQuarantined {
+		writeHttpResponse(ErrPolicy(msgID, "", now), errors.New("quarantined "+fdef.Id))
+		return
+	}
 
-	params := map[string]string{"url": url}
+	params := map[string]any{"url": url}
 	if globals.mediaGcPeriod > 0 {
 		// How long this file is guaranteed to exist without being attached to a message or a topic.
 		params["expires"] = now.Add(globals.mediaGcPeriod).Format(types.TimeFormatRFC3339)
 	}
+	if globals.mediaVariants != nil {
+		if urls := globals.mediaVariants.Submit(fdef, url); urls != nil {
+			params["variants"] = urls
+		}
+	}
+	audioUploadParams(params, fdef)
 
 	writeHttpResponse(NoErrParams(msgID, "", now, params), nil)
 	logs.Info.Println("media upload: ok", fdef.Id, fdef.Location)
@@ -413,6 +448,12 @@ func (*grpcNodeServer) LargeFileServe(req *pbx.FileDownReq, stream pbx.Node_Larg
 
 	defer rsc.Close()
 
+	if fd.MimeType == takeoutMimeType && fd.User != uid.String() {
+		// Archives with exported data are available to the owner only.
+		writeResponse(ErrPermissionDenied(msgID, "", now), errors.New("takeout archive of another user"))
+		return nil
+	}
+
 	resp.Code = http.StatusOK
 	resp.Text = http.StatusText(http.StatusOK)
 	resp.Meta.Name = fd.Location
@@ -509,6 +550,11 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 		return err
 	}
 
+	if err = checkUserQuota(uid, req.Meta.GetSize()); err != nil {
+		writeResponse(decodeStoreError(err, msgID, now, nil), err)
+		return nil
+	}
+
 	mimeType := http.DetectContentType(req.Content)
 	// If DetectContentType fails, use client-provided content type.
 	if mimeType == "application/octet-stream" {
@@ -548,7 +594,38 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 		}
 	}()
 
-	url, size, err := mh.Upload(fdef, reader)
+	var upload io.Reader = reader
+	if scan.IsEnabled() || (globals.audioAnalyzer != nil && strings.HasPrefix(mimeType, "audio/")) {
+		// The file is scanned or analyzed before the upload, it's needed in full.
+		tmp, err := os.CreateTemp("", "tinode-upload-")
+		if err == nil {
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+			if _, err = io.Copy(tmp, reader); err == nil {
+				err = <-done
+			}
+			if err == nil {
+				_, err = tmp.Seek(0, io.SeekStart)
+			}
+		}
+		if err == nil {
+			err = scanUpload(fdef, tmp)
+		}
+		if err == nil {
+			err = analyzeAudio(fdef, tmp)
+		}
+		if err != nil {
+			// Unblock the inbound IO process.
+			reader.CloseWithError(err)
+			writeResponse(decodeStoreError(err, msgID, now, nil), err)
+			return nil
+		}
+		upload = tmp
+		// Inbound IO is complete, the error was already collected.
+		done <- nil
+	}
+
+	url, size, err := mh.Upload(fdef, upload)
 	if err == nil {
 		// No outbound IO error. Maybe we have an inbound one?
 		err = <-done
@@ -560,6 +637,13 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 		return nil
 	}
 
+	if fdef.Scan != nil && fdef.Scan.Verdict == types.ScanInfected {
+		// Keep the file in quarantine but don't disclose its URL.
+		store.Files.FinishUpload(fdef, true, size)
+		writeResponse(ErrPolicy(msgID, "", now), errors.New("quarantined "+fdef.Id))
+		return nil
+	}
+
 	err = stream.SendAndClose(&pbx.FileUpResp{
 		Id:   msgID,
 		Code: http.StatusOK,
@@ -575,6 +659,44 @@ func (*grpcNodeServer) LargeFileReceive(stream pbx.Node_LargeFileReceiveServer)
 	return err
 }
 
+// scanUpload checks the file for malware before it's passed to the media handler and records the result
+// in fdef. Returns types.ErrPolicy if the file is rejected. The file is rewound.
+func scanUpload(fdef *types.FileDef, file io.ReadSeeker) error {
+	if !scan.IsEnabled() {
+		return nil
+	}
+	result, action := scan.Check(file, fdef.MimeType)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fdef.Scan = result
+	if action == scan.Reject {
+		return types.ErrPolicy
+	}
+	// Quarantined files are uploaded and marked as such when the upload is finished.
+	return nil
+}
+
+// detectMimeType detects content type from the first 512 bytes of the file. If detection fails,
+// the client-provided content type is used if allowed.
+func detectMimeType(head []byte, userContentType string) string {
+	mimeType := http.DetectContentType(head)
+	if mimeType == "application/octet-stream" {
+		if userContentType, params, err := mime.ParseMediaType(userContentType); err == nil {
+			// Make sure the content-type is legit.
+			for _, allowed := range allowedMimeTypes {
+				if strings.HasPrefix(userContentType, allowed) {
+					if userContentType = mime.FormatMediaType(userContentType, params); userContentType != "" {
+						mimeType = userContentType
+					}
+					break
+				}
+			}
+		}
+	}
+	return mimeType
+}
+
 // largeFileRunGarbageCollection runs every 'period' and deletes up to 'blockSize' unused files.
 // Returns channel which can be used to stop the process.
 func largeFileRunGarbageCollection(period time.Duration, blockSize int) chan<- bool {
@@ -616,6 +738,11 @@ func authFileRequest(authMethod, secret, sid, remoteAddr string) (types.Uid, []b
 			if err != nil {
 				return uid, nil, err
 			}
+			if challenge == nil {
+				if challenge, err = secondFactorChallenge(authMethod, rec); err != nil {
+					return uid, nil, err
+				}
+			}
 			if challenge != nil {
 				return uid, challenge, nil
 			}
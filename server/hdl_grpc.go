@@ -17,9 +17,11 @@ import (
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/logs"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
 type grpcNodeServer struct {
@@ -36,10 +38,22 @@ func (sess *Session) closeGrpc() {
 
 // Equivalent of starting a new session and a read loop in one.
 func (*grpcNodeServer) MessageLoop(stream pbx.Node_MessageLoopServer) error {
-	sess, count := globals.sessionStore.NewSession(stream, "")
+	if globals.draining.Load() {
+		return status.Error(codes.Unavailable, "draining")
+	}
+
+	var remoteAddr string
 	if p, ok := peer.FromContext(stream.Context()); ok {
-		sess.remoteAddr = p.Addr.String()
+		remoteAddr = p.Addr.String()
+	}
+	reject, restrict := netAclCheckConnection(remoteAddr)
+	if reject {
+		return status.Error(codes.PermissionDenied, "blocked network")
 	}
+
+	sess, count := globals.sessionStore.NewSession(stream, "")
+	sess.remoteAddr = remoteAddr
+	sess.netRestricted = restrict
 	logs.Info.Println("grpc: session started", sess.sid, sess.remoteAddr, count)
 
 	defer func() {
@@ -178,6 +192,10 @@ func serveGrpc(addr string, kaEnabled bool, tlsConf *tls.Config) (*grpc.Server,
 
 	srv := grpc.NewServer(opts...)
 	pbx.RegisterNodeServer(srv, &grpcNodeServer{})
+	if globals.firehose != nil {
+		pbx.RegisterFirehoseServer(srv, &grpcFirehoseServer{})
+		logs.Info.Println("gRPC firehose enabled")
+	}
 	logs.Info.Printf("gRPC/%s%s server is registered at [%s]", grpc.Version, secure, addr)
 
 	go func() {
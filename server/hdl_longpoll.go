@@ -157,9 +157,25 @@ func serveLongPoll(wrt http.ResponseWriter, req *http.Request) {
 	var sess *Session
 	if sid == "" {
 		// New session
+		if globals.draining.Load() {
+			wrt.WriteHeader(http.StatusServiceUnavailable)
+			enc.Encode(ErrDraining(now))
+			return
+		}
+
+		remoteAddr := getRemoteAddr(req)
+		reject, restrict := netAclCheckConnection(remoteAddr)
+		if reject {
+			wrt.WriteHeader(http.StatusForbidden)
+			enc.Encode(ErrPermissionDenied(req.FormValue("id"), "", now))
+			return
+		}
+
 		var count int
 		sess, count = globals.sessionStore.NewSession(wrt, "")
-		sess.remoteAddr = getRemoteAddr(req)
+		sess.remoteAddr = remoteAddr
+		sess.tenant = tenantByHost(req.Host)
+		sess.netRestricted = restrict
 		logs.Info.Println("longPoll: session started", sess.sid, sess.remoteAddr, count)
 
 		wrt.WriteHeader(http.StatusCreated)
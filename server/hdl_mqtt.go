@@ -0,0 +1,734 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Gateway for MQTT 3.1.1 and 5.0 clients, such as small embedded devices
+ *    which cannot use websockets. See also hdl_xmpp.go for XMPP clients.
+ *
+ *    CONNECT is a {login}: the user name and the password are the login and
+ *    the password of the 'basic' authenticator; when the user name is empty,
+ *    the password is an authentication token of the 'token' authenticator.
+ *
+ *    MQTT topics are names of Tinode topics as clients see them: grpAbCdEf
+ *    for a group topic, chnAbCdEf for a channel, usrAbCdEf for the p2p topic
+ *    with the user. Wildcard and shared subscriptions are not supported.
+ *
+ *    - SUBSCRIBE attaches the topics, UNSUBSCRIBE detaches them ({leave}
+ *      without unsubscribing).
+ *    - PUBLISH is a {pub} to the topic. The topic is attached first if
+ *      needed. A payload which is valid JSON is published as is, any other
+ *      payload must be UTF-8 text and is published as a string.
+ *    - {data} of subscribed topics is sent as PUBLISH: text content as is,
+ *      other content as JSON. MQTT 5 clients receive the sender and the seq
+ *      ID as the user properties "from" and "seq".
+ *
+ *    Messages are accepted with QoS 0 and 1 and delivered with QoS 0: the
+ *    history is kept by the server. Sessions are not persisted, retained
+ *    messages and will messages are not supported.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/mqtt"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Connection of an MQTT client is dropped if nothing is received for this time and the client
+	// did not ask for a shorter keep alive interval.
+	mqttIdleTimeout = 5 * time.Minute
+	// Time allowed to send CONNECT after connecting.
+	mqttConnectTimeout = 10 * time.Second
+	// Number of client requests waiting to be dispatched to the session.
+	mqttQueueSize = 64
+)
+
+// Return codes of MQTT 3.1.1 CONNACK.
+const (
+	mqttRefusedVersion     = 0x01
+	mqttRefusedIdentifier  = 0x02
+	mqttRefusedUnavailable = 0x03
+	mqttRefusedCredentials = 0x04
+	mqttRefusedAuth        = 0x05
+)
+
+// Reason codes of MQTT 5.
+const (
+	mqttFailure             = 0x80
+	mqttMalformed           = 0x81
+	mqttProtocolError       = 0x82
+	mqttUnsupportedVersion  = 0x84
+	mqttBadCredentials      = 0x86
+	mqttNotAuthorized       = 0x87
+	mqttServerUnavailable   = 0x88
+	mqttShuttingDown        = 0x8B
+	mqttKeepAliveTimeout    = 0x8D
+	mqttTopicFilterInvalid  = 0x8F
+	mqttTopicNameInvalid    = 0x90
+	mqttPacketTooLarge      = 0x95
+	mqttQuotaExceeded       = 0x97
+	mqttAdministrative      = 0x98
+	mqttPayloadInvalid      = 0x99
+	mqttQoSNotSupported     = 0x9B
+	mqttSharedNotSupported  = 0x9E
+	mqttWildcardUnsupported = 0xA2
+	mqttNoSubscription      = 0x11
+)
+
+// Configuration of the MQTT gateway.
+type mqttConfig struct {
+	// Enable the gateway.
+	Enabled bool `json:"enabled"`
+	// Address and port to listen on for MQTT clients, default ":1883" or ":8883" with TLS.
+	Listen string `json:"listen"`
+	// Accept connections over TLS using the certificate from the "tls" section.
+	UseTLS bool `json:"use_tls"`
+}
+
+// Kinds of requests dispatched on behalf of MQTT clients.
+const (
+	mqttReqConnect = iota + 1
+	mqttReqSub
+	mqttReqPub
+)
+
+// mqttRequest is a request waiting for a response from the server.
+type mqttRequest struct {
+	kind int
+	// CONNECT: the client ID to assign to the client, if any.
+	clientId string
+	// CONNECT: the server keep alive to report to the client, seconds.
+	keepAlive uint16
+	// SUBSCRIBE: acknowledgement to update and the index of the topic filter in it.
+	ack    *mqttSubAck
+	filter int
+	// SUBSCRIBE: the topic to subscribe to and the subscription options.
+	topic   string
+	noLocal bool
+	// PUBLISH: ID of a QoS 1 packet to acknowledge, 0 for QoS 0.
+	packetId uint16
+}
+
+// mqttSubAck is a SUBACK waiting for responses to requests for all topic filters of a SUBSCRIBE.
+type mqttSubAck struct {
+	packetId uint16
+	codes    []byte
+	pending  int
+}
+
+// mqttConn is a connection of an MQTT client.
+type mqttConn struct {
+	conn *mqtt.Conn
+	sess *Session
+
+	// Requests dispatched to the session one at a time by dispatchLoop.
+	queue chan *ClientComMessage
+	done  chan struct{}
+
+	// The following fields are read by the read loop only.
+
+	// CONNECT was received.
+	connected bool
+
+	lock sync.Mutex
+	// Subscribed topics: true if messages of the client must not be delivered back to it.
+	subs map[string]bool
+	// Requests waiting for responses, by message ID.
+	reqs  map[string]*mqttRequest
+	reqId int
+}
+
+// serveMqtt starts the listener of MQTT client connections.
+func serveMqtt(conf *mqttConfig, tlsConf *tls.Config) (net.Listener, error) {
+	if conf == nil || !conf.Enabled {
+		return nil, nil
+	}
+	if conf.UseTLS && tlsConf == nil {
+		return nil, errors.New("mqtt: TLS is not configured")
+	}
+
+	addr := conf.Listen
+	if addr == "" {
+		addr = ":1883"
+		if conf.UseTLS {
+			addr = ":8883"
+		}
+	}
+	lis, err := netListener(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := ""
+	if conf.UseTLS {
+		lis = tls.NewListener(lis, tlsConf)
+		secure = " over TLS"
+	}
+	logs.Info.Printf("MQTT gateway is listening at [%s]%s", addr, secure)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logs.Err.Println("mqtt: accept", err)
+				}
+				return
+			}
+			go mqttServe(conn)
+		}
+	}()
+
+	return lis, nil
+}
+
+// mqttServe runs the session of a client connection.
+func mqttServe(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	reject, restrict := netAclCheckConnection(remoteAddr)
+	if reject || globals.draining.Load() {
+		conn.Close()
+		return
+	}
+
+	mc := &mqttConn{
+		conn:  mqtt.NewConn(conn, globals.maxMessageSize, mqttConnectTimeout),
+		queue: make(chan *ClientComMessage, mqttQueueSize),
+		done:  make(chan struct{}),
+		subs:  make(map[string]bool),
+		reqs:  make(map[string]*mqttRequest),
+	}
+	sess, count := globals.sessionStore.NewSession(mc, "")
+	mc.sess = sess
+	sess.remoteAddr = remoteAddr
+	sess.netRestricted = restrict
+	logs.Info.Println("mqtt: session started", sess.sid, sess.remoteAddr, count)
+
+	dispatched := make(chan struct{})
+	go func() {
+		mc.dispatchLoop()
+		close(dispatched)
+	}()
+	go sess.writeMqttLoop()
+
+	defer func() {
+		close(mc.done)
+		<-dispatched
+		mc.conn.Close()
+		sess.cleanUp(false)
+	}()
+
+	mc.readLoop()
+}
+
+// dispatchLoop dispatches requests of the client to the session in order.
+func (mc *mqttConn) dispatchLoop() {
+	for {
+		select {
+		case msg := <-mc.queue:
+			mc.sess.dispatch(msg)
+			if msg.Sub != nil {
+				// Wait for the subscription to complete: the following requests may need the topic attached.
+				mc.sess.inflightReqs.Add(1)
+				mc.sess.inflightReqs.Done()
+			}
+		case <-mc.done:
+			return
+		}
+	}
+}
+
+// enqueue adds a request to the dispatch queue.
+func (mc *mqttConn) enqueue(msg *ClientComMessage) {
+	select {
+	case mc.queue <- msg:
+	default:
+		logs.Warn.Println("mqtt: dispatch queue full", mc.sess.sid)
+	}
+}
+
+// request registers the request waiting for a response and returns the message ID to use.
+func (mc *mqttConn) request(req *mqttRequest) string {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	mc.reqId++
+	id := "m" + strconv.Itoa(mc.reqId)
+	mc.reqs[id] = req
+	return id
+}
+
+// response returns the request the message with the given ID responds to and removes it.
+func (mc *mqttConn) response(id string) *mqttRequest {
+	if id == "" {
+		return nil
+	}
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	req := mc.reqs[id]
+	delete(mc.reqs, id)
+	return req
+}
+
+// send writes the packet to the client.
+func (mc *mqttConn) send(pkt mqtt.Packet) bool {
+	statsInc("OutgoingMessagesMqttTotal", 1)
+	if err := mc.conn.Send(pkt); err != nil {
+		if errors.Is(err, mqtt.ErrTooLarge) {
+			// The client does not accept packets this large: the packet is skipped.
+			logs.Info.Println("mqtt: packet too large for the client", mc.sess.sid)
+			return true
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			logs.Info.Println("mqtt: write", mc.sess.sid, err)
+		}
+		return false
+	}
+	return true
+}
+
+// disconnect tells MQTT 5 clients the reason and closes the connection.
+func (mc *mqttConn) disconnect(reason byte) {
+	if mc.conn.Version() == mqtt.Version5 {
+		mc.send(&mqtt.Disconnect{Code: reason})
+	}
+	mc.conn.Close()
+}
+
+func (mc *mqttConn) isV5() bool {
+	return mc.conn.Version() == mqtt.Version5
+}
+
+// readLoop reads and handles packets until the connection is closed.
+func (mc *mqttConn) readLoop() {
+	for {
+		pkt, err := mc.conn.Next()
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case err == io.EOF || errors.Is(err, net.ErrClosed):
+			case errors.Is(err, mqtt.ErrTooLarge):
+				mc.disconnect(mqttPacketTooLarge)
+			case errors.Is(err, mqtt.ErrMalformed):
+				mc.disconnect(mqttMalformed)
+			case errors.Is(err, mqtt.ErrUnsupported):
+				mc.disconnect(mqttProtocolError)
+			case errors.As(err, &netErr) && netErr.Timeout():
+				mc.disconnect(mqttKeepAliveTimeout)
+			default:
+				logs.Info.Println("mqtt: read", mc.sess.sid, err)
+			}
+			return
+		}
+		statsInc("IncomingMessagesMqttTotal", 1)
+
+		if p, ok := pkt.(*mqtt.Connect); ok {
+			if mc.connected {
+				mc.disconnect(mqttProtocolError)
+				return
+			}
+			mc.connected = true
+			if !mc.connect(p) {
+				return
+			}
+			continue
+		}
+		if !mc.connected {
+			// The first packet must be CONNECT.
+			return
+		}
+
+		switch p := pkt.(type) {
+		case *mqtt.Publish:
+			if !mc.publish(p) {
+				return
+			}
+		case *mqtt.PubAck:
+			// Messages are delivered with QoS 0, nothing to acknowledge.
+		case *mqtt.Subscribe:
+			mc.subscribe(p)
+		case *mqtt.Unsubscribe:
+			mc.unsubscribe(p)
+		case *mqtt.PingReq:
+			mc.send(&mqtt.PingResp{})
+		case *mqtt.Disconnect:
+			return
+		default:
+			mc.disconnect(mqttProtocolError)
+			return
+		}
+	}
+}
+
+// connect logs the client in with the credentials from CONNECT.
+func (mc *mqttConn) connect(p *mqtt.Connect) bool {
+	refuse := func(v311, v5 byte) bool {
+		code := v311
+		if p.Version == mqtt.Version5 {
+			code = v5
+		}
+		mc.send(&mqtt.ConnAck{Code: code})
+		return false
+	}
+
+	if p.Version != mqtt.Version311 && p.Version != mqtt.Version5 {
+		return refuse(mqttRefusedVersion, mqttUnsupportedVersion)
+	}
+	if p.Version == mqtt.Version311 && p.ClientID == "" && !p.CleanStart {
+		return refuse(mqttRefusedIdentifier, 0)
+	}
+	if p.Password == nil {
+		return refuse(mqttRefusedCredentials, mqttBadCredentials)
+	}
+
+	req := &mqttRequest{kind: mqttReqConnect}
+	if p.ClientID == "" {
+		req.clientId = mc.sess.sid
+	}
+	idle := mqttIdleTimeout
+	if keepAlive := time.Duration(p.KeepAlive) * time.Second; keepAlive > 0 && keepAlive < idle {
+		// Allow one and a half keep alive intervals.
+		idle = keepAlive * 3 / 2
+	} else {
+		req.keepAlive = uint16(mqttIdleTimeout / time.Second)
+	}
+	mc.conn.SetIdle(idle)
+
+	login := &MsgClientLogin{Id: mc.request(req)}
+	if p.Username == "" {
+		login.Scheme = "token"
+		if token, err := base64.StdEncoding.DecodeString(string(p.Password)); err == nil {
+			login.Secret = token
+		} else {
+			login.Secret = p.Password
+		}
+	} else {
+		login.Scheme = "basic"
+		login.Secret = []byte(p.Username + ":" + string(p.Password))
+	}
+
+	mc.enqueue(&ClientComMessage{Hi: &MsgClientHi{Version: currentVersion, UserAgent: "MQTT"}})
+	mc.enqueue(&ClientComMessage{Login: login})
+	return true
+}
+
+// mqttTopicReason checks if the MQTT topic can be mapped to a Tinode topic. Returns 0 if it can,
+// otherwise the reason code of MQTT 5.
+func mqttTopicReason(topic string) byte {
+	switch {
+	case strings.HasPrefix(topic, "$share/"):
+		return mqttSharedNotSupported
+	case strings.ContainsAny(topic, "+#"):
+		return mqttWildcardUnsupported
+	case strings.ContainsAny(topic, "/$ ") || len(topic) <= 3:
+		return mqttTopicNameInvalid
+	}
+	switch topic[:3] {
+	case "grp", "chn", "usr":
+		return 0
+	}
+	return mqttTopicNameInvalid
+}
+
+// mqttReason converts the response code to the reason code of MQTT 5 acknowledgements.
+func mqttReason(code int) byte {
+	switch {
+	case code < http.StatusBadRequest:
+		return 0
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return mqttNotAuthorized
+	case code == http.StatusTooManyRequests:
+		return mqttQuotaExceeded
+	}
+	return mqttFailure
+}
+
+// attach attaches the topic unless it's already attached.
+func (mc *mqttConn) attach(topic string) {
+	name := topic
+	if strings.HasPrefix(topic, "usr") {
+		uid := types.ParseUserId(topic)
+		if uid.IsZero() {
+			return
+		}
+		name = mc.sess.uid.P2PName(uid)
+	}
+	if mc.sess.getSub(name) == nil {
+		mc.enqueue(&ClientComMessage{Sub: &MsgClientSub{Topic: topic}})
+	}
+}
+
+// publish publishes the message to the topic.
+func (mc *mqttConn) publish(p *mqtt.Publish) bool {
+	if p.QoS > 1 {
+		mc.disconnect(mqttQoSNotSupported)
+		return false
+	}
+	reject := func(reason byte) {
+		if p.QoS > 0 {
+			mc.send(&mqtt.PubAck{PacketID: p.PacketID, Code: reason})
+		}
+	}
+
+	if mqttTopicReason(p.Topic) != 0 {
+		reject(mqttTopicNameInvalid)
+		return true
+	}
+	var content any
+	switch {
+	case json.Valid(p.Payload):
+		json.Unmarshal(p.Payload, &content)
+	case utf8.Valid(p.Payload):
+		content = string(p.Payload)
+	default:
+		reject(mqttPayloadInvalid)
+		return true
+	}
+
+	mc.lock.Lock()
+	noLocal := mc.subs[p.Topic]
+	mc.lock.Unlock()
+
+	mc.attach(p.Topic)
+	pub := &MsgClientPub{Topic: p.Topic, NoEcho: noLocal, Content: content}
+	if p.QoS > 0 {
+		pub.Id = mc.request(&mqttRequest{kind: mqttReqPub, packetId: p.PacketID})
+	}
+	mc.enqueue(&ClientComMessage{Pub: pub})
+	return true
+}
+
+// subscribe attaches the topics of the topic filters.
+func (mc *mqttConn) subscribe(p *mqtt.Subscribe) {
+	ack := &mqttSubAck{packetId: p.PacketID, codes: make([]byte, len(p.Filters))}
+	for i, f := range p.Filters {
+		if reason := mqttTopicReason(f.Filter); reason != 0 {
+			if reason == mqttTopicNameInvalid {
+				reason = mqttTopicFilterInvalid
+			}
+			if !mc.isV5() {
+				reason = mqttFailure
+			}
+			ack.codes[i] = reason
+		} else {
+			ack.pending++
+		}
+	}
+	if ack.pending == 0 {
+		mc.send(&mqtt.SubAck{PacketID: ack.packetId, Codes: ack.codes})
+		return
+	}
+
+	// Responses are handled by the write loop: the acknowledgement must be complete before the first request.
+	for i, f := range p.Filters {
+		if ack.codes[i] == 0 {
+			mc.enqueue(&ClientComMessage{Sub: &MsgClientSub{
+				Id: mc.request(&mqttRequest{kind: mqttReqSub, ack: ack, filter: i, topic: f.Filter,
+					noLocal: f.NoLocal}),
+				Topic: f.Filter,
+			}})
+		}
+	}
+}
+
+// unsubscribe detaches the topics of the topic filters.
+func (mc *mqttConn) unsubscribe(p *mqtt.Unsubscribe) {
+	codes := make([]byte, len(p.Filters))
+	mc.lock.Lock()
+	for i, topic := range p.Filters {
+		if _, ok := mc.subs[topic]; ok {
+			delete(mc.subs, topic)
+		} else {
+			codes[i] = mqttNoSubscription
+		}
+	}
+	mc.lock.Unlock()
+
+	for i, topic := range p.Filters {
+		if codes[i] == 0 {
+			mc.enqueue(&ClientComMessage{Leave: &MsgClientLeave{Topic: topic}})
+		}
+	}
+	mc.send(&mqtt.UnsubAck{PacketID: p.PacketID, Codes: codes})
+}
+
+// deliver translates the message from the server to packets.
+func (mc *mqttConn) deliver(msg *ServerComMessage) bool {
+	switch {
+	case msg.Ctrl != nil:
+		return mc.onCtrl(msg.Ctrl)
+	case msg.Data != nil:
+		return mc.onData(msg.Data)
+	}
+	return true
+}
+
+func (mc *mqttConn) onCtrl(ctrl *MsgServerCtrl) bool {
+	req := mc.response(ctrl.Id)
+	if req == nil {
+		return true
+	}
+
+	switch req.kind {
+	case mqttReqConnect:
+		if ctrl.Code != http.StatusOK {
+			ack := &mqtt.ConnAck{}
+			switch {
+			case mc.isV5() && ctrl.Code == http.StatusUnauthorized:
+				ack.Code = mqttBadCredentials
+			case mc.isV5() && ctrl.Code == http.StatusServiceUnavailable:
+				ack.Code = mqttServerUnavailable
+			case mc.isV5():
+				ack.Code = mqttReason(ctrl.Code)
+			case ctrl.Code == http.StatusBadRequest || ctrl.Code == http.StatusUnauthorized:
+				ack.Code = mqttRefusedCredentials
+			case ctrl.Code == http.StatusForbidden:
+				ack.Code = mqttRefusedAuth
+			default:
+				ack.Code = mqttRefusedUnavailable
+			}
+			mc.send(ack)
+			return false
+		}
+		ack := &mqtt.ConnAck{Props: mqtt.Properties{
+			{ID: mqtt.PropMaxQoS, Value: byte(1)},
+			{ID: mqtt.PropRetainAvailable, Value: byte(0)},
+			{ID: mqtt.PropMaxPacketSize, Value: uint32(globals.maxMessageSize)},
+			{ID: mqtt.PropWildcardAvailable, Value: byte(0)},
+			{ID: mqtt.PropSubIDAvailable, Value: byte(0)},
+			{ID: mqtt.PropSharedSubAvailable, Value: byte(0)},
+		}}
+		if req.clientId != "" {
+			ack.Props = append(ack.Props, mqtt.Property{ID: mqtt.PropAssignedClientID, Value: req.clientId})
+		}
+		if req.keepAlive > 0 {
+			ack.Props = append(ack.Props, mqtt.Property{ID: mqtt.PropServerKeepAlive, Value: req.keepAlive})
+		}
+		return mc.send(ack)
+	case mqttReqSub:
+		ack := req.ack
+		if reason := mqttReason(ctrl.Code); reason == 0 {
+			mc.lock.Lock()
+			mc.subs[req.topic] = req.noLocal
+			mc.lock.Unlock()
+		} else if mc.isV5() {
+			ack.codes[req.filter] = reason
+		} else {
+			ack.codes[req.filter] = mqttFailure
+		}
+		ack.pending--
+		if ack.pending == 0 {
+			return mc.send(&mqtt.SubAck{PacketID: ack.packetId, Codes: ack.codes})
+		}
+	case mqttReqPub:
+		return mc.send(&mqtt.PubAck{PacketID: req.packetId, Code: mqttReason(ctrl.Code)})
+	}
+	return true
+}
+
+func (mc *mqttConn) onData(data *MsgServerData) bool {
+	mc.lock.Lock()
+	_, subscribed := mc.subs[data.Topic]
+	mc.lock.Unlock()
+	if !subscribed || data.Content == nil {
+		return true
+	}
+
+	var payload []byte
+	if text, ok := data.Content.(string); ok {
+		payload = []byte(text)
+	} else {
+		payload, _ = json.Marshal(data.Content)
+	}
+	return mc.send(&mqtt.Publish{
+		Topic:   data.Topic,
+		Payload: payload,
+		Props: mqtt.Properties{
+			{ID: mqtt.PropUserProperty, Value: [2]string{"from", data.From}},
+			{ID: mqtt.PropUserProperty, Value: [2]string{"seq", strconv.Itoa(data.SeqId)}},
+		},
+	})
+}
+
+// topicDetached removes the subscription to the topic detached by the server.
+func (mc *mqttConn) topicDetached(name string) {
+	topic := name
+	if uid1, uid2, err := types.ParseP2P(name); err == nil {
+		if uid1 == mc.sess.uid {
+			topic = uid2.UserId()
+		} else {
+			topic = uid1.UserId()
+		}
+	}
+	mc.lock.Lock()
+	delete(mc.subs, topic)
+	mc.lock.Unlock()
+}
+
+func (sess *Session) writeMqttLoop() {
+	mc := sess.mqtt
+	defer func() {
+		// Closing the connection terminates the read loop.
+		mc.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				// channel closed
+				return
+			}
+			switch v := msg.(type) {
+			case []*ServerComMessage:
+				for _, msg := range v {
+					if !mc.deliver(msg) {
+						return
+					}
+				}
+			case *ServerComMessage:
+				if !mc.deliver(v) {
+					return
+				}
+			}
+
+		case <-sess.bkgTimer.C:
+			if sess.background {
+				sess.background = false
+				sess.onBackgroundTimer()
+			}
+
+		case msg := <-sess.stop:
+			// Shutdown requested, don't care if the message is delivered.
+			if msg, ok := msg.(*ServerComMessage); ok && msg.Ctrl != nil {
+				if msg.Ctrl.Text == "evicted" {
+					mc.disconnect(mqttAdministrative)
+				} else {
+					mc.disconnect(mqttShuttingDown)
+				}
+			}
+			return
+
+		case topic := <-sess.detach:
+			sess.delSub(topic)
+			mc.topicDetached(topic)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Resumable uploads of large files. The protocol follows the core of tus 1.0
+ *    (https://tus.io/protocols/resumable-upload):
+ *
+ *    POST   v0/file/r/      Upload-Length: <total size> creates an upload, returns Location.
+ *    HEAD   v0/file/r/<id>  returns Upload-Offset: bytes received so far.
+ *    PATCH  v0/file/r/<id>  Upload-Offset: <offset> appends the body at the offset.
+ *    POST   v0/file/r/<id>  finalizes the complete upload, returns file URL as
+ *                           v0/file/u/ does.
+ *    DELETE v0/file/r/<id>  cancels the upload.
+ *
+ *    Browsers may send PATCH and DELETE as POST with X-HTTP-Method-Override header.
+ *    Chunks are collected in a local directory, the finished file is passed to
+ *    the configured media handler. Incomplete uploads expire after a period of
+ *    inactivity.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	tusVersion = "1.0.0"
+
+	// Default time of inactivity after which incomplete uploads are deleted, seconds.
+	defaultResumableExpires = 86400
+)
+
+// errUploadOverflow is returned when the received data exceeds the declared length of the upload.
+var errUploadOverflow = errors.New("data exceeds Upload-Length")
+
+// resumableConfig is the configuration of resumable uploads.
+type resumableConfig struct {
+	Enabled bool `json:"enabled"`
+	// Directory to keep incomplete uploads in. Defaults to a subdirectory of the system temp directory.
+	Dir string `json:"dir"`
+	// Time of inactivity after which incomplete uploads are deleted, seconds.
+	Expires int `json:"expires"`
+}
+
+// resumableUpload is the description of an upload, saved next to the received data.
+type resumableUpload struct {
+	User string `json:"user"`
+	// Declared total size.
+	Length int64 `json:"length"`
+	// Client-provided content type.
+	MimeType string `json:"type,omitempty"`
+}
+
+// resumableUploads keeps incomplete uploads in a directory.
+type resumableUploads struct {
+	dir     string
+	expires time.Duration
+
+	// Uploads being written or finalized. Concurrent requests to the same upload are rejected.
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+func newResumableUploads(conf *resumableConfig) (*resumableUploads, error) {
+	ru := &resumableUploads{
+		dir:     conf.Dir,
+		expires: time.Duration(conf.Expires) * time.Second,
+		busy:    make(map[string]bool),
+	}
+	if ru.dir == "" {
+		ru.dir = filepath.Join(os.TempDir(), "tinode-uploads")
+	}
+	if ru.expires <= 0 {
+		ru.expires = defaultResumableExpires * time.Second
+	}
+	if err := os.MkdirAll(ru.dir, 0700); err != nil {
+		return nil, err
+	}
+	return ru, nil
+}
+
+func (ru *resumableUploads) infoPath(id string) string {
+	return filepath.Join(ru.dir, id+".json")
+}
+
+func (ru *resumableUploads) dataPath(id string) string {
+	return filepath.Join(ru.dir, id+".part")
+}
+
+// acquire marks the upload as busy. Returns false if it's already busy.
+func (ru *resumableUploads) acquire(id string) bool {
+	ru.lock.Lock()
+	defer ru.lock.Unlock()
+	if ru.busy[id] {
+		return false
+	}
+	ru.busy[id] = true
+	return true
+}
+
+func (ru *resumableUploads) release(id string) {
+	ru.lock.Lock()
+	delete(ru.busy, id)
+	ru.lock.Unlock()
+}
+
+// create starts a new upload.
+func (ru *resumableUploads) create(id string, info *resumableUpload) error {
+	data, _ := json.Marshal(info)
+	if err := os.WriteFile(ru.infoPath(id), data, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(ru.dataPath(id), nil, 0600)
+}
+
+// get returns the description of the upload, the number of bytes received and the expiration time.
+func (ru *resumableUploads) get(id string) (*resumableUpload, int64, time.Time, error) {
+	stat, err := os.Stat(ru.dataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = types.ErrNotFound
+		}
+		return nil, 0, time.Time{}, err
+	}
+	expires := stat.ModTime().Add(ru.expires)
+	if expires.Before(time.Now()) {
+		ru.remove(id)
+		return nil, 0, time.Time{}, types.ErrNotFound
+	}
+
+	data, err := os.ReadFile(ru.infoPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = types.ErrNotFound
+		}
+		return nil, 0, time.Time{}, err
+	}
+	var info resumableUpload
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return &info, stat.Size(), expires, nil
+}
+
+// write appends data at the offset which must be the current size of the upload. Data received
+// before an error is kept. Returns the new offset.
+func (ru *resumableUploads) write(id string, offset, length int64, body io.Reader) (int64, error) {
+	file, err := os.OpenFile(ru.dataPath(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(file, io.LimitReader(body, length-offset))
+	offset += n
+	if err == nil {
+		// Body must not extend past the declared length.
+		if m, _ := body.Read(make([]byte, 1)); m > 0 {
+			err = errUploadOverflow
+		}
+	}
+	return offset, err
+}
+
+// remove deletes the upload.
+func (ru *resumableUploads) remove(id string) {
+	os.Remove(ru.dataPath(id))
+	os.Remove(ru.infoPath(id))
+}
+
+// expire deletes uploads inactive for longer than the expiration period.
+func (ru *resumableUploads) expire() {
+	entries, err := os.ReadDir(ru.dir)
+	if err != nil {
+		logs.Warn.Println("resumable upload: failed to read dir", err)
+		return
+	}
+	cutoff := time.Now().Add(-ru.expires)
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		stat, err := os.Stat(ru.dataPath(id))
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && stat.ModTime().After(cutoff) {
+			continue
+		}
+		if ru.acquire(id) {
+			ru.remove(id)
+			ru.release(id)
+			logs.Info.Println("resumable upload: expired", id)
+		}
+	}
+}
+
+// runExpiration periodically deletes expired uploads. Returns channel which can be used to stop the process.
+func (ru *resumableUploads) runExpiration() chan<- bool {
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(min(ru.expires/4, time.Hour))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ru.expire()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stop
+}
+
+// parseTusMetadata extracts the file type from Upload-Metadata header: comma-separated pairs
+// of a key and a base64-encoded value.
+func parseTusMetadata(header string) (mimeType string) {
+	for pair := range strings.SplitSeq(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "filetype" {
+			if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+				mimeType = string(decoded)
+			}
+		}
+	}
+	return
+}
+
+// largeFileResumableHTTP handles requests of resumable uploads.
+func largeFileResumableHTTP(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+	mh := store.Store.GetMediaHandler()
+	ru := globals.resumableUploads
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		// Gorilla CompressHandler requires Content-Type to be set.
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		if err != nil {
+			logs.Info.Println("resumable upload:", msg.Ctrl.Code, msg.Ctrl.Text, "/", err)
+		}
+	}
+
+	// Preflight request: process before any security checks.
+	if req.Method == http.MethodOptions {
+		headers, statusCode, err := mh.Headers(req.Method, req.URL, req.Header, false)
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+			return
+		}
+		for name, values := range headers {
+			for _, value := range values {
+				wrt.Header().Add(name, value)
+			}
+		}
+		wrt.Header().Set("Tus-Resumable", tusVersion)
+		wrt.Header().Set("Tus-Version", tusVersion)
+		wrt.Header().Set("Tus-Extension", "creation,termination,expiration")
+		if globals.maxFileUploadSize > 0 {
+			wrt.Header().Set("Tus-Max-Size", strconv.FormatInt(globals.maxFileUploadSize, 10))
+		}
+		if statusCode <= 0 {
+			statusCode = http.StatusNoContent
+		}
+		wrt.WriteHeader(statusCode)
+		return
+	}
+
+	method := req.Method
+	if override := req.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+		method = strings.ToUpper(override)
+	}
+
+	// Only CORS headers are of interest here: upload methods are not known to media handlers.
+	headers, _, err := mh.Headers(http.MethodPost, req.URL, req.Header, false)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+	for name, values := range headers {
+		for _, value := range values {
+			wrt.Header().Add(name, value)
+		}
+	}
+	wrt.Header().Set("Tus-Resumable", tusVersion)
+	wrt.Header().Set("Access-Control-Expose-Headers",
+		"Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable")
+
+	if method != http.MethodHead && globals.maintenance.Load() {
+		writeHttpResponse(ErrMaintenance("", "", now, now), nil)
+		return
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	msgID := req.FormValue("id")
+	authMethod, secret := getHttpAuth(req)
+	uid, challenge, err := authFileRequest(authMethod, secret, req.FormValue("sid"), getRemoteAddr(req))
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge(msgID, now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		// Resumable uploads are not available at signup.
+		writeHttpResponse(ErrAuthRequired(msgID, "", now, now), nil)
+		return
+	}
+
+	_, id := path.Split(req.URL.Path)
+	if id == "" {
+		if method != http.MethodPost {
+			writeHttpResponse(ErrOperationNotAllowed(msgID, "", now),
+				errors.New("method '"+method+"' not allowed"))
+			return
+		}
+
+		length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			writeHttpResponse(ErrMalformed(msgID, "", now), errors.New("invalid Upload-Length"))
+			return
+		}
+		if globals.maxFileUploadSize > 0 && length > globals.maxFileUploadSize {
+			writeHttpResponse(ErrTooLarge(msgID, "", now), nil)
+			return
+		}
+		if err = checkUserQuota(uid, length); err != nil {
+			writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+			return
+		}
+
+		id = store.Store.GetUidString()
+		if err = ru.create(id, &resumableUpload{
+			User:     uid.String(),
+			Length:   length,
+			MimeType: parseTusMetadata(req.Header.Get("Upload-Metadata")),
+		}); err != nil {
+			writeHttpResponse(ErrUnknown(msgID, "", now), err)
+			return
+		}
+
+		location := strings.TrimSuffix(req.URL.Path, "/") + "/" + id
+		wrt.Header().Set("Location", location)
+		wrt.Header().Set("Upload-Expires", now.Add(ru.expires).UTC().Format(http.TimeFormat))
+		msg := NoErrCreated(msgID, "", now)
+		msg.Ctrl.Params = map[string]string{"location": location}
+		writeHttpResponse(msg, nil)
+		logs.Info.Println("resumable upload: created", id, "length", length, "uid=", uid)
+		return
+	}
+
+	if types.ParseUid(id).IsZero() {
+		writeHttpResponse(ErrNotFound(msgID, "", now), nil)
+		return
+	}
+	if !ru.acquire(id) {
+		writeHttpResponse(ErrLocked(msgID, "", now), errors.New("concurrent request to upload "+id))
+		return
+	}
+	defer ru.release(id)
+
+	info, offset, expires, err := ru.get(id)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+		return
+	}
+	if info.User != uid.String() {
+		// Uploads are visible to their owners only.
+		writeHttpResponse(ErrNotFound(msgID, "", now), nil)
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		wrt.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+		wrt.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+		wrt.Header().Set("Cache-Control", "no-store")
+		wrt.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if ct := req.Header.Get("Content-Type"); ct != "application/offset+octet-stream" {
+			writeHttpResponse(ErrMalformed(msgID, "", now), errors.New("invalid Content-Type '"+ct+"'"))
+			return
+		}
+		if req.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+			// The client must check the offset with HEAD and resume from there.
+			wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			writeHttpResponse(ErrCommandOutOfSequence(msgID, "", now),
+				errors.New("offset mismatch"))
+			return
+		}
+		offset, err = ru.write(id, offset, info.Length, req.Body)
+		wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if err == errUploadOverflow {
+			writeHttpResponse(ErrTooLarge(msgID, "", now), err)
+			return
+		}
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+			return
+		}
+		wrt.Header().Set("Upload-Expires", time.Now().Add(ru.expires).UTC().Format(http.TimeFormat))
+		wrt.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		ru.remove(id)
+		wrt.WriteHeader(http.StatusNoContent)
+		logs.Info.Println("resumable upload: cancelled", id, "uid=", uid)
+
+	case http.MethodPost:
+		if offset != info.Length {
+			wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			writeHttpResponse(ErrCommandOutOfSequence(msgID, "", now),
+				errors.New("upload incomplete"))
+			return
+		}
+		url, fdef, err := finishResumableUpload(ru, id, uid, info)
+		if err == types.ErrPolicy || err == types.ErrQuotaExceeded {
+			// Rejected by the malware scanner or over quota, the upload can't be retried.
+			ru.remove(id)
+		}
+		if err != nil {
+			writeHttpResponse(decodeStoreError(err, msgID, now, nil), err)
+			return
+		}
+		ru.remove(id)
+
+		params := map[string]any{"url": url}
+		if globals.mediaGcPeriod > 0 {
+			// How long this file is guaranteed to exist without being attached to a message or a topic.
+			params["expires"] = now.Add(globals.mediaGcPeriod).Format(types.TimeFormatRFC3339)
+		}
+		if globals.mediaVariants != nil {
+			if urls := globals.mediaVariants.Submit(fdef, url); urls != nil {
+				params["variants"] = urls
+			}
+		}
+		audioUploadParams(params, fdef)
+		writeHttpResponse(NoErrParams(msgID, "", now, params), nil)
+
+	default:
+		writeHttpResponse(ErrOperationNotAllowed(msgID, "", now), errors.New("method '"+method+"' not allowed"))
+	}
+}
+
+// finishResumableUpload passes the received file to the media handler. Returns URL and record of the file.
+func finishResumableUpload(ru *resumableUploads, id string, uid types.Uid,
+	info *resumableUpload) (string, *types.FileDef, error) {
+	// Other files may have been uploaded since the upload was created.
+	if err := checkUserQuota(uid, info.Length); err != nil {
+		return "", nil, err
+	}
+
+	file, err := os.Open(ru.dataPath(id))
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	buff := make([]byte, 512)
+	n, err := file.Read(buff)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+
+	fdef := &types.FileDef{
+		ObjHeader: types.ObjHeader{
+			Id: store.Store.GetUidString(),
+		},
+		User:     uid.String(),
+		MimeType: detectMimeType(buff[:n], info.MimeType),
+	}
+	fdef.InitTimes()
+
+	if err = scanUpload(fdef, file); err != nil {
+		return "", nil, err
+	}
+	if err = analyzeAudio(fdef, file); err != nil {
+		return "", nil, err
+	}
+
+	mh := store.Store.GetMediaHandler()
+	url, size, err := mh.Upload(fdef, file)
+	if err != nil {
+		logs.Info.Println("resumable upload: failed", id, "key", fdef.Location, err)
+		store.Files.FinishUpload(fdef, false, 0)
+		return "", nil, err
+	}
+
+	done, err := store.Files.FinishUpload(fdef, true, size)
+	if err != nil {
+		logs.Info.Println("resumable upload: failed to finalize", id, "key", fdef.Location, err)
+		// Best effort cleanup.
+		mh.Delete([]string{fdef.Location})
+		return "", nil, err
+	}
+	if done.Status == types.UploadQuarantined {
+		logs.Info.Println("resumable upload: quarantined", id, fdef.Id)
+		return "", nil, types.ErrPolicy
+	}
+
+	logs.Info.Println("resumable upload: ok", id, fdef.Id, fdef.Location)
+	return url, fdef, nil
+}
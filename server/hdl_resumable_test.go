@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumableUploads(t *testing.T) {
+	ru, err := newResumableUploads(&resumableConfig{Dir: t.TempDir(), Expires: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ru.create("abc", &resumableUpload{User: "usr1", Length: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	offset, err := ru.write("abc", 0, 10, strings.NewReader("hello"))
+	if err != nil || offset != 5 {
+		t.Fatalf("First chunk: offset %d, err %v", offset, err)
+	}
+	if _, offset, _, err = ru.get("abc"); err != nil || offset != 5 {
+		t.Fatalf("Progress: offset %d, err %v", offset, err)
+	}
+	if offset, err = ru.write("abc", 5, 10, strings.NewReader("world!")); err != errUploadOverflow || offset != 10 {
+		t.Errorf("Overflow: offset %d, err %v", offset, err)
+	}
+	if data, _ := os.ReadFile(ru.dataPath("abc")); string(data) != "helloworld" {
+		t.Errorf("Unexpected data %q", data)
+	}
+
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(ru.dataPath("abc"), old, old)
+	ru.expire()
+	if _, _, _, err = ru.get("abc"); err == nil {
+		t.Error("Expired upload not deleted")
+	}
+}
+
+func TestParseTusMetadata(t *testing.T) {
+	if mime := parseTusMetadata("filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==,filetype aW1hZ2UvcG5n, is_confidential"); mime != "image/png" {
+		t.Errorf("Expected 'image/png', got '%s'", mime)
+	}
+}
@@ -0,0 +1,128 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *  SAML 2.0 single sign-on endpoints of the service provider:
+ *
+ *    GET  <api>/v0/saml/metadata  metadata to be registered with the identity provider
+ *    GET  <api>/v0/saml/login     redirect to the identity provider; optional 'state'
+ *                                 is passed back to the app unchanged
+ *    POST <api>/v0/saml/acs       assertion consumer service
+ *
+ *  After a successful login the browser is redirected to the app with
+ *  '#token=<token>&expires=<time>&state=<state>' to be used in {login scheme="token"}.
+ *  On failure it's redirected with '#error=<text>&state=<state>'.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth/saml"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum size of the form posted to the assertion consumer service.
+const maxSamlResponseSize = 1 << 20
+
+// samlServe adds SAML endpoints to the mux if SAML authentication is configured.
+func samlServe(mux *http.ServeMux, path string) {
+	if !saml.Enabled() {
+		return
+	}
+	mux.HandleFunc("GET "+path+"metadata", samlMetadata)
+	mux.HandleFunc("GET "+path+"login", samlLogin)
+	mux.HandleFunc("POST "+path+"acs", samlAcs)
+	logs.Info.Printf("SAML single sign-on served at '%s'", path)
+}
+
+func samlMetadata(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set("Content-Type", "application/samlmetadata+xml")
+	wrt.Write(saml.Metadata())
+}
+
+func samlLogin(wrt http.ResponseWriter, req *http.Request) {
+	idpURL, err := saml.LoginURL(req.URL.Query().Get("state"))
+	if err != nil {
+		logs.Warn.Println("saml: failed to start login", err)
+		resp := decodeStoreError(err, "", types.TimeNow(), nil)
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(resp.Ctrl.Code)
+		json.NewEncoder(wrt).Encode(resp)
+		return
+	}
+	wrt.Header().Set("Cache-Control", "no-store")
+	http.Redirect(wrt, req, idpURL, http.StatusFound)
+}
+
+func samlAcs(wrt http.ResponseWriter, req *http.Request) {
+	remoteAddr := getRemoteAddr(req)
+	req.Body = http.MaxBytesReader(wrt, req.Body, maxSamlResponseSize)
+
+	// The token and the error are passed in the fragment to keep them out of server logs.
+	redirect := func(params url.Values) {
+		if state := req.PostFormValue("RelayState"); state != "" {
+			params.Set("state", state)
+		}
+		wrt.Header().Set("Cache-Control", "no-store")
+		http.Redirect(wrt, req, saml.RedirectURL()+"#"+params.Encode(), http.StatusSeeOther)
+	}
+	fail := func(err error, target string) {
+		resp := decodeStoreError(err, "", types.TimeNow(), nil)
+		if resp.Ctrl.Code >= 500 {
+			logs.Warn.Println("saml: internal", err)
+		} else {
+			auditLog(&types.AuditRecord{
+				Event:      types.AuditLoginFailed,
+				Target:     target,
+				RemoteAddr: remoteAddr,
+				Details:    "saml: " + err.Error(),
+			})
+		}
+		redirect(url.Values{"error": {resp.Ctrl.Text}})
+	}
+
+	data, err := base64.StdEncoding.DecodeString(req.PostFormValue("SAMLResponse"))
+	if err != nil || len(data) == 0 {
+		fail(types.ErrMalformed, "")
+		return
+	}
+
+	rec, _, err := store.Store.GetAuthHandler("saml").Authenticate(data, remoteAddr)
+	if err != nil {
+		fail(err, "")
+		return
+	}
+	if rec.State == types.StateUndefined {
+		rec.State, err = userGetState(rec.Uid)
+	}
+	if err == nil && rec.State != types.StateOK {
+		err = types.ErrPermissionDenied
+	}
+	if err != nil {
+		fail(err, rec.Uid.UserId())
+		return
+	}
+
+	token, expires, err := store.Store.GetLogicalAuthHandler("token").GenSecret(&auth.Rec{
+		Uid:       rec.Uid,
+		AuthLevel: rec.AuthLevel,
+	})
+	if err != nil {
+		fail(err, rec.Uid.UserId())
+		return
+	}
+	redirect(url.Values{
+		"token":   {base64.StdEncoding.EncodeToString(token)},
+		"expires": {expires.Format(time.RFC3339)},
+	})
+}
@@ -0,0 +1,242 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Handler of Server-Sent Events clients, for networks where websockets are
+ *    broken and long polling is too heavy. See also hdl_websock.go for web
+ *    sockets and hdl_longpoll.go for long polling.
+ *
+ *    GET opens the event stream and creates the session. The first event is
+ *    a {ctrl} with the session ID in params. Every following event is a
+ *    server message, comments are sent as keepalives. The session ends when
+ *    the stream is closed.
+ *
+ *    Client messages are sent to the same URL by POST with ?sid=<session ID>.
+ *    Responses are delivered over the stream.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// sseStream is the event stream of an SSE session.
+type sseStream struct {
+	wrt http.ResponseWriter
+	rc  *http.ResponseController
+}
+
+// write sends the data to the client and flushes it.
+func (s *sseStream) write(data []byte) error {
+	// The stream outlives the write timeout of the HTTP server.
+	s.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := s.wrt.Write(data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// sseEvent formats the serialized message as an event.
+func sseEvent(msg []byte) []byte {
+	event := make([]byte, 0, len(msg)+8)
+	event = append(event, "data: "...)
+	event = append(event, msg...)
+	return append(event, '\n', '\n')
+}
+
+func (sess *Session) sendMessageSSE(msg any) bool {
+	if len(sess.send) > sendQueueLimit {
+		logs.Err.Println("sse: outbound queue limit exceeded", sess.sid)
+		return false
+	}
+
+	statsInc("OutgoingMessagesSseTotal", 1)
+	// This will panic if msg is not []byte. This is intentional.
+	if err := sess.sse.write(sseEvent(msg.([]byte))); err != nil {
+		logs.Info.Println("sse: writeLoop", sess.sid, err)
+		return false
+	}
+	return true
+}
+
+// writeSSELoop writes messages to the event stream until the session is stopped or the client
+// disconnects.
+func (sess *Session) writeSSELoop(req *http.Request) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				// Channel closed.
+				return
+			}
+			switch v := msg.(type) {
+			case []*ServerComMessage: // batch of unserialized messages
+				for _, msg := range v {
+					w := sess.serializeAndUpdateStats(msg)
+					if !sess.sendMessageSSE(w) {
+						return
+					}
+				}
+			case *ServerComMessage: // single unserialized message
+				w := sess.serializeAndUpdateStats(v)
+				if !sess.sendMessageSSE(w) {
+					return
+				}
+			default: // serialized message
+				if !sess.sendMessageSSE(v) {
+					return
+				}
+			}
+
+		case <-sess.bkgTimer.C:
+			if sess.background {
+				sess.background = false
+				sess.onBackgroundTimer()
+			}
+
+		case msg := <-sess.stop:
+			// Shutdown requested, don't care if the message is delivered
+			if msg, ok := msg.([]byte); ok {
+				sess.sse.write(sseEvent(msg))
+			}
+			return
+
+		case topic := <-sess.detach:
+			sess.delSub(topic)
+
+		case <-ticker.C:
+			if err := sess.sse.write([]byte(": ping\n\n")); err != nil {
+				logs.Info.Println("sse: writeLoop ping", sess.sid, err)
+				return
+			}
+
+		case <-req.Context().Done():
+			// Client disconnected.
+			return
+		}
+	}
+}
+
+// readSSE dispatches client messages of a POST request.
+func (sess *Session) readSSE(wrt http.ResponseWriter, req *http.Request) (int, error) {
+	if req.ContentLength > globals.maxMessageSize {
+		return http.StatusExpectationFailed, errors.New("request too large")
+	}
+
+	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxMessageSize)
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(raw) == 0 {
+		return http.StatusBadRequest, errors.New("empty request")
+	}
+
+	// The client may issue multiple requests in parallel.
+	sess.lock.Lock()
+	statsInc("IncomingMessagesSseTotal", 1)
+	sess.dispatchRaw(raw)
+	sess.lock.Unlock()
+	return http.StatusNoContent, nil
+}
+
+// serveSSE handles Server-Sent Events clients:
+//   - GET opens the event stream of a new session;
+//   - POST with sid dispatches messages of the client to the session.
+func serveSSE(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+
+	// Currently any domain is allowed to get data from the chat server
+	wrt.Header().Set("Access-Control-Allow-Origin", "*")
+	wrt.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if globals.tlsStrictMaxAge != "" {
+		wrt.Header().Set("Strict-Transport-Security", "max-age"+globals.tlsStrictMaxAge)
+	}
+
+	enc := json.NewEncoder(wrt)
+	fail := func(code int, msg *ServerComMessage) {
+		wrt.Header().Set("Content-Type", "application/json")
+		wrt.WriteHeader(code)
+		enc.Encode(msg)
+	}
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		fail(http.StatusForbidden, ErrAPIKeyRequired(now))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		sess := globals.sessionStore.Get(req.FormValue("sid"))
+		if sess == nil || sess.proto != SSE {
+			fail(http.StatusForbidden, ErrSessionNotFound(now))
+			return
+		}
+		if addr := getRemoteAddr(req); sess.remoteAddr != addr {
+			sess.remoteAddr = addr
+			logs.Warn.Println("sse: remote address changed", sess.sid, addr)
+		}
+		code, err := sess.readSSE(wrt, req)
+		if err != nil {
+			logs.Warn.Println("sse: read failed", sess.sid, err)
+			fail(code, ErrMalformed(req.FormValue("id"), "", now))
+			return
+		}
+		wrt.WriteHeader(code)
+		return
+	default:
+		fail(http.StatusMethodNotAllowed, ErrOperationNotAllowed("", "", now))
+		return
+	}
+
+	if globals.draining.Load() {
+		fail(http.StatusServiceUnavailable, ErrDraining(now))
+		return
+	}
+
+	remoteAddr := getRemoteAddr(req)
+	reject, restrict := netAclCheckConnection(remoteAddr)
+	if reject {
+		fail(http.StatusForbidden, ErrPermissionDenied("", "", now))
+		return
+	}
+
+	stream := &sseStream{wrt: wrt, rc: http.NewResponseController(wrt)}
+	wrt.Header().Set("Content-Type", "text/event-stream")
+	// Disable buffering of the stream by nginx.
+	wrt.Header().Set("X-Accel-Buffering", "no")
+	wrt.WriteHeader(http.StatusOK)
+
+	sess, count := globals.sessionStore.NewSession(stream, "")
+	sess.remoteAddr = remoteAddr
+	sess.tenant = tenantByHost(req.Host)
+	sess.netRestricted = restrict
+	logs.Info.Println("sse: session started", sess.sid, sess.remoteAddr, count)
+
+	defer sess.cleanUp(false)
+
+	pkt := NoErrCreated(req.FormValue("id"), "", now)
+	pkt.Ctrl.Params = map[string]string{
+		"sid": sess.sid,
+	}
+	_, data := sess.serialize(pkt)
+	if !sess.sendMessageSSE(data) {
+		return
+	}
+
+	// The handler must not return while the stream is open.
+	sess.writeSSELoop(req)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteSSELoop(t *testing.T) {
+	wrt := httptest.NewRecorder()
+	sess := &Session{
+		proto:    SSE,
+		sid:      "abc",
+		sse:      &sseStream{wrt: wrt, rc: http.NewResponseController(wrt)},
+		send:     make(chan any, 10),
+		stop:     make(chan any, 1),
+		detach:   make(chan string, 1),
+		bkgTimer: time.NewTimer(time.Hour),
+	}
+
+	sess.send <- []byte(`{"ctrl":{"code":200}}`)
+	sess.send <- &ServerComMessage{Data: &MsgServerData{Topic: "grpX", SeqId: 5}}
+
+	done := make(chan struct{})
+	go func() {
+		sess.writeSSELoop(httptest.NewRequest(http.MethodGet, "/v0/channels/sse", nil))
+		close(done)
+	}()
+	// Stop the session once the messages are taken for writing.
+	for len(sess.send) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sess.stop <- []byte(`{"ctrl":{"code":503}}`)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write loop did not stop")
+	}
+
+	events := strings.Split(wrt.Body.String(), "\n\n")
+	if len(events) != 4 || events[3] != "" {
+		t.Fatalf("Unexpected events %q", events)
+	}
+	if events[0] != `data: {"ctrl":{"code":200}}` || events[2] != `data: {"ctrl":{"code":503}}` {
+		t.Errorf("Unexpected events %q", events)
+	}
+	if !strings.HasPrefix(events[1], `data: {"data":{"topic":"grpX"`) {
+		t.Errorf("Unexpected data event '%s'", events[1])
+	}
+}
@@ -10,8 +10,11 @@
 package main
 
 import (
+	"compress/flate"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -28,8 +31,53 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Default minimum size of a message to compress.
+	defaultWsCompressionThreshold = 256
+	// Default maximum size of a frame with a batch of messages.
+	defaultWsMaxBatchSize = 1 << 16
 )
 
+// Websocket config.
+type wsConfig struct {
+	// Compression level of permessage-deflate from 1 (best speed) to 9 (best compression), default 1.
+	CompressionLevel int `json:"compression_level"`
+	// Messages shorter than this many bytes are sent uncompressed, default 256.
+	CompressionThreshold int `json:"compression_threshold"`
+	// Maximum size of a frame with a batch of messages in bytes, default 65536.
+	MaxBatchSize int `json:"max_batch_size"`
+}
+
+var wsOptions struct {
+	compressionLevel     int
+	compressionThreshold int
+	maxBatchSize         int
+}
+
+// wsInit applies the websocket config.
+func wsInit(config *wsConfig) error {
+	upgrader.EnableCompression = globals.wsCompression
+	wsOptions.compressionLevel = flate.BestSpeed
+	wsOptions.compressionThreshold = defaultWsCompressionThreshold
+	wsOptions.maxBatchSize = defaultWsMaxBatchSize
+	if config == nil {
+		return nil
+	}
+	if config.CompressionLevel != 0 {
+		if config.CompressionLevel < flate.BestSpeed || config.CompressionLevel > flate.BestCompression {
+			return errors.New("ws: invalid compression level")
+		}
+		wsOptions.compressionLevel = config.CompressionLevel
+	}
+	if config.CompressionThreshold > 0 {
+		wsOptions.compressionThreshold = config.CompressionThreshold
+	}
+	if config.MaxBatchSize > 0 {
+		wsOptions.maxBatchSize = config.MaxBatchSize
+	}
+	return nil
+}
+
 func (sess *Session) closeWS() {
 	if sess.proto == WEBSOCK {
 		sess.ws.Close()
@@ -39,7 +87,12 @@ func (sess *Session) closeWS() {
 func (sess *Session) readLoop() {
 	defer func() {
 		sess.closeWS()
-		sess.cleanUp(false)
+		if !sess.outboxPark() {
+			sess.cleanUp(false)
+		}
+		if sess.outbox != nil {
+			sess.outbox.loops.Done()
+		}
 	}()
 
 	sess.ws.SetReadLimit(globals.maxMessageSize)
@@ -71,7 +124,9 @@ func (sess *Session) sendMessage(msg any) bool {
 	}
 
 	statsInc("OutgoingMessagesWebsockTotal", 1)
-	if err := wsWrite(sess.ws, websocket.TextMessage, msg); err != nil {
+	// Compressing short messages costs more than it saves.
+	sess.ws.EnableWriteCompression(len(msg.([]byte)) >= wsOptions.compressionThreshold)
+	if err := wsWrite(sess.ws, sess.wsMessageType(), msg); err != nil {
 		if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure,
 			websocket.CloseNormalClosure) {
 			logs.Err.Println("ws: writeLoop", sess.sid, err)
@@ -88,6 +143,9 @@ func (sess *Session) writeLoop() {
 		ticker.Stop()
 		// Break readLoop.
 		sess.closeWS()
+		if sess.outbox != nil {
+			sess.outbox.loops.Done()
+		}
 	}()
 
 	for {
@@ -99,11 +157,8 @@ func (sess *Session) writeLoop() {
 			}
 			switch v := msg.(type) {
 			case []*ServerComMessage: // batch of unserialized messages
-				for _, msg := range v {
-					w := sess.serializeAndUpdateStats(msg)
-					if !sess.sendMessage(w) {
-						return
-					}
+				if !sess.sendBatch(v) {
+					return
 				}
 			case *ServerComMessage: // single unserialized message
 				w := sess.serializeAndUpdateStats(v)
@@ -125,7 +180,7 @@ func (sess *Session) writeLoop() {
 		case msg := <-sess.stop:
 			// Shutdown requested, don't care if the message is delivered
 			if msg != nil {
-				wsWrite(sess.ws, websocket.TextMessage, msg)
+				wsWrite(sess.ws, sess.wsMessageType(), msg)
 			}
 			return
 
@@ -144,6 +199,52 @@ func (sess *Session) writeLoop() {
 	}
 }
 
+// sendBatch sends a batch of messages. Clients which accept batches receive the messages in
+// as few frames as the size limit allows, others receive one message per frame.
+func (sess *Session) sendBatch(msgs []*ServerComMessage) bool {
+	if !sess.wsBatch {
+		for _, msg := range msgs {
+			if !sess.sendMessage(sess.serializeAndUpdateStats(msg)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	var frame [][]byte
+	size := 0
+	flush := func() bool {
+		if len(frame) == 0 {
+			return true
+		}
+		var data []byte
+		if len(frame) == 1 {
+			data = frame[0]
+		} else {
+			data = sess.codec().Batch(frame)
+		}
+		frame, size = nil, 0
+		return sess.sendMessage(data)
+	}
+	for _, msg := range msgs {
+		data := sess.serializeAndUpdateStats(msg).([]byte)
+		if size+len(data) > wsOptions.maxBatchSize && !flush() {
+			return false
+		}
+		frame = append(frame, data)
+		size += len(data)
+	}
+	return flush()
+}
+
+// wsMessageType returns the type of frames to send messages in: binary for binary encodings.
+func (sess *Session) wsMessageType() int {
+	if sess.codec().Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
 // Writes a message with the given message type (mt) and payload.
 func wsWrite(ws *websocket.Conn, mt int, msg any) error {
 	var bits []byte
@@ -163,6 +264,8 @@ var upgrader = websocket.Upgrader{
 	EnableCompression: globals.wsCompression,
 	// Allow connections from any Origin
 	CheckOrigin: func(r *http.Request) bool { return true },
+	// Binary encodings of messages, JSON if none is requested.
+	Subprotocols: wireSubprotocols,
 }
 
 func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
@@ -182,6 +285,20 @@ func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if globals.draining.Load() {
+		wrt.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(wrt).Encode(ErrDraining(now))
+		return
+	}
+
+	remoteAddr := getRemoteAddr(req)
+	reject, restrict := netAclCheckConnection(remoteAddr)
+	if reject {
+		wrt.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(wrt).Encode(ErrPermissionDenied("", "", now))
+		return
+	}
+
 	ws, err := upgrader.Upgrade(wrt, req, nil)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		logs.Err.Println("ws: Not a websocket handshake")
@@ -191,18 +308,44 @@ func serveWebSocket(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	sess, count := globals.sessionStore.NewSession(ws, "")
-	if globals.useXForwardedFor {
-		sess.remoteAddr = req.Header.Get("X-Forwarded-For")
-		if !isRoutableIP(sess.remoteAddr) {
-			sess.remoteAddr = ""
+	ws.SetCompressionLevel(wsOptions.compressionLevel)
+	query := req.URL.Query()
+	wire := wireCodecs[ws.Subprotocol()]
+	batch := query.Get("batch") == "1"
+
+	resumeFailed := false
+	if token := query.Get("resume"); token != "" && outboxOptions.enabled {
+		cursor, _ := strconv.ParseInt(query.Get("cursor"), 10, 64)
+		sess := outboxResume(token, cursor, func(sess *Session) {
+			sess.ws, sess.remoteAddr, sess.wire, sess.wsBatch = ws, remoteAddr, wire, batch
+		})
+		if sess != nil {
+			logs.Info.Println("ws: session resumed", sess.sid, sess.remoteAddr)
+			go sess.writeLoop()
+			go sess.readLoop()
+			return
 		}
+		resumeFailed = true
 	}
-	if sess.remoteAddr == "" {
-		sess.remoteAddr = req.RemoteAddr
+
+	sess, count := globals.sessionStore.NewSession(ws, "")
+	sess.remoteAddr = remoteAddr
+	sess.tenant = tenantByHost(req.Host)
+	sess.netRestricted = restrict
+	sess.wire = wire
+	sess.wsBatch = batch
+	if outboxOptions.enabled && (query.Get("outbox") == "1" || resumeFailed) {
+		outboxAttach(sess)
+	}
+	if sess.outbox != nil {
+		sess.outbox.loops.Add(2)
 	}
 
 	logs.Info.Println("ws: session started", sess.sid, sess.remoteAddr, count)
+	if resumeFailed {
+		// The client has to start over with {hi}.
+		sess.queueOut(ErrGone("", "", now))
+	}
 
 	// Do work in goroutines to return from serveWebSocket() to release file pointers.
 	// Otherwise "too many open files" will happen.
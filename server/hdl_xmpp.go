@@ -0,0 +1,1018 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Gateway for XMPP clients (RFC 6120, 6121). See also hdl_websock.go for
+ *    websockets and hdl_grpc.go for gRPC.
+ *
+ *    Clients authenticate with SASL PLAIN using the login and password of the
+ *    'basic' authenticator. Users are addressed by their IDs: the JID of the
+ *    user usrAbCdEf is usrAbCdEf@<domain>, the bound JID of the client is
+ *    usrAbCdEf@<domain>/<resource>.
+ *
+ *    - The roster is the list of p2p topics of the user. Presence of contacts
+ *      is translated from {pres} of 'me' topic. Roster changes and presence
+ *      subscriptions are managed by Tinode clients.
+ *    - p2p topics are chats: <message type='chat'/> to usrAbCdEf@<domain> is
+ *      published to the p2p topic with the user. The topic is attached when
+ *      the first message is sent or received.
+ *    - Group topics are MUC rooms (XEP-0045) grpAbCdEf@<muc_domain>. Nicks
+ *      are user IDs of the members: the nick requested by the client is
+ *      replaced with the user ID (status 210).
+ *    - Messages sent from other sessions of the user are delivered as
+ *      message carbons (XEP-0280) when enabled by the client.
+ *
+ *    Only plain text of messages is translated: Drafty content is converted to
+ *    text, messages without text are not delivered.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/xmpp"
+)
+
+const (
+	// Connection of an XMPP client is dropped if nothing is received for this time.
+	xmppIdleTimeout = 5 * time.Minute
+	// Number of client requests waiting to be dispatched to the session.
+	xmppQueueSize = 64
+	// Messages older than this are marked as delayed (XEP-0203).
+	xmppDelayThreshold = time.Minute
+)
+
+// Configuration of the XMPP gateway.
+type xmppConfig struct {
+	// Enable the gateway.
+	Enabled bool `json:"enabled"`
+	// Address and port to listen on for XMPP clients, default ":5222".
+	Listen string `json:"listen"`
+	// Domain of the JIDs of users.
+	Domain string `json:"domain"`
+	// Domain of the JIDs of group topics, default "conference.<domain>".
+	MucDomain string `json:"muc_domain"`
+}
+
+var xmppGateway struct {
+	domain    string
+	mucDomain string
+	tlsConf   *tls.Config
+}
+
+// Kinds of requests dispatched on behalf of XMPP clients.
+const (
+	xmppReqLogin = iota + 1
+	xmppReqRoster
+	xmppReqProbe
+	xmppReqPub
+	xmppReqJoin
+	xmppReqLeave
+)
+
+// xmppRequest is a request waiting for a response from the server.
+type xmppRequest struct {
+	kind int
+	// ID of the stanza which caused the request.
+	stanza string
+	// Addressee of the stanza: contact or room.
+	jid xmpp.JID
+	// Message is published to a room.
+	groupchat bool
+	// Room is joined, waiting for members.
+	joined bool
+	// Name of the room.
+	subject string
+}
+
+// xmppConn is a connection of an XMPP client.
+type xmppConn struct {
+	stream *xmpp.Stream
+	sess   *Session
+
+	// Requests dispatched to the session one at a time by dispatchLoop.
+	queue chan *ClientComMessage
+	done  chan struct{}
+
+	// The following fields are read by the read loop only.
+
+	// {hi} was sent.
+	hello bool
+
+	lock sync.Mutex
+	// The client is authenticated.
+	authed bool
+	// Full JID of the client, set after resource binding.
+	jid xmpp.JID
+	// The client sent the initial presence.
+	available bool
+	// Message carbons are enabled.
+	carbons bool
+	// Group topics joined as rooms.
+	rooms map[string]bool
+	// Requests waiting for responses, by message ID.
+	reqs  map[string]*xmppRequest
+	reqId int
+	// Stanza IDs of published groupchat messages by topic and seq: reflected messages must have the same ID.
+	echoIds map[string]string
+}
+
+// serveXmpp starts the listener of XMPP client connections.
+func serveXmpp(conf *xmppConfig, tlsConf *tls.Config) (net.Listener, error) {
+	if conf == nil || !conf.Enabled {
+		return nil, nil
+	}
+	if conf.Domain == "" {
+		return nil, errors.New("xmpp: missing domain")
+	}
+	xmppGateway.domain = strings.ToLower(conf.Domain)
+	xmppGateway.mucDomain = strings.ToLower(conf.MucDomain)
+	if xmppGateway.mucDomain == "" {
+		xmppGateway.mucDomain = "conference." + xmppGateway.domain
+	}
+	xmppGateway.tlsConf = tlsConf
+
+	addr := conf.Listen
+	if addr == "" {
+		addr = ":5222"
+	}
+	lis, err := netListener(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	secure := ""
+	if tlsConf != nil {
+		secure = " with STARTTLS"
+	}
+	logs.Info.Printf("XMPP gateway for '%s'%s is listening at [%s]", xmppGateway.domain, secure, addr)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logs.Err.Println("xmpp: accept", err)
+				}
+				return
+			}
+			go xmppServe(conn)
+		}
+	}()
+
+	return lis, nil
+}
+
+// xmppServe runs the session of a client connection.
+func xmppServe(conn net.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	reject, restrict := netAclCheckConnection(remoteAddr)
+	if reject || globals.draining.Load() {
+		conn.Close()
+		return
+	}
+
+	xc := &xmppConn{
+		stream:  xmpp.NewStream(conn, globals.maxMessageSize, xmppIdleTimeout),
+		queue:   make(chan *ClientComMessage, xmppQueueSize),
+		done:    make(chan struct{}),
+		rooms:   make(map[string]bool),
+		reqs:    make(map[string]*xmppRequest),
+		echoIds: make(map[string]string),
+	}
+	sess, count := globals.sessionStore.NewSession(xc, "")
+	xc.sess = sess
+	sess.remoteAddr = remoteAddr
+	sess.netRestricted = restrict
+	logs.Info.Println("xmpp: session started", sess.sid, sess.remoteAddr, count)
+
+	dispatched := make(chan struct{})
+	go func() {
+		xc.dispatchLoop()
+		close(dispatched)
+	}()
+	go sess.writeXmppLoop()
+
+	defer func() {
+		close(xc.done)
+		<-dispatched
+		xc.stream.Close()
+		sess.cleanUp(false)
+	}()
+
+	xc.readLoop()
+}
+
+// dispatchLoop dispatches requests of the client to the session in order.
+func (xc *xmppConn) dispatchLoop() {
+	for {
+		select {
+		case msg := <-xc.queue:
+			xc.sess.dispatch(msg)
+			if msg.Sub != nil {
+				// Wait for the subscription to complete: the following requests may need the topic attached.
+				xc.sess.inflightReqs.Add(1)
+				xc.sess.inflightReqs.Done()
+			}
+		case <-xc.done:
+			return
+		}
+	}
+}
+
+// enqueue adds a request to the dispatch queue.
+func (xc *xmppConn) enqueue(msg *ClientComMessage) {
+	select {
+	case xc.queue <- msg:
+	default:
+		logs.Warn.Println("xmpp: dispatch queue full", xc.sess.sid)
+	}
+}
+
+// request registers the request waiting for a response and returns the message ID to use.
+func (xc *xmppConn) request(req *xmppRequest) string {
+	xc.lock.Lock()
+	defer xc.lock.Unlock()
+
+	xc.reqId++
+	id := "x" + strconv.Itoa(xc.reqId)
+	xc.reqs[id] = req
+	return id
+}
+
+// response returns the request the message with the given ID responds to.
+func (xc *xmppConn) response(id string) *xmppRequest {
+	if id == "" {
+		return nil
+	}
+	xc.lock.Lock()
+	defer xc.lock.Unlock()
+
+	return xc.reqs[id]
+}
+
+// finish removes the request after the response was received.
+func (xc *xmppConn) finish(id string) {
+	xc.lock.Lock()
+	delete(xc.reqs, id)
+	xc.lock.Unlock()
+}
+
+// fullJID returns the bound JID of the client.
+func (xc *xmppConn) fullJID() xmpp.JID {
+	xc.lock.Lock()
+	defer xc.lock.Unlock()
+
+	return xc.jid
+}
+
+func (xc *xmppConn) isAuthed() bool {
+	xc.lock.Lock()
+	defer xc.lock.Unlock()
+
+	return xc.authed
+}
+
+func (xc *xmppConn) isJoined(topic string) bool {
+	xc.lock.Lock()
+	defer xc.lock.Unlock()
+
+	return xc.rooms[topic]
+}
+
+// send writes the stanza to the client.
+func (xc *xmppConn) send(el *xmpp.Element) bool {
+	statsInc("OutgoingMessagesXmppTotal", 1)
+	if err := xc.stream.Send(el); err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			logs.Info.Println("xmpp: write", xc.sess.sid, err)
+		}
+		return false
+	}
+	return true
+}
+
+// readLoop reads and handles stanzas until the stream is closed.
+func (xc *xmppConn) readLoop() {
+	for {
+		el, err := xc.stream.Next()
+		if err != nil {
+			var netErr net.Error
+			var syntaxErr *xml.SyntaxError
+			switch {
+			case err == io.EOF || errors.Is(err, net.ErrClosed):
+			case errors.Is(err, xmpp.ErrTooLarge):
+				xc.stream.Error("policy-violation")
+			case errors.As(err, &netErr) && netErr.Timeout():
+				xc.stream.Error("connection-timeout")
+			case errors.As(err, &syntaxErr):
+				xc.stream.Error("not-well-formed")
+			default:
+				logs.Info.Println("xmpp: read", xc.sess.sid, err)
+			}
+			return
+		}
+		statsInc("IncomingMessagesXmppTotal", 1)
+
+		switch {
+		case el.Is(xmpp.NSStream, "stream"):
+			xc.open(el)
+		case el.Is(xmpp.NSTLS, "starttls"):
+			xc.startTLS()
+		case el.Is(xmpp.NSSASL, "auth"):
+			xc.auth(el)
+		case !xc.isAuthed():
+			xc.stream.Error("not-authorized")
+		case el.Is(xmpp.NSClient, "iq"):
+			xc.iq(el)
+		case xc.fullJID().Resource == "":
+			// Messages and presence are accepted after resource binding.
+			xc.stream.Error("not-authorized")
+		case el.Is(xmpp.NSClient, "message"):
+			xc.message(el)
+		case el.Is(xmpp.NSClient, "presence"):
+			xc.presence(el)
+		default:
+			xc.stream.Error("unsupported-stanza-type")
+		}
+	}
+}
+
+// open responds to the opening of the stream with stream features.
+func (xc *xmppConn) open(header *xmpp.Element) {
+	if to := header.Attr("to"); to != "" && !strings.EqualFold(to, xmppGateway.domain) {
+		xc.stream.Open(xc.sess.sid, xmppGateway.domain)
+		xc.stream.Error("host-unknown")
+		return
+	}
+
+	var features []*xmpp.Element
+	switch {
+	case xc.isAuthed():
+		features = append(features, xmpp.NewElement(xmpp.NSBind, "bind"),
+			xmpp.NewElement(xmpp.NSSession, "session").Add(xmpp.NewElement(xmpp.NSSession, "optional")))
+	case xmppGateway.tlsConf != nil && !xc.stream.IsSecure():
+		features = append(features, xmpp.NewElement(xmpp.NSTLS, "starttls").Add(xmpp.NewElement(xmpp.NSTLS, "required")))
+	default:
+		features = append(features, xmpp.NewElement(xmpp.NSSASL, "mechanisms").
+			Add(xmpp.NewElement(xmpp.NSSASL, "mechanism").SetText("PLAIN")))
+	}
+	xc.stream.Open(xc.sess.sid, xmppGateway.domain, features...)
+}
+
+// startTLS upgrades the connection to TLS.
+func (xc *xmppConn) startTLS() {
+	if xmppGateway.tlsConf == nil || xc.stream.IsSecure() {
+		xc.send(xmpp.NewElement(xmpp.NSTLS, "failure"))
+		xc.stream.Close()
+		return
+	}
+	if !xc.send(xmpp.NewElement(xmpp.NSTLS, "proceed")) {
+		return
+	}
+	if err := xc.stream.StartTLS(xmppGateway.tlsConf); err != nil {
+		logs.Info.Println("xmpp: TLS handshake", xc.sess.sid, err)
+		xc.stream.Close()
+	}
+}
+
+// auth logs the client in with SASL PLAIN.
+func (xc *xmppConn) auth(el *xmpp.Element) {
+	failure := func(condition, text string) {
+		failure := xmpp.NewElement(xmpp.NSSASL, "failure").Add(xmpp.NewElement(xmpp.NSSASL, condition))
+		if text != "" {
+			failure.Add(xmpp.NewElement(xmpp.NSSASL, "text").SetText(text))
+		}
+		xc.send(failure)
+	}
+
+	if xc.isAuthed() {
+		xc.stream.Error("policy-violation")
+		return
+	}
+	if el.Attr("mechanism") != "PLAIN" {
+		failure("invalid-mechanism", "")
+		return
+	}
+	if xmppGateway.tlsConf != nil && !xc.stream.IsSecure() {
+		failure("encryption-required", "")
+		return
+	}
+
+	// Message is [authzid] NUL authcid NUL passwd.
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(el.Text))
+	parts := bytes.Split(data, []byte{0})
+	if err != nil || len(parts) != 3 || len(parts[1]) == 0 {
+		failure("malformed-request", "")
+		return
+	}
+	login := string(parts[1])
+	if at := strings.IndexByte(login, '@'); at > 0 {
+		// Authentication identity may be given as a bare JID.
+		login = login[:at]
+	}
+
+	if !xc.hello {
+		xc.hello = true
+		xc.enqueue(&ClientComMessage{Hi: &MsgClientHi{Version: currentVersion, UserAgent: "XMPP"}})
+	}
+	xc.enqueue(&ClientComMessage{Login: &MsgClientLogin{
+		Id:     xc.request(&xmppRequest{kind: xmppReqLogin}),
+		Scheme: "basic",
+		Secret: []byte(login + ":" + string(parts[2])),
+	}})
+}
+
+// iqResult creates a result of the iq request.
+func (xc *xmppConn) iqResult(req *xmpp.Element, children ...*xmpp.Element) *xmpp.Element {
+	return xmpp.NewElement("", "iq", "type", "result", "id", req.Attr("id"), "from", req.Attr("to"),
+		"to", xc.fullJID().String()).Add(children...)
+}
+
+// stanzaError creates an error response to the stanza.
+func (xc *xmppConn) stanzaError(req *xmpp.Element, errType, condition, text string) *xmpp.Element {
+	return xmpp.NewElement("", req.XMLName.Local, "type", "error", "id", req.Attr("id"), "from", req.Attr("to"),
+		"to", xc.fullJID().String()).Add(xmpp.StanzaError(errType, condition, text))
+}
+
+// iq handles an info/query request.
+func (xc *xmppConn) iq(el *xmpp.Element) {
+	typ := el.Attr("type")
+	if typ == "result" || typ == "error" {
+		return
+	}
+	if (typ != "get" && typ != "set") || len(el.Children) != 1 {
+		xc.send(xc.stanzaError(el, "modify", "bad-request", ""))
+		return
+	}
+
+	payload := el.Children[0]
+	to := xmpp.ParseJID(el.Attr("to"))
+	switch {
+	case payload.Is(xmpp.NSBind, "bind") && typ == "set":
+		xc.bind(el, payload.ChildText(xmpp.NSBind, "resource"))
+	case payload.Is(xmpp.NSSession, "session"):
+		xc.send(xc.iqResult(el))
+	case xc.fullJID().Resource == "":
+		xc.send(xc.stanzaError(el, "auth", "not-authorized", ""))
+	case payload.Is(xmpp.NSPing, "ping"):
+		xc.send(xc.iqResult(el))
+	case payload.Is(xmpp.NSRoster, "query") && typ == "get":
+		xc.enqueue(&ClientComMessage{Get: &MsgClientGet{
+			Id:          xc.request(&xmppRequest{kind: xmppReqRoster, stanza: el.Attr("id")}),
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "sub"},
+		}})
+	case (payload.Is(xmpp.NSCarbons, "enable") || payload.Is(xmpp.NSCarbons, "disable")) && typ == "set":
+		xc.lock.Lock()
+		xc.carbons = payload.XMLName.Local == "enable"
+		xc.lock.Unlock()
+		xc.send(xc.iqResult(el))
+	case payload.Is(xmpp.NSDiscoInfo, "query") && typ == "get":
+		if info := xmppDiscoInfo(to); info != nil {
+			xc.send(xc.iqResult(el, info))
+		} else {
+			xc.send(xc.stanzaError(el, "cancel", "item-not-found", ""))
+		}
+	case payload.Is(xmpp.NSDiscoItems, "query") && typ == "get":
+		items := xmpp.NewElement(xmpp.NSDiscoItems, "query")
+		if to.Local == "" && (to.Domain == "" || to.Domain == xmppGateway.domain) {
+			items.Add(xmpp.NewElement(xmpp.NSDiscoItems, "item", "jid", xmppGateway.mucDomain))
+		}
+		xc.send(xc.iqResult(el, items))
+	default:
+		xc.send(xc.stanzaError(el, "cancel", "service-unavailable", ""))
+	}
+}
+
+// xmppDiscoInfo describes the server, the MUC service or a room (XEP-0030).
+func xmppDiscoInfo(jid xmpp.JID) *xmpp.Element {
+	info := xmpp.NewElement(xmpp.NSDiscoInfo, "query")
+	feature := func(vars ...string) {
+		for _, v := range vars {
+			info.Add(xmpp.NewElement(xmpp.NSDiscoInfo, "feature", "var", v))
+		}
+	}
+	switch {
+	case jid.Local == "" && (jid.Domain == "" || jid.Domain == xmppGateway.domain):
+		info.Add(xmpp.NewElement(xmpp.NSDiscoInfo, "identity", "category", "server", "type", "im"))
+		feature(xmpp.NSDiscoInfo, xmpp.NSDiscoItems, xmpp.NSPing, xmpp.NSCarbons)
+	case jid.Local == "" && jid.Domain == xmppGateway.mucDomain:
+		info.Add(xmpp.NewElement(xmpp.NSDiscoInfo, "identity", "category", "conference", "type", "text",
+			"name", "Group topics"))
+		feature(xmpp.NSDiscoInfo, xmpp.NSMUC)
+	case jid.Domain == xmppGateway.mucDomain && strings.HasPrefix(jid.Local, "grp"):
+		info.Add(xmpp.NewElement(xmpp.NSDiscoInfo, "identity", "category", "conference", "type", "text"))
+		feature(xmpp.NSDiscoInfo, xmpp.NSMUC, "muc_persistent", "muc_membersonly", "muc_nonanonymous")
+	default:
+		return nil
+	}
+	return info
+}
+
+// bind binds the resource and attaches the session to 'me' topic.
+func (xc *xmppConn) bind(el *xmpp.Element, resource string) {
+	if xc.fullJID().Resource != "" {
+		xc.send(xc.stanzaError(el, "cancel", "not-allowed", ""))
+		return
+	}
+	if resource == "" {
+		resource = xc.sess.sid
+	}
+	jid := xmpp.JID{Local: xc.sess.uid.UserId(), Domain: xmppGateway.domain, Resource: resource}
+	xc.lock.Lock()
+	xc.jid = jid
+	xc.lock.Unlock()
+
+	xc.send(xc.iqResult(el, xmpp.NewElement(xmpp.NSBind, "bind").
+		Add(xmpp.NewElement(xmpp.NSBind, "jid").SetText(jid.String()))))
+	xc.enqueue(&ClientComMessage{Sub: &MsgClientSub{Topic: "me"}})
+}
+
+// presence handles presence of the client and joining and leaving rooms.
+func (xc *xmppConn) presence(el *xmpp.Element) {
+	typ := el.Attr("type")
+	to := xmpp.ParseJID(el.Attr("to"))
+	switch {
+	case to.Domain == "":
+		// Presence broadcast.
+		xc.lock.Lock()
+		initial := typ == "" && !xc.available
+		xc.available = typ == ""
+		xc.lock.Unlock()
+		if initial {
+			// Send presence of online contacts.
+			xc.enqueue(&ClientComMessage{Get: &MsgClientGet{
+				Id:          xc.request(&xmppRequest{kind: xmppReqProbe}),
+				Topic:       "me",
+				MsgGetQuery: MsgGetQuery{What: "sub"},
+			}})
+		}
+	case to.Domain == xmppGateway.mucDomain && to.Local != "":
+		room := to.Bare()
+		switch typ {
+		case "":
+			if !strings.HasPrefix(room.Local, "grp") {
+				xc.send(xc.stanzaError(el, "cancel", "item-not-found", ""))
+				return
+			}
+			xc.enqueue(&ClientComMessage{Sub: &MsgClientSub{
+				Id:    xc.request(&xmppRequest{kind: xmppReqJoin, stanza: el.Attr("id"), jid: to}),
+				Topic: room.Local,
+				Get:   &MsgGetQuery{What: "desc sub"},
+			}})
+		case "unavailable":
+			xc.enqueue(&ClientComMessage{Leave: &MsgClientLeave{
+				Id:    xc.request(&xmppRequest{kind: xmppReqLeave, jid: room}),
+				Topic: room.Local,
+			}})
+		}
+	default:
+		// Presence subscriptions are managed by Tinode clients.
+	}
+}
+
+// message publishes a chat or a groupchat message.
+func (xc *xmppConn) message(el *xmpp.Element) {
+	body := el.ChildText(xmpp.NSClient, "body")
+	if strings.TrimSpace(body) == "" {
+		// Chat states, receipts and other extensions are not translated.
+		return
+	}
+
+	typ := el.Attr("type")
+	to := xmpp.ParseJID(el.Attr("to"))
+	switch {
+	case typ == "groupchat" && to.Domain == xmppGateway.mucDomain:
+		if !xc.isJoined(to.Local) {
+			xc.send(xc.stanzaError(el, "modify", "not-acceptable", "join the room first"))
+			return
+		}
+		xc.enqueue(&ClientComMessage{Pub: &MsgClientPub{
+			Id: xc.request(&xmppRequest{kind: xmppReqPub, stanza: el.Attr("id"), jid: to.Bare(),
+				groupchat: true}),
+			Topic:   to.Local,
+			Content: body,
+		}})
+	case typ != "groupchat" && typ != "error" && to.Domain == xmppGateway.domain && to.Local != "":
+		uid := types.ParseUserId(to.Local)
+		if uid.IsZero() || uid == xc.sess.uid {
+			xc.send(xc.stanzaError(el, "cancel", "item-not-found", ""))
+			return
+		}
+		if xc.sess.getSub(xc.sess.uid.P2PName(uid)) == nil {
+			xc.enqueue(&ClientComMessage{Sub: &MsgClientSub{Topic: to.Local}})
+		}
+		xc.enqueue(&ClientComMessage{Pub: &MsgClientPub{
+			Id:      xc.request(&xmppRequest{kind: xmppReqPub, stanza: el.Attr("id"), jid: to.Bare()}),
+			Topic:   to.Local,
+			NoEcho:  true,
+			Content: body,
+		}})
+	default:
+		xc.send(xc.stanzaError(el, "cancel", "service-unavailable", ""))
+	}
+}
+
+// xmppCondition converts the response code to the type and the condition of a stanza error.
+func xmppCondition(code int) (string, string) {
+	switch code {
+	case http.StatusBadRequest:
+		return "modify", "bad-request"
+	case http.StatusUnauthorized:
+		return "auth", "not-authorized"
+	case http.StatusForbidden:
+		return "auth", "forbidden"
+	case http.StatusNotFound:
+		return "cancel", "item-not-found"
+	case http.StatusConflict:
+		return "cancel", "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "modify", "not-acceptable"
+	case http.StatusTooManyRequests:
+		return "wait", "resource-constraint"
+	case http.StatusServiceUnavailable:
+		return "wait", "service-unavailable"
+	}
+	return "cancel", "undefined-condition"
+}
+
+// xmppText converts the content of the message to plain text.
+func xmppText(content any) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case map[string]any:
+		text, _ := drafty.PlainText(content)
+		return text
+	}
+	return ""
+}
+
+// xmppName returns the full name from the public data of a user or a topic.
+func xmppName(public any) string {
+	if public, ok := public.(map[string]any); ok {
+		fn, _ := public["fn"].(string)
+		return fn
+	}
+	return ""
+}
+
+// xmppAffiliation converts the access mode of a member to the MUC affiliation and role.
+func xmppAffiliation(mode string) (string, string) {
+	acs, err := types.ParseAcs([]byte(mode))
+	if err != nil || mode == "" {
+		return "member", "participant"
+	}
+	switch {
+	case acs.IsOwner():
+		return "owner", "moderator"
+	case acs.IsAdmin():
+		return "admin", "moderator"
+	case acs.IsWriter():
+		return "member", "participant"
+	}
+	return "member", "visitor"
+}
+
+// occupant creates presence of a room member.
+func (xc *xmppConn) occupant(room xmpp.JID, user, mode string, unavailable bool, codes ...string) *xmpp.Element {
+	room.Resource = user
+	pres := xmpp.NewElement("", "presence", "from", room.String(), "to", xc.fullJID().String())
+	if unavailable {
+		pres.Attrs = append(pres.Attrs, xml.Attr{Name: xml.Name{Local: "type"}, Value: "unavailable"})
+	}
+	affiliation, role := xmppAffiliation(mode)
+	if unavailable {
+		role = "none"
+	}
+	x := xmpp.NewElement(xmpp.NSMUCUser, "x").Add(xmpp.NewElement(xmpp.NSMUCUser, "item",
+		"affiliation", affiliation, "role", role, "jid", xmpp.JID{Local: user, Domain: xmppGateway.domain}.String()))
+	for _, code := range codes {
+		x.Add(xmpp.NewElement(xmpp.NSMUCUser, "status", "code", code))
+	}
+	return pres.Add(x)
+}
+
+// joined completes joining the room: sends presence of online members, own presence and the subject.
+func (xc *xmppConn) joined(req *xmppRequest, members []MsgTopicSub) bool {
+	xc.lock.Lock()
+	xc.rooms[req.jid.Local] = true
+	xc.lock.Unlock()
+
+	me := xc.sess.uid.UserId()
+	mode := ""
+	for i := range members {
+		member := &members[i]
+		if member.User == me {
+			mode = member.Acs.Mode
+		} else if member.Online && !xc.send(xc.occupant(req.jid, member.User, member.Acs.Mode, false)) {
+			return false
+		}
+	}
+	codes := []string{"110"}
+	if req.jid.Resource != me {
+		// Nick requested by the client is replaced with the user ID.
+		codes = append(codes, "210")
+	}
+	room := req.jid.Bare()
+	self := xc.occupant(room, me, mode, false, codes...)
+	if req.stanza != "" {
+		self.Attrs = append(self.Attrs, xml.Attr{Name: xml.Name{Local: "id"}, Value: req.stanza})
+	}
+	return xc.send(self) && xc.send(xmpp.NewElement("", "message", "type", "groupchat", "from", room.String(),
+		"to", xc.fullJID().String()).Add(xmpp.NewElement("", "subject").SetText(req.subject)))
+}
+
+// left sends own unavailable presence in the room.
+func (xc *xmppConn) left(room xmpp.JID) bool {
+	xc.lock.Lock()
+	joined := xc.rooms[room.Local]
+	delete(xc.rooms, room.Local)
+	xc.lock.Unlock()
+
+	return !joined || xc.send(xc.occupant(room, xc.sess.uid.UserId(), "", true, "110"))
+}
+
+// deliver translates the message from the server to stanzas.
+func (xc *xmppConn) deliver(msg *ServerComMessage) bool {
+	switch {
+	case msg.Ctrl != nil:
+		return xc.onCtrl(msg.Ctrl)
+	case msg.Meta != nil:
+		return xc.onMeta(msg.Meta)
+	case msg.Data != nil:
+		return xc.onData(msg.Data)
+	case msg.Pres != nil:
+		return xc.onPres(msg.Pres)
+	}
+	return true
+}
+
+func (xc *xmppConn) onCtrl(ctrl *MsgServerCtrl) bool {
+	req := xc.response(ctrl.Id)
+	if req == nil {
+		return true
+	}
+
+	failed := ctrl.Code >= http.StatusMultipleChoices
+	switch req.kind {
+	case xmppReqLogin:
+		xc.finish(ctrl.Id)
+		if ctrl.Code != http.StatusOK {
+			return xc.send(xmpp.NewElement(xmpp.NSSASL, "failure").Add(
+				xmpp.NewElement(xmpp.NSSASL, "not-authorized"),
+				xmpp.NewElement(xmpp.NSSASL, "text").SetText(ctrl.Text)))
+		}
+		xc.lock.Lock()
+		xc.authed = true
+		xc.lock.Unlock()
+		return xc.send(xmpp.NewElement(xmpp.NSSASL, "success"))
+	case xmppReqRoster:
+		xc.finish(ctrl.Id)
+		iq := xmpp.NewElement("", "iq", "id", req.stanza, "to", xc.fullJID().String())
+		if failed {
+			errType, condition := xmppCondition(ctrl.Code)
+			return xc.send(iq.Add(xmpp.StanzaError(errType, condition, ctrl.Text)))
+		}
+		// No contacts.
+		iq.Attrs = append(iq.Attrs, xml.Attr{Name: xml.Name{Local: "type"}, Value: "result"})
+		return xc.send(iq.Add(xmpp.NewElement(xmpp.NSRoster, "query")))
+	case xmppReqProbe:
+		xc.finish(ctrl.Id)
+	case xmppReqPub:
+		xc.finish(ctrl.Id)
+		if failed {
+			errType, condition := xmppCondition(ctrl.Code)
+			return xc.send(xmpp.NewElement("", "message", "type", "error", "id", req.stanza, "from", req.jid.String(),
+				"to", xc.fullJID().String()).Add(xmpp.StanzaError(errType, condition, ctrl.Text)))
+		}
+		if params, ok := ctrl.Params.(map[string]any); ok && req.groupchat && req.stanza != "" {
+			if seq, ok := params["seq"].(int); ok {
+				xc.lock.Lock()
+				xc.echoIds[req.jid.Local+":"+strconv.Itoa(seq)] = req.stanza
+				xc.lock.Unlock()
+			}
+		}
+	case xmppReqJoin:
+		if failed && ctrl.Code != http.StatusNotModified {
+			xc.finish(ctrl.Id)
+			errType, condition := xmppCondition(ctrl.Code)
+			return xc.send(xmpp.NewElement("", "presence", "type", "error", "id", req.stanza, "from", req.jid.String(),
+				"to", xc.fullJID().String()).Add(xmpp.NewElement(xmpp.NSMUC, "x"),
+				xmpp.StanzaError(errType, condition, ctrl.Text)))
+		}
+		if req.joined || ctrl.Code == http.StatusNotModified {
+			// Already attached or the list of members is not coming.
+			xc.finish(ctrl.Id)
+			return xc.joined(req, nil)
+		}
+		req.joined = true
+	case xmppReqLeave:
+		xc.finish(ctrl.Id)
+		return xc.left(req.jid)
+	}
+	return true
+}
+
+func (xc *xmppConn) onMeta(meta *MsgServerMeta) bool {
+	req := xc.response(meta.Id)
+	if req == nil {
+		return true
+	}
+
+	switch req.kind {
+	case xmppReqRoster:
+		xc.finish(meta.Id)
+		query := xmpp.NewElement(xmpp.NSRoster, "query")
+		for i := range meta.Sub {
+			sub := &meta.Sub[i]
+			if strings.HasPrefix(sub.Topic, "usr") && sub.DeletedAt == nil {
+				query.Add(xmpp.NewElement(xmpp.NSRoster, "item", "jid", xmpp.JID{Local: sub.Topic,
+					Domain: xmppGateway.domain}.String(), "name", xmppName(sub.Public), "subscription", "both"))
+			}
+		}
+		return xc.send(xmpp.NewElement("", "iq", "type", "result", "id", req.stanza,
+			"to", xc.fullJID().String()).Add(query))
+	case xmppReqProbe:
+		xc.finish(meta.Id)
+		for i := range meta.Sub {
+			sub := &meta.Sub[i]
+			if sub.Online && strings.HasPrefix(sub.Topic, "usr") &&
+				!xc.send(xmpp.NewElement("", "presence", "from", xmpp.JID{Local: sub.Topic,
+					Domain: xmppGateway.domain}.String(), "to", xc.fullJID().String())) {
+				return false
+			}
+		}
+	case xmppReqJoin:
+		if meta.Desc != nil {
+			req.subject = xmppName(meta.Desc.Public)
+		}
+		if meta.Sub != nil {
+			xc.finish(meta.Id)
+			return xc.joined(req, meta.Sub)
+		}
+	}
+	return true
+}
+
+func (xc *xmppConn) onData(data *MsgServerData) bool {
+	text := xmppText(data.Content)
+	if text == "" {
+		return true
+	}
+
+	me := xc.fullJID()
+	seq := strconv.Itoa(data.SeqId)
+	message := func(typ, id string, from, to xmpp.JID) *xmpp.Element {
+		msg := xmpp.NewElement("", "message", "type", typ, "id", id, "from", from.String(), "to", to.String()).
+			Add(xmpp.NewElement("", "body").SetText(text))
+		if time.Since(data.Timestamp) > xmppDelayThreshold {
+			msg.Add(xmpp.NewElement(xmpp.NSDelay, "delay", "stamp", data.Timestamp.UTC().Format(time.RFC3339)))
+		}
+		return msg
+	}
+
+	mine := data.From == xc.sess.uid.UserId()
+	switch {
+	case strings.HasPrefix(data.Topic, "usr"):
+		peer := xmpp.JID{Local: data.Topic, Domain: xmppGateway.domain}
+		if !mine {
+			return xc.send(message("chat", seq, peer, me))
+		}
+		xc.lock.Lock()
+		carbons := xc.carbons
+		xc.lock.Unlock()
+		if !carbons {
+			return true
+		}
+		// Message sent by another session of the user.
+		sent := message("chat", seq, me.Bare(), peer)
+		sent.XMLName.Space = xmpp.NSClient
+		return xc.send(xmpp.NewElement("", "message", "type", "chat", "from", me.Bare().String(), "to", me.String()).
+			Add(xmpp.NewElement(xmpp.NSCarbons, "sent").Add(xmpp.NewElement(xmpp.NSForward, "forwarded").Add(sent))))
+	case strings.HasPrefix(data.Topic, "grp") && xc.isJoined(data.Topic):
+		id := seq
+		if mine {
+			key := data.Topic + ":" + seq
+			xc.lock.Lock()
+			if stanza, ok := xc.echoIds[key]; ok {
+				id = stanza
+				delete(xc.echoIds, key)
+			}
+			xc.lock.Unlock()
+		}
+		return xc.send(message("groupchat", id, xmpp.JID{Local: data.Topic, Domain: xmppGateway.mucDomain,
+			Resource: data.From}, me))
+	}
+	return true
+}
+
+func (xc *xmppConn) onPres(pres *MsgServerPres) bool {
+	switch {
+	case pres.Topic == "me" && strings.HasPrefix(pres.Src, "usr"):
+		switch pres.What {
+		case "on", "off":
+			xc.lock.Lock()
+			available := xc.available
+			xc.lock.Unlock()
+			if !available {
+				return true
+			}
+			p := xmpp.NewElement("", "presence", "from", xmpp.JID{Local: pres.Src, Domain: xmppGateway.domain}.String(),
+				"to", xc.fullJID().String())
+			if pres.What == "off" {
+				p.Attrs = append(p.Attrs, xml.Attr{Name: xml.Name{Local: "type"}, Value: "unavailable"})
+			}
+			return xc.send(p)
+		case "msg":
+			if uid := types.ParseUserId(pres.Src); !uid.IsZero() && xc.sess.getSub(xc.sess.uid.P2PName(uid)) == nil {
+				// Attach the topic to receive the new message and the following ones.
+				xc.enqueue(&ClientComMessage{Sub: &MsgClientSub{
+					Topic: pres.Src,
+					Get:   &MsgGetQuery{What: "data", Data: &MsgGetOpts{SinceId: pres.SeqId}},
+				}})
+			}
+		}
+	case strings.HasPrefix(pres.Topic, "grp") && xc.isJoined(pres.Topic):
+		room := xmpp.JID{Local: pres.Topic, Domain: xmppGateway.mucDomain}
+		switch pres.What {
+		case "on", "off":
+			if pres.Src != xc.sess.uid.UserId() {
+				return xc.send(xc.occupant(room, pres.Src, "", pres.What == "off"))
+			}
+		case "term":
+			return xc.left(room)
+		}
+	}
+	return true
+}
+
+func (sess *Session) writeXmppLoop() {
+	xc := sess.xmpp
+	defer func() {
+		// Closing the stream terminates the read loop.
+		xc.stream.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sess.send:
+			if !ok {
+				// channel closed
+				return
+			}
+			switch v := msg.(type) {
+			case []*ServerComMessage:
+				for _, msg := range v {
+					if !xc.deliver(msg) {
+						return
+					}
+				}
+			case *ServerComMessage:
+				if !xc.deliver(v) {
+					return
+				}
+			}
+
+		case <-sess.bkgTimer.C:
+			if sess.background {
+				sess.background = false
+				sess.onBackgroundTimer()
+			}
+
+		case msg := <-sess.stop:
+			// Shutdown requested, don't care if the message is delivered.
+			if msg, ok := msg.(*ServerComMessage); ok && msg.Ctrl != nil {
+				if msg.Ctrl.Text == "evicted" {
+					xc.stream.Error("not-authorized")
+				} else {
+					xc.stream.Error("system-shutdown")
+				}
+			}
+			return
+
+		case topic := <-sess.detach:
+			sess.delSub(topic)
+			if strings.HasPrefix(topic, "grp") && !xc.left(xmpp.JID{Local: topic, Domain: xmppGateway.mucDomain}) {
+				return
+			}
+		}
+	}
+}
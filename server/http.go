@@ -129,6 +129,16 @@ Loop:
 				globals.grpcServer.Stop()
 			}
 
+			// Stop accepting XMPP connections. Sessions are terminated by the session store.
+			if globals.xmppListener != nil {
+				globals.xmppListener.Close()
+			}
+
+			// Stop accepting MQTT connections.
+			if globals.mqttListener != nil {
+				globals.mqttListener.Close()
+			}
+
 			// Stop publishing statistics.
 			statsShutdown()
 
@@ -158,9 +168,13 @@ func signalHandler() <-chan bool {
 	signal.Notify(signchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		// Wait for a signal. Don't care which signal it is
-		sig := <-signchan
-		logs.Info.Printf("Signal received: '%s', shutting down", sig)
+		select {
+		case sig := <-signchan:
+			// Wait for a signal. Don't care which signal it is
+			logs.Info.Printf("Signal received: '%s', shutting down", sig)
+		case <-drainDone:
+			logs.Info.Println("Node drained, shutting down")
+		}
 		stop <- true
 	}()
 
@@ -10,6 +10,7 @@
 package main
 
 import (
+	"errors"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +19,7 @@ import (
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // RequestLatencyDistribution is an array of request latency distribution bounds (in milliseconds).
@@ -41,6 +43,9 @@ type topicUnreg struct {
 	forUser types.Uid
 	// Unregister then delete the topic.
 	del bool
+	// User's data is being erased: also unload group topics where the user is a member
+	// so they are reloaded without user's data.
+	erase bool
 	// Channel for reporting operation completion when deleting topics for a user.
 	done chan<- bool
 }
@@ -126,9 +131,18 @@ func newHub() *Hub {
 	statsRegisterInt("IncomingMessagesLongpollTotal")
 	statsRegisterInt("OutgoingMessagesLongpollTotal")
 
+	statsRegisterInt("IncomingMessagesSseTotal")
+	statsRegisterInt("OutgoingMessagesSseTotal")
+
 	statsRegisterInt("IncomingMessagesGrpcTotal")
 	statsRegisterInt("OutgoingMessagesGrpcTotal")
 
+	statsRegisterInt("IncomingMessagesXmppTotal")
+	statsRegisterInt("OutgoingMessagesXmppTotal")
+
+	statsRegisterInt("IncomingMessagesMqttTotal")
+	statsRegisterInt("OutgoingMessagesMqttTotal")
+
 	statsRegisterInt("FileDownloadsTotal")
 	statsRegisterInt("FileUploadsTotal")
 
@@ -148,6 +162,81 @@ func newHub() *Hub {
 	return h
 }
 
+// topicNew creates a topic which is not yet loaded and adds it to the hub. The topic is created in
+// suspended state and must be initialized with topicInit.
+func (h *Hub) topicNew(name, original string) *Topic {
+	t := &Topic{
+		name:      name,
+		xoriginal: original,
+		loadedAt:  types.TimeNow(),
+		// Indicates a proxy topic.
+		isProxy:   globals.cluster.isRemoteTopic(name),
+		sessions:  make(map[*Session]perSessionData),
+		clientMsg: make(chan *ClientComMessage, 192),
+		serverMsg: make(chan *ServerComMessage, 64),
+		reg:       make(chan *ClientComMessage, 256),
+		unreg:     make(chan *ClientComMessage, 256),
+		meta:      make(chan *ClientComMessage, 64),
+		perUser:   make(map[types.Uid]perUserData),
+		exit:      make(chan *shutDown, 1),
+	}
+	if globals.cluster != nil {
+		if t.isProxy {
+			t.proxy = make(chan *ClusterResp, 32)
+			t.masterNode = globals.cluster.ring.Get(t.name)
+		} else {
+			// It's a master topic. Make a channel for handling
+			// direct messages from the proxy.
+			t.master = make(chan *ClusterSessUpdate, 8)
+		}
+	}
+	// Topic is created in suspended state because it's not yet configured.
+	t.markPaused(true)
+	// Save topic now to prevent race condition.
+	h.topicPut(name, t)
+	return t
+}
+
+// topicLoadOriginal returns the name of the topic which is used to load it without a session.
+func topicLoadOriginal(topic string) string {
+	if types.GetTopicCat(topic) == types.TopicCatSlf {
+		return "slf"
+	}
+	return topic
+}
+
+// serverPublish routes the message generated by the server on behalf of the user to the topic.
+// Messages to topics hosted by other nodes are forwarded to the master node of the topic.
+// Attachments are URLs of uploaded files referenced by the message. Returns an error if the
+// message could not be routed.
+func serverPublish(asUser, topic string, head map[string]any, content any, attachments []string) error {
+	msg := &ClientComMessage{
+		Pub: &MsgClientPub{
+			Head:    head,
+			Content: content,
+		},
+		AsUser:    asUser,
+		RcptTo:    topic,
+		Original:  topicLoadOriginal(topic),
+		Timestamp: types.TimeNow(),
+	}
+	msg.Pub.Topic = msg.Original
+	if len(attachments) > 0 {
+		msg.Extra = &MsgClientExtra{Attachments: attachments}
+	}
+
+	if globals.cluster.isRemoteTopic(topic) {
+		return globals.cluster.routeServerPub(msg)
+	}
+
+	select {
+	case globals.hub.routeCli <- msg:
+		return nil
+	default:
+		return errors.New("hub.route channel full")
+	}
+}
+
 func (h *Hub) run() {
 	for {
 		select {
@@ -162,37 +251,11 @@ func (h *Hub) run() {
 			// 2. Check access rights and reject, if appropriate
 			// 3. Attach session to the topic
 			// Is the topic already loaded?
+			_, span := traceStart(join.ctx, "hub.join", attribute.String("tinode.topic", join.RcptTo))
 			t := h.topicGet(join.RcptTo)
 			if t == nil {
 				// Topic does not exist or not loaded.
-				t = &Topic{
-					name:      join.RcptTo,
-					xoriginal: join.Original,
-					// Indicates a proxy topic.
-					isProxy:   globals.cluster.isRemoteTopic(join.RcptTo),
-					sessions:  make(map[*Session]perSessionData),
-					clientMsg: make(chan *ClientComMessage, 192),
-					serverMsg: make(chan *ServerComMessage, 64),
-					reg:       make(chan *ClientComMessage, 256),
-					unreg:     make(chan *ClientComMessage, 256),
-					meta:      make(chan *ClientComMessage, 64),
-					perUser:   make(map[types.Uid]perUserData),
-					exit:      make(chan *shutDown, 1),
-				}
-				if globals.cluster != nil {
-					if t.isProxy {
-						t.proxy = make(chan *ClusterResp, 32)
-						t.masterNode = globals.cluster.ring.Get(t.name)
-					} else {
-						// It's a master topic. Make a channel for handling
-						// direct messages from the proxy.
-						t.master = make(chan *ClusterSessUpdate, 8)
-					}
-				}
-				// Topic is created in suspended state because it's not yet configured.
-				t.markPaused(true)
-				// Save topic now to prevent race condition.
-				h.topicPut(join.RcptTo, t)
+				t = h.topicNew(join.RcptTo, join.Original)
 
 				// Configure the topic.
 				go topicInit(t, join, h)
@@ -204,6 +267,7 @@ func (h *Hub) run() {
 						join.sess.inflightReqs.Done()
 					}
 					join.sess.queueOut(ErrLockedReply(join, join.Timestamp))
+					span.End()
 					continue
 				}
 				// Topic will check access rights and send appropriate {ctrl}
@@ -218,10 +282,12 @@ func (h *Hub) run() {
 						" - total queue len:", len(t.reg))
 				}
 			}
+			span.End()
 
 		case msg := <-h.routeCli:
 			// This is a message from a session not subscribed to topic
 			// Route incoming message to topic if topic permits such routing.
+			_, span := traceStart(msg.ctx, "hub.route", attribute.String("tinode.topic", msg.RcptTo))
 			if dst := h.topicGet(msg.RcptTo); dst != nil {
 				// Everything is OK, sending packet to known topic
 				if dst.clientMsg != nil {
@@ -233,6 +299,18 @@ func (h *Hub) run() {
 				} else {
 					logs.Warn.Println("hub: invalid topic category for broadcast", dst.name)
 				}
+			} else if msg.sess == nil && (msg.Pub != nil || msg.Del != nil) &&
+				!globals.cluster.isRemoteTopic(msg.RcptTo) {
+				// Message generated by the server, e.g. a scheduled message or a deletion of expired messages,
+				// to a topic which is not loaded. Load the topic to handle the message.
+				t := h.topicNew(msg.RcptTo, msg.Original)
+				t.clientMsg <- msg
+				go topicInit(t, &ClientComMessage{
+					RcptTo:    msg.RcptTo,
+					Original:  msg.Original,
+					AsUser:    msg.AsUser,
+					Timestamp: msg.Timestamp,
+				}, h)
 			} else if msg.Note == nil {
 				// Topic is unknown or offline.
 				// Note is silently ignored, all other messages are reported as accepted to prevent
@@ -244,6 +322,8 @@ func (h *Hub) run() {
 
 				msg.sess.queueOut(NoErrAcceptedExplicitTs(msg.Id, msg.RcptTo, types.TimeNow(), msg.Timestamp))
 			}
+			span.End()
+
 		case msg := <-h.routeSrv:
 			// This is a server message from a connection not subscribed to topic
 			// Route incoming message to topic if topic permits such routing.
@@ -289,7 +369,7 @@ func (h *Hub) run() {
 				}
 			} else {
 				// User is being deleted.
-				go h.stopTopicsForUser(unreg.forUser, reason, unreg.done)
+				go h.stopTopicsForUser(unreg.forUser, reason, unreg.erase, unreg.done)
 			}
 
 		case <-h.rehash:
@@ -402,7 +482,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 		// Case 1 (unregister and delete)
 		if t := h.topicGet(topic); t != nil {
 			// Case 1.1: topic is online
-			if (!asUid.IsZero() && t.owner == asUid) || (t.cat == types.TopicCatP2P && t.subsCount() < 2) {
+			if t.isOwner(asUid) || (t.cat == types.TopicCatP2P && t.subsCount() < 2) {
 				// Case 1.1.1: requester is the owner or last sub in a p2p topic
 				t.markPaused(true)
 				hard := true
@@ -439,6 +519,12 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 		} else {
 			// Case 1.2: topic is offline.
 
+			// Session could be nil if the request is made by the admin API.
+			var skipSid string
+			if sess != nil {
+				skipSid = sess.sid
+			}
+
 			// Is user a channel subscriber? Use chnABC instead of grpABC and get only this user's subscription.
 			var opts *types.QueryOpt
 			if types.IsChannel(msg.Original) {
@@ -491,6 +577,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 					}
 					// Inform plugin that the topic was deleted.
 					pluginTopic(&Topic{name: topic}, plgActDel)
+					webhookTopic(topic, webhookTopicDeleted, types.ZeroUid)
 				} else if err := store.Subs.Delete(topic, asUid); err != nil {
 					// Not P2P or more than 1 subscription left.
 					// Delete user's own subscription only
@@ -504,7 +591,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 				}
 
 				// Notify user's other sessions that the subscription is gone
-				presSingleUserOfflineOffline(asUid, msg.Original, "gone", nilPresParams, sess.sid)
+				presSingleUserOfflineOffline(asUid, msg.Original, "gone", nilPresParams, skipSid)
 				if tcat == types.TopicCatP2P && len(subs) == 2 {
 					uname1 := asUid.UserId()
 					uid2 := types.ParseUserId(msg.Original)
@@ -527,7 +614,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 				}
 
 				// Notify subscribers that the group topic is gone.
-				presSubsOfflineOffline(topic, tcat, subs, "gone", &presParams{}, sess.sid)
+				presSubsOfflineOffline(topic, tcat, subs, "gone", &presParams{}, skipSid)
 
 				// Notify channel subscribers that the channel is deleted.
 				// The push will not be delivered to anybody if the topic is not a channel.
@@ -535,6 +622,7 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 
 				// Inform plugin that the topic was deleted.
 				pluginTopic(&Topic{name: topic}, plgActDel)
+				webhookTopic(topic, webhookTopicDeleted, types.ZeroUid)
 			}
 
 			sess.queueOut(NoErrReply(msg, now))
@@ -564,7 +652,8 @@ func (h *Hub) topicUnreg(sess *Session, topic string, msg *ClientComMessage, rea
 // * all p2p topics with the given user
 // * group topics where the given user is the owner.
 // * user's 'me', 'fnd', 'slf' topics.
-func (h *Hub) stopTopicsForUser(uid types.Uid, reason int, alldone chan<- bool) {
+// * if erase is true, group topics where the given user is a member.
+func (h *Hub) stopTopicsForUser(uid types.Uid, reason int, erase bool, alldone chan<- bool) {
 	var done chan bool
 	if alldone != nil {
 		done = make(chan bool, 128)
@@ -573,8 +662,8 @@ func (h *Hub) stopTopicsForUser(uid types.Uid, reason int, alldone chan<- bool)
 	count := 0
 	h.topics.Range(func(name any, t any) bool {
 		topic := t.(*Topic)
-		if _, isMember := topic.perUser[uid]; (topic.cat != types.TopicCatGrp && isMember) ||
-			topic.owner == uid {
+		_, isMember := topic.perUser[uid]
+		if (topic.cat != types.TopicCatGrp && isMember) || topic.owner == uid {
 			topic.markDeleted()
 			h.topics.Delete(name)
 
@@ -586,6 +675,11 @@ func (h *Hub) stopTopicsForUser(uid types.Uid, reason int, alldone chan<- bool)
 				presSingleUserOfflineOffline(topic.p2pOtherUser(uid), uid.UserId(), "gone", nilPresParams, "")
 			}
 			count++
+		} else if erase && isMember {
+			// The topic is not deleted, just unloaded. It will be reloaded on the next request.
+			h.topics.Delete(name)
+			topic.exit <- &shutDown{reason: StopNone, done: done}
+			count++
 		}
 		return true
 	})
@@ -619,12 +713,23 @@ func replyOfflineTopicGetDesc(sess *Session, msg *ClientComMessage) {
 			sess.queueOut(ErrTopicNotFoundReply(msg, now))
 			return
 		}
+		// Group topics are not visible to users of other tenants.
+		if topic != "sys" {
+			if tenant, err := userTenant(asUid); err != nil {
+				sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+				return
+			} else if tenant != stopic.Tenant {
+				sess.queueOut(ErrTopicNotFoundReply(msg, now))
+				return
+			}
+		}
 
 		desc.CreatedAt = &stopic.CreatedAt
 		desc.UpdatedAt = &stopic.UpdatedAt
 		desc.Public = stopic.Public
 		desc.Trusted = stopic.Trusted
 		desc.IsChan = stopic.UseBt
+		desc.IsBroadcast = stopic.UseBt && stopic.Broadcast
 		desc.SubCnt = stopic.SubCnt
 		if stopic.Owner == msg.AsUser {
 			desc.DefaultAcs = &MsgDefaultAcsMode{
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestStopTopicsForUserErase(t *testing.T) {
+	uid, other := types.Uid(1), types.Uid(2)
+	topics := map[string]*Topic{
+		// Deleted with the user.
+		"usr1": {cat: types.TopicCatMe, perUser: map[types.Uid]perUserData{uid: {}}},
+		"p2p1": {cat: types.TopicCatP2P, perUser: map[types.Uid]perUserData{uid: {}}},
+		"grp1": {cat: types.TopicCatGrp, owner: uid, perUser: map[types.Uid]perUserData{uid: {}, other: {}}},
+		// Unloaded if the user is erased.
+		"grp2": {cat: types.TopicCatGrp, owner: other, perUser: map[types.Uid]perUserData{uid: {}, other: {}}},
+		// Not affected.
+		"grp3": {cat: types.TopicCatGrp, owner: other, perUser: map[types.Uid]perUserData{other: {}}},
+	}
+
+	for _, erase := range []bool{false, true} {
+		h := &Hub{topics: &sync.Map{}}
+		for name, topic := range topics {
+			topic.status = 0
+			topic.exit = make(chan *shutDown, 1)
+			h.topics.Store(name, topic)
+		}
+
+		h.stopTopicsForUser(uid, StopDeleted, erase, nil)
+
+		for name, topic := range topics {
+			_, loaded := h.topics.Load(name)
+			deleted := name != "grp2" && name != "grp3"
+			unloaded := deleted || (erase && name == "grp2")
+			if loaded == unloaded || topic.isDeleted() != deleted {
+				t.Errorf("erase=%t, %s: loaded=%t, deleted=%t", erase, name, loaded, topic.isDeleted())
+			}
+			if unloaded {
+				if sd := <-topic.exit; (sd.reason == StopDeleted) != deleted {
+					t.Errorf("erase=%t, %s: unexpected reason %d", erase, name, sd.reason)
+				}
+			}
+		}
+	}
+}
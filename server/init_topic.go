@@ -42,15 +42,18 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 		err = initTopicP2P(t, join)
 	case strings.HasPrefix(t.xoriginal, "new"):
 		// Processing request to create a new group topic.
-		err = initTopicNewGrp(t, join, false)
+		err = initTopicNewGrp(t, join, false, false)
 	case strings.HasPrefix(t.xoriginal, "nch"):
 		// Processing request to create a new channel.
-		err = initTopicNewGrp(t, join, true)
+		err = initTopicNewGrp(t, join, true, false)
+	case strings.HasPrefix(t.xoriginal, "ncm"):
+		// Processing request to create a new community.
+		err = initTopicNewGrp(t, join, false, true)
 	case strings.HasPrefix(t.xoriginal, "grp") || strings.HasPrefix(t.xoriginal, "chn"):
 		// Load existing group topic (or channel).
 		err = initTopicGrp(t)
-	case t.xoriginal == "sys":
-		// Initialize system topic.
+	case t.xoriginal == "sys" || t.xoriginal == rptTopic:
+		// Initialize system topic or moderators' topic.
 		err = initTopicSys(t)
 	case t.xoriginal == "slf":
 		// Initialize self (notes and saved messages) topic.
@@ -118,6 +121,7 @@ func topicInit(t *Topic, join *ClientComMessage, h *Hub) {
 
 	statsInc("LiveTopics", 1)
 	statsInc("TotalTopics", 1)
+	metricsTopicActivated(t.name)
 	usersRegisterTopic(t, true)
 
 	// Topic will check access rights, send invite to p2p user, send {ctrl} message to the initiator session
@@ -155,6 +159,7 @@ func initTopicMe(t *Topic, sreg *ClientComMessage) error {
 
 	// Assign tags
 	t.tags = user.Tags
+	t.tenant = user.Tenant
 
 	if err = t.loadSubscribers(); err != nil {
 		return err
@@ -162,6 +167,7 @@ func initTopicMe(t *Topic, sreg *ClientComMessage) error {
 
 	t.public = user.Public
 	t.trusted = user.Trusted
+	t.userStatus = user.Status
 
 	t.created = user.CreatedAt
 	t.updated = user.UpdatedAt
@@ -207,6 +213,9 @@ func initTopicFnd(t *Topic, sreg *ClientComMessage) error {
 	t.accessAuth = getDefaultAccess(t.cat, true, false)
 	t.accessAnon = getDefaultAccess(t.cat, false, false)
 
+	// Search is limited to the tenant of the user.
+	t.tenant = user.Tenant
+
 	if err = t.loadSubscribers(); err != nil {
 		return err
 	}
@@ -265,6 +274,9 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 		t.aux = stopic.Aux
 		t.lastID = stopic.SeqId
 		t.delID = stopic.DelId
+		t.msgTTL = stopic.MsgTTL
+		t.pinned = stopic.Pinned
+		t.tenant = stopic.Tenant
 	}
 
 	// t.owner is blank for p2p topics
@@ -294,8 +306,15 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 				delID:     subs[i].DelId,
 				recvID:    subs[i].RecvSeqId,
 				readID:    subs[i].ReadSeqId,
+
+				archived:      subs[i].ArchivedAt != nil,
+				autoUnarchive: subs[i].AutoUnarchive,
 			}
 		}
+	} else if pktsub == nil {
+		// The topic is loaded without a subscription request, e.g. to publish a scheduled message:
+		// missing subscriptions cannot be created.
+		return types.ErrTopicNotFound
 	} else {
 		// Cases 1 (new topic), 2 (one of the two subscriptions is missing: either it's a new request
 		// or the subscription was deleted)
@@ -325,6 +344,19 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 			u1, u2 = 1, 0
 		}
 
+		// Users of different tenants cannot see one another.
+		if users[0].Tenant != users[1].Tenant {
+			return types.ErrUserNotFound
+		}
+		t.tenant = users[u1].Tenant
+
+		// Users who blocked one another cannot start a conversation.
+		if blocks, err := store.Blocks.GetBetween([]types.Uid{userID1, userID2}); err != nil {
+			return err
+		} else if len(blocks) > 0 {
+			return types.ErrPermissionDenied
+		}
+
 		// Figure out which subscriptions are missing: User1's, User2's or both.
 		var sub1, sub2 *types.Subscription
 		// Set to true if only requester's subscription has to be created.
@@ -499,12 +531,13 @@ func initTopicP2P(t *Topic, sreg *ClientComMessage) error {
 }
 
 // Create a new group topic
-func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
+func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan, isCommunity bool) error {
 	timestamp := types.TimeNow()
 	pktsub := sreg.Sub
 
 	t.cat = types.TopicCatGrp
 	t.isChan = isChan
+	t.community = isCommunity
 
 	// Generic topics have parameters stored in the topic object
 	t.owner = types.ParseUserId(sreg.AsUser)
@@ -537,6 +570,25 @@ func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
 				userData.private = pktsub.Set.Desc.Private
 			}
 
+			if pktsub.Set.Desc.Broadcast != nil && *pktsub.Set.Desc.Broadcast {
+				if !isChan {
+					// Only channels can be created in broadcast mode.
+					return types.ErrMalformed
+				}
+				t.broadcast = true
+			}
+
+			if pktsub.Set.Desc.Parent != "" {
+				// Only group topics belong to communities.
+				if isChan || isCommunity {
+					return types.ErrMalformed
+				}
+				if err := checkCommunityParent(pktsub.Set.Desc.Parent, t.owner); err != nil {
+					return err
+				}
+				t.parent = pktsub.Set.Desc.Parent
+			}
+
 			// set default access
 			if pktsub.Set.Desc.DefaultAcs != nil {
 				if authMode, anonMode, err := parseTopicAccess(pktsub.Set.Desc.DefaultAcs,
@@ -584,6 +636,13 @@ func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
 
 	t.perUser[t.owner] = userData
 
+	// The topic belongs to the tenant of the owner.
+	tenant, err := userTenant(t.owner)
+	if err != nil {
+		return err
+	}
+	t.tenant = tenant
+
 	t.created = timestamp
 	t.updated = timestamp
 	t.touched = timestamp
@@ -595,13 +654,17 @@ func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
 		Access:    types.DefaultAccess{Auth: t.accessAuth, Anon: t.accessAnon},
 		Tags:      t.tags,
 		UseBt:     isChan,
+		Broadcast: t.broadcast,
+		Community: t.community,
+		Parent:    t.parent,
+		Tenant:    t.tenant,
 		Public:    t.public,
 		Trusted:   t.trusted,
 	}
 
 	// store.Topics.Create will add a subscription record for the topic creator
 	stopic.GiveAccess(t.owner, userData.modeWant, userData.modeGiven)
-	err := store.Topics.Create(stopic, t.owner, t.perUser[t.owner].private)
+	err = store.Topics.Create(stopic, t.owner, t.perUser[t.owner].private)
 	if err != nil {
 		return err
 	}
@@ -614,7 +677,7 @@ func initTopicNewGrp(t *Topic, sreg *ClientComMessage, isChan bool) error {
 		}
 	}
 
-	t.xoriginal = t.name // keeping 'new' or 'nch' as original has no value to the client
+	t.xoriginal = t.name // keeping 'new', 'nch' or 'ncm' as original has no value to the client
 	t.subCnt = 1         // One subscription, the owner.
 
 	pktsub.Created = true
@@ -641,8 +704,15 @@ func initTopicGrp(t *Topic) error {
 	}
 
 	t.isChan = stopic.UseBt
-
-	// t.owner is set by loadSubscriptions
+	t.broadcast = stopic.UseBt && stopic.Broadcast
+	t.community = stopic.Community
+	t.parent = stopic.Parent
+	t.tenant = stopic.Tenant
+
+	// The topic may have several owners, the primary one is recorded in the topic.
+	if owner := types.ParseUid(stopic.Owner); !owner.IsZero() {
+		t.owner = owner
+	}
 
 	t.accessAuth = stopic.Access.Auth
 	t.accessAnon = stopic.Access.Anon
@@ -661,6 +731,10 @@ func initTopicGrp(t *Topic) error {
 	}
 	t.lastID = stopic.SeqId
 	t.delID = stopic.DelId
+	t.msgTTL = stopic.MsgTTL
+	t.slowMode = stopic.SlowMode
+	t.frozen = stopic.Frozen
+	t.pinned = stopic.Pinned
 	t.subCnt = stopic.SubCnt
 
 	// Initialize channel for receiving session online updates.
@@ -688,9 +762,15 @@ func initTopicSys(t *Topic) error {
 
 	// There is no t.owner
 
-	// Default permissions are 'W'
-	t.accessAuth = types.ModeWrite
-	t.accessAnon = types.ModeWrite
+	if t.name == rptTopic {
+		// Messages are posted to 'rpt' by the server only.
+		t.accessAuth = types.ModeNone
+		t.accessAnon = types.ModeNone
+	} else {
+		// Default permissions are 'W'
+		t.accessAuth = types.ModeWrite
+		t.accessAnon = types.ModeWrite
+	}
 
 	t.public = stopic.Public
 	t.trusted = stopic.Trusted
@@ -736,6 +816,8 @@ func initTopicSlf(t *Topic, sreg *ClientComMessage) error {
 		t.aux = stopic.Aux
 		t.lastID = stopic.SeqId
 		t.delID = stopic.DelId
+		t.msgTTL = stopic.MsgTTL
+		t.pinned = stopic.Pinned
 
 	} else {
 		// Get topic owner.
@@ -834,6 +916,11 @@ func (t *Topic) loadSubscribers() error {
 			private:   sub.Private,
 			modeWant:  sub.ModeWant,
 			modeGiven: sub.ModeGiven,
+
+			archived:      sub.ArchivedAt != nil,
+			autoUnarchive: sub.AutoUnarchive,
+
+			role: sub.Role,
 		}
 
 		if (sub.ModeGiven & sub.ModeWant).IsOwner() {
@@ -0,0 +1,177 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Invite links to group topics. Managers who can invite users create
+ *    links which let anyone who has the link join the topic, even if the
+ *    topic cannot be found by 'fnd' and its default access has no J:
+ *
+ *    - {set topic="grpX" invite={expires, maxuses, approval}} creates a link,
+ *      the token is returned in {ctrl params={token}}.
+ *      {set topic="grpX" invite={token, revoke: true}} revokes the link.
+ *    - {get topic="grpX" what="invites"} lists links to the topic.
+ *    - {sub topic="grpX" token="..."} joins the topic by the link. With
+ *      approval=true the user is given only the J permission and waits for
+ *      managers to approve the request with {set sub={user, mode}}. Pending
+ *      requests are listed with {get what="sub" sub={pending: true}}.
+ *
+ *    Links stop working when they expire or have been used the maximum
+ *    number of times. Users banned from the topic cannot rejoin by a link.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum number of active invite links to a topic.
+const maxTopicInvites = 32
+
+// inviteAccess uses the invite link to the topic and returns the access mode given to the user who joins by it.
+func (t *Topic) inviteAccess(token string) (types.AccessMode, error) {
+	inv, err := store.Invites.Use(t.name, token)
+	if err != nil {
+		return types.ModeNone, err
+	}
+	if inv == nil {
+		// The link is unknown, expired or used up.
+		return types.ModeNone, types.ErrPermissionDenied
+	}
+	if inv.Approval {
+		// The request is approved by topic managers.
+		return types.ModeJoin, nil
+	}
+	// Same as an invite by a manager.
+	return t.accessFor(auth.LevelAuth) | types.ModeJoin, nil
+}
+
+// inviteActive checks if the invite link can still be used.
+func inviteActive(inv *types.Invite, now time.Time) bool {
+	return (inv.ExpiresAt == nil || inv.ExpiresAt.After(now)) && (inv.MaxUses == 0 || inv.Uses < inv.MaxUses)
+}
+
+// replySetInvite creates or revokes an invite link to the topic.
+func (t *Topic) replySetInvite(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for invite links")
+	}
+
+	if asChan || !t.userCan(asUid, capInvite) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to manage invite links by non-manager")
+	}
+
+	req := msg.Set.Invite
+	if req.Revoke {
+		if req.Token == "" {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.invite: missing token")
+		}
+		deleted, err := store.Invites.Delete(t.name, req.Token)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		if !deleted {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return types.ErrNotFound
+		}
+		sess.queueOut(NoErrReply(msg, now))
+		return nil
+	}
+
+	if req.Token != "" || req.MaxUses < 0 || (req.Expires != nil && !req.Expires.After(now)) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.invite: invalid parameters of the link")
+	}
+
+	invites, err := store.Invites.GetAll(t.name)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	active := 0
+	for i := range invites {
+		if inviteActive(&invites[i], now) {
+			active++
+		}
+	}
+	if active >= maxTopicInvites {
+		sess.queueOut(ErrPolicyReply(msg, now))
+		return errors.New("set.invite: too many invite links")
+	}
+
+	inv := &types.Invite{
+		Topic:     t.name,
+		CreatedBy: asUid.String(),
+		ExpiresAt: req.Expires,
+		MaxUses:   req.MaxUses,
+		Approval:  req.Approval,
+	}
+	if err = store.Invites.Create(inv); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]string{"token": inv.Token}))
+	return nil
+}
+
+// replyGetInvites returns invite links to the topic, the most recent first.
+func (t *Topic) replyGetInvites(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for invite links")
+	}
+
+	if asChan || !t.userCan(asUid, capInvite) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to list invite links by non-manager")
+	}
+
+	invites, err := store.Invites.GetAll(t.name)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(invites) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "invites"}))
+		return nil
+	}
+
+	result := make([]MsgInvite, len(invites))
+	for i := range invites {
+		inv := &invites[i]
+		result[i] = MsgInvite{
+			Token:    inv.Token,
+			User:     types.ParseUid(inv.CreatedBy).UserId(),
+			Created:  inv.CreatedAt,
+			Expires:  inv.ExpiresAt,
+			MaxUses:  inv.MaxUses,
+			Uses:     inv.Uses,
+			Approval: inv.Approval,
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Invites:   result,
+		},
+	})
+	return nil
+}
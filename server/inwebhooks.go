@@ -0,0 +1,180 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Incoming webhooks: external services such as CI systems and monitoring
+ *    tools post messages to a topic with a plain HTTP request:
+ *
+ *      POST <api>/v0/hooks/<token>
+ *
+ *    The secret token is generated when the server operator adds the webhook
+ *    through the admin API. The message is published on behalf of the bot
+ *    user of the webhook, which must be subscribed to the topic with the 'W'
+ *    permission. The request body is converted to the message according to
+ *    the format of the webhook:
+ *
+ *    - text: plain text. The body is used as is unless it's a JSON object,
+ *      then the 'text' field of the object is used.
+ *    - drafty: a Drafty document. Plain text bodies are converted to
+ *      documents without formatting.
+ *    - json: the JSON body is posted as is with head.mime=application/json.
+ *
+ *    The webhook may have a Go template (text/template) which converts the
+ *    payload to the message: the decoded JSON body or the plain text body is
+ *    passed to the template as the dot. The output of the template is the
+ *    text of the message or, for drafty and json formats, the JSON of the
+ *    content. Function 'json' of the template encodes a value as JSON, i.e.
+ *    {"txt": {{json .title}}}.
+ *
+ *    Responses are the same as of other HTTP endpoints: {ctrl} with 202 when
+ *    the message is accepted for publishing.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum length of the template of an incoming webhook.
+const maxInWebhookTemplateLength = 4096
+
+// Path where incoming webhooks are served, reported by the admin API.
+var inWebhooksPath string
+
+// inWebhooksServe adds the endpoint of incoming webhooks to the mux.
+func inWebhooksServe(mux *http.ServeMux, path string) {
+	inWebhooksPath = path
+	mux.HandleFunc("POST "+path+"{token}", inWebhookPost)
+}
+
+// inWebhookTemplate parses the template of an incoming webhook.
+func inWebhookTemplate(text string) (*template.Template, error) {
+	return template.New("hook").Option("missingkey=zero").Funcs(template.FuncMap{
+		"json": func(val any) (string, error) {
+			data, err := json.Marshal(val)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+// inWebhookMessage converts the body of the request to the head and the content of the message.
+func inWebhookMessage(hook *types.IncomingWebhook, body []byte) (map[string]any, any, error) {
+	var payload any
+	isJSON := json.Unmarshal(body, &payload) == nil
+	if !isJSON {
+		payload = string(body)
+	}
+
+	if hook.Template != "" {
+		tpl, err := inWebhookTemplate(hook.Template)
+		if err != nil {
+			return nil, nil, err
+		}
+		var out strings.Builder
+		if err = tpl.Execute(&out, payload); err != nil {
+			return nil, nil, err
+		}
+		if int64(out.Len()) > globals.maxMessageSize {
+			return nil, nil, errors.New("message too large")
+		}
+		if hook.Format == types.InWebhookText {
+			payload = out.String()
+		} else if err = json.Unmarshal([]byte(out.String()), &payload); err != nil {
+			return nil, nil, errors.New("template output is not JSON: " + err.Error())
+		}
+	}
+
+	switch hook.Format {
+	case types.InWebhookText:
+		if obj, ok := payload.(map[string]any); ok {
+			payload = obj["text"]
+		}
+		text, _ := payload.(string)
+		if text = strings.TrimSpace(text); text == "" {
+			return nil, nil, errors.New("empty message")
+		}
+		return nil, text, nil
+	case types.InWebhookDrafty:
+		if text, ok := payload.(string); ok {
+			if text = strings.TrimSpace(text); text == "" {
+				return nil, nil, errors.New("empty message")
+			}
+			payload = map[string]any{"txt": text}
+		}
+		if _, ok := payload.(map[string]any); !ok {
+			return nil, nil, errors.New("not a Drafty document")
+		}
+		if _, err := drafty.Preview(payload, 64); err != nil {
+			return nil, nil, err
+		}
+		return map[string]any{"mime": "text/x-drafty"}, payload, nil
+	case types.InWebhookJSON:
+		if !isJSON && hook.Template == "" {
+			return nil, nil, errors.New("not JSON")
+		}
+		return map[string]any{"mime": "application/json"}, payload, nil
+	}
+	return nil, nil, errors.New("unknown format " + hook.Format)
+}
+
+// inWebhookPost publishes the message posted to the incoming webhook.
+func inWebhookPost(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		json.NewEncoder(wrt).Encode(msg)
+
+		if err != nil {
+			logs.Info.Println("incoming webhook:", msg.Ctrl.Code, msg.Ctrl.Text, "/", err)
+		}
+	}
+
+	hook, err := store.InWebhooks.Get(req.PathValue("token"))
+	if err == nil && hook == nil {
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+
+	uid := types.ParseUserId(hook.User)
+	if state, err := userGetState(uid); err != nil || state != types.StateOK {
+		if err == nil {
+			err = errors.New("bot user is not active")
+		}
+		writeHttpResponse(ErrPermissionDenied("", "", now), err)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(wrt, req.Body, globals.maxMessageSize)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeHttpResponse(ErrTooLarge("", "", now), err)
+		return
+	}
+
+	head, content, err := inWebhookMessage(hook, body)
+	if err != nil {
+		writeHttpResponse(ErrMalformed("", "", now), err)
+		return
+	}
+
+	if err = serverPublish(hook.User, hook.Topic, head, content, nil); err != nil {
+		writeHttpResponse(ErrServiceUnavailableExplicitTs("", "", now, now), err)
+		return
+	}
+	writeHttpResponse(NoErrAccepted("", "", now), nil)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func setTestMaxMessageSize(t *testing.T, size int64) {
+	prev := globals.maxMessageSize
+	globals.maxMessageSize = size
+	t.Cleanup(func() { globals.maxMessageSize = prev })
+}
+
+func TestInWebhookMessage(t *testing.T) {
+	setTestMaxMessageSize(t, 1024)
+	drafty := map[string]any{"mime": "text/x-drafty"}
+
+	testCases := []struct {
+		format, template, body string
+		head                   map[string]any
+		content                any
+	}{
+		{types.InWebhookText, "", "  Build passed\n", nil, "Build passed"},
+		{types.InWebhookText, "", `{"text": "Build passed", "status": 0}`, nil, "Build passed"},
+		{types.InWebhookText, "Build {{.build}}: {{.status}}", `{"build": 12, "status": "failed"}`,
+			nil, "Build 12: failed"},
+		{types.InWebhookText, "Alert: {{.}}", "disk full", nil, "Alert: disk full"},
+		{types.InWebhookDrafty, "", "Build passed", drafty, map[string]any{"txt": "Build passed"}},
+		{types.InWebhookDrafty, "", `{"txt": "Build passed", "fmt": [{"at": 6, "len": 6, "tp": "ST"}]}`, drafty,
+			map[string]any{"txt": "Build passed", "fmt": []any{map[string]any{"at": 6.0, "len": 6.0, "tp": "ST"}}}},
+		{types.InWebhookDrafty, `{"txt": {{json .title}}}`, `{"title": "Say \"hi\""}`, drafty,
+			map[string]any{"txt": `Say "hi"`}},
+		{types.InWebhookJSON, "", `{"status": "ok"}`, map[string]any{"mime": "application/json"},
+			map[string]any{"status": "ok"}},
+	}
+	for _, tc := range testCases {
+		hook := &types.IncomingWebhook{Format: tc.format, Template: tc.template}
+		head, content, err := inWebhookMessage(hook, []byte(tc.body))
+		if err != nil {
+			t.Errorf("%s '%s': unexpected error %v", tc.format, tc.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(head, tc.head) || !reflect.DeepEqual(content, tc.content) {
+			t.Errorf("%s '%s': expected %v %v, got %v %v", tc.format, tc.body, tc.head, tc.content, head, content)
+		}
+	}
+
+	invalid := []struct {
+		format, template, body string
+	}{
+		{types.InWebhookText, "", "   "},
+		{types.InWebhookText, "", `{"status": "ok"}`},
+		{types.InWebhookText, "{{.x", "text"},
+		{types.InWebhookText, "{{.}}{{.}}", strings.Repeat("x", 600)},
+		{types.InWebhookDrafty, "", "[1, 2]"},
+		{types.InWebhookDrafty, "", `{"txt": "x", "fmt": [{"at": 5, "len": 1}]}`},
+		{types.InWebhookDrafty, "not {{.}}", "json"},
+		{types.InWebhookJSON, "", "plain text"},
+		{"xml", "", "<msg/>"},
+	}
+	for _, tc := range invalid {
+		hook := &types.IncomingWebhook{Format: tc.format, Template: tc.template}
+		if _, _, err := inWebhookMessage(hook, []byte(tc.body)); err == nil {
+			t.Errorf("%s '%s' '%s': expected an error", tc.format, tc.template, tc.body)
+		}
+	}
+}
+
+func TestInWebhookPost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	hh := mock_store.NewMockInWebhooksPersistenceInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	prevHooks, prevUsers, prevHub := store.InWebhooks, store.Users, globals.hub
+	store.InWebhooks, store.Users = hh, uu
+	hub := &Hub{routeCli: make(chan *ClientComMessage, 1)}
+	globals.hub = hub
+	defer func() {
+		store.InWebhooks, store.Users, globals.hub = prevHooks, prevUsers, prevHub
+		ctrl.Finish()
+	}()
+	setTestMaxMessageSize(t, 1024)
+
+	mux := http.NewServeMux()
+	inWebhooksServe(mux, "/v0/hooks/")
+	post := func(token, body string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v0/hooks/"+token, strings.NewReader(body)))
+		var resp ServerComMessage
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Ctrl == nil || resp.Ctrl.Code != rec.Code {
+			t.Errorf("Invalid response to '%s': %d %v", token, rec.Code, err)
+		}
+		return rec.Code
+	}
+
+	bot := types.Uid(1)
+	hook := &types.IncomingWebhook{Token: "token1", Topic: "grpAAAAAAAAAAA", User: bot.UserId(),
+		Format: types.InWebhookText}
+	hh.EXPECT().Get("token1").Return(hook, nil).Times(4)
+	hh.EXPECT().Get("unknown").Return(nil, nil)
+	uu.EXPECT().Get(bot).Return(&types.User{State: types.StateOK}, nil).Times(3)
+	uu.EXPECT().Get(bot).Return(&types.User{State: types.StateSuspended}, nil)
+
+	if code := post("token1", "Build passed"); code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", code)
+	}
+	msg := <-hub.routeCli
+	if msg.AsUser != bot.UserId() || msg.RcptTo != hook.Topic || msg.Pub == nil || msg.Pub.Content != "Build passed" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+
+	if code := post("token1", "   "); code != http.StatusBadRequest {
+		t.Errorf("Empty message: expected 400, got %d", code)
+	}
+	if code := post("token1", strings.Repeat("x", 2048)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Large message: expected 413, got %d", code)
+	}
+	if code := post("token1", "Build passed"); code != http.StatusForbidden {
+		t.Errorf("Suspended bot: expected 403, got %d", code)
+	}
+	if code := post("unknown", "Build passed"); code != http.StatusNotFound {
+		t.Errorf("Unknown token: expected 404, got %d", code)
+	}
+	if len(hub.routeCli) != 0 {
+		t.Error("Unexpected message published")
+	}
+}
@@ -0,0 +1,112 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Requests to join restricted group topics. A group is restricted when
+ *    its default access gives new subscribers only the J permission: users
+ *    who subscribe become members only after managers approve the request.
+ *
+ *    - {sub topic="grpX" request="Hi, it's Alice from work"} asks to join with
+ *      an optional message to managers. Managers are notified of the request
+ *      with {pres what="acs"} as usual.
+ *    - {get topic="grpX" what="sub" sub={pending: true}} lists pending
+ *      requests with their messages to users who can invite.
+ *    - {set topic="grpX" request={user: "usrX"}} approves the request and
+ *      gives the user the access requested within JRWPS, deny=true denies
+ *      it and removes the subscription. The requester is notified with
+ *      {pres topic="me" what="acs"} or {pres topic="me" what="gone"}.
+ *
+ *    A denied user may ask again. Managers who want to stop the requests ban
+ *    the user instead.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Maximum length of the message to managers in a request to join, in bytes.
+const maxJoinRequestLength = 256
+
+// isJoinRequest checks if the subscription is a request to join waiting for approval:
+// the user asks for more than joining but was not given access to read the topic yet.
+func isJoinRequest(want, given types.AccessMode) bool {
+	return want.IsJoiner() && given.IsJoiner() && !given.IsReader() && want.BetterThan(given)
+}
+
+// filterPendingSubs leaves only requests to join waiting for approval.
+func filterPendingSubs(subs []types.Subscription) []types.Subscription {
+	filtered := subs[:0]
+	for i := range subs {
+		if subs[i].DeletedAt == nil && isJoinRequest(subs[i].ModeWant, subs[i].ModeGiven) {
+			filtered = append(filtered, subs[i])
+		}
+	}
+	return filtered
+}
+
+// replySetRequest approves or denies a request to join a group topic.
+func (t *Topic) replySetRequest(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for requests to join")
+	}
+
+	if asChan || !t.userCan(asUid, capInvite) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to manage requests to join by non-manager")
+	}
+
+	req := msg.Set.Request
+	target := types.ParseUserId(req.User)
+	if target.IsZero() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.request: invalid user")
+	}
+
+	pud, ok := t.perUser[target]
+	if !ok || pud.deleted || pud.isChan || !isJoinRequest(pud.modeWant, pud.modeGiven) {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+
+	if req.Deny {
+		if err := store.Subs.Delete(t.name, target); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+
+		// The requester is told the subscription is gone.
+		t.notifySubChange(target, asUid, false,
+			pud.modeWant, pud.modeGiven, types.ModeUnset, types.ModeUnset, sess.sid)
+		t.evictUser(target, true, "")
+		pluginSubscription(&types.Subscription{Topic: t.name, User: target.String()}, plgActDel)
+
+		sess.queueOut(NoErrReply(msg, now))
+		return nil
+	}
+
+	// Give the user what was asked for, but no management permissions.
+	oldGiven := pud.modeGiven
+	pud.modeGiven |= pud.modeWant & types.ModeCPublic
+	if err := store.Subs.Update(t.name, target,
+		map[string]any{"ModeGiven": pud.modeGiven, "Request": ""}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	t.perUser[target] = pud
+	t.computePerUserAcsUnion()
+
+	t.notifySubChange(target, asUid, false, pud.modeWant, oldGiven, pud.modeWant, pud.modeGiven, sess.sid)
+	pluginSubscription(&types.Subscription{Topic: t.name, User: target.String(), ModeGiven: pud.modeGiven},
+		plgActUpd)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
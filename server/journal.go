@@ -0,0 +1,99 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Compliance journal, see the journal package. Every message published to
+ *    a journaled topic is copied to the journal as it's published, then every
+ *    edit, unsend and deletion of messages is recorded, so the journal keeps
+ *    the messages after they are changed or deleted in the database.
+ *
+ *    The journal is kept per tenant of the topic, see tenants.go. Topics of
+ *    the default tenant are journaled when the empty tenant is listed or all
+ *    tenants are ("*").
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"github.com/tinode/chat/server/journal"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Reasons of deletion of messages recorded in the journal.
+const (
+	journalDelUser       = "user"
+	journalDelTTL        = "ttl"
+	journalDelModeration = "moderation"
+	journalDelRetention  = "retention"
+)
+
+// journalMessage records the message accepted for delivery.
+func (t *Topic) journalMessage(data *MsgServerData) {
+	if !journal.Wants(t.tenant) {
+		return
+	}
+	journal.Add(&journal.Entry{
+		Ts:      data.Timestamp,
+		Type:    journal.EntryMessage,
+		Tenant:  t.tenant,
+		Topic:   t.name,
+		User:    data.From,
+		SeqId:   data.SeqId,
+		Head:    data.Head,
+		Content: data.Content,
+	})
+}
+
+// journalEdit records the new content of the edited message.
+func (t *Topic) journalEdit(editor types.Uid, seqId int, content any, ts time.Time) {
+	if !journal.Wants(t.tenant) {
+		return
+	}
+	journal.Add(&journal.Entry{
+		Ts:      ts,
+		Type:    journal.EntryEdit,
+		Tenant:  t.tenant,
+		Topic:   t.name,
+		User:    editor.UserId(),
+		SeqId:   seqId,
+		Content: content,
+	})
+}
+
+// journalUnsend records that the sender unsent the message.
+func (t *Topic) journalUnsend(sender types.Uid, seqId int, ts time.Time) {
+	if !journal.Wants(t.tenant) {
+		return
+	}
+	journal.Add(&journal.Entry{
+		Ts:     ts,
+		Type:   journal.EntryUnsend,
+		Tenant: t.tenant,
+		Topic:  t.name,
+		User:   sender.UserId(),
+		SeqId:  seqId,
+	})
+}
+
+// journalDelete records deletion of messages. The actor is zero when messages are deleted by the server.
+func (t *Topic) journalDelete(actor types.Uid, ranges []types.Range, hard bool, reason string) {
+	if !journal.Wants(t.tenant) {
+		return
+	}
+	entry := &journal.Entry{
+		Type:   journal.EntryDelete,
+		Tenant: t.tenant,
+		Topic:  t.name,
+		Hard:   hard,
+		Reason: reason,
+	}
+	if !actor.IsZero() {
+		entry.User = actor.UserId()
+	}
+	for _, r := range ranges {
+		entry.Ranges = append(entry.Ranges, journal.Range{Low: r.Low, Hi: r.Hi})
+	}
+	journal.Add(entry)
+}
@@ -0,0 +1,114 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPTimeout = 30
+
+	// Maximum number of bytes of the response to read.
+	maxHTTPResponseSize = 1 << 12
+)
+
+// httpSink writes batches to an external archiver over HTTP:
+//
+//	PUT <url>/<node>/<first>.jsonl stores the batch. The archiver must respond with 2xx when the batch
+//	  is stored and with 409 Conflict if the batch already exists.
+//	GET <url>/<node>/HEAD returns the head of the chain {"seq": 123, "hash": "..."} or 404 Not Found if the
+//	  chain is new.
+type httpSink struct {
+	client *http.Client
+	url    string
+	token  string
+}
+
+type httpConfig struct {
+	// Base URL of the archiver.
+	URL string `json:"url"`
+	// Bearer token sent in the Authorization header.
+	Token string `json:"token,omitempty"`
+	// Timeout of one request (seconds).
+	Timeout int `json:"timeout,omitempty"`
+}
+
+func newHTTPSink(jsconfig json.RawMessage) (*httpSink, error) {
+	var config httpConfig
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return nil, errors.New("failed to parse http config: " + err.Error())
+		}
+	}
+	if u, err := url.Parse(config.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("http: invalid url")
+	}
+	return &httpSink{
+		client: &http.Client{
+			Timeout: time.Second * time.Duration(valueOrDefault(config.Timeout, defaultHTTPTimeout)),
+		},
+		url:   strings.TrimSuffix(config.URL, "/") + "/",
+		token: config.Token,
+	}, nil
+}
+
+// Head requests the head of the chain from the archiver.
+func (h *httpSink) Head(node string) (Head, error) {
+	var head Head
+	resp, err := h.do(http.MethodGet, node+"/HEAD", nil)
+	if err != nil {
+		return head, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxHTTPResponseSize)).Decode(&head)
+	case http.StatusNotFound:
+	default:
+		err = errors.New("http: unexpected status " + resp.Status)
+	}
+	return head, err
+}
+
+// Write uploads the batch to the archiver.
+func (h *httpSink) Write(batch *Batch) error {
+	resp, err := h.do(http.MethodPut, batch.Key(), batch)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxHTTPResponseSize))
+	resp.Body.Close()
+
+	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	return errors.New("http: unexpected status " + resp.Status)
+}
+
+func (h *httpSink) do(method, path string, batch *Batch) (*http.Response, error) {
+	var body io.Reader
+	if batch != nil {
+		body = bytes.NewReader(batch.Data)
+	}
+	req, err := http.NewRequest(method, h.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if batch != nil {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("X-Tinode-Journal-Last", strconv.FormatUint(batch.Last, 10))
+		req.Header.Set("X-Tinode-Journal-Hash", batch.Hash)
+	}
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	return h.client.Do(req)
+}
@@ -0,0 +1,456 @@
+// Package journal keeps a compliance journal: an append-only copy of every message, edit and deletion
+// written to WORM storage (S3 with object lock or an external archiver). Entries are written as batches of
+// JSON lines. Entries form a hash chain: every entry contains the SHA-256 hash of the previous line, so
+// a removed, changed or reordered entry breaks the chain. Every cluster node keeps its own chain, which
+// continues across restarts if the sink can report the head of the chain.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	defaultQueueSize     = 8192
+	defaultBatchSize     = 500
+	defaultFlushInterval = 10
+	defaultBackoff       = 1
+	defaultMaxBackoff    = 60
+	// Time given to the writer to write queued entries when stopping (seconds).
+	defaultDrainTimeout = 10
+
+	// Name of the chain of a standalone server.
+	defaultNode = "standalone"
+
+	// Tenant which enables the journal for all topics.
+	allTenants = "*"
+)
+
+// Types of entries.
+const (
+	// The chain is started or resumed by a server.
+	EntryStart = "start"
+	// A message was published.
+	EntryMessage = "message"
+	// The content of a message was edited.
+	EntryEdit = "edit"
+	// A message was unsent by the sender.
+	EntryUnsend = "unsend"
+	// Messages were deleted.
+	EntryDelete = "delete"
+)
+
+// Range is a range of message IDs [Low, Hi), Hi = 0 for a single message.
+type Range struct {
+	Low int `json:"low"`
+	Hi  int `json:"hi,omitempty"`
+}
+
+// Entry is a record of the journal.
+type Entry struct {
+	// Position of the entry in the chain, starting with 1.
+	Seq uint64 `json:"seq"`
+	// Hash of the previous line of the chain, empty for the first entry.
+	Prev string `json:"prev"`
+	// Time of the event.
+	Ts time.Time `json:"ts"`
+	// Type of the entry.
+	Type string `json:"type"`
+	// Tenant of the topic, empty for the default tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// Topic of the event.
+	Topic string `json:"topic,omitempty"`
+	// User who made the change: the sender, the editor or the user who deleted messages.
+	User string `json:"user,omitempty"`
+	// ID of the message.
+	SeqId int `json:"seqid,omitempty"`
+	// Header and content of the message as published or edited.
+	Head    map[string]any `json:"head,omitempty"`
+	Content any            `json:"content,omitempty"`
+	// Deleted messages.
+	Ranges []Range `json:"ranges,omitempty"`
+	// Messages were deleted for all users, not just hidden for the user.
+	Hard bool `json:"hard,omitempty"`
+	// Why messages were deleted: "user", "ttl", "moderation".
+	Reason string `json:"reason,omitempty"`
+	// Node which wrote the chain, start entries only.
+	Node string `json:"node,omitempty"`
+}
+
+// Head is the last written entry of the chain.
+type Head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// Batch is a number of consecutive entries of the chain serialized as JSON lines.
+type Batch struct {
+	// Node which wrote the chain.
+	Node string
+	// Positions of the first and the last entries.
+	First, Last uint64
+	// Hash of the last line.
+	Hash string
+	// JSON lines.
+	Data []byte
+}
+
+// Key returns the name of the batch in the storage: "<node>/<first>.jsonl".
+func (b *Batch) Key() string {
+	return BatchKey(b.Node, b.First)
+}
+
+// BatchKey returns the name of the batch of the node starting with the given entry.
+func BatchKey(node string, first uint64) string {
+	return node + "/" + fmt.Sprintf("%020d", first) + ".jsonl"
+}
+
+// Sink is WORM storage of batches.
+type Sink interface {
+	// Head returns the last written entry of the chain of the node, zero if the chain is new or the sink
+	// does not know it.
+	Head(node string) (Head, error)
+	// Write saves the batch. Writing the same batch twice must not create a second copy.
+	Write(batch *Batch) error
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Tenants to keep the journal of: IDs of tenants, "" for the default tenant. "*" keeps the journal
+	// of all topics.
+	Tenants []string `json:"tenants"`
+	// Storage to write to: "s3" or "http".
+	Sink string          `json:"sink"`
+	S3   json.RawMessage `json:"s3,omitempty"`
+	HTTP json.RawMessage `json:"http,omitempty"`
+	// Maximum number of entries waiting to be written.
+	QueueSize int `json:"queue_size,omitempty"`
+	// Maximum number of entries in one batch.
+	BatchSize int `json:"batch_size,omitempty"`
+	// Maximum time entries wait to be written (seconds).
+	FlushInterval int `json:"flush_interval,omitempty"`
+	// Delay before the first retry (seconds), doubled with every attempt.
+	Backoff int `json:"backoff,omitempty"`
+	// Maximum delay between retries (seconds).
+	MaxBackoff int `json:"max_backoff,omitempty"`
+}
+
+// journal writes entries to the sink from a single goroutine, which keeps the chain.
+type journal struct {
+	sink       Sink
+	node       string
+	all        bool
+	tenants    map[string]bool
+	batchSize  int
+	interval   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+	queue      chan *Entry
+	stop       chan struct{}
+	done       chan struct{}
+
+	// Head of the chain.
+	head Head
+}
+
+var jrnl *journal
+
+// Init initializes the journal of the given cluster node. Returns false if the journal is disabled.
+func Init(jsconfig json.RawMessage, node string) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+	if len(config.Tenants) == 0 {
+		return false, errors.New("journal: no tenants")
+	}
+
+	var sink Sink
+	var err error
+	switch config.Sink {
+	case "s3":
+		sink, err = newS3Sink(config.S3)
+	case "http":
+		sink, err = newHTTPSink(config.HTTP)
+	default:
+		return false, errors.New("journal: unknown sink '" + config.Sink + "'")
+	}
+	if err != nil {
+		return false, errors.New("journal: " + err.Error())
+	}
+
+	if node == "" {
+		node = defaultNode
+	}
+	j, err := newJournal(sink, node, &config)
+	if err != nil {
+		return false, errors.New("journal: " + err.Error())
+	}
+	jrnl = j
+	return true, nil
+}
+
+func newJournal(sink Sink, node string, config *configType) (*journal, error) {
+	head, err := sink.Head(node)
+	if err != nil {
+		return nil, errors.New("failed to read head of the chain: " + err.Error())
+	}
+
+	j := &journal{
+		sink:       sink,
+		node:       node,
+		tenants:    make(map[string]bool),
+		batchSize:  valueOrDefault(config.BatchSize, defaultBatchSize),
+		interval:   time.Second * time.Duration(valueOrDefault(config.FlushInterval, defaultFlushInterval)),
+		backoff:    time.Second * time.Duration(valueOrDefault(config.Backoff, defaultBackoff)),
+		maxBackoff: time.Second * time.Duration(valueOrDefault(config.MaxBackoff, defaultMaxBackoff)),
+		queue:      make(chan *Entry, valueOrDefault(config.QueueSize, defaultQueueSize)),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		head:       head,
+	}
+	for _, tenant := range config.Tenants {
+		if tenant == allTenants {
+			j.all = true
+		} else {
+			j.tenants[tenant] = true
+		}
+	}
+
+	// Record the start of the server in the chain.
+	j.queue <- &Entry{Type: EntryStart, Ts: time.Now().UTC().Round(time.Millisecond), Node: node}
+	go j.writer()
+	return j, nil
+}
+
+// Enabled checks if the journal is enabled.
+func Enabled() bool {
+	return jrnl != nil
+}
+
+// Wants checks if the journal of the tenant is kept. The tenant is the ID of the tenant of the topic or an
+// empty string for the default tenant.
+func Wants(tenant string) bool {
+	return jrnl != nil && (jrnl.all || jrnl.tenants[tenant])
+}
+
+// Add queues the entry for writing. The entry is logged as lost if the queue is full.
+func Add(entry *Entry) {
+	if !Wants(entry.Tenant) {
+		return
+	}
+	if entry.Ts.IsZero() {
+		entry.Ts = time.Now()
+	}
+	entry.Ts = entry.Ts.UTC().Round(time.Millisecond)
+	select {
+	case jrnl.queue <- entry:
+	default:
+		lost(entry, errors.New("queue full"))
+	}
+}
+
+// Stop writes queued entries, waiting up to a few seconds, and stops the journal.
+func Stop() {
+	if jrnl == nil {
+		return
+	}
+	close(jrnl.stop)
+	select {
+	case <-jrnl.done:
+	case <-time.After(time.Second * defaultDrainTimeout):
+		logs.Err.Println("journal: timed out writing queued entries")
+	}
+	jrnl = nil
+}
+
+// writer collects entries into batches and writes them.
+func (j *journal) writer() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	var pending []*Entry
+	stopping := false
+	for {
+		flush := false
+		select {
+		case entry := <-j.queue:
+			pending = append(pending, entry)
+			flush = len(pending) >= j.batchSize
+		case <-ticker.C:
+			flush = len(pending) > 0
+		case <-j.stop:
+			stopping = true
+		}
+
+		if stopping {
+			// Collect everything which is queued and write it.
+		drain:
+			for {
+				select {
+				case entry := <-j.queue:
+					pending = append(pending, entry)
+				default:
+					break drain
+				}
+			}
+			for len(pending) > 0 {
+				n := min(len(pending), j.batchSize)
+				if !j.write(pending[:n], true) {
+					j.abandon(pending[n:])
+					return
+				}
+				pending = pending[n:]
+			}
+			return
+		}
+
+		if flush {
+			if !j.write(pending, false) {
+				j.abandon(nil)
+				return
+			}
+			pending = nil
+		}
+	}
+}
+
+// abandon logs the pending and queued entries as lost when the sink fails during shutdown.
+func (j *journal) abandon(pending []*Entry) {
+	err := errors.New("shutting down")
+	for _, entry := range pending {
+		lost(entry, err)
+	}
+	for {
+		select {
+		case entry := <-j.queue:
+			lost(entry, err)
+		default:
+			return
+		}
+	}
+}
+
+// write chains the entries, serializes them and writes the batch retrying failures. Returns false if
+// the journal was stopped before the batch was written.
+func (j *journal) write(entries []*Entry, stopping bool) bool {
+	batch, head, err := chain(j.node, j.head, entries)
+	if err != nil {
+		for _, entry := range entries {
+			lost(entry, err)
+		}
+		return true
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := j.sink.Write(batch)
+		if err == nil {
+			j.head = head
+			return true
+		}
+		logs.Warn.Printf("journal: attempt %d to write %s failed: %v", attempt, batch.Key(), err)
+		if stopping && attempt >= 3 {
+			for _, entry := range entries {
+				lost(entry, err)
+			}
+			return false
+		}
+
+		delay := j.retryDelay(attempt)
+		select {
+		case <-time.After(delay):
+		case <-j.stop:
+			// Stop requested: make a few more attempts without waiting for the full delay.
+			stopping = true
+		}
+	}
+}
+
+// chain links the entries to the head of the chain and serializes them. Returns the batch and the new head.
+func chain(node string, head Head, entries []*Entry) (*Batch, Head, error) {
+	var buf bytes.Buffer
+	batch := &Batch{Node: node, First: head.Seq + 1}
+	for _, entry := range entries {
+		entry.Seq = head.Seq + 1
+		entry.Prev = head.Hash
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, head, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		head = Head{Seq: entry.Seq, Hash: Hash(line)}
+	}
+	batch.Last, batch.Hash, batch.Data = head.Seq, head.Hash, buf.Bytes()
+	return batch, head, nil
+}
+
+// Hash returns the hex-encoded SHA-256 hash of the line without the line break.
+func Hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks the chain of entries read from r as JSON lines, e.g. concatenated batches of one node.
+// The first entry must follow the head prev; pass the zero head to verify the chain from its start.
+// Returns the head of the verified chain.
+func Verify(r io.Reader, prev Head) (Head, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return prev, errors.New("entry after " + strconv.FormatUint(prev.Seq, 10) + " is malformed")
+		}
+		if entry.Seq != prev.Seq+1 || entry.Prev != prev.Hash {
+			return prev, errors.New("chain is broken at entry " + strconv.FormatUint(prev.Seq+1, 10))
+		}
+		prev = Head{Seq: entry.Seq, Hash: Hash(line)}
+	}
+	return prev, scanner.Err()
+}
+
+// retryDelay returns the delay before the next attempt: the backoff doubled with every attempt.
+func (j *journal) retryDelay(attempt int) time.Duration {
+	delay := j.backoff << (attempt - 1)
+	if delay <= 0 || delay > j.maxBackoff {
+		delay = j.maxBackoff
+	}
+	return delay
+}
+
+// lost logs the entry which could not be written so it can be recovered from the log.
+func lost(entry *Entry, err error) {
+	payload, _ := json.Marshal(entry)
+	logs.Err.Printf("journal: entry lost: %v; payload: %s", err, payload)
+}
+
+func valueOrDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,129 @@
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+func TestChainVerify(t *testing.T) {
+	first, head, err := chain("node1", Head{}, []*Entry{{Type: EntryStart}, {Type: EntryMessage, Topic: "grpX", SeqId: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, head, err := chain("node1", head, []*Entry{{Type: EntryDelete, Topic: "grpX", Ranges: []Range{{Low: 1}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Key() != "node1/00000000000000000001.jsonl" || second.First != 3 || head.Seq != 3 ||
+		second.Hash != head.Hash {
+		t.Errorf("unexpected batches %+v %+v", first, second)
+	}
+
+	data := append(append([]byte{}, first.Data...), second.Data...)
+	if verified, err := Verify(bytes.NewReader(data), Head{}); err != nil || verified != head {
+		t.Errorf("Verify: got %+v, %v", verified, err)
+	}
+	// The second batch alone verifies against the head of the first.
+	if _, err := Verify(bytes.NewReader(second.Data), Head{Seq: first.Last, Hash: first.Hash}); err != nil {
+		t.Errorf("Verify second batch: %v", err)
+	}
+
+	// Changed content, removed entry.
+	tampered := bytes.Replace(data, []byte(`"seqid":1`), []byte(`"seqid":2`), 1)
+	if _, err := Verify(bytes.NewReader(tampered), Head{}); err == nil {
+		t.Error("changed entry not detected")
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	removed := append(append([]byte{}, lines[0]...), lines[2]...)
+	if _, err := Verify(bytes.NewReader(removed), Head{}); err == nil {
+		t.Error("removed entry not detected")
+	}
+}
+
+// archiver is a fake external archiver.
+type archiver struct {
+	lock    sync.Mutex
+	batches map[string][]byte
+	heads   map[string]Head
+}
+
+func (a *archiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/journal/")
+	node, name, _ := strings.Cut(key, "/")
+	switch r.Method {
+	case http.MethodGet:
+		head, ok := a.heads[node]
+		if !ok || name != "HEAD" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(head)
+	case http.MethodPut:
+		if _, ok := a.batches[key]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		head, err := Verify(bytes.NewReader(data), a.heads[node])
+		if err != nil || head.Hash != r.Header.Get("X-Tinode-Journal-Hash") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		a.batches[key] = data
+		a.heads[node] = head
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestJournalHTTP(t *testing.T) {
+	arch := &archiver{batches: map[string][]byte{}, heads: map[string]Head{}}
+	srv := httptest.NewServer(arch)
+	defer srv.Close()
+
+	config := &configType{Tenants: []string{"acme"}, HTTP: json.RawMessage(`{"url":"` + srv.URL + `/journal"}`)}
+	for run := 0; run < 2; run++ {
+		sink, err := newHTTPSink(config.HTTP)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jrnl, err = newJournal(sink, "node1", config); err != nil {
+			t.Fatal(err)
+		}
+		if !Wants("acme") || Wants("") {
+			t.Error("unexpected tenants")
+		}
+		Add(&Entry{Type: EntryMessage, Tenant: "acme", Topic: "grpX", SeqId: 1, Content: "hello"})
+		Add(&Entry{Type: EntryMessage, Tenant: "", Topic: "p2pX", SeqId: 1, Content: "not journaled"})
+		Add(&Entry{Type: EntryEdit, Tenant: "acme", Topic: "grpX", SeqId: 1, Content: "hi"})
+		Stop()
+	}
+
+	// Two runs of three entries each: start, message, edit. The second run continues the chain.
+	if len(arch.batches) != 2 || arch.heads["node1"].Seq != 6 {
+		t.Fatalf("unexpected archive %v", arch.heads)
+	}
+	data := append(append([]byte{}, arch.batches[BatchKey("node1", 1)]...), arch.batches[BatchKey("node1", 4)]...)
+	if head, err := Verify(bytes.NewReader(data), Head{}); err != nil || head != arch.heads["node1"] {
+		t.Errorf("Verify: got %+v, %v", head, err)
+	}
+	if bytes.Contains(data, []byte("not journaled")) {
+		t.Error("entry of another tenant journaled")
+	}
+}
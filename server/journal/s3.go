@@ -0,0 +1,177 @@
+package journal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	// Name of the object with the head of the chain of a node.
+	s3HeadObject = "HEAD"
+	// Default object lock mode.
+	defaultLockMode = s3.ObjectLockModeCompliance
+)
+
+// s3Sink writes batches to an S3 bucket with object lock enabled. Batches are locked until the end of
+// the retention period. The head of the chain of every node is kept in the object "<node>/HEAD" which is
+// overwritten after every batch. The bucket must be created with object lock enabled.
+type s3Sink struct {
+	svc       *s3.S3
+	bucket    string
+	prefix    string
+	lockMode  string
+	retention time.Duration
+}
+
+type s3Config struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	DisableSSL      bool   `json:"disable_ssl"`
+	ForcePathStyle  bool   `json:"force_path_style"`
+	Endpoint        string `json:"endpoint"`
+	BucketName      string `json:"bucket"`
+	// Prefix of object keys, e.g. "journal/".
+	Prefix string `json:"prefix"`
+	// Object lock mode: "COMPLIANCE" (default), "GOVERNANCE" or "none" to rely on the default
+	// retention of the bucket.
+	LockMode string `json:"lock_mode"`
+	// Batches are locked for this many days.
+	RetentionDays int `json:"retention_days"`
+}
+
+func newS3Sink(jsconfig json.RawMessage) (*s3Sink, error) {
+	var config s3Config
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return nil, errors.New("failed to parse s3 config: " + err.Error())
+		}
+	}
+	if config.AccessKeyId == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("s3: missing credentials")
+	}
+	if config.Region == "" || config.BucketName == "" {
+		return nil, errors.New("s3: missing region or bucket")
+	}
+	switch config.LockMode {
+	case "":
+		config.LockMode = defaultLockMode
+	case s3.ObjectLockModeCompliance, s3.ObjectLockModeGovernance:
+	case "none":
+		config.LockMode = ""
+	default:
+		return nil, errors.New("s3: invalid lock_mode '" + config.LockMode + "'")
+	}
+	if config.LockMode != "" && config.RetentionDays <= 0 {
+		return nil, errors.New("s3: retention_days is required with object lock")
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(config.Region),
+		DisableSSL:       aws.Bool(config.DisableSSL),
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+		Endpoint:         aws.String(config.Endpoint),
+		Credentials:      credentials.NewStaticCredentials(config.AccessKeyId, config.SecretAccessKey, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Sink{
+		svc:       s3.New(sess),
+		bucket:    config.BucketName,
+		prefix:    config.Prefix,
+		lockMode:  config.LockMode,
+		retention: time.Duration(config.RetentionDays) * 24 * time.Hour,
+	}, nil
+}
+
+// Head reads the head of the chain from the HEAD object, then follows batches written after it in case
+// the server stopped before updating the HEAD object. The batches are verified on the way.
+func (s *s3Sink) Head(node string) (Head, error) {
+	var head Head
+	data, err := s.get(s.prefix + node + "/" + s3HeadObject)
+	if err != nil {
+		return head, err
+	}
+	if data != nil {
+		if err = json.Unmarshal(data, &head); err != nil {
+			return head, errors.New("s3: invalid head object: " + err.Error())
+		}
+	}
+
+	for {
+		data, err = s.get(s.prefix + BatchKey(node, head.Seq+1))
+		if err != nil || data == nil {
+			return head, err
+		}
+		if head, err = Verify(bytes.NewReader(data), head); err != nil {
+			return head, err
+		}
+	}
+}
+
+// Write puts the batch, then updates the head. An existing batch is not overwritten.
+func (s *s3Sink) Write(batch *Batch) error {
+	sum := md5.Sum(batch.Data)
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + batch.Key()),
+		Body:        bytes.NewReader(batch.Data),
+		ContentMD5:  aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+		ContentType: aws.String("application/x-ndjson"),
+	}
+	if s.lockMode != "" {
+		input.ObjectLockMode = aws.String(s.lockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(s.retention))
+	}
+	req, _ := s.svc.PutObjectRequest(input)
+	// Conditional write: the batch may have been written by an attempt which failed to get a response.
+	req.HTTPRequest.Header.Set("If-None-Match", "*")
+	if err := req.Send(); err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != http.StatusPreconditionFailed {
+			return err
+		}
+	}
+
+	head, _ := json.Marshal(&Head{Seq: batch.Last, Hash: batch.Hash})
+	if _, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + batch.Node + "/" + s3HeadObject),
+		Body:        bytes.NewReader(head),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		// Not an error: the batch is written, the head is found by following batches.
+		logs.Warn.Println("journal: failed to update head:", err)
+	}
+	return nil
+}
+
+// get reads the object. Returns nil if the object does not exist.
+func (s *s3Sink) get(key string) ([]byte, error) {
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
@@ -0,0 +1,84 @@
+// Package awskms implements store.KeyProvider by unwrapping data keys with AWS Key Management Service.
+//
+// Data keys are generated with `aws kms generate-data-key --key-spec AES_256` (use CiphertextBlob)
+// or wrapped with `aws kms encrypt`, and configured base64-encoded.
+package awskms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/tinode/chat/server/store"
+)
+
+const providerName = "aws_kms"
+
+type awsconfig struct {
+	// Optional static credentials. If missing, the default AWS credential chain is used:
+	// environment, shared config, instance role.
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	Endpoint        string `json:"endpoint"`
+	// Optional ID or ARN of the KMS key. If set, only data keys wrapped by this key are accepted.
+	KeyId string `json:"key_id"`
+}
+
+type provider struct {
+	svc  *kms.KMS
+	conf awsconfig
+}
+
+// Init initializes the key provider.
+func (p *provider) Init(jsonconf json.RawMessage) error {
+	if err := json.Unmarshal(jsonconf, &p.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if p.conf.Region == "" {
+		return errors.New("missing Region")
+	}
+
+	awsConf := &aws.Config{Region: aws.String(p.conf.Region)}
+	if p.conf.Endpoint != "" {
+		awsConf.Endpoint = aws.String(p.conf.Endpoint)
+	}
+	if p.conf.AccessKeyId != "" {
+		awsConf.Credentials = credentials.NewStaticCredentials(p.conf.AccessKeyId, p.conf.SecretAccessKey, "")
+	}
+
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return err
+	}
+	p.svc = kms.New(sess)
+	return nil
+}
+
+// UnwrapKey decrypts base64-encoded CiphertextBlob of a data key.
+func (p *provider) UnwrapKey(wrapped string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, errors.New("invalid wrapped key: " + err.Error())
+	}
+
+	input := &kms.DecryptInput{CiphertextBlob: blob}
+	if p.conf.KeyId != "" {
+		input.KeyId = aws.String(p.conf.KeyId)
+	}
+	out, err := p.svc.Decrypt(input)
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+func init() {
+	store.RegisterKeyProvider(providerName, &provider{})
+}
@@ -0,0 +1,113 @@
+// Package vault implements store.KeyProvider by unwrapping data keys with HashiCorp Vault transit
+// secrets engine.
+//
+// Data keys are generated with `vault write -f transit/datakey/wrapped/<key_name> bits=256`
+// (use the "ciphertext" value, e.g. "vault:v1:...") and configured as is.
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	providerName = "vault"
+
+	defaultMount   = "transit"
+	defaultTimeout = 10
+)
+
+type vaultconfig struct {
+	// Vault address, e.g. "https://vault.example.com:8200".
+	Address string `json:"address"`
+	// Access token. If missing, VAULT_TOKEN environment variable is used.
+	Token string `json:"token"`
+	// Mount path of the transit secrets engine, "transit" by default.
+	Mount string `json:"mount"`
+	// Name of the transit key which wraps the data keys.
+	KeyName string `json:"key_name"`
+	// Request timeout in seconds.
+	Timeout int `json:"timeout"`
+}
+
+type provider struct {
+	conf   vaultconfig
+	client *http.Client
+}
+
+// Init initializes the key provider.
+func (p *provider) Init(jsonconf json.RawMessage) error {
+	if err := json.Unmarshal(jsonconf, &p.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if p.conf.Address == "" {
+		return errors.New("missing Address")
+	}
+	if p.conf.KeyName == "" {
+		return errors.New("missing Key Name")
+	}
+	if p.conf.Token == "" {
+		p.conf.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if p.conf.Token == "" {
+		return errors.New("missing Token")
+	}
+	if p.conf.Mount == "" {
+		p.conf.Mount = defaultMount
+	}
+	if p.conf.Timeout <= 0 {
+		p.conf.Timeout = defaultTimeout
+	}
+	p.client = &http.Client{Timeout: time.Duration(p.conf.Timeout) * time.Second}
+	return nil
+}
+
+// UnwrapKey decrypts a data key wrapped by the transit key.
+func (p *provider) UnwrapKey(wrapped string) ([]byte, error) {
+	if !strings.HasPrefix(wrapped, "vault:") {
+		return nil, errors.New("invalid wrapped key")
+	}
+
+	body, _ := json.Marshal(map[string]string{"ciphertext": wrapped})
+	url := strings.TrimSuffix(p.conf.Address, "/") + "/v1/" + p.conf.Mount + "/decrypt/" + p.conf.KeyName
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.conf.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("vault responded with status " + strconv.Itoa(resp.StatusCode))
+	}
+
+	var result struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.New("invalid vault response: " + err.Error())
+	}
+	return base64.StdEncoding.DecodeString(result.Data.Plaintext)
+}
+
+func init() {
+	store.RegisterKeyProvider(providerName, &provider{})
+}
@@ -0,0 +1,118 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    User-defined labels (folders) of subscriptions, such as "work" or
+ *    "archived". Labels are stored with the subscription, so they are synced
+ *    to all user's devices with {get what="sub"} on 'me':
+ *
+ *    - {set topic="me" labels={topic, labels}} replaces labels of the user's
+ *      subscription. User's other sessions are notified with
+ *      {pres topic="me" what="upd" src="grpX"}.
+ *    - {get topic="me" what="sub" sub={label}} lists only subscriptions with
+ *      the given label.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of labels of a subscription.
+	maxLabelCount = 16
+	// Maximum length of a label in bytes.
+	maxLabelLength = 32
+)
+
+// normalizeLabels validates labels of a subscription and removes duplicates.
+func normalizeLabels(labels []string) ([]string, error) {
+	if len(labels) > maxLabelCount {
+		return nil, errors.New("too many labels")
+	}
+	var result []string
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" || len(label) > maxLabelLength {
+			return nil, errors.New("invalid label")
+		}
+		if !slices.Contains(result, label) {
+			result = append(result, label)
+		}
+	}
+	return result, nil
+}
+
+// replySetLabels replaces labels of the user's subscription.
+func (t *Topic) replySetLabels(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for labels")
+	}
+
+	req := msg.Set.Labels
+	labels, err := normalizeLabels(req.Labels)
+	if err != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.labels: " + err.Error())
+	}
+
+	// The topic could be in the form of user ID 'usrAbCd' or 'slf'.
+	topic := req.Topic
+	switch cat, ok := topicCatOf(topic); {
+	case !ok || cat == types.TopicCatFnd || cat == types.TopicCatSys:
+		topic = ""
+	case cat == types.TopicCatMe:
+		topic = asUid.P2PName(types.ParseUserId(topic))
+	case topic == "slf":
+		topic = asUid.SlfName()
+	}
+	if topic == "" {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.labels: invalid topic")
+	}
+
+	sub, err := store.Subs.Get(topic, asUid, false)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if sub == nil {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+	if slices.Equal(sub.Labels, labels) {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	update := map[string]any{"Labels": nil}
+	if len(labels) > 0 {
+		update["Labels"] = types.StringSlice(labels)
+	}
+	if err := store.Subs.Update(topic, asUid, update); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	// Notify user's other sessions.
+	t.broadcastToSessions(&ServerComMessage{
+		Pres: &MsgServerPres{
+			Topic: "me",
+			Src:   req.Topic,
+			What:  "upd",
+		},
+		SkipSid: sess.sid,
+	})
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
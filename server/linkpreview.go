@@ -0,0 +1,60 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Link previews generated by the server. Web pages linked from Drafty
+ *    messages are fetched in the background and OpenGraph metadata is
+ *    attached to delivered messages as LP entities. The persisted message
+ *    is unchanged. A message delivered before the page is fetched is
+ *    delivered without the preview.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/linkpreview"
+)
+
+// Maximum number of links in a message to generate previews for.
+const maxLinkPreviews = 3
+
+// linkPreviewTransform attaches previews of the cached linked pages to the message.
+func linkPreviewTransform(topic string, head map[string]any, content any) (map[string]any, any, error) {
+	if mime, _ := head["mime"].(string); mime != "text/x-drafty" {
+		return head, content, nil
+	}
+
+	links, err := drafty.Links(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var previews []map[string]any
+	for _, link := range links[:min(len(links), maxLinkPreviews)] {
+		preview := linkpreview.Get(link)
+		if preview == nil {
+			continue
+		}
+		data := map[string]any{"url": preview.URL}
+		if preview.Title != "" {
+			data["title"] = preview.Title
+		}
+		if preview.Description != "" {
+			data["desc"] = preview.Description
+		}
+		if preview.Image != "" {
+			data["image"] = preview.Image
+		}
+		if preview.SiteName != "" {
+			data["site"] = preview.SiteName
+		}
+		previews = append(previews, data)
+	}
+	if len(previews) == 0 {
+		return head, content, nil
+	}
+
+	content, err = drafty.Attach(content, "LP", previews)
+	return head, content, err
+}
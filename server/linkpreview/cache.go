@@ -0,0 +1,114 @@
+package linkpreview
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a preview of one page. Nil preview means the page cannot be previewed.
+type cacheEntry struct {
+	link    string
+	preview *Preview
+	expires time.Time
+}
+
+// cache is an LRU cache of previews with expiration.
+type cache struct {
+	lock       sync.Mutex
+	maxSize    int
+	ttl        time.Duration
+	failureTTL time.Duration
+	// Most recently used entries are in front.
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func newCache(maxSize int, ttl, failureTTL time.Duration) *cache {
+	return &cache{
+		maxSize:    maxSize,
+		ttl:        ttl,
+		failureTTL: failureTTL,
+		lru:        list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+// get returns the preview and true if the page is in cache.
+func (c *cache) get(link string) (*Preview, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[link]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.items, link)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.preview, true
+}
+
+// put adds or replaces the preview of the page. Nil preview is kept for a shorter time.
+func (c *cache) put(link string, preview *Preview) {
+	ttl := c.ttl
+	if preview == nil {
+		ttl = c.failureTTL
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &cacheEntry{link: link, preview: preview, expires: time.Now().Add(ttl)}
+	if elem, ok := c.items[link]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[link] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).link)
+	}
+}
+
+// domainLimiter limits the number of requests to a domain within a time window.
+type domainLimiter struct {
+	lock   sync.Mutex
+	limit  int
+	window time.Duration
+	// Start of the current window.
+	start  time.Time
+	counts map[string]int
+}
+
+func newDomainLimiter(limit int, window time.Duration) *domainLimiter {
+	return &domainLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]int),
+	}
+}
+
+// allow records a request to the domain and checks if it's within the limit.
+func (l *domainLimiter) allow(domain string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now := time.Now(); now.Sub(l.start) >= l.window {
+		// The map is small: it only holds domains requested during one window.
+		l.start = now
+		clear(l.counts)
+	}
+	if l.counts[domain] >= l.limit {
+		return false
+	}
+	l.counts[domain]++
+	return true
+}
@@ -0,0 +1,227 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// Maximum number of redirects to follow.
+	maxRedirects = 3
+	// Maximum lengths of preview fields in bytes.
+	maxTitleLength       = 256
+	maxDescriptionLength = 512
+	maxSiteNameLength    = 128
+)
+
+var (
+	errForbiddenAddress = errors.New("address not allowed")
+	errNotHTML          = errors.New("not an HTML page")
+	errTooManyRedirects = errors.New("too many redirects")
+)
+
+// Shared address space for carrier-grade NAT (RFC 6598), not covered by netip.Addr.IsPrivate.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// fetcher downloads web pages and extracts previews.
+type fetcher struct {
+	client    *http.Client
+	maxBody   int64
+	userAgent string
+	// Checks if the address can be connected to.
+	allowAddr func(netip.AddrPort) bool
+}
+
+func newFetcher(timeout time.Duration, maxBody int64, userAgent string) *fetcher {
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	f := &fetcher{
+		maxBody:   maxBody,
+		userAgent: userAgent,
+		allowAddr: isPublicAddr,
+	}
+
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// The address is checked after the name is resolved, right before connecting, so
+		// DNS tricks cannot be used to reach internal services.
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil || !f.allowAddr(addr) {
+				return errForbiddenAddress
+			}
+			return nil
+		},
+	}
+	f.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// Never go through a proxy: the proxy would connect to addresses which are not checked.
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          16,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errForbiddenAddress
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// isPublicAddr checks if the address is a public unicast address on a standard web port.
+func isPublicAddr(addr netip.AddrPort) bool {
+	if port := addr.Port(); port != 80 && port != 443 {
+		return false
+	}
+	ip := addr.Addr().Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnatPrefix.Contains(ip)
+}
+
+// fetch downloads the page and extracts the preview. Returns nil preview if the page has no metadata.
+func (f *fetcher) fetch(link string) (*Preview, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status " + resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/html" {
+		return nil, errNotHTML
+	}
+
+	return parsePreview(io.LimitReader(resp.Body, f.maxBody), resp.Request.URL), nil
+}
+
+// parsePreview extracts OpenGraph metadata from the head of the HTML document. The title and
+// description meta tags are used if OpenGraph properties are missing.
+func parsePreview(r io.Reader, base *url.URL) *Preview {
+	meta := map[string]string{}
+	var title string
+
+	tokenizer := html.NewTokenizer(r)
+	inTitle := false
+loop:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// End of document, truncated body or invalid markup.
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "body":
+				// Metadata is in the head only.
+				break loop
+			case "title":
+				inTitle = title == ""
+			case "meta":
+				var key, content string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = tokenizer.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = string(v)
+					}
+				}
+				if key != "" && meta[key] == "" {
+					meta[key] = content
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title = string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			inTitle = false
+		}
+	}
+
+	preview := &Preview{
+		URL:         base.String(),
+		Title:       firstNonEmpty(meta["og:title"], title),
+		Description: firstNonEmpty(meta["og:description"], meta["description"]),
+		SiteName:    meta["og:site_name"],
+	}
+	if canonical := resolveURL(base, meta["og:url"]); canonical != "" {
+		preview.URL = canonical
+	}
+	preview.Image = resolveURL(base, meta["og:image"])
+
+	preview.Title = truncate(preview.Title, maxTitleLength)
+	preview.Description = truncate(preview.Description, maxDescriptionLength)
+	preview.SiteName = truncate(preview.SiteName, maxSiteNameLength)
+
+	if preview.Title == "" && preview.Description == "" && preview.Image == "" {
+		return nil
+	}
+	return preview
+}
+
+// resolveURL resolves a possibly relative http(s) URL against the base.
+func resolveURL(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.String()) > maxURLLength {
+		return ""
+	}
+	return u.String()
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, val := range vals {
+		if val = strings.TrimSpace(val); val != "" {
+			return val
+		}
+	}
+	return ""
+}
+
+// truncate shortens the string to at most maxLen bytes without breaking UTF-8 sequences.
+func truncate(str string, maxLen int) string {
+	str = strings.Join(strings.Fields(strings.ToValidUTF8(str, "")), " ")
+	if len(str) <= maxLen {
+		return str
+	}
+	for maxLen > 0 && !utf8.RuneStart(str[maxLen]) {
+		maxLen--
+	}
+	return str[:maxLen]
+}
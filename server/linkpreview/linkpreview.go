@@ -0,0 +1,240 @@
+// Package linkpreview fetches web pages linked from messages and extracts OpenGraph metadata
+// for previews. Pages are fetched asynchronously by a pool of workers, the results are cached.
+// Private, loopback and link-local addresses are never fetched.
+package linkpreview
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	defaultWorkers     = 4
+	defaultQueueSize   = 256
+	defaultTimeout     = 5
+	defaultMaxBodySize = 1 << 19
+	defaultCacheSize   = 10000
+	defaultCacheTTL    = 86400
+	defaultFailureTTL  = 600
+	defaultDomainRate  = 30
+	defaultUserAgent   = "TinodeLinkPreview/1.0"
+
+	// Maximum length of a URL to fetch.
+	maxURLLength = 2048
+)
+
+// Preview is the metadata of a web page.
+type Preview struct {
+	// Canonical URL of the page or the URL as linked.
+	URL string `json:"url"`
+	// Title of the page.
+	Title string `json:"title,omitempty"`
+	// Short description of the page.
+	Description string `json:"desc,omitempty"`
+	// URL of an image representing the page.
+	Image string `json:"image,omitempty"`
+	// Name of the website.
+	SiteName string `json:"site,omitempty"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Number of workers fetching pages.
+	Workers int `json:"workers"`
+	// Maximum number of pages waiting to be fetched. Requests over the limit are dropped.
+	QueueSize int `json:"queue_size"`
+	// Timeout of fetching one page (seconds).
+	Timeout int `json:"timeout"`
+	// Maximum number of bytes of the page to read.
+	MaxBodySize int64 `json:"max_body_size"`
+	// Maximum number of cached previews.
+	CacheSize int `json:"cache_size"`
+	// How long to cache previews (seconds).
+	CacheTTL int `json:"cache_ttl"`
+	// How long to remember pages which failed to fetch (seconds).
+	FailureTTL int `json:"failure_ttl"`
+	// Maximum number of pages fetched from one domain per minute.
+	DomainRate int `json:"domain_rate"`
+	// User-Agent header sent with requests.
+	UserAgent string `json:"user_agent"`
+}
+
+var errQueueFull = errors.New("link preview queue full")
+
+// generator fetches and caches previews.
+type generator struct {
+	fetcher *fetcher
+	cache   *cache
+	limiter *domainLimiter
+	work    chan string
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	// URLs queued or being fetched.
+	lock    sync.Mutex
+	pending map[string]bool
+}
+
+var gen *generator
+
+// Init initializes link previews. Returns false if previews are disabled in the config.
+func Init(jsconfig json.RawMessage) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	gen = newGenerator(&config)
+	return true, nil
+}
+
+// Get returns the cached preview of the page at the URL. If the page is not cached, it's queued
+// for fetching and nil is returned. Nil is also returned for pages which cannot be previewed.
+func Get(link string) *Preview {
+	if gen == nil {
+		return nil
+	}
+	return gen.get(link)
+}
+
+// Stop stops the workers. Pages in the queue are not fetched.
+func Stop() {
+	if gen == nil {
+		return
+	}
+	gen.shutdown()
+	gen = nil
+}
+
+func newGenerator(config *configType) *generator {
+	workers := valueOrDefault(config.Workers, defaultWorkers)
+	g := &generator{
+		fetcher: newFetcher(time.Second*time.Duration(valueOrDefault(config.Timeout, defaultTimeout)),
+			int64(valueOrDefault(int(config.MaxBodySize), defaultMaxBodySize)),
+			config.UserAgent),
+		cache: newCache(valueOrDefault(config.CacheSize, defaultCacheSize),
+			time.Second*time.Duration(valueOrDefault(config.CacheTTL, defaultCacheTTL)),
+			time.Second*time.Duration(valueOrDefault(config.FailureTTL, defaultFailureTTL))),
+		limiter: newDomainLimiter(valueOrDefault(config.DomainRate, defaultDomainRate), time.Minute),
+		work:    make(chan string, valueOrDefault(config.QueueSize, defaultQueueSize)),
+		stop:    make(chan struct{}),
+		pending: make(map[string]bool),
+	}
+
+	g.wg.Add(workers)
+	for range workers {
+		go g.worker()
+	}
+	return g
+}
+
+func (g *generator) get(link string) *Preview {
+	link = normalizeURL(link)
+	if link == "" {
+		return nil
+	}
+
+	if preview, found := g.cache.get(link); found {
+		return preview
+	}
+
+	if err := g.enqueue(link); err != nil {
+		logs.Warn.Println("linkpreview:", err)
+	}
+	return nil
+}
+
+// enqueue adds the URL to the queue unless it's already there.
+func (g *generator) enqueue(link string) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.pending[link] {
+		return nil
+	}
+
+	select {
+	case g.work <- link:
+		g.pending[link] = true
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (g *generator) worker() {
+	defer g.wg.Done()
+	for {
+		select {
+		case link := <-g.work:
+			g.process(link)
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// process fetches one page and caches the result.
+func (g *generator) process(link string) {
+	defer func() {
+		g.lock.Lock()
+		delete(g.pending, link)
+		g.lock.Unlock()
+	}()
+
+	u, _ := url.Parse(link)
+	if !g.limiter.allow(u.Hostname()) {
+		// Leave it uncached: the page will be requested again later.
+		return
+	}
+
+	preview, err := g.fetcher.fetch(link)
+	if err != nil {
+		logs.Info.Printf("linkpreview: failed to fetch '%s': %v", link, err)
+	}
+	g.cache.put(link, preview)
+}
+
+func (g *generator) shutdown() {
+	close(g.stop)
+	g.wg.Wait()
+}
+
+// normalizeURL returns the URL without the fragment or an empty string if the URL cannot be fetched.
+func normalizeURL(link string) string {
+	if len(link) > maxURLLength {
+		return ""
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.User != nil || u.Hostname() == "" {
+		return ""
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+func valueOrDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,169 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Login methods of an account. A user may log in with several
+ *    authentication schemes, such as a password, an OpenID Connect identity and
+ *    a code sent to a validated phone number, and move from one to another
+ *    without creating a new account:
+ *      {acc auth={what="list"}} lists login methods of the account;
+ *      {acc auth={what="add" scheme="oidc" secret=...}} adds a login method;
+ *      {acc auth={what="del" scheme="basic"}} removes a login method.
+ *
+ *    The secret of the added method is verified by its authenticator. A login
+ *    or an identity which belongs to another account is rejected with 409. The
+ *    last login method cannot be removed. Logins with the 'code' scheme rely on
+ *    validated credentials, they are managed as credentials of 'me'.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Scheme of logins by a code sent to a validated credential.
+const codeLoginScheme = "code"
+
+// loginMethods returns sorted names of authentication schemes the user can log in with.
+func loginMethods(uid types.Uid) ([]string, error) {
+	var methods []string
+	for _, name := range store.Store.GetAuthNames() {
+		if slices.Contains(secondFactorSchemes, name) {
+			continue
+		}
+		if name == codeLoginScheme {
+			creds, err := store.Users.GetAllCreds(uid, "", true)
+			if err != nil {
+				return nil, err
+			}
+			if len(creds) > 0 {
+				methods = append(methods, name)
+			}
+			continue
+		}
+		// Schemes without records of users, such as tokens, are not login methods.
+		unique, _, _, _, err := store.Users.GetAuthRecord(uid, name)
+		if err != nil && err != types.ErrNotFound {
+			return nil, err
+		}
+		if unique != "" {
+			methods = append(methods, name)
+		}
+	}
+	slices.Sort(methods)
+	return methods, nil
+}
+
+// updateLoginMethods handles {acc auth}. Returns remaining login methods of the account in params.
+func updateLoginMethods(s *Session, user *types.User, req *MsgAccAuth) (map[string]any, error) {
+	uid := user.Uid()
+	var err error
+	switch req.What {
+	case "list":
+	case "add":
+		err = addLoginMethod(user, req.Scheme, req.Secret, s.remoteAddr)
+	case "del":
+		err = delLoginMethod(user, req.Scheme)
+	default:
+		err = types.ErrMalformed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.What != "list" {
+		auditLog(&types.AuditRecord{
+			Event:      types.AuditAuthChange,
+			Actor:      s.uid.UserId(),
+			Target:     uid.UserId(),
+			RemoteAddr: s.remoteAddr,
+			Details:    req.What + " " + req.Scheme,
+		})
+	}
+
+	methods, err := loginMethods(uid)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"auth": methods}, nil
+}
+
+// addLoginMethod links a new authentication scheme to the account.
+func addLoginMethod(user *types.User, scheme string, secret []byte, remoteAddr string) error {
+	uid := user.Uid()
+	hdl := store.Store.GetLogicalAuthHandler(scheme)
+	if hdl == nil || scheme == codeLoginScheme || slices.Contains(secondFactorSchemes, scheme) {
+		return types.ErrMalformed
+	}
+	tenant, err := userTenant(uid)
+	if err != nil {
+		return err
+	}
+	if !tenantAuthAllowed(tenant, scheme) {
+		return types.ErrPermissionDenied
+	}
+	if unique, _, _, _, err := store.Users.GetAuthRecord(uid, scheme); err != nil && err != types.ErrNotFound {
+		return err
+	} else if unique != "" {
+		// The secret of an existing method is changed with {acc scheme secret}.
+		return types.ErrDuplicate
+	}
+
+	// The authenticator verifies the secret. Logins and identities are unique: one which is linked to
+	// another account is rejected as a duplicate.
+	rec, err := hdl.AddRecord(&auth.Rec{Uid: uid, AuthLevel: auth.LevelAuth, Tags: user.Tags}, secret, remoteAddr)
+	if err != nil {
+		return err
+	}
+	if _, err = store.Users.UpdateTags(uid, nil, nil, rec.Tags); err != nil {
+		logs.Warn.Println("addLoginMethod: failed to update tags", err)
+	}
+	return nil
+}
+
+// delLoginMethod unlinks the authentication scheme from the account unless it's the last login method.
+func delLoginMethod(user *types.User, scheme string) error {
+	uid := user.Uid()
+	methods, err := loginMethods(uid)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(methods, scheme) {
+		return types.ErrNotFound
+	}
+	if scheme == codeLoginScheme {
+		// Credentials are deleted with {del what="cred"}.
+		return types.ErrMalformed
+	}
+	if len(methods) == 1 {
+		return types.ErrPolicy
+	}
+
+	if err = store.Store.GetLogicalAuthHandler(scheme).DelRecords(uid); err != nil {
+		return err
+	}
+	// Login tag of the scheme, such as 'basic:alice'.
+	var stale []string
+	for _, tag := range user.Tags {
+		if strings.HasPrefix(tag, scheme+":") {
+			stale = append(stale, tag)
+		}
+	}
+	if len(stale) > 0 {
+		if _, err = store.Users.UpdateTags(uid, nil, stale, nil); err != nil {
+			logs.Warn.Println("delLoginMethod: failed to update tags", err)
+		}
+	}
+	// Tokens issued after a login with the removed method must not outlive it.
+	if err = revokeUserTokens(uid, false); err != nil {
+		logs.Warn.Println("delLoginMethod: failed to revoke tokens", err)
+	}
+	return nil
+}
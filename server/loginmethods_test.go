@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth/mock_auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestDelLoginMethod(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+	oldStore, oldUsers := store.Store, store.Users
+	store.Store, store.Users = ss, uu
+	defer func() {
+		store.Store, store.Users = oldStore, oldUsers
+		ctrl.Finish()
+	}()
+
+	uid := types.Uid(1)
+	user := &types.User{Tags: []string{"basic:alice", "email:alice@example.com"}}
+	user.SetUid(uid)
+
+	ss.EXPECT().GetAuthNames().Return([]string{"basic", "code", "oidc", "token", "totp"}).AnyTimes()
+	uu.EXPECT().GetAllCreds(uid, "", true).Return(nil, nil).AnyTimes()
+	uu.EXPECT().GetAuthRecord(uid, "token").Return("", auth.LevelNone, nil, types.TimeNow(), types.ErrNotFound).AnyTimes()
+	uu.EXPECT().GetAuthRecord(uid, "basic").Return("alice", auth.LevelAuth, nil, types.TimeNow(), nil).AnyTimes()
+	oidc := uu.EXPECT().GetAuthRecord(uid, "oidc").Return("", auth.LevelNone, nil, types.TimeNow(), types.ErrNotFound).Times(2)
+
+	// The only login method cannot be removed.
+	if err := delLoginMethod(user, "basic"); err != types.ErrPolicy {
+		t.Fatal("Last login method removed:", err)
+	}
+	if err := delLoginMethod(user, "oidc"); err != types.ErrNotFound {
+		t.Fatal("Missing login method removed:", err)
+	}
+
+	uu.EXPECT().GetAuthRecord(uid, "oidc").Return("issuer:12345", auth.LevelAuth, nil, types.TimeNow(), nil).After(oidc)
+	ss.EXPECT().GetLogicalAuthHandler("basic").Return(aa)
+	aa.EXPECT().DelRecords(uid).Return(nil)
+	uu.EXPECT().UpdateTags(uid, nil, []string{"basic:alice"}, nil).Return(nil, nil)
+	ss.EXPECT().GetLogicalAuthHandler("resume").Return(nil)
+	ss.EXPECT().GetLogicalAuthHandler("refresh").Return(nil)
+	if err := delLoginMethod(user, "basic"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,10 +1,21 @@
 // Package logs exposes info, warning and error loggers.
+//
+// Records are written as text lines or, for log aggregation, as JSON objects. Records can be
+// tagged with IDs of the session, user, topic and message they relate to by using loggers
+// returned by With. The subsystem which logged the record is taken from the leading word of the
+// message, e.g. "cluster" for "cluster: node joined", and records can be filtered by level
+// separately for each subsystem.
 package logs
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"log/slog"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -16,6 +27,59 @@ var (
 	Err *log.Logger
 )
 
+// Config is the configuration of logging.
+type Config struct {
+	// Format of records: "text" (default) or "json".
+	Format string `json:"format"`
+	// Minimum level of logged records: "info" (default), "warn" or "error".
+	Level string `json:"level"`
+	// Minimum levels of records of individual subsystems, e.g. {"cluster": "warn"}.
+	Subsystems map[string]string `json:"subsystems"`
+}
+
+// Fields identify the session, user, topic and client message the record relates to.
+// Blank fields are omitted.
+type Fields struct {
+	Sid   string
+	User  string
+	Topic string
+	MsgId string
+}
+
+// Scoped are loggers which tag records with Fields.
+type Scoped struct {
+	Info *log.Logger
+	Warn *log.Logger
+	Err  *log.Logger
+}
+
+// Frames between the call to text logger's Output and the Print* call of the caller.
+const textCallDepth = 4
+
+// Alternative names of subsystems as they appear in messages.
+var subsystemAliases = map[string]string{
+	"s":          "session",
+	"sess":       "session",
+	"in":         "session",
+	"init_topic": "topic",
+}
+
+// output is the current destination of records.
+type output struct {
+	// Text loggers for the info, warning and error levels. Used if handler is nil.
+	text [3]*log.Logger
+	// JSON handler.
+	handler slog.Handler
+	// Minimum level of logged records.
+	level slog.Level
+	// Minimum levels by subsystem.
+	subsystems map[string]slog.Level
+}
+
+var current atomic.Pointer[output]
+
+var levels = [3]slog.Level{slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
 func parseFlags(logFlags string) int {
 	flags := 0
 	for _, v := range strings.Split(logFlags, ",") {
@@ -46,10 +110,167 @@ func parseFlags(logFlags string) int {
 	return flags
 }
 
+func parseLevel(level string) (slog.Level, error) {
+	switch level {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, errors.New("logs: invalid level '" + level + "'")
+}
+
 // Init initializes info, warning and error loggers given the flags and the output.
 func Init(output io.Writer, logFlags string) {
 	flags := parseFlags(logFlags)
 	Info = log.New(output, "I", flags)
 	Warn = log.New(output, "W", flags)
 	Err = log.New(output, "E", flags)
+	current.Store(nil)
+}
+
+// Configure switches the loggers initialized by Init to the format and levels from the config.
+// Must be called before the loggers are used concurrently.
+func Configure(dst io.Writer, config *Config) error {
+	if config == nil {
+		return nil
+	}
+
+	o := &output{text: [3]*log.Logger{Info, Warn, Err}}
+	switch config.Format {
+	case "", "text":
+	case "json":
+		o.handler = slog.NewJSONHandler(dst, &slog.HandlerOptions{
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				if attr.Key == slog.TimeKey && len(groups) == 0 {
+					attr.Value = slog.TimeValue(attr.Value.Time().UTC())
+				}
+				return attr
+			},
+		})
+	default:
+		return errors.New("logs: invalid format '" + config.Format + "'")
+	}
+
+	var err error
+	if o.level, err = parseLevel(config.Level); err != nil {
+		return err
+	}
+	o.subsystems = make(map[string]slog.Level, len(config.Subsystems))
+	for name, level := range config.Subsystems {
+		if o.subsystems[name], err = parseLevel(level); err != nil {
+			return err
+		}
+	}
+
+	current.Store(o)
+	if o.handler == nil && o.level == slog.LevelInfo && len(o.subsystems) == 0 {
+		// Nothing to filter or reformat: keep the text loggers.
+		return nil
+	}
+
+	Info = log.New(&recordWriter{level: 0}, "", 0)
+	Warn = log.New(&recordWriter{level: 1}, "", 0)
+	Err = log.New(&recordWriter{level: 2}, "", 0)
+	return nil
+}
+
+// With returns loggers which tag records with the fields.
+func With(fields Fields) *Scoped {
+	return &Scoped{
+		Info: log.New(&recordWriter{level: 0, fields: &fields}, "", 0),
+		Warn: log.New(&recordWriter{level: 1, fields: &fields}, "", 0),
+		Err:  log.New(&recordWriter{level: 2, fields: &fields}, "", 0),
+	}
+}
+
+// subsystem returns the name of the subsystem which logged the message: the leading lowercase word
+// of the message followed by ':', '[' or '.', e.g. "topic" for "topic[grpXXX]: ...".
+func subsystem(msg string) string {
+	end := strings.IndexFunc(msg, func(r rune) bool {
+		return (r < 'a' || r > 'z') && r != '_'
+	})
+	if end <= 0 || !strings.ContainsRune(":[.", rune(msg[end])) {
+		return ""
+	}
+	name := msg[:end]
+	if alias, ok := subsystemAliases[name]; ok {
+		return alias
+	}
+	return name
+}
+
+// recordWriter receives messages formatted by a log.Logger and writes them to the current output.
+type recordWriter struct {
+	// Index of the level in levels.
+	level int
+	// Fields to tag records with, could be nil.
+	fields *Fields
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+	sub := subsystem(msg)
+
+	o := current.Load()
+	if o == nil {
+		// Not configured yet.
+		o = &output{text: [3]*log.Logger{Info, Warn, Err}}
+	}
+	level := levels[w.level]
+	minLevel := o.level
+	if subLevel, ok := o.subsystems[sub]; ok {
+		minLevel = subLevel
+	}
+	if level < minLevel {
+		return len(p), nil
+	}
+
+	if o.handler == nil {
+		if w.fields != nil {
+			msg += w.fields.text()
+		}
+		o.text[w.level].Output(textCallDepth, msg)
+		return len(p), nil
+	}
+
+	rec := slog.NewRecord(time.Now(), level, msg, 0)
+	if sub != "" {
+		rec.AddAttrs(slog.String("subsystem", sub))
+	}
+	if w.fields != nil {
+		rec.AddAttrs(w.fields.attrs()...)
+	}
+	if err := o.handler.Handle(context.Background(), rec); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// text formats non-blank fields for appending to a text record.
+func (f *Fields) text() string {
+	var sb strings.Builder
+	for _, attr := range f.attrs() {
+		sb.WriteString(" " + attr.Key + "=" + attr.Value.String())
+	}
+	return sb.String()
+}
+
+func (f *Fields) attrs() []slog.Attr {
+	var attrs []slog.Attr
+	if f.Sid != "" {
+		attrs = append(attrs, slog.String("sid", f.Sid))
+	}
+	if f.User != "" {
+		attrs = append(attrs, slog.String("uid", f.User))
+	}
+	if f.Topic != "" {
+		attrs = append(attrs, slog.String("topic", f.Topic))
+	}
+	if f.MsgId != "" {
+		attrs = append(attrs, slog.String("id", f.MsgId))
+	}
+	return attrs
 }
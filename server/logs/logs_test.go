@@ -0,0 +1,58 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTextFields(t *testing.T) {
+	var buf bytes.Buffer
+	Init(&buf, "shortfile")
+	if err := Configure(&buf, &Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	With(Fields{Sid: "abc", User: "usrAlice", Topic: "grpX"}).Warn.Println("s.publish: must attach first")
+	line := buf.String()
+	if !strings.HasPrefix(line, "Wlogs_test.go:") ||
+		!strings.HasSuffix(line, "s.publish: must attach first sid=abc uid=usrAlice topic=grpX\n") {
+		t.Errorf("Unexpected record '%s'", line)
+	}
+}
+
+func TestJSONLevels(t *testing.T) {
+	var buf bytes.Buffer
+	Init(&buf, "stdFlags")
+	if err := Configure(&buf, &Config{Format: "json", Subsystems: map[string]string{"cluster": "warn"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer Init(&buf, "stdFlags")
+
+	Info.Println("cluster: node joined")
+	Warn.Println("cluster: node failed")
+	With(Fields{Sid: "abc", MsgId: "42"}).Info.Printf("s.dispatch: %s", "ok")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %d: %v", len(lines), lines)
+	}
+	var rec map[string]string
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["level"] != "WARN" || rec["subsystem"] != "cluster" || rec["msg"] != "cluster: node failed" {
+		t.Errorf("Unexpected record %v", rec)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["subsystem"] != "session" || rec["sid"] != "abc" || rec["id"] != "42" {
+		t.Errorf("Unexpected record %v", rec)
+	}
+
+	if err := Configure(&buf, &Config{Level: "debug"}); err == nil {
+		t.Error("Expected error for invalid level")
+	}
+}
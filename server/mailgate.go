@@ -0,0 +1,321 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Email gateway of topics. The server operator assigns email addresses
+ *    (mailboxes) to topics through the admin API. Then:
+ *
+ *    - Email received for a mailbox is posted to the topic by the user of the
+ *      mailbox. The subject and the text of the email become the text of the
+ *      message, attachments of the email are uploaded to the media store and
+ *      attached to the message. The message is marked with head.email={from,
+ *      name, subject, id} so clients can show the real sender. Replies to
+ *      messages sent by the gateway are posted as replies to the original
+ *      messages.
+ *    - If the mailbox has replies enabled, messages published to the topic as
+ *      replies to emails are sent back to the senders of the emails. The
+ *      mailbox is the sender of the replies.
+ *
+ *    Email received by a cluster node which does not host the topic is
+ *    rejected with a temporary error.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rivo/uniseg"
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/mailgate"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Message header with the origin of a message received by email.
+	msgHeadEmail = "email"
+
+	// Mailboxes of topics are reloaded after this time.
+	mailboxCacheTTL = time.Minute
+	// Expired entries are purged from the cache when there are this many of them.
+	mailboxCachePurgeSize = 4096
+)
+
+// Mailboxes which send replies by topic name, nil if the topic has no such mailbox.
+var mailboxCache struct {
+	sync.Mutex
+	entries map[string]*mailboxEntry
+}
+
+type mailboxEntry struct {
+	box      *types.Mailbox
+	loadedAt time.Time
+}
+
+// mailgateHandler posts email received by the gateway to topics.
+type mailgateHandler struct{}
+
+// Accept checks if the address is a mailbox of a topic.
+func (mailgateHandler) Accept(rcpt string) error {
+	box, err := store.Mailboxes.Get(rcpt)
+	if err != nil {
+		return err
+	}
+	if box == nil {
+		return mailgate.ErrRejected
+	}
+	return nil
+}
+
+// Deliver posts the email to the topic of the mailbox.
+func (mailgateHandler) Deliver(rcpt string, msg *mailgate.Message) error {
+	box, err := store.Mailboxes.Get(rcpt)
+	if err != nil {
+		return err
+	}
+	if box == nil {
+		return mailgate.ErrRejected
+	}
+	attachments, ents, err := mailgateUpload(types.ParseUserId(box.User), msg.Attachments)
+	if err != nil {
+		return err
+	}
+	head, content := mailgateToTinode(box.Topic, msg)
+	if content, err = drafty.Attach(content, "EX", ents); err != nil {
+		return err
+	}
+
+	return serverPublish(box.User, box.Topic, head, content, attachments)
+}
+
+// mailgateUpload saves attachments of the email to the media store. Returns URLs of the saved files and
+// data of the Drafty entities which reference them.
+func mailgateUpload(uid types.Uid, files []mailgate.Attachment) ([]string, []map[string]any, error) {
+	if len(files) == 0 {
+		return nil, nil, nil
+	}
+	mh := store.Store.GetMediaHandler()
+	if mh == nil {
+		logs.Warn.Println("mailgate: media handler not configured, attachments dropped")
+		return nil, nil, nil
+	}
+
+	var urls []string
+	var ents []map[string]any
+	for _, file := range files {
+		if globals.maxFileUploadSize > 0 && int64(len(file.Data)) > globals.maxFileUploadSize {
+			logs.Info.Println("mailgate: attachment too large", file.Name, len(file.Data))
+			continue
+		}
+		if err := checkUserQuota(uid, int64(len(file.Data))); err != nil {
+			logs.Info.Println("mailgate: attachment dropped", file.Name, err)
+			continue
+		}
+		fdef := &types.FileDef{
+			ObjHeader: types.ObjHeader{
+				Id: store.Store.GetUidString(),
+			},
+			User:     uid.String(),
+			MimeType: file.Mime,
+		}
+		fdef.InitTimes()
+		if err := scanUpload(fdef, bytes.NewReader(file.Data)); err != nil {
+			logs.Info.Println("mailgate: attachment rejected", file.Name, err)
+			continue
+		}
+		analyzeAudio(fdef, bytes.NewReader(file.Data))
+		url, size, err := mh.Upload(fdef, bytes.NewReader(file.Data))
+		if err != nil {
+			store.Files.FinishUpload(fdef, false, 0)
+			return nil, nil, err
+		}
+		done, err := store.Files.FinishUpload(fdef, true, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		if done.Status == types.UploadQuarantined {
+			logs.Info.Println("mailgate: attachment quarantined", file.Name, fdef.Id)
+			continue
+		}
+		urls = append(urls, url)
+		ents = append(ents, map[string]any{"mime": file.Mime, "name": file.Name, "ref": url, "size": size})
+	}
+	return urls, ents, nil
+}
+
+// mailgateToTinode converts the email to the head and the Drafty content of the message. The subject is
+// the first line of the text formatted as bold.
+func mailgateToTinode(topic string, msg *mailgate.Message) (map[string]any, any) {
+	text := msg.Text
+	// Long emails are truncated to fit the message.
+	if limit := int(globals.maxMessageSize) / 2; len(text) > limit {
+		text = strings.ToValidUTF8(text[:limit], "") + "…"
+	}
+
+	txt := msg.Subject
+	fmts := []any{}
+	if txt != "" {
+		fmts = append(fmts, map[string]any{"at": 0, "len": uniseg.GraphemeClusterCount(txt), "tp": "ST"})
+		if text != "" {
+			txt += "\n"
+		}
+	}
+	txt += text
+
+	origin := map[string]any{"from": msg.From}
+	if msg.Name != "" {
+		origin["name"] = msg.Name
+	}
+	if msg.Subject != "" {
+		origin["subject"] = msg.Subject
+	}
+	if msg.MessageID != "" {
+		origin["id"] = msg.MessageID
+	}
+	if msg.Auto {
+		origin["auto"] = true
+	}
+	head := map[string]any{"mime": "text/x-drafty", msgHeadEmail: origin}
+
+	// The email is a reply to a message sent by the gateway: make it a reply to the original message.
+	for _, id := range append([]string{msg.InReplyTo}, msg.References...) {
+		if replyTopic, seq := mailgate.ParseMessageID(id); replyTopic == topic {
+			head["reply"] = map[string]any{"seq": float64(seq)}
+			break
+		}
+	}
+
+	return head, map[string]any{"txt": txt, "fmt": fmts}
+}
+
+// mailboxOf returns the cached mailbox of the topic which sends replies or nil.
+func mailboxOf(topic string) *types.Mailbox {
+	now := time.Now()
+
+	mailboxCache.Lock()
+	defer mailboxCache.Unlock()
+
+	if entry := mailboxCache.entries[topic]; entry != nil && now.Sub(entry.loadedAt) < mailboxCacheTTL {
+		return entry.box
+	}
+
+	boxes, err := store.Mailboxes.GetAll(topic)
+	if err != nil {
+		logs.Warn.Printf("mailgate: failed to load mailboxes of '%s': %v", topic, err)
+		return nil
+	}
+	var box *types.Mailbox
+	for i := range boxes {
+		if boxes[i].Reply {
+			box = &boxes[i]
+			break
+		}
+	}
+
+	if mailboxCache.entries == nil {
+		mailboxCache.entries = make(map[string]*mailboxEntry)
+	} else if len(mailboxCache.entries) >= mailboxCachePurgeSize {
+		for name, entry := range mailboxCache.entries {
+			if now.Sub(entry.loadedAt) >= mailboxCacheTTL {
+				delete(mailboxCache.entries, name)
+			}
+		}
+	}
+	mailboxCache.entries[topic] = &mailboxEntry{box: box, loadedAt: now}
+	return box
+}
+
+// mailboxInvalidate drops the cached mailbox of the topic after mailboxes were changed.
+func mailboxInvalidate(topic string) {
+	mailboxCache.Lock()
+	delete(mailboxCache.entries, topic)
+	mailboxCache.Unlock()
+}
+
+// mailReply sends the message published to the topic as a reply to an email back to the sender of the email.
+func (t *Topic) mailReply(data *MsgServerData) {
+	if !mailgate.CanReply() || t.isChan {
+		return
+	}
+	if data.Head[msgHeadEmail] != nil || data.Head[msgHeadService] != nil || data.Head[msgHeadScope] != nil {
+		// Messages from email, service messages and messages visible to some subscribers only.
+		return
+	}
+	reply, _ := data.Head["reply"].(map[string]any)
+	replySeq, _ := reply["seq"].(float64)
+	if replySeq <= 0 {
+		return
+	}
+	uid := types.ParseUserId(data.From)
+	if uid.IsZero() {
+		return
+	}
+	box := mailboxOf(t.name)
+	if box == nil || data.From == box.User {
+		return
+	}
+
+	// The original message is loaded from the database: don't block the topic.
+	topic, seq, content := t.name, data.SeqId, data.Content
+	go func() {
+		if err := mailSendReply(box, uid, topic, int(replySeq), seq, content); err != nil {
+			logs.Warn.Printf("mailgate: failed to reply to %s.%d: %v", topic, int(replySeq), err)
+		}
+	}()
+}
+
+// mailSendReply sends the message seq of the user as a reply to the email posted as the message replySeq.
+func mailSendReply(box *types.Mailbox, uid types.Uid, topic string, replySeq, seq int, content any) error {
+	orig, err := store.Messages.GetBySeqId(topic, replySeq)
+	if err != nil || orig == nil {
+		return err
+	}
+	origin, _ := orig.Head[msgHeadEmail].(map[string]any)
+	to, _ := origin["from"].(string)
+	if to == "" || origin["auto"] != nil {
+		// Not an email or an automatic email.
+		return nil
+	}
+
+	text, err := drafty.PlainText(content)
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		return nil
+	}
+
+	var name string
+	if user, err := store.Users.Get(uid); err == nil && user != nil {
+		if public, ok := user.Public.(map[string]any); ok {
+			name, _ = public["fn"].(string)
+		}
+	}
+
+	subject, _ := origin["subject"].(string)
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = strings.TrimSpace("Re: " + subject)
+	}
+	out := &mailgate.Outgoing{
+		From:      box.Address,
+		FromName:  name,
+		To:        to,
+		Subject:   subject,
+		Text:      text,
+		MessageID: mailgate.MessageID(topic, seq),
+	}
+	if id, _ := origin["id"].(string); id != "" {
+		out.InReplyTo = id
+		out.References = []string{id}
+	}
+	if !mailgate.Send(out) {
+		return errors.New("queue full")
+	}
+	return nil
+}
@@ -0,0 +1,621 @@
+// Package mailgate is the transport of the email gateway: an SMTP server which receives email addressed
+// to the mailboxes of the gateway, a parser of received messages and an SMTP client which sends replies.
+// Mapping of mailboxes to topics is done by the server through the Handler.
+package mailgate
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	defaultListen    = ":2525"
+	defaultMaxSize   = 10 << 20
+	defaultQueueSize = 256
+
+	// Maximum number of recipients of one message.
+	maxRecipients = 10
+	// Maximum length of a command line.
+	maxLineLength = 1000
+	// Time allowed to send the next command or the message data.
+	commandTimeout = 5 * time.Minute
+	// Time allowed to deliver one reply to the outbound SMTP server.
+	sendTimeout = 30 * time.Second
+)
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Address to accept SMTP connections at, i.e. ":25".
+	Listen string `json:"listen"`
+	// Name of the host used in the greeting and in IDs of sent messages, the hostname of the system if missing.
+	Hostname string `json:"hostname"`
+	// Maximum size of a received message in bytes.
+	MaxSize int64 `json:"max_size"`
+
+	// Outbound SMTP server for replies. Replies are disabled if missing.
+	SMTPAddr string `json:"smtp_server"`
+	// Port of the outbound SMTP server.
+	SMTPPort string `json:"smtp_port"`
+	// Name of this host sent in HELO, "localhost" if missing.
+	SMTPHeloHost string `json:"smtp_helo_host"`
+	// Login and password to authenticate with the SMTP server, optional.
+	Login    string `json:"login"`
+	Password string `json:"sender_password"`
+	// Skip verification of the certificate of the SMTP server.
+	TLSInsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// Maximum number of replies waiting to be sent.
+	QueueSize int `json:"queue_size"`
+}
+
+// ErrRejected is returned by the Handler when the mailbox does not exist or does not accept the message.
+// The message is rejected with a permanent error. Other errors are reported to the client as temporary.
+var ErrRejected = errors.New("mailbox unavailable")
+
+// Handler posts received messages to topics.
+type Handler interface {
+	// Accept checks if the address is a mailbox of the gateway.
+	Accept(rcpt string) error
+	// Deliver posts the message received for the address.
+	Deliver(rcpt string, msg *Message) error
+}
+
+// Outgoing is a reply to send by email.
+type Outgoing struct {
+	// Address and display name of the sender.
+	From     string
+	FromName string
+	// Address of the recipient.
+	To      string
+	Subject string
+	Text    string
+	// Message-ID of the reply, In-Reply-To and References of the message being replied to, in angle brackets.
+	MessageID  string
+	InReplyTo  string
+	References []string
+}
+
+type gateway struct {
+	config   *configType
+	handler  Handler
+	tlsConf  *tls.Config
+	listener net.Listener
+	auth     smtp.Auth
+
+	// Open connections and the state of the outbox are guarded by the lock.
+	lock    sync.Mutex
+	conns   map[net.Conn]bool
+	stopped bool
+
+	outbox chan *Outgoing
+	wg     sync.WaitGroup
+}
+
+var gate *gateway
+
+// Init initializes the gateway and starts accepting email. Returns false if the gateway is disabled in
+// the config. STARTTLS is offered to clients if tlsConf is not nil.
+func Init(jsconfig json.RawMessage, handler Handler, tlsConf *tls.Config) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+	if config.Listen == "" {
+		config.Listen = defaultListen
+	}
+	if config.Hostname == "" {
+		config.Hostname, _ = os.Hostname()
+	}
+	if config.Hostname == "" {
+		return false, errors.New("hostname is required")
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultMaxSize
+	}
+	if config.SMTPPort == "" {
+		config.SMTPPort = "25"
+	}
+	if config.SMTPHeloHost == "" {
+		config.SMTPHeloHost = "localhost"
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return false, err
+	}
+
+	g := &gateway{
+		config:   &config,
+		handler:  handler,
+		tlsConf:  tlsConf,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	if config.SMTPAddr != "" {
+		if config.Login != "" {
+			g.auth = smtp.PlainAuth("", config.Login, config.Password, config.SMTPAddr)
+		}
+		g.outbox = make(chan *Outgoing, config.QueueSize)
+		g.wg.Add(1)
+		go g.sendLoop()
+	}
+	go g.serve()
+
+	gate = g
+	logs.Info.Printf("Email gateway listening at '%s'", listener.Addr())
+	return true, nil
+}
+
+// Enabled checks if the gateway is enabled.
+func Enabled() bool {
+	return gate != nil
+}
+
+// CanReply checks if replies can be sent by email.
+func CanReply() bool {
+	return gate != nil && gate.outbox != nil
+}
+
+// Hostname returns the name of the host of the gateway.
+func Hostname() string {
+	if gate == nil {
+		return ""
+	}
+	return gate.config.Hostname
+}
+
+// MessageID returns the Message-ID of the message of the topic sent or received by the gateway.
+func MessageID(topic string, seq int) string {
+	return "<" + topic + "." + strconv.Itoa(seq) + "@" + Hostname() + ">"
+}
+
+// ParseMessageID returns the topic and the sequence ID of the message with the ID generated by MessageID.
+// Returns an empty topic if the ID was not generated by the gateway.
+func ParseMessageID(id string) (string, int) {
+	id = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+	local, host, ok := strings.Cut(id, "@")
+	if !ok || !strings.EqualFold(host, Hostname()) {
+		return "", 0
+	}
+	dot := strings.LastIndexByte(local, '.')
+	if dot <= 0 {
+		return "", 0
+	}
+	seq, err := strconv.Atoi(local[dot+1:])
+	if err != nil || seq <= 0 {
+		return "", 0
+	}
+	return local[:dot], seq
+}
+
+// Send queues the reply to be sent. Returns false if the queue is full or replies are disabled.
+func Send(msg *Outgoing) bool {
+	g := gate
+	if g == nil || g.outbox == nil {
+		return false
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.stopped {
+		return false
+	}
+	select {
+	case g.outbox <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stops accepting email, closes open connections and sends queued replies.
+func Stop() {
+	g := gate
+	if g == nil {
+		return
+	}
+	gate = nil
+
+	g.listener.Close()
+	g.lock.Lock()
+	g.stopped = true
+	for conn := range g.conns {
+		conn.Close()
+	}
+	if g.outbox != nil {
+		close(g.outbox)
+	}
+	g.lock.Unlock()
+
+	g.wg.Wait()
+}
+
+func (g *gateway) serve() {
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logs.Warn.Println("mailgate: accept failed", err)
+			}
+			return
+		}
+
+		g.lock.Lock()
+		g.conns[conn] = true
+		g.lock.Unlock()
+
+		go func() {
+			newSession(g, conn).serve()
+
+			g.lock.Lock()
+			delete(g.conns, conn)
+			g.lock.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// session is an SMTP session of a client (RFC 5321).
+type session struct {
+	gate *gateway
+	conn net.Conn
+	text *textproto.Conn
+
+	helo  bool
+	from  string
+	rcpts []string
+}
+
+func newSession(g *gateway, conn net.Conn) *session {
+	s := &session{gate: g}
+	s.reset(conn)
+	return s
+}
+
+func (s *session) reset(conn net.Conn) {
+	s.conn = conn
+	s.text = textproto.NewConn(conn)
+	s.helo = false
+	s.resetTransaction()
+}
+
+func (s *session) resetTransaction() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *session) reply(code int, text string) error {
+	s.conn.SetWriteDeadline(time.Now().Add(commandTimeout))
+	return s.text.PrintfLine("%d %s", code, text)
+}
+
+func (s *session) serve() {
+	if s.reply(220, s.gate.config.Hostname+" ESMTP ready") != nil {
+		return
+	}
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(commandTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		if len(line) > maxLineLength {
+			if s.reply(500, "Line too long") != nil {
+				return
+			}
+			continue
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			err = s.cmdEhlo(arg)
+		case "HELO":
+			s.helo = true
+			s.resetTransaction()
+			err = s.reply(250, s.gate.config.Hostname)
+		case "MAIL":
+			err = s.cmdMail(arg)
+		case "RCPT":
+			err = s.cmdRcpt(arg)
+		case "DATA":
+			err = s.cmdData()
+		case "RSET":
+			s.resetTransaction()
+			err = s.reply(250, "OK")
+		case "NOOP":
+			err = s.reply(250, "OK")
+		case "VRFY":
+			err = s.reply(252, "Cannot verify user")
+		case "STARTTLS":
+			err = s.cmdStartTLS()
+		case "QUIT":
+			s.reply(221, "Bye")
+			return
+		default:
+			err = s.reply(502, "Command not implemented")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *session) cmdEhlo(arg string) error {
+	if arg == "" {
+		return s.reply(501, "Domain required")
+	}
+	s.helo = true
+	s.resetTransaction()
+
+	s.conn.SetWriteDeadline(time.Now().Add(commandTimeout))
+	w := s.text.Writer.W
+	w.WriteString("250-" + s.gate.config.Hostname + "\r\n")
+	w.WriteString("250-SIZE " + strconv.FormatInt(s.gate.config.MaxSize, 10) + "\r\n")
+	w.WriteString("250-8BITMIME\r\n")
+	if _, secure := s.conn.(*tls.Conn); !secure && s.gate.tlsConf != nil {
+		w.WriteString("250-STARTTLS\r\n")
+	}
+	w.WriteString("250 PIPELINING\r\n")
+	return w.Flush()
+}
+
+func (s *session) cmdStartTLS() error {
+	if _, secure := s.conn.(*tls.Conn); secure || s.gate.tlsConf == nil {
+		return s.reply(502, "Command not implemented")
+	}
+	if err := s.reply(220, "Ready to start TLS"); err != nil {
+		return err
+	}
+	conn := tls.Server(s.conn, s.gate.tlsConf)
+	conn.SetDeadline(time.Now().Add(commandTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// The client must start over after TLS is established.
+	s.reset(conn)
+	return nil
+}
+
+// pathArg extracts the address from "FROM:<addr> PARAMS" or "TO:<addr> PARAMS" and returns the address and
+// the parameters.
+func pathArg(prefix, arg string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	return arg[1:end], strings.Fields(arg[end+1:]), true
+}
+
+func (s *session) cmdMail(arg string) error {
+	if !s.helo {
+		return s.reply(503, "Send EHLO first")
+	}
+	if s.from != "" {
+		return s.reply(503, "Sender already specified")
+	}
+	from, params, ok := pathArg("FROM:", arg)
+	if !ok {
+		return s.reply(501, "Syntax: MAIL FROM:<address>")
+	}
+	for _, param := range params {
+		key, val, _ := strings.Cut(param, "=")
+		if strings.EqualFold(key, "SIZE") {
+			if size, err := strconv.ParseInt(val, 10, 64); err == nil && size > s.gate.config.MaxSize {
+				return s.reply(552, "Message too large")
+			}
+		}
+	}
+	// The null reverse-path of bounces is represented as "<>".
+	s.from = "<" + from + ">"
+	return s.reply(250, "OK")
+}
+
+func (s *session) cmdRcpt(arg string) error {
+	if s.from == "" {
+		return s.reply(503, "Send MAIL first")
+	}
+	rcpt, _, ok := pathArg("TO:", arg)
+	if !ok || rcpt == "" {
+		return s.reply(501, "Syntax: RCPT TO:<address>")
+	}
+	if len(s.rcpts) >= maxRecipients {
+		return s.reply(452, "Too many recipients")
+	}
+	if err := s.gate.handler.Accept(rcpt); err != nil {
+		if errors.Is(err, ErrRejected) {
+			return s.reply(550, "No such mailbox")
+		}
+		logs.Warn.Println("mailgate: failed to check mailbox", rcpt, err)
+		return s.reply(451, "Temporary failure, try again later")
+	}
+	s.rcpts = append(s.rcpts, rcpt)
+	return s.reply(250, "OK")
+}
+
+func (s *session) cmdData() error {
+	if len(s.rcpts) == 0 {
+		return s.reply(503, "Send RCPT first")
+	}
+	if err := s.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(commandTimeout))
+	dot := s.text.DotReader()
+	data, err := io.ReadAll(io.LimitReader(dot, s.gate.config.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	rcpts := s.rcpts
+	s.resetTransaction()
+	if int64(len(data)) > s.gate.config.MaxSize {
+		// Consume the rest of the message.
+		if _, err = io.Copy(io.Discard, dot); err != nil {
+			return err
+		}
+		return s.reply(552, "Message too large")
+	}
+
+	msg, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return s.reply(554, "Malformed message")
+	}
+
+	// The message is accepted if it's delivered to at least one mailbox. If some deliveries failed,
+	// the worst error is reported.
+	var delivered int
+	var failed, rejected bool
+	for _, rcpt := range rcpts {
+		if err := s.gate.handler.Deliver(rcpt, msg); err == nil {
+			delivered++
+		} else if errors.Is(err, ErrRejected) {
+			rejected = true
+		} else {
+			logs.Warn.Println("mailgate: failed to deliver message to", rcpt, err)
+			failed = true
+		}
+	}
+	switch {
+	case delivered > 0:
+		return s.reply(250, "OK")
+	case failed:
+		return s.reply(451, "Temporary failure, try again later")
+	case rejected:
+		return s.reply(550, "Message rejected")
+	}
+	return s.reply(250, "OK")
+}
+
+func (g *gateway) sendLoop() {
+	defer g.wg.Done()
+	for msg := range g.outbox {
+		if err := g.sendMail(msg.To, buildMessage(msg)); err != nil {
+			logs.Warn.Println("mailgate: failed to send reply to", msg.To, err)
+		}
+	}
+}
+
+func (g *gateway) sendMail(to string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(g.config.SMTPAddr, g.config.SMTPPort), sendTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+	client, err := smtp.NewClient(conn, g.config.SMTPAddr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if err = client.Hello(g.config.SMTPHeloHost); err != nil {
+		return err
+	}
+	if istls, _ := client.Extension("STARTTLS"); istls {
+		tlsConfig := &tls.Config{
+			InsecureSkipVerify: g.config.TLSInsecureSkipVerify,
+			ServerName:         g.config.SMTPAddr,
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if g.auth != nil {
+		if isauth, _ := client.Extension("AUTH"); isauth {
+			if err = client.Auth(g.auth); err != nil {
+				return err
+			}
+		}
+	}
+	// Replies are sent with the null reverse-path: the gateway does not accept bounces.
+	if err = client.Mail(""); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// noCRLF replaces line breaks which could be used to inject headers.
+func noCRLF(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r", " "), "\n", " ")
+}
+
+// buildMessage formats the reply as a plain text email.
+func buildMessage(msg *Outgoing) []byte {
+	message := &bytes.Buffer{}
+	from := &mail.Address{Name: noCRLF(msg.FromName), Address: noCRLF(msg.From)}
+	message.WriteString("From: " + from.String() + "\r\n")
+	message.WriteString("To: " + (&mail.Address{Address: noCRLF(msg.To)}).String() + "\r\n")
+	message.WriteString("Subject: ")
+	message.WriteString(strings.Join(strings.Split(mime.QEncoding.Encode("utf-8", noCRLF(msg.Subject)), " "), "\r\n    "))
+	message.WriteString("\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	if msg.MessageID != "" {
+		message.WriteString("Message-ID: " + noCRLF(msg.MessageID) + "\r\n")
+	}
+	if msg.InReplyTo != "" {
+		message.WriteString("In-Reply-To: " + noCRLF(msg.InReplyTo) + "\r\n")
+	}
+	if len(msg.References) > 0 {
+		message.WriteString("References: " + noCRLF(strings.Join(msg.References, " ")) + "\r\n")
+	}
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=\"UTF-8\"\r\n")
+	message.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+
+	// Lines of base64 must not exceed 76 characters.
+	body := base64.StdEncoding.EncodeToString([]byte(msg.Text))
+	for len(body) > 76 {
+		message.WriteString(body[:76] + "\r\n")
+		body = body[76:]
+	}
+	message.WriteString(body + "\r\n")
+	return message.Bytes()
+}
@@ -0,0 +1,187 @@
+package mailgate
+
+import (
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+const testMessage = "From: =?utf-8?q?J=C3=BCrgen?= <Juergen@Example.com>\r\n" +
+	"To: support@example.com\r\n" +
+	"Subject: =?utf-8?b?UmU6IETDvHNzZWxkb3Jm?=\r\n" +
+	"Message-ID: <abc@mail.example.com>\r\n" +
+	"In-Reply-To: <grpX.5@chat.example.com>\r\n" +
+	"References: <first@mail.example.com> <grpX.5@chat.example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>HTML body</p>\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Gr=FC=DFe,\r\n" +
+	"it works.\r\n" +
+	"\r\n" +
+	"On Mon, Jan 1, 2024 at 10:00 AM Support <support@example.com>\r\n" +
+	"wrote:\r\n" +
+	"> Does it work?\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAEC\r\n" +
+	"--outer--\r\n"
+
+func TestParse(t *testing.T) {
+	msg, err := Parse(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal("Parse:", err)
+	}
+	if msg.From != "juergen@example.com" || msg.Name != "Jürgen" {
+		t.Errorf("Unexpected sender '%s' '%s'", msg.From, msg.Name)
+	}
+	if msg.Subject != "Re: Düsseldorf" {
+		t.Errorf("Unexpected subject '%s'", msg.Subject)
+	}
+	if msg.MessageID != "<abc@mail.example.com>" || msg.InReplyTo != "<grpX.5@chat.example.com>" ||
+		len(msg.References) != 2 {
+		t.Errorf("Unexpected IDs %+v", msg)
+	}
+	if msg.Text != "Grüße,\nit works." {
+		t.Errorf("Unexpected text '%s'", msg.Text)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Name != "data.bin" ||
+		msg.Attachments[0].Mime != "application/octet-stream" || string(msg.Attachments[0].Data) != "\x00\x01\x02" {
+		t.Errorf("Unexpected attachments %+v", msg.Attachments)
+	}
+	if msg.Auto {
+		t.Error("Message is not automatic")
+	}
+
+	msg, err = Parse(strings.NewReader("From: robot@example.com\r\nAuto-Submitted: auto-replied\r\n" +
+		"Content-Type: text/html\r\n\r\n<html><head><title>x</title></head><body>Out of<br>office &amp; away</body></html>"))
+	if err != nil {
+		t.Fatal("Parse:", err)
+	}
+	if !msg.Auto || msg.Text != "Out of\noffice & away" {
+		t.Errorf("Unexpected autoreply %+v", msg)
+	}
+
+	if _, err = Parse(strings.NewReader("Subject: no sender\r\n\r\ntext")); err == nil {
+		t.Error("Message without a sender must fail")
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	gate = &gateway{config: &configType{Hostname: "chat.example.com"}}
+	defer func() { gate = nil }()
+
+	id := MessageID("grpX", 5)
+	if id != "<grpX.5@chat.example.com>" {
+		t.Errorf("MessageID: got '%s'", id)
+	}
+	if topic, seq := ParseMessageID(id); topic != "grpX" || seq != 5 {
+		t.Errorf("ParseMessageID: got '%s', %d", topic, seq)
+	}
+	for _, id := range []string{"<grpX.5@example.com>", "<grpX@chat.example.com>", "<grpX.0@chat.example.com>"} {
+		if topic, _ := ParseMessageID(id); topic != "" {
+			t.Errorf("ParseMessageID(%s): expected no topic, got '%s'", id, topic)
+		}
+	}
+}
+
+func TestBuildMessage(t *testing.T) {
+	msg, err := Parse(strings.NewReader(string(buildMessage(&Outgoing{
+		From:       "support@example.com",
+		FromName:   "Support\r\nBcc: x@example.com",
+		To:         "alice@example.com",
+		Subject:    "Re: Grüße",
+		Text:       strings.Repeat("Long reply. ", 20),
+		MessageID:  "<grpX.6@chat.example.com>",
+		InReplyTo:  "<abc@mail.example.com>",
+		References: []string{"<abc@mail.example.com>"},
+	}))))
+	if err != nil {
+		t.Fatal("Parse:", err)
+	}
+	if msg.From != "support@example.com" || msg.Subject != "Re: Grüße" || msg.InReplyTo != "<abc@mail.example.com>" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	if msg.Text != strings.TrimSpace(strings.Repeat("Long reply. ", 20)) {
+		t.Errorf("Unexpected text '%s'", msg.Text)
+	}
+}
+
+type testHandler struct {
+	lock      sync.Mutex
+	delivered map[string]*Message
+}
+
+func (h *testHandler) Accept(rcpt string) error {
+	if !strings.HasSuffix(rcpt, "@example.com") {
+		return ErrRejected
+	}
+	return nil
+}
+
+func (h *testHandler) Deliver(rcpt string, msg *Message) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.delivered[rcpt] = msg
+	return nil
+}
+
+func TestSession(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &testHandler{delivered: make(map[string]*Message)}
+	g := &gateway{
+		config:   &configType{Hostname: "chat.example.com", MaxSize: 1024},
+		handler:  handler,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	go g.serve()
+	defer listener.Close()
+
+	addr := listener.Addr().String()
+	if err = smtp.SendMail(addr, nil, "juergen@example.com", []string{"support@example.com"},
+		[]byte(testMessage)); err != nil {
+		t.Fatal("SendMail:", err)
+	}
+	if msg := handler.delivered["support@example.com"]; msg == nil || msg.Text != "Grüße,\nit works." {
+		t.Errorf("Unexpected delivery %+v", handler.delivered)
+	}
+
+	err = smtp.SendMail(addr, nil, "juergen@example.com", []string{"support@example.org"}, []byte(testMessage))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("Unknown mailbox: expected 550, got %v", err)
+	}
+
+	err = smtp.SendMail(addr, nil, "juergen@example.com", []string{"support@example.com"},
+		[]byte(testMessage+strings.Repeat("x", 1024)))
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("Large message: expected 552, got %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package mailgate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Maximum depth of nested multipart entities.
+const maxPartDepth = 8
+
+// Message is a received email.
+type Message struct {
+	// Address and display name of the sender.
+	From string
+	Name string
+	// Subject of the message, decoded.
+	Subject string
+	// Message-ID, In-Reply-To and References of the message in angle brackets.
+	MessageID  string
+	InReplyTo  string
+	References []string
+	// Text of the message without quoted text of previous messages.
+	Text        string
+	Attachments []Attachment
+	// The message was generated automatically: autoreplies, mailing lists, bounces. Such messages
+	// should not be replied to.
+	Auto bool
+}
+
+// Attachment is a file attached to a received email.
+type Attachment struct {
+	Name string
+	Mime string
+	Data []byte
+}
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// charsetReader converts text in the charset to UTF-8.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// Parse parses the email message (RFC 5322) with MIME entities.
+func Parse(r io.Reader) (*Message, error) {
+	raw, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	from, err := parser.Parse(raw.Header.Get("From"))
+	if err != nil {
+		return nil, errors.New("invalid sender: " + err.Error())
+	}
+
+	msg := &Message{
+		From:       strings.ToLower(from.Address),
+		Name:       from.Name,
+		MessageID:  strings.TrimSpace(raw.Header.Get("Message-Id")),
+		InReplyTo:  strings.TrimSpace(raw.Header.Get("In-Reply-To")),
+		References: strings.Fields(raw.Header.Get("References")),
+	}
+	if msg.Subject, err = wordDecoder.DecodeHeader(raw.Header.Get("Subject")); err != nil {
+		msg.Subject = raw.Header.Get("Subject")
+	}
+	msg.Subject = strings.TrimSpace(msg.Subject)
+
+	// Autoreplies are marked with Auto-Submitted (RFC 3834), mailing lists and bulk email with Precedence.
+	if auto := strings.ToLower(raw.Header.Get("Auto-Submitted")); auto != "" && auto != "no" {
+		msg.Auto = true
+	}
+	switch strings.ToLower(raw.Header.Get("Precedence")) {
+	case "bulk", "junk", "list", "auto_reply":
+		msg.Auto = true
+	}
+	if raw.Header.Get("List-Id") != "" || msg.From == "" {
+		msg.Auto = true
+	}
+
+	var htmlText string
+	if err = msg.parsePart(raw.Header, raw.Body, 0, &htmlText); err != nil {
+		return nil, err
+	}
+	if msg.Text == "" && htmlText != "" {
+		msg.Text = htmlToText(htmlText)
+	}
+	msg.Text = stripQuote(msg.Text)
+	return msg, nil
+}
+
+// header is the common part of mail.Header and textproto.MIMEHeader.
+type header interface {
+	Get(key string) string
+}
+
+// parsePart collects the text and attachments of the MIME entity. The first HTML part is saved to htmlText
+// in case the message has no plain text.
+func (msg *Message) parsePart(hdr header, body io.Reader, depth int, htmlText *string) error {
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	switch strings.ToLower(hdr.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxPartDepth || params["boundary"] == "" {
+			return nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = msg.parsePart(part.Header, part, depth+1, htmlText); err != nil {
+				return err
+			}
+		}
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(hdr.Get("Content-Disposition"))
+	name := dparams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	if name != "" {
+		if decoded, err := wordDecoder.DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	if disposition != "attachment" && name == "" {
+		switch mediaType {
+		case "text/plain":
+			if msg.Text == "" {
+				msg.Text = decodeText(params["charset"], data)
+			}
+			return nil
+		case "text/html":
+			if *htmlText == "" {
+				*htmlText = decodeText(params["charset"], data)
+			}
+			return nil
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if name == "" {
+		if mediaType == "message/rfc822" {
+			name = "message.eml"
+		} else {
+			name = "attachment"
+		}
+	}
+	msg.Attachments = append(msg.Attachments, Attachment{Name: name, Mime: mediaType, Data: data})
+	return nil
+}
+
+// decodeText converts text in the charset to UTF-8.
+func decodeText(charset string, data []byte) string {
+	if r, err := charsetReader(charset, bytes.NewReader(data)); err == nil {
+		if decoded, err := io.ReadAll(r); err == nil {
+			data = decoded
+		}
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if !utf8.ValidString(text) {
+		text = strings.ToValidUTF8(text, "�")
+	}
+	return strings.TrimSpace(text)
+}
+
+var (
+	htmlHidden = regexp.MustCompile(`(?is)<(head|style|script)[^>]*>.*?</(head|style|script)>`)
+	htmlBreak  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|h[1-6])>`)
+	htmlTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLines = regexp.MustCompile(`\n\s*\n\s*\n+`)
+)
+
+// htmlToText converts the HTML body of a message to plain text.
+func htmlToText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = strings.NewReplacer("\r", "", "\n", " ").Replace(s)
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// Attribution line of quoted text, "On Mon, Jan 1, 2024 at 10:00 AM Alice <alice@example.com> wrote:".
+var quoteHeader = regexp.MustCompile(`(?i)^(on|le|am|el|il)\s.*\s(wrote|a écrit|schrieb|escribió|ha scritto):$`)
+
+// stripQuote removes quoted text of the previous messages which email clients append to replies.
+func stripQuote(text string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "-----Original Message-----") {
+			lines = lines[:i]
+			break
+		}
+	}
+
+	// Drop the trailing quoted lines.
+	end := len(lines)
+	for end > 0 {
+		line := strings.TrimSpace(lines[end-1])
+		if line != "" && !strings.HasPrefix(line, ">") {
+			break
+		}
+		end--
+	}
+	if end < len(lines) {
+		// The attribution line may be wrapped.
+		for n := 1; n <= 2 && n <= end; n++ {
+			var attribution []string
+			for _, line := range lines[end-n : end] {
+				attribution = append(attribution, strings.TrimSpace(line))
+			}
+			if quoteHeader.MatchString(strings.Join(attribution, " ")) {
+				end -= n
+				break
+			}
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines[:end], "\n"))
+}
@@ -8,16 +8,18 @@
 
 package main
 
-//go:generate protoc --go_out=../pbx --go_opt=paths=source_relative --go-grpc_out=../pbx --go-grpc_opt=paths=source_relative ../pbx/model.proto
+//go:generate protoc --go_out=../pbx --go_opt=paths=source_relative --go-grpc_out=../pbx --go-grpc_opt=paths=source_relative --proto_path=../pbx ../pbx/model.proto ../pbx/firehose.proto
 
 import (
 	"encoding/json"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	gh "github.com/gorilla/handlers"
@@ -30,8 +32,15 @@ import (
 	_ "github.com/tinode/chat/server/auth/anon"
 	_ "github.com/tinode/chat/server/auth/basic"
 	_ "github.com/tinode/chat/server/auth/code"
+	_ "github.com/tinode/chat/server/auth/ldap"
+	_ "github.com/tinode/chat/server/auth/oidc"
+	_ "github.com/tinode/chat/server/auth/refresh"
 	_ "github.com/tinode/chat/server/auth/rest"
+	_ "github.com/tinode/chat/server/auth/resume"
+	_ "github.com/tinode/chat/server/auth/saml"
 	_ "github.com/tinode/chat/server/auth/token"
+	_ "github.com/tinode/chat/server/auth/totp"
+	_ "github.com/tinode/chat/server/auth/webauthn"
 	"github.com/tinode/chat/server/store/types"
 
 	// Database backends
@@ -39,25 +48,73 @@ import (
 	_ "github.com/tinode/chat/server/db/mysql"
 	_ "github.com/tinode/chat/server/db/postgres"
 	_ "github.com/tinode/chat/server/db/rethinkdb"
+	_ "github.com/tinode/chat/server/db/sqlite"
 
+	"github.com/tinode/chat/server/cache"
+	"github.com/tinode/chat/server/export"
+	"github.com/tinode/chat/server/journal"
+	"github.com/tinode/chat/server/linkpreview"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/mailgate"
+	"github.com/tinode/chat/server/matrix"
+	"github.com/tinode/chat/server/tiering"
+	"github.com/tinode/chat/server/webhooks"
 
 	// Push notifications
 	"github.com/tinode/chat/server/push"
+	_ "github.com/tinode/chat/server/push/apns"
 	_ "github.com/tinode/chat/server/push/fcm"
+	"github.com/tinode/chat/server/push/sms"
 	_ "github.com/tinode/chat/server/push/stdout"
 	_ "github.com/tinode/chat/server/push/tnpg"
+	_ "github.com/tinode/chat/server/push/unifiedpush"
+	_ "github.com/tinode/chat/server/push/webpush"
+
+	// Content moderation filters
+	"github.com/tinode/chat/server/moderation"
+	_ "github.com/tinode/chat/server/moderation/webhook"
+	_ "github.com/tinode/chat/server/moderation/wordlist"
+
+	// Registration guards
+	"github.com/tinode/chat/server/regguard"
+	_ "github.com/tinode/chat/server/regguard/captcha"
+	_ "github.com/tinode/chat/server/regguard/velocity"
+
+	// Network access control
+	"github.com/tinode/chat/server/netacl"
 
 	"github.com/tinode/chat/server/store"
 
+	// Translation providers
+	"github.com/tinode/chat/server/translate"
+	_ "github.com/tinode/chat/server/translate/deepl"
+	_ "github.com/tinode/chat/server/translate/google"
+	_ "github.com/tinode/chat/server/translate/libre"
+
 	// Credential validators
 	_ "github.com/tinode/chat/server/validate/email"
 	_ "github.com/tinode/chat/server/validate/tel"
 	"google.golang.org/grpc"
 
 	// File upload handlers
+	"github.com/tinode/chat/server/media/audio"
+	_ "github.com/tinode/chat/server/media/azure"
 	_ "github.com/tinode/chat/server/media/fs"
+	_ "github.com/tinode/chat/server/media/gcs"
 	_ "github.com/tinode/chat/server/media/s3"
+	"github.com/tinode/chat/server/media/variants"
+
+	// Malware scanners of uploaded files
+	"github.com/tinode/chat/server/scan"
+	_ "github.com/tinode/chat/server/scan/clamd"
+	_ "github.com/tinode/chat/server/scan/icap"
+
+	// SFU providers for group calls
+	_ "github.com/tinode/chat/server/sfu/livekit"
+
+	// Key providers for envelope encryption of messages at rest
+	_ "github.com/tinode/chat/server/kms/awskms"
+	_ "github.com/tinode/chat/server/kms/vault"
 )
 
 const (
@@ -83,6 +140,12 @@ const (
 	// defaultMaxTagCount is the default maximum number of indexable tags
 	defaultMaxTagCount = 16
 
+	// defaultMaxPinnedCount is the default maximum number of pinned messages per topic.
+	defaultMaxPinnedCount = 5
+
+	// defaultMaxContactHashes is the default maximum number of hashes in one contact discovery request.
+	defaultMaxContactHashes = 500
+
 	// minTagLength is the shortest acceptable length of a tag in runes. Shorter tags are discarded.
 	minTagLength = 2
 	// maxTagLength is the maximum length of a tag in runes. Longer tags are trimmed.
@@ -138,12 +201,22 @@ var globals struct {
 	hub *Hub
 	// Indicator that shutdown is in progress
 	shuttingDown bool
+	// The node is being taken out of service: new sessions are rejected, existing ones are asked to reconnect.
+	draining atomic.Bool
+	// Read-only maintenance mode: requests which change data are rejected.
+	maintenance atomic.Bool
 	// Sessions cache.
 	sessionStore *SessionStore
 	// Cluster data.
 	cluster *Cluster
 	// gRPC server.
 	grpcServer *grpc.Server
+	// Stream of events for backend services, nil if disabled.
+	firehose *firehose
+	// Listener of the XMPP gateway.
+	xmppListener net.Listener
+	// Listener of the MQTT gateway.
+	mqttListener net.Listener
 	// Plugins.
 	plugins []Plugin
 	// Runtime statistics communication channel.
@@ -175,17 +248,54 @@ var globals struct {
 	tlsRedirectHTTP string
 	// Maximum message size allowed from peer.
 	maxMessageSize int64
+	// Maximum size of a message delivered to clients after server-side transforms.
+	maxOutboundMessageSize int
 	// Maximum number of group topic subscribers.
 	maxSubscriberCount int
 	// Maximum number of indexable tags.
 	maxTagCount int
+	// Maximum number of pinned messages per topic.
+	maxPinnedCount int
+	// Read and received notifications are not forwarded in group topics with more subscribers than this.
+	maxReceiptFanout int
+	// Data messages are delivered to attached sessions in parallel shards of this size.
+	fanoutShardSize int
 	// If true, ordinary users cannot delete their accounts.
 	permanentAccounts bool
+	// Hard-deleting an account also erases all data derived from the user.
+	eraseDeletedAccounts bool
+	// Limiter of client requests; nil if rate limiting is disabled.
+	rateLimiter *rateLimiter
+	// Maximum number of hashes or prefixes in one contact discovery request.
+	maxContactHashes int
+	// Length of hash prefixes in contact discovery requests, 0 if requests by prefix are disabled.
+	contactPrefixLength int
+	// The last encryption health check failed.
+	encryptionUnhealthy atomic.Bool
+	// Encryption is unhealthy and the server is configured to reject new messages.
+	encryptionReadOnly atomic.Bool
 
 	// Maximum allowed upload size.
 	maxFileUploadSize int64
 	// Periodicity of a garbage collector for abandoned media uploads.
 	mediaGcPeriod time.Duration
+	// Incomplete resumable uploads; nil if resumable uploads are disabled.
+	resumableUploads *resumableUploads
+	// Generator of thumbnails and other variants of uploaded media; nil if disabled.
+	mediaVariants *variants.Pipeline
+	// Extractor of duration and waveform of uploaded audio files; nil if disabled.
+	audioAnalyzer *audio.Analyzer
+	// Storage quotas of users and topics in bytes, 0 if unlimited.
+	userMediaQuota  int64
+	topicMediaQuota int64
+
+	// Users, topics and files are partitioned by tenant.
+	tenantsEnabled bool
+
+	// Usage is metered for billing.
+	meteringEnabled bool
+	// Monthly usage limits of each user by metric.
+	meterLimits map[string]types.UsageLimit
 
 	// Prioritize X-Forwarded-For header as the source of IP address of the client.
 	useXForwardedFor bool
@@ -201,6 +311,8 @@ var globals struct {
 
 	// ICE servers config (video calling)
 	iceServers []iceServer
+	// Minter of TURN credentials, nil if static credentials are used.
+	turn *turnCredentials
 
 	// Websocket per-message compression negotiation is enabled.
 	wsCompression bool
@@ -214,6 +326,37 @@ var globals struct {
 
 	// Maximum age of messages which can be deleted with 'D' permission.
 	msgDeleteAge time.Duration
+
+	// Maximum delay of publishing a scheduled message; 0 if scheduled messages are disabled.
+	schedMsgMaxDelay time.Duration
+
+	// Minimum time to live of messages in seconds; 0 if disappearing messages are disabled.
+	msgTTLMin int
+
+	// Reports of messages and users are accepted.
+	reportsEnabled bool
+
+	// Security-relevant events are saved to the audit log.
+	auditEnabled bool
+
+	// Queue of exports of users' data; nil if takeouts are disabled.
+	takeoutQueue chan *types.Takeout
+	// Minimum interval between exports of one user.
+	takeoutPeriod time.Duration
+	// How long the archive of the export is available for download.
+	takeoutExpires time.Duration
+
+	// Typing notifications sent by a session more often than this are dropped.
+	typingMinInterval time.Duration
+	// Typing notifications in group topics with more subscribers than this are aggregated.
+	typingAggregateOver int
+	// Period of aggregation of typing notifications; 0 if aggregation is disabled.
+	typingWindow time.Duration
+
+	// Records of sessions inactive for longer than this are deleted; 0 if session records are disabled.
+	sessRecordMaxIdle time.Duration
+	// Maximum number of session records kept per user.
+	sessRecordMaxCount int
 }
 
 // Credential validator config.
@@ -237,6 +380,132 @@ type accountGcConfig struct {
 	GcMinAccountAge int `json:"gc_min_account_age"`
 }
 
+// Encryption health check config.
+type encryptionCheckConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to run the check (seconds).
+	CheckPeriod int `json:"check_period"`
+	// What to do when the check fails: "log" (default), "read_only" or "fail_closed".
+	OnFailure string `json:"on_failure"`
+}
+
+// Scheduled messages config.
+type scheduledMsgConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to check for messages due for publishing (seconds).
+	CheckPeriod int `json:"check_period"`
+	// Maximum number of messages to publish in one pass.
+	BlockSize int `json:"block_size"`
+	// Maximum time in the future a message can be scheduled for (hours).
+	MaxDelay int `json:"max_delay"`
+}
+
+// Typing notifications config.
+type typingConfig struct {
+	// Typing notifications sent by a session more often than this are dropped (milliseconds).
+	MinInterval int `json:"min_interval"`
+	// Typing notifications in group topics with more subscribers than this are aggregated.
+	AggregateOver int `json:"aggregate_over"`
+	// Period of aggregation of typing notifications (milliseconds). 0 disables aggregation.
+	Window int `json:"window"`
+}
+
+// Contact discovery config. Hashes are salted with store_config.contact_salt.
+type contactsConfig struct {
+	// Maximum number of hashes or prefixes in one request.
+	MaxHashes int `json:"max_hashes"`
+	// Length of hash prefixes in hex digits for private set intersection. 0 disables requests by prefix.
+	PrefixLength int `json:"prefix_length"`
+}
+
+// Disappearing messages config.
+type msgTTLConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to check for expired messages (seconds).
+	CheckPeriod int `json:"check_period"`
+	// Maximum number of topics to process in one pass.
+	BlockSize int `json:"block_size"`
+	// Minimum time to live of messages a topic may have (seconds).
+	MinTTL int `json:"min_ttl"`
+}
+
+// Message retention config.
+type msgRetentionConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to check for messages past the retention period (seconds).
+	CheckPeriod int `json:"check_period"`
+	// Maximum number of topics of every category to process in one pass.
+	BlockSize int `json:"block_size"`
+	// Messages older than this number of days are deleted or anonymized. 0 keeps messages forever.
+	Days int `json:"days"`
+	// What to do with old messages: "delete" (default) or "anonymize".
+	Action string `json:"action"`
+	// Overrides of the policy by topic category: "p2p", "grp" or "chn".
+	Categories map[string]msgRetentionPolicyConfig `json:"categories"`
+}
+
+// Cold storage tiering config.
+type tieringConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to check for messages to move to cold storage (seconds).
+	CheckPeriod int `json:"check_period"`
+	// Maximum number of topics to process in one pass.
+	BlockSize int `json:"block_size"`
+	// Maximum number of messages in one blob.
+	BatchSize int `json:"batch_size"`
+	// Messages older than this number of days are moved to cold storage.
+	Days int `json:"days"`
+	// Number of blobs cached in memory.
+	CacheSize int `json:"cache_size"`
+	// Config of the S3 bucket.
+	S3 json.RawMessage `json:"s3"`
+}
+
+// Cache of frequent reads of the store.
+type cacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// Time to keep cached objects (seconds).
+	TTL int `json:"ttl"`
+	// Number of the latest messages of every topic to cache, 0 disables caching of messages.
+	Messages int `json:"messages"`
+	// Config of Redis.
+	Redis json.RawMessage `json:"redis"`
+}
+
+// Message retention policy of a topic category.
+type msgRetentionPolicyConfig struct {
+	Days int `json:"days"`
+	// Action of the server-wide policy is used when empty.
+	Action string `json:"action"`
+}
+
+// Reports of messages and users config.
+type reportsConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often to check for reports not yet posted to the 'rpt' topic (seconds).
+	CheckPeriod int `json:"check_period"`
+	// Maximum number of reports to post in one pass.
+	BlockSize int `json:"block_size"`
+}
+
+// Audit log config.
+type auditConfig struct {
+	Enabled bool `json:"enabled"`
+	// Records older than this are deleted (days); 0 to keep records forever.
+	RetentionDays int `json:"retention_days"`
+	// How often to delete expired records (seconds).
+	CheckPeriod int `json:"check_period"`
+}
+
+// Records of user sessions config.
+type userSessionsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Records of sessions inactive for this long are deleted (hours).
+	MaxIdle int `json:"max_idle"`
+	// Maximum number of records per user, the least recently active are deleted.
+	MaxCount int `json:"max_count"`
+}
+
 // Large file handler config.
 type mediaConfig struct {
 	// The name of the handler to use for file uploads.
@@ -249,6 +518,22 @@ type mediaConfig struct {
 	GcBlockSize int `json:"gc_block_size"`
 	// Individual handler config params to pass to handlers unchanged.
 	Handlers map[string]json.RawMessage `json:"handlers"`
+	// Resumable uploads.
+	Resumable *resumableConfig `json:"resumable"`
+	// Generation of thumbnails and other variants of uploaded media.
+	Variants *variantsConfig `json:"variants"`
+	// Malware scanning of uploaded files.
+	Scan json.RawMessage `json:"scan"`
+	// Storage quotas of users and topics.
+	Quota *quotaConfig `json:"quota"`
+	// Extraction of duration and waveform of audio files.
+	Audio *audioConfig `json:"audio"`
+}
+
+type variantsConfig struct {
+	Enabled bool `json:"enabled"`
+	// Configuration of the pipeline to pass unchanged.
+	Config json.RawMessage `json:"config"`
 }
 
 // Contentx of the configuration file
@@ -267,6 +552,10 @@ type configType struct {
 	// If true, do not attempt to negotiate websocket per message compression (RFC 7692.4).
 	// It should be disabled (set to true) if you are using MSFT IIS as a reverse proxy.
 	WSCompressionDisabled bool `json:"ws_compression_disabled"`
+	// Websocket compression and batching parameters.
+	Websocket *wsConfig `json:"websocket"`
+	// Resumable delivery of events to websocket clients.
+	Outbox *outboxConfig `json:"outbox"`
 	// Address:port to listen for gRPC clients. If blank gRPC support will not be initialized.
 	// Could be overridden from the command line with --grpc_listen.
 	GrpcListen string `json:"grpc_listen"`
@@ -282,6 +571,10 @@ type configType struct {
 	// Maximum message size allowed from client. Intended to prevent malicious client from sending
 	// very large files inband (does not affect out of band uploads).
 	MaxMessageSize int `json:"max_message_size"`
+	// Maximum size of a {data} message after server-side transforms (link previews, translations, etc).
+	// If a transform makes the message larger, the message is delivered without it.
+	// Default is max_message_size.
+	MaxOutboundMessageSize int `json:"max_outbound_message_size"`
 	// Maximum number of group topic subscribers.
 	MaxSubscriberCount int `json:"max_subscriber_count"`
 	// Masked tags namespaces: tags immutable on User (mask), mutable on Topic only within the mask.
@@ -290,10 +583,25 @@ type configType struct {
 	AliasTagNamespace string `json:"alias_tag"`
 	// Maximum number of indexable tags.
 	MaxTagCount int `json:"max_tag_count"`
+	// Maximum number of pinned messages per topic.
+	MaxPinnedCount int `json:"max_pinned_count"`
+	// Read and received notifications are not forwarded to subscribers of group topics
+	// with more subscribers than this. 0 means no limit.
+	MaxReceiptFanout int `json:"max_receipt_fanout"`
+	// Topics with more attached sessions than this deliver data messages in parallel shards
+	// of this size. 0 disables sharding.
+	FanoutShardSize int `json:"fanout_shard_size"`
 	// If true, ordinary users cannot delete their accounts.
 	PermanentAccounts bool `json:"permanent_accounts"`
+	// If true, hard-deleting an account also erases all data derived from the user, such as content of
+	// user's messages in other users' topics and files.
+	EraseDeletedAccounts bool `json:"erase_deleted_accounts"`
 	// URL path for exposing runtime stats. Disabled if the path is blank.
 	ExpvarPath string `json:"expvar"`
+	// Format and levels of logging.
+	Logging *logs.Config `json:"logging"`
+	// URL path for exposing Prometheus metrics. Disabled if the path is blank.
+	MetricsPath string `json:"metrics"`
 	// URL path for internal server status. Disabled if the path is blank.
 	ServerStatusPath string `json:"server_status"`
 	// Take IP address of the client from HTTP header 'X-Forwarded-For'.
@@ -319,16 +627,49 @@ type configType struct {
 	MsgDeleteAge int `json:"msg_delete_age"`
 
 	// Configs for subsystems
-	Cluster   json.RawMessage             `json:"cluster_config"`
-	Plugin    json.RawMessage             `json:"plugins"`
-	Store     json.RawMessage             `json:"store_config"`
-	Push      json.RawMessage             `json:"push"`
-	TLS       json.RawMessage             `json:"tls"`
-	Auth      map[string]json.RawMessage  `json:"auth_config"`
-	Validator map[string]*validatorConfig `json:"acc_validation"`
-	AccountGC *accountGcConfig            `json:"acc_gc_config"`
-	Media     *mediaConfig                `json:"media"`
-	WebRTC    json.RawMessage             `json:"webrtc"`
+	Cluster         json.RawMessage             `json:"cluster_config"`
+	Plugin          json.RawMessage             `json:"plugins"`
+	Store           json.RawMessage             `json:"store_config"`
+	Push            json.RawMessage             `json:"push"`
+	PushTemplates   json.RawMessage             `json:"push_templates"`
+	TLS             json.RawMessage             `json:"tls"`
+	Auth            map[string]json.RawMessage  `json:"auth_config"`
+	Validator       map[string]*validatorConfig `json:"acc_validation"`
+	AccountGC       *accountGcConfig            `json:"acc_gc_config"`
+	EncryptionCheck *encryptionCheckConfig      `json:"encryption_check"`
+	ScheduledMsg    *scheduledMsgConfig         `json:"scheduled_msg"`
+	MsgTTL          *msgTTLConfig               `json:"msg_ttl"`
+	MsgRetention    *msgRetentionConfig         `json:"msg_retention"`
+	Tenants         *tenantsConfig              `json:"tenants"`
+	Metering        *meteringConfig             `json:"metering"`
+	Tiering         *tieringConfig              `json:"tiering"`
+	Cache           *cacheConfig                `json:"cache"`
+	Reports         *reportsConfig              `json:"reports"`
+	Audit           *auditConfig                `json:"audit"`
+	Takeout         *takeoutConfig              `json:"takeout"`
+	RateLimit       *rateLimitConfig            `json:"rate_limit"`
+	Tracing         *tracingConfig              `json:"tracing"`
+	Diagnostics     *diagnosticsConfig          `json:"diagnostics"`
+	Maintenance     *maintenanceConfig          `json:"maintenance"`
+	Admin           *adminConfig                `json:"admin"`
+	Typing          *typingConfig               `json:"typing"`
+	Contacts        *contactsConfig             `json:"contacts"`
+	UserSessions    *userSessionsConfig         `json:"user_sessions"`
+	Media           *mediaConfig                `json:"media"`
+	LinkPreview     json.RawMessage             `json:"link_preview"`
+	Webhooks        json.RawMessage             `json:"webhooks"`
+	Export          json.RawMessage             `json:"export"`
+	Journal         json.RawMessage             `json:"journal"`
+	Matrix          json.RawMessage             `json:"matrix"`
+	Xmpp            *xmppConfig                 `json:"xmpp"`
+	Mqtt            *mqttConfig                 `json:"mqtt"`
+	EmailGateway    json.RawMessage             `json:"email_gateway"`
+	GrpcFirehose    json.RawMessage             `json:"grpc_firehose"`
+	Translation     json.RawMessage             `json:"translation"`
+	Moderation      json.RawMessage             `json:"moderation"`
+	Registration    json.RawMessage             `json:"registration"`
+	NetworkACL      json.RawMessage             `json:"network_acl"`
+	WebRTC          json.RawMessage             `json:"webrtc"`
 }
 
 func main() {
@@ -387,6 +728,10 @@ func main() {
 		file.Close()
 	}
 
+	if err := logs.Configure(os.Stderr, config.Logging); err != nil {
+		logs.Err.Fatal("Invalid logging config: ", err)
+	}
+
 	if *listenOn != "" {
 		config.Listen = *listenOn
 	}
@@ -400,6 +745,7 @@ func main() {
 		evpath = config.ExpvarPath
 	}
 	statsInit(mux, evpath)
+	metricsInit(mux, config.MetricsPath)
 	statsRegisterInt("Version")
 	decVersion := base10Version(parseVersion(buildstamp))
 	if decVersion <= 0 {
@@ -448,6 +794,19 @@ func main() {
 	}()
 	statsRegisterDbStats()
 
+	// Cache of frequent reads of the store.
+	if config.Cache != nil && config.Cache.Enabled {
+		if config.Cache.Messages < 0 {
+			logs.Err.Fatalln("Invalid cache config")
+		}
+		rc, err := cache.NewRedis(config.Cache.Redis, config.Cache.TTL)
+		if err != nil {
+			logs.Err.Fatalln("Failed to initialize cache:", err)
+		}
+		store.InitCache(rc, config.Cache.Messages)
+		defer rc.Close()
+	}
+
 	// API key signing secret
 	globals.apiKeySalt = config.APIKeySalt
 
@@ -574,6 +933,10 @@ func main() {
 	if globals.maxMessageSize <= 0 {
 		globals.maxMessageSize = defaultMaxMessageSize
 	}
+	globals.maxOutboundMessageSize = config.MaxOutboundMessageSize
+	if globals.maxOutboundMessageSize <= 0 {
+		globals.maxOutboundMessageSize = int(globals.maxMessageSize)
+	}
 	// Maximum number of group topic subscribers
 	globals.maxSubscriberCount = config.MaxSubscriberCount
 	if globals.maxSubscriberCount <= 1 {
@@ -584,8 +947,36 @@ func main() {
 	if globals.maxTagCount <= 0 {
 		globals.maxTagCount = defaultMaxTagCount
 	}
+	// Maximum number of pinned messages per topic
+	globals.maxPinnedCount = config.MaxPinnedCount
+	if globals.maxPinnedCount <= 0 {
+		globals.maxPinnedCount = defaultMaxPinnedCount
+	}
+	// Limit of fanout of read receipts
+	globals.maxReceiptFanout = config.MaxReceiptFanout
+	// Sharding of fanout in topics with many attached sessions
+	globals.fanoutShardSize = config.FanoutShardSize
+	// Rate limiting and aggregation of typing notifications
+	if config.Typing != nil {
+		globals.typingMinInterval = time.Millisecond * time.Duration(config.Typing.MinInterval)
+		globals.typingAggregateOver = config.Typing.AggregateOver
+		globals.typingWindow = time.Millisecond * time.Duration(config.Typing.Window)
+	}
+	// Contact discovery
+	globals.maxContactHashes = defaultMaxContactHashes
+	if config.Contacts != nil {
+		if config.Contacts.MaxHashes > 0 {
+			globals.maxContactHashes = config.Contacts.MaxHashes
+		}
+		globals.contactPrefixLength = config.Contacts.PrefixLength
+		if globals.contactPrefixLength != 0 && (globals.contactPrefixLength < minContactPrefixLength ||
+			globals.contactPrefixLength > maxContactPrefixLength) {
+			logs.Err.Fatal("Invalid length of contact hash prefixes ", globals.contactPrefixLength)
+		}
+	}
 	// If account deletion is disabled.
 	globals.permanentAccounts = config.PermanentAccounts
+	globals.eraseDeletedAccounts = config.EraseDeletedAccounts
 
 	globals.useXForwardedFor = config.UseXForwardedFor
 	globals.defaultCountryCode = config.DefaultCountryCode
@@ -593,6 +984,8 @@ func main() {
 		globals.defaultCountryCode = defaultCountryCode
 	}
 
+	globals.tenantsEnabled = config.Tenants != nil && config.Tenants.Enabled
+
 	// Default access mode for P2P: with/without the D permission.
 	globals.typesModeCP2P = types.ModeCP2P
 	if config.P2PDeleteEnabled {
@@ -615,6 +1008,12 @@ func main() {
 
 	// Websocket compression.
 	globals.wsCompression = !config.WSCompressionDisabled
+	if err := wsInit(config.Websocket); err != nil {
+		logs.Err.Fatal(err)
+	}
+	if err := outboxInit(config.Outbox); err != nil {
+		logs.Err.Fatal(err)
+	}
 
 	if config.Media != nil {
 		if config.Media.UseHandler == "" {
@@ -638,6 +1037,39 @@ func main() {
 					logs.Info.Println("Stopped files garbage collector")
 				}()
 			}
+			if config.Media.Resumable != nil && config.Media.Resumable.Enabled {
+				if globals.resumableUploads, err = newResumableUploads(config.Media.Resumable); err != nil {
+					logs.Err.Fatalln("Failed to init resumable uploads:", err)
+				}
+				stopResumableExpiration := globals.resumableUploads.runExpiration()
+				defer func() {
+					stopResumableExpiration <- true
+					logs.Info.Println("Stopped expiration of resumable uploads")
+				}()
+			}
+			if config.Media.Variants != nil && config.Media.Variants.Enabled {
+				if globals.mediaVariants, err = variants.New(config.Media.Variants.Config); err != nil {
+					logs.Err.Fatalln("Failed to init media variants:", err)
+				}
+				defer func() {
+					globals.mediaVariants.Stop()
+					logs.Info.Println("Stopped media variants pipeline")
+				}()
+			}
+			if config.Media.Audio != nil && config.Media.Audio.Enabled {
+				if globals.audioAnalyzer, err = audio.New(config.Media.Audio.Config); err != nil {
+					logs.Err.Fatalln("Failed to init audio analyzer:", err)
+				}
+			}
+			if config.Media.Quota != nil {
+				globals.userMediaQuota = config.Media.Quota.User
+				globals.topicMediaQuota = config.Media.Quota.Topic
+			}
+			if scanner, err := scan.Init(config.Media.Scan); err != nil {
+				logs.Err.Fatalln("Failed to init malware scanner:", err)
+			} else if scanner != "" {
+				logs.Info.Println("Malware scanner:", scanner)
+			}
 		}
 	}
 
@@ -656,6 +1088,19 @@ func main() {
 		}()
 	}
 
+	// Periodic health check of message encryption.
+	if config.EncryptionCheck != nil && config.EncryptionCheck.Enabled && store.IsEncryptionEnabled() {
+		onFailure, err := parseEncCheckOnFailure(config.EncryptionCheck.OnFailure)
+		if err != nil || config.EncryptionCheck.CheckPeriod <= 0 {
+			logs.Err.Fatalln("Invalid encryption check config", err)
+		}
+		stopEncCheck := encryptionHealthCheck(time.Second*time.Duration(config.EncryptionCheck.CheckPeriod), onFailure)
+		defer func() {
+			stopEncCheck <- true
+			logs.Info.Println("Stopped encryption health check")
+		}()
+	}
+
 	pushHandlers, err := push.Init(config.Push)
 	if err != nil {
 		logs.Err.Fatal("Failed to initialize push notifications:", err)
@@ -666,6 +1111,81 @@ func main() {
 	}()
 	logs.Info.Println("Push handlers configured:", pushHandlers)
 
+	if ok, err := push.InitTemplates(config.PushTemplates); err != nil {
+		logs.Err.Fatal("Failed to initialize push templates:", err)
+	} else if ok {
+		logs.Info.Println("Push templates enabled")
+	}
+
+	if provider, err := translate.Init(config.Translation); err != nil {
+		logs.Err.Fatal("Failed to initialize translations:", err)
+	} else if provider != "" {
+		logs.Info.Println("Translation provider:", provider)
+	}
+
+	if enabled, err := linkpreview.Init(config.LinkPreview); err != nil {
+		logs.Err.Fatal("Failed to initialize link previews:", err)
+	} else if enabled {
+		registerMsgTransform("linkpreview", linkPreviewTransform)
+		defer func() {
+			linkpreview.Stop()
+			logs.Info.Println("Stopped link previews")
+		}()
+	}
+
+	if enabled, err := webhooks.Init(config.Webhooks); err != nil {
+		logs.Err.Fatal("Failed to initialize webhooks:", err)
+	} else if enabled {
+		logs.Info.Println("Webhooks enabled")
+		defer func() {
+			webhooks.Stop()
+			logs.Info.Println("Stopped webhooks")
+		}()
+	}
+
+	if enabled, err := export.Init(config.Export); err != nil {
+		logs.Err.Fatal("Failed to initialize event export:", err)
+	} else if enabled {
+		logs.Info.Println("Event export enabled")
+		defer func() {
+			export.Stop()
+			logs.Info.Println("Stopped event export")
+		}()
+	}
+
+	var nodeName string
+	if globals.cluster != nil {
+		nodeName = globals.cluster.thisNodeName
+	}
+	if enabled, err := journal.Init(config.Journal, nodeName); err != nil {
+		logs.Err.Fatal("Failed to initialize compliance journal:", err)
+	} else if enabled {
+		logs.Info.Println("Compliance journal enabled")
+		defer func() {
+			journal.Stop()
+			logs.Info.Println("Stopped compliance journal")
+		}()
+	}
+
+	if stopTracing, err := tracingInit(config.Tracing, nodeName); err != nil {
+		logs.Err.Fatalln(err)
+	} else if stopTracing != nil {
+		defer func() {
+			stopTracing()
+			logs.Info.Println("Stopped tracing")
+		}()
+	}
+
+	if enabled, err := matrix.Init(config.Matrix); err != nil {
+		logs.Err.Fatal("Failed to initialize Matrix bridge:", err)
+	} else if enabled {
+		logs.Info.Println("Matrix bridge enabled")
+		defer func() {
+			matrix.Stop()
+			logs.Info.Println("Stopped Matrix bridge")
+		}()
+	}
+
 	if err = initVideoCalls(config.WebRTC); err != nil {
 		logs.Err.Fatal("Failed to init video calls: %w", err)
 	}
@@ -680,6 +1200,182 @@ func main() {
 		globals.cluster.start()
 	}
 
+	// Publishing of scheduled messages.
+	if config.ScheduledMsg != nil && config.ScheduledMsg.Enabled {
+		if config.ScheduledMsg.CheckPeriod <= 0 || config.ScheduledMsg.BlockSize <= 0 ||
+			config.ScheduledMsg.MaxDelay <= 0 {
+			logs.Err.Fatalln("Invalid scheduled messages config")
+		}
+		globals.schedMsgMaxDelay = time.Hour * time.Duration(config.ScheduledMsg.MaxDelay)
+		stopScheduler := scheduledMsgRunPublisher(time.Second*time.Duration(config.ScheduledMsg.CheckPeriod),
+			config.ScheduledMsg.BlockSize)
+		defer func() {
+			stopScheduler <- true
+			logs.Info.Println("Stopped publisher of scheduled messages")
+		}()
+	}
+
+	// Deletion of expired messages.
+	if config.MsgTTL != nil && config.MsgTTL.Enabled {
+		if config.MsgTTL.CheckPeriod <= 0 || config.MsgTTL.BlockSize <= 0 || config.MsgTTL.MinTTL <= 0 {
+			logs.Err.Fatalln("Invalid message TTL config")
+		}
+		globals.msgTTLMin = config.MsgTTL.MinTTL
+		stopReaper := msgTTLRunReaper(time.Second*time.Duration(config.MsgTTL.CheckPeriod),
+			config.MsgTTL.BlockSize)
+		defer func() {
+			stopReaper <- true
+			logs.Info.Println("Stopped reaper of expired messages")
+		}()
+	}
+
+	// Deletion of messages past the retention period.
+	// Topic categories with a retention policy: their messages are not moved to cold storage.
+	var retentionCats []string
+	if config.MsgRetention != nil && config.MsgRetention.Enabled {
+		if config.MsgRetention.CheckPeriod <= 0 || config.MsgRetention.BlockSize <= 0 {
+			logs.Err.Fatalln("Invalid message retention config")
+		}
+		policies, err := msgRetentionPolicies(config.MsgRetention)
+		if err != nil {
+			logs.Err.Fatalln("Invalid message retention config:", err)
+		}
+		for cat := range policies {
+			retentionCats = append(retentionCats, cat)
+		}
+		stopRetention := msgRetentionRunReaper(time.Second*time.Duration(config.MsgRetention.CheckPeriod),
+			config.MsgRetention.BlockSize, policies)
+		defer func() {
+			stopRetention <- true
+			logs.Info.Println("Stopped reaper of old messages")
+		}()
+	}
+
+	// Usage metering.
+	if config.Metering != nil && config.Metering.Enabled {
+		if config.Metering.FlushPeriod <= 0 {
+			logs.Err.Fatalln("Invalid metering config")
+		}
+		if err := meterValidateLimits(config.Metering.Limits); err != nil {
+			logs.Err.Fatalln("Invalid metering config:", err)
+		}
+		if export := config.Metering.Export; export != nil {
+			if export.Format == "" {
+				export.Format = "csv"
+			}
+			if export.Path == "" || export.Period <= 0 || (export.Format != "csv" && export.Format != "json") {
+				logs.Err.Fatalln("Invalid usage export config")
+			}
+		}
+		globals.meteringEnabled = true
+		globals.meterLimits = config.Metering.Limits
+		stopMetering := meteringRunFlusher(time.Second*time.Duration(config.Metering.FlushPeriod),
+			config.Metering.Export)
+		defer func() {
+			stopMetering <- true
+			<-stopMetering
+			logs.Info.Println("Stopped usage metering")
+		}()
+	}
+
+	// Moving old messages to cold storage.
+	if config.Tiering != nil && config.Tiering.Enabled {
+		if config.Tiering.CheckPeriod <= 0 || config.Tiering.BlockSize <= 0 || config.Tiering.BatchSize <= 0 ||
+			config.Tiering.Days <= 0 {
+			logs.Err.Fatalln("Invalid tiering config")
+		}
+		cold, err := tiering.NewS3(config.Tiering.S3, config.Tiering.CacheSize)
+		if err != nil {
+			logs.Err.Fatalln("Failed to initialize cold storage:", err)
+		}
+		store.InitColdStorage(cold)
+		stopTiering := tieringRunMover(time.Second*time.Duration(config.Tiering.CheckPeriod),
+			time.Duration(config.Tiering.Days)*24*time.Hour, retentionCats, config.Tiering.BlockSize,
+			config.Tiering.BatchSize)
+		defer func() {
+			stopTiering <- true
+			logs.Info.Println("Stopped mover of old messages to cold storage")
+		}()
+	}
+
+	// Reports of messages and users.
+	if config.Reports != nil && config.Reports.Enabled {
+		if config.Reports.CheckPeriod <= 0 || config.Reports.BlockSize <= 0 {
+			logs.Err.Fatalln("Invalid reports config")
+		}
+		globals.reportsEnabled = true
+		stopPoster := reportsRunPoster(time.Second*time.Duration(config.Reports.CheckPeriod),
+			config.Reports.BlockSize)
+		defer func() {
+			stopPoster <- true
+			logs.Info.Println("Stopped poster of reports")
+		}()
+	}
+
+	// Audit log of security-relevant events.
+	if config.Audit != nil && config.Audit.Enabled {
+		if config.Audit.RetentionDays < 0 || (config.Audit.RetentionDays > 0 && config.Audit.CheckPeriod <= 0) {
+			logs.Err.Fatalln("Invalid audit log config")
+		}
+		globals.auditEnabled = true
+		if config.Audit.RetentionDays > 0 {
+			stopReaper := auditRunReaper(time.Second*time.Duration(config.Audit.CheckPeriod),
+				time.Hour*24*time.Duration(config.Audit.RetentionDays))
+			defer func() {
+				stopReaper <- true
+				logs.Info.Println("Stopped reaper of audit log")
+			}()
+		}
+	}
+
+	if globals.rateLimiter, err = newRateLimiter(config.RateLimit); err != nil {
+		logs.Err.Fatalln(err)
+	} else if globals.rateLimiter != nil {
+		stopRateLimiter := globals.rateLimiter.run()
+		defer func() {
+			stopRateLimiter <- true
+			logs.Info.Println("Stopped rate limiter")
+		}()
+	}
+
+	diag = diagnosticsInit(config.Diagnostics)
+	stopDiagnostics := diag.run()
+	defer func() {
+		stopDiagnostics <- true
+		logs.Info.Println("Stopped diagnostics")
+	}()
+
+	if config.Maintenance != nil && config.Maintenance.Enabled {
+		maintenanceSet(true)
+	}
+
+	// Records of users' sessions.
+	if config.UserSessions != nil && config.UserSessions.Enabled {
+		if config.UserSessions.MaxIdle <= 0 || config.UserSessions.MaxCount <= 0 {
+			logs.Err.Fatalln("Invalid user sessions config")
+		}
+		globals.sessRecordMaxIdle = time.Hour * time.Duration(config.UserSessions.MaxIdle)
+		globals.sessRecordMaxCount = config.UserSessions.MaxCount
+	}
+
+	// Exports of users' data.
+	if config.Takeout != nil && config.Takeout.Enabled {
+		if config.Takeout.PeriodDays <= 0 || config.Takeout.ExpiresHours <= 0 || config.Takeout.QueueSize <= 0 {
+			logs.Err.Fatalln("Invalid takeout config")
+		}
+		if store.Store.GetMediaHandler() == nil {
+			logs.Err.Fatalln("Takeouts require a media handler")
+		}
+		globals.takeoutPeriod = time.Hour * 24 * time.Duration(config.Takeout.PeriodDays)
+		globals.takeoutExpires = time.Hour * time.Duration(config.Takeout.ExpiresHours)
+		globals.takeoutQueue = make(chan *types.Takeout, config.Takeout.QueueSize)
+		stopWorker := takeoutRunWorker(globals.takeoutQueue)
+		defer func() {
+			stopWorker <- true
+			logs.Info.Println("Stopped takeout worker")
+		}()
+	}
+
 	tlsConfig, err := parseTLSConfig(*tlsEnabled, config.TLS)
 	if err != nil {
 		logs.Err.Fatalln(err)
@@ -688,6 +1384,26 @@ func main() {
 	// Initialize plugins.
 	pluginsInit(config.Plugin)
 
+	// Initialize content moderation after plugins: filters may use them.
+	if filters, err := moderation.Init(config.Moderation); err != nil {
+		logs.Err.Fatal("Failed to initialize content moderation:", err)
+	} else if len(filters) > 0 {
+		logs.Info.Println("Content moderation filters:", filters)
+	}
+
+	if guards, err := regguard.Init(config.Registration); err != nil {
+		logs.Err.Fatal("Failed to initialize registration guards:", err)
+	} else if len(guards) > 0 {
+		logs.Info.Println("Registration guards:", guards)
+	}
+
+	if enabled, err := netacl.Init(config.NetworkACL); err != nil {
+		logs.Err.Fatal("Failed to initialize network access control:", err)
+	} else if enabled {
+		netAclInit()
+		logs.Info.Println("Network access control enabled")
+	}
+
 	// Initialize users cache
 	usersInit()
 
@@ -695,9 +1411,37 @@ func main() {
 	if *listenGrpc == "" {
 		*listenGrpc = config.GrpcListen
 	}
+	if globals.firehose, err = firehoseInit(config.GrpcFirehose); err != nil {
+		logs.Err.Fatal(err)
+	}
 	if globals.grpcServer, err = serveGrpc(*listenGrpc, config.GrpcKeepalive, tlsConfig); err != nil {
 		logs.Err.Fatal(err)
 	}
+	if globals.grpcServer == nil && globals.firehose != nil {
+		logs.Warn.Println("Firehose disabled: gRPC is not configured")
+		globals.firehose = nil
+	}
+
+	// Set up XMPP gateway, if one is configured
+	if globals.xmppListener, err = serveXmpp(config.Xmpp, tlsConfig); err != nil {
+		logs.Err.Fatal(err)
+	}
+
+	// Set up MQTT gateway, if one is configured
+	if globals.mqttListener, err = serveMqtt(config.Mqtt, tlsConfig); err != nil {
+		logs.Err.Fatal(err)
+	}
+
+	// Set up email gateway, if one is configured
+	if enabled, err := mailgate.Init(config.EmailGateway, mailgateHandler{}, tlsConfig); err != nil {
+		logs.Err.Fatal("Failed to initialize email gateway:", err)
+	} else if enabled {
+		logs.Info.Println("Email gateway enabled")
+		defer func() {
+			mailgate.Stop()
+			logs.Info.Println("Stopped email gateway")
+		}()
+	}
 
 	// Serve static content from the directory in -static_data flag if that's
 	// available, otherwise assume '<current-dir>/static'. The content is served at
@@ -778,19 +1522,47 @@ func main() {
 	mux.HandleFunc(config.ApiPath+"v0/channels", serveWebSocket)
 	// Handle long polling clients. Enable compression.
 	mux.Handle(config.ApiPath+"v0/channels/lp", gh.CompressHandler(http.HandlerFunc(serveLongPoll)))
+	// Handle Server-Sent Events clients. The stream must not be buffered by compression.
+	mux.HandleFunc(config.ApiPath+"v0/channels/sse", serveSSE)
 	if config.Media != nil {
 		// Handle uploads of large files.
 		mux.Handle(config.ApiPath+"v0/file/u/", gh.CompressHandler(http.HandlerFunc(largeFileReceiveHTTP)))
 		// Serve large files.
 		mux.Handle(config.ApiPath+"v0/file/s/", gh.CompressHandler(http.HandlerFunc(largeFileServeHTTP)))
+		if globals.resumableUploads != nil {
+			// Handle resumable uploads.
+			mux.Handle(config.ApiPath+"v0/file/r/", gh.CompressHandler(http.HandlerFunc(largeFileResumableHTTP)))
+		}
 		logs.Info.Println("Large media handling enabled", config.Media.UseHandler)
 	}
+	if globals.turn != nil {
+		// Time-limited TURN credentials.
+		mux.HandleFunc(config.ApiPath+"v0/turn", serveTurnCredentials)
+	}
+	// SAML single sign-on.
+	samlServe(mux, config.ApiPath+"v0/saml/")
+	// Incoming webhooks.
+	inWebhooksServe(mux, config.ApiPath+"v0/hooks/")
+	// Application service API of the Matrix bridge.
+	matrixServe(mux, config.ApiPath+"v0/matrix")
+	// Delivery reports of SMS notifications.
+	if h := sms.StatusHandler(); h != nil {
+		mux.Handle(config.ApiPath+"v0/sms/", h)
+		logs.Info.Printf("SMS delivery reports served at '%s'", config.ApiPath+"v0/sms/")
+	}
 
 	if staticMountPoint != "/" {
 		// Serve json-formatted 404 for all other URLs
 		mux.HandleFunc("/", serve404)
 	}
 
+	// Admin API is served on a separate listener.
+	if adminServer, err := adminServe(config.Admin); err != nil {
+		logs.Err.Fatal("Failed to start admin API:", err)
+	} else if adminServer != nil {
+		defer adminServer.Close()
+	}
+
 	if err = listenAndServe(config.Listen, mux, tlsConfig, signalHandler()); err != nil {
 		logs.Err.Fatal(err)
 	}
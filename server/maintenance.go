@@ -0,0 +1,101 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Read-only maintenance mode, e.g. for database migrations. While the mode
+ *    is on, the node rejects requests which change data with
+ *    {ctrl code=503 text="maintenance"}: publishing, editing and deleting
+ *    messages, reactions and votes, changes of topics, subscriptions and
+ *    accounts, creation of topics and uploads of files. Logins, reads,
+ *    subscriptions to existing topics and notifications are allowed. Data
+ *    written by the server itself, e.g. by scheduled messages, is not
+ *    affected.
+ *
+ *    The mode is switched on in the config file or at runtime with
+ *    POST /admin/v0/maintenance. Requests are checked by the node the client
+ *    is connected to, so the mode is switched on every node of a cluster.
+ *
+ *    A single group topic is locked by freezing it with {set desc={frozen}}.
+ *    Only managers may publish to a frozen topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+// Maintenance mode config.
+type maintenanceConfig struct {
+	// Start in maintenance mode.
+	Enabled bool `json:"enabled"`
+}
+
+// maintenanceSet switches maintenance mode on or off. Returns false if the mode is unchanged.
+func maintenanceSet(enabled bool) bool {
+	if !globals.maintenance.CompareAndSwap(!enabled, enabled) {
+		return false
+	}
+	if enabled {
+		logs.Info.Println("maintenance: read-only mode on")
+	} else {
+		logs.Info.Println("maintenance: read-only mode off")
+	}
+	return true
+}
+
+// maintenanceRejects checks if the client request changes data and must be rejected in maintenance mode.
+func maintenanceRejects(msg *ClientComMessage) bool {
+	if !globals.maintenance.Load() {
+		return false
+	}
+	switch {
+	case msg.Pub != nil, msg.Set != nil, msg.Del != nil, msg.Acc != nil, msg.React != nil, msg.Vote != nil,
+		msg.Fwd != nil, msg.Report != nil:
+		return true
+	case msg.Sub != nil:
+		// New topics cannot be created.
+		return strings.HasPrefix(msg.Sub.Topic, "new") || strings.HasPrefix(msg.Sub.Topic, "nch")
+	}
+	return false
+}
+
+// ErrMaintenanceReply the server is in read-only maintenance mode in response to a client request (503).
+func ErrMaintenanceReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
+	return ErrMaintenance(msg.Id, msg.Original, ts, msg.Timestamp)
+}
+
+// ErrMaintenance the server is in read-only maintenance mode with explicit server and incoming request
+// timestamps (503).
+func ErrMaintenance(id, topic string, serverTs, incomingReqTs time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        id,
+			Code:      http.StatusServiceUnavailable, // 503
+			Text:      "maintenance",
+			Topic:     topic,
+			Timestamp: serverTs,
+		},
+		Id:        id,
+		Timestamp: incomingReqTs,
+	}
+}
+
+// ErrTopicFrozenReply the topic is frozen and the user may not publish in response to a client request (423).
+func ErrTopicFrozenReply(msg *ClientComMessage, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        msg.Id,
+			Code:      http.StatusLocked, // 423
+			Text:      "frozen",
+			Topic:     msg.Original,
+			Timestamp: ts,
+		},
+		Id:        msg.Id,
+		Timestamp: msg.Timestamp,
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMaintenanceRejects(t *testing.T) {
+	if !maintenanceSet(true) {
+		t.Fatal("Maintenance mode is not switched on")
+	}
+	defer maintenanceSet(false)
+	if maintenanceSet(true) {
+		t.Error("Maintenance mode switched on twice")
+	}
+
+	for _, msg := range []*ClientComMessage{
+		{Pub: &MsgClientPub{Topic: "grpTest"}},
+		{Set: &MsgClientSet{Topic: "grpTest"}},
+		{Del: &MsgClientDel{Topic: "grpTest"}},
+		{Acc: &MsgClientAcc{User: "new"}},
+		{Sub: &MsgClientSub{Topic: "new123"}},
+	} {
+		if !maintenanceRejects(msg) {
+			t.Errorf("Write %+v is not rejected", msg)
+		}
+	}
+	for _, msg := range []*ClientComMessage{
+		{Login: &MsgClientLogin{Scheme: "basic"}},
+		{Get: &MsgClientGet{Topic: "grpTest"}},
+		{Sub: &MsgClientSub{Topic: "grpTest"}},
+		{Note: &MsgClientNote{Topic: "grpTest"}},
+	} {
+		if maintenanceRejects(msg) {
+			t.Errorf("Read %+v is rejected", msg)
+		}
+	}
+}
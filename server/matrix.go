@@ -0,0 +1,518 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Bridge of group topics to Matrix rooms. The server operator links a
+ *    topic to a room through the admin API. Then:
+ *
+ *    - Messages published to the topic are relayed to the room on behalf of
+ *      puppet Matrix users which represent Tinode users (double puppeting).
+ *      Images and files sent in-band are uploaded to the media repository of
+ *      the homeserver.
+ *    - Messages of Matrix users in the room are posted to the topic by the
+ *      bot user of the bridge. They are marked with head.matrix={sender,
+ *      name, event} so clients can show the real sender. Media is posted as
+ *      Drafty attachments referencing the homeserver.
+ *    - Puppets join the room when Tinode users join the topic and leave it
+ *      when they leave. Joins and leaves of Matrix users are posted to the
+ *      topic as messages of the bot with head.matrix.membership.
+ *
+ *    Messages without a session are published by the master node of the
+ *    topic: messages of Matrix users received by other cluster nodes are
+ *    dropped.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/matrix"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Message header with the origin of a message relayed from Matrix.
+	msgHeadMatrix = "matrix"
+
+	// Rooms of topics are reloaded after this time.
+	matrixCacheTTL = time.Minute
+	// Expired entries are purged from the cache when there are this many of them.
+	matrixCachePurgeSize = 4096
+	// Maximum number of remembered display names of Matrix users.
+	maxMatrixNames = 4096
+)
+
+// Rooms bridged to topics by topic name, empty if the topic is not bridged.
+var matrixRoomCache struct {
+	sync.Mutex
+	entries map[string]*matrixRoomEntry
+}
+
+type matrixRoomEntry struct {
+	room     string
+	loadedAt time.Time
+}
+
+// Puppets joined to rooms, keyed by "<puppet> <room>".
+var matrixJoined sync.Map
+
+// Display names of Matrix users learned from membership events.
+var matrixNames struct {
+	sync.Mutex
+	names map[string]string
+}
+
+// matrixServe adds the application service API called by the homeserver to the mux if the bridge is enabled.
+func matrixServe(mux *http.ServeMux, path string) {
+	mc := matrix.Get()
+	if mc == nil {
+		return
+	}
+	mux.Handle(path+"/_matrix/", http.StripPrefix(path, mc.Handler(matrixEvent)))
+	logs.Info.Printf("Matrix application service served at '%s'", path)
+}
+
+// matrixRoomOf returns the cached ID of the room bridged to the topic or an empty string.
+func matrixRoomOf(topic string) string {
+	now := time.Now()
+
+	matrixRoomCache.Lock()
+	defer matrixRoomCache.Unlock()
+
+	if entry := matrixRoomCache.entries[topic]; entry != nil && now.Sub(entry.loadedAt) < matrixCacheTTL {
+		return entry.room
+	}
+
+	link, err := store.MatrixRooms.Get(topic)
+	if err != nil {
+		logs.Warn.Printf("matrix: failed to load room of '%s': %v", topic, err)
+		return ""
+	}
+	var room string
+	if link != nil {
+		room = link.Room
+	}
+
+	if matrixRoomCache.entries == nil {
+		matrixRoomCache.entries = make(map[string]*matrixRoomEntry)
+	} else if len(matrixRoomCache.entries) >= matrixCachePurgeSize {
+		for name, entry := range matrixRoomCache.entries {
+			if now.Sub(entry.loadedAt) >= matrixCacheTTL {
+				delete(matrixRoomCache.entries, name)
+			}
+		}
+	}
+	matrixRoomCache.entries[topic] = &matrixRoomEntry{room: room, loadedAt: now}
+	return room
+}
+
+// matrixRoomInvalidate drops the cached room of the topic after the link was changed.
+func matrixRoomInvalidate(topic string) {
+	matrixRoomCache.Lock()
+	delete(matrixRoomCache.entries, topic)
+	matrixRoomCache.Unlock()
+}
+
+// matrixName returns the display name of the Matrix user or the ID if the name is unknown.
+func matrixName(userID string) string {
+	matrixNames.Lock()
+	defer matrixNames.Unlock()
+	if name := matrixNames.names[userID]; name != "" {
+		return name
+	}
+	return userID
+}
+
+// matrixSetName remembers the display name of the Matrix user.
+func matrixSetName(userID, name string) {
+	matrixNames.Lock()
+	defer matrixNames.Unlock()
+	if matrixNames.names == nil || len(matrixNames.names) >= maxMatrixNames {
+		matrixNames.names = make(map[string]string)
+	}
+	if name == "" {
+		delete(matrixNames.names, userID)
+	} else {
+		matrixNames.names[userID] = name
+	}
+}
+
+// matrixPuppetSuffix returns the suffix of the localpart of the puppet of the user: Matrix localparts are lowercase.
+func matrixPuppetSuffix(uid types.Uid) string {
+	return strconv.FormatUint(uint64(uid), 36)
+}
+
+// matrixPuppet registers the puppet of the user and joins it to the room. Returns the Matrix ID of the puppet.
+func matrixPuppet(mc *matrix.Client, room string, uid types.Uid) (string, error) {
+	puppet := mc.PuppetID(matrixPuppetSuffix(uid))
+	key := puppet + " " + room
+	if _, ok := matrixJoined.Load(key); ok {
+		return puppet, nil
+	}
+
+	if err := mc.Register(mc.PuppetLocalpart(matrixPuppetSuffix(uid))); err != nil {
+		return "", err
+	}
+	if user, err := store.Users.Get(uid); err == nil && user != nil {
+		if public, ok := user.Public.(map[string]any); ok {
+			if fn, _ := public["fn"].(string); fn != "" {
+				if err := mc.SetDisplayName(puppet, fn); err != nil {
+					logs.Warn.Printf("matrix: failed to set name of %s: %v", puppet, err)
+				}
+			}
+		}
+	}
+	if _, err := mc.Join(puppet, room); err != nil {
+		var merr *matrix.Error
+		if !errors.As(err, &merr) || merr.Code != "M_FORBIDDEN" {
+			return "", err
+		}
+		// The room is invite-only: the bot of the bridge invites the puppet.
+		if err = mc.Invite(room, puppet); err != nil {
+			return "", err
+		}
+		if _, err = mc.Join(puppet, room); err != nil {
+			return "", err
+		}
+	}
+	matrixJoined.Store(key, true)
+	return puppet, nil
+}
+
+// matrixSyncMembers joins puppets of current members of the topic to the room.
+func matrixSyncMembers(mc *matrix.Client, topic, room string) {
+	subs, err := store.Topics.GetSubs(topic, nil)
+	if err != nil {
+		logs.Warn.Printf("matrix: failed to load members of '%s': %v", topic, err)
+		return
+	}
+	for i := range subs {
+		sub := &subs[i]
+		if sub.User == mc.BotUser() || !isTopicMember(sub.ModeWant, sub.ModeGiven) {
+			continue
+		}
+		uid := types.ParseUserId(sub.User)
+		if !mc.Enqueue(room, func() {
+			if _, err := matrixPuppet(mc, room, uid); err != nil {
+				logs.Warn.Printf("matrix: failed to join %s to %s: %v", sub.User, room, err)
+			}
+		}) {
+			logs.Warn.Printf("matrix: queue full, members of %s not synced", topic)
+			return
+		}
+	}
+}
+
+// matrixMessage relays the message published to the bridged topic to the room.
+func (t *Topic) matrixMessage(data *MsgServerData) {
+	mc := matrix.Get()
+	if mc == nil || t.cat != types.TopicCatGrp || t.isChan {
+		return
+	}
+	if data.Head[msgHeadMatrix] != nil || data.Head[msgHeadService] != nil || data.Head[msgHeadScope] != nil {
+		// Messages from Matrix, service messages and messages visible to some subscribers only.
+		return
+	}
+	uid := types.ParseUserId(data.From)
+	if uid.IsZero() || data.From == mc.BotUser() {
+		return
+	}
+	room := matrixRoomOf(t.name)
+	if room == "" {
+		return
+	}
+
+	// The transaction ID makes retries of the same message idempotent.
+	txnID := t.name + "." + strconv.Itoa(data.SeqId)
+	head, content := data.Head, data.Content
+	if !mc.Enqueue(room, func() {
+		if err := matrixRelay(mc, room, uid, txnID, head, content); err != nil {
+			logs.Warn.Printf("matrix: failed to relay message %s to %s: %v", txnID, room, err)
+		}
+	}) {
+		logs.Warn.Printf("matrix: queue full, message %s to %s dropped", txnID, room)
+	}
+}
+
+// matrixRelay sends the message to the room on behalf of the puppet of the user.
+func matrixRelay(mc *matrix.Client, room string, uid types.Uid, txnID string, head map[string]any, content any) error {
+	text, media := matrixFromTinode(head, content)
+	if text == "" && len(media) == 0 {
+		return nil
+	}
+
+	puppet, err := matrixPuppet(mc, room, uid)
+	if err != nil {
+		return err
+	}
+
+	if text != "" {
+		if _, err = mc.Send(puppet, room, txnID, map[string]any{"msgtype": "m.text", "body": text}); err != nil {
+			return err
+		}
+	}
+	for i, m := range media {
+		mxc, err := mc.Upload(puppet, m.mime, m.name, m.data)
+		if err != nil {
+			return err
+		}
+		info := map[string]any{"mimetype": m.mime, "size": len(m.data)}
+		if m.width > 0 && m.height > 0 {
+			info["w"], info["h"] = m.width, m.height
+		}
+		if _, err = mc.Send(puppet, room, txnID+"."+strconv.Itoa(i), map[string]any{
+			"msgtype": m.msgtype,
+			"body":    m.name,
+			"url":     mxc,
+			"info":    info,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matrixMedia is an in-band image or file of a Drafty message.
+type matrixMedia struct {
+	msgtype string
+	mime    string
+	name    string
+	data    []byte
+	width   int
+	height  int
+}
+
+// matrixFromTinode converts the content of the message to the text and media to send to Matrix.
+// Out-of-band attachments are sent as links in the text.
+func matrixFromTinode(head map[string]any, content any) (string, []matrixMedia) {
+	if text, ok := content.(string); ok {
+		return strings.TrimSpace(text), nil
+	}
+	if mime, _ := head["mime"].(string); mime != "text/x-drafty" {
+		return "", nil
+	}
+
+	text, err := drafty.PlainText(content)
+	if err != nil {
+		return "", nil
+	}
+
+	var media []matrixMedia
+	doc, _ := content.(map[string]any)
+	ents, _ := doc["ent"].([]any)
+	for _, e := range ents {
+		ent, _ := e.(map[string]any)
+		tp, _ := ent["tp"].(string)
+		data, _ := ent["data"].(map[string]any)
+		var msgtype string
+		switch tp {
+		case "IM":
+			msgtype = "m.image"
+		case "EX":
+			msgtype = "m.file"
+		case "VD":
+			msgtype = "m.video"
+		case "AU":
+			msgtype = "m.audio"
+		default:
+			continue
+		}
+		m := matrixMedia{msgtype: msgtype}
+		m.mime, _ = data["mime"].(string)
+		m.name, _ = data["name"].(string)
+		if strings.HasPrefix(m.mime, "text/x-drafty") {
+			// Form responses and other Drafty internals.
+			continue
+		}
+		if m.name == "" {
+			m.name = "attachment"
+		}
+		if val, ok := data["val"].(string); ok {
+			if m.data, err = base64.StdEncoding.DecodeString(val); err != nil || len(m.data) == 0 {
+				continue
+			}
+			if w, ok := data["width"].(float64); ok {
+				m.width = int(w)
+			}
+			if h, ok := data["height"].(float64); ok {
+				m.height = int(h)
+			}
+			media = append(media, m)
+		} else if ref, _ := data["ref"].(string); strings.HasPrefix(ref, "https://") || strings.HasPrefix(ref, "http://") {
+			text = strings.TrimSpace(text + "\n" + m.name + ": " + ref)
+		}
+	}
+	return text, media
+}
+
+// matrixSubChange makes the puppet of the user join or leave the room when the user joins or leaves the topic.
+func (t *Topic) matrixSubChange(uid types.Uid, oldWant, oldGiven, newWant, newGiven types.AccessMode) {
+	mc := matrix.Get()
+	if mc == nil || t.cat != types.TopicCatGrp || uid.UserId() == mc.BotUser() {
+		return
+	}
+	room := matrixRoomOf(t.name)
+	if room == "" {
+		return
+	}
+
+	wasMember, isMember := isTopicMember(oldWant, oldGiven), isTopicMember(newWant, newGiven)
+	var job func()
+	switch {
+	case !wasMember && isMember:
+		job = func() {
+			if _, err := matrixPuppet(mc, room, uid); err != nil {
+				logs.Warn.Printf("matrix: failed to join %s to %s: %v", uid.UserId(), room, err)
+			}
+		}
+	case wasMember && !isMember:
+		job = func() {
+			puppet := mc.PuppetID(matrixPuppetSuffix(uid))
+			matrixJoined.Delete(puppet + " " + room)
+			if err := mc.Leave(puppet, room); err != nil {
+				logs.Warn.Printf("matrix: failed to remove %s from %s: %v", uid.UserId(), room, err)
+			}
+		}
+	default:
+		return
+	}
+	if !mc.Enqueue(room, job) {
+		logs.Warn.Printf("matrix: queue full, membership of %s in %s not synced", uid.UserId(), room)
+	}
+}
+
+// matrixEvent posts the event of the Matrix room to the bridged topic. Returns an error if the event
+// should be retried by the homeserver.
+func matrixEvent(ev *matrix.Event) error {
+	mc := matrix.Get()
+	if mc == nil || mc.IsBridged(ev.Sender) {
+		// Echo of events sent by the bridge.
+		return nil
+	}
+
+	var head map[string]any
+	var content any
+	switch ev.Type {
+	case "m.room.message":
+		head, content = matrixToTinode(mc, ev)
+	case "m.room.member":
+		if ev.StateKey != nil && !mc.IsBridged(*ev.StateKey) {
+			head, content = matrixMembership(ev)
+		}
+	}
+	if content == nil {
+		return nil
+	}
+
+	link, err := store.MatrixRooms.GetByRoom(ev.RoomID)
+	if err != nil || link == nil {
+		return err
+	}
+
+	if head == nil {
+		head = make(map[string]any)
+	}
+	origin, _ := head[msgHeadMatrix].(map[string]any)
+	if origin == nil {
+		origin = make(map[string]any)
+	}
+	origin["sender"], origin["name"], origin["event"] = ev.Sender, matrixName(ev.Sender), ev.EventID
+	head[msgHeadMatrix] = origin
+
+	return serverPublish(mc.BotUser(), link.Topic, head, content, nil)
+}
+
+// matrixToTinode converts the m.room.message event to the head and the content of the message.
+func matrixToTinode(mc *matrix.Client, ev *matrix.Event) (map[string]any, any) {
+	msgtype, _ := ev.Content["msgtype"].(string)
+	body, _ := ev.Content["body"].(string)
+	switch msgtype {
+	case "m.text", "m.notice":
+		if body = strings.TrimSpace(body); body == "" {
+			return nil, nil
+		}
+		return nil, body
+	case "m.emote":
+		return nil, "* " + matrixName(ev.Sender) + " " + strings.TrimSpace(body)
+	case "m.image", "m.file", "m.video", "m.audio":
+	default:
+		return nil, nil
+	}
+
+	mxc, _ := ev.Content["url"].(string)
+	ref := mc.MediaURL(mxc)
+	if ref == "" {
+		// Encrypted media cannot be bridged.
+		return nil, nil
+	}
+	info, _ := ev.Content["info"].(map[string]any)
+	data := map[string]any{"ref": ref, "name": body}
+	if mime, _ := info["mimetype"].(string); mime != "" {
+		data["mime"] = mime
+	}
+	if size, ok := info["size"].(float64); ok {
+		data["size"] = int(size)
+	}
+
+	head := map[string]any{"mime": "text/x-drafty"}
+	if msgtype == "m.image" {
+		if w, ok := info["w"].(float64); ok {
+			data["width"] = int(w)
+		}
+		if h, ok := info["h"].(float64); ok {
+			data["height"] = int(h)
+		}
+		return head, map[string]any{
+			"txt": " ",
+			"fmt": []any{map[string]any{"len": 1}},
+			"ent": []any{map[string]any{"tp": "IM", "data": data}},
+		}
+	}
+	return head, map[string]any{
+		"txt": "",
+		"fmt": []any{map[string]any{"at": -1}},
+		"ent": []any{map[string]any{"tp": "EX", "data": data}},
+	}
+}
+
+// matrixMembership converts the m.room.member event to a message about the user joining or leaving the room.
+func matrixMembership(ev *matrix.Event) (map[string]any, any) {
+	if ev.StateKey == nil {
+		return nil, nil
+	}
+	user := *ev.StateKey
+	membership, _ := ev.Content["membership"].(string)
+	prevContent, _ := ev.Unsigned["prev_content"].(map[string]any)
+	prev, _ := prevContent["membership"].(string)
+
+	name, _ := ev.Content["displayname"].(string)
+	if membership == "join" {
+		matrixSetName(user, name)
+	}
+	if name == "" {
+		name = matrixName(user)
+	}
+
+	var text string
+	switch {
+	case membership == "join" && prev != "join":
+		text = name + " joined the room"
+	case (membership == "leave" || membership == "ban") && prev == "join":
+		text = name + " left the room"
+		matrixSetName(user, "")
+	default:
+		// Profile changes, invites, knocks.
+		return nil, nil
+	}
+	return map[string]any{msgHeadMatrix: map[string]any{"membership": membership, "user": user}}, text
+}
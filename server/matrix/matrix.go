@@ -0,0 +1,490 @@
+// Package matrix is a client of the Matrix application service API used to bridge topics to Matrix rooms.
+// The server is registered with the homeserver as an application service which owns a namespace of
+// puppet users: every Tinode user is represented in Matrix by a puppet user. The homeserver pushes events
+// of the rooms where the users of the namespace are joined to the transactions endpoint served by
+// Handler. Requests to the homeserver are executed by a pool of workers, requests of the same room are
+// executed in order.
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	defaultUserPrefix   = "tinode_"
+	defaultBotLocalpart = "tinode"
+	defaultWorkers      = 4
+	defaultQueueSize    = 1024
+	defaultTimeout      = 10
+
+	// Maximum size of a transaction pushed by the homeserver.
+	maxTransactionSize = 1 << 22
+	// Maximum size of a response of the homeserver to read.
+	maxResponseSize = 1 << 16
+	// Number of IDs of processed transactions to remember.
+	maxTransactionIds = 1024
+)
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Base URL of the client-server API of the homeserver, i.e. "https://matrix.example.com".
+	Homeserver string `json:"homeserver"`
+	// Server name of the homeserver, the part of user IDs after the colon, i.e. "example.com".
+	Domain string `json:"domain"`
+	// Token used by the bridge to authenticate with the homeserver, as_token of the registration.
+	AsToken string `json:"as_token"`
+	// Token used by the homeserver to authenticate with the bridge, hs_token of the registration.
+	HsToken string `json:"hs_token"`
+	// Localpart of the bot user of the bridge, sender_localpart of the registration.
+	BotLocalpart string `json:"bot_localpart"`
+	// Prefix of localparts of puppet users.
+	UserPrefix string `json:"user_prefix"`
+	// Tinode user who posts messages of Matrix users to topics.
+	BotUser string `json:"bot_user"`
+	// Number of workers executing requests to the homeserver.
+	Workers int `json:"workers"`
+	// Maximum number of requests waiting to be executed.
+	QueueSize int `json:"queue_size"`
+	// Timeout of one request (seconds).
+	Timeout int `json:"timeout"`
+}
+
+// Event is an event of a room pushed by the homeserver.
+type Event struct {
+	Type    string         `json:"type"`
+	EventID string         `json:"event_id"`
+	RoomID  string         `json:"room_id"`
+	Sender  string         `json:"sender"`
+	Ts      int64          `json:"origin_server_ts"`
+	Content map[string]any `json:"content"`
+	// State key of state events, such as the user ID of m.room.member.
+	StateKey *string `json:"state_key,omitempty"`
+	// Data added by the homeserver, such as the previous content of state events in prev_content.
+	Unsigned map[string]any `json:"unsigned,omitempty"`
+}
+
+// Error is an error response of the homeserver.
+type Error struct {
+	Status  int
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return "matrix: " + strconv.Itoa(e.Status) + " " + e.Code + ": " + e.Message
+}
+
+// Client sends requests to the homeserver on behalf of the users of the namespace.
+type Client struct {
+	homeserver string
+	domain     string
+	asToken    string
+	hsToken    string
+	bot        string
+	userPrefix string
+	botUser    string
+	http       *http.Client
+
+	// Queues of workers, requests of a room go to the same worker.
+	queues  []chan func()
+	wg      sync.WaitGroup
+	lock    sync.RWMutex
+	stopped bool
+
+	// Number of processed events by IDs of recent transactions, the homeserver retries transactions
+	// until they are acknowledged.
+	txnLock sync.Mutex
+	txnIds  map[string]int
+	txnList []string
+}
+
+var client *Client
+
+// Init initializes the bridge. Returns false if the bridge is disabled in the config.
+func Init(jsconfig json.RawMessage) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+	if config.Homeserver == "" || config.Domain == "" || config.AsToken == "" || config.HsToken == "" {
+		return false, errors.New("homeserver, domain, as_token and hs_token are required")
+	}
+	if config.BotUser == "" {
+		return false, errors.New("bot_user is required")
+	}
+
+	client = newClient(&config)
+	return true, nil
+}
+
+// Enabled checks if the bridge is enabled.
+func Enabled() bool {
+	return client != nil
+}
+
+// Get returns the client of the homeserver or nil if the bridge is disabled.
+func Get() *Client {
+	return client
+}
+
+// Stop stops the workers. Requests waiting to be executed are discarded.
+func Stop() {
+	if client == nil {
+		return
+	}
+	client.shutdown()
+	client = nil
+}
+
+func newClient(config *configType) *Client {
+	c := &Client{
+		homeserver: strings.TrimSuffix(config.Homeserver, "/"),
+		domain:     config.Domain,
+		asToken:    config.AsToken,
+		hsToken:    config.HsToken,
+		userPrefix: config.UserPrefix,
+		botUser:    config.BotUser,
+		http:       &http.Client{Timeout: time.Second * time.Duration(valueOrDefault(config.Timeout, defaultTimeout))},
+		txnIds:     make(map[string]int),
+	}
+	if c.userPrefix == "" {
+		c.userPrefix = defaultUserPrefix
+	}
+	botLocalpart := config.BotLocalpart
+	if botLocalpart == "" {
+		botLocalpart = defaultBotLocalpart
+	}
+	c.bot = "@" + botLocalpart + ":" + c.domain
+
+	workers := valueOrDefault(config.Workers, defaultWorkers)
+	queueSize := valueOrDefault(config.QueueSize, defaultQueueSize)
+	c.queues = make([]chan func(), workers)
+	c.wg.Add(workers)
+	for i := range c.queues {
+		c.queues[i] = make(chan func(), queueSize/workers+1)
+		go c.worker(c.queues[i])
+	}
+	return c
+}
+
+func (c *Client) worker(queue chan func()) {
+	defer c.wg.Done()
+	for job := range queue {
+		job()
+	}
+}
+
+func (c *Client) shutdown() {
+	c.lock.Lock()
+	c.stopped = true
+	c.lock.Unlock()
+
+	for _, queue := range c.queues {
+		close(queue)
+	}
+	c.wg.Wait()
+}
+
+// Enqueue schedules the job to be executed by a worker. Jobs of the same room are executed in order.
+// Returns false if the queue is full or the bridge is stopped.
+func (c *Client) Enqueue(room string, job func()) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.stopped {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(room))
+	select {
+	case c.queues[h.Sum32()%uint32(len(c.queues))] <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// BotUser returns the ID of the Tinode user who posts messages of Matrix users.
+func (c *Client) BotUser() string {
+	return c.botUser
+}
+
+// Bot returns the Matrix ID of the bot user of the bridge.
+func (c *Client) Bot() string {
+	return c.bot
+}
+
+// PuppetLocalpart returns the localpart of the puppet user with the given suffix.
+func (c *Client) PuppetLocalpart(suffix string) string {
+	return c.userPrefix + suffix
+}
+
+// PuppetID returns the Matrix ID of the puppet user with the given suffix.
+func (c *Client) PuppetID(suffix string) string {
+	return "@" + c.PuppetLocalpart(suffix) + ":" + c.domain
+}
+
+// IsBridged checks if the Matrix user is the bot or a puppet of the bridge.
+func (c *Client) IsBridged(userID string) bool {
+	return userID == c.bot || (strings.HasPrefix(userID, "@"+c.userPrefix) && strings.HasSuffix(userID, ":"+c.domain))
+}
+
+// MediaURL converts the mxc:// URI of the content to the HTTP URL to download it from the homeserver.
+func (c *Client) MediaURL(mxc string) string {
+	rest, ok := strings.CutPrefix(mxc, "mxc://")
+	if !ok {
+		return ""
+	}
+	return c.homeserver + "/_matrix/media/v3/download/" + rest
+}
+
+// call sends the request to the homeserver on behalf of the user, the bot if the user is empty,
+// and decodes the response into resp if it's not nil.
+func (c *Client) call(method, path string, query url.Values, contentType string, body io.Reader, resp any) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	req, err := http.NewRequest(method, c.homeserver+path+"?"+query.Encode(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.asToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		merr := &Error{Status: res.StatusCode}
+		json.Unmarshal(data, merr)
+		return merr
+	}
+	if resp != nil {
+		return json.Unmarshal(data, resp)
+	}
+	return nil
+}
+
+// callJSON sends the JSON request to the homeserver on behalf of the user.
+func (c *Client) callJSON(method, path, userID string, req, resp any) error {
+	var query url.Values
+	if userID != "" && userID != c.bot {
+		query = url.Values{"user_id": {userID}}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return c.call(method, path, query, "application/json", bytes.NewReader(body), resp)
+}
+
+// Register creates the puppet user with the localpart. Existing users are not an error.
+func (c *Client) Register(localpart string) error {
+	err := c.callJSON(http.MethodPost, "/_matrix/client/v3/register", "", map[string]any{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}, nil)
+	var merr *Error
+	if errors.As(err, &merr) && merr.Code == "M_USER_IN_USE" {
+		return nil
+	}
+	return err
+}
+
+// SetDisplayName changes the display name of the user.
+func (c *Client) SetDisplayName(userID, name string) error {
+	return c.callJSON(http.MethodPut, "/_matrix/client/v3/profile/"+url.PathEscape(userID)+"/displayname", userID,
+		map[string]any{"displayname": name}, nil)
+}
+
+// Join joins the user to the room given by ID or alias. Returns the ID of the room.
+func (c *Client) Join(userID, room string) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	err := c.callJSON(http.MethodPost, "/_matrix/client/v3/join/"+url.PathEscape(room), userID, map[string]any{}, &resp)
+	return resp.RoomID, err
+}
+
+// Invite invites the user to the room on behalf of the bot.
+func (c *Client) Invite(room, userID string) error {
+	return c.callJSON(http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/invite", "",
+		map[string]any{"user_id": userID}, nil)
+}
+
+// Leave makes the user leave the room.
+func (c *Client) Leave(userID, room string) error {
+	return c.callJSON(http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/leave", userID,
+		map[string]any{}, nil)
+}
+
+// Send sends the m.room.message event to the room on behalf of the user. The transaction ID makes
+// retries idempotent. Returns the ID of the event.
+func (c *Client) Send(userID, room, txnID string, content map[string]any) (string, error) {
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	err := c.callJSON(http.MethodPut, "/_matrix/client/v3/rooms/"+url.PathEscape(room)+"/send/m.room.message/"+
+		url.PathEscape(txnID), userID, content, &resp)
+	return resp.EventID, err
+}
+
+// Upload uploads the content to the media repository of the homeserver. Returns the mxc:// URI.
+func (c *Client) Upload(userID, contentType, name string, data []byte) (string, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("filename", name)
+	}
+	if userID != "" && userID != c.bot {
+		query.Set("user_id", userID)
+	}
+	var resp struct {
+		ContentURI string `json:"content_uri"`
+	}
+	err := c.call(http.MethodPost, "/_matrix/media/v3/upload", query, contentType, bytes.NewReader(data), &resp)
+	return resp.ContentURI, err
+}
+
+// Handler returns the handler of the application service API called by the homeserver. Events of
+// transactions are passed to onEvent. If onEvent fails, the transaction is rejected and the homeserver
+// retries it starting with the failed event.
+func (c *Client) Handler(onEvent func(*Event) error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /_matrix/app/v1/transactions/{txn}", func(wrt http.ResponseWriter, req *http.Request) {
+		c.transaction(wrt, req, onEvent)
+	})
+	mux.HandleFunc("GET /_matrix/app/v1/users/{user}", func(wrt http.ResponseWriter, req *http.Request) {
+		if !c.authorized(wrt, req) {
+			return
+		}
+		// Puppets are registered by the bridge when they are needed.
+		writeError(wrt, http.StatusNotFound, "M_NOT_FOUND", "user not found")
+	})
+	mux.HandleFunc("GET /_matrix/app/v1/rooms/{room}", func(wrt http.ResponseWriter, req *http.Request) {
+		if !c.authorized(wrt, req) {
+			return
+		}
+		writeError(wrt, http.StatusNotFound, "M_NOT_FOUND", "room not found")
+	})
+	mux.HandleFunc("/", func(wrt http.ResponseWriter, req *http.Request) {
+		writeError(wrt, http.StatusNotFound, "M_UNRECOGNIZED", "unrecognized request")
+	})
+	return mux
+}
+
+// authorized checks the token of the homeserver.
+func (c *Client) authorized(wrt http.ResponseWriter, req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		// Older homeservers pass the token as a query parameter.
+		token = req.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		writeError(wrt, http.StatusUnauthorized, "M_UNAUTHORIZED", "missing token")
+		return false
+	}
+	if token != c.hsToken {
+		writeError(wrt, http.StatusForbidden, "M_FORBIDDEN", "invalid token")
+		return false
+	}
+	return true
+}
+
+func (c *Client) transaction(wrt http.ResponseWriter, req *http.Request, onEvent func(*Event) error) {
+	if !c.authorized(wrt, req) {
+		return
+	}
+
+	txnID := req.PathValue("txn")
+	var txn struct {
+		Events []*Event `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(wrt, req.Body, maxTransactionSize)).Decode(&txn); err != nil {
+		writeError(wrt, http.StatusBadRequest, "M_NOT_JSON", err.Error())
+		return
+	}
+
+	done := c.transactionProgress(txnID)
+	if done > 0 && done >= len(txn.Events) {
+		logs.Info.Printf("matrix: transaction %s already processed", txnID)
+	}
+	for i := done; i < len(txn.Events); i++ {
+		if txn.Events[i] == nil {
+			continue
+		}
+		if err := onEvent(txn.Events[i]); err != nil {
+			// Events before the failed one are not processed again when the transaction is retried.
+			c.markTransaction(txnID, i)
+			logs.Warn.Printf("matrix: transaction %s failed at event %s: %v", txnID, txn.Events[i].EventID, err)
+			writeError(wrt, http.StatusServiceUnavailable, "M_UNKNOWN", err.Error())
+			return
+		}
+	}
+	c.markTransaction(txnID, len(txn.Events))
+
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.Write([]byte("{}"))
+}
+
+// transactionProgress returns the number of processed events of the transaction.
+func (c *Client) transactionProgress(txnID string) int {
+	c.txnLock.Lock()
+	defer c.txnLock.Unlock()
+
+	return c.txnIds[txnID]
+}
+
+// markTransaction remembers the number of processed events of the transaction.
+func (c *Client) markTransaction(txnID string, done int) {
+	c.txnLock.Lock()
+	defer c.txnLock.Unlock()
+
+	if _, ok := c.txnIds[txnID]; !ok {
+		if len(c.txnList) >= maxTransactionIds {
+			delete(c.txnIds, c.txnList[0])
+			c.txnList = c.txnList[1:]
+		}
+		c.txnList = append(c.txnList, txnID)
+	}
+	c.txnIds[txnID] = done
+}
+
+func writeError(wrt http.ResponseWriter, status int, code, message string) {
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.WriteHeader(status)
+	json.NewEncoder(wrt).Encode(map[string]string{"errcode": code, "error": message})
+}
+
+func valueOrDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,164 @@
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+func testClient(homeserver string) *Client {
+	return newClient(&configType{
+		Homeserver: homeserver + "/",
+		Domain:     "example.com",
+		AsToken:    "as-token",
+		HsToken:    "hs-token",
+		BotUser:    "usrBot",
+		Workers:    1,
+	})
+}
+
+func TestIds(t *testing.T) {
+	c := testClient("https://matrix.example.com")
+	defer c.shutdown()
+
+	if id := c.PuppetID("abc"); id != "@tinode_abc:example.com" {
+		t.Errorf("PuppetID: got '%s'", id)
+	}
+	for id, expected := range map[string]bool{
+		"@tinode:example.com":      true,
+		"@tinode_abc:example.com":  true,
+		"@tinode_abc:example.org":  false,
+		"@alice:example.com":       false,
+		"@tinodealice:example.com": false,
+	} {
+		if c.IsBridged(id) != expected {
+			t.Errorf("IsBridged(%s): expected %v", id, expected)
+		}
+	}
+	if u := c.MediaURL("mxc://example.com/abc"); u != "https://matrix.example.com/_matrix/media/v3/download/example.com/abc" {
+		t.Errorf("MediaURL: got '%s'", u)
+	}
+	if u := c.MediaURL("https://example.com/abc"); u != "" {
+		t.Errorf("MediaURL: expected empty, got '%s'", u)
+	}
+}
+
+func TestSend(t *testing.T) {
+	var registered []string
+	srv := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer as-token" {
+			writeError(wrt, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "bad token")
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		switch {
+		case req.URL.Path == "/_matrix/client/v3/register":
+			var reg map[string]string
+			json.Unmarshal(body, &reg)
+			registered = append(registered, reg["username"])
+			if len(registered) > 1 {
+				writeError(wrt, http.StatusBadRequest, "M_USER_IN_USE", "taken")
+				return
+			}
+			wrt.Write([]byte(`{}`))
+		case strings.HasPrefix(req.URL.Path, "/_matrix/client/v3/rooms/!room:example.com/send/m.room.message/"):
+			if req.URL.Query().Get("user_id") != "@tinode_abc:example.com" {
+				writeError(wrt, http.StatusForbidden, "M_FORBIDDEN", "wrong user")
+				return
+			}
+			wrt.Write([]byte(`{"event_id":"$event"}`))
+		default:
+			writeError(wrt, http.StatusNotFound, "M_UNRECOGNIZED", "unrecognized")
+		}
+	}))
+	defer srv.Close()
+
+	c := testClient(srv.URL)
+	defer c.shutdown()
+
+	// The second registration fails with M_USER_IN_USE which is not an error.
+	for range 2 {
+		if err := c.Register("tinode_abc"); err != nil {
+			t.Fatal("Register:", err)
+		}
+	}
+	id, err := c.Send("@tinode_abc:example.com", "!room:example.com", "txn", map[string]any{"msgtype": "m.text", "body": "hi"})
+	if err != nil || id != "$event" {
+		t.Fatalf("Send: got '%s', %v", id, err)
+	}
+	_, err = c.Send("@tinode_xyz:example.com", "!room:example.com", "txn", map[string]any{"msgtype": "m.text", "body": "hi"})
+	if merr, ok := err.(*Error); !ok || merr.Status != http.StatusForbidden || merr.Code != "M_FORBIDDEN" {
+		t.Errorf("Send: expected M_FORBIDDEN, got %v", err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	c := testClient("https://matrix.example.com")
+	defer c.shutdown()
+
+	var events []*Event
+	var failure error
+	handler := c.Handler(func(ev *Event) error {
+		if failure != nil && ev.EventID == "$2" {
+			return failure
+		}
+		events = append(events, ev)
+		return nil
+	})
+	txn := `{"events":[{"type":"m.room.message","event_id":"$1","room_id":"!room:example.com",` +
+		`"sender":"@alice:example.com","content":{"msgtype":"m.text","body":"hello"}}]}`
+	txnID := "1"
+
+	put := func(token string) int {
+		req := httptest.NewRequest(http.MethodPut, "/_matrix/app/v1/transactions/"+txnID, strings.NewReader(txn))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put(""); code != http.StatusUnauthorized {
+		t.Errorf("Missing token: expected 401, got %d", code)
+	}
+	if code := put("as-token"); code != http.StatusForbidden {
+		t.Errorf("Invalid token: expected 403, got %d", code)
+	}
+	if code := put("hs-token"); code != http.StatusOK {
+		t.Fatalf("Transaction: expected 200, got %d", code)
+	}
+	// Retried transaction is acknowledged but not processed again.
+	if code := put("hs-token"); code != http.StatusOK {
+		t.Fatalf("Retry: expected 200, got %d", code)
+	}
+	if len(events) != 1 || events[0].Sender != "@alice:example.com" || events[0].Content["body"] != "hello" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+
+	// The failed event is retried, the events before it are not processed again.
+	txn = `{"events":[{"type":"m.room.message","event_id":"$1"},{"type":"m.room.message","event_id":"$2"}]}`
+	txnID, events, failure = "2", nil, errors.New("topic master unreachable")
+	if code := put("hs-token"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Failed event: expected 503, got %d", code)
+	}
+	failure = nil
+	if code := put("hs-token"); code != http.StatusOK {
+		t.Fatalf("Retry after failure: expected 200, got %d", code)
+	}
+	if len(events) != 2 || events[0].EventID != "$1" || events[1].EventID != "$2" {
+		t.Errorf("Unexpected events after retry %+v", events)
+	}
+}
@@ -0,0 +1,178 @@
+// Package audio extracts duration and waveform of uploaded audio files, such as voice messages.
+// Files are decoded by an external ffmpeg executable.
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	defaultBars = 96
+	maxBars     = 1024
+	// Default timeout of decoding one file, seconds.
+	defaultTimeout = 30
+
+	// Audio is decoded to mono 16 bit PCM at this rate.
+	sampleRate = 8000
+	// Number of samples in one block of the waveform: 10 ms.
+	blockSize = sampleRate / 100
+)
+
+type configType struct {
+	// Path to ffmpeg executable.
+	Ffmpeg string `json:"ffmpeg"`
+	// Number of amplitudes in the waveform.
+	Bars int `json:"bars"`
+	// Timeout of decoding one file, seconds.
+	Timeout int `json:"timeout"`
+}
+
+// Analyzer extracts properties of audio files.
+type Analyzer struct {
+	conf configType
+}
+
+// New creates the analyzer.
+func New(jsconfig json.RawMessage) (*Analyzer, error) {
+	a := &Analyzer{}
+	if err := json.Unmarshal(jsconfig, &a.conf); err != nil {
+		return nil, errors.New("audio: failed to parse config: " + err.Error())
+	}
+	if a.conf.Bars <= 0 {
+		a.conf.Bars = defaultBars
+	}
+	if a.conf.Bars > maxBars {
+		a.conf.Bars = maxBars
+	}
+	if a.conf.Timeout <= 0 {
+		a.conf.Timeout = defaultTimeout
+	}
+	if a.conf.Ffmpeg == "" {
+		return nil, errors.New("audio: ffmpeg path not set")
+	}
+	if _, err := os.Stat(a.conf.Ffmpeg); err != nil {
+		return nil, errors.New("audio: ffmpeg not found: " + err.Error())
+	}
+	return a, nil
+}
+
+// Analyze decodes the audio file and returns its duration and waveform.
+func (a *Analyzer) Analyze(file io.Reader) (*types.MediaInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.conf.Timeout)*time.Second)
+	defer cancel()
+
+	// Some containers, like MP4, can't be decoded from a pipe.
+	src, err := os.CreateTemp("", "tinode-audio-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(src.Name())
+	_, err = io.Copy(src, file)
+	src.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, a.conf.Ffmpeg, "-hide_banner", "-loglevel", "error", "-nostdin",
+		"-i", src.Name(), "-vn", "-ac", "1", "-ar", strconv.Itoa(sampleRate), "-f", "s16le", "pipe:1")
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	peaks, samples, rerr := readPeaks(bufio.NewReader(stdout))
+	if err = cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New("audio: ffmpeg: " + msg)
+		}
+		return nil, err
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	if samples == 0 {
+		return nil, errors.New("audio: no audio")
+	}
+
+	return &types.MediaInfo{
+		Duration: int(int64(samples) * 1000 / sampleRate),
+		Waveform: waveform(peaks, a.conf.Bars),
+	}, nil
+}
+
+// readPeaks reads 16 bit little endian PCM samples. Returns the peak amplitude of every block of
+// samples and the total number of samples.
+func readPeaks(r io.Reader) ([]uint16, int, error) {
+	var peaks []uint16
+	var peak uint16
+	samples := 0
+	buf := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, 0, err
+		}
+		val := int32(int16(binary.LittleEndian.Uint16(buf)))
+		if val < 0 {
+			val = -val
+		}
+		peak = max(peak, uint16(val))
+		samples++
+		if samples%blockSize == 0 {
+			peaks = append(peaks, peak)
+			peak = 0
+		}
+	}
+	if samples%blockSize != 0 {
+		peaks = append(peaks, peak)
+	}
+	return peaks, samples, nil
+}
+
+// waveform splits peaks into bars evenly spaced over the duration and scales the loudest bar to 255.
+// The waveform of audio shorter than the number of bars has one bar per block.
+func waveform(peaks []uint16, bars int) []byte {
+	if len(peaks) == 0 {
+		return nil
+	}
+	bars = min(bars, len(peaks))
+	values := make([]uint16, bars)
+	var loudest uint16
+	for i := range bars {
+		// Maximum of the peaks which fall into the bar.
+		start, end := i*len(peaks)/bars, (i+1)*len(peaks)/bars
+		for _, p := range peaks[start:end] {
+			values[i] = max(values[i], p)
+		}
+		loudest = max(loudest, values[i])
+	}
+
+	result := make([]byte, bars)
+	if loudest == 0 {
+		// Silence.
+		return result
+	}
+	for i, val := range values {
+		result[i] = byte(uint32(val) * 255 / uint32(loudest))
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestReadPeaks(t *testing.T) {
+	// One full block and a partial block.
+	samples := make([]int16, blockSize+10)
+	samples[5] = 1000
+	samples[7] = -3000
+	samples[blockSize+3] = -32768
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, samples)
+	// Trailing odd byte is ignored.
+	buf.WriteByte(1)
+
+	peaks, count, err := readPeaks(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != blockSize+10 {
+		t.Errorf("Expected %d samples, got %d", blockSize+10, count)
+	}
+	if !reflect.DeepEqual(peaks, []uint16{3000, 32768}) {
+		t.Errorf("Unexpected peaks %v", peaks)
+	}
+}
+
+func TestWaveform(t *testing.T) {
+	cases := []struct {
+		peaks    []uint16
+		bars     int
+		expected []byte
+	}{
+		{[]uint16{100, 200, 50, 400, 0, 0}, 3, []byte{127, 255, 0}},
+		{[]uint16{100, 200}, 4, []byte{127, 255}},
+		{[]uint16{0, 0, 0}, 2, []byte{0, 0}},
+		{nil, 4, nil},
+	}
+	for _, c := range cases {
+		if got := waveform(c.peaks, c.bars); !bytes.Equal(got, c.expected) {
+			t.Errorf("waveform(%v, %d) = %v, expected %v", c.peaks, c.bars, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Package azure implements media interface by storing media objects in an Azure Blob Storage container.
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	defaultServeURL     = "/v0/file/s/"
+	defaultCacheControl = "no-cache, must-revalidate"
+
+	handlerName = "azure"
+	// Sign GET URLs for this number of seconds.
+	defaultPresignDuration = 120
+	// Files are uploaded in blocks of this size, every block is retried on failure.
+	defaultBlockSize = 4 << 20
+	// Maximum number of attempts to upload a block.
+	blockAttempts = 3
+	// Timeout of requests.
+	requestTimeout = 60 * time.Second
+)
+
+type azconfig struct {
+	// Name and access key of the storage account.
+	AccountName string `json:"account_name"`
+	AccountKey  string `json:"account_key"`
+	// Optional endpoint of the Blob service, default https://<account_name>.blob.core.windows.net.
+	Endpoint      string   `json:"endpoint"`
+	ContainerName string   `json:"container"`
+	CorsOrigins   []string `json:"cors_origins"`
+	ServeURL      string   `json:"serve_url"`
+	PresignTTL    int      `json:"presign_ttl"`
+	CacheControl  string   `json:"cache_control"`
+	// Size of uploaded blocks in bytes.
+	BlockSize int `json:"block_size"`
+	// Encrypt uploaded files with the message encryption key. Encrypted files are served
+	// by the server instead of redirecting to Azure.
+	Encrypt bool `json:"encrypt"`
+}
+
+type azhandler struct {
+	client      *blobClient
+	conf        azconfig
+	corsOrigins []media.AllowedOrigin
+}
+
+// readerCounter is a byte counter for bytes read through the io.Reader
+type readerCounter struct {
+	count  int64
+	reader io.Reader
+}
+
+// Read reads the bytes and records the number of read bytes.
+func (rc *readerCounter) Read(buf []byte) (int, error) {
+	n, err := rc.reader.Read(buf)
+	rc.count += int64(n)
+	return n, err
+}
+
+// Init initializes the media handler.
+func (ah *azhandler) Init(jsconf string) error {
+	var err error
+	if err = json.Unmarshal([]byte(jsconf), &ah.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if ah.conf.AccountName == "" {
+		return errors.New("missing Account Name")
+	}
+	if ah.conf.AccountKey == "" {
+		return errors.New("missing Account Key")
+	}
+	if ah.conf.ContainerName == "" {
+		return errors.New("missing Container")
+	}
+	if ah.conf.PresignTTL <= 0 {
+		ah.conf.PresignTTL = defaultPresignDuration
+	}
+	if ah.conf.CacheControl == "" {
+		ah.conf.CacheControl = defaultCacheControl
+	}
+	if ah.conf.ServeURL == "" {
+		ah.conf.ServeURL = defaultServeURL
+	}
+	if ah.conf.BlockSize <= 0 {
+		ah.conf.BlockSize = defaultBlockSize
+	}
+	ah.corsOrigins, err = media.ParseCORSAllow(ah.conf.CorsOrigins)
+	if err != nil {
+		return errors.New("failed to parse CORS allowed origins: " + err.Error())
+	}
+	if ah.conf.Encrypt && !store.IsEncryptionEnabled() {
+		return errors.New("encryption of uploads requires message encryption to be enabled")
+	}
+
+	if ah.client, err = newBlobClient(ah.conf.AccountName, ah.conf.AccountKey, ah.conf.Endpoint,
+		ah.conf.ContainerName); err != nil {
+		return err
+	}
+
+	// Create the container if it does not exist. CORS rules of Azure are set for the whole account,
+	// they must be configured by the administrator to serve media directly from Azure.
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return ah.client.createContainer(ctx)
+}
+
+// Headers adds CORS headers and redirects GET and HEAD requests to Azure.
+func (ah *azhandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	// Add CORS headers, if necessary.
+	headers, status := media.CORSHandler(method, headers, ah.corsOrigins, serve)
+	if status != 0 || method == http.MethodPost || method == http.MethodPut {
+		return headers, status, nil
+	}
+
+	fid := ah.GetIdFromUrl(url.String())
+	if fid.IsZero() {
+		return nil, 0, types.ErrNotFound
+	}
+
+	fdef, err := ah.getFileRecord(fid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if fdef.ETag != "" && headers.Get("If-None-Match") == `"`+fdef.ETag+`"` {
+		return http.Header{
+				"ETag":          {`"` + fdef.ETag + `"`},
+				"Cache-Control": {ah.conf.CacheControl},
+			},
+			http.StatusNotModified, nil
+	}
+
+	if ah.conf.Encrypt {
+		// Encrypted files cannot be served by Azure directly: serve them through Download.
+		return http.Header{
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Content-Type":  {fdef.MimeType},
+			"Cache-Control": {ah.conf.CacheControl},
+		}, 0, nil
+	}
+
+	if method != http.MethodGet && method != http.MethodHead {
+		return nil, 0, nil
+	}
+
+	// If the query parameter "asatt" is set to a true, set Content-Disposition to attachment.
+	// This will cause browsers to download the file rather than attempt to display it.
+	// This closes an XSS vulnerability when users upload HTML files.
+	var disposition string
+	if isAttachment, _ := strconv.ParseBool(url.Query().Get("asatt")); isAttachment {
+		disposition = "attachment"
+	}
+
+	// Return URL with a shared access signature with 308 Permanent redirect. Let the client cache
+	// the response. The original URL will stop working after a short period of time to prevent use
+	// of Tinode as a free file server.
+	signed := ah.client.signedURL(fdef.Location, time.Now().Add(time.Second*time.Duration(ah.conf.PresignTTL)),
+		ah.conf.CacheControl, disposition, fdef.MimeType)
+	return http.Header{
+			"Location":      {signed},
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Content-Type":  {"application/json; charset=utf-8"},
+			"Cache-Control": {ah.conf.CacheControl},
+		},
+		http.StatusPermanentRedirect, nil
+}
+
+// Upload processes request for a file upload. The file is given as io.Reader. The file is uploaded
+// in blocks, every block is retried on failure. Failed uploads are abandoned: Azure removes
+// uncommitted blocks after a week.
+func (ah *azhandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	var err error
+
+	// Using String32 just for consistency with the file handler.
+	key := fdef.Uid().String32()
+	// The location is known before the upload so the blob is garbage-collected if the server stops
+	// before the upload is finished.
+	fdef.Location = key
+
+	if err = store.Files.StartUpload(fdef); err != nil {
+		logs.Warn.Println("failed to create file record", fdef.Id, err)
+		return "", 0, err
+	}
+
+	rc := readerCounter{reader: file}
+	var body io.Reader = &rc
+	contentType := fdef.MimeType
+	if ah.conf.Encrypt {
+		var enc *media.StreamEncrypter
+		if enc, err = media.NewStreamEncrypter(&rc, store.ActiveEncryptionKeyID(), store.DeriveMediaKey); err != nil {
+			return "", 0, err
+		}
+		body = enc
+		contentType = "application/octet-stream"
+	}
+
+	var blockIds []string
+	buf := make([]byte, ah.conf.BlockSize)
+	for {
+		n, rerr := io.ReadFull(body, buf)
+		if n > 0 {
+			// IDs of all blocks of a blob must have the same length.
+			id := base64.StdEncoding.EncodeToString(fmt.Appendf(nil, "%08d", len(blockIds)))
+			if err = ah.putBlock(key, id, buf[:n]); err != nil {
+				return "", 0, err
+			}
+			blockIds = append(blockIds, id)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return "", 0, rerr
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if fdef.ETag, err = ah.client.putBlockList(ctx, key, blockIds, contentType, ah.conf.CacheControl); err != nil {
+		return "", 0, err
+	}
+
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+	return ah.conf.ServeURL + fname, rc.count, nil
+}
+
+// putBlock uploads the block of the blob, retries on failure.
+func (ah *azhandler) putBlock(key, id string, data []byte) error {
+	var err error
+	for attempt := 0; attempt < blockAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second << attempt)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		err = ah.client.putBlock(ctx, key, id, data)
+		cancel()
+		var berr *blobError
+		if err == nil || (errors.As(err, &berr) && berr.Status < http.StatusInternalServerError) {
+			// Success or a permanent error.
+			break
+		}
+	}
+	return err
+}
+
+// Download processes request for file download. Only encrypted files are downloaded through
+// the server, others are served by Azure directly.
+// The returned ReadSeekCloser must be closed after use.
+func (ah *azhandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	if !ah.conf.Encrypt {
+		return nil, nil, types.ErrUnsupported
+	}
+
+	fid := ah.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, nil, types.ErrNotFound
+	}
+
+	fd, err := ah.getFileRecord(fid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	size, err := ah.client.getSize(ctx, fd.Location)
+	if err != nil {
+		var berr *blobError
+		if errors.As(err, &berr) && berr.Status == http.StatusNotFound {
+			err = types.ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	obj := &blobReader{client: ah.client, key: fd.Location, size: size}
+	rsc, err := media.NewDecryptingReadSeekCloser(obj, store.DeriveMediaKey)
+	if err != nil {
+		obj.Close()
+		return nil, nil, err
+	}
+	return fd, rsc, nil
+}
+
+// blobReader reads the blob with ranged GET requests so it can seek.
+type blobReader struct {
+	client *blobClient
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads blob data from the current offset.
+func (br *blobReader) Read(p []byte) (int, error) {
+	if br.offset >= br.size {
+		return 0, io.EOF
+	}
+	if br.body == nil {
+		body, err := br.client.getRange(context.Background(), br.key, br.offset)
+		if err != nil {
+			return 0, err
+		}
+		br.body = body
+	}
+	n, err := br.body.Read(p)
+	br.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (br *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += br.offset
+	case io.SeekEnd:
+		offset += br.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != br.offset {
+		br.Close()
+		br.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the current GET request, if any.
+func (br *blobReader) Close() error {
+	if br.body == nil {
+		return nil
+	}
+	err := br.body.Close()
+	br.body = nil
+	return err
+}
+
+// Delete deletes files from Azure by provided slice of locations.
+func (ah *azhandler) Delete(locations []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	for _, key := range locations {
+		if key == "" {
+			continue
+		}
+		if err := ah.client.deleteBlob(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetIdFromUrl converts an attahment URL to a file UID.
+func (ah *azhandler) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, ah.conf.ServeURL)
+}
+
+// getFileRecord given file ID reads file record from the database.
+func (ah *azhandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
+	fd, err := store.Files.Get(fid.String())
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, types.ErrNotFound
+	}
+	return fd, nil
+}
+
+func init() {
+	store.RegisterMediaHandler(handlerName, &azhandler{})
+}
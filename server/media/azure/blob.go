@@ -0,0 +1,295 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the Blob service REST API.
+const apiVersion = "2021-08-06"
+
+// blobClient is a client of the Blob service REST API authorized with the account key.
+// See https://learn.microsoft.com/en-us/rest/api/storageservices/blob-service-rest-api
+type blobClient struct {
+	account string
+	key     []byte
+	// URL of the container, e.g. https://account.blob.core.windows.net/container
+	container *url.URL
+	// Name of the container.
+	name string
+	http *http.Client
+}
+
+// blobError is an error response of the service.
+type blobError struct {
+	Status int
+	Code   string `xml:"Code"`
+	Msg    string `xml:"Message"`
+}
+
+func (e *blobError) Error() string {
+	if e.Code == "" {
+		return "azure: status " + strconv.Itoa(e.Status)
+	}
+	return "azure: " + e.Code + ": " + e.Msg
+}
+
+func newBlobClient(account, key, endpoint, container string) (*blobClient, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("invalid account key: " + err.Error())
+	}
+	if endpoint == "" {
+		endpoint = "https://" + account + ".blob.core.windows.net"
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + container)
+	if err != nil {
+		return nil, err
+	}
+	return &blobClient{account: account, key: decoded, container: u, name: container, http: &http.Client{}}, nil
+}
+
+// blobURL returns URL of the blob with the query.
+func (c *blobClient) blobURL(name string, query url.Values) *url.URL {
+	u := *c.container
+	if name != "" {
+		u.Path += "/" + name
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do sends the request signed with the account key. Returns an error if the response status is not
+// one of the expected statuses. The body of the successful response must be closed.
+func (c *blobClient) do(ctx context.Context, method string, u *url.URL, header http.Header, body []byte,
+	expected ...int) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", apiVersion)
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Authorization", "SharedKey "+c.account+":"+c.sign(c.stringToSign(req)))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	berr := &blobError{Status: resp.StatusCode}
+	if data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16)); len(data) > 0 {
+		xml.Unmarshal(data, berr)
+	}
+	if berr.Code == "" {
+		berr.Code = resp.Header.Get("x-ms-error-code")
+	}
+	return nil, berr
+}
+
+// stringToSign builds the string to sign of the Shared Key authorization.
+// See https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (c *blobClient) stringToSign(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	parts := []string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		length,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		// Date is empty, x-ms-date is used.
+		"",
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}
+
+	var msHeaders []string
+	for k := range h {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			msHeaders = append(msHeaders, k)
+		}
+	}
+	sort.Strings(msHeaders)
+	for _, k := range msHeaders {
+		parts = append(parts, k+":"+strings.TrimSpace(h.Get(k)))
+	}
+
+	resource := "/" + c.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(values, ",")
+	}
+	parts = append(parts, resource)
+
+	return strings.Join(parts, "\n")
+}
+
+func (c *blobClient) sign(str string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(str))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// createContainer creates the container, ignores the error if it already exists.
+func (c *blobClient) createContainer(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodPut, c.blobURL("", url.Values{"restype": {"container"}}), nil, nil,
+		http.StatusCreated)
+	if err != nil {
+		var berr *blobError
+		if errors.As(err, &berr) && berr.Code == "ContainerAlreadyExists" {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putBlock uploads one block of a blob. Uncommitted blocks are removed by the service after a week.
+func (c *blobClient) putBlock(ctx context.Context, name, blockId string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut,
+		c.blobURL(name, url.Values{"comp": {"block"}, "blockid": {blockId}}), nil, data, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// putBlockList commits the uploaded blocks as the blob. Returns ETag of the blob.
+func (c *blobClient) putBlockList(ctx context.Context, name string, blockIds []string, contentType,
+	cacheControl string) (string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIds {
+		body.WriteString("<Latest>" + id + "</Latest>")
+	}
+	body.WriteString("</BlockList>")
+
+	header := http.Header{}
+	header.Set("x-ms-blob-content-type", contentType)
+	header.Set("x-ms-blob-cache-control", cacheControl)
+	resp, err := c.do(ctx, http.MethodPut, c.blobURL(name, url.Values{"comp": {"blocklist"}}), header,
+		body.Bytes(), http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("ETag"), `"`), nil
+}
+
+// getSize returns the size of the blob.
+func (c *blobClient) getSize(ctx context.Context, name string) (int64, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.blobURL(name, nil), nil, nil, http.StatusOK)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// getRange reads the blob starting at the offset.
+func (c *blobClient) getRange(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("x-ms-range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	resp, err := c.do(ctx, http.MethodGet, c.blobURL(name, nil), header, nil, http.StatusOK,
+		http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// deleteBlob deletes the blob with its snapshots. Missing blobs are ignored.
+func (c *blobClient) deleteBlob(ctx context.Context, name string) error {
+	header := http.Header{}
+	header.Set("x-ms-delete-snapshots", "include")
+	resp, err := c.do(ctx, http.MethodDelete, c.blobURL(name, nil), header, nil, http.StatusAccepted,
+		http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// signedURL returns URL of the blob with a service SAS which permits reading the blob until the
+// expiration time. Response headers Content-Type and Content-Disposition are overridden if not empty.
+// See https://learn.microsoft.com/en-us/rest/api/storageservices/create-service-sas
+func (c *blobClient) signedURL(name string, expires time.Time, cacheControl, disposition, contentType string) string {
+	u := c.blobURL(name, nil)
+	expiry := expires.UTC().Format(time.RFC3339)
+	protocol := ""
+	if u.Scheme == "https" {
+		protocol = "https"
+	}
+	// Fields in the order of the string to sign: permissions, start, expiry, resource, identifier, IP,
+	// protocol, version, resource type, snapshot time, encryption scope and response headers.
+	str := strings.Join([]string{
+		"r", "", expiry,
+		"/blob/" + c.account + "/" + c.name + "/" + name,
+		"", "", protocol, apiVersion, "b", "", "",
+		cacheControl, disposition, "", "", contentType,
+	}, "\n")
+
+	query := url.Values{
+		"sv":  {apiVersion},
+		"sr":  {"b"},
+		"sp":  {"r"},
+		"se":  {expiry},
+		"sig": {c.sign(str)},
+	}
+	if protocol != "" {
+		query.Set("spr", protocol)
+	}
+	if cacheControl != "" {
+		query.Set("rscc", cacheControl)
+	}
+	if disposition != "" {
+		query.Set("rscd", disposition)
+	}
+	if contentType != "" {
+		query.Set("rsct", contentType)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
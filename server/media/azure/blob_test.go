@@ -0,0 +1,86 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBlobClient(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	var blockList string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path+"?"+r.URL.Query().Get("comp"))
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedKey devstoreaccount1:") ||
+			r.Header.Get("x-ms-version") != apiVersion {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "blocklist":
+			data, _ := io.ReadAll(r.Body)
+			blockList = string(data)
+			w.Header().Set("ETag", `"0x8D"`)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodDelete:
+			w.Header().Set("x-ms-error-code", "BlobNotFound")
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := newBlobClient("devstoreaccount1", "c2VjcmV0", srv.URL+"/devstoreaccount1", "media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err = c.putBlock(ctx, "abc", "MDA=", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	etag, err := c.putBlockList(ctx, "abc", []string{"MDA="}, "text/plain", "no-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag != "0x8D" || !strings.Contains(blockList, "<Latest>MDA=</Latest>") {
+		t.Errorf("Unexpected block list %q, etag %q", blockList, etag)
+	}
+	if err = c.deleteBlob(ctx, "abc"); err != nil {
+		t.Errorf("Missing blob not ignored: %v", err)
+	}
+	if requests[0] != "PUT /devstoreaccount1/media/abc?block" {
+		t.Errorf("Unexpected request %q", requests[0])
+	}
+
+	signed, _ := url.Parse(c.signedURL("abc", time.Now().Add(time.Minute), "", "attachment", "text/plain"))
+	query := signed.Query()
+	if query.Get("sp") != "r" || query.Get("sr") != "b" || query.Get("sig") == "" || query.Get("rscd") != "attachment" ||
+		query.Get("spr") != "" {
+		t.Errorf("Unexpected signed URL %s", signed)
+	}
+}
+
+func TestStringToSign(t *testing.T) {
+	c, _ := newBlobClient("acc", "c2VjcmV0", "", "media")
+	req, _ := http.NewRequest(http.MethodPut, c.blobURL("abc", url.Values{"comp": {"block"}, "blockid": {"MDA="}}).String(),
+		nil)
+	req.ContentLength = 5
+	req.Header.Set("x-ms-version", apiVersion)
+	req.Header.Set("x-ms-date", "Mon, 01 Jan 2024 00:00:00 GMT")
+	expected := "PUT\n\n\n5\n\n\n\n\n\n\n\n\n" +
+		"x-ms-date:Mon, 01 Jan 2024 00:00:00 GMT\nx-ms-version:" + apiVersion + "\n" +
+		"/acc/media/abc\nblockid:MDA=\ncomp:block"
+	if str := c.stringToSign(req); str != expected {
+		t.Errorf("Unexpected string to sign:\n%q\nexpected\n%q", str, expected)
+	}
+}
@@ -0,0 +1,335 @@
+package media
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Streaming encryption of media at rest. Files are encrypted in chunks so they can be
+// encrypted and decrypted without buffering the whole file, and decrypted from any offset.
+//
+// Encrypted stream is a header followed by a sequence of chunks:
+//
+//	header: magic "TNM1" | key ID length, 1 byte | key ID | salt, 16 bytes | nonce prefix, 7 bytes
+//	chunk:  AES-GCM sealed StreamChunkSize bytes of plaintext | tag, 16 bytes
+//
+// The last chunk may be shorter than StreamChunkSize, possibly empty. Nonce of a chunk is the nonce
+// prefix followed by 4 byte big endian chunk index and 1 byte flag of the last chunk, so reordering
+// or truncation of chunks is detected.
+
+// StreamChunkSize is the size of plaintext in one encrypted chunk.
+const StreamChunkSize = 64 << 10
+
+const (
+	streamMagic           = "TNM1"
+	streamSaltSize        = 16
+	streamNoncePrefixSize = 7
+	streamTagSize         = 16
+	streamChunkOverhead   = streamTagSize
+)
+
+// ErrStreamCorrupted is returned when the encrypted stream is malformed or fails authentication.
+var ErrStreamCorrupted = errors.New("encrypted media is corrupted")
+
+// StreamKeyFunc returns a 32-byte file key for the given key ID and salt.
+type StreamKeyFunc func(keyID string, salt []byte) ([]byte, error)
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// StreamEncrypter is an io.Reader which produces encrypted stream from plaintext.
+type StreamEncrypter struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	// Encrypted data ready to be read.
+	out []byte
+	// Plaintext read from src but not yet encrypted.
+	pending []byte
+	index   uint32
+	done    bool
+	size    int64
+}
+
+// NewStreamEncrypter creates a reader which encrypts src with the file key derived by keyFn
+// from the key ID and a random salt.
+func NewStreamEncrypter(src io.Reader, keyID string, keyFn StreamKeyFunc) (*StreamEncrypter, error) {
+	if len(keyID) > 255 {
+		return nil, errors.New("key ID too long")
+	}
+
+	salt := make([]byte, streamSaltSize)
+	prefix := make([]byte, streamNoncePrefixSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	key, err := keyFn(keyID, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, len(streamMagic)+1+len(keyID)+streamSaltSize+streamNoncePrefixSize)
+	header = append(header, streamMagic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = append(header, salt...)
+	header = append(header, prefix...)
+
+	return &StreamEncrypter{
+		src:     src,
+		aead:    aead,
+		prefix:  prefix,
+		out:     header,
+		pending: make([]byte, 0, StreamChunkSize+1),
+	}, nil
+}
+
+// Read reads encrypted data.
+func (se *StreamEncrypter) Read(p []byte) (int, error) {
+	for len(se.out) == 0 {
+		if se.done {
+			return 0, io.EOF
+		}
+		if err := se.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, se.out)
+	se.out = se.out[n:]
+	return n, nil
+}
+
+// Size returns the number of plaintext bytes read so far.
+func (se *StreamEncrypter) Size() int64 {
+	return se.size
+}
+
+// nextChunk reads one chunk of plaintext plus one byte to find out if it's the last chunk, and encrypts it.
+func (se *StreamEncrypter) nextChunk() error {
+	// Read until there is more than a chunk of data or the source is exhausted.
+	for len(se.pending) <= StreamChunkSize {
+		n, err := se.src.Read(se.pending[len(se.pending):cap(se.pending)])
+		se.pending = se.pending[:len(se.pending)+n]
+		se.size += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	last := len(se.pending) <= StreamChunkSize
+	chunk := se.pending
+	if !last {
+		chunk = se.pending[:StreamChunkSize]
+	}
+	se.out = se.aead.Seal(se.out[:0], streamNonce(se.prefix, se.index, last), chunk, nil)
+
+	if last {
+		se.done = true
+		se.pending = se.pending[:0]
+	} else {
+		// Move the extra byte to the start of the buffer.
+		rest := copy(se.pending, se.pending[StreamChunkSize:])
+		se.pending = se.pending[:rest]
+		se.index++
+	}
+	return nil
+}
+
+// IsEncryptedStream checks if the stream starts with the header of an encrypted stream.
+// The stream is positioned at the start on return.
+func IsEncryptedStream(rs io.ReadSeeker) (bool, error) {
+	magic := make([]byte, len(streamMagic))
+	n, err := io.ReadFull(rs, magic)
+	if _, serr := rs.Seek(0, io.SeekStart); serr != nil {
+		return false, serr
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(magic[:n]) == streamMagic, nil
+}
+
+// StreamDecrypter is an io.ReadSeeker which decrypts an encrypted stream.
+type StreamDecrypter struct {
+	src       io.ReadSeeker
+	aead      cipher.AEAD
+	prefix    []byte
+	headerLen int64
+	chunks    int64
+	size      int64
+	// Current position in plaintext.
+	offset int64
+	// Decrypted chunk and its index.
+	chunk    []byte
+	chunkIdx int64
+}
+
+// NewStreamDecrypter creates a reader which decrypts src. The key is obtained from keyFn.
+func NewStreamDecrypter(src io.ReadSeeker, keyFn StreamKeyFunc) (*StreamDecrypter, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	fixed := make([]byte, len(streamMagic)+1)
+	if _, err := io.ReadFull(src, fixed); err != nil || string(fixed[:len(streamMagic)]) != streamMagic {
+		return nil, ErrStreamCorrupted
+	}
+	rest := make([]byte, int(fixed[len(streamMagic)])+streamSaltSize+streamNoncePrefixSize)
+	if _, err := io.ReadFull(src, rest); err != nil {
+		return nil, ErrStreamCorrupted
+	}
+	keyID := string(rest[:fixed[len(streamMagic)]])
+	salt := rest[len(keyID) : len(keyID)+streamSaltSize]
+	prefix := rest[len(keyID)+streamSaltSize:]
+
+	key, err := keyFn(keyID, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := int64(len(fixed) + len(rest))
+	encLen := end - headerLen
+	fullChunk := int64(StreamChunkSize + streamChunkOverhead)
+	chunks := (encLen + fullChunk - 1) / fullChunk
+	if chunks == 0 || encLen-(chunks-1)*fullChunk < streamChunkOverhead {
+		return nil, ErrStreamCorrupted
+	}
+
+	return &StreamDecrypter{
+		src:       src,
+		aead:      aead,
+		prefix:    prefix,
+		headerLen: headerLen,
+		chunks:    chunks,
+		size:      encLen - chunks*streamChunkOverhead,
+		chunkIdx:  -1,
+	}, nil
+}
+
+// Size returns the size of plaintext.
+func (sd *StreamDecrypter) Size() int64 {
+	return sd.size
+}
+
+// Read reads decrypted data.
+func (sd *StreamDecrypter) Read(p []byte) (int, error) {
+	if sd.offset >= sd.size {
+		return 0, io.EOF
+	}
+
+	idx := sd.offset / StreamChunkSize
+	if idx != sd.chunkIdx {
+		if err := sd.loadChunk(idx); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sd.chunk[sd.offset-idx*StreamChunkSize:])
+	sd.offset += int64(n)
+	return n, nil
+}
+
+// loadChunk reads and decrypts the chunk with the given index.
+func (sd *StreamDecrypter) loadChunk(idx int64) error {
+	fullChunk := int64(StreamChunkSize + streamChunkOverhead)
+	if _, err := sd.src.Seek(sd.headerLen+idx*fullChunk, io.SeekStart); err != nil {
+		return err
+	}
+
+	last := idx == sd.chunks-1
+	length := fullChunk
+	if last {
+		length = sd.size - idx*StreamChunkSize + streamChunkOverhead
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(sd.src, buf); err != nil {
+		return ErrStreamCorrupted
+	}
+
+	chunk, err := sd.aead.Open(buf[:0], streamNonce(sd.prefix, uint32(idx), last), buf, nil)
+	if err != nil {
+		return ErrStreamCorrupted
+	}
+	sd.chunk = chunk
+	sd.chunkIdx = idx
+	return nil
+}
+
+// Seek sets the offset in plaintext for the next Read.
+func (sd *StreamDecrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sd.offset
+	case io.SeekEnd:
+		offset += sd.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	sd.offset = offset
+	return offset, nil
+}
+
+// decryptingReadSeekCloser closes the underlying source of the StreamDecrypter.
+type decryptingReadSeekCloser struct {
+	*StreamDecrypter
+	io.Closer
+}
+
+// NewDecryptingReadSeekCloser returns src as is if it's not encrypted, otherwise it returns
+// a ReadSeekCloser which decrypts src.
+func NewDecryptingReadSeekCloser(src ReadSeekCloser, keyFn StreamKeyFunc) (ReadSeekCloser, error) {
+	encrypted, err := IsEncryptedStream(src)
+	if err != nil || !encrypted {
+		return src, err
+	}
+	sd, err := NewStreamDecrypter(src, keyFn)
+	if err != nil {
+		return nil, err
+	}
+	return decryptingReadSeekCloser{StreamDecrypter: sd, Closer: src}, nil
+}
@@ -0,0 +1,116 @@
+package media
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func testStreamKey(keyID string, salt []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	copy(key, salt)
+	copy(key[len(salt):], keyID)
+	return key, nil
+}
+
+func encryptTestStream(t *testing.T, plain []byte) []byte {
+	t.Helper()
+	enc, err := NewStreamEncrypter(bytes.NewReader(plain), "k1", testStreamKey)
+	if err != nil {
+		t.Fatalf("Failed to create encrypter: %v", err)
+	}
+	// Read in small pieces to exercise buffering.
+	var out bytes.Buffer
+	if _, err := io.CopyBuffer(&out, struct{ io.Reader }{enc}, make([]byte, 1000)); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if enc.Size() != int64(len(plain)) {
+		t.Errorf("Expected plaintext size %d, got %d", len(plain), enc.Size())
+	}
+	return out.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 100} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		encrypted := encryptTestStream(t, plain)
+
+		if ok, _ := IsEncryptedStream(bytes.NewReader(encrypted)); !ok {
+			t.Fatalf("Expected encrypted stream header, size %d", size)
+		}
+
+		dec, err := NewStreamDecrypter(bytes.NewReader(encrypted), testStreamKey)
+		if err != nil {
+			t.Fatalf("Failed to create decrypter, size %d: %v", size, err)
+		}
+		if dec.Size() != int64(size) {
+			t.Errorf("Expected size %d, got %d", size, dec.Size())
+		}
+		got, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatalf("Failed to decrypt, size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("Decrypted data does not match, size %d", size)
+		}
+	}
+}
+
+func TestStreamSeek(t *testing.T) {
+	plain := make([]byte, 2*StreamChunkSize+500)
+	rand.Read(plain)
+	dec, err := NewStreamDecrypter(bytes.NewReader(encryptTestStream(t, plain)), testStreamKey)
+	if err != nil {
+		t.Fatalf("Failed to create decrypter: %v", err)
+	}
+
+	for _, offset := range []int64{StreamChunkSize + 10, 5, 2*StreamChunkSize + 499} {
+		if _, err := dec.Seek(offset, io.SeekStart); err != nil {
+			t.Fatalf("Seek failed: %v", err)
+		}
+		buf := make([]byte, 100)
+		n, err := io.ReadFull(dec, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatalf("Read failed at %d: %v", offset, err)
+		}
+		if !bytes.Equal(buf[:n], plain[offset:offset+int64(n)]) {
+			t.Errorf("Data at offset %d does not match", offset)
+		}
+	}
+
+	if end, _ := dec.Seek(0, io.SeekEnd); end != int64(len(plain)) {
+		t.Errorf("Expected end at %d, got %d", len(plain), end)
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	plain := make([]byte, 2*StreamChunkSize)
+	encrypted := encryptTestStream(t, plain)
+
+	// Modified chunk.
+	modified := bytes.Clone(encrypted)
+	modified[len(modified)-20] ^= 1
+	dec, err := NewStreamDecrypter(bytes.NewReader(modified), testStreamKey)
+	if err == nil {
+		_, err = io.ReadAll(dec)
+	}
+	if err != ErrStreamCorrupted {
+		t.Errorf("Expected ErrStreamCorrupted for modified data, got %v", err)
+	}
+
+	// Truncated at the chunk boundary: the remaining last chunk is not marked as last.
+	truncated := encrypted[:len(encrypted)-(StreamChunkSize+streamChunkOverhead)]
+	dec, err = NewStreamDecrypter(bytes.NewReader(truncated), testStreamKey)
+	if err == nil {
+		_, err = io.ReadAll(dec)
+	}
+	if err != ErrStreamCorrupted {
+		t.Errorf("Expected ErrStreamCorrupted for truncated data, got %v", err)
+	}
+
+	if ok, _ := IsEncryptedStream(bytes.NewReader([]byte("plain text"))); ok {
+		t.Error("Plaintext detected as encrypted")
+	}
+}
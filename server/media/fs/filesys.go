@@ -35,6 +35,8 @@ type fileConfig struct {
 	ServeURL            string   `json:"serve_url"`
 	CorsOrigins         []string `json:"cors_origins"`
 	CacheControl        string   `json:"cache_control"`
+	// Encrypt uploaded files at rest with the message encryption key.
+	Encrypt bool `json:"encrypt"`
 }
 
 type fshandler struct {
@@ -66,6 +68,11 @@ func (fh *fshandler) Init(jsconf string) error {
 	if err != nil {
 		return errors.New("failed to parse CORS allowed origins: " + err.Error())
 	}
+
+	if fh.Encrypt && !store.IsEncryptionEnabled() {
+		return errors.New("encryption of uploads requires message encryption to be enabled")
+	}
+
 	// Make sure the upload directory exists.
 	return os.MkdirAll(fh.FileUploadDirectory, 0777)
 }
@@ -142,7 +149,16 @@ func (fh *fshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64,
 		return "", 0, err
 	}
 
-	size, err := io.Copy(outfile, file)
+	var size int64
+	if fh.Encrypt {
+		var enc *media.StreamEncrypter
+		if enc, err = media.NewStreamEncrypter(file, store.ActiveEncryptionKeyID(), store.DeriveMediaKey); err == nil {
+			_, err = io.Copy(outfile, enc)
+			size = enc.Size()
+		}
+	} else {
+		size, err = io.Copy(outfile, file)
+	}
 	outfile.Close()
 	if err != nil {
 		os.Remove(location)
@@ -185,7 +201,18 @@ func (fh *fshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser,
 		return nil, nil, err
 	}
 
-	return fd, file, nil
+	if !store.IsEncryptionEnabled() {
+		return fd, file, nil
+	}
+
+	// Files uploaded with encryption enabled remain readable after it's disabled.
+	rsc, err := media.NewDecryptingReadSeekCloser(file, store.DeriveMediaKey)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return fd, rsc, nil
 }
 
 // Delete deletes files from storage by provided slice of locations.
@@ -0,0 +1,403 @@
+// Package gcs implements media interface by storing media objects in a Google Cloud Storage bucket.
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/media"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	defaultServeURL     = "/v0/file/s/"
+	defaultCacheControl = "no-cache, must-revalidate"
+
+	handlerName = "gcs"
+	// Sign GET URLs for this number of seconds.
+	defaultPresignDuration = 120
+	// Files are uploaded in chunks of this size, every chunk is retried on failure.
+	defaultChunkSize = 16 << 20
+	// Timeout of requests other than uploads.
+	requestTimeout = 30 * time.Second
+)
+
+type gcsconfig struct {
+	// Path to the JSON key of the service account. Application default credentials are used if empty.
+	// Signing URLs requires a service account.
+	CredentialsFile string `json:"credentials_file"`
+	BucketName      string `json:"bucket"`
+	// Project to create the bucket in if it does not exist.
+	ProjectId    string   `json:"project_id"`
+	CorsOrigins  []string `json:"cors_origins"`
+	ServeURL     string   `json:"serve_url"`
+	PresignTTL   int      `json:"presign_ttl"`
+	CacheControl string   `json:"cache_control"`
+	// Size of chunks of resumable uploads in bytes.
+	ChunkSize int `json:"chunk_size"`
+	// Encrypt uploaded files with the message encryption key. Encrypted files are served
+	// by the server instead of redirecting to GCS.
+	Encrypt bool `json:"encrypt"`
+}
+
+type gcshandler struct {
+	client      *storage.Client
+	bucket      *storage.BucketHandle
+	conf        gcsconfig
+	corsOrigins []media.AllowedOrigin
+}
+
+// readerCounter is a byte counter for bytes read through the io.Reader
+type readerCounter struct {
+	count  int64
+	reader io.Reader
+}
+
+// Read reads the bytes and records the number of read bytes.
+func (rc *readerCounter) Read(buf []byte) (int, error) {
+	n, err := rc.reader.Read(buf)
+	rc.count += int64(n)
+	return n, err
+}
+
+// Init initializes the media handler.
+func (gh *gcshandler) Init(jsconf string) error {
+	var err error
+	if err = json.Unmarshal([]byte(jsconf), &gh.conf); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	if gh.conf.BucketName == "" {
+		return errors.New("missing Bucket")
+	}
+	if gh.conf.PresignTTL <= 0 {
+		gh.conf.PresignTTL = defaultPresignDuration
+	}
+	if gh.conf.CacheControl == "" {
+		gh.conf.CacheControl = defaultCacheControl
+	}
+	if gh.conf.ServeURL == "" {
+		gh.conf.ServeURL = defaultServeURL
+	}
+	if gh.conf.ChunkSize <= 0 {
+		gh.conf.ChunkSize = defaultChunkSize
+	}
+	gh.corsOrigins, err = media.ParseCORSAllow(gh.conf.CorsOrigins)
+	if err != nil {
+		return errors.New("failed to parse CORS allowed origins: " + err.Error())
+	}
+	if gh.conf.Encrypt && !store.IsEncryptionEnabled() {
+		return errors.New("encryption of uploads requires message encryption to be enabled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var opts []option.ClientOption
+	if gh.conf.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(gh.conf.CredentialsFile))
+	}
+	if gh.client, err = storage.NewClient(context.Background(), opts...); err != nil {
+		return err
+	}
+	gh.bucket = gh.client.Bucket(gh.conf.BucketName)
+
+	// Check if bucket already exists.
+	_, err = gh.bucket.Attrs(ctx)
+	if err == nil {
+		// Bucket exists
+		return nil
+	}
+	if err != storage.ErrBucketNotExist || gh.conf.ProjectId == "" {
+		// Hard error.
+		return err
+	}
+
+	// Bucket does not exist. Create one with CORS policy to be able to serve media directly from GCS.
+	origins := gh.conf.CorsOrigins
+	if len(origins) == 0 {
+		origins = append(origins, "*")
+	}
+	err = gh.bucket.Create(ctx, gh.conf.ProjectId, &storage.BucketAttrs{
+		CORS: []storage.CORS{{
+			Methods:         []string{http.MethodGet, http.MethodHead},
+			Origins:         origins,
+			ResponseHeaders: []string{"*"},
+		}},
+	})
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusConflict {
+		// Someone has already created the bucket (possible in a cluster).
+		err = nil
+	}
+	return err
+}
+
+// Headers adds CORS headers and redirects GET and HEAD requests to GCS.
+func (gh *gcshandler) Headers(method string, url *url.URL, headers http.Header, serve bool) (http.Header, int, error) {
+	// Add CORS headers, if necessary.
+	headers, status := media.CORSHandler(method, headers, gh.corsOrigins, serve)
+	if status != 0 || method == http.MethodPost || method == http.MethodPut {
+		return headers, status, nil
+	}
+
+	fid := gh.GetIdFromUrl(url.String())
+	if fid.IsZero() {
+		return nil, 0, types.ErrNotFound
+	}
+
+	fdef, err := gh.getFileRecord(fid)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if fdef.ETag != "" && headers.Get("If-None-Match") == `"`+fdef.ETag+`"` {
+		return http.Header{
+				"ETag":          {`"` + fdef.ETag + `"`},
+				"Cache-Control": {gh.conf.CacheControl},
+			},
+			http.StatusNotModified, nil
+	}
+
+	if gh.conf.Encrypt {
+		// Encrypted files cannot be served by GCS directly: serve them through Download.
+		return http.Header{
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Content-Type":  {fdef.MimeType},
+			"Cache-Control": {gh.conf.CacheControl},
+		}, 0, nil
+	}
+
+	if method != http.MethodGet && method != http.MethodHead {
+		return nil, 0, nil
+	}
+
+	opts := &storage.SignedURLOptions{
+		Scheme:  storage.SigningSchemeV4,
+		Method:  method,
+		Expires: time.Now().Add(time.Second * time.Duration(gh.conf.PresignTTL)),
+	}
+	if method == http.MethodGet {
+		query := map[string][]string{
+			"response-content-type": {fdef.MimeType},
+		}
+		// If the query parameter "asatt" is set to a true, set Content-Disposition to attachment.
+		// This will cause browsers to download the file rather than attempt to display it.
+		// This closes an XSS vulnerability when users upload HTML files.
+		if isAttachment, _ := strconv.ParseBool(url.Query().Get("asatt")); isAttachment {
+			query["response-content-disposition"] = []string{"attachment"}
+		}
+		opts.QueryParameters = query
+	}
+
+	// Return signed URL with 308 Permanent redirect. Let the client cache the response.
+	// The original URL will stop working after a short period of time to prevent use of Tinode
+	// as a free file server.
+	signed, err := gh.bucket.SignedURL(fdef.Location, opts)
+	return http.Header{
+			"Location":      {signed},
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Content-Type":  {"application/json; charset=utf-8"},
+			"Cache-Control": {gh.conf.CacheControl},
+		},
+		http.StatusPermanentRedirect, err
+}
+
+// Upload processes request for a file upload. The file is given as io.Reader. The file is uploaded
+// in chunks with a resumable upload, every chunk is retried on failure. Failed uploads are abandoned:
+// GCS removes incomplete uploads after a week.
+func (gh *gcshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64, error) {
+	var err error
+
+	// Using String32 just for consistency with the file handler.
+	key := fdef.Uid().String32()
+	// The location is known before the upload so the object is garbage-collected if the server stops
+	// before the upload is finished.
+	fdef.Location = key
+
+	if err = store.Files.StartUpload(fdef); err != nil {
+		logs.Warn.Println("failed to create file record", fdef.Id, err)
+		return "", 0, err
+	}
+
+	rc := readerCounter{reader: file}
+	var body io.Reader = &rc
+	contentType := fdef.MimeType
+	if gh.conf.Encrypt {
+		var enc *media.StreamEncrypter
+		if enc, err = media.NewStreamEncrypter(&rc, store.ActiveEncryptionKeyID(), store.DeriveMediaKey); err != nil {
+			return "", 0, err
+		}
+		body = enc
+		contentType = "application/octet-stream"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := gh.bucket.Object(key).NewWriter(ctx)
+	w.ChunkSize = gh.conf.ChunkSize
+	w.ContentType = contentType
+	w.CacheControl = gh.conf.CacheControl
+	if _, err = io.Copy(w, body); err != nil {
+		// Cancelling the context aborts the upload.
+		cancel()
+		w.Close()
+		return "", 0, err
+	}
+	if err = w.Close(); err != nil {
+		return "", 0, err
+	}
+
+	fname := fdef.Id
+	ext, _ := mime.ExtensionsByType(fdef.MimeType)
+	if len(ext) > 0 {
+		fname += ext[0]
+	}
+
+	fdef.ETag = w.Attrs().Etag
+	return gh.conf.ServeURL + fname, rc.count, nil
+}
+
+// Download processes request for file download. Only encrypted files are downloaded through
+// the server, others are served by GCS directly.
+// The returned ReadSeekCloser must be closed after use.
+func (gh *gcshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
+	if !gh.conf.Encrypt {
+		return nil, nil, types.ErrUnsupported
+	}
+
+	fid := gh.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, nil, types.ErrNotFound
+	}
+
+	fd, err := gh.getFileRecord(fid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	obj := gh.bucket.Object(fd.Location)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = types.ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	or := &objectReader{obj: obj, size: attrs.Size}
+	rsc, err := media.NewDecryptingReadSeekCloser(or, store.DeriveMediaKey)
+	if err != nil {
+		or.Close()
+		return nil, nil, err
+	}
+	return fd, rsc, nil
+}
+
+// objectReader reads GCS object with ranged requests so it can seek.
+type objectReader struct {
+	obj    *storage.ObjectHandle
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads object data from the current offset.
+func (or *objectReader) Read(p []byte) (int, error) {
+	if or.offset >= or.size {
+		return 0, io.EOF
+	}
+	if or.body == nil {
+		r, err := or.obj.NewRangeReader(context.Background(), or.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		or.body = r
+	}
+	n, err := or.body.Read(p)
+	or.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (or *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += or.offset
+	case io.SeekEnd:
+		offset += or.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != or.offset {
+		or.Close()
+		or.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the current request, if any.
+func (or *objectReader) Close() error {
+	if or.body == nil {
+		return nil
+	}
+	err := or.body.Close()
+	or.body = nil
+	return err
+}
+
+// Delete deletes files from GCS by provided slice of locations.
+func (gh *gcshandler) Delete(locations []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	for _, key := range locations {
+		if key == "" {
+			continue
+		}
+		if err := gh.bucket.Object(key).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetIdFromUrl converts an attahment URL to a file UID.
+func (gh *gcshandler) GetIdFromUrl(url string) types.Uid {
+	return media.GetIdFromUrl(url, gh.conf.ServeURL)
+}
+
+// getFileRecord given file ID reads file record from the database.
+func (gh *gcshandler) getFileRecord(fid types.Uid) (*types.FileDef, error) {
+	fd, err := store.Files.Get(fid.String())
+	if err != nil {
+		return nil, err
+	}
+	if fd == nil {
+		return nil, types.ErrNotFound
+	}
+	return fd, nil
+}
+
+func init() {
+	store.RegisterMediaHandler(handlerName, &gcshandler{})
+}
@@ -48,6 +48,9 @@ type awsconfig struct {
 	ServeURL        string   `json:"serve_url"`
 	PresignTTL      int      `json:"presign_ttl"`
 	CacheControl    string   `json:"cache_control"`
+	// Encrypt uploaded files with the message encryption key. Encrypted files are served
+	// by the server instead of redirecting to S3.
+	Encrypt bool `json:"encrypt"`
 }
 
 type awshandler struct {
@@ -102,6 +105,9 @@ func (ah *awshandler) Init(jsconf string) error {
 	if err != nil {
 		return errors.New("failed to parse CORS allowed origins: " + err.Error())
 	}
+	if ah.conf.Encrypt && !store.IsEncryptionEnabled() {
+		return errors.New("encryption of uploads requires message encryption to be enabled")
+	}
 
 	var sess *session.Session
 	if sess, err = session.NewSession(&aws.Config{
@@ -193,6 +199,15 @@ func (ah *awshandler) Headers(method string, url *url.URL, headers http.Header,
 			http.StatusNotModified, nil
 	}
 
+	if ah.conf.Encrypt {
+		// Encrypted files cannot be served by S3 directly: serve them through Download.
+		return http.Header{
+			"ETag":          {`"` + fdef.ETag + `"`},
+			"Content-Type":  {fdef.MimeType},
+			"Cache-Control": {ah.conf.CacheControl},
+		}, 0, nil
+	}
+
 	var awsReq *request.Request
 	switch method {
 	case http.MethodGet:
@@ -248,11 +263,19 @@ func (ah *awshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64
 	}
 
 	rc := readerCounter{reader: file}
+	var body io.Reader = &rc
+	var enc *media.StreamEncrypter
+	if ah.conf.Encrypt {
+		if enc, err = media.NewStreamEncrypter(&rc, store.ActiveEncryptionKeyID(), store.DeriveMediaKey); err != nil {
+			return "", 0, err
+		}
+		body = enc
+	}
 	result, err := uploader.Upload(&s3manager.UploadInput{
 		CacheControl: aws.String(ah.conf.CacheControl),
 		Bucket:       aws.String(ah.conf.BucketName),
 		Key:          aws.String(key),
-		Body:         &rc,
+		Body:         body,
 	})
 
 	if err != nil {
@@ -272,10 +295,104 @@ func (ah *awshandler) Upload(fdef *types.FileDef, file io.Reader) (string, int64
 	return ah.conf.ServeURL + fname, rc.count, nil
 }
 
-// Download processes request for file download.
+// Download processes request for file download. Only encrypted files are downloaded through
+// the server, others are served by S3 directly.
 // The returned ReadSeekCloser must be closed after use.
 func (ah *awshandler) Download(url string) (*types.FileDef, media.ReadSeekCloser, error) {
-	return nil, nil, types.ErrUnsupported
+	if !ah.conf.Encrypt {
+		return nil, nil, types.ErrUnsupported
+	}
+
+	fid := ah.GetIdFromUrl(url)
+	if fid.IsZero() {
+		return nil, nil, types.ErrNotFound
+	}
+
+	fd, err := ah.getFileRecord(fid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	head, err := ah.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(ah.conf.BucketName),
+		Key:    aws.String(fd.Location),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			err = types.ErrNotFound
+		}
+		return nil, nil, err
+	}
+
+	obj := &objectReader{svc: ah.svc, bucket: ah.conf.BucketName, key: fd.Location, size: aws.Int64Value(head.ContentLength)}
+	rsc, err := media.NewDecryptingReadSeekCloser(obj, store.DeriveMediaKey)
+	if err != nil {
+		obj.Close()
+		return nil, nil, err
+	}
+	return fd, rsc, nil
+}
+
+// objectReader reads S3 object with ranged GET requests so it can seek.
+type objectReader struct {
+	svc    *s3.S3
+	bucket string
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read reads object data from the current offset.
+func (obj *objectReader) Read(p []byte) (int, error) {
+	if obj.offset >= obj.size {
+		return 0, io.EOF
+	}
+	if obj.body == nil {
+		out, err := obj.svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(obj.bucket),
+			Key:    aws.String(obj.key),
+			Range:  aws.String("bytes=" + strconv.FormatInt(obj.offset, 10) + "-"),
+		})
+		if err != nil {
+			return 0, err
+		}
+		obj.body = out.Body
+	}
+	n, err := obj.body.Read(p)
+	obj.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (obj *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += obj.offset
+	case io.SeekEnd:
+		offset += obj.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != obj.offset {
+		obj.Close()
+		obj.offset = offset
+	}
+	return offset, nil
+}
+
+// Close closes the current GET request, if any.
+func (obj *objectReader) Close() error {
+	if obj.body == nil {
+		return nil
+	}
+	err := obj.body.Close()
+	obj.body = nil
+	return err
 }
 
 // Delete deletes files from aws by provided slice of locations.
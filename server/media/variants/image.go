@@ -0,0 +1,99 @@
+package variants
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	// Register decoders of image formats.
+	_ "image/gif"
+)
+
+// errTooManyPixels is returned when the image is too large to decode.
+var errTooManyPixels = errors.New("variants: image too large")
+
+// decodeImage decodes the image, rejects images with more than maxPixels pixels.
+func decodeImage(data []byte, maxPixels int) (image.Image, error) {
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if maxPixels > 0 && conf.Width*conf.Height > maxPixels {
+		return nil, errTooManyPixels
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// fitSize returns dimensions of the image scaled down to fit into a square of maxSize.
+// Images smaller than maxSize are not scaled.
+func fitSize(width, height, maxSize int) (int, int) {
+	if maxSize <= 0 || (width <= maxSize && height <= maxSize) {
+		return width, height
+	}
+	if width >= height {
+		return maxSize, max(1, height*maxSize/width)
+	}
+	return max(1, width*maxSize/height), maxSize
+}
+
+// scaleImage scales the image down to the given size averaging the covered pixels of the source.
+func scaleImage(src image.Image, width, height int) *image.NRGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		y0 := bounds.Min.Y + y*srcH/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/height)
+		for x := range width {
+			x0 := bounds.Min.X + x*srcW/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					// Premultiplied 16 bit components.
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			c := color.NRGBA{}
+			if a > 0 {
+				// Un-premultiply and convert to 8 bit.
+				c.R = uint8(r * 0xff / a)
+				c.G = uint8(g * 0xff / a)
+				c.B = uint8(b * 0xff / a)
+				c.A = uint8(a / n >> 8)
+			}
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+	return dst
+}
+
+// encodeImage writes the image as JPEG or, if mimeType is not "image/jpeg", as PNG.
+func encodeImage(w io.Writer, img image.Image, mimeType string, quality int) error {
+	if mimeType == "image/jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	return png.Encode(w, img)
+}
+
+// thumbnail scales the image to fit into a square of maxSize and encodes it.
+func thumbnail(img image.Image, maxSize int, mimeType string, quality int) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := fitSize(bounds.Dx(), bounds.Dy(), maxSize)
+	if width != bounds.Dx() || height != bounds.Dy() {
+		img = scaleImage(img, width, height)
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, mimeType, quality); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,65 @@
+package variants
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestFitSize(t *testing.T) {
+	cases := []struct{ w, h, size, ew, eh int }{
+		{1000, 500, 100, 100, 50},
+		{500, 1000, 100, 50, 100},
+		{80, 60, 100, 80, 60},
+		{1000, 1, 100, 100, 1},
+		{1000, 500, 0, 1000, 500},
+	}
+	for _, c := range cases {
+		if w, h := fitSize(c.w, c.h, c.size); w != c.ew || h != c.eh {
+			t.Errorf("fitSize(%d, %d, %d) = %d, %d, expected %d, %d", c.w, c.h, c.size, w, h, c.ew, c.eh)
+		}
+	}
+}
+
+func TestScaleImage(t *testing.T) {
+	// Vertical stripes: black, white, black, white.
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for x := range 4 {
+		for y := range 2 {
+			src.SetNRGBA(x, y, color.NRGBA{R: uint8(255 * (x % 2)), G: uint8(255 * (x % 2)), B: uint8(255 * (x % 2)), A: 255})
+		}
+	}
+	// Transparent pixel must not darken the average.
+	src.SetNRGBA(3, 1, color.NRGBA{})
+
+	dst := scaleImage(src, 2, 1)
+	if c := dst.NRGBAAt(0, 0); c.R != 127 || c.A != 255 {
+		t.Errorf("Expected gray, got %v", c)
+	}
+	if c := dst.NRGBAAt(1, 0); c.R != 85 || c.A != 191 {
+		t.Errorf("Expected translucent gray, got %v", c)
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 300, 200)))
+	img, err := decodeImage(buf.Bytes(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decodeImage(buf.Bytes(), 1000); err != errTooManyPixels {
+		t.Errorf("Expected image rejected, got %v", err)
+	}
+
+	data, err := thumbnail(img, 90, "image/jpeg", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != "jpeg" || conf.Width != 90 || conf.Height != 60 {
+		t.Errorf("Unexpected thumbnail %s %dx%d, %v", format, conf.Width, conf.Height, err)
+	}
+}
@@ -0,0 +1,326 @@
+// Package variants generates variants of uploaded media files in the background: thumbnails of
+// images, poster frames and thumbnails of videos, and MP4 copies of videos. Videos are processed
+// by an external ffmpeg executable. Variants are stored by the media handler as regular files.
+package variants
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	defaultWorkers   = 2
+	defaultQueueSize = 64
+	defaultQuality   = 80
+	// Images with more pixels are not processed.
+	defaultMaxPixels = 50_000_000
+	// Default timeout of processing one video, seconds.
+	defaultTimeout = 300
+)
+
+type configType struct {
+	// Number of files processed concurrently.
+	Workers int `json:"workers"`
+	// Number of files waiting to be processed. Files uploaded when the queue is full get no variants.
+	QueueSize int `json:"queue_size"`
+	// Sizes of thumbnails: maximum width and height in pixels.
+	Thumbnails []int `json:"thumbnails"`
+	// Quality of JPEG images, 1-100.
+	Quality int `json:"quality"`
+	// Maximum number of pixels of processed images.
+	MaxPixels int `json:"max_pixels"`
+	// Path to ffmpeg executable. Videos are not processed if blank.
+	Ffmpeg string `json:"ffmpeg"`
+	// Time of the poster frame of videos, seconds.
+	PosterAt float64 `json:"poster_at"`
+	// Maximum height of the MP4 copy of videos. No copy is made if 0.
+	TranscodeHeight int `json:"transcode_height"`
+	// Timeout of processing one video, seconds.
+	Timeout int `json:"timeout"`
+}
+
+// variant is one file generated from the upload.
+type variant struct {
+	name string
+	// Maximum width and height of an image variant, 0 for the original size.
+	size int
+	fdef *types.FileDef
+	url  string
+}
+
+type job struct {
+	// Download URL of the uploaded file.
+	url      string
+	mimeType string
+	variants []*variant
+}
+
+// Pipeline generates variants of uploaded files by a pool of workers.
+type Pipeline struct {
+	conf configType
+	jobs chan *job
+	wg   sync.WaitGroup
+}
+
+// New creates the pipeline and starts the workers.
+func New(jsconfig json.RawMessage) (*Pipeline, error) {
+	p := &Pipeline{}
+	if err := json.Unmarshal(jsconfig, &p.conf); err != nil {
+		return nil, errors.New("variants: failed to parse config: " + err.Error())
+	}
+	if p.conf.Workers <= 0 {
+		p.conf.Workers = defaultWorkers
+	}
+	if p.conf.QueueSize <= 0 {
+		p.conf.QueueSize = defaultQueueSize
+	}
+	if p.conf.Quality <= 0 || p.conf.Quality > 100 {
+		p.conf.Quality = defaultQuality
+	}
+	if p.conf.MaxPixels <= 0 {
+		p.conf.MaxPixels = defaultMaxPixels
+	}
+	if p.conf.Timeout <= 0 {
+		p.conf.Timeout = defaultTimeout
+	}
+	for _, size := range p.conf.Thumbnails {
+		if size <= 0 {
+			return nil, errors.New("variants: invalid thumbnail size " + strconv.Itoa(size))
+		}
+	}
+	if p.conf.Ffmpeg != "" {
+		if _, err := os.Stat(p.conf.Ffmpeg); err != nil {
+			return nil, errors.New("variants: ffmpeg not found: " + err.Error())
+		}
+	}
+
+	p.jobs = make(chan *job, p.conf.QueueSize)
+	for range p.conf.Workers {
+		p.wg.Add(1)
+		go p.run()
+	}
+	return p, nil
+}
+
+// Stop waits for the queued files to be processed and stops the workers.
+func (p *Pipeline) Stop() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+// Submit queues generation of variants of the uploaded file. Returns download URLs of the variants
+// by name or nil if the file has none. Variants are available once generated, until then the URLs
+// return 404. The URLs are attached to messages like URLs of uploaded files.
+func (p *Pipeline) Submit(fdef *types.FileDef, url string) map[string]string {
+	var names []string
+	var sizes []int
+	var mimeTypes []string
+	switch {
+	case fdef.MimeType == "image/jpeg" || fdef.MimeType == "image/png" || fdef.MimeType == "image/gif":
+		// Keep transparency of PNG and GIF.
+		thumbType := "image/png"
+		if fdef.MimeType == "image/jpeg" {
+			thumbType = "image/jpeg"
+		}
+		for _, size := range p.conf.Thumbnails {
+			names, sizes, mimeTypes = append(names, "thumb"+strconv.Itoa(size)), append(sizes, size),
+				append(mimeTypes, thumbType)
+		}
+	case strings.HasPrefix(fdef.MimeType, "video/") && p.conf.Ffmpeg != "":
+		names, sizes, mimeTypes = append(names, "poster"), append(sizes, 0), append(mimeTypes, "image/jpeg")
+		for _, size := range p.conf.Thumbnails {
+			names, sizes, mimeTypes = append(names, "thumb"+strconv.Itoa(size)), append(sizes, size),
+				append(mimeTypes, "image/jpeg")
+		}
+		if p.conf.TranscodeHeight > 0 {
+			names, sizes, mimeTypes = append(names, "mp4"), append(sizes, p.conf.TranscodeHeight),
+				append(mimeTypes, "video/mp4")
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	// Variants are served from the same location as the original.
+	prefix := url[:strings.LastIndex(url, "/")+1]
+	jb := &job{url: url, mimeType: fdef.MimeType}
+	urls := make(map[string]string, len(names))
+	for i, name := range names {
+		vfdef := &types.FileDef{
+			ObjHeader: types.ObjHeader{
+				Id: store.Store.GetUidString(),
+			},
+			User:     fdef.User,
+			MimeType: mimeTypes[i],
+		}
+		vfdef.InitTimes()
+		if err := store.ReserveUpload(vfdef); err != nil {
+			logs.Warn.Println("variants: failed to reserve upload", fdef.Id, name, err)
+			continue
+		}
+		v := &variant{name: name, size: sizes[i], fdef: vfdef, url: prefix + vfdef.Id}
+		if ext, _ := mime.ExtensionsByType(vfdef.MimeType); len(ext) > 0 {
+			// Media handlers name files the same way.
+			v.url += ext[0]
+		}
+		jb.variants = append(jb.variants, v)
+		urls[name] = v.url
+	}
+
+	select {
+	case p.jobs <- jb:
+		return urls
+	default:
+		logs.Warn.Println("variants: queue full, skipped", fdef.Id)
+		for _, v := range jb.variants {
+			store.Files.FinishUpload(v.fdef, false, 0)
+		}
+		return nil
+	}
+}
+
+func (p *Pipeline) run() {
+	defer p.wg.Done()
+	for jb := range p.jobs {
+		start := time.Now()
+		var err error
+		if strings.HasPrefix(jb.mimeType, "video/") {
+			err = p.processVideo(jb)
+		} else {
+			err = p.processImage(jb)
+		}
+		// Drop records of variants which were not generated.
+		for _, v := range jb.variants {
+			if v.fdef.Status == types.UploadStarted {
+				store.Files.FinishUpload(v.fdef, false, 0)
+			}
+		}
+		if err != nil {
+			logs.Warn.Println("variants: failed to process", jb.url, err)
+		} else {
+			logs.Info.Println("variants: processed", jb.url, "in", time.Since(start))
+		}
+	}
+}
+
+// download reads the uploaded file.
+func (p *Pipeline) download(url string) ([]byte, error) {
+	_, rsc, err := store.Store.GetMediaHandler().Download(url)
+	if err != nil {
+		return nil, err
+	}
+	defer rsc.Close()
+	return io.ReadAll(rsc)
+}
+
+// upload stores the generated variant.
+func (p *Pipeline) upload(v *variant, file io.Reader) error {
+	mh := store.Store.GetMediaHandler()
+	url, size, err := mh.Upload(v.fdef, file)
+	if err != nil {
+		return err
+	}
+	if _, err = store.Files.FinishUpload(v.fdef, true, size); err != nil {
+		mh.Delete([]string{v.fdef.Location})
+		return err
+	}
+	if url != v.url {
+		logs.Warn.Println("variants: URL of", v.name, "is", url, "expected", v.url)
+	}
+	return nil
+}
+
+func (p *Pipeline) processImage(jb *job) error {
+	data, err := p.download(jb.url)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(data, p.conf.MaxPixels)
+	if err != nil {
+		return err
+	}
+	for _, v := range jb.variants {
+		thumb, err := thumbnail(img, v.size, v.fdef.MimeType, p.conf.Quality)
+		if err != nil {
+			return err
+		}
+		if err = p.upload(v, bytes.NewReader(thumb)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Pipeline) processVideo(jb *job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.conf.Timeout)*time.Second)
+	defer cancel()
+
+	// ffmpeg needs a seekable input.
+	_, rsc, err := store.Store.GetMediaHandler().Download(jb.url)
+	if err != nil {
+		return err
+	}
+	src, err := os.CreateTemp("", "tinode-video-")
+	if err != nil {
+		rsc.Close()
+		return err
+	}
+	defer os.Remove(src.Name())
+	_, err = io.Copy(src, rsc)
+	rsc.Close()
+	src.Close()
+	if err != nil {
+		return err
+	}
+
+	frame, err := posterFrame(ctx, p.conf.Ffmpeg, src.Name(), p.conf.PosterAt)
+	if err != nil {
+		return err
+	}
+	img, err := decodeImage(frame, p.conf.MaxPixels)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range jb.variants {
+		if v.fdef.MimeType == "video/mp4" {
+			dst := src.Name() + ".mp4"
+			if err = transcode(ctx, p.conf.Ffmpeg, src.Name(), dst, v.size); err != nil {
+				return err
+			}
+			file, err := os.Open(dst)
+			if err != nil {
+				return err
+			}
+			err = p.upload(v, file)
+			file.Close()
+			os.Remove(dst)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		thumb, err := thumbnail(img, v.size, v.fdef.MimeType, p.conf.Quality)
+		if err != nil {
+			return err
+		}
+		if err = p.upload(v, bytes.NewReader(thumb)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
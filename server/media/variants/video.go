@@ -0,0 +1,56 @@
+package variants
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ffmpeg runs the ffmpeg executable with the arguments. Returns standard output.
+func ffmpeg(ctx context.Context, path string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, append([]string{"-hide_banner", "-loglevel", "error", "-nostdin"}, args...)...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New("variants: ffmpeg: " + msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// posterFrame extracts one frame of the video at the given time in seconds as a PNG image. Falls back
+// to the first frame if the video is shorter.
+func posterFrame(ctx context.Context, ffmpegPath, src string, at float64) ([]byte, error) {
+	extract := func(at float64) ([]byte, error) {
+		return ffmpeg(ctx, ffmpegPath, "-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", src,
+			"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	}
+	frame, err := extract(at)
+	if err == nil && len(frame) == 0 && at > 0 {
+		frame, err = extract(0)
+	}
+	if err == nil && len(frame) == 0 {
+		err = errors.New("variants: no video frames")
+	}
+	return frame, err
+}
+
+// transcode converts the video to MP4 with H.264 video and AAC audio, height at most maxHeight.
+func transcode(ctx context.Context, ffmpegPath, src, dst string, maxHeight int) error {
+	// Keep the width even as required by H.264, never scale up.
+	scale := "scale=-2:'min(" + strconv.Itoa(maxHeight) + ",trunc(ih/2)*2)'"
+	_, err := ffmpeg(ctx, ffmpegPath, "-y", "-i", src, "-vf", scale,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k", "-movflags", "+faststart", "-f", "mp4", dst)
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Mentions and keyword alerts. Subscribers mentioned in a new message with
+ *    Drafty MN entities and subscribers whose keywords are found in the text
+ *    of the message are added to the index of mentions. They are notified of
+ *    the message even if they muted the topic. The user sets keywords with
+ *    {set topic="me" notify={keywords: [...]}} and fetches own mentions across
+ *    topics with {get topic="me" what="mentions"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/moderation"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum number of keywords of a user.
+	maxKeywordCount = 32
+	// Maximum length of a keyword in bytes.
+	maxKeywordLength = 64
+)
+
+// normalizeKeywords validates keywords of the user and converts them to lowercase.
+func normalizeKeywords(keywords []string) ([]string, error) {
+	if len(keywords) > maxKeywordCount {
+		return nil, errors.New("too many keywords")
+	}
+	result := make([]string, 0, len(keywords))
+	seen := make(map[string]bool, len(keywords))
+	for _, kw := range keywords {
+		kw = strings.ToLower(strings.TrimSpace(kw))
+		if kw == "" || len(kw) > maxKeywordLength || len(moderation.Words(kw)) != 1 || moderation.Words(kw)[0] != kw {
+			return nil, errors.New("invalid keyword")
+		}
+		if !seen[kw] {
+			seen[kw] = true
+			result = append(result, kw)
+		}
+	}
+	return result, nil
+}
+
+// msgMentions finds subscribers mentioned in the new message by MN entities or by their keywords.
+// Returns the mentioned users with the keyword found in the message, empty for @mentions.
+func (t *Topic) msgMentions(fromUid types.Uid, head map[string]any, content any) map[types.Uid]string {
+	if (t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp) || head[types.MsgHeadE2EE] == true {
+		// Content of encrypted messages is opaque.
+		return nil
+	}
+
+	scope := msgScope(head)
+	// Subscribers who can read the message, except the sender.
+	canRead := func(uid types.Uid) bool {
+		pud, ok := t.perUser[uid]
+		return ok && uid != fromUid && !pud.deleted && !pud.isChan &&
+			(pud.modeGiven & pud.modeWant).IsReader() && t.userInMsgScope(scope, uid)
+	}
+
+	mentioned := make(map[types.Uid]string)
+	if mentions, err := drafty.Mentions(content); err == nil {
+		for _, userId := range mentions {
+			if uid := types.ParseUserId(userId); !uid.IsZero() && canRead(uid) {
+				mentioned[uid] = ""
+			}
+		}
+	}
+
+	words := moderation.Words(messageContentText(head, content))
+	if len(words) == 0 {
+		return mentioned
+	}
+	var uids []types.Uid
+	for uid := range t.perUser {
+		if _, found := mentioned[uid]; !found && canRead(uid) {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return mentioned
+	}
+	settings, err := store.NotifySettings.Get(uids...)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load keywords: %v", t.name, err)
+		return mentioned
+	}
+	if len(settings) == 0 {
+		return mentioned
+	}
+	found := make(map[string]bool, len(words))
+	for _, w := range words {
+		found[w] = true
+	}
+	for uid, ns := range settings {
+		for _, kw := range ns.Keywords {
+			if found[kw] {
+				mentioned[uid] = kw
+				break
+			}
+		}
+	}
+	return mentioned
+}
+
+// indexMentions adds the message to the index of mentions of the mentioned users.
+func (t *Topic) indexMentions(fromUid types.Uid, seqId int, msg *ClientComMessage, mentioned map[types.Uid]string) {
+	if len(mentioned) == 0 {
+		return
+	}
+	mentions := make([]types.Mention, 0, len(mentioned))
+	for uid, kw := range mentioned {
+		mentions = append(mentions, types.Mention{
+			User:      uid.String(),
+			Topic:     t.name,
+			SeqId:     seqId,
+			From:      fromUid.String(),
+			Keyword:   kw,
+			CreatedAt: msg.Timestamp,
+		})
+	}
+	if err := store.Mentions.Add(mentions); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to index mentions: %v", t.name, err)
+	}
+}
+
+// replyGetMentions returns messages which mention the user across topics the user can read.
+func (t *Topic) replyGetMentions(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for mentions")
+	}
+
+	if req != nil && (req.User != "" || req.IfModifiedSince != nil || req.SinceId != 0 || req.BeforeId != 0 ||
+		len(req.IdRanges) > 0 || req.Search != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid mentions query")
+	}
+
+	var topic string
+	var opts MsgGetOpts
+	if req != nil {
+		opts = *req
+		topic = req.Topic
+	}
+	scopes, err := msgSearchScopes(asUid, topic)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	topics := make([]string, 0, len(scopes))
+	for name, scope := range scopes {
+		// Channel readers are not notified of mentions.
+		if !scope.asChan {
+			topics = append(topics, name)
+		}
+	}
+
+	mentions, err := store.Mentions.GetAll(asUid, topics, opts.Until, opts.Limit)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(mentions) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "mentions"}))
+		return nil
+	}
+
+	result := make([]MsgMention, len(mentions))
+	for i := range mentions {
+		mn := &mentions[i]
+		result[i] = MsgMention{
+			Topic:     scopes[mn.Topic].name,
+			SeqId:     mn.SeqId,
+			From:      types.ParseUid(mn.From).UserId(),
+			Keyword:   mn.Keyword,
+			Timestamp: mn.CreatedAt,
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Mentions:  result,
+		},
+	})
+	return nil
+}
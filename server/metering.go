@@ -0,0 +1,542 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Usage metering for billing. Messages sent, push notifications sent and
+ *    minutes of calls are counted per user and billing period, a calendar
+ *    month in UTC. Storage used is the total size of files uploaded by the
+ *    user, see quota.go. Each node counts usage in memory and periodically
+ *    adds it to the database, where usage of a tenant is the sum of usage of
+ *    its users.
+ *
+ *    Usage limits are configured per user for the server and may be
+ *    overridden for users of a tenant. Tenants may also limit the total
+ *    usage of all their users. Reaching a soft limit is logged once per
+ *    period, requests over a hard limit are rejected: messages and calls
+ *    with 'quota exceeded', push notifications are not sent. Storage is
+ *    limited by the storage quotas.
+ *
+ *    Limits are checked against the saved usage plus usage counted at this
+ *    node. Usage counted at other nodes becomes visible once it's saved, so
+ *    a cluster may exceed a hard limit by the usage of one flush period.
+ *
+ *    Usage is queried through the admin API and is periodically exported to
+ *    CSV or JSON files, one file per billing period.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Saved usage is reloaded after this time: usage saved by other cluster nodes becomes visible.
+	meterCacheTTL = time.Minute
+	// Layout of the billing period.
+	meterPeriodLayout = "2006-01"
+)
+
+// Usage metering config.
+type meteringConfig struct {
+	Enabled bool `json:"enabled"`
+	// How often usage counted by the node is saved to the database (seconds).
+	FlushPeriod int `json:"flush_period"`
+	// Monthly usage limits of each user by metric: "messages", "pushes", "call_minutes".
+	Limits map[string]types.UsageLimit `json:"limits"`
+	// Periodic export of usage to files.
+	Export *meteringExportConfig `json:"export"`
+}
+
+// Usage export config.
+type meteringExportConfig struct {
+	// Directory to write files to.
+	Path string `json:"path"`
+	// Format of files: "csv" or "json".
+	Format string `json:"format"`
+	// How often usage of the current and the previous billing period is exported (seconds).
+	Period int `json:"period"`
+}
+
+// Usage of a user or a tenant saved to the database.
+type meterSaved struct {
+	usage    types.UsageRecord
+	loadedAt time.Time
+	// Metrics with reached soft limits which were reported.
+	reported map[string]bool
+}
+
+// Key of usage counted at the node.
+type meterKey struct {
+	period string
+	uid    types.Uid
+}
+
+var meterCache struct {
+	sync.Mutex
+	// Usage counted at this node and not saved yet.
+	pending map[meterKey]*types.UsageRecord
+	// Saved usage of users and tenants in the current period.
+	users   map[types.Uid]*meterSaved
+	tenants map[string]*meterSaved
+	// Users whose saved usage is being loaded in background.
+	loading map[types.Uid]bool
+}
+
+// meterPeriod returns the billing period of the given time.
+func meterPeriod(ts time.Time) string {
+	return ts.UTC().Format(meterPeriodLayout)
+}
+
+// meterValue returns the value of the usage metric.
+func meterValue(usage *types.UsageRecord, metric string) int64 {
+	switch metric {
+	case types.UsageMessages:
+		return usage.Messages
+	case types.UsagePushes:
+		return usage.Pushes
+	case types.UsageCallMinutes:
+		// Started minutes.
+		return (usage.CallSeconds + 59) / 60
+	}
+	return 0
+}
+
+// meterAddTo adds counts of the usage to the total.
+func meterAddTo(total, usage *types.UsageRecord) {
+	total.Messages += usage.Messages
+	total.Pushes += usage.Pushes
+	total.CallSeconds += usage.CallSeconds
+}
+
+// meterValidateLimits checks usage limits from the config or the admin API.
+func meterValidateLimits(limits map[string]types.UsageLimit) error {
+	for metric, limit := range limits {
+		switch metric {
+		case types.UsageMessages, types.UsagePushes, types.UsageCallMinutes:
+		default:
+			return errors.New("unknown usage metric '" + metric + "'")
+		}
+		if limit.Soft < 0 || limit.Hard < 0 {
+			return errors.New("negative usage limit of '" + metric + "'")
+		}
+		if limit.Hard > 0 && limit.Soft > limit.Hard {
+			return errors.New("soft usage limit of '" + metric + "' is above the hard limit")
+		}
+	}
+	return nil
+}
+
+// meterLimits returns usage limits of each user of the tenant and of all users of the tenant together.
+func meterLimits(tenant string) (map[string]types.UsageLimit, map[string]types.UsageLimit) {
+	t := tenantGet(tenant)
+	if t == nil {
+		return globals.meterLimits, nil
+	}
+	if len(t.Config.AccountLimits) == 0 {
+		return globals.meterLimits, t.Config.Limits
+	}
+	account := make(map[string]types.UsageLimit, len(globals.meterLimits)+len(t.Config.AccountLimits))
+	maps.Copy(account, globals.meterLimits)
+	maps.Copy(account, t.Config.AccountLimits)
+	return account, t.Config.Limits
+}
+
+// meterAdd adds usage of the user in the current billing period.
+func meterAdd(uid types.Uid, update func(usage *types.UsageRecord)) {
+	if !globals.meteringEnabled || uid.IsZero() {
+		return
+	}
+	key := meterKey{period: meterPeriod(time.Now()), uid: uid}
+
+	meterCache.Lock()
+	if meterCache.pending == nil {
+		meterCache.pending = make(map[meterKey]*types.UsageRecord)
+	}
+	usage := meterCache.pending[key]
+	if usage == nil {
+		usage = &types.UsageRecord{Period: key.period, User: uid.String()}
+		meterCache.pending[key] = usage
+	}
+	update(usage)
+	meterCache.Unlock()
+}
+
+// meterMessage counts a message sent by the user.
+func meterMessage(uid types.Uid) {
+	meterAdd(uid, func(usage *types.UsageRecord) {
+		usage.Messages++
+	})
+}
+
+// meterCall counts the call duration in milliseconds for each participant of the call.
+func meterCall(participants []string, duration int64) {
+	if duration <= 0 {
+		return
+	}
+	for _, id := range participants {
+		meterAdd(types.ParseUid(id), func(usage *types.UsageRecord) {
+			usage.CallSeconds += (duration + 999) / 1000
+		})
+	}
+}
+
+// meterPushes removes recipients who reached the hard limit of push notifications from the receipt
+// and counts the push for the rest. Silent pushes are not metered.
+func meterPushes(rcpt *push.Receipt) {
+	if !globals.meteringEnabled || rcpt.Payload.Silent {
+		return
+	}
+	for uid := range rcpt.To {
+		// The push is not delayed by loading of usage.
+		if meterCheck(uid, types.UsagePushes, false) != nil {
+			delete(rcpt.To, uid)
+			continue
+		}
+		meterAdd(uid, func(usage *types.UsageRecord) {
+			usage.Pushes++
+		})
+	}
+}
+
+// meterCheck returns types.ErrQuotaExceeded if usage of the metric by the user in the current billing
+// period has reached a hard limit of the user or the user's tenant. Usage which is not cached is loaded
+// if wait is true, otherwise it's loaded in background and the limit is not checked.
+func meterCheck(uid types.Uid, metric string, wait bool) error {
+	if !globals.meteringEnabled || uid.IsZero() {
+		return nil
+	}
+	period := meterPeriod(time.Now())
+	user, tenant := meterLoad(uid, period, wait)
+	if user == nil {
+		return nil
+	}
+	account, total := meterLimits(user.usage.Tenant)
+
+	meterCache.Lock()
+	defer meterCache.Unlock()
+
+	pending := meterCache.pending[meterKey{period: period, uid: uid}]
+	usage := user.usage
+	if pending != nil {
+		meterAddTo(&usage, pending)
+	}
+	if meterReached(user, &usage, metric, account[metric]) {
+		return types.ErrQuotaExceeded
+	}
+	if tenant != nil {
+		usage = tenant.usage
+		// Usage counted at this node is added to the tenant when saved.
+		for key, pending := range meterCache.pending {
+			if key.period == period && meterCache.users[key.uid] != nil &&
+				meterCache.users[key.uid].usage.Tenant == user.usage.Tenant {
+				meterAddTo(&usage, pending)
+			}
+		}
+		if meterReached(tenant, &usage, metric, total[metric]) {
+			return types.ErrQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// meterReached checks the usage against the limit and reports the reached soft limit once.
+// Returns true if the hard limit is reached.
+func meterReached(saved *meterSaved, usage *types.UsageRecord, metric string, limit types.UsageLimit) bool {
+	value := meterValue(usage, metric)
+	if limit.Soft > 0 && value >= limit.Soft && !saved.reported[metric] {
+		if saved.reported == nil {
+			saved.reported = make(map[string]bool)
+		}
+		saved.reported[metric] = true
+		who := "tenant '" + usage.Tenant + "'"
+		if usage.User != "" {
+			who = "user " + types.ParseUid(usage.User).UserId()
+		}
+		logs.Info.Printf("metering: %s reached soft limit of %s (%d) in %s", who, metric, limit.Soft, usage.Period)
+		statsInc("UsageSoftLimitsReachedTotal", 1)
+	}
+	if limit.Hard > 0 && value >= limit.Hard {
+		statsInc("UsageHardLimitRejectionsTotal", 1)
+		return true
+	}
+	return false
+}
+
+// meterLoad returns saved usage of the user and of the user's tenant if the tenant limits total usage,
+// loading it if needed. Returns nil if usage is not cached and wait is false.
+func meterLoad(uid types.Uid, period string, wait bool) (*meterSaved, *meterSaved) {
+	now := time.Now()
+
+	meterCache.Lock()
+	user := meterCache.users[uid]
+	if user != nil && user.usage.Period == period && now.Sub(user.loadedAt) < meterCacheTTL {
+		tenant := meterCache.tenants[user.usage.Tenant]
+		if tenant != nil && (tenant.usage.Period != period || now.Sub(tenant.loadedAt) >= meterCacheTTL) {
+			tenant = nil
+		}
+		_, total := meterLimits(user.usage.Tenant)
+		if tenant != nil || len(total) == 0 {
+			meterCache.Unlock()
+			return user, tenant
+		}
+	}
+	if !wait {
+		if !meterCache.loading[uid] {
+			if meterCache.loading == nil {
+				meterCache.loading = make(map[types.Uid]bool)
+			}
+			meterCache.loading[uid] = true
+			go func() {
+				meterLoad(uid, period, true)
+				meterCache.Lock()
+				delete(meterCache.loading, uid)
+				meterCache.Unlock()
+			}()
+		}
+		meterCache.Unlock()
+		return nil, nil
+	}
+	meterCache.Unlock()
+
+	tenantId, err := userTenant(uid)
+	if err != nil {
+		logs.Warn.Println("metering: failed to load tenant of user", uid.UserId(), err)
+		return nil, nil
+	}
+	usage, err := store.Usage.Get(period, uid)
+	if err != nil {
+		logs.Warn.Println("metering: failed to load usage of user", uid.UserId(), err)
+		return nil, nil
+	}
+	usage.Tenant = tenantId
+	var total *types.UsageRecord
+	if _, limits := meterLimits(tenantId); len(limits) > 0 {
+		if total, err = store.Usage.Total(period, tenantId); err != nil {
+			logs.Warn.Println("metering: failed to load usage of tenant", tenantId, err)
+			return nil, nil
+		}
+	}
+
+	meterCache.Lock()
+	defer meterCache.Unlock()
+
+	if meterCache.users == nil {
+		meterCache.users = make(map[types.Uid]*meterSaved)
+		meterCache.tenants = make(map[string]*meterSaved)
+	}
+	user = meterCache.users[uid]
+	if user == nil || user.usage.Period != period {
+		user = &meterSaved{}
+		meterCache.users[uid] = user
+	}
+	user.usage, user.loadedAt = *usage, now
+
+	var tenant *meterSaved
+	if total != nil {
+		tenant = meterCache.tenants[tenantId]
+		if tenant == nil || tenant.usage.Period != period {
+			tenant = &meterSaved{}
+			meterCache.tenants[tenantId] = tenant
+		}
+		tenant.usage, tenant.loadedAt = *total, now
+	}
+	return user, tenant
+}
+
+// meterFlush saves usage counted at the node and evicts stale usage from the cache.
+func meterFlush() {
+	meterCache.Lock()
+	pending := meterCache.pending
+	meterCache.pending = nil
+	meterCache.Unlock()
+
+	if len(pending) == 0 {
+		meterEvict()
+		return
+	}
+
+	records := make([]types.UsageRecord, 0, len(pending))
+	for key, usage := range pending {
+		tenant, err := userTenant(key.uid)
+		if err != nil && err != types.ErrUserNotFound {
+			logs.Warn.Println("metering: failed to load tenant of user", key.uid.UserId(), err)
+			// Try again next time.
+			meterRestore(map[meterKey]*types.UsageRecord{key: usage})
+			continue
+		}
+		usage.Tenant = tenant
+		records = append(records, *usage)
+	}
+
+	if err := store.Usage.Add(records); err != nil {
+		logs.Warn.Println("metering: failed to save usage:", err)
+		meterRestore(pending)
+		return
+	}
+
+	// Saved usage stays accurate until it's reloaded.
+	meterCache.Lock()
+	for i := range records {
+		if user := meterCache.users[types.ParseUid(records[i].User)]; user != nil &&
+			user.usage.Period == records[i].Period {
+			meterAddTo(&user.usage, &records[i])
+		}
+		if tenant := meterCache.tenants[records[i].Tenant]; tenant != nil && tenant.usage.Period == records[i].Period {
+			meterAddTo(&tenant.usage, &records[i])
+		}
+	}
+	meterCache.Unlock()
+
+	meterEvict()
+}
+
+// meterRestore returns usage which failed to save to pending usage.
+func meterRestore(failed map[meterKey]*types.UsageRecord) {
+	meterCache.Lock()
+	defer meterCache.Unlock()
+
+	if meterCache.pending == nil {
+		meterCache.pending = make(map[meterKey]*types.UsageRecord)
+	}
+	for key, usage := range failed {
+		if current := meterCache.pending[key]; current != nil {
+			meterAddTo(current, usage)
+		} else {
+			meterCache.pending[key] = usage
+		}
+	}
+}
+
+// meterEvict removes stale saved usage from the cache.
+func meterEvict() {
+	now := time.Now()
+
+	meterCache.Lock()
+	defer meterCache.Unlock()
+
+	for uid, user := range meterCache.users {
+		if now.Sub(user.loadedAt) >= meterCacheTTL {
+			delete(meterCache.users, uid)
+		}
+	}
+	for id, tenant := range meterCache.tenants {
+		if now.Sub(tenant.loadedAt) >= meterCacheTTL {
+			delete(meterCache.tenants, id)
+		}
+	}
+}
+
+// meterExport writes usage of all users in the billing period to a file in the directory.
+func meterExport(config *meteringExportConfig, period string) error {
+	usage, err := store.Usage.List(period, nil)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(config.Path, "usage-"+period+"."+config.Format)
+	// Write to a temporary file first: readers never see a partial file.
+	file, err := os.CreateTemp(config.Path, ".usage-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if config.Format == "json" {
+		rows := make([]map[string]any, 0, len(usage))
+		for i := range usage {
+			rows = append(rows, map[string]any{
+				"period":       usage[i].Period,
+				"tenant":       usage[i].Tenant,
+				"user":         types.ParseUid(usage[i].User).UserId(),
+				"messages":     usage[i].Messages,
+				"pushes":       usage[i].Pushes,
+				"call_minutes": meterValue(&usage[i], types.UsageCallMinutes),
+				"storage":      usage[i].Storage,
+			})
+		}
+		err = json.NewEncoder(file).Encode(rows)
+	} else {
+		w := csv.NewWriter(file)
+		w.Write([]string{"period", "tenant", "user", "messages", "pushes", "call_minutes", "storage"})
+		for i := range usage {
+			w.Write([]string{
+				usage[i].Period,
+				usage[i].Tenant,
+				types.ParseUid(usage[i].User).UserId(),
+				strconv.FormatInt(usage[i].Messages, 10),
+				strconv.FormatInt(usage[i].Pushes, 10),
+				strconv.FormatInt(meterValue(&usage[i], types.UsageCallMinutes), 10),
+				strconv.FormatInt(usage[i].Storage, 10),
+			})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
+
+// meteringRunFlusher starts periodic saving and export of usage. Send true to the returned channel to
+// stop it, then wait for true back: usage counted at the node is saved before stopping.
+func meteringRunFlusher(period time.Duration, export *meteringExportConfig) chan bool {
+	statsRegisterInt("UsageSoftLimitsReachedTotal")
+	statsRegisterInt("UsageHardLimitRejectionsTotal")
+
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		var exportTick <-chan time.Time
+		if export != nil {
+			// Add some randomness to the export period to desynchronize runs on cluster nodes.
+			exportPeriod := time.Duration(export.Period) * time.Second
+			exportPeriod = exportPeriod - (exportPeriod >> 2) + time.Duration(rand.Intn(int(exportPeriod>>1)))
+			exportTicker := time.NewTicker(exportPeriod)
+			defer exportTicker.Stop()
+			exportTick = exportTicker.C
+		}
+
+		logs.Info.Printf("Usage metering started with flush period %s", period)
+		for {
+			select {
+			case <-ticker.C:
+				meterFlush()
+			case now := <-exportTick:
+				now = now.UTC()
+				// Usage saved by other nodes after the end of the previous period is exported too.
+				for _, p := range []string{meterPeriod(now.AddDate(0, 0, -now.Day())), meterPeriod(now)} {
+					if err := meterExport(export, p); err != nil {
+						logs.Warn.Println("metering: failed to export usage of", p, err)
+					}
+				}
+			case <-stop:
+				meterFlush()
+				stop <- true
+				return
+			}
+		}
+	}()
+
+	return stop
+}
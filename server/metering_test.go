@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func setTestMetering(t *testing.T, limits map[string]types.UsageLimit) *mock_store.MockUsagePersistenceInterface {
+	ctrl := gomock.NewController(t)
+	usage := mock_store.NewMockUsagePersistenceInterface(ctrl)
+	store.Usage = usage
+	globals.meteringEnabled, globals.meterLimits = true, limits
+	t.Cleanup(func() {
+		store.Usage = nil
+		globals.meteringEnabled, globals.meterLimits = false, nil
+		meterCache.Lock()
+		meterCache.pending, meterCache.users, meterCache.tenants, meterCache.loading = nil, nil, nil, nil
+		meterCache.Unlock()
+		ctrl.Finish()
+	})
+	return usage
+}
+
+func TestMeterCheck(t *testing.T) {
+	usage := setTestMetering(t, map[string]types.UsageLimit{
+		types.UsageMessages:    {Soft: 5, Hard: 10},
+		types.UsageCallMinutes: {Hard: 2},
+	})
+	alice, bob := types.Uid(1), types.Uid(2)
+	period := meterPeriod(time.Now())
+
+	usage.EXPECT().Get(period, alice).Return(&types.UsageRecord{Period: period, User: alice.String(), Messages: 8}, nil)
+	if err := meterCheck(alice, types.UsageMessages, true); err != nil {
+		t.Fatal("Limit reached too early:", err)
+	}
+	// Cached usage is not loaded again.
+	meterMessage(alice)
+	meterMessage(alice)
+	if err := meterCheck(alice, types.UsageMessages, true); err != types.ErrQuotaExceeded {
+		t.Error("Hard limit of messages is not enforced:", err)
+	}
+
+	meterCall([]string{alice.String(), bob.String()}, 61000)
+	if err := meterCheck(alice, types.UsageCallMinutes, true); err != types.ErrQuotaExceeded {
+		t.Error("Hard limit of call minutes is not enforced:", err)
+	}
+
+	// Usage of bob is loaded in background, the push is sent meanwhile.
+	loaded := make(chan bool)
+	usage.EXPECT().Get(period, bob).DoAndReturn(func(string, types.Uid) (*types.UsageRecord, error) {
+		defer close(loaded)
+		return &types.UsageRecord{Period: period, User: bob.String()}, nil
+	})
+	rcpt := &push.Receipt{To: map[types.Uid]push.Recipient{bob: {}}}
+	meterPushes(rcpt)
+	<-loaded
+	if len(rcpt.To) != 1 {
+		t.Error("Push is not sent while usage is loaded")
+	}
+}
+
+func TestMeterFlush(t *testing.T) {
+	usage := setTestMetering(t, nil)
+	alice := types.Uid(1)
+	period := meterPeriod(time.Now())
+
+	meterMessage(alice)
+	meterPushes(&push.Receipt{To: map[types.Uid]push.Recipient{}, Payload: push.Payload{Silent: true}})
+	meterCall([]string{alice.String()}, 1500)
+
+	usage.EXPECT().Add([]types.UsageRecord{
+		{Period: period, User: alice.String(), Messages: 1, CallSeconds: 2},
+	}).Return(types.ErrInternal)
+	meterFlush()
+	if len(meterCache.pending) != 1 {
+		t.Fatal("Usage which failed to save is lost")
+	}
+
+	meterMessage(alice)
+	usage.EXPECT().Add([]types.UsageRecord{
+		{Period: period, User: alice.String(), Messages: 2, CallSeconds: 2},
+	}).Return(nil)
+	meterFlush()
+	if len(meterCache.pending) != 0 {
+		t.Error("Saved usage is still pending")
+	}
+}
+
+func TestMeterExport(t *testing.T) {
+	usage := setTestMetering(t, nil)
+	dir := t.TempDir()
+
+	usage.EXPECT().List("2026-10", nil).Return([]types.UsageRecord{
+		{Period: "2026-10", Tenant: "acme", User: types.Uid(1).String(), Messages: 3, CallSeconds: 61, Storage: 100},
+	}, nil)
+	if err := meterExport(&meteringExportConfig{Path: dir, Format: "csv"}, "2026-10"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "usage-2026-10.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "period,tenant,user,messages,pushes,call_minutes,storage\n" +
+		"2026-10,acme," + types.Uid(1).UserId() + ",3,0,2,100\n"
+	if string(data) != expected {
+		t.Errorf("Unexpected export:\n%s", data)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Error("Temporary files are left behind")
+	}
+}
+
+func TestMeterValidateLimits(t *testing.T) {
+	for _, limits := range []map[string]types.UsageLimit{
+		{"storage": {Hard: 1}},
+		{types.UsageMessages: {Soft: -1}},
+		{types.UsagePushes: {Soft: 10, Hard: 5}},
+	} {
+		if err := meterValidateLimits(limits); err == nil {
+			t.Errorf("Invalid limits %v accepted", limits)
+		}
+	}
+	if err := meterValidateLimits(map[string]types.UsageLimit{types.UsageMessages: {Soft: 10}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,189 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Prometheus metrics: latency of client requests, durations of database
+ *    queries, outcomes of push notifications, depth of websocket send queues
+ *    and per-topic-category counters. Metrics are served in Prometheus text
+ *    format at the path configured by the "metrics" config parameter.
+ *
+ *    The expvar stats in stats.go are kept as is for compatibility with the
+ *    existing exporter in monitoring/exporter.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store/types"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Namespace of the metrics.
+const metricsNamespace = "tinode"
+
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requestLatency  prometheus.Histogram
+	storeQueries    *prometheus.HistogramVec
+	pushOutcomes    *prometheus.CounterVec
+	sendQueueDepth  prometheus.Histogram
+	messages        *prometheus.CounterVec
+	subscriptions   *prometheus.CounterVec
+	topicsActivated *prometheus.CounterVec
+}
+
+// Metrics, nil if disabled.
+var metrics *serverMetrics
+
+// metricsInit registers the metrics and serves them at the given path. Blank path or "-" disables metrics.
+func metricsInit(mux *http.ServeMux, path string) {
+	if path == "" || path == "-" {
+		return
+	}
+
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requestLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_latency_seconds",
+			Help:      "Time from receiving a client message to sending the response.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		storeQueries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_query_duration_seconds",
+			Help:      "Duration of database queries.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"query"}),
+		pushOutcomes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "push_notifications_total",
+			Help:      "Push notifications by handler and outcome of sending.",
+		}, []string{"handler", "outcome"}),
+		sendQueueDepth: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_send_queue_depth",
+			Help:      "Number of messages in the send queue of the websocket session when a message is queued.",
+			Buckets:   []float64{1, 2, 4, 8, 16, 32, 64, 96, 128},
+		}),
+		messages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_total",
+			Help:      "Messages published by topic category.",
+		}, []string{"category"}),
+		subscriptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "subscriptions_total",
+			Help:      "Sessions subscribed to topics by topic category.",
+		}, []string{"category"}),
+		topicsActivated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "topics_activated_total",
+			Help:      "Topics loaded or created at this node by topic category.",
+		}, []string{"category"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requestLatency, m.storeQueries, m.pushOutcomes, m.sendQueueDepth,
+		m.messages, m.subscriptions, m.topicsActivated,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "live_topics",
+			Help:      "Number of topics loaded at this node.",
+		}, func() float64 {
+			count := 0
+			globals.hub.topics.Range(func(_, _ any) bool {
+				count++
+				return true
+			})
+			return float64(count)
+		}),
+	)
+
+	push.OnOutcome = func(handler, outcome string) {
+		m.pushOutcomes.WithLabelValues(handler, outcome).Inc()
+	}
+
+	mux.Handle(path, promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	metrics = m
+
+	logs.Info.Printf("metrics: exposed at '%s'", path)
+}
+
+// topicCatName returns the category of the topic for labeling metrics.
+func topicCatName(topic string) string {
+	switch {
+	case strings.HasPrefix(topic, "usr"):
+		return "me"
+	case strings.HasPrefix(topic, "grp"), strings.HasPrefix(topic, "chn"):
+		return "grp"
+	case strings.HasPrefix(topic, "rpt"):
+		return "sys"
+	case len(topic) >= 3:
+		return topic[:3]
+	}
+	return "unknown"
+}
+
+// metricsRequestLatency records the time it took to respond to the client request.
+func metricsRequestLatency(latency time.Duration) {
+	if metrics != nil {
+		metrics.requestLatency.Observe(latency.Seconds())
+	}
+}
+
+// metricsSendQueueDepth records the depth of the websocket send queue.
+func metricsSendQueueDepth(depth int) {
+	if metrics != nil {
+		metrics.sendQueueDepth.Observe(float64(depth))
+	}
+}
+
+// metricsMessage counts a message published to the topic.
+func metricsMessage(topic string) {
+	if metrics != nil {
+		metrics.messages.WithLabelValues(topicCatName(topic)).Inc()
+	}
+}
+
+// metricsSubscription counts a session subscribed to the topic.
+func metricsSubscription(topic string) {
+	if metrics != nil {
+		metrics.subscriptions.WithLabelValues(topicCatName(topic)).Inc()
+	}
+}
+
+// metricsTopicActivated counts a topic loaded or created at this node.
+func metricsTopicActivated(topic string) {
+	if metrics != nil {
+		metrics.topicsActivated.WithLabelValues(topicCatName(topic)).Inc()
+	}
+}
+
+// storeQueryStart starts the tracing span of the database query and times it. Options of the
+// query, if any, are used for reporting slow queries. The returned function must be called when
+// the query completes.
+func storeQueryStart(ctx context.Context, query, topic string, opts *types.QueryOpt) func() {
+	_, span := traceStart(ctx, "store."+query, attribute.String("tinode.topic", topic))
+	start := time.Now()
+	return func() {
+		span.End()
+		took := time.Since(start)
+		if metrics != nil {
+			metrics.storeQueries.WithLabelValues(query).Observe(took.Seconds())
+		}
+		diag.observeQuery(query, queryShape(opts), topic, took)
+	}
+}
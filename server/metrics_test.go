@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestAdminBusiestTopics(t *testing.T) {
+	globals.hub = &Hub{topics: &sync.Map{}}
+	defer func() {
+		globals.hub = nil
+	}()
+
+	for name, counts := range map[string][2]int64{
+		"grpQuiet": {1, 5},
+		"grpBusy":  {100, 2},
+		"p2pChat":  {10, 2},
+		"grpProxy": {1000, 1000},
+	} {
+		topic := &Topic{name: name, isProxy: name == "grpProxy"}
+		topic.pubCount.Store(counts[0])
+		topic.sessCount.Store(counts[1])
+		globals.hub.topics.Store(name, topic)
+	}
+
+	resp, _ := adminBusiestTopics(httptest.NewRequest(http.MethodGet, "/admin/v0/topics?limit=2", nil))
+	topics := resp.Ctrl.Params.(map[string]any)["topics"].([]adminTopic)
+	if len(topics) != 2 || topics[0].Topic != "grpBusy" || topics[1].Topic != "p2pChat" || topics[1].Category != "p2p" {
+		t.Errorf("Unexpected busiest topics by messages: %+v", topics)
+	}
+
+	resp, _ = adminBusiestTopics(httptest.NewRequest(http.MethodGet, "/admin/v0/topics?by=sessions", nil))
+	topics = resp.Ctrl.Params.(map[string]any)["topics"].([]adminTopic)
+	if len(topics) != 3 || topics[0].Topic != "grpQuiet" {
+		t.Errorf("Unexpected busiest topics by sessions: %+v", topics)
+	}
+
+	resp, _ = adminBusiestTopics(httptest.NewRequest(http.MethodGet, "/admin/v0/topics?by=name", nil))
+	if resp.Ctrl.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid ordering, got %d", resp.Ctrl.Code)
+	}
+}
@@ -0,0 +1,306 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Content moderation of {pub} messages. The server-wide chain of filters
+ *    is applied by the session before the message is routed to the topic.
+ *    Topic admins may add a list of words to aux.moderation. Decisions
+ *    other than "allow" are logged to the store for review.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/tinode/chat/pbx"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/moderation"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Message header which marks quarantined messages.
+	msgHeadModeration = "moderation"
+	// Key of the per-topic moderation settings in topic's aux.
+	auxModeration = "moderation"
+
+	// Maximum number of words in per-topic moderation settings.
+	maxTopicModerationWords = 256
+	// Maximum length of a word in per-topic moderation settings in bytes.
+	maxTopicModerationWordLength = 64
+
+	// Name of the filter for decisions made by per-topic settings.
+	topicModerationFilter = "topic"
+)
+
+// moderatePub runs the {pub} message through the chain of moderation filters. The decision is attached
+// to the message to be applied by the topic. Returns false if the message is rejected.
+func (s *Session) moderatePub(msg *ClientComMessage) bool {
+	// Clear potentially false decision: it's set by the server only.
+	delete(msg.Pub.Head, msgHeadModeration)
+	if msg.Extra != nil {
+		msg.Extra.Moderation = nil
+	}
+	if !moderation.IsEnabled() {
+		return true
+	}
+
+	verdict := moderation.Check(&moderation.Message{
+		Topic:   msg.RcptTo,
+		From:    msg.AsUser,
+		Head:    msg.Pub.Head,
+		Content: msg.Pub.Content,
+		Text:    messageContentText(msg.Pub.Head, msg.Pub.Content),
+	})
+	switch verdict.Action {
+	case moderation.ActionAllow:
+		return true
+	case moderation.ActionReject:
+		logModeration(msg.RcptTo, 0, msg.AsUser, &MsgModeration{
+			Action: verdict.Action.String(),
+			Filter: verdict.Filter,
+			Reason: verdict.Reason,
+		})
+		s.queueOut(ErrPolicyReply(msg, types.TimeNow()))
+		return false
+	}
+
+	if msg.Extra == nil {
+		msg.Extra = &MsgClientExtra{}
+	}
+	msg.Extra.Moderation = &MsgModeration{
+		Action: verdict.Action.String(),
+		Filter: verdict.Filter,
+		Reason: verdict.Reason,
+	}
+	return true
+}
+
+// moderateEdit runs the new content of an edited message through the chain of moderation filters.
+// Edits cannot be quarantined: such edits are rejected. Returns false if the edit is rejected.
+func (s *Session) moderateEdit(msg *ClientComMessage) bool {
+	if !moderation.IsEnabled() {
+		return true
+	}
+
+	// Edits carry no headers: content which is an object is assumed to be Drafty.
+	head := map[string]any{"mime": "text/x-drafty"}
+	verdict := moderation.Check(&moderation.Message{
+		Topic:   msg.RcptTo,
+		From:    msg.AsUser,
+		Content: msg.Note.Content,
+		Text:    messageContentText(head, msg.Note.Content),
+	})
+	if verdict.Action == moderation.ActionAllow {
+		return true
+	}
+	if verdict.Action == moderation.ActionQuarantine {
+		verdict.Action = moderation.ActionReject
+	}
+	logModeration(msg.RcptTo, msg.Note.SeqId, msg.AsUser, &MsgModeration{
+		Action: verdict.Action.String(),
+		Filter: verdict.Filter,
+		Reason: verdict.Reason,
+	})
+	return verdict.Action != moderation.ActionReject
+}
+
+// topicModerationWords returns the words and the action from per-topic moderation settings.
+func topicModerationWords(aux map[string]any) (map[string]struct{}, moderation.Action) {
+	settings, _ := aux[auxModeration].(map[string]any)
+	if settings == nil {
+		return nil, moderation.ActionAllow
+	}
+
+	action := moderation.ActionReject
+	if name, ok := settings["action"].(string); ok {
+		action, _ = moderation.ParseAction(name)
+	}
+
+	var words map[string]struct{}
+	switch list := settings["words"].(type) {
+	case []string:
+		words = make(map[string]struct{}, len(list))
+		for _, w := range list {
+			words[strings.ToLower(w)] = struct{}{}
+		}
+	case []any:
+		words = make(map[string]struct{}, len(list))
+		for _, val := range list {
+			if w, ok := val.(string); ok {
+				words[strings.ToLower(w)] = struct{}{}
+			}
+		}
+	}
+	return words, action
+}
+
+// validateTopicModeration checks per-topic moderation settings assigned by topic admins.
+func validateTopicModeration(val any) error {
+	if val == nil {
+		return nil
+	}
+	settings, ok := val.(map[string]any)
+	if !ok {
+		return errors.New("invalid moderation settings")
+	}
+
+	if name, ok := settings["action"]; ok {
+		str, _ := name.(string)
+		if action, err := moderation.ParseAction(str); err != nil || action == moderation.ActionAllow {
+			return errors.New("invalid moderation action")
+		}
+	}
+
+	list, ok := settings["words"].([]any)
+	if settings["words"] != nil && !ok {
+		return errors.New("invalid moderation words")
+	}
+	if len(list) > maxTopicModerationWords {
+		return errors.New("too many moderation words")
+	}
+	for _, val := range list {
+		w, _ := val.(string)
+		if w == "" || len(w) > maxTopicModerationWordLength || len(moderation.Words(w)) != 1 {
+			return errors.New("invalid moderation word")
+		}
+	}
+	return nil
+}
+
+// moderateMsg combines the decision of the moderation filters with per-topic settings and applies it to the
+// header of the message being published. Returns the decision to log or nil if there is nothing to log, and
+// false if the message is rejected.
+func (t *Topic) moderateMsg(msg *ClientComMessage, asUid types.Uid) (*MsgModeration, bool) {
+	var verdict *MsgModeration
+	if msg.Extra != nil {
+		verdict = msg.Extra.Moderation
+	}
+
+	current := moderation.ActionAllow
+	if verdict != nil {
+		current, _ = moderation.ParseAction(verdict.Action)
+	}
+	// Words cannot be found in end-to-end encrypted content.
+	if words, action := topicModerationWords(t.aux); action > current && msg.Pub.Head[types.MsgHeadE2EE] != true {
+		if w, found := moderation.ContainsWord(messageContentText(msg.Pub.Head, msg.Pub.Content), words); found {
+			current = action
+			verdict = &MsgModeration{Filter: topicModerationFilter, Reason: "word '" + w + "'"}
+		}
+	}
+
+	if current == moderation.ActionQuarantine && t.cat != types.TopicCatGrp {
+		// All parties of other topics may see scoped messages: quarantine is not possible.
+		current = moderation.ActionReject
+	}
+	if verdict != nil {
+		verdict.Action = current.String()
+	}
+
+	switch current {
+	case moderation.ActionReject:
+		logModeration(t.name, 0, asUid.UserId(), verdict)
+		msg.sess.queueOut(ErrPolicyReply(msg, types.TimeNow()))
+		return nil, false
+	case moderation.ActionQuarantine:
+		// Quarantined message is visible to the sender and topic moderators only.
+		if msg.Pub.Head == nil {
+			msg.Pub.Head = map[string]any{}
+		}
+		msg.Pub.Head[msgHeadScope] = []string{asUid.UserId()}
+		msg.Pub.Head[msgHeadModeration] = current.String()
+	case moderation.ActionAllow:
+		return nil, true
+	}
+	return verdict, true
+}
+
+// logModeration saves the moderation decision to the store.
+func logModeration(topic string, seqId int, from string, verdict *MsgModeration) {
+	logs.Info.Printf("moderation: %s message %s:%d from %s by '%s', %s", verdict.Action, topic, seqId, from,
+		verdict.Filter, verdict.Reason)
+	if err := store.Moderation.Log(&types.ModerationRecord{
+		Topic:  topic,
+		SeqId:  seqId,
+		From:   from,
+		Action: verdict.Action,
+		Filter: verdict.Filter,
+		Reason: verdict.Reason,
+	}); err != nil {
+		logs.Warn.Printf("moderation: failed to log decision on %s:%d: %v", topic, seqId, err)
+	}
+}
+
+// pluginModerationFilter is a moderation filter which sends {pub} messages to the FireHose of a gRPC plugin.
+// The plugin responds with CONTINUE or REPLACE to allow the message, with DROP to reject it, or with RESPOND
+// and a {ctrl} with params.action set to "flag", "quarantine" or "reject".
+type pluginModerationFilter struct {
+	plugin *Plugin
+}
+
+type pluginModerationConfig struct {
+	// Name of the plugin in the "plugins" section of the config.
+	Plugin string `json:"plugin"`
+}
+
+// Init initializes the filter. Must be called after the plugins are initialized.
+func (f *pluginModerationFilter) Init(jsonconf json.RawMessage) error {
+	var config pluginModerationConfig
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	for i := range globals.plugins {
+		if globals.plugins[i].name == config.Plugin {
+			f.plugin = &globals.plugins[i]
+			return nil
+		}
+	}
+	return errors.New("plugin '" + config.Plugin + "' is not enabled")
+}
+
+// Check asks the plugin to check the message.
+func (f *pluginModerationFilter) Check(ctx context.Context, msg *moderation.Message) (moderation.Action, string, error) {
+	req := &pbx.ClientReq{
+		Msg: pbCliSerialize(&ClientComMessage{
+			Pub: &MsgClientPub{Topic: msg.Topic, Head: msg.Head, Content: msg.Content},
+		}),
+		Sess: &pbx.Session{UserId: msg.From},
+	}
+	if req.Msg == nil {
+		return moderation.ActionAllow, "", errors.New("failed to serialize message")
+	}
+
+	resp, err := f.plugin.client.FireHose(ctx, req)
+	if err != nil {
+		return moderation.ActionAllow, "", err
+	}
+
+	switch resp.GetStatus() {
+	case pbx.RespCode_DROP:
+		return moderation.ActionReject, "dropped by plugin", nil
+	case pbx.RespCode_RESPOND:
+		srvmsg := pbServDeserialize(resp.GetSrvmsg())
+		if srvmsg == nil || srvmsg.Ctrl == nil {
+			return moderation.ActionReject, "", nil
+		}
+		action := moderation.ActionReject
+		if params, ok := srvmsg.Ctrl.Params.(map[string]any); ok {
+			if name, ok := params["action"].(string); ok {
+				if action, err = moderation.ParseAction(name); err != nil {
+					return moderation.ActionAllow, "", err
+				}
+			}
+		}
+		return action, srvmsg.Ctrl.Text, nil
+	}
+	return moderation.ActionAllow, "", nil
+}
+
+func init() {
+	moderation.Register("plugin", &pluginModerationFilter{})
+}
@@ -0,0 +1,221 @@
+// Package moderation defines an interface which must be implemented by content moderation filters
+// and runs the configured chain of filters.
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Action is the decision of a filter on a message. Actions are ordered by severity.
+type Action int
+
+const (
+	// ActionAllow accepts the message.
+	ActionAllow Action = iota
+	// ActionFlag accepts the message and logs the decision for review.
+	ActionFlag
+	// ActionQuarantine saves the message but hides it from everyone but the sender and topic moderators.
+	ActionQuarantine
+	// ActionReject refuses the message.
+	ActionReject
+)
+
+const defaultTimeout = 3
+
+var actionNames = []string{"allow", "flag", "quarantine", "reject"}
+
+// String returns the name of the action.
+func (a Action) String() string {
+	if a < ActionAllow || a > ActionReject {
+		return ""
+	}
+	return actionNames[a]
+}
+
+// ParseAction converts the name of the action to Action.
+func ParseAction(name string) (Action, error) {
+	for i, n := range actionNames {
+		if strings.EqualFold(n, name) {
+			return Action(i), nil
+		}
+	}
+	return ActionAllow, errors.New("unknown moderation action '" + name + "'")
+}
+
+// Message is a message to check.
+type Message struct {
+	// Topic the message is published to.
+	Topic string `json:"topic"`
+	// User ID of the sender.
+	From string `json:"from"`
+	// Message headers.
+	Head map[string]any `json:"head,omitempty"`
+	// Message content as published.
+	Content any `json:"content"`
+	// Plain text of the message, if any.
+	Text string `json:"text,omitempty"`
+}
+
+// Verdict is the decision on a message.
+type Verdict struct {
+	Action Action
+	// Name of the filter which made the decision.
+	Filter string
+	// Human-readable reason of the decision.
+	Reason string
+}
+
+// Filter is an interface which must be implemented by moderation filters.
+type Filter interface {
+	// Init initializes the filter.
+	Init(jsonconf json.RawMessage) error
+
+	// Check checks the message and returns the action to take and an optional reason.
+	Check(ctx context.Context, msg *Message) (Action, string, error)
+}
+
+type filterConfig struct {
+	Name string `json:"name"`
+	// Action to take if the filter fails, "allow" by default.
+	OnError string          `json:"on_error"`
+	Config  json.RawMessage `json:"config"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Time limit for checking one message by all filters (seconds).
+	Timeout int `json:"timeout"`
+	// Filters in the order they are applied.
+	Filters []filterConfig `json:"filters"`
+}
+
+type chainEntry struct {
+	name    string
+	filter  Filter
+	onError Action
+}
+
+var filters map[string]Filter
+
+// Filters in use in the order they are applied.
+var chain []chainEntry
+var timeout time.Duration
+
+// Register a moderation filter.
+func Register(name string, f Filter) {
+	if filters == nil {
+		filters = make(map[string]Filter)
+	}
+
+	if f == nil {
+		panic("Register: moderation filter is nil")
+	}
+	if _, dup := filters[name]; dup {
+		panic("Register: called twice for filter " + name)
+	}
+	filters[name] = f
+}
+
+// Init initializes the filters in the chain. Returns the names of filters in use.
+func Init(jsconfig json.RawMessage) ([]string, error) {
+	if len(jsconfig) == 0 {
+		return nil, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return nil, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	var names []string
+	for _, fc := range config.Filters {
+		f := filters[fc.Name]
+		if f == nil {
+			return nil, errors.New("unknown moderation filter '" + fc.Name + "'")
+		}
+		for _, entry := range chain {
+			if entry.name == fc.Name {
+				return nil, errors.New("moderation filter '" + fc.Name + "' is used twice")
+			}
+		}
+
+		onError := ActionAllow
+		if fc.OnError != "" {
+			var err error
+			if onError, err = ParseAction(fc.OnError); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := f.Init(fc.Config); err != nil {
+			return nil, errors.New(fc.Name + ": " + err.Error())
+		}
+		chain = append(chain, chainEntry{name: fc.Name, filter: f, onError: onError})
+		names = append(names, fc.Name)
+	}
+
+	timeout = time.Second * time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = time.Second * defaultTimeout
+	}
+	return names, nil
+}
+
+// IsEnabled checks if any filters are configured.
+func IsEnabled() bool {
+	return len(chain) > 0
+}
+
+// Check runs the message through the chain of filters and returns the most severe decision.
+// Filters after the first rejection are not applied.
+func Check(msg *Message) Verdict {
+	verdict := Verdict{Action: ActionAllow}
+	if len(chain) == 0 {
+		return verdict
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, entry := range chain {
+		action, reason, err := entry.filter.Check(ctx, msg)
+		if err != nil {
+			action, reason = entry.onError, "filter failed: "+err.Error()
+		}
+		if action > verdict.Action {
+			verdict = Verdict{Action: action, Filter: entry.name, Reason: reason}
+		}
+		if verdict.Action == ActionReject {
+			break
+		}
+	}
+	return verdict
+}
+
+// Words splits the text into lowercase words. Words are sequences of letters, digits and marks.
+func Words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r)
+	})
+}
+
+// ContainsWord checks if the text contains any of the words. Words must be lowercase.
+func ContainsWord(text string, words map[string]struct{}) (string, bool) {
+	if len(words) == 0 {
+		return "", false
+	}
+	for _, w := range Words(text) {
+		if _, found := words[w]; found {
+			return w, true
+		}
+	}
+	return "", false
+}
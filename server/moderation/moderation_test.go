@@ -0,0 +1,75 @@
+package moderation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testFilter struct {
+	action Action
+	err    error
+	calls  int
+}
+
+func (f *testFilter) Init(jsonconf json.RawMessage) error {
+	return nil
+}
+
+func (f *testFilter) Check(ctx context.Context, msg *Message) (Action, string, error) {
+	f.calls++
+	return f.action, "test", f.err
+}
+
+func TestCheck(t *testing.T) {
+	flag := &testFilter{action: ActionFlag}
+	failing := &testFilter{err: errors.New("unavailable")}
+	reject := &testFilter{action: ActionReject}
+	last := &testFilter{action: ActionQuarantine}
+	Register("flag", flag)
+	Register("failing", failing)
+	Register("reject", reject)
+	Register("last", last)
+	defer func() { chain = nil }()
+
+	names, err := Init(json.RawMessage(`{"enabled": true, "filters": [{"name": "flag"},
+		{"name": "failing", "on_error": "quarantine"}, {"name": "reject"}, {"name": "last"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"flag", "failing", "reject", "last"}) {
+		t.Errorf("Unexpected filters %v", names)
+	}
+
+	verdict := Check(&Message{Text: "hello"})
+	if verdict.Action != ActionReject || verdict.Filter != "reject" {
+		t.Errorf("Expected rejection by 'reject', got %+v", verdict)
+	}
+	if failing.calls != 1 || last.calls != 0 {
+		t.Errorf("Filters after rejection must not be called: failing=%d, last=%d", failing.calls, last.calls)
+	}
+
+	chain = nil
+	if _, err = Init(json.RawMessage(`{"enabled": true, "filters": [{"name": "flag"}, {"name": "flag"}]}`)); err == nil {
+		t.Error("Duplicate filter must be rejected")
+	}
+	chain = nil
+	if _, err = Init(json.RawMessage(`{"enabled": true, "filters": [{"name": "missing"}]}`)); err == nil {
+		t.Error("Unknown filter must be rejected")
+	}
+}
+
+func TestWords(t *testing.T) {
+	if got := Words("Hello, wörld! it's 2day"); !reflect.DeepEqual(got, []string{"hello", "wörld", "it", "s", "2day"}) {
+		t.Errorf("Unexpected words %v", got)
+	}
+	words := map[string]struct{}{"wörld": {}}
+	if w, found := ContainsWord("HELLO WÖRLD", words); !found || w != "wörld" {
+		t.Errorf("Expected 'wörld' to be found, got '%s'", w)
+	}
+	if _, found := ContainsWord("worldwide", words); found {
+		t.Error("Parts of words must not match")
+	}
+}
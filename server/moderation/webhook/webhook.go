@@ -0,0 +1,98 @@
+// Package webhook implements moderation filter which sends messages to an external classifier
+// over HTTP.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/tinode/chat/server/moderation"
+)
+
+const (
+	filterName = "webhook"
+
+	// Maximum size of the classifier response.
+	maxResponseSize = 1 << 16
+)
+
+type configType struct {
+	// URL of the classifier endpoint.
+	URL string `json:"url"`
+	// Additional HTTP headers to send, e.g. authorization.
+	Headers map[string]string `json:"headers"`
+}
+
+type webhookFilter struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+type response struct {
+	// Action to take: "allow", "flag", "quarantine" or "reject".
+	Action string `json:"action"`
+	// Optional reason of the decision.
+	Reason string `json:"reason"`
+}
+
+// Init initializes the filter.
+func (f *webhookFilter) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.URL == "" {
+		return errors.New("missing URL")
+	}
+
+	f.url = config.URL
+	f.headers = config.Headers
+	f.client = &http.Client{}
+	return nil
+}
+
+// Check POSTs the message as JSON to the classifier and returns its decision.
+func (f *webhookFilter) Check(ctx context.Context, msg *moderation.Message) (moderation.Action, string, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return moderation.ActionAllow, "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return moderation.ActionAllow, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range f.headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return moderation.ActionAllow, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return moderation.ActionAllow, "", errors.New("unexpected status " + resp.Status)
+	}
+
+	var result response
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&result); err != nil {
+		return moderation.ActionAllow, "", errors.New("invalid response: " + err.Error())
+	}
+	action, err := moderation.ParseAction(result.Action)
+	if err != nil {
+		return moderation.ActionAllow, "", err
+	}
+	return action, result.Reason, nil
+}
+
+func init() {
+	moderation.Register(filterName, &webhookFilter{})
+}
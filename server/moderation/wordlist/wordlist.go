@@ -0,0 +1,98 @@
+// Package wordlist implements moderation filter which matches message text against lists of
+// words and regular expressions.
+package wordlist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/tinode/chat/server/moderation"
+)
+
+const filterName = "wordlist"
+
+type ruleConfig struct {
+	// Action to take if the rule matches.
+	Action string `json:"action"`
+	// Whole words to match, case-insensitive.
+	Words []string `json:"words"`
+	// Regular expressions to match.
+	Patterns []string `json:"patterns"`
+}
+
+type configType struct {
+	Rules []ruleConfig `json:"rules"`
+}
+
+type rule struct {
+	action   moderation.Action
+	words    map[string]struct{}
+	patterns []*regexp.Regexp
+}
+
+type wordlistFilter struct {
+	rules []rule
+}
+
+// Init initializes the filter.
+func (f *wordlistFilter) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+
+	f.rules = nil
+	for _, rc := range config.Rules {
+		action, err := moderation.ParseAction(rc.Action)
+		if err != nil {
+			return err
+		}
+		r := rule{action: action, words: make(map[string]struct{}, len(rc.Words))}
+		for _, w := range rc.Words {
+			if w = strings.ToLower(strings.TrimSpace(w)); w != "" {
+				r.words[w] = struct{}{}
+			}
+		}
+		for _, p := range rc.Patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return errors.New("invalid pattern '" + p + "': " + err.Error())
+			}
+			r.patterns = append(r.patterns, re)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return nil
+}
+
+// Check returns the most severe action of the matching rules.
+func (f *wordlistFilter) Check(ctx context.Context, msg *moderation.Message) (moderation.Action, string, error) {
+	action, reason := moderation.ActionAllow, ""
+	if msg.Text == "" {
+		return action, reason, nil
+	}
+
+	for _, r := range f.rules {
+		if r.action <= action {
+			continue
+		}
+		if w, found := moderation.ContainsWord(msg.Text, r.words); found {
+			action, reason = r.action, "word '"+w+"'"
+			continue
+		}
+		for _, re := range r.patterns {
+			if re.MatchString(msg.Text) {
+				action, reason = r.action, "pattern '"+re.String()+"'"
+				break
+			}
+		}
+	}
+	return action, reason, nil
+}
+
+func init() {
+	moderation.Register(filterName, &wordlistFilter{})
+}
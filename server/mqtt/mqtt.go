@@ -0,0 +1,786 @@
+// Package mqtt implements the packet layer of MQTT 3.1.1 and 5.0 client connections: reading and
+// writing control packets and MQTT 5 properties. Translation of packets to Tinode messages is done
+// by the server. QoS 2 flows and enhanced authentication are not supported.
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Protocol versions.
+const (
+	Version311 = 4
+	Version5   = 5
+)
+
+// Types of control packets.
+const (
+	TypeConnect     = 1
+	TypeConnAck     = 2
+	TypePublish     = 3
+	TypePubAck      = 4
+	TypePubRec      = 5
+	TypePubRel      = 6
+	TypePubComp     = 7
+	TypeSubscribe   = 8
+	TypeSubAck      = 9
+	TypeUnsubscribe = 10
+	TypeUnsubAck    = 11
+	TypePingReq     = 12
+	TypePingResp    = 13
+	TypeDisconnect  = 14
+	TypeAuth        = 15
+)
+
+// MQTT 5 properties used by the gateway.
+const (
+	PropSessionExpiry      = 0x11
+	PropAssignedClientID   = 0x12
+	PropServerKeepAlive    = 0x13
+	PropReasonString       = 0x1F
+	PropMaxQoS             = 0x24
+	PropRetainAvailable    = 0x25
+	PropUserProperty       = 0x26
+	PropMaxPacketSize      = 0x27
+	PropWildcardAvailable  = 0x28
+	PropSubIDAvailable     = 0x29
+	PropSharedSubAvailable = 0x2A
+)
+
+// Kinds of values of properties.
+const (
+	propByte = iota + 1
+	propUint16
+	propUint32
+	propVarint
+	propString
+	propBinary
+	propPair
+)
+
+// Kinds of values of all MQTT 5 properties by identifier.
+var propKinds = map[byte]int{
+	0x01: propByte, 0x02: propUint32, 0x03: propString, 0x08: propString, 0x09: propBinary,
+	0x0B: propVarint, 0x11: propUint32, 0x12: propString, 0x13: propUint16, 0x15: propString,
+	0x16: propBinary, 0x17: propByte, 0x18: propUint32, 0x19: propByte, 0x1A: propString,
+	0x1C: propString, 0x1F: propString, 0x21: propUint16, 0x22: propUint16, 0x23: propUint16,
+	0x24: propByte, 0x25: propByte, 0x26: propPair, 0x27: propUint32, 0x28: propByte,
+	0x29: propByte, 0x2A: propByte,
+}
+
+// Largest value of the remaining length of a packet.
+const maxRemainingLength = 268435455
+
+// Time allowed to write a packet to the client.
+const writeTimeout = 10 * time.Second
+
+var (
+	// ErrTooLarge is returned by Conn.Next when a packet exceeds the size limit and by
+	// Conn.Send when a packet exceeds the limit set by the peer.
+	ErrTooLarge = errors.New("packet too large")
+	// ErrMalformed is returned by Conn.Next when a packet cannot be parsed.
+	ErrMalformed = errors.New("malformed packet")
+	// ErrUnsupported is returned by Conn.Next for QoS 2 flows and enhanced authentication.
+	ErrUnsupported = errors.New("unsupported packet")
+)
+
+// Property is an MQTT 5 property. Value is byte, uint16 or uint32 for integer properties,
+// string for strings, []byte for binary data and [2]string for user properties.
+type Property struct {
+	ID    byte
+	Value any
+}
+
+// Properties is a list of MQTT 5 properties.
+type Properties []Property
+
+// Get returns the value of the first property with the given ID.
+func (p Properties) Get(id byte) (any, bool) {
+	for _, prop := range p {
+		if prop.ID == id {
+			return prop.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Packet is a control packet.
+type Packet interface {
+	// encode returns the first byte of the fixed header and the rest of the packet.
+	encode(version byte) (byte, []byte)
+}
+
+// Connect is a CONNECT packet. The will message is parsed but not used by the gateway.
+type Connect struct {
+	// Protocol level: Version311 or Version5. Other fields are not set for other levels.
+	Version    byte
+	ClientID   string
+	CleanStart bool
+	// Keep alive interval in seconds.
+	KeepAlive   uint16
+	Username    string
+	Password    []byte
+	WillTopic   string
+	WillPayload []byte
+	WillQoS     byte
+	WillRetain  bool
+	Props       Properties
+}
+
+// ConnAck is a CONNACK packet.
+type ConnAck struct {
+	SessionPresent bool
+	// Return code of MQTT 3.1.1 or reason code of MQTT 5.
+	Code  byte
+	Props Properties
+}
+
+// Publish is a PUBLISH packet.
+type Publish struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16
+	Props    Properties
+}
+
+// PubAck is a PUBACK packet.
+type PubAck struct {
+	PacketID uint16
+	Code     byte
+}
+
+// Subscription is a topic filter of a SUBSCRIBE packet with its options.
+type Subscription struct {
+	Filter string
+	QoS    byte
+	// MQTT 5: messages published by the client are not delivered to it.
+	NoLocal bool
+}
+
+// Subscribe is a SUBSCRIBE packet.
+type Subscribe struct {
+	PacketID uint16
+	Filters  []Subscription
+	Props    Properties
+}
+
+// SubAck is a SUBACK packet.
+type SubAck struct {
+	PacketID uint16
+	// Granted QoS or failure code for each topic filter.
+	Codes []byte
+}
+
+// Unsubscribe is an UNSUBSCRIBE packet.
+type Unsubscribe struct {
+	PacketID uint16
+	Filters  []string
+	Props    Properties
+}
+
+// UnsubAck is an UNSUBACK packet. Codes are sent by MQTT 5 only.
+type UnsubAck struct {
+	PacketID uint16
+	Codes    []byte
+}
+
+// PingReq is a PINGREQ packet.
+type PingReq struct{}
+
+// PingResp is a PINGRESP packet.
+type PingResp struct{}
+
+// Disconnect is a DISCONNECT packet. The reason code is sent by MQTT 5 only.
+type Disconnect struct {
+	Code  byte
+	Props Properties
+}
+
+func (p *Connect) encode(version byte) (byte, []byte) {
+	buf := appendString(nil, "MQTT")
+	buf = append(buf, p.Version)
+	var flags byte
+	if p.Username != "" {
+		flags |= 0x80
+	}
+	if p.Password != nil {
+		flags |= 0x40
+	}
+	if p.WillTopic != "" {
+		flags |= 0x04 | p.WillQoS<<3
+		if p.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if p.CleanStart {
+		flags |= 0x02
+	}
+	buf = append(buf, flags)
+	buf = appendUint16(buf, p.KeepAlive)
+	if p.Version == Version5 {
+		buf = appendProperties(buf, p.Props)
+	}
+	buf = appendString(buf, p.ClientID)
+	if p.WillTopic != "" {
+		if p.Version == Version5 {
+			buf = appendProperties(buf, nil)
+		}
+		buf = appendString(buf, p.WillTopic)
+		buf = appendBinary(buf, p.WillPayload)
+	}
+	if p.Username != "" {
+		buf = appendString(buf, p.Username)
+	}
+	if p.Password != nil {
+		buf = appendBinary(buf, p.Password)
+	}
+	return TypeConnect << 4, buf
+}
+
+func (p *ConnAck) encode(version byte) (byte, []byte) {
+	buf := []byte{0, p.Code}
+	if p.SessionPresent {
+		buf[0] = 1
+	}
+	if version == Version5 {
+		buf = appendProperties(buf, p.Props)
+	}
+	return TypeConnAck << 4, buf
+}
+
+func (p *Publish) encode(version byte) (byte, []byte) {
+	header := byte(TypePublish<<4) | p.QoS<<1
+	if p.Dup {
+		header |= 0x08
+	}
+	if p.Retain {
+		header |= 0x01
+	}
+	buf := appendString(nil, p.Topic)
+	if p.QoS > 0 {
+		buf = appendUint16(buf, p.PacketID)
+	}
+	if version == Version5 {
+		buf = appendProperties(buf, p.Props)
+	}
+	return header, append(buf, p.Payload...)
+}
+
+func (p *PubAck) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version == Version5 && p.Code != 0 {
+		buf = append(buf, p.Code)
+	}
+	return TypePubAck << 4, buf
+}
+
+func (p *Subscribe) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version == Version5 {
+		buf = appendProperties(buf, p.Props)
+	}
+	for _, f := range p.Filters {
+		buf = appendString(buf, f.Filter)
+		opts := f.QoS
+		if f.NoLocal && version == Version5 {
+			opts |= 0x04
+		}
+		buf = append(buf, opts)
+	}
+	return TypeSubscribe<<4 | 0x02, buf
+}
+
+func (p *SubAck) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version == Version5 {
+		buf = appendProperties(buf, nil)
+	}
+	return TypeSubAck << 4, append(buf, p.Codes...)
+}
+
+func (p *Unsubscribe) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version == Version5 {
+		buf = appendProperties(buf, p.Props)
+	}
+	for _, f := range p.Filters {
+		buf = appendString(buf, f)
+	}
+	return TypeUnsubscribe<<4 | 0x02, buf
+}
+
+func (p *UnsubAck) encode(version byte) (byte, []byte) {
+	buf := appendUint16(nil, p.PacketID)
+	if version == Version5 {
+		buf = appendProperties(buf, nil)
+		buf = append(buf, p.Codes...)
+	}
+	return TypeUnsubAck << 4, buf
+}
+
+func (p *PingReq) encode(version byte) (byte, []byte) {
+	return TypePingReq << 4, nil
+}
+
+func (p *PingResp) encode(version byte) (byte, []byte) {
+	return TypePingResp << 4, nil
+}
+
+func (p *Disconnect) encode(version byte) (byte, []byte) {
+	if version != Version5 || (p.Code == 0 && len(p.Props) == 0) {
+		return TypeDisconnect << 4, nil
+	}
+	return TypeDisconnect << 4, appendProperties([]byte{p.Code}, p.Props)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendVarint(buf []byte, v uint32) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(buf, b)
+		}
+		buf = append(buf, b|0x80)
+	}
+}
+
+func appendBinary(buf, data []byte) []byte {
+	return append(appendUint16(buf, uint16(len(data))), data...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUint16(buf, uint16(len(s))), s...)
+}
+
+func appendProperties(buf []byte, props Properties) []byte {
+	var data []byte
+	for _, prop := range props {
+		data = append(data, prop.ID)
+		switch v := prop.Value.(type) {
+		case byte:
+			data = append(data, v)
+		case uint16:
+			data = appendUint16(data, v)
+		case uint32:
+			if propKinds[prop.ID] == propVarint {
+				data = appendVarint(data, v)
+			} else {
+				data = appendUint32(data, v)
+			}
+		case string:
+			data = appendString(data, v)
+		case []byte:
+			data = appendBinary(data, v)
+		case [2]string:
+			data = appendString(appendString(data, v[0]), v[1])
+		}
+	}
+	return append(appendVarint(buf, uint32(len(data))), data...)
+}
+
+// decoder reads fields of a packet. Once an error occurs, reads return zero values.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = ErrMalformed
+		return nil
+	}
+	data := d.buf[:n]
+	d.buf = d.buf[n:]
+	return data
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+	}
+	return 0
+}
+
+func (d *decoder) varint() uint32 {
+	var v uint32
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		v |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+	d.err = ErrMalformed
+	return 0
+}
+
+func (d *decoder) binary() []byte {
+	n := d.uint16()
+	return d.take(int(n))
+}
+
+func (d *decoder) string() string {
+	s := d.binary()
+	if !utf8.Valid(s) {
+		d.err = ErrMalformed
+		return ""
+	}
+	return string(s)
+}
+
+func (d *decoder) properties() Properties {
+	n := d.varint()
+	data := d.take(int(n))
+	if d.err != nil {
+		return nil
+	}
+	pd := &decoder{buf: data}
+	var props Properties
+	for len(pd.buf) > 0 && pd.err == nil {
+		prop := Property{ID: pd.byte()}
+		switch propKinds[prop.ID] {
+		case propByte:
+			prop.Value = pd.byte()
+		case propUint16:
+			prop.Value = pd.uint16()
+		case propUint32:
+			prop.Value = pd.uint32()
+		case propVarint:
+			prop.Value = pd.varint()
+		case propString:
+			prop.Value = pd.string()
+		case propBinary:
+			prop.Value = pd.binary()
+		case propPair:
+			prop.Value = [2]string{pd.string(), pd.string()}
+		default:
+			pd.err = ErrMalformed
+		}
+		props = append(props, prop)
+	}
+	d.err = pd.err
+	return props
+}
+
+// Conn is a connection of an MQTT client. Next must be called from a single goroutine,
+// writes are safe for concurrent use.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	maxSize int64
+	idle    time.Duration
+
+	wlock sync.Mutex
+	// Protocol level of the connection, set by CONNECT.
+	version byte
+	// Maximum size of packets accepted by the peer, 0 if unlimited.
+	sendLimit uint32
+	closed    bool
+}
+
+// NewConn creates a connection. Packets larger than maxSize are rejected, the connection is
+// considered dead if nothing is received for the idle time.
+func NewConn(conn net.Conn, maxSize int64, idle time.Duration) *Conn {
+	return &Conn{conn: conn, reader: bufio.NewReader(conn), maxSize: maxSize, idle: idle}
+}
+
+// SetIdle changes the time the connection may be idle, e.g. to follow the keep alive interval.
+// Must be called from the goroutine calling Next.
+func (c *Conn) SetIdle(idle time.Duration) {
+	c.idle = idle
+}
+
+// Version returns the protocol level of the connection, Version311 until CONNECT is seen.
+func (c *Conn) Version() byte {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.version == 0 {
+		return Version311
+	}
+	return c.version
+}
+
+// setConnect applies the protocol level and limits of the CONNECT packet to the connection.
+func (c *Conn) setConnect(p *Connect) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if p.Version == Version311 || p.Version == Version5 {
+		c.version = p.Version
+	}
+	if limit, ok := p.Props.Get(PropMaxPacketSize); ok {
+		c.sendLimit = limit.(uint32)
+	}
+}
+
+// Next reads the next control packet. It returns io.EOF when the client closes the connection.
+func (c *Conn) Next() (Packet, error) {
+	if c.idle > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.idle))
+	}
+
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var length uint32
+	for i := 0; ; i++ {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= uint32(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, ErrMalformed
+		}
+	}
+	if int64(length) > c.maxSize {
+		return nil, ErrTooLarge
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(c.reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	pkt, err := c.decode(header, &decoder{buf: body})
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := pkt.(*Connect); ok {
+		c.setConnect(p)
+	}
+	return pkt, nil
+}
+
+// decode parses the packet with the given first byte of the fixed header.
+func (c *Conn) decode(header byte, d *decoder) (Packet, error) {
+	version := c.Version()
+	flags := header & 0x0F
+	var pkt Packet
+	switch header >> 4 {
+	case TypeConnect:
+		p := &Connect{}
+		name := d.string()
+		p.Version = d.byte()
+		if d.err != nil || (name != "MQTT" && name != "MQIsdp") {
+			return nil, ErrMalformed
+		}
+		if p.Version != Version311 && p.Version != Version5 {
+			return p, nil
+		}
+		connFlags := d.byte()
+		if connFlags&0x01 != 0 {
+			return nil, ErrMalformed
+		}
+		p.CleanStart = connFlags&0x02 != 0
+		p.KeepAlive = d.uint16()
+		if p.Version == Version5 {
+			p.Props = d.properties()
+		}
+		p.ClientID = d.string()
+		if connFlags&0x04 != 0 {
+			if p.Version == Version5 {
+				d.properties()
+			}
+			p.WillQoS = connFlags >> 3 & 0x03
+			p.WillRetain = connFlags&0x20 != 0
+			p.WillTopic = d.string()
+			p.WillPayload = d.binary()
+		}
+		if connFlags&0x80 != 0 {
+			p.Username = d.string()
+		}
+		if connFlags&0x40 != 0 {
+			p.Password = append([]byte{}, d.binary()...)
+		}
+		pkt = p
+	case TypeConnAck:
+		p := &ConnAck{SessionPresent: d.byte()&0x01 != 0, Code: d.byte()}
+		if version == Version5 {
+			p.Props = d.properties()
+		}
+		pkt = p
+	case TypePublish:
+		p := &Publish{
+			Dup:    flags&0x08 != 0,
+			QoS:    flags >> 1 & 0x03,
+			Retain: flags&0x01 != 0,
+		}
+		if p.QoS == 3 {
+			return nil, ErrMalformed
+		}
+		p.Topic = d.string()
+		if p.QoS > 0 {
+			p.PacketID = d.uint16()
+		}
+		if version == Version5 {
+			p.Props = d.properties()
+		}
+		p.Payload = d.buf
+		d.buf = nil
+		pkt = p
+	case TypePubAck:
+		p := &PubAck{PacketID: d.uint16()}
+		if len(d.buf) > 0 {
+			p.Code = d.byte()
+			d.buf = nil
+		}
+		pkt = p
+	case TypeSubscribe:
+		if flags != 0x02 {
+			return nil, ErrMalformed
+		}
+		p := &Subscribe{PacketID: d.uint16()}
+		if version == Version5 {
+			p.Props = d.properties()
+		}
+		for len(d.buf) > 0 && d.err == nil {
+			f := Subscription{Filter: d.string()}
+			opts := d.byte()
+			f.QoS = opts & 0x03
+			f.NoLocal = version == Version5 && opts&0x04 != 0
+			if f.QoS == 3 || (version == Version311 && opts&0xFC != 0) {
+				return nil, ErrMalformed
+			}
+			p.Filters = append(p.Filters, f)
+		}
+		if len(p.Filters) == 0 {
+			return nil, ErrMalformed
+		}
+		pkt = p
+	case TypeSubAck:
+		p := &SubAck{PacketID: d.uint16()}
+		if version == Version5 {
+			d.properties()
+		}
+		p.Codes = d.buf
+		d.buf = nil
+		pkt = p
+	case TypeUnsubscribe:
+		if flags != 0x02 {
+			return nil, ErrMalformed
+		}
+		p := &Unsubscribe{PacketID: d.uint16()}
+		if version == Version5 {
+			p.Props = d.properties()
+		}
+		for len(d.buf) > 0 && d.err == nil {
+			p.Filters = append(p.Filters, d.string())
+		}
+		if len(p.Filters) == 0 {
+			return nil, ErrMalformed
+		}
+		pkt = p
+	case TypeUnsubAck:
+		p := &UnsubAck{PacketID: d.uint16()}
+		if version == Version5 {
+			d.properties()
+			p.Codes = d.buf
+			d.buf = nil
+		}
+		pkt = p
+	case TypePingReq:
+		pkt = &PingReq{}
+	case TypePingResp:
+		pkt = &PingResp{}
+	case TypeDisconnect:
+		p := &Disconnect{}
+		if version == Version5 && len(d.buf) > 0 {
+			p.Code = d.byte()
+			if len(d.buf) > 0 {
+				p.Props = d.properties()
+			}
+		}
+		pkt = p
+	default:
+		return nil, ErrUnsupported
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.buf) > 0 {
+		return nil, ErrMalformed
+	}
+	return pkt, nil
+}
+
+// Send writes the packet to the connection.
+func (c *Conn) Send(p Packet) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	if p, ok := p.(*Connect); ok && (p.Version == Version311 || p.Version == Version5) {
+		// Client side of the connection.
+		c.version = p.Version
+	}
+	version := c.version
+	if version == 0 {
+		version = Version311
+	}
+
+	header, body := p.encode(version)
+	if len(body) > maxRemainingLength {
+		return ErrTooLarge
+	}
+	buf := appendVarint([]byte{header}, uint32(len(body)))
+	if c.sendLimit > 0 && len(buf)+len(body) > int(c.sendLimit) {
+		return ErrTooLarge
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(append(buf, body...))
+	return err
+}
+
+// Close closes the connection. It's safe to call Close more than once.
+func (c *Conn) Close() error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
@@ -0,0 +1,106 @@
+package mqtt
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint32{0, 127, 128, 16383, 16384, maxRemainingLength} {
+		d := &decoder{buf: appendVarint(nil, v)}
+		if got := d.varint(); got != v || d.err != nil || len(d.buf) != 0 {
+			t.Errorf("varint(%d): got %d, %v", v, got, d.err)
+		}
+	}
+	d := &decoder{buf: []byte{0x80, 0x80, 0x80, 0x80, 0x01}}
+	if d.varint(); d.err != ErrMalformed {
+		t.Error("varint: expected error for 5 bytes")
+	}
+}
+
+func TestConn(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		clientConn, serverConn := net.Pipe()
+		client := NewConn(clientConn, 1024, time.Second)
+		server := NewConn(serverConn, 64, time.Second)
+
+		connect := &Connect{
+			Version:    version,
+			ClientID:   "sensor-1",
+			CleanStart: true,
+			KeepAlive:  30,
+			Username:   "alice",
+			Password:   []byte("alice123"),
+		}
+		if version == Version5 {
+			connect.Props = Properties{{ID: PropMaxPacketSize, Value: uint32(32)}}
+		}
+		sent := []Packet{
+			connect,
+			&Subscribe{PacketID: 1, Filters: []Subscription{{Filter: "grpX", QoS: 1, NoLocal: version == Version5},
+				{Filter: "usrY"}}},
+			&Publish{Topic: "grpX", QoS: 1, PacketID: 2, Payload: []byte("hello")},
+			&PingReq{},
+		}
+		go func() {
+			for _, p := range sent {
+				if err := client.Send(p); err != nil {
+					t.Error("Send:", err)
+				}
+			}
+		}()
+
+		for _, expected := range sent {
+			p, err := server.Next()
+			if err != nil {
+				t.Fatalf("v%d Next: %v", version, err)
+			}
+			if !reflect.DeepEqual(p, expected) {
+				t.Errorf("v%d Next: got %+v, expected %+v", version, p, expected)
+			}
+		}
+		if server.Version() != version {
+			t.Errorf("v%d: unexpected version %d", version, server.Version())
+		}
+
+		// Responses of the server.
+		go func() {
+			server.Send(&ConnAck{Code: 0, Props: Properties{{ID: PropMaxQoS, Value: byte(1)}}})
+			server.Send(&SubAck{PacketID: 1, Codes: []byte{0, 0x80}})
+			server.Send(&Publish{Topic: "grpX", Payload: []byte("hi"),
+				Props: Properties{{ID: PropUserProperty, Value: [2]string{"from", "usrZ"}}}})
+		}()
+		p, err := client.Next()
+		if ack, ok := p.(*ConnAck); err != nil || !ok || ack.Code != 0 {
+			t.Errorf("v%d ConnAck: got %+v, %v", version, p, err)
+		} else if _, ok := ack.Props.Get(PropMaxQoS); ok != (version == Version5) {
+			t.Errorf("v%d ConnAck: unexpected properties %+v", version, ack.Props)
+		}
+		p, err = client.Next()
+		if ack, ok := p.(*SubAck); err != nil || !ok || ack.PacketID != 1 || len(ack.Codes) != 2 {
+			t.Errorf("v%d SubAck: got %+v, %v", version, p, err)
+		}
+		p, err = client.Next()
+		if pub, ok := p.(*Publish); err != nil || !ok || string(pub.Payload) != "hi" {
+			t.Errorf("v%d Publish: got %+v, %v", version, p, err)
+		}
+
+		// MQTT 5 client does not accept packets larger than 32 bytes.
+		if version == Version5 {
+			if err = server.Send(&Publish{Topic: "grpX", Payload: make([]byte, 40)}); !errors.Is(err, ErrTooLarge) {
+				t.Errorf("Expected ErrTooLarge sending large packet, got %v", err)
+			}
+		}
+
+		// The connection is closed after reading a large packet: the client is not waited for.
+		go client.Send(&Publish{Topic: "grpX", Payload: make([]byte, 100)})
+		if _, err := server.Next(); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("v%d large packet: expected ErrTooLarge, got %v", version, err)
+		}
+		server.Close()
+		client.Close()
+	}
+}
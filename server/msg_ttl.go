@@ -0,0 +1,119 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Disappearing messages. The owner of a group topic or any party of a p2p
+ *    topic sets time to live of messages with {set desc={ttl:SECONDS}}.
+ *    Messages older than that are hard-deleted by a background reaper and
+ *    subscribers are informed with {pres what="del"}.
+ *
+ *    Every cluster node periodically checks for expired messages but deletes
+ *    only those in topics mastered by the node.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// handleMsgExpired hard-deletes messages in the range [1, msg.Del.DelSeq[0].HiId) which outlived
+// the time to live of the topic. The message is generated by the reaper, not by a session.
+func (t *Topic) handleMsgExpired(msg *ClientComMessage) {
+	if t.isInactive() {
+		// Ignore request - topic is paused or being deleted. Messages will be deleted on the next run.
+		return
+	}
+
+	if t.msgTTL == 0 || len(msg.Del.DelSeq) != 1 {
+		// TTL was removed after the reaper has found the messages.
+		return
+	}
+
+	t.hardDeleteOlder(msg.Del.DelSeq[0].HiId, journalDelTTL)
+}
+
+// hardDeleteOlder hard-deletes messages with IDs below hi on behalf of the server and informs
+// subscribers. The reason is recorded in the compliance journal.
+func (t *Topic) hardDeleteOlder(hi int, reason string) {
+	hi = min(hi, t.lastID+1)
+	if hi <= 1 {
+		return
+	}
+	ranges := []types.Range{{Low: 1, Hi: hi}}
+
+	if err := store.Messages.DeleteList(t.name, t.delID+1, types.ZeroUid, 0, ranges); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to delete old messages (%s): %v", t.name, reason, err)
+		return
+	}
+	t.journalDelete(types.ZeroUid, ranges, true, reason)
+
+	t.delID++
+	t.unpinDeleted(ranges)
+	t.broadcastHardDelete(ranges, types.ZeroUid, t.xoriginal, "")
+}
+
+// deleteExpiredMessages requests topics mastered by this node to delete expired messages.
+// Up to 'limit' topics are processed at a time.
+func deleteExpiredMessages(limit int) {
+	expired, err := store.Messages.GetExpired(types.TimeNow(), limit)
+	if err != nil {
+		logs.Warn.Println("Expired messages:", err)
+		return
+	}
+	for topic, seqId := range expired {
+		if globals.cluster.isRemoteTopic(topic) {
+			// Messages will be deleted by the master node of the topic.
+			continue
+		}
+
+		msg := &ClientComMessage{
+			Del: &MsgClientDel{
+				What:   "msg",
+				DelSeq: []MsgRange{{LowId: 1, HiId: seqId + 1}},
+				Hard:   true,
+			},
+			RcptTo:    topic,
+			Original:  topicLoadOriginal(topic),
+			Timestamp: types.TimeNow(),
+		}
+		msg.Del.Topic = msg.Original
+
+		select {
+		case globals.hub.routeCli <- msg:
+		default:
+			logs.Err.Printf("topic[%s]: hub.route channel full, expired messages not deleted", topic)
+		}
+	}
+}
+
+// msgTTLRunReaper deletes expired messages every 'period'.
+// Returns channel which can be used to stop the process.
+func msgTTLRunReaper(period time.Duration, blockSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the reaper must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Reaper of expired messages started with period %s, block size %d",
+			period.Round(time.Second), blockSize)
+		for {
+			select {
+			case <-ticker.C:
+				deleteExpiredMessages(blockSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,50 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Network access control. Addresses of new connections are checked against
+ *    allow/deny lists and blocked countries. If some authentication levels are
+ *    exempt, connections from blocked addresses are accepted but restricted to
+ *    {hi} and {login} until a user with an exempt level logs in. Logins are
+ *    checked again because the address of a long polling client may change.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/netacl"
+)
+
+func netAclInit() {
+	statsRegisterInt("NetAclRejectedConnectionsTotal")
+	statsRegisterInt("NetAclRejectedLoginsTotal")
+}
+
+// netAclCheckConnection checks the address of a new connection. Returns reject=true if the connection
+// must be rejected, restrict=true if the session must be restricted.
+func netAclCheckConnection(remoteAddr string) (reject, restrict bool) {
+	reason := netacl.Check(remoteAddr)
+	if reason == "" {
+		return false, false
+	}
+	if netacl.HasExemptions() {
+		return false, true
+	}
+
+	statsInc("NetAclRejectedConnectionsTotal", 1)
+	logs.Info.Println("netacl: connection rejected", remoteAddr, reason)
+	return true, false
+}
+
+// netAclCheckLogin checks if the user with the given authentication level may log in from the session's address.
+func (s *Session) netAclCheckLogin(lvl auth.Level) bool {
+	if reason := netacl.Check(s.remoteAddr); reason != "" && !netacl.IsExempt(lvl) {
+		statsInc("NetAclRejectedLoginsTotal", 1)
+		logs.Info.Println("netacl: login rejected", s.remoteAddr, reason, s.sid)
+		return false
+	}
+	s.netRestricted = false
+	return true
+}
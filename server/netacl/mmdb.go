@@ -0,0 +1,316 @@
+package netacl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// Minimal reader of MaxMind DB files, such as GeoLite2-Country.mmdb.
+// See https://maxmind.github.io/MaxMind-DB/ for description of the format.
+
+// Start of the metadata section.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Size of the separator between the search tree and the data section.
+const mmdbDataSeparator = 16
+
+// Data types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// Limit of nesting of data structures.
+const mmdbMaxDepth = 32
+
+var errMmdbInvalid = errors.New("invalid MaxMind DB file")
+
+type mmdbReader struct {
+	// Search tree.
+	tree []byte
+	// Data section.
+	data       []byte
+	nodeCount  uint32
+	recordSize uint32
+	ipVersion  uint32
+	// Node where the search for IPv4 addresses starts in IPv6 databases.
+	ipv4Start uint32
+}
+
+func openMmdb(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseMmdb(buf)
+}
+
+func parseMmdb(buf []byte) (*mmdbReader, error) {
+	at := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if at < 0 {
+		return nil, errMmdbInvalid
+	}
+	meta, _, err := (&mmdbReader{}).decode(buf[at+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errMmdbInvalid
+	}
+
+	r := &mmdbReader{}
+	for name, dst := range map[string]*uint32{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		val, ok := fields[name].(uint64)
+		if !ok || val > math.MaxUint32 {
+			return nil, errMmdbInvalid
+		}
+		*dst = uint32(val)
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, errors.New("unsupported MaxMind DB record size")
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, errMmdbInvalid
+	}
+
+	treeSize := uint64(r.nodeCount) * uint64(r.recordSize) / 4
+	if treeSize+mmdbDataSeparator > uint64(at) {
+		return nil, errMmdbInvalid
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+mmdbDataSeparator : at]
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are mapped to ::a.b.c.d, the first 96 bits are zero.
+		node := uint32(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// record returns the left (bit 0) or the right (bit 1) record of the node.
+func (r *mmdbReader) record(node uint32, bit byte) uint32 {
+	switch r.recordSize {
+	case 24:
+		off := node*6 + uint32(bit)*3
+		b := r.tree[off : off+3]
+		return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+	case 28:
+		b := r.tree[node*7 : node*7+7]
+		if bit == 0 {
+			return uint32(b[3]>>4)<<24 | uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+		}
+		return uint32(b[3]&0x0f)<<24 | uint32(b[4])<<16 | uint32(b[5])<<8 | uint32(b[6])
+	default:
+		off := node*8 + uint32(bit)*4
+		return binary.BigEndian.Uint32(r.tree[off : off+4])
+	}
+}
+
+// lookup returns the data record of the address or nil if the address is not in the database.
+func (r *mmdbReader) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	node := uint32(0)
+	if addr.Is4() && r.ipVersion == 6 {
+		node = r.ipv4Start
+	} else if addr.Is6() && r.ipVersion == 4 {
+		return nil, nil
+	}
+
+	ip := addr.AsSlice()
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, (ip[i/8]>>(7-uint(i%8)))&1)
+	}
+
+	if node == r.nodeCount {
+		// Not found.
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, errMmdbInvalid
+	}
+	offset := node - r.nodeCount - mmdbDataSeparator
+	if int(offset) >= len(r.data) {
+		return nil, errMmdbInvalid
+	}
+	val, _, err := r.decode(r.data, int(offset), 0)
+	return val, err
+}
+
+// country returns the ISO 3166-1 code of the country of the address or "" if it's unknown.
+func (r *mmdbReader) country(addr netip.Addr) (string, error) {
+	val, err := r.lookup(addr)
+	if err != nil {
+		return "", err
+	}
+	rec, _ := val.(map[string]any)
+	for _, field := range []string{"country", "registered_country"} {
+		if c, ok := rec[field].(map[string]any); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				return code, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// decode decodes the data field at the offset in the section. Returns the value and the offset
+// of the next field.
+func (r *mmdbReader) decode(section []byte, offset, depth int) (any, int, error) {
+	if depth > mmdbMaxDepth || offset >= len(section) {
+		return nil, 0, errMmdbInvalid
+	}
+
+	ctrl := section[offset]
+	offset++
+	kind := int(ctrl >> 5)
+	if kind == mmdbPointer {
+		size := int(ctrl>>3) & 0x3
+		if offset+size+1 > len(section) {
+			return nil, 0, errMmdbInvalid
+		}
+		var ptr int
+		switch size {
+		case 0:
+			ptr = int(ctrl&0x7)<<8 | int(section[offset])
+		case 1:
+			ptr = (int(ctrl&0x7)<<16 | int(section[offset])<<8 | int(section[offset+1])) + 2048
+		case 2:
+			ptr = (int(ctrl&0x7)<<24 | int(section[offset])<<16 | int(section[offset+1])<<8 |
+				int(section[offset+2])) + 526336
+		default:
+			ptr = int(binary.BigEndian.Uint32(section[offset : offset+4]))
+		}
+		// Pointers are relative to the start of the data section.
+		val, _, err := r.decode(r.data, ptr, depth+1)
+		return val, offset + size + 1, err
+	}
+
+	if kind == mmdbExtended {
+		if offset >= len(section) {
+			return nil, 0, errMmdbInvalid
+		}
+		kind = int(section[offset]) + 7
+		offset++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(section) {
+			return nil, 0, errMmdbInvalid
+		}
+		extra := 0
+		for _, b := range section[offset : offset+n] {
+			extra = extra<<8 | int(b)
+		}
+		size = []int{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch kind {
+	case mmdbMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			key, next, err := r.decode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMmdbInvalid
+			}
+			if m[name], offset, err = r.decode(section, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			val, next, err := r.decode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, val)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbEndMarker, mmdbContainer:
+		return nil, offset, nil
+	}
+
+	if offset+size > len(section) {
+		return nil, 0, errMmdbInvalid
+	}
+	b := section[offset : offset+size]
+	offset += size
+	switch kind {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes:
+		return bytes.Clone(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMmdbInvalid
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMmdbInvalid
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			// Large uint128 values are not used by country databases.
+			return nil, offset, nil
+		}
+		var val uint64
+		for _, x := range b {
+			val = val<<8 | uint64(x)
+		}
+		return val, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMmdbInvalid
+		}
+		var val uint32
+		for _, x := range b {
+			val = val<<8 | uint32(x)
+		}
+		if size == 4 {
+			return int64(int32(val)), offset, nil
+		}
+		return int64(val), offset, nil
+	}
+	return nil, 0, errMmdbInvalid
+}
@@ -0,0 +1,180 @@
+// Package netacl implements network access control: blocking clients by IP address and by country.
+//
+// Addresses are checked against the allow list first: allowed addresses are never blocked. Then the
+// address is checked against the deny list, then the country of the address is looked up in a MaxMind
+// GeoIP database and checked against allowed and denied countries.
+package netacl
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/tinode/chat/server/auth"
+)
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Networks in CIDR notation which are always allowed, e.g. "10.0.0.0/8".
+	Allow []string `json:"allow"`
+	// Networks in CIDR notation which are blocked. Single addresses are accepted too.
+	Deny []string `json:"deny"`
+	// Path to MaxMind GeoIP2 or GeoLite2 country or city database.
+	GeoIPDb string `json:"geoip_db"`
+	// If not empty, only clients from these countries are allowed (ISO 3166-1 codes).
+	// Clients from unknown countries are blocked.
+	AllowCountries []string `json:"allow_countries"`
+	// Clients from these countries are blocked (ISO 3166-1 codes).
+	DenyCountries []string `json:"deny_countries"`
+	// Users with these authentication levels may log in from blocked addresses, e.g. "root".
+	ExemptAuthLevels []string `json:"exempt_auth_levels"`
+}
+
+var enabled bool
+var allowNets []netip.Prefix
+var denyNets []netip.Prefix
+var geoDb *mmdbReader
+var allowCountries map[string]bool
+var denyCountries map[string]bool
+var exemptLevels map[auth.Level]bool
+
+// Init initializes network access control. Returns true if it's enabled.
+func Init(jsonconf json.RawMessage) (bool, error) {
+	if len(jsonconf) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("netacl: failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	var err error
+	if allowNets, err = parseNets(config.Allow); err != nil {
+		return false, err
+	}
+	if denyNets, err = parseNets(config.Deny); err != nil {
+		return false, err
+	}
+
+	allowCountries = parseCountries(config.AllowCountries)
+	denyCountries = parseCountries(config.DenyCountries)
+	if len(allowCountries) > 0 || len(denyCountries) > 0 {
+		if config.GeoIPDb == "" {
+			return false, errors.New("netacl: countries are configured without GeoIP database")
+		}
+		if geoDb, err = openMmdb(config.GeoIPDb); err != nil {
+			return false, errors.New("netacl: failed to open GeoIP database: " + err.Error())
+		}
+	}
+
+	exemptLevels = make(map[auth.Level]bool)
+	for _, name := range config.ExemptAuthLevels {
+		lvl := auth.ParseAuthLevel(name)
+		if lvl == auth.LevelNone {
+			return false, errors.New("netacl: invalid auth level '" + name + "'")
+		}
+		exemptLevels[lvl] = true
+	}
+
+	enabled = true
+	return true, nil
+}
+
+// Check checks if the client with the given address must be blocked. The address may include a port.
+// Returns a non-empty reason if the client is blocked. Addresses which are not IP addresses are not blocked.
+func Check(remoteAddr string) string {
+	if !enabled {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		// If SplitHostPort has failed assume it's because :port part is missing.
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(host))
+	if err != nil {
+		// Not an IP address, such as a Unix socket.
+		return ""
+	}
+	addr = addr.Unmap()
+
+	if containsAddr(allowNets, addr) {
+		return ""
+	}
+	if containsAddr(denyNets, addr) {
+		return "denied network"
+	}
+
+	if geoDb == nil {
+		return ""
+	}
+	country, err := geoDb.country(addr)
+	if err != nil {
+		return "GeoIP lookup failed"
+	}
+	if denyCountries[country] {
+		return "denied country " + country
+	}
+	if len(allowCountries) > 0 && !allowCountries[country] {
+		if country == "" {
+			return "unknown country"
+		}
+		return "country not allowed " + country
+	}
+	return ""
+}
+
+// HasExemptions returns true if users with some authentication levels may log in from blocked addresses.
+func HasExemptions() bool {
+	return len(exemptLevels) > 0
+}
+
+// IsExempt returns true if users with the given authentication level may log in from blocked addresses.
+func IsExempt(lvl auth.Level) bool {
+	return exemptLevels[lvl]
+}
+
+func parseNets(list []string) ([]netip.Prefix, error) {
+	var nets []netip.Prefix
+	for _, cidr := range list {
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(cidr, "/") {
+			prefix, err = netip.ParsePrefix(cidr)
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(cidr); err == nil {
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, errors.New("netacl: invalid network '" + cidr + "'")
+		}
+		nets = append(nets, prefix.Masked())
+	}
+	return nets, nil
+}
+
+func parseCountries(list []string) map[string]bool {
+	countries := make(map[string]bool, len(list))
+	for _, code := range list {
+		countries[strings.ToUpper(code)] = true
+	}
+	return countries
+}
+
+func containsAddr(nets []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range nets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package netacl
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tinode/chat/server/auth"
+)
+
+// Encoders of MaxMind DB data fields.
+
+func mmdbStr(s string) []byte {
+	return append([]byte{byte(mmdbString<<5 | len(s))}, s...)
+}
+
+func mmdbUint(kind int, val uint32) []byte {
+	return []byte{byte(kind<<5 | 4), byte(val >> 24), byte(val >> 16), byte(val >> 8), byte(val)}
+}
+
+func mmdbMapOf(fields ...[]byte) []byte {
+	out := []byte{byte(mmdbMap<<5 | len(fields)/2)}
+	for _, f := range fields {
+		out = append(out, f...)
+	}
+	return out
+}
+
+// buildMmdb creates a database with IPv4 networks mapped to countries.
+func buildMmdb(t *testing.T, ipVersion, recordSize int, networks map[string]string) []byte {
+	t.Helper()
+
+	// Data section. The second and subsequent records of a country use a pointer to the first one.
+	var data []byte
+	offsets := map[string]int{}
+	dataOf := map[string]int{}
+	for cidr, country := range networks {
+		dataOf[cidr] = len(data)
+		if at, ok := offsets[country]; ok {
+			data = append(data, mmdbMapOf(mmdbStr("country"), []byte{mmdbPointer << 5, byte(at)})...)
+			continue
+		}
+		data = append(data, byte(mmdbMap<<5|1))
+		data = append(data, mmdbStr("country")...)
+		offsets[country] = len(data)
+		data = append(data, mmdbMapOf(mmdbStr("iso_code"), mmdbStr(country))...)
+	}
+
+	// Search tree: record is -1 for empty, -2-offset for data, node index otherwise.
+	nodes := [][2]int{{-1, -1}}
+	for cidr := range networks {
+		prefix := netip.MustParsePrefix(cidr)
+		ip := prefix.Addr().As4()
+		// IPv4 networks in IPv6 databases follow 96 zero bits.
+		start := 0
+		if ipVersion == 6 {
+			start = 96
+		}
+		node := 0
+		bits := start + prefix.Bits()
+		for i := 0; i < bits; i++ {
+			bit := 0
+			if i >= start {
+				j := i - start
+				bit = int(ip[j/8]>>(7-j%8)) & 1
+			}
+			if i == bits-1 {
+				nodes[node][bit] = -2 - dataOf[cidr]
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	count := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		var rec [2]uint32
+		for i, v := range n {
+			switch {
+			case v == -1:
+				rec[i] = uint32(count)
+			case v < -1:
+				rec[i] = uint32(count + mmdbDataSeparator + (-2 - v))
+			default:
+				rec[i] = uint32(v)
+			}
+		}
+		if recordSize == 24 {
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		} else {
+			tree = append(tree, byte(rec[0]>>16), byte(rec[0]>>8), byte(rec[0]),
+				byte(rec[0]>>24)<<4|byte(rec[1]>>24), byte(rec[1]>>16), byte(rec[1]>>8), byte(rec[1]))
+		}
+	}
+
+	out := append(tree, make([]byte, mmdbDataSeparator)...)
+	out = append(out, data...)
+	out = append(out, mmdbMetadataMarker...)
+	out = append(out, mmdbMapOf(
+		mmdbStr("node_count"), mmdbUint(mmdbUint32, uint32(count)),
+		mmdbStr("record_size"), mmdbUint(mmdbUint16, uint32(recordSize)),
+		mmdbStr("ip_version"), mmdbUint(mmdbUint16, uint32(ipVersion)),
+	)...)
+	return out
+}
+
+func TestMmdbCountry(t *testing.T) {
+	networks := map[string]string{
+		"1.0.0.0/8":      "AU",
+		"5.6.0.0/16":     "DE",
+		"203.0.113.0/24": "AU",
+	}
+	for _, layout := range [][2]int{{4, 24}, {6, 28}} {
+		r, err := parseMmdb(buildMmdb(t, layout[0], layout[1], networks))
+		if err != nil {
+			t.Fatal(layout, err)
+		}
+		for addr, expected := range map[string]string{
+			"1.2.3.4":         "AU",
+			"5.6.7.8":         "DE",
+			"5.7.0.1":         "",
+			"203.0.113.77":    "AU",
+			"::ffff:1.0.0.1":  "AU",
+			"8.8.8.8":         "",
+			"2001:db8::1":     "",
+			"255.255.255.255": "",
+		} {
+			country, err := r.country(netip.MustParseAddr(addr))
+			if err != nil || country != expected {
+				t.Errorf("%v %s: expected '%s', got '%s' %v", layout, addr, expected, country, err)
+			}
+		}
+	}
+
+	if _, err := parseMmdb([]byte("not a database")); err == nil {
+		t.Error("invalid database accepted")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, buildMmdb(t, 6, 28, map[string]string{
+		"1.0.0.0/8":  "AU",
+		"5.6.0.0/16": "DE",
+		"7.0.0.0/8":  "US",
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, _ := json.Marshal(map[string]any{
+		"enabled":            true,
+		"allow":              []string{"1.2.3.0/24"},
+		"deny":               []string{"9.9.9.9", "2001:db8::/32"},
+		"geoip_db":           path,
+		"deny_countries":     []string{"au"},
+		"allow_countries":    []string{"DE", "AU"},
+		"exempt_auth_levels": []string{"root"},
+	})
+	if ok, err := Init(conf); !ok || err != nil {
+		t.Fatal("failed to initialize", err)
+	}
+	defer func() { enabled = false }()
+
+	for addr, blocked := range map[string]bool{
+		"1.2.3.4:5000":         false, // allow list overrides country
+		"1.1.1.1:5000":         true,  // denied country
+		"5.6.7.8":              false,
+		"[::ffff:5.6.7.8]:443": false,
+		"7.7.7.7:80":           true, // not an allowed country
+		"8.8.8.8":              true, // unknown country
+		"9.9.9.9:1":            true, // deny list
+		"[2001:db8::5]:1":      true,
+		"@":                    false, // not an IP address
+	} {
+		if reason := Check(addr); (reason != "") != blocked {
+			t.Errorf("%s: expected blocked=%t, got '%s'", addr, blocked, reason)
+		}
+	}
+
+	if !HasExemptions() || !IsExempt(auth.LevelRoot) || IsExempt(auth.LevelAuth) {
+		t.Error("wrong exemptions")
+	}
+
+	for _, bad := range []map[string]any{
+		{"enabled": true, "deny": []string{"1.2.3.4/40"}},
+		{"enabled": true, "deny_countries": []string{"XX"}},
+		{"enabled": true, "exempt_auth_levels": []string{"admin"}},
+	} {
+		conf, _ := json.Marshal(bad)
+		if _, err := Init(conf); err == nil {
+			t.Error("invalid config accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    User's settings of push notifications:
+ *
+ *    - {set topic="me" notify={lang, preview, quiet, keywords}} changes the
+ *      language of notification texts, enables or disables previews of message
+ *      content in notifications, sets quiet hours when notifications are silent
+ *      and keywords which alert the user like mentions. Missing fields are not
+ *      changed.
+ *    - {set topic="grpXXX" notify={until, mentions}} mutes notifications
+ *      from the topic until the given time or limits them to messages which
+ *      mention the user. Mentioned users are notified even if they muted
+ *      the topic.
+ *    - {get what="notify"} returns the current settings of the user in 'me'
+ *      or of the subscription in other topics.
+ *
+ *    Texts of notifications are rendered by the push package from templates
+ *    configured in "push_templates". Muted subscriptions and quiet hours are
+ *    enforced when pushes are sent, regardless of the client.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"time"
+	// Time zone database for quiet hours on systems without one.
+	_ "time/tzdata"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+
+	"golang.org/x/text/language"
+)
+
+// Format of start and end of quiet hours.
+const quietHoursLayout = "15:04"
+
+// notifySettings returns notification settings of the user or defaults if the user has not changed them.
+func notifySettings(uid types.Uid) (*types.NotifySettings, error) {
+	settings, err := store.NotifySettings.Get(uid)
+	if err != nil {
+		return nil, err
+	}
+	if ns := settings[uid]; ns != nil {
+		return ns, nil
+	}
+	return &types.NotifySettings{User: uid.String()}, nil
+}
+
+// topicNotify returns subscribers' settings of notifications from the topic, loading them if needed.
+func (t *Topic) topicNotify() (map[types.Uid]*types.TopicNotifySettings, error) {
+	if t.notify == nil {
+		settings, err := store.NotifySettings.GetForTopic(t.name)
+		if err != nil {
+			return nil, err
+		}
+		if settings == nil {
+			settings = make(map[types.Uid]*types.TopicNotifySettings)
+		}
+		t.notify = settings
+	}
+	return t.notify, nil
+}
+
+// pushMutedBy returns the set of subscribers who get no push about the message: those who muted
+// or archived the topic and those who want to be notified only of messages which mention them.
+// Mentioned users are notified even if they muted the topic, but not if they archived it. The
+// mentioned set is nil for pushes which are not about messages, such as new subscriptions.
+func (t *Topic) pushMutedBy(mentioned map[types.Uid]string) map[types.Uid]bool {
+	muted := make(map[types.Uid]bool)
+	for uid, pud := range t.perUser {
+		if pud.archived {
+			muted[uid] = true
+		}
+	}
+
+	notify, err := t.topicNotify()
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load notification settings: %v", t.name, err)
+		return muted
+	}
+
+	now := types.TimeNow()
+	for uid, tns := range notify {
+		if _, found := mentioned[uid]; !found && (tns.MentionsOnly || tns.IsMuted(now)) {
+			muted[uid] = true
+		}
+	}
+	return muted
+}
+
+// parseQuietHours converts quiet hours from the request to minutes after midnight and the time zone.
+func parseQuietHours(quiet *MsgQuietHours) (int, int, string, error) {
+	if quiet.Start == quiet.End {
+		// Quiet hours are disabled.
+		return 0, 0, "", nil
+	}
+	start, err := time.Parse(quietHoursLayout, quiet.Start)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	end, err := time.Parse(quietHoursLayout, quiet.End)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if quiet.Tz != "" {
+		if _, err := time.LoadLocation(quiet.Tz); err != nil {
+			return 0, 0, "", err
+		}
+	}
+	return start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute(), quiet.Tz, nil
+}
+
+// formatQuietHours converts minutes after midnight to the format of quiet hours.
+func formatQuietHours(minutes int) string {
+	return time.Date(0, 1, 1, minutes/60, minutes%60, 0, 0, time.UTC).Format(quietHoursLayout)
+}
+
+// replySetNotify updates user's settings of push notifications in 'me' or of the subscription in other topics.
+func (t *Topic) replySetNotify(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	switch t.cat {
+	case types.TopicCatMe:
+		return t.replySetUserNotify(sess, asUid, msg)
+	case types.TopicCatP2P, types.TopicCatGrp:
+		return t.replySetTopicNotify(sess, asUid, msg)
+	}
+
+	sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+	return errors.New("invalid topic category for notification settings")
+}
+
+// replySetUserNotify updates user's settings of push notifications.
+func (t *Topic) replySetUserNotify(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	req := msg.Set.Notify
+	if req.MuteUntil != nil || req.Mentions != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.notify: topic settings in 'me'")
+	}
+
+	var lang string
+	if req.Lang != nil && *req.Lang != "" {
+		tag, err := language.Parse(*req.Lang)
+		if err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.notify: invalid language")
+		}
+		lang = tag.String()
+	}
+
+	var keywords []string
+	if req.Keywords != nil {
+		var err error
+		if keywords, err = normalizeKeywords(*req.Keywords); err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.notify: " + err.Error())
+		}
+	}
+
+	var quietStart, quietEnd int
+	var tz string
+	if req.Quiet != nil {
+		var err error
+		if quietStart, quietEnd, tz, err = parseQuietHours(req.Quiet); err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.notify: invalid quiet hours")
+		}
+	}
+
+	ns, err := notifySettings(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if req.Lang != nil {
+		ns.Lang = lang
+	}
+	if req.Preview != nil {
+		ns.NoPreview = !*req.Preview
+	}
+	if req.Quiet != nil {
+		ns.QuietStart, ns.QuietEnd, ns.TimeZone = quietStart, quietEnd, tz
+	}
+	if req.Keywords != nil {
+		ns.Keywords = keywords
+	}
+	if req.Sms != nil {
+		ns.Sms = *req.Sms
+	}
+	if err := store.NotifySettings.Update(ns); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replySetTopicNotify updates user's settings of push notifications from the topic.
+func (t *Topic) replySetTopicNotify(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	req := msg.Set.Notify
+	if req.Lang != nil || req.Preview != nil || req.Quiet != nil || req.Keywords != nil || req.Sms != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.notify: user settings outside of 'me'")
+	}
+
+	if userData := t.perUser[asUid]; !(userData.modeGiven & userData.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("notification settings update by non-reader")
+	}
+
+	notify, err := t.topicNotify()
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	tns := &types.TopicNotifySettings{Topic: t.name, User: asUid.String()}
+	if old := notify[asUid]; old != nil {
+		*tns = *old
+	}
+	if req.MuteUntil != nil {
+		tns.MuteUntil = nil
+		if req.MuteUntil.After(now) {
+			until := req.MuteUntil.UTC().Round(time.Millisecond)
+			tns.MuteUntil = &until
+		}
+	}
+	if req.Mentions != nil {
+		tns.MentionsOnly = *req.Mentions
+	}
+	if err := store.NotifySettings.UpdateForTopic(tns); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	notify[asUid] = tns
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetNotify returns user's settings of push notifications in 'me' or of the subscription in other topics.
+func (t *Topic) replyGetNotify(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	var result *MsgNotifySettings
+	switch t.cat {
+	case types.TopicCatMe:
+		ns, err := notifySettings(asUid)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+
+		preview := !ns.NoPreview
+		keywords := []string(ns.Keywords)
+		result = &MsgNotifySettings{Lang: &ns.Lang, Preview: &preview, Sms: &ns.Sms}
+		if len(keywords) > 0 {
+			result.Keywords = &keywords
+		}
+		if ns.QuietStart != ns.QuietEnd {
+			result.Quiet = &MsgQuietHours{
+				Start: formatQuietHours(ns.QuietStart),
+				End:   formatQuietHours(ns.QuietEnd),
+				Tz:    ns.TimeZone,
+			}
+		}
+
+	case types.TopicCatP2P, types.TopicCatGrp:
+		if userData := t.perUser[asUid]; !(userData.modeGiven & userData.modeWant).IsReader() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to get notification settings by non-reader")
+		}
+
+		notify, err := t.topicNotify()
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+
+		var mentions bool
+		result = &MsgNotifySettings{Mentions: &mentions}
+		if tns := notify[asUid]; tns != nil {
+			mentions = tns.MentionsOnly
+			if tns.IsMuted(now) {
+				result.MuteUntil = tns.MuteUntil
+			}
+		}
+
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting notification settings")
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Notify:    result,
+		},
+	})
+	return nil
+}
@@ -0,0 +1,189 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Automatic service messages of group topics. Topic admins configure them
+ *    in aux.onboarding:
+ *
+ *      {set aux={onboarding: {
+ *        welcome: "Welcome to $topic, $user!",
+ *        join: "$user joined",
+ *        leave: "$user left"
+ *      }}}
+ *
+ *    - welcome is sent to every new subscriber as a message scoped to the
+ *      subscriber: other members except admins don't see it.
+ *    - join and leave are posted to all subscribers when a user joins or
+ *      leaves the topic, is approved, removed or banned.
+ *
+ *    Templates may contain variables: $user is the full name of the user,
+ *    $topic is the name of the topic, $count is the number of subscribers.
+ *    Messages are generated by the server and have no sender. They are
+ *    marked with head.service="welcome", "join" or "leave" and head.user is
+ *    the ID of the user the message is about, so clients render them as
+ *    service messages. Push notifications of service messages are silent.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Key of the settings of automatic messages in topic's aux.
+	auxOnboarding = "onboarding"
+	// Message header with the event of a message generated by the server.
+	msgHeadService = "service"
+	// Message header with the ID of the user the service message is about.
+	msgHeadServiceUser = "user"
+
+	// Maximum length of a template of an automatic message in bytes.
+	maxOnboardingTemplateLength = 1024
+)
+
+// Events of service messages.
+const (
+	serviceWelcome = "welcome"
+	serviceJoin    = "join"
+	serviceLeave   = "leave"
+)
+
+// validateTopicOnboarding checks settings of automatic messages assigned to topic's aux.
+func validateTopicOnboarding(val any) error {
+	if val == nil {
+		return nil
+	}
+	settings, ok := val.(map[string]any)
+	if !ok {
+		return errors.New("invalid onboarding settings")
+	}
+	for key, tpl := range settings {
+		if key != serviceWelcome && key != serviceJoin && key != serviceLeave {
+			return errors.New("unknown onboarding message")
+		}
+		if str, ok := tpl.(string); !ok || len(str) > maxOnboardingTemplateLength {
+			return errors.New("invalid onboarding template")
+		}
+	}
+	return nil
+}
+
+// onboardingTemplate returns the template of the automatic message or an empty string.
+func (t *Topic) onboardingTemplate(event string) string {
+	settings, _ := t.aux[auxOnboarding].(map[string]any)
+	tpl, _ := settings[event].(string)
+	return strings.TrimSpace(tpl)
+}
+
+// renderOnboarding expands variables of the template of the automatic message about the user.
+func (t *Topic) renderOnboarding(tpl string, uid types.Uid) string {
+	return strings.TrimSpace(os.Expand(tpl, func(name string) string {
+		switch name {
+		case "user":
+			if user, err := store.Users.Get(uid); err == nil && user != nil {
+				if public, ok := user.Public.(map[string]any); ok {
+					fn, _ := public["fn"].(string)
+					return fn
+				}
+			}
+			return ""
+		case "topic":
+			if public, ok := t.public.(map[string]any); ok {
+				fn, _ := public["fn"].(string)
+				return fn
+			}
+			return ""
+		case "count":
+			return strconv.Itoa(t.subsCount())
+		}
+		return "$" + name
+	}))
+}
+
+// isTopicMember checks if the access modes make the user a member of the topic: joined and not waiting for approval.
+func isTopicMember(want, given types.AccessMode) bool {
+	return want.IsDefined() && given.IsDefined() && (want & given).IsJoiner() && !isJoinRequest(want, given)
+}
+
+// onboardingSubChange posts automatic messages when the user joins or leaves the topic.
+func (t *Topic) onboardingSubChange(uid types.Uid, oldWant, oldGiven, newWant, newGiven types.AccessMode) {
+	if t.cat != types.TopicCatGrp || t.isChan || t.community || t.aux[auxOnboarding] == nil {
+		return
+	}
+
+	wasMember, isMember := isTopicMember(oldWant, oldGiven), isTopicMember(newWant, newGiven)
+	switch {
+	case !wasMember && isMember:
+		if tpl := t.onboardingTemplate(serviceJoin); tpl != "" {
+			t.postServiceMessage(serviceJoin, uid, t.renderOnboarding(tpl, uid), nil)
+		}
+		if tpl := t.onboardingTemplate(serviceWelcome); tpl != "" && (newWant & newGiven).IsReader() {
+			t.postServiceMessage(serviceWelcome, uid, t.renderOnboarding(tpl, uid), []string{uid.UserId()})
+		}
+	case wasMember && !isMember:
+		if tpl := t.onboardingTemplate(serviceLeave); tpl != "" {
+			t.postServiceMessage(serviceLeave, uid, t.renderOnboarding(tpl, uid), nil)
+		}
+	}
+}
+
+// postServiceMessage saves the message generated by the server and delivers it to subscribers in scope.
+func (t *Topic) postServiceMessage(event string, uid types.Uid, text string, scope []string) {
+	if text == "" {
+		return
+	}
+
+	now := types.TimeNow()
+	head := map[string]any{msgHeadService: event, msgHeadServiceUser: uid.UserId()}
+	if scope != nil {
+		head[msgHeadScope] = scope
+	}
+	if err, _ := store.Messages.Save(
+		&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: now},
+			SeqId:     t.lastID + 1,
+			Topic:     t.name,
+			Head:      head,
+			Content:   text,
+		}, nil, false); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to save %s message: %v", t.name, event, err)
+		return
+	}
+
+	t.lastID++
+	t.touched = now
+
+	data := &ServerComMessage{
+		Data: &MsgServerData{
+			Topic:     t.xoriginal,
+			Timestamp: now,
+			SeqId:     t.lastID,
+			Head:      head,
+			Content:   text,
+		},
+		RcptTo:    t.name,
+		Timestamp: now,
+		Scope:     scope,
+	}
+
+	t.presSubsOffline("msg", &presParams{seqID: t.lastID}, &presFilters{filterIn: types.ModeRead}, nilPresFilters, "", true)
+	pluginMessage(data.Data, plgActCreate)
+	t.webhookMessage(data.Data)
+	t.exportMessage(data.Data)
+	t.journalMessage(data.Data)
+	t.broadcastToSessions(data)
+
+	if pushRcpt := t.pushForData(types.ZeroUid, data.Data, false, nil); pushRcpt != nil {
+		// Service messages update unread counters but don't alert users.
+		pushRcpt.Payload.Silent = true
+		sendPush(pushRcpt)
+	}
+}
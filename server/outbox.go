@@ -0,0 +1,301 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Resumable delivery of events to websocket clients on flaky networks.
+ *    A client which connects with ?outbox=1 receives a token in params.outbox
+ *    of the {hi} response. Events sent to the session, {data}, {pres} and
+ *    {info}, are numbered with a cursor, and the most recent of them are kept
+ *    in the outbox of the session.
+ *
+ *    When the connection of a logged in session is lost, the session is parked
+ *    for outbox.window seconds: it stays subscribed to its topics and events
+ *    keep being added to the outbox. The client reconnects with
+ *    ?resume=<token>&cursor=<cursor of the last event received>, the new
+ *    connection takes over the session and the missed events are replayed in
+ *    order. No {hi}, {login} or {sub} is needed after that. If the session
+ *    expired, the missed events are no longer kept or the client connected to
+ *    another node, a new session is started with {ctrl code=410 text="gone"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default time a session is kept after its connection is lost.
+	defaultOutboxWindow = time.Minute
+	// Default number of recent events kept for replay.
+	defaultOutboxMaxEvents = 500
+)
+
+// Resumable delivery config.
+type outboxConfig struct {
+	// Let websocket clients opt into resumable delivery.
+	Enabled bool `json:"enabled"`
+	// Seconds a session is kept after its connection is lost, default 60.
+	Window int `json:"window"`
+	// Number of recent events of a session kept for replay, default 500.
+	MaxEvents int `json:"max_events"`
+}
+
+var outboxOptions struct {
+	enabled   bool
+	window    time.Duration
+	maxEvents int
+}
+
+// Sessions with outboxes indexed by token.
+var outboxCache struct {
+	sync.Mutex
+	sessions map[string]*Session
+}
+
+// sessionOutbox keeps recent events sent to a session for replay after reconnection.
+type sessionOutbox struct {
+	sync.Mutex
+	// Secret which lets a new connection take over the session.
+	token string
+	// Cursor of the last event.
+	cursor int64
+	// Recent events in the order of cursors.
+	events []*ServerComMessage
+	// Set while the session has no connection: expires the session when fired.
+	parked *time.Timer
+	// The session is being terminated and must not be parked or resumed.
+	discarded bool
+	// A new connection is taking over the session.
+	resuming bool
+	// Read and write loops of the current connection.
+	loops sync.WaitGroup
+}
+
+// outboxInit applies the resumable delivery config.
+func outboxInit(config *outboxConfig) error {
+	outboxOptions.window = defaultOutboxWindow
+	outboxOptions.maxEvents = defaultOutboxMaxEvents
+	if config == nil || !config.Enabled {
+		return nil
+	}
+	if config.Window < 0 || config.MaxEvents < 0 {
+		return errors.New("outbox: invalid window or max_events")
+	}
+	if config.Window > 0 {
+		outboxOptions.window = time.Duration(config.Window) * time.Second
+	}
+	if config.MaxEvents > 0 {
+		outboxOptions.maxEvents = config.MaxEvents
+	}
+	outboxOptions.enabled = true
+	return nil
+}
+
+// outboxAttach makes delivery to the session resumable.
+func outboxAttach(s *Session) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		s.log(nil).Warn.Println("outbox: failed to generate token", err)
+		return
+	}
+	s.outbox = &sessionOutbox{token: base64.RawURLEncoding.EncodeToString(buf)}
+
+	outboxCache.Lock()
+	if outboxCache.sessions == nil {
+		outboxCache.sessions = make(map[string]*Session)
+	}
+	outboxCache.sessions[s.outbox.token] = s
+	outboxCache.Unlock()
+}
+
+// outboxRelease forgets the outbox of a terminated session.
+func (s *Session) outboxRelease() {
+	if s.outbox == nil {
+		return
+	}
+	outboxCache.Lock()
+	delete(outboxCache.sessions, s.outbox.token)
+	outboxCache.Unlock()
+}
+
+// outboxStamp returns a copy of the event with the cursor set.
+func outboxStamp(msg *ServerComMessage, cursor int64) *ServerComMessage {
+	msg = msg.copy()
+	switch {
+	case msg.Data != nil:
+		msg.Data.Cursor = cursor
+	case msg.Pres != nil:
+		msg.Pres.Cursor = cursor
+	case msg.Info != nil:
+		msg.Info.Cursor = cursor
+	}
+	return msg
+}
+
+// queue adds an event to the outbox and sends it to the connection, if any. Returns false as
+// 'handled' if the message is not an event and the session is connected: such messages
+// are sent as usual.
+func (o *sessionOutbox) queue(s *Session, msg *ServerComMessage) (sent, handled bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if msg.Data == nil && msg.Pres == nil && msg.Info == nil {
+		// Responses are not replayed, they are lost together with the connection.
+		return true, o.parked != nil
+	}
+
+	o.cursor++
+	msg = outboxStamp(msg, o.cursor)
+	o.events = append(o.events, msg)
+	if len(o.events) > outboxOptions.maxEvents {
+		o.events = o.events[len(o.events)-outboxOptions.maxEvents:]
+	}
+	if o.parked != nil {
+		return true, true
+	}
+
+	// Sending under the lock keeps the order of events when a new connection takes over.
+	select {
+	case s.send <- msg:
+	default:
+		s.log(nil).Err.Println("s.queueOut: session's send queue full")
+		return false, true
+	}
+	return true, true
+}
+
+// isParked checks if the session has no connection.
+func (o *sessionOutbox) isParked() bool {
+	o.Lock()
+	defer o.Unlock()
+	return o.parked != nil
+}
+
+// outboxPark keeps the session after its connection is lost. Returns false if the session
+// must be terminated.
+func (s *Session) outboxPark() bool {
+	if s.outbox == nil || s.uid.IsZero() || atomic.LoadInt32(&s.terminating) > 0 {
+		return false
+	}
+
+	o := s.outbox
+	o.Lock()
+	defer o.Unlock()
+	if o.discarded {
+		return false
+	}
+	o.parked = time.AfterFunc(outboxOptions.window, s.outboxExpire)
+	// Stop the write loop if it's still running.
+	select {
+	case s.stop <- nil:
+	default:
+	}
+	s.log(nil).Info.Println("outbox: session parked")
+	return true
+}
+
+// outboxExpire terminates the parked session once no connection took it over.
+func (s *Session) outboxExpire() {
+	o := s.outbox
+	o.Lock()
+	if o.parked == nil {
+		// Resumed.
+		o.Unlock()
+		return
+	}
+	o.parked = nil
+	o.discarded = true
+	o.Unlock()
+
+	s.log(nil).Info.Println("outbox: parked session expired")
+	s.cleanUp(false)
+}
+
+// outboxDiscard prevents the session from being parked or resumed once it's stopped by the server.
+// Returns true if the session is parked: it expires right away and has no write loop to stop.
+func (s *Session) outboxDiscard() bool {
+	o := s.outbox
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.discarded = true
+	if o.parked == nil {
+		return false
+	}
+	o.parked.Reset(0)
+	return true
+}
+
+// outboxResume lets a new connection take over the session with the given token and replays
+// events after the cursor. The attach function assigns the connection to the session. Returns nil
+// if the session cannot be resumed.
+func outboxResume(token string, cursor int64, attach func(*Session)) *Session {
+	outboxCache.Lock()
+	s := outboxCache.sessions[token]
+	outboxCache.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	o := s.outbox
+	o.Lock()
+	if o.resuming || o.discarded {
+		o.Unlock()
+		return nil
+	}
+	o.resuming = true
+	o.Unlock()
+
+	// The old connection may still look alive to the server: drop it and let it park the session.
+	s.closeWS()
+	o.loops.Wait()
+
+	o.Lock()
+	defer o.Unlock()
+	o.resuming = false
+	if o.parked == nil || o.discarded {
+		// The session was terminated.
+		return nil
+	}
+	missed := o.cursor - cursor
+	if missed < 0 || missed > int64(len(o.events)) {
+		// Some of the missed events are no longer kept.
+		s.log(nil).Info.Println("outbox: cursor is out of range", cursor)
+		o.discarded = true
+		o.parked.Reset(0)
+		return nil
+	}
+	o.parked.Stop()
+	o.parked = nil
+
+	// Topics which detached the session while it was parked.
+	for len(s.detach) > 0 {
+		s.delSub(<-s.detach)
+	}
+	s.purgeChannels()
+	attach(s)
+
+	replay := []*ServerComMessage{{Ctrl: &MsgServerCtrl{
+		Code:      200,
+		Text:      "resumed",
+		Params:    map[string]any{"replayed": missed},
+		Timestamp: types.TimeNow(),
+	}}}
+	replay = append(replay, o.events[int64(len(o.events))-missed:]...)
+	// The send queue is empty: purged above.
+	s.send <- replay
+	o.loops.Add(2)
+
+	s.log(nil).Info.Println("outbox: session resumed, events replayed:", missed)
+	return s
+}
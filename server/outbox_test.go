@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestOutboxResume(t *testing.T) {
+	outboxOptions.window, outboxOptions.maxEvents = time.Hour, 3
+	s := &Session{
+		send:   make(chan any, 10),
+		stop:   make(chan any, 1),
+		detach: make(chan string, 10),
+		uid:    types.Uid(1),
+		subs:   map[string]*Subscription{"grpTest": {}},
+	}
+	outboxAttach(s)
+	defer s.outboxRelease()
+
+	s.queueOut(&ServerComMessage{Data: &MsgServerData{Topic: "grpTest", SeqId: 1}})
+	s.queueOut(NoErr("1", "grpTest", types.TimeNow()))
+	if msg := (<-s.send).(*ServerComMessage); msg.Data == nil || msg.Data.Cursor != 1 {
+		t.Fatalf("Expected data with cursor 1, got %+v", msg)
+	}
+	if msg := (<-s.send).(*ServerComMessage); msg.Ctrl == nil {
+		t.Fatalf("Expected ctrl, got %+v", msg)
+	}
+
+	// Events are kept while the session has no connection, responses are dropped.
+	if !s.outboxPark() {
+		t.Fatal("Session is not parked")
+	}
+	s.queueOut(&ServerComMessage{Pres: &MsgServerPres{Topic: "grpTest", What: "on"}})
+	s.queueOut(&ServerComMessage{Info: &MsgServerInfo{Topic: "grpTest", What: "read", SeqId: 1}})
+	s.queueOut(NoErr("2", "grpTest", types.TimeNow()))
+	s.detachSession("grpTest")
+	if len(s.send) != 0 {
+		t.Fatalf("Parked session sent %d messages", len(s.send))
+	}
+	if s.getSub("grpTest") != nil {
+		t.Error("Parked session is not detached from the topic")
+	}
+
+	if outboxResume("invalid", 0, func(*Session) {}) != nil {
+		t.Error("Session resumed with an invalid token")
+	}
+	var attached bool
+	if outboxResume(s.outbox.token, 1, func(*Session) { attached = true }) != s || !attached {
+		t.Fatal("Session is not resumed")
+	}
+	replay, _ := (<-s.send).([]*ServerComMessage)
+	if len(replay) != 3 || replay[0].Ctrl == nil || replay[0].Ctrl.Text != "resumed" {
+		t.Fatalf("Unexpected replay %+v", replay)
+	}
+	if replay[1].Pres == nil || replay[1].Pres.Cursor != 2 || replay[2].Info == nil || replay[2].Info.Cursor != 3 {
+		t.Errorf("Events are replayed out of order: %s, %s", replay[1].describe(), replay[2].describe())
+	}
+	if s.outbox.isParked() || len(s.stop) != 0 {
+		t.Error("Resumed session is still parked")
+	}
+}
@@ -0,0 +1,164 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Owners of group topics. A group topic may have several owners with
+ *    equal rights: subscribers with the O permission both given and wanted.
+ *    One of them is the primary owner recorded in the topic.
+ *
+ *    - An owner offers ownership to a subscriber by giving the O permission:
+ *      {set sub={user: "usrX", mode: "JRWPASDO"}}. The offer is withdrawn by
+ *      removing O from the given permissions.
+ *    - The subscriber accepts the offer by asking for O:
+ *      {set sub={mode: "JRWPASDO"}}, and becomes one more owner.
+ *    - An owner steps down by dropping O from the wanted permissions or leaves
+ *      the topic while another owner remains. When the primary owner steps
+ *      down, the ownership is transferred to another owner. Ownership
+ *      transfer is thus an offer, an acceptance and the old owner stepping
+ *      down.
+ *    - When the account of the primary owner is deleted, the topic passes to
+ *      the oldest other owner, or if there is none, to the oldest admin. The
+ *      topic is deleted only if there are no owners and admins left.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"sort"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// isOwner checks if the user is an owner of the topic.
+func (t *Topic) isOwner(uid types.Uid) bool {
+	if uid.IsZero() {
+		return false
+	}
+	if uid == t.owner {
+		return true
+	}
+	if t.cat != types.TopicCatGrp {
+		return false
+	}
+	pud, ok := t.perUser[uid]
+	return ok && !pud.deleted && (pud.modeGiven & pud.modeWant).IsOwner()
+}
+
+// otherOwner returns an owner of the topic other than the given user or zero if the user is the only owner.
+// The primary owner is preferred, then the owner with the lowest ID to make the choice stable.
+func (t *Topic) otherOwner(uid types.Uid) types.Uid {
+	if t.owner != uid && t.isOwner(t.owner) {
+		return t.owner
+	}
+	var other types.Uid
+	for id := range t.perUser {
+		if id != uid && t.isOwner(id) && (other.IsZero() || id < other) {
+			other = id
+		}
+	}
+	return other
+}
+
+// stepDownOwner transfers primary ownership of the topic to another owner when the primary owner
+// steps down or leaves. The caller makes sure another owner exists.
+func (t *Topic) stepDownOwner(uid types.Uid, remoteAddr string) error {
+	if uid != t.owner {
+		return nil
+	}
+	newOwner := t.otherOwner(uid)
+	if newOwner.IsZero() {
+		return types.ErrPermissionDenied
+	}
+	if err := store.Topics.OwnerChange(t.name, newOwner); err != nil {
+		return err
+	}
+	auditLog(&types.AuditRecord{
+		Event:      types.AuditOwnerChange,
+		Actor:      uid.UserId(),
+		Target:     newOwner.UserId(),
+		Topic:      t.name,
+		RemoteAddr: remoteAddr,
+		Details:    "owner stepped down",
+	})
+	t.owner = newOwner
+	return nil
+}
+
+// ownerSuccessor picks the subscriber who takes over the topic from the deleted owner: the oldest other
+// owner, otherwise the oldest admin. Returns nil if there is none.
+func ownerSuccessor(subs []types.Subscription, owner types.Uid) *types.Subscription {
+	sort.SliceStable(subs, func(i, j int) bool {
+		return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+	})
+	var admin *types.Subscription
+	for i := range subs {
+		sub := &subs[i]
+		mode := sub.ModeGiven & sub.ModeWant
+		if sub.DeletedAt != nil || types.ParseUid(sub.User) == owner || !mode.IsJoiner() {
+			continue
+		}
+		if mode.IsOwner() {
+			return sub
+		}
+		if admin == nil && (mode.IsAdmin() || sub.Role == roleAdmin) {
+			admin = sub
+		}
+	}
+	return admin
+}
+
+// promoteOwners passes group topics owned by the user being deleted to their other owners or admins.
+// Topics without successors are deleted together with the user.
+func promoteOwners(uid types.Uid, skipSid string) {
+	ownTopics, err := store.Users.GetOwnTopics(uid)
+	if err != nil {
+		logs.Warn.Println("deleteUser: failed to get owned topics", err, skipSid)
+		return
+	}
+
+	for _, topic := range ownTopics {
+		subs, err := store.Topics.GetSubs(topic, nil)
+		if err != nil {
+			logs.Warn.Println("deleteUser: failed to get topic subscribers", err, topic, skipSid)
+			continue
+		}
+		sub := ownerSuccessor(subs, uid)
+		if sub == nil {
+			continue
+		}
+
+		newOwner := types.ParseUid(sub.User)
+		update := map[string]any{
+			"ModeWant":  sub.ModeWant | types.ModeOwner,
+			"ModeGiven": sub.ModeGiven | types.ModeOwner,
+			"Role":      "",
+		}
+		if err := store.Subs.Update(topic, newOwner, update); err != nil {
+			logs.Warn.Println("deleteUser: failed to promote owner", err, topic, skipSid)
+			continue
+		}
+		if err := store.Topics.OwnerChange(topic, newOwner); err != nil {
+			logs.Warn.Println("deleteUser: failed to change owner", err, topic, skipSid)
+			continue
+		}
+		auditLog(&types.AuditRecord{
+			Event:   types.AuditOwnerChange,
+			Actor:   uid.UserId(),
+			Target:  newOwner.UserId(),
+			Topic:   topic,
+			Details: "owner account deleted",
+		})
+
+		// Unload the topic so it's reloaded with the new owner instead of being deleted with the user.
+		globals.hub.unreg <- &topicUnreg{rcptTo: topic}
+
+		// Tell the new owner about the promotion.
+		presSingleUserOfflineOffline(newOwner, topic, "acs", &presParams{
+			dWant:  sub.ModeWant.Delta(sub.ModeWant | types.ModeOwner),
+			dGiven: sub.ModeGiven.Delta(sub.ModeGiven | types.ModeOwner),
+			actor:  uid.UserId(),
+		}, skipSid)
+	}
+}
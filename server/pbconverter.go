@@ -168,7 +168,7 @@ func pbServDeserialize(pkt *pbx.ServerMsg) *ServerComMessage {
 			DeletedAt: int64ToTime(data.GetDeletedAt()),
 			SeqId:     int(data.GetSeqId()),
 			Head:      byteMapToInterfaceMap(data.GetHead()),
-			Content:   data.GetContent(),
+			Content:   bytesToInterface(data.GetContent()),
 		}
 	} else if pres := pkt.GetPres(); pres != nil {
 		var what string
@@ -528,7 +528,7 @@ func byteMapToInterfaceMap(in map[string][]byte) map[string]any {
 
 func interfaceToBytes(in any) []byte {
 	if in != nil {
-		out, _ := json.Marshal(in)
+		out, _ := jsonWire.Marshal(in)
 		return out
 	}
 	return nil
@@ -537,7 +537,7 @@ func interfaceToBytes(in any) []byte {
 func bytesToInterface(in []byte) any {
 	var out any
 	if len(in) > 0 {
-		err := json.Unmarshal(in, &out)
+		err := jsonWire.Unmarshal(in, &out)
 		if err != nil {
 			logs.Warn.Println("pbx: failed to parse bytes", string(in), err)
 		}
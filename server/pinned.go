@@ -0,0 +1,118 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Pinned messages. Managers of a group topic or any party of a p2p topic
+ *    pin messages with {set pin={seq:123}} and unpin them with
+ *    {set pin={seq:123 unpin:true}}. IDs of pinned messages are reported in
+ *    {meta desc} as desc.pinned, changes are announced to topic subscribers
+ *    as {pres what="pin"} and {pres what="unpin"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// replySetPin pins or unpins a message in the topic.
+func (t *Topic) replySetPin(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for pinned messages")
+	}
+
+	pud := t.perUser[asUid]
+	if mode := pud.modeGiven & pud.modeWant; !mode.IsReader() || (t.cat == types.TopicCatGrp && !t.userCan(asUid, capPin)) {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to pin a message by non-manager")
+	}
+
+	pin := msg.Set.Pin
+	if pin.SeqId <= 0 || pin.SeqId > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid ID of a message to pin")
+	}
+
+	idx := slices.Index(t.pinned, pin.SeqId)
+	if (idx >= 0) != pin.Unpin {
+		// The message is already pinned or is not pinned.
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	var pinned []int
+	what := "unpin"
+	if pin.Unpin {
+		pinned = slices.Delete(slices.Clone(t.pinned), idx, idx+1)
+	} else {
+		if len(t.pinned) >= globals.maxPinnedCount {
+			sess.queueOut(ErrPolicyReply(msg, now))
+			return errors.New("too many pinned messages")
+		}
+
+		origMsg, err := store.Messages.GetBySeqId(t.name, pin.SeqId)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+		if origMsg == nil || origMsg.DeletedAt != nil || origMsg.Head["unsent"] == true {
+			sess.queueOut(ErrNotFoundReply(msg, now))
+			return types.ErrNotFound
+		}
+		if len(msgScope(origMsg.Head)) > 0 {
+			// Messages visible to some subscribers only cannot be pinned for everyone.
+			sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+			return errors.New("attempt to pin a scoped message")
+		}
+
+		pinned = append(slices.Clone(t.pinned), pin.SeqId)
+		what = "pin"
+	}
+
+	if err := store.Topics.Update(t.name, map[string]any{"Pinned": pinned, "UpdatedAt": now}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	t.pinned = pinned
+	t.updated = now
+
+	// Inform topic subscribers, except the session which made the change.
+	params := &presParams{seqID: pin.SeqId, actor: asUid.UserId()}
+	t.presSubsOnline(what, params.actor, params, &presFilters{filterIn: types.ModeRead}, sess.sid)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// unpinDeleted removes hard-deleted messages from the list of pinned messages.
+func (t *Topic) unpinDeleted(ranges []types.Range) {
+	if len(t.pinned) == 0 {
+		return
+	}
+
+	pinned := slices.DeleteFunc(slices.Clone(t.pinned), func(seqId int) bool {
+		for _, r := range ranges {
+			if seqId == r.Low || (seqId > r.Low && seqId < r.Hi) {
+				return true
+			}
+		}
+		return false
+	})
+	if len(pinned) == len(t.pinned) {
+		return
+	}
+
+	if err := store.Topics.Update(t.name, map[string]any{"Pinned": pinned}); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to unpin deleted messages: %v", t.name, err)
+		return
+	}
+	t.pinned = pinned
+}
@@ -213,6 +213,10 @@ type pluginConfig struct {
 	FailureMessage string `json:"failure_text"`
 	// Address of plugin server of the form "tcp://localhost:123" or "unix://path_to_socket_file"
 	ServiceAddr string `json:"service_addr"`
+	// Slash commands handled by the plugin as a bot.
+	Commands []botCommandConfig `json:"commands"`
+	// Names of button callbacks handled by the plugin as a bot.
+	Callbacks []string `json:"callbacks"`
 }
 
 // Plugin defines client-side parameters of a gRPC plugin.
@@ -230,6 +234,9 @@ type Plugin struct {
 	failureText        string
 	network            string
 	addr               string
+	// Slash commands and button callbacks of the bot.
+	commands  []botCommand
+	callbacks map[string]bool
 
 	conn   *grpc.ClientConn
 	client pbx.PluginClient
@@ -247,6 +254,8 @@ func pluginsInit(configString json.RawMessage) {
 	}
 
 	nameIndex := make(map[string]bool)
+	// Names of commands and callbacks of all bots.
+	botIndex := make(map[string]bool)
 	globals.plugins = make([]Plugin, len(config))
 	count := 0
 	for i := range config {
@@ -289,6 +298,11 @@ func pluginsInit(configString json.RawMessage) {
 
 		globals.plugins[count].filterFind = conf.Filters.Find
 
+		if globals.plugins[count].commands, globals.plugins[count].callbacks, err =
+			botParseConfig(conf, botIndex); err != nil {
+			logs.Err.Fatal("plugins: bad bot commands", err)
+		}
+
 		if parts := strings.SplitN(conf.ServiceAddr, "://", 2); len(parts) < 2 {
 			logs.Err.Fatal("plugins: invalid server address format", conf.ServiceAddr)
 		} else {
@@ -474,6 +488,8 @@ func pluginFind(user types.Uid, query string) (string, []types.Subscription, err
 }
 
 func pluginAccount(user *types.User, action int) {
+	exportAccount(user, action)
+
 	if globals.plugins == nil {
 		return
 	}
@@ -549,6 +565,8 @@ func pluginTopic(topic *Topic, action int) {
 }
 
 func pluginSubscription(sub *types.Subscription, action int) {
+	exportSubscription(sub, action)
+
 	if globals.plugins == nil {
 		return
 	}
@@ -631,36 +649,6 @@ func pluginMessage(data *MsgServerData, action int) {
 
 // Returns false to skip, true to process
 func pluginDoFiltering(filter *PluginFilter, msg *ClientComMessage) bool {
-	filterByTopic := func(topic string, flt int) bool {
-		if topic == "" || flt == plgTopicCatMask {
-			return true
-		}
-
-		tt := topic
-		if len(tt) > 3 {
-			tt = topic[:3]
-		}
-		switch tt {
-		case "me":
-			return flt&plgTopicMe != 0
-		case "fnd":
-			return flt&plgTopicFnd != 0
-		case "usr":
-			return flt&plgTopicP2P != 0
-		case "grp":
-			return flt&plgTopicGrp != 0
-		case "sys":
-			return flt&plgTopicSys != 0
-		case "slf":
-			return flt&plgTopicSlf != 0
-		case "new":
-			return flt&plgTopicNew != 0
-		case "nch":
-			return flt&plgTopicNch != 0
-		}
-		return false
-	}
-
 	// Check if plugin has any filters for this call
 	if filter == nil || filter.byPacket == 0 {
 		return false
@@ -680,25 +668,57 @@ func pluginDoFiltering(filter *PluginFilter, msg *ClientComMessage) bool {
 		return filter.byPacket&plgLogin != 0
 	}
 	if msg.Sub != nil {
-		return filter.byPacket&plgSub != 0 && filterByTopic(msg.Sub.Topic, filter.byTopicType)
+		return filter.byPacket&plgSub != 0 && pluginFilterByTopic(msg.Sub.Topic, filter.byTopicType)
 	}
 	if msg.Leave != nil {
-		return filter.byPacket&plgLeave != 0 && filterByTopic(msg.Leave.Topic, filter.byTopicType)
+		return filter.byPacket&plgLeave != 0 && pluginFilterByTopic(msg.Leave.Topic, filter.byTopicType)
 	}
 	if msg.Pub != nil {
-		return filter.byPacket&plgPub != 0 && filterByTopic(msg.Pub.Topic, filter.byTopicType)
+		return filter.byPacket&plgPub != 0 && pluginFilterByTopic(msg.Pub.Topic, filter.byTopicType)
 	}
 	if msg.Get != nil {
-		return filter.byPacket&plgGet != 0 && filterByTopic(msg.Get.Topic, filter.byTopicType)
+		return filter.byPacket&plgGet != 0 && pluginFilterByTopic(msg.Get.Topic, filter.byTopicType)
 	}
 	if msg.Set != nil {
-		return filter.byPacket&plgSet != 0 && filterByTopic(msg.Set.Topic, filter.byTopicType)
+		return filter.byPacket&plgSet != 0 && pluginFilterByTopic(msg.Set.Topic, filter.byTopicType)
 	}
 	if msg.Del != nil {
-		return filter.byPacket&plgDel != 0 && filterByTopic(msg.Del.Topic, filter.byTopicType)
+		return filter.byPacket&plgDel != 0 && pluginFilterByTopic(msg.Del.Topic, filter.byTopicType)
 	}
 	if msg.Note != nil {
-		return filter.byPacket&plgNote != 0 && filterByTopic(msg.Note.Topic, filter.byTopicType)
+		return filter.byPacket&plgNote != 0 && pluginFilterByTopic(msg.Note.Topic, filter.byTopicType)
+	}
+	return false
+}
+
+// pluginFilterByTopic checks if the topic passes the filter by topic type.
+func pluginFilterByTopic(topic string, flt int) bool {
+	if topic == "" || flt == plgTopicCatMask {
+		return true
+	}
+
+	tt := topic
+	if len(tt) > 3 {
+		tt = topic[:3]
+	}
+	switch tt {
+	case "me":
+		return flt&plgTopicMe != 0
+	case "fnd":
+		return flt&plgTopicFnd != 0
+	case "usr":
+		return flt&plgTopicP2P != 0
+	case "grp":
+		return flt&plgTopicGrp != 0
+	case "sys":
+		return flt&plgTopicSys != 0
+	case "slf":
+		return flt&plgTopicSlf != 0
+	case "new", "ncm":
+		// A new community is a new group topic.
+		return flt&plgTopicNew != 0
+	case "nch":
+		return flt&plgTopicNch != 0
 	}
 	return false
 }
@@ -0,0 +1,203 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Polls. A {pub} with head.poll={options:["A","B"], multi:false} creates a
+ *    poll attached to the message. Votes are cast with {vote seq=123
+ *    options=[0]} and counted by the store, so tallies are consistent. The
+ *    creator closes the poll with {vote seq=123 what="close"}. Changes of the
+ *    tally are fanned out to topic subscribers as {info what="poll"}. Tallies
+ *    are attached to {data} messages sent in response to {get what="data"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Header of a message which describes the poll.
+const msgHeadPoll = "poll"
+
+// Maximum length of a poll option in bytes.
+const maxPollOptionLength = 256
+
+var errPollCategory = errors.New("polls are not supported in the topic")
+
+// normalizeMsgPoll validates the poll in the header of a message being published. Only the options and
+// the multiple choice flag are retained.
+func (t *Topic) normalizeMsgPoll(head map[string]any) error {
+	if head == nil || head[msgHeadPoll] == nil {
+		return nil
+	}
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		return errPollCategory
+	}
+
+	poll, ok := head[msgHeadPoll].(map[string]any)
+	if !ok {
+		return types.ErrMalformed
+	}
+
+	var options []string
+	switch opts := poll["options"].(type) {
+	case []string:
+		options = opts
+	case []any:
+		for _, val := range opts {
+			opt, ok := val.(string)
+			if !ok {
+				return types.ErrMalformed
+			}
+			options = append(options, opt)
+		}
+	default:
+		return types.ErrMalformed
+	}
+	if len(options) < 2 || len(options) > store.MaxPollOptions {
+		return types.ErrMalformed
+	}
+	for _, opt := range options {
+		if opt == "" || len(opt) > maxPollOptionLength {
+			return types.ErrMalformed
+		}
+	}
+
+	normalized := map[string]any{"options": options}
+	if multi, _ := poll["multi"].(bool); multi {
+		normalized["multi"] = true
+	}
+	head[msgHeadPoll] = normalized
+	return nil
+}
+
+// createPoll creates a poll described by the header of the just saved message.
+func (t *Topic) createPoll(asUid types.Uid, seqId int, head map[string]any) {
+	poll, ok := head[msgHeadPoll].(map[string]any)
+	if !ok {
+		return
+	}
+
+	options, _ := poll["options"].([]string)
+	multi, _ := poll["multi"].(bool)
+	if err := store.Polls.Create(t.name, &types.Poll{
+		SeqId:   seqId,
+		From:    asUid.String(),
+		Options: len(options),
+		Multi:   multi,
+	}); err != nil {
+		// The message is already sent. It remains in the topic but cannot be voted on.
+		logs.Warn.Printf("topic[%s]: failed to create poll %d: %v", t.name, seqId, err)
+	}
+}
+
+// handleVoteBroadcast processes {vote} requests: casts user's vote or closes the poll and informs
+// topic subscribers about the new tally.
+func (t *Topic) handleVoteBroadcast(msg *ClientComMessage) {
+	asUid := types.ParseUserId(msg.AsUser)
+	now := types.TimeNow()
+	if t.isInactive() {
+		// Ignore request - topic is paused or being deleted.
+		msg.sess.queueOut(ErrLockedReply(msg, now))
+		return
+	}
+
+	if _, err := t.verifyChannelAccess(msg.Original); err != nil {
+		msg.sess.queueOut(ErrNotFoundReply(msg, now))
+		return
+	}
+
+	pud := t.perUser[asUid]
+	if mode := pud.modeGiven & pud.modeWant; pud.deleted || !mode.IsReader() {
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	seqId := msg.Vote.SeqId
+	scope, err := t.reactionScope(asUid, seqId)
+	if err == errReactionScope {
+		// Don't disclose the existence of the message.
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	var poll *types.Poll
+	event := msg.Vote.What
+	if event == "close" {
+		poll, err = store.Polls.Get(t.name, seqId, asUid)
+		if err == nil && poll == nil {
+			err = types.ErrNotFound
+		} else if err == nil && poll.From != asUid.String() {
+			// Only the creator can close the poll.
+			err = types.ErrPermissionDenied
+		}
+		if err == nil {
+			var closed bool
+			if poll, closed, err = store.Polls.Close(t.name, seqId, asUid); err == nil && !closed {
+				msg.sess.queueOut(InfoNotModifiedReply(msg, now))
+				return
+			}
+		}
+	} else {
+		event = "vote"
+		poll, err = store.Polls.Vote(t.name, seqId, asUid, msg.Vote.Options)
+	}
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to update poll: %v", t.name, err)
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	msg.sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"tally": poll.Tally}))
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: msg.Original,
+			From:  msg.AsUser,
+			What:  "poll",
+			SeqId: seqId,
+			Event: event,
+			Tally: poll.Tally,
+		},
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		SkipSid:   msg.sess.sid,
+		Scope:     scope,
+		sess:      msg.sess,
+	})
+}
+
+// pollsForDelivery returns polls attached to the messages keyed by message ID.
+// Errors are logged and not reported: messages are delivered without tallies.
+func pollsForDelivery(topic string, asUid types.Uid, messages []types.Message) map[int]*MsgPoll {
+	var seqIds []int
+	for i := range messages {
+		if messages[i].DeletedAt == nil && messages[i].Head[msgHeadPoll] != nil {
+			seqIds = append(seqIds, messages[i].SeqId)
+		}
+	}
+	if len(seqIds) == 0 {
+		return nil
+	}
+
+	polls, err := store.Polls.GetAll(topic, asUid, seqIds)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load polls: %v", topic, err)
+		return nil
+	}
+
+	result := make(map[int]*MsgPoll, len(polls))
+	for _, p := range polls {
+		result[p.SeqId] = &MsgPoll{Tally: p.Tally, Mine: p.Mine, Closed: p.ClosedAt != nil}
+	}
+	return result
+}
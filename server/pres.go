@@ -22,6 +22,12 @@ type presParams struct {
 	target string
 	dWant  string
 	dGiven string
+
+	// Counts of unread messages and mentions of the user.
+	unread   int
+	mentions int
+	// Users mentioned in the new message.
+	mentioned map[types.Uid]string
 }
 
 type presFilters struct {
@@ -140,7 +146,21 @@ func (t *Topic) procPresReq(fromUserID, what string, wantReply bool) string {
 		return what
 	}
 
+	if t.cat == types.TopicCatMe && online != nil && *online &&
+		t.blockedBetween(types.ParseUserId(t.name), types.ParseUserId(fromUserID)) {
+		// Users who blocked one another always see each other offline and don't exchange statuses.
+		*online = false
+		what = "off"
+		reqReply = false
+		wantReply = false
+	}
+
 	if t.cat == types.TopicCatMe {
+		if !t.presence().shares(fromUserID) {
+			// The user appears offline to the contact.
+			replyAs = "off"
+		}
+
 		// Find if the contact is listed.
 		if psd, ok := t.perSubs[fromUserID]; ok {
 			if cmd == "rem" {
@@ -256,6 +276,9 @@ func (t *Topic) presUsersOfInterest(what, ua string) {
 	wantReply := parts[0] == "on"
 	goOffline := len(parts) > 1 && parts[1] == "dis"
 
+	t.firehosePres(parts[0], ua)
+
+	pp := t.presence()
 	// Push update to subscriptions
 	for topic, psd := range t.perSubs {
 		notifyOn := notifyOnOrSkip(topic, what, psd.online)
@@ -263,10 +286,18 @@ func (t *Topic) presUsersOfInterest(what, ua string) {
 			continue
 		}
 
+		status := what
+		if !pp.shares(topic) {
+			// The user appears offline to the contact or in the topic.
+			if status = presenceWhenHidden(what); status == "" {
+				continue
+			}
+		}
+
 		globals.hub.routeSrv <- &ServerComMessage{
 			Pres: &MsgServerPres{
 				Topic:     notifyOn,
-				What:      what,
+				What:      status,
 				Src:       t.name,
 				UserAgent: ua,
 				WantReply: wantReply,
@@ -441,6 +472,11 @@ func (t *Topic) presSubsOffline(what string, params *presParams,
 			continue
 		}
 
+		if pud.isChan && t.broadcast {
+			// Readers of broadcast channels are not notified individually.
+			continue
+		}
+
 		user := uid.UserId()
 		actor := params.actor
 		target := params.target
@@ -452,6 +488,14 @@ func (t *Topic) presSubsOffline(what string, params *presParams,
 			target = ""
 		}
 
+		var unread int
+		var mention bool
+		if what == "msg" && !pud.isChan {
+			// Unread counts are not tracked for channel readers.
+			unread = params.seqID - pud.readID
+			_, mention = params.mentioned[uid]
+		}
+
 		globals.hub.routeSrv <- &ServerComMessage{
 			Pres: &MsgServerPres{
 				Topic:       "me",
@@ -462,6 +506,8 @@ func (t *Topic) presSubsOffline(what string, params *presParams,
 				AcsTarget:   target,
 				SeqId:       params.seqID,
 				DelId:       params.delID,
+				Unread:      unread,
+				Mention:     mention,
 				FilterIn:    int(filterTarget.filterIn),
 				FilterOut:   int(filterTarget.filterOut),
 				SingleUser:  filterTarget.singleUser,
@@ -618,6 +664,8 @@ func (t *Topic) presSingleUserOffline(uid types.Uid, mode types.AccessMode,
 				AcsActor:  actor,
 				AcsTarget: target,
 				UserAgent: params.userAgent,
+				Unread:    params.unread,
+				Mentions:  params.mentions,
 				WantReply: strings.HasPrefix(what, "?unkn"),
 				SkipTopic: skipTopic,
 			},
@@ -660,7 +708,7 @@ func presSingleUserOfflineOffline(uid types.Uid, original, what string, params *
 // Let other sessions of a given user know what messages are now received/read.
 // If both 'read' and 'recv' != 0 then 'read' takes precedence over 'recv'.
 // Cases U
-func (t *Topic) presPubMessageCount(uid types.Uid, mode types.AccessMode, read, recv int, skip string) {
+func (t *Topic) presPubMessageCount(uid types.Uid, mode types.AccessMode, read, recv int, asChan bool, skip string) {
 	var what string
 	var seq int
 	if read > 0 {
@@ -672,10 +720,22 @@ func (t *Topic) presPubMessageCount(uid types.Uid, mode types.AccessMode, read,
 	}
 
 	if what != "" {
+		params := &presParams{seqID: seq}
+		if read > 0 && !asChan {
+			// Report the remaining unread messages and mentions. Not tracked for channel readers.
+			params.unread = t.lastID - read
+			if params.unread > 0 {
+				var err error
+				if params.mentions, err = store.Mentions.Count(uid, t.name, read); err != nil {
+					logs.Warn.Printf("topic[%s]: failed to count mentions: %v", t.name, err)
+				}
+			}
+		}
+
 		// Announce to user's other sessions on 'me' only if they are not attached to this topic.
 		// Attached topics will receive an {info}
 
-		t.presSingleUserOffline(uid, mode, what, &presParams{seqID: seq}, skip, true)
+		t.presSingleUserOffline(uid, mode, what, params, skip, true)
 	}
 }
 
@@ -0,0 +1,453 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Presence privacy. Users decide who sees them online and when they were
+ *    online last time:
+ *
+ *    - {set topic="me" presence={invisible, seen}} makes the user appear
+ *      offline to everyone and restricts who sees the time when the user was
+ *      last online: "everyone", "contacts" (users whose presence the user
+ *      follows in their p2p topic) or "nobody". Last seen time of invisible
+ *      users is hidden from everyone. Missing fields are not changed.
+ *    - {set topic="grpXXX" presence={share}} overrides the settings in one
+ *      p2p or group topic: "show" shares presence even if the user is
+ *      invisible, "hide" makes the user appear offline, "" follows the
+ *      user's settings.
+ *    - {get what="presence"} returns the current settings of the user in 'me'
+ *      or the override in other topics.
+ *
+ *    Settings are enforced where presence notifications are sent rather than
+ *    by clients: 'me' reports the user to contacts as offline and does not
+ *    report changes of user agent, group topics do not report the user
+ *    joining and leaving. Settings cached by 'me' are dropped when they
+ *    change on this node and expire after presenceTTL to pick up changes
+ *    made on other cluster nodes. Group topics check the settings when the
+ *    user comes online in the topic.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Presence settings cached by 'me' are reloaded after this time.
+const presenceTTL = time.Minute
+
+// Visibility of last seen time for everyone, stored as blank.
+const presenceSeenEveryone = "everyone"
+
+// Version of presence settings on this node, incremented on every change.
+var presenceVersion atomic.Int64
+
+// presencePrefs is a cache of presence settings of the owner of 'me'.
+type presencePrefs struct {
+	// User's settings, nil if the user has not changed the defaults.
+	settings *types.PresenceSettings
+	// Overrides of sharing presence indexed like perSubs: by the other user's ID for p2p topics.
+	share map[string]string
+	// Value of presenceVersion when the settings were loaded.
+	version  int64
+	loadedAt time.Time
+}
+
+// shares checks if the user shares presence with the contact or topic from perSubs. Safe to call on nil.
+func (pp *presencePrefs) shares(topic string) bool {
+	if pp == nil {
+		return true
+	}
+	return pp.settings.Shares(pp.share[topic])
+}
+
+// presence returns presence settings of the owner of 'me', loading them if needed.
+func (t *Topic) presence() *presencePrefs {
+	version := presenceVersion.Load()
+	pp := t.presPrefs
+	if pp != nil && pp.version == version && time.Since(pp.loadedAt) < presenceTTL {
+		return pp
+	}
+
+	uid := types.ParseUserId(t.name)
+	settings, err := store.PresenceSettings.Get(uid)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load presence settings: %v", t.name, err)
+		return pp
+	}
+	overrides, err := store.PresenceSettings.GetForUser(uid)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load presence settings: %v", t.name, err)
+		return pp
+	}
+
+	share := make(map[string]string, len(overrides))
+	for topic, tps := range overrides {
+		if uid1, uid2, err := types.ParseP2P(topic); err == nil {
+			if uid1 == uid {
+				topic = uid2.UserId()
+			} else {
+				topic = uid1.UserId()
+			}
+		}
+		share[topic] = tps.Share
+	}
+	t.presPrefs = &presencePrefs{
+		settings: settings[uid],
+		share:    share,
+		version:  version,
+		loadedAt: time.Now(),
+	}
+	return t.presPrefs
+}
+
+// presenceWhenHidden converts a presence update of the user to what is sent to contacts the user is hidden
+// from: "on" becomes "?unkn" to learn statuses of contacts without disclosing own status, changes of user
+// agent are not sent at all.
+func presenceWhenHidden(what string) string {
+	parts := strings.SplitN(what, "+", 2)
+	switch parts[0] {
+	case "on":
+		parts[0] = "?unkn"
+		return strings.Join(parts, "+")
+	case "ua":
+		return ""
+	}
+	return what
+}
+
+// presAnnounceChanged reports the user's status to contacts after a change of presence settings: "off" to
+// contacts the user is hidden from now, "on" to those the user is visible to now.
+func (t *Topic) presAnnounceChanged(before *presencePrefs) {
+	after := t.presence()
+	for topic := range t.perSubs {
+		if types.ParseUserId(topic).IsZero() {
+			// Group topics check the settings when the user comes online in the topic.
+			continue
+		}
+		shares := after.shares(topic)
+		if shares == before.shares(topic) {
+			continue
+		}
+		what := "off"
+		if shares {
+			what = "on"
+		}
+		globals.hub.routeSrv <- &ServerComMessage{
+			Pres: &MsgServerPres{
+				Topic:     "me",
+				What:      what,
+				Src:       t.name,
+				UserAgent: t.userAgent,
+			},
+			RcptTo: topic,
+		}
+	}
+}
+
+// topicPresence returns subscribers' overrides of sharing presence in the topic, loading them if needed.
+func (t *Topic) topicPresence() (map[types.Uid]*types.TopicPresenceSettings, error) {
+	if t.presShare == nil {
+		overrides, err := store.PresenceSettings.GetForTopic(t.name)
+		if err != nil {
+			return nil, err
+		}
+		if overrides == nil {
+			overrides = make(map[types.Uid]*types.TopicPresenceSettings)
+		}
+		t.presShare = overrides
+	}
+	return t.presShare, nil
+}
+
+// hidesPresence checks if the user appears offline in the topic.
+func (t *Topic) hidesPresence(uid types.Uid) bool {
+	settings, err := store.PresenceSettings.Get(uid)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load presence settings: %v", t.name, err)
+		return false
+	}
+	var share string
+	if overrides, err := t.topicPresence(); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load presence settings: %v", t.name, err)
+	} else if tps := overrides[uid]; tps != nil {
+		share = tps.Share
+	}
+	return !settings[uid].Shares(share)
+}
+
+// lastSeenVisible checks if the user with the given presence settings discloses the time when they were
+// last online to the viewer. The viewer is a contact if the user follows viewer's presence: it's checked
+// only if needed.
+func lastSeenVisible(ps *types.PresenceSettings, isContact func() bool) bool {
+	if ps == nil {
+		return true
+	}
+	switch {
+	case ps.Invisible || ps.LastSeen == types.PresenceSeenNobody:
+		return false
+	case ps.LastSeen == types.PresenceSeenContacts:
+		return isContact()
+	}
+	return true
+}
+
+// p2pLastSeenVisible checks if the other user of the p2p topic discloses the time when they were last
+// online to the user.
+func (t *Topic) p2pLastSeenVisible(asUid types.Uid) bool {
+	peer := t.p2pOtherUser(asUid)
+	settings, err := store.PresenceSettings.Get(peer)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load presence settings: %v", t.name, err)
+		return true
+	}
+	return lastSeenVisible(settings[peer], func() bool {
+		pud := t.perUser[peer]
+		return !pud.deleted && (pud.modeGiven & pud.modeWant).IsPresencer()
+	})
+}
+
+// peersPresence loads presence settings of the other users of p2p subscriptions.
+func peersPresence(subs []types.Subscription) map[types.Uid]*types.PresenceSettings {
+	var peers []types.Uid
+	for i := range subs {
+		if with := subs[i].GetWith(); with != "" {
+			peers = append(peers, types.ParseUserId(with))
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	settings, err := store.PresenceSettings.Get(peers...)
+	if err != nil {
+		logs.Warn.Println("failed to load presence settings:", err)
+	}
+	return settings
+}
+
+// peerLastSeenVisible checks if the other user of the p2p subscription discloses the time when they were
+// last online.
+func peerLastSeenVisible(settings map[types.Uid]*types.PresenceSettings, sub *types.Subscription) bool {
+	peer := types.ParseUserId(sub.GetWith())
+	return lastSeenVisible(settings[peer], func() bool {
+		psub, err := store.Subs.Get(sub.Topic, peer, false)
+		if err != nil || psub == nil {
+			return false
+		}
+		return (psub.ModeGiven & psub.ModeWant).IsPresencer()
+	})
+}
+
+// replySetPresence updates user's presence settings in 'me' or the override of sharing presence in
+// other topics.
+func (t *Topic) replySetPresence(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	switch t.cat {
+	case types.TopicCatMe:
+		return t.replySetUserPresence(sess, asUid, msg)
+	case types.TopicCatP2P, types.TopicCatGrp:
+		return t.replySetTopicPresence(sess, asUid, msg)
+	}
+
+	sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+	return errors.New("invalid topic category for presence settings")
+}
+
+// replySetUserPresence updates user's presence settings and reports the new status to contacts.
+func (t *Topic) replySetUserPresence(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	req := msg.Set.Presence
+	if req.Share != nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.presence: topic settings in 'me'")
+	}
+
+	var seen string
+	if req.Seen != nil {
+		switch *req.Seen {
+		case presenceSeenEveryone:
+		case types.PresenceSeenContacts, types.PresenceSeenNobody:
+			seen = *req.Seen
+		default:
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("set.presence: invalid visibility of last seen time")
+		}
+	}
+
+	settings, err := store.PresenceSettings.Get(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	before := t.presence()
+	ps := &types.PresenceSettings{User: asUid.String()}
+	if old := settings[asUid]; old != nil {
+		*ps = *old
+	}
+	if req.Invisible != nil {
+		ps.Invisible = *req.Invisible
+	}
+	if req.Seen != nil {
+		ps.LastSeen = seen
+	}
+	if err := store.PresenceSettings.Update(ps); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	presenceVersion.Add(1)
+	t.presAnnounceChanged(before)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replySetTopicPresence updates user's override of sharing presence in the topic and reports the new
+// status to other users of the topic.
+func (t *Topic) replySetTopicPresence(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	req := msg.Set.Presence
+	if req.Invisible != nil || req.Seen != nil || req.Share == nil {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.presence: user settings outside of 'me'")
+	}
+	switch *req.Share {
+	case "", types.PresenceShareShow, types.PresenceShareHide:
+	default:
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.presence: invalid share")
+	}
+
+	pud := t.perUser[asUid]
+	if !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("presence settings update by non-reader")
+	}
+
+	overrides, err := t.topicPresence()
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	var before string
+	if old := overrides[asUid]; old != nil {
+		before = old.Share
+	}
+	tps := &types.TopicPresenceSettings{Topic: t.name, User: asUid.String(), Share: *req.Share}
+	if err := store.PresenceSettings.UpdateForTopic(tps); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	overrides[asUid] = tps
+	presenceVersion.Add(1)
+
+	if before != tps.Share {
+		switch t.cat {
+		case types.TopicCatP2P:
+			settings, err := store.PresenceSettings.Get(asUid)
+			if err != nil {
+				logs.Warn.Printf("topic[%s]: failed to load presence settings: %v", t.name, err)
+				break
+			}
+			if shares := settings[asUid].Shares(tps.Share); shares != settings[asUid].Shares(before) {
+				// Report the user to the other user on 'me' like the user's 'me' does.
+				what := "off"
+				if shares {
+					what = "on"
+				}
+				globals.hub.routeSrv <- &ServerComMessage{
+					Pres: &MsgServerPres{
+						Topic: "me",
+						What:  what,
+						Src:   asUid.UserId(),
+					},
+					RcptTo: t.p2pOtherUser(asUid).UserId(),
+				}
+			}
+		case types.TopicCatGrp:
+			if pud.online == 0 {
+				break
+			}
+			if hidden := t.hidesPresence(asUid); hidden != pud.presHidden {
+				pud.presHidden = hidden
+				t.perUser[asUid] = pud
+				what := "on"
+				if hidden {
+					what = "off"
+				}
+				t.presSubsOnline(what, asUid.UserId(), nilPresParams, &presFilters{filterIn: types.ModeRead}, sess.sid)
+			}
+		}
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetPresence returns user's presence settings in 'me' or the override of sharing presence in
+// other topics.
+func (t *Topic) replyGetPresence(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	var result *MsgPresenceSettings
+	switch t.cat {
+	case types.TopicCatMe:
+		settings, err := store.PresenceSettings.Get(asUid)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+
+		var invisible bool
+		seen := presenceSeenEveryone
+		if ps := settings[asUid]; ps != nil {
+			invisible = ps.Invisible
+			if ps.LastSeen != "" {
+				seen = ps.LastSeen
+			}
+		}
+		result = &MsgPresenceSettings{Invisible: &invisible, Seen: &seen}
+
+	case types.TopicCatP2P, types.TopicCatGrp:
+		if userData := t.perUser[asUid]; !(userData.modeGiven & userData.modeWant).IsReader() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to get presence settings by non-reader")
+		}
+
+		overrides, err := t.topicPresence()
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+
+		var share string
+		if tps := overrides[asUid]; tps != nil {
+			share = tps.Share
+		}
+		result = &MsgPresenceSettings{Share: &share}
+
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting presence settings")
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Presence:  result,
+		},
+	})
+	return nil
+}
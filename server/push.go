@@ -24,7 +24,9 @@ func (t *Topic) channelSubUnsub(uid types.Uid, sub bool) {
 }
 
 // Prepares a payload to be delivered to a mobile device as a push notification in response to a {data} message.
-func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsReadBySender bool) *push.Receipt {
+// The mentioned users are notified even if they muted the topic.
+func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsReadBySender bool,
+	mentioned map[types.Uid]string) *push.Receipt {
 	// Passing `Topic` as `t.name` for group topics and P2P topics. The p2p topic name is later rewritten for
 	// each recipient then the payload is created: p2p recipient sees the topic as the ID of the other user.
 
@@ -51,16 +53,31 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsR
 	if replace, found := data.Head["replace"].(string); found {
 		receipt.Payload.Replace = replace
 	}
+	if data.Head[types.MsgHeadE2EE] == true {
+		// Encrypted content is useless for previews.
+		receipt.Payload.Content = nil
+	}
 
 	if t.isChan {
 		// Channel readers should get a push on a channel name (as an FCM topic push).
 		receipt.Channel = types.GrpToChn(t.name)
 	}
 
+	scope := msgScope(data.Head)
+	muted := t.threadMutedBy(data.Head)
+	pushMuted := t.pushMutedBy(mentioned)
+	var blocks *blockList
+	if t.cat == types.TopicCatGrp {
+		blocks = t.blocksFor(fromUid)
+	}
 	for uid, pud := range t.perUser {
+		if !t.userInMsgScope(scope, uid) || blocks.between(uid, fromUid) {
+			continue
+		}
+
 		online := pud.online
-		if uid == fromUid && online == 0 {
-			// Make sure the sender's devices receive a silent push.
+		if (uid == fromUid || muted[uid]) && online == 0 {
+			// Make sure the sender's devices and those who muted the thread receive a silent push.
 			online = 1
 		}
 
@@ -74,6 +91,16 @@ func (t *Topic) pushForData(fromUid types.Uid, data *MsgServerData, msgMarkedAsR
 				// Unread counts are incremented for all recipients,
 				// and for sender only if the message wasnt't marked 'read' by the sender
 				ShouldIncrementUnreadCountInCache: uid != fromUid || !msgMarkedAsReadBySender,
+				// The user muted notifications from the topic.
+				Muted: pushMuted[uid],
+				// The 'me' topic is loaded while the user has sessions attached to it.
+				Online: globals.hub.topicGet(uid.UserId()) != nil,
+			}
+			if _, found := mentioned[uid]; found {
+				rcpt := receipt.To[uid]
+				// The message mentions the user.
+				rcpt.Mentioned = true
+				receipt.To[uid] = rcpt
 			}
 		}
 	}
@@ -129,11 +156,12 @@ func (t *Topic) pushForGroupSub(fromUid types.Uid, now time.Time) *push.Receipt
 		return nil
 	}
 
+	pushMuted := t.pushMutedBy(nil)
 	for uid, pud := range t.perUser {
 		// Send only to those who have notifications enabled.
 		mode := pud.modeWant & pud.modeGiven
 		if mode.IsPresencer() && mode.IsReader() && !pud.deleted && !pud.isChan {
-			receipt.To[uid] = push.Recipient{}
+			receipt.To[uid] = push.Recipient{Muted: pushMuted[uid]}
 		}
 	}
 	if len(receipt.To) > 0 || receipt.Channel != "" {
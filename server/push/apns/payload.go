@@ -0,0 +1,188 @@
+package apns
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/push/fcm"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// TTL of a regular push notification in seconds.
+	defaultTimeToLive = 3600
+	// TTL of a notification of an incoming call in seconds.
+	callTimeToLive = 10
+	// Maximum length of apns-collapse-id.
+	maxCollapseIDLength = 64
+)
+
+// notification is a single request to APNs.
+type notification struct {
+	uid t.Uid
+	// Device ID as reported by the client.
+	deviceID string
+	// APNs device token.
+	token   string
+	bundle  *bundleConfig
+	headers map[string]string
+	payload []byte
+}
+
+// prepareNotifications creates notifications for devices with APNs tokens of the receipt's recipients.
+func prepareNotifications(rcpt *push.Receipt, config *configType) []*notification {
+	if len(rcpt.To) == 0 {
+		// Channel pushes are not supported by APNs.
+		return nil
+	}
+
+	data, err := fcm.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("apns push: could not parse payload:", err)
+		return nil
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("apns push: db error", err)
+		return nil
+	}
+	if count == 0 {
+		return nil
+	}
+
+	var notifications []*notification
+	for uid, devList := range devices {
+		topic, userData := common.DataForUser(data, rcpt.Payload.Topic, uid, rcpt.To[uid])
+
+		for i := range devList {
+			d := &devList[i]
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+			bundleID, token, ok := parseToken(d.DeviceId)
+			if !ok {
+				continue
+			}
+			bundle := findBundle(config.Bundles, bundleID)
+			if bundle == nil {
+				logs.Warn.Println("apns: unknown bundle", bundleID)
+				continue
+			}
+			headers, payload, err := apnsNotification(rcpt.Payload.What, topic, userData, rcpt.To[uid].Unread, bundle)
+			if err != nil {
+				logs.Warn.Println("apns: failed to create payload", err)
+				continue
+			}
+			notifications = append(notifications, &notification{
+				uid:      uid,
+				deviceID: d.DeviceId,
+				token:    token,
+				bundle:   bundle,
+				headers:  headers,
+				payload:  payload,
+			})
+		}
+	}
+	return notifications
+}
+
+// findBundle returns the config of the bundle with the given ID, or the first one if the ID is empty.
+func findBundle(bundles []bundleConfig, bundleID string) *bundleConfig {
+	if bundleID == "" {
+		return &bundles[0]
+	}
+	for i := range bundles {
+		if bundles[i].BundleID == bundleID {
+			return &bundles[i]
+		}
+	}
+	return nil
+}
+
+// apnsNotification creates headers and payload of the notification. Fields of the push payload
+// are sent as custom keys next to "aps".
+func apnsNotification(what, topic string, data map[string]string, unread int,
+	bundle *bundleConfig) (map[string]string, []byte, error) {
+
+	callStatus := data["webrtc"]
+	ttl := defaultTimeToLive
+	if bundle.TimeToLive > 0 {
+		ttl = bundle.TimeToLive
+	}
+	pushType := common.ApnsPushTypeAlert
+	priority := 10
+	interruptionLevel := common.InterruptionLevelTimeSensitive
+	if callStatus == "started" {
+		interruptionLevel = common.InterruptionLevelCritical
+		ttl = callTimeToLive
+	} else if what == push.ActRead {
+		priority = 5
+		interruptionLevel = common.InterruptionLevelPassive
+		pushType = common.ApnsPushTypeBackground
+	}
+
+	aps := common.Aps{
+		Badge:             unread,
+		ContentAvailable:  1,
+		MutableContent:    1,
+		InterruptionLevel: interruptionLevel,
+		Sound:             "default",
+		ThreadID:          topic,
+	}
+
+	alert := bundle.Alert
+	// Do not present alert for read notifications, video calls other than missed calls and silent pushes.
+	if alert != nil && alert.Enabled && what != push.ActRead &&
+		(callStatus == "" || callStatus == push.CallMissed) && data["silent"] == "" {
+		kind := push.NotificationKind(what, callStatus)
+		aps.Alert = common.NewApsAlert(alert, kind, data)
+		// Category selects actions of the notification registered by the app, e.g. "call back".
+		aps.Category = alert.GetStringField(kind, "Category")
+	}
+	if pushType == common.ApnsPushTypeBackground {
+		// Background notifications must not play sounds or update the badge.
+		aps.Sound = nil
+		aps.Badge = 0
+		aps.MutableContent = 0
+	}
+
+	body := make(map[string]any, len(data)+1)
+	for k, v := range data {
+		body[k] = v
+	}
+	body["aps"] = aps
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Notifications of the same topic replace each other on the device.
+	collapseID := topic
+	if len(collapseID) > maxCollapseIDLength {
+		collapseID = collapseID[:maxCollapseIDLength]
+	}
+
+	headers := map[string]string{
+		common.HeaderApnsExpiration: strconv.FormatInt(time.Now().Add(time.Duration(ttl)*time.Second).Unix(), 10),
+		common.HeaderApnsPriority:   strconv.Itoa(priority),
+		common.HeaderApnsTopic:      bundle.BundleID,
+		common.HeaderApnsCollapseID: collapseID,
+		common.HeaderApnsPushType:   string(pushType),
+	}
+	return headers, payload, nil
+}
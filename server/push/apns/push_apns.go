@@ -0,0 +1,345 @@
+// Package apns implements push notification plugin for Apple Push Notification service.
+// Notifications are sent to iOS clients directly over HTTP/2 using token-based authentication.
+// https://developer.apple.com/documentation/usernotifications/sending-notification-requests-to-apns
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	// Name of the handler.
+	handlerName = "apns"
+
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	productionServer = "https://api.push.apple.com"
+	sandboxServer    = "https://api.sandbox.push.apple.com"
+
+	// Provider tokens must be refreshed at least once an hour but no more often than once every 20 minutes.
+	providerTokenLifetime = 50 * time.Minute
+
+	// Timeout of one request to APNs.
+	requestTimeout = 10 * time.Second
+)
+
+var handler Handler
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	client *http.Client
+	signer *tokenSigner
+}
+
+type bundleConfig struct {
+	// App's bundle ID, used as apns-topic.
+	BundleID string `json:"bundle_id"`
+	// Use production APNs server instead of sandbox.
+	Production bool `json:"production"`
+	// Time in seconds before notification is discarded if undelivered.
+	TimeToLive int `json:"time_to_live,omitempty"`
+	// Payload of alerts, overrides the common one.
+	Alert *common.Config `json:"alert,omitempty"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Signing key in PEM format or the path to the .p8 key file downloaded from Apple developer account.
+	Key     string `json:"key,omitempty"`
+	KeyFile string `json:"key_file,omitempty"`
+	// ID of the signing key.
+	KeyID string `json:"key_id"`
+	// Apple developer team ID.
+	TeamID string `json:"team_id"`
+	// Apps to send notifications to. The first one is used for tokens without a bundle ID.
+	Bundles []bundleConfig `json:"bundles"`
+	// Payload of alerts.
+	Alert *common.Config `json:"alert,omitempty"`
+	// Address of APNs server to use instead of the default one, for debugging.
+	DebugServer string `json:"debug_server,omitempty"`
+}
+
+// tokenSigner creates provider authentication tokens and caches them until they expire.
+type tokenSigner struct {
+	key    *ecdsa.PrivateKey
+	keyID  string
+	teamID string
+
+	lock     sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.Key == "" && config.KeyFile != "" {
+		key, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return false, err
+		}
+		config.Key = string(key)
+	}
+	if config.Key == "" || config.KeyID == "" || config.TeamID == "" {
+		return false, errors.New("apns: missing key, key_id or team_id")
+	}
+	key, err := parsePrivateKey([]byte(config.Key))
+	if err != nil {
+		return false, err
+	}
+
+	if len(config.Bundles) == 0 {
+		return false, errors.New("apns: no bundles configured")
+	}
+	for i := range config.Bundles {
+		if config.Bundles[i].BundleID == "" {
+			return false, errors.New("apns: missing bundle_id")
+		}
+		if config.Bundles[i].Alert == nil {
+			config.Bundles[i].Alert = config.Alert
+		}
+	}
+
+	handler.signer = &tokenSigner{key: key, keyID: config.KeyID, teamID: config.TeamID}
+	handler.client = &http.Client{
+		// Requests are sent over HTTP/2 negotiated by TLS.
+		Transport: &http.Transport{ForceAttemptHTTP2: true},
+		Timeout:   requestTimeout,
+	}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt, &config)
+			case <-handler.channel:
+				// APNs has no topics (channels). Ignore.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// parsePrivateKey parses the ECDSA signing key in PKCS#8 PEM format.
+func parsePrivateKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("apns: invalid key, expected PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("apns: invalid key: " + err.Error())
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns: key is not an ECDSA key")
+	}
+	return key, nil
+}
+
+// get returns a valid provider token, creating a new one if needed.
+func (ts *tokenSigner) get(now time.Time) (string, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	if ts.token != "" && now.Sub(ts.issuedAt) < providerTokenLifetime {
+		return ts.token, nil
+	}
+
+	token, err := common.SignJWTES256(ts.key,
+		map[string]any{"alg": "ES256", "kid": ts.keyID},
+		map[string]any{"iss": ts.teamID, "iat": now.Unix()})
+	if err != nil {
+		return "", err
+	}
+	ts.token = token
+	ts.issuedAt = now
+	return ts.token, nil
+}
+
+// invalidate forces creation of a new provider token.
+func (ts *tokenSigner) invalidate(token string) {
+	ts.lock.Lock()
+	if ts.token == token {
+		ts.token = ""
+	}
+	ts.lock.Unlock()
+}
+
+// apnsResponse is the body of an error response from APNs.
+type apnsResponse struct {
+	Reason string `json:"reason"`
+	// Time when APNs confirmed that the token is no longer valid, milliseconds.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// Error reasons reported by APNs.
+const (
+	reasonBadDeviceToken         = "BadDeviceToken"
+	reasonDeviceTokenNotForTopic = "DeviceTokenNotForTopic"
+	reasonUnregistered           = "Unregistered"
+	reasonExpiredProviderToken   = "ExpiredProviderToken"
+	reasonInvalidProviderToken   = "InvalidProviderToken"
+	reasonTooManyRequests        = "TooManyRequests"
+)
+
+// postNotification sends one notification. Returns HTTP status code and the error reason, if any.
+func postNotification(server string, n *notification) (int, string, error) {
+	auth, err := handler.signer.get(time.Now())
+	if err != nil {
+		return 0, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, server+"/3/device/"+n.token, bytes.NewReader(n.payload))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Authorization", "bearer "+auth)
+	req.Header.Set("Content-Type", "application/json")
+	for name, val := range n.headers {
+		req.Header.Set(name, val)
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, "", nil
+	}
+
+	var body apnsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		logs.Warn.Println("apns failed to decode response:", err)
+	}
+	if body.Reason == reasonExpiredProviderToken || body.Reason == reasonInvalidProviderToken {
+		handler.signer.invalidate(auth)
+	}
+	return resp.StatusCode, body.Reason, nil
+}
+
+func sendPushes(rcpt *push.Receipt, config *configType) {
+	for _, n := range prepareNotifications(rcpt, config) {
+		server := sandboxServer
+		if config.DebugServer != "" {
+			server = config.DebugServer
+		} else if n.bundle.Production {
+			server = productionServer
+		}
+
+		code, reason, err := postNotification(server, n)
+		if err != nil {
+			logs.Warn.Println("apns push request failed:", err)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
+			return
+		}
+		switch {
+		case code == http.StatusOK:
+			push.ReportOutcome(handlerName, push.OutcomeSent)
+		case reason == reasonBadDeviceToken || reason == reasonDeviceTokenNotForTopic ||
+			reason == reasonUnregistered || code == http.StatusGone:
+			// Token is no longer valid. Delete token from DB and continue sending.
+			logs.Info.Println("apns invalid token:", reason, n.uid.UserId())
+			push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
+			if err := store.Devices.Delete(n.uid, n.deviceID); err != nil {
+				logs.Warn.Println("apns failed to delete invalid token:", err)
+			}
+		case code == http.StatusForbidden:
+			// Config errors or expired provider token. Stop.
+			logs.Warn.Println("apns authentication failed:", reason)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
+			return
+		case reason == reasonTooManyRequests || code >= http.StatusInternalServerError:
+			// Transient errors. Stop sending this batch.
+			logs.Warn.Println("apns transient failure:", code, reason)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
+			return
+		default:
+			// Invalid payload or headers. Other notifications may still succeed.
+			logs.Warn.Println("apns push rejected:", code, reason)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
+		}
+	}
+}
+
+// parseToken splits the device token reported by the client into bundle ID and the APNs token.
+// Returns false if the token is not an APNs token.
+func parseToken(deviceID string) (string, string, bool) {
+	if !common.IsApnsToken(deviceID) {
+		return "", "", false
+	}
+	token := strings.TrimPrefix(deviceID, common.ApnsTokenPrefix)
+	bundleID := ""
+	if at := strings.LastIndexByte(token, ':'); at >= 0 {
+		bundleID, token = token[:at], token[at+1:]
+	}
+	if token == "" {
+		return "", "", false
+	}
+	return bundleID, token, true
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to FCM topics. APNs has no topics,
+// the requests are ignored.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register(handlerName, &handler)
+}
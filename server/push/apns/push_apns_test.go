@@ -0,0 +1,198 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+func TestParseToken(t *testing.T) {
+	for deviceID, expected := range map[string][2]string{
+		"apns:abcd":                 {"", "abcd"},
+		"apns:co.tinode.app:abcd":   {"co.tinode.app", "abcd"},
+		"apns:co.tinode.app.voip:0": {"co.tinode.app.voip", "0"},
+	} {
+		bundleID, token, ok := parseToken(deviceID)
+		if !ok || bundleID != expected[0] || token != expected[1] {
+			t.Errorf("%s: expected %v, got '%s' '%s' %t", deviceID, expected, bundleID, token, ok)
+		}
+	}
+	for _, deviceID := range []string{"fcm-token:APA91b", "apns:", "apns:co.tinode.app:"} {
+		if _, _, ok := parseToken(deviceID); ok {
+			t.Errorf("%s: expected not an APNs token", deviceID)
+		}
+	}
+}
+
+func TestProviderToken(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ts := &tokenSigner{key: key, keyID: "KEY123", teamID: "TEAM456"}
+
+	now := time.Now()
+	token, err := ts.get(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatal("malformed token", token)
+	}
+	var header map[string]string
+	claims := map[string]any{}
+	hdr, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	cl, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if json.Unmarshal(hdr, &header) != nil || json.Unmarshal(cl, &claims) != nil ||
+		header["alg"] != "ES256" || header["kid"] != "KEY123" || claims["iss"] != "TEAM456" {
+		t.Errorf("unexpected token content %s %s", hdr, cl)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if len(sig) != 64 || !ecdsa.Verify(&key.PublicKey, hash[:],
+		new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Error("invalid signature")
+	}
+
+	if cached, _ := ts.get(now.Add(time.Minute)); cached != token {
+		t.Error("token is not cached")
+	}
+	ts.invalidate(token)
+	if fresh, _ := ts.get(now.Add(time.Second)); fresh == token {
+		t.Error("token is not refreshed after invalidation")
+	}
+}
+
+func TestSendPushes(t *testing.T) {
+	var lock sync.Mutex
+	requests := map[string]*http.Request{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		lock.Lock()
+		requests[token] = r
+		lock.Unlock()
+		if token == "dead" {
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered","timestamp":1700000000000}`))
+		}
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	handler.signer = &tokenSigner{key: key, keyID: "KEY123", teamID: "TEAM456"}
+	handler.client = srv.Client()
+	defer func() { handler.client, handler.signer = nil, nil }()
+
+	config := &configType{
+		Bundles: []bundleConfig{
+			{BundleID: "co.tinode.app", Alert: &common.Config{Enabled: true, Payload: common.Payload{Body: "$content"}}},
+			{BundleID: "co.tinode.beta"},
+		},
+		DebugServer: srv.URL,
+	}
+
+	uid := types.Uid(1)
+	ctrl := gomock.NewController(t)
+	devices := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = devices
+	defer func() { store.Devices = nil; ctrl.Finish() }()
+	devices.EXPECT().GetAll(uid).Return(map[types.Uid][]types.DeviceDef{uid: {
+		{DeviceId: "apns:live", Platform: "ios"},
+		{DeviceId: "apns:co.tinode.beta:dead", Platform: "ios"},
+		{DeviceId: "fcm-token", Platform: "android"},
+	}}, 3, nil)
+	devices.EXPECT().Delete(uid, "apns:co.tinode.beta:dead").Return(nil)
+
+	sendPushes(&push.Receipt{
+		To: map[types.Uid]push.Recipient{uid: {Unread: 3}},
+		Payload: push.Payload{
+			What:        push.ActMsg,
+			Topic:       "grpTest",
+			From:        types.Uid(2).UserId(),
+			SeqId:       5,
+			ContentType: "text/plain",
+			Content:     "hello",
+		},
+	}, config)
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	r := requests["live"]
+	if r == nil || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Authorization"), "bearer ") ||
+		r.Header.Get(common.HeaderApnsTopic) != "co.tinode.app" ||
+		r.Header.Get(common.HeaderApnsCollapseID) != "grpTest" ||
+		r.Header.Get(common.HeaderApnsPushType) != "alert" {
+		t.Errorf("unexpected request %+v", r)
+	}
+	if r := requests["dead"]; r == nil || r.Header.Get(common.HeaderApnsTopic) != "co.tinode.beta" {
+		t.Errorf("unexpected request %+v", r)
+	}
+}
+
+func TestApnsNotification(t *testing.T) {
+	bundle := &bundleConfig{BundleID: "co.tinode.app",
+		Alert: &common.Config{Enabled: true, Payload: common.Payload{Body: "$content"}}}
+
+	headers, payload, err := apnsNotification(push.ActMsg, "grpTest", map[string]string{"content": "hi", "seq": "5"}, 2, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Aps common.Aps `json:"aps"`
+		Seq string     `json:"seq"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Aps.Alert == nil || body.Aps.Alert.Body != "hi" || body.Aps.Badge != 2 || body.Seq != "5" ||
+		headers[common.HeaderApnsPriority] != "10" {
+		t.Errorf("unexpected notification %s %v", payload, headers)
+	}
+
+	headers, payload, _ = apnsNotification(push.ActRead, "grpTest", map[string]string{"seq": "5"}, 0, bundle)
+	body.Aps = common.Aps{}
+	json.Unmarshal(payload, &body)
+	if body.Aps.Alert != nil || body.Aps.Sound != nil || headers[common.HeaderApnsPriority] != "5" ||
+		headers[common.HeaderApnsPushType] != "background" {
+		t.Errorf("unexpected read notification %s %v", payload, headers)
+	}
+
+	bundle.Alert.Call = common.Payload{Title: "Missed call", Category: "MISSED_CALL"}
+	_, payload, _ = apnsNotification(push.ActMsg, "grpTest", map[string]string{"webrtc": "started"}, 0, bundle)
+	body.Aps = common.Aps{}
+	json.Unmarshal(payload, &body)
+	if body.Aps.Alert != nil {
+		t.Errorf("unexpected alert of call notification %s", payload)
+	}
+	_, payload, _ = apnsNotification(push.ActMsg, "grpTest", map[string]string{"webrtc": push.CallMissed}, 0, bundle)
+	body.Aps = common.Aps{}
+	json.Unmarshal(payload, &body)
+	if body.Aps.Alert == nil || body.Aps.Alert.Title != "Missed call" || body.Aps.Category != "MISSED_CALL" {
+		t.Errorf("unexpected missed call notification %s", payload)
+	}
+}
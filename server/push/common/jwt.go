@@ -0,0 +1,36 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+)
+
+// SignJWTES256 creates a JSON Web Token signed with the ECDSA P-256 key. Used by APNs and Web Push
+// for authentication of the server.
+func SignJWTES256(key *ecdsa.PrivateKey, header, claims map[string]any) (string, error) {
+	hdr, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	cl, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(cl)
+
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS signature is a concatenation of fixed-size R and S.
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -29,6 +29,7 @@ type Payload struct {
 
 	// APNS
 	Action          string   `json:"action,omitempty"`
+	Category        string   `json:"category,omitempty"`
 	ActionLocKey    string   `json:"action_loc_key,omitempty"`
 	LaunchImage     string   `json:"launch_image,omitempty"`
 	LocArgs         []string `json:"loc_args,omitempty"`
@@ -46,6 +47,8 @@ type Config struct {
 	// Configs for specific push types.
 	Msg Payload `json:"msg,omitempty"`
 	Sub Payload `json:"sub,omitempty"`
+	// Notifications of missed calls.
+	Call Payload `json:"call,omitempty"`
 }
 
 func (cp Payload) getStringAttr(field string) string {
@@ -76,6 +79,8 @@ func (cc *Config) GetStringField(what, field string) string {
 		val = cc.Msg.getStringAttr(field)
 	} else if what == push.ActSub {
 		val = cc.Sub.getStringAttr(field)
+	} else if what == push.KindCall {
+		val = cc.Call.getStringAttr(field)
 	}
 	if val == "" {
 		val = cc.Payload.getStringAttr(field)
@@ -89,6 +94,8 @@ func (cc *Config) GetIntField(what, field string) int {
 		val = cc.Msg.getIntAttr(field)
 	} else if what == push.ActSub {
 		val = cc.Sub.getIntAttr(field)
+	} else if what == push.KindCall {
+		val = cc.Call.getIntAttr(field)
 	}
 	if val == 0 {
 		val = cc.Payload.getIntAttr(field)
@@ -231,6 +238,38 @@ const (
 	HeaderApnsPushType = "apns-push-type"
 )
 
+// ApnsTokenPrefix marks device tokens issued by APNs directly as opposed to FCM registration tokens.
+// Clients report such tokens as "apns:<hex token>" or "apns:<bundle ID>:<hex token>".
+const ApnsTokenPrefix = "apns:"
+
+// IsApnsToken checks if the device token must be used with APNs directly.
+func IsApnsToken(token string) bool {
+	return strings.HasPrefix(token, ApnsTokenPrefix)
+}
+
+// WebPushPrefix marks Web Push subscriptions. Clients report them as "webpush:" followed by
+// JSON-serialized PushSubscription.
+const WebPushPrefix = "webpush:"
+
+// IsWebPushSubscription checks if the device token is a Web Push subscription.
+func IsWebPushSubscription(token string) bool {
+	return strings.HasPrefix(token, WebPushPrefix)
+}
+
+// UnifiedPushPrefix marks UnifiedPush endpoints. Clients report them as "unifiedpush:<endpoint URL>"
+// where the URL is provided by the UnifiedPush distributor on the device.
+const UnifiedPushPrefix = "unifiedpush:"
+
+// IsUnifiedPushEndpoint checks if the device token is a UnifiedPush endpoint.
+func IsUnifiedPushEndpoint(token string) bool {
+	return strings.HasPrefix(token, UnifiedPushPrefix)
+}
+
+// IsFcmToken checks if the device token is an FCM registration token, i.e. not a token of another service.
+func IsFcmToken(token string) bool {
+	return token != "" && !IsApnsToken(token) && !IsWebPushSubscription(token) && !IsUnifiedPushEndpoint(token)
+}
+
 type ApnsPushTypeType string
 
 const (
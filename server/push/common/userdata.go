@@ -0,0 +1,81 @@
+package common
+
+import (
+	"maps"
+
+	"github.com/tinode/chat/server/push"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// DataForUser customizes push data for the recipient. Returns the name of the topic as seen by the user
+// and the data, cloned if changed:
+//   - the name of a P2P topic is replaced with the ID of the other user;
+//   - pushes to users who have received the message interactively or are in their quiet hours are silent;
+//   - previews of message content are removed if the user disabled them;
+//   - pushes about messages which mention the user are marked with "mention";
+//   - localized title and body of the notification are added as "title" and "body".
+func DataForUser(data map[string]string, topic string, uid t.Uid, to push.Recipient) (string, map[string]string) {
+	tcat := t.GetTopicCat(topic)
+	if to.Delivered == 0 && !to.Silent && !to.Mentioned && tcat != t.TopicCatP2P && !to.NoPreview && to.Title == "" && to.Body == "" {
+		return topic, data
+	}
+
+	userData := maps.Clone(data)
+	// Fix topic name for P2P pushes.
+	if tcat == t.TopicCatP2P {
+		topic, _ = t.P2PNameForUser(uid, topic)
+		userData["topic"] = topic
+	}
+	// Silence the push for user who have received the data interactively or don't want to be disturbed.
+	if to.Delivered > 0 || to.Silent {
+		userData["silent"] = "true"
+	}
+	if to.Mentioned {
+		userData["mention"] = "true"
+	}
+	if to.NoPreview {
+		delete(userData, "content")
+		delete(userData, "rc")
+	}
+	if to.Title != "" {
+		userData["title"] = to.Title
+	}
+	if to.Body != "" {
+		userData["body"] = to.Body
+	}
+	return topic, userData
+}
+
+// NotificationText returns the title and the body of the visible notification: the localized texts
+// rendered for the recipient if available, otherwise the ones from config. The last value is true if
+// the texts are localized by the server, i.e. client-side localization keys must not be used.
+func NotificationText(cc *Config, what string, data map[string]string) (string, string, bool) {
+	if data["title"] != "" || data["body"] != "" {
+		return data["title"], data["body"], true
+	}
+	body := cc.GetStringField(what, "Body")
+	if body == "$content" {
+		body = data["content"]
+	}
+	return cc.GetStringField(what, "Title"), body, false
+}
+
+// NewApsAlert creates the alert of an APNs notification.
+func NewApsAlert(cc *Config, what string, data map[string]string) *ApsAlert {
+	title, body, localized := NotificationText(cc, what, data)
+	alert := &ApsAlert{
+		Action:          cc.GetStringField(what, "Action"),
+		ActionLocKey:    cc.GetStringField(what, "ActionLocKey"),
+		Body:            body,
+		LaunchImage:     cc.GetStringField(what, "LaunchImage"),
+		Title:           title,
+		Subtitle:        cc.GetStringField(what, "Subtitle"),
+		SummaryArg:      cc.GetStringField(what, "SummaryArg"),
+		SummaryArgCount: cc.GetIntField(what, "SummaryArgCount"),
+	}
+	if !localized {
+		alert.LocKey = cc.GetStringField(what, "LocKey")
+		alert.TitleLocKey = cc.GetStringField(what, "TitleLocKey")
+	}
+	return alert
+}
@@ -24,7 +24,8 @@ const (
 	defaultTimeToLive = 3600
 )
 
-func payloadToData(pl *push.Payload) (map[string]string, error) {
+// PayloadToData converts the push payload to a map of strings.
+func PayloadToData(pl *push.Payload) (map[string]string, error) {
 	if pl == nil {
 		return nil, errors.New("empty push payload")
 	}
@@ -66,12 +67,16 @@ func payloadToData(pl *push.Payload) (map[string]string, error) {
 			if pl.AudioOnly {
 				data["aonly"] = "true"
 			}
-			// Video call push notifications are silent.
-			data["silent"] = "true"
+			if pl.Webrtc != push.CallMissed {
+				// Video call push notifications are silent except notifications of missed calls.
+				data["silent"] = "true"
+			}
 		}
 		if pl.Replace != "" {
-			// Notification of a message edit should be silent too.
-			data["silent"] = "true"
+			if pl.Webrtc != push.CallMissed {
+				// Notification of a message edit should be silent too.
+				data["silent"] = "true"
+			}
 			data["replace"] = pl.Replace
 		}
 		if err != nil {
@@ -98,7 +103,7 @@ func clonePayload(src map[string]string) map[string]string {
 // PrepareV1Notifications creates notification payloads ready to be posted
 // to push notification server for the provided receipt.
 func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Message, []t.Uid) {
-	data, err := payloadToData(&rcpt.Payload)
+	data, err := PayloadToData(&rcpt.Payload)
 	if err != nil {
 		logs.Warn.Println("fcm push: could not parse payload:", err)
 		return nil, nil
@@ -141,25 +146,12 @@ func PrepareV1Notifications(rcpt *push.Receipt, config *configType) ([]*fcmv1.Me
 	var messages []*fcmv1.Message
 	var uids []t.Uid
 	for uid, devList := range devices {
-		topic := rcpt.Payload.Topic
-		userData := data
-		tcat := t.GetTopicCat(topic)
-		if rcpt.To[uid].Delivered > 0 || tcat == t.TopicCatP2P {
-			userData = clonePayload(data)
-			// Fix topic name for P2P pushes.
-			if tcat == t.TopicCatP2P {
-				topic, _ = t.P2PNameForUser(uid, topic)
-				userData["topic"] = topic
-			}
-			// Silence the push for user who have received the data interactively.
-			if rcpt.To[uid].Delivered > 0 {
-				userData["silent"] = "true"
-			}
-		}
+		topic, userData := common.DataForUser(data, rcpt.Payload.Topic, uid, rcpt.To[uid])
 
 		for i := range devList {
 			d := &devList[i]
-			if _, ok := skipDevices[d.DeviceId]; !ok && d.DeviceId != "" {
+			// Tokens of native APNs and Web Push subscriptions are handled by other adapters.
+			if _, ok := skipDevices[d.DeviceId]; !ok && common.IsFcmToken(d.DeviceId) {
 				msg := fcmv1.Message{
 					Token: d.DeviceId,
 					Data:  userData,
@@ -221,9 +213,11 @@ func DevicesForUser(uid t.Uid) []string {
 		return nil
 	}
 
-	devices := make([]string, count)
-	for i, dd := range ddef[uid] {
-		devices[i] = dd.DeviceId
+	devices := make([]string, 0, count)
+	for _, dd := range ddef[uid] {
+		if common.IsFcmToken(dd.DeviceId) {
+			devices = append(devices, dd.DeviceId)
+		}
 	}
 	return devices
 }
@@ -252,7 +246,10 @@ func androidNotificationConfig(what, topic string, data map[string]string, confi
 		}
 	}
 
+	// Missed calls are notified like regular messages.
+	kind := push.NotificationKind(what, data["webrtc"])
 	_, videoCall := data["webrtc"]
+	videoCall = videoCall && kind != push.KindCall
 	if videoCall {
 		timeToLive = "0s"
 	}
@@ -271,14 +268,12 @@ func androidNotificationConfig(what, topic string, data map[string]string, confi
 		return ac
 	}
 
-	body := config.Android.GetStringField(what, "Body")
-	if body == "$content" {
-		body = data["content"]
-	}
+	title, body, localized := common.NotificationText(config.Android, kind, data)
 
 	// Client-side display priority.
 	priority = string(common.AndroidNotificationPriorityHigh)
-	if videoCall {
+	if videoCall || data["mention"] == "true" {
+		// Calls and messages which mention the user are shown prominently.
 		priority = string(common.AndroidNotificationPriorityMax)
 	}
 
@@ -288,20 +283,23 @@ func androidNotificationConfig(what, topic string, data map[string]string, confi
 		Tag:                  topic,
 		NotificationPriority: priority,
 		Visibility:           string(common.AndroidVisibilityPrivate),
-		TitleLocKey:          config.Android.GetStringField(what, "TitleLocKey"),
-		Title:                config.Android.GetStringField(what, "Title"),
-		BodyLocKey:           config.Android.GetStringField(what, "BodyLocKey"),
+		Title:                title,
 		Body:                 body,
-		Icon:                 config.Android.GetStringField(what, "Icon"),
-		Color:                config.Android.GetStringField(what, "Color"),
-		ClickAction:          config.Android.GetStringField(what, "ClickAction"),
+		Icon:                 config.Android.GetStringField(kind, "Icon"),
+		Color:                config.Android.GetStringField(kind, "Color"),
+		ClickAction:          config.Android.GetStringField(kind, "ClickAction"),
+	}
+	if !localized {
+		ac.Notification.TitleLocKey = config.Android.GetStringField(kind, "TitleLocKey")
+		ac.Notification.BodyLocKey = config.Android.GetStringField(kind, "BodyLocKey")
 	}
 
 	return ac
 }
 
 func apnsShouldPresentAlert(what, callStatus, isSilent string, config *configType) bool {
-	return config.Apns != nil && config.Apns.Enabled && what != push.ActRead && callStatus == "" && isSilent == ""
+	return config.Apns != nil && config.Apns.Enabled && what != push.ActRead &&
+		(callStatus == "" || callStatus == push.CallMissed) && isSilent == ""
 }
 
 func apnsNotificationConfig(what, topic string, data map[string]string, unread int, config *configType) *fcmv1.ApnsConfig {
@@ -339,25 +337,12 @@ func apnsNotificationConfig(what, topic string, data map[string]string, unread i
 		ThreadID:          topic,
 	}
 
-	// Do not present alert for read notifications and video calls.
+	// Do not present alert for read notifications and video calls other than missed calls.
 	if apnsShouldPresentAlert(what, callStatus, data["silent"], config) {
-		body := config.Apns.GetStringField(what, "Body")
-		if body == "$content" {
-			body = data["content"]
-		}
-
-		apsPayload.Alert = &common.ApsAlert{
-			Action:          config.Apns.GetStringField(what, "Action"),
-			ActionLocKey:    config.Apns.GetStringField(what, "ActionLocKey"),
-			Body:            body,
-			LaunchImage:     config.Apns.GetStringField(what, "LaunchImage"),
-			LocKey:          config.Apns.GetStringField(what, "LocKey"),
-			Title:           config.Apns.GetStringField(what, "Title"),
-			Subtitle:        config.Apns.GetStringField(what, "Subtitle"),
-			TitleLocKey:     config.Apns.GetStringField(what, "TitleLocKey"),
-			SummaryArg:      config.Apns.GetStringField(what, "SummaryArg"),
-			SummaryArgCount: config.Apns.GetIntField(what, "SummaryArgCount"),
-		}
+		kind := push.NotificationKind(what, callStatus)
+		apsPayload.Alert = common.NewApsAlert(config.Apns, kind, data)
+		// Category selects actions of the notification registered by the app, e.g. "call back".
+		apsPayload.Category = config.Apns.GetStringField(kind, "Category")
 	}
 
 	payload, err := json.Marshal(map[string]any{"aps": apsPayload})
@@ -28,6 +28,9 @@ import (
 var handler Handler
 
 const (
+	// Name of the handler.
+	handlerName = "fcm"
+
 	// Size of the input channel buffer.
 	bufferSize = 1024
 
@@ -145,25 +148,32 @@ func sendFcmV1(rcpt *push.Receipt, config *configType) {
 			}
 			switch strings.ToUpper(gerr.FcmErrCode) {
 			case "": // no error
+				push.ReportOutcome(handlerName, push.OutcomeSent)
 			case common.ErrorQuotaExceeded, common.ErrorUnavailable, common.ErrorInternal, common.ErrorUnspecified:
 				// Transient errors. Stop sending this batch.
 				logs.Warn.Println("fcm transient failure:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.ReportOutcome(handlerName, push.OutcomeFailed)
 				return
 			case common.ErrorSenderIDMismatch, common.ErrorInvalidArgument, common.ErrorThirdPartyAuth:
 				// Config errors. Stop.
 				logs.Warn.Println("fcm invalid config:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.ReportOutcome(handlerName, push.OutcomeFailed)
 				return
 			case common.ErrorUnregistered:
 				// Token is no longer valid. Delete token from DB and continue sending.
 				logs.Warn.Println("fcm invalid token:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
 				if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
 					logs.Warn.Println("tnpg failed to delete invalid token:", err)
 				}
 			default:
 				// Unknown error. Stop sending just in case.
 				logs.Warn.Println("tnpg unrecognized error:", gerr.FcmErrCode, gerr.ErrMessage)
+				push.ReportOutcome(handlerName, push.OutcomeFailed)
 				return
 			}
+		} else {
+			push.ReportOutcome(handlerName, push.OutcomeSent)
 		}
 	}
 }
@@ -177,7 +187,7 @@ func processSubscription(req *push.ChannelReq) {
 	if req.Channel != "" {
 		devices = DevicesForUser(req.Uid)
 		channel = req.Channel
-	} else if req.DeviceID != "" {
+	} else if common.IsFcmToken(req.DeviceID) {
 		channels = ChannelsForUser(req.Uid)
 		device = req.DeviceID
 	}
@@ -268,5 +278,5 @@ func (Handler) Stop() {
 }
 
 func init() {
-	push.Register("fcm", &handler)
+	push.Register(handlerName, &handler)
 }
@@ -19,9 +19,38 @@ const (
 	ActRead = "read"
 )
 
+// Outcomes of sending a push notification reported by handlers.
+const (
+	// The push service accepted the notification.
+	OutcomeSent = "sent"
+	// The device token or subscription is no longer valid.
+	OutcomeInvalidToken = "invalid_token"
+	// The push service rejected the notification or the request failed.
+	OutcomeFailed = "failed"
+	// The notification was dropped because the handler is overloaded.
+	OutcomeDropped = "dropped"
+)
+
 // MaxPayloadLength is the maximum length of push payload in multibyte characters.
 const MaxPayloadLength = 128
 
+// CallMissed is the state of a video call which nobody answered. Unlike other video call pushes,
+// notifications of missed calls are shown to the user.
+const CallMissed = "missed"
+
+// KindCall is the kind of visible notifications of missed calls. Notification texts and options are
+// configured for it separately from ActMsg.
+const KindCall = "call"
+
+// NotificationKind returns the kind of the visible notification for the push: the push action or
+// KindCall for missed calls.
+func NotificationKind(what, webrtc string) string {
+	if what == ActMsg && webrtc == CallMissed {
+		return KindCall
+	}
+	return what
+}
+
 // Recipient is a user targeted by the push.
 type Recipient struct {
 	// Count of user's connections that were live when the packet was dispatched from the server
@@ -32,6 +61,24 @@ type Recipient struct {
 	Unread int `json:"unread"`
 	// Indicates whether unread counter in the cache should be incremented before sending the push.
 	ShouldIncrementUnreadCountInCache bool `json:"-"`
+	// The user muted notifications from the topic: the recipient is kept for updating the unread counter
+	// but the push is not sent.
+	Muted bool `json:"muted,omitempty"`
+	// The message mentions the user by an @mention or by a keyword.
+	Mentioned bool `json:"mention,omitempty"`
+	// The user has sessions attached to the 'me' topic, i.e. the user is online but not in this topic.
+	// Known only for users whose 'me' topic is hosted by this cluster node.
+	Online bool `json:"-"`
+
+	// Set by the push package before the receipt is passed to handlers.
+
+	// Title and body of the notification rendered from templates in the user's language.
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// The user disabled previews of message content in notifications.
+	NoPreview bool `json:"nopreview,omitempty"`
+	// The push is silent because of the user's quiet hours.
+	Silent bool `json:"-"`
 }
 
 // Receipt is the push payload with a list of recipients.
@@ -120,6 +167,17 @@ type configType struct {
 
 var handlers map[string]Handler
 
+// OnOutcome is called with the outcome of every notification sent by handlers, e.g. to collect
+// metrics. Must be set before handlers are initialized, must not block.
+var OnOutcome func(handler, outcome string)
+
+// ReportOutcome is called by the handler to report the outcome of sending a notification.
+func ReportOutcome(handler, outcome string) {
+	if OnOutcome != nil {
+		OnOutcome(handler, outcome)
+	}
+}
+
 // Register a push handler
 func Register(name string, hnd Handler) {
 	if handlers == nil {
@@ -163,7 +221,39 @@ func Push(msg *Receipt) {
 		return
 	}
 
+	for uid, to := range msg.To {
+		if to.Muted {
+			delete(msg.To, uid)
+		}
+	}
+	if len(msg.To) == 0 && msg.Channel == "" {
+		return
+	}
+
+	if needsSettings(msg) && anyReady() {
+		// Notification settings of recipients are loaded from the database: don't block the caller.
+		go func() {
+			applySettings(msg, time.Now())
+			dispatch(msg)
+		}()
+		return
+	}
+	dispatch(msg)
+}
+
+// anyReady checks if at least one handler is initialized.
+func anyReady() bool {
 	for _, hnd := range handlers {
+		if hnd.IsReady() {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch passes the receipt to handlers.
+func dispatch(msg *Receipt) {
+	for name, hnd := range handlers {
 		if !hnd.IsReady() {
 			continue
 		}
@@ -172,6 +262,7 @@ func Push(msg *Receipt) {
 		select {
 		case hnd.Push() <- msg:
 		default:
+			ReportOutcome(name, OutcomeDropped)
 		}
 	}
 }
@@ -0,0 +1,386 @@
+// Package sms implements push notification plugin which notifies users of new messages by SMS when they
+// have been offline for a while. SMS are sent through a provider (Twilio, Vonage) to the validated phone
+// number of the user. Users opt in to SMS notifications in their notification settings.
+package sms
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Default time in seconds since the user was last seen after which the user is notified by SMS.
+	defaultOfflineAfter = 900
+	// Default maximum numbers of SMS sent to one user per hour and per day.
+	defaultMaxPerHour = 3
+	defaultMaxPerDay  = 10
+	// Default maximum length of the SMS text in characters.
+	defaultMaxLength = 160
+	// Default text of the SMS when the preview of the message is not included.
+	defaultText = "New message"
+
+	// Name of the credential method with the phone number.
+	telMethod = "tel"
+)
+
+var handler Handler
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	config   *configType
+	provider Provider
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Name of the SMS provider, "twilio" or "vonage".
+	Provider string `json:"provider"`
+	// Configs of the providers.
+	Twilio json.RawMessage `json:"twilio,omitempty"`
+	Vonage json.RawMessage `json:"vonage,omitempty"`
+	// Phone number or alphanumeric ID of the sender.
+	Sender string `json:"sender"`
+	// The user is notified by SMS if not seen for this many seconds.
+	OfflineAfter int `json:"offline_after,omitempty"`
+	// Maximum numbers of SMS sent to one user per hour and per day.
+	MaxPerHour int `json:"max_per_hour,omitempty"`
+	MaxPerDay  int `json:"max_per_day,omitempty"`
+	// Include previews of message content into SMS, if allowed by the user.
+	Preview bool `json:"preview,omitempty"`
+	// Maximum length of the SMS text in characters.
+	MaxLength int `json:"max_length,omitempty"`
+	// Text of the SMS when the preview of the message is not included.
+	Text string `json:"text,omitempty"`
+	// Public URL of the endpoint which receives delivery reports, e.g. "https://api.example.com/v0/sms/".
+	// Delivery reports are not requested if the URL is empty.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Secret key for signing URLs of delivery reports.
+	CallbackSecret string `json:"callback_secret,omitempty"`
+}
+
+// Provider is an SMS service.
+type Provider interface {
+	// Init initializes the provider with its config.
+	Init(jsonconf json.RawMessage) error
+	// Send sends the SMS and requests delivery reports at the callback URL, if not empty.
+	// Returns the ID of the SMS assigned by the provider.
+	Send(from, to, text, callback string) (string, error)
+	// Status parses the delivery report. Returns the final status of the SMS (t.SmsDelivered or t.SmsFailed)
+	// and the error reported by the provider. Empty status is returned for intermediate reports.
+	Status(req *http.Request) (string, string)
+}
+
+var providers = map[string]Provider{}
+
+// RegisterProvider makes an SMS provider available by name.
+func RegisterProvider(name string, p Provider) {
+	if p == nil {
+		panic("RegisterProvider: provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("RegisterProvider: called twice for provider " + name)
+	}
+	providers[name] = p
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	p := providers[config.Provider]
+	if p == nil {
+		return false, errors.New("sms: unknown provider '" + config.Provider + "'")
+	}
+	var providerConf json.RawMessage
+	switch config.Provider {
+	case "twilio":
+		providerConf = config.Twilio
+	case "vonage":
+		providerConf = config.Vonage
+	}
+	if err := p.Init(providerConf); err != nil {
+		return false, errors.New("sms: " + err.Error())
+	}
+	if config.Sender == "" {
+		return false, errors.New("sms: missing sender")
+	}
+
+	if config.OfflineAfter <= 0 {
+		config.OfflineAfter = defaultOfflineAfter
+	}
+	if config.MaxPerHour <= 0 {
+		config.MaxPerHour = defaultMaxPerHour
+	}
+	if config.MaxPerDay <= 0 {
+		config.MaxPerDay = defaultMaxPerDay
+	}
+	if config.MaxLength <= 0 {
+		config.MaxLength = defaultMaxLength
+	}
+	if config.Text == "" {
+		config.Text = defaultText
+	}
+	if config.CallbackURL != "" {
+		if _, err := url.Parse(config.CallbackURL); err != nil {
+			return false, errors.New("sms: invalid callback_url")
+		}
+		if !strings.HasSuffix(config.CallbackURL, "/") {
+			config.CallbackURL += "/"
+		}
+		if config.CallbackSecret == "" {
+			// Reports of SMS sent before a restart and by other cluster nodes will be rejected.
+			logs.Warn.Println("sms: callback_secret not set, using a random one")
+			secret := make([]byte, 32)
+			rand.Read(secret)
+			config.CallbackSecret = string(secret)
+		}
+	}
+
+	handler.config = &config
+	handler.provider = p
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				// Receipts are processed one by one to keep the counts of sent SMS accurate.
+				sendSms(rcpt, &config, p)
+			case <-handler.channel:
+				// SMS have no topics (channels). Ignore.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// smsText formats the text of the SMS notification.
+func smsText(to *push.Recipient, config *configType) string {
+	body := config.Text
+	if config.Preview && !to.NoPreview && to.Body != "" {
+		body = to.Body
+	}
+	text := body
+	if to.Title != "" {
+		text = to.Title + ": " + body
+	}
+	if utf8.RuneCountInString(text) > config.MaxLength {
+		runes := []rune(text)
+		text = string(runes[:config.MaxLength-1]) + "…"
+	}
+	return text
+}
+
+// isOffline checks if the user was last seen longer ago than allowed by config.
+func isOffline(user *t.User, now time.Time, config *configType) bool {
+	return user.LastSeen == nil ||
+		now.Sub(*user.LastSeen) >= time.Duration(config.OfflineAfter)*time.Second
+}
+
+// overLimit checks if the user has already received the maximum number of SMS.
+func overLimit(uid t.Uid, now time.Time, config *configType) (bool, error) {
+	count, err := store.SmsMessages.Count(uid, now.Add(-time.Hour))
+	if err != nil || count >= config.MaxPerHour {
+		return true, err
+	}
+	count, err = store.SmsMessages.Count(uid, now.Add(-24*time.Hour))
+	return count >= config.MaxPerDay, err
+}
+
+// signature is the signature of the URL of delivery reports of the SMS.
+func signature(id string, config *configType) string {
+	hasher := hmac.New(sha256.New, []byte(config.CallbackSecret))
+	hasher.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(hasher.Sum(nil))
+}
+
+// callbackURL returns the URL of delivery reports of the SMS or an empty string if reports are not requested.
+func callbackURL(id string, config *configType) string {
+	if config.CallbackURL == "" {
+		return ""
+	}
+	return config.CallbackURL + id + "?sig=" + signature(id, config)
+}
+
+func sendSms(rcpt *push.Receipt, config *configType, p Provider) {
+	if rcpt.Payload.What != push.ActMsg || rcpt.Payload.Webrtc != "" || len(rcpt.To) == 0 {
+		return
+	}
+
+	// Users who did not receive the message and are not online.
+	var uids []t.Uid
+	for uid, to := range rcpt.To {
+		if to.Delivered == 0 && !to.Online && !to.Muted && !to.Silent {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+
+	settings, err := store.NotifySettings.Get(uids...)
+	if err != nil {
+		logs.Warn.Println("sms: failed to load settings", err)
+		return
+	}
+	uids = uids[:0]
+	for uid, ns := range settings {
+		if ns.Sms {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+
+	users, err := store.Users.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("sms: failed to load users", err)
+		return
+	}
+
+	now := t.TimeNow()
+	for i := range users {
+		user := &users[i]
+		if user.State != t.StateOK || !isOffline(user, now, config) {
+			continue
+		}
+		uid := user.Uid()
+		if over, err := overLimit(uid, now, config); over {
+			if err != nil {
+				logs.Warn.Println("sms: failed to count messages", err)
+			}
+			continue
+		}
+
+		creds, err := store.Users.GetAllCreds(uid, telMethod, true)
+		if err != nil {
+			logs.Warn.Println("sms: failed to load phone number", err)
+			continue
+		}
+		if len(creds) == 0 {
+			continue
+		}
+
+		to := rcpt.To[uid]
+		msg := &t.SmsMessage{
+			User:     uid.String(),
+			Topic:    rcpt.Payload.Topic,
+			SeqId:    rcpt.Payload.SeqId,
+			Phone:    creds[0].Value,
+			Provider: config.Provider,
+			Status:   t.SmsQueued,
+		}
+		if err := store.SmsMessages.Create(msg); err != nil {
+			logs.Warn.Println("sms: failed to save message", err)
+			continue
+		}
+
+		status, errText := t.SmsSent, ""
+		providerId, err := p.Send(config.Sender, msg.Phone, smsText(&to, config), callbackURL(msg.Id, config))
+		if err != nil {
+			logs.Warn.Println("sms: failed to send", uid.UserId(), err)
+			status, errText = t.SmsFailed, err.Error()
+		}
+		if _, err := store.SmsMessages.Update(msg.Id, providerId, status, errText); err != nil {
+			logs.Warn.Println("sms: failed to update status", err)
+		}
+	}
+}
+
+// serveStatus receives delivery reports from the provider.
+func serveStatus(wrt http.ResponseWriter, req *http.Request) {
+	id := path.Base(req.URL.Path)
+	sig := req.URL.Query().Get("sig")
+	if !hmac.Equal([]byte(sig), []byte(signature(id, handler.config))) {
+		wrt.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	status, errText := handler.provider.Status(req)
+	if status != "" {
+		found, err := store.SmsMessages.Update(id, "", status, errText)
+		if err != nil {
+			logs.Warn.Println("sms: failed to update status", err)
+			wrt.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			wrt.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	wrt.WriteHeader(http.StatusNoContent)
+}
+
+// StatusHandler returns the HTTP handler of delivery reports to be served at callback_url or nil if
+// delivery reports are not requested.
+func StatusHandler() http.Handler {
+	if handler.input == nil || handler.config.CallbackURL == "" {
+		return nil
+	}
+	return http.HandlerFunc(serveStatus)
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to FCM topics. SMS have no topics,
+// the requests are ignored.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register("sms", &handler)
+	RegisterProvider("twilio", &twilioProvider{})
+	RegisterProvider("vonage", &vonageProvider{})
+}
@@ -0,0 +1,187 @@
+package sms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// testProvider records sent SMS.
+type testProvider struct {
+	sent []string
+}
+
+func (p *testProvider) Init(json.RawMessage) error { return nil }
+
+func (p *testProvider) Send(from, to, text, callback string) (string, error) {
+	p.sent = append(p.sent, to+" "+text+" "+callback)
+	return "prov1", nil
+}
+
+func (p *testProvider) Status(req *http.Request) (string, string) {
+	if status := req.FormValue("status"); status == types.SmsDelivered {
+		return status, ""
+	}
+	return "", ""
+}
+
+func TestSmsText(t *testing.T) {
+	config := &configType{MaxLength: 20, Text: "New message"}
+	to := &push.Recipient{Title: "Alice", Body: "Hello there, how are you?"}
+	if text := smsText(to, config); text != "Alice: New message" {
+		t.Errorf("no preview: got '%s'", text)
+	}
+	config.Preview = true
+	if text := smsText(to, config); text != "Alice: Hello there,…" {
+		t.Errorf("preview: got '%s'", text)
+	}
+	to.NoPreview = true
+	if text := smsText(to, config); text != "Alice: New message" {
+		t.Errorf("preview disabled by user: got '%s'", text)
+	}
+	if text := smsText(&push.Recipient{}, config); text != "New message" {
+		t.Errorf("no title: got '%s'", text)
+	}
+}
+
+func TestSendSms(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	users := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	settings := mock_store.NewMockNotifySettingsPersistenceInterface(ctrl)
+	messages := mock_store.NewMockSmsPersistenceInterface(ctrl)
+	store.Users, store.NotifySettings, store.SmsMessages = users, settings, messages
+	defer func() {
+		store.Users, store.NotifySettings, store.SmsMessages = nil, nil, nil
+		ctrl.Finish()
+	}()
+
+	config := &configType{Provider: "test", Sender: "+15550000000", OfflineAfter: 900, MaxPerHour: 3, MaxPerDay: 10,
+		MaxLength: 160, Text: "New message", CallbackURL: "https://api.example.com/v0/sms/", CallbackSecret: "secret"}
+	p := &testProvider{}
+
+	// 1: offline and opted in; 2: not opted in; 3: seen recently; 4: over the limit; 5: online; 6: delivered.
+	long := time.Now().Add(-time.Hour)
+	recent := time.Now().Add(-time.Minute)
+	uid1, uid2, uid3, uid4 := types.Uid(1), types.Uid(2), types.Uid(3), types.Uid(4)
+	settings.EXPECT().Get(gomock.Any()).DoAndReturn(func(uids ...types.Uid) (map[types.Uid]*types.NotifySettings, error) {
+		if len(uids) != 4 {
+			t.Errorf("expected 4 candidates, got %v", uids)
+		}
+		return map[types.Uid]*types.NotifySettings{
+			uid1: {Sms: true}, uid2: {}, uid3: {Sms: true}, uid4: {Sms: true},
+		}, nil
+	})
+	users.EXPECT().GetAll(gomock.Any()).DoAndReturn(func(uids ...types.Uid) ([]types.User, error) {
+		result := []types.User{{LastSeen: &long}, {LastSeen: &recent}, {LastSeen: &long}}
+		result[0].SetUid(uid1)
+		result[1].SetUid(uid3)
+		result[2].SetUid(uid4)
+		return result, nil
+	})
+	messages.EXPECT().Count(uid1, gomock.Any()).Return(0, nil).Times(2)
+	messages.EXPECT().Count(uid4, gomock.Any()).Return(3, nil)
+	users.EXPECT().GetAllCreds(uid1, "tel", true).Return([]types.Credential{{Value: "+15551234567"}}, nil)
+	messages.EXPECT().Create(gomock.Any()).DoAndReturn(func(msg *types.SmsMessage) error {
+		if msg.User != uid1.String() || msg.Topic != "grpTest" || msg.SeqId != 5 || msg.Phone != "+15551234567" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+		msg.Id = "sms1"
+		return nil
+	})
+	messages.EXPECT().Update("sms1", "prov1", types.SmsSent, "").Return(true, nil)
+
+	sendSms(&push.Receipt{
+		To: map[types.Uid]push.Recipient{
+			uid1: {Title: "Alice"}, uid2: {}, uid3: {}, uid4: {},
+			types.Uid(5): {Online: true}, types.Uid(6): {Delivered: 1},
+		},
+		Payload: push.Payload{What: push.ActMsg, Topic: "grpTest", SeqId: 5},
+	}, config, p)
+
+	if len(p.sent) != 1 ||
+		p.sent[0] != "+15551234567 Alice: New message https://api.example.com/v0/sms/sms1?sig="+signature("sms1", config) {
+		t.Errorf("unexpected SMS %v", p.sent)
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	messages := mock_store.NewMockSmsPersistenceInterface(ctrl)
+	store.SmsMessages = messages
+	handler.config = &configType{CallbackSecret: "secret"}
+	handler.provider = &testProvider{}
+	defer func() {
+		store.SmsMessages = nil
+		handler.config, handler.provider = nil, nil
+		ctrl.Finish()
+	}()
+
+	messages.EXPECT().Update("sms1", "", types.SmsDelivered, "").Return(true, nil)
+
+	for _, test := range []struct {
+		query string
+		code  int
+	}{
+		{"sig=" + signature("sms1", handler.config) + "&status=delivered", http.StatusNoContent},
+		{"sig=" + signature("sms1", handler.config) + "&status=sent", http.StatusNoContent},
+		{"sig=" + signature("sms2", handler.config) + "&status=delivered", http.StatusForbidden},
+	} {
+		rec := httptest.NewRecorder()
+		serveStatus(rec, httptest.NewRequest(http.MethodGet, "/v0/sms/sms1?"+test.query, nil))
+		if rec.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.query, test.code, rec.Code)
+		}
+	}
+}
+
+func TestVonage(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		if form.Get("to") == "15559999999" {
+			w.Write([]byte(`{"messages":[{"status":"6","error-text":"Unroutable"}]}`))
+			return
+		}
+		w.Write([]byte(`{"message-count":"1","messages":[{"message-id":"abc123","status":"0"}]}`))
+	}))
+	defer srv.Close()
+	vonageApiURL = srv.URL
+
+	p := &vonageProvider{}
+	if err := p.Init(json.RawMessage(`{"api_key":"key","api_secret":"secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.Send("+15550000000", "+15551234567", "Grüße", "https://api.example.com/v0/sms/sms1")
+	if err != nil || id != "abc123" {
+		t.Errorf("Send: got '%s', %v", id, err)
+	}
+	if form.Get("to") != "15551234567" || form.Get("type") != "unicode" || form.Get("callback") == "" {
+		t.Errorf("unexpected request %v", form)
+	}
+	if _, err = p.Send("+15550000000", "+15559999999", "Hi", ""); err == nil || !strings.Contains(err.Error(), "Unroutable") {
+		t.Errorf("expected error, got %v", err)
+	}
+
+	status, errText := p.Status(httptest.NewRequest(http.MethodGet, "/?status=failed&err-code=6", nil))
+	if status != types.SmsFailed || errText != "failed 6" {
+		t.Errorf("Status: got '%s' '%s'", status, errText)
+	}
+}
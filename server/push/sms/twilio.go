@@ -0,0 +1,73 @@
+package sms
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	t "github.com/tinode/chat/server/store/types"
+	"github.com/twilio/twilio-go"
+	twapi "github.com/twilio/twilio-go/rest/api/v2010"
+)
+
+type twilioConfig struct {
+	AccountSid string `json:"account_sid"`
+	AuthToken  string `json:"auth_token"`
+}
+
+// twilioProvider sends SMS through Twilio Programmable Messaging.
+type twilioProvider struct {
+	client *twilio.RestClient
+}
+
+// Init creates the Twilio client.
+func (p *twilioProvider) Init(jsonconf json.RawMessage) error {
+	var conf twilioConfig
+	if err := json.Unmarshal(jsonconf, &conf); err != nil {
+		return errors.New("failed to parse twilio config: " + err.Error())
+	}
+	if conf.AccountSid == "" || conf.AuthToken == "" {
+		return errors.New("missing twilio credentials")
+	}
+	p.client = twilio.NewRestClientWithParams(twilio.ClientParams{
+		Username: conf.AccountSid,
+		Password: conf.AuthToken,
+	})
+	return nil
+}
+
+// Send sends the SMS. Twilio posts status updates to the StatusCallback URL.
+func (p *twilioProvider) Send(from, to, text, callback string) (string, error) {
+	params := &twapi.CreateMessageParams{
+		From: &from,
+		To:   &to,
+		Body: &text,
+	}
+	if callback != "" {
+		params.SetStatusCallback(callback)
+	}
+	resp, err := p.client.Api.CreateMessage(params)
+	if err != nil {
+		return "", err
+	}
+	if resp.Sid == nil {
+		return "", nil
+	}
+	return *resp.Sid, nil
+}
+
+// Status parses the status update, a form with MessageStatus and ErrorCode.
+func (p *twilioProvider) Status(req *http.Request) (string, string) {
+	switch req.FormValue("MessageStatus") {
+	case "delivered":
+		return t.SmsDelivered, ""
+	case "failed", "undelivered":
+		errText := req.FormValue("MessageStatus")
+		if code := req.FormValue("ErrorCode"); code != "" {
+			errText += " " + code
+		}
+		return t.SmsFailed, errText
+	}
+	// Intermediate statuses: queued, sending, sent.
+	return "", ""
+}
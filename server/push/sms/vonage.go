@@ -0,0 +1,106 @@
+package sms
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Endpoint of the Vonage (Nexmo) SMS API.
+var vonageApiURL = "https://rest.nexmo.com/sms/json"
+
+type vonageConfig struct {
+	ApiKey    string `json:"api_key"`
+	ApiSecret string `json:"api_secret"`
+}
+
+// vonageProvider sends SMS through the Vonage SMS API.
+type vonageProvider struct {
+	config vonageConfig
+	client *http.Client
+}
+
+// vonageResponse is the response of the SMS API.
+type vonageResponse struct {
+	Messages []struct {
+		MessageId string `json:"message-id"`
+		Status    string `json:"status"`
+		ErrorText string `json:"error-text"`
+	} `json:"messages"`
+}
+
+// Init saves the API credentials.
+func (p *vonageProvider) Init(jsonconf json.RawMessage) error {
+	if err := json.Unmarshal(jsonconf, &p.config); err != nil {
+		return errors.New("failed to parse vonage config: " + err.Error())
+	}
+	if p.config.ApiKey == "" || p.config.ApiSecret == "" {
+		return errors.New("missing vonage credentials")
+	}
+	p.client = &http.Client{Timeout: 10 * time.Second}
+	return nil
+}
+
+// Send sends the SMS. Vonage sends delivery receipts to the callback URL.
+func (p *vonageProvider) Send(from, to, text, callback string) (string, error) {
+	form := url.Values{
+		"api_key":    {p.config.ApiKey},
+		"api_secret": {p.config.ApiSecret},
+		"from":       {strings.TrimPrefix(from, "+")},
+		"to":         {strings.TrimPrefix(to, "+")},
+		"text":       {text},
+	}
+	for _, r := range text {
+		if r > 0x7f {
+			form.Set("type", "unicode")
+			break
+		}
+	}
+	if callback != "" {
+		form.Set("callback", callback)
+	}
+
+	resp, err := p.client.PostForm(vonageApiURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("vonage: " + resp.Status)
+	}
+
+	var result vonageResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Messages) == 0 {
+		return "", errors.New("vonage: empty response")
+	}
+	// Long text is sent as several messages. The first one identifies the SMS.
+	msg := result.Messages[0]
+	if msg.Status != "0" {
+		return "", errors.New("vonage: " + msg.Status + " " + msg.ErrorText)
+	}
+	return msg.MessageId, nil
+}
+
+// Status parses the delivery receipt with status and err-code in the query or in the form.
+func (p *vonageProvider) Status(req *http.Request) (string, string) {
+	switch req.FormValue("status") {
+	case "delivered":
+		return t.SmsDelivered, ""
+	case "failed", "rejected", "expired":
+		errText := req.FormValue("status")
+		if code := req.FormValue("err-code"); code != "" && code != "0" {
+			errText += " " + code
+		}
+		return t.SmsFailed, errText
+	}
+	// Intermediate statuses: accepted, buffered, unknown.
+	return "", ""
+}
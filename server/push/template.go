@@ -0,0 +1,238 @@
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+// Template of the visible part of a notification. Title and body may contain placeholders:
+// $sender is the name of the sender, $preview is the preview of the message content.
+type Template struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+	// Body used when the recipient has disabled previews. Defaults to Body with empty $preview.
+	BodyNoPreview string `json:"body_no_preview,omitempty"`
+}
+
+// Templates of one language keyed by notification kind.
+type langTemplates struct {
+	Msg *Template `json:"msg,omitempty"`
+	Sub *Template `json:"sub,omitempty"`
+	// Missed calls.
+	Call *Template `json:"call,omitempty"`
+}
+
+type templatesConfig struct {
+	Enabled bool `json:"enabled"`
+	// Language used when templates for the recipient's language are not available.
+	DefaultLang string `json:"default_lang"`
+	// Templates keyed by language: BCP 47 tag or its base language, e.g. "pt-BR" or "pt".
+	Langs map[string]*langTemplates `json:"langs"`
+}
+
+var templates *templatesConfig
+
+// InitTemplates initializes templates of notification texts.
+func InitTemplates(jsconfig json.RawMessage) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config templatesConfig
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse push templates: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	langs := make(map[string]*langTemplates, len(config.Langs))
+	for lang, tpl := range config.Langs {
+		langs[strings.ToLower(lang)] = tpl
+	}
+	config.Langs = langs
+	config.DefaultLang = strings.ToLower(config.DefaultLang)
+	if config.Langs[config.DefaultLang] == nil {
+		return false, errors.New("push templates: missing templates for the default language '" + config.DefaultLang + "'")
+	}
+
+	templates = &config
+	return true, nil
+}
+
+// findTemplate returns the template for the notification kind in the given language falling back to
+// the base language and then to the default language.
+func findTemplate(what, lang string) *Template {
+	lang = strings.ToLower(lang)
+	candidates := []string{lang}
+	if base, _, found := strings.Cut(lang, "-"); found {
+		candidates = append(candidates, base)
+	}
+	candidates = append(candidates, templates.DefaultLang)
+	for _, l := range candidates {
+		if lt := templates.Langs[l]; lt != nil {
+			switch what {
+			case ActMsg:
+				if lt.Msg != nil {
+					return lt.Msg
+				}
+			case ActSub:
+				if lt.Sub != nil {
+					return lt.Sub
+				}
+			case KindCall:
+				if lt.Call != nil {
+					return lt.Call
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// render expands placeholders in the template.
+func (tpl *Template) render(sender, preview string, noPreview bool) (string, string) {
+	body := tpl.Body
+	if noPreview {
+		preview = ""
+		if tpl.BodyNoPreview != "" {
+			body = tpl.BodyNoPreview
+		}
+	}
+	mapping := func(name string) string {
+		switch name {
+		case "sender":
+			return sender
+		case "preview":
+			return preview
+		}
+		return "$" + name
+	}
+	return strings.TrimSpace(os.Expand(tpl.Title, mapping)), strings.TrimSpace(os.Expand(body, mapping))
+}
+
+// needsSettings checks if recipients of the receipt may get visible notifications.
+func needsSettings(rcpt *Receipt) bool {
+	return len(rcpt.To) > 0 && !rcpt.Payload.Silent &&
+		(rcpt.Payload.What == ActMsg || rcpt.Payload.What == ActSub) &&
+		(rcpt.Payload.Webrtc == "" || rcpt.Payload.Webrtc == CallMissed)
+}
+
+// applySettings applies notification settings of recipients to the receipt: marks recipients who disabled
+// previews or are in their quiet hours and renders titles and bodies of notifications in the recipients'
+// languages.
+func applySettings(rcpt *Receipt, now time.Time) {
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	for uid, to := range rcpt.To {
+		// Users who received the message interactively get silent pushes.
+		if to.Delivered == 0 {
+			uids = append(uids, uid)
+		}
+	}
+	if len(uids) == 0 {
+		return
+	}
+
+	settings, err := store.NotifySettings.Get(uids...)
+	if err != nil {
+		logs.Warn.Println("push: failed to load notification settings", err)
+	}
+
+	for uid, ns := range settings {
+		to := rcpt.To[uid]
+		to.NoPreview = ns.NoPreview
+		to.Silent = ns.IsQuiet(now)
+		rcpt.To[uid] = to
+	}
+
+	if templates == nil {
+		return
+	}
+
+	// Language of the recipients who have not chosen one: the language of the most recently active device.
+	var devices map[t.Uid][]t.DeviceDef
+	missing := make([]t.Uid, 0, len(uids))
+	for _, uid := range uids {
+		if ns := settings[uid]; ns == nil || ns.Lang == "" {
+			missing = append(missing, uid)
+		}
+	}
+	if len(missing) > 0 {
+		if devices, _, err = store.Devices.GetAll(missing...); err != nil {
+			logs.Warn.Println("push: failed to load devices", err)
+		}
+	}
+
+	sender := senderName(rcpt.Payload.From)
+	preview := contentPreview(&rcpt.Payload)
+	for _, uid := range uids {
+		to := rcpt.To[uid]
+		var lang string
+		if ns := settings[uid]; ns != nil {
+			lang = ns.Lang
+		}
+		if lang == "" {
+			lang = deviceLang(devices[uid])
+		}
+		if tpl := findTemplate(NotificationKind(rcpt.Payload.What, rcpt.Payload.Webrtc), lang); tpl != nil {
+			to.Title, to.Body = tpl.render(sender, preview, to.NoPreview)
+		}
+		rcpt.To[uid] = to
+	}
+}
+
+// senderName returns the full name of the user from the user's public data.
+func senderName(from string) string {
+	uid := t.ParseUserId(from)
+	if uid.IsZero() {
+		return ""
+	}
+	user, err := store.Users.Get(uid)
+	if err != nil || user == nil {
+		return ""
+	}
+	if public, ok := user.Public.(map[string]any); ok {
+		if fn, ok := public["fn"].(string); ok {
+			return fn
+		}
+	}
+	return ""
+}
+
+// contentPreview converts message content to plain text trimmed to MaxPayloadLength.
+func contentPreview(pl *Payload) string {
+	if pl.What != ActMsg || pl.Content == nil || pl.Webrtc != "" {
+		return ""
+	}
+	text, err := drafty.PlainText(pl.Content)
+	if err != nil {
+		return ""
+	}
+	if len(text) > MaxPayloadLength {
+		if runes := []rune(text); len(runes) > MaxPayloadLength {
+			text = string(runes[:MaxPayloadLength]) + "…"
+		}
+	}
+	return text
+}
+
+// deviceLang returns the language of the most recently active device.
+func deviceLang(devices []t.DeviceDef) string {
+	var lang string
+	var lastSeen int64
+	for i := range devices {
+		if devices[i].Lang != "" && devices[i].LastSeen.UnixMilli() >= lastSeen {
+			lang = devices[i].Lang
+			lastSeen = devices[i].LastSeen.UnixMilli()
+		}
+	}
+	return lang
+}
@@ -0,0 +1,128 @@
+package push
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+const testTemplates = `{
+	"enabled": true,
+	"default_lang": "en",
+	"langs": {
+		"en": {
+			"msg": {"title": "$sender", "body": "$preview", "body_no_preview": "New message"},
+			"sub": {"title": "New chat", "body": "$sender started a chat"},
+			"call": {"title": "Missed call", "body": "$sender called you"}
+		},
+		"pt": {
+			"msg": {"title": "$sender", "body": "$preview", "body_no_preview": "Nova mensagem"}
+		},
+		"pt-BR": {
+			"msg": {"title": "$sender (BR)", "body": "$preview"}
+		}
+	}
+}`
+
+func TestFindTemplate(tt *testing.T) {
+	if ok, err := InitTemplates([]byte(testTemplates)); !ok || err != nil {
+		tt.Fatal("failed to init templates", err)
+	}
+	defer func() { templates = nil }()
+
+	for _, tc := range []struct {
+		what, lang, title string
+	}{
+		{ActMsg, "pt-BR", "$sender (BR)"},
+		{ActMsg, "pt-PT", "$sender"},
+		{ActMsg, "", "$sender"},
+		{ActSub, "pt", "New chat"},
+		{KindCall, "pt-BR", "Missed call"},
+		{ActRead, "en", ""},
+	} {
+		tpl := findTemplate(tc.what, tc.lang)
+		if (tpl == nil && tc.title != "") || (tpl != nil && tpl.Title != tc.title) {
+			tt.Errorf("%s/%s: unexpected template %+v", tc.what, tc.lang, tpl)
+		}
+	}
+
+	if kind := NotificationKind(ActMsg, CallMissed); kind != KindCall {
+		tt.Errorf("unexpected kind of missed call notification '%s'", kind)
+	}
+	if kind := NotificationKind(ActMsg, "started"); kind != ActMsg {
+		tt.Errorf("unexpected kind of call notification '%s'", kind)
+	}
+
+	if _, err := InitTemplates([]byte(`{"enabled": true, "default_lang": "fr", "langs": {"en": {}}}`)); err == nil {
+		tt.Error("expected error for missing default language")
+	}
+}
+
+func TestApplySettings(tt *testing.T) {
+	if _, err := InitTemplates([]byte(testTemplates)); err != nil {
+		tt.Fatal(err)
+	}
+	defer func() { templates = nil }()
+
+	sender, alice, bob, carol, dave := t.Uid(10), t.Uid(1), t.Uid(2), t.Uid(3), t.Uid(4)
+	ctrl := gomock.NewController(tt)
+	settings := mock_store.NewMockNotifySettingsPersistenceInterface(ctrl)
+	devices := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	users := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	store.NotifySettings, store.Devices, store.Users = settings, devices, users
+	defer func() {
+		store.NotifySettings, store.Devices, store.Users = nil, nil, nil
+		ctrl.Finish()
+	}()
+
+	settings.EXPECT().Get(gomock.Any()).Return(map[t.Uid]*t.NotifySettings{
+		alice: {User: alice.String(), Lang: "pt", NoPreview: true},
+		// Quiet from 22:00 till 07:00 in Berlin.
+		dave: {User: dave.String(), Lang: "en", QuietStart: 22 * 60, QuietEnd: 7 * 60, TimeZone: "Europe/Berlin"},
+	}, nil)
+	devices.EXPECT().GetAll(bob).Return(map[t.Uid][]t.DeviceDef{bob: {
+		{DeviceId: "old", Lang: "en", LastSeen: time.Now().Add(-time.Hour)},
+		{DeviceId: "new", Lang: "pt-BR", LastSeen: time.Now()},
+	}}, 2, nil)
+	users.EXPECT().Get(sender).Return(&t.User{Public: map[string]any{"fn": "Maria"}}, nil)
+
+	rcpt := &Receipt{
+		To: map[t.Uid]Recipient{
+			alice: {},
+			bob:   {},
+			// Online: gets a silent push.
+			carol: {Delivered: 1},
+			dave:  {},
+		},
+		Payload: Payload{What: ActMsg, Topic: "grpTest", From: sender.UserId(), Content: "Olá!"},
+	}
+	// 22:30 in Berlin.
+	applySettings(rcpt, time.Date(2026, time.January, 15, 21, 30, 0, 0, time.UTC))
+
+	if to := rcpt.To[alice]; to.Title != "Maria" || to.Body != "Nova mensagem" || !to.NoPreview {
+		tt.Errorf("unexpected alice's notification %+v", to)
+	}
+	if to := rcpt.To[bob]; to.Title != "Maria (BR)" || to.Body != "Olá!" || to.NoPreview {
+		tt.Errorf("unexpected bob's notification %+v", to)
+	}
+	if to := rcpt.To[carol]; to.Title != "" || to.Body != "" {
+		tt.Errorf("unexpected carol's notification %+v", to)
+	}
+	if to := rcpt.To[dave]; !to.Silent || to.Title != "Maria" {
+		tt.Errorf("unexpected dave's notification %+v", to)
+	}
+	if to := rcpt.To[bob]; to.Silent {
+		tt.Errorf("bob's notification is silent %+v", to)
+	}
+}
@@ -22,6 +22,7 @@ import (
 )
 
 const (
+	handlerName       = "tnpg"
 	baseTargetAddress = "https://pushgw.tinode.co/"
 	pushPath          = "pushv1"
 	subsPath          = "sub"
@@ -217,14 +218,17 @@ func sendPushes(rcpt *push.Receipt, config *configType) {
 		resp, err := postMessage(handler.pushUrl, payloads, config)
 		if err != nil {
 			logs.Warn.Println("tnpg push request failed:", err)
+			reportOutcomes(len(payloads), push.OutcomeFailed)
 			break
 		}
 		if resp.httpCode >= 300 {
 			logs.Warn.Println("tnpg push rejected:", resp.httpStatus)
+			reportOutcomes(len(payloads), push.OutcomeFailed)
 			break
 		}
 		if resp.FatalCode != "" {
 			logs.Err.Println("tnpg push failed:", resp.FatalMessage)
+			reportOutcomes(len(payloads), push.OutcomeFailed)
 			break
 		}
 		// Check for expired tokens and other errors.
@@ -240,7 +244,7 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 	if req.Channel != "" {
 		su.Devices = fcm.DevicesForUser(req.Uid)
 		su.Channel = req.Channel
-	} else if req.DeviceID != "" {
+	} else if common.IsFcmToken(req.DeviceID) {
 		su.Channels = fcm.ChannelsForUser(req.Uid)
 		su.Device = req.DeviceID
 	}
@@ -272,38 +276,54 @@ func processSubscription(req *push.ChannelReq, config *configType) {
 	handleSubResponse(resp, req, su.Devices, su.Channels)
 }
 
+// reportOutcomes reports the same outcome of count notifications.
+func reportOutcomes(count int, outcome string) {
+	for range count {
+		push.ReportOutcome(handlerName, outcome)
+	}
+}
+
 func handlePushResponse(batch *batchResponse, messages []*fcmv1.Message, uids []types.Uid) {
 	if batch.FailureCount <= 0 {
+		reportOutcomes(len(messages), push.OutcomeSent)
 		return
 	}
 
 	for i, resp := range batch.Responses {
 		switch resp.ErrorCode {
 		case "": // no error
+			push.ReportOutcome(handlerName, push.OutcomeSent)
 		case common.ErrorQuotaExceeded, common.ErrorUnavailable, common.ErrorInternal, common.ErrorUnspecified:
 			// Transient errors. Stop sending this batch.
 			logs.Warn.Println("tnpg transient failure:", resp.ErrorMessage)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
 			return
 		case common.ErrorInvalidArgument:
 			// Usually an invalid token.
 			logs.Warn.Println("tnpg invalid argument:", resp.ExtendedError, resp.ErrorMessage)
 			if strings.Contains(resp.ExtendedError, "message.token") {
+				push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
 				if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
 					logs.Warn.Println("tnpg failed to delete invalid token:", err)
 				}
+			} else {
+				push.ReportOutcome(handlerName, push.OutcomeFailed)
 			}
 		case common.ErrorSenderIDMismatch, common.ErrorThirdPartyAuth:
 			// Config errors
 			logs.Warn.Println("tnpg invalid config:", resp.ExtendedError, resp.ErrorMessage)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
 			return
 		case common.ErrorUnregistered:
 			// Token is no longer valid.
 			logs.Info.Println("tnpg invalid token:", resp.ErrorMessage, resp.ExtendedError, resp.MessageID)
+			push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
 			if err := store.Devices.Delete(uids[i], messages[i].Token); err != nil {
 				logs.Warn.Println("tnpg failed to delete invalid token:", err)
 			}
 		default:
 			logs.Warn.Println("tnpg unrecognized error:", resp.ErrorCode, resp.ErrorMessage, resp.ExtendedError, resp.Code)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
 		}
 	}
 }
@@ -348,5 +368,5 @@ func (Handler) Stop() {
 }
 
 func init() {
-	push.Register("tnpg", &handler)
+	push.Register(handlerName, &handler)
 }
@@ -0,0 +1,316 @@
+// Package unifiedpush implements push notification plugin for UnifiedPush. Notifications are posted
+// to endpoints provided by UnifiedPush distributors such as ntfy or Gotify, so Android clients
+// without Google Play services can receive them through a self-hosted push server.
+// https://unifiedpush.org/developers/spec/
+package unifiedpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/push/fcm"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Name of the handler.
+	handlerName = "unifiedpush"
+
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// Maximum size of a message accepted by UnifiedPush distributors.
+	maxMessageSize = 4096
+
+	// Timeout of one request to a push server.
+	requestTimeout = 10 * time.Second
+
+	// Default number of retries of a failed request.
+	defaultMaxRetries = 3
+	// Upper limit of the delay between retries.
+	maxRetryDelay = time.Minute
+)
+
+// Delay before the first retry, doubled on every following retry.
+var retryBaseDelay = time.Second
+
+var handler Handler
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	client *http.Client
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Hosts of push servers which are allowed as endpoints, e.g. "ntfy.sh" or "push.example.com".
+	// If empty, endpoints at any host are accepted.
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+	// Allow endpoints with plain http:// URLs, e.g. of a push server on the local network.
+	AllowInsecure bool `json:"allow_insecure,omitempty"`
+	// Number of retries of requests which failed with transient errors.
+	MaxRetries *int `json:"max_retries,omitempty"`
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.MaxRetries == nil {
+		retries := defaultMaxRetries
+		config.MaxRetries = &retries
+	} else if *config.MaxRetries < 0 {
+		return false, errors.New("unifiedpush: invalid max_retries")
+	}
+	for i, host := range config.AllowedHosts {
+		config.AllowedHosts[i] = strings.ToLower(host)
+	}
+
+	handler.client = &http.Client{
+		Timeout: requestTimeout,
+		// Endpoints are provided by clients: do not follow redirects to hosts which are not allowed.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt, &config)
+			case <-handler.channel:
+				// UnifiedPush has no topics (channels). Ignore.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+// parseEndpoint extracts the endpoint URL from the device ID and checks if it's allowed by config.
+// Returns false if the device ID is not a UnifiedPush endpoint.
+func parseEndpoint(deviceID string, config *configType) (string, bool, error) {
+	if !common.IsUnifiedPushEndpoint(deviceID) {
+		return "", false, nil
+	}
+
+	endpoint := strings.TrimPrefix(deviceID, common.UnifiedPushPrefix)
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return "", true, err
+	}
+	if parsed.Host == "" || parsed.User != nil ||
+		(parsed.Scheme != "https" && !(parsed.Scheme == "http" && config.AllowInsecure)) {
+		return "", true, errors.New("invalid endpoint URL")
+	}
+	if len(config.AllowedHosts) > 0 {
+		host := strings.ToLower(parsed.Hostname())
+		allowed := false
+		for _, h := range config.AllowedHosts {
+			if h == host {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "", true, errors.New("endpoint host is not allowed: " + host)
+		}
+	}
+	return endpoint, true, nil
+}
+
+// preparePayload serializes the push data. Content is dropped if the message is too large.
+func preparePayload(data map[string]string) ([]byte, error) {
+	payload, err := json.Marshal(data)
+	if err != nil || len(payload) <= maxMessageSize {
+		return payload, err
+	}
+	data = maps.Clone(data)
+	delete(data, "content")
+	delete(data, "rc")
+	return json.Marshal(data)
+}
+
+// postMessage sends one message to the endpoint. Returns HTTP status code and the delay requested
+// by the server with the Retry-After header.
+func postMessage(endpoint string, payload []byte) (int, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxMessageSize))
+
+	var retryAfter time.Duration
+	if val := resp.Header.Get("Retry-After"); val != "" {
+		if sec, err := strconv.Atoi(val); err == nil && sec > 0 {
+			retryAfter = time.Duration(sec) * time.Second
+		}
+	}
+	return resp.StatusCode, retryAfter, nil
+}
+
+// isTransient checks if the request may succeed when retried.
+func isTransient(code int) bool {
+	return code == 0 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout ||
+		code >= http.StatusInternalServerError
+}
+
+// deliver sends the message retrying transient failures with exponential backoff.
+// Returns the status code of the last attempt.
+func deliver(endpoint string, payload []byte, maxRetries int) int {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		code, retryAfter, err := postMessage(endpoint, payload)
+		if err != nil {
+			logs.Warn.Println("unifiedpush push request failed:", err)
+		}
+		if !isTransient(code) || attempt >= maxRetries {
+			return code
+		}
+
+		wait := delay
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > maxRetryDelay {
+			wait = maxRetryDelay
+		}
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+func sendPushes(rcpt *push.Receipt, config *configType) {
+	if len(rcpt.To) == 0 {
+		// Channel pushes are not supported by UnifiedPush.
+		return
+	}
+
+	data, err := fcm.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("unifiedpush push: could not parse payload:", err)
+		return
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("unifiedpush push: db error", err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+
+	for uid, devList := range devices {
+		_, userData := common.DataForUser(data, rcpt.Payload.Topic, uid, rcpt.To[uid])
+		var payload []byte
+
+		for i := range devList {
+			d := &devList[i]
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+			endpoint, ok, err := parseEndpoint(d.DeviceId, config)
+			if !ok {
+				continue
+			}
+			if err != nil {
+				// Endpoint is not usable. Keep it: the config may change.
+				logs.Warn.Println("unifiedpush:", err, uid.UserId())
+				continue
+			}
+			if payload == nil {
+				if payload, err = preparePayload(userData); err != nil {
+					logs.Warn.Println("unifiedpush: failed to create payload", err)
+					break
+				}
+			}
+
+			code := deliver(endpoint, payload, *config.MaxRetries)
+			switch {
+			case code >= http.StatusOK && code < http.StatusMultipleChoices:
+				push.ReportOutcome(handlerName, push.OutcomeSent)
+			case code == http.StatusNotFound || code == http.StatusGone:
+				// The app was unregistered from the distributor. Delete the endpoint.
+				logs.Info.Println("unifiedpush endpoint is gone:", uid.UserId())
+				push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
+				if err := store.Devices.Delete(uid, d.DeviceId); err != nil {
+					logs.Warn.Println("unifiedpush failed to delete endpoint:", err)
+				}
+			default:
+				logs.Warn.Println("unifiedpush push failed:", code, uid.UserId())
+				push.ReportOutcome(handlerName, push.OutcomeFailed)
+			}
+		}
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to FCM topics. UnifiedPush has no topics,
+// the requests are ignored.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register(handlerName, &handler)
+}
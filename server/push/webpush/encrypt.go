@@ -0,0 +1,180 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/push/common"
+)
+
+// Message encryption for Web Push, RFC 8291, and VAPID, RFC 8292.
+
+const (
+	// Record size of aes128gcm content coding. A single record is used.
+	recordSize = 4096
+	// Size of the salt of content encryption.
+	saltSize = 16
+	// Overhead of the aes128gcm header: salt, record size, key ID length and the key ID (public key).
+	headerSize = saltSize + 4 + 1 + 65
+)
+
+// subscription is a Web Push subscription as reported by the browser, PushSubscription.toJSON().
+type subscription struct {
+	Endpoint string `json:"endpoint"`
+	// Time when the subscription expires, milliseconds since epoch, or nil.
+	ExpirationTime *int64 `json:"expirationTime,omitempty"`
+	Keys           struct {
+		// Public key of the user agent, P-256 point in uncompressed form.
+		P256dh string `json:"p256dh"`
+		// Authentication secret.
+		Auth string `json:"auth"`
+	} `json:"keys"`
+
+	// Decoded keys.
+	uaPublic   *ecdh.PublicKey
+	authSecret []byte
+}
+
+// decodeBase64 decodes base64 strings with or without padding, standard or URL-safe.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// parseSubscription parses the device ID reported by the client. Returns nil if the device ID is not
+// a Web Push subscription.
+func parseSubscription(deviceID string) (*subscription, error) {
+	if !common.IsWebPushSubscription(deviceID) {
+		return nil, nil
+	}
+
+	var sub subscription
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(deviceID, common.WebPushPrefix)), &sub); err != nil {
+		return nil, err
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, errors.New("invalid endpoint")
+	}
+	key, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	if sub.uaPublic, err = ecdh.P256().NewPublicKey(key); err != nil {
+		return nil, err
+	}
+	if sub.authSecret, err = decodeBase64(sub.Keys.Auth); err != nil {
+		return nil, err
+	}
+	if len(sub.authSecret) != 16 {
+		return nil, errors.New("invalid auth secret")
+	}
+	return &sub, nil
+}
+
+// isExpired checks if the subscription has expired.
+func (sub *subscription) isExpired(now time.Time) bool {
+	return sub.ExpirationTime != nil && *sub.ExpirationTime > 0 && *sub.ExpirationTime < now.UnixMilli()
+}
+
+// encrypt encrypts the payload for the subscription using aes128gcm content coding.
+func (sub *subscription) encrypt(plaintext []byte) ([]byte, error) {
+	if len(plaintext)+headerSize+1+16 > recordSize {
+		return nil, errors.New("payload too large")
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWithKeys(plaintext, sub.uaPublic, sub.authSecret, asPrivate, salt)
+}
+
+func encryptWithKeys(plaintext []byte, uaPublic *ecdh.PublicKey, authSecret []byte,
+	asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := "WebPush: info\x00" + string(uaPublic.Bytes()) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// The only record is the last one: padding delimiter 0x02.
+	record := append(append([]byte{}, plaintext...), 2)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+// parseVapidKey creates the signing key from the private key encoded as base64url, as generated
+// by most Web Push libraries.
+func parseVapidKey(privateKey string) (*ecdsa.PrivateKey, []byte, error) {
+	raw, err := decodeBase64(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	public := key.PublicKey().Bytes()
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}, public, nil
+}
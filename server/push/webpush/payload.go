@@ -0,0 +1,117 @@
+package webpush
+
+import (
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/push/fcm"
+	"github.com/tinode/chat/server/store"
+	t "github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// TTL of a regular push notification in seconds.
+	defaultTimeToLive = 3600
+
+	urgencyHigh   = "high"
+	urgencyNormal = "normal"
+	urgencyLow    = "low"
+)
+
+// Topic header may contain at most 32 characters of the URL-safe base64 alphabet.
+var topicHeaderRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// notification is a single request to a push service.
+type notification struct {
+	uid t.Uid
+	// Device ID as reported by the client.
+	deviceID string
+	// Parsed subscription or nil if the subscription is invalid or expired.
+	sub     *subscription
+	urgency string
+	// Notifications with the same topic replace each other while undelivered.
+	topic   string
+	payload []byte
+}
+
+// prepareNotifications creates notifications for devices with Web Push subscriptions of the receipt's
+// recipients. Invalid and expired subscriptions are returned with nil sub to be deleted.
+func prepareNotifications(rcpt *push.Receipt, now time.Time) []*notification {
+	if len(rcpt.To) == 0 {
+		// Channel pushes are not supported by Web Push.
+		return nil
+	}
+
+	data, err := fcm.PayloadToData(&rcpt.Payload)
+	if err != nil {
+		logs.Warn.Println("webpush push: could not parse payload:", err)
+		return nil
+	}
+
+	uids := make([]t.Uid, 0, len(rcpt.To))
+	// Devices which were online in the topic when the message was sent.
+	skipDevices := make(map[string]struct{})
+	for uid, to := range rcpt.To {
+		uids = append(uids, uid)
+		for _, deviceID := range to.Devices {
+			skipDevices[deviceID] = struct{}{}
+		}
+	}
+	devices, count, err := store.Devices.GetAll(uids...)
+	if err != nil {
+		logs.Warn.Println("webpush push: db error", err)
+		return nil
+	}
+	if count == 0 {
+		return nil
+	}
+
+	urgency := urgencyHigh
+	switch rcpt.Payload.What {
+	case push.ActSub:
+		urgency = urgencyNormal
+	case push.ActRead:
+		urgency = urgencyLow
+	}
+
+	var notifications []*notification
+	for uid, devList := range devices {
+		topic, userData := common.DataForUser(data, rcpt.Payload.Topic, uid, rcpt.To[uid])
+		var payload []byte
+
+		for i := range devList {
+			d := &devList[i]
+			if _, ok := skipDevices[d.DeviceId]; ok {
+				continue
+			}
+			sub, err := parseSubscription(d.DeviceId)
+			if sub == nil && err == nil {
+				// Not a Web Push subscription.
+				continue
+			}
+			n := &notification{uid: uid, deviceID: d.DeviceId}
+			if err != nil {
+				logs.Warn.Println("webpush: invalid subscription", err)
+			} else if !sub.isExpired(now) {
+				if payload == nil {
+					if payload, err = json.Marshal(userData); err != nil {
+						logs.Warn.Println("webpush: failed to create payload", err)
+						break
+					}
+				}
+				n.sub = sub
+				n.urgency = urgency
+				if topicHeaderRegexp.MatchString(topic) {
+					n.topic = topic
+				}
+				n.payload = payload
+			}
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications
+}
@@ -0,0 +1,264 @@
+// Package webpush implements push notification plugin for the Web Push protocol. Notifications are
+// sent directly to the push services of browsers without FCM, authenticated with VAPID keys.
+// https://www.rfc-editor.org/rfc/rfc8030, https://www.rfc-editor.org/rfc/rfc8291,
+// https://www.rfc-editor.org/rfc/rfc8292
+package webpush
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+)
+
+const (
+	// Name of the handler.
+	handlerName = "webpush"
+
+	// Size of the input channel buffer.
+	bufferSize = 1024
+
+	// VAPID tokens must not be valid for longer than 24 hours.
+	vapidTokenExpiration = 12 * time.Hour
+	// VAPID tokens are reused for this long.
+	vapidTokenLifetime = time.Hour
+
+	// Timeout of one request to a push service.
+	requestTimeout = 10 * time.Second
+)
+
+var handler Handler
+
+// Handler represents the push handler; implements push.PushHandler interface.
+type Handler struct {
+	input   chan *push.Receipt
+	channel chan *push.ChannelReq
+	stop    chan bool
+
+	client *http.Client
+	signer *vapidSigner
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// VAPID private key: P-256 scalar encoded as base64url.
+	PrivateKey string `json:"private_key"`
+	// Contact of the application server operator, "mailto:" or "https:" URL.
+	Subject string `json:"subject"`
+	// Time in seconds the push service keeps undelivered notifications.
+	TimeToLive int `json:"time_to_live,omitempty"`
+}
+
+// vapidSigner creates VAPID tokens and caches them per push service.
+type vapidSigner struct {
+	key *ecdsa.PrivateKey
+	// Public key encoded as base64url, same as applicationServerKey of the web client.
+	publicKey string
+	subject   string
+
+	lock   sync.Mutex
+	tokens map[string]vapidToken
+}
+
+type vapidToken struct {
+	token    string
+	issuedAt time.Time
+}
+
+// Init initializes the push handler
+func (Handler) Init(jsonconf json.RawMessage) (bool, error) {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+
+	if !config.Enabled {
+		return false, nil
+	}
+
+	if config.PrivateKey == "" || config.Subject == "" {
+		return false, errors.New("webpush: missing private_key or subject")
+	}
+	if !strings.HasPrefix(config.Subject, "mailto:") && !strings.HasPrefix(config.Subject, "https:") {
+		return false, errors.New("webpush: subject must be a 'mailto:' or 'https:' URL")
+	}
+	key, public, err := parseVapidKey(config.PrivateKey)
+	if err != nil {
+		return false, errors.New("webpush: invalid private_key: " + err.Error())
+	}
+
+	handler.signer = newVapidSigner(key, public, config.Subject)
+	handler.client = &http.Client{Timeout: requestTimeout}
+
+	handler.input = make(chan *push.Receipt, bufferSize)
+	handler.channel = make(chan *push.ChannelReq, bufferSize)
+	handler.stop = make(chan bool, 1)
+
+	logs.Info.Println("webpush: VAPID public key", handler.signer.publicKey)
+
+	go func() {
+		for {
+			select {
+			case rcpt := <-handler.input:
+				go sendPushes(rcpt, &config)
+			case <-handler.channel:
+				// Web Push has no topics (channels). Ignore.
+			case <-handler.stop:
+				return
+			}
+		}
+	}()
+
+	return true, nil
+}
+
+func newVapidSigner(key *ecdsa.PrivateKey, public []byte, subject string) *vapidSigner {
+	return &vapidSigner{
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+		subject:   subject,
+		tokens:    make(map[string]vapidToken),
+	}
+}
+
+// authorization returns the value of the Authorization header for the push service at the given origin.
+func (vs *vapidSigner) authorization(audience string, now time.Time) (string, error) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	cached, ok := vs.tokens[audience]
+	if !ok || now.Sub(cached.issuedAt) >= vapidTokenLifetime {
+		token, err := common.SignJWTES256(vs.key,
+			map[string]any{"typ": "JWT", "alg": "ES256"},
+			map[string]any{"aud": audience, "exp": now.Add(vapidTokenExpiration).Unix(), "sub": vs.subject})
+		if err != nil {
+			return "", err
+		}
+		cached = vapidToken{token: token, issuedAt: now}
+		vs.tokens[audience] = cached
+	}
+	return "vapid t=" + cached.token + ", k=" + vs.publicKey, nil
+}
+
+// postNotification sends one encrypted notification to the push service. Returns HTTP status code.
+func postNotification(n *notification, ttl int) (int, error) {
+	endpoint, err := url.Parse(n.sub.Endpoint)
+	if err != nil {
+		return 0, err
+	}
+	auth, err := handler.signer.authorization(endpoint.Scheme+"://"+endpoint.Host, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	body, err := n.sub.encrypt(n.payload)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	req.Header.Set("Urgency", n.urgency)
+	if n.topic != "" {
+		req.Header.Set("Topic", n.topic)
+	}
+
+	resp, err := handler.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		logs.Warn.Println("webpush push rejected:", resp.StatusCode, strings.TrimSpace(string(reason)))
+	} else {
+		io.Copy(io.Discard, resp.Body)
+	}
+	return resp.StatusCode, nil
+}
+
+func sendPushes(rcpt *push.Receipt, config *configType) {
+	ttl := defaultTimeToLive
+	if config.TimeToLive > 0 {
+		ttl = config.TimeToLive
+	}
+
+	for _, n := range prepareNotifications(rcpt, time.Now()) {
+		if n.sub == nil {
+			// Subscription is invalid or expired. Delete it and continue sending.
+			logs.Info.Println("webpush expired or invalid subscription:", n.uid.UserId())
+			push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
+			if err := store.Devices.Delete(n.uid, n.deviceID); err != nil {
+				logs.Warn.Println("webpush failed to delete subscription:", err)
+			}
+			continue
+		}
+
+		code, err := postNotification(n, ttl)
+		if err != nil {
+			logs.Warn.Println("webpush push request failed:", err)
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
+			continue
+		}
+		switch {
+		case code < http.StatusMultipleChoices:
+			push.ReportOutcome(handlerName, push.OutcomeSent)
+		case code == http.StatusNotFound || code == http.StatusGone:
+			// Subscription has expired or was cancelled by the user. Delete it.
+			logs.Info.Println("webpush subscription is gone:", n.uid.UserId())
+			push.ReportOutcome(handlerName, push.OutcomeInvalidToken)
+			if err := store.Devices.Delete(n.uid, n.deviceID); err != nil {
+				logs.Warn.Println("webpush failed to delete subscription:", err)
+			}
+		default:
+			// Authentication errors, invalid requests, throttling and transient errors are specific to
+			// one push service. Other services may still succeed.
+			push.ReportOutcome(handlerName, push.OutcomeFailed)
+		}
+	}
+}
+
+// IsReady checks if the push handler has been initialized.
+func (Handler) IsReady() bool {
+	return handler.input != nil
+}
+
+// Push returns a channel that the server will use to send messages to.
+// If the adapter blocks, the message will be dropped.
+func (Handler) Push() chan<- *push.Receipt {
+	return handler.input
+}
+
+// Channel returns a channel for subscribing/unsubscribing devices to FCM topics. Web Push has no topics,
+// the requests are ignored.
+func (Handler) Channel() chan<- *push.ChannelReq {
+	return handler.channel
+}
+
+// Stop shuts down the handler
+func (Handler) Stop() {
+	handler.stop <- true
+}
+
+func init() {
+	push.Register(handlerName, &handler)
+}
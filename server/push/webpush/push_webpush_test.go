@@ -0,0 +1,251 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/push/common"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// userAgent is the browser side of a subscription.
+type userAgent struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+func newUserAgent() *userAgent {
+	key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	return &userAgent{key: key, auth: auth}
+}
+
+func (ua *userAgent) deviceID(endpoint string, expires int64) string {
+	sub := map[string]any{
+		"endpoint": endpoint,
+		"keys": map[string]string{
+			"p256dh": base64.RawURLEncoding.EncodeToString(ua.key.PublicKey().Bytes()),
+			"auth":   base64.RawURLEncoding.EncodeToString(ua.auth),
+		},
+	}
+	if expires != 0 {
+		sub["expirationTime"] = expires
+	}
+	data, _ := json.Marshal(sub)
+	return common.WebPushPrefix + string(data)
+}
+
+// decrypt decrypts aes128gcm content the way the browser does.
+func (ua *userAgent) decrypt(body []byte) ([]byte, error) {
+	salt := body[:saltSize]
+	if rs := binary.BigEndian.Uint32(body[saltSize:]); rs != recordSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	idlen := int(body[saltSize+4])
+	asPublic, err := ecdh.P256().NewPublicKey(body[saltSize+5 : saltSize+5+idlen])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ua.key.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+	ikm, _ := hkdf.Key(sha256.New, secret, ua.auth,
+		"WebPush: info\x00"+string(ua.key.PublicKey().Bytes())+string(asPublic.Bytes()), 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plain, err := gcm.Open(nil, nonce, body[saltSize+5+idlen:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if plain[len(plain)-1] != 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return plain[:len(plain)-1], nil
+}
+
+func TestParseSubscription(t *testing.T) {
+	ua := newUserAgent()
+	sub, err := parseSubscription(ua.deviceID("https://push.example.com/send/abc", 0))
+	if err != nil || sub == nil || sub.Endpoint != "https://push.example.com/send/abc" {
+		t.Fatalf("failed to parse subscription: %v %+v", err, sub)
+	}
+	if sub.isExpired(time.Now()) {
+		t.Error("subscription without expiration time must not expire")
+	}
+	sub, _ = parseSubscription(ua.deviceID("https://push.example.com/send/abc", time.Now().Add(-time.Minute).UnixMilli()))
+	if sub == nil || !sub.isExpired(time.Now()) {
+		t.Error("subscription must be expired")
+	}
+
+	if sub, err := parseSubscription("apns:abcd"); sub != nil || err != nil {
+		t.Error("not a web push subscription must be skipped")
+	}
+	for _, deviceID := range []string{
+		"webpush:{",
+		ua.deviceID("http://push.example.com/send/abc", 0),
+		`webpush:{"endpoint":"https://push.example.com/","keys":{"p256dh":"AAAA","auth":"AAAA"}}`,
+	} {
+		if _, err := parseSubscription(deviceID); err == nil {
+			t.Errorf("%s: expected error", deviceID)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	ua := newUserAgent()
+	sub, err := parseSubscription(ua.deviceID("https://push.example.com/send/abc", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := sub.encrypt([]byte(`{"topic":"grpTest"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ua.decrypt(body)
+	if err != nil || string(plain) != `{"topic":"grpTest"}` {
+		t.Errorf("failed to decrypt: %v '%s'", err, plain)
+	}
+
+	if _, err := sub.encrypt(make([]byte, recordSize)); err == nil {
+		t.Error("expected payload too large error")
+	}
+}
+
+func TestVapidAuthorization(t *testing.T) {
+	key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	signer, public, err := parseVapidKey(base64.RawURLEncoding.EncodeToString(key.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs := newVapidSigner(signer, public, "mailto:admin@example.com")
+
+	now := time.Now()
+	auth, err := vs.authorization("https://push.example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedKey := ", k=" + base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	if !strings.HasPrefix(auth, "vapid t=") || !strings.HasSuffix(auth, expectedKey) {
+		t.Fatal("unexpected authorization", auth)
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(auth, "vapid t="), expectedKey), ".")
+	claims := map[string]any{}
+	cl, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if len(parts) != 3 || json.Unmarshal(cl, &claims) != nil || claims["aud"] != "https://push.example.com" ||
+		claims["sub"] != "mailto:admin@example.com" || claims["exp"] == nil {
+		t.Errorf("unexpected claims %s", cl)
+	}
+
+	if cached, _ := vs.authorization("https://push.example.com", now.Add(time.Minute)); cached != auth {
+		t.Error("token is not cached")
+	}
+	if other, _ := vs.authorization("https://other.example.com", now); other == auth {
+		t.Error("token must be specific to the push service")
+	}
+}
+
+func TestSendPushes(t *testing.T) {
+	var lock sync.Mutex
+	requests := map[string]*http.Request{}
+	bodies := map[string][]byte{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/send/")
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests[id] = r
+		bodies[id] = body
+		lock.Unlock()
+		if id == "gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	key, _ := ecdh.P256().GenerateKey(rand.Reader)
+	signer, public, _ := parseVapidKey(base64.RawURLEncoding.EncodeToString(key.Bytes()))
+	handler.signer = newVapidSigner(signer, public, "mailto:admin@example.com")
+	handler.client = srv.Client()
+	defer func() { handler.client, handler.signer = nil, nil }()
+
+	live, gone := newUserAgent(), newUserAgent()
+	liveID := live.deviceID(srv.URL+"/send/live", 0)
+	goneID := gone.deviceID(srv.URL+"/send/gone", 0)
+	expiredID := live.deviceID(srv.URL+"/send/expired", time.Now().Add(-time.Hour).UnixMilli())
+
+	uid := types.Uid(1)
+	ctrl := gomock.NewController(t)
+	devices := mock_store.NewMockDevicePersistenceInterface(ctrl)
+	store.Devices = devices
+	defer func() { store.Devices = nil; ctrl.Finish() }()
+	devices.EXPECT().GetAll(uid).Return(map[types.Uid][]types.DeviceDef{uid: {
+		{DeviceId: liveID, Platform: "web"},
+		{DeviceId: goneID, Platform: "web"},
+		{DeviceId: expiredID, Platform: "web"},
+		{DeviceId: "fcm-token", Platform: "android"},
+	}}, 4, nil)
+	devices.EXPECT().Delete(uid, goneID).Return(nil)
+	devices.EXPECT().Delete(uid, expiredID).Return(nil)
+
+	sendPushes(&push.Receipt{
+		To: map[types.Uid]push.Recipient{uid: {Unread: 3}},
+		Payload: push.Payload{
+			What:        push.ActMsg,
+			Topic:       "grpTest",
+			From:        types.Uid(2).UserId(),
+			SeqId:       5,
+			ContentType: "text/plain",
+			Content:     "hello",
+		},
+	}, &configType{TimeToLive: 60})
+
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	r := requests["live"]
+	if r == nil || !strings.HasPrefix(r.Header.Get("Authorization"), "vapid t=") ||
+		r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") != "60" ||
+		r.Header.Get("Urgency") != "high" || r.Header.Get("Topic") != "grpTest" {
+		t.Fatalf("unexpected request %+v", r)
+	}
+	plain, err := live.decrypt(bodies["live"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data map[string]string
+	if err := json.Unmarshal(plain, &data); err != nil || data["topic"] != "grpTest" ||
+		data["content"] != "hello" || data["seq"] != "5" {
+		t.Errorf("unexpected payload %s", plain)
+	}
+}
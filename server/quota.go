@@ -0,0 +1,108 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Storage quotas of uploaded files. Usage of a user is the total size of
+ *    files uploaded by the user, usage of a topic is the total size of files
+ *    attached to the topic and its messages. Usage is computed from records
+ *    of files, so the quota is reclaimed as soon as unused files are garbage
+ *    collected. Uploads over the quota of the user are rejected, so are
+ *    messages with attachments over the quota of the topic. Clients check
+ *    usage with {get what="usage"}: in 'me' of the user, in other topics of
+ *    the topic. Tenants may override the quotas of the server.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Storage quotas config.
+type quotaConfig struct {
+	// Maximum total size of files uploaded by one user, bytes. 0 means unlimited.
+	User int64 `json:"user"`
+	// Maximum total size of files attached to messages of one topic, bytes. 0 means unlimited.
+	Topic int64 `json:"topic"`
+}
+
+// checkUserQuota checks if the user can upload a file of the given size. Returns
+// types.ErrQuotaExceeded if the quota would be exceeded.
+func checkUserQuota(uid types.Uid, size int64) error {
+	if uid.IsZero() {
+		return nil
+	}
+	tenant, err := userTenant(uid)
+	if err != nil {
+		return err
+	}
+	quota, _ := tenantQuotas(tenant)
+	if quota <= 0 {
+		return nil
+	}
+	used, err := store.Files.UserUsage(uid)
+	if err != nil {
+		return err
+	}
+	if used+size > quota {
+		logs.Info.Println("quota: user quota exceeded", uid.UserId(), used, size)
+		return types.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// checkTopicQuota checks if the attachments can be added to the topic of the tenant. Returns
+// types.ErrQuotaExceeded if the quota would be exceeded.
+func checkTopicQuota(tenant, topic string, attachments []string) error {
+	_, quota := tenantQuotas(tenant)
+	if quota <= 0 || len(attachments) == 0 {
+		return nil
+	}
+	used, err := store.Files.TopicUsage(topic, attachments)
+	if err != nil {
+		return err
+	}
+	if used > quota {
+		logs.Info.Println("quota: topic quota exceeded", topic, used)
+		return types.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// replyGetUsage reports storage used by the user in 'me' or by the topic in other topics.
+func (t *Topic) replyGetUsage(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	var used, limit int64
+	var err error
+	userQuota, topicQuota := tenantQuotas(t.tenant)
+	switch t.cat {
+	case types.TopicCatMe:
+		used, err = store.Files.UserUsage(asUid)
+		limit = userQuota
+	case types.TopicCatP2P, types.TopicCatGrp:
+		used, err = store.Files.TopicUsage(t.name, nil)
+		limit = topicQuota
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting usage")
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Usage:     &MsgStorageUsage{Used: used, Limit: limit},
+		},
+	})
+	return nil
+}
@@ -0,0 +1,361 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Rate limiting of client requests. Publishing, creation of topics,
+ *    subscriptions, attempts to validate credentials and discovery of contacts
+ *    are limited by token buckets. Limits are configured per authentication level. Buckets of
+ *    authenticated requests are kept per user and shared by all user's
+ *    sessions on this node, buckets of unauthenticated requests are kept per
+ *    IP address. Requests over the limit are rejected with {ctrl code=429}.
+ *
+ *    Buckets are local to the node, so a user can get more by connecting to
+ *    several cluster nodes. Optionally requests are also counted in Redis
+ *    shared by all nodes: within a window of 'window' seconds a user or an IP
+ *    address can make up to rate * window + burst requests of each kind
+ *    across the cluster. The number of sessions of a user across the cluster
+ *    can be limited too. Requests are not limited by the shared counters when
+ *    Redis is unavailable.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/cache"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+	"golang.org/x/time/rate"
+)
+
+// Kinds of rate-limited requests.
+const (
+	rateLimitPub   = "pub"
+	rateLimitTopic = "topic"
+	rateLimitSub   = "sub"
+	rateLimitCred  = "cred"
+	// Discovery of contacts by hashes is limited to prevent enumeration of phone numbers.
+	rateLimitContacts = "contacts"
+)
+
+// Buckets unused for this long are removed.
+const rateLimitIdleTimeout = 10 * time.Minute
+
+const (
+	// Default length of the window of shared request counters.
+	rateLimitDefaultWindow = 10 * time.Second
+	// Sessions of a node which stopped refreshing them for this long are not counted, e.g. the node crashed.
+	rateLimitSessionStaleAfter = 3 * time.Minute
+	// Period of refreshing sessions of this node in the shared set.
+	rateLimitSessionRefresh = time.Minute
+)
+
+// rateLimitRule is a limit of one kind of requests.
+type rateLimitRule struct {
+	// Sustained number of requests per second.
+	Rate float64 `json:"rate"`
+	// Maximum number of requests which can be made at once.
+	Burst int `json:"burst"`
+}
+
+// Rate limiter config.
+type rateLimitConfig struct {
+	Enabled bool `json:"enabled"`
+	// Limits by authentication level ("none", "anon", "auth", "root") then by kind of request
+	// ("pub", "topic", "sub", "cred"). Requests without a limit are not limited.
+	Limits map[string]map[string]*rateLimitRule `json:"limits"`
+	// Limits enforced across cluster nodes, optional.
+	Cluster *clusterRateLimitConfig `json:"cluster"`
+}
+
+// Config of limits shared by cluster nodes.
+type clusterRateLimitConfig struct {
+	// Redis server which keeps the counters, same format as the config of the cache.
+	Redis json.RawMessage `json:"redis"`
+	// Length of the window of request counters, seconds.
+	Window int `json:"window"`
+	// Maximum number of sessions of one user across the cluster, 0 for unlimited.
+	MaxUserSessions int `json:"max_user_sessions"`
+}
+
+type rateBucket struct {
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+// rateLimiter keeps token buckets of users and IP addresses.
+type rateLimiter struct {
+	// Limits by auth level then by kind of request.
+	limits map[auth.Level]map[string]rate.Limit
+	bursts map[auth.Level]map[string]int
+
+	lock    sync.Mutex
+	buckets map[string]*rateBucket
+
+	// Counters shared by cluster nodes, nil if limits are local to the node.
+	shared *cache.Redis
+	// Length of the window of shared request counters.
+	window time.Duration
+	// Maximum number of sessions of one user across the cluster.
+	maxUserSessions int
+}
+
+// newRateLimiter parses the config. Returns nil if rate limiting is disabled.
+func newRateLimiter(config *rateLimitConfig) (*rateLimiter, error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+
+	rl := &rateLimiter{
+		limits:  map[auth.Level]map[string]rate.Limit{},
+		bursts:  map[auth.Level]map[string]int{},
+		buckets: map[string]*rateBucket{},
+	}
+	for name, rules := range config.Limits {
+		level := auth.ParseAuthLevel(name)
+		if level == auth.LevelNone && name != "none" {
+			return nil, errors.New("rate limit: unknown auth level '" + name + "'")
+		}
+		rl.limits[level] = map[string]rate.Limit{}
+		rl.bursts[level] = map[string]int{}
+		for kind, rule := range rules {
+			switch kind {
+			case rateLimitPub, rateLimitTopic, rateLimitSub, rateLimitCred, rateLimitContacts:
+			default:
+				return nil, errors.New("rate limit: unknown request kind '" + kind + "'")
+			}
+			if rule == nil || rule.Rate <= 0 || rule.Burst <= 0 {
+				return nil, errors.New("rate limit: invalid limit of '" + kind + "' for '" + name + "'")
+			}
+			rl.limits[level][kind] = rate.Limit(rule.Rate)
+			rl.bursts[level][kind] = rule.Burst
+		}
+	}
+
+	if config.Cluster != nil {
+		var err error
+		if rl.shared, err = cache.NewRedis(config.Cluster.Redis, 0); err != nil {
+			return nil, errors.New("rate limit: " + err.Error())
+		}
+		rl.window = time.Duration(config.Cluster.Window) * time.Second
+		if rl.window <= 0 {
+			rl.window = rateLimitDefaultWindow
+		}
+		rl.maxUserSessions = config.Cluster.MaxUserSessions
+	}
+	return rl, nil
+}
+
+// allow consumes one token from the bucket of the given kind of request for the user or the address
+// identified by 'key'. If the bucket is empty, returns false and the time to wait for the next token.
+func (rl *rateLimiter) allow(key string, level auth.Level, kind string) (bool, time.Duration) {
+	limit, ok := rl.limits[level][kind]
+	if !ok {
+		return true, 0
+	}
+
+	now := time.Now()
+	key = level.String() + ":" + kind + ":" + key
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	bucket := rl.buckets[key]
+	if bucket == nil {
+		bucket = &rateBucket{limiter: rate.NewLimiter(limit, rl.bursts[level][kind])}
+		rl.buckets[key] = bucket
+	}
+	bucket.used = now
+	if bucket.limiter.AllowN(now, 1) {
+		return true, 0
+	}
+	wait := time.Duration(float64(time.Second) * (1 - bucket.limiter.TokensAt(now)) / float64(limit))
+	return false, wait
+}
+
+// allowShared counts the request in the counter shared by cluster nodes. If the request exceeds the limit,
+// returns false and the time until the end of the window.
+func (rl *rateLimiter) allowShared(key string, level auth.Level, kind string) (bool, time.Duration) {
+	limit, ok := rl.limits[level][kind]
+	if !ok || rl.shared == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+	start := now.Truncate(rl.window)
+	maxCount := int64(float64(limit)*rl.window.Seconds()) + int64(rl.bursts[level][kind])
+	count, err := rl.shared.Incr("rl:"+level.String()+":"+kind+":"+key+":"+strconv.FormatInt(start.Unix(), 10), rl.window)
+	if err != nil {
+		logs.Warn.Println("rate limit: shared counter failed", err)
+		return true, 0
+	}
+	if count <= maxCount {
+		return true, 0
+	}
+	return false, start.Add(rl.window).Sub(now)
+}
+
+// acquireSession adds the session to the sessions of the user shared by cluster nodes. Returns false if
+// the user has too many sessions already.
+func (rl *rateLimiter) acquireSession(uid types.Uid, sid string) bool {
+	if rl == nil || rl.shared == nil || rl.maxUserSessions <= 0 {
+		return true
+	}
+
+	key := "sess:" + uid.UserId()
+	now := time.Now()
+	count, err := rl.shared.ZCard(key, now.Add(-rateLimitSessionStaleAfter).Unix())
+	if err != nil {
+		logs.Warn.Println("rate limit: shared sessions failed", err)
+		return true
+	}
+	if count >= int64(rl.maxUserSessions) {
+		return false
+	}
+	if err = rl.shared.ZAdd(key, sid, now.Unix(), rateLimitSessionStaleAfter); err != nil {
+		logs.Warn.Println("rate limit: shared sessions failed", err)
+	}
+	return true
+}
+
+// releaseSession removes the session from the sessions of the user shared by cluster nodes.
+func (rl *rateLimiter) releaseSession(uid types.Uid, sid string) {
+	if rl == nil || rl.shared == nil || rl.maxUserSessions <= 0 || uid.IsZero() {
+		return
+	}
+	if err := rl.shared.ZRem("sess:"+uid.UserId(), sid); err != nil {
+		logs.Warn.Println("rate limit: shared sessions failed", err)
+	}
+}
+
+// refreshSessions marks sessions of this node as live in the shared sets.
+func (rl *rateLimiter) refreshSessions() {
+	sessions := map[string]types.Uid{}
+	globals.sessionStore.Range(func(sid string, s *Session) bool {
+		if !s.uid.IsZero() && !s.isMultiplex() {
+			sessions[sid] = s.uid
+		}
+		return true
+	})
+
+	now := time.Now().Unix()
+	for sid, uid := range sessions {
+		if err := rl.shared.ZAdd("sess:"+uid.UserId(), sid, now, rateLimitSessionStaleAfter); err != nil {
+			logs.Warn.Println("rate limit: shared sessions failed", err)
+			return
+		}
+	}
+}
+
+// expire removes buckets which have not been used for rateLimitIdleTimeout. Such buckets are full anyway
+// unless the rate is extremely low.
+func (rl *rateLimiter) expire() {
+	cutoff := time.Now().Add(-rateLimitIdleTimeout)
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	for key, bucket := range rl.buckets {
+		if bucket.used.Before(cutoff) {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// run periodically removes unused buckets.
+// Returns channel which can be used to stop the process.
+func (rl *rateLimiter) run() chan<- bool {
+	// Unbuffered stop channel. Whomever stops the process must wait for it to finish.
+	stop := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(rateLimitIdleTimeout)
+		defer ticker.Stop()
+		// Sessions are refreshed only if their number is limited.
+		refresh := make(<-chan time.Time)
+		if rl.shared != nil && rl.maxUserSessions > 0 {
+			refreshTicker := time.NewTicker(rateLimitSessionRefresh)
+			defer refreshTicker.Stop()
+			refresh = refreshTicker.C
+		}
+		for {
+			select {
+			case <-ticker.C:
+				rl.expire()
+			case <-refresh:
+				rl.refreshSessions()
+			case <-stop:
+				if rl.shared != nil {
+					rl.shared.Close()
+				}
+				return
+			}
+		}
+	}()
+
+	return stop
+}
+
+// rateLimitKind returns the kind of the rate-limited client request or blank if the request is not limited.
+func rateLimitKind(msg *ClientComMessage) string {
+	hasResponse := func(creds []MsgCredClient) bool {
+		for i := range creds {
+			if creds[i].Response != "" {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case msg.Pub != nil:
+		return rateLimitPub
+	case msg.Sub != nil:
+		if strings.HasPrefix(msg.Sub.Topic, "new") || strings.HasPrefix(msg.Sub.Topic, "nch") ||
+			strings.HasPrefix(msg.Sub.Topic, "ncm") {
+			return rateLimitTopic
+		}
+		return rateLimitSub
+	case msg.Login != nil && hasResponse(msg.Login.Cred),
+		msg.Acc != nil && hasResponse(msg.Acc.Cred),
+		msg.Set != nil && msg.Set.Cred != nil && msg.Set.Cred.Response != "":
+		return rateLimitCred
+	case msg.Get != nil && msg.Get.Contacts != nil:
+		return rateLimitContacts
+	}
+	return ""
+}
+
+// rateLimited checks if the request exceeds the rate limit of the session's user or IP address.
+// Returns the response to send if the request must be rejected.
+func (s *Session) rateLimited(msg *ClientComMessage) *ServerComMessage {
+	if globals.rateLimiter == nil || s.isMultiplex() {
+		// Multiplexing sessions carry requests of many users which are limited at the originating node.
+		return nil
+	}
+	kind := rateLimitKind(msg)
+	if kind == "" {
+		return nil
+	}
+
+	key := s.remoteAddr
+	if !s.uid.IsZero() {
+		key = s.uid.UserId()
+	}
+	ok, wait := globals.rateLimiter.allow(key, s.authLvl, kind)
+	if ok {
+		ok, wait = globals.rateLimiter.allowShared(key, s.authLvl, kind)
+	}
+	if ok {
+		return nil
+	}
+
+	logs.Info.Println("s.dispatch: rate limit exceeded", kind, key, s.sid)
+	resp := ErrTooManyRequestsReply(msg, msg.Timestamp)
+	resp.Ctrl.Params = map[string]any{"retry": int(math.Ceil(float64(wait) / float64(time.Millisecond)))}
+	return resp
+}
@@ -0,0 +1,180 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Emoji reactions to messages. Reactions are added and removed with {react}
+ *    or toggled with {note what="react"}. Changes are fanned out to topic
+ *    subscribers as {info what="react"} with the new count of the reaction.
+ *    Aggregated reactions are attached to {data} messages sent in response
+ *    to {get what="data"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+var errReactionScope = errors.New("reaction to a message out of scope")
+
+// reactionScope checks if the user can react to the message and returns the scope of the message.
+func (t *Topic) reactionScope(asUid types.Uid, seqId int) ([]string, error) {
+	if seqId <= 0 || seqId > t.lastID {
+		return nil, types.ErrNotFound
+	}
+
+	origMsg, err := store.Messages.GetBySeqId(t.name, seqId)
+	if err != nil {
+		return nil, err
+	}
+	if origMsg == nil || origMsg.DeletedAt != nil || origMsg.Head["unsent"] == true {
+		return nil, types.ErrNotFound
+	}
+
+	// Reactions to scoped messages are permitted to and delivered to the recipients only.
+	scope := msgScope(origMsg.Head)
+	if !t.userInMsgScope(scope, asUid) {
+		return nil, errReactionScope
+	}
+	return scope, nil
+}
+
+// handleReactBroadcast processes {react} requests: adds or removes user's reaction and informs
+// topic subscribers about the change.
+func (t *Topic) handleReactBroadcast(msg *ClientComMessage) {
+	asUid := types.ParseUserId(msg.AsUser)
+	now := types.TimeNow()
+	if t.isInactive() {
+		// Ignore request - topic is paused or being deleted.
+		msg.sess.queueOut(ErrLockedReply(msg, now))
+		return
+	}
+
+	if _, err := t.verifyChannelAccess(msg.Original); err != nil {
+		msg.sess.queueOut(ErrNotFoundReply(msg, now))
+		return
+	}
+
+	pud := t.perUser[asUid]
+	if mode := pud.modeGiven & pud.modeWant; pud.deleted || !mode.IsReader() {
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	seqId, reaction := msg.React.SeqId, msg.React.Reaction
+	scope, err := t.reactionScope(asUid, seqId)
+	if err == errReactionScope {
+		// Don't disclose the existence of the message.
+		err = types.ErrNotFound
+	}
+	if err != nil {
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	var count int
+	var changed bool
+	event := msg.React.What
+	if event == "del" {
+		count, changed, err = store.Reactions.Delete(t.name, seqId, asUid, reaction)
+	} else {
+		event = "add"
+		count, changed, err = store.Reactions.Add(t.name, seqId, asUid, reaction)
+	}
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to update reaction: %v", t.name, err)
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	if !changed {
+		// The user already has this reaction or has no such reaction to remove.
+		msg.sess.queueOut(InfoNotModifiedReply(msg, now))
+		return
+	}
+
+	msg.sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"count": count}))
+	t.broadcastReaction(msg, seqId, reaction, event, count, scope)
+}
+
+// handleReaction processes emoji reaction {note what="react"} messages: the reaction is added
+// if the user does not have it yet, removed otherwise.
+func (t *Topic) handleReaction(msg *ClientComMessage) {
+	asUid := types.ParseUserId(msg.AsUser)
+	seqId := msg.Note.SeqId
+	reaction := msg.Note.Reaction
+
+	if len(reaction) > store.MaxReactionLength {
+		return
+	}
+
+	scope, err := t.reactionScope(asUid, seqId)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: reaction failed: %v", t.name, err)
+		return
+	}
+
+	event := "add"
+	count, added, err := store.Reactions.Add(t.name, seqId, asUid, reaction)
+	if err == nil && !added {
+		event = "del"
+		count, _, err = store.Reactions.Delete(t.name, seqId, asUid, reaction)
+	}
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to toggle reaction: %v", t.name, err)
+		return
+	}
+
+	t.broadcastReaction(msg, seqId, reaction, event, count, scope)
+}
+
+// broadcastReaction informs topic subscribers about a change of a reaction to a message.
+func (t *Topic) broadcastReaction(msg *ClientComMessage, seqId int, reaction, event string, count int, scope []string) {
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic:    msg.Original,
+			From:     msg.AsUser,
+			What:     "react",
+			SeqId:    seqId,
+			Event:    event,
+			Reaction: reaction,
+			Count:    count,
+		},
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		SkipSid:   msg.sess.sid,
+		Scope:     scope,
+		sess:      msg.sess,
+	})
+}
+
+// reactionsForDelivery returns reactions to the messages keyed by message ID.
+// Errors are logged and not reported: messages are delivered without reactions.
+func reactionsForDelivery(topic string, asUid types.Uid, messages []types.Message) map[int][]MsgReaction {
+	seqIds := make([]int, 0, len(messages))
+	for i := range messages {
+		if messages[i].DeletedAt == nil {
+			seqIds = append(seqIds, messages[i].SeqId)
+		}
+	}
+
+	reactions, err := store.Reactions.GetAll(topic, asUid, seqIds)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load reactions: %v", topic, err)
+		return nil
+	}
+	if len(reactions) == 0 {
+		return nil
+	}
+
+	result := make(map[int][]MsgReaction)
+	for _, r := range reactions {
+		result[r.SeqId] = append(result[r.SeqId], MsgReaction{Val: r.Reaction, Count: r.Count, Mine: r.Mine})
+	}
+	return result
+}
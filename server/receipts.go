@@ -0,0 +1,78 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Read receipts of individual messages. Read and received markers of
+ *    subscribers are monotonic, so the receipts of a message are aggregated
+ *    from the markers cached in the topic and no per-message records are
+ *    kept. Receipts are fetched with {get what="receipts" receipts={seq:123}}.
+ *
+ *    In group topics with more subscribers than max_receipt_fanout the
+ *    {note what="read"|"recv"} are not forwarded to other subscribers.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// receiptsThrottled checks if read and received notifications should not be fanned out to topic subscribers.
+func (t *Topic) receiptsThrottled() bool {
+	return t.cat == types.TopicCatGrp && globals.maxReceiptFanout > 0 && t.subsCount() > globals.maxReceiptFanout
+}
+
+// replyGetReceipts returns subscribers who have read or received the message as {meta receipts}.
+func (t *Topic) replyGetReceipts(sess *Session, asUid types.Uid, asChan bool, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if req == nil || req.SeqId <= 0 || req.SeqId > t.lastID || req.Limit < 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid receipts query")
+	}
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for receipts")
+	}
+
+	if pud := t.perUser[asUid]; asChan || !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to get receipts by non-reader")
+	}
+
+	receipts := &MsgReceipts{SeqId: req.SeqId}
+	for uid, pud := range t.perUser {
+		if pud.isChan || pud.deleted {
+			continue
+		}
+		if pud.readID >= req.SeqId {
+			receipts.ReadCount++
+			receipts.ReadBy = append(receipts.ReadBy, uid.UserId())
+		} else if pud.recvID >= req.SeqId {
+			receipts.RecvCount++
+			receipts.RecvBy = append(receipts.RecvBy, uid.UserId())
+		}
+	}
+
+	// Make the order stable. The lists are truncated but the counts are not.
+	sort.Strings(receipts.ReadBy)
+	sort.Strings(receipts.RecvBy)
+	if req.Limit > 0 {
+		receipts.ReadBy = receipts.ReadBy[:min(len(receipts.ReadBy), req.Limit)]
+		receipts.RecvBy = receipts.RecvBy[:min(len(receipts.RecvBy), req.Limit)]
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Receipts:  receipts,
+		},
+	})
+	return nil
+}
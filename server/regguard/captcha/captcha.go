@@ -0,0 +1,124 @@
+// Package captcha implements registration guards which verify hCaptcha and reCAPTCHA tokens.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tinode/chat/server/regguard"
+)
+
+const (
+	// Maximum size of the verification response.
+	maxResponseSize = 1 << 16
+)
+
+type configType struct {
+	// Secret key issued by the CAPTCHA provider.
+	Secret string `json:"secret"`
+	// Minimum score of reCAPTCHA v3 in the range [0, 1]. Ignored if the provider returns no score.
+	MinScore float64 `json:"min_score"`
+	// Optional list of host names of the sites where the CAPTCHA may be solved.
+	Hostnames []string `json:"hostnames"`
+	// URL of the verification endpoint. Set by default.
+	VerifyURL string `json:"verify_url"`
+}
+
+type captchaGuard struct {
+	verifyURL string
+	secret    string
+	minScore  float64
+	hostnames []string
+	client    *http.Client
+}
+
+// Response of the siteverify endpoint. Both providers use the same format.
+type response struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	Hostname   string   `json:"hostname"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Init initializes the guard.
+func (g *captchaGuard) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.Secret == "" {
+		return errors.New("missing secret")
+	}
+	if config.MinScore < 0 || config.MinScore > 1 {
+		return errors.New("invalid min_score")
+	}
+
+	if config.VerifyURL != "" {
+		g.verifyURL = config.VerifyURL
+	}
+	g.secret = config.Secret
+	g.minScore = config.MinScore
+	g.hostnames = config.Hostnames
+	g.client = &http.Client{}
+	return nil
+}
+
+// Check verifies the CAPTCHA token of the request with the provider.
+func (g *captchaGuard) Check(ctx context.Context, req *regguard.Request) error {
+	if req.Captcha == "" {
+		return fmt.Errorf("%w: missing captcha", regguard.ErrRejected)
+	}
+
+	form := url.Values{}
+	form.Set("secret", g.secret)
+	form.Set("response", req.Captcha)
+	if req.RemoteAddr != "" {
+		form.Set("remoteip", req.RemoteAddr)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, g.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := g.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status " + resp.Status)
+	}
+
+	var result response
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&result); err != nil {
+		return errors.New("invalid response: " + err.Error())
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: captcha failed %v", regguard.ErrRejected, result.ErrorCodes)
+	}
+	if result.Score != nil && *result.Score < g.minScore {
+		return fmt.Errorf("%w: captcha score %.2f", regguard.ErrRejected, *result.Score)
+	}
+	if len(g.hostnames) > 0 {
+		for _, name := range g.hostnames {
+			if strings.EqualFold(name, result.Hostname) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: captcha solved at '%s'", regguard.ErrRejected, result.Hostname)
+	}
+	return nil
+}
+
+func init() {
+	regguard.Register("hcaptcha", &captchaGuard{verifyURL: "https://api.hcaptcha.com/siteverify"})
+	regguard.Register("recaptcha", &captchaGuard{verifyURL: "https://www.google.com/recaptcha/api/siteverify"})
+}
@@ -0,0 +1,138 @@
+// Package regguard defines an interface which must be implemented by registration guards
+// and runs the configured chain of guards on requests to create new accounts.
+package regguard
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const defaultTimeout = 5
+
+// ErrRejected is returned by guards which refuse the registration.
+var ErrRejected = errors.New("registration rejected")
+
+// Cred is a credential of the new account, such as email.
+type Cred struct {
+	Method string
+	Value  string
+}
+
+// Request is a request to create a new account.
+type Request struct {
+	// IP address of the client.
+	RemoteAddr string
+	// CAPTCHA token provided by the client, if any.
+	Captcha string
+	// Credentials of the new account.
+	Creds []Cred
+}
+
+// Guard is an interface which must be implemented by registration guards.
+type Guard interface {
+	// Init initializes the guard.
+	Init(jsonconf json.RawMessage) error
+
+	// Check checks the request. Returns an error wrapping ErrRejected if the account must not be created,
+	// other errors if the check failed.
+	Check(ctx context.Context, req *Request) error
+}
+
+type guardConfig struct {
+	Name   string          `json:"name"`
+	Config json.RawMessage `json:"config"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Time limit for checking one request by all guards (seconds).
+	Timeout int `json:"timeout"`
+	// Guards in the order they are applied.
+	Guards []guardConfig `json:"guards"`
+}
+
+type chainEntry struct {
+	name  string
+	guard Guard
+}
+
+var guards map[string]Guard
+
+// Guards in use in the order they are applied.
+var chain []chainEntry
+var timeout time.Duration
+
+// Register a registration guard.
+func Register(name string, g Guard) {
+	if guards == nil {
+		guards = make(map[string]Guard)
+	}
+
+	if g == nil {
+		panic("Register: registration guard is nil")
+	}
+	if _, dup := guards[name]; dup {
+		panic("Register: called twice for guard " + name)
+	}
+	guards[name] = g
+}
+
+// Init initializes the guards in the chain. Returns the names of guards in use.
+func Init(jsconfig json.RawMessage) ([]string, error) {
+	if len(jsconfig) == 0 {
+		return nil, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return nil, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return nil, nil
+	}
+
+	var names []string
+	for _, gc := range config.Guards {
+		g := guards[gc.Name]
+		if g == nil {
+			return nil, errors.New("unknown registration guard '" + gc.Name + "'")
+		}
+		for _, entry := range chain {
+			if entry.name == gc.Name {
+				return nil, errors.New("registration guard '" + gc.Name + "' is used twice")
+			}
+		}
+
+		if err := g.Init(gc.Config); err != nil {
+			return nil, errors.New(gc.Name + ": " + err.Error())
+		}
+		chain = append(chain, chainEntry{name: gc.Name, guard: g})
+		names = append(names, gc.Name)
+	}
+
+	timeout = time.Second * time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = time.Second * defaultTimeout
+	}
+	return names, nil
+}
+
+// Check runs the request through the chain of guards. Returns the name of the guard which refused
+// the request or failed, and the error. Guards after the first failure are not applied.
+func Check(req *Request) (string, error) {
+	if len(chain) == 0 {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, entry := range chain {
+		if err := entry.guard.Check(ctx, req); err != nil {
+			return entry.name, err
+		}
+	}
+	return "", nil
+}
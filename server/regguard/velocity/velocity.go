@@ -0,0 +1,106 @@
+// Package velocity implements registration guard which limits the number of accounts created
+// from one IP address in a period of time. Counts are kept in memory of each cluster node.
+package velocity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/regguard"
+)
+
+type configType struct {
+	// Maximum number of registrations from one address in the period.
+	MaxAccounts int `json:"max_accounts"`
+	// Length of the period (seconds).
+	Period int `json:"period"`
+	// Length of the prefix of IPv6 addresses to treat as one address, 64 by default.
+	IPv6Prefix int `json:"ipv6_prefix"`
+}
+
+type velocityGuard struct {
+	maxAccounts int
+	period      time.Duration
+	ipv6Mask    net.IPMask
+
+	lock sync.Mutex
+	// Times of recent registrations by address.
+	attempts map[string][]time.Time
+	// Time of the last cleanup of the map.
+	cleanedAt time.Time
+}
+
+// Init initializes the guard.
+func (g *velocityGuard) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("failed to parse config: " + err.Error())
+	}
+	if config.MaxAccounts <= 0 || config.Period <= 0 {
+		return errors.New("invalid max_accounts or period")
+	}
+	if config.IPv6Prefix == 0 {
+		config.IPv6Prefix = 64
+	} else if config.IPv6Prefix < 0 || config.IPv6Prefix > 128 {
+		return errors.New("invalid ipv6_prefix")
+	}
+
+	g.maxAccounts = config.MaxAccounts
+	g.period = time.Duration(config.Period) * time.Second
+	g.ipv6Mask = net.CIDRMask(config.IPv6Prefix, 128)
+	g.attempts = make(map[string][]time.Time)
+	return nil
+}
+
+// key converts the address to the key of the map: IPv6 addresses are truncated to the prefix.
+func (g *velocityGuard) key(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(g.ipv6Mask).String()
+}
+
+// Check counts the request and rejects it if too many accounts were registered from the same address.
+func (g *velocityGuard) Check(_ context.Context, req *regguard.Request) error {
+	if req.RemoteAddr == "" {
+		return nil
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-g.period)
+	key := g.key(req.RemoteAddr)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.cleanedAt.Before(cutoff) {
+		// Remove addresses without recent registrations.
+		for k, times := range g.attempts {
+			if times[len(times)-1].Before(cutoff) {
+				delete(g.attempts, k)
+			}
+		}
+		g.cleanedAt = now
+	}
+
+	times := g.attempts[key]
+	for len(times) > 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+	if len(times) >= g.maxAccounts {
+		g.attempts[key] = times
+		return fmt.Errorf("%w: too many registrations from %s", regguard.ErrRejected, key)
+	}
+	g.attempts[key] = append(times, now)
+	return nil
+}
+
+func init() {
+	regguard.Register("velocity", &velocityGuard{})
+}
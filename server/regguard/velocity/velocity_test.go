@@ -0,0 +1,38 @@
+package velocity
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/tinode/chat/server/regguard"
+)
+
+func TestCheck(t *testing.T) {
+	g := &velocityGuard{}
+	if err := g.Init(json.RawMessage(`{"max_accounts": 2, "period": 3600}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		if err := g.Check(t.Context(), &regguard.Request{RemoteAddr: "10.0.0.1"}); err != nil {
+			t.Fatalf("Registration %d must be accepted: %v", i, err)
+		}
+	}
+	if err := g.Check(t.Context(), &regguard.Request{RemoteAddr: "10.0.0.1"}); !errors.Is(err, regguard.ErrRejected) {
+		t.Errorf("Third registration must be rejected, got %v", err)
+	}
+	if err := g.Check(t.Context(), &regguard.Request{RemoteAddr: "10.0.0.2"}); err != nil {
+		t.Errorf("Registration from another address must be accepted: %v", err)
+	}
+
+	// Addresses in the same IPv6 /64 network are counted together.
+	for _, addr := range []string{"2001:db8::1", "2001:db8::2"} {
+		if err := g.Check(t.Context(), &regguard.Request{RemoteAddr: addr}); err != nil {
+			t.Fatalf("Registration from %s must be accepted: %v", addr, err)
+		}
+	}
+	if err := g.Check(t.Context(), &regguard.Request{RemoteAddr: "2001:db8::3"}); !errors.Is(err, regguard.ErrRejected) {
+		t.Errorf("Registration from the same /64 must be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,456 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Reports of messages and users. A user reports a message with
+ *    {report topic="grpABC" seq=123 reason="spam"} or a user with
+ *    {report user="usrXYZ" reason="abuse"}. Reports are saved with a
+ *    snapshot of the reported object and posted to the system topic 'rpt'
+ *    which lists open reports to moderators (root users). A moderator acts on
+ *    a report with {report topic="rpt" seq=45 what="delete"}: "dismiss" closes
+ *    the report, "delete" hard-deletes the reported message, "suspend"
+ *    suspends the reported user. Closed reports are removed from 'rpt'.
+ *
+ *    Reports are posted to 'rpt' by the cluster node which masters the topic.
+ *    Reports filed on other nodes are posted by a periodic background job.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Name of the system topic with open reports.
+	rptTopic = "rpt"
+	// Message header with the ID of the report posted to 'rpt'.
+	msgHeadReport = "report"
+	// Internal 'what' of server-generated {del} of a reported message.
+	delWhatReported = "reported"
+
+	// Maximum length of the reporter's comment in bytes.
+	maxReportComment = 512
+)
+
+// Accepted reasons of reports.
+var reportReasons = map[string]struct{}{
+	"spam":    {},
+	"abuse":   {},
+	"illegal": {},
+	"other":   {},
+}
+
+// validReport checks the reason and the comment of a report being filed.
+func validReport(rpt *MsgClientReport) bool {
+	_, ok := reportReasons[rpt.Reason]
+	return ok && rpt.What == "" && len(rpt.Comment) <= maxReportComment
+}
+
+// report files a report of a message or a user or, in 'rpt' topic, acts on a report.
+func (s *Session) report(msg *ClientComMessage) {
+	if !globals.reportsEnabled {
+		s.queueOut(ErrNotImplementedReply(msg, msg.Timestamp))
+		return
+	}
+
+	if msg.Original == "" {
+		// Report of a user is handled by the session: there is no topic.
+		s.reportUser(msg)
+		return
+	}
+
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	rpt := msg.Report
+	var valid bool
+	if msg.RcptTo == rptTopic {
+		valid = rpt.SeqId > 0 && (rpt.What == "dismiss" || rpt.What == "delete" || rpt.What == "suspend")
+	} else {
+		valid = rpt.SeqId > 0 && rpt.User == "" && validReport(rpt)
+	}
+	if !valid {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		return
+	}
+
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		select {
+		case sub.broadcast <- msg:
+		default:
+			// Reply with a 503 to the user.
+			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+			logs.Err.Println("s.report: sub.broacast channel full, topic ", msg.RcptTo, s.sid)
+		}
+	} else {
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		logs.Warn.Println("s.report: report in invalid topic - must subscribe first", s.sid)
+	}
+}
+
+// reportUser files a report of a user. The public data of the user is saved as evidence.
+func (s *Session) reportUser(msg *ClientComMessage) {
+	rpt := msg.Report
+	uid := types.ParseUserId(rpt.User)
+	if uid.IsZero() || uid == s.uid || rpt.SeqId != 0 || !validReport(rpt) {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		return
+	}
+
+	now := types.TimeNow()
+	user, err := store.Users.Get(uid)
+	if err == nil && user == nil {
+		err = types.ErrUserNotFound
+	}
+	if err != nil {
+		s.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	s.queueOut(fileReport(msg, &types.Report{
+		Reporter: s.uid.String(),
+		Target:   uid.String(),
+		Reason:   rpt.Reason,
+		Comment:  rpt.Comment,
+		Evidence: map[string]any{"public": user.Public, "trusted": user.Trusted},
+	}, now))
+}
+
+// handleReportBroadcast processes {report} requests: files a report of a message in the topic or, in 'rpt'
+// topic, acts on a report.
+func (t *Topic) handleReportBroadcast(msg *ClientComMessage) {
+	if t.name == rptTopic {
+		t.handleReportAction(msg)
+		return
+	}
+
+	asUid := types.ParseUserId(msg.AsUser)
+	now := types.TimeNow()
+	if t.isInactive() {
+		// Ignore request - topic is paused or being deleted.
+		msg.sess.queueOut(ErrLockedReply(msg, now))
+		return
+	}
+
+	if _, err := t.verifyChannelAccess(msg.Original); err != nil {
+		msg.sess.queueOut(ErrNotFoundReply(msg, now))
+		return
+	}
+
+	pud := t.perUser[asUid]
+	if mode := pud.modeGiven & pud.modeWant; pud.deleted || !mode.IsReader() {
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	seqId := msg.Report.SeqId
+	var origMsg *types.Message
+	var err error
+	if seqId > t.lastID {
+		err = types.ErrNotFound
+	} else if origMsg, err = store.Messages.GetBySeqId(t.name, seqId); err == nil {
+		// Messages outside of user's scope are reported as not found to avoid disclosing their existence.
+		if origMsg == nil || origMsg.DeletedAt != nil || origMsg.Head["unsent"] == true ||
+			!t.userInMsgScope(msgScope(origMsg.Head), asUid) {
+			err = types.ErrNotFound
+		}
+	}
+	if err != nil {
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	from := types.ParseUid(origMsg.From)
+	if from == asUid {
+		// Users cannot report their own messages.
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	msg.sess.queueOut(fileReport(msg, &types.Report{
+		Reporter: asUid.String(),
+		Target:   from.String(),
+		Topic:    t.name,
+		SeqId:    seqId,
+		Reason:   msg.Report.Reason,
+		Comment:  msg.Report.Comment,
+		Evidence: map[string]any{
+			"from":    from.UserId(),
+			"ts":      origMsg.CreatedAt,
+			"head":    origMsg.Head,
+			"content": origMsg.Content,
+		},
+	}, now))
+}
+
+// fileReport saves the report and posts it to 'rpt' topic. Returns the response to the reporter.
+func fileReport(msg *ClientComMessage, rpt *types.Report, now time.Time) *ServerComMessage {
+	if err := store.Reports.Create(rpt); err == types.ErrDuplicate {
+		// The user has already reported it.
+		return InfoNotModifiedReply(msg, now)
+	} else if err != nil {
+		logs.Warn.Printf("report: failed to save report by %s: %v", msg.AsUser, err)
+		return decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil)
+	}
+
+	logs.Info.Printf("report: %s filed by %s against %s, '%s'", rpt.Id, msg.AsUser,
+		types.ParseUid(rpt.Target).UserId(), rpt.Reason)
+	postReport(rpt)
+	return NoErrParamsReply(msg, now, map[string]any{"report": rpt.Id})
+}
+
+// postReport publishes the report to 'rpt' topic if the topic is mastered by this node. Otherwise
+// the report is posted by the periodic job on the master node.
+func postReport(rpt *types.Report) {
+	if globals.cluster.isRemoteTopic(rptTopic) {
+		return
+	}
+
+	claimed, err := store.Reports.Claim(rpt.Uid())
+	if err != nil {
+		logs.Warn.Printf("report: failed to claim report %s: %v", rpt.Id, err)
+		return
+	}
+	if !claimed {
+		// Already posted.
+		return
+	}
+
+	content := map[string]any{
+		"reason":   rpt.Reason,
+		"target":   types.ParseUid(rpt.Target).UserId(),
+		"evidence": rpt.Evidence,
+	}
+	if rpt.Topic != "" {
+		content["topic"] = rpt.Topic
+		content["seq"] = rpt.SeqId
+	}
+	if rpt.Comment != "" {
+		content["comment"] = rpt.Comment
+	}
+
+	msg := &ClientComMessage{
+		Pub: &MsgClientPub{
+			Topic:   rptTopic,
+			Head:    map[string]any{"mime": "application/json", msgHeadReport: rpt.Id},
+			Content: content,
+		},
+		AsUser:    types.ParseUid(rpt.Reporter).UserId(),
+		RcptTo:    rptTopic,
+		Original:  rptTopic,
+		Timestamp: types.TimeNow(),
+	}
+
+	select {
+	case globals.hub.routeCli <- msg:
+	default:
+		logs.Err.Printf("report: hub.route channel full, report %s not posted", rpt.Id)
+	}
+}
+
+// handleReportAction processes moderator's action on a report posted to 'rpt' topic.
+func (t *Topic) handleReportAction(msg *ClientComMessage) {
+	asUid := types.ParseUserId(msg.AsUser)
+	now := types.TimeNow()
+	if t.isInactive() {
+		// Ignore request - topic is paused or being deleted.
+		msg.sess.queueOut(ErrLockedReply(msg, now))
+		return
+	}
+
+	if pud, ok := t.perUser[asUid]; !ok || pud.deleted {
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	seqId := msg.Report.SeqId
+	var rptMsg *types.Message
+	var rpt *types.Report
+	var err error
+	if seqId > t.lastID {
+		err = types.ErrNotFound
+	} else if rptMsg, err = store.Messages.GetBySeqId(t.name, seqId); err == nil {
+		if rptMsg == nil || rptMsg.DeletedAt != nil {
+			err = types.ErrNotFound
+		} else if id, _ := rptMsg.Head[msgHeadReport].(string); id == "" {
+			err = types.ErrNotFound
+		} else if rpt, err = store.Reports.Get(types.ParseUid(id)); err == nil && rpt == nil {
+			err = types.ErrNotFound
+		}
+	}
+	if err != nil {
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	resp := NoErrReply(msg, now)
+	if rpt.Status == types.ReportOpen {
+		status, action := types.ReportActioned, msg.Report.What
+		switch action {
+		case "dismiss":
+			status, action = types.ReportDismissed, ""
+		case "delete":
+			if rpt.SeqId == 0 {
+				// Report of a user: there is no message to delete.
+				msg.sess.queueOut(ErrMalformedReply(msg, now))
+				return
+			}
+			if globals.cluster.isRemoteTopic(rpt.Topic) {
+				// The report remains open: the moderator may retry when the topic is mastered by this node.
+				msg.sess.queueOut(ErrServiceUnavailableReply(msg, now))
+				return
+			}
+			requestDeleteReported(rpt)
+		case "suspend":
+			if err = suspendReported(rpt); err != nil {
+				logs.Warn.Printf("report: failed to suspend user %s: %v", rpt.Target, err)
+				msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+				return
+			}
+		}
+
+		var resolved bool
+		if resolved, err = store.Reports.Resolve(rpt.Uid(), status, action, asUid); err != nil {
+			logs.Warn.Printf("report: failed to resolve report %s: %v", rpt.Id, err)
+			msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return
+		}
+		if resolved {
+			logs.Info.Printf("report: %s %s by %s", rpt.Id, status, msg.AsUser)
+		} else {
+			// Resolved by another moderator.
+			resp = InfoNotModifiedReply(msg, now)
+		}
+	} else {
+		resp = InfoNotModifiedReply(msg, now)
+	}
+
+	// The report is closed: remove it from the list of open reports.
+	if err = t.hardDeleteMessage(seqId); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to delete closed report %s: %v", t.name, rpt.Id, err)
+	}
+	msg.sess.queueOut(resp)
+}
+
+// requestDeleteReported asks the topic of the reported message to hard-delete it.
+func requestDeleteReported(rpt *types.Report) {
+	msg := &ClientComMessage{
+		Del: &MsgClientDel{
+			What:   delWhatReported,
+			DelSeq: []MsgRange{{LowId: rpt.SeqId}},
+			Hard:   true,
+		},
+		RcptTo:    rpt.Topic,
+		Original:  topicLoadOriginal(rpt.Topic),
+		Timestamp: types.TimeNow(),
+	}
+	msg.Del.Topic = msg.Original
+
+	select {
+	case globals.hub.routeCli <- msg:
+	default:
+		logs.Err.Printf("topic[%s]: hub.route channel full, reported message %d not deleted",
+			rpt.Topic, rpt.SeqId)
+	}
+}
+
+// suspendReported suspends the account of the reported user.
+func suspendReported(rpt *types.Report) error {
+	uid := types.ParseUid(rpt.Target)
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return types.ErrUserNotFound
+	}
+	changed, err := setUserState(uid, user, types.StateSuspended)
+	if changed {
+		exportAccount(user, plgActUpd)
+	}
+	return err
+}
+
+// handleReportedDelete hard-deletes a reported message on request of a moderator. The message is generated
+// by the server, not by a session.
+func (t *Topic) handleReportedDelete(msg *ClientComMessage) {
+	if t.isInactive() || len(msg.Del.DelSeq) != 1 {
+		return
+	}
+
+	seqId := msg.Del.DelSeq[0].LowId
+	if err := t.hardDeleteMessage(seqId); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to delete reported message %d: %v", t.name, seqId, err)
+	}
+}
+
+// hardDeleteMessage hard-deletes one message on behalf of the server and informs subscribers.
+func (t *Topic) hardDeleteMessage(seqId int) error {
+	if seqId <= 0 || seqId > t.lastID {
+		return types.ErrNotFound
+	}
+	ranges := []types.Range{{Low: seqId, Hi: seqId + 1}}
+
+	if err := store.Messages.DeleteList(t.name, t.delID+1, types.ZeroUid, 0, ranges); err != nil {
+		return err
+	}
+	t.journalDelete(types.ZeroUid, ranges, true, journalDelModeration)
+
+	t.delID++
+	t.unpinDeleted(ranges)
+	t.broadcastHardDelete(ranges, types.ZeroUid, t.xoriginal, "")
+	return nil
+}
+
+// postUnpostedReports posts reports filed on other cluster nodes to 'rpt' topic if it's mastered by this node.
+// Up to 'limit' reports are processed at a time.
+func postUnpostedReports(limit int) {
+	if globals.cluster.isRemoteTopic(rptTopic) {
+		return
+	}
+
+	reports, err := store.Reports.GetUnposted(limit)
+	if err != nil {
+		logs.Warn.Println("Unposted reports:", err)
+		return
+	}
+	for i := range reports {
+		postReport(&reports[i])
+	}
+}
+
+// reportsRunPoster posts unposted reports every 'period'.
+// Returns channel which can be used to stop the process.
+func reportsRunPoster(period time.Duration, blockSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the poster must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Poster of reports started with period %s, block size %d",
+			period.Round(time.Second), blockSize)
+		for {
+			select {
+			case <-ticker.C:
+				postUnpostedReports(blockSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,209 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Message retention policies. Messages older than the retention period are
+ *    either hard-deleted or anonymized by a background reaper. The period and
+ *    the action are configured for the server and may be overridden for p2p
+ *    topics, group topics and channels.
+ *
+ *    Deletion is performed by the topic like deletion of expired messages:
+ *    subscribers are informed with {pres what="del"}. Anonymized messages keep
+ *    the content but lose the sender and all headers except mime.
+ *
+ *    Tenants may override the retention period of categories with a policy.
+ *    The action of the category still applies. Categories without a policy
+ *    keep messages forever for all tenants.
+ *
+ *    Every cluster node periodically checks for old messages but processes
+ *    only those in topics mastered by the node.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Internal 'what' of server-generated {del} of messages past the retention period.
+	delWhatRetention = "retention"
+
+	// Retention actions.
+	retentionDelete    = "delete"
+	retentionAnonymize = "anonymize"
+
+	// Maximum number of messages of one topic to anonymize in one pass.
+	retentionAnonymizeLimit = 1000
+)
+
+// retentionPolicy is the retention period and the action of a topic category.
+type retentionPolicy struct {
+	period    time.Duration
+	anonymize bool
+}
+
+// msgRetentionPolicies builds retention policies of topic categories from the config.
+// Categories which keep messages forever are omitted.
+func msgRetentionPolicies(config *msgRetentionConfig) (map[string]retentionPolicy, error) {
+	for cat := range config.Categories {
+		switch cat {
+		case types.RetentionP2P, types.RetentionGrp, types.RetentionChn:
+		default:
+			return nil, errors.New("unknown topic category '" + cat + "'")
+		}
+	}
+
+	policies := make(map[string]retentionPolicy)
+	for _, cat := range []string{types.RetentionP2P, types.RetentionGrp, types.RetentionChn} {
+		days, action := config.Days, config.Action
+		if override, ok := config.Categories[cat]; ok {
+			days = override.Days
+			if override.Action != "" {
+				action = override.Action
+			}
+		}
+		if days < 0 {
+			return nil, errors.New("negative retention days of '" + cat + "'")
+		}
+		if action != "" && action != retentionDelete && action != retentionAnonymize {
+			return nil, errors.New("unknown retention action '" + action + "'")
+		}
+		if days > 0 {
+			policies[cat] = retentionPolicy{
+				period:    time.Duration(days) * 24 * time.Hour,
+				anonymize: action == retentionAnonymize,
+			}
+		}
+	}
+	return policies, nil
+}
+
+// handleMsgRetention hard-deletes messages in the range [1, msg.Del.DelSeq[0].HiId) which are past
+// the retention period. The message is generated by the reaper, not by a session.
+func (t *Topic) handleMsgRetention(msg *ClientComMessage) {
+	if t.isInactive() {
+		// Ignore request - topic is paused or being deleted. Messages will be deleted on the next run.
+		return
+	}
+	if len(msg.Del.DelSeq) != 1 {
+		return
+	}
+	t.hardDeleteOlder(msg.Del.DelSeq[0].HiId, journalDelRetention)
+}
+
+// applyRetention deletes or anonymizes messages of topics mastered by this node which are past
+// the retention period. Up to 'limit' topics of every category and tenant are processed at a time.
+func applyRetention(policies map[string]retentionPolicy, limit int) {
+	// Tenants with own retention periods are excluded from the server-wide pass. A positive period
+	// of the tenant replaces the period of the server, a negative one keeps messages forever.
+	overrides := tenantRetention()
+	excluded := make([]string, 0, len(overrides))
+	for id := range overrides {
+		excluded = append(excluded, id)
+	}
+
+	pending := 0
+	for _, cat := range []string{types.RetentionP2P, types.RetentionGrp, types.RetentionChn} {
+		policy, ok := policies[cat]
+		if !ok {
+			// Messages of the category are kept forever regardless of the tenant.
+			continue
+		}
+		pending += applyRetentionPolicy(cat, excluded, true, policy, limit)
+		for id, days := range overrides {
+			if days > 0 {
+				pending += applyRetentionPolicy(cat, []string{id}, false, retentionPolicy{
+					period:    time.Duration(days) * 24 * time.Hour,
+					anonymize: policy.anonymize,
+				}, limit)
+			}
+		}
+	}
+	statsSet("RetentionTopicsPending", int64(pending))
+}
+
+// applyRetentionPolicy applies the policy to topics of the category which belong to the given tenants
+// or, if exclude is true, to all other tenants. Returns the number of topics with old messages.
+func applyRetentionPolicy(cat string, tenants []string, exclude bool, policy retentionPolicy, limit int) int {
+	older, err := store.Messages.GetOlder(cat, tenants, exclude, types.TimeNow().Add(-policy.period),
+		!policy.anonymize, limit)
+	if err != nil {
+		logs.Warn.Printf("Message retention (%s): %v", cat, err)
+		return 0
+	}
+	for _, batch := range older {
+		if globals.cluster.isRemoteTopic(batch.Topic) {
+			// Messages will be processed by the master node of the topic.
+			continue
+		}
+
+		if policy.anonymize {
+			count, err := store.Messages.Anonymize(batch.Topic, batch.SeqId, retentionAnonymizeLimit)
+			if err != nil {
+				logs.Warn.Printf("topic[%s]: failed to anonymize old messages: %v", batch.Topic, err)
+				continue
+			}
+			statsInc("RetentionMessagesAnonymizedTotal", count)
+			continue
+		}
+
+		msg := &ClientComMessage{
+			Del: &MsgClientDel{
+				What:   delWhatRetention,
+				DelSeq: []MsgRange{{LowId: 1, HiId: batch.SeqId + 1}},
+				Hard:   true,
+			},
+			RcptTo:    batch.Topic,
+			Original:  topicLoadOriginal(batch.Topic),
+			Timestamp: types.TimeNow(),
+		}
+		msg.Del.Topic = msg.Original
+
+		select {
+		case globals.hub.routeCli <- msg:
+			statsInc("RetentionMessagesDeletedTotal", batch.Count)
+		default:
+			logs.Err.Printf("topic[%s]: hub.route channel full, old messages not deleted", batch.Topic)
+		}
+	}
+	return len(older)
+}
+
+// msgRetentionRunReaper applies retention policies every 'period'.
+// Returns channel which can be used to stop the process.
+func msgRetentionRunReaper(period time.Duration, blockSize int, policies map[string]retentionPolicy) chan<- bool {
+	// Number of messages handed to topics for deletion.
+	statsRegisterInt("RetentionMessagesDeletedTotal")
+	statsRegisterInt("RetentionMessagesAnonymizedTotal")
+	// Number of topics with old messages found in the last pass. Equal to the number of categories and
+	// tenants times the block size when the reaper is falling behind.
+	statsRegisterInt("RetentionTopicsPending")
+
+	// Unbuffered stop channel. Whomever stops the reaper must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Reaper of old messages started with period %s, block size %d, categories %d",
+			period.Round(time.Second), blockSize, len(policies))
+		for {
+			select {
+			case <-ticker.C:
+				applyRetention(policies, blockSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMsgRetentionPolicies(t *testing.T) {
+	day := 24 * time.Hour
+	policies, err := msgRetentionPolicies(&msgRetentionConfig{
+		Days:   30,
+		Action: retentionAnonymize,
+		Categories: map[string]msgRetentionPolicyConfig{
+			types.RetentionP2P: {Days: 7, Action: retentionDelete},
+			// Channels keep messages forever.
+			types.RetentionChn: {Days: 0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]retentionPolicy{
+		types.RetentionP2P: {period: 7 * day},
+		types.RetentionGrp: {period: 30 * day, anonymize: true},
+	}
+	if len(policies) != len(expected) {
+		t.Errorf("Expected %d policies, got %v", len(expected), policies)
+	}
+	for cat, policy := range expected {
+		if policies[cat] != policy {
+			t.Errorf("Category %s: expected %+v, got %+v", cat, policy, policies[cat])
+		}
+	}
+
+	for _, config := range []*msgRetentionConfig{
+		{Days: 30, Categories: map[string]msgRetentionPolicyConfig{"usr": {Days: 1}}},
+		{Days: -1},
+		{Days: 30, Categories: map[string]msgRetentionPolicyConfig{types.RetentionGrp: {Days: -1}}},
+		{Days: 30, Action: "archive"},
+		{Days: 30, Categories: map[string]msgRetentionPolicyConfig{types.RetentionGrp: {Days: 1, Action: "x"}}},
+	} {
+		if _, err := msgRetentionPolicies(config); err == nil {
+			t.Errorf("Invalid config %+v accepted", config)
+		}
+	}
+}
+
+// olderThanDays matches the time the given number of days ago.
+type olderThanDays int
+
+func (d olderThanDays) Matches(x any) bool {
+	before, ok := x.(time.Time)
+	expected := time.Now().Add(-time.Duration(d) * 24 * time.Hour)
+	return ok && before.Sub(expected).Abs() < time.Minute
+}
+
+func (d olderThanDays) String() string {
+	return fmt.Sprintf("is %d days ago", int(d))
+}
+
+func TestApplyRetention(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mm := mock_store.NewMockMessagesPersistenceInterface(ctrl)
+	prevMessages, prevHub := store.Messages, globals.hub
+	store.Messages = mm
+	hub := &Hub{routeCli: make(chan *ClientComMessage, 4)}
+	globals.hub = hub
+	defer func() {
+		store.Messages, globals.hub = prevMessages, prevHub
+		ctrl.Finish()
+	}()
+	setTestTenants(t, types.Tenant{Id: "acme", Config: types.TenantConfig{RetentionDays: 7}}, types.Tenant{Id: "globex"},
+		types.Tenant{Id: "initech", Config: types.TenantConfig{RetentionDays: -1}})
+
+	policies := map[string]retentionPolicy{
+		types.RetentionP2P: {period: 30 * 24 * time.Hour},
+		types.RetentionGrp: {period: 90 * 24 * time.Hour, anonymize: true},
+	}
+	// Server-wide policies skip tenants with own retention periods, including those keeping messages forever.
+	excluded := gomock.InAnyOrder([]string{"acme", "initech"})
+	mm.EXPECT().GetOlder(types.RetentionP2P, excluded, true, olderThanDays(30), true, 10).
+		Return([]types.RetentionBatch{{Topic: "p2pAAAAAAAAAAAAAAAAAAAAAA", SeqId: 5, Count: 3}}, nil)
+	mm.EXPECT().GetOlder(types.RetentionGrp, excluded, true, olderThanDays(90), false, 10).
+		Return([]types.RetentionBatch{{Topic: "grpAAAAAAAAAAA", SeqId: 9, Count: 2}}, nil)
+	mm.EXPECT().Anonymize("grpAAAAAAAAAAA", 9, retentionAnonymizeLimit).Return(2, nil)
+	// The period of the tenant applies to categories with a policy, with the action of the category.
+	// Channels have no policy and keep messages forever.
+	acme := []string{"acme"}
+	mm.EXPECT().GetOlder(types.RetentionP2P, acme, false, olderThanDays(7), true, 10).
+		Return([]types.RetentionBatch{{Topic: "p2pBBBBBBBBBBBBBBBBBBBBBB", SeqId: 4, Count: 4}}, nil)
+	mm.EXPECT().GetOlder(types.RetentionGrp, acme, false, olderThanDays(7), false, 10).Return(nil, nil)
+
+	applyRetention(policies, 10)
+
+	if len(hub.routeCli) != 2 {
+		t.Fatalf("Expected 2 requests to delete messages, got %d", len(hub.routeCli))
+	}
+	for _, expected := range []types.RetentionBatch{{Topic: "p2pAAAAAAAAAAAAAAAAAAAAAA", SeqId: 5},
+		{Topic: "p2pBBBBBBBBBBBBBBBBBBBBBB", SeqId: 4}} {
+		msg := <-hub.routeCli
+		if msg.RcptTo != expected.Topic || msg.sess != nil || msg.Del == nil || msg.Del.What != delWhatRetention ||
+			!msg.Del.Hard || len(msg.Del.DelSeq) != 1 || msg.Del.DelSeq[0].HiId != expected.SeqId+1 {
+			t.Errorf("Unexpected request %+v", msg)
+		}
+	}
+}
+
+func TestHandleMsgRetention(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.lastID = 10
+	helper.topic.delID = 2
+
+	// Messages are deleted up to the last message of the topic.
+	helper.mm.EXPECT().DeleteList(topicName, 3, types.ZeroUid, time.Duration(0), []types.Range{{Low: 1, Hi: 11}}).Return(nil)
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		Del: &MsgClientDel{
+			Topic:  topicName,
+			What:   delWhatRetention,
+			DelSeq: []MsgRange{{LowId: 1, HiId: 20}},
+			Hard:   true,
+		},
+		RcptTo:    topicName,
+		Original:  topicName,
+		Timestamp: types.TimeNow(),
+	})
+	helper.finish()
+
+	if helper.topic.delID != 3 {
+		t.Errorf("Expected topic delID 3, got %d", helper.topic.delID)
+	}
+	pres := helper.hubMessages[topicName]
+	if len(pres) != 1 || pres[0].Pres == nil || pres[0].Pres.What != "del" || pres[0].Pres.DelId != 3 {
+		t.Fatalf("Expected one {pres what=del} to topic subscribers, got %+v", pres)
+	}
+}
@@ -0,0 +1,219 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Roles of subscribers in group topics. Access mode bits define what the
+ *    user may do with the topic in general, roles grant granular management
+ *    capabilities on top of them:
+ *
+ *                 pin  delete  invite  desc  ban
+ *      owner       +     +       +      +     +
+ *      admin       +     +       +      +     +
+ *      moderator   +     +       +      -     +
+ *      member      -     -       -      -     -
+ *
+ *    "delete" is hard-deleting messages of other users, "desc" is changing
+ *    topic's public description, "ban" is changing access modes of other
+ *    users and removing them from the topic. Owners of the topic are always
+ *    "owner". Subscribers without a role keep the capabilities defined by
+ *    their access mode: A to pin, delete and ban, D to delete, S to invite.
+ *
+ *    - {set topic="grpX" role={user: "usrX", role: "moderator"}} assigns a
+ *      role, an empty role returns the user to the access mode. The owner
+ *      assigns any role, admins assign roles below admin to users below admin.
+ *      Online subscribers are notified with {pres topic="grpX" what="role"
+ *      src="usrX"}.
+ *    - {get topic="grpX" what="sub"} reports roles of subscribers.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Names of roles.
+const (
+	roleOwner     = "owner"
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+	roleMember    = "member"
+)
+
+// Users without the capability to delete messages of others may hard-delete at most this many
+// messages at once: every message is checked to be their own.
+const maxOwnMessagesDelete = 100
+
+// roleCap is a management capability in a group topic.
+type roleCap int
+
+const (
+	// Pin and unpin messages.
+	capPin roleCap = 1 << iota
+	// Hard-delete messages of other users.
+	capDelete
+	// Invite users to the topic.
+	capInvite
+	// Change topic's public description.
+	capDesc
+	// Change access modes of other users, remove them from the topic.
+	capBan
+)
+
+// Capabilities of roles.
+var roleCaps = map[string]roleCap{
+	roleOwner:     capPin | capDelete | capInvite | capDesc | capBan,
+	roleAdmin:     capPin | capDelete | capInvite | capDesc | capBan,
+	roleModerator: capPin | capDelete | capInvite | capBan,
+	roleMember:    0,
+}
+
+// Ranks of roles: users manage only users of a lower rank.
+var roleRanks = map[string]int{
+	roleMember:    1,
+	roleModerator: 2,
+	roleAdmin:     3,
+	roleOwner:     4,
+}
+
+// roleOf returns the role of the user in a group topic or an empty string if the user has no role.
+func (t *Topic) roleOf(uid types.Uid) string {
+	if t.cat != types.TopicCatGrp {
+		return ""
+	}
+	if t.isOwner(uid) {
+		return roleOwner
+	}
+	if role := t.perUser[uid].role; role != "" || t.parent == "" {
+		return role
+	}
+	// Users without a role in the topic have their role in the community.
+	return t.communityRole(uid)
+}
+
+// rankOf returns the rank of the user in the topic. Users without a role are ranked by the access mode.
+func (t *Topic) rankOf(uid types.Uid) int {
+	role := t.roleOf(uid)
+	if role == "" {
+		role = roleMember
+		if pud := t.perUser[uid]; (pud.modeGiven & pud.modeWant).IsAdmin() {
+			role = roleAdmin
+		}
+	}
+	return roleRanks[role]
+}
+
+// userCan checks if the user has the capability in the topic.
+func (t *Topic) userCan(uid types.Uid, capability roleCap) bool {
+	pud, ok := t.perUser[uid]
+	if !ok || pud.deleted {
+		return false
+	}
+	if role := t.roleOf(uid); role != "" {
+		return roleCaps[role]&capability != 0
+	}
+
+	mode := pud.modeGiven & pud.modeWant
+	switch capability {
+	case capPin, capBan:
+		return mode.IsAdmin()
+	case capDelete:
+		return mode.IsAdmin() || mode.IsDeleter()
+	case capInvite:
+		return mode.IsSharer()
+	case capDesc:
+		return mode.IsOwner()
+	}
+	return false
+}
+
+// canDeleteMessages checks if the user may hard-delete messages in the given ranges:
+// users without the capDelete capability delete only their own messages.
+func (t *Topic) canDeleteMessages(uid types.Uid, ranges []types.Range, count int) (bool, error) {
+	if t.cat != types.TopicCatGrp || t.userCan(uid, capDelete) {
+		return true, nil
+	}
+	if count > maxOwnMessagesDelete {
+		return false, nil
+	}
+
+	messages, err := store.Messages.GetAll(t.name, types.ZeroUid, &types.QueryOpt{IdRanges: ranges, Limit: count})
+	if err != nil {
+		return false, err
+	}
+	for i := range messages {
+		if types.ParseUid(messages[i].From) != uid {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// replySetRole assigns a role to a subscriber of a group topic.
+func (t *Topic) replySetRole(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatGrp {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for roles")
+	}
+
+	req := msg.Set.Role
+	target := types.ParseUserId(req.User)
+	if _, ok := roleCaps[req.Role]; target.IsZero() || req.Role == roleOwner || (!ok && req.Role != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.role: invalid user or role")
+	}
+
+	pud, ok := t.perUser[target]
+	if !ok || pud.deleted || pud.isChan {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return types.ErrNotFound
+	}
+
+	// Users manage roles of users below them and assign only roles below their own.
+	// Owners are managed by ownership transfer.
+	rank := t.rankOf(asUid)
+	newRank := roleRanks[req.Role]
+	if req.Role == "" {
+		newRank = roleRanks[roleMember]
+	}
+	if asChan || target == asUid || t.isOwner(target) || rank < roleRanks[roleAdmin] ||
+		t.rankOf(target) >= rank || newRank >= rank {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("set.role: permission denied")
+	}
+
+	if pud.role == req.Role {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	if err := store.Subs.Update(t.name, target, map[string]any{"Role": req.Role}); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	oldRole := pud.role
+	pud.role = req.Role
+	t.perUser[target] = pud
+	if t.community {
+		communityVersion.Add(1)
+	}
+
+	auditLog(&types.AuditRecord{
+		Event:      types.AuditRoleChange,
+		Actor:      asUid.UserId(),
+		Target:     target.UserId(),
+		Topic:      t.original(asUid),
+		RemoteAddr: sess.remoteAddr,
+		Details:    "role '" + oldRole + "' -> '" + req.Role + "'",
+	})
+
+	t.presSubsOnline("role", target.UserId(), &presParams{actor: asUid.UserId()}, nilPresFilters, sess.sid)
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
@@ -0,0 +1,114 @@
+// Package clamd implements malware scanner using ClamAV daemon. Files are sent with the INSTREAM
+// command over TCP or a unix socket.
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/scan"
+)
+
+const (
+	scannerName = "clamd"
+
+	// Size of chunks of the stream.
+	chunkSize = 64 * 1024
+)
+
+type configType struct {
+	// Address of clamd: "tcp://host:port" or "unix:///path/to/clamd.ctl".
+	Address string `json:"address"`
+}
+
+type clamdScanner struct {
+	network string
+	addr    string
+}
+
+// Init initializes the scanner.
+func (s *clamdScanner) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("clamd: failed to parse config: " + err.Error())
+	}
+	network, addr, found := strings.Cut(config.Address, "://")
+	if !found || (network != "tcp" && network != "unix") || addr == "" {
+		return errors.New("clamd: invalid address '" + config.Address + "'")
+	}
+	s.network, s.addr = network, addr
+	return nil
+}
+
+// Scan sends the content to clamd. Returns the name of the detected threat, if any.
+func (s *clamdScanner) Scan(ctx context.Context, content io.Reader) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	// Commands prefixed with 'z' are terminated with a null character.
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, rerr := io.ReadFull(content, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection when the stream exceeds StreamMaxLength, the reply tells why.
+				break
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+	if err == nil {
+		// Zero-length chunk terminates the stream.
+		_, err = conn.Write([]byte{0, 0, 0, 0})
+	}
+
+	reply, rerr := bufio.NewReader(conn).ReadString(0)
+	if rerr != nil && reply == "" {
+		if err != nil {
+			return "", err
+		}
+		return "", rerr
+	}
+	return parseReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseReply parses clamd reply like "stream: OK" or "stream: Eicar-Signature FOUND".
+func parseReply(reply string) (string, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", errors.New("clamd: " + reply)
+}
+
+func init() {
+	scan.Register(scannerName, &clamdScanner{})
+}
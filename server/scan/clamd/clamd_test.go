@@ -0,0 +1,73 @@
+package clamd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeClamd reads one INSTREAM command and replies FOUND if the stream contains "EICAR".
+func fakeClamd(t *testing.T, ln net.Listener) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+		t.Errorf("Unexpected command %q, %v", cmd, err)
+		return
+	}
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			t.Error(err)
+			return
+		}
+		if size == 0 {
+			break
+		}
+		chunk := make([]byte, size)
+		io.ReadFull(r, chunk)
+		data = append(data, chunk...)
+	}
+	if strings.Contains(string(data), "EICAR") {
+		conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+func TestScan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := &clamdScanner{}
+	if err = s.Init(json.RawMessage(`{"address":"tcp://` + ln.Addr().String() + `"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for content, expected := range map[string]string{
+		"hello":                               "",
+		strings.Repeat("x", 100000) + "EICAR": "Eicar-Signature",
+	} {
+		go fakeClamd(t, ln)
+		threat, err := s.Scan(context.Background(), strings.NewReader(content))
+		if err != nil || threat != expected {
+			t.Errorf("Expected threat '%s', got '%s', %v", expected, threat, err)
+		}
+	}
+
+	if _, err = parseReply("stream: INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("Error reply not reported")
+	}
+}
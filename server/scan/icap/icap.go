@@ -0,0 +1,164 @@
+// Package icap implements malware scanner using an ICAP server (RFC 3507), such as c-icap with
+// ClamAV, Kaspersky or Sophos scan engines. Files are sent in RESPMOD requests.
+package icap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/scan"
+)
+
+const (
+	scannerName = "icap"
+
+	defaultPort = "1344"
+
+	// Size of chunks of the body.
+	chunkSize = 64 * 1024
+)
+
+type configType struct {
+	// URL of the ICAP service, e.g. "icap://localhost:1344/avscan".
+	URL string `json:"url"`
+}
+
+type icapScanner struct {
+	url  string
+	host string
+}
+
+// Init initializes the scanner.
+func (s *icapScanner) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("icap: failed to parse config: " + err.Error())
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Scheme != "icap" || u.Host == "" {
+		return errors.New("icap: invalid URL '" + config.URL + "'")
+	}
+	s.host = u.Host
+	if u.Port() == "" {
+		s.host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	s.url = config.URL
+	return nil
+}
+
+// Scan sends the content to the ICAP server as an HTTP response to modify. Returns the name of the
+// detected threat, if any.
+func (s *icapScanner) Scan(ctx context.Context, content io.Reader) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	reqHdr := "GET /upload HTTP/1.1\r\nHost: tinode\r\n\r\n"
+	resHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nTransfer-Encoding: chunked\r\n\r\n"
+	w := bufio.NewWriterSize(conn, chunkSize+16)
+	w.WriteString("RESPMOD " + s.url + " ICAP/1.0\r\n" +
+		"Host: " + s.host + "\r\n" +
+		"Allow: 204\r\n" +
+		"Connection: close\r\n" +
+		"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(reqHdr)) +
+		", res-body=" + strconv.Itoa(len(reqHdr)+len(resHdr)) + "\r\n\r\n" +
+		reqHdr + resHdr)
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, rerr := io.ReadFull(content, buf)
+		if n > 0 {
+			w.WriteString(strconv.FormatInt(int64(n), 16) + "\r\n")
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+
+	return parseResponse(textproto.NewReader(bufio.NewReader(conn)))
+}
+
+// parseResponse reads the ICAP response. 204 means the content is not modified, i.e. clean.
+// Scanners report threats in X-Infection-Found, X-Virus-ID or X-Violations-Found headers.
+func parseResponse(r *textproto.Reader) (string, error) {
+	line, err := r.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	proto, status, _ := strings.Cut(line, " ")
+	if proto != "ICAP/1.0" {
+		return "", errors.New("icap: invalid response '" + line + "'")
+	}
+	code, _, _ := strings.Cut(status, " ")
+	header, err := r.ReadMIMEHeader()
+	if err != nil && header == nil {
+		return "", err
+	}
+
+	switch code {
+	case "204":
+		return "", nil
+	case "200":
+	default:
+		return "", errors.New("icap: " + status)
+	}
+
+	// X-Infection-Found: Type=0; Resolution=2; Threat=Eicar-Test-Signature;
+	if found := header.Get("X-Infection-Found"); found != "" {
+		for field := range strings.SplitSeq(found, ";") {
+			if name, value, ok := strings.Cut(strings.TrimSpace(field), "="); ok && name == "Threat" {
+				return value, nil
+			}
+		}
+		return found, nil
+	}
+	if virus := header.Get("X-Virus-ID"); virus != "" {
+		return virus, nil
+	}
+	if violations := header.Get("X-Violations-Found"); violations != "" {
+		// The count is followed by lines describing the violations, the name is the second one.
+		lines := strings.Fields(violations)
+		if len(lines) > 2 {
+			return lines[2], nil
+		}
+		return "unknown", nil
+	}
+
+	// The server may echo clean content in 200 instead of 204, or replace it with a block page.
+	if line, err = r.ReadLine(); err == nil && strings.HasPrefix(line, "HTTP/") {
+		if _, httpStatus, _ := strings.Cut(line, " "); !strings.HasPrefix(httpStatus, "200") {
+			return "blocked: " + httpStatus, nil
+		}
+	}
+	return "", nil
+}
+
+func init() {
+	scan.Register(scannerName, &icapScanner{})
+}
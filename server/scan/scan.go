@@ -0,0 +1,181 @@
+// Package scan defines an interface which must be implemented by malware scanners of uploaded files
+// and applies per-mime-type policies to the scan results.
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const defaultTimeout = 30
+
+// Action to take on the uploaded file.
+type Action int
+
+const (
+	// Accept the file.
+	Accept Action = iota
+	// Reject the upload.
+	Reject
+	// Store the file in quarantine: kept for review but not served.
+	Quarantine
+)
+
+// Scanner is an interface which must be implemented by malware scanners.
+type Scanner interface {
+	// Init initializes the scanner.
+	Init(jsonconf json.RawMessage) error
+
+	// Scan checks the content for malware. Returns the name of the detected threat or an empty
+	// string if the content is clean.
+	Scan(ctx context.Context, content io.Reader) (string, error)
+}
+
+// policy defines handling of files with mime types starting with Mime.
+type policy struct {
+	// Prefix of mime types, e.g. "image/". Empty prefix matches all types.
+	Mime string `json:"mime"`
+	// Don't scan the files.
+	Skip bool `json:"skip"`
+	// Action on infected files: "reject" or "quarantine".
+	Infected string `json:"infected"`
+	// Action when the file could not be scanned: "reject" or "accept".
+	Failure string `json:"failure"`
+}
+
+type configType struct {
+	// Name of the scanner to use. Scanning is disabled if blank.
+	UseScanner string `json:"use_scanner"`
+	// Timeout of scanning one file (seconds).
+	Timeout int `json:"timeout"`
+	// Policies by mime type. The first matching policy applies. Files not matched by any policy
+	// are scanned, infected files and files which failed to scan are rejected.
+	Policies []policy `json:"policies"`
+	// Individual scanner config params to pass to scanners unchanged.
+	Scanners map[string]json.RawMessage `json:"scanners"`
+}
+
+var scanners map[string]Scanner
+
+// The scanner in use.
+var scanner Scanner
+var scannerName string
+var timeout time.Duration
+var policies []policy
+
+// Register a malware scanner.
+func Register(name string, s Scanner) {
+	if scanners == nil {
+		scanners = make(map[string]Scanner)
+	}
+
+	if s == nil {
+		panic("Register: scanner is nil")
+	}
+	if _, dup := scanners[name]; dup {
+		panic("Register: called twice for scanner " + name)
+	}
+	scanners[name] = s
+}
+
+// Init initializes the configured scanner. Returns the name of the scanner in use or an empty string
+// if scanning is disabled.
+func Init(jsconfig json.RawMessage) (string, error) {
+	if len(jsconfig) == 0 {
+		return "", nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return "", errors.New("failed to parse config: " + err.Error())
+	}
+	if config.UseScanner == "" {
+		return "", nil
+	}
+
+	for _, p := range config.Policies {
+		if p.Infected != "" && p.Infected != "reject" && p.Infected != "quarantine" {
+			return "", errors.New("invalid action on infected files '" + p.Infected + "'")
+		}
+		if p.Failure != "" && p.Failure != "reject" && p.Failure != "accept" {
+			return "", errors.New("invalid action on scan failures '" + p.Failure + "'")
+		}
+	}
+
+	s := scanners[config.UseScanner]
+	if s == nil {
+		return "", errors.New("unknown scanner '" + config.UseScanner + "'")
+	}
+	if err := s.Init(config.Scanners[config.UseScanner]); err != nil {
+		return "", err
+	}
+
+	scanner = s
+	scannerName = config.UseScanner
+	policies = config.Policies
+	timeout = time.Second * time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = time.Second * defaultTimeout
+	}
+	return config.UseScanner, nil
+}
+
+// IsEnabled checks if a scanner is configured.
+func IsEnabled() bool {
+	return scanner != nil
+}
+
+// policyFor returns the policy for the mime type.
+func policyFor(mimeType string) policy {
+	for _, p := range policies {
+		if strings.HasPrefix(mimeType, p.Mime) {
+			return p
+		}
+	}
+	return policy{}
+}
+
+// Check scans the file according to the policy for its mime type. Returns the result to store with
+// the file record, nil if the file was not scanned, and the action to take.
+func Check(content io.Reader, mimeType string) (*types.FileScan, Action) {
+	if scanner == nil {
+		return nil, Accept
+	}
+	p := policyFor(mimeType)
+	if p.Skip {
+		return nil, Accept
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := &types.FileScan{Scanner: scannerName, ScannedAt: types.TimeNow()}
+	threat, err := scanner.Scan(ctx, content)
+	switch {
+	case err != nil:
+		logs.Warn.Println("scan: failed", mimeType, err)
+		result.Verdict = types.ScanError
+		result.Details = err.Error()
+		if p.Failure == "accept" {
+			return result, Accept
+		}
+		return result, Reject
+	case threat != "":
+		logs.Warn.Println("scan: malware found", mimeType, threat)
+		result.Verdict = types.ScanInfected
+		result.Details = threat
+		if p.Infected == "quarantine" {
+			return result, Quarantine
+		}
+		return result, Reject
+	}
+	result.Verdict = types.ScanClean
+	return result, Accept
+}
@@ -0,0 +1,82 @@
+package scan
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+// testScanner reports content starting with "virus" as infected and fails on "fail".
+type testScanner struct{}
+
+func (testScanner) Init(jsonconf json.RawMessage) error {
+	return nil
+}
+
+func (testScanner) Scan(ctx context.Context, content io.Reader) (string, error) {
+	data, _ := io.ReadAll(content)
+	switch {
+	case strings.HasPrefix(string(data), "virus"):
+		return "Test-Virus", nil
+	case strings.HasPrefix(string(data), "fail"):
+		return "", errors.New("unavailable")
+	}
+	return "", nil
+}
+
+func TestCheck(t *testing.T) {
+	if res, action := Check(strings.NewReader("virus"), "text/plain"); res != nil || action != Accept {
+		t.Errorf("Unconfigured scanner: expected accept, got %v, %d", res, action)
+	}
+
+	scanners = map[string]Scanner{"test": testScanner{}}
+	defer func() {
+		scanners = nil
+		scanner = nil
+		policies = nil
+	}()
+	if _, err := Init(json.RawMessage(`{"use_scanner":"test","policies":[{"mime":"audio/","infected":"bogus"}]}`)); err == nil {
+		t.Error("Invalid policy accepted")
+	}
+	if name, err := Init(json.RawMessage(`{"use_scanner":"test","policies":[` +
+		`{"mime":"image/","skip":true},` +
+		`{"mime":"application/pdf","infected":"quarantine","failure":"accept"}]}`)); err != nil || name != "test" {
+		t.Fatalf("Init failed: %s, %v", name, err)
+	}
+
+	cases := []struct {
+		content, mime string
+		verdict       string
+		action        Action
+	}{
+		{"virus", "image/png", "", Accept},
+		{"hello", "text/plain", types.ScanClean, Accept},
+		{"virus", "text/plain", types.ScanInfected, Reject},
+		{"fail", "text/plain", types.ScanError, Reject},
+		{"virus", "application/pdf", types.ScanInfected, Quarantine},
+		{"fail", "application/pdf", types.ScanError, Accept},
+	}
+	for _, c := range cases {
+		res, action := Check(strings.NewReader(c.content), c.mime)
+		verdict := ""
+		if res != nil {
+			verdict = res.Verdict
+		}
+		if verdict != c.verdict || action != c.action {
+			t.Errorf("Check(%s, %s): expected %s, %d, got %s, %d", c.content, c.mime, c.verdict, c.action,
+				verdict, action)
+		}
+	}
+}
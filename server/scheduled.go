@@ -0,0 +1,248 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Scheduled messages. A message published with head.sendAt set to a time
+ *    in the future is stored aside and published at that time on behalf of
+ *    the sender. Pending messages are listed with {get what="sched"} and
+ *    cancelled with {del what="sched" sched="ID"}.
+ *
+ *    Every cluster node periodically checks for due messages but publishes
+ *    only those addressed to topics mastered by the node. A message is
+ *    claimed by deleting it from the store, so it's published at most once.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// scheduledMsgSendAt parses the time of publishing of a scheduled message from head.sendAt.
+func scheduledMsgSendAt(head map[string]any) (time.Time, error) {
+	str, ok := head["sendAt"].(string)
+	if !ok {
+		return time.Time{}, errors.New("sendAt must be a string")
+	}
+	sendAt, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sendAt.UTC().Round(time.Millisecond), nil
+}
+
+// scheduleMessage saves a {pub} message with head.sendAt to be published later.
+func (t *Topic) scheduleMessage(msg *ClientComMessage, asUid types.Uid, attachments []string) {
+	now := types.TimeNow()
+
+	if globals.schedMsgMaxDelay == 0 {
+		msg.sess.queueOut(ErrNotImplementedReply(msg, now))
+		return
+	}
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf {
+		msg.sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return
+	}
+
+	if pud := t.perUser[asUid]; !(pud.modeWant & pud.modeGiven).IsWriter() {
+		msg.sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return
+	}
+
+	if msg.Pub.Head["webrtc"] != nil {
+		// Calls cannot be scheduled.
+		msg.sess.queueOut(ErrMalformedReply(msg, now))
+		return
+	}
+
+	sendAt, err := scheduledMsgSendAt(msg.Pub.Head)
+	if err != nil || !sendAt.After(now) {
+		msg.sess.queueOut(ErrMalformedReply(msg, now))
+		return
+	}
+	if sendAt.Sub(now) > globals.schedMsgMaxDelay {
+		msg.sess.queueOut(ErrPolicyReply(msg, now))
+		return
+	}
+
+	// Copy the header without sendAt: the published message must not be scheduled again.
+	var head map[string]any
+	for k, v := range msg.Pub.Head {
+		if k == "sendAt" {
+			continue
+		}
+		if head == nil {
+			head = make(map[string]any, len(msg.Pub.Head))
+		}
+		head[k] = v
+	}
+
+	sched := &types.ScheduledMessage{
+		Topic:       t.name,
+		From:        asUid.String(),
+		SendAt:      sendAt,
+		Head:        head,
+		Content:     msg.Pub.Content,
+		Attachments: attachments,
+	}
+	if err = store.Scheduled.Add(sched); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to schedule message: %v", t.name, err)
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return
+	}
+
+	reply := NoErrAcceptedExplicitTs(msg.Id, t.original(asUid), now, msg.Timestamp)
+	reply.Ctrl.Params = map[string]any{"sched": sched.Id, "sendAt": sendAt}
+	msg.sess.queueOut(reply)
+}
+
+// replyGetSched returns messages of the user waiting to be published in the topic.
+func (t *Topic) replyGetSched(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for scheduled messages")
+	}
+
+	msgs, err := store.Scheduled.GetAll(t.name, asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(msgs) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "sched"}))
+		return nil
+	}
+
+	result := make([]MsgScheduled, len(msgs))
+	for i := range msgs {
+		mm := &msgs[i]
+		result[i] = MsgScheduled{
+			Id:        mm.Id,
+			SendAt:    mm.SendAt,
+			Timestamp: mm.CreatedAt,
+			Head:      mm.Head,
+			Content:   sess.downgradeContent(mm.Head, mm.Content),
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Sched:     result,
+		},
+	})
+	return nil
+}
+
+// replyDelSched cancels a scheduled message of the user.
+func (t *Topic) replyDelSched(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	id := types.ParseUid(msg.Del.Sched)
+	if id.IsZero() {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid scheduled message ID")
+	}
+
+	deleted, err := store.Scheduled.Delete(t.name, asUid, id)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if !deleted {
+		// Already published, cancelled or never existed.
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return nil
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// publishScheduled hands a due message over to the topic for publishing.
+func publishScheduled(sched *types.ScheduledMessage) {
+	// Claim the message. If another node got it first, the message is not found.
+	claimed, err := store.Scheduled.Delete(sched.Topic, types.ZeroUid, sched.Uid())
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to claim scheduled message %s: %v", sched.Topic, sched.Id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	msg := &ClientComMessage{
+		Pub: &MsgClientPub{
+			Head:    sched.Head,
+			Content: sched.Content,
+		},
+		AsUser:    types.ParseUid(sched.From).UserId(),
+		RcptTo:    sched.Topic,
+		Original:  topicLoadOriginal(sched.Topic),
+		Timestamp: types.TimeNow(),
+	}
+	msg.Pub.Topic = msg.Original
+	if len(sched.Attachments) > 0 {
+		msg.Extra = &MsgClientExtra{Attachments: sched.Attachments}
+	}
+
+	select {
+	case globals.hub.routeCli <- msg:
+	default:
+		logs.Err.Printf("topic[%s]: hub.route channel full, scheduled message %s lost", sched.Topic, sched.Id)
+	}
+}
+
+// publishDueMessages publishes up to 'limit' messages which are due, addressed to topics mastered by this node.
+func publishDueMessages(limit int) {
+	msgs, err := store.Scheduled.GetDue(time.Now(), limit)
+	if err != nil {
+		logs.Warn.Println("Scheduled messages:", err)
+		return
+	}
+	for i := range msgs {
+		if globals.cluster.isRemoteTopic(msgs[i].Topic) {
+			// The message will be published by the master node of the topic.
+			continue
+		}
+		publishScheduled(&msgs[i])
+	}
+}
+
+// scheduledMsgRunPublisher checks for due scheduled messages every 'period' and publishes them.
+// Returns channel which can be used to stop the process.
+func scheduledMsgRunPublisher(period time.Duration, blockSize int) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the publisher must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes:
+		// 0.75 * period + rand(0, 0.5) * period.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Publisher of scheduled messages started with period %s, block size %d",
+			period.Round(time.Second), blockSize)
+		for {
+			select {
+			case <-ticker.C:
+				publishDueMessages(blockSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,116 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Per-message delivery scope: messages in group topics visible only to
+ *    a subset of topic members.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Message header which holds the list of user IDs the message is restricted to.
+const msgHeadScope = "scope"
+
+// Maximum number of recipients in a scoped message.
+const maxMsgScopeSize = 128
+
+// msgScope extracts the list of scoped recipients from the message header.
+// Returns nil if the message is not scoped.
+func msgScope(head map[string]any) []string {
+	if head == nil {
+		return nil
+	}
+	switch scope := head[msgHeadScope].(type) {
+	case []string:
+		return scope
+	case []any:
+		// Header read from the DB.
+		result := make([]string, 0, len(scope))
+		for _, val := range scope {
+			if uid, ok := val.(string); ok {
+				result = append(result, uid)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// normalizeMsgScope validates the scope in the header of a message being published by asUid. The
+// scope is rewritten as a sorted list of unique user IDs which always includes the sender.
+// The header is left unchanged if it has no scope.
+func (t *Topic) normalizeMsgScope(head map[string]any, asUid types.Uid) error {
+	if head == nil {
+		return nil
+	}
+	raw, ok := head[msgHeadScope]
+	if !ok {
+		return nil
+	}
+
+	// Scope makes sense in non-channel group topics only.
+	if t.cat != types.TopicCatGrp || t.isChan {
+		return errors.New("message scope not supported in this topic")
+	}
+
+	list, ok := raw.([]any)
+	if !ok || len(list) == 0 || len(list) > maxMsgScopeSize {
+		return errors.New("invalid message scope")
+	}
+
+	unique := map[string]struct{}{asUid.UserId(): {}}
+	for _, val := range list {
+		userId, _ := val.(string)
+		uid := types.ParseUserId(userId)
+		if uid.IsZero() {
+			return errors.New("invalid user ID in message scope")
+		}
+		// Recipients must be members of the topic who can read it.
+		if pud, ok := t.perUser[uid]; !ok || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+			return errors.New("message scope recipient is not a reader")
+		}
+		unique[uid.UserId()] = struct{}{}
+	}
+
+	scope := make([]string, 0, len(unique))
+	for userId := range unique {
+		scope = append(scope, userId)
+	}
+	sort.Strings(scope)
+	head[msgHeadScope] = scope
+	return nil
+}
+
+// userInMsgScope checks if the user may see a message with the given scope.
+// Topic moderators (owners and approvers) may see all messages.
+func (t *Topic) userInMsgScope(scope []string, uid types.Uid) bool {
+	if len(scope) == 0 {
+		return true
+	}
+	userId := uid.UserId()
+	for _, id := range scope {
+		if id == userId {
+			return true
+		}
+	}
+	modeWant, modeGiven := t.getPerUserAcs(uid)
+	return (modeWant & modeGiven).IsAdmin()
+}
+
+// filterByMsgScope removes messages which the user is not permitted to see.
+func (t *Topic) filterByMsgScope(messages []types.Message, uid types.Uid) []types.Message {
+	filtered := messages[:0]
+	for i := range messages {
+		if t.userInMsgScope(msgScope(messages[i].Head), uid) {
+			filtered = append(filtered, messages[i])
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,191 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Full-text search of message history: {get what="msg"}. In a group or
+ *    p2p topic the search is limited to the topic. In the 'me' topic the
+ *    search covers all topics the user can read, or one of them.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// msgSearchScope describes a topic covered by the search as seen by the user.
+type msgSearchScope struct {
+	// Topic name as seen by the user.
+	name string
+	// The user is a topic moderator and can see all scoped messages.
+	admin bool
+	// The user is a channel reader.
+	asChan bool
+}
+
+// msgSearchScopeFromSub converts user's subscription into a search scope.
+// Returns the name of the topic where messages are stored and the scope, or an empty string if
+// the topic cannot be searched.
+func msgSearchScopeFromSub(asUid types.Uid, sub *types.Subscription) (string, msgSearchScope) {
+	mode := sub.ModeGiven & sub.ModeWant
+	if !mode.IsReader() {
+		return "", msgSearchScope{}
+	}
+
+	scope := msgSearchScope{name: sub.Topic, admin: mode.IsAdmin()}
+	switch types.GetTopicCat(sub.Topic) {
+	case types.TopicCatP2P:
+		name, err := types.P2PNameForUser(asUid, sub.Topic)
+		if err != nil {
+			return "", msgSearchScope{}
+		}
+		scope.name = name
+		return sub.Topic, scope
+	case types.TopicCatGrp:
+		if types.IsChannel(sub.Topic) {
+			// Channel readers see messages of the group topic.
+			scope.asChan = true
+			scope.admin = false
+			return types.ChnToGrp(sub.Topic), scope
+		}
+		return sub.Topic, scope
+	case types.TopicCatSlf:
+		return sub.Topic, scope
+	}
+	return "", msgSearchScope{}
+}
+
+// msgSearchScopes returns the topics readable by the user in the 'me' topic, optionally limited
+// to one topic as named by the user.
+func msgSearchScopes(asUid types.Uid, topic string) (map[string]msgSearchScope, error) {
+	var opts *types.QueryOpt
+	if topic != "" {
+		if cat, ok := topicCatOf(topic); !ok {
+			return nil, types.ErrMalformed
+		} else if cat == types.TopicCatMe {
+			// P2P topic addressed by the name of the other user.
+			topic = asUid.P2PName(types.ParseUserId(topic))
+			if topic == "" {
+				return nil, types.ErrMalformed
+			}
+		}
+		opts = &types.QueryOpt{Topic: topic}
+	}
+
+	subs, err := store.Users.GetTopics(asUid, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := make(map[string]msgSearchScope, len(subs))
+	for i := range subs {
+		name, scope := msgSearchScopeFromSub(asUid, &subs[i])
+		if name == "" {
+			continue
+		}
+		if prev, ok := scopes[name]; ok && !prev.asChan {
+			// The user is both a member and a channel reader: membership takes precedence.
+			continue
+		}
+		scopes[name] = scope
+	}
+	return scopes, nil
+}
+
+// replyGetMsg searches message history for messages containing all words of the query and
+// returns them as a {meta} message.
+func (t *Topic) replyGetMsg(sess *Session, asUid types.Uid, asChan bool, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if req == nil || strings.TrimSpace(req.Search) == "" || req.User != "" || req.IfModifiedSince != nil ||
+		req.SinceId != 0 || req.BeforeId != 0 || len(req.IdRanges) > 0 ||
+		(req.Topic != "" && t.cat != types.TopicCatMe) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid message search query")
+	}
+
+	var scopes map[string]msgSearchScope
+	switch t.cat {
+	case types.TopicCatMe:
+		var err error
+		if scopes, err = msgSearchScopes(asUid, req.Topic); err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			return err
+		}
+	case types.TopicCatP2P, types.TopicCatGrp, types.TopicCatSlf:
+		userData := t.perUser[asUid]
+		mode := userData.modeGiven & userData.modeWant
+		if !mode.IsReader() {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("attempt to search messages by non-reader")
+		}
+		scopes = map[string]msgSearchScope{
+			t.name: {name: t.original(asUid), admin: mode.IsAdmin() && !asChan, asChan: asChan},
+		}
+	default:
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category to search messages")
+	}
+
+	topics := make([]string, 0, len(scopes))
+	for name := range scopes {
+		topics = append(topics, name)
+	}
+
+	messages, err := store.Messages.Search(asUid, &types.MessageSearchQuery{
+		Topics: topics,
+		Query:  req.Search,
+		Before: req.Until,
+		Limit:  req.Limit,
+	})
+	if err != nil {
+		// Search of encrypted content is not supported without the search index.
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	var found []*MsgServerData
+	for i := range messages {
+		mm := &messages[i]
+		scope := scopes[mm.Topic]
+		// Drop messages scoped to other users.
+		if list := msgScope(mm.Head); len(list) > 0 && !scope.admin && !slices.Contains(list, asUid.UserId()) {
+			continue
+		}
+
+		from := ""
+		if !scope.asChan {
+			// Don't show sender for channel readers
+			from = types.ParseUid(mm.From).UserId()
+		}
+		head, content := transformForDelivery(mm.Topic, mm.SeqId, mm.Head, mm.Content)
+		found = append(found, &MsgServerData{
+			Topic:     scope.name,
+			Head:      head,
+			SeqId:     mm.SeqId,
+			From:      from,
+			Timestamp: mm.CreatedAt,
+			Content:   sess.downgradeContent(head, content),
+		})
+	}
+
+	if len(found) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "msg"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Msgs:      found,
+		},
+	})
+	return nil
+}
@@ -11,7 +11,7 @@ package main
 
 import (
 	"container/list"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -22,9 +22,12 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/auth/refresh"
+	"github.com/tinode/chat/server/drafty"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"go.opentelemetry.io/otel/trace"
 
 	"golang.org/x/text/language"
 )
@@ -38,6 +41,9 @@ const deferredNotificationsTimeout = time.Second * 5
 
 var minSupportedVersionValue = parseVersion(minSupportedVersion)
 
+// Authenticators which may require a second step of authentication by other authenticators.
+var secondFactorSchemes = []string{"totp"}
+
 // SessionProto is the type of the wire transport.
 type SessionProto int
 
@@ -55,12 +61,18 @@ const (
 	PROXY
 	// MULTIPLEX is a multiplexing session reprsenting a connection from proxy topic to master.
 	MULTIPLEX
+	// XMPP is a connection of an XMPP client through the gateway.
+	XMPP
+	// MQTT is a connection of an MQTT client through the gateway.
+	MQTT
+	// SSE is a Server-Sent Events stream paired with HTTP POST requests.
+	SSE
 )
 
 // Session represents a single WS connection or a long polling session. A user may have multiple
 // sessions.
 type Session struct {
-	// protocol - NONE (unset), WEBSOCK, LPOLL, GRPC, PROXY, MULTIPLEX
+	// protocol - NONE (unset), WEBSOCK, LPOLL, GRPC, PROXY, MULTIPLEX, XMPP, MQTT, SSE
 	proto SessionProto
 
 	// Session ID
@@ -69,12 +81,30 @@ type Session struct {
 	// Websocket. Set only for websocket sessions.
 	ws *websocket.Conn
 
+	// Encoding of messages negotiated by websocket clients, nil for JSON.
+	wire wireCodec
+
+	// Websocket client accepts batches of messages in one frame.
+	wsBatch bool
+
+	// Recent events for resumable delivery. Set only for websocket clients which opted in.
+	outbox *sessionOutbox
+
 	// Pointer to session's record in sessionStore. Set only for Long Poll sessions.
 	lpTracker *list.Element
 
 	// gRPC handle. Set only for gRPC clients.
 	grpcnode pbx.Node_MessageLoopServer
 
+	// XMPP connection. Set only for XMPP clients.
+	xmpp *xmppConn
+
+	// MQTT connection. Set only for MQTT clients.
+	mqtt *mqttConn
+
+	// Event stream. Set only for SSE clients.
+	sse *sseStream
+
 	// Reference to the cluster node where the session has originated. Set only for cluster RPC sessions.
 	clnode *ClusterNode
 
@@ -82,9 +112,16 @@ type Session struct {
 	multi        *Session
 	proxiedTopic string
 
+	// Send messages to the proxy node in batches. Set by the master topic, multiplexing sessions only.
+	batchFanout atomic.Bool
+
 	// IP address of the client. For long polling this is the IP of the last poll.
 	remoteAddr string
 
+	// The client connected from an address blocked by network access control. Only {hi} and {login}
+	// are accepted until a user exempt from network access control logs in.
+	netRestricted bool
+
 	// User agent, a string provived by an authenticated client in {login} packet.
 	userAgent string
 
@@ -93,12 +130,20 @@ type Session struct {
 
 	// Device ID of the client
 	deviceID string
+	// ID of the registered device of the session, a string. Read/written atomically.
+	regDevice atomic.Value
 	// Platform: web, ios, android
 	platf string
+	// Drafty styles and entities supported by the client. Nil if all are supported.
+	draftyCaps map[string]bool
+
 	// Human language of the client
 	lang string
 	// Country code of the client
 	countryCode string
+	// Tenant of the session: the tenant of the user once authenticated, otherwise the tenant
+	// of the host the client connected to.
+	tenant string
 
 	// ID of the current user. Could be zero if session is not authenticated
 	// or for multiplexing sessions.
@@ -107,6 +152,9 @@ type Session struct {
 	// Authentication level - NONE (unset), ANON, AUTH, ROOT.
 	authLvl auth.Level
 
+	// Reconnection token issued to or used by the session, if any.
+	resumeToken string
+
 	// Time when the long polling session was last refreshed
 	lastTouched time.Time
 
@@ -289,12 +337,12 @@ func (s *Session) queueOutBatch(msgs []*ServerComMessage) bool {
 		return false
 	}
 
-	if s.supportsMessageBatching() {
+	if s.supportsMessageBatching() && s.outbox == nil {
 		select {
 		case s.send <- msgs:
 		default:
 			// Never block here since it may also block the topic's run() goroutine.
-			logs.Err.Println("s.queueOut: session's send queue2 full", s.sid)
+			s.log(nil).Err.Println("s.queueOut: session's send queue2 full")
 			return false
 		}
 		if s.isMultiplex() {
@@ -309,6 +357,22 @@ func (s *Session) queueOutBatch(msgs []*ServerComMessage) bool {
 	return true
 }
 
+// log returns loggers which tag records with IDs of the session, the user and the client message, if any.
+func (s *Session) log(msg *ClientComMessage) *logs.Scoped {
+	fields := logs.Fields{Sid: s.sid}
+	if !s.uid.IsZero() {
+		fields.User = s.uid.UserId()
+	}
+	if msg != nil {
+		if msg.AsUser != "" {
+			fields.User = msg.AsUser
+		}
+		fields.Topic = msg.Original
+		fields.MsgId = msg.Id
+	}
+	return logs.With(fields)
+}
+
 // queueOut attempts to send a ServerComMessage to a session write loop;
 // it fails, if the send buffer is full.
 func (s *Session) queueOut(msg *ServerComMessage) bool {
@@ -332,8 +396,9 @@ func (s *Session) queueOut(msg *ServerComMessage) bool {
 	// Record latency only on {ctrl} messages and end-user sessions.
 	if msg.Ctrl != nil && msg.Id != "" {
 		if !msg.Ctrl.Timestamp.IsZero() && !s.isCluster() {
-			duration := time.Since(msg.Ctrl.Timestamp).Milliseconds()
-			statsAddHistSample("RequestLatency", float64(duration))
+			duration := time.Since(msg.Ctrl.Timestamp)
+			statsAddHistSample("RequestLatency", float64(duration.Milliseconds()))
+			metricsRequestLatency(duration)
 		}
 		if 200 <= msg.Ctrl.Code && msg.Ctrl.Code < 600 {
 			statsInc(fmt.Sprintf("CtrlCodesTotal%dxx", msg.Ctrl.Code/100), 1)
@@ -342,13 +407,22 @@ func (s *Session) queueOut(msg *ServerComMessage) bool {
 		}
 	}
 
+	if s.outbox != nil {
+		if sent, handled := s.outbox.queue(s, msg); handled {
+			return sent
+		}
+	}
+
 	select {
 	case s.send <- msg:
 	default:
 		// Never block here since it may also block the topic's run() goroutine.
-		logs.Err.Println("s.queueOut: session's send queue full", s.sid)
+		s.log(nil).Err.Println("s.queueOut: session's send queue full")
 		return false
 	}
+	if s.proto == WEBSOCK {
+		metricsSendQueueDepth(len(s.send))
+	}
 	if s.isMultiplex() {
 		s.scheduleClusterWriteLoop()
 	}
@@ -365,7 +439,7 @@ func (s *Session) queueOutBytes(data []byte) bool {
 	select {
 	case s.send <- data:
 	default:
-		logs.Err.Println("s.queueOutBytes: session's send queue full", s.sid)
+		s.log(nil).Err.Println("s.queueOutBytes: session's send queue full")
 		return false
 	}
 	if s.isMultiplex() {
@@ -385,6 +459,11 @@ func (s *Session) maybeScheduleClusterWriteLoop() {
 }
 
 func (s *Session) detachSession(fromTopic string) {
+	if s.outbox != nil && s.outbox.isParked() {
+		// No write loop to read the channel.
+		s.delSub(fromTopic)
+		return
+	}
 	if atomic.LoadInt32(&s.terminating) == 0 {
 		s.detach <- fromTopic
 		s.maybeScheduleClusterWriteLoop()
@@ -392,6 +471,9 @@ func (s *Session) detachSession(fromTopic string) {
 }
 
 func (s *Session) stopSession(data any) {
+	if s.outboxDiscard() {
+		return
+	}
 	s.stop <- data
 	s.maybeScheduleClusterWriteLoop()
 }
@@ -419,10 +501,15 @@ func (s *Session) cleanUp(expired bool) {
 		globals.sessionStore.Delete(s)
 		s.sessionStoreLock.Unlock()
 	}
+	s.outboxRelease()
+
+	globals.rateLimiter.releaseSession(s.uid, s.sid)
 
 	s.background = false
 	s.bkgTimer.Stop()
 	s.unsubAll()
+	s.touchSessionRecord()
+	s.touchDeviceRecord()
 	// Stop the write loop.
 	s.stopSession(nil)
 }
@@ -433,7 +520,7 @@ func (s *Session) dispatchRaw(raw []byte) {
 	var msg ClientComMessage
 
 	if atomic.LoadInt32(&s.terminating) > 0 {
-		logs.Warn.Println("s.dispatch: message received on a terminating session", s.sid)
+		s.log(nil).Warn.Println("s.dispatch: message received on a terminating session")
 		s.queueOut(ErrLocked("", "", now))
 		return
 	}
@@ -450,11 +537,16 @@ func (s *Session) dispatchRaw(raw []byte) {
 		toLog = raw[:512]
 		truncated = "<...>"
 	}
-	logs.Info.Printf("in: '%s%s' sid='%s' uid='%s'", toLog, truncated, s.sid, s.uid)
+	codec := s.codec()
+	if codec.Binary() {
+		s.log(nil).Info.Printf("in: %d bytes of %s", len(raw), codec.Name())
+	} else {
+		s.log(nil).Info.Printf("in: '%s%s'", toLog, truncated)
+	}
 
-	if err := json.Unmarshal(raw, &msg); err != nil {
+	if err := codec.Unmarshal(raw, &msg); err != nil {
 		// Malformed message
-		logs.Warn.Println("s.dispatch", err, s.sid)
+		s.log(nil).Warn.Println("s.dispatch", err)
 		s.queueOut(ErrMalformed("", "", now))
 		return
 	}
@@ -484,12 +576,12 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 	} else if s.authLvl != auth.LevelRoot {
 		// Only root user can set alternative user ID and auth level values.
 		s.queueOut(ErrPermissionDenied("", "", now))
-		logs.Warn.Println("s.dispatch: non-root assigned asUser", s.sid)
+		s.log(msg).Warn.Println("s.dispatch: non-root assigned asUser")
 		return
 	} else if fromUid := types.ParseUserId(msg.Extra.AsUser); fromUid.IsZero() {
 		// Invalid msg.Extra.AsUser.
 		s.queueOut(ErrMalformed("", "", now))
-		logs.Warn.Println("s.dispatch: malformed asUser: ", msg.Extra.AsUser, s.sid)
+		s.log(msg).Warn.Println("s.dispatch: malformed asUser: ", msg.Extra.AsUser)
 		return
 	} else {
 		// Use provided msg.Extra.AsUser
@@ -513,7 +605,7 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 	checkVers := func(handler func(*ClientComMessage)) func(*ClientComMessage) {
 		return func(m *ClientComMessage) {
 			if s.ver == 0 {
-				logs.Warn.Println("s.dispatch: {hi} is missing", s.sid)
+				s.log(msg).Warn.Println("s.dispatch: {hi} is missing")
 				s.queueOut(ErrCommandOutOfSequence(m.Id, m.Original, msg.Timestamp))
 				return
 			}
@@ -525,7 +617,7 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 	checkUser := func(handler func(*ClientComMessage)) func(*ClientComMessage) {
 		return func(m *ClientComMessage) {
 			if msg.AsUser == "" {
-				logs.Warn.Println("s.dispatch: authentication required", s.sid)
+				s.log(msg).Warn.Println("s.dispatch: authentication required")
 				s.queueOut(ErrAuthRequiredReply(m, m.Timestamp))
 				return
 			}
@@ -586,10 +678,47 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		msg.Original = msg.Note.Topic
 		uaRefresh = true
 
+	case msg.React != nil:
+		handler = checkVers(checkUser(s.react))
+		msg.Id = msg.React.Id
+		msg.Original = msg.React.Topic
+		uaRefresh = true
+
+	case msg.Vote != nil:
+		handler = checkVers(checkUser(s.vote))
+		msg.Id = msg.Vote.Id
+		msg.Original = msg.Vote.Topic
+		uaRefresh = true
+
+	case msg.Fwd != nil:
+		handler = checkVers(checkUser(s.forward))
+		msg.Id = msg.Fwd.Id
+		msg.Original = msg.Fwd.Topic
+		uaRefresh = true
+
+	case msg.Report != nil:
+		handler = checkVers(checkUser(s.report))
+		msg.Id = msg.Report.Id
+		msg.Original = msg.Report.Topic
+
+	case msg.Takeout != nil:
+		handler = checkVers(checkUser(s.takeout))
+		msg.Id = msg.Takeout.Id
+
 	default:
 		// Unknown message
 		s.queueOut(ErrMalformed("", "", msg.Timestamp))
-		logs.Warn.Println("s.dispatch: unknown message", s.sid)
+		s.log(msg).Warn.Println("s.dispatch: unknown message")
+		return
+	}
+
+	if s.netRestricted && msg.Hi == nil && msg.Login == nil {
+		s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
+		return
+	}
+
+	if maintenanceRejects(msg) {
+		s.queueOut(ErrMaintenanceReply(msg, msg.Timestamp))
 		return
 	}
 
@@ -600,9 +729,19 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 		return
 	}
 
+	if resp := s.rateLimited(msg); resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
 	msg.sess = s
 	msg.init = true
+
+	// The span ends once the message is handed off to the hub or topic; spans started there are its children.
+	var span trace.Span
+	msg.ctx, span = traceStart(context.Background(), "session."+traceMsgName(msg), traceMsgAttrs(msg)...)
 	handler(msg)
+	span.End()
 
 	// Notify 'me' topic that this session is currently active.
 	if uaRefresh && msg.AsUser != "" && s.userAgent != "" {
@@ -615,8 +754,9 @@ func (s *Session) dispatch(msg *ClientComMessage) {
 
 // Request to subscribe to a topic.
 func (s *Session) subscribe(msg *ClientComMessage) {
-	if strings.HasPrefix(msg.Original, "new") || strings.HasPrefix(msg.Original, "nch") {
-		// Request to create a new group/channel topic.
+	if strings.HasPrefix(msg.Original, "new") || strings.HasPrefix(msg.Original, "nch") ||
+		strings.HasPrefix(msg.Original, "ncm") {
+		// Request to create a new group/channel topic or a community.
 		// If we are in a cluster, make sure the new topic belongs to the current node.
 		msg.RcptTo = globals.cluster.genLocalTopicName()
 	} else {
@@ -640,7 +780,7 @@ func (s *Session) subscribe(msg *ClientComMessage) {
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
 			s.inflightReqs.Done()
-			logs.Err.Println("s.subscribe: hub.join queue full, topic ", msg.RcptTo, s.sid)
+			s.log(msg).Err.Println("s.subscribe: hub.join queue full, topic ", msg.RcptTo)
 		}
 		// Hub will send Ctrl success/failure packets back to session
 	}
@@ -676,7 +816,7 @@ func (s *Session) leave(msg *ClientComMessage) {
 	} else {
 		// Session wants to unsubscribe from the topic it did not join
 		// TODO(gene): allow topic to unsubscribe without joining first; send to hub to unsub
-		logs.Warn.Println("s.leave:", "must attach first", s.sid)
+		s.log(msg).Warn.Println("s.leave:", "must attach first")
 		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
 	}
 }
@@ -684,6 +824,12 @@ func (s *Session) leave(msg *ClientComMessage) {
 // Broadcast a message to all topic subscribers
 func (s *Session) publish(msg *ClientComMessage) {
 	// TODO(gene): Check for repeated messages with the same ID
+	// Reject new messages while encryption is unhealthy rather than risk storing them unprotected.
+	if globals.encryptionReadOnly.Load() {
+		s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+		return
+	}
+
 	var resp *ServerComMessage
 	msg.RcptTo, resp = s.expandTopicName(msg)
 	if resp != nil {
@@ -691,6 +837,10 @@ func (s *Session) publish(msg *ClientComMessage) {
 		return
 	}
 
+	// Clear potentially false "forwarded" and "ephemeral" headers: they are set by the server only.
+	delete(msg.Pub.Head, msgHeadForwarded)
+	delete(msg.Pub.Head, msgHeadEphemeral)
+
 	// Add "sender" header if the message is sent on behalf of another user.
 	if msg.AsUser != s.uid.UserId() {
 		if msg.Pub.Head == nil {
@@ -705,6 +855,17 @@ func (s *Session) publish(msg *ClientComMessage) {
 		}
 	}
 
+	if name, callback := botInvocation(msg.Pub.Head); name != "" {
+		// Slash commands and button callbacks are handled by bots.
+		if msg = s.invokeBot(msg, name, callback); msg == nil {
+			return
+		}
+	}
+
+	if !s.moderatePub(msg) {
+		return
+	}
+
 	if sub := s.getSub(msg.RcptTo); sub != nil {
 		// This is a post to a subscribed topic. The message is sent to the topic only
 		select {
@@ -712,7 +873,7 @@ func (s *Session) publish(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.publish: sub.broadcast channel full, topic ", msg.RcptTo, s.sid)
+			s.log(msg).Err.Println("s.publish: sub.broadcast channel full, topic ", msg.RcptTo)
 		}
 	} else if msg.RcptTo == "sys" {
 		// Publishing to "sys" topic requires no subscription.
@@ -721,12 +882,12 @@ func (s *Session) publish(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.publish: hub.route channel full", s.sid)
+			s.log(msg).Err.Println("s.publish: hub.route channel full")
 		}
 	} else {
 		// Publish request received without attaching to topic first.
 		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
-		logs.Warn.Printf("s.publish[%s]: must attach first %s", msg.RcptTo, s.sid)
+		s.log(msg).Warn.Printf("s.publish[%s]: must attach first", msg.RcptTo)
 	}
 }
 
@@ -738,7 +899,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 	if s.ver == 0 {
 		s.ver = parseVersion(msg.Hi.Version)
 		if s.ver == 0 {
-			logs.Warn.Println("s.hello:", "failed to parse version", s.sid)
+			s.log(msg).Warn.Println("s.hello:", "failed to parse version")
 			s.queueOut(ErrMalformed(msg.Id, "", msg.Timestamp))
 			return
 		}
@@ -746,7 +907,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 		if versionCompare(s.ver, minSupportedVersionValue) < 0 {
 			s.ver = 0
 			s.queueOut(ErrVersionNotSupported(msg.Id, msg.Timestamp))
-			logs.Warn.Println("s.hello:", "unsupported version", s.sid)
+			s.log(msg).Warn.Println("s.hello:", "unsupported version")
 			return
 		}
 
@@ -758,6 +919,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 			"minTagLength":       minTagLength,
 			"maxTagLength":       maxTagLength,
 			"maxTagCount":        globals.maxTagCount,
+			"maxPinnedCount":     globals.maxPinnedCount,
 			"maxFileUploadSize":  globals.maxFileUploadSize,
 			"reqCred":            globals.validatorClientConfig,
 			"msgDelAge":          globals.msgDeleteAge.Seconds(),
@@ -765,9 +927,23 @@ func (s *Session) hello(msg *ClientComMessage) {
 		if len(globals.iceServers) > 0 {
 			params["iceServers"] = globals.iceServers
 		}
+		if globals.turn != nil {
+			// TURN credentials must be fetched from the /v0/turn endpoint.
+			params["turn"] = true
+		}
 		if globals.callEstablishmentTimeout > 0 {
 			params["callTimeout"] = globals.callEstablishmentTimeout
 		}
+		if s.outbox != nil {
+			// Token to resume the session after reconnection.
+			params["outbox"] = s.outbox.token
+		}
+		if store.IsContactDiscoveryEnabled() {
+			params["contactSalt"] = store.ContactSalt()
+			if globals.contactPrefixLength > 0 {
+				params["contactPrefix"] = globals.contactPrefixLength
+			}
+		}
 
 		if s.proto == GRPC {
 			// gRPC client may need server address to be able to fetch large files over http(s).
@@ -788,6 +964,8 @@ func (s *Session) hello(msg *ClientComMessage) {
 		if s.platf == "" {
 			s.platf = platformFromUA(msg.Hi.UserAgent)
 		}
+		// Drafty formats which the client is able to render.
+		s.draftyCaps = draftyCapsFromList(msg.Hi.Drafty)
 		// This is a background session. Start a timer.
 		if msg.Hi.Background {
 			s.bkgTimer.Reset(deferredNotificationsTimeout)
@@ -811,9 +989,12 @@ func (s *Session) hello(msg *ClientComMessage) {
 
 				userChannelsSubUnsub(s.uid, msg.Hi.DeviceID, true)
 			}
+			if err == nil && deviceIDUpdate {
+				s.updateDevicePushToken(msg.Hi.DeviceID)
+			}
 
 			if err != nil {
-				logs.Warn.Println("s.hello:", "device ID", err, s.sid)
+				s.log(msg).Warn.Println("s.hello:", "device ID", err)
 				s.queueOut(ErrUnknown(msg.Id, "", msg.Timestamp))
 				return
 			}
@@ -821,7 +1002,7 @@ func (s *Session) hello(msg *ClientComMessage) {
 	} else {
 		// Version cannot be changed mid-session.
 		s.queueOut(ErrCommandOutOfSequence(msg.Id, "", msg.Timestamp))
-		logs.Warn.Println("s.hello:", "version cannot be changed", s.sid)
+		s.log(msg).Warn.Println("s.hello:", "version cannot be changed")
 		return
 	}
 
@@ -843,15 +1024,15 @@ func (s *Session) hello(msg *ClientComMessage) {
 		if len(s.lang) > 2 {
 			// Logging strings longer than 2 b/c language.Parse(XX) always succeeds
 			// returning confidence Low.
-			logs.Warn.Println("s.hello:", "could not parse locale ", s.lang)
+			s.log(msg).Warn.Println("s.hello:", "could not parse locale ", s.lang)
 		}
 		s.countryCode = globals.defaultCountryCode
 	}
 
 	var httpStatus int
 	var httpStatusText string
-	if s.proto == LPOLL || deviceIDUpdate {
-		// In case of long polling StatusCreated was reported earlier.
+	if s.proto == LPOLL || s.proto == SSE || deviceIDUpdate {
+		// In case of long polling and SSE StatusCreated was reported earlier.
 		// In case of deviceID update just report success.
 		httpStatus = http.StatusOK
 		httpStatusText = "ok"
@@ -877,13 +1058,13 @@ func (s *Session) acc(msg *ClientComMessage) {
 	if !newAcc && msg.Acc.TmpScheme != "" {
 		if !s.uid.IsZero() {
 			s.queueOut(ErrAlreadyAuthenticated(msg.Acc.Id, "", msg.Timestamp))
-			logs.Warn.Println("s.acc: got temp auth while already authenticated", s.sid)
+			s.log(msg).Warn.Println("s.acc: got temp auth while already authenticated")
 			return
 		}
 
 		authHdl := store.Store.GetLogicalAuthHandler(msg.Acc.TmpScheme)
 		if authHdl == nil {
-			logs.Warn.Println("s.acc: unknown authentication scheme", msg.Acc.TmpScheme, s.sid)
+			s.log(msg).Warn.Println("s.acc: unknown authentication scheme", msg.Acc.TmpScheme)
 			s.queueOut(ErrAuthUnknownScheme(msg.Id, "", msg.Timestamp))
 		}
 
@@ -892,7 +1073,7 @@ func (s *Session) acc(msg *ClientComMessage) {
 		if err != nil {
 			s.queueOut(decodeStoreError(err, msg.Acc.Id, msg.Timestamp,
 				map[string]any{"what": "auth"}))
-			logs.Warn.Println("s.acc: invalid temp auth", err, s.sid)
+			s.log(msg).Warn.Println("s.acc: invalid temp auth", err)
 			return
 		}
 	}
@@ -911,6 +1092,10 @@ func (s *Session) login(msg *ClientComMessage) {
 	// msg.from is ignored here
 
 	if msg.Login.Scheme == "reset" {
+		if s.netRestricted {
+			s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+			return
+		}
 		if err := s.authSecretReset(msg.Login.Secret); err != nil {
 			s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
 		} else {
@@ -928,7 +1113,7 @@ func (s *Session) login(msg *ClientComMessage) {
 
 	handler := store.Store.GetLogicalAuthHandler(msg.Login.Scheme)
 	if handler == nil {
-		logs.Warn.Println("s.login: unknown authentication scheme", msg.Login.Scheme, s.sid)
+		s.log(msg).Warn.Println("s.login: unknown authentication scheme", msg.Login.Scheme)
 		s.queueOut(ErrAuthUnknownScheme(msg.Id, "", msg.Timestamp))
 		return
 	}
@@ -938,12 +1123,29 @@ func (s *Session) login(msg *ClientComMessage) {
 		resp := decodeStoreError(err, msg.Id, msg.Timestamp, nil)
 		if resp.Ctrl.Code >= 500 {
 			// Log internal errors
-			logs.Warn.Println("s.login: internal", err, s.sid)
+			s.log(msg).Warn.Println("s.login: internal", err)
+		} else {
+			var target string
+			if rec != nil {
+				target = auditUserId(rec.Uid)
+			}
+			auditLog(&types.AuditRecord{
+				Event:      types.AuditLoginFailed,
+				Target:     target,
+				RemoteAddr: s.remoteAddr,
+				Details:    msg.Login.Scheme + ": " + err.Error(),
+			})
 		}
 		s.queueOut(resp)
 		return
 	}
 
+	if rec == nil && challenge != nil {
+		// The first step of authentication which does not identify the user yet, such as WebAuthn.
+		s.queueOut(InfoChallenge(msg.Id, msg.Timestamp, challenge))
+		return
+	}
+
 	// If authenticator did not check user state, it returns state "undef". If so, check user state here.
 	if rec.State == types.StateUndefined {
 		rec.State, err = userGetState(rec.Uid)
@@ -953,11 +1155,54 @@ func (s *Session) login(msg *ClientComMessage) {
 	}
 
 	if err != nil {
-		logs.Warn.Println("s.login: user state check failed", rec.Uid, err, s.sid)
+		s.log(msg).Warn.Println("s.login: user state check failed", rec.Uid, err)
+		auditLog(&types.AuditRecord{
+			Event:      types.AuditLoginFailed,
+			Target:     rec.Uid.UserId(),
+			RemoteAddr: s.remoteAddr,
+			Details:    msg.Login.Scheme + ": " + err.Error(),
+		})
 		s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
 		return
 	}
 
+	if !s.netAclCheckLogin(rec.AuthLevel) {
+		auditLog(&types.AuditRecord{
+			Event:      types.AuditLoginFailed,
+			Target:     rec.Uid.UserId(),
+			RemoteAddr: s.remoteAddr,
+			Details:    msg.Login.Scheme + ": blocked network",
+		})
+		s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+		return
+	}
+
+	// Sessions at hosts of a tenant accept users of the tenant only.
+	tenant, err := userTenant(rec.Uid)
+	if err == nil && ((s.tenant != "" && tenant != s.tenant) || !tenantAuthAllowed(tenant, msg.Login.Scheme)) {
+		err = types.ErrPermissionDenied
+	}
+	if err != nil {
+		s.log(msg).Warn.Println("s.login: tenant check failed", rec.Uid, err)
+		auditLog(&types.AuditRecord{
+			Event:      types.AuditLoginFailed,
+			Target:     rec.Uid.UserId(),
+			RemoteAddr: s.remoteAddr,
+			Details:    msg.Login.Scheme + ": tenant",
+		})
+		s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
+		return
+	}
+
+	if challenge == nil {
+		challenge, err = secondFactorChallenge(msg.Login.Scheme, rec)
+		if err != nil {
+			s.log(msg).Warn.Println("s.login: failed to issue second factor challenge", rec.Uid, err)
+			s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
+			return
+		}
+	}
+
 	if challenge != nil {
 		// Multi-stage authentication. Issue challenge to the client.
 		s.queueOut(InfoChallenge(msg.Id, msg.Timestamp, challenge))
@@ -974,11 +1219,39 @@ func (s *Session) login(msg *ClientComMessage) {
 		}
 	}
 	if err != nil {
-		logs.Warn.Println("s.login: failed to validate credentials:", err, s.sid)
+		s.log(msg).Warn.Println("s.login: failed to validate credentials:", err)
 		s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
 	} else {
-		s.queueOut(s.onLogin(msg.Id, msg.Timestamp, rec, missing))
+		if msg.Login.Scheme == "resume" {
+			s.resumeToken = string(msg.Login.Secret)
+		}
+		resp := s.onLogin(msg.Id, msg.Timestamp, msg.Login.Scheme, rec, missing)
+		if s.uid == rec.Uid {
+			s.tenant = tenant
+		}
+		s.queueOut(resp)
+	}
+}
+
+// secondFactorChallenge returns a challenge if the user authenticated by the scheme must complete
+// authentication with a second factor, such as TOTP.
+func secondFactorChallenge(scheme string, rec *auth.Rec) ([]byte, error) {
+	if rec.Features&auth.FeatureNoLogin != 0 {
+		// Restricted authentication, i.e. for resetting the password.
+		return nil, nil
+	}
+	for _, name := range secondFactorSchemes {
+		hdl := store.Store.GetLogicalAuthHandler(name)
+		if hdl == nil || !hdl.IsInitialized() {
+			continue
+		}
+		if sf, ok := hdl.(auth.SecondFactor); ok {
+			if challenge, err := sf.Challenge(scheme, rec); challenge != nil || err != nil {
+				return challenge, err
+			}
+		}
 	}
+	return nil, nil
 }
 
 // authSecretReset resets an authentication secret;
@@ -1022,7 +1295,7 @@ func (s *Session) authSecretReset(params []byte) error {
 
 	tempAuth := store.Store.GetLogicalAuthHandler(tempScheme)
 	if tempAuth == nil || !tempAuth.IsInitialized() {
-		logs.Err.Println("s.authSecretReset: validator with missing temp auth", credMethod, tempScheme, s.sid)
+		s.log(nil).Err.Println("s.authSecretReset: validator with missing temp auth", credMethod, tempScheme)
 		return types.ErrInternal
 	}
 
@@ -1040,7 +1313,8 @@ func (s *Session) authSecretReset(params []byte) error {
 }
 
 // onLogin performs steps after successful authentication.
-func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, missing []string) *ServerComMessage {
+// The scheme is the name of the authentication scheme used, "" if unknown.
+func (s *Session) onLogin(msgID string, timestamp time.Time, scheme string, rec *auth.Rec, missing []string) *ServerComMessage {
 	var reply *ServerComMessage
 	var params map[string]any
 
@@ -1062,11 +1336,26 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 
 		// Check if the token is suitable for session authentication.
 		if features&auth.FeatureNoLogin == 0 {
+			if s.uid != rec.Uid {
+				if !globals.rateLimiter.acquireSession(rec.Uid, s.sid) {
+					s.log(nil).Info.Println("s.login: too many sessions", rec.Uid.UserId())
+					return ErrTooManyRequestsExplicitTs(msgID, "", types.TimeNow(), timestamp)
+				}
+				globals.rateLimiter.releaseSession(s.uid, s.sid)
+			}
 			// Authenticate the session.
 			s.uid = rec.Uid
 			s.authLvl = rec.AuthLevel
 			// Reset expiration time.
 			rec.Lifetime = 0
+
+			auditLog(&types.AuditRecord{
+				Event:      types.AuditLogin,
+				Actor:      rec.Uid.UserId(),
+				Target:     rec.Uid.UserId(),
+				RemoteAddr: s.remoteAddr,
+				Details:    scheme + ", " + rec.AuthLevel.String(),
+			})
 		}
 		features |= auth.FeatureValidated
 
@@ -1078,7 +1367,7 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 				LastSeen: timestamp,
 				Lang:     s.lang,
 			}); err != nil {
-				logs.Warn.Println("failed to update device record", err)
+				s.log(nil).Warn.Println("failed to update device record", err)
 			}
 		}
 	}
@@ -1086,8 +1375,47 @@ func (s *Session) onLogin(msgID string, timestamp time.Time, rec *auth.Rec, miss
 	// GenSecret fails only if tokenLifetime is < 0. It can't be < 0 here,
 	// otherwise login would have failed earlier.
 	rec.Features = features
+	if lifetime := refresh.AccessLifetime(); lifetime > 0 && s.uid == rec.Uid {
+		// Access tokens are short-lived when refresh tokens are issued.
+		rec.Lifetime = auth.Duration(lifetime)
+	}
 	params["token"], params["expires"], _ = store.Store.GetLogicalAuthHandler("token").GenSecret(rec)
 
+	// Issue a refresh token unless the session logged in with a token which can be refreshed already.
+	if s.uid == rec.Uid && scheme != "token" && scheme != "resume" {
+		if hdl := store.Store.GetLogicalAuthHandler("refresh"); hdl != nil && hdl.IsInitialized() {
+			if token, expires, err := hdl.GenSecret(&auth.Rec{
+				Uid:       rec.Uid,
+				AuthLevel: rec.AuthLevel,
+				Features:  features,
+			}); err != nil {
+				s.log(nil).Warn.Println("s.onLogin: failed to issue refresh token", err)
+			} else {
+				params["refresh"], params["refresh_expires"] = token, expires
+			}
+		}
+	}
+
+	// Issue a reconnection token for fast session resumption, unless the session was resumed with one already.
+	if s.uid == rec.Uid && scheme != "resume" {
+		if resume := store.Store.GetLogicalAuthHandler("resume"); resume != nil && resume.IsInitialized() {
+			if token, expires, err := resume.GenSecret(&auth.Rec{
+				Uid:       rec.Uid,
+				AuthLevel: rec.AuthLevel,
+				Features:  features,
+			}); err != nil {
+				s.log(nil).Warn.Println("s.onLogin: failed to issue reconnection token", err)
+			} else {
+				params["resume"], params["resume_expires"] = token, expires
+				s.resumeToken = string(token)
+			}
+		}
+	}
+
+	if s.uid == rec.Uid {
+		s.saveSessionRecord(timestamp)
+	}
+
 	reply.Ctrl.Params = params
 	return reply
 }
@@ -1106,14 +1434,14 @@ func (s *Session) get(msg *ClientComMessage) {
 	sub := s.getSub(msg.RcptTo)
 	if msg.MetaWhat == 0 {
 		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
-		logs.Warn.Println("s.get: invalid Get message action", msg.Get.What)
+		s.log(msg).Warn.Println("s.get: invalid Get message action", msg.Get.What)
 	} else if sub != nil {
 		select {
 		case sub.meta <- msg:
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.get: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+			s.log(msg).Err.Println("s.get: sub.meta channel full, topic ", msg.RcptTo)
 		}
 	} else if msg.MetaWhat&(constMsgMetaDesc|constMsgMetaSub) != 0 {
 		// Request some minimal info from a topic not currently attached to.
@@ -1122,10 +1450,10 @@ func (s *Session) get(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.get: hub.meta channel full", s.sid)
+			s.log(msg).Err.Println("s.get: hub.meta channel full")
 		}
 	} else {
-		logs.Warn.Println("s.get: subscribe first to get=", msg.Get.What)
+		s.log(msg).Warn.Println("s.get: subscribe first to get=", msg.Get.What)
 		s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
 	}
 }
@@ -1154,20 +1482,71 @@ func (s *Session) set(msg *ClientComMessage) {
 	if msg.Set.Aux != nil {
 		msg.MetaWhat |= constMsgMetaAux
 	}
+	if msg.Set.Thread != nil {
+		msg.MetaWhat |= constMsgMetaThreads
+	}
+	if msg.Set.Pin != nil {
+		msg.MetaWhat |= constMsgMetaPin
+	}
+	if msg.Set.Keys != nil {
+		msg.MetaWhat |= constMsgMetaKeys
+	}
+	if msg.Set.SKey != nil {
+		msg.MetaWhat |= constMsgMetaSKey
+	}
+	if msg.Set.Device != nil {
+		msg.MetaWhat |= constMsgMetaDevices
+	}
+	if msg.Set.Notify != nil {
+		msg.MetaWhat |= constMsgMetaNotify
+	}
+	if msg.Set.Presence != nil {
+		msg.MetaWhat |= constMsgMetaPresence
+	}
+	if msg.Set.Draft != nil {
+		msg.MetaWhat |= constMsgMetaDrafts
+	}
+	if msg.Set.Star != nil {
+		msg.MetaWhat |= constMsgMetaStarred
+	}
+	if msg.Set.Labels != nil {
+		msg.MetaWhat |= constMsgMetaLabels
+	}
+	if msg.Set.Archive != nil {
+		msg.MetaWhat |= constMsgMetaArchive
+	}
+	if msg.Set.Block != nil {
+		msg.MetaWhat |= constMsgMetaBlocks
+	}
+	if msg.Set.Role != nil {
+		msg.MetaWhat |= constMsgMetaRoles
+	}
+	if msg.Set.Invite != nil {
+		msg.MetaWhat |= constMsgMetaInvites
+	}
+	if msg.Set.Request != nil {
+		msg.MetaWhat |= constMsgMetaRequest
+	}
+	if msg.Set.Directory != nil {
+		msg.MetaWhat |= constMsgMetaDirectory
+	}
 
 	if msg.MetaWhat == 0 {
 		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
-		logs.Warn.Println("s.set: nil Set action")
+		s.log(msg).Warn.Println("s.set: nil Set action")
 	} else if sub := s.getSub(msg.RcptTo); sub != nil {
 		select {
 		case sub.meta <- msg:
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.set: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+			s.log(msg).Err.Println("s.set: sub.meta channel full, topic ", msg.RcptTo)
 		}
-	} else if msg.MetaWhat&(constMsgMetaTags|constMsgMetaCred|constMsgMetaAux) != 0 {
-		logs.Warn.Println("s.set: setting tags/creds/aux is allowed for subscribed topics only", msg.MetaWhat)
+	} else if msg.MetaWhat&(constMsgMetaTags|constMsgMetaCred|constMsgMetaAux|constMsgMetaThreads|constMsgMetaPin|
+		constMsgMetaKeys|constMsgMetaSKey|constMsgMetaDevices|constMsgMetaNotify|constMsgMetaDrafts|constMsgMetaStarred|
+		constMsgMetaLabels|constMsgMetaArchive|constMsgMetaBlocks|constMsgMetaRoles|constMsgMetaInvites|
+		constMsgMetaRequest|constMsgMetaDirectory|constMsgMetaPresence) != 0 {
+		s.log(msg).Warn.Println("s.set: setting tags/creds/aux/thread/pin/keys/device/notify/presence/draft/star/labels/archive/block/role/invite/request/directory is allowed for subscribed topics only", msg.MetaWhat)
 		s.queueOut(ErrPermissionDeniedReply(msg, msg.Timestamp))
 	} else {
 		// Desc.Private and Sub updates are possible without the subscription.
@@ -1176,7 +1555,7 @@ func (s *Session) set(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.set: hub.meta channel full", s.sid)
+			s.log(msg).Err.Println("s.set: hub.meta channel full")
 		}
 	}
 }
@@ -1202,7 +1581,7 @@ func (s *Session) del(msg *ClientComMessage) {
 
 	if msg.MetaWhat == 0 {
 		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
-		logs.Warn.Println("s.del: invalid Del action", msg.Del.What, s.sid)
+		s.log(msg).Warn.Println("s.del: invalid Del action", msg.Del.What)
 		return
 	}
 
@@ -1219,7 +1598,7 @@ func (s *Session) del(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.del: hub.unreg channel full", s.sid)
+			s.log(msg).Err.Println("s.del: hub.unreg channel full")
 		}
 	} else if sub := s.getSub(msg.RcptTo); sub != nil {
 		// Session is attached, deleting subscription or messages. Send to topic.
@@ -1228,12 +1607,12 @@ func (s *Session) del(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.del: sub.meta channel full, topic ", msg.RcptTo, s.sid)
+			s.log(msg).Err.Println("s.del: sub.meta channel full, topic ", msg.RcptTo)
 		}
 	} else {
 		// Must join the topic to delete messages or subscriptions.
 		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
-		logs.Warn.Println("s.del: invalid Del action while unsubbed", msg.Del.What, s.sid)
+		s.log(msg).Warn.Println("s.del: invalid Del action while unsubbed", msg.Del.What)
 	}
 }
 
@@ -1264,8 +1643,8 @@ func (s *Session) note(msg *ClientComMessage) {
 			return
 		}
 	case "call":
-		if types.GetTopicCat(msg.RcptTo) != types.TopicCatP2P {
-			// Calls are only available in P2P topics.
+		if cat := types.GetTopicCat(msg.RcptTo); cat != types.TopicCatP2P && cat != types.TopicCatGrp {
+			// Calls are only available in P2P and group topics.
 			return
 		}
 		fallthrough
@@ -1280,16 +1659,19 @@ func (s *Session) note(msg *ClientComMessage) {
 		}
 	case "edit":
 		// Message edit: requires valid SeqId and non-empty content.
-		logs.Info.Printf("session.note: received edit for seq %d, content=%v", msg.Note.SeqId, msg.Note.Content)
+		s.log(msg).Info.Printf("session.note: received edit for seq %d, content=%v", msg.Note.SeqId, msg.Note.Content)
 		if msg.Note.SeqId <= 0 || msg.Note.Content == nil {
-			logs.Warn.Printf("session.note: edit rejected - seqId=%d, content=%v", msg.Note.SeqId, msg.Note.Content)
+			s.log(msg).Warn.Printf("session.note: edit rejected - seqId=%d, content=%v", msg.Note.SeqId, msg.Note.Content)
+			return
+		}
+		if !s.moderateEdit(msg) {
 			return
 		}
 	case "unsend":
 		// Message unsend: requires valid SeqId.
-		logs.Info.Printf("session.note: received unsend for seq %d", msg.Note.SeqId)
+		s.log(msg).Info.Printf("session.note: received unsend for seq %d", msg.Note.SeqId)
 		if msg.Note.SeqId <= 0 {
-			logs.Warn.Printf("session.note: unsend rejected - seqId=%d", msg.Note.SeqId)
+			s.log(msg).Warn.Printf("session.note: unsend rejected - seqId=%d", msg.Note.SeqId)
 			return
 		}
 	default:
@@ -1303,7 +1685,7 @@ func (s *Session) note(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.note: sub.broacast channel full, topic ", msg.RcptTo, s.sid)
+			s.log(msg).Err.Println("s.note: sub.broacast channel full, topic ", msg.RcptTo)
 		}
 	} else if msg.Note.What == "recv" || (msg.Note.What == "call" && (msg.Note.Event == "ringing" || msg.Note.Event == "hang-up" || msg.Note.Event == "accept")) {
 		// One of the following events happened:
@@ -1319,11 +1701,69 @@ func (s *Session) note(msg *ClientComMessage) {
 		default:
 			// Reply with a 503 to the user.
 			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
-			logs.Err.Println("s.note: hub.route channel full", s.sid)
+			s.log(msg).Err.Println("s.note: hub.route channel full")
 		}
 	} else {
 		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
-		logs.Warn.Println("s.note: note to invalid topic - must subscribe first", msg.Note.What, s.sid)
+		s.log(msg).Warn.Println("s.note: note to invalid topic - must subscribe first", msg.Note.What)
+	}
+}
+
+// react adds or removes an emoji reaction to a message.
+func (s *Session) react(msg *ClientComMessage) {
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	if msg.React.SeqId <= 0 || msg.React.Reaction == "" || len(msg.React.Reaction) > store.MaxReactionLength ||
+		(msg.React.What != "" && msg.React.What != "add" && msg.React.What != "del") {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		return
+	}
+
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		select {
+		case sub.broadcast <- msg:
+		default:
+			// Reply with a 503 to the user.
+			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+			s.log(msg).Err.Println("s.react: sub.broacast channel full, topic ", msg.RcptTo)
+		}
+	} else {
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		s.log(msg).Warn.Println("s.react: reaction to invalid topic - must subscribe first")
+	}
+}
+
+// vote casts a vote in a poll or closes the poll.
+func (s *Session) vote(msg *ClientComMessage) {
+	var resp *ServerComMessage
+	msg.RcptTo, resp = s.expandTopicName(msg)
+	if resp != nil {
+		s.queueOut(resp)
+		return
+	}
+
+	if msg.Vote.SeqId <= 0 || len(msg.Vote.Options) > store.MaxPollOptions ||
+		(msg.Vote.What != "" && msg.Vote.What != "vote" && msg.Vote.What != "close") {
+		s.queueOut(ErrMalformedReply(msg, msg.Timestamp))
+		return
+	}
+
+	if sub := s.getSub(msg.RcptTo); sub != nil {
+		select {
+		case sub.broadcast <- msg:
+		default:
+			// Reply with a 503 to the user.
+			s.queueOut(ErrServiceUnavailableReply(msg, msg.Timestamp))
+			s.log(msg).Err.Println("s.vote: sub.broacast channel full, topic ", msg.RcptTo)
+		}
+	} else {
+		s.queueOut(ErrAttachFirst(msg, msg.Timestamp))
+		s.log(msg).Warn.Println("s.vote: vote in invalid topic - must subscribe first")
 	}
 }
 
@@ -1335,7 +1775,7 @@ func (s *Session) note(msg *ClientComMessage) {
 //	err: *ServerComMessage with an error to return to the sender
 func (s *Session) expandTopicName(msg *ClientComMessage) (string, *ServerComMessage) {
 	if msg.Original == "" {
-		logs.Warn.Println("s.etn: empty topic name", s.sid)
+		s.log(msg).Warn.Println("s.etn: empty topic name")
 		return "", ErrMalformed(msg.Id, "", msg.Timestamp)
 	}
 
@@ -1353,11 +1793,11 @@ func (s *Session) expandTopicName(msg *ClientComMessage) (string, *ServerComMess
 		uid2 := types.ParseUserId(msg.Original)
 		if uid2.IsZero() {
 			// Ensure the user id is valid.
-			logs.Warn.Println("s.etn: failed to parse p2p topic name", s.sid)
+			s.log(msg).Warn.Println("s.etn: failed to parse p2p topic name")
 			return "", ErrMalformed(msg.Id, msg.Original, msg.Timestamp)
 		} else if uid2 == uid1 {
 			// Use 'me' to access self-topic.
-			logs.Warn.Println("s.etn: invalid p2p self-subscription", s.sid)
+			s.log(msg).Warn.Println("s.etn: invalid p2p self-subscription")
 			return "", ErrPermissionDeniedReply(msg, msg.Timestamp)
 		}
 		routeTo = uid1.P2PName(uid2)
@@ -1390,10 +1830,23 @@ func (s *Session) serialize(msg *ServerComMessage) (int, any) {
 		return -1, msg
 	}
 
-	out, _ := json.Marshal(msg)
+	if s.proto == XMPP || s.proto == MQTT {
+		// Messages are translated to stanzas or packets by the write loop.
+		return -1, msg
+	}
+
+	out, _ := s.codec().Marshal(msg)
 	return len(out), out
 }
 
+// codec returns the encoding of messages of the session.
+func (s *Session) codec() wireCodec {
+	if s.wire == nil {
+		return jsonWire
+	}
+	return s.wire
+}
+
 // onBackgroundTimer marks background session as foreground and informs topics it's subscribed to.
 func (s *Session) onBackgroundTimer() {
 	s.subsLock.RLock()
@@ -1406,3 +1859,20 @@ func (s *Session) onBackgroundTimer() {
 		}
 	}
 }
+
+// downgradeContent converts Drafty content of a {data} message to the formats supported by the client.
+// The content is returned unchanged if the client supports all formats or the content is not Drafty.
+func (s *Session) downgradeContent(head map[string]any, content any) any {
+	if s.draftyCaps == nil {
+		return content
+	}
+	if mime, _ := head["mime"].(string); mime != "text/x-drafty" {
+		return content
+	}
+	result, err := drafty.Downgrade(content, func(tp string) bool { return s.draftyCaps[tp] })
+	if err != nil {
+		s.log(nil).Warn.Println("s.downgradeContent: invalid drafty content", err)
+		return content
+	}
+	return result
+}
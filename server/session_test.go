@@ -1,17 +1,21 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/pbx"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/auth/mock_auth"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/mock_store"
 	"github.com/tinode/chat/server/store/types"
+	"google.golang.org/grpc"
 )
 
 func test_makeSession(uid types.Uid) *Session {
@@ -162,11 +166,17 @@ func TestDispatchLogin(t *testing.T) {
 	}
 	ss.EXPECT().GetLogicalAuthHandler("basic").Return(aa)
 	aa.EXPECT().Authenticate([]byte(secret), gomock.Any()).Return(authRec, nil, nil)
+	// Second factor is not configured.
+	ss.EXPECT().GetLogicalAuthHandler("totp").Return(nil)
 	// Token generation.
 	ss.EXPECT().GetLogicalAuthHandler("token").Return(aa)
 	token := "<==auth-token==>"
 	expires, _ := time.Parse(time.RFC822, "01 Jan 50 00:00 UTC")
 	aa.EXPECT().GenSecret(authRec).Return([]byte(token), expires, nil)
+	// Refresh token is not configured.
+	ss.EXPECT().GetLogicalAuthHandler("refresh").Return(nil)
+	// Reconnection token is not configured.
+	ss.EXPECT().GetLogicalAuthHandler("resume").Return(nil)
 
 	s := &Session{
 		send:    make(chan any, 10),
@@ -219,6 +229,65 @@ func TestDispatchLogin(t *testing.T) {
 	}
 }
 
+func TestDispatchLoginFailedAudit(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	aa := mock_auth.NewMockAuthHandler(ctrl)
+	al := mock_store.NewMockAuditPersistenceInterface(ctrl)
+
+	store.Store = ss
+	store.Audit = al
+	globals.auditEnabled = true
+	defer func() {
+		store.Store = nil
+		store.Audit = nil
+		globals.auditEnabled = false
+		ctrl.Finish()
+	}()
+
+	secret := "<==bad-secret==>"
+	ss.EXPECT().GetLogicalAuthHandler("basic").Return(aa)
+	aa.EXPECT().Authenticate([]byte(secret), "10.0.0.1").Return(nil, nil, types.ErrFailed)
+	al.EXPECT().Log(gomock.Any()).DoAndReturn(func(rec *types.AuditRecord) error {
+		if rec.Event != types.AuditLoginFailed || rec.RemoteAddr != "10.0.0.1" || rec.Actor != "" ||
+			rec.Target != "" || rec.Details != "basic: "+types.ErrFailed.Error() {
+			t.Errorf("Unexpected audit record: %+v", rec)
+		}
+		return nil
+	})
+
+	s := &Session{
+		send:       make(chan any, 10),
+		authLvl:    auth.LevelAuth,
+		ver:        16,
+		remoteAddr: "10.0.0.1",
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	s.dispatch(&ClientComMessage{
+		Login: &MsgClientLogin{
+			Id:     "123",
+			Scheme: "basic",
+			Secret: []byte(secret),
+		},
+	})
+	close(s.send)
+	wg.Wait()
+
+	if len(r.messages) != 1 {
+		t.Fatalf("responses: expected 1, received %d.", len(r.messages))
+	}
+	if resp := r.messages[0].(*ServerComMessage); resp.Ctrl == nil || resp.Ctrl.Code != http.StatusUnauthorized {
+		t.Errorf("Expected ctrl 401, got %+v", resp.Ctrl)
+	}
+	if !s.uid.IsZero() {
+		t.Errorf("Session must not be authenticated, got %s", s.uid.UserId())
+	}
+}
+
 func TestDispatchSubscribe(t *testing.T) {
 	uid := types.Uid(1)
 	s := test_makeSession(uid)
@@ -575,6 +644,127 @@ func TestDispatchPublishMissingSubcription(t *testing.T) {
 	verifyResponseCodes(&r, []int{http.StatusConflict}, t)
 }
 
+func TestDispatchForward(t *testing.T) {
+	uid := types.Uid(1)
+	s := test_makeSession(uid)
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ss := mock_store.NewMockSubsPersistenceInterface(ctrl)
+	mm := mock_store.NewMockMessagesPersistenceInterface(ctrl)
+	store.Subs = ss
+	store.Messages = mm
+	defer func() {
+		store.Subs = nil
+		store.Messages = nil
+	}()
+
+	srcTopic := "grpSource"
+	destUid := types.Uid(2)
+	topicName := uid.P2PName(destUid)
+	origTs := time.Now().UTC().Round(time.Millisecond)
+	content := map[string]any{
+		"txt": " ",
+		"fmt": []any{map[string]any{"at": float64(0), "len": float64(1), "key": float64(0)}},
+		"ent": []any{map[string]any{"tp": "IM", "data": map[string]any{"ref": "/v0/file/s/abc.jpg"}}},
+	}
+	ss.EXPECT().Get(srcTopic, uid, false).Return(&types.Subscription{ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}, nil)
+	mm.EXPECT().GetBySeqId(srcTopic, 5).Return(&types.Message{
+		ObjHeader: types.ObjHeader{CreatedAt: origTs},
+		SeqId:     5,
+		Topic:     srcTopic,
+		From:      types.Uid(3).String(),
+		Head:      map[string]any{"mime": "text/x-drafty", "reply": map[string]any{"seq": float64(2)}},
+		Content:   content,
+	}, nil)
+
+	brdcst := make(chan *ClientComMessage, 1)
+	s.subs = make(map[string]*Subscription)
+	s.subs[topicName] = &Subscription{
+		broadcast: brdcst,
+	}
+
+	msg := &ClientComMessage{
+		Fwd: &MsgClientFwd{
+			Id:    "123",
+			Topic: destUid.UserId(),
+			Src:   srcTopic,
+			SeqId: 5,
+		},
+	}
+
+	s.dispatch(msg)
+	close(s.send)
+	wg.Wait()
+
+	if len(r.messages) != 0 {
+		t.Errorf("responses: expected 0, received %d.", len(r.messages))
+	}
+	if len(brdcst) != 1 {
+		t.Fatalf("Pub messages: expected 1, received %d.", len(brdcst))
+	}
+	req := <-brdcst
+	if req.Pub == nil || req.Fwd != nil {
+		t.Fatal("Forward request must be converted to {pub}.")
+	}
+	if req.Pub.Id != "123" || req.Pub.Topic != destUid.UserId() || req.RcptTo != topicName {
+		t.Errorf("Pub request: unexpected id '%s' or topic '%s'.", req.Pub.Id, req.Pub.Topic)
+	}
+	if _, ok := req.Pub.Head["reply"]; ok || req.Pub.Head["mime"] != "text/x-drafty" {
+		t.Errorf("Pub request head: unexpected %v.", req.Pub.Head)
+	}
+	forwarded, _ := req.Pub.Head["forwarded"].(map[string]any)
+	if forwarded["topic"] != srcTopic || forwarded["seq"] != 5 || forwarded["from"] != types.Uid(3).UserId() ||
+		forwarded["ts"] != origTs {
+		t.Errorf("Pub request: unexpected head.forwarded %v.", forwarded)
+	}
+	if req.Extra == nil || len(req.Extra.Attachments) != 1 || req.Extra.Attachments[0] != "/v0/file/s/abc.jpg" {
+		t.Errorf("Pub request: unexpected attachments %+v.", req.Extra)
+	}
+}
+
+func TestDispatchPublishStripsForwarded(t *testing.T) {
+	uid := types.Uid(1)
+	s := test_makeSession(uid)
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	destUid := types.Uid(2)
+	topicName := uid.P2PName(destUid)
+
+	brdcst := make(chan *ClientComMessage, 1)
+	s.subs = make(map[string]*Subscription)
+	s.subs[topicName] = &Subscription{
+		broadcast: brdcst,
+	}
+
+	msg := &ClientComMessage{
+		Pub: &MsgClientPub{
+			Id:      "123",
+			Topic:   destUid.UserId(),
+			Head:    map[string]any{"forwarded": map[string]any{"topic": "grpFake", "seq": 1}},
+			Content: "test content",
+		},
+	}
+
+	s.dispatch(msg)
+	close(s.send)
+	wg.Wait()
+
+	if len(brdcst) != 1 {
+		t.Fatalf("Pub messages: expected 1, received %d.", len(brdcst))
+	}
+	if req := <-brdcst; req.Pub.Head != nil {
+		t.Errorf("Pub request head: expected nil, got %v.", req.Pub.Head)
+	}
+}
+
 func TestDispatchGet(t *testing.T) {
 	uid := types.Uid(1)
 	s := test_makeSession(uid)
@@ -1142,6 +1332,123 @@ func TestDispatchAccNew(t *testing.T) {
 	}
 }
 
+func TestDispatchTakeoutRecent(t *testing.T) {
+	uid := types.Uid(1)
+	ctrl := gomock.NewController(t)
+	tk := mock_store.NewMockTakeoutsPersistenceInterface(ctrl)
+
+	store.Takeouts = tk
+	globals.takeoutQueue = make(chan *types.Takeout, 1)
+	globals.takeoutPeriod = 7 * 24 * time.Hour
+	defer func() {
+		store.Takeouts = nil
+		globals.takeoutQueue = nil
+		globals.takeoutPeriod = 0
+		ctrl.Finish()
+	}()
+
+	now := types.TimeNow()
+	expires := now.Add(time.Hour)
+	last := &types.Takeout{
+		ObjHeader: types.ObjHeader{Id: "tk1", CreatedAt: now.Add(-time.Hour)},
+		User:      uid.String(),
+		Status:    types.TakeoutReady,
+		Url:       "/v0/file/s/abc.zip",
+		ExpiresAt: &expires,
+	}
+	// A recent export is reported instead of starting a new one.
+	tk.EXPECT().GetLast(uid).Return(last, nil)
+
+	s := &Session{
+		send:    make(chan any, 10),
+		uid:     uid,
+		authLvl: auth.LevelAuth,
+		ver:     16,
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	s.dispatch(&ClientComMessage{
+		Takeout: &MsgClientTakeout{
+			Id: "123",
+		},
+	})
+	close(s.send)
+	wg.Wait()
+
+	if len(r.messages) != 1 {
+		t.Fatalf("responses: expected 1, received %d.", len(r.messages))
+	}
+	resp := r.messages[0].(*ServerComMessage)
+	if resp.Ctrl == nil || resp.Ctrl.Code != http.StatusOK {
+		t.Fatalf("Expected ctrl 200, got %+v", resp.Ctrl)
+	}
+	params := resp.Ctrl.Params.(map[string]any)
+	if params["status"] != types.TakeoutReady || params["url"] != last.Url {
+		t.Errorf("Unexpected params: %+v", params)
+	}
+	if len(globals.takeoutQueue) != 0 {
+		t.Error("Export must not be queued")
+	}
+}
+
+func TestDispatchPubRateLimited(t *testing.T) {
+	uid := types.Uid(1)
+	var err error
+	globals.rateLimiter, err = newRateLimiter(&rateLimitConfig{
+		Enabled: true,
+		Limits: map[string]map[string]*rateLimitRule{
+			"auth": {"pub": {Rate: 0.001, Burst: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		globals.rateLimiter = nil
+	}()
+
+	s := &Session{
+		send:    make(chan any, 10),
+		uid:     uid,
+		authLvl: auth.LevelAuth,
+		ver:     16,
+	}
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	for _, id := range []string{"1", "2"} {
+		s.dispatch(&ClientComMessage{
+			Pub: &MsgClientPub{
+				Id:      id,
+				Topic:   "grpTest",
+				Content: "test",
+			},
+		})
+	}
+	close(s.send)
+	wg.Wait()
+
+	if len(r.messages) != 2 {
+		t.Fatalf("responses: expected 2, received %d.", len(r.messages))
+	}
+	// The first request is not limited. It fails because the session is not attached to the topic.
+	if resp := r.messages[0].(*ServerComMessage); resp.Ctrl == nil || resp.Ctrl.Code == http.StatusTooManyRequests {
+		t.Errorf("First request must not be rate limited, got %+v", resp.Ctrl)
+	}
+	resp := r.messages[1].(*ServerComMessage)
+	if resp.Ctrl == nil || resp.Ctrl.Code != http.StatusTooManyRequests || resp.Ctrl.Id != "2" {
+		t.Fatalf("Expected ctrl 429, got %+v", resp.Ctrl)
+	}
+	if retry, _ := resp.Ctrl.Params.(map[string]any)["retry"].(int); retry <= 0 {
+		t.Errorf("Expected positive retry, got %+v", resp.Ctrl.Params)
+	}
+}
+
 func TestDispatchNoMessage(t *testing.T) {
 	remoteAddr := "192.168.0.1"
 	s := &Session{
@@ -1175,3 +1482,149 @@ func TestDispatchNoMessage(t *testing.T) {
 		t.Errorf("Response code: expected 400, got %d", resp.Ctrl.Code)
 	}
 }
+
+// testBotClient is a bot which responds to every command with the same message.
+type testBotClient struct {
+	pbx.PluginClient
+	resp *pbx.ServerResp
+	reqs []*pbx.ClientReq
+}
+
+func (c *testBotClient) FireHose(ctx context.Context, in *pbx.ClientReq, opts ...grpc.CallOption) (*pbx.ServerResp, error) {
+	c.reqs = append(c.reqs, in)
+	return c.resp, nil
+}
+
+func TestDispatchPublishBotCommand(t *testing.T) {
+	bot := &testBotClient{
+		resp: &pbx.ServerResp{
+			Status: pbx.RespCode_RESPOND,
+			Srvmsg: &pbx.ServerMsg{
+				Message: &pbx.ServerMsg_Data{Data: &pbx.ServerData{Content: []byte(`"sunny"`)}},
+			},
+		},
+	}
+	globals.plugins = []Plugin{{
+		name:      "weather",
+		client:    bot,
+		commands:  []botCommand{{name: "weather", topics: plgTopicGrp}},
+		callbacks: map[string]bool{"refresh": true},
+	}}
+	defer func() { globals.plugins = nil }()
+
+	uid := types.Uid(1)
+	s := test_makeSession(uid)
+	wg := sync.WaitGroup{}
+	r := responses{}
+	wg.Add(1)
+	go s.testWriteLoop(&r, &wg)
+
+	brdcst := make(chan *ClientComMessage, 1)
+	s.subs = map[string]*Subscription{
+		"grpTest":                 {broadcast: brdcst},
+		uid.P2PName(types.Uid(2)): {broadcast: brdcst},
+	}
+
+	for _, pub := range []*MsgClientPub{
+		{Id: "1", Topic: "grpTest", Head: map[string]any{"cmd": "weather"}, Content: "Paris"},
+		{Id: "2", Topic: "grpTest", Head: map[string]any{"callback": "refresh"}},
+		// Not available in p2p topics.
+		{Id: "3", Topic: types.Uid(2).UserId(), Head: map[string]any{"cmd": "weather"}},
+		{Id: "4", Topic: "grpTest", Head: map[string]any{"cmd": "unknown"}},
+	} {
+		s.dispatch(&ClientComMessage{Pub: pub})
+	}
+	close(s.send)
+	wg.Wait()
+
+	if len(brdcst) != 0 {
+		t.Errorf("Pub messages: expected 0, received %d.", len(brdcst))
+	}
+	if len(bot.reqs) != 2 {
+		t.Fatalf("Bot requests: expected 2, received %d.", len(bot.reqs))
+	}
+	if len(r.messages) != 6 {
+		t.Fatalf("responses: expected 6, received %d.", len(r.messages))
+	}
+	for i, id := range []string{"1", "2"} {
+		data := r.messages[i*2].(*ServerComMessage).Data
+		if data == nil || data.Topic != "grpTest" || data.SeqId != 0 || data.Content != "sunny" ||
+			data.Head["ephemeral"] != true {
+			t.Errorf("Ephemeral response %s: unexpected %+v.", id, data)
+		}
+		ctrl := r.messages[i*2+1].(*ServerComMessage).Ctrl
+		if ctrl == nil || ctrl.Id != id || ctrl.Code != http.StatusOK {
+			t.Errorf("Response %s: unexpected %+v.", id, ctrl)
+		}
+	}
+	for i, id := range []string{"3", "4"} {
+		ctrl := r.messages[4+i].(*ServerComMessage).Ctrl
+		if ctrl == nil || ctrl.Id != id || ctrl.Code != http.StatusNotFound {
+			t.Errorf("Response %s: expected 404, got %+v.", id, ctrl)
+		}
+	}
+}
+
+func TestSessionStoreDrain(t *testing.T) {
+	ss := &SessionStore{sessCache: make(map[string]*Session)}
+	var sessions []*Session
+	for _, sid := range []string{"sid1", "sid2", "sid3"} {
+		s := &Session{sid: sid, proto: WEBSOCK, stop: make(chan any, 1)}
+		ss.sessCache[sid] = s
+		sessions = append(sessions, s)
+	}
+	// Multiplexing sessions serve other nodes and are not drained.
+	ss.sessCache["mux"] = &Session{sid: "mux", proto: MULTIPLEX, stop: make(chan any, 1)}
+
+	if left := ss.Drain(2); left != 1 {
+		t.Errorf("Expected 1 session left, got %d", left)
+	}
+	if left := ss.Drain(2); left != 0 {
+		t.Errorf("Expected no sessions left, got %d", left)
+	}
+	if len(ss.sessCache) != 1 || ss.sessCache["mux"] == nil {
+		t.Errorf("Unexpected sessions %v", ss.sessCache)
+	}
+	for _, s := range sessions {
+		// Clients are asked to reconnect.
+		if data, _ := (<-s.stop).([]byte); !strings.Contains(string(data), `"code":503,"text":"draining"`) {
+			t.Errorf("Session %s: unexpected stop message %s", s.sid, data)
+		}
+	}
+}
+
+func TestRateLimiterClusterConfig(t *testing.T) {
+	rl, err := newRateLimiter(&rateLimitConfig{
+		Enabled: true,
+		Limits: map[string]map[string]*rateLimitRule{
+			"auth": {"pub": {Rate: 1, Burst: 5}},
+		},
+		Cluster: &clusterRateLimitConfig{
+			Redis:           []byte(`{"url":"redis://localhost:6379"}`),
+			MaxUserSessions: 3,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rl.shared == nil || rl.window != rateLimitDefaultWindow || rl.maxUserSessions != 3 {
+		t.Errorf("Unexpected shared limits %v %d", rl.window, rl.maxUserSessions)
+	}
+	// Requests without a limit are not counted.
+	if ok, _ := rl.allowShared("usrA", auth.LevelAuth, rateLimitSub); !ok {
+		t.Error("Unlimited request rejected")
+	}
+
+	if _, err = newRateLimiter(&rateLimitConfig{
+		Enabled: true,
+		Cluster: &clusterRateLimitConfig{Redis: []byte(`{"url":"http://localhost"}`)},
+	}); err == nil {
+		t.Error("Expected error of invalid Redis URL")
+	}
+
+	// Number of sessions is not limited without the shared counters.
+	var local *rateLimiter
+	if !local.acquireSession(types.Uid(1), "sid1") {
+		t.Error("Session rejected by disabled limiter")
+	}
+}
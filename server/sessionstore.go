@@ -101,6 +101,15 @@ func (ss *SessionStore) NewSession(conn any, sid string) (*Session, int) {
 	case pbx.Node_MessageLoopServer:
 		s.proto = GRPC
 		s.grpcnode = c
+	case *xmppConn:
+		s.proto = XMPP
+		s.xmpp = c
+	case *mqttConn:
+		s.proto = MQTT
+		s.mqtt = c
+	case *sseStream:
+		s.proto = SSE
+		s.sse = c
 	default:
 		logs.Err.Panicln("session: unknown connection type", conn)
 	}
@@ -219,6 +228,35 @@ func (ss *SessionStore) Shutdown() {
 	logs.Info.Println("SessionStore shut down, sessions terminated:", len(ss.sessCache))
 }
 
+// Drain asks up to 'limit' client sessions to reconnect to another server and terminates them.
+// Returns the number of client sessions left.
+func (ss *SessionStore) Drain(limit int) int {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	draining := ErrDraining(types.TimeNow())
+	left := 0
+	for _, s := range ss.sessCache {
+		if s.isMultiplex() {
+			continue
+		}
+		if limit <= 0 {
+			left++
+			continue
+		}
+		limit--
+		_, data := s.serialize(draining)
+		s.stopSession(data)
+		delete(ss.sessCache, s.sid)
+		if s.proto == LPOLL {
+			ss.lru.Remove(s.lpTracker)
+		}
+	}
+
+	statsSet("LiveSessions", int64(len(ss.sessCache)))
+	return left
+}
+
 // EvictUser terminates all sessions of a given user.
 func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 	ss.lock.Lock()
@@ -241,6 +279,29 @@ func (ss *SessionStore) EvictUser(uid types.Uid, skipSid string) {
 	statsSet("LiveSessions", int64(len(ss.sessCache)))
 }
 
+// EvictSessions terminates the given sessions of the user.
+func (ss *SessionStore) EvictSessions(uid types.Uid, sids []string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	evicted := NoErrEvicted("", "", types.TimeNow())
+	evicted.AsUser = uid.UserId()
+	for _, sid := range sids {
+		s := ss.sessCache[sid]
+		if s == nil || s.uid != uid || s.isMultiplex() {
+			continue
+		}
+		_, data := s.serialize(evicted)
+		s.stopSession(data)
+		delete(ss.sessCache, s.sid)
+		if s.proto == LPOLL {
+			ss.lru.Remove(s.lpTracker)
+		}
+	}
+
+	statsSet("LiveSessions", int64(len(ss.sessCache)))
+}
+
 // NodeRestarted removes stale sessions from a restarted cluster node.
 //   - nodeName is the name of affected node
 //   - fingerprint is the new fingerprint of the node.
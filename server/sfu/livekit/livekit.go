@@ -0,0 +1,208 @@
+// Package livekit implements group video calls using a LiveKit server (https://livekit.io).
+// Rooms are managed through the Twirp room service API, access tokens are JWTs signed with the
+// API secret.
+package livekit
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/sfu"
+)
+
+const (
+	providerName = "livekit"
+
+	roomServicePath = "/twirp/livekit.RoomService/"
+
+	// Lifetime of tokens used to call the room service.
+	serviceTokenTTL = time.Minute
+
+	// Default number of seconds to keep an empty room open.
+	defaultEmptyTimeout = 300
+)
+
+type configType struct {
+	// URL clients use to connect to the server, e.g. "wss://livekit.example.com".
+	URL string `json:"url"`
+	// URL of the server API. Derived from the client URL if blank.
+	APIURL string `json:"api_url"`
+	// API key and secret.
+	APIKey    string `json:"api_key"`
+	APISecret string `json:"api_secret"`
+	// Number of seconds to keep an empty room open.
+	EmptyTimeout int `json:"empty_timeout"`
+}
+
+type livekit struct {
+	url          string
+	apiURL       string
+	apiKey       string
+	apiSecret    []byte
+	emptyTimeout int
+	client       *http.Client
+}
+
+// Grants of the access token.
+type videoGrant struct {
+	Room         string `json:"room,omitempty"`
+	RoomJoin     bool   `json:"roomJoin,omitempty"`
+	RoomCreate   bool   `json:"roomCreate,omitempty"`
+	CanPublish   *bool  `json:"canPublish,omitempty"`
+	CanSubscribe *bool  `json:"canSubscribe,omitempty"`
+}
+
+type claims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub,omitempty"`
+	NotBefore int64       `json:"nbf"`
+	Expires   int64       `json:"exp"`
+	Name      string      `json:"name,omitempty"`
+	Video     *videoGrant `json:"video"`
+}
+
+// Init initializes the provider.
+func (lk *livekit) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("livekit: failed to parse config: " + err.Error())
+	}
+	if config.APIKey == "" || config.APISecret == "" {
+		return errors.New("livekit: missing API key or secret")
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Host == "" {
+		return errors.New("livekit: invalid URL '" + config.URL + "'")
+	}
+	lk.url = config.URL
+
+	lk.apiURL = config.APIURL
+	if lk.apiURL == "" {
+		// LiveKit serves the API and the signaling connections on the same port.
+		switch u.Scheme {
+		case "wss":
+			u.Scheme = "https"
+		case "ws":
+			u.Scheme = "http"
+		}
+		lk.apiURL = u.String()
+	}
+	lk.apiURL = strings.TrimSuffix(lk.apiURL, "/")
+
+	lk.apiKey = config.APIKey
+	lk.apiSecret = []byte(config.APISecret)
+	lk.emptyTimeout = config.EmptyTimeout
+	if lk.emptyTimeout <= 0 {
+		lk.emptyTimeout = defaultEmptyTimeout
+	}
+	lk.client = &http.Client{}
+	return nil
+}
+
+// URL returns the URL clients use to connect to the server.
+func (lk *livekit) URL() string {
+	return lk.url
+}
+
+// CreateRoom creates a room. Creating a room which already exists is not an error.
+func (lk *livekit) CreateRoom(ctx context.Context, room string, maxParticipants int) error {
+	return lk.call(ctx, "CreateRoom", room, map[string]any{
+		"name":             room,
+		"empty_timeout":    lk.emptyTimeout,
+		"max_participants": maxParticipants,
+	})
+}
+
+// Token issues a token which allows the identity to join the room.
+func (lk *livekit) Token(room, identity, name string, ttl time.Duration) (string, error) {
+	yes := true
+	return lk.sign(&claims{
+		Subject: identity,
+		Name:    name,
+		Video: &videoGrant{
+			Room:         room,
+			RoomJoin:     true,
+			CanPublish:   &yes,
+			CanSubscribe: &yes,
+		},
+	}, ttl)
+}
+
+// DeleteRoom disconnects all participants and deletes the room.
+func (lk *livekit) DeleteRoom(ctx context.Context, room string) error {
+	return lk.call(ctx, "DeleteRoom", room, map[string]any{"room": room})
+}
+
+// call makes a request to the room service.
+func (lk *livekit) call(ctx context.Context, method, room string, params map[string]any) error {
+	token, err := lk.sign(&claims{Video: &videoGrant{Room: room, RoomCreate: true}}, serviceTokenTTL)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lk.apiURL+roomServicePath+method,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := lk.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Twirp errors are JSON objects with 'code' and 'msg'.
+		var twerr struct {
+			Code string `json:"code"`
+			Msg  string `json:"msg"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &twerr) == nil && twerr.Code != "" {
+			if method == "DeleteRoom" && twerr.Code == "not_found" {
+				// The room is already gone.
+				return nil
+			}
+			return errors.New("livekit: " + method + ": " + twerr.Code + " " + twerr.Msg)
+		}
+		return errors.New("livekit: " + method + ": " + resp.Status)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// sign creates a JWT signed with HS256.
+func (lk *livekit) sign(c *claims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	c.Issuer = lk.apiKey
+	c.NotBefore = now.Unix()
+	c.Expires = now.Add(ttl).Unix()
+	payload, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, lk.apiSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+func init() {
+	sfu.Register(providerName, &livekit{})
+}
@@ -0,0 +1,112 @@
+package livekit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verify checks the signature of the token and returns its claims.
+func verify(t *testing.T, token, secret string) *claims {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Malformed token %q", token)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != parts[2] {
+		t.Fatal("Invalid signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c claims
+	if err = json.Unmarshal(payload, &c); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func TestToken(t *testing.T) {
+	lk := &livekit{}
+	if err := lk.Init(json.RawMessage(`{"url":"wss://sfu.example.com","api_key":"key","api_secret":"secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if lk.apiURL != "https://sfu.example.com" {
+		t.Errorf("Unexpected API URL %q", lk.apiURL)
+	}
+
+	token, err := lk.Token("grpABC-5", "usrXYZ", "Alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := verify(t, token, "secret")
+	if c.Issuer != "key" || c.Subject != "usrXYZ" || c.Name != "Alice" || c.Expires-c.NotBefore != 3600 {
+		t.Errorf("Unexpected claims %+v", c)
+	}
+	if c.Video == nil || c.Video.Room != "grpABC-5" || !c.Video.RoomJoin || c.Video.RoomCreate {
+		t.Errorf("Unexpected grants %+v", c.Video)
+	}
+}
+
+func TestRoomService(t *testing.T) {
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := verify(t, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), "secret")
+		if c.Video == nil || !c.Video.RoomCreate {
+			t.Errorf("Missing room grant %+v", c.Video)
+		}
+		var params map[string]any
+		json.NewDecoder(r.Body).Decode(&params)
+		method := strings.TrimPrefix(r.URL.Path, roomServicePath)
+		methods = append(methods, method)
+		switch method {
+		case "CreateRoom":
+			if params["name"] != "room" || params["max_participants"] != float64(8) {
+				t.Errorf("Unexpected params %v", params)
+			}
+			w.Write([]byte(`{"name":"room"}`))
+		case "DeleteRoom":
+			if params["room"] == "missing" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"code":"not_found","msg":"room not found"}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":"bad_route","msg":"no handler"}`))
+		}
+	}))
+	defer srv.Close()
+
+	lk := &livekit{}
+	if err := lk.Init(json.RawMessage(`{"url":"wss://sfu.example.com","api_url":"` + srv.URL +
+		`","api_key":"key","api_secret":"secret"}`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := lk.CreateRoom(ctx, "room", 8); err != nil {
+		t.Error(err)
+	}
+	if err := lk.DeleteRoom(ctx, "room"); err != nil {
+		t.Error(err)
+	}
+	if err := lk.DeleteRoom(ctx, "missing"); err != nil {
+		t.Error("Deleting missing room:", err)
+	}
+	if err := lk.call(ctx, "Bogus", "room", nil); err == nil || !strings.Contains(err.Error(), "bad_route") {
+		t.Error("Expected error, got", err)
+	}
+	if strings.Join(methods, ",") != "CreateRoom,DeleteRoom,DeleteRoom,Bogus" {
+		t.Errorf("Unexpected calls %v", methods)
+	}
+}
@@ -0,0 +1,149 @@
+// Package sfu defines an interface which must be implemented by selective forwarding units (media
+// servers) used for group video calls. The server provisions a room for every group call and issues
+// access tokens to the participants. Media is exchanged between clients and the SFU directly.
+package sfu
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	// Default timeout of requests to the SFU, seconds.
+	defaultTimeout = 10
+	// Default lifetime of access tokens, seconds.
+	defaultTokenTTL = 3600
+	// Default maximum number of participants of a call.
+	defaultMaxParticipants = 16
+)
+
+// Provider is an interface which must be implemented by SFU integrations.
+type Provider interface {
+	// Init initializes the provider.
+	Init(jsonconf json.RawMessage) error
+
+	// URL returns the URL clients use to connect to the SFU.
+	URL() string
+
+	// CreateRoom provisions a room which holds up to maxParticipants participants.
+	CreateRoom(ctx context.Context, room string, maxParticipants int) error
+
+	// Token issues a token which grants the identity access to the room. The name is shown to
+	// other participants.
+	Token(room, identity, name string, ttl time.Duration) (string, error)
+
+	// DeleteRoom disconnects all participants and deletes the room.
+	DeleteRoom(ctx context.Context, room string) error
+}
+
+type configType struct {
+	// Name of the SFU to use. Group calls are disabled if blank.
+	UseSFU string `json:"use_sfu"`
+	// Maximum number of participants of a call.
+	MaxParticipants int `json:"max_participants"`
+	// Lifetime of access tokens, seconds.
+	TokenTTL int `json:"token_ttl"`
+	// Timeout of requests to the SFU, seconds.
+	Timeout int `json:"timeout"`
+	// Individual SFU config params to pass to providers unchanged.
+	Providers map[string]json.RawMessage `json:"providers"`
+}
+
+var providers map[string]Provider
+
+// The provider in use.
+var provider Provider
+var maxParticipants int
+var tokenTTL time.Duration
+var timeout time.Duration
+
+// Register an SFU provider.
+func Register(name string, p Provider) {
+	if providers == nil {
+		providers = make(map[string]Provider)
+	}
+
+	if p == nil {
+		panic("Register: provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("Register: called twice for provider " + name)
+	}
+	providers[name] = p
+}
+
+// Init initializes the configured provider. Returns the name of the provider in use or an empty
+// string if group calls are disabled.
+func Init(jsconfig json.RawMessage) (string, error) {
+	provider = nil
+	if len(jsconfig) == 0 {
+		return "", nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return "", errors.New("failed to parse config: " + err.Error())
+	}
+	if config.UseSFU == "" {
+		return "", nil
+	}
+
+	p := providers[config.UseSFU]
+	if p == nil {
+		return "", errors.New("unknown SFU '" + config.UseSFU + "'")
+	}
+	if err := p.Init(config.Providers[config.UseSFU]); err != nil {
+		return "", err
+	}
+
+	provider = p
+	maxParticipants = config.MaxParticipants
+	if maxParticipants <= 0 {
+		maxParticipants = defaultMaxParticipants
+	}
+	tokenTTL = time.Second * time.Duration(config.TokenTTL)
+	if tokenTTL <= 0 {
+		tokenTTL = time.Second * defaultTokenTTL
+	}
+	timeout = time.Second * time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = time.Second * defaultTimeout
+	}
+	return config.UseSFU, nil
+}
+
+// IsEnabled checks if an SFU is configured.
+func IsEnabled() bool {
+	return provider != nil
+}
+
+// MaxParticipants returns the maximum number of participants of a call.
+func MaxParticipants() int {
+	return maxParticipants
+}
+
+// URL returns the URL clients use to connect to the SFU.
+func URL() string {
+	return provider.URL()
+}
+
+// CreateRoom provisions a room for a call.
+func CreateRoom(room string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return provider.CreateRoom(ctx, room, maxParticipants)
+}
+
+// Token issues a token which grants the identity access to the room.
+func Token(room, identity, name string) (string, error) {
+	return provider.Token(room, identity, name, tokenTTL)
+}
+
+// DeleteRoom deletes the room of a finished call.
+func DeleteRoom(room string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return provider.DeleteRoom(ctx, room)
+}
@@ -0,0 +1,77 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Slow mode of group topics. Owners and admins of a group topic limit
+ *    subscribers to one message per N seconds with {set desc={slow: N}},
+ *    {set desc={slow: 0}} turns the slow mode off. Messages published
+ *    sooner are rejected with {ctrl code=429} and params.retry, the number
+ *    of milliseconds after which the message may be sent.
+ *
+ *    Owners, admins and moderators are not limited.
+ *
+ *    All messages of a topic are published by the cluster node which masters
+ *    the topic, so times of the last messages are kept by the master topic
+ *    and are the same for all sessions of the user on all nodes.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum interval between messages in slow mode, seconds.
+	maxSlowMode = 3600
+	// Times of the last messages are purged of expired ones when there are this many of them.
+	slowModePurgeSize = 256
+)
+
+// slowModeExempt checks if the user is not limited by the slow mode.
+func (t *Topic) slowModeExempt(uid types.Uid) bool {
+	return t.rankOf(uid) >= roleRanks[roleModerator]
+}
+
+// slowModeWait returns the time the user must wait before publishing the next message or 0.
+func (t *Topic) slowModeWait(uid types.Uid, now time.Time) time.Duration {
+	if t.slowMode <= 0 || t.cat != types.TopicCatGrp || t.slowModeExempt(uid) {
+		return 0
+	}
+	last, ok := t.slowPosts[uid]
+	if !ok {
+		return 0
+	}
+	if wait := last.Add(time.Duration(t.slowMode) * time.Second).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// slowModeRecord records the time of the message published by the user.
+func (t *Topic) slowModeRecord(uid types.Uid, now time.Time) {
+	if t.slowMode <= 0 || t.cat != types.TopicCatGrp || t.slowModeExempt(uid) {
+		return
+	}
+	if t.slowPosts == nil {
+		t.slowPosts = make(map[types.Uid]time.Time)
+	} else if len(t.slowPosts) >= slowModePurgeSize {
+		expired := now.Add(-time.Duration(t.slowMode) * time.Second)
+		for id, last := range t.slowPosts {
+			if last.Before(expired) {
+				delete(t.slowPosts, id)
+			}
+		}
+	}
+	t.slowPosts[uid] = now
+}
+
+// ErrSlowModeReply is a response to a message published too soon in slow mode (429).
+func ErrSlowModeReply(msg *ClientComMessage, wait time.Duration) *ServerComMessage {
+	resp := ErrTooManyRequestsReply(msg, types.TimeNow())
+	resp.Ctrl.Params = map[string]any{"retry": int(math.Ceil(float64(wait) / float64(time.Millisecond)))}
+	return resp
+}
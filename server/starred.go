@@ -0,0 +1,216 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Starred (saved) messages. The user stars a message in a topic with
+ *    {set topic="grpX" star={seq}} and unstars it with unstar=true. The server
+ *    keeps a copy of the starred message, so it survives even if the user
+ *    leaves the topic. Messages of left topics are unstarred in 'me' with
+ *    {set topic="me" star={topic, seq, unstar: true}}. Starred messages across
+ *    topics are fetched with {get topic="me" what="starred"}. User's other
+ *    sessions are notified with {info topic="me" what="star"}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// replySetStar stars or unstars a message in the topic, or unstars a message of any topic in 'me'.
+func (t *Topic) replySetStar(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	star := msg.Set.Star
+	if t.cat == types.TopicCatMe {
+		return t.replyUnstarMe(sess, asUid, msg)
+	}
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for starred messages")
+	}
+
+	pud := t.perUser[asUid]
+	if asChan || pud.deleted || !(pud.modeGiven & pud.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to star a message by non-reader")
+	}
+
+	if star.Topic != "" || star.SeqId <= 0 || star.SeqId > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.star: invalid message ID")
+	}
+
+	var changed bool
+	var err error
+	what := "del"
+	if star.Unstar {
+		changed, err = store.Starred.Delete(asUid, t.name, star.SeqId)
+	} else {
+		var origMsg *types.Message
+		if origMsg, err = store.Messages.GetBySeqId(t.name, star.SeqId); err == nil {
+			if origMsg == nil || origMsg.DeletedAt != nil || origMsg.Head["unsent"] == true ||
+				!t.userInMsgScope(msgScope(origMsg.Head), asUid) {
+				// Don't disclose the existence of the message.
+				sess.queueOut(ErrNotFoundReply(msg, now))
+				return types.ErrNotFound
+			}
+			changed, err = store.Starred.Add(&types.StarredMessage{
+				User:    asUid.String(),
+				Topic:   t.name,
+				SeqId:   star.SeqId,
+				From:    types.ParseUid(origMsg.From).String(),
+				Head:    origMsg.Head,
+				Content: origMsg.Content,
+				SentAt:  origMsg.CreatedAt,
+			})
+		}
+		what = "add"
+	}
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if !changed {
+		// The message is already starred or is not starred.
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	// Inform user's other sessions.
+	globals.hub.routeSrv <- &ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: "me",
+			Src:   t.original(asUid),
+			From:  asUid.UserId(),
+			What:  "star",
+			SeqId: star.SeqId,
+			Event: what,
+		},
+		RcptTo:  asUid.UserId(),
+		SkipSid: sess.sid,
+	}
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyUnstarMe unstars a message of any topic, including topics the user has left.
+func (t *Topic) replyUnstarMe(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	star := msg.Set.Star
+	topic := star.Topic
+	if cat, ok := topicCatOf(topic); !ok {
+		topic = ""
+	} else if cat == types.TopicCatMe {
+		// P2P topic addressed by the ID of the other user.
+		topic = asUid.P2PName(types.ParseUserId(topic))
+	}
+	if !star.Unstar || topic == "" || star.SeqId <= 0 {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("set.star: messages are starred in their topics")
+	}
+
+	deleted, err := store.Starred.Delete(asUid, topic, star.SeqId)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+	if !deleted {
+		sess.queueOut(InfoNotModifiedReply(msg, now))
+		return nil
+	}
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: "me",
+			Src:   star.Topic,
+			From:  asUid.UserId(),
+			What:  "star",
+			SeqId: star.SeqId,
+			Event: "del",
+		},
+		SkipSid: sess.sid,
+	})
+
+	sess.queueOut(NoErrReply(msg, now))
+	return nil
+}
+
+// replyGetStarred returns messages starred by the user, the most recently starred first.
+func (t *Topic) replyGetStarred(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for starred messages")
+	}
+
+	if req != nil && (req.User != "" || req.IfModifiedSince != nil || req.SinceId != 0 || req.BeforeId != 0 ||
+		len(req.IdRanges) > 0 || req.Search != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid starred messages query")
+	}
+
+	var opts MsgGetOpts
+	if req != nil {
+		opts = *req
+	}
+	topic := opts.Topic
+	if topic != "" {
+		cat, ok := topicCatOf(topic)
+		if ok && cat == types.TopicCatMe {
+			// P2P topic addressed by the ID of the other user.
+			topic = asUid.P2PName(types.ParseUserId(topic))
+		}
+		if !ok || topic == "" {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return errors.New("invalid topic of starred messages")
+		}
+	}
+
+	starred, err := store.Starred.GetAll(asUid, topic, opts.Until, opts.Limit)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(starred) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "starred"}))
+		return nil
+	}
+
+	result := make([]MsgStarred, len(starred))
+	for i := range starred {
+		sm := &starred[i]
+		topic := sm.Topic
+		if types.GetTopicCat(topic) == types.TopicCatP2P {
+			// The user sees P2P topics as IDs of the other users.
+			topic, _ = types.P2PNameForUser(asUid, topic)
+		}
+		result[i] = MsgStarred{
+			Topic:     topic,
+			SeqId:     sm.SeqId,
+			From:      types.ParseUid(sm.From).UserId(),
+			Head:      sm.Head,
+			Content:   sm.Content,
+			Timestamp: sm.SentAt,
+			StarredAt: sm.CreatedAt,
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Starred:   result,
+		},
+	})
+	return nil
+}
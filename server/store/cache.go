@@ -0,0 +1,190 @@
+package store
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Cache of frequent reads. Users, topics, subscriptions of topics and the latest messages of topics are
+// kept serialized in a cache shared by cluster nodes, e.g. Redis. The store removes cached objects when
+// it changes them. Objects also expire after a while in case a change is missed, e.g. when a write races
+// with a read which repopulates the cache. Failures of the cache are not fatal: objects are read from
+// the database. Messages are cached as stored, i.e. encrypted if encryption at rest is enabled.
+
+// Cache keeps serialized objects by key.
+type Cache interface {
+	// Get returns the value of the key, nil if the key is not found.
+	Get(key string) ([]byte, error)
+	// Set stores the value of the key.
+	Set(key string, value []byte) error
+	// HGet returns the value of the field of the hash, nil if the field is not found.
+	HGet(key, field string) ([]byte, error)
+	// HSet stores the value of the field of the hash.
+	HSet(key, field string, value []byte) error
+	// Delete removes the keys. Hashes are removed with all fields.
+	Delete(keys ...string) error
+}
+
+// Cache or nil if caching is disabled.
+var readCache Cache
+
+// Number of the latest messages of a topic to cache, 0 if messages are not cached.
+var cachedMessages int
+
+// InitCache enables caching of frequent reads. Up to 'messages' latest messages of every topic are cached
+// per user. Nil disables caching.
+func InitCache(c Cache, messages int) {
+	readCache = c
+	cachedMessages = messages
+}
+
+// IsCacheEnabled checks if frequent reads are cached.
+func IsCacheEnabled() bool {
+	return readCache != nil
+}
+
+func cacheKeyUser(uid types.Uid) string {
+	return "usr:" + uid.String()
+}
+
+func cacheKeyTopic(topic string) string {
+	return "top:" + topic
+}
+
+// Subscriptions of the topic without deleted subscriptions.
+func cacheKeySubs(topic string) string {
+	return "sub:" + topic
+}
+
+// Hash of the latest messages of the topic, one field per user.
+func cacheKeyMessages(topic string) string {
+	return "msg:" + topic
+}
+
+// cacheGet reads the cached object into val. Returns false if the object is not cached.
+func cacheGet(key string, val any) bool {
+	if readCache == nil {
+		return false
+	}
+	data, err := readCache.Get(key)
+	if err != nil {
+		logs.Warn.Println("cache: failed to read", key, err)
+		return false
+	}
+	return cacheDecode(key, data, val)
+}
+
+// cachePut caches the object.
+func cachePut(key string, val any) {
+	if readCache == nil {
+		return
+	}
+	data, err := json.Marshal(val)
+	if err == nil {
+		err = readCache.Set(key, data)
+	}
+	if err != nil {
+		logs.Warn.Println("cache: failed to write", key, err)
+	}
+}
+
+// cacheHGet reads the cached object from the field of the hash into val. Returns false if the object
+// is not cached.
+func cacheHGet(key, field string, val any) bool {
+	if readCache == nil {
+		return false
+	}
+	data, err := readCache.HGet(key, field)
+	if err != nil {
+		logs.Warn.Println("cache: failed to read", key, err)
+		return false
+	}
+	return cacheDecode(key, data, val)
+}
+
+// cacheHPut caches the object in the field of the hash.
+func cacheHPut(key, field string, val any) {
+	if readCache == nil {
+		return
+	}
+	data, err := json.Marshal(val)
+	if err == nil {
+		err = readCache.HSet(key, field, data)
+	}
+	if err != nil {
+		logs.Warn.Println("cache: failed to write", key, err)
+	}
+}
+
+func cacheDecode(key string, data []byte, val any) bool {
+	if data == nil {
+		return false
+	}
+	if err := json.Unmarshal(data, val); err != nil {
+		logs.Warn.Println("cache: invalid value of", key, err)
+		return false
+	}
+	return true
+}
+
+// cacheInvalidate removes the objects from the cache.
+func cacheInvalidate(keys ...string) {
+	if readCache == nil {
+		return
+	}
+	if err := readCache.Delete(keys...); err != nil {
+		logs.Warn.Println("cache: failed to remove", keys, err)
+	}
+}
+
+// cacheInvalidateTopic removes the topic, its subscriptions and messages from the cache.
+func cacheInvalidateTopic(topic string) {
+	cacheInvalidate(cacheKeyTopic(topic), cacheKeySubs(topic), cacheKeyMessages(topic))
+}
+
+// cacheInvalidateUserTopics removes topics and subscriptions of topics the user is subscribed to.
+// Called before changes of the user which affect all of user's topics.
+func cacheInvalidateUserTopics(uid types.Uid) {
+	if readCache == nil {
+		return
+	}
+	subs, err := adp.SubsForUser(uid)
+	if err != nil {
+		logs.Warn.Println("cache: failed to read subscriptions of", uid, err)
+		return
+	}
+	keys := make([]string, 0, 2*len(subs))
+	for i := range subs {
+		keys = append(keys, cacheKeyTopic(subs[i].Topic), cacheKeySubs(subs[i].Topic))
+	}
+	if len(keys) > 0 {
+		cacheInvalidate(keys...)
+	}
+}
+
+// cachedMessagesQuery checks if the query requests only the latest messages of the topic which are
+// cached. Returns the number of requested messages.
+func cachedMessagesQuery(opt *types.QueryOpt) (int, bool) {
+	if readCache == nil || cachedMessages <= 0 {
+		return 0, false
+	}
+	limit := defaultColdResults
+	if opt != nil {
+		if opt.Since > 0 || opt.Before > 0 || len(opt.IdRanges) > 0 || opt.Search != "" || opt.Thread > 0 {
+			return 0, false
+		}
+		if opt.Limit > 0 {
+			limit = opt.Limit
+		}
+	}
+	return limit, limit <= cachedMessages
+}
+
+// cacheFieldMessages is the field of the hash of the latest messages of the topic with messages
+// as seen by the user. The number of messages is a part of the field in case it's changed in the config.
+func cacheFieldMessages(forUser types.Uid) string {
+	return forUser.String() + ":" + strconv.Itoa(cachedMessages)
+}
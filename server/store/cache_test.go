@@ -0,0 +1,38 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+type nullCache struct{}
+
+func (nullCache) Get(key string) ([]byte, error)             { return nil, nil }
+func (nullCache) Set(key string, value []byte) error         { return nil }
+func (nullCache) HGet(key, field string) ([]byte, error)     { return nil, nil }
+func (nullCache) HSet(key, field string, value []byte) error { return nil }
+func (nullCache) Delete(keys ...string) error                { return nil }
+
+func TestCachedMessagesQuery(t *testing.T) {
+	InitCache(nullCache{}, 50)
+	defer InitCache(nil, 0)
+
+	if limit, ok := cachedMessagesQuery(&types.QueryOpt{Limit: 24}); !ok || limit != 24 {
+		t.Errorf("Expected latest 24 messages cached, got %d, %v", limit, ok)
+	}
+	if _, ok := cachedMessagesQuery(nil); ok {
+		t.Error("Default number of messages is greater than cached")
+	}
+	if _, ok := cachedMessagesQuery(&types.QueryOpt{Limit: 10, Before: 100}); ok {
+		t.Error("Older messages must not be cached")
+	}
+	if _, ok := cachedMessagesQuery(&types.QueryOpt{Limit: 10, Thread: 5}); ok {
+		t.Error("Messages of a thread must not be cached")
+	}
+
+	InitCache(nullCache{}, 0)
+	if _, ok := cachedMessagesQuery(&types.QueryOpt{Limit: 10}); ok {
+		t.Error("Messages cached when disabled")
+	}
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Index of contacts for discovering users by phone numbers and emails from the address book of the
+// client. The index contains hashes of users' phone number and email tags, such as "tel:+17025550001"
+// and "email:alice@example.com", salted with a server-wide salt. Clients compute the same hashes
+// of their contacts and look them up without sending the plain phone numbers and emails.
+
+// Salt of hashes of contacts or empty if the index is disabled.
+var contactSalt string
+
+// InitContactIndex enables discovery of contacts with the given salt. Empty salt disables it.
+func InitContactIndex(salt string) {
+	contactSalt = salt
+}
+
+// IsContactDiscoveryEnabled returns true if users can be found by hashes of phone numbers and emails.
+func IsContactDiscoveryEnabled() bool {
+	return contactSalt != ""
+}
+
+// ContactSalt returns the salt clients use to compute hashes of contacts.
+func ContactSalt() string {
+	return contactSalt
+}
+
+// ContactHash returns the hex-encoded SHA-256 hash of the salt followed by the tag.
+func ContactHash(tag string) string {
+	sum := sha256.Sum256([]byte(contactSalt + tag))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,18 @@
+package store
+
+import "testing"
+
+func TestContactHash(t *testing.T) {
+	if IsContactDiscoveryEnabled() {
+		t.Fatal("Expected contact discovery to be disabled without the salt")
+	}
+
+	InitContactIndex("pepper")
+	t.Cleanup(func() { InitContactIndex("") })
+
+	// Same as: echo -n "peppertel:+17025550001" | sha256sum
+	expected := "95a49e831d1af0292466d6af22aedc265831e81f990e24c88ea74d0d2d5178b6"
+	if hash := ContactHash("tel:+17025550001"); hash != expected {
+		t.Errorf("Expected %s, got %s", expected, hash)
+	}
+}
@@ -8,60 +8,211 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"strings"
+	"sync/atomic"
 
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
 )
 
+// DefaultMaxDecryptedSize is the default upper bound on the size of decrypted message content: 4 MiB.
+const DefaultMaxDecryptedSize = 4 << 20
+
+// ErrContentTooLarge is returned when decrypted content exceeds the configured limit.
+var ErrContentTooLarge = errors.New("decrypted content exceeds size limit")
+
+// ErrEncryptionUnavailable is returned when encryption is suspended after a failed health check.
+var ErrEncryptionUnavailable = errors.New("message encryption unavailable")
+
+// Value encrypted and decrypted by EncryptionSelfTest. It's never stored.
+const encryptionCanary = "tinode-encryption-canary"
+
+// Name of the topic the per-topic key of EncryptionSelfTest is derived for. It's not a valid topic name.
+const encryptionCanaryTopic = "encryption-canary"
+
+// Prefix of encrypted content in the legacy format which has no key ID: "ENC:<base64>".
+const encPrefixV1 = "ENC:"
+
+// Prefix of encrypted content which carries the ID of the key: "ENC:v2:<key id>:<base64>".
+const encPrefixV2 = "ENC:v2:"
+
+// Prefix of content encrypted with a per-topic key derived from the key with the given ID:
+// "ENC:v3:<key id>:<base64>". The key ID is empty for the legacy key.
+const encPrefixV3 = "ENC:v3:"
+
+// Maximum length of a key ID.
+const maxEncryptionKeyIDLength = 32
+
 // MessageEncryption handles encryption/decryption of message content at rest.
 type MessageEncryption struct {
 	enabled bool
-	key     []byte
-	gcm     cipher.AEAD
+	// Keys by key ID.
+	keys map[string]cipher.AEAD
+	// Raw keys by key ID for derivation of per-topic keys. The legacy key has an empty ID.
+	rawKeys map[string][]byte
+	// Encrypt message content with per-topic keys.
+	perTopic bool
+	// ID of the key used to encrypt new content. Empty if new content is encrypted in the
+	// legacy format with the legacy key.
+	activeID string
+	// Key for content in the legacy format. Could be nil.
+	legacy cipher.AEAD
+	// Maximum size of plaintext in bytes.
+	maxSize int
+	// Message header fields to encrypt.
+	headFields map[string]bool
+	// Encrypt metadata of uploaded files.
+	fileMetadata bool
+	// Key provider which unwrapped the keys and the wrapped active key: used by EncryptionSelfTest to
+	// check that the provider is still available and returns the same key.
+	keyProvider   *keyProviderConfig
+	wrappedActive string
+}
+
+// Message header fields which are updated by DB adapters and must remain in plaintext.
+var plaintextHeadFields = map[string]bool{
+	"reactions":  true,
+	"edited":     true,
+	"edited_at":  true,
+	"edit_count": true,
+	"unsent":     true,
+	"unsent_at":  true,
 }
 
 var msgEncryption *MessageEncryption
 
+// Set when encryption is deemed broken and the server is configured to fail closed.
+var encryptionSuspended atomic.Bool
+
 // InitMessageEncryption initializes the message encryption system.
 // key should be a base64-encoded 32-byte (256-bit) AES key.
 // If key is empty, encryption is disabled.
-func InitMessageEncryption(keyBase64 string) error {
-	if keyBase64 == "" {
-		msgEncryption = &MessageEncryption{enabled: false}
+// maxDecryptedSize limits the size of plaintext produced by DecryptContent;
+// if it's zero or negative, DefaultMaxDecryptedSize is used.
+func InitMessageEncryption(keyBase64 string, maxDecryptedSize int) error {
+	return InitMessageEncryptionKeyring(keyBase64, nil, "", maxDecryptedSize)
+}
+
+// InitMessageEncryptionKeyring initializes the message encryption system with multiple keys.
+// legacyKey is a base64-encoded AES-256 key used for content encrypted in the legacy format
+// without a key ID; it's optional if keyring is not empty. keyring maps key IDs to base64-encoded
+// AES-256 keys. New content is encrypted with the key activeID. If activeID is empty, new content
+// is encrypted with the legacy key in the legacy format. If all keys are empty, encryption is disabled.
+//
+// Keys are rotated by adding a new key to the keyring and making it active. Old keys must be kept
+// in the keyring for as long as content encrypted with them exists.
+func InitMessageEncryptionKeyring(legacyKey string, keyring map[string]string, activeID string,
+	maxDecryptedSize int) error {
+	if maxDecryptedSize <= 0 {
+		maxDecryptedSize = DefaultMaxDecryptedSize
+	}
+
+	if legacyKey == "" && len(keyring) == 0 {
+		if activeID != "" {
+			return errors.New("active encryption key '" + activeID + "' not found")
+		}
+		msgEncryption = &MessageEncryption{enabled: false, maxSize: maxDecryptedSize}
 		if logs.Info != nil {
 			logs.Info.Println("Message encryption at rest: DISABLED")
 		}
 		return nil
 	}
 
+	enc := &MessageEncryption{
+		enabled:  true,
+		keys:     make(map[string]cipher.AEAD, len(keyring)),
+		rawKeys:  make(map[string][]byte, len(keyring)+1),
+		activeID: activeID,
+		maxSize:  maxDecryptedSize,
+	}
+
+	if legacyKey != "" {
+		gcm, raw, err := newEncryptionCipher(legacyKey)
+		if err != nil {
+			return err
+		}
+		enc.legacy = gcm
+		enc.rawKeys[""] = raw
+	}
+
+	for id, key := range keyring {
+		if !isValidEncryptionKeyID(id) {
+			return errors.New("invalid encryption key ID '" + id + "'")
+		}
+		gcm, raw, err := newEncryptionCipher(key)
+		if err != nil {
+			return errors.New("encryption key '" + id + "': " + err.Error())
+		}
+		enc.keys[id] = gcm
+		enc.rawKeys[id] = raw
+	}
+
+	if activeID == "" {
+		if enc.legacy == nil {
+			return errors.New("active encryption key ID is not specified")
+		}
+	} else if _, ok := enc.keys[activeID]; !ok {
+		return errors.New("active encryption key '" + activeID + "' not found")
+	}
+
+	msgEncryption = enc
+	resetTopicKeyCache()
+
+	if err := EncryptionSelfTest(); err != nil {
+		msgEncryption = nil
+		return errors.New("encryption self-test failed: " + err.Error())
+	}
+
+	if logs.Info != nil {
+		if activeID != "" {
+			logs.Info.Printf("Message encryption at rest: ENABLED, %d key(s), active key '%s'", len(enc.keys), activeID)
+		} else {
+			logs.Info.Println("Message encryption at rest: ENABLED")
+		}
+	}
+	return nil
+}
+
+// newEncryptionCipher creates AES-GCM cipher from a base64-encoded 32-byte key.
+// Returns the cipher and the decoded key.
+func newEncryptionCipher(keyBase64 string) (cipher.AEAD, []byte, error) {
 	key, err := base64.StdEncoding.DecodeString(keyBase64)
 	if err != nil {
-		return errors.New("invalid encryption key: " + err.Error())
+		return nil, nil, errors.New("invalid encryption key: " + err.Error())
 	}
 
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, key, nil
+}
+
+// newGCM creates AES-GCM cipher from a raw 32-byte key.
+func newGCM(key []byte) (cipher.AEAD, error) {
 	if len(key) != 32 {
-		return errors.New("encryption key must be 32 bytes (256-bit AES)")
+		return nil, errors.New("encryption key must be 32 bytes (256-bit AES)")
 	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
-	}
+	return cipher.NewGCM(block)
+}
 
-	msgEncryption = &MessageEncryption{
-		enabled: true,
-		key:     key,
-		gcm:     gcm,
+// isValidEncryptionKeyID checks that the key ID is made of letters, digits, '-' and '_'.
+func isValidEncryptionKeyID(id string) bool {
+	if id == "" || len(id) > maxEncryptionKeyIDLength {
+		return false
 	}
-
-	if logs.Info != nil {
-		logs.Info.Println("Message encryption at rest: ENABLED")
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
 	}
-	return nil
+	return true
 }
 
 // IsEncryptionEnabled returns true if message encryption is enabled.
@@ -69,39 +220,188 @@ func IsEncryptionEnabled() bool {
 	return msgEncryption != nil && msgEncryption.enabled
 }
 
+// SuspendEncryption makes EncryptContent and DecryptContent fail with ErrEncryptionUnavailable
+// while suspended is true. It's used to fail closed when encryption health check fails.
+func SuspendEncryption(suspended bool) {
+	encryptionSuspended.Store(suspended)
+}
+
+// IsEncryptionSuspended returns true if encryption is suspended by SuspendEncryption.
+func IsEncryptionSuspended() bool {
+	return encryptionSuspended.Load()
+}
+
+// EncryptionSelfTest checks that message encryption works: the key provider, if any, still returns
+// the active key, and a canary value encrypted with the active key and, if per-topic keys are enabled,
+// with a freshly derived per-topic key decrypts correctly. The check does not read or write stored
+// messages, it runs even while encryption is suspended. Returns nil if encryption is disabled.
+func EncryptionSelfTest() error {
+	if !IsEncryptionEnabled() {
+		return nil
+	}
+
+	if msgEncryption.keyProvider != nil {
+		key, err := unwrapKey(msgEncryption.keyProvider, msgEncryption.wrappedActive)
+		if err != nil {
+			return errors.New("key provider failed: " + err.Error())
+		}
+		if key != base64.StdEncoding.EncodeToString(msgEncryption.rawKeys[msgEncryption.activeID]) {
+			return errors.New("key provider returned a different key")
+		}
+	}
+
+	topics := []string{""}
+	if msgEncryption.perTopic {
+		// Drop the cached key to derive it anew.
+		topicKeyCache.Lock()
+		delete(topicKeyCache.entries, msgEncryption.activeID+":"+encryptionCanaryTopic)
+		topicKeyCache.Unlock()
+		topics = append(topics, encryptionCanaryTopic)
+	}
+	for _, topic := range topics {
+		enc, err := encryptContent(topic, encryptionCanary)
+		if err != nil {
+			return err
+		}
+		dec, err := decryptContent(topic, enc)
+		if err != nil {
+			return err
+		}
+		if dec != encryptionCanary {
+			return errors.New("decrypted canary does not match")
+		}
+	}
+	return nil
+}
+
 // EncryptContent encrypts message content before storing to database.
 // Returns the original content if encryption is disabled.
 func EncryptContent(content any) (any, error) {
+	return EncryptTopicContent("", content)
+}
+
+// EncryptTopicContent encrypts content of a message in the given topic. If per-topic keys are
+// enabled, the content is encrypted with the key of the topic, otherwise it's the same as EncryptContent.
+func EncryptTopicContent(topic string, content any) (any, error) {
 	if !IsEncryptionEnabled() {
 		return content, nil
 	}
+	if encryptionSuspended.Load() {
+		return nil, ErrEncryptionUnavailable
+	}
+	return encryptContent(topic, content)
+}
 
+func encryptContent(topic string, content any) (any, error) {
 	// Serialize content to JSON
 	plaintext, err := json.Marshal(content)
 	if err != nil {
 		return nil, err
 	}
 
+	prefix := msgEncryption.activePrefix(topic)
+	var gcm cipher.AEAD
+	if strings.HasPrefix(prefix, encPrefixV3) {
+		if gcm, err = topicCipher(msgEncryption.activeID, topic, true); err != nil {
+			return nil, err
+		}
+	} else if msgEncryption.activeID != "" {
+		gcm = msgEncryption.keys[msgEncryption.activeID]
+	} else {
+		gcm = msgEncryption.legacy
+	}
+
 	// Generate random nonce
-	nonce := make([]byte, msgEncryption.gcm.NonceSize())
+	nonce := make([]byte, gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
 	// Encrypt: nonce is prepended to ciphertext
-	ciphertext := msgEncryption.gcm.Seal(nonce, nonce, plaintext, nil)
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	// Return as base64 string with prefix to identify encrypted content and the key.
+	return prefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// activePrefix returns the prefix of content in the topic encrypted with the active key.
+func (me *MessageEncryption) activePrefix(topic string) string {
+	if me.perTopic && topic != "" {
+		return encPrefixV3 + me.activeID + ":"
+	}
+	if me.activeID != "" {
+		return encPrefixV2 + me.activeID + ":"
+	}
+	return encPrefixV1
+}
+
+// parseEnvelope splits encrypted content into the prefix which identifies the key and the payload.
+func parseEnvelope(str string) (prefix, payload string, err error) {
+	for _, versioned := range []string{encPrefixV3, encPrefixV2} {
+		if strings.HasPrefix(str, versioned) {
+			id, rest, found := strings.Cut(str[len(versioned):], ":")
+			if !found {
+				return "", "", errors.New("malformed encrypted content")
+			}
+			return versioned + id + ":", rest, nil
+		}
+	}
+	return encPrefixV1, str[len(encPrefixV1):], nil
+}
 
-	// Return as base64 string with prefix to identify encrypted content
-	return "ENC:" + base64.StdEncoding.EncodeToString(ciphertext), nil
+// ReencryptContent encrypts plaintext content of a message in the topic, or decrypts and encrypts
+// again content which was encrypted with other than the active key. Returns the new content and true
+// if the content was changed, the original content and false if no change is needed.
+func ReencryptContent(topic string, content any) (any, bool, error) {
+	if !IsEncryptionEnabled() {
+		return content, false, nil
+	}
+	if encryptionSuspended.Load() {
+		return nil, false, ErrEncryptionUnavailable
+	}
+
+	if str, ok := content.(string); ok && strings.HasPrefix(str, encPrefixV1) {
+		prefix, _, err := parseEnvelope(str)
+		if err != nil {
+			return nil, false, err
+		}
+		if prefix == msgEncryption.activePrefix(topic) {
+			// Already encrypted with the active key.
+			return content, false, nil
+		}
+		plain, err := decryptContent(topic, content)
+		if err != nil {
+			return nil, false, err
+		}
+		content = plain
+	}
+
+	enc, err := encryptContent(topic, content)
+	if err != nil {
+		return nil, false, err
+	}
+	return enc, true, nil
 }
 
 // DecryptContent decrypts message content after reading from database.
 // Returns the original content if encryption is disabled or content is not encrypted.
+// Content encrypted with a per-topic key can be decrypted by DecryptTopicContent only.
 func DecryptContent(content any) (any, error) {
+	return DecryptTopicContent("", content)
+}
+
+// DecryptTopicContent decrypts content of a message in the given topic.
+func DecryptTopicContent(topic string, content any) (any, error) {
 	if !IsEncryptionEnabled() {
 		return content, nil
 	}
+	if encryptionSuspended.Load() {
+		return nil, ErrEncryptionUnavailable
+	}
+	return decryptContent(topic, content)
+}
 
+func decryptContent(topic string, content any) (any, error) {
 	// Check if content is an encrypted string
 	str, ok := content.(string)
 	if !ok {
@@ -110,19 +410,61 @@ func DecryptContent(content any) (any, error) {
 	}
 
 	// Check for encryption prefix
-	if len(str) < 4 || str[:4] != "ENC:" {
+	if !strings.HasPrefix(str, encPrefixV1) {
 		// Not encrypted, return as-is
 		return content, nil
 	}
 
+	prefix, payload, err := parseEnvelope(str)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the key(s) to try.
+	var ciphers []cipher.AEAD
+	switch {
+	case strings.HasPrefix(prefix, encPrefixV3):
+		if topic == "" {
+			return nil, errors.New("topic is required to decrypt content")
+		}
+		gcm, err := topicCipher(prefix[len(encPrefixV3):len(prefix)-1], topic, false)
+		if err != nil {
+			return nil, err
+		}
+		ciphers = []cipher.AEAD{gcm}
+	case strings.HasPrefix(prefix, encPrefixV2):
+		id := prefix[len(encPrefixV2) : len(prefix)-1]
+		gcm := msgEncryption.keys[id]
+		if gcm == nil {
+			return nil, errors.New("unknown encryption key '" + id + "'")
+		}
+		ciphers = []cipher.AEAD{gcm}
+	default:
+		// Legacy format: use the legacy key if available, otherwise try all keys.
+		if msgEncryption.legacy != nil {
+			ciphers = []cipher.AEAD{msgEncryption.legacy}
+		} else {
+			for _, gcm := range msgEncryption.keys {
+				ciphers = append(ciphers, gcm)
+			}
+		}
+	}
+
+	// Reject oversized payloads before allocating memory for them. Plaintext is never
+	// longer than ciphertext less nonce and authentication tag.
+	nonceSize := ciphers[0].NonceSize()
+	overhead := nonceSize + ciphers[0].Overhead()
+	if base64.StdEncoding.DecodedLen(len(payload))-overhead > msgEncryption.maxSize {
+		return nil, ErrContentTooLarge
+	}
+
 	// Decode base64
-	ciphertext, err := base64.StdEncoding.DecodeString(str[4:])
+	ciphertext, err := base64.StdEncoding.DecodeString(payload)
 	if err != nil {
 		return nil, errors.New("failed to decode encrypted content: " + err.Error())
 	}
 
 	// Extract nonce
-	nonceSize := msgEncryption.gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
@@ -130,11 +472,20 @@ func DecryptContent(content any) (any, error) {
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
 
 	// Decrypt
-	plaintext, err := msgEncryption.gcm.Open(nil, nonce, ciphertext, nil)
+	var plaintext []byte
+	for _, gcm := range ciphers {
+		if plaintext, err = gcm.Open(nil, nonce, ciphertext, nil); err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return nil, errors.New("failed to decrypt content: " + err.Error())
 	}
 
+	if len(plaintext) > msgEncryption.maxSize {
+		return nil, ErrContentTooLarge
+	}
+
 	// Deserialize JSON back to original type
 	var result any
 	if err := json.Unmarshal(plaintext, &result); err != nil {
@@ -144,6 +495,129 @@ func DecryptContent(content any) (any, error) {
 	return result, nil
 }
 
+// SetEncryptedMetadata configures encryption of message header fields and of file upload metadata
+// in addition to message content. Must be called after the encryption is initialized.
+func SetEncryptedMetadata(headFields []string, fileMetadata bool) error {
+	if !IsEncryptionEnabled() {
+		if len(headFields) > 0 || fileMetadata {
+			return errors.New("metadata encryption requires message encryption to be enabled")
+		}
+		return nil
+	}
+
+	fields := make(map[string]bool, len(headFields))
+	for _, name := range headFields {
+		if plaintextHeadFields[name] {
+			return errors.New("header field '" + name + "' cannot be encrypted")
+		}
+		fields[name] = true
+	}
+	msgEncryption.headFields = fields
+	msgEncryption.fileMetadata = fileMetadata
+	return nil
+}
+
+// EncryptHead returns a copy of the header of a message in the topic with values of the configured
+// fields encrypted. The original header is not modified. Returns the header unchanged if no fields
+// need encryption.
+func EncryptHead(topic string, head types.KVMap) (types.KVMap, error) {
+	if !IsEncryptionEnabled() || len(msgEncryption.headFields) == 0 || len(head) == 0 {
+		return head, nil
+	}
+
+	var result types.KVMap
+	for name, val := range head {
+		if !msgEncryption.headFields[name] || val == nil {
+			continue
+		}
+		enc, err := EncryptTopicContent(topic, val)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			result = make(types.KVMap, len(head))
+			for k, v := range head {
+				result[k] = v
+			}
+		}
+		result[name] = enc
+	}
+	if result == nil {
+		return head, nil
+	}
+	return result, nil
+}
+
+// DecryptHead decrypts encrypted values of the header of a message in the topic in place. All
+// encrypted values are decrypted, not just the currently configured fields.
+func DecryptHead(topic string, head types.KVMap) error {
+	if !IsEncryptionEnabled() {
+		return nil
+	}
+	for name, val := range head {
+		if str, ok := val.(string); !ok || !strings.HasPrefix(str, encPrefixV1) {
+			continue
+		}
+		dec, err := DecryptTopicContent(topic, val)
+		if err != nil {
+			return err
+		}
+		head[name] = dec
+	}
+	return nil
+}
+
+// encryptFileDef returns a copy of the file record with MIME type and location encrypted
+// if encryption of file metadata is enabled. Otherwise returns the original record.
+func encryptFileDef(fd *types.FileDef) (*types.FileDef, error) {
+	if !IsEncryptionEnabled() || !msgEncryption.fileMetadata || fd == nil {
+		return fd, nil
+	}
+
+	enc := *fd
+	for _, field := range []*string{&enc.MimeType, &enc.Location} {
+		if *field == "" {
+			continue
+		}
+		val, err := EncryptContent(*field)
+		if err != nil {
+			return nil, err
+		}
+		*field = val.(string)
+	}
+	return &enc, nil
+}
+
+// decryptFileDef decrypts MIME type and location of the file record in place.
+func decryptFileDef(fd *types.FileDef) error {
+	if fd == nil {
+		return nil
+	}
+	for _, field := range []*string{&fd.MimeType, &fd.Location} {
+		val, err := decryptString(*field)
+		if err != nil {
+			return err
+		}
+		*field = val
+	}
+	return nil
+}
+
+// decryptString decrypts a string value encrypted by EncryptContent. Plaintext values are returned as is.
+func decryptString(str string) (string, error) {
+	if !IsEncryptionEnabled() || !strings.HasPrefix(str, encPrefixV1) {
+		return str, nil
+	}
+	dec, err := DecryptContent(str)
+	if err != nil {
+		return "", err
+	}
+	if val, ok := dec.(string); ok {
+		return val, nil
+	}
+	return "", errors.New("encrypted value is not a string")
+}
+
 // GenerateEncryptionKey generates a new random 256-bit encryption key.
 // Returns the key as a base64-encoded string.
 func GenerateEncryptionKey() (string, error) {
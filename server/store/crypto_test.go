@@ -0,0 +1,301 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func initTestEncryption(t *testing.T, maxSize int) {
+	t.Helper()
+	key, err := GenerateEncryptionKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	if err := InitMessageEncryption(key, maxSize); err != nil {
+		t.Fatalf("Failed to init encryption: %v", err)
+	}
+	t.Cleanup(func() { msgEncryption = nil })
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	initTestEncryption(t, 0)
+
+	enc, err := EncryptContent("hello world")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if s, ok := enc.(string); !ok || !strings.HasPrefix(s, "ENC:") {
+		t.Fatalf("Expected encrypted string, got %v", enc)
+	}
+
+	dec, err := DecryptContent(enc)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if dec != "hello world" {
+		t.Errorf("Expected 'hello world', got %v", dec)
+	}
+}
+
+func TestDecryptContentSizeLimit(t *testing.T) {
+	initTestEncryption(t, 1024)
+
+	// Content which fits under the limit.
+	enc, err := EncryptContent(strings.Repeat("a", 512))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := DecryptContent(enc); err != nil {
+		t.Errorf("Expected content under the limit to decrypt, got %v", err)
+	}
+
+	// Content which is larger than the limit.
+	enc, err = EncryptContent(strings.Repeat("a", 4096))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := DecryptContent(enc); err != ErrContentTooLarge {
+		t.Errorf("Expected ErrContentTooLarge, got %v", err)
+	}
+
+	// Crafted oversized payload: must be rejected before decoding, i.e. even when it's not valid base64.
+	bomb := "ENC:" + strings.Repeat("!", 1<<20)
+	if _, err := DecryptContent(bomb); err != ErrContentTooLarge {
+		t.Errorf("Expected ErrContentTooLarge for crafted payload, got %v", err)
+	}
+}
+
+func TestEncryptionSelfTest(t *testing.T) {
+	// Disabled encryption always passes.
+	if err := EncryptionSelfTest(); err != nil {
+		t.Fatalf("Expected no error with encryption disabled, got %v", err)
+	}
+
+	initTestEncryption(t, 0)
+	if err := EncryptionSelfTest(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Self-test is not affected by suspension while content operations fail closed.
+	SuspendEncryption(true)
+	t.Cleanup(func() { SuspendEncryption(false) })
+	if err := EncryptionSelfTest(); err != nil {
+		t.Errorf("Expected self-test to pass while suspended, got %v", err)
+	}
+	if _, err := EncryptContent("hello"); err != ErrEncryptionUnavailable {
+		t.Errorf("Expected ErrEncryptionUnavailable, got %v", err)
+	}
+	if _, err := DecryptContent("ENC:AAAA"); err != ErrEncryptionUnavailable {
+		t.Errorf("Expected ErrEncryptionUnavailable, got %v", err)
+	}
+}
+
+func TestEncryptionSelfTestKeyProvider(t *testing.T) {
+	RegisterKeyProvider("test", testKeyProvider{})
+	t.Cleanup(func() { delete(keyProviders, "test") })
+
+	key, _ := GenerateEncryptionKey()
+	other, _ := GenerateEncryptionKey()
+	if err := InitMessageEncryption(key, 0); err != nil {
+		t.Fatalf("Failed to init encryption: %v", err)
+	}
+	t.Cleanup(func() { msgEncryption = nil })
+	conf := &keyProviderConfig{Name: "test"}
+
+	setEncryptionKeyProvider(conf, "wrapped:"+key)
+	if err := EncryptionSelfTest(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The provider returns another key, e.g. the data key was replaced.
+	setEncryptionKeyProvider(conf, "wrapped:"+other)
+	if err := EncryptionSelfTest(); err == nil {
+		t.Error("Expected error when the provider returns a different key")
+	}
+
+	// The provider fails, e.g. the master key is disabled.
+	setEncryptionKeyProvider(conf, key)
+	if err := EncryptionSelfTest(); err == nil {
+		t.Error("Expected error when the provider fails")
+	}
+}
+
+func TestEncryptionSelfTestPerTopic(t *testing.T) {
+	cache := memPCache{}
+	savedPCache := PCache
+	PCache = cache
+	t.Cleanup(func() {
+		PCache = savedPCache
+		resetTopicKeyCache()
+	})
+
+	initTestEncryption(t, 0)
+	if err := EnablePerTopicKeys(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := EncryptionSelfTest(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := cache[topicSaltKeyPrefix+encryptionCanaryTopic]; !ok {
+		t.Fatal("Expected the per-topic key of the canary to be derived")
+	}
+
+	// The key is derived anew on every check, not taken from the cache.
+	cache[topicSaltKeyPrefix+encryptionCanaryTopic] = "not base64"
+	if err := EncryptionSelfTest(); err == nil {
+		t.Error("Expected error when the per-topic key cannot be derived")
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	t.Cleanup(func() { msgEncryption = nil })
+
+	legacy, _ := GenerateEncryptionKey()
+	key1, _ := GenerateEncryptionKey()
+	key2, _ := GenerateEncryptionKey()
+
+	// Content encrypted in the legacy format with a single key.
+	if err := InitMessageEncryption(legacy, 0); err != nil {
+		t.Fatalf("Failed to init encryption: %v", err)
+	}
+	encLegacy, _ := EncryptContent("legacy")
+	if s := encLegacy.(string); strings.HasPrefix(s, "ENC:v2:") {
+		t.Fatalf("Expected legacy format, got %s", s)
+	}
+
+	// Rotate to key1.
+	if err := InitMessageEncryptionKeyring(legacy, map[string]string{"k1": key1}, "k1", 0); err != nil {
+		t.Fatalf("Failed to init keyring: %v", err)
+	}
+	enc1, _ := EncryptContent("first")
+	if s := enc1.(string); !strings.HasPrefix(s, "ENC:v2:k1:") {
+		t.Fatalf("Expected content encrypted with k1, got %s", s)
+	}
+
+	// Rotate to key2, all content must remain readable.
+	if err := InitMessageEncryptionKeyring(legacy, map[string]string{"k1": key1, "k2": key2}, "k2", 0); err != nil {
+		t.Fatalf("Failed to init keyring: %v", err)
+	}
+	enc2, _ := EncryptContent("second")
+	if s := enc2.(string); !strings.HasPrefix(s, "ENC:v2:k2:") {
+		t.Fatalf("Expected content encrypted with k2, got %s", s)
+	}
+	for enc, expected := range map[any]string{encLegacy: "legacy", enc1: "first", enc2: "second"} {
+		dec, err := DecryptContent(enc)
+		if err != nil || dec != expected {
+			t.Errorf("Expected '%s', got %v, %v", expected, dec, err)
+		}
+	}
+
+	// Legacy content without the legacy key: keyring keys are tried.
+	if err := InitMessageEncryptionKeyring("", map[string]string{"k1": legacy, "k2": key2}, "k2", 0); err != nil {
+		t.Fatalf("Failed to init keyring: %v", err)
+	}
+	if dec, err := DecryptContent(encLegacy); err != nil || dec != "legacy" {
+		t.Errorf("Expected 'legacy', got %v, %v", dec, err)
+	}
+
+	// Removed key.
+	if _, err := DecryptContent(enc1); err == nil {
+		t.Error("Expected error decrypting content with unknown key")
+	}
+
+	// Invalid configurations.
+	if err := InitMessageEncryptionKeyring("", map[string]string{"k1": key1}, "k3", 0); err == nil {
+		t.Error("Expected error for missing active key")
+	}
+	if err := InitMessageEncryptionKeyring("", map[string]string{"k:1": key1}, "k:1", 0); err == nil {
+		t.Error("Expected error for invalid key ID")
+	}
+	if err := InitMessageEncryptionKeyring("", map[string]string{"k1": key1}, "", 0); err == nil {
+		t.Error("Expected error for unspecified active key")
+	}
+}
+
+func TestReencryptContent(t *testing.T) {
+	t.Cleanup(func() { msgEncryption = nil })
+
+	key1, _ := GenerateEncryptionKey()
+	key2, _ := GenerateEncryptionKey()
+	if err := InitMessageEncryptionKeyring(key1, map[string]string{"k2": key2}, "", 0); err != nil {
+		t.Fatalf("Failed to init keyring: %v", err)
+	}
+	encLegacy, _ := EncryptContent("old")
+
+	// Content encrypted with the active key is not changed.
+	if _, changed, err := ReencryptContent("", encLegacy); err != nil || changed {
+		t.Errorf("Expected no change, got %v, %v", changed, err)
+	}
+
+	// Make k2 active.
+	if err := InitMessageEncryptionKeyring(key1, map[string]string{"k2": key2}, "k2", 0); err != nil {
+		t.Fatalf("Failed to init keyring: %v", err)
+	}
+	for content, expected := range map[any]any{encLegacy: "old", "plain": "plain"} {
+		enc, changed, err := ReencryptContent("", content)
+		if err != nil || !changed {
+			t.Fatalf("Expected content to change, got %v, %v", changed, err)
+		}
+		if s, _ := enc.(string); !strings.HasPrefix(s, "ENC:v2:k2:") {
+			t.Errorf("Expected content encrypted with k2, got %v", enc)
+		}
+		if _, changed, _ := ReencryptContent("", enc); changed {
+			t.Error("Expected re-encrypted content to be unchanged on second pass")
+		}
+		if dec, _ := DecryptContent(enc); dec != expected {
+			t.Errorf("Expected '%v', got %v", expected, dec)
+		}
+	}
+}
+
+func TestEncryptMetadata(t *testing.T) {
+	if err := SetEncryptedMetadata([]string{"mime"}, false); err == nil {
+		t.Error("Expected error with encryption disabled")
+	}
+
+	initTestEncryption(t, 0)
+	if err := SetEncryptedMetadata([]string{"reactions"}, false); err == nil {
+		t.Error("Expected error for server-maintained field")
+	}
+	if err := SetEncryptedMetadata([]string{"mime", "reply"}, true); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	head := types.KVMap{"mime": "text/x-drafty", "reply": map[string]any{"seq": float64(5)}, "sender": "usr123"}
+	enc, err := EncryptHead("grpTest", head)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["mime"] != "text/x-drafty" {
+		t.Error("Original header must not be modified")
+	}
+	if s, _ := enc["mime"].(string); !strings.HasPrefix(s, "ENC:") {
+		t.Errorf("Expected encrypted mime, got %v", enc["mime"])
+	}
+	if enc["sender"] != "usr123" {
+		t.Errorf("Expected sender in plaintext, got %v", enc["sender"])
+	}
+	if err = DecryptHead("grpTest", enc); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if enc["mime"] != "text/x-drafty" || enc["reply"].(map[string]any)["seq"] != float64(5) {
+		t.Errorf("Decrypted header does not match: %v", enc)
+	}
+
+	fd := &types.FileDef{MimeType: "image/png", Location: "uploads/abc.png"}
+	encFd, err := encryptFileDef(fd)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if fd.Location != "uploads/abc.png" || encFd.Location == fd.Location || encFd.MimeType == fd.MimeType {
+		t.Fatalf("Expected encrypted copy of file record, got %+v", encFd)
+	}
+	if err = decryptFileDef(encFd); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if encFd.MimeType != "image/png" || encFd.Location != "uploads/abc.png" {
+		t.Errorf("Decrypted file record does not match: %+v", encFd)
+	}
+}
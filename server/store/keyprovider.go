@@ -0,0 +1,97 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// KeyProvider unwraps data keys used for message encryption at rest (envelope encryption).
+// The master key never leaves the provider, e.g. an external KMS; the config contains
+// only wrapped data keys.
+type KeyProvider interface {
+	// Init initializes the key provider.
+	Init(jsonconf json.RawMessage) error
+	// UnwrapKey decrypts a wrapped data key. The format of the wrapped key is provider-specific.
+	// Returns the raw 32-byte AES key.
+	UnwrapKey(wrapped string) ([]byte, error)
+}
+
+// Key provider config.
+type keyProviderConfig struct {
+	// Name of the key provider to use.
+	Name string `json:"name"`
+	// Provider-specific config.
+	Config json.RawMessage `json:"config"`
+}
+
+var keyProviders map[string]KeyProvider
+
+// RegisterKeyProvider registers a provider of encryption keys.
+func RegisterKeyProvider(name string, kp KeyProvider) {
+	if keyProviders == nil {
+		keyProviders = make(map[string]KeyProvider)
+	}
+
+	if kp == nil {
+		panic("RegisterKeyProvider: provider is nil")
+	}
+	if _, dup := keyProviders[name]; dup {
+		panic("RegisterKeyProvider: called twice for provider " + name)
+	}
+	keyProviders[name] = kp
+}
+
+// unwrapEncryptionKeys initializes the configured key provider and unwraps the legacy key and the
+// keys in the keyring. Returns the keys base64-encoded.
+func unwrapEncryptionKeys(conf *keyProviderConfig, legacyKey string, keyring map[string]string) (string, map[string]string, error) {
+	kp := keyProviders[conf.Name]
+	if kp == nil {
+		return "", nil, errors.New("unknown key provider '" + conf.Name + "'")
+	}
+	if err := kp.Init(conf.Config); err != nil {
+		return "", nil, errors.New("failed to init key provider '" + conf.Name + "': " + err.Error())
+	}
+
+	unwrap := func(wrapped string) (string, error) {
+		return unwrapKey(conf, wrapped)
+	}
+
+	var err error
+	if legacyKey != "" {
+		if legacyKey, err = unwrap(legacyKey); err != nil {
+			return "", nil, errors.New("failed to unwrap encryption key: " + err.Error())
+		}
+	}
+
+	unwrapped := make(map[string]string, len(keyring))
+	for id, wrapped := range keyring {
+		if unwrapped[id], err = unwrap(wrapped); err != nil {
+			return "", nil, errors.New("failed to unwrap encryption key '" + id + "': " + err.Error())
+		}
+	}
+	return legacyKey, unwrapped, nil
+}
+
+// unwrapKey unwraps a single key with the key provider initialized by unwrapEncryptionKeys.
+// Returns the key base64-encoded.
+func unwrapKey(conf *keyProviderConfig, wrapped string) (string, error) {
+	kp := keyProviders[conf.Name]
+	if kp == nil {
+		return "", errors.New("unknown key provider '" + conf.Name + "'")
+	}
+	key, err := kp.UnwrapKey(wrapped)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// setEncryptionKeyProvider makes EncryptionSelfTest verify that the key provider unwraps the active key.
+// wrapped is the active key as it is in the config. Must be called after the encryption is initialized.
+func setEncryptionKeyProvider(conf *keyProviderConfig, wrapped string) {
+	if IsEncryptionEnabled() {
+		msgEncryption.keyProvider = conf
+		msgEncryption.wrappedActive = wrapped
+	}
+}
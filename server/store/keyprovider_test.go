@@ -0,0 +1,49 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testKeyProvider "wraps" keys by prefixing them with "wrapped:".
+type testKeyProvider struct{}
+
+func (testKeyProvider) Init(jsonconf json.RawMessage) error {
+	return nil
+}
+
+func (testKeyProvider) UnwrapKey(wrapped string) ([]byte, error) {
+	key, ok := strings.CutPrefix(wrapped, "wrapped:")
+	if !ok {
+		return nil, errors.New("not wrapped")
+	}
+	return base64.StdEncoding.DecodeString(key)
+}
+
+func TestUnwrapEncryptionKeys(t *testing.T) {
+	RegisterKeyProvider("test", testKeyProvider{})
+	t.Cleanup(func() { delete(keyProviders, "test") })
+
+	key1, _ := GenerateEncryptionKey()
+	key2, _ := GenerateEncryptionKey()
+	conf := &keyProviderConfig{Name: "test"}
+
+	legacy, keyring, err := unwrapEncryptionKeys(conf, "wrapped:"+key1, map[string]string{"k2": "wrapped:" + key2})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if legacy != key1 || keyring["k2"] != key2 {
+		t.Errorf("Unwrapped keys do not match")
+	}
+
+	if _, _, err := unwrapEncryptionKeys(conf, key1, nil); err == nil {
+		t.Error("Expected error for unwrapped key")
+	}
+	if _, _, err := unwrapEncryptionKeys(&keyProviderConfig{Name: "missing"}, "", nil); err == nil {
+		t.Error("Expected error for unknown provider")
+	}
+
+}
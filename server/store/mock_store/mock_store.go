@@ -400,6 +400,21 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) Delete(id, hard interface{}
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).Delete), id, hard)
 }
 
+// Erase mocks base method.
+func (m *MockUsersPersistenceInterface) Erase(id types.Uid, dryRun bool) (types.ErasureReport, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Erase", id, dryRun)
+	ret0, _ := ret[0].(types.ErasureReport)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Erase indicates an expected call of Erase.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) Erase(id, dryRun interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Erase", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).Erase), id, dryRun)
+}
+
 // FailCred mocks base method.
 func (m *MockUsersPersistenceInterface) FailCred(id types.Uid, method string) error {
 	m.ctrl.T.Helper()
@@ -415,33 +430,33 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) FailCred(id, method interfa
 }
 
 // FindOne mocks base method.
-func (m *MockUsersPersistenceInterface) FindOne(tag string) (string, error) {
+func (m *MockUsersPersistenceInterface) FindOne(tenant, tag string) (string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindOne", tag)
+	ret := m.ctrl.Call(m, "FindOne", tenant, tag)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // FindOne indicates an expected call of FindOne.
-func (mr *MockUsersPersistenceInterfaceMockRecorder) FindOne(tag interface{}) *gomock.Call {
+func (mr *MockUsersPersistenceInterfaceMockRecorder) FindOne(tenant, tag interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindOne", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).FindOne), tag)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindOne", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).FindOne), tenant, tag)
 }
 
 // FindSubs mocks base method.
-func (m *MockUsersPersistenceInterface) FindSubs(caller types.Uid, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error) {
+func (m *MockUsersPersistenceInterface) FindSubs(caller types.Uid, tenant, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindSubs", caller, prefPrefix, required, optional, activeOnly)
+	ret := m.ctrl.Call(m, "FindSubs", caller, tenant, prefPrefix, required, optional, activeOnly)
 	ret0, _ := ret[0].([]types.Subscription)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // FindSubs indicates an expected call of FindSubs.
-func (mr *MockUsersPersistenceInterfaceMockRecorder) FindSubs(caller, prefPrefix, required, optional, activeOnly interface{}) *gomock.Call {
+func (mr *MockUsersPersistenceInterfaceMockRecorder) FindSubs(caller, tenant, prefPrefix, required, optional, activeOnly interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindSubs", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).FindSubs), caller, prefPrefix, required, optional, activeOnly)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindSubs", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).FindSubs), caller, tenant, prefPrefix, required, optional, activeOnly)
 }
 
 // Get mocks base method.
@@ -526,6 +541,21 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) GetAuthRecord(user, scheme
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuthRecord", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetAuthRecord), user, scheme)
 }
 
+// GetAuthRecords mocks base method.
+func (m *MockUsersPersistenceInterface) GetAuthRecords(scheme string, after string, limit int) ([]types.AuthRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAuthRecords", scheme, after, limit)
+	ret0, _ := ret[0].([]types.AuthRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAuthRecords indicates an expected call of GetAuthRecords.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) GetAuthRecords(scheme, after, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAuthRecords", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetAuthRecords), scheme, after, limit)
+}
+
 // GetAuthUniqueRecord mocks base method.
 func (m *MockUsersPersistenceInterface) GetAuthUniqueRecord(scheme, unique string) (types.Uid, auth.Level, []byte, time.Time, error) {
 	m.ctrl.T.Helper()
@@ -634,6 +664,21 @@ func (mr *MockUsersPersistenceInterfaceMockRecorder) GetTopicsAny(id, opts inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetTopicsAny", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetTopicsAny), id, opts)
 }
 
+// GetUnreadByTopic mocks base method.
+func (m *MockUsersPersistenceInterface) GetUnreadByTopic(uid types.Uid) ([]types.TopicUnread, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUnreadByTopic", uid)
+	ret0, _ := ret[0].([]types.TopicUnread)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUnreadByTopic indicates an expected call of GetUnreadByTopic.
+func (mr *MockUsersPersistenceInterfaceMockRecorder) GetUnreadByTopic(uid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUnreadByTopic", reflect.TypeOf((*MockUsersPersistenceInterface)(nil).GetUnreadByTopic), uid)
+}
+
 // GetUnreadCount mocks base method.
 func (m *MockUsersPersistenceInterface) GetUnreadCount(ids ...types.Uid) (map[types.Uid]int, error) {
 	m.ctrl.T.Helper()
@@ -819,6 +864,21 @@ func (mr *MockTopicsPersistenceInterfaceMockRecorder) Delete(topic, isChan, hard
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).Delete), topic, isChan, hard)
 }
 
+// FindDuplicateP2P mocks base method.
+func (m *MockTopicsPersistenceInterface) FindDuplicateP2P() (map[string][]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindDuplicateP2P")
+	ret0, _ := ret[0].(map[string][]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindDuplicateP2P indicates an expected call of FindDuplicateP2P.
+func (mr *MockTopicsPersistenceInterfaceMockRecorder) FindDuplicateP2P() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindDuplicateP2P", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).FindDuplicateP2P))
+}
+
 // Get mocks base method.
 func (m *MockTopicsPersistenceInterface) Get(topic string) (*types.Topic, error) {
 	m.ctrl.T.Helper()
@@ -834,6 +894,21 @@ func (mr *MockTopicsPersistenceInterfaceMockRecorder) Get(topic interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).Get), topic)
 }
 
+// GetChildren mocks base method.
+func (m *MockTopicsPersistenceInterface) GetChildren(parent string) ([]types.Topic, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetChildren", parent)
+	ret0, _ := ret[0].([]types.Topic)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetChildren indicates an expected call of GetChildren.
+func (mr *MockTopicsPersistenceInterfaceMockRecorder) GetChildren(parent interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetChildren", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).GetChildren), parent)
+}
+
 // GetSubs mocks base method.
 func (m *MockTopicsPersistenceInterface) GetSubs(topic string, opts *types.QueryOpt) ([]types.Subscription, error) {
 	m.ctrl.T.Helper()
@@ -894,6 +969,20 @@ func (mr *MockTopicsPersistenceInterfaceMockRecorder) GetUsersAny(topic, opts in
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsersAny", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).GetUsersAny), topic, opts)
 }
 
+// Merge mocks base method.
+func (m *MockTopicsPersistenceInterface) Merge(dst, src string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Merge", dst, src)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Merge indicates an expected call of Merge.
+func (mr *MockTopicsPersistenceInterfaceMockRecorder) Merge(dst, src interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Merge", reflect.TypeOf((*MockTopicsPersistenceInterface)(nil).Merge), dst, src)
+}
+
 // OwnerChange mocks base method.
 func (m *MockTopicsPersistenceInterface) OwnerChange(topic string, newOwner types.Uid) error {
 	m.ctrl.T.Helper()
@@ -1043,6 +1132,21 @@ func (m *MockMessagesPersistenceInterface) EXPECT() *MockMessagesPersistenceInte
 	return m.recorder
 }
 
+// Anonymize mocks base method.
+func (m *MockMessagesPersistenceInterface) Anonymize(topic string, upto int, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Anonymize", topic, upto, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Anonymize indicates an expected call of Anonymize.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Anonymize(topic, upto, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Anonymize", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Anonymize), topic, upto, limit)
+}
+
 // DeleteList mocks base method.
 func (m *MockMessagesPersistenceInterface) DeleteList(topic string, delID int, forUser types.Uid, msgDelAge time.Duration, ranges []types.Range) error {
 	m.ctrl.T.Helper()
@@ -1057,6 +1161,35 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) DeleteList(topic, delID,
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteList", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).DeleteList), topic, delID, forUser, msgDelAge, ranges)
 }
 
+// DeleteOrphanedTiers mocks base method.
+func (m *MockMessagesPersistenceInterface) DeleteOrphanedTiers(limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteOrphanedTiers", limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteOrphanedTiers indicates an expected call of DeleteOrphanedTiers.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) DeleteOrphanedTiers(limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteOrphanedTiers", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).DeleteOrphanedTiers), limit)
+}
+
+// Edit mocks base method.
+func (m *MockMessagesPersistenceInterface) Edit(topic string, seqId int, content any, editedAt time.Time, editCount int, opaque bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Edit", topic, seqId, content, editedAt, editCount, opaque)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Edit indicates an expected call of Edit.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Edit(topic, seqId, content, editedAt, editCount, opaque interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Edit", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Edit), topic, seqId, content, editedAt, editCount, opaque)
+}
+
 // GetAll mocks base method.
 func (m *MockMessagesPersistenceInterface) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error) {
 	m.ctrl.T.Helper()
@@ -1072,6 +1205,52 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetAll(topic, forUser, o
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetAll), topic, forUser, opt)
 }
 
+// GetAllBySender mocks base method.
+func (m *MockMessagesPersistenceInterface) GetAllBySender(from types.Uid, afterId int64, limit int) ([]types.Message, int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAllBySender", from, afterId, limit)
+	ret0, _ := ret[0].([]types.Message)
+	ret1, _ := ret[1].(int64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetAllBySender indicates an expected call of GetAllBySender.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetAllBySender(from, afterId, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllBySender", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetAllBySender), from, afterId, limit)
+}
+
+// GetBySeqId mocks base method.
+func (m *MockMessagesPersistenceInterface) GetBySeqId(topic string, seqId int) (*types.Message, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBySeqId", topic, seqId)
+	ret0, _ := ret[0].(*types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBySeqId indicates an expected call of GetBySeqId.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetBySeqId(topic, seqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBySeqId", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetBySeqId), topic, seqId)
+}
+
+// GetColdTopics mocks base method.
+func (m *MockMessagesPersistenceInterface) GetColdTopics(before time.Time, skipCats []string, limit int) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetColdTopics", before, skipCats, limit)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetColdTopics indicates an expected call of GetColdTopics.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetColdTopics(before, skipCats, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetColdTopics", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetColdTopics), before, skipCats, limit)
+}
+
 // GetDeleted mocks base method.
 func (m *MockMessagesPersistenceInterface) GetDeleted(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Range, int, error) {
 	m.ctrl.T.Helper()
@@ -1088,6 +1267,96 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetDeleted(topic, forUse
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeleted", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetDeleted), topic, forUser, opt)
 }
 
+// GetEdits mocks base method.
+func (m *MockMessagesPersistenceInterface) GetEdits(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.MessageVersion, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetEdits", topic, forUser, opt)
+	ret0, _ := ret[0].([]types.MessageVersion)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetEdits indicates an expected call of GetEdits.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetEdits(topic, forUser, opt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetEdits", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetEdits), topic, forUser, opt)
+}
+
+// GetExpired mocks base method.
+func (m *MockMessagesPersistenceInterface) GetExpired(now time.Time, limit int) (map[string]int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpired", now, limit)
+	ret0, _ := ret[0].(map[string]int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetExpired indicates an expected call of GetExpired.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetExpired(now, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpired", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetExpired), now, limit)
+}
+
+// GetOlder mocks base method.
+func (m *MockMessagesPersistenceInterface) GetOlder(cat string, tenants []string, exclude bool, before time.Time, anonymized bool, limit int) ([]types.RetentionBatch, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetOlder", cat, tenants, exclude, before, anonymized, limit)
+	ret0, _ := ret[0].([]types.RetentionBatch)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetOlder indicates an expected call of GetOlder.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) GetOlder(cat, tenants, exclude, before, anonymized, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetOlder", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).GetOlder), cat, tenants, exclude, before, anonymized, limit)
+}
+
+// MarkUnsent mocks base method.
+func (m *MockMessagesPersistenceInterface) MarkUnsent(topic string, seqId int, unsentAt time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MarkUnsent", topic, seqId, unsentAt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// MarkUnsent indicates an expected call of MarkUnsent.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) MarkUnsent(topic, seqId, unsentAt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkUnsent", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).MarkUnsent), topic, seqId, unsentAt)
+}
+
+// MoveCold mocks base method.
+func (m *MockMessagesPersistenceInterface) MoveCold(topic string, before time.Time, limit int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "MoveCold", topic, before, limit)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// MoveCold indicates an expected call of MoveCold.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) MoveCold(topic, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MoveCold", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).MoveCold), topic, before, limit)
+}
+
+// ReencryptBatch mocks base method.
+func (m *MockMessagesPersistenceInterface) ReencryptBatch(afterId int64, limit int) (int64, int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ReencryptBatch", afterId, limit)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ReencryptBatch indicates an expected call of ReencryptBatch.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) ReencryptBatch(afterId, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ReencryptBatch", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).ReencryptBatch), afterId, limit)
+}
+
 // Save mocks base method.
 func (m *MockMessagesPersistenceInterface) Save(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
 	m.ctrl.T.Helper()
@@ -1103,164 +1372,2402 @@ func (mr *MockMessagesPersistenceInterfaceMockRecorder) Save(msg, attachmentURLs
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Save), msg, attachmentURLs, readBySender)
 }
 
-// AddReaction mocks base method.
-func (m *MockMessagesPersistenceInterface) AddReaction(topic string, seqId int, oderId string, reaction string) error {
+// Search mocks base method.
+func (m *MockMessagesPersistenceInterface) Search(forUser types.Uid, query *types.MessageSearchQuery) ([]types.Message, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddReaction", topic, seqId, oderId, reaction)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "Search", forUser, query)
+	ret0, _ := ret[0].([]types.Message)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
-// AddReaction indicates an expected call of AddReaction.
-func (mr *MockMessagesPersistenceInterfaceMockRecorder) AddReaction(topic, seqId, oderId, reaction interface{}) *gomock.Call {
+// Search indicates an expected call of Search.
+func (mr *MockMessagesPersistenceInterfaceMockRecorder) Search(forUser, query interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddReaction", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).AddReaction), topic, seqId, oderId, reaction)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Search", reflect.TypeOf((*MockMessagesPersistenceInterface)(nil).Search), forUser, query)
 }
 
-// MockDevicePersistenceInterface is a mock of DevicePersistenceInterface interface.
-type MockDevicePersistenceInterface struct {
+// MockReactionsPersistenceInterface is a mock of ReactionsPersistenceInterface interface.
+type MockReactionsPersistenceInterface struct {
 	ctrl     *gomock.Controller
-	recorder *MockDevicePersistenceInterfaceMockRecorder
+	recorder *MockReactionsPersistenceInterfaceMockRecorder
 }
 
-// MockDevicePersistenceInterfaceMockRecorder is the mock recorder for MockDevicePersistenceInterface.
-type MockDevicePersistenceInterfaceMockRecorder struct {
-	mock *MockDevicePersistenceInterface
+// MockReactionsPersistenceInterfaceMockRecorder is the mock recorder for MockReactionsPersistenceInterface.
+type MockReactionsPersistenceInterfaceMockRecorder struct {
+	mock *MockReactionsPersistenceInterface
 }
 
-// NewMockDevicePersistenceInterface creates a new mock instance.
-func NewMockDevicePersistenceInterface(ctrl *gomock.Controller) *MockDevicePersistenceInterface {
-	mock := &MockDevicePersistenceInterface{ctrl: ctrl}
-	mock.recorder = &MockDevicePersistenceInterfaceMockRecorder{mock}
+// NewMockReactionsPersistenceInterface creates a new mock instance.
+func NewMockReactionsPersistenceInterface(ctrl *gomock.Controller) *MockReactionsPersistenceInterface {
+	mock := &MockReactionsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockReactionsPersistenceInterfaceMockRecorder{mock}
 	return mock
 }
 
 // EXPECT returns an object that allows the caller to indicate expected use.
-func (m *MockDevicePersistenceInterface) EXPECT() *MockDevicePersistenceInterfaceMockRecorder {
+func (m *MockReactionsPersistenceInterface) EXPECT() *MockReactionsPersistenceInterfaceMockRecorder {
 	return m.recorder
 }
 
-// Delete mocks base method.
-func (m *MockDevicePersistenceInterface) Delete(uid types.Uid, deviceID string) error {
+// Add mocks base method.
+func (m *MockReactionsPersistenceInterface) Add(topic string, seqId int, user types.Uid, reaction string) (int, bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Delete", uid, deviceID)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "Add", topic, seqId, user, reaction)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
-// Delete indicates an expected call of Delete.
-func (mr *MockDevicePersistenceInterfaceMockRecorder) Delete(uid, deviceID interface{}) *gomock.Call {
+// Add indicates an expected call of Add.
+func (mr *MockReactionsPersistenceInterfaceMockRecorder) Add(topic, seqId, user, reaction interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockDevicePersistenceInterface)(nil).Delete), uid, deviceID)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockReactionsPersistenceInterface)(nil).Add), topic, seqId, user, reaction)
 }
 
-// GetAll mocks base method.
-func (m *MockDevicePersistenceInterface) GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, int, error) {
+// Delete mocks base method.
+func (m *MockReactionsPersistenceInterface) Delete(topic string, seqId int, user types.Uid, reaction string) (int, bool, error) {
 	m.ctrl.T.Helper()
-	varargs := []interface{}{}
-	for _, a := range uid {
-		varargs = append(varargs, a)
-	}
-	ret := m.ctrl.Call(m, "GetAll", varargs...)
-	ret0, _ := ret[0].(map[types.Uid][]types.DeviceDef)
-	ret1, _ := ret[1].(int)
+	ret := m.ctrl.Call(m, "Delete", topic, seqId, user, reaction)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(bool)
 	ret2, _ := ret[2].(error)
 	return ret0, ret1, ret2
 }
 
-// GetAll indicates an expected call of GetAll.
-func (mr *MockDevicePersistenceInterfaceMockRecorder) GetAll(uid ...interface{}) *gomock.Call {
+// Delete indicates an expected call of Delete.
+func (mr *MockReactionsPersistenceInterfaceMockRecorder) Delete(topic, seqId, user, reaction interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockDevicePersistenceInterface)(nil).GetAll), uid...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockReactionsPersistenceInterface)(nil).Delete), topic, seqId, user, reaction)
 }
 
-// Update mocks base method.
-func (m *MockDevicePersistenceInterface) Update(uid types.Uid, oldDeviceID string, dev *types.DeviceDef) error {
+// GetAll mocks base method.
+func (m *MockReactionsPersistenceInterface) GetAll(topic string, forUser types.Uid, seqIds []int) ([]types.Reaction, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Update", uid, oldDeviceID, dev)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "GetAll", topic, forUser, seqIds)
+	ret0, _ := ret[0].([]types.Reaction)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
-// Update indicates an expected call of Update.
-func (mr *MockDevicePersistenceInterfaceMockRecorder) Update(uid, oldDeviceID, dev interface{}) *gomock.Call {
+// GetAll indicates an expected call of GetAll.
+func (mr *MockReactionsPersistenceInterfaceMockRecorder) GetAll(topic, forUser, seqIds interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockDevicePersistenceInterface)(nil).Update), uid, oldDeviceID, dev)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockReactionsPersistenceInterface)(nil).GetAll), topic, forUser, seqIds)
 }
 
-// MockFilePersistenceInterface is a mock of FilePersistenceInterface interface.
-type MockFilePersistenceInterface struct {
+// MockPollsPersistenceInterface is a mock of PollsPersistenceInterface interface.
+type MockPollsPersistenceInterface struct {
 	ctrl     *gomock.Controller
-	recorder *MockFilePersistenceInterfaceMockRecorder
+	recorder *MockPollsPersistenceInterfaceMockRecorder
 }
 
-// MockFilePersistenceInterfaceMockRecorder is the mock recorder for MockFilePersistenceInterface.
-type MockFilePersistenceInterfaceMockRecorder struct {
-	mock *MockFilePersistenceInterface
+// MockPollsPersistenceInterfaceMockRecorder is the mock recorder for MockPollsPersistenceInterface.
+type MockPollsPersistenceInterfaceMockRecorder struct {
+	mock *MockPollsPersistenceInterface
 }
 
-// NewMockFilePersistenceInterface creates a new mock instance.
-func NewMockFilePersistenceInterface(ctrl *gomock.Controller) *MockFilePersistenceInterface {
-	mock := &MockFilePersistenceInterface{ctrl: ctrl}
-	mock.recorder = &MockFilePersistenceInterfaceMockRecorder{mock}
+// NewMockPollsPersistenceInterface creates a new mock instance.
+func NewMockPollsPersistenceInterface(ctrl *gomock.Controller) *MockPollsPersistenceInterface {
+	mock := &MockPollsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockPollsPersistenceInterfaceMockRecorder{mock}
 	return mock
 }
 
 // EXPECT returns an object that allows the caller to indicate expected use.
-func (m *MockFilePersistenceInterface) EXPECT() *MockFilePersistenceInterfaceMockRecorder {
+func (m *MockPollsPersistenceInterface) EXPECT() *MockPollsPersistenceInterfaceMockRecorder {
 	return m.recorder
 }
 
-// DeleteUnused mocks base method.
-func (m *MockFilePersistenceInterface) DeleteUnused(olderThan time.Time, limit int) error {
+// Close mocks base method.
+func (m *MockPollsPersistenceInterface) Close(topic string, seqId int, forUser types.Uid) (*types.Poll, bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteUnused", olderThan, limit)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "Close", topic, seqId, forUser)
+	ret0, _ := ret[0].(*types.Poll)
+	ret1, _ := ret[1].(bool)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
 }
 
-// DeleteUnused indicates an expected call of DeleteUnused.
-func (mr *MockFilePersistenceInterfaceMockRecorder) DeleteUnused(olderThan, limit interface{}) *gomock.Call {
+// Close indicates an expected call of Close.
+func (mr *MockPollsPersistenceInterfaceMockRecorder) Close(topic, seqId, forUser interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUnused", reflect.TypeOf((*MockFilePersistenceInterface)(nil).DeleteUnused), olderThan, limit)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockPollsPersistenceInterface)(nil).Close), topic, seqId, forUser)
 }
 
-// FinishUpload mocks base method.
-func (m *MockFilePersistenceInterface) FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+// Create mocks base method.
+func (m *MockPollsPersistenceInterface) Create(topic string, poll *types.Poll) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FinishUpload", fd, success, size)
-	ret0, _ := ret[0].(*types.FileDef)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret := m.ctrl.Call(m, "Create", topic, poll)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
-// FinishUpload indicates an expected call of FinishUpload.
-func (mr *MockFilePersistenceInterfaceMockRecorder) FinishUpload(fd, success, size interface{}) *gomock.Call {
+// Create indicates an expected call of Create.
+func (mr *MockPollsPersistenceInterfaceMockRecorder) Create(topic, poll interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishUpload", reflect.TypeOf((*MockFilePersistenceInterface)(nil).FinishUpload), fd, success, size)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockPollsPersistenceInterface)(nil).Create), topic, poll)
 }
 
 // Get mocks base method.
-func (m *MockFilePersistenceInterface) Get(fid string) (*types.FileDef, error) {
+func (m *MockPollsPersistenceInterface) Get(topic string, seqId int, forUser types.Uid) (*types.Poll, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Get", fid)
-	ret0, _ := ret[0].(*types.FileDef)
+	ret := m.ctrl.Call(m, "Get", topic, seqId, forUser)
+	ret0, _ := ret[0].(*types.Poll)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Get indicates an expected call of Get.
-func (mr *MockFilePersistenceInterfaceMockRecorder) Get(fid interface{}) *gomock.Call {
+func (mr *MockPollsPersistenceInterfaceMockRecorder) Get(topic, seqId, forUser interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockFilePersistenceInterface)(nil).Get), fid)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockPollsPersistenceInterface)(nil).Get), topic, seqId, forUser)
 }
 
-// LinkAttachments mocks base method.
-func (m *MockFilePersistenceInterface) LinkAttachments(topic string, msgId types.Uid, attachments []string) error {
+// GetAll mocks base method.
+func (m *MockPollsPersistenceInterface) GetAll(topic string, forUser types.Uid, seqIds []int) ([]types.Poll, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "LinkAttachments", topic, msgId, attachments)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "GetAll", topic, forUser, seqIds)
+	ret0, _ := ret[0].([]types.Poll)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockPollsPersistenceInterfaceMockRecorder) GetAll(topic, forUser, seqIds interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockPollsPersistenceInterface)(nil).GetAll), topic, forUser, seqIds)
+}
+
+// Vote mocks base method.
+func (m *MockPollsPersistenceInterface) Vote(topic string, seqId int, user types.Uid, options []int) (*types.Poll, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Vote", topic, seqId, user, options)
+	ret0, _ := ret[0].(*types.Poll)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Vote indicates an expected call of Vote.
+func (mr *MockPollsPersistenceInterfaceMockRecorder) Vote(topic, seqId, user, options interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Vote", reflect.TypeOf((*MockPollsPersistenceInterface)(nil).Vote), topic, seqId, user, options)
+}
+
+// MockTranslationsPersistenceInterface is a mock of TranslationsPersistenceInterface interface.
+type MockTranslationsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockTranslationsPersistenceInterfaceMockRecorder
+}
+
+// MockTranslationsPersistenceInterfaceMockRecorder is the mock recorder for MockTranslationsPersistenceInterface.
+type MockTranslationsPersistenceInterfaceMockRecorder struct {
+	mock *MockTranslationsPersistenceInterface
+}
+
+// NewMockTranslationsPersistenceInterface creates a new mock instance.
+func NewMockTranslationsPersistenceInterface(ctrl *gomock.Controller) *MockTranslationsPersistenceInterface {
+	mock := &MockTranslationsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockTranslationsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTranslationsPersistenceInterface) EXPECT() *MockTranslationsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// GetAll mocks base method.
+func (m *MockTranslationsPersistenceInterface) GetAll(topic, lang string, seqIds []int) ([]types.Translation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic, lang, seqIds)
+	ret0, _ := ret[0].([]types.Translation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockTranslationsPersistenceInterfaceMockRecorder) GetAll(topic, lang, seqIds interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockTranslationsPersistenceInterface)(nil).GetAll), topic, lang, seqIds)
+}
+
+// Save mocks base method.
+func (m *MockTranslationsPersistenceInterface) Save(topic string, translations []types.Translation) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Save", topic, translations)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Save indicates an expected call of Save.
+func (mr *MockTranslationsPersistenceInterfaceMockRecorder) Save(topic, translations interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Save", reflect.TypeOf((*MockTranslationsPersistenceInterface)(nil).Save), topic, translations)
+}
+
+// MockModerationPersistenceInterface is a mock of ModerationPersistenceInterface interface.
+type MockModerationPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockModerationPersistenceInterfaceMockRecorder
+}
+
+// MockModerationPersistenceInterfaceMockRecorder is the mock recorder for MockModerationPersistenceInterface.
+type MockModerationPersistenceInterfaceMockRecorder struct {
+	mock *MockModerationPersistenceInterface
+}
+
+// NewMockModerationPersistenceInterface creates a new mock instance.
+func NewMockModerationPersistenceInterface(ctrl *gomock.Controller) *MockModerationPersistenceInterface {
+	mock := &MockModerationPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockModerationPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockModerationPersistenceInterface) EXPECT() *MockModerationPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// GetLog mocks base method.
+func (m *MockModerationPersistenceInterface) GetLog(topic string, limit int) ([]types.ModerationRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLog", topic, limit)
+	ret0, _ := ret[0].([]types.ModerationRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLog indicates an expected call of GetLog.
+func (mr *MockModerationPersistenceInterfaceMockRecorder) GetLog(topic, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLog", reflect.TypeOf((*MockModerationPersistenceInterface)(nil).GetLog), topic, limit)
+}
+
+// Log mocks base method.
+func (m *MockModerationPersistenceInterface) Log(rec *types.ModerationRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Log", rec)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Log indicates an expected call of Log.
+func (mr *MockModerationPersistenceInterfaceMockRecorder) Log(rec interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Log", reflect.TypeOf((*MockModerationPersistenceInterface)(nil).Log), rec)
+}
+
+// MockTakeoutsPersistenceInterface is a mock of TakeoutsPersistenceInterface interface.
+type MockTakeoutsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockTakeoutsPersistenceInterfaceMockRecorder
+}
+
+// MockTakeoutsPersistenceInterfaceMockRecorder is the mock recorder for MockTakeoutsPersistenceInterface.
+type MockTakeoutsPersistenceInterfaceMockRecorder struct {
+	mock *MockTakeoutsPersistenceInterface
+}
+
+// NewMockTakeoutsPersistenceInterface creates a new mock instance.
+func NewMockTakeoutsPersistenceInterface(ctrl *gomock.Controller) *MockTakeoutsPersistenceInterface {
+	mock := &MockTakeoutsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockTakeoutsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTakeoutsPersistenceInterface) EXPECT() *MockTakeoutsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockTakeoutsPersistenceInterface) Create(tk *types.Takeout) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", tk)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockTakeoutsPersistenceInterfaceMockRecorder) Create(tk interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockTakeoutsPersistenceInterface)(nil).Create), tk)
+}
+
+// Finish mocks base method.
+func (m *MockTakeoutsPersistenceInterface) Finish(tk *types.Takeout) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Finish", tk)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Finish indicates an expected call of Finish.
+func (mr *MockTakeoutsPersistenceInterfaceMockRecorder) Finish(tk interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Finish", reflect.TypeOf((*MockTakeoutsPersistenceInterface)(nil).Finish), tk)
+}
+
+// GetLast mocks base method.
+func (m *MockTakeoutsPersistenceInterface) GetLast(uid types.Uid) (*types.Takeout, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLast", uid)
+	ret0, _ := ret[0].(*types.Takeout)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLast indicates an expected call of GetLast.
+func (mr *MockTakeoutsPersistenceInterfaceMockRecorder) GetLast(uid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLast", reflect.TypeOf((*MockTakeoutsPersistenceInterface)(nil).GetLast), uid)
+}
+
+// MockAuditPersistenceInterface is a mock of AuditPersistenceInterface interface.
+type MockAuditPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockAuditPersistenceInterfaceMockRecorder
+}
+
+// MockAuditPersistenceInterfaceMockRecorder is the mock recorder for MockAuditPersistenceInterface.
+type MockAuditPersistenceInterfaceMockRecorder struct {
+	mock *MockAuditPersistenceInterface
+}
+
+// NewMockAuditPersistenceInterface creates a new mock instance.
+func NewMockAuditPersistenceInterface(ctrl *gomock.Controller) *MockAuditPersistenceInterface {
+	mock := &MockAuditPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockAuditPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockAuditPersistenceInterface) EXPECT() *MockAuditPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Expire mocks base method.
+func (m *MockAuditPersistenceInterface) Expire(before time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Expire", before)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Expire indicates an expected call of Expire.
+func (mr *MockAuditPersistenceInterfaceMockRecorder) Expire(before interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Expire", reflect.TypeOf((*MockAuditPersistenceInterface)(nil).Expire), before)
+}
+
+// Log mocks base method.
+func (m *MockAuditPersistenceInterface) Log(rec *types.AuditRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Log", rec)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Log indicates an expected call of Log.
+func (mr *MockAuditPersistenceInterfaceMockRecorder) Log(rec interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Log", reflect.TypeOf((*MockAuditPersistenceInterface)(nil).Log), rec)
+}
+
+// Query mocks base method.
+func (m *MockAuditPersistenceInterface) Query(query *types.AuditQuery) ([]types.AuditRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Query", query)
+	ret0, _ := ret[0].([]types.AuditRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Query indicates an expected call of Query.
+func (mr *MockAuditPersistenceInterfaceMockRecorder) Query(query interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Query", reflect.TypeOf((*MockAuditPersistenceInterface)(nil).Query), query)
+}
+
+// MockReportsPersistenceInterface is a mock of ReportsPersistenceInterface interface.
+type MockReportsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockReportsPersistenceInterfaceMockRecorder
+}
+
+// MockReportsPersistenceInterfaceMockRecorder is the mock recorder for MockReportsPersistenceInterface.
+type MockReportsPersistenceInterfaceMockRecorder struct {
+	mock *MockReportsPersistenceInterface
+}
+
+// NewMockReportsPersistenceInterface creates a new mock instance.
+func NewMockReportsPersistenceInterface(ctrl *gomock.Controller) *MockReportsPersistenceInterface {
+	mock := &MockReportsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockReportsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockReportsPersistenceInterface) EXPECT() *MockReportsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Claim mocks base method.
+func (m *MockReportsPersistenceInterface) Claim(id types.Uid) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Claim", id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Claim indicates an expected call of Claim.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) Claim(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Claim", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).Claim), id)
+}
+
+// Create mocks base method.
+func (m *MockReportsPersistenceInterface) Create(rpt *types.Report) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", rpt)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) Create(rpt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).Create), rpt)
+}
+
+// Get mocks base method.
+func (m *MockReportsPersistenceInterface) Get(id types.Uid) (*types.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", id)
+	ret0, _ := ret[0].(*types.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) Get(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).Get), id)
+}
+
+// GetUnposted mocks base method.
+func (m *MockReportsPersistenceInterface) GetUnposted(limit int) ([]types.Report, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUnposted", limit)
+	ret0, _ := ret[0].([]types.Report)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUnposted indicates an expected call of GetUnposted.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) GetUnposted(limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUnposted", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).GetUnposted), limit)
+}
+
+// Resolve mocks base method.
+func (m *MockReportsPersistenceInterface) Resolve(id types.Uid, status, action string, by types.Uid) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Resolve", id, status, action, by)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Resolve indicates an expected call of Resolve.
+func (mr *MockReportsPersistenceInterfaceMockRecorder) Resolve(id, status, action, by interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Resolve", reflect.TypeOf((*MockReportsPersistenceInterface)(nil).Resolve), id, status, action, by)
+}
+
+// MockThreadsPersistenceInterface is a mock of ThreadsPersistenceInterface interface.
+type MockThreadsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockThreadsPersistenceInterfaceMockRecorder
+}
+
+// MockThreadsPersistenceInterfaceMockRecorder is the mock recorder for MockThreadsPersistenceInterface.
+type MockThreadsPersistenceInterfaceMockRecorder struct {
+	mock *MockThreadsPersistenceInterface
+}
+
+// NewMockThreadsPersistenceInterface creates a new mock instance.
+func NewMockThreadsPersistenceInterface(ctrl *gomock.Controller) *MockThreadsPersistenceInterface {
+	mock := &MockThreadsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockThreadsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockThreadsPersistenceInterface) EXPECT() *MockThreadsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// GetAll mocks base method.
+func (m *MockThreadsPersistenceInterface) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Thread, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic, forUser, opt)
+	ret0, _ := ret[0].([]types.Thread)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockThreadsPersistenceInterfaceMockRecorder) GetAll(topic, forUser, opt interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockThreadsPersistenceInterface)(nil).GetAll), topic, forUser, opt)
+}
+
+// GetMuted mocks base method.
+func (m *MockThreadsPersistenceInterface) GetMuted(topic string, threadId int) ([]types.Uid, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMuted", topic, threadId)
+	ret0, _ := ret[0].([]types.Uid)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMuted indicates an expected call of GetMuted.
+func (mr *MockThreadsPersistenceInterfaceMockRecorder) GetMuted(topic, threadId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMuted", reflect.TypeOf((*MockThreadsPersistenceInterface)(nil).GetMuted), topic, threadId)
+}
+
+// SetMuted mocks base method.
+func (m *MockThreadsPersistenceInterface) SetMuted(topic string, user types.Uid, threadId int, muted bool) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMuted", topic, user, threadId, muted)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetMuted indicates an expected call of SetMuted.
+func (mr *MockThreadsPersistenceInterfaceMockRecorder) SetMuted(topic, user, threadId, muted interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMuted", reflect.TypeOf((*MockThreadsPersistenceInterface)(nil).SetMuted), topic, user, threadId, muted)
+}
+
+// SetRead mocks base method.
+func (m *MockThreadsPersistenceInterface) SetRead(topic string, user types.Uid, threadId, readSeqId int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetRead", topic, user, threadId, readSeqId)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetRead indicates an expected call of SetRead.
+func (mr *MockThreadsPersistenceInterfaceMockRecorder) SetRead(topic, user, threadId, readSeqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetRead", reflect.TypeOf((*MockThreadsPersistenceInterface)(nil).SetRead), topic, user, threadId, readSeqId)
+}
+
+// MockScheduledPersistenceInterface is a mock of ScheduledPersistenceInterface interface.
+type MockScheduledPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockScheduledPersistenceInterfaceMockRecorder
+}
+
+// MockScheduledPersistenceInterfaceMockRecorder is the mock recorder for MockScheduledPersistenceInterface.
+type MockScheduledPersistenceInterfaceMockRecorder struct {
+	mock *MockScheduledPersistenceInterface
+}
+
+// NewMockScheduledPersistenceInterface creates a new mock instance.
+func NewMockScheduledPersistenceInterface(ctrl *gomock.Controller) *MockScheduledPersistenceInterface {
+	mock := &MockScheduledPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockScheduledPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockScheduledPersistenceInterface) EXPECT() *MockScheduledPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Add mocks base method.
+func (m *MockScheduledPersistenceInterface) Add(msg *types.ScheduledMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Add", msg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Add indicates an expected call of Add.
+func (mr *MockScheduledPersistenceInterfaceMockRecorder) Add(msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockScheduledPersistenceInterface)(nil).Add), msg)
+}
+
+// Delete mocks base method.
+func (m *MockScheduledPersistenceInterface) Delete(topic string, user, id types.Uid) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", topic, user, id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockScheduledPersistenceInterfaceMockRecorder) Delete(topic, user, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockScheduledPersistenceInterface)(nil).Delete), topic, user, id)
+}
+
+// GetAll mocks base method.
+func (m *MockScheduledPersistenceInterface) GetAll(topic string, user types.Uid) ([]types.ScheduledMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic, user)
+	ret0, _ := ret[0].([]types.ScheduledMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockScheduledPersistenceInterfaceMockRecorder) GetAll(topic, user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockScheduledPersistenceInterface)(nil).GetAll), topic, user)
+}
+
+// GetDue mocks base method.
+func (m *MockScheduledPersistenceInterface) GetDue(before time.Time, limit int) ([]types.ScheduledMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDue", before, limit)
+	ret0, _ := ret[0].([]types.ScheduledMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetDue indicates an expected call of GetDue.
+func (mr *MockScheduledPersistenceInterfaceMockRecorder) GetDue(before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDue", reflect.TypeOf((*MockScheduledPersistenceInterface)(nil).GetDue), before, limit)
+}
+
+// MockSessionPersistenceInterface is a mock of SessionPersistenceInterface interface.
+type MockSessionPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockSessionPersistenceInterfaceMockRecorder
+}
+
+// MockSessionPersistenceInterfaceMockRecorder is the mock recorder for MockSessionPersistenceInterface.
+type MockSessionPersistenceInterfaceMockRecorder struct {
+	mock *MockSessionPersistenceInterface
+}
+
+// NewMockSessionPersistenceInterface creates a new mock instance.
+func NewMockSessionPersistenceInterface(ctrl *gomock.Controller) *MockSessionPersistenceInterface {
+	mock := &MockSessionPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockSessionPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSessionPersistenceInterface) EXPECT() *MockSessionPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Delete mocks base method.
+func (m *MockSessionPersistenceInterface) Delete(user types.Uid, id string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", user, id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockSessionPersistenceInterfaceMockRecorder) Delete(user, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockSessionPersistenceInterface)(nil).Delete), user, id)
+}
+
+// GetAll mocks base method.
+func (m *MockSessionPersistenceInterface) GetAll(user types.Uid) ([]types.SessionRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", user)
+	ret0, _ := ret[0].([]types.SessionRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockSessionPersistenceInterfaceMockRecorder) GetAll(user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockSessionPersistenceInterface)(nil).GetAll), user)
+}
+
+// Touch mocks base method.
+func (m *MockSessionPersistenceInterface) Touch(id string, lastSeen time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Touch", id, lastSeen)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Touch indicates an expected call of Touch.
+func (mr *MockSessionPersistenceInterfaceMockRecorder) Touch(id, lastSeen interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Touch", reflect.TypeOf((*MockSessionPersistenceInterface)(nil).Touch), id, lastSeen)
+}
+
+// Upsert mocks base method.
+func (m *MockSessionPersistenceInterface) Upsert(sess *types.SessionRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Upsert", sess)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Upsert indicates an expected call of Upsert.
+func (mr *MockSessionPersistenceInterfaceMockRecorder) Upsert(sess interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Upsert", reflect.TypeOf((*MockSessionPersistenceInterface)(nil).Upsert), sess)
+}
+
+// MockCallPersistenceInterface is a mock of CallPersistenceInterface interface.
+type MockCallPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockCallPersistenceInterfaceMockRecorder
+}
+
+// MockCallPersistenceInterfaceMockRecorder is the mock recorder for MockCallPersistenceInterface.
+type MockCallPersistenceInterfaceMockRecorder struct {
+	mock *MockCallPersistenceInterface
+}
+
+// NewMockCallPersistenceInterface creates a new mock instance.
+func NewMockCallPersistenceInterface(ctrl *gomock.Controller) *MockCallPersistenceInterface {
+	mock := &MockCallPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockCallPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockCallPersistenceInterface) EXPECT() *MockCallPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockCallPersistenceInterface) Create(call *types.CallRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", call)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockCallPersistenceInterfaceMockRecorder) Create(call interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockCallPersistenceInterface)(nil).Create), call)
+}
+
+// End mocks base method.
+func (m *MockCallPersistenceInterface) End(call *types.CallRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "End", call)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// End indicates an expected call of End.
+func (mr *MockCallPersistenceInterfaceMockRecorder) End(call interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "End", reflect.TypeOf((*MockCallPersistenceInterface)(nil).End), call)
+}
+
+// Get mocks base method.
+func (m *MockCallPersistenceInterface) Get(topic string, seqId int) (*types.CallRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", topic, seqId)
+	ret0, _ := ret[0].(*types.CallRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockCallPersistenceInterfaceMockRecorder) Get(topic, seqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockCallPersistenceInterface)(nil).Get), topic, seqId)
+}
+
+// GetAll mocks base method.
+func (m *MockCallPersistenceInterface) GetAll(topics []string, before *time.Time, limit int) ([]types.CallRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topics, before, limit)
+	ret0, _ := ret[0].([]types.CallRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockCallPersistenceInterfaceMockRecorder) GetAll(topics, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockCallPersistenceInterface)(nil).GetAll), topics, before, limit)
+}
+
+// MockKeysPersistenceInterface is a mock of KeysPersistenceInterface interface.
+type MockKeysPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockKeysPersistenceInterfaceMockRecorder
+}
+
+// MockKeysPersistenceInterfaceMockRecorder is the mock recorder for MockKeysPersistenceInterface.
+type MockKeysPersistenceInterfaceMockRecorder struct {
+	mock *MockKeysPersistenceInterface
+}
+
+// NewMockKeysPersistenceInterface creates a new mock instance.
+func NewMockKeysPersistenceInterface(ctrl *gomock.Controller) *MockKeysPersistenceInterface {
+	mock := &MockKeysPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockKeysPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockKeysPersistenceInterface) EXPECT() *MockKeysPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// AddSenderKeys mocks base method.
+func (m *MockKeysPersistenceInterface) AddSenderKeys(keys []types.SenderKey) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AddSenderKeys", keys)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// AddSenderKeys indicates an expected call of AddSenderKeys.
+func (mr *MockKeysPersistenceInterfaceMockRecorder) AddSenderKeys(keys interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddSenderKeys", reflect.TypeOf((*MockKeysPersistenceInterface)(nil).AddSenderKeys), keys)
+}
+
+// DeleteBundle mocks base method.
+func (m *MockKeysPersistenceInterface) DeleteBundle(user types.Uid, deviceId string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteBundle", user, deviceId)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteBundle indicates an expected call of DeleteBundle.
+func (mr *MockKeysPersistenceInterfaceMockRecorder) DeleteBundle(user, deviceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteBundle", reflect.TypeOf((*MockKeysPersistenceInterface)(nil).DeleteBundle), user, deviceId)
+}
+
+// GetBundles mocks base method.
+func (m *MockKeysPersistenceInterface) GetBundles(user types.Uid, consume bool) ([]types.KeyBundle, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBundles", user, consume)
+	ret0, _ := ret[0].([]types.KeyBundle)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBundles indicates an expected call of GetBundles.
+func (mr *MockKeysPersistenceInterfaceMockRecorder) GetBundles(user, consume interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBundles", reflect.TypeOf((*MockKeysPersistenceInterface)(nil).GetBundles), user, consume)
+}
+
+// PopSenderKeys mocks base method.
+func (m *MockKeysPersistenceInterface) PopSenderKeys(topic string, user types.Uid, deviceId string) ([]types.SenderKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PopSenderKeys", topic, user, deviceId)
+	ret0, _ := ret[0].([]types.SenderKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PopSenderKeys indicates an expected call of PopSenderKeys.
+func (mr *MockKeysPersistenceInterfaceMockRecorder) PopSenderKeys(topic, user, deviceId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PopSenderKeys", reflect.TypeOf((*MockKeysPersistenceInterface)(nil).PopSenderKeys), topic, user, deviceId)
+}
+
+// UpsertBundle mocks base method.
+func (m *MockKeysPersistenceInterface) UpsertBundle(kb *types.KeyBundle, maxOneTime int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpsertBundle", kb, maxOneTime)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpsertBundle indicates an expected call of UpsertBundle.
+func (mr *MockKeysPersistenceInterfaceMockRecorder) UpsertBundle(kb, maxOneTime interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpsertBundle", reflect.TypeOf((*MockKeysPersistenceInterface)(nil).UpsertBundle), kb, maxOneTime)
+}
+
+// MockUserDevicePersistenceInterface is a mock of UserDevicePersistenceInterface interface.
+type MockUserDevicePersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockUserDevicePersistenceInterfaceMockRecorder
+}
+
+// MockUserDevicePersistenceInterfaceMockRecorder is the mock recorder for MockUserDevicePersistenceInterface.
+type MockUserDevicePersistenceInterfaceMockRecorder struct {
+	mock *MockUserDevicePersistenceInterface
+}
+
+// NewMockUserDevicePersistenceInterface creates a new mock instance.
+func NewMockUserDevicePersistenceInterface(ctrl *gomock.Controller) *MockUserDevicePersistenceInterface {
+	mock := &MockUserDevicePersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockUserDevicePersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUserDevicePersistenceInterface) EXPECT() *MockUserDevicePersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Delete mocks base method.
+func (m *MockUserDevicePersistenceInterface) Delete(user types.Uid, id string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", user, id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockUserDevicePersistenceInterfaceMockRecorder) Delete(user, id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockUserDevicePersistenceInterface)(nil).Delete), user, id)
+}
+
+// GetAll mocks base method.
+func (m *MockUserDevicePersistenceInterface) GetAll(user types.Uid) ([]types.UserDevice, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", user)
+	ret0, _ := ret[0].([]types.UserDevice)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockUserDevicePersistenceInterfaceMockRecorder) GetAll(user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockUserDevicePersistenceInterface)(nil).GetAll), user)
+}
+
+// Register mocks base method.
+func (m *MockUserDevicePersistenceInterface) Register(dev *types.UserDevice) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Register", dev)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Register indicates an expected call of Register.
+func (mr *MockUserDevicePersistenceInterfaceMockRecorder) Register(dev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Register", reflect.TypeOf((*MockUserDevicePersistenceInterface)(nil).Register), dev)
+}
+
+// Update mocks base method.
+func (m *MockUserDevicePersistenceInterface) Update(user types.Uid, id string, update map[string]any) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", user, id, update)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockUserDevicePersistenceInterfaceMockRecorder) Update(user, id, update interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockUserDevicePersistenceInterface)(nil).Update), user, id, update)
+}
+
+// MockNotifySettingsPersistenceInterface is a mock of NotifySettingsPersistenceInterface interface.
+type MockNotifySettingsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockNotifySettingsPersistenceInterfaceMockRecorder
+}
+
+// MockNotifySettingsPersistenceInterfaceMockRecorder is the mock recorder for MockNotifySettingsPersistenceInterface.
+type MockNotifySettingsPersistenceInterfaceMockRecorder struct {
+	mock *MockNotifySettingsPersistenceInterface
+}
+
+// NewMockNotifySettingsPersistenceInterface creates a new mock instance.
+func NewMockNotifySettingsPersistenceInterface(ctrl *gomock.Controller) *MockNotifySettingsPersistenceInterface {
+	mock := &MockNotifySettingsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockNotifySettingsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockNotifySettingsPersistenceInterface) EXPECT() *MockNotifySettingsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockNotifySettingsPersistenceInterface) Get(users ...types.Uid) (map[types.Uid]*types.NotifySettings, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range users {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Get", varargs...)
+	ret0, _ := ret[0].(map[types.Uid]*types.NotifySettings)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockNotifySettingsPersistenceInterfaceMockRecorder) Get(users ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockNotifySettingsPersistenceInterface)(nil).Get), users...)
+}
+
+// GetForTopic mocks base method.
+func (m *MockNotifySettingsPersistenceInterface) GetForTopic(topic string) (map[types.Uid]*types.TopicNotifySettings, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetForTopic", topic)
+	ret0, _ := ret[0].(map[types.Uid]*types.TopicNotifySettings)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetForTopic indicates an expected call of GetForTopic.
+func (mr *MockNotifySettingsPersistenceInterfaceMockRecorder) GetForTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetForTopic", reflect.TypeOf((*MockNotifySettingsPersistenceInterface)(nil).GetForTopic), topic)
+}
+
+// Update mocks base method.
+func (m *MockNotifySettingsPersistenceInterface) Update(settings *types.NotifySettings) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", settings)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockNotifySettingsPersistenceInterfaceMockRecorder) Update(settings interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockNotifySettingsPersistenceInterface)(nil).Update), settings)
+}
+
+// UpdateForTopic mocks base method.
+func (m *MockNotifySettingsPersistenceInterface) UpdateForTopic(settings *types.TopicNotifySettings) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateForTopic", settings)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateForTopic indicates an expected call of UpdateForTopic.
+func (mr *MockNotifySettingsPersistenceInterfaceMockRecorder) UpdateForTopic(settings interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateForTopic", reflect.TypeOf((*MockNotifySettingsPersistenceInterface)(nil).UpdateForTopic), settings)
+}
+
+// MockPresenceSettingsPersistenceInterface is a mock of PresenceSettingsPersistenceInterface interface.
+type MockPresenceSettingsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockPresenceSettingsPersistenceInterfaceMockRecorder
+}
+
+// MockPresenceSettingsPersistenceInterfaceMockRecorder is the mock recorder for MockPresenceSettingsPersistenceInterface.
+type MockPresenceSettingsPersistenceInterfaceMockRecorder struct {
+	mock *MockPresenceSettingsPersistenceInterface
+}
+
+// NewMockPresenceSettingsPersistenceInterface creates a new mock instance.
+func NewMockPresenceSettingsPersistenceInterface(ctrl *gomock.Controller) *MockPresenceSettingsPersistenceInterface {
+	mock := &MockPresenceSettingsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockPresenceSettingsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockPresenceSettingsPersistenceInterface) EXPECT() *MockPresenceSettingsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockPresenceSettingsPersistenceInterface) Get(users ...types.Uid) (map[types.Uid]*types.PresenceSettings, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range users {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Get", varargs...)
+	ret0, _ := ret[0].(map[types.Uid]*types.PresenceSettings)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockPresenceSettingsPersistenceInterfaceMockRecorder) Get(users ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockPresenceSettingsPersistenceInterface)(nil).Get), users...)
+}
+
+// GetForTopic mocks base method.
+func (m *MockPresenceSettingsPersistenceInterface) GetForTopic(topic string) (map[types.Uid]*types.TopicPresenceSettings, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetForTopic", topic)
+	ret0, _ := ret[0].(map[types.Uid]*types.TopicPresenceSettings)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetForTopic indicates an expected call of GetForTopic.
+func (mr *MockPresenceSettingsPersistenceInterfaceMockRecorder) GetForTopic(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetForTopic", reflect.TypeOf((*MockPresenceSettingsPersistenceInterface)(nil).GetForTopic), topic)
+}
+
+// GetForUser mocks base method.
+func (m *MockPresenceSettingsPersistenceInterface) GetForUser(user types.Uid) (map[string]*types.TopicPresenceSettings, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetForUser", user)
+	ret0, _ := ret[0].(map[string]*types.TopicPresenceSettings)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetForUser indicates an expected call of GetForUser.
+func (mr *MockPresenceSettingsPersistenceInterfaceMockRecorder) GetForUser(user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetForUser", reflect.TypeOf((*MockPresenceSettingsPersistenceInterface)(nil).GetForUser), user)
+}
+
+// Update mocks base method.
+func (m *MockPresenceSettingsPersistenceInterface) Update(settings *types.PresenceSettings) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", settings)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockPresenceSettingsPersistenceInterfaceMockRecorder) Update(settings interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockPresenceSettingsPersistenceInterface)(nil).Update), settings)
+}
+
+// UpdateForTopic mocks base method.
+func (m *MockPresenceSettingsPersistenceInterface) UpdateForTopic(settings *types.TopicPresenceSettings) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateForTopic", settings)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UpdateForTopic indicates an expected call of UpdateForTopic.
+func (mr *MockPresenceSettingsPersistenceInterfaceMockRecorder) UpdateForTopic(settings interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateForTopic", reflect.TypeOf((*MockPresenceSettingsPersistenceInterface)(nil).UpdateForTopic), settings)
+}
+
+// MockMentionsPersistenceInterface is a mock of MentionsPersistenceInterface interface.
+type MockMentionsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockMentionsPersistenceInterfaceMockRecorder
+}
+
+// MockMentionsPersistenceInterfaceMockRecorder is the mock recorder for MockMentionsPersistenceInterface.
+type MockMentionsPersistenceInterfaceMockRecorder struct {
+	mock *MockMentionsPersistenceInterface
+}
+
+// NewMockMentionsPersistenceInterface creates a new mock instance.
+func NewMockMentionsPersistenceInterface(ctrl *gomock.Controller) *MockMentionsPersistenceInterface {
+	mock := &MockMentionsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockMentionsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMentionsPersistenceInterface) EXPECT() *MockMentionsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Add mocks base method.
+func (m *MockMentionsPersistenceInterface) Add(mentions []types.Mention) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Add", mentions)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Add indicates an expected call of Add.
+func (mr *MockMentionsPersistenceInterfaceMockRecorder) Add(mentions interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockMentionsPersistenceInterface)(nil).Add), mentions)
+}
+
+// Count mocks base method.
+func (m *MockMentionsPersistenceInterface) Count(forUser types.Uid, topic string, since int) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Count", forUser, topic, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Count indicates an expected call of Count.
+func (mr *MockMentionsPersistenceInterfaceMockRecorder) Count(forUser, topic, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Count", reflect.TypeOf((*MockMentionsPersistenceInterface)(nil).Count), forUser, topic, since)
+}
+
+// GetAll mocks base method.
+func (m *MockMentionsPersistenceInterface) GetAll(forUser types.Uid, topics []string, before *time.Time, limit int) ([]types.Mention, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", forUser, topics, before, limit)
+	ret0, _ := ret[0].([]types.Mention)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockMentionsPersistenceInterfaceMockRecorder) GetAll(forUser, topics, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockMentionsPersistenceInterface)(nil).GetAll), forUser, topics, before, limit)
+}
+
+// MockDraftsPersistenceInterface is a mock of DraftsPersistenceInterface interface.
+type MockDraftsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockDraftsPersistenceInterfaceMockRecorder
+}
+
+// MockDraftsPersistenceInterfaceMockRecorder is the mock recorder for MockDraftsPersistenceInterface.
+type MockDraftsPersistenceInterfaceMockRecorder struct {
+	mock *MockDraftsPersistenceInterface
+}
+
+// NewMockDraftsPersistenceInterface creates a new mock instance.
+func NewMockDraftsPersistenceInterface(ctrl *gomock.Controller) *MockDraftsPersistenceInterface {
+	mock := &MockDraftsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockDraftsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDraftsPersistenceInterface) EXPECT() *MockDraftsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// GetAll mocks base method.
+func (m *MockDraftsPersistenceInterface) GetAll(user types.Uid, since *time.Time) ([]types.Draft, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", user, since)
+	ret0, _ := ret[0].([]types.Draft)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockDraftsPersistenceInterfaceMockRecorder) GetAll(user, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockDraftsPersistenceInterface)(nil).GetAll), user, since)
+}
+
+// Update mocks base method.
+func (m *MockDraftsPersistenceInterface) Update(draft *types.Draft) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", draft)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockDraftsPersistenceInterfaceMockRecorder) Update(draft interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockDraftsPersistenceInterface)(nil).Update), draft)
+}
+
+// MockStarredPersistenceInterface is a mock of StarredPersistenceInterface interface.
+type MockStarredPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockStarredPersistenceInterfaceMockRecorder
+}
+
+// MockStarredPersistenceInterfaceMockRecorder is the mock recorder for MockStarredPersistenceInterface.
+type MockStarredPersistenceInterfaceMockRecorder struct {
+	mock *MockStarredPersistenceInterface
+}
+
+// NewMockStarredPersistenceInterface creates a new mock instance.
+func NewMockStarredPersistenceInterface(ctrl *gomock.Controller) *MockStarredPersistenceInterface {
+	mock := &MockStarredPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockStarredPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockStarredPersistenceInterface) EXPECT() *MockStarredPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Add mocks base method.
+func (m *MockStarredPersistenceInterface) Add(msg *types.StarredMessage) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Add", msg)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Add indicates an expected call of Add.
+func (mr *MockStarredPersistenceInterfaceMockRecorder) Add(msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockStarredPersistenceInterface)(nil).Add), msg)
+}
+
+// Delete mocks base method.
+func (m *MockStarredPersistenceInterface) Delete(user types.Uid, topic string, seqId int) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", user, topic, seqId)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockStarredPersistenceInterfaceMockRecorder) Delete(user, topic, seqId interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockStarredPersistenceInterface)(nil).Delete), user, topic, seqId)
+}
+
+// GetAll mocks base method.
+func (m *MockStarredPersistenceInterface) GetAll(user types.Uid, topic string, before *time.Time, limit int) ([]types.StarredMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", user, topic, before, limit)
+	ret0, _ := ret[0].([]types.StarredMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockStarredPersistenceInterfaceMockRecorder) GetAll(user, topic, before, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockStarredPersistenceInterface)(nil).GetAll), user, topic, before, limit)
+}
+
+// MockBlocksPersistenceInterface is a mock of BlocksPersistenceInterface interface.
+type MockBlocksPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockBlocksPersistenceInterfaceMockRecorder
+}
+
+// MockBlocksPersistenceInterfaceMockRecorder is the mock recorder for MockBlocksPersistenceInterface.
+type MockBlocksPersistenceInterfaceMockRecorder struct {
+	mock *MockBlocksPersistenceInterface
+}
+
+// NewMockBlocksPersistenceInterface creates a new mock instance.
+func NewMockBlocksPersistenceInterface(ctrl *gomock.Controller) *MockBlocksPersistenceInterface {
+	mock := &MockBlocksPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockBlocksPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockBlocksPersistenceInterface) EXPECT() *MockBlocksPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Add mocks base method.
+func (m *MockBlocksPersistenceInterface) Add(user types.Uid, target types.Uid) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Add", user, target)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Add indicates an expected call of Add.
+func (mr *MockBlocksPersistenceInterfaceMockRecorder) Add(user, target interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockBlocksPersistenceInterface)(nil).Add), user, target)
+}
+
+// Delete mocks base method.
+func (m *MockBlocksPersistenceInterface) Delete(user types.Uid, target types.Uid) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", user, target)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockBlocksPersistenceInterfaceMockRecorder) Delete(user, target interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockBlocksPersistenceInterface)(nil).Delete), user, target)
+}
+
+// GetAll mocks base method.
+func (m *MockBlocksPersistenceInterface) GetAll(user types.Uid) ([]types.Block, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", user)
+	ret0, _ := ret[0].([]types.Block)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockBlocksPersistenceInterfaceMockRecorder) GetAll(user interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockBlocksPersistenceInterface)(nil).GetAll), user)
+}
+
+// GetBetween mocks base method.
+func (m *MockBlocksPersistenceInterface) GetBetween(users []types.Uid) ([]types.Block, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetBetween", users)
+	ret0, _ := ret[0].([]types.Block)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetBetween indicates an expected call of GetBetween.
+func (mr *MockBlocksPersistenceInterfaceMockRecorder) GetBetween(users interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetBetween", reflect.TypeOf((*MockBlocksPersistenceInterface)(nil).GetBetween), users)
+}
+
+// MockInvitesPersistenceInterface is a mock of InvitesPersistenceInterface interface.
+type MockInvitesPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockInvitesPersistenceInterfaceMockRecorder
+}
+
+// MockInvitesPersistenceInterfaceMockRecorder is the mock recorder for MockInvitesPersistenceInterface.
+type MockInvitesPersistenceInterfaceMockRecorder struct {
+	mock *MockInvitesPersistenceInterface
+}
+
+// NewMockInvitesPersistenceInterface creates a new mock instance.
+func NewMockInvitesPersistenceInterface(ctrl *gomock.Controller) *MockInvitesPersistenceInterface {
+	mock := &MockInvitesPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockInvitesPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockInvitesPersistenceInterface) EXPECT() *MockInvitesPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockInvitesPersistenceInterface) Create(invite *types.Invite) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", invite)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockInvitesPersistenceInterfaceMockRecorder) Create(invite interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockInvitesPersistenceInterface)(nil).Create), invite)
+}
+
+// Delete mocks base method.
+func (m *MockInvitesPersistenceInterface) Delete(topic string, token string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", topic, token)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockInvitesPersistenceInterfaceMockRecorder) Delete(topic, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockInvitesPersistenceInterface)(nil).Delete), topic, token)
+}
+
+// GetAll mocks base method.
+func (m *MockInvitesPersistenceInterface) GetAll(topic string) ([]types.Invite, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic)
+	ret0, _ := ret[0].([]types.Invite)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockInvitesPersistenceInterfaceMockRecorder) GetAll(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockInvitesPersistenceInterface)(nil).GetAll), topic)
+}
+
+// Use mocks base method.
+func (m *MockInvitesPersistenceInterface) Use(topic string, token string) (*types.Invite, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Use", topic, token)
+	ret0, _ := ret[0].(*types.Invite)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Use indicates an expected call of Use.
+func (mr *MockInvitesPersistenceInterfaceMockRecorder) Use(topic, token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Use", reflect.TypeOf((*MockInvitesPersistenceInterface)(nil).Use), topic, token)
+}
+
+// MockDirectoryPersistenceInterface is a mock of DirectoryPersistenceInterface interface.
+type MockDirectoryPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockDirectoryPersistenceInterfaceMockRecorder
+}
+
+// MockDirectoryPersistenceInterfaceMockRecorder is the mock recorder for MockDirectoryPersistenceInterface.
+type MockDirectoryPersistenceInterfaceMockRecorder struct {
+	mock *MockDirectoryPersistenceInterface
+}
+
+// NewMockDirectoryPersistenceInterface creates a new mock instance.
+func NewMockDirectoryPersistenceInterface(ctrl *gomock.Controller) *MockDirectoryPersistenceInterface {
+	mock := &MockDirectoryPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockDirectoryPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDirectoryPersistenceInterface) EXPECT() *MockDirectoryPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// List mocks base method.
+func (m *MockDirectoryPersistenceInterface) List(tenant, category string, offset int, limit int) ([]types.DirectoryEntry, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", tenant, category, offset, limit)
+	ret0, _ := ret[0].([]types.DirectoryEntry)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockDirectoryPersistenceInterfaceMockRecorder) List(tenant, category, offset, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockDirectoryPersistenceInterface)(nil).List), tenant, category, offset, limit)
+}
+
+// Publish mocks base method.
+func (m *MockDirectoryPersistenceInterface) Publish(entry *types.DirectoryEntry) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Publish", entry)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Publish indicates an expected call of Publish.
+func (mr *MockDirectoryPersistenceInterfaceMockRecorder) Publish(entry interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Publish", reflect.TypeOf((*MockDirectoryPersistenceInterface)(nil).Publish), entry)
+}
+
+// Unpublish mocks base method.
+func (m *MockDirectoryPersistenceInterface) Unpublish(topic string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unpublish", topic)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Unpublish indicates an expected call of Unpublish.
+func (mr *MockDirectoryPersistenceInterfaceMockRecorder) Unpublish(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unpublish", reflect.TypeOf((*MockDirectoryPersistenceInterface)(nil).Unpublish), topic)
+}
+
+// MockWebhooksPersistenceInterface is a mock of WebhooksPersistenceInterface interface.
+type MockWebhooksPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockWebhooksPersistenceInterfaceMockRecorder
+}
+
+// MockWebhooksPersistenceInterfaceMockRecorder is the mock recorder for MockWebhooksPersistenceInterface.
+type MockWebhooksPersistenceInterfaceMockRecorder struct {
+	mock *MockWebhooksPersistenceInterface
+}
+
+// NewMockWebhooksPersistenceInterface creates a new mock instance.
+func NewMockWebhooksPersistenceInterface(ctrl *gomock.Controller) *MockWebhooksPersistenceInterface {
+	mock := &MockWebhooksPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockWebhooksPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockWebhooksPersistenceInterface) EXPECT() *MockWebhooksPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockWebhooksPersistenceInterface) Create(hook *types.Webhook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", hook)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockWebhooksPersistenceInterfaceMockRecorder) Create(hook interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockWebhooksPersistenceInterface)(nil).Create), hook)
+}
+
+// Delete mocks base method.
+func (m *MockWebhooksPersistenceInterface) Delete(id string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockWebhooksPersistenceInterfaceMockRecorder) Delete(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockWebhooksPersistenceInterface)(nil).Delete), id)
+}
+
+// GetAll mocks base method.
+func (m *MockWebhooksPersistenceInterface) GetAll(topic string) ([]types.Webhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic)
+	ret0, _ := ret[0].([]types.Webhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockWebhooksPersistenceInterfaceMockRecorder) GetAll(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockWebhooksPersistenceInterface)(nil).GetAll), topic)
+}
+
+// MockInWebhooksPersistenceInterface is a mock of InWebhooksPersistenceInterface interface.
+type MockInWebhooksPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockInWebhooksPersistenceInterfaceMockRecorder
+}
+
+// MockInWebhooksPersistenceInterfaceMockRecorder is the mock recorder for MockInWebhooksPersistenceInterface.
+type MockInWebhooksPersistenceInterfaceMockRecorder struct {
+	mock *MockInWebhooksPersistenceInterface
+}
+
+// NewMockInWebhooksPersistenceInterface creates a new mock instance.
+func NewMockInWebhooksPersistenceInterface(ctrl *gomock.Controller) *MockInWebhooksPersistenceInterface {
+	mock := &MockInWebhooksPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockInWebhooksPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockInWebhooksPersistenceInterface) EXPECT() *MockInWebhooksPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockInWebhooksPersistenceInterface) Create(hook *types.IncomingWebhook) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", hook)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockInWebhooksPersistenceInterfaceMockRecorder) Create(hook interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockInWebhooksPersistenceInterface)(nil).Create), hook)
+}
+
+// Delete mocks base method.
+func (m *MockInWebhooksPersistenceInterface) Delete(token string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", token)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockInWebhooksPersistenceInterfaceMockRecorder) Delete(token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockInWebhooksPersistenceInterface)(nil).Delete), token)
+}
+
+// Get mocks base method.
+func (m *MockInWebhooksPersistenceInterface) Get(token string) (*types.IncomingWebhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", token)
+	ret0, _ := ret[0].(*types.IncomingWebhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockInWebhooksPersistenceInterfaceMockRecorder) Get(token interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockInWebhooksPersistenceInterface)(nil).Get), token)
+}
+
+// GetAll mocks base method.
+func (m *MockInWebhooksPersistenceInterface) GetAll(topic string) ([]types.IncomingWebhook, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic)
+	ret0, _ := ret[0].([]types.IncomingWebhook)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockInWebhooksPersistenceInterfaceMockRecorder) GetAll(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockInWebhooksPersistenceInterface)(nil).GetAll), topic)
+}
+
+// MockMatrixRoomsPersistenceInterface is a mock of MatrixRoomsPersistenceInterface interface.
+type MockMatrixRoomsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockMatrixRoomsPersistenceInterfaceMockRecorder
+}
+
+// MockMatrixRoomsPersistenceInterfaceMockRecorder is the mock recorder for MockMatrixRoomsPersistenceInterface.
+type MockMatrixRoomsPersistenceInterfaceMockRecorder struct {
+	mock *MockMatrixRoomsPersistenceInterface
+}
+
+// NewMockMatrixRoomsPersistenceInterface creates a new mock instance.
+func NewMockMatrixRoomsPersistenceInterface(ctrl *gomock.Controller) *MockMatrixRoomsPersistenceInterface {
+	mock := &MockMatrixRoomsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockMatrixRoomsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMatrixRoomsPersistenceInterface) EXPECT() *MockMatrixRoomsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Get mocks base method.
+func (m *MockMatrixRoomsPersistenceInterface) Get(topic string) (*types.MatrixRoom, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", topic)
+	ret0, _ := ret[0].(*types.MatrixRoom)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockMatrixRoomsPersistenceInterfaceMockRecorder) Get(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockMatrixRoomsPersistenceInterface)(nil).Get), topic)
+}
+
+// GetByRoom mocks base method.
+func (m *MockMatrixRoomsPersistenceInterface) GetByRoom(room string) (*types.MatrixRoom, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetByRoom", room)
+	ret0, _ := ret[0].(*types.MatrixRoom)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetByRoom indicates an expected call of GetByRoom.
+func (mr *MockMatrixRoomsPersistenceInterfaceMockRecorder) GetByRoom(room interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetByRoom", reflect.TypeOf((*MockMatrixRoomsPersistenceInterface)(nil).GetByRoom), room)
+}
+
+// Link mocks base method.
+func (m *MockMatrixRoomsPersistenceInterface) Link(topic string, room string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Link", topic, room)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Link indicates an expected call of Link.
+func (mr *MockMatrixRoomsPersistenceInterfaceMockRecorder) Link(topic, room interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Link", reflect.TypeOf((*MockMatrixRoomsPersistenceInterface)(nil).Link), topic, room)
+}
+
+// Unlink mocks base method.
+func (m *MockMatrixRoomsPersistenceInterface) Unlink(topic string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unlink", topic)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Unlink indicates an expected call of Unlink.
+func (mr *MockMatrixRoomsPersistenceInterfaceMockRecorder) Unlink(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unlink", reflect.TypeOf((*MockMatrixRoomsPersistenceInterface)(nil).Unlink), topic)
+}
+
+// MockMailboxesPersistenceInterface is a mock of MailboxesPersistenceInterface interface.
+type MockMailboxesPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockMailboxesPersistenceInterfaceMockRecorder
+}
+
+// MockMailboxesPersistenceInterfaceMockRecorder is the mock recorder for MockMailboxesPersistenceInterface.
+type MockMailboxesPersistenceInterfaceMockRecorder struct {
+	mock *MockMailboxesPersistenceInterface
+}
+
+// NewMockMailboxesPersistenceInterface creates a new mock instance.
+func NewMockMailboxesPersistenceInterface(ctrl *gomock.Controller) *MockMailboxesPersistenceInterface {
+	mock := &MockMailboxesPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockMailboxesPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockMailboxesPersistenceInterface) EXPECT() *MockMailboxesPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockMailboxesPersistenceInterface) Create(box *types.Mailbox) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", box)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockMailboxesPersistenceInterfaceMockRecorder) Create(box interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockMailboxesPersistenceInterface)(nil).Create), box)
+}
+
+// Delete mocks base method.
+func (m *MockMailboxesPersistenceInterface) Delete(address string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", address)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockMailboxesPersistenceInterfaceMockRecorder) Delete(address interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockMailboxesPersistenceInterface)(nil).Delete), address)
+}
+
+// Get mocks base method.
+func (m *MockMailboxesPersistenceInterface) Get(address string) (*types.Mailbox, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", address)
+	ret0, _ := ret[0].(*types.Mailbox)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockMailboxesPersistenceInterfaceMockRecorder) Get(address interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockMailboxesPersistenceInterface)(nil).Get), address)
+}
+
+// GetAll mocks base method.
+func (m *MockMailboxesPersistenceInterface) GetAll(topic string) ([]types.Mailbox, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", topic)
+	ret0, _ := ret[0].([]types.Mailbox)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockMailboxesPersistenceInterfaceMockRecorder) GetAll(topic interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockMailboxesPersistenceInterface)(nil).GetAll), topic)
+}
+
+// MockTenantsPersistenceInterface is a mock of TenantsPersistenceInterface interface.
+type MockTenantsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockTenantsPersistenceInterfaceMockRecorder
+}
+
+// MockTenantsPersistenceInterfaceMockRecorder is the mock recorder for MockTenantsPersistenceInterface.
+type MockTenantsPersistenceInterfaceMockRecorder struct {
+	mock *MockTenantsPersistenceInterface
+}
+
+// NewMockTenantsPersistenceInterface creates a new mock instance.
+func NewMockTenantsPersistenceInterface(ctrl *gomock.Controller) *MockTenantsPersistenceInterface {
+	mock := &MockTenantsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockTenantsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockTenantsPersistenceInterface) EXPECT() *MockTenantsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Create mocks base method.
+func (m *MockTenantsPersistenceInterface) Create(tenant *types.Tenant) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", tenant)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockTenantsPersistenceInterfaceMockRecorder) Create(tenant interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockTenantsPersistenceInterface)(nil).Create), tenant)
+}
+
+// Delete mocks base method.
+func (m *MockTenantsPersistenceInterface) Delete(id string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", id)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockTenantsPersistenceInterfaceMockRecorder) Delete(id interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockTenantsPersistenceInterface)(nil).Delete), id)
+}
+
+// GetAll mocks base method.
+func (m *MockTenantsPersistenceInterface) GetAll() ([]types.Tenant, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll")
+	ret0, _ := ret[0].([]types.Tenant)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockTenantsPersistenceInterfaceMockRecorder) GetAll() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockTenantsPersistenceInterface)(nil).GetAll))
+}
+
+// Update mocks base method.
+func (m *MockTenantsPersistenceInterface) Update(tenant *types.Tenant) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", tenant)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockTenantsPersistenceInterfaceMockRecorder) Update(tenant interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockTenantsPersistenceInterface)(nil).Update), tenant)
+}
+
+// MockUsagePersistenceInterface is a mock of UsagePersistenceInterface interface.
+type MockUsagePersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockUsagePersistenceInterfaceMockRecorder
+}
+
+// MockUsagePersistenceInterfaceMockRecorder is the mock recorder for MockUsagePersistenceInterface.
+type MockUsagePersistenceInterfaceMockRecorder struct {
+	mock *MockUsagePersistenceInterface
+}
+
+// NewMockUsagePersistenceInterface creates a new mock instance.
+func NewMockUsagePersistenceInterface(ctrl *gomock.Controller) *MockUsagePersistenceInterface {
+	mock := &MockUsagePersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockUsagePersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockUsagePersistenceInterface) EXPECT() *MockUsagePersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Add mocks base method.
+func (m *MockUsagePersistenceInterface) Add(records []types.UsageRecord) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Add", records)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Add indicates an expected call of Add.
+func (mr *MockUsagePersistenceInterfaceMockRecorder) Add(records interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Add", reflect.TypeOf((*MockUsagePersistenceInterface)(nil).Add), records)
+}
+
+// Get mocks base method.
+func (m *MockUsagePersistenceInterface) Get(period string, uid types.Uid) (*types.UsageRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", period, uid)
+	ret0, _ := ret[0].(*types.UsageRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockUsagePersistenceInterfaceMockRecorder) Get(period, uid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockUsagePersistenceInterface)(nil).Get), period, uid)
+}
+
+// List mocks base method.
+func (m *MockUsagePersistenceInterface) List(period string, tenants []string) ([]types.UsageRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", period, tenants)
+	ret0, _ := ret[0].([]types.UsageRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockUsagePersistenceInterfaceMockRecorder) List(period, tenants interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockUsagePersistenceInterface)(nil).List), period, tenants)
+}
+
+// Total mocks base method.
+func (m *MockUsagePersistenceInterface) Total(period, tenant string) (*types.UsageRecord, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Total", period, tenant)
+	ret0, _ := ret[0].(*types.UsageRecord)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Total indicates an expected call of Total.
+func (mr *MockUsagePersistenceInterfaceMockRecorder) Total(period, tenant interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Total", reflect.TypeOf((*MockUsagePersistenceInterface)(nil).Total), period, tenant)
+}
+
+// MockSmsPersistenceInterface is a mock of SmsPersistenceInterface interface.
+type MockSmsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockSmsPersistenceInterfaceMockRecorder
+}
+
+// MockSmsPersistenceInterfaceMockRecorder is the mock recorder for MockSmsPersistenceInterface.
+type MockSmsPersistenceInterfaceMockRecorder struct {
+	mock *MockSmsPersistenceInterface
+}
+
+// NewMockSmsPersistenceInterface creates a new mock instance.
+func NewMockSmsPersistenceInterface(ctrl *gomock.Controller) *MockSmsPersistenceInterface {
+	mock := &MockSmsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockSmsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSmsPersistenceInterface) EXPECT() *MockSmsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Count mocks base method.
+func (m *MockSmsPersistenceInterface) Count(user types.Uid, since time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Count", user, since)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Count indicates an expected call of Count.
+func (mr *MockSmsPersistenceInterfaceMockRecorder) Count(user, since interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Count", reflect.TypeOf((*MockSmsPersistenceInterface)(nil).Count), user, since)
+}
+
+// Create mocks base method.
+func (m *MockSmsPersistenceInterface) Create(msg *types.SmsMessage) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", msg)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockSmsPersistenceInterfaceMockRecorder) Create(msg interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockSmsPersistenceInterface)(nil).Create), msg)
+}
+
+// GetAll mocks base method.
+func (m *MockSmsPersistenceInterface) GetAll(user types.Uid, limit int) ([]types.SmsMessage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAll", user, limit)
+	ret0, _ := ret[0].([]types.SmsMessage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockSmsPersistenceInterfaceMockRecorder) GetAll(user, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockSmsPersistenceInterface)(nil).GetAll), user, limit)
+}
+
+// Update mocks base method.
+func (m *MockSmsPersistenceInterface) Update(id string, providerId string, status string, errText string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", id, providerId, status, errText)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockSmsPersistenceInterfaceMockRecorder) Update(id, providerId, status, errText interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockSmsPersistenceInterface)(nil).Update), id, providerId, status, errText)
+}
+
+// MockContactsPersistenceInterface is a mock of ContactsPersistenceInterface interface.
+type MockContactsPersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockContactsPersistenceInterfaceMockRecorder
+}
+
+// MockContactsPersistenceInterfaceMockRecorder is the mock recorder for MockContactsPersistenceInterface.
+type MockContactsPersistenceInterfaceMockRecorder struct {
+	mock *MockContactsPersistenceInterface
+}
+
+// NewMockContactsPersistenceInterface creates a new mock instance.
+func NewMockContactsPersistenceInterface(ctrl *gomock.Controller) *MockContactsPersistenceInterface {
+	mock := &MockContactsPersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockContactsPersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockContactsPersistenceInterface) EXPECT() *MockContactsPersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Find mocks base method.
+func (m *MockContactsPersistenceInterface) Find(tenant string, hashes []string) ([]types.ContactHash, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Find", tenant, hashes)
+	ret0, _ := ret[0].([]types.ContactHash)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Find indicates an expected call of Find.
+func (mr *MockContactsPersistenceInterfaceMockRecorder) Find(tenant, hashes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Find", reflect.TypeOf((*MockContactsPersistenceInterface)(nil).Find), tenant, hashes)
+}
+
+// FindByPrefix mocks base method.
+func (m *MockContactsPersistenceInterface) FindByPrefix(tenant string, prefixes []string) ([]types.ContactHash, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FindByPrefix", tenant, prefixes)
+	ret0, _ := ret[0].([]types.ContactHash)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FindByPrefix indicates an expected call of FindByPrefix.
+func (mr *MockContactsPersistenceInterfaceMockRecorder) FindByPrefix(tenant, prefixes interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindByPrefix", reflect.TypeOf((*MockContactsPersistenceInterface)(nil).FindByPrefix), tenant, prefixes)
+}
+
+// MockDevicePersistenceInterface is a mock of DevicePersistenceInterface interface.
+type MockDevicePersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockDevicePersistenceInterfaceMockRecorder
+}
+
+// MockDevicePersistenceInterfaceMockRecorder is the mock recorder for MockDevicePersistenceInterface.
+type MockDevicePersistenceInterfaceMockRecorder struct {
+	mock *MockDevicePersistenceInterface
+}
+
+// NewMockDevicePersistenceInterface creates a new mock instance.
+func NewMockDevicePersistenceInterface(ctrl *gomock.Controller) *MockDevicePersistenceInterface {
+	mock := &MockDevicePersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockDevicePersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockDevicePersistenceInterface) EXPECT() *MockDevicePersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// Delete mocks base method.
+func (m *MockDevicePersistenceInterface) Delete(uid types.Uid, deviceID string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Delete", uid, deviceID)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Delete indicates an expected call of Delete.
+func (mr *MockDevicePersistenceInterfaceMockRecorder) Delete(uid, deviceID interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockDevicePersistenceInterface)(nil).Delete), uid, deviceID)
+}
+
+// GetAll mocks base method.
+func (m *MockDevicePersistenceInterface) GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, int, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{}
+	for _, a := range uid {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "GetAll", varargs...)
+	ret0, _ := ret[0].(map[types.Uid][]types.DeviceDef)
+	ret1, _ := ret[1].(int)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetAll indicates an expected call of GetAll.
+func (mr *MockDevicePersistenceInterfaceMockRecorder) GetAll(uid ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAll", reflect.TypeOf((*MockDevicePersistenceInterface)(nil).GetAll), uid...)
+}
+
+// Update mocks base method.
+func (m *MockDevicePersistenceInterface) Update(uid types.Uid, oldDeviceID string, dev *types.DeviceDef) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Update", uid, oldDeviceID, dev)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Update indicates an expected call of Update.
+func (mr *MockDevicePersistenceInterfaceMockRecorder) Update(uid, oldDeviceID, dev interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Update", reflect.TypeOf((*MockDevicePersistenceInterface)(nil).Update), uid, oldDeviceID, dev)
+}
+
+// MockFilePersistenceInterface is a mock of FilePersistenceInterface interface.
+type MockFilePersistenceInterface struct {
+	ctrl     *gomock.Controller
+	recorder *MockFilePersistenceInterfaceMockRecorder
+}
+
+// MockFilePersistenceInterfaceMockRecorder is the mock recorder for MockFilePersistenceInterface.
+type MockFilePersistenceInterfaceMockRecorder struct {
+	mock *MockFilePersistenceInterface
+}
+
+// NewMockFilePersistenceInterface creates a new mock instance.
+func NewMockFilePersistenceInterface(ctrl *gomock.Controller) *MockFilePersistenceInterface {
+	mock := &MockFilePersistenceInterface{ctrl: ctrl}
+	mock.recorder = &MockFilePersistenceInterfaceMockRecorder{mock}
+	return mock
+}
+
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockFilePersistenceInterface) EXPECT() *MockFilePersistenceInterfaceMockRecorder {
+	return m.recorder
+}
+
+// DeleteUnused mocks base method.
+func (m *MockFilePersistenceInterface) DeleteUnused(olderThan time.Time, limit int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUnused", olderThan, limit)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteUnused indicates an expected call of DeleteUnused.
+func (mr *MockFilePersistenceInterfaceMockRecorder) DeleteUnused(olderThan, limit interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUnused", reflect.TypeOf((*MockFilePersistenceInterface)(nil).DeleteUnused), olderThan, limit)
+}
+
+// FinishUpload mocks base method.
+func (m *MockFilePersistenceInterface) FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FinishUpload", fd, success, size)
+	ret0, _ := ret[0].(*types.FileDef)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// FinishUpload indicates an expected call of FinishUpload.
+func (mr *MockFilePersistenceInterfaceMockRecorder) FinishUpload(fd, success, size interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FinishUpload", reflect.TypeOf((*MockFilePersistenceInterface)(nil).FinishUpload), fd, success, size)
+}
+
+// Get mocks base method.
+func (m *MockFilePersistenceInterface) Get(fid string) (*types.FileDef, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Get", fid)
+	ret0, _ := ret[0].(*types.FileDef)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Get indicates an expected call of Get.
+func (mr *MockFilePersistenceInterfaceMockRecorder) Get(fid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockFilePersistenceInterface)(nil).Get), fid)
+}
+
+// GetAllByUser mocks base method.
+func (m *MockFilePersistenceInterface) GetAllByUser(uid types.Uid) ([]types.FileDef, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetAllByUser", uid)
+	ret0, _ := ret[0].([]types.FileDef)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetAllByUser indicates an expected call of GetAllByUser.
+func (mr *MockFilePersistenceInterfaceMockRecorder) GetAllByUser(uid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAllByUser", reflect.TypeOf((*MockFilePersistenceInterface)(nil).GetAllByUser), uid)
+}
+
+// LinkAttachments mocks base method.
+func (m *MockFilePersistenceInterface) LinkAttachments(topic string, msgId types.Uid, attachments []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LinkAttachments", topic, msgId, attachments)
+	ret0, _ := ret[0].(error)
+	return ret0
 }
 
 // LinkAttachments indicates an expected call of LinkAttachments.
@@ -1283,6 +3790,36 @@ func (mr *MockFilePersistenceInterfaceMockRecorder) StartUpload(fd interface{})
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "StartUpload", reflect.TypeOf((*MockFilePersistenceInterface)(nil).StartUpload), fd)
 }
 
+// TopicUsage mocks base method.
+func (m *MockFilePersistenceInterface) TopicUsage(topic string, attachments []string) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TopicUsage", topic, attachments)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// TopicUsage indicates an expected call of TopicUsage.
+func (mr *MockFilePersistenceInterfaceMockRecorder) TopicUsage(topic, attachments interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TopicUsage", reflect.TypeOf((*MockFilePersistenceInterface)(nil).TopicUsage), topic, attachments)
+}
+
+// UserUsage mocks base method.
+func (m *MockFilePersistenceInterface) UserUsage(uid types.Uid) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UserUsage", uid)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UserUsage indicates an expected call of UserUsage.
+func (mr *MockFilePersistenceInterfaceMockRecorder) UserUsage(uid interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UserUsage", reflect.TypeOf((*MockFilePersistenceInterface)(nil).UserUsage), uid)
+}
+
 // MockPersistentCacheInterface is a mock of PersistentCacheInterface interface.
 type MockPersistentCacheInterface struct {
 	ctrl     *gomock.Controller
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Blind index for searching message content encrypted at rest. Each word of the message text is
+// replaced with a keyed hash (token) of the word and the topic name. The tokens are stored alongside
+// the ciphertext. Search queries are converted into tokens the same way and matched against the index,
+// so the database never sees the words. Binding tokens to the topic prevents correlation of messages
+// across topics.
+
+const (
+	// Minimum length of an indexed word in characters.
+	minSearchWordLength = 2
+	// Maximum number of unique tokens per message.
+	maxSearchTokens = 256
+	// Length of a token hash in bytes before encoding.
+	searchTokenSize = 16
+)
+
+// Key for computing blind index tokens or nil if the index is disabled.
+var searchIndexKey []byte
+
+// InitSearchIndex enables the blind search index with the given base64-encoded 32-byte key.
+// Empty key disables the index.
+func InitSearchIndex(key string) error {
+	if key == "" {
+		searchIndexKey = nil
+		return nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("invalid search index key: " + err.Error())
+	}
+	if len(raw) != 32 {
+		return errors.New("search index key must be 32 bytes")
+	}
+	searchIndexKey = raw
+	return nil
+}
+
+// IsSearchIndexEnabled returns true if the blind search index is enabled.
+func IsSearchIndexEnabled() bool {
+	return searchIndexKey != nil
+}
+
+// searchWords splits text into unique lowercase words, ignoring punctuation and words which are too short.
+func searchWords(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var words []string
+	seen := make(map[string]struct{}, len(fields))
+	for _, word := range fields {
+		if utf8.RuneCountInString(word) < minSearchWordLength {
+			continue
+		}
+		if _, dup := seen[word]; dup {
+			continue
+		}
+		seen[word] = struct{}{}
+		words = append(words, word)
+		if len(words) == maxSearchTokens {
+			break
+		}
+	}
+	return words
+}
+
+// searchToken computes the blind index token of a word in the topic.
+func searchToken(topic, word string) string {
+	mac := hmac.New(sha256.New, searchIndexKey)
+	mac.Write([]byte(topic))
+	mac.Write([]byte{0})
+	mac.Write([]byte(word))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:searchTokenSize])
+}
+
+func searchTokens(topic, text string) []string {
+	words := searchWords(text)
+	if len(words) == 0 {
+		return nil
+	}
+	tokens := make([]string, len(words))
+	for i, word := range words {
+		tokens[i] = searchToken(topic, word)
+	}
+	return tokens
+}
+
+// contentText extracts searchable text from message content: either a plain string or Drafty.
+func contentText(content any) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case map[string]any:
+		txt, _ := c["txt"].(string)
+		return txt
+	}
+	return ""
+}
+
+// ContentSearchTokens returns blind index tokens of plaintext message content in the topic.
+// Returns nil if the index is disabled.
+func ContentSearchTokens(topic string, content any) []string {
+	if !IsSearchIndexEnabled() {
+		return nil
+	}
+	return searchTokens(topic, contentText(content))
+}
+
+// QuerySearchTokens converts a search query into blind index tokens. A message matches the query
+// if it contains all of the tokens.
+func QuerySearchTokens(topic, query string) []string {
+	if !IsSearchIndexEnabled() {
+		return nil
+	}
+	return searchTokens(topic, query)
+}
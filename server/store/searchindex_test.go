@@ -0,0 +1,52 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchWords(t *testing.T) {
+	words := searchWords("Hello, hello WORLD! I'm a naïve café-goer 42")
+	expected := []string{"hello", "world", "naïve", "café", "goer", "42"}
+	if !reflect.DeepEqual(words, expected) {
+		t.Errorf("Expected %v, got %v", expected, words)
+	}
+}
+
+func TestSearchTokens(t *testing.T) {
+	if tokens := ContentSearchTokens("grpTest", "hello"); tokens != nil {
+		t.Fatalf("Expected no tokens with the index disabled, got %v", tokens)
+	}
+
+	key, _ := GenerateEncryptionKey()
+	if err := InitSearchIndex(key); err != nil {
+		t.Fatalf("Failed to init search index: %v", err)
+	}
+	t.Cleanup(func() { searchIndexKey = nil })
+
+	content := map[string]any{"txt": "Meeting at noon", "fmt": []any{map[string]any{"at": 0, "len": 7, "tp": "ST"}}}
+	tokens := ContentSearchTokens("grpTest", content)
+	if len(tokens) != 3 {
+		t.Fatalf("Expected 3 tokens, got %v", tokens)
+	}
+
+	// Query tokens match content tokens regardless of case and order.
+	query := QuerySearchTokens("grpTest", "NOON meeting")
+	if len(query) != 2 || query[0] != tokens[2] || query[1] != tokens[0] {
+		t.Errorf("Expected query tokens to match content tokens, got %v, %v", query, tokens)
+	}
+
+	// Tokens are bound to the topic and the key.
+	if other := QuerySearchTokens("grpOther", "noon"); other[0] == tokens[2] {
+		t.Error("Expected different tokens in different topics")
+	}
+	key2, _ := GenerateEncryptionKey()
+	InitSearchIndex(key2)
+	if other := QuerySearchTokens("grpTest", "noon"); other[0] == tokens[2] {
+		t.Error("Expected different tokens with different keys")
+	}
+
+	if err := InitSearchIndex("c2hvcnQ="); err == nil {
+		t.Error("Expected error for short key")
+	}
+}
@@ -2,11 +2,14 @@
 package store
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tinode/chat/server/auth"
@@ -36,6 +39,30 @@ type configType struct {
 	// Base64-encoded 32-byte AES key for encrypting message content at rest.
 	// If empty, encryption is disabled.
 	EncryptionKey string `json:"encryption_key"`
+	// Keyring for rotation of encryption keys: key ID -> base64-encoded 32-byte AES key.
+	// Content encrypted with EncryptionKey remains readable.
+	EncryptionKeys map[string]string `json:"encryption_keys"`
+	// ID of the key from EncryptionKeys used to encrypt new content. If empty,
+	// EncryptionKey is used.
+	EncryptionKeyID string `json:"encryption_key_id"`
+	// Provider of the master key for envelope encryption. If set, EncryptionKey and EncryptionKeys
+	// contain data keys wrapped by the master key in the provider-specific format.
+	KeyProvider *keyProviderConfig `json:"key_provider"`
+	// Message header fields to encrypt at rest in addition to content, e.g. ["mime", "reply", "mentions"].
+	EncryptHeadFields []string `json:"encrypt_head_fields"`
+	// Encrypt MIME type and location of uploaded files.
+	EncryptFileMetadata bool `json:"encrypt_file_metadata"`
+	// Encrypt message content with per-topic keys derived from the current key.
+	PerTopicKeys bool `json:"per_topic_keys"`
+	// Base64-encoded 32-byte key of the blind index for searching message content. Wrapped
+	// by the KeyProvider if one is configured. If empty, search is not available.
+	SearchIndexKey string `json:"search_index_key"`
+	// Maximum size in bytes of decrypted message content. Larger content is rejected
+	// on read. If 0, DefaultMaxDecryptedSize is used.
+	MaxDecryptedSize int `json:"max_decrypted_size"`
+	// Salt of hashes of phone numbers and emails for contact discovery. Clients receive the salt
+	// to compute the hashes. If empty, contact discovery is disabled.
+	ContactSalt string `json:"contact_salt"`
 }
 
 func openAdapter(workerId int, jsonconf json.RawMessage) error {
@@ -85,9 +112,40 @@ func openAdapter(workerId int, jsonconf json.RawMessage) error {
 	}
 
 	// Initialize message encryption
-	if err := InitMessageEncryption(config.EncryptionKey); err != nil {
+	useKeyProvider := config.KeyProvider != nil && config.KeyProvider.Name != ""
+	wrappedActive := config.EncryptionKey
+	if config.EncryptionKeyID != "" {
+		wrappedActive = config.EncryptionKeys[config.EncryptionKeyID]
+	}
+	if useKeyProvider {
+		var err error
+		if config.EncryptionKey, config.EncryptionKeys, err = unwrapEncryptionKeys(config.KeyProvider,
+			config.EncryptionKey, config.EncryptionKeys); err != nil {
+			return errors.New("store: " + err.Error())
+		}
+		if config.SearchIndexKey != "" {
+			if config.SearchIndexKey, err = unwrapKey(config.KeyProvider, config.SearchIndexKey); err != nil {
+				return errors.New("store: failed to unwrap search index key: " + err.Error())
+			}
+		}
+	}
+	if err := InitMessageEncryptionKeyring(config.EncryptionKey, config.EncryptionKeys, config.EncryptionKeyID,
+		config.MaxDecryptedSize); err != nil {
+		return errors.New("store: failed to init message encryption: " + err.Error())
+	}
+	if useKeyProvider {
+		setEncryptionKeyProvider(config.KeyProvider, wrappedActive)
+	}
+	if err := SetEncryptedMetadata(config.EncryptHeadFields, config.EncryptFileMetadata); err != nil {
+		return errors.New("store: failed to init message encryption: " + err.Error())
+	}
+	if err := EnablePerTopicKeys(config.PerTopicKeys); err != nil {
 		return errors.New("store: failed to init message encryption: " + err.Error())
 	}
+	if err := InitSearchIndex(config.SearchIndexKey); err != nil {
+		return errors.New("store: failed to init search index: " + err.Error())
+	}
+	InitContactIndex(config.ContactSalt)
 
 	return adp.Open(adapterConfig)
 }
@@ -128,7 +186,12 @@ func (storeObj) Open(workerId int, jsonconf json.RawMessage) error {
 		return err
 	}
 
-	return adp.CheckDbVersion()
+	if err := adp.CheckDbVersion(); err != nil {
+		return err
+	}
+
+	// Rebuild the index of contacts if the salt has changed.
+	return adp.ContactsInit(contactSalt)
 }
 
 // Close terminates connection to persistent storage.
@@ -265,17 +328,19 @@ type UsersPersistenceInterface interface {
 	AddAuthRecord(uid types.Uid, authLvl auth.Level, scheme, unique string, secret []byte, expires time.Time) error
 	UpdateAuthRecord(uid types.Uid, authLvl auth.Level, scheme, unique string, secret []byte, expires time.Time) error
 	DelAuthRecords(uid types.Uid, scheme string) error
+	GetAuthRecords(scheme, after string, limit int) ([]types.AuthRecord, error)
 	Get(uid types.Uid) (*types.User, error)
 	GetAll(uid ...types.Uid) ([]types.User, error)
 	GetByCred(method, value string) (types.Uid, error)
 	Delete(id types.Uid, hard bool) error
+	Erase(id types.Uid, dryRun bool) (types.ErasureReport, error)
 	UpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error
 	Update(uid types.Uid, update map[string]any) error
 	UpdateTags(uid types.Uid, add, remove, reset []string) ([]string, error)
 	UpdateState(uid types.Uid, state types.ObjState) error
 	GetSubs(id types.Uid) ([]types.Subscription, error)
-	FindSubs(caller types.Uid, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error)
-	FindOne(tag string) (string, error)
+	FindSubs(caller types.Uid, tenant, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error)
+	FindOne(tenant, tag string) (string, error)
 	GetTopics(id types.Uid, opts *types.QueryOpt) ([]types.Subscription, error)
 	GetTopicsAny(id types.Uid, opts *types.QueryOpt) ([]types.Subscription, error)
 	GetOwnTopics(id types.Uid) ([]string, error)
@@ -287,6 +352,7 @@ type UsersPersistenceInterface interface {
 	GetAllCreds(id types.Uid, method string, validatedOnly bool) ([]types.Credential, error)
 	DelCred(id types.Uid, method, value string) error
 	GetUnreadCount(ids ...types.Uid) (map[types.Uid]int, error)
+	GetUnreadByTopic(uid types.Uid) ([]types.TopicUnread, error)
 	GetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]types.Uid, error)
 }
 
@@ -379,7 +445,15 @@ func (usersMapper) DelAuthRecords(uid types.Uid, scheme string) error {
 
 // Get returns a user object for the given user ID or nil if the user is not found.
 func (usersMapper) Get(uid types.Uid) (*types.User, error) {
-	return adp.UserGet(uid)
+	var user types.User
+	if cacheGet(cacheKeyUser(uid), &user) {
+		return &user, nil
+	}
+	found, err := adp.UserGet(uid)
+	if err == nil && found != nil {
+		cachePut(cacheKeyUser(uid), found)
+	}
+	return found, err
 }
 
 // GetAll returns a slice of user objects for the given user IDs.
@@ -394,11 +468,57 @@ func (usersMapper) GetByCred(method, value string) (types.Uid, error) {
 
 // Delete deletes user records.
 func (usersMapper) Delete(id types.Uid, hard bool) error {
+	// Subscriptions of the user are deleted or suspended together with the user.
+	cacheInvalidateUserTopics(id)
+	defer cacheInvalidate(cacheKeyUser(id))
 	return adp.UserDelete(id, hard)
 }
 
+// Erase deletes or anonymizes the data derived from the user which is not removed by Delete, including
+// user's files in the media store. It must be followed by a hard Delete. If dryRun is true, nothing
+// is changed, the report lists the records which would be affected by Erase and Delete.
+func (usersMapper) Erase(id types.Uid, dryRun bool) (types.ErasureReport, error) {
+	// Messages in cold storage are removed first: the subscriptions of the user locate the blobs.
+	cold := 0
+	if coldStorage != nil {
+		var err error
+		if cold, err = eraseCold(id, dryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	report, toDel, err := adp.UserErase(id, dryRun)
+	if err == nil && cold > 0 {
+		report["coldmessages"] = cold
+	}
+	if err != nil || len(toDel) == 0 {
+		return report, err
+	}
+	for i, loc := range toDel {
+		if toDel[i], err = decryptString(loc); err != nil {
+			return report, err
+		}
+	}
+	if mediaHandler != nil {
+		err = mediaHandler.Delete(toDel)
+	}
+	return report, err
+}
+
+// GetAuthRecords returns up to 'limit' authentication records of the scheme with unique values greater
+// than 'after', in the order of unique values. Pass the unique value of the last record to get the next page.
+func (usersMapper) GetAuthRecords(scheme, after string, limit int) ([]types.AuthRecord, error) {
+	prefix := scheme + ":"
+	records, err := adp.AuthGetAllRecords(scheme, prefix+after, limit)
+	for i := range records {
+		records[i].Unique = strings.TrimPrefix(records[i].Unique, prefix)
+	}
+	return records, err
+}
+
 // UpdateLastSeen updates LastSeen and UserAgent.
 func (usersMapper) UpdateLastSeen(uid types.Uid, userAgent string, when time.Time) error {
+	defer cacheInvalidate(cacheKeyUser(uid))
 	return adp.UserUpdate(uid, map[string]any{"LastSeen": when, "UserAgent": userAgent})
 }
 
@@ -407,11 +527,13 @@ func (usersMapper) Update(uid types.Uid, update map[string]any) error {
 	if _, ok := update["UpdatedAt"]; !ok {
 		update["UpdatedAt"] = types.TimeNow()
 	}
+	defer cacheInvalidate(cacheKeyUser(uid))
 	return adp.UserUpdate(uid, update)
 }
 
 // UpdateTags either adds, removes, or resets tags to the given slices.
 func (usersMapper) UpdateTags(uid types.Uid, add, remove, reset []string) ([]string, error) {
+	defer cacheInvalidate(cacheKeyUser(uid))
 	return adp.UserUpdateTags(uid, add, remove, reset)
 }
 
@@ -420,6 +542,9 @@ func (usersMapper) UpdateState(uid types.Uid, state types.ObjState) error {
 	update := map[string]any{
 		"State":   state,
 		"StateAt": types.TimeNow()}
+	// State of user's topics changes together with the user.
+	cacheInvalidateUserTopics(uid)
+	defer cacheInvalidate(cacheKeyUser(uid))
 	return adp.UserUpdate(uid, update)
 }
 
@@ -429,21 +554,21 @@ func (usersMapper) GetSubs(id types.Uid) ([]types.Subscription, error) {
 	return adp.SubsForUser(id)
 }
 
-// FindSubs find a list of users and topics for the given tags. Results are formatted as subscriptions.
+// FindSubs find a list of users and topics of the tenant for the given tags. Results are formatted as subscriptions.
 // `required` specifies an AND of ORs for required terms:
 // at least one element of every sublist in `required` must be present in the object's tags list.
 // `optional` specifies a list of optional terms.
-func (usersMapper) FindSubs(caller types.Uid, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error) {
+func (usersMapper) FindSubs(caller types.Uid, tenant, prefPrefix string, required [][]string, optional []string, activeOnly bool) ([]types.Subscription, error) {
 	if len(required) == 0 && len(optional) == 0 {
 		// No tags specified, return empty list.
 		return nil, nil
 	}
-	return adp.Find(caller.UserId(), prefPrefix, required, optional, activeOnly)
+	return adp.Find(caller.UserId(), tenant, prefPrefix, required, optional, activeOnly)
 }
 
-// Find returns topics and/or users which match the given tag, with optional partial matching.
-func (usersMapper) FindOne(tag string) (string, error) {
-	return adp.FindOne(tag)
+// Find returns topics and/or users of the tenant which match the given tag, with optional partial matching.
+func (usersMapper) FindOne(tenant, tag string) (string, error) {
+	return adp.FindOne(tenant, tag)
 }
 
 // GetTopics load a list of user's subscriptions with Public+Trusted fields copied to subscription
@@ -475,6 +600,8 @@ func (usersMapper) UpsertCred(cred *types.Credential) (bool, error) {
 
 // ConfirmCred marks credential method as confirmed.
 func (usersMapper) ConfirmCred(id types.Uid, method string) error {
+	// Confirmed credentials are added to user's tags.
+	defer cacheInvalidate(cacheKeyUser(id))
 	return adp.CredConfirm(id, method)
 }
 
@@ -495,6 +622,7 @@ func (usersMapper) GetAllCreds(id types.Uid, method string, validatedOnly bool)
 
 // DelCred deletes user's credentials. If method is "", all credentials are deleted.
 func (usersMapper) DelCred(id types.Uid, method, value string) error {
+	defer cacheInvalidate(cacheKeyUser(id))
 	return adp.CredDel(id, method, value)
 }
 
@@ -503,6 +631,11 @@ func (usersMapper) GetUnreadCount(ids ...types.Uid) (map[types.Uid]int, error) {
 	return adp.UserUnreadCount(ids...)
 }
 
+// GetUnreadByTopic returns user's counts of unread messages and mentions in each topic with unread messages.
+func (usersMapper) GetUnreadByTopic(uid types.Uid) ([]types.TopicUnread, error) {
+	return adp.UserUnreadByTopic(uid)
+}
+
 // GetUnvalidated returns a list of stale user ids which have unvalidated credentials,
 // their auth levels and a comma-separated list of these credential names.
 func (usersMapper) GetUnvalidated(lastUpdatedBefore time.Time, limit int) ([]types.Uid, error) {
@@ -514,6 +647,7 @@ type TopicsPersistenceInterface interface {
 	Create(topic *types.Topic, owner types.Uid, private any) error
 	CreateP2P(initiator, invited *types.Subscription) error
 	Get(topic string) (*types.Topic, error)
+	GetChildren(parent string) ([]types.Topic, error)
 	GetUsers(topic string, opts *types.QueryOpt) ([]types.Subscription, error)
 	GetUsersAny(topic string, opts *types.QueryOpt) ([]types.Subscription, error)
 	GetSubs(topic string, opts *types.QueryOpt) ([]types.Subscription, error)
@@ -522,6 +656,8 @@ type TopicsPersistenceInterface interface {
 	UpdateSubCnt(topic string) error
 	OwnerChange(topic string, newOwner types.Uid) error
 	Delete(topic string, isChan, hard bool) error
+	FindDuplicateP2P() (map[string][]string, error)
+	Merge(dst, src string) error
 }
 
 // topicsMapper is a concrete type implementing TopicsPersistenceInterface.
@@ -537,6 +673,8 @@ func (topicsMapper) Create(topic *types.Topic, owner types.Uid, private any) err
 	topic.TouchedAt = topic.CreatedAt
 	topic.Owner = owner.String()
 
+	// Drop the empty list of subscriptions cached before the topic was created.
+	defer cacheInvalidate(cacheKeySubs(topic.Id))
 	err := adp.TopicCreate(topic)
 	if err != nil {
 		return err
@@ -562,12 +700,27 @@ func (topicsMapper) CreateP2P(initiator, invited *types.Subscription) error {
 	invited.InitTimes()
 	invited.SetTouchedAt(invited.CreatedAt)
 
+	// Subscriptions of a deleted p2p topic may be restored.
+	defer cacheInvalidateTopic(initiator.Topic)
 	return adp.TopicCreateP2P(initiator, invited)
 }
 
 // Get a single topic with a list of relevant users de-normalized into it
 func (topicsMapper) Get(topic string) (*types.Topic, error) {
-	return adp.TopicGet(topic)
+	var stopic types.Topic
+	if cacheGet(cacheKeyTopic(topic), &stopic) {
+		return &stopic, nil
+	}
+	found, err := adp.TopicGet(topic)
+	if err == nil && found != nil {
+		cachePut(cacheKeyTopic(topic), found)
+	}
+	return found, err
+}
+
+// GetChildren loads group topics of the community.
+func (topicsMapper) GetChildren(parent string) ([]types.Topic, error) {
+	return adp.TopicsForParent(parent)
 }
 
 // GetUsers loads subscriptions for topic plus loads user.Public+Trusted.
@@ -585,7 +738,19 @@ func (topicsMapper) GetUsersAny(topic string, opts *types.QueryOpt) ([]types.Sub
 // GetSubs loads a list of subscriptions to the given topic, user.Public+Trusted and deleted
 // subscriptions are not loaded. Suspended subscriptions are loaded.
 func (topicsMapper) GetSubs(topic string, opts *types.QueryOpt) ([]types.Subscription, error) {
-	return adp.SubsForTopic(topic, false, opts)
+	if opts != nil {
+		return adp.SubsForTopic(topic, false, opts)
+	}
+	// Only the complete list of subscriptions is cached.
+	var subs []types.Subscription
+	if cacheGet(cacheKeySubs(topic), &subs) {
+		return subs, nil
+	}
+	subs, err := adp.SubsForTopic(topic, false, nil)
+	if err == nil {
+		cachePut(cacheKeySubs(topic), subs)
+	}
+	return subs, err
 }
 
 // GetSubsAny loads a list of subscriptions to the given topic including deleted subscription.
@@ -596,6 +761,7 @@ func (topicsMapper) GetSubsAny(topic string, opts *types.QueryOpt) ([]types.Subs
 
 // UpdateSubCnt refreshes subscriber count value denormalized in topic.
 func (topicsMapper) UpdateSubCnt(topic string) error {
+	defer cacheInvalidate(cacheKeyTopic(topic))
 	return adp.TopicUpdateSubCnt(topic)
 }
 
@@ -604,17 +770,75 @@ func (topicsMapper) Update(topic string, update map[string]any) error {
 	if _, ok := update["UpdatedAt"]; !ok {
 		update["UpdatedAt"] = types.TimeNow()
 	}
+	defer cacheInvalidate(cacheKeyTopic(topic))
 	return adp.TopicUpdate(topic, update)
 }
 
 // OwnerChange replaces the old topic owner with the new owner.
 func (topicsMapper) OwnerChange(topic string, newOwner types.Uid) error {
+	defer cacheInvalidate(cacheKeyTopic(topic), cacheKeySubs(topic))
 	return adp.TopicOwnerChange(topic, newOwner)
 }
 
 // Delete deletes topic, messages, attachments, and subscriptions.
 func (topicsMapper) Delete(topic string, isChan, hard bool) error {
-	return adp.TopicDelete(topic, isChan, hard)
+	defer cacheInvalidateTopic(topic)
+	if err := adp.TopicDelete(topic, isChan, hard); err != nil {
+		return err
+	}
+	if hard && IsEncryptionEnabled() {
+		// Crypto-shred any remaining content of the topic.
+		if err := ShredTopicKey(topic); err != nil {
+			logs.Warn.Printf("Failed to shred encryption key of topic %s: %v", topic, err)
+		}
+	}
+	return nil
+}
+
+// FindDuplicateP2P finds p2p topics which duplicate the canonically named topic of the same pair of users.
+// Returns a map of canonical topic name to the list of its duplicates. The canonical topic may not exist.
+func (topicsMapper) FindDuplicateP2P() (map[string][]string, error) {
+	names, err := adp.TopicNamesByPrefix("p2p")
+	if err != nil {
+		return nil, err
+	}
+
+	dupes := make(map[string][]string)
+	for _, name := range names {
+		uid1, uid2, err := types.ParseP2P(name)
+		if err != nil {
+			logs.Warn.Println("store: invalid p2p topic name", name, err)
+			continue
+		}
+		if canonical := uid1.P2PName(uid2); canonical != "" && canonical != name {
+			dupes[canonical] = append(dupes[canonical], name)
+		}
+	}
+	return dupes, nil
+}
+
+// Merge moves messages and subscriptions of topic src into topic dst, then deletes src.
+// Messages of both topics are re-sequenced chronologically.
+func (topicsMapper) Merge(dst, src string) error {
+	defer cacheInvalidateTopic(src)
+	defer cacheInvalidateTopic(dst)
+	var rewrite func(content any) (any, bool, error)
+	if IsEncryptionEnabled() {
+		// Content encrypted with the key of src must be encrypted with the key of dst. It's done in the same
+		// transaction as the merge: content is never left encrypted with the key of another topic.
+		rewrite = func(content any) (any, bool, error) {
+			if str, ok := content.(string); !ok || !strings.HasPrefix(str, encPrefixV3) {
+				return content, false, nil
+			}
+			plain, err := DecryptTopicContent(src, content)
+			if err != nil {
+				return nil, false, err
+			}
+			enc, err := EncryptTopicContent(dst, plain)
+			return enc, err == nil, err
+		}
+	}
+	return adp.TopicMerge(dst, src, rewrite)
 }
 
 // SubsPersistenceInterface is an interface which defines methods for persistent storage of subscriptions.
@@ -652,6 +876,7 @@ func (subsMapper) Create(subs ...*types.Subscription) error {
 		}
 	}
 
+	defer cacheInvalidate(cacheKeyTopic(subs[0].Topic), cacheKeySubs(subs[0].Topic))
 	return adp.TopicShare(topic, subs)
 }
 
@@ -663,12 +888,14 @@ func (subsMapper) Get(topic string, user types.Uid, keepDeleted bool) (*types.Su
 // Update values of topic's subscriptions.
 func (subsMapper) Update(topic string, user types.Uid, update map[string]any) error {
 	update["UpdatedAt"] = types.TimeNow()
+	defer cacheInvalidate(cacheKeySubs(topic))
 	return adp.SubsUpdate(topic, user, update)
 }
 
 // Delete deletes a subscription.
 // To delete channel subscription the channel name must be explicitly specified.
 func (subsMapper) Delete(topic string, user types.Uid) error {
+	defer cacheInvalidate(cacheKeyTopic(topic), cacheKeySubs(topic))
 	return adp.SubsDelete(topic, user)
 }
 
@@ -678,10 +905,19 @@ type MessagesPersistenceInterface interface {
 	DeleteList(topic string, delID int, forUser types.Uid, msgDelAge time.Duration, ranges []types.Range) error
 	GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error)
 	GetDeleted(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Range, int, error)
-	AddReaction(topic string, seqId int, oderId string, reaction string) error
 	GetBySeqId(topic string, seqId int) (*types.Message, error)
-	Edit(topic string, seqId int, content any, editedAt time.Time, editCount int) error
+	Edit(topic string, seqId int, content any, editedAt time.Time, editCount int, opaque bool) error
+	GetEdits(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.MessageVersion, error)
 	MarkUnsent(topic string, seqId int, unsentAt time.Time) error
+	ReencryptBatch(afterId int64, limit int) (int64, int, error)
+	Search(forUser types.Uid, query *types.MessageSearchQuery) ([]types.Message, error)
+	GetExpired(now time.Time, limit int) (map[string]int, error)
+	GetOlder(cat string, tenants []string, exclude bool, before time.Time, anonymized bool, limit int) ([]types.RetentionBatch, error)
+	Anonymize(topic string, upto, limit int) (int, error)
+	GetColdTopics(before time.Time, skipCats []string, limit int) ([]string, error)
+	MoveCold(topic string, before time.Time, limit int) (int, error)
+	DeleteOrphanedTiers(limit int) (int, error)
+	GetAllBySender(from types.Uid, afterId int64, limit int) ([]types.Message, int64, error)
 }
 
 // messagesMapper is a concrete type implementing MessagesPersistenceInterface.
@@ -695,10 +931,20 @@ func (messagesMapper) Save(msg *types.Message, attachmentURLs []string, readBySe
 	msg.InitTimes()
 	msg.SetUid(Store.GetUid())
 
+	// Tokens must be computed from plaintext. End-to-end encrypted content is not indexed.
+	var tokens []string
+	if !msg.IsOpaque() {
+		tokens = ContentSearchTokens(msg.Topic, msg.Content)
+	}
+
 	// Encrypt message content if encryption is enabled
 	if IsEncryptionEnabled() && msg.Content != nil {
-		encrypted, err := EncryptContent(msg.Content)
+		encrypted, err := EncryptTopicContent(msg.Topic, msg.Content)
 		if err != nil {
+			if err == ErrEncryptionUnavailable {
+				// Fail closed: never store plaintext while encryption is suspended.
+				return err, false
+			}
 			logs.Warn.Printf("Failed to encrypt message content: %v", err)
 			// Continue without encryption rather than failing
 		} else {
@@ -706,6 +952,18 @@ func (messagesMapper) Save(msg *types.Message, attachmentURLs []string, readBySe
 		}
 	}
 
+	if head, err := EncryptHead(msg.Topic, msg.Head); err != nil {
+		if err == ErrEncryptionUnavailable {
+			return err, false
+		}
+		logs.Warn.Printf("Failed to encrypt message head: %v", err)
+	} else {
+		msg.Head = head
+	}
+
+	// The topic, sender's subscription and the latest messages change.
+	defer cacheInvalidateTopic(msg.Topic)
+
 	// Increment topic's or user's SeqId
 	err := adp.TopicUpdateOnMessage(msg.Topic, msg)
 	if err != nil {
@@ -717,6 +975,12 @@ func (messagesMapper) Save(msg *types.Message, attachmentURLs []string, readBySe
 		return err, false
 	}
 
+	if len(tokens) > 0 {
+		if err := adp.MessageSetSearchTokens(msg.Topic, msg.SeqId, tokens); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to index message (seq: %d): %v", msg.Topic, msg.SeqId, err)
+		}
+	}
+
 	markedReadBySender := false
 	// Mark message as read by the sender.
 	if readBySender {
@@ -767,6 +1031,7 @@ func (messagesMapper) DeleteList(topic string, delID int, forUser types.Uid, msg
 		}
 	}
 
+	defer cacheInvalidateTopic(topic)
 	err := adp.MessageDeleteList(topic, toDel)
 	if err != nil {
 		return err
@@ -788,34 +1053,174 @@ func (messagesMapper) DeleteList(topic string, delID int, forUser types.Uid, msg
 		}
 	}
 
+	if coldStorage != nil && toDel != nil && forUser.IsZero() {
+		// Hard-deleted messages are removed from cold storage too.
+		low, hi := 1<<31-1, 0
+		for _, r := range ranges {
+			low, hi = min(low, r.Low), max(hi, r.Low+1, r.Hi)
+		}
+		newerThan := toDel.GetNewerThan()
+		_, err = purgeCold(topic, low, hi, func(msg *types.Message) bool {
+			return rangesContain(ranges, msg.SeqId) && (newerThan == nil || !msg.CreatedAt.Before(*newerThan))
+		})
+	}
+
 	return err
 }
 
 // GetAll returns multiple messages.
 func (messagesMapper) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Message, error) {
+	if opt != nil && opt.Search != "" {
+		if IsSearchIndexEnabled() {
+			tokens := QuerySearchTokens(topic, opt.Search)
+			if len(tokens) == 0 {
+				// Nothing searchable in the query.
+				return nil, nil
+			}
+			query := *opt
+			query.SearchTokens = tokens
+			opt = &query
+		} else if IsEncryptionEnabled() {
+			// Encrypted content can be searched only with the index.
+			return nil, types.ErrUnsupported
+		}
+	}
+
+	limit, cached := cachedMessagesQuery(opt)
+	var msgs []types.Message
+	if cached && cacheHGet(cacheKeyMessages(topic), cacheFieldMessages(forUser), &msgs) {
+		msgs = msgs[:min(limit, len(msgs))]
+		if err := decryptMessages(msgs); err != nil {
+			return nil, err
+		}
+		return msgs, nil
+	}
+	if cached {
+		// Read all cached messages and return as many as requested.
+		query := types.QueryOpt{Limit: cachedMessages}
+		if opt != nil {
+			query = *opt
+			query.Limit = cachedMessages
+		}
+		opt = &query
+	}
+
 	msgs, err := adp.MessageGetAll(topic, forUser, opt)
 	if err != nil {
 		return nil, err
 	}
 
-	// Decrypt message content if encryption is enabled
-	if IsEncryptionEnabled() {
-		for i := range msgs {
-			if msgs[i].Content != nil {
-				decrypted, err := DecryptContent(msgs[i].Content)
-				if err != nil {
-					logs.Warn.Printf("Failed to decrypt message %d: %v", msgs[i].SeqId, err)
-					// Keep encrypted content rather than failing
-				} else {
-					msgs[i].Content = decrypted
-				}
+	if coldStorage != nil && (opt == nil || opt.Search == "") {
+		// Messages in cold storage are not searchable.
+		if msgs, err = hydrateCold(topic, forUser, opt, msgs); err != nil {
+			return nil, err
+		}
+	}
+
+	if cached {
+		// Messages are cached as stored, before decryption.
+		cacheHPut(cacheKeyMessages(topic), cacheFieldMessages(forUser), msgs)
+		msgs = msgs[:min(limit, len(msgs))]
+	}
+
+	if err = decryptMessages(msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// decryptMessages decrypts content and head of messages in place if encryption is enabled.
+func decryptMessages(msgs []types.Message) error {
+	if !IsEncryptionEnabled() {
+		return nil
+	}
+
+	for i := range msgs {
+		if msgs[i].Content != nil {
+			decrypted, err := DecryptTopicContent(msgs[i].Topic, msgs[i].Content)
+			if err == ErrEncryptionUnavailable {
+				return err
+			}
+			if err != nil {
+				logs.Warn.Printf("Failed to decrypt message %d: %v", msgs[i].SeqId, err)
+				// Keep encrypted content rather than failing
+			} else {
+				msgs[i].Content = decrypted
+			}
+		}
+		if err := DecryptHead(msgs[i].Topic, msgs[i].Head); err != nil {
+			if err == ErrEncryptionUnavailable {
+				return err
 			}
+			logs.Warn.Printf("Failed to decrypt head of message %d: %v", msgs[i].SeqId, err)
+		}
+	}
+	return nil
+}
+
+// Search returns messages in the given topics which contain all words of the query, newest first.
+// Encrypted content is searched using the blind index, if the index is not enabled such search
+// is not supported.
+func (messagesMapper) Search(forUser types.Uid, query *types.MessageSearchQuery) ([]types.Message, error) {
+	if IsSearchIndexEnabled() {
+		q := *query
+		q.Tokens = nil
+		for _, topic := range query.Topics {
+			tokens := QuerySearchTokens(topic, query.Query)
+			q.Tokens = append(q.Tokens, tokens...)
+			q.TokenCount = len(tokens)
 		}
+		if q.TokenCount == 0 {
+			// Nothing searchable in the query.
+			return nil, nil
+		}
+		query = &q
+	} else if IsEncryptionEnabled() {
+		return nil, types.ErrUnsupported
+	}
+
+	msgs, err := adp.MessageSearch(forUser, query)
+	if err != nil {
+		return nil, err
 	}
 
+	if err = decryptMessages(msgs); err != nil {
+		return nil, err
+	}
 	return msgs, nil
 }
 
+// GetExpired returns the largest ID of messages past the time to live of the topic, keyed by topic name.
+func (messagesMapper) GetExpired(now time.Time, limit int) (map[string]int, error) {
+	return adp.MessageGetExpired(now, limit)
+}
+
+// GetOlder returns topics of the retention category with messages created before the given time.
+// Already anonymized messages are skipped unless 'anonymized' is true. Topics are limited to the
+// listed tenants or, if 'exclude' is true, to all other tenants.
+func (messagesMapper) GetOlder(cat string, tenants []string, exclude bool, before time.Time, anonymized bool, limit int) ([]types.RetentionBatch, error) {
+	return adp.MessageGetOlder(cat, tenants, exclude, before, anonymized, limit)
+}
+
+// Anonymize removes the sender from up to 'limit' messages of the topic with IDs up to 'upto' inclusive.
+func (messagesMapper) Anonymize(topic string, upto, limit int) (int, error) {
+	defer cacheInvalidate(cacheKeyMessages(topic))
+	return adp.MessageAnonymize(topic, upto, limit)
+}
+
+// GetAllBySender returns up to 'limit' messages sent by the user in all topics with ID greater than 'afterId',
+// ordered by ID. Returns ID of the last message to continue from.
+func (messagesMapper) GetAllBySender(from types.Uid, afterId int64, limit int) ([]types.Message, int64, error) {
+	msgs, lastId, err := adp.MessageGetAllBySender(from, afterId, limit)
+	if err != nil {
+		return nil, afterId, err
+	}
+	if err = decryptMessages(msgs); err != nil {
+		return nil, afterId, err
+	}
+	return msgs, lastId, nil
+}
+
 // GetDeleted returns the ranges of deleted messages and the largest DelId reported in the list.
 func (messagesMapper) GetDeleted(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Range, int, error) {
 	dmsgs, err := adp.MessageGetDeleted(topic, forUser, opt)
@@ -839,37 +1244,53 @@ func (messagesMapper) GetDeleted(topic string, forUser types.Uid, opt *types.Que
 	return ranges, maxID, nil
 }
 
-// AddReaction adds or removes an emoji reaction to a message.
-// If the user already has this reaction, it is removed (toggle behavior).
-func (messagesMapper) AddReaction(topic string, seqId int, oderId string, reaction string) error {
-	return adp.MessageAddReaction(topic, seqId, oderId, reaction)
-}
-
 // GetBySeqId retrieves a single message by topic and sequence ID.
 func (messagesMapper) GetBySeqId(topic string, seqId int) (*types.Message, error) {
 	msg, err := adp.MessageGetBySeqId(topic, seqId)
+	if err == nil && msg == nil && coldStorage != nil {
+		msg, err = getColdBySeqId(topic, seqId)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// Decrypt message content if encryption is enabled
 	if IsEncryptionEnabled() && msg != nil && msg.Content != nil {
-		decrypted, err := DecryptContent(msg.Content)
+		decrypted, err := DecryptTopicContent(topic, msg.Content)
+		if err == ErrEncryptionUnavailable {
+			return nil, err
+		}
 		if err != nil {
 			logs.Warn.Printf("Failed to decrypt message %d: %v", msg.SeqId, err)
 		} else {
 			msg.Content = decrypted
 		}
 	}
+	if msg != nil {
+		if err := DecryptHead(topic, msg.Head); err != nil {
+			if err == ErrEncryptionUnavailable {
+				return nil, err
+			}
+			logs.Warn.Printf("Failed to decrypt head of message %d: %v", msg.SeqId, err)
+		}
+	}
 
 	return msg, nil
 }
 
-// Edit updates a message's content and marks it as edited.
-func (messagesMapper) Edit(topic string, seqId int, content any, editedAt time.Time, editCount int) error {
+// Edit updates a message's content and marks it as edited. Opaque content is not indexed for search.
+func (messagesMapper) Edit(topic string, seqId int, content any, editedAt time.Time, editCount int, opaque bool) error {
+	var tokens []string
+	if !opaque {
+		tokens = ContentSearchTokens(topic, content)
+	}
+
 	// Encrypt new content if encryption is enabled
 	if IsEncryptionEnabled() && content != nil {
-		encrypted, err := EncryptContent(content)
+		encrypted, err := EncryptTopicContent(topic, content)
+		if err == ErrEncryptionUnavailable {
+			return err
+		}
 		if err != nil {
 			logs.Warn.Printf("Failed to encrypt edited message content: %v", err)
 		} else {
@@ -877,12 +1298,76 @@ func (messagesMapper) Edit(topic string, seqId int, content any, editedAt time.T
 		}
 	}
 
-	return adp.MessageEdit(topic, seqId, content, editedAt, editCount)
+	defer cacheInvalidate(cacheKeyMessages(topic))
+	if err := adp.MessageEdit(topic, seqId, content, editedAt, editCount); err != nil {
+		return err
+	}
+
+	if IsSearchIndexEnabled() {
+		if err := adp.MessageSetSearchTokens(topic, seqId, tokens); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to index edited message (seq: %d): %v", topic, seqId, err)
+		}
+	}
+	return nil
+}
+
+// GetEdits returns previous versions of edited messages, newest first.
+func (messagesMapper) GetEdits(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.MessageVersion, error) {
+	versions, err := adp.MessageGetEdits(topic, forUser, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if IsEncryptionEnabled() {
+		for i := range versions {
+			if versions[i].Content != nil {
+				decrypted, err := DecryptTopicContent(topic, versions[i].Content)
+				if err == ErrEncryptionUnavailable {
+					return nil, err
+				}
+				if err != nil {
+					logs.Warn.Printf("Failed to decrypt version %d of message %d: %v", versions[i].Version,
+						versions[i].SeqId, err)
+				} else {
+					versions[i].Content = decrypted
+				}
+			}
+			if err := DecryptHead(topic, versions[i].Head); err != nil {
+				if err == ErrEncryptionUnavailable {
+					return nil, err
+				}
+				logs.Warn.Printf("Failed to decrypt head of message %d: %v", versions[i].SeqId, err)
+			}
+		}
+	}
+
+	return versions, nil
 }
 
 // MarkUnsent marks a message as unsent (tombstone).
 func (messagesMapper) MarkUnsent(topic string, seqId int, unsentAt time.Time) error {
-	return adp.MessageMarkUnsent(topic, seqId, unsentAt)
+	defer cacheInvalidate(cacheKeyMessages(topic))
+	if err := adp.MessageMarkUnsent(topic, seqId, unsentAt); err != nil {
+		return err
+	}
+
+	if IsSearchIndexEnabled() {
+		// Unsent content must not be found by search.
+		if err := adp.MessageSetSearchTokens(topic, seqId, nil); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to remove unsent message from index (seq: %d): %v", topic, seqId, err)
+		}
+	}
+	return nil
+}
+
+// ReencryptBatch encrypts plaintext content and re-encrypts content encrypted with other than the
+// active key in up to limit messages with ID greater than afterId. Returns ID of the last
+// processed message, 0 when there are no more messages, and the number of rewritten messages.
+func (messagesMapper) ReencryptBatch(afterId int64, limit int) (int64, int, error) {
+	if !IsEncryptionEnabled() {
+		return 0, 0, errors.New("message encryption is not enabled")
+	}
+	return adp.MessageRewriteContent("", afterId, limit, ReencryptContent)
 }
 
 // Registered authentication handlers.
@@ -1022,114 +1507,1590 @@ func (storeObj) GetValidator(name string) validate.Validator {
 	return validators[strings.ToLower(name)]
 }
 
-// DevicePersistenceInterface is an interface which defines methods used for handling device IDs.
-// Mostly used to generate push notifications.
-type DevicePersistenceInterface interface {
-	Update(uid types.Uid, oldDeviceID string, dev *types.DeviceDef) error
-	GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, int, error)
-	Delete(uid types.Uid, deviceID string) error
+// MaxReactionLength is the maximum length of an emoji reaction in bytes. Multi-codepoint emoji
+// can be long.
+const MaxReactionLength = 32
+
+// ReactionsPersistenceInterface is an interface which defines methods for persistent storage of
+// emoji reactions to messages.
+type ReactionsPersistenceInterface interface {
+	Add(topic string, seqId int, user types.Uid, reaction string) (int, bool, error)
+	Delete(topic string, seqId int, user types.Uid, reaction string) (int, bool, error)
+	GetAll(topic string, forUser types.Uid, seqIds []int) ([]types.Reaction, error)
 }
 
-// deviceMapper is a concrete type implementing DevicePersistenceInterface.
-type deviceMapper struct{}
+// reactionsMapper is a concrete type implementing ReactionsPersistenceInterface.
+type reactionsMapper struct{}
 
-// Devices is a singleton instance of DevicePersistenceInterface to map methods to.
-var Devices DevicePersistenceInterface
+// Reactions is a singleton ancor object for exporting ReactionsPersistenceInterface.
+var Reactions ReactionsPersistenceInterface
 
-// Update updates a device record.
-func (deviceMapper) Update(uid types.Uid, oldDeviceID string, dev *types.DeviceDef) error {
-	// If the old device Id is specified and it's different from the new ID, delete the old id
-	if oldDeviceID != "" && (dev == nil || dev.DeviceId != oldDeviceID) {
-		if err := adp.DeviceDelete(uid, oldDeviceID); err != nil {
-			return err
-		}
+// Add adds user's reaction to a message. Each user can react to a message with the same emoji
+// only once. Returns the number of users who reacted with the emoji and false if the user
+// already had the reaction.
+func (reactionsMapper) Add(topic string, seqId int, user types.Uid, reaction string) (int, bool, error) {
+	if reaction == "" || len(reaction) > MaxReactionLength {
+		return 0, false, types.ErrMalformed
+	}
+	added, err := adp.ReactionAdd(topic, seqId, user, reaction)
+	if err != nil {
+		return 0, false, err
 	}
+	count, err := adp.ReactionCount(topic, seqId, reaction)
+	return count, added, err
+}
 
-	// Insert or update the new DeviceId if one is given.
-	if dev != nil && dev.DeviceId != "" {
-		return adp.DeviceUpsert(uid, dev)
+// Delete removes user's reaction to a message. Returns the number of users who still have
+// the reaction and false if the user had no such reaction.
+func (reactionsMapper) Delete(topic string, seqId int, user types.Uid, reaction string) (int, bool, error) {
+	if reaction == "" || len(reaction) > MaxReactionLength {
+		return 0, false, types.ErrMalformed
 	}
-	return nil
+	removed, err := adp.ReactionDelete(topic, seqId, user, reaction)
+	if err != nil {
+		return 0, false, err
+	}
+	count, err := adp.ReactionCount(topic, seqId, reaction)
+	return count, removed, err
 }
 
-// GetAll returns all known device IDs for a given list of user IDs.
-// The second return parameter is the count of found device IDs.
-func (deviceMapper) GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, int, error) {
-	return adp.DeviceGetAll(uid...)
+// GetAll returns reactions to the given messages aggregated by message and emoji, ordered by
+// message ID and the time of the first reaction.
+func (reactionsMapper) GetAll(topic string, forUser types.Uid, seqIds []int) ([]types.Reaction, error) {
+	if len(seqIds) == 0 {
+		return nil, nil
+	}
+	return adp.ReactionGetAll(topic, forUser, seqIds)
 }
 
-// Delete deletes device record for a given user.
-func (deviceMapper) Delete(uid types.Uid, deviceID string) error {
-	return adp.DeviceDelete(uid, deviceID)
+// MaxPollOptions is the maximum number of options in a poll.
+const MaxPollOptions = 12
+
+// PollsPersistenceInterface is an interface which defines methods for persistent storage of
+// polls and votes.
+type PollsPersistenceInterface interface {
+	Create(topic string, poll *types.Poll) error
+	Vote(topic string, seqId int, user types.Uid, options []int) (*types.Poll, error)
+	Close(topic string, seqId int, forUser types.Uid) (*types.Poll, bool, error)
+	Get(topic string, seqId int, forUser types.Uid) (*types.Poll, error)
+	GetAll(topic string, forUser types.Uid, seqIds []int) ([]types.Poll, error)
 }
 
-// Registered media/file handlers.
-var fileHandlers map[string]media.Handler
+// pollsMapper is a concrete type implementing PollsPersistenceInterface.
+type pollsMapper struct{}
 
-// RegisterMediaHandler saves reference to a media handler (file upload-download handler).
-func RegisterMediaHandler(name string, mh media.Handler) {
-	if fileHandlers == nil {
-		fileHandlers = make(map[string]media.Handler)
+// Polls is a singleton ancor object for exporting PollsPersistenceInterface.
+var Polls PollsPersistenceInterface
+
+// Create saves a new poll attached to a message.
+func (pollsMapper) Create(topic string, poll *types.Poll) error {
+	if poll.Options < 2 || poll.Options > MaxPollOptions {
+		return types.ErrMalformed
 	}
+	return adp.PollCreate(topic, poll)
+}
 
-	if mh == nil {
-		panic("RegisterMediaHandler: handler is nil")
+// Vote replaces the votes of the user in the poll. An empty list of options retracts the vote.
+// Returns the poll with the updated tally.
+func (pollsMapper) Vote(topic string, seqId int, user types.Uid, options []int) (*types.Poll, error) {
+	if err := adp.PollVote(topic, seqId, user, options); err != nil {
+		return nil, err
 	}
-	if _, dup := fileHandlers[name]; dup {
-		panic("RegisterMediaHandler: called twice for handler " + name)
+	return Polls.Get(topic, seqId, user)
+}
+
+// Close closes the poll to new votes. Returns the poll with the final tally and false if the poll
+// was already closed.
+func (pollsMapper) Close(topic string, seqId int, forUser types.Uid) (*types.Poll, bool, error) {
+	closed, err := adp.PollClose(topic, seqId)
+	if err != nil {
+		return nil, false, err
 	}
-	fileHandlers[name] = mh
+	poll, err := Polls.Get(topic, seqId, forUser)
+	return poll, closed, err
 }
 
-// GetMediaHandler returns default media handler.
-func (storeObj) GetMediaHandler() media.Handler {
-	return mediaHandler
+// Get returns the poll attached to the message or nil if the message has no poll.
+func (pollsMapper) Get(topic string, seqId int, forUser types.Uid) (*types.Poll, error) {
+	polls, err := adp.PollGetAll(topic, forUser, []int{seqId})
+	if err != nil || len(polls) == 0 {
+		return nil, err
+	}
+	return &polls[0], nil
 }
 
-// UseMediaHandler sets specified media handler as default.
-func (storeObj) UseMediaHandler(name, config string) error {
-	mediaHandler = fileHandlers[name]
-	if mediaHandler == nil {
-		panic("UseMediaHandler: unknown handler '" + name + "'")
+// GetAll returns polls attached to the given messages.
+func (pollsMapper) GetAll(topic string, forUser types.Uid, seqIds []int) ([]types.Poll, error) {
+	if len(seqIds) == 0 {
+		return nil, nil
 	}
-	return mediaHandler.Init(config)
+	return adp.PollGetAll(topic, forUser, seqIds)
 }
 
-// FilePersistenceInterface is an interface wchich defines methods used for file handling (records or uploaded files).
-type FilePersistenceInterface interface {
-	// StartUpload records that the given user initiated a file upload
-	StartUpload(fd *types.FileDef) error
-	// FinishUpload marks started upload as successfully finished.
-	FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error)
-	// Get fetches a file record for a unique file id.
-	Get(fid string) (*types.FileDef, error)
-	// DeleteUnused removes unused attachments.
-	DeleteUnused(olderThan time.Time, limit int) error
-	// LinkAttachments connects earlier uploaded attachments to a message or topic to prevent it
-	// from being garbage collected.
-	LinkAttachments(topic string, msgId types.Uid, attachments []string) error
+// TranslationsPersistenceInterface is an interface which defines methods for persistent storage of
+// cached machine translations of messages.
+type TranslationsPersistenceInterface interface {
+	GetAll(topic, lang string, seqIds []int) ([]types.Translation, error)
+	Save(topic string, translations []types.Translation) error
 }
 
-// fileMapper is concrete type which implements FilePersistenceInterface.
-type fileMapper struct{}
+// translationsMapper is a concrete type implementing TranslationsPersistenceInterface.
+type translationsMapper struct{}
 
-// Files is a sigleton instance of FilePersistenceInterface to be used for handling file uploads.
-var Files FilePersistenceInterface
+// Translations is a singleton ancor object for exporting TranslationsPersistenceInterface.
+var Translations TranslationsPersistenceInterface
 
-// StartUpload records that the given user initiated a file upload
-func (fileMapper) StartUpload(fd *types.FileDef) error {
+// GetAll returns cached translations of the given messages to the language. Translations which
+// cannot be decrypted are skipped.
+func (translationsMapper) GetAll(topic, lang string, seqIds []int) ([]types.Translation, error) {
+	if len(seqIds) == 0 {
+		return nil, nil
+	}
+	translations, err := adp.TranslationGetAll(topic, lang, seqIds)
+	if err != nil || !IsEncryptionEnabled() {
+		return translations, err
+	}
+
+	result := translations[:0]
+	for _, tr := range translations {
+		decrypted, err := DecryptTopicContent(topic, tr.Content)
+		if err == ErrEncryptionUnavailable {
+			return nil, err
+		}
+		if err != nil {
+			logs.Warn.Printf("Failed to decrypt translation of message %d: %v", tr.SeqId, err)
+			continue
+		}
+		tr.Content = decrypted
+		result = append(result, tr)
+	}
+	return result, nil
+}
+
+// Save creates or replaces cached translations of messages.
+func (translationsMapper) Save(topic string, translations []types.Translation) error {
+	if len(translations) == 0 {
+		return nil
+	}
+	if IsEncryptionEnabled() {
+		encrypted := make([]types.Translation, 0, len(translations))
+		for _, tr := range translations {
+			content, err := EncryptTopicContent(topic, tr.Content)
+			if err != nil {
+				// Translations are a cache: better not to store one than to store it in plain text.
+				return err
+			}
+			tr.Content = content
+			encrypted = append(encrypted, tr)
+		}
+		translations = encrypted
+	}
+	return adp.TranslationSave(topic, translations)
+}
+
+// ModerationPersistenceInterface is an interface which defines methods for persistent storage of
+// content moderation decisions.
+type ModerationPersistenceInterface interface {
+	Log(rec *types.ModerationRecord) error
+	GetLog(topic string, limit int) ([]types.ModerationRecord, error)
+}
+
+// moderationMapper is a concrete type implementing ModerationPersistenceInterface.
+type moderationMapper struct{}
+
+// Moderation is a singleton ancor object for exporting ModerationPersistenceInterface.
+var Moderation ModerationPersistenceInterface
+
+// maxModerationReason is the maximum length of the logged reason of a moderation decision in bytes.
+const maxModerationReason = 512
+
+// Log saves the moderation decision.
+func (moderationMapper) Log(rec *types.ModerationRecord) error {
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = types.TimeNow()
+	}
+	if len(rec.Reason) > maxModerationReason {
+		// Drop the multibyte character which may be cut in half.
+		rec.Reason = strings.ToValidUTF8(rec.Reason[:maxModerationReason], "")
+	}
+	return adp.ModerationLogAdd(rec)
+}
+
+// GetLog returns the most recent moderation decisions in the topic or in all topics if topic is blank.
+func (moderationMapper) GetLog(topic string, limit int) ([]types.ModerationRecord, error) {
+	return adp.ModerationLogGetAll(topic, limit)
+}
+
+// TakeoutsPersistenceInterface is an interface which defines methods for persistent storage of
+// exports of users' data.
+type TakeoutsPersistenceInterface interface {
+	Create(tk *types.Takeout) error
+	GetLast(uid types.Uid) (*types.Takeout, error)
+	Finish(tk *types.Takeout) error
+}
+
+// takeoutsMapper is a concrete type implementing TakeoutsPersistenceInterface.
+type takeoutsMapper struct{}
+
+// Takeouts is a singleton ancor object for exporting TakeoutsPersistenceInterface.
+var Takeouts TakeoutsPersistenceInterface
+
+// Create saves a new pending export of user's data.
+func (takeoutsMapper) Create(tk *types.Takeout) error {
+	tk.InitTimes()
+	tk.SetUid(Store.GetUid())
+	tk.Status = types.TakeoutPending
+	return adp.TakeoutCreate(tk)
+}
+
+// GetLast returns the most recent export of user's data or nil if the user has none.
+func (takeoutsMapper) GetLast(uid types.Uid) (*types.Takeout, error) {
+	return adp.TakeoutGetLast(uid)
+}
+
+// Finish saves the final status of the export and, if it's ready, the archive.
+func (takeoutsMapper) Finish(tk *types.Takeout) error {
+	tk.UpdatedAt = types.TimeNow()
+	return adp.TakeoutFinish(tk)
+}
+
+// AuditPersistenceInterface is an interface which defines methods for persistent storage of
+// the audit log of security-relevant events.
+type AuditPersistenceInterface interface {
+	Log(rec *types.AuditRecord) error
+	Query(query *types.AuditQuery) ([]types.AuditRecord, error)
+	Expire(before time.Time) (int, error)
+}
+
+// auditMapper is a concrete type implementing AuditPersistenceInterface.
+type auditMapper struct{}
+
+// Audit is a singleton ancor object for exporting AuditPersistenceInterface.
+var Audit AuditPersistenceInterface
+
+// maxAuditDetails is the maximum length of details of an audit record in bytes.
+const maxAuditDetails = 512
+
+// Log saves the audit record.
+func (auditMapper) Log(rec *types.AuditRecord) error {
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = types.TimeNow()
+	}
+	if len(rec.Details) > maxAuditDetails {
+		// Drop the multibyte character which may be cut in half.
+		rec.Details = strings.ToValidUTF8(rec.Details[:maxAuditDetails], "")
+	}
+	return adp.AuditLogAdd(rec)
+}
+
+// Query returns the most recent audit records matching the query, newest first.
+func (auditMapper) Query(query *types.AuditQuery) ([]types.AuditRecord, error) {
+	return adp.AuditLogGetAll(query)
+}
+
+// Expire deletes audit records older than 'before'. Returns the number of deleted records.
+func (auditMapper) Expire(before time.Time) (int, error) {
+	return adp.AuditLogExpire(before)
+}
+
+// ReportsPersistenceInterface is an interface which defines methods for persistent storage of
+// reports of messages and users.
+type ReportsPersistenceInterface interface {
+	Create(rpt *types.Report) error
+	Get(id types.Uid) (*types.Report, error)
+	Claim(id types.Uid) (bool, error)
+	GetUnposted(limit int) ([]types.Report, error)
+	Resolve(id types.Uid, status, action string, by types.Uid) (bool, error)
+}
+
+// reportsMapper is a concrete type implementing ReportsPersistenceInterface.
+type reportsMapper struct{}
+
+// Reports is a singleton ancor object for exporting ReportsPersistenceInterface.
+var Reports ReportsPersistenceInterface
+
+// Create saves a new open report. Returns types.ErrDuplicate if the same user already has an open report
+// of the same object. The evidence is encrypted with the common key.
+func (reportsMapper) Create(rpt *types.Report) error {
+	rpt.InitTimes()
+	rpt.SetUid(Store.GetUid())
+	rpt.Status = types.ReportOpen
+
+	if !IsEncryptionEnabled() || rpt.Evidence == nil {
+		return adp.ReportCreate(rpt)
+	}
+
+	evidence := rpt.Evidence
+	encrypted, err := EncryptContent(evidence)
+	if err != nil {
+		return err
+	}
+	// The caller gets the report with the evidence unencrypted.
+	rpt.Evidence = encrypted
+	err = adp.ReportCreate(rpt)
+	rpt.Evidence = evidence
+	return err
+}
+
+// decryptReports decrypts evidence of reports in place.
+func decryptReports(reports []types.Report) error {
+	if !IsEncryptionEnabled() {
+		return nil
+	}
+	for i := range reports {
+		if reports[i].Evidence != nil {
+			decrypted, err := DecryptContent(reports[i].Evidence)
+			if err != nil {
+				return err
+			}
+			reports[i].Evidence = decrypted
+		}
+	}
+	return nil
+}
+
+// Get returns the report by ID or nil if not found.
+func (reportsMapper) Get(id types.Uid) (*types.Report, error) {
+	rpt, err := adp.ReportGet(id)
+	if err != nil || rpt == nil {
+		return nil, err
+	}
+	reports := []types.Report{*rpt}
+	if err = decryptReports(reports); err != nil {
+		return nil, err
+	}
+	return &reports[0], nil
+}
+
+// Claim marks the report as posted to the moderators' topic. Returns false if it's already posted.
+func (reportsMapper) Claim(id types.Uid) (bool, error) {
+	return adp.ReportClaim(id)
+}
+
+// GetUnposted returns up to 'limit' open reports which are not posted to the moderators' topic yet.
+func (reportsMapper) GetUnposted(limit int) ([]types.Report, error) {
+	reports, err := adp.ReportGetUnposted(limit)
+	if err != nil {
+		return nil, err
+	}
+	if err = decryptReports(reports); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// Resolve closes an open report with the given status and action taken by the moderator 'by'.
+// Returns false if the report is not open.
+func (reportsMapper) Resolve(id types.Uid, status, action string, by types.Uid) (bool, error) {
+	return adp.ReportResolve(id, status, action, by)
+}
+
+// ThreadsPersistenceInterface is an interface which defines methods for persistent storage of
+// per-user state of threads: read markers and mute flags.
+type ThreadsPersistenceInterface interface {
+	GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Thread, error)
+	SetRead(topic string, user types.Uid, threadId, readSeqId int) error
+	SetMuted(topic string, user types.Uid, threadId int, muted bool) error
+	GetMuted(topic string, threadId int) ([]types.Uid, error)
+}
+
+// threadsMapper is a concrete type implementing ThreadsPersistenceInterface.
+type threadsMapper struct{}
+
+// Threads is a singleton ancor object for exporting ThreadsPersistenceInterface.
+var Threads ThreadsPersistenceInterface
+
+// GetAll returns summaries of threads in the topic with unread counts of the user.
+func (threadsMapper) GetAll(topic string, forUser types.Uid, opt *types.QueryOpt) ([]types.Thread, error) {
+	return adp.ThreadGetAll(topic, forUser, opt)
+}
+
+// SetRead marks replies in the thread up to readSeqId as read by the user. The marker never moves back.
+func (threadsMapper) SetRead(topic string, user types.Uid, threadId, readSeqId int) error {
+	if threadId <= 0 || readSeqId <= threadId {
+		return types.ErrMalformed
+	}
+	return adp.ThreadSetRead(topic, user, threadId, readSeqId)
+}
+
+// SetMuted mutes or unmutes notifications of the thread for the user.
+func (threadsMapper) SetMuted(topic string, user types.Uid, threadId int, muted bool) error {
+	if threadId <= 0 {
+		return types.ErrMalformed
+	}
+	return adp.ThreadSetMuted(topic, user, threadId, muted)
+}
+
+// GetMuted returns users who muted notifications of the thread.
+func (threadsMapper) GetMuted(topic string, threadId int) ([]types.Uid, error) {
+	return adp.ThreadGetMuted(topic, threadId)
+}
+
+// ScheduledPersistenceInterface is an interface which defines methods for persistent storage of
+// messages scheduled for publishing at a later time.
+type ScheduledPersistenceInterface interface {
+	Add(msg *types.ScheduledMessage) error
+	GetDue(before time.Time, limit int) ([]types.ScheduledMessage, error)
+	GetAll(topic string, user types.Uid) ([]types.ScheduledMessage, error)
+	Delete(topic string, user, id types.Uid) (bool, error)
+}
+
+// scheduledMapper is a concrete type implementing ScheduledPersistenceInterface.
+type scheduledMapper struct{}
+
+// Scheduled is a singleton ancor object for exporting ScheduledPersistenceInterface.
+var Scheduled ScheduledPersistenceInterface
+
+// Add saves a message to be published at msg.SendAt. Content is encrypted with the common key rather than
+// the key of the topic because the message may be moved to another topic before it's published.
+func (scheduledMapper) Add(msg *types.ScheduledMessage) error {
+	msg.InitTimes()
+	msg.SetUid(Store.GetUid())
+
+	if IsEncryptionEnabled() && msg.Content != nil {
+		encrypted, err := EncryptContent(msg.Content)
+		if err != nil {
+			// Unlike published messages, scheduled messages are never stored unencrypted.
+			return err
+		}
+		msg.Content = encrypted
+	}
+
+	head, err := EncryptHead("", msg.Head)
+	if err != nil {
+		return err
+	}
+	msg.Head = head
+
+	var fids []string
+	for _, url := range msg.Attachments {
+		if fid := mediaHandler.GetIdFromUrl(url); !fid.IsZero() {
+			fids = append(fids, fid.String())
+		}
+	}
+
+	return adp.ScheduledAdd(msg, fids)
+}
+
+// decryptScheduled decrypts content and head of scheduled messages in place.
+func decryptScheduled(msgs []types.ScheduledMessage) error {
+	if !IsEncryptionEnabled() {
+		return nil
+	}
+
+	for i := range msgs {
+		if msgs[i].Content != nil {
+			decrypted, err := DecryptContent(msgs[i].Content)
+			if err != nil {
+				return err
+			}
+			msgs[i].Content = decrypted
+		}
+		if err := DecryptHead("", msgs[i].Head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDue returns up to 'limit' messages due for publishing at or before the given time.
+func (scheduledMapper) GetDue(before time.Time, limit int) ([]types.ScheduledMessage, error) {
+	msgs, err := adp.ScheduledGetDue(before, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err = decryptScheduled(msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// GetAll returns messages of the user waiting to be published in the topic.
+func (scheduledMapper) GetAll(topic string, user types.Uid) ([]types.ScheduledMessage, error) {
+	msgs, err := adp.ScheduledGetAll(topic, user)
+	if err != nil {
+		return nil, err
+	}
+	if err = decryptScheduled(msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// Delete cancels a scheduled message. If the user is zero, the message is deleted regardless of the sender.
+// Returns false if the message does not exist (anymore).
+func (scheduledMapper) Delete(topic string, user, id types.Uid) (bool, error) {
+	if id.IsZero() {
+		return false, types.ErrMalformed
+	}
+	return adp.ScheduledDelete(topic, user, id)
+}
+
+// SessionPersistenceInterface is an interface which defines methods for persistent records of
+// sessions where users logged in.
+type SessionPersistenceInterface interface {
+	Upsert(sess *types.SessionRecord) error
+	Touch(id string, lastSeen time.Time) error
+	GetAll(user types.Uid) ([]types.SessionRecord, error)
+	Delete(user types.Uid, id string) (bool, error)
+}
+
+// sessionsMapper is a concrete type implementing SessionPersistenceInterface.
+type sessionsMapper struct{}
+
+// Sessions is a singleton ancor object for exporting SessionPersistenceInterface.
+var Sessions SessionPersistenceInterface
+
+// Upsert creates or replaces a record of the session.
+func (sessionsMapper) Upsert(sess *types.SessionRecord) error {
+	if sess.Id == "" || sess.User == "" {
+		return types.ErrMalformed
+	}
+	return adp.SessionUpsert(sess)
+}
+
+// Touch updates the time when the session was last active.
+func (sessionsMapper) Touch(id string, lastSeen time.Time) error {
+	return adp.SessionTouch(id, lastSeen)
+}
+
+// GetAll returns records of the user's sessions, the most recently active first.
+func (sessionsMapper) GetAll(user types.Uid) ([]types.SessionRecord, error) {
+	return adp.SessionGetAll(user)
+}
+
+// Delete deletes a record of the user's session. Returns false if the record does not exist.
+func (sessionsMapper) Delete(user types.Uid, id string) (bool, error) {
+	return adp.SessionDelete(user, id)
+}
+
+// CallPersistenceInterface is an interface which defines methods for records of video calls.
+type CallPersistenceInterface interface {
+	Create(call *types.CallRecord) error
+	End(call *types.CallRecord) error
+	Get(topic string, seqId int) (*types.CallRecord, error)
+	GetAll(topics []string, before *time.Time, limit int) ([]types.CallRecord, error)
+}
+
+// callsMapper is a concrete type implementing CallPersistenceInterface.
+type callsMapper struct{}
+
+// Calls is a singleton ancor object for exporting CallPersistenceInterface.
+var Calls CallPersistenceInterface
+
+// Create creates a record of a call.
+func (callsMapper) Create(call *types.CallRecord) error {
+	if call.Topic == "" || call.SeqId <= 0 {
+		return types.ErrMalformed
+	}
+	if call.CreatedAt.IsZero() {
+		call.CreatedAt = types.TimeNow()
+	}
+	return adp.CallCreate(call)
+}
+
+// End saves the final state of the call.
+func (callsMapper) End(call *types.CallRecord) error {
+	if call.EndedAt == nil {
+		now := types.TimeNow()
+		call.EndedAt = &now
+	}
+	return adp.CallEnd(call)
+}
+
+// Get returns the record of the call.
+func (callsMapper) Get(topic string, seqId int) (*types.CallRecord, error) {
+	return adp.CallGet(topic, seqId)
+}
+
+// GetAll returns records of calls in the given topics, the most recent first.
+func (callsMapper) GetAll(topics []string, before *time.Time, limit int) ([]types.CallRecord, error) {
+	return adp.CallGetAll(topics, before, limit)
+}
+
+// KeysPersistenceInterface is an interface which defines methods for public keys of devices and
+// sender key distribution messages used by end-to-end encryption.
+type KeysPersistenceInterface interface {
+	UpsertBundle(kb *types.KeyBundle, maxOneTime int) error
+	GetBundles(user types.Uid, consume bool) ([]types.KeyBundle, error)
+	DeleteBundle(user types.Uid, deviceId string) (bool, error)
+	AddSenderKeys(keys []types.SenderKey) error
+	PopSenderKeys(topic string, user types.Uid, deviceId string) ([]types.SenderKey, error)
+}
+
+// keysMapper is a concrete type implementing KeysPersistenceInterface.
+type keysMapper struct{}
+
+// Keys is a singleton ancor object for exporting KeysPersistenceInterface.
+var Keys KeysPersistenceInterface
+
+// UpsertBundle creates or replaces the public keys of the user's device. New one-time prekeys are added
+// to those already stored, keeping at most maxOneTime most recent keys.
+func (keysMapper) UpsertBundle(kb *types.KeyBundle, maxOneTime int) error {
+	if kb.User == "" || kb.DeviceId == "" || len(kb.IdentityKey) == 0 || len(kb.SignedPreKey) == 0 {
+		return types.ErrMalformed
+	}
+	kb.UpdatedAt = types.TimeNow()
+	return adp.KeyBundleUpsert(kb, maxOneTime)
+}
+
+// GetBundles returns key bundles of the user's devices. If consume is true, each bundle contains
+// at most one one-time prekey which is removed from the store.
+func (keysMapper) GetBundles(user types.Uid, consume bool) ([]types.KeyBundle, error) {
+	return adp.KeyBundleGetAll(user, consume)
+}
+
+// DeleteBundle deletes the key bundle of the user's device or of all devices if deviceId is empty.
+// Returns false if there was nothing to delete.
+func (keysMapper) DeleteBundle(user types.Uid, deviceId string) (bool, error) {
+	return adp.KeyBundleDelete(user, deviceId)
+}
+
+// AddSenderKeys saves sender key distribution messages until the recipients fetch them.
+func (keysMapper) AddSenderKeys(keys []types.SenderKey) error {
+	now := types.TimeNow()
+	for i := range keys {
+		if keys[i].Topic == "" || keys[i].User == "" || keys[i].DeviceId == "" || keys[i].From == "" {
+			return types.ErrMalformed
+		}
+		keys[i].CreatedAt = now
+	}
+	return adp.SenderKeyAdd(keys)
+}
+
+// PopSenderKeys returns and deletes sender key distribution messages for the user's device in the topic,
+// the earliest first.
+func (keysMapper) PopSenderKeys(topic string, user types.Uid, deviceId string) ([]types.SenderKey, error) {
+	return adp.SenderKeyPopAll(topic, user, deviceId)
+}
+
+// UserDevicePersistenceInterface is an interface which defines methods for devices registered by users.
+type UserDevicePersistenceInterface interface {
+	Register(dev *types.UserDevice) error
+	Update(user types.Uid, id string, update map[string]any) (bool, error)
+	GetAll(user types.Uid) ([]types.UserDevice, error)
+	Delete(user types.Uid, id string) (bool, error)
+}
+
+// userDevicesMapper is a concrete type implementing UserDevicePersistenceInterface.
+type userDevicesMapper struct{}
+
+// UserDevices is a singleton ancor object for exporting UserDevicePersistenceInterface.
+var UserDevices UserDevicePersistenceInterface
+
+// Register creates a record of the user's device or updates the existing one. The name of the device
+// and its public key are not changed if they are not provided.
+func (userDevicesMapper) Register(dev *types.UserDevice) error {
+	if dev.User == "" || dev.Id == "" {
+		return types.ErrMalformed
+	}
+	dev.CreatedAt = types.TimeNow()
+	dev.LastSeen = dev.CreatedAt
+	return adp.UserDeviceUpsert(dev)
+}
+
+// Update updates the record of the user's device. Returns false if the device is not found.
+func (userDevicesMapper) Update(user types.Uid, id string, update map[string]any) (bool, error) {
+	return adp.UserDeviceUpdate(user, id, update)
+}
+
+// GetAll returns records of the user's devices together with the state of delivery of encryption keys.
+func (userDevicesMapper) GetAll(user types.Uid) ([]types.UserDevice, error) {
+	return adp.UserDeviceGetAll(user)
+}
+
+// Delete deletes the record of the user's device and its encryption keys. Returns false if the device
+// is not found.
+func (userDevicesMapper) Delete(user types.Uid, id string) (bool, error) {
+	return adp.UserDeviceDelete(user, id)
+}
+
+// SmsPersistenceInterface is an interface which defines methods for persistent storage of
+// SMS notifications and their delivery statuses.
+type SmsPersistenceInterface interface {
+	Create(msg *types.SmsMessage) error
+	Update(id, providerId, status, errText string) (bool, error)
+	Count(user types.Uid, since time.Time) (int, error)
+	GetAll(user types.Uid, limit int) ([]types.SmsMessage, error)
+}
+
+// smsMapper is a concrete type implementing SmsPersistenceInterface.
+type smsMapper struct{}
+
+// SmsMessages is a singleton ancor object for exporting SmsPersistenceInterface.
+var SmsMessages SmsPersistenceInterface
+
+// Create assigns an ID to the SMS notification and saves it.
+func (smsMapper) Create(msg *types.SmsMessage) error {
+	msg.SetUid(Store.GetUid())
+	msg.InitTimes()
+	return adp.SmsCreate(msg)
+}
+
+// Update changes the provider ID and the status of the SMS notification. Empty provider ID is not changed.
+// Returns false if the notification does not exist.
+func (smsMapper) Update(id, providerId, status, errText string) (bool, error) {
+	return adp.SmsUpdate(id, providerId, status, errText, types.TimeNow())
+}
+
+// Count returns the number of SMS notifications sent to the user since the given time. Notifications
+// sent to all users are counted if the user is zero.
+func (smsMapper) Count(user types.Uid, since time.Time) (int, error) {
+	return adp.SmsCount(user, since)
+}
+
+// GetAll returns the most recent SMS notifications sent to the user, newest first.
+func (smsMapper) GetAll(user types.Uid, limit int) ([]types.SmsMessage, error) {
+	return adp.SmsGetAll(user, limit)
+}
+
+// NotifySettingsPersistenceInterface is an interface which defines methods for users' settings of push notifications.
+type NotifySettingsPersistenceInterface interface {
+	Get(users ...types.Uid) (map[types.Uid]*types.NotifySettings, error)
+	Update(settings *types.NotifySettings) error
+	GetForTopic(topic string) (map[types.Uid]*types.TopicNotifySettings, error)
+	UpdateForTopic(settings *types.TopicNotifySettings) error
+}
+
+// notifySettingsMapper is a concrete type implementing NotifySettingsPersistenceInterface.
+type notifySettingsMapper struct{}
+
+// NotifySettings is a singleton ancor object for exporting NotifySettingsPersistenceInterface.
+var NotifySettings NotifySettingsPersistenceInterface
+
+// Get returns notification settings of the given users. Users who have not changed the defaults are
+// not included.
+func (notifySettingsMapper) Get(users ...types.Uid) (map[types.Uid]*types.NotifySettings, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	list, err := adp.NotifySettingsGet(users)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.Uid]*types.NotifySettings, len(list))
+	for i := range list {
+		result[types.ParseUid(list[i].User)] = &list[i]
+	}
+	return result, nil
+}
+
+// Update replaces notification settings of the user.
+func (notifySettingsMapper) Update(settings *types.NotifySettings) error {
+	if settings.User == "" {
+		return types.ErrMalformed
+	}
+	settings.UpdatedAt = types.TimeNow()
+	return adp.NotifySettingsUpsert(settings)
+}
+
+// GetForTopic returns settings of notifications from the topic of its subscribers. Subscribers who have
+// not changed the defaults are not included.
+func (notifySettingsMapper) GetForTopic(topic string) (map[types.Uid]*types.TopicNotifySettings, error) {
+	list, err := adp.TopicNotifyGet(topic)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.Uid]*types.TopicNotifySettings, len(list))
+	for i := range list {
+		result[types.ParseUid(list[i].User)] = &list[i]
+	}
+	return result, nil
+}
+
+// UpdateForTopic creates or replaces settings of notifications from a topic of one user.
+func (notifySettingsMapper) UpdateForTopic(settings *types.TopicNotifySettings) error {
+	if settings.Topic == "" || settings.User == "" {
+		return types.ErrMalformed
+	}
+	settings.UpdatedAt = types.TimeNow()
+	return adp.TopicNotifyUpsert(settings)
+}
+
+// PresenceSettingsPersistenceInterface is an interface which defines methods for users' settings of
+// presence privacy.
+type PresenceSettingsPersistenceInterface interface {
+	Get(users ...types.Uid) (map[types.Uid]*types.PresenceSettings, error)
+	Update(settings *types.PresenceSettings) error
+	GetForTopic(topic string) (map[types.Uid]*types.TopicPresenceSettings, error)
+	GetForUser(user types.Uid) (map[string]*types.TopicPresenceSettings, error)
+	UpdateForTopic(settings *types.TopicPresenceSettings) error
+}
+
+// presenceSettingsMapper is a concrete type implementing PresenceSettingsPersistenceInterface.
+type presenceSettingsMapper struct{}
+
+// PresenceSettings is a singleton ancor object for exporting PresenceSettingsPersistenceInterface.
+var PresenceSettings PresenceSettingsPersistenceInterface
+
+// Get returns presence settings of the given users. Users who have not changed the defaults are not included.
+func (presenceSettingsMapper) Get(users ...types.Uid) (map[types.Uid]*types.PresenceSettings, error) {
+	if len(users) == 0 {
+		return nil, nil
+	}
+	list, err := adp.PresenceSettingsGet(users)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.Uid]*types.PresenceSettings, len(list))
+	for i := range list {
+		result[types.ParseUid(list[i].User)] = &list[i]
+	}
+	return result, nil
+}
+
+// Update replaces presence settings of the user.
+func (presenceSettingsMapper) Update(settings *types.PresenceSettings) error {
+	if settings.User == "" {
+		return types.ErrMalformed
+	}
+	settings.UpdatedAt = types.TimeNow()
+	return adp.PresenceSettingsUpsert(settings)
+}
+
+// GetForTopic returns overrides of sharing presence in the topic of its subscribers.
+func (presenceSettingsMapper) GetForTopic(topic string) (map[types.Uid]*types.TopicPresenceSettings, error) {
+	list, err := adp.TopicPresenceGet(topic, types.ZeroUid)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[types.Uid]*types.TopicPresenceSettings, len(list))
+	for i := range list {
+		result[types.ParseUid(list[i].User)] = &list[i]
+	}
+	return result, nil
+}
+
+// GetForUser returns overrides of sharing presence of the user indexed by topic name.
+func (presenceSettingsMapper) GetForUser(user types.Uid) (map[string]*types.TopicPresenceSettings, error) {
+	list, err := adp.TopicPresenceGet("", user)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*types.TopicPresenceSettings, len(list))
+	for i := range list {
+		result[list[i].Topic] = &list[i]
+	}
+	return result, nil
+}
+
+// UpdateForTopic creates or replaces the override of sharing presence in a topic of one user.
+func (presenceSettingsMapper) UpdateForTopic(settings *types.TopicPresenceSettings) error {
+	if settings.Topic == "" || settings.User == "" {
+		return types.ErrMalformed
+	}
+	settings.UpdatedAt = types.TimeNow()
+	return adp.TopicPresenceUpsert(settings)
+}
+
+// MentionsPersistenceInterface is an interface which defines methods for the index of messages which
+// mention users or contain their keywords.
+type MentionsPersistenceInterface interface {
+	Add(mentions []types.Mention) error
+	GetAll(forUser types.Uid, topics []string, before *time.Time, limit int) ([]types.Mention, error)
+	Count(forUser types.Uid, topic string, since int) (int, error)
+}
+
+// mentionsMapper is a concrete type implementing MentionsPersistenceInterface.
+type mentionsMapper struct{}
+
+// Mentions is a singleton ancor object for exporting MentionsPersistenceInterface.
+var Mentions MentionsPersistenceInterface
+
+// Add adds messages to the index of mentions.
+func (mentionsMapper) Add(mentions []types.Mention) error {
+	return adp.MentionAdd(mentions)
+}
+
+// GetAll returns mentions of the user in the given topics sent before the given time, the most recent first.
+func (mentionsMapper) GetAll(forUser types.Uid, topics []string, before *time.Time, limit int) ([]types.Mention, error) {
+	return adp.MentionGetAll(forUser, topics, before, limit)
+}
+
+// Count returns the number of mentions of the user in the topic in messages with IDs greater than since.
+func (mentionsMapper) Count(forUser types.Uid, topic string, since int) (int, error) {
+	return adp.MentionCount(forUser, topic, since)
+}
+
+// DraftsPersistenceInterface is an interface which defines methods for persistent storage of
+// message drafts of users.
+type DraftsPersistenceInterface interface {
+	Update(draft *types.Draft) (bool, error)
+	GetAll(user types.Uid, since *time.Time) ([]types.Draft, error)
+}
+
+// draftsMapper is a concrete type implementing DraftsPersistenceInterface.
+type draftsMapper struct{}
+
+// Drafts is a singleton ancor object for exporting DraftsPersistenceInterface.
+var Drafts DraftsPersistenceInterface
+
+// Update saves the draft unless a draft with the same or a later timestamp is already stored.
+// Returns false if the draft was not saved. Content is encrypted with the key of the topic.
+func (draftsMapper) Update(draft *types.Draft) (bool, error) {
+	if IsEncryptionEnabled() && draft.Content != nil {
+		encrypted, err := EncryptTopicContent(draft.Topic, draft.Content)
+		if err != nil {
+			// Drafts are never stored unencrypted.
+			return false, err
+		}
+		stored := *draft
+		stored.Content = encrypted
+		draft = &stored
+	}
+	return adp.DraftUpsert(draft)
+}
+
+// GetAll returns drafts of the user updated after the given time including deleted ones, or all
+// drafts which are not deleted if the time is nil. Drafts which cannot be decrypted are skipped.
+func (draftsMapper) GetAll(user types.Uid, since *time.Time) ([]types.Draft, error) {
+	drafts, err := adp.DraftGetAll(user, since)
+	if err != nil || !IsEncryptionEnabled() {
+		return drafts, err
+	}
+
+	result := drafts[:0]
+	for _, d := range drafts {
+		if d.Content != nil {
+			decrypted, err := DecryptTopicContent(d.Topic, d.Content)
+			if err == ErrEncryptionUnavailable {
+				return nil, err
+			}
+			if err != nil {
+				logs.Warn.Printf("Failed to decrypt draft in topic %s: %v", d.Topic, err)
+				continue
+			}
+			d.Content = decrypted
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// StarredPersistenceInterface is an interface which defines methods for persistent storage of
+// copies of messages starred by users.
+type StarredPersistenceInterface interface {
+	Add(msg *types.StarredMessage) (bool, error)
+	Delete(user types.Uid, topic string, seqId int) (bool, error)
+	GetAll(user types.Uid, topic string, before *time.Time, limit int) ([]types.StarredMessage, error)
+}
+
+// starredMapper is a concrete type implementing StarredPersistenceInterface.
+type starredMapper struct{}
+
+// Starred is a singleton ancor object for exporting StarredPersistenceInterface.
+var Starred StarredPersistenceInterface
+
+// Add saves a copy of the message starred by the user. Returns false if the message is already
+// starred. Content and header are encrypted like those of messages.
+func (starredMapper) Add(msg *types.StarredMessage) (bool, error) {
+	if msg.User == "" || msg.Topic == "" || msg.SeqId <= 0 {
+		return false, types.ErrMalformed
+	}
+	msg.CreatedAt = types.TimeNow()
+
+	stored := *msg
+	if IsEncryptionEnabled() && msg.Content != nil {
+		encrypted, err := EncryptTopicContent(msg.Topic, msg.Content)
+		if err != nil {
+			return false, err
+		}
+		stored.Content = encrypted
+	}
+	head, err := EncryptHead(msg.Topic, msg.Head)
+	if err != nil {
+		return false, err
+	}
+	stored.Head = head
+	return adp.StarredAdd(&stored)
+}
+
+// Delete deletes the starred message of the user. Returns false if the message was not starred.
+func (starredMapper) Delete(user types.Uid, topic string, seqId int) (bool, error) {
+	return adp.StarredDelete(user, topic, seqId)
+}
+
+// GetAll returns messages starred by the user before the given time, optionally in one topic only,
+// the most recently starred first.
+func (starredMapper) GetAll(user types.Uid, topic string, before *time.Time, limit int) ([]types.StarredMessage, error) {
+	starred, err := adp.StarredGetAll(user, topic, before, limit)
+	if err != nil || !IsEncryptionEnabled() {
+		return starred, err
+	}
+
+	for i := range starred {
+		sm := &starred[i]
+		if sm.Content != nil {
+			decrypted, err := DecryptTopicContent(sm.Topic, sm.Content)
+			if err == ErrEncryptionUnavailable {
+				return nil, err
+			}
+			if err != nil {
+				logs.Warn.Printf("Failed to decrypt starred message %s:%d: %v", sm.Topic, sm.SeqId, err)
+			} else {
+				sm.Content = decrypted
+			}
+		}
+		if err := DecryptHead(sm.Topic, sm.Head); err != nil {
+			if err == ErrEncryptionUnavailable {
+				return nil, err
+			}
+			logs.Warn.Printf("Failed to decrypt head of starred message %s:%d: %v", sm.Topic, sm.SeqId, err)
+		}
+	}
+	return starred, nil
+}
+
+// BlocksPersistenceInterface is an interface which defines methods for persistent storage of
+// users blocked by other users.
+type BlocksPersistenceInterface interface {
+	Add(user, target types.Uid) (bool, error)
+	Delete(user, target types.Uid) (bool, error)
+	GetAll(user types.Uid) ([]types.Block, error)
+	GetBetween(users []types.Uid) ([]types.Block, error)
+}
+
+// blocksMapper is a concrete type implementing BlocksPersistenceInterface.
+type blocksMapper struct{}
+
+// Blocks is a singleton ancor object for exporting BlocksPersistenceInterface.
+var Blocks BlocksPersistenceInterface
+
+// Add blocks the target user on behalf of the user. Returns false if the target is already blocked.
+func (blocksMapper) Add(user, target types.Uid) (bool, error) {
+	if user.IsZero() || target.IsZero() || user == target {
+		return false, types.ErrMalformed
+	}
+	return adp.BlocksAdd(&types.Block{User: user.String(), Target: target.String(), CreatedAt: types.TimeNow()})
+}
+
+// Delete unblocks the target user. Returns false if the target was not blocked.
+func (blocksMapper) Delete(user, target types.Uid) (bool, error) {
+	return adp.BlocksDelete(user, target)
+}
+
+// GetAll returns blocks made by the user and blocks of the user by others, the most recent first.
+func (blocksMapper) GetAll(user types.Uid) ([]types.Block, error) {
+	return adp.BlocksGetAll(user)
+}
+
+// GetBetween returns blocks where both the blocker and the blocked user are among the given users.
+func (blocksMapper) GetBetween(users []types.Uid) ([]types.Block, error) {
+	return adp.BlocksGetBetween(users)
+}
+
+// InvitesPersistenceInterface is an interface which defines methods for persistent storage of
+// links to join group topics.
+type InvitesPersistenceInterface interface {
+	Create(invite *types.Invite) error
+	GetAll(topic string) ([]types.Invite, error)
+	Use(topic, token string) (*types.Invite, error)
+	Delete(topic, token string) (bool, error)
+}
+
+// invitesMapper is a concrete type implementing InvitesPersistenceInterface.
+type invitesMapper struct{}
+
+// Invites is a singleton ancor object for exporting InvitesPersistenceInterface.
+var Invites InvitesPersistenceInterface
+
+// Create generates a random token of the invite link and saves the link.
+func (invitesMapper) Create(invite *types.Invite) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	invite.Token = base64.RawURLEncoding.EncodeToString(token)
+	invite.CreatedAt = types.TimeNow()
+	return adp.InvitesCreate(invite)
+}
+
+// GetAll returns invite links to the topic, the most recent first.
+func (invitesMapper) GetAll(topic string) ([]types.Invite, error) {
+	return adp.InvitesGetAll(topic)
+}
+
+// Use counts a use of the invite link to the topic. Returns nil if the link cannot be used.
+func (invitesMapper) Use(topic, token string) (*types.Invite, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return adp.InvitesUse(topic, token, types.TimeNow())
+}
+
+// Delete revokes the invite link. Returns false if the link does not exist.
+func (invitesMapper) Delete(topic, token string) (bool, error) {
+	return adp.InvitesDelete(topic, token)
+}
+
+// DirectoryPersistenceInterface is an interface which defines methods for persistent storage of
+// the public directory of group topics.
+type DirectoryPersistenceInterface interface {
+	Publish(entry *types.DirectoryEntry) error
+	Unpublish(topic string) (bool, error)
+	List(tenant, category string, offset, limit int) ([]types.DirectoryEntry, error)
+}
+
+// directoryMapper is a concrete type implementing DirectoryPersistenceInterface.
+type directoryMapper struct{}
+
+// Directory is a singleton ancor object for exporting DirectoryPersistenceInterface.
+var Directory DirectoryPersistenceInterface
+
+// Publish lists the topic in the directory or updates its entry.
+func (directoryMapper) Publish(entry *types.DirectoryEntry) error {
+	now := types.TimeNow()
+	entry.CreatedAt = now
+	entry.UpdatedAt = now
+	return adp.DirectoryUpsert(entry)
+}
+
+// Unpublish removes the topic from the directory. Returns false if the topic is not listed.
+func (directoryMapper) Unpublish(topic string) (bool, error) {
+	return adp.DirectoryDelete(topic)
+}
+
+// List returns listed topics of the tenant in the category or in all categories, the most popular first.
+func (directoryMapper) List(tenant, category string, offset, limit int) ([]types.DirectoryEntry, error) {
+	return adp.DirectoryList(tenant, category, types.TimeNow(), offset, limit)
+}
+
+// WebhooksPersistenceInterface is an interface which defines methods for persistent storage of
+// outgoing webhooks.
+type WebhooksPersistenceInterface interface {
+	Create(hook *types.Webhook) error
+	GetAll(topic string) ([]types.Webhook, error)
+	Delete(id string) (bool, error)
+}
+
+// webhooksMapper is a concrete type implementing WebhooksPersistenceInterface.
+type webhooksMapper struct{}
+
+// Webhooks is a singleton ancor object for exporting WebhooksPersistenceInterface.
+var Webhooks WebhooksPersistenceInterface
+
+// Create generates a random ID of the webhook and saves it.
+func (webhooksMapper) Create(hook *types.Webhook) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	hook.Id = base64.RawURLEncoding.EncodeToString(id)
+	hook.CreatedAt = types.TimeNow()
+	return adp.WebhooksCreate(hook)
+}
+
+// GetAll returns webhooks of the topic or server-wide webhooks if the topic is empty.
+func (webhooksMapper) GetAll(topic string) ([]types.Webhook, error) {
+	return adp.WebhooksGetAll(topic)
+}
+
+// Delete deletes the webhook. Returns false if the webhook does not exist.
+func (webhooksMapper) Delete(id string) (bool, error) {
+	return adp.WebhooksDelete(id)
+}
+
+// InWebhooksPersistenceInterface is an interface which defines methods for persistent storage of
+// incoming webhooks.
+type InWebhooksPersistenceInterface interface {
+	Create(hook *types.IncomingWebhook) error
+	Get(token string) (*types.IncomingWebhook, error)
+	GetAll(topic string) ([]types.IncomingWebhook, error)
+	Delete(token string) (bool, error)
+}
+
+// inWebhooksMapper is a concrete type implementing InWebhooksPersistenceInterface.
+type inWebhooksMapper struct{}
+
+// InWebhooks is a singleton ancor object for exporting InWebhooksPersistenceInterface.
+var InWebhooks InWebhooksPersistenceInterface
+
+// Create generates a random token of the webhook and saves it.
+func (inWebhooksMapper) Create(hook *types.IncomingWebhook) error {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	hook.Token = base64.RawURLEncoding.EncodeToString(token)
+	hook.CreatedAt = types.TimeNow()
+	return adp.InWebhooksCreate(hook)
+}
+
+// Get returns the webhook with the token or nil if not found.
+func (inWebhooksMapper) Get(token string) (*types.IncomingWebhook, error) {
+	return adp.InWebhooksGet(token)
+}
+
+// GetAll returns incoming webhooks of the topic.
+func (inWebhooksMapper) GetAll(topic string) ([]types.IncomingWebhook, error) {
+	return adp.InWebhooksGetAll(topic)
+}
+
+// Delete deletes the webhook. Returns false if the webhook does not exist.
+func (inWebhooksMapper) Delete(token string) (bool, error) {
+	return adp.InWebhooksDelete(token)
+}
+
+// MatrixRoomsPersistenceInterface is an interface which defines methods for persistent storage of
+// links between topics and Matrix rooms.
+type MatrixRoomsPersistenceInterface interface {
+	Link(topic, room string) error
+	Get(topic string) (*types.MatrixRoom, error)
+	GetByRoom(room string) (*types.MatrixRoom, error)
+	Unlink(topic string) (bool, error)
+}
+
+// matrixRoomsMapper is a concrete type implementing MatrixRoomsPersistenceInterface.
+type matrixRoomsMapper struct{}
+
+// MatrixRooms is a singleton ancor object for exporting MatrixRoomsPersistenceInterface.
+var MatrixRooms MatrixRoomsPersistenceInterface
+
+// Link bridges the topic to the room replacing the previous room of the topic.
+func (matrixRoomsMapper) Link(topic, room string) error {
+	return adp.MatrixRoomsLink(&types.MatrixRoom{Topic: topic, Room: room, CreatedAt: types.TimeNow()})
+}
+
+// Get returns the room bridged to the topic or nil if the topic is not bridged.
+func (matrixRoomsMapper) Get(topic string) (*types.MatrixRoom, error) {
+	return adp.MatrixRoomsGet(topic, "")
+}
+
+// GetByRoom returns the link of the room or nil if the room is not bridged.
+func (matrixRoomsMapper) GetByRoom(room string) (*types.MatrixRoom, error) {
+	return adp.MatrixRoomsGet("", room)
+}
+
+// Unlink removes the bridge of the topic. Returns false if the topic is not bridged.
+func (matrixRoomsMapper) Unlink(topic string) (bool, error) {
+	return adp.MatrixRoomsUnlink(topic)
+}
+
+// MailboxesPersistenceInterface is an interface which defines methods for persistent storage of
+// mailboxes of the email gateway.
+type MailboxesPersistenceInterface interface {
+	Create(box *types.Mailbox) error
+	Get(address string) (*types.Mailbox, error)
+	GetAll(topic string) ([]types.Mailbox, error)
+	Delete(address string) (bool, error)
+}
+
+// mailboxesMapper is a concrete type implementing MailboxesPersistenceInterface.
+type mailboxesMapper struct{}
+
+// Mailboxes is a singleton ancor object for exporting MailboxesPersistenceInterface.
+var Mailboxes MailboxesPersistenceInterface
+
+// Create saves a new mailbox. The address is converted to lowercase.
+func (mailboxesMapper) Create(box *types.Mailbox) error {
+	box.Address = strings.ToLower(box.Address)
+	box.CreatedAt = types.TimeNow()
+	return adp.MailboxesCreate(box)
+}
+
+// Get returns the mailbox with the address or nil if not found. The address is case-insensitive.
+func (mailboxesMapper) Get(address string) (*types.Mailbox, error) {
+	return adp.MailboxesGet(strings.ToLower(address))
+}
+
+// GetAll returns mailboxes of the topic.
+func (mailboxesMapper) GetAll(topic string) ([]types.Mailbox, error) {
+	return adp.MailboxesGetAll(topic)
+}
+
+// Delete deletes the mailbox. Returns false if the mailbox does not exist.
+func (mailboxesMapper) Delete(address string) (bool, error) {
+	return adp.MailboxesDelete(strings.ToLower(address))
+}
+
+// ContactsPersistenceInterface is an interface which defines methods for finding users by hashes
+// of their phone numbers and emails.
+type ContactsPersistenceInterface interface {
+	Find(tenant string, hashes []string) ([]types.ContactHash, error)
+	FindByPrefix(tenant string, prefixes []string) ([]types.ContactHash, error)
+}
+
+// contactsMapper is a concrete type implementing ContactsPersistenceInterface.
+type contactsMapper struct{}
+
+// Contacts is a singleton ancor object for exporting ContactsPersistenceInterface.
+var Contacts ContactsPersistenceInterface
+
+// Find returns active users of the tenant with the given hashes of phone numbers or emails.
+func (contactsMapper) Find(tenant string, hashes []string) ([]types.ContactHash, error) {
+	if !IsContactDiscoveryEnabled() {
+		return nil, types.ErrUnsupported
+	}
+	return adp.ContactsFind(tenant, hashes)
+}
+
+// FindByPrefix returns active users of the tenant with hashes of phone numbers or emails starting with
+// any of the prefixes.
+func (contactsMapper) FindByPrefix(tenant string, prefixes []string) ([]types.ContactHash, error) {
+	if !IsContactDiscoveryEnabled() {
+		return nil, types.ErrUnsupported
+	}
+	return adp.ContactsFindByPrefix(tenant, prefixes)
+}
+
+// TenantsPersistenceInterface is an interface which defines methods for persistent storage of tenants.
+type TenantsPersistenceInterface interface {
+	Create(tenant *types.Tenant) error
+	GetAll() ([]types.Tenant, error)
+	Update(tenant *types.Tenant) (bool, error)
+	Delete(id string) (bool, error)
+}
+
+// tenantsMapper is a concrete type implementing TenantsPersistenceInterface.
+type tenantsMapper struct{}
+
+// Tenants is a singleton ancor object for exporting TenantsPersistenceInterface.
+var Tenants TenantsPersistenceInterface
+
+// Create saves a new tenant.
+func (tenantsMapper) Create(tenant *types.Tenant) error {
+	tenant.CreatedAt = types.TimeNow()
+	tenant.UpdatedAt = tenant.CreatedAt
+	return adp.TenantsCreate(tenant)
+}
+
+// GetAll returns all tenants.
+func (tenantsMapper) GetAll() ([]types.Tenant, error) {
+	return adp.TenantsGetAll()
+}
+
+// Update replaces the name, hosts and config of the tenant. Returns false if the tenant does not exist.
+func (tenantsMapper) Update(tenant *types.Tenant) (bool, error) {
+	tenant.UpdatedAt = types.TimeNow()
+	return adp.TenantsUpdate(tenant)
+}
+
+// Delete deletes the tenant. Returns false if the tenant does not exist or has users.
+func (tenantsMapper) Delete(id string) (bool, error) {
+	return adp.TenantsDelete(id)
+}
+
+// UsagePersistenceInterface is an interface which defines methods for persistent storage of metered usage.
+type UsagePersistenceInterface interface {
+	Add(records []types.UsageRecord) error
+	Get(period string, uid types.Uid) (*types.UsageRecord, error)
+	Total(period, tenant string) (*types.UsageRecord, error)
+	List(period string, tenants []string) ([]types.UsageRecord, error)
+}
+
+// usageMapper is a concrete type implementing UsagePersistenceInterface.
+type usageMapper struct{}
+
+// Usage is a singleton ancor object for exporting UsagePersistenceInterface.
+var Usage UsagePersistenceInterface
+
+// Add adds counts of the records to the usage of the users.
+func (usageMapper) Add(records []types.UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return adp.UsageAdd(records)
+}
+
+// Get returns usage of the user in the billing period.
+func (usageMapper) Get(period string, uid types.Uid) (*types.UsageRecord, error) {
+	return adp.UsageGet(period, uid)
+}
+
+// Total returns the total usage of all users of the tenant in the billing period.
+func (usageMapper) Total(period, tenant string) (*types.UsageRecord, error) {
+	return adp.UsageTotal(period, tenant)
+}
+
+// List returns usage of users of the tenants in the billing period, of all users if tenants is nil.
+func (usageMapper) List(period string, tenants []string) ([]types.UsageRecord, error) {
+	return adp.UsageList(period, tenants)
+}
+
+// DevicePersistenceInterface is an interface which defines methods used for handling device IDs.
+// Mostly used to generate push notifications.
+type DevicePersistenceInterface interface {
+	Update(uid types.Uid, oldDeviceID string, dev *types.DeviceDef) error
+	GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, int, error)
+	Delete(uid types.Uid, deviceID string) error
+}
+
+// deviceMapper is a concrete type implementing DevicePersistenceInterface.
+type deviceMapper struct{}
+
+// Devices is a singleton instance of DevicePersistenceInterface to map methods to.
+var Devices DevicePersistenceInterface
+
+// Update updates a device record.
+func (deviceMapper) Update(uid types.Uid, oldDeviceID string, dev *types.DeviceDef) error {
+	// If the old device Id is specified and it's different from the new ID, delete the old id
+	if oldDeviceID != "" && (dev == nil || dev.DeviceId != oldDeviceID) {
+		if err := adp.DeviceDelete(uid, oldDeviceID); err != nil {
+			return err
+		}
+	}
+
+	// Some adapters load devices together with the user.
+	defer cacheInvalidate(cacheKeyUser(uid))
+
+	// Insert or update the new DeviceId if one is given.
+	if dev != nil && dev.DeviceId != "" {
+		return adp.DeviceUpsert(uid, dev)
+	}
+	return nil
+}
+
+// GetAll returns all known device IDs for a given list of user IDs.
+// The second return parameter is the count of found device IDs.
+func (deviceMapper) GetAll(uid ...types.Uid) (map[types.Uid][]types.DeviceDef, int, error) {
+	return adp.DeviceGetAll(uid...)
+}
+
+// Delete deletes device record for a given user.
+func (deviceMapper) Delete(uid types.Uid, deviceID string) error {
+	defer cacheInvalidate(cacheKeyUser(uid))
+	return adp.DeviceDelete(uid, deviceID)
+}
+
+// Registered media/file handlers.
+var fileHandlers map[string]media.Handler
+
+// RegisterMediaHandler saves reference to a media handler (file upload-download handler).
+func RegisterMediaHandler(name string, mh media.Handler) {
+	if fileHandlers == nil {
+		fileHandlers = make(map[string]media.Handler)
+	}
+
+	if mh == nil {
+		panic("RegisterMediaHandler: handler is nil")
+	}
+	if _, dup := fileHandlers[name]; dup {
+		panic("RegisterMediaHandler: called twice for handler " + name)
+	}
+	fileHandlers[name] = mh
+}
+
+// GetMediaHandler returns default media handler.
+func (storeObj) GetMediaHandler() media.Handler {
+	return mediaHandler
+}
+
+// UseMediaHandler sets specified media handler as default.
+func (storeObj) UseMediaHandler(name, config string) error {
+	mediaHandler = fileHandlers[name]
+	if mediaHandler == nil {
+		panic("UseMediaHandler: unknown handler '" + name + "'")
+	}
+	return mediaHandler.Init(config)
+}
+
+// FilePersistenceInterface is an interface wchich defines methods used for file handling (records or uploaded files).
+type FilePersistenceInterface interface {
+	// StartUpload records that the given user initiated a file upload
+	StartUpload(fd *types.FileDef) error
+	// FinishUpload marks started upload as successfully finished.
+	FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error)
+	// Get fetches a file record for a unique file id.
+	Get(fid string) (*types.FileDef, error)
+	// GetAllByUser fetches records of all files uploaded by the user.
+	GetAllByUser(uid types.Uid) ([]types.FileDef, error)
+	// UserUsage returns the number of bytes of files uploaded by the user.
+	UserUsage(uid types.Uid) (int64, error)
+	// TopicUsage returns the number of bytes of files attached to the topic and its messages, including
+	// the given attachments which may not be attached yet.
+	TopicUsage(topic string, attachments []string) (int64, error)
+	// DeleteUnused removes unused attachments.
+	DeleteUnused(olderThan time.Time, limit int) error
+	// LinkAttachments connects earlier uploaded attachments to a message or topic to prevent it
+	// from being garbage collected.
+	LinkAttachments(topic string, msgId types.Uid, attachments []string) error
+}
+
+// fileMapper is concrete type which implements FilePersistenceInterface.
+type fileMapper struct{}
+
+// Files is a sigleton instance of FilePersistenceInterface to be used for handling file uploads.
+var Files FilePersistenceInterface
+
+// reservedUploads are IDs of file records created by ReserveUpload and not uploaded yet.
+var reservedUploads sync.Map
+
+// ReserveUpload creates a record of a file which will be uploaded later by this node, such as a
+// variant of an image generated in the background. The record can be linked to messages before the
+// upload. StartUpload of the file reuses the record.
+func ReserveUpload(fd *types.FileDef) error {
+	fd.Status = types.UploadStarted
+	enc, err := encryptFileDef(fd)
+	if err != nil {
+		return err
+	}
+	if err = adp.FileStartUpload(enc); err != nil {
+		return err
+	}
+	reservedUploads.Store(fd.Id, true)
+	return nil
+}
+
+// StartUpload records that the given user initiated a file upload
+func (fileMapper) StartUpload(fd *types.FileDef) error {
 	fd.Status = types.UploadStarted
-	return adp.FileStartUpload(fd)
+	if _, ok := reservedUploads.LoadAndDelete(fd.Id); ok {
+		// The record is already created.
+		return nil
+	}
+	enc, err := encryptFileDef(fd)
+	if err != nil {
+		return err
+	}
+	return adp.FileStartUpload(enc)
 }
 
 // FinishUpload marks started upload as successfully finished or failed.
 func (fileMapper) FinishUpload(fd *types.FileDef, success bool, size int64) (*types.FileDef, error) {
-	return adp.FileFinishUpload(fd, success, size)
+	if !success {
+		// Upload of a reserved file was abandoned before it started.
+		reservedUploads.Delete(fd.Id)
+	} else if fd.Scan != nil && fd.Scan.Verdict == types.ScanInfected {
+		// Infected files which were not rejected are quarantined.
+		fd.Status = types.UploadQuarantined
+	}
+	enc, err := encryptFileDef(fd)
+	if err != nil {
+		return nil, err
+	}
+	res, err := adp.FileFinishUpload(enc, success, size)
+	if res == nil || res == fd {
+		return res, err
+	}
+	// Return the plaintext record to the caller.
+	fd.Status, fd.Size, fd.UpdatedAt = res.Status, res.Size, res.UpdatedAt
+	return fd, err
 }
 
 // Get fetches a file record for a unique file id.
 func (fileMapper) Get(fid string) (*types.FileDef, error) {
-	return adp.FileGet(fid)
+	fd, err := adp.FileGet(fid)
+	if err != nil {
+		return nil, err
+	}
+	if err = decryptFileDef(fd); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// GetAllByUser fetches records of all completed uploads by the user.
+func (fileMapper) GetAllByUser(uid types.Uid) ([]types.FileDef, error) {
+	files, err := adp.FileGetAllByUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		if err = decryptFileDef(&files[i]); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
 }
 
 // DeleteUnused removes unused attachments and avatars.
@@ -1138,6 +3099,11 @@ func (fileMapper) DeleteUnused(olderThan time.Time, limit int) error {
 	if err != nil {
 		return err
 	}
+	for i, loc := range toDel {
+		if toDel[i], err = decryptString(loc); err != nil {
+			return err
+		}
+	}
 	if len(toDel) > 0 {
 		logs.Warn.Println("deleting media", toDel)
 		return Store.GetMediaHandler().Delete(toDel)
@@ -1167,6 +3133,23 @@ func (fileMapper) LinkAttachments(topic string, msgId types.Uid, attachments []s
 	return nil
 }
 
+// UserUsage returns the number of bytes of files uploaded by the user.
+func (fileMapper) UserUsage(uid types.Uid) (int64, error) {
+	return adp.FileUsageByUser(uid)
+}
+
+// TopicUsage returns the number of bytes of files attached to the topic and its messages, including
+// the given attachments which may not be attached yet.
+func (fileMapper) TopicUsage(topic string, attachments []string) (int64, error) {
+	var fids []string
+	for _, url := range attachments {
+		if fid := mediaHandler.GetIdFromUrl(url); !fid.IsZero() {
+			fids = append(fids, fid.String())
+		}
+	}
+	return adp.FileUsageByTopic(topic, fids)
+}
+
 // PersistentCacheInterface is an interface which defines methods used for accessing persistent key-value cache.
 type PersistentCacheInterface interface {
 	// Get reads a persistent cache entry.
@@ -1214,6 +3197,35 @@ func init() {
 	Topics = topicsMapper{}
 	Subs = subsMapper{}
 	Messages = messagesMapper{}
+	Reactions = reactionsMapper{}
+	Polls = pollsMapper{}
+	Translations = translationsMapper{}
+	Moderation = moderationMapper{}
+	Audit = auditMapper{}
+	Takeouts = takeoutsMapper{}
+	Reports = reportsMapper{}
+	Threads = threadsMapper{}
+	Scheduled = scheduledMapper{}
+	Sessions = sessionsMapper{}
+	Calls = callsMapper{}
+	Keys = keysMapper{}
+	UserDevices = userDevicesMapper{}
+	NotifySettings = notifySettingsMapper{}
+	PresenceSettings = presenceSettingsMapper{}
+	Mentions = mentionsMapper{}
+	Drafts = draftsMapper{}
+	Starred = starredMapper{}
+	Blocks = blocksMapper{}
+	Invites = invitesMapper{}
+	Directory = directoryMapper{}
+	Webhooks = webhooksMapper{}
+	InWebhooks = inWebhooksMapper{}
+	MatrixRooms = matrixRoomsMapper{}
+	Mailboxes = mailboxesMapper{}
+	SmsMessages = smsMapper{}
+	Contacts = contactsMapper{}
+	Tenants = tenantsMapper{}
+	Usage = usageMapper{}
 	Devices = deviceMapper{}
 	Files = fileMapper{}
 	PCache = pcacheMapper{}
@@ -0,0 +1,330 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Cold storage tiering. Old messages are moved out of the database into blobs in cold storage, one blob
+// per range of message IDs. The ranges are indexed in the database. Messages are read back from the blobs
+// when the history of the topic is requested. Messages in cold storage are read-only: they cannot be
+// edited, found by search or anonymized. Soft deletion of such messages hides them on read. Hard deletion
+// and erasure of the sender rewrite the blobs without the removed messages, empty blobs are deleted.
+
+// Number of messages returned by GetAll when the query has no limit. Same as the default of the adapters.
+const defaultColdResults = 100
+
+// ColdStorage keeps blobs of messages moved out of the database.
+type ColdStorage interface {
+	// Put writes the blob of messages.
+	Put(key string, msgs []types.Message) error
+	// Get reads the blob of messages.
+	Get(key string) ([]types.Message, error)
+	// Delete removes the blob.
+	Delete(key string) error
+}
+
+// Cold storage or nil if tiering is disabled.
+var coldStorage ColdStorage
+
+// Serializes rewrites of blobs so that concurrent removals do not restore each other's messages.
+var coldRewriteLock sync.Mutex
+
+// InitColdStorage enables moving old messages to the given cold storage. Nil disables tiering: messages
+// which are already moved become unavailable.
+func InitColdStorage(cs ColdStorage) {
+	coldStorage = cs
+}
+
+// IsTieringEnabled checks if old messages are moved to cold storage.
+func IsTieringEnabled() bool {
+	return coldStorage != nil
+}
+
+// coldKey returns the key of the blob with messages [low, hi) of the topic.
+func coldKey(topic string, low, hi int) string {
+	return fmt.Sprintf("%s/%010d-%010d", topic, low, hi)
+}
+
+// coldRewriteKey returns a new key of the rewritten blob with messages [low, hi) of the topic. Blobs are
+// immutable: the old blob may be cached by other cluster nodes.
+func coldRewriteKey(topic string, low, hi int) string {
+	return fmt.Sprintf("%s-%x", coldKey(topic, low, hi), time.Now().UnixNano())
+}
+
+// GetColdTopics returns up to 'limit' topics with messages created before the given time which can be
+// moved to cold storage. Topics with the time to live of messages and topics of the retention categories
+// 'skipCats' are not returned: messages in cold storage are not found by the reapers.
+func (messagesMapper) GetColdTopics(before time.Time, skipCats []string, limit int) ([]string, error) {
+	return adp.MessageGetColdTopics(before, skipCats, limit)
+}
+
+// MoveCold moves up to 'limit' oldest messages of the topic created before the given time to cold storage.
+// Returns the number of moved messages.
+func (messagesMapper) MoveCold(topic string, before time.Time, limit int) (int, error) {
+	if coldStorage == nil {
+		return 0, types.ErrUnsupported
+	}
+
+	// Messages changed after this moment are not moved.
+	readAt := types.TimeNow()
+	msgs, err := adp.MessageGetCold(topic, before, limit)
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+
+	low, hi := msgs[0].SeqId, msgs[len(msgs)-1].SeqId+1
+	tier := &types.MessageTier{
+		Topic:     topic,
+		Low:       low,
+		Hi:        hi,
+		Count:     len(msgs),
+		Key:       coldKey(topic, low, hi),
+		CreatedAt: readAt,
+	}
+	if err = coldStorage.Put(tier.Key, msgs); err != nil {
+		return 0, err
+	}
+
+	seqIds := make([]int, len(msgs))
+	for i := range msgs {
+		seqIds[i] = msgs[i].SeqId
+	}
+	if err = adp.MessageTierCreate(tier, seqIds, readAt); err != nil {
+		if err := coldStorage.Delete(tier.Key); err != nil {
+			logs.Warn.Printf("topic[%s]: failed to delete unused blob %s: %v", topic, tier.Key, err)
+		}
+		return 0, err
+	}
+	return len(msgs), nil
+}
+
+// DeleteOrphanedTiers removes blobs of up to 'limit' ranges of messages of deleted topics.
+// Returns the number of removed blobs.
+func (messagesMapper) DeleteOrphanedTiers(limit int) (int, error) {
+	if coldStorage == nil {
+		return 0, types.ErrUnsupported
+	}
+
+	tiers, err := adp.MessageTierGetOrphaned(limit)
+	if err != nil {
+		return 0, err
+	}
+	for i, tier := range tiers {
+		if err = coldStorage.Delete(tier.Key); err != nil {
+			return i, err
+		}
+		if err = adp.MessageTierDelete(tier.Topic, tier.Low); err != nil {
+			return i, err
+		}
+	}
+	return len(tiers), nil
+}
+
+// purgeCold removes messages of the topic with IDs in [low, hi) which match the filter from cold storage.
+// Blobs are rewritten without the removed messages, blobs left empty are deleted.
+// Returns the number of removed messages.
+func purgeCold(topic string, low, hi int, remove func(*types.Message) bool) (int, error) {
+	coldRewriteLock.Lock()
+	defer coldRewriteLock.Unlock()
+
+	tiers, _, err := adp.MessageGetTiers(topic, types.ZeroUid, low, hi)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, tier := range tiers {
+		cold, err := coldStorage.Get(tier.Key)
+		if err != nil {
+			return removed, err
+		}
+		var keep []types.Message
+		for i := range cold {
+			if cold[i].SeqId < low || cold[i].SeqId >= hi || !remove(&cold[i]) {
+				keep = append(keep, cold[i])
+			}
+		}
+		if len(keep) == len(cold) {
+			continue
+		}
+
+		if len(keep) == 0 {
+			if err = adp.MessageTierDelete(topic, tier.Low); err != nil {
+				return removed, err
+			}
+		} else {
+			key := coldRewriteKey(topic, tier.Low, tier.Hi)
+			if err = coldStorage.Put(key, keep); err != nil {
+				return removed, err
+			}
+			if err = adp.MessageTierUpdate(topic, tier.Low, key, len(keep)); err != nil {
+				if err := coldStorage.Delete(key); err != nil {
+					logs.Warn.Printf("topic[%s]: failed to delete unused blob %s: %v", topic, key, err)
+				}
+				return removed, err
+			}
+		}
+		if err = coldStorage.Delete(tier.Key); err != nil {
+			return removed, err
+		}
+		removed += len(cold) - len(keep)
+	}
+	return removed, nil
+}
+
+// eraseCold removes messages sent by the user from cold storage. If dryRun is true, the messages are only
+// counted. Returns the number of messages.
+func eraseCold(uid types.Uid, dryRun bool) (int, error) {
+	topics, err := adp.MessageTierGetTopics(uid)
+	if err != nil {
+		return 0, err
+	}
+	from := uid.String()
+	sentByUser := func(msg *types.Message) bool { return msg.From == from }
+	count := 0
+	for _, topic := range topics {
+		if !dryRun {
+			removed, err := purgeCold(topic, 0, 1<<31-1, sentByUser)
+			count += removed
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+
+		tiers, _, err := adp.MessageGetTiers(topic, types.ZeroUid, 0, 1<<31-1)
+		if err != nil {
+			return count, err
+		}
+		for _, tier := range tiers {
+			cold, err := coldStorage.Get(tier.Key)
+			if err != nil {
+				return count, err
+			}
+			for i := range cold {
+				if sentByUser(&cold[i]) {
+					count++
+				}
+			}
+		}
+	}
+	return count, nil
+}
+
+// coldBounds returns the range of message IDs [low, hi) requested by the query.
+func coldBounds(opt *types.QueryOpt) (int, int) {
+	low, hi := 0, 1<<31-1
+	if opt == nil {
+		return low, hi
+	}
+	if len(opt.IdRanges) > 0 {
+		low, hi = hi, low
+		for _, r := range opt.IdRanges {
+			low = min(low, r.Low)
+			hi = max(hi, r.Low+1, r.Hi)
+		}
+		return low, hi
+	}
+	if opt.Since > 0 {
+		low = opt.Since
+	}
+	if opt.Before > 0 {
+		hi = opt.Before
+	}
+	return low, hi
+}
+
+// rangesContain checks if any of the ranges contains the message ID.
+func rangesContain(ranges []types.Range, seqId int) bool {
+	for _, r := range ranges {
+		if seqId == r.Low || (seqId > r.Low && seqId < r.Hi) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeCold adds messages from a cold blob which match the query to messages sorted by ID descending.
+// Keeps up to 'limit' newest messages.
+func mergeCold(msgs, cold []types.Message, opt *types.QueryOpt, deleted []types.Range, limit int) []types.Message {
+	low, hi := coldBounds(opt)
+	for i := range cold {
+		msg := &cold[i]
+		if msg.SeqId < low || msg.SeqId >= hi || rangesContain(deleted, msg.SeqId) {
+			continue
+		}
+		if opt != nil {
+			if len(opt.IdRanges) > 0 && !rangesContain(opt.IdRanges, msg.SeqId) {
+				continue
+			}
+			if opt.Thread > 0 && msg.ThreadId != opt.Thread && msg.SeqId != opt.Thread {
+				continue
+			}
+		}
+		msgs = append(msgs, *msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].SeqId > msgs[j].SeqId })
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs
+}
+
+// hydrateCold adds messages from cold storage to messages read from the database by GetAll.
+func hydrateCold(topic string, forUser types.Uid, opt *types.QueryOpt, msgs []types.Message) ([]types.Message, error) {
+	limit := defaultColdResults
+	if opt != nil && opt.Limit > 0 {
+		limit = opt.Limit
+	}
+
+	low, hi := coldBounds(opt)
+	if len(msgs) >= limit {
+		// Older messages would not make it into the result.
+		low = max(low, msgs[len(msgs)-1].SeqId+1)
+	}
+	if low >= hi {
+		return msgs, nil
+	}
+
+	tiers, deleted, err := adp.MessageGetTiers(topic, forUser, low, hi)
+	if err != nil {
+		return nil, err
+	}
+	for _, tier := range tiers {
+		if len(msgs) >= limit && msgs[limit-1].SeqId >= tier.Hi {
+			// This and the remaining tiers are older than all the messages of the result.
+			break
+		}
+		cold, err := coldStorage.Get(tier.Key)
+		if err != nil {
+			return nil, err
+		}
+		msgs = mergeCold(msgs, cold, opt, deleted, limit)
+	}
+	return msgs, nil
+}
+
+// getColdBySeqId finds the message in cold storage. Returns nil if the message is not found.
+func getColdBySeqId(topic string, seqId int) (*types.Message, error) {
+	tiers, deleted, err := adp.MessageGetTiers(topic, types.ZeroUid, seqId, seqId+1)
+	if err != nil || len(tiers) == 0 || rangesContain(deleted, seqId) {
+		return nil, err
+	}
+	for _, tier := range tiers {
+		cold, err := coldStorage.Get(tier.Key)
+		if err != nil {
+			return nil, err
+		}
+		for i := range cold {
+			if cold[i].SeqId == seqId {
+				return &cold[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	adapter "github.com/tinode/chat/server/db"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func seqIds(msgs []types.Message) []int {
+	var ids []int
+	for i := range msgs {
+		ids = append(ids, msgs[i].SeqId)
+	}
+	return ids
+}
+
+func TestMergeCold(t *testing.T) {
+	// Message 5 has an attachment and stayed in the database.
+	hot := []types.Message{{SeqId: 9}, {SeqId: 8}, {SeqId: 5}}
+	cold := []types.Message{{SeqId: 2}, {SeqId: 3, ThreadId: 2}, {SeqId: 4}, {SeqId: 6}, {SeqId: 7, ThreadId: 2}}
+
+	merged := mergeCold(append([]types.Message{}, hot...), cold, nil, []types.Range{{Low: 6, Hi: 7}}, 5)
+	if ids := seqIds(merged); len(ids) != 5 || ids[0] != 9 || ids[2] != 7 || ids[3] != 5 || ids[4] != 4 {
+		t.Errorf("Expected [9 8 7 5 4], got %v", ids)
+	}
+
+	merged = mergeCold(nil, cold, &types.QueryOpt{Before: 7, Since: 3}, nil, 10)
+	if ids := seqIds(merged); len(ids) != 3 || ids[0] != 6 || ids[2] != 3 {
+		t.Errorf("Expected [6 4 3], got %v", ids)
+	}
+
+	merged = mergeCold(nil, cold, &types.QueryOpt{Thread: 2}, nil, 10)
+	if ids := seqIds(merged); len(ids) != 3 || ids[0] != 7 || ids[2] != 2 {
+		t.Errorf("Expected thread [7 3 2], got %v", ids)
+	}
+
+	merged = mergeCold(nil, cold, &types.QueryOpt{IdRanges: []types.Range{{Low: 2}, {Low: 6, Hi: 8}}}, nil, 10)
+	if ids := seqIds(merged); len(ids) != 3 || ids[0] != 7 || ids[2] != 2 {
+		t.Errorf("Expected ranges [7 6 2], got %v", ids)
+	}
+}
+
+// memColdStorage keeps blobs in memory.
+type memColdStorage map[string][]types.Message
+
+func (cs memColdStorage) Put(key string, msgs []types.Message) error {
+	cs[key] = msgs
+	return nil
+}
+
+func (cs memColdStorage) Get(key string) ([]types.Message, error) {
+	if msgs, ok := cs[key]; ok {
+		return msgs, nil
+	}
+	return nil, types.ErrNotFound
+}
+
+func (cs memColdStorage) Delete(key string) error {
+	delete(cs, key)
+	return nil
+}
+
+// tierAdapter keeps ranges of messages in cold storage of one topic.
+type tierAdapter struct {
+	adapter.Adapter
+	tiers []types.MessageTier
+}
+
+func (a *tierAdapter) MessageGetTiers(topic string, forUser types.Uid, low, hi int) ([]types.MessageTier, []types.Range, error) {
+	var tiers []types.MessageTier
+	for _, tier := range a.tiers {
+		if tier.Low < hi && tier.Hi > low {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers, nil, nil
+}
+
+func (a *tierAdapter) MessageTierGetTopics(uid types.Uid) ([]string, error) {
+	var topics []string
+	for _, tier := range a.tiers {
+		if len(topics) == 0 || topics[len(topics)-1] != tier.Topic {
+			topics = append(topics, tier.Topic)
+		}
+	}
+	return topics, nil
+}
+
+func (a *tierAdapter) MessageTierDelete(topic string, low int) error {
+	for i := range a.tiers {
+		if a.tiers[i].Low == low {
+			a.tiers = append(a.tiers[:i], a.tiers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (a *tierAdapter) MessageTierUpdate(topic string, low int, key string, count int) error {
+	for i := range a.tiers {
+		if a.tiers[i].Low == low {
+			a.tiers[i].Key, a.tiers[i].Count = key, count
+		}
+	}
+	return nil
+}
+
+func TestPurgeCold(t *testing.T) {
+	topic := "grpTest"
+	cs := memColdStorage{
+		coldKey(topic, 1, 4): {{SeqId: 1, From: "usrA"}, {SeqId: 2, From: "usrB"}, {SeqId: 3, From: "usrA"}},
+		coldKey(topic, 4, 6): {{SeqId: 4, From: "usrB"}, {SeqId: 5, From: "usrB"}},
+		coldKey(topic, 6, 8): {{SeqId: 6, From: "usrB"}, {SeqId: 7, From: "usrA"}},
+	}
+	ta := &tierAdapter{tiers: []types.MessageTier{
+		{Topic: topic, Low: 6, Hi: 8, Count: 2, Key: coldKey(topic, 6, 8)},
+		{Topic: topic, Low: 4, Hi: 6, Count: 2, Key: coldKey(topic, 4, 6)},
+		{Topic: topic, Low: 1, Hi: 4, Count: 3, Key: coldKey(topic, 1, 4)},
+	}}
+	prevAdp, prevCold := adp, coldStorage
+	adp, coldStorage = ta, cs
+	defer func() { adp, coldStorage = prevAdp, prevCold }()
+
+	// Messages of usrB in [2, 6): the first blob is rewritten, the second is removed, the third is
+	// out of range.
+	removed, err := purgeCold(topic, 2, 6, func(msg *types.Message) bool { return msg.From == "usrB" })
+	if err != nil || removed != 3 {
+		t.Fatalf("Expected 3 removed messages, got %d %v", removed, err)
+	}
+	if len(ta.tiers) != 2 || ta.tiers[0].Low != 6 || ta.tiers[1].Low != 1 {
+		t.Fatalf("Unexpected tiers %+v", ta.tiers)
+	}
+	rewritten := ta.tiers[1]
+	if rewritten.Count != 2 || rewritten.Key == coldKey(topic, 1, 4) ||
+		!strings.HasPrefix(rewritten.Key, coldKey(topic, 1, 4)) {
+		t.Errorf("Unexpected rewritten tier %+v", rewritten)
+	}
+	if ids := seqIds(cs[rewritten.Key]); len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+		t.Errorf("Expected [1 3], got %v", ids)
+	}
+	if len(cs) != 2 || len(cs[coldKey(topic, 6, 8)]) != 2 {
+		t.Errorf("Unexpected blobs %v", cs)
+	}
+
+	// Nothing to remove: blobs are not rewritten.
+	if removed, err = purgeCold(topic, 1, 8, func(msg *types.Message) bool { return false }); err != nil || removed != 0 {
+		t.Errorf("Expected no removed messages, got %d %v", removed, err)
+	}
+	if len(cs) != 2 || len(cs[rewritten.Key]) != 2 {
+		t.Errorf("Unexpected blobs %v", cs)
+	}
+}
+
+func TestEraseCold(t *testing.T) {
+	topic := "grpTest"
+	uid := types.Uid(1)
+	from := uid.String()
+	cs := memColdStorage{
+		coldKey(topic, 1, 3): {{SeqId: 1, From: from}, {SeqId: 2, From: "usrB"}},
+		coldKey(topic, 3, 5): {{SeqId: 3, From: from}, {SeqId: 4, From: from}},
+	}
+	ta := &tierAdapter{tiers: []types.MessageTier{
+		{Topic: topic, Low: 3, Hi: 5, Count: 2, Key: coldKey(topic, 3, 5)},
+		{Topic: topic, Low: 1, Hi: 3, Count: 2, Key: coldKey(topic, 1, 3)},
+	}}
+	prevAdp, prevCold := adp, coldStorage
+	adp, coldStorage = ta, cs
+	defer func() { adp, coldStorage = prevAdp, prevCold }()
+
+	// Dry run only counts the messages.
+	if count, err := eraseCold(uid, true); err != nil || count != 3 {
+		t.Fatalf("Expected 3 messages, got %d %v", count, err)
+	}
+	if len(cs) != 2 || len(ta.tiers) != 2 {
+		t.Fatalf("Blobs changed by dry run %v", cs)
+	}
+
+	if count, err := eraseCold(uid, false); err != nil || count != 3 {
+		t.Fatalf("Expected 3 erased messages, got %d %v", count, err)
+	}
+	if len(ta.tiers) != 1 || ta.tiers[0].Low != 1 || ta.tiers[0].Count != 1 {
+		t.Fatalf("Unexpected tiers %+v", ta.tiers)
+	}
+	if msgs := cs[ta.tiers[0].Key]; len(cs) != 1 || len(msgs) != 1 || msgs[0].From != "usrB" {
+		t.Errorf("Unexpected blobs %v", cs)
+	}
+}
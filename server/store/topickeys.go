@@ -0,0 +1,172 @@
+package store
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Per-topic keys are derived from the master key with HKDF using a random per-topic salt. The salt
+// is stored in the persistent cache. Deleting the salt makes the content of the topic unrecoverable
+// (crypto-shredding) even if the master key is known.
+
+// Persistent cache key prefix of per-topic key salts.
+const topicSaltKeyPrefix = "topicsalt:"
+
+// Length of per-topic salt in bytes.
+const topicSaltLength = 32
+
+// Derived keys are cached for this long. A key shredded on another cluster node
+// remains usable on this node until it expires from the cache.
+const topicKeyCacheTTL = 5 * time.Minute
+
+// Maximum number of cached derived keys.
+const topicKeyCacheSize = 4096
+
+// ErrTopicKeyShredded is returned when the key of the topic is shredded or never existed.
+var ErrTopicKeyShredded = errors.New("topic encryption key not found")
+
+type topicKeyEntry struct {
+	gcm    cipher.AEAD
+	loaded time.Time
+}
+
+var topicKeyCache = struct {
+	sync.Mutex
+	entries map[string]topicKeyEntry
+}{entries: make(map[string]topicKeyEntry)}
+
+// EnablePerTopicKeys makes new message content encrypted with keys unique to each topic.
+// Content encrypted without per-topic keys remains readable. Must be called after the
+// encryption is initialized.
+func EnablePerTopicKeys(enabled bool) error {
+	if !IsEncryptionEnabled() {
+		if enabled {
+			return errors.New("per-topic keys require message encryption to be enabled")
+		}
+		return nil
+	}
+	msgEncryption.perTopic = enabled
+	return nil
+}
+
+// ShredTopicKey deletes the key material of the topic. Content of the topic encrypted with
+// per-topic keys becomes permanently unreadable.
+func ShredTopicKey(topic string) error {
+	topicKeyCache.Lock()
+	for key := range topicKeyCache.entries {
+		if _, keyTopic, _ := strings.Cut(key, ":"); keyTopic == topic {
+			delete(topicKeyCache.entries, key)
+		}
+	}
+	topicKeyCache.Unlock()
+
+	if err := PCache.Delete(topicSaltKeyPrefix + topic); err != nil && err != types.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// ActiveEncryptionKeyID returns the ID of the key used to encrypt new content,
+// an empty string for the legacy key.
+func ActiveEncryptionKeyID() string {
+	if !IsEncryptionEnabled() {
+		return ""
+	}
+	return msgEncryption.activeID
+}
+
+// DeriveMediaKey derives a key for encryption of a media file from the key keyID and the salt.
+// It implements media.StreamKeyFunc.
+func DeriveMediaKey(keyID string, salt []byte) ([]byte, error) {
+	if !IsEncryptionEnabled() {
+		return nil, errors.New("message encryption is not enabled")
+	}
+	if encryptionSuspended.Load() {
+		return nil, ErrEncryptionUnavailable
+	}
+	master := msgEncryption.rawKeys[keyID]
+	if master == nil {
+		return nil, errors.New("unknown encryption key '" + keyID + "'")
+	}
+	return hkdf.Key(sha256.New, master, salt, "tinode media key", 32)
+}
+
+// resetTopicKeyCache drops all cached derived keys.
+func resetTopicKeyCache() {
+	topicKeyCache.Lock()
+	topicKeyCache.entries = make(map[string]topicKeyEntry)
+	topicKeyCache.Unlock()
+}
+
+// topicCipher returns the cipher for the topic derived from the master key keyID. If the topic has
+// no salt yet and create is true, a new salt is generated.
+func topicCipher(keyID, topic string, create bool) (cipher.AEAD, error) {
+	master := msgEncryption.rawKeys[keyID]
+	if master == nil {
+		return nil, errors.New("unknown encryption key '" + keyID + "'")
+	}
+
+	cacheKey := keyID + ":" + topic
+	topicKeyCache.Lock()
+	entry, ok := topicKeyCache.entries[cacheKey]
+	topicKeyCache.Unlock()
+	if ok && time.Since(entry.loaded) < topicKeyCacheTTL {
+		return entry.gcm, nil
+	}
+
+	salt, err := topicSalt(topic, create)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hkdf.Key(sha256.New, master, salt, "tinode topic key "+topic, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	topicKeyCache.Lock()
+	if len(topicKeyCache.entries) >= topicKeyCacheSize {
+		topicKeyCache.entries = make(map[string]topicKeyEntry)
+	}
+	topicKeyCache.entries[cacheKey] = topicKeyEntry{gcm: gcm, loaded: time.Now()}
+	topicKeyCache.Unlock()
+
+	return gcm, nil
+}
+
+// topicSalt reads the salt of the topic from the persistent cache, optionally creating it.
+func topicSalt(topic string, create bool) ([]byte, error) {
+	key := topicSaltKeyPrefix + topic
+	val, err := PCache.Get(key)
+	if err == types.ErrNotFound {
+		if !create {
+			return nil, ErrTopicKeyShredded
+		}
+		salt := make([]byte, topicSaltLength)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, err
+		}
+		val = base64.StdEncoding.EncodeToString(salt)
+		if err = PCache.Upsert(key, val, true); err == types.ErrDuplicate {
+			// Created concurrently by another node.
+			val, err = PCache.Get(key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(val)
+}
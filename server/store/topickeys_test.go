@@ -0,0 +1,91 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// memPCache is an in-memory PersistentCacheInterface.
+type memPCache map[string]string
+
+func (c memPCache) Get(key string) (string, error) {
+	if val, ok := c[key]; ok {
+		return val, nil
+	}
+	return "", types.ErrNotFound
+}
+
+func (c memPCache) Upsert(key string, value string, failOnDuplicate bool) error {
+	if _, ok := c[key]; ok && failOnDuplicate {
+		return types.ErrDuplicate
+	}
+	c[key] = value
+	return nil
+}
+
+func (c memPCache) Delete(key string) error {
+	delete(c, key)
+	return nil
+}
+
+func (c memPCache) Expire(keyPrefix string, olderThan time.Time) error {
+	return nil
+}
+
+func TestPerTopicKeys(t *testing.T) {
+	savedPCache := PCache
+	PCache = memPCache{}
+	t.Cleanup(func() { PCache = savedPCache })
+
+	initTestEncryption(t, 0)
+	legacy, _ := EncryptContent("legacy")
+	if err := EnablePerTopicKeys(true); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	enc1, err := EncryptTopicContent("grpOne", "first")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if s := enc1.(string); !strings.HasPrefix(s, "ENC:v3::") {
+		t.Fatalf("Expected per-topic envelope, got %s", s)
+	}
+	enc2, _ := EncryptTopicContent("grpTwo", "second")
+
+	if dec, err := DecryptTopicContent("grpOne", enc1); err != nil || dec != "first" {
+		t.Errorf("Expected 'first', got %v, %v", dec, err)
+	}
+	if _, err := DecryptTopicContent("grpTwo", enc1); err == nil {
+		t.Error("Expected error decrypting content with the key of another topic")
+	}
+	if _, err := DecryptContent(enc1); err == nil {
+		t.Error("Expected error decrypting per-topic content without topic")
+	}
+	// Content encrypted before per-topic keys were enabled is readable.
+	if dec, err := DecryptTopicContent("grpOne", legacy); err != nil || dec != "legacy" {
+		t.Errorf("Expected 'legacy', got %v, %v", dec, err)
+	}
+
+	// Shredding one topic does not affect the other.
+	if err := ShredTopicKey("grpOne"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := DecryptTopicContent("grpOne", enc1); err != ErrTopicKeyShredded {
+		t.Errorf("Expected ErrTopicKeyShredded, got %v", err)
+	}
+	if dec, err := DecryptTopicContent("grpTwo", enc2); err != nil || dec != "second" {
+		t.Errorf("Expected 'second', got %v, %v", dec, err)
+	}
+
+	// New content after shredding gets a new key.
+	enc3, _ := EncryptTopicContent("grpOne", "third")
+	if dec, err := DecryptTopicContent("grpOne", enc3); err != nil || dec != "third" {
+		t.Errorf("Expected 'third', got %v, %v", dec, err)
+	}
+	if _, err := DecryptTopicContent("grpOne", enc1); err == nil {
+		t.Error("Expected shredded content to remain unreadable")
+	}
+}
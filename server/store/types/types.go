@@ -52,6 +52,8 @@ const (
 	ErrInvalidResponse = StoreError("invalid response")
 	// ErrRedirected means the subscription request was redirected to another topic.
 	ErrRedirected = StoreError("redirected")
+	// ErrQuotaExceeded means the storage quota of the user or topic is exhausted.
+	ErrQuotaExceeded = StoreError("quota exceeded")
 )
 
 // Uid is a database-specific record id, suitable to be used as a primary key.
@@ -524,12 +526,33 @@ type User struct {
 	// 'users' as well as indexed in 'tagunique'
 	Tags StringSlice
 
+	// Custom status of the user, nil if not set.
+	Status *UserStatus `bson:",omitempty"`
+
+	// Tenant the user belongs to, blank for the default tenant. Set at creation only.
+	Tenant string `json:"Tenant,omitempty" bson:",omitempty"`
+
 	// Info on known devices, used for push notifications
 	Devices map[string]*DeviceDef `bson:"__devices,skip,omitempty"`
 	// Same for mongodb scheme. Ignore in other db backends if its not suitable.
 	DeviceArray []*DeviceDef `json:"-" bson:"devices"`
 }
 
+// UserStatus is a custom status of the user such as "On vacation until Friday".
+type UserStatus struct {
+	// Emoji shown next to the text.
+	Emoji string `json:",omitempty" bson:",omitempty"`
+	// Text of the status.
+	Text string `json:",omitempty" bson:",omitempty"`
+	// Time when the status expires, nil if it does not expire.
+	ExpiresAt *time.Time `json:",omitempty" bson:",omitempty"`
+}
+
+// IsActive checks if the status is set and has not expired at the given time. Safe to call on nil.
+func (us *UserStatus) IsActive(now time.Time) bool {
+	return us != nil && (us.ExpiresAt == nil || us.ExpiresAt.After(now))
+}
+
 // AccessMode is a definition of access mode bits.
 type AccessMode uint
 
@@ -913,6 +936,17 @@ type Subscription struct {
 	ModeGiven AccessMode
 	// User's private data associated with the subscription to topic
 	Private any
+	// User-defined labels (folders) of the subscription.
+	Labels StringSlice `bson:",omitempty"`
+	// Time when the user archived the subscription, nil if not archived.
+	ArchivedAt *time.Time `bson:",omitempty"`
+	// Unarchive the subscription when a new message arrives.
+	AutoUnarchive bool `bson:",omitempty"`
+	// Role of the user in a group topic, such as "admin" or "moderator". Empty if the
+	// permissions are defined by the access mode only.
+	Role string `bson:",omitempty"`
+	// Message of the user to managers of a group topic asking to approve the request to join.
+	Request string `bson:",omitempty"`
 
 	// Deserialized ephemeral values
 
@@ -927,6 +961,8 @@ type Subscription struct {
 	touchedAt time.Time
 	// Timestamp & user agent of when the user was last online.
 	lastSeenUA *LastSeenUA
+	// Custom status of the user.
+	status *UserStatus
 
 	// Count of subscribers.
 	subCnt int
@@ -1041,6 +1077,16 @@ func (s *Subscription) SetLastSeenAndUA(when *time.Time, ua string) {
 	}
 }
 
+// SetStatus assigns custom status of the user, otherwise not accessible from outside the package.
+func (s *Subscription) SetStatus(status *UserStatus) {
+	s.status = status
+}
+
+// GetStatus reads custom status of the user.
+func (s *Subscription) GetStatus() *UserStatus {
+	return s.status
+}
+
 // SetDefaultAccess updates default access values.
 func (s *Subscription) SetDefaultAccess(auth, anon AccessMode) {
 	s.modeDefault = &DefaultAccess{auth, anon}
@@ -1117,6 +1163,14 @@ type Topic struct {
 	// Indicates that the topic is a channel.
 	UseBt bool
 
+	// Indicates that the channel is in broadcast mode. Set at creation only.
+	Broadcast bool `json:"Broadcast,omitempty" bson:",omitempty"`
+
+	// Indicates that the topic is a community which groups other group topics. Set at creation only.
+	Community bool `json:"Community,omitempty" bson:",omitempty"`
+	// Community the group topic belongs to. Set at creation only.
+	Parent string `json:"Parent,omitempty" bson:",omitempty"`
+
 	// Topic owner. Could be zero
 	Owner string
 
@@ -1140,6 +1194,21 @@ type Topic struct {
 	// Auxiliary set of key-value pairs.
 	Aux KVMap `json:"Aux,omitempty" bson:",omitempty"`
 
+	// Time to live of messages in seconds. Older messages are deleted. 0 means messages are kept forever.
+	MsgTTL int `json:"MsgTTL,omitempty" bson:",omitempty"`
+
+	// Minimum interval between messages of a user in seconds. 0 means slow mode is off.
+	SlowMode int `json:"SlowMode,omitempty" bson:",omitempty"`
+
+	// IDs of pinned messages in the order they were pinned.
+	Pinned []int `json:"Pinned,omitempty" bson:",omitempty"`
+
+	// Topic is frozen: only managers may publish.
+	Frozen bool `json:"Frozen,omitempty" bson:",omitempty"`
+
+	// Tenant the topic belongs to, blank for the default tenant. Set at creation only.
+	Tenant string `json:"Tenant,omitempty" bson:",omitempty"`
+
 	// Deserialized ephemeral params
 	perUser map[Uid]*perUserData // deserialized from Subscription
 }
@@ -1224,6 +1293,31 @@ type Message struct {
 	From    string
 	Head    KVMap `json:"Head,omitempty" bson:",omitempty"`
 	Content any
+	// SeqId of the root message of the thread the message belongs to, 0 if none.
+	ThreadId int `json:"ThreadId,omitempty" bson:",omitempty"`
+}
+
+// MsgHeadE2EE is the message header which marks content encrypted end-to-end. Such content is opaque
+// to the server: it's not indexed for search and not transformed on delivery.
+const MsgHeadE2EE = "e2ee"
+
+// IsOpaque returns true if the message content is encrypted end-to-end.
+func (m *Message) IsOpaque() bool {
+	return m.Head[MsgHeadE2EE] == true
+}
+
+// ScheduledMessage is a message waiting to be published at a later time.
+type ScheduledMessage struct {
+	ObjHeader `bson:",inline"`
+	Topic     string
+	// Sender's user ID as string (without 'usr' prefix).
+	From string
+	// Time when the message is to be published.
+	SendAt  time.Time
+	Head    KVMap `json:"Head,omitempty" bson:",omitempty"`
+	Content any
+	// URLs of out-of-band attachments.
+	Attachments []string `json:"Attachments,omitempty" bson:",omitempty"`
 }
 
 // Range is a range of message SeqIDs. Low end is inclusive (closed), high end is exclusive (open): [Low, Hi).
@@ -1350,6 +1444,339 @@ type QueryOpt struct {
 	Limit int
 	// Ranges of IDs.
 	IdRanges []Range
+	// Text search query: messages must contain all words of the query.
+	Search string
+	// Blind index tokens of the search query. Set by the store from Search.
+	SearchTokens []string
+	// Messages of the thread with this root SeqId, including the root.
+	Thread int
+	// Subscriptions with this label.
+	Label string
+	// Only archived (true) or only not archived (false) subscriptions, all if nil.
+	Archived *bool
+}
+
+// MessageVersion is a previous version of content of an edited message.
+type MessageVersion struct {
+	Topic string
+	SeqId int
+	// Version number, the original content is version 0.
+	Version int
+	// Time when this version was written.
+	CreatedAt time.Time
+	// Time when this version was replaced by an edit.
+	ReplacedAt time.Time
+	Content    any
+	// Current header of the message, e.g. for checking the scope.
+	Head KVMap
+}
+
+// MessageSearchQuery is a query for full-text search of messages in one or more topics.
+type MessageSearchQuery struct {
+	// Topics to search in.
+	Topics []string
+	// Text query: messages must contain all words of the query.
+	Query string
+	// Blind index tokens of the query in all the topics. If set, the index is searched instead of content.
+	Tokens []string
+	// Number of tokens a message must match, i.e. the number of words in the query.
+	TokenCount int
+	// Return messages sent before this time.
+	Before *time.Time
+	// Maximum number of messages to return.
+	Limit int
+}
+
+// Thread is a summary of a thread of replies to a message as seen by a user.
+type Thread struct {
+	// SeqId of the root message.
+	SeqId int
+	// Number of replies in the thread.
+	Count int
+	// SeqId of the latest reply.
+	LastSeqId int
+	// Time of the latest reply.
+	TouchedAt time.Time
+	// SeqId of the latest reply read by the user.
+	ReadSeqId int
+	// Number of replies by other users after ReadSeqId.
+	Unread int
+	// The user muted notifications of the thread.
+	Muted bool
+}
+
+// Reaction is a count of identical emoji reactions to a message.
+type Reaction struct {
+	SeqId int
+	// Emoji, up to 32 bytes.
+	Reaction string
+	// Number of users who reacted with the emoji.
+	Count int
+	// The requesting user is one of the users who reacted.
+	Mine bool
+}
+
+// Poll is the state of a poll attached to a message.
+type Poll struct {
+	SeqId int
+	// ID of the user who created the poll.
+	From string
+	// Number of options to choose from.
+	Options int
+	// More than one option can be chosen.
+	Multi bool
+	// Time when the poll was closed, nil if the poll is open.
+	ClosedAt *time.Time
+	// Number of votes for each option.
+	Tally []int
+	// Options chosen by the requesting user.
+	Mine []int
+}
+
+// Translation is a machine translation of a message.
+type Translation struct {
+	SeqId int
+	// BCP 47 tag of the language of the translation.
+	Lang string
+	// Language of the message as detected by the translation provider.
+	Src string
+	// Translated text of the message as string, possibly encrypted at rest.
+	Content any
+}
+
+// ModerationRecord is a logged decision of content moderation.
+type ModerationRecord struct {
+	CreatedAt time.Time
+	Topic     string
+	// ID of the moderated message, 0 if the message was rejected and not saved.
+	SeqId int
+	// ID of the sender.
+	From string
+	// Name of the action taken: "flag", "quarantine" or "reject".
+	Action string
+	// Name of the filter which made the decision.
+	Filter string
+	Reason string
+}
+
+// Takeout statuses.
+const (
+	// TakeoutPending is an export being prepared.
+	TakeoutPending = "pending"
+	// TakeoutReady is an export with the archive available for download.
+	TakeoutReady = "ready"
+	// TakeoutFailed is an export which could not be completed.
+	TakeoutFailed = "failed"
+)
+
+// Takeout is an export of all data of a user account.
+type Takeout struct {
+	ObjHeader `bson:",inline"`
+	// ID of the user whose data is exported.
+	User   string
+	Status string
+	// ID and download URL of the file with the archive. Blank until the export is ready.
+	FileId string
+	Url    string
+	// The archive is available for download until this time.
+	ExpiresAt *time.Time
+}
+
+// Events of the audit log.
+const (
+	// AuditLogin is a successful login.
+	AuditLogin = "login"
+	// AuditLoginFailed is a failed authentication attempt.
+	AuditLoginFailed = "login-failed"
+	// AuditAcsChange is a change of the access mode of a subscriber by another user.
+	AuditAcsChange = "acs"
+	// AuditOwnerChange is a transfer of topic ownership.
+	AuditOwnerChange = "owner"
+	// AuditRoleChange is a change of the role of a subscriber by another user.
+	AuditRoleChange = "role"
+	// AuditAccountDelete is a deletion of a user account.
+	AuditAccountDelete = "acc-del"
+	// AuditAdmin is a request to the admin API.
+	AuditAdmin = "admin"
+	// AuditSessionRevoke is a revocation of user's sessions by the user.
+	AuditSessionRevoke = "sess-revoke"
+	// AuditAuthChange is a login method added to or removed from the account.
+	AuditAuthChange = "auth"
+)
+
+// AuditRecord is an entry in the audit log of security-relevant events.
+type AuditRecord struct {
+	CreatedAt time.Time
+	Event     string
+	// ID of the user who performed the action. Blank if unknown or if the action was taken
+	// by the server operator through the admin API.
+	Actor string
+	// ID of the user affected by the action.
+	Target string
+	Topic  string
+	// IP address of the client.
+	RemoteAddr string
+	// Event-specific details, such as the authentication scheme or old and new access modes.
+	Details string
+}
+
+// AuditQuery is a filter of audit log records. Blank or zero fields are ignored.
+type AuditQuery struct {
+	Event string
+	// Records where the user is either the actor or the target.
+	User   string
+	Topic  string
+	Since  time.Time
+	Before time.Time
+	Limit  int
+}
+
+// AuthRecord is an authentication record of a user with the scheme prefix removed from the unique value.
+type AuthRecord struct {
+	Uid    Uid
+	Unique string
+	Secret []byte
+}
+
+// SessionRecord is a persistent record of a session where the user logged in.
+type SessionRecord struct {
+	// ID of the session, the same as the ID of the live session.
+	Id string
+	// User ID as string (without 'usr' prefix).
+	User      string
+	CreatedAt time.Time
+	// Time when the session was last active.
+	LastSeen   time.Time
+	RemoteAddr string
+	UserAgent  string
+	Platform   string
+	DeviceId   string
+	// Reconnection token used by the session, if any. It's revoked together with the session.
+	Resume string
+}
+
+// CallRecord is a record of a video call.
+type CallRecord struct {
+	Topic string
+	// ID of the message which started the call.
+	SeqId int
+	// Name of the SFU room of a group call, blank for P2P calls.
+	Room string
+	// User ID as string (without 'usr' prefix) of the user who started the call.
+	Owner     string
+	CreatedAt time.Time
+	// Time when the call ended, nil while the call is in progress.
+	EndedAt *time.Time
+	// Final state of the call: "finished", "missed", "declined" or "disconnected". Blank while the call
+	// is in progress.
+	Outcome string
+	// Duration of the established call in milliseconds.
+	Duration int
+	// IDs of users who took part in the call.
+	Participants []string
+}
+
+// KeyBundle is a set of public keys of a user's device used to establish end-to-end encrypted sessions
+// with the device. The keys are opaque to the server.
+type KeyBundle struct {
+	// User ID as string (without 'usr' prefix).
+	User string
+	// Client-assigned ID of the device.
+	DeviceId string
+	// Long-term identity key of the device.
+	IdentityKey []byte
+	// Signed prekey and its signature made with the identity key.
+	SignedPreKey []byte
+	Signature    []byte
+	// One-time prekeys. When the bundle is fetched by other users, it contains at most one key
+	// which is removed from the store.
+	OneTimeKeys [][]byte
+	// Number of one-time prekeys left in the store.
+	OneTimeCount int
+	UpdatedAt    time.Time
+}
+
+// SenderKey is a sender key distribution message: the sender's key of a group topic encrypted for
+// one device of another member of the topic. It's kept until fetched by the recipient.
+type SenderKey struct {
+	Topic string
+	// Sender's user ID as string (without 'usr' prefix).
+	From string
+	// Sender's device ID.
+	FromDevice string
+	// Recipient's user ID as string (without 'usr' prefix).
+	User string
+	// Recipient's device ID.
+	DeviceId  string
+	Data      []byte
+	CreatedAt time.Time
+}
+
+// ErasureReport is the number of records deleted or anonymized by the erasure of a user, or which would
+// be affected in a dry run, by kind of the record, e.g. "messages" or "files".
+type ErasureReport map[string]int
+
+// Categories of topics with separate message retention periods.
+const (
+	// RetentionP2P is the category of p2p topics.
+	RetentionP2P = "p2p"
+	// RetentionGrp is the category of group topics which are not channels.
+	RetentionGrp = "grp"
+	// RetentionChn is the category of channels.
+	RetentionChn = "chn"
+)
+
+// MessageTier is a range of messages moved out of the database to cold storage.
+type MessageTier struct {
+	Topic string
+	// Range of message IDs [Low, Hi). Messages of the range which were not moved remain in the database.
+	Low int
+	Hi  int
+	// Number of messages in the blob.
+	Count int
+	// Key of the blob in cold storage.
+	Key       string
+	CreatedAt time.Time
+}
+
+// RetentionBatch is the messages of a topic older than the retention period: the largest message ID
+// and the number of messages.
+type RetentionBatch struct {
+	Topic string
+	SeqId int
+	Count int
+}
+
+// Report statuses.
+const (
+	// ReportOpen is a report waiting for a decision of moderators.
+	ReportOpen = "open"
+	// ReportDismissed is a report closed by moderators without action.
+	ReportDismissed = "dismissed"
+	// ReportActioned is a report closed by moderators who took action.
+	ReportActioned = "actioned"
+)
+
+// Report is a complaint about a message or a user filed for review by moderators.
+type Report struct {
+	ObjHeader `bson:",inline"`
+	// ID of the user who filed the report as string (without 'usr' prefix).
+	Reporter string
+	// ID of the reported user: the sender of the reported message or the reported user.
+	Target string
+	// Topic and ID of the reported message. Blank and 0 if the report is about a user.
+	Topic   string
+	SeqId   int
+	Reason  string
+	Comment string
+	// Snapshot of the reported message or user at the time of the report, possibly encrypted at rest.
+	Evidence any
+	Status   string
+	// The report has been posted to the 'rpt' topic.
+	Posted bool
+	// Moderator who resolved the report and the action taken.
+	ResolvedBy string
+	Action     string
 }
 
 // TopicCat is an enum of topic categories.
@@ -1381,7 +1808,7 @@ func GetTopicCat(name string) TopicCat {
 		return TopicCatGrp
 	case "fnd":
 		return TopicCatFnd
-	case "sys":
+	case "sys", "rpt":
 		return TopicCatSys
 	case "slf":
 		return TopicCatSlf
@@ -1410,6 +1837,413 @@ type DeviceDef struct {
 	Lang string
 }
 
+// UserDevice is a device registered by the user: a named client installation with a stable ID.
+type UserDevice struct {
+	// Client-assigned ID of the device, the same as the device ID used by end-to-end encryption.
+	Id string
+	// User ID as string (without 'usr' prefix).
+	User string
+	// User-assigned name of the device.
+	Name       string
+	Platform   string
+	AppVersion string
+	// Public key of the device.
+	PublicKey []byte
+	// Push notification token of the device, if any. The same as DeviceDef.DeviceId.
+	PushToken string
+	// Push notifications are sent to the device.
+	Push      bool
+	CreatedAt time.Time
+	// Time when the device was last active.
+	LastSeen time.Time
+
+	// Delivery state, not stored.
+
+	// Number of one-time prekeys left, -1 if the device has no key bundle.
+	OneTimeKeys int
+	// Number of sender key distribution messages waiting for the device.
+	SenderKeys int
+}
+
+// NotifySettings are the user's settings of push notifications.
+type NotifySettings struct {
+	// User ID as string (without 'usr' prefix).
+	User string
+	// BCP 47 tag of the language of notification texts, empty to use the language of the user's device.
+	Lang string
+	// Do not include previews of message content into notifications.
+	NoPreview bool
+	// Quiet hours as minutes after midnight in the user's time zone: notifications are silent from
+	// QuietStart till QuietEnd. There are no quiet hours if the values are equal.
+	QuietStart int
+	QuietEnd   int
+	// IANA name of the user's time zone, e.g. "Europe/Berlin". UTC if empty.
+	TimeZone string
+	// Lowercase words which alert the user like @mentions when found in messages.
+	Keywords StringSlice
+	// Notify by SMS of messages received while the user is offline.
+	Sms       bool
+	UpdatedAt time.Time
+}
+
+// IsQuiet checks if the time falls within the user's quiet hours.
+func (ns *NotifySettings) IsQuiet(now time.Time) bool {
+	if ns.QuietStart == ns.QuietEnd {
+		return false
+	}
+	if ns.TimeZone != "" {
+		if loc, err := time.LoadLocation(ns.TimeZone); err == nil {
+			now = now.In(loc)
+		}
+	} else {
+		now = now.UTC()
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	if ns.QuietStart < ns.QuietEnd {
+		return minutes >= ns.QuietStart && minutes < ns.QuietEnd
+	}
+	// Quiet hours span midnight.
+	return minutes >= ns.QuietStart || minutes < ns.QuietEnd
+}
+
+// TopicNotifySettings are the user's settings of push notifications from one topic.
+type TopicNotifySettings struct {
+	Topic string
+	// User ID as string (without 'usr' prefix).
+	User string
+	// Notifications from the topic are not sent until this time.
+	MuteUntil *time.Time
+	// Notifications are sent only for messages which mention the user.
+	MentionsOnly bool
+	UpdatedAt    time.Time
+}
+
+// IsMuted checks if notifications from the topic are muted at the given time.
+func (tns *TopicNotifySettings) IsMuted(now time.Time) bool {
+	return tns.MuteUntil != nil && tns.MuteUntil.After(now)
+}
+
+// Who can see the time when the user was last online. Everyone if blank.
+const (
+	// Users whose presence the user follows in their p2p topic.
+	PresenceSeenContacts = "contacts"
+	// Nobody.
+	PresenceSeenNobody = "nobody"
+)
+
+// Overrides of sharing presence in a topic. The user's presence settings apply if blank.
+const (
+	// Share presence in the topic even if the user is invisible.
+	PresenceShareShow = "show"
+	// Appear offline in the topic.
+	PresenceShareHide = "hide"
+)
+
+// PresenceSettings are the user's settings of presence privacy.
+type PresenceSettings struct {
+	// User ID as string (without 'usr' prefix).
+	User string
+	// Appear offline to everyone.
+	Invisible bool
+	// Who can see the time when the user was last online: blank for everyone, PresenceSeenContacts
+	// or PresenceSeenNobody.
+	LastSeen  string
+	UpdatedAt time.Time
+}
+
+// Shares checks if the user shares presence in a topic given the override of the topic. Safe to call on nil.
+func (ps *PresenceSettings) Shares(share string) bool {
+	switch share {
+	case PresenceShareShow:
+		return true
+	case PresenceShareHide:
+		return false
+	}
+	return ps == nil || !ps.Invisible
+}
+
+// TopicPresenceSettings is the user's override of sharing presence in one topic.
+type TopicPresenceSettings struct {
+	Topic string
+	// User ID as string (without 'usr' prefix).
+	User string
+	// PresenceShareShow, PresenceShareHide or blank to follow the user's settings.
+	Share     string
+	UpdatedAt time.Time
+}
+
+// Mention is an entry of the index of messages which mention users or contain their keywords.
+type Mention struct {
+	// Mentioned user ID as string (without 'usr' prefix).
+	User  string
+	Topic string
+	SeqId int
+	// Sender of the message as user ID string.
+	From string
+	// The keyword found in the message, empty for @mentions.
+	Keyword   string
+	CreatedAt time.Time
+}
+
+// TopicUnread is the number of unread messages of the user in a topic.
+type TopicUnread struct {
+	Topic string
+	// Community the topic belongs to, if any.
+	Parent string
+	Unread int
+	// Number of unread messages which mention the user.
+	Mentions int
+}
+
+// Draft is a message which the user is composing in a topic, shared between user's devices.
+type Draft struct {
+	// User ID as string (without 'usr' prefix).
+	User  string
+	Topic string
+	// Content of the draft, nil if the draft was deleted.
+	Content any
+	// Time of the change as reported by the client. The latest change wins.
+	UpdatedAt time.Time
+}
+
+// StarredMessage is a copy of a message saved by the user. It's kept after the user leaves the topic.
+type StarredMessage struct {
+	// User ID as string (without 'usr' prefix).
+	User  string
+	Topic string
+	SeqId int
+	// Sender of the message as user ID string.
+	From    string
+	Head    KVMap
+	Content any
+	// Time when the message was sent.
+	SentAt time.Time
+	// Time when the message was starred.
+	CreatedAt time.Time
+}
+
+// Block is a user blocked by another user across all topics.
+type Block struct {
+	// ID of the blocking user as string (without 'usr' prefix).
+	User string
+	// ID of the blocked user as string (without 'usr' prefix).
+	Target    string
+	CreatedAt time.Time
+}
+
+// Invite is a link to join a group topic.
+type Invite struct {
+	// Secret token of the link.
+	Token string
+	Topic string
+	// ID of the user who created the link as string (without 'usr' prefix).
+	CreatedBy string
+	CreatedAt time.Time
+	// Time when the link expires, nil if it does not expire.
+	ExpiresAt *time.Time
+	// Maximum number of users who may join by the link, 0 if unlimited.
+	MaxUses int
+	// Number of users who joined by the link.
+	Uses int
+	// Users who join by the link wait for approval by topic managers.
+	Approval bool
+}
+
+// DirectoryEntry is a group topic published in the public directory.
+type DirectoryEntry struct {
+	Topic string
+	// Category of the topic in the directory.
+	Category string
+	// Short description of the topic.
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+
+	// Fields of the topic loaded with listings of the directory.
+	UseBt     bool
+	Public    any
+	Tags      StringSlice
+	SubCnt    int
+	TouchedAt time.Time
+}
+
+// Webhook is an HTTP endpoint which receives events of topics.
+type Webhook struct {
+	Id string
+	// Topic of the webhook, empty for server-wide webhooks which receive events of all topics.
+	Topic string
+	// URL of the endpoint.
+	URL string
+	// Secret used to sign requests.
+	Secret string
+	// Names of the events to deliver, all events if empty.
+	Events    StringSlice
+	CreatedAt time.Time
+}
+
+// Formats of messages posted through incoming webhooks.
+const (
+	// Plain text.
+	InWebhookText = "text"
+	// Drafty document.
+	InWebhookDrafty = "drafty"
+	// Arbitrary JSON posted with head.mime=application/json.
+	InWebhookJSON = "json"
+)
+
+// IncomingWebhook is an HTTP endpoint which posts messages to a topic on behalf of a bot user.
+type IncomingWebhook struct {
+	// Secret token which identifies the webhook in the URL.
+	Token string
+	// Topic to post messages to.
+	Topic string
+	// User posting the messages.
+	User string
+	// Format of the messages: InWebhookText, InWebhookDrafty or InWebhookJSON.
+	Format string
+	// Optional Go template which converts the request payload to the message.
+	Template  string
+	CreatedAt time.Time
+}
+
+// MatrixRoom is a Matrix room bridged to a topic.
+type MatrixRoom struct {
+	Topic string
+	// ID of the room, i.e. "!abc:example.com".
+	Room      string
+	CreatedAt time.Time
+}
+
+// Delivery statuses of SMS notifications.
+const (
+	// Accepted for sending.
+	SmsQueued = "queued"
+	// Sent to the provider.
+	SmsSent = "sent"
+	// Delivered to the phone.
+	SmsDelivered = "delivered"
+	// Failed to send or to deliver.
+	SmsFailed = "failed"
+)
+
+// SmsMessage is an SMS notification sent to a user.
+type SmsMessage struct {
+	ObjHeader
+	// User ID as string (without 'usr' prefix).
+	User string
+	// Topic and the sequence ID of the message the user was notified of.
+	Topic string
+	SeqId int
+	// Phone number the notification was sent to.
+	Phone string
+	// Name of the SMS provider and the ID of the SMS assigned by the provider.
+	Provider   string
+	ProviderId string
+	// Delivery status: SmsQueued, SmsSent, SmsDelivered or SmsFailed.
+	Status string
+	// Error reported by the provider.
+	Error string
+}
+
+// Mailbox is an email address of the email gateway which posts received emails to a topic.
+type Mailbox struct {
+	// Email address, lowercase.
+	Address string
+	// Topic to post emails to.
+	Topic string
+	// User posting the emails.
+	User string
+	// Replies to the emails posted to the topic are sent back to the senders by email.
+	Reply     bool
+	CreatedAt time.Time
+}
+
+// Tenant is an organization with its own isolated set of users, topics and files.
+type Tenant struct {
+	// Unique name of the tenant: lowercase letters, digits and dashes.
+	Id string
+	// Human-readable name.
+	Name string
+	// Host names which clients of the tenant connect to.
+	Hosts StringSlice
+	// Overrides of the server configuration.
+	Config    TenantConfig
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TenantConfig contains overrides of the server configuration for one tenant.
+type TenantConfig struct {
+	// Authentication schemes the users of the tenant may use, all schemes if empty.
+	AuthSchemes []string `json:",omitempty"`
+	// Messages of topic categories with a server retention policy are kept for this many days: 0 means
+	// the server retention period applies, a negative value means messages are kept forever.
+	RetentionDays int `json:",omitempty"`
+	// Maximum total size of files uploaded by one user, bytes: 0 means the server quota applies,
+	// a negative value means unlimited.
+	UserQuota int64 `json:",omitempty"`
+	// Maximum total size of files attached to messages of one topic, bytes: 0 means the server quota
+	// applies, a negative value means unlimited.
+	TopicQuota int64 `json:",omitempty"`
+	// Monthly usage limits of each user of the tenant by metric: override limits of the server.
+	AccountLimits map[string]UsageLimit `json:",omitempty"`
+	// Monthly usage limits of all users of the tenant together by metric.
+	Limits map[string]UsageLimit `json:",omitempty"`
+}
+
+// Scan implements sql.Scanner interface.
+func (tc *TenantConfig) Scan(val any) error {
+	if val == nil {
+		return nil
+	}
+	return json.Unmarshal(val.([]byte), tc)
+}
+
+// Value implements sql's driver.Valuer interface.
+func (tc TenantConfig) Value() (driver.Value, error) {
+	return json.Marshal(tc)
+}
+
+// Metered usage metrics.
+const (
+	// Messages sent.
+	UsageMessages = "messages"
+	// Push notifications sent.
+	UsagePushes = "pushes"
+	// Minutes of calls.
+	UsageCallMinutes = "call_minutes"
+)
+
+// UsageLimit is a limit of a usage metric per billing period: usage over the soft limit is reported,
+// usage over the hard limit is rejected. 0 means no limit.
+type UsageLimit struct {
+	Soft int64 `json:",omitempty"`
+	Hard int64 `json:",omitempty"`
+}
+
+// UsageRecord is usage of one user or of all users of a tenant in one billing period.
+type UsageRecord struct {
+	// Billing period, calendar month in UTC as YYYY-MM.
+	Period string
+	Tenant string
+	// User ID as string (without 'usr' prefix), blank in usage of a tenant.
+	User     string
+	Messages int64
+	Pushes   int64
+	// Duration of calls the user took part in, seconds.
+	CallSeconds int64
+	// Total size of uploaded files at the time of the query, bytes.
+	Storage int64
+}
+
+// ContactHash is a user found by the hash of a phone number or email.
+type ContactHash struct {
+	// Hash of the phone number or email tag, hex-encoded.
+	Hash string
+	// User ID as string (without 'usr' prefix).
+	User string
+}
+
 // Media handling constants
 const (
 	// UploadStarted indicates that the upload has started but not finished yet.
@@ -1420,8 +2254,37 @@ const (
 	UploadFailed
 	// UploadDeleted indicates that the upload is no longer needed and can be deleted.
 	UploadDeleted
+	// UploadQuarantined indicates that malware was found in the file. The file is kept for review
+	// but not served.
+	UploadQuarantined
+)
+
+// Verdicts of malware scans.
+const (
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanError    = "error"
 )
 
+// FileScan is the result of a malware scan of an uploaded file.
+type FileScan struct {
+	// Name of the scanner.
+	Scanner string `json:"scanner"`
+	// Verdict: "clean", "infected" or "error".
+	Verdict string `json:"verdict"`
+	// Name of the detected threat or the error.
+	Details   string    `json:"details,omitempty"`
+	ScannedAt time.Time `json:"ts"`
+}
+
+// MediaInfo describes the content of an audio or video file.
+type MediaInfo struct {
+	// Duration in milliseconds.
+	Duration int `json:"duration,omitempty"`
+	// Amplitudes of the sound, 0-255, evenly spaced over the duration.
+	Waveform []byte `json:"waveform,omitempty"`
+}
+
 // FileDef is a stored record of a file upload
 type FileDef struct {
 	ObjHeader `bson:",inline"`
@@ -1437,6 +2300,12 @@ type FileDef struct {
 	Location string
 	// ETag generated by the file server.
 	ETag string
+	// Result of the malware scan, nil if the file was not scanned.
+	Scan *FileScan `json:",omitempty"`
+	// Properties of audio and video files, nil if unknown.
+	Media *MediaInfo `json:",omitempty"`
+	// Tenant of the user who uploaded the file. Assigned by the store.
+	Tenant string `json:",omitempty"`
 }
 
 // FlattenDoubleSlice turns 2d slice into a 1d slice.
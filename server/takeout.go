@@ -0,0 +1,370 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Export of all data of the user's account (takeout). The user requests
+ *    the export with {takeout}. The export is prepared by a background worker
+ *    as a zip archive with the profile, credentials, subscriptions, messages
+ *    sent by the user and the files uploaded by the user. The archive is
+ *    saved by the media handler and can be downloaded only by the owner.
+ *    Progress is reported to the user's 'me' topic as
+ *    {info what="takeout" event="progress|ready|failed"}.
+ *
+ *    A user may request one export per configured period. Failed exports
+ *    don't count.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"os"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Mime type of takeout archives. Files of this type can be downloaded by the owner only.
+	takeoutMimeType = "application/vnd.tinode.takeout+zip"
+	// Export not completed in this time is considered failed, i.e. the node has crashed.
+	takeoutJobTimeout = 24 * time.Hour
+	// Number of messages to read from the store at once.
+	takeoutMsgBatchSize = 100
+)
+
+// Takeout config.
+type takeoutConfig struct {
+	Enabled bool `json:"enabled"`
+	// Minimum interval between exports of one user (days).
+	PeriodDays int `json:"period_days"`
+	// How long the archive is available for download (hours).
+	ExpiresHours int `json:"expires_hours"`
+	// Maximum number of exports waiting to be processed by this node.
+	QueueSize int `json:"queue_size"`
+}
+
+// takeoutState returns the status of the export taking into account the exports abandoned by crashed nodes.
+func takeoutState(tk *types.Takeout, now time.Time) string {
+	if tk.Status == types.TakeoutPending && tk.CreatedAt.Add(takeoutJobTimeout).Before(now) {
+		return types.TakeoutFailed
+	}
+	return tk.Status
+}
+
+// takeoutParams formats the status of the export for the client.
+func takeoutParams(tk *types.Takeout, now time.Time) map[string]any {
+	params := map[string]any{
+		"takeout": tk.Id,
+		"status":  takeoutState(tk, now),
+	}
+	if tk.Status == types.TakeoutReady && tk.ExpiresAt != nil && tk.ExpiresAt.After(now) {
+		params["url"] = tk.Url
+		params["expires"] = *tk.ExpiresAt
+	}
+	if tk.Status != types.TakeoutFailed {
+		params["next"] = tk.CreatedAt.Add(globals.takeoutPeriod)
+	}
+	return params
+}
+
+// takeout starts export of the user's data unless the user has exported the data recently.
+// Otherwise it reports the status of the most recent export.
+func (s *Session) takeout(msg *ClientComMessage) {
+	now := types.TimeNow()
+	if globals.takeoutQueue == nil {
+		s.queueOut(ErrNotImplemented(msg.Id, "", now, msg.Timestamp))
+		return
+	}
+
+	uid := types.ParseUserId(msg.AsUser)
+	last, err := store.Takeouts.GetLast(uid)
+	if err != nil {
+		s.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, "", now, msg.Timestamp, nil))
+		return
+	}
+	if last != nil {
+		state := takeoutState(last, now)
+		if state == types.TakeoutPending ||
+			(state == types.TakeoutReady && last.CreatedAt.Add(globals.takeoutPeriod).After(now)) {
+			s.queueOut(NoErrParamsExplicitTs(msg.Id, "", now, msg.Timestamp, takeoutParams(last, now)))
+			return
+		}
+	}
+
+	tk := &types.Takeout{User: uid.String()}
+	if err = store.Takeouts.Create(tk); err != nil {
+		s.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, "", now, msg.Timestamp, nil))
+		return
+	}
+
+	select {
+	case globals.takeoutQueue <- tk:
+	default:
+		tk.Status = types.TakeoutFailed
+		if err = store.Takeouts.Finish(tk); err != nil {
+			logs.Warn.Println("takeout: failed to save status", tk.Id, err)
+		}
+		s.queueOut(ErrServiceUnavailableExplicitTs(msg.Id, "", now, msg.Timestamp))
+		logs.Err.Println("s.takeout: queue full", s.sid)
+		return
+	}
+
+	resp := NoErrAcceptedExplicitTs(msg.Id, "", now, msg.Timestamp)
+	resp.Ctrl.Params = takeoutParams(tk, now)
+	s.queueOut(resp)
+}
+
+// takeoutNotify informs the user's sessions about the progress of the export.
+func takeoutNotify(uid types.Uid, event string, payload map[string]any) {
+	data, _ := json.Marshal(payload)
+	globals.hub.routeSrv <- &ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic:   "me",
+			What:    "takeout",
+			Event:   event,
+			Payload: data,
+		},
+		RcptTo: uid.UserId(),
+	}
+}
+
+// takeoutProcess prepares the archive with the user's data and saves it with the media handler.
+func takeoutProcess(tk *types.Takeout) {
+	uid := types.ParseUid(tk.User)
+	var reported int
+	progress := func(percent int) {
+		// Report every 5% at most.
+		if percent-reported >= 5 {
+			reported = percent
+			takeoutNotify(uid, "progress", map[string]any{"takeout": tk.Id, "progress": percent})
+		}
+	}
+
+	var url string
+	var size int64
+	tmp, err := os.CreateTemp("", "takeout-*.zip")
+	if err == nil {
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+		if err = takeoutWriteArchive(tmp, uid, progress); err == nil {
+			_, err = tmp.Seek(0, io.SeekStart)
+		}
+	}
+	if err == nil {
+		fdef := &types.FileDef{
+			ObjHeader: types.ObjHeader{
+				Id: store.Store.GetUidString(),
+			},
+			User:     tk.User,
+			MimeType: takeoutMimeType,
+		}
+		fdef.InitTimes()
+		if url, size, err = store.Store.GetMediaHandler().Upload(fdef, tmp); err != nil {
+			store.Files.FinishUpload(fdef, false, 0)
+		} else if _, err = store.Files.FinishUpload(fdef, true, size); err == nil {
+			tk.FileId = fdef.Id
+		}
+	}
+
+	if err != nil {
+		logs.Warn.Println("takeout: export failed", tk.Id, err)
+		tk.Status = types.TakeoutFailed
+	} else {
+		expires := types.TimeNow().Add(globals.takeoutExpires)
+		tk.Status = types.TakeoutReady
+		tk.Url = url
+		tk.ExpiresAt = &expires
+	}
+	if err := store.Takeouts.Finish(tk); err != nil {
+		logs.Warn.Println("takeout: failed to save status", tk.Id, err)
+		tk.Status = types.TakeoutFailed
+	}
+
+	if tk.Status == types.TakeoutReady {
+		takeoutNotify(uid, "ready", map[string]any{"takeout": tk.Id, "url": tk.Url, "expires": *tk.ExpiresAt})
+	} else {
+		takeoutNotify(uid, "failed", map[string]any{"takeout": tk.Id})
+	}
+}
+
+// takeoutWriteArchive writes the user's data to a zip archive. Progress is reported in percent.
+func takeoutWriteArchive(dst io.Writer, uid types.Uid, progress func(int)) error {
+	zw := zip.NewWriter(dst)
+	writeJSON := func(name string, val any) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(val)
+	}
+
+	// Profile.
+	user, err := store.Users.Get(uid)
+	if err == nil && user == nil {
+		err = types.ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err = writeJSON("profile.json", map[string]any{
+		"id":         uid.UserId(),
+		"created":    user.CreatedAt,
+		"updated":    user.UpdatedAt,
+		"state":      user.State.String(),
+		"defacs":     map[string]string{"auth": user.Access.Auth.String(), "anon": user.Access.Anon.String()},
+		"public":     user.Public,
+		"trusted":    user.Trusted,
+		"tags":       user.Tags,
+		"last_seen":  user.LastSeen,
+		"user_agent": user.UserAgent,
+	}); err != nil {
+		return err
+	}
+
+	// Credentials.
+	creds, err := store.Users.GetAllCreds(uid, "", false)
+	if err != nil {
+		return err
+	}
+	credList := []map[string]any{}
+	for i := range creds {
+		credList = append(credList, map[string]any{
+			"meth": creds[i].Method,
+			"val":  creds[i].Value,
+			"done": creds[i].Done,
+		})
+	}
+	if err = writeJSON("credentials.json", credList); err != nil {
+		return err
+	}
+
+	// Subscriptions.
+	subs, err := store.Users.GetSubs(uid)
+	if err != nil {
+		return err
+	}
+	subList := []map[string]any{}
+	for i := range subs {
+		sub := &subs[i]
+		subList = append(subList, map[string]any{
+			"topic":   sub.Topic,
+			"created": sub.CreatedAt,
+			"updated": sub.UpdatedAt,
+			"want":    sub.ModeWant.String(),
+			"given":   sub.ModeGiven.String(),
+			"read":    sub.ReadSeqId,
+			"recv":    sub.RecvSeqId,
+			"private": sub.Private,
+		})
+	}
+	if err = writeJSON("subscriptions.json", subList); err != nil {
+		return err
+	}
+	progress(10)
+
+	// Messages sent by the user, one JSON object per line.
+	w, err := zw.Create("messages.jsonl")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	var afterId int64
+	for {
+		var msgs []types.Message
+		if msgs, afterId, err = store.Messages.GetAllBySender(uid, afterId, takeoutMsgBatchSize); err != nil {
+			return err
+		}
+		for i := range msgs {
+			msg := &msgs[i]
+			if err = enc.Encode(map[string]any{
+				"topic":   msg.Topic,
+				"seq":     msg.SeqId,
+				"ts":      msg.CreatedAt,
+				"head":    msg.Head,
+				"content": msg.Content,
+			}); err != nil {
+				return err
+			}
+		}
+		if len(msgs) < takeoutMsgBatchSize {
+			break
+		}
+	}
+	progress(50)
+
+	// Files uploaded by the user. Content of files which cannot be read by the server, i.e. stored
+	// in an external storage without encryption, is not included.
+	files, err := store.Files.GetAllByUser(uid)
+	if err != nil {
+		return err
+	}
+	mh := store.Store.GetMediaHandler()
+	fileList := []map[string]any{}
+	for i := range files {
+		fd := &files[i]
+		if fd.MimeType == takeoutMimeType {
+			continue
+		}
+		entry := map[string]any{
+			"id":      fd.Id,
+			"created": fd.CreatedAt,
+			"mime":    fd.MimeType,
+			"size":    fd.Size,
+		}
+		name := "files/" + fd.Id
+		if ext, _ := mime.ExtensionsByType(fd.MimeType); len(ext) > 0 {
+			name += ext[0]
+		}
+		if _, rsc, err := mh.Download(fd.Id); err == nil {
+			w, err := zw.Create(name)
+			if err == nil {
+				_, err = io.Copy(w, rsc)
+			}
+			rsc.Close()
+			if err != nil {
+				return err
+			}
+			entry["name"] = name
+		} else if !errors.Is(err, types.ErrUnsupported) && !errors.Is(err, types.ErrNotFound) {
+			return err
+		}
+		fileList = append(fileList, entry)
+		progress(50 + 45*(i+1)/len(files))
+	}
+	if err = writeJSON("files.json", fileList); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// takeoutRunWorker processes queued exports one at a time.
+// Returns channel which can be used to stop the process.
+func takeoutRunWorker(queue <-chan *types.Takeout) chan<- bool {
+	// Unbuffered stop channel. Whomever stops the worker must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		logs.Info.Println("Takeout worker started")
+		for {
+			select {
+			case tk := <-queue:
+				takeoutProcess(tk)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
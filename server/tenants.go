@@ -0,0 +1,234 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Multi-tenancy: isolated namespaces of users, topics and files within one
+ *    server. Users belong to the tenant of the host they registered at, topics
+ *    and files belong to the tenant of their users. Search, contact discovery,
+ *    the directory and p2p topics never cross tenant boundaries. Users and
+ *    topics created without a tenant belong to the default tenant, blank.
+ *
+ *    Clients of a tenant connect to one of its hosts. The tenant of a session
+ *    is found by the Host header of the HTTP request. Sessions at a tenant's
+ *    host accept logins of the tenant's users only.
+ *
+ *    Multi-tenancy is enabled in the config. Tenants are provisioned through
+ *    the admin API and may override the authentication schemes, the message
+ *    retention period, storage quotas and usage limits of the server.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Tenants are reloaded after this time: changes made at other cluster nodes become visible.
+	tenantCacheTTL = time.Minute
+	// The cache of tenants of users is cleared when it grows to this size.
+	userTenantCacheSize = 8192
+)
+
+// Multi-tenancy config.
+type tenantsConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Tenant IDs are lowercase letters, digits and dashes.
+var tenantIdRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Provisioned tenants. Maps are replaced on reload, not modified.
+var tenantCache struct {
+	sync.Mutex
+	byId     map[string]*types.Tenant
+	byHost   map[string]string
+	loadedAt time.Time
+}
+
+// Tenants of users. Tenant of a user never changes.
+var userTenantCache struct {
+	sync.Mutex
+	entries map[types.Uid]string
+}
+
+// tenantsLoad returns tenants by ID and IDs of tenants by host, loading them from the store if needed.
+func tenantsLoad() (map[string]*types.Tenant, map[string]string) {
+	if !globals.tenantsEnabled {
+		return nil, nil
+	}
+
+	now := time.Now()
+
+	tenantCache.Lock()
+	defer tenantCache.Unlock()
+
+	if now.Sub(tenantCache.loadedAt) < tenantCacheTTL {
+		return tenantCache.byId, tenantCache.byHost
+	}
+
+	tenants, err := store.Tenants.GetAll()
+	if err != nil {
+		logs.Warn.Println("tenants: failed to load tenants:", err)
+		// Keep using stale tenants.
+		return tenantCache.byId, tenantCache.byHost
+	}
+	byId := make(map[string]*types.Tenant, len(tenants))
+	byHost := make(map[string]string)
+	for i := range tenants {
+		byId[tenants[i].Id] = &tenants[i]
+		for _, host := range tenants[i].Hosts {
+			byHost[host] = tenants[i].Id
+		}
+	}
+	tenantCache.byId, tenantCache.byHost, tenantCache.loadedAt = byId, byHost, now
+	return byId, byHost
+}
+
+// tenantsInvalidate forces reloading of tenants after they were changed.
+func tenantsInvalidate() {
+	tenantCache.Lock()
+	tenantCache.loadedAt = time.Time{}
+	tenantCache.Unlock()
+}
+
+// tenantGet returns the tenant with the given ID or nil for the default or unknown tenant.
+func tenantGet(id string) *types.Tenant {
+	if id == "" {
+		return nil
+	}
+	byId, _ := tenantsLoad()
+	return byId[id]
+}
+
+// tenantByHost returns the ID of the tenant which serves the host, blank if none does.
+func tenantByHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	_, byHost := tenantsLoad()
+	return byHost[strings.ToLower(host)]
+}
+
+// userTenant returns the ID of the tenant of the user.
+func userTenant(uid types.Uid) (string, error) {
+	if uid.IsZero() {
+		return "", nil
+	}
+	if byId, _ := tenantsLoad(); len(byId) == 0 {
+		// No tenants: everyone belongs to the default tenant. A tenant with users cannot be deleted.
+		return "", nil
+	}
+
+	userTenantCache.Lock()
+	tenant, ok := userTenantCache.entries[uid]
+	userTenantCache.Unlock()
+	if ok {
+		return tenant, nil
+	}
+
+	user, err := store.Users.Get(uid)
+	if err != nil {
+		return "", err
+	}
+	if user == nil {
+		return "", types.ErrUserNotFound
+	}
+
+	userTenantCache.Lock()
+	if userTenantCache.entries == nil || len(userTenantCache.entries) >= userTenantCacheSize {
+		userTenantCache.entries = make(map[types.Uid]string)
+	}
+	userTenantCache.entries[uid] = user.Tenant
+	userTenantCache.Unlock()
+
+	return user.Tenant, nil
+}
+
+// tenantAuthAllowed checks if the users of the tenant may use the authentication scheme.
+func tenantAuthAllowed(tenant, scheme string) bool {
+	t := tenantGet(tenant)
+	if t == nil || len(t.Config.AuthSchemes) == 0 {
+		return true
+	}
+	// Tokens, session resumption and refresh tokens are issued after authentication
+	// with one of the allowed schemes.
+	switch scheme {
+	case "token", "resume", "refresh":
+		return true
+	}
+	for _, allowed := range t.Config.AuthSchemes {
+		if allowed == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantQuotas returns storage quotas of users and topics of the tenant, 0 if unlimited.
+func tenantQuotas(tenant string) (int64, int64) {
+	user, topic := globals.userMediaQuota, globals.topicMediaQuota
+	if t := tenantGet(tenant); t != nil {
+		// Negative quotas of the tenant mean unlimited.
+		if t.Config.UserQuota < 0 {
+			user = 0
+		} else if t.Config.UserQuota > 0 {
+			user = t.Config.UserQuota
+		}
+		if t.Config.TopicQuota < 0 {
+			topic = 0
+		} else if t.Config.TopicQuota > 0 {
+			topic = t.Config.TopicQuota
+		}
+	}
+	return user, topic
+}
+
+// tenantRetention returns retention periods in days of tenants which override the retention period
+// of the server, negative if messages are kept forever.
+func tenantRetention() map[string]int {
+	byId, _ := tenantsLoad()
+	overrides := make(map[string]int)
+	for id, t := range byId {
+		if t.Config.RetentionDays != 0 {
+			overrides[id] = t.Config.RetentionDays
+		}
+	}
+	return overrides
+}
+
+// tenantValidate checks the tenant provisioned through the admin API and normalizes its hosts.
+func tenantValidate(t *types.Tenant) error {
+	if !tenantIdRegexp.MatchString(t.Id) {
+		return errors.New("invalid tenant id")
+	}
+	_, byHost := tenantsLoad()
+	for i, host := range t.Hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			return errors.New("empty host")
+		}
+		if owner, ok := byHost[host]; ok && owner != t.Id {
+			return errors.New("host '" + host + "' belongs to tenant '" + owner + "'")
+		}
+		t.Hosts[i] = host
+	}
+	for _, scheme := range t.Config.AuthSchemes {
+		if store.Store.GetLogicalAuthHandler(scheme) == nil {
+			return errors.New("unknown authentication scheme '" + scheme + "'")
+		}
+	}
+	if err := meterValidateLimits(t.Config.AccountLimits); err != nil {
+		return err
+	}
+	return meterValidateLimits(t.Config.Limits)
+}
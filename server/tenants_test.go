@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func setTestTenants(t *testing.T, tenants ...types.Tenant) {
+	globals.tenantsEnabled = true
+	byId := make(map[string]*types.Tenant)
+	byHost := make(map[string]string)
+	for i := range tenants {
+		byId[tenants[i].Id] = &tenants[i]
+		for _, host := range tenants[i].Hosts {
+			byHost[host] = tenants[i].Id
+		}
+	}
+	tenantCache.byId, tenantCache.byHost, tenantCache.loadedAt = byId, byHost, time.Now()
+	t.Cleanup(func() {
+		globals.tenantsEnabled = false
+		tenantCache.byId, tenantCache.byHost, tenantCache.loadedAt = nil, nil, time.Time{}
+	})
+}
+
+func TestTenantLookup(t *testing.T) {
+	globals.userMediaQuota, globals.topicMediaQuota = 100, 200
+	defer func() {
+		globals.userMediaQuota, globals.topicMediaQuota = 0, 0
+	}()
+	setTestTenants(t,
+		types.Tenant{Id: "acme", Hosts: types.StringSlice{"chat.acme.com"},
+			Config: types.TenantConfig{AuthSchemes: []string{"basic"}, UserQuota: 10, TopicQuota: -1}},
+		types.Tenant{Id: "globex", Hosts: types.StringSlice{"globex.example.com"},
+			Config: types.TenantConfig{RetentionDays: -1}})
+
+	for host, expected := range map[string]string{
+		"chat.acme.com":           "acme",
+		"Chat.Acme.com:443":       "acme",
+		"globex.example.com:8080": "globex",
+		"example.com":             "",
+		"":                        "",
+	} {
+		if got := tenantByHost(host); got != expected {
+			t.Errorf("Tenant of '%s': expected '%s', got '%s'", host, expected, got)
+		}
+	}
+
+	if !tenantAuthAllowed("acme", "basic") || !tenantAuthAllowed("acme", "token") ||
+		!tenantAuthAllowed("acme", "resume") || !tenantAuthAllowed("acme", "refresh") || tenantAuthAllowed("acme", "oauth") {
+		t.Error("Auth schemes of the tenant are not respected")
+	}
+	if !tenantAuthAllowed("globex", "oauth") || !tenantAuthAllowed("", "oauth") {
+		t.Error("Tenants without restrictions must allow all auth schemes")
+	}
+
+	if user, topic := tenantQuotas("acme"); user != 10 || topic != 0 {
+		t.Errorf("Quotas of the tenant: got %d, %d", user, topic)
+	}
+	if user, topic := tenantQuotas(""); user != 100 || topic != 200 {
+		t.Errorf("Quotas of the default tenant: got %d, %d", user, topic)
+	}
+
+	if overrides := tenantRetention(); len(overrides) != 1 || overrides["globex"] != -1 {
+		t.Errorf("Unexpected retention overrides %v", overrides)
+	}
+}
+
+func TestTenantValidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	store.Store = ss
+	defer func() {
+		store.Store = nil
+		ctrl.Finish()
+	}()
+	setTestTenants(t, types.Tenant{Id: "acme", Hosts: types.StringSlice{"chat.acme.com"}})
+
+	ss.EXPECT().GetLogicalAuthHandler("basic").Return(nil)
+
+	for _, tenant := range []types.Tenant{
+		{Id: "Acme"},
+		{Id: "-acme"},
+		{Id: "globex", Hosts: types.StringSlice{" "}},
+		{Id: "globex", Hosts: types.StringSlice{"CHAT.acme.com"}},
+		{Id: "globex", Config: types.TenantConfig{AuthSchemes: []string{"basic"}}},
+	} {
+		if err := tenantValidate(&tenant); err == nil {
+			t.Errorf("Invalid tenant %+v accepted", tenant)
+		}
+	}
+
+	tenant := types.Tenant{Id: "acme", Hosts: types.StringSlice{" Chat.Acme.com", "acme.example.com"}}
+	if err := tenantValidate(&tenant); err != nil {
+		t.Fatal(err)
+	}
+	if tenant.Hosts[0] != "chat.acme.com" {
+		t.Errorf("Host is not normalized: '%s'", tenant.Hosts[0])
+	}
+}
+
+func TestOfflineGetDescTenant(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	tt := mock_store.NewMockTopicsPersistenceInterface(ctrl)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	ss := mock_store.NewMockSubsPersistenceInterface(ctrl)
+	prevTopics, prevUsers, prevSubs := store.Topics, store.Users, store.Subs
+	store.Topics, store.Users, store.Subs = tt, uu, ss
+	defer func() {
+		store.Topics, store.Users, store.Subs = prevTopics, prevUsers, prevSubs
+		userTenantCache.Lock()
+		userTenantCache.entries = nil
+		userTenantCache.Unlock()
+		ctrl.Finish()
+	}()
+	setTestTenants(t, types.Tenant{Id: "acme"}, types.Tenant{Id: "globex"})
+
+	member, stranger := types.Uid(101), types.Uid(102)
+	topic := "grpAAAAAAAAAAA"
+	tt.EXPECT().Get(topic).Return(&types.Topic{Tenant: "acme", Public: "Acme"}, nil).Times(2)
+	uu.EXPECT().Get(member).Return(&types.User{Tenant: "acme"}, nil)
+	uu.EXPECT().Get(stranger).Return(&types.User{Tenant: "globex"}, nil)
+	ss.EXPECT().Get(topic, member, false).Return(nil, nil)
+
+	for _, uid := range []types.Uid{member, stranger} {
+		sess := test_makeSession(uid)
+		replyOfflineTopicGetDesc(sess, &ClientComMessage{
+			Get:       &MsgClientGet{Id: "1", Topic: topic, MsgGetQuery: MsgGetQuery{What: "desc"}},
+			AsUser:    uid.UserId(),
+			RcptTo:    topic,
+			Original:  topic,
+			Id:        "1",
+			Timestamp: types.TimeNow(),
+		})
+		resp := (<-sess.send).(*ServerComMessage)
+		if uid == member {
+			if resp.Meta == nil || resp.Meta.Desc == nil || resp.Meta.Desc.Public != "Acme" {
+				t.Errorf("Expected topic description, got %+v", resp)
+			}
+		} else if resp.Ctrl == nil || resp.Ctrl.Code != 404 {
+			// Group topics of another tenant must be invisible.
+			t.Errorf("Expected 404, got %+v", resp)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Threads of replies within a topic. A reply carries the ID of the root
+ *    message of the thread in head.thread as ":123". Messages of a thread are
+ *    fetched with {get what="data" data={thread:123}}, summaries of threads
+ *    with unread counts with {get what="threads"}. Read markers are reported
+ *    with {note what="read" thread=123}, notifications are muted with
+ *    {set thread={seq:123 muted:true}}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// msgThreadId returns the ID of the root message of the thread from message header, or 0.
+func msgThreadId(head map[string]any) int {
+	ref, ok := head["thread"].(string)
+	if !ok || !strings.HasPrefix(ref, ":") {
+		return 0
+	}
+	seq, err := strconv.Atoi(ref[1:])
+	if err != nil || seq <= 0 {
+		return 0
+	}
+	return seq
+}
+
+// normalizeMsgThread removes invalid thread reference from the header of a new message.
+func (t *Topic) normalizeMsgThread(head map[string]any) {
+	if _, ok := head["thread"]; !ok {
+		return
+	}
+	if seq := msgThreadId(head); seq == 0 || seq > t.lastID {
+		delete(head, "thread")
+	}
+}
+
+// replyGetThreads returns summaries of threads in the topic as {meta threads=[...]}.
+func (t *Topic) replyGetThreads(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "" || req.Search != "" ||
+		req.Thread != 0) {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for threads")
+	}
+
+	if userData := t.perUser[asUid]; !(userData.modeGiven & userData.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to get threads by non-reader")
+	}
+
+	threads, err := store.Threads.GetAll(t.name, asUid, msgOpts2storeOpts(req))
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	if len(threads) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "threads"}))
+		return nil
+	}
+
+	result := make([]MsgThread, len(threads))
+	for i := range threads {
+		th := &threads[i]
+		result[i] = MsgThread{
+			SeqId:     th.SeqId,
+			Count:     th.Count,
+			LastSeqId: th.LastSeqId,
+			TouchedAt: th.TouchedAt,
+			ReadSeqId: th.ReadSeqId,
+			Unread:    th.Unread,
+			Muted:     th.Muted,
+		}
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Threads:   result,
+		},
+	})
+	return nil
+}
+
+// replySetThread updates user's settings of a thread.
+func (t *Topic) replySetThread(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for threads")
+	}
+
+	if userData := t.perUser[asUid]; !(userData.modeGiven & userData.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("thread settings update by non-reader")
+	}
+
+	thread := msg.Set.Thread
+	if thread.SeqId <= 0 || thread.SeqId > t.lastID {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid thread ID")
+	}
+
+	err := store.Threads.SetMuted(t.name, asUid, thread.SeqId, thread.Muted)
+	sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+	return err
+}
+
+// handleThreadRead stores user's read marker in a thread and informs other topic subscribers.
+func (t *Topic) handleThreadRead(msg *ClientComMessage, asUid types.Uid) {
+	if err := store.Threads.SetRead(t.name, asUid, msg.Note.Thread, msg.Note.SeqId); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to update thread read marker: %v", t.name, err)
+		return
+	}
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic:  msg.Original,
+			From:   msg.AsUser,
+			What:   "read",
+			SeqId:  msg.Note.SeqId,
+			Thread: msg.Note.Thread,
+		},
+		RcptTo:    msg.RcptTo,
+		AsUser:    msg.AsUser,
+		Timestamp: msg.Timestamp,
+		SkipSid:   msg.sess.sid,
+		sess:      msg.sess,
+	})
+}
+
+// threadMutedBy returns the set of users who muted the thread the message belongs to.
+func (t *Topic) threadMutedBy(head map[string]any) map[types.Uid]bool {
+	threadId := msgThreadId(head)
+	if threadId == 0 {
+		return nil
+	}
+	uids, err := store.Threads.GetMuted(t.name, threadId)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load muted thread subscribers: %v", t.name, err)
+		return nil
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	muted := make(map[types.Uid]bool, len(uids))
+	for _, uid := range uids {
+		muted[uid] = true
+	}
+	return muted
+}
@@ -0,0 +1,95 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Cold storage tiering, see store/tiering.go. Messages older than the
+ *    threshold are moved from the database to blobs in S3 by a background
+ *    mover. The history of topics is read from both transparently.
+ *
+ *    Messages with attachments stay in the database so that the attachments
+ *    are not garbage-collected. Blobs of deleted topics are removed.
+ *
+ *    Messages of topics with the time to live of messages and of topic
+ *    categories with a retention policy stay in the database: the reapers
+ *    find old messages in the database only.
+ *
+ *    Every cluster node periodically checks for old messages but moves
+ *    only those in topics mastered by the node.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// moveColdMessages moves messages older than 'age' of up to 'limit' topics mastered by this node to cold
+// storage, up to 'batchSize' messages per topic. Topics of the retention categories 'skipCats' are skipped.
+// Removes blobs of deleted topics.
+func moveColdMessages(age time.Duration, skipCats []string, limit, batchSize int) {
+	topics, err := store.Messages.GetColdTopics(types.TimeNow().Add(-age), skipCats, limit)
+	if err != nil {
+		logs.Warn.Println("Tiering:", err)
+		return
+	}
+	for _, topic := range topics {
+		if globals.cluster.isRemoteTopic(topic) {
+			// Messages will be moved by the master node of the topic.
+			continue
+		}
+
+		moved, err := store.Messages.MoveCold(topic, types.TimeNow().Add(-age), batchSize)
+		if err != nil {
+			logs.Warn.Printf("topic[%s]: failed to move messages to cold storage: %v", topic, err)
+			continue
+		}
+		if moved > 0 {
+			statsInc("TieringMessagesMovedTotal", moved)
+			statsInc("TieringBlobsTotal", 1)
+		}
+	}
+	statsSet("TieringTopicsPending", int64(len(topics)))
+
+	// Removal is idempotent, any node may remove blobs of deleted topics.
+	if removed, err := store.Messages.DeleteOrphanedTiers(limit); err != nil {
+		logs.Warn.Println("Tiering: failed to remove blobs of deleted topics:", err)
+	} else if removed > 0 {
+		logs.Info.Printf("Tiering: removed %d blobs of deleted topics", removed)
+	}
+}
+
+// tieringRunMover moves messages older than 'age' to cold storage every 'period'. Messages of the retention
+// categories 'skipCats' are not moved.
+// Returns channel which can be used to stop the process.
+func tieringRunMover(period, age time.Duration, skipCats []string, blockSize, batchSize int) chan<- bool {
+	statsRegisterInt("TieringMessagesMovedTotal")
+	statsRegisterInt("TieringBlobsTotal")
+	// Number of topics with old messages found in the last pass.
+	statsRegisterInt("TieringTopicsPending")
+
+	// Unbuffered stop channel. Whomever stops the mover must wait for the process to finish.
+	stop := make(chan bool)
+	go func() {
+		// Add some randomness to the tick period to desynchronize runs on cluster nodes.
+		period = period - (period >> 2) + time.Duration(rand.Intn(int(period>>1)))
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		logs.Info.Printf("Mover of old messages to cold storage started with period %s, block size %d",
+			period.Round(time.Second), blockSize)
+		for {
+			select {
+			case <-ticker.C:
+				moveColdMessages(age, skipCats, blockSize, batchSize)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,130 @@
+package tiering
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Extension of blob keys.
+const blobExt = ".jsonl.gz"
+
+// S3 keeps blobs of messages in an S3 bucket as objects "<prefix><key>.jsonl.gz".
+type S3 struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+	cache  *cache
+}
+
+type s3Config struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Region          string `json:"region"`
+	DisableSSL      bool   `json:"disable_ssl"`
+	ForcePathStyle  bool   `json:"force_path_style"`
+	Endpoint        string `json:"endpoint"`
+	BucketName      string `json:"bucket"`
+	// Prefix of object keys, e.g. "cold/".
+	Prefix string `json:"prefix"`
+}
+
+// NewS3 creates cold storage in S3 from the config. Up to cacheSize blobs are cached in memory.
+func NewS3(jsconfig json.RawMessage, cacheSize int) (*S3, error) {
+	var config s3Config
+	if len(jsconfig) > 0 {
+		if err := json.Unmarshal(jsconfig, &config); err != nil {
+			return nil, errors.New("failed to parse s3 config: " + err.Error())
+		}
+	}
+	if config.AccessKeyId == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("s3: missing credentials")
+	}
+	if config.Region == "" || config.BucketName == "" {
+		return nil, errors.New("s3: missing region or bucket")
+	}
+	if cacheSize <= 0 {
+		cacheSize = defaultCacheSize
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String(config.Region),
+		DisableSSL:       aws.Bool(config.DisableSSL),
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+		Endpoint:         aws.String(config.Endpoint),
+		Credentials:      credentials.NewStaticCredentials(config.AccessKeyId, config.SecretAccessKey, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{
+		svc:    s3.New(sess),
+		bucket: config.BucketName,
+		prefix: config.Prefix,
+		cache:  newCache(cacheSize),
+	}, nil
+}
+
+// Put writes the blob of messages.
+func (s *S3) Put(key string, msgs []types.Message) error {
+	data, err := Encode(msgs)
+	if err != nil {
+		return err
+	}
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + key + blobExt),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/gzip"),
+	})
+	return err
+}
+
+// Get reads the blob of messages. The topic of messages is the first segment of the key.
+func (s *S3) Get(key string) ([]types.Message, error) {
+	data := s.cache.get(key)
+	if data == nil {
+		out, err := s.svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.prefix + key + blobExt),
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+				return nil, types.ErrNotFound
+			}
+			return nil, err
+		}
+		defer out.Body.Close()
+		if data, err = io.ReadAll(out.Body); err != nil {
+			return nil, err
+		}
+		s.cache.put(key, data)
+	}
+	return Decode(topicOf(key), data)
+}
+
+// Delete removes the blob.
+func (s *S3) Delete(key string) error {
+	s.cache.remove(key)
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key + blobExt),
+	})
+	return err
+}
+
+// topicOf returns the topic name from the key of the blob "<topic>/<low>-<hi>".
+func topicOf(key string) string {
+	topic, _, _ := strings.Cut(key, "/")
+	return topic
+}
@@ -0,0 +1,147 @@
+// Package tiering implements cold storage of old messages in S3. Messages are kept in blobs of gzipped
+// JSON lines, one message per line, ordered by message ID. Recently read blobs are cached in memory.
+package tiering
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default number of blobs cached in memory.
+	defaultCacheSize = 64
+
+	// Maximum length of one line of a blob.
+	maxLineSize = 1 << 24
+)
+
+// record is a message as stored in a blob.
+type record struct {
+	SeqId     int         `json:"seq"`
+	CreatedAt time.Time   `json:"ts"`
+	UpdatedAt time.Time   `json:"upd"`
+	From      string      `json:"from,omitempty"`
+	Head      types.KVMap `json:"head,omitempty"`
+	Content   any         `json:"content,omitempty"`
+	ThreadId  int         `json:"thread,omitempty"`
+}
+
+// Encode writes messages as gzipped JSON lines.
+func Encode(msgs []types.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for i := range msgs {
+		msg := &msgs[i]
+		if err := enc.Encode(&record{
+			SeqId:     msg.SeqId,
+			CreatedAt: msg.CreatedAt,
+			UpdatedAt: msg.UpdatedAt,
+			From:      msg.From,
+			Head:      msg.Head,
+			Content:   msg.Content,
+			ThreadId:  msg.ThreadId,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode reads messages of the topic from gzipped JSON lines.
+func Decode(topic string, data []byte) ([]types.Message, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var msgs []types.Message
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, errors.New("tiering: invalid blob: " + err.Error())
+		}
+		msg := types.Message{
+			SeqId:    rec.SeqId,
+			Topic:    topic,
+			From:     rec.From,
+			Head:     rec.Head,
+			Content:  rec.Content,
+			ThreadId: rec.ThreadId,
+		}
+		msg.CreatedAt = rec.CreatedAt
+		msg.UpdatedAt = rec.UpdatedAt
+		msgs = append(msgs, msg)
+	}
+	return msgs, scanner.Err()
+}
+
+// cache is an LRU cache of compressed blobs. Blobs are decoded on every read because the store
+// modifies messages in place, e.g. when decrypting them.
+type cache struct {
+	lock  sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheItem struct {
+	key  string
+	data []byte
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *cache) get(key string) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*cacheItem).data
+	}
+	return nil
+}
+
+func (c *cache) put(key string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*cacheItem).data = data
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheItem{key: key, data: data})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheItem).key)
+	}
+}
+
+func (c *cache) remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+		delete(c.items, key)
+	}
+}
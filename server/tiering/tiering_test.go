@@ -0,0 +1,48 @@
+package tiering
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []types.Message{
+		{SeqId: 1, From: "AAAAAAAAAAE", Head: types.KVMap{"mime": "text/x-drafty"}, Content: map[string]any{"txt": "hi"}},
+		{SeqId: 2, From: "AAAAAAAAAAE", Content: "hello", ThreadId: 1},
+	}
+	msgs[0].CreatedAt, msgs[1].CreatedAt = ts, ts.Add(time.Minute)
+
+	data, err := Encode(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Decode("grpTest", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].Topic != "grpTest" || decoded[0].Head["mime"] != "text/x-drafty" ||
+		decoded[1].Content != "hello" || decoded[1].ThreadId != 1 || !decoded[1].CreatedAt.Equal(ts.Add(time.Minute)) {
+		t.Errorf("unexpected messages %+v", decoded)
+	}
+	if txt := decoded[0].Content.(map[string]any)["txt"]; txt != "hi" {
+		t.Errorf("unexpected content %v", decoded[0].Content)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(2)
+	c.put("a", []byte("a"))
+	c.put("b", []byte("b"))
+	c.get("a")
+	c.put("c", []byte("c"))
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil {
+		t.Error("least recently used blob not evicted")
+	}
+	c.remove("a")
+	if c.get("a") != nil {
+		t.Error("blob not removed")
+	}
+}
@@ -17,8 +17,12 @@ import (
 
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/sfu"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/translate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Topic is an isolated communication channel
@@ -46,6 +50,16 @@ type Topic struct {
 	lastID int
 	// ID of the deletion operation. Not an ID of the message.
 	delID int
+	// Time to live of messages in seconds, 0 if messages don't expire.
+	msgTTL int
+	// Minimum interval between messages of a user in seconds, 0 if slow mode is off.
+	slowMode int
+	// Topic is frozen: only managers may publish.
+	frozen bool
+	// Times of the last messages of users in slow mode.
+	slowPosts map[types.Uid]time.Time
+	// IDs of pinned messages.
+	pinned []int
 
 	// Total count of subscribers (excluding deleted).
 	// This is different from subsCount() for channels.
@@ -53,6 +67,8 @@ type Topic struct {
 
 	// Last published userAgent ('me' topic only)
 	userAgent string
+	// Custom status of the user ('me' topic only)
+	userStatus *types.UserStatus
 
 	// User ID of the topic owner/creator. Could be zero.
 	owner types.Uid
@@ -88,6 +104,16 @@ type Topic struct {
 	// Sessions attached to this topic. The UID kept here may not match Session.uid if session is
 	// subscribed on behalf of another user.
 	sessions map[*Session]perSessionData
+	// Topic has enough attached sessions to send messages to other nodes in batches. Master topic only.
+	shardedFanout bool
+
+	// Stats for reporting the busiest topics, read by the admin API.
+	// Time when the topic was loaded.
+	loadedAt time.Time
+	// Number of messages published since the topic was loaded.
+	pubCount atomic.Int64
+	// Number of attached sessions, a multiplexing session counts as one.
+	sessCount atomic.Int64
 
 	// Present video call data. Null when there's no call in progress or being established.
 	// Only available for p2p topics.
@@ -117,6 +143,14 @@ type Topic struct {
 
 	// Channel functionality is enabled for the group topic.
 	isChan bool
+	// The channel is in broadcast mode: channel readers are not tracked individually.
+	broadcast bool
+	// The group topic is a community: it has members but no messages.
+	community bool
+	// Name of the community the group topic belongs to.
+	parent string
+	// Tenant the topic belongs to, blank for the default tenant.
+	tenant string
 
 	// If isProxy == true, the actual topic is hosted by another cluster member.
 	// The topic should:
@@ -132,6 +166,26 @@ type Topic struct {
 
 	// Countdown timer for terminating iniatated (but not established) calls.
 	callEstablishmentTimer *time.Timer
+
+	// Users who have been typing during the current aggregation window.
+	typing map[types.Uid]bool
+	// Timer which ends the window of aggregation of typing notifications.
+	typingTimer *time.Timer
+
+	// Timer which clears the custom status of the user when it expires, 'me' only.
+	statusTimer *time.Timer
+
+	// Subscribers' settings of push notifications from the topic. Loaded on first use.
+	notify map[types.Uid]*types.TopicNotifySettings
+	// Subscribers' overrides of sharing presence in the topic. Loaded on first use.
+	presShare map[types.Uid]*types.TopicPresenceSettings
+	// Presence settings of the owner of 'me'. Loaded on first use.
+	presPrefs *presencePrefs
+
+	// Blocks between users of the topic. Loaded on first use.
+	blocks *blockList
+	// Members of the community of the topic. Loaded on first use.
+	members *communityMembers
 }
 
 // perUserData holds topic's cache of per-subscriber data
@@ -161,6 +215,17 @@ type perUserData struct {
 
 	// The user is a channel subscriber.
 	isChan bool
+
+	// The user archived the subscription.
+	archived bool
+	// Unarchive the subscription when a new message arrives.
+	autoUnarchive bool
+
+	// Role of the user in a group topic, empty if permissions are defined by the access mode only.
+	role string
+
+	// The user appears offline in the group topic.
+	presHidden bool
 }
 
 // perSubsData holds user's (on 'me' topic) cache of subscription data
@@ -181,6 +246,8 @@ type perSessionData struct {
 	isChanSub bool
 	// IDs of subscribed users in a multiplexing session.
 	muids []types.Uid
+	// Time of the last typing notification from the session.
+	typingAt time.Time
 }
 
 // Reasons why topic is being shut down.
@@ -306,7 +373,17 @@ func (t *Topic) computePerUserAcsUnion() {
 // unregisterSession implements all logic following receipt of a leave
 // request via the Topic.unreg channel.
 func (t *Topic) unregisterSession(msg *ClientComMessage) {
-	if t.currentCall != nil {
+	if t.currentCall != nil && t.currentCall.isGroup() {
+		// Remove the session and sessions multiplexed over it from the group call.
+		for sid, p := range t.currentCall.parties {
+			if sid == msg.sess.sid || (msg.sess.isMultiplex() && p.sess.isProxy() && p.sess.multi == msg.sess) {
+				t.leaveGroupCall(sid)
+				if t.currentCall == nil {
+					break
+				}
+			}
+		}
+	} else if t.currentCall != nil {
 		shouldTerminateCall := false
 		if msg.sess.isMultiplex() {
 			// Check if any of the call party sessions is multiplexed over msg.sess.
@@ -339,6 +416,10 @@ func (t *Topic) unregisterSession(msg *ClientComMessage) {
 // registerSession handles a session join (registration) request
 // received via the Topic.reg channel.
 func (t *Topic) registerSession(msg *ClientComMessage) {
+	var span trace.Span
+	msg.ctx, span = traceStart(msg.ctx, "topic.subscribe", attribute.String("tinode.topic", t.name))
+	defer span.End()
+
 	// Request to add a connection to this topic
 	if t.isInactive() {
 		msg.sess.queueOut(ErrLockedReply(msg, types.TimeNow()))
@@ -353,16 +434,18 @@ func (t *Topic) registerSession(msg *ClientComMessage) {
 		// while processing the call.
 		t.killTimer.Stop()
 		if err := t.handleSubscription(msg); err == nil {
+			metricsSubscription(t.name)
 			if msg.Sub.Created {
 				// Call plugins with the new topic
 				pluginTopic(t, plgActCreate)
+				webhookTopic(t.name, webhookTopicCreated, types.ParseUserId(msg.AsUser))
 			}
 		} else {
 			if len(t.sessions) == 0 && t.cat != types.TopicCatSys {
 				// Failed to subscribe, the topic is still inactive
 				t.killTimer.Reset(idleMasterTopicTimeout)
 			}
-			logs.Warn.Printf("topic[%s] subscription failed %v, sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] subscription failed %v", t.name, err)
 		}
 	}
 	if msg.sess.inflightReqs != nil {
@@ -391,6 +474,119 @@ func (t *Topic) handleMetaGet(msg *ClientComMessage, asUid types.Uid, asChan boo
 			logs.Warn.Printf("topic[%s] meta.Get.Del failed: %s", t.name, err)
 		}
 	}
+	if msg.MetaWhat&constMsgMetaEdits != 0 {
+		if err := t.replyGetEdits(msg.sess, asUid, msg.Get.Edits, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Edits failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaThreads != 0 {
+		if err := t.replyGetThreads(msg.sess, asUid, msg.Get.Threads, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Threads failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaSched != 0 {
+		if err := t.replyGetSched(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Sched failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaReceipts != 0 {
+		if err := t.replyGetReceipts(msg.sess, asUid, asChan, msg.Get.Receipts, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Receipts failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaSess != 0 {
+		if err := t.replyGetSessions(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Sess failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaKeys != 0 {
+		if err := t.replyGetKeys(msg.sess, asUid, msg.Get.Keys, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Keys failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaSKey != 0 {
+		if err := t.replyGetSenderKeys(msg.sess, asUid, msg.Get.SKey, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.SKey failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaDevices != 0 {
+		if err := t.replyGetDevices(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Devices failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaNotify != 0 {
+		if err := t.replyGetNotify(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Notify failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaPresence != 0 {
+		if err := t.replyGetPresence(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Presence failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaDrafts != 0 {
+		if err := t.replyGetDrafts(msg.sess, asUid, msg.Get.Drafts, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Drafts failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaStarred != 0 {
+		if err := t.replyGetStarred(msg.sess, asUid, msg.Get.Starred, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Starred failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaBlocks != 0 {
+		if err := t.replyGetBlocks(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Blocks failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaInvites != 0 {
+		if err := t.replyGetInvites(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Invites failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaTopics != 0 {
+		if err := t.replyGetTopics(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Topics failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaContacts != 0 {
+		if err := t.replyGetContacts(msg.sess, asUid, msg.Get.Contacts, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Contacts failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaDirectory != 0 {
+		if err := t.replyGetDirectory(msg.sess, asUid, msg.Get.Directory, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Directory failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaCommands != 0 {
+		t.replyGetCommands(msg.sess, asUid, msg)
+	}
+	if msg.MetaWhat&constMsgMetaUsage != 0 {
+		if err := t.replyGetUsage(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Usage failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaUnread != 0 {
+		if err := t.replyGetUnread(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Unread failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaMentions != 0 {
+		if err := t.replyGetMentions(msg.sess, asUid, msg.Get.Mentions, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Mentions failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaCalls != 0 {
+		if err := t.replyGetCalls(msg.sess, asUid, msg.Get.Calls, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Calls failed: %s", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaMsg != 0 {
+		if err := t.replyGetMsg(msg.sess, asUid, asChan, msg.Get.Msg, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Get.Msg failed: %s", t.name, err)
+		}
+	}
 	if msg.MetaWhat&constMsgMetaTags != 0 {
 		if err := t.replyGetTags(msg.sess, asUid, msg); err != nil {
 			logs.Warn.Printf("topic[%s] meta.Get.Tags failed: %s", t.name, err)
@@ -438,6 +634,86 @@ func (t *Topic) handleMetaSet(msg *ClientComMessage, asUid types.Uid, asChan boo
 			logs.Warn.Printf("topic[%s] meta.Set.Aux failed: %v", t.name, err)
 		}
 	}
+	if msg.MetaWhat&constMsgMetaThreads != 0 {
+		if err := t.replySetThread(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Thread failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaPin != 0 {
+		if err := t.replySetPin(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Pin failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaKeys != 0 {
+		if err := t.replySetKeys(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Keys failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaSKey != 0 {
+		if err := t.replySetSenderKeys(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.SKey failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaDevices != 0 {
+		if err := t.replySetDevice(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Device failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaNotify != 0 {
+		if err := t.replySetNotify(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Notify failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaPresence != 0 {
+		if err := t.replySetPresence(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Presence failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaDrafts != 0 {
+		if err := t.replySetDraft(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Draft failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaStarred != 0 {
+		if err := t.replySetStar(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Star failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaLabels != 0 {
+		if err := t.replySetLabels(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Labels failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaArchive != 0 {
+		if err := t.replySetArchive(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Archive failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaBlocks != 0 {
+		if err := t.replySetBlock(msg.sess, asUid, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Block failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaRoles != 0 {
+		if err := t.replySetRole(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Role failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaInvites != 0 {
+		if err := t.replySetInvite(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Invite failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaRequest != 0 {
+		if err := t.replySetRequest(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Request failed: %v", t.name, err)
+		}
+	}
+	if msg.MetaWhat&constMsgMetaDirectory != 0 {
+		if err := t.replySetDirectory(msg.sess, asUid, asChan, msg); err != nil {
+			logs.Warn.Printf("topic[%s] meta.Set.Directory failed: %v", t.name, err)
+		}
+	}
 }
 
 func (t *Topic) handleMetaDel(msg *ClientComMessage, asUid types.Uid, asChan bool, authLevel auth.Level) {
@@ -451,6 +727,14 @@ func (t *Topic) handleMetaDel(msg *ClientComMessage, asUid types.Uid, asChan boo
 		err = t.replyDelTopic(msg.sess, asUid, msg)
 	case constMsgDelCred:
 		err = t.replyDelCred(msg.sess, asUid, authLevel, msg)
+	case constMsgDelSched:
+		err = t.replyDelSched(msg.sess, asUid, msg)
+	case constMsgDelSess:
+		err = t.replyDelSessions(msg.sess, asUid, msg)
+	case constMsgDelKeys:
+		err = t.replyDelKeys(msg.sess, asUid, msg)
+	case constMsgDelDevice:
+		err = t.replyDelDevice(msg.sess, asUid, msg)
 	}
 
 	if err != nil {
@@ -461,6 +745,10 @@ func (t *Topic) handleMetaDel(msg *ClientComMessage, asUid types.Uid, asChan boo
 // handleMeta implements logic handling meta requests
 // received via the Topic.meta channel.
 func (t *Topic) handleMeta(msg *ClientComMessage) {
+	var span trace.Span
+	msg.ctx, span = traceStart(msg.ctx, "topic.meta", attribute.String("tinode.topic", t.name))
+	defer span.End()
+
 	// Request to get/set topic metadata
 	asUid := types.ParseUserId(msg.AsUser)
 	authLevel := auth.Level(msg.AuthLvl)
@@ -528,6 +816,12 @@ func (t *Topic) handleTopicTermination(sd *shutDown) {
 	// 3. System shutdown (reason == StopShutdown, done != nil).
 	// 4. Cluster rehashing (reason == StopRehashing)
 
+	if t.currentCall != nil && t.currentCall.isGroup() {
+		// Deleting the room disconnects the participants.
+		t.closeGroupCall(t.currentCall, constCallMsgDisconnected, t.currentCall.duration())
+		t.currentCall = nil
+	}
+
 	switch sd.reason {
 	case StopDeleted:
 		if t.cat == types.TopicCatGrp {
@@ -537,6 +831,7 @@ func (t *Topic) handleTopicTermination(sd *shutDown) {
 
 		// Inform plugins that the topic is deleted
 		pluginTopic(t, plgActDel)
+		webhookTopic(t.name, webhookTopicDeleted, types.ZeroUid)
 
 	case StopRehashing:
 		// Must send individual messages to sessions because normal sending through the topic's
@@ -569,6 +864,11 @@ func (t *Topic) runLocal(hub *Hub) {
 	// Kills topic after a period of inactivity.
 	t.killTimer = time.NewTimer(time.Hour)
 	t.killTimer.Stop()
+	if len(t.sessions) == 0 && t.cat != types.TopicCatSys {
+		// The topic may be loaded without a session, e.g. to publish a scheduled message.
+		// Unload it when idle. Subscription requests stop the timer.
+		t.killTimer.Reset(idleMasterTopicTimeout)
+	}
 
 	// Notifies about user agent change. 'me' only
 	uaTimer := time.NewTimer(time.Minute)
@@ -581,6 +881,15 @@ func (t *Topic) runLocal(hub *Hub) {
 	t.callEstablishmentTimer = time.NewTimer(time.Second)
 	t.callEstablishmentTimer.Stop()
 
+	t.typingTimer = time.NewTimer(time.Second)
+	t.typingTimer.Stop()
+
+	t.statusTimer = time.NewTimer(time.Second)
+	t.statusTimer.Stop()
+	if t.cat == types.TopicCatMe {
+		t.statusExpirySchedule()
+	}
+
 	for {
 		select {
 		case msg := <-t.reg:
@@ -610,6 +919,12 @@ func (t *Topic) runLocal(hub *Hub) {
 		case <-t.callEstablishmentTimer.C:
 			t.terminateCallInProgress(true)
 
+		case <-t.typingTimer.C:
+			t.flushTyping()
+
+		case <-t.statusTimer.C:
+			t.handleStatusExpired()
+
 		case sd := <-t.exit:
 			t.handleTopicTermination(sd)
 			return
@@ -619,10 +934,28 @@ func (t *Topic) runLocal(hub *Hub) {
 
 // handleClientMsg is the top-level handler of messages received by the topic from sessions.
 func (t *Topic) handleClientMsg(msg *ClientComMessage) {
+	var span trace.Span
+	msg.ctx, span = traceStart(msg.ctx, "topic."+traceMsgName(msg), attribute.String("tinode.topic", t.name))
+	defer span.End()
+
 	if msg.Pub != nil {
 		t.handlePubBroadcast(msg)
 	} else if msg.Note != nil {
 		t.handleNoteBroadcast(msg)
+	} else if msg.React != nil {
+		t.handleReactBroadcast(msg)
+	} else if msg.Vote != nil {
+		t.handleVoteBroadcast(msg)
+	} else if msg.Report != nil {
+		t.handleReportBroadcast(msg)
+	} else if msg.Del != nil && msg.sess == nil && msg.Del.What == delWhatReported {
+		t.handleReportedDelete(msg)
+	} else if msg.Del != nil && msg.sess == nil && msg.Del.What == delWhatCommunity {
+		t.handleCommunityLeave(msg)
+	} else if msg.Del != nil && msg.sess == nil && msg.Del.What == delWhatRetention {
+		t.handleMsgRetention(msg)
+	} else if msg.Del != nil && msg.sess == nil {
+		t.handleMsgExpired(msg)
 	} else {
 		// TODO(gene): maybe remove this panic.
 		logs.Err.Panic("topic: wrong client message type for broadcasting", t.name)
@@ -669,49 +1002,49 @@ func (t *Topic) handleSubscription(msg *ClientComMessage) error {
 	if getWhat&constMsgMetaDesc != 0 {
 		// Send get.desc as a {meta} packet.
 		if err := t.replyGetDesc(msg.sess, asUid, asChan, msgsub.Get.Desc, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Desc failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Desc failed: %v", t.name, err)
 		}
 	}
 
 	if getWhat&constMsgMetaSub != 0 {
 		// Send get.sub response as a separate {meta} packet
 		if err := t.replyGetSub(msg.sess, asUid, authLevel, asChan, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Sub failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Sub failed: %v", t.name, err)
 		}
 	}
 
 	if getWhat&constMsgMetaTags != 0 {
 		// Send get.tags response as a separate {meta} packet
 		if err := t.replyGetTags(msg.sess, asUid, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Tags failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Tags failed: %v", t.name, err)
 		}
 	}
 
 	if getWhat&constMsgMetaCred != 0 {
 		// Send get.tags response as a separate {meta} packet
 		if err := t.replyGetCreds(msg.sess, asUid, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Cred failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Cred failed: %v", t.name, err)
 		}
 	}
 
 	if getWhat&constMsgMetaAux != 0 {
 		// Send get.aux response as a separate {meta} packet
 		if err := t.replyGetAux(msg.sess, asUid, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Aux failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Aux failed: %v", t.name, err)
 		}
 	}
 
 	if getWhat&constMsgMetaData != 0 {
 		// Send get.data response as {data} packets
 		if err := t.replyGetData(msg.sess, asUid, asChan, msgsub.Get.Data, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Data failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Data failed: %v", t.name, err)
 		}
 	}
 
 	if getWhat&constMsgMetaDel != 0 {
 		// Send get.del response as a separate {meta} packet
 		if err := t.replyGetDel(msg.sess, asUid, msgsub.Get.Del, msg); err != nil {
-			logs.Warn.Printf("topic[%s] handleSubscription Get.Del failed: %v sid=%s", t.name, err, msg.sess.sid)
+			msg.sess.log(msg).Warn.Printf("topic[%s] handleSubscription Get.Del failed: %v", t.name, err)
 		}
 	}
 
@@ -833,7 +1166,7 @@ func (t *Topic) handleLeaveRequest(msg *ClientComMessage, sess *Session) {
 					if asChan {
 						// Simply delete record from perUserData
 						delete(t.perUser, uid)
-					} else {
+					} else if !pud.presHidden {
 						t.presSubsOnline("off", uid.UserId(), nilPresParams, readFilter, "")
 					}
 				}
@@ -843,7 +1176,7 @@ func (t *Topic) handleLeaveRequest(msg *ClientComMessage, sess *Session) {
 						if asChan {
 							// delete record from perUserData
 							delete(t.perUser, uid)
-						} else {
+						} else if !t.perUser[uid].presHidden {
 							t.presSubsOnline("off", uid.UserId(), nilPresParams, readFilter, "")
 						}
 					}
@@ -934,6 +1267,9 @@ func (t *Topic) sendImmediateSubNotifications(asUid types.Uid, acs *MsgAccessMod
 	} else if t.cat == types.TopicCatGrp && !asChan && sreg.Sub.Newsub {
 		// For new group subscriptions, notify other group members.
 		sendPush(t.pushForGroupSub(asUid, now))
+		t.onboardingSubChange(asUid, types.ModeNone, types.ModeNone, modeWant, modeGiven)
+		t.webhookSubChange(asUid, types.ModeNone, types.ModeNone, modeWant, modeGiven)
+		t.matrixSubChange(asUid, types.ModeNone, types.ModeNone, modeWant, modeGiven)
 	}
 
 	// newsub could be true only for p2p and group topics, no need to check topic category explicitly.
@@ -975,6 +1311,12 @@ func (t *Topic) sendSubNotifications(asUid types.Uid, sid, userAgent string) {
 			return
 		}
 
+		if pud.online == 1 {
+			// The first session of the user in the topic: check if the user appears offline.
+			pud.presHidden = t.hidesPresence(asUid)
+			t.perUser[asUid] = pud
+		}
+
 		// Enable notifications for a new group topic, if appropriate.
 		if !t.isLoaded() {
 			t.markLoaded()
@@ -985,7 +1327,7 @@ func (t *Topic) sendSubNotifications(asUid types.Uid, sid, userAgent string) {
 
 			// Notify topic subscribers that the topic is online now.
 			t.presSubsOffline(status, nilPresParams, nilPresFilters, nilPresFilters, "", false)
-		} else if pud.online == 1 {
+		} else if pud.online == 1 && !pud.presHidden {
 			// If this is the first session of the user in the topic.
 			// Notify other online group members that the user is online now.
 			t.presSubsOnline("on", asUid.UserId(), nilPresParams,
@@ -1018,8 +1360,8 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 		delete(head, "sender")
 	}
 
-	markedReadBySender := false
-	if err, unreadUpdated := store.Messages.Save(
+	queryDone := storeQueryStart(msg.ctx, "Messages.Save", t.name, nil)
+	err, markedReadBySender := store.Messages.Save(
 		&types.Message{
 			ObjHeader: types.ObjHeader{CreatedAt: msg.Timestamp},
 			SeqId:     t.lastID + 1,
@@ -1027,17 +1369,29 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 			From:      asUid.String(),
 			Head:      head,
 			Content:   content,
-		}, attachments, (pud.modeGiven & pud.modeWant).IsReader()); err != nil {
+			ThreadId:  msgThreadId(head),
+		}, attachments, (pud.modeGiven & pud.modeWant).IsReader())
+	queryDone()
+	if err != nil {
 		logs.Warn.Printf("topic[%s]: failed to save message: %v", t.name, err)
 		msg.sess.queueOut(ErrUnknown(msg.Id, t.original(asUid), msg.Timestamp))
 
 		return err
-	} else {
-		markedReadBySender = unreadUpdated
 	}
 
 	t.lastID++
 	t.touched = msg.Timestamp
+	t.pubCount.Add(1)
+	metricsMessage(t.name)
+	meterMessage(asUid)
+
+	if head[msgHeadPoll] != nil {
+		t.createPoll(asUid, t.lastID, head)
+	}
+
+	mentioned := t.msgMentions(asUid, head, content)
+	t.indexMentions(asUid, t.lastID, msg, mentioned)
+	t.unarchiveOnMessage(head)
 
 	if userFound {
 		pud.readID = t.lastID
@@ -1065,6 +1419,7 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 		RcptTo:    msg.RcptTo,
 		AsUser:    msg.AsUser,
 		Timestamp: msg.Timestamp,
+		Scope:     msgScope(head),
 		sess:      msg.sess,
 	}
 	if noEcho {
@@ -1072,17 +1427,28 @@ func (t *Topic) saveAndBroadcastMessage(msg *ClientComMessage, asUid types.Uid,
 	}
 
 	// Message sent: notify offline 'R' subscrbers on 'me'.
-	t.presSubsOffline("msg", &presParams{seqID: t.lastID, actor: msg.AsUser},
+	t.presSubsOffline("msg", &presParams{seqID: t.lastID, actor: msg.AsUser, mentioned: mentioned},
 		&presFilters{filterIn: types.ModeRead}, nilPresFilters, "", true)
 
 	// Tell the plugins that a message was accepted for delivery
 	pluginMessage(data.Data, plgActCreate)
+	t.webhookMessage(data.Data)
+	t.matrixMessage(data.Data)
+	t.mailReply(data.Data)
+	t.firehoseMessage(data.Data)
+	t.exportMessage(data.Data)
+	t.journalMessage(data.Data)
+
+	// Apply server-side transforms to the delivered copy. The persisted message is unchanged.
+	data.Data.Head, data.Data.Content = transformForDelivery(t.name, t.lastID, head, content)
 
 	t.broadcastToSessions(data)
 
 	// sendPush will update unread message count and send push notification.
-	if pushRcpt := t.pushForData(asUid, data.Data, markedReadBySender); pushRcpt != nil {
+	if pushRcpt := t.pushForData(asUid, data.Data, markedReadBySender, mentioned); pushRcpt != nil {
+		_, span := traceStart(msg.ctx, "push.fanout", attribute.Int("tinode.recipients", len(pushRcpt.To)))
 		sendPush(pushRcpt)
+		span.End()
 	}
 	return nil
 }
@@ -1097,18 +1463,53 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 		return
 	}
 
-	if t.isReadOnly() {
+	if t.isReadOnly() || (t.name == rptTopic && msg.sess != nil) {
+		// Messages in 'rpt' topic are posted by the server only.
+		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
+		return
+	}
+
+	if t.cat == types.TopicCatP2P && t.blockedBetween(asUid, t.p2pOtherUser(asUid)) {
+		// One of the users blocked the other.
 		msg.sess.queueOut(ErrPermissionDenied(msg.Id, t.original(asUid), msg.Timestamp))
 		return
 	}
 
+	if t.community {
+		// Messages are published in topics of the community.
+		msg.sess.queueOut(ErrOperationNotAllowedReply(msg, types.TimeNow()))
+		return
+	}
+
+	if t.frozen && !t.userCan(asUid, capDesc) {
+		// Managers may still publish, e.g. to explain why the topic is frozen.
+		msg.sess.queueOut(ErrTopicFrozenReply(msg, types.TimeNow()))
+		return
+	}
+
+	if wait := t.slowModeWait(asUid, msg.Timestamp); wait > 0 {
+		msg.sess.queueOut(ErrSlowModeReply(msg, wait))
+		return
+	}
+
 	isCall := msg.Pub.Head != nil && msg.Pub.Head["webrtc"] != nil
+	err := meterCheck(asUid, types.UsageMessages, true)
+	if err == nil && isCall {
+		err = meterCheck(asUid, types.UsageCallMinutes, true)
+	}
+	if err != nil {
+		msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), types.TimeNow(),
+			msg.Timestamp, nil))
+		return
+	}
+
 	if isCall {
-		if len(globals.iceServers) == 0 {
+		if len(globals.iceServers) == 0 && globals.turn == nil {
 			msg.sess.queueOut(ErrNotImplementedReply(msg, types.TimeNow()))
 			return
 		}
-		if t.cat != types.TopicCatP2P {
+		// Group calls require an SFU.
+		if t.cat != types.TopicCatP2P && (t.cat != types.TopicCatGrp || !sfu.IsEnabled()) {
 			msg.sess.queueOut(ErrPermissionDeniedReply(msg, types.TimeNow()))
 			return
 		}
@@ -1135,16 +1536,67 @@ func (t *Topic) handlePubBroadcast(msg *ClientComMessage) {
 		}
 	}
 
+	// Validate thread reference if present.
+	t.normalizeMsgThread(msg.Pub.Head)
+
+	// Service messages are generated by the server only.
+	delete(msg.Pub.Head, msgHeadService)
+
+	// Validate recipient scope if present.
+	if err := t.normalizeMsgScope(msg.Pub.Head, asUid); err != nil {
+		msg.sess.queueOut(ErrMalformedReply(msg, types.TimeNow()))
+		return
+	}
+
+	// Validate poll if present.
+	if err := t.normalizeMsgPoll(msg.Pub.Head); err != nil {
+		if err == errPollCategory {
+			msg.sess.queueOut(ErrOperationNotAllowedReply(msg, types.TimeNow()))
+		} else {
+			msg.sess.queueOut(ErrMalformedReply(msg, types.TimeNow()))
+		}
+		return
+	}
+
+	// Mark content of end-to-end encrypted topics as opaque.
+	msg.Pub.Head = t.normalizeMsgE2EE(msg.Pub.Head)
+
+	// Apply content moderation decision.
+	verdict, accepted := t.moderateMsg(msg, asUid)
+	if !accepted {
+		return
+	}
+
 	// Save to DB at master topic.
 	var attachments []string
 	if msg.Extra != nil && len(msg.Extra.Attachments) > 0 {
 		attachments = msg.Extra.Attachments
+		if err := checkTopicQuota(t.tenant, t.name, attachments); err != nil {
+			msg.sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, t.original(asUid), types.TimeNow(),
+				msg.Timestamp, nil))
+			return
+		}
+		msg.Pub.Content = fillAudioEntities(msg.Pub.Head, msg.Pub.Content, attachments)
+	}
+
+	if _, ok := msg.Pub.Head["sendAt"]; ok {
+		// The message is to be published later.
+		t.scheduleMessage(msg, asUid, attachments)
+		t.slowModeRecord(asUid, msg.Timestamp)
+		if verdict != nil {
+			logModeration(t.name, 0, asUid.UserId(), verdict)
+		}
+		return
 	}
 
 	if err := t.saveAndBroadcastMessage(msg, asUid, msg.Pub.NoEcho, attachments, msg.Pub.Head, msg.Pub.Content); err != nil {
 		logs.Err.Printf("topic[%s]: failed to save messagge - %s", t.name, err)
 		return
 	}
+	t.slowModeRecord(asUid, msg.Timestamp)
+	if verdict != nil {
+		logModeration(t.name, t.lastID, asUid.UserId(), verdict)
+	}
 
 	if isCall {
 		t.handleCallInvite(msg, asUid)
@@ -1180,7 +1632,11 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 	switch msg.Note.What {
 	case "kp", "kpa", "kpv":
 		// Filter out "kp*" from users with no 'W' permission (or people without a subscription).
-		if !mode.IsWriter() || t.isReadOnly() {
+		if !mode.IsWriter() || t.isReadOnly() || t.typingRateLimited(msg.sess) {
+			return
+		}
+		if msg.Note.What == "kp" && t.typingAggregated() {
+			t.aggregateTyping(asUid)
 			return
 		}
 	case "read", "recv":
@@ -1188,6 +1644,17 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 		if !mode.IsReader() {
 			return
 		}
+		if asChan && t.broadcast && msg.Note.What == "recv" {
+			// Readers of broadcast channels keep only the read cursor.
+			return
+		}
+		if msg.Note.Thread > 0 {
+			// Read markers in threads are kept separately from the topic's. Recv is not tracked.
+			if msg.Note.What == "read" {
+				t.handleThreadRead(msg, asUid)
+			}
+			return
+		}
 	case "call":
 		// Handle calls separately.
 		t.handleCallEvent(msg)
@@ -1265,7 +1732,7 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 		}
 
 		// Read/recv updated: notify user's other sessions of the change
-		t.presPubMessageCount(asUid, mode, read, recv, msg.sess.sid)
+		t.presPubMessageCount(asUid, mode, read, recv, asChan, msg.sess.sid)
 
 		if read > 0 {
 			// Send push notification to other user devices.
@@ -1287,6 +1754,11 @@ func (t *Topic) handleNoteBroadcast(msg *ClientComMessage) {
 		t.perUser[asUid] = pud
 	}
 
+	if (msg.Note.What == "read" || msg.Note.What == "recv") && t.receiptsThrottled() {
+		// Too many subscribers to fan out read/recv. Receipts are available through {get what="receipts"}.
+		return
+	}
+
 	// Read/recv/kp: notify users offline in the topic on their 'me'.
 	t.infoSubsOffline(asUid, msg.Note.What, seq, msg.sess.sid)
 
@@ -1360,11 +1832,12 @@ func (t *Topic) handleEdit(msg *ClientComMessage) {
 
 	// Update the message in the database.
 	now := types.TimeNow()
-	err = store.Messages.Edit(t.name, seqId, newContent, now, editCount+1)
+	err = store.Messages.Edit(t.name, seqId, newContent, now, editCount+1, origMsg.IsOpaque())
 	if err != nil {
 		logs.Warn.Printf("topic[%s]: failed to edit message: %v", t.name, err)
 		return
 	}
+	t.journalEdit(asUid, seqId, newContent, now)
 
 	// Broadcast the edit to all topic subscribers.
 	info := &ServerComMessage{
@@ -1380,6 +1853,7 @@ func (t *Topic) handleEdit(msg *ClientComMessage) {
 		AsUser:    msg.AsUser,
 		Timestamp: msg.Timestamp,
 		SkipSid:   msg.sess.sid,
+		Scope:     msgScope(origMsg.Head),
 		sess:      msg.sess,
 	}
 
@@ -1425,6 +1899,7 @@ func (t *Topic) handleUnsend(msg *ClientComMessage) {
 		logs.Warn.Printf("topic[%s]: failed to unsend message: %v", t.name, err)
 		return
 	}
+	t.journalUnsend(asUid, seqId, now)
 
 	// Broadcast the unsend to all topic subscribers.
 	info := &ServerComMessage{
@@ -1438,48 +1913,7 @@ func (t *Topic) handleUnsend(msg *ClientComMessage) {
 		AsUser:    msg.AsUser,
 		Timestamp: msg.Timestamp,
 		SkipSid:   msg.sess.sid,
-		sess:      msg.sess,
-	}
-
-	t.broadcastToSessions(info)
-}
-
-// handleReaction processes emoji reaction {note what="react"} messages.
-func (t *Topic) handleReaction(msg *ClientComMessage) {
-	asUid := types.ParseUserId(msg.AsUser)
-	seqId := msg.Note.SeqId
-	reaction := msg.Note.Reaction
-
-	// Validate reaction length (max 32 chars for multi-codepoint emoji).
-	if len(reaction) > 32 {
-		return
-	}
-
-	// Validate SeqId is within valid range.
-	if seqId > t.lastID || seqId <= 0 {
-		return
-	}
-
-	// Update the message's Head.reactions in the database.
-	err := store.Messages.AddReaction(t.name, seqId, asUid.UserId(), reaction)
-	if err != nil {
-		logs.Warn.Printf("topic[%s]: failed to add reaction: %v", t.name, err)
-		return
-	}
-
-	// Broadcast the reaction to all topic subscribers.
-	info := &ServerComMessage{
-		Info: &MsgServerInfo{
-			Topic:    msg.Original,
-			From:     msg.AsUser,
-			What:     "react",
-			SeqId:    seqId,
-			Reaction: reaction,
-		},
-		RcptTo:    msg.RcptTo,
-		AsUser:    msg.AsUser,
-		Timestamp: msg.Timestamp,
-		SkipSid:   msg.sess.sid,
+		Scope:     msgScope(origMsg.Head),
 		sess:      msg.sess,
 	}
 
@@ -1502,91 +1936,127 @@ func (t *Topic) handlePresence(msg *ServerComMessage) {
 
 // broadcastToSessions writes message to attached sessions.
 func (t *Topic) broadcastToSessions(msg *ServerComMessage) {
+	if msg.Data != nil && t.cat == types.TopicCatGrp {
+		// Make sure blocks of the sender are loaded: sessions may be served concurrently.
+		t.blocksFor(types.ParseUserId(msg.Data.From))
+	}
+
 	// List of sessions to be dropped.
 	var dropSessions []*Session
-	// Broadcast the message. Only {data}, {pres}, {info} are broadcastable.
-	// {meta} and {ctrl} are sent to the session only
-	for sess, pssd := range t.sessions {
-		// Send all messages to multiplexing session.
-		if !sess.isMultiplex() {
-			if sess.sid == msg.SkipSid {
-				continue
+	if msg.Data != nil {
+		t.updateFanoutMode()
+	}
+	if msg.Data != nil && globals.fanoutShardSize > 0 && len(t.sessions) > globals.fanoutShardSize {
+		// Too many sessions to deliver {data} one by one.
+		dropSessions = t.broadcastSharded(msg)
+	} else {
+		// Broadcast the message. Only {data}, {pres}, {info} are broadcastable.
+		// {meta} and {ctrl} are sent to the session only
+		for sess, pssd := range t.sessions {
+			if !t.broadcastToSession(sess, pssd, msg) {
+				dropSessions = append(dropSessions, sess)
 			}
+		}
+	}
 
-			if msg.Pres != nil {
-				// Skip notifying - already notified on topic.
-				if msg.Pres.SkipTopic != "" && sess.getSub(msg.Pres.SkipTopic) != nil {
-					continue
-				}
+	// Drop "bad" sessions.
+	for _, sess := range dropSessions {
+		// The whole session is being dropped, so ClientComMessage.init is false.
+		// keep redundant init: false so it can be searched for.
+		t.unregisterSession(&ClientComMessage{sess: sess, init: false})
+	}
+}
 
-				// Notification addressed to a single user only.
-				if msg.Pres.SingleUser != "" && pssd.uid.UserId() != msg.Pres.SingleUser {
-					continue
-				}
-				// Notification should skip a single user.
-				if msg.Pres.ExcludeUser != "" && pssd.uid.UserId() == msg.Pres.ExcludeUser {
-					continue
-				}
+// broadcastToSession writes message to one attached session if the session should receive it.
+// Returns false if the session is stuck and must be dropped.
+func (t *Topic) broadcastToSession(sess *Session, pssd perSessionData, msg *ServerComMessage) bool {
+	// Send all messages to multiplexing session.
+	if !sess.isMultiplex() {
+		if sess.sid == msg.SkipSid {
+			return true
+		}
 
-				// Check presence filters
-				if !t.passesPresenceFilters(msg.Pres, pssd.uid) {
-					continue
-				}
+		// Message is restricted to a subset of topic members.
+		if !t.userInMsgScope(msg.Scope, pssd.uid) {
+			return true
+		}
 
-			} else {
-				if msg.Info != nil {
-					// Don't forward read receipts and key presses to channel readers and those without the R permission.
-					// OK to forward with Src != "" because it's sent from another topic to 'me', permissions already
-					// checked there.
-					if msg.Info.Src == "" && (pssd.isChanSub || !t.userIsReader(pssd.uid)) {
-						continue
-					}
+		// The recipient and the sender blocked one another.
+		if msg.Data != nil && t.blocks.between(pssd.uid, types.ParseUserId(msg.Data.From)) {
+			return true
+		}
 
-					// Skip notifying - already notified on topic.
-					if msg.Info.SkipTopic != "" && sess.getSub(msg.Info.SkipTopic) != nil {
-						continue
-					}
+		if msg.Pres != nil {
+			// Skip notifying - already notified on topic.
+			if msg.Pres.SkipTopic != "" && sess.getSub(msg.Pres.SkipTopic) != nil {
+				return true
+			}
 
-					// Don't send key presses from one user's session to the other sessions of the same user.
-					if msg.Info.What == "kp" && msg.Info.From == pssd.uid.UserId() {
-						continue
-					}
+			// Notification addressed to a single user only.
+			if msg.Pres.SingleUser != "" && pssd.uid.UserId() != msg.Pres.SingleUser {
+				return true
+			}
+			// Notification should skip a single user.
+			if msg.Pres.ExcludeUser != "" && pssd.uid.UserId() == msg.Pres.ExcludeUser {
+				return true
+			}
 
-				} else if !t.userIsReader(pssd.uid) && !pssd.isChanSub {
-					// Skip {data} if the user has no Read permission and not a channel reader.
-					continue
-				}
+			// Check presence filters
+			if !t.passesPresenceFilters(msg.Pres, pssd.uid) {
+				return true
 			}
-		} else if pssd.isChanSub && types.IsChannel(sess.sid) {
-			// If it's a chnX multiplexing session, check if there's a corresponding
-			// grpX multiplexing session as we don't want to send the message to both.
-			grpSid := types.ChnToGrp(sess.sid)
-			if grpSess := globals.sessionStore.Get(grpSid); grpSess != nil && grpSess.isMultiplex() {
-				// If grpX multiplexing session's attached to topic, skip this chnX session
-				// (message will be routed to the topic proxy via the grpX session).
-				if _, attached := t.sessions[grpSess]; attached {
-					continue
+
+		} else {
+			if msg.Info != nil {
+				// Don't forward read receipts and key presses to channel readers and those without the R permission.
+				// OK to forward with Src != "" because it's sent from another topic to 'me', permissions already
+				// checked there.
+				if msg.Info.Src == "" && (pssd.isChanSub || !t.userIsReader(pssd.uid)) {
+					return true
 				}
+
+				// Skip notifying - already notified on topic.
+				if msg.Info.SkipTopic != "" && sess.getSub(msg.Info.SkipTopic) != nil {
+					return true
+				}
+
+				// Don't send key presses from one user's session to the other sessions of the same user.
+				if msg.Info.What == "kp" && msg.Info.From == pssd.uid.UserId() {
+					return true
+				}
+
+			} else if !t.userIsReader(pssd.uid) && !pssd.isChanSub {
+				// Skip {data} if the user has no Read permission and not a channel reader.
+				return true
 			}
 		}
-
-		// Make a copy of msg since messages sent to sessions differ.
-		msgCopy := msg.copy()
-		// Topic name may be different depending on the user to which the `sess` belongs.
-		t.prepareBroadcastableMessage(msgCopy, pssd.uid, pssd.isChanSub)
-		// Send message to session.
-		if !sess.queueOut(msgCopy) {
-			logs.Warn.Printf("topic[%s]: connection stuck, detaching - %s", t.name, sess.sid)
-			dropSessions = append(dropSessions, sess)
+	} else if pssd.isChanSub && types.IsChannel(sess.sid) {
+		// If it's a chnX multiplexing session, check if there's a corresponding
+		// grpX multiplexing session as we don't want to send the message to both.
+		grpSid := types.ChnToGrp(sess.sid)
+		if grpSess := globals.sessionStore.Get(grpSid); grpSess != nil && grpSess.isMultiplex() {
+			// If grpX multiplexing session's attached to topic, skip this chnX session
+			// (message will be routed to the topic proxy via the grpX session).
+			if _, attached := t.sessions[grpSess]; attached {
+				return true
+			}
 		}
 	}
 
-	// Drop "bad" sessions.
-	for _, sess := range dropSessions {
-		// The whole session is being dropped, so ClientComMessage.init is false.
-		// keep redundant init: false so it can be searched for.
-		t.unregisterSession(&ClientComMessage{sess: sess, init: false})
+	// Make a copy of msg since messages sent to sessions differ.
+	msgCopy := msg.copy()
+	// Topic name may be different depending on the user to which the `sess` belongs.
+	t.prepareBroadcastableMessage(msgCopy, pssd.uid, pssd.isChanSub)
+	if msgCopy.Data != nil && !sess.isMultiplex() {
+		// Multiplexing sessions have no client capabilities: converted by the proxy topic.
+		msgCopy.Data.Content = sess.downgradeContent(msgCopy.Data.Head, msgCopy.Data.Content)
+	}
+	// Send message to session.
+	if !sess.queueOut(msgCopy) {
+		logs.Warn.Printf("topic[%s]: connection stuck, detaching - %s", t.name, sess.sid)
+		return false
 	}
+	return true
 }
 
 // subscriptionReply generates a response to a subscription request
@@ -1739,6 +2209,15 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 		}
 	}
 
+	var request string
+	if pkt.Sub != nil {
+		request = pkt.Sub.Request
+	}
+	if len(request) > maxJoinRequestLength {
+		sess.queueOut(ErrMalformedReply(pkt, now))
+		return nil, errors.New("request to join is too long")
+	}
+
 	var err error
 	// Check if it's an attempt at a new subscription to the topic / a first connection of a channel reader
 	// (channel readers are not permanently cached).
@@ -1753,6 +2232,17 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 			return nil, errors.New("max subscription count exceeded")
 		}
 
+		// Group topics are not visible to users of other tenants.
+		if t.cat == types.TopicCatGrp {
+			if tenant, err := userTenant(asUid); err != nil {
+				sess.queueOut(ErrUnknownReply(pkt, now))
+				return nil, err
+			} else if tenant != t.tenant {
+				sess.queueOut(ErrTopicNotFoundReply(pkt, now))
+				return nil, errors.New("topic of another tenant")
+			}
+		}
+
 		var sub *types.Subscription
 		tname := t.name
 		if t.cat == types.TopicCatP2P {
@@ -1830,8 +2320,16 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 			}
 
 			if userData.modeGiven == types.ModeUnset {
-				// New user: default access.
-				userData.modeGiven = t.accessFor(asLvl)
+				if pkt.Sub != nil && pkt.Sub.Token != "" && t.cat == types.TopicCatGrp {
+					// New user joins by an invite link.
+					if userData.modeGiven, err = t.inviteAccess(pkt.Sub.Token); err != nil {
+						sess.queueOut(decodeStoreErrorExplicitTs(err, pkt.Id, pkt.Original, now, pkt.Timestamp, nil))
+						return nil, err
+					}
+				} else {
+					// New user: default access.
+					userData.modeGiven = t.accessFor(asLvl)
+				}
 			}
 
 			if modeWant == types.ModeUnset {
@@ -1842,6 +2340,11 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 			}
 		}
 
+		// Topics of a community are open to its members only.
+		if !t.isOwner(asUid) && !t.isCommunityMember(asUid) {
+			userData.modeGiven = types.ModeNone
+		}
+
 		// Reject new subscription: 'given' permissions have no 'J'.
 		if !userData.modeGiven.IsJoiner() {
 			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
@@ -1868,6 +2371,10 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 				ModeGiven: userData.modeGiven,
 				Private:   userData.private,
 			}
+			if t.cat == types.TopicCatGrp && isJoinRequest(userData.modeWant, userData.modeGiven) {
+				// Message to managers who approve the request.
+				sub.Request = request
+			}
 
 			if err := store.Subs.Create(sub); err != nil {
 				sess.queueOut(ErrUnknownReply(pkt, now))
@@ -1908,7 +2415,7 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 			return nil, types.ErrNotFound
 		}
 
-		var ownerChange bool
+		var ownerChange, ownerStepDown bool
 
 		// Save old access values
 
@@ -1918,27 +2425,32 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 		if modeWant != types.ModeUnset {
 			// Explicit modeWant is provided
 
-			// Make sure the current owner cannot unset the owner flag or ban himself.
-			if t.owner == asUid && (!modeWant.IsOwner() || !modeWant.IsJoiner()) {
-				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
-				return nil, errors.New("cannot unset ownership or self-ban the owner")
+			// Make sure the last owner cannot unset the owner flag or ban himself.
+			if t.isOwner(asUid) && (!modeWant.IsOwner() || !modeWant.IsJoiner()) {
+				if t.otherOwner(asUid).IsZero() {
+					sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+					return nil, errors.New("cannot unset ownership or self-ban the last owner")
+				}
+				// The owner steps down: the offer is used up.
+				ownerStepDown = true
+				userData.modeGiven &= ^types.ModeOwner
 			}
 
 			// Perform sanity checks
 			if userData.modeGiven.IsOwner() {
-				// Check for possible ownership transfer. Handle the following cases:
-				// 1. Acceptance or rejection of the ownership transfer
+				// Check for possible ownership offer. Handle the following cases:
+				// 1. Acceptance or rejection of the ownership offer
 				// 2. Owner changing own settings
 
-				// Ownership transfer
+				// Ownership accepted
 				ownerChange = modeWant.IsOwner() && !userData.modeWant.IsOwner()
 
 				// The owner should be able to grant himself any access permissions.
 				if modeWant.IsOwner() && !userData.modeGiven.BetterEqual(modeWant) {
 					userData.modeGiven |= modeWant
 				}
-			} else if modeWant.IsOwner() {
-				// Ownership transfer can only be initiated by the owner.
+			} else if modeWant.IsOwner() && !ownerStepDown {
+				// Ownership can only be offered by an owner.
 				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 				return nil, errors.New("non-owner cannot request ownership transfer")
 			} else if t.cat == types.TopicCatGrp && userData.modeGiven.IsAdmin() && modeWant.IsAdmin() {
@@ -2006,27 +2518,24 @@ func (t *Topic) thisUserSub(sess *Session, pkt *ClientComMessage, asUid types.Ui
 			pluginSubscription(&sub, plgActUpd)
 		}
 
-		// No transactions in RethinkDB, but two owners are better than none
+		// The user accepted the offer and became one more owner.
 		if ownerChange {
-			oldOwnerData := t.perUser[t.owner]
-			oldOwnerOldWant, oldOwnerOldGiven := oldOwnerData.modeWant, oldOwnerData.modeGiven
-			oldOwnerData.modeGiven = (oldOwnerData.modeGiven & ^types.ModeOwner)
-			oldOwnerData.modeWant = (oldOwnerData.modeWant & ^types.ModeOwner)
-			if err := store.Subs.Update(t.name, t.owner,
-				map[string]any{
-					"ModeWant":  oldOwnerData.modeWant,
-					"ModeGiven": oldOwnerData.modeGiven,
-				}); err != nil {
-				return nil, err
-			}
-			if err := store.Topics.OwnerChange(t.name, asUid); err != nil {
+			auditLog(&types.AuditRecord{
+				Event:      types.AuditOwnerChange,
+				Actor:      asUid.UserId(),
+				Target:     asUid.UserId(),
+				Topic:      t.original(asUid),
+				RemoteAddr: sess.remoteAddr,
+				Details:    "ownership accepted",
+			})
+		}
+
+		// The primary owner stepped down: another owner becomes the primary one.
+		if ownerStepDown {
+			t.perUser[asUid] = userData
+			if err := t.stepDownOwner(asUid, sess.remoteAddr); err != nil {
 				return nil, err
 			}
-			t.perUser[t.owner] = oldOwnerData
-			// Send presence notifications.
-			t.notifySubChange(t.owner, asUid, false,
-				oldOwnerOldWant, oldOwnerOldGiven, oldOwnerData.modeWant, oldOwnerData.modeGiven, "")
-			t.owner = asUid
 		}
 	}
 
@@ -2105,7 +2614,12 @@ func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid, asChan bo
 	hostData, ok := t.perUser[asUid]
 	// Access mode of the person who is executing this approval process
 	hostMode := hostData.modeGiven & hostData.modeWant
-	if !ok || !hostMode.IsSharer() {
+	allowed := hostMode.IsSharer()
+	if t.cat == types.TopicCatGrp {
+		// Managers of group topics either invite users or manage existing subscriptions.
+		allowed = t.userCan(asUid, capInvite) || t.userCan(asUid, capBan)
+	}
+	if !ok || !allowed {
 		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 		return nil, errors.New("topic access denied; approver has no permission")
 	}
@@ -2138,13 +2652,21 @@ func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid, asChan bo
 	}
 
 	// Make sure only the owner & approvers can set non-default access mode
-	if modeGiven != types.ModeUnset && !hostMode.IsAdmin() {
+	if modeGiven != types.ModeUnset && !t.userCan(asUid, capBan) {
 		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 		return nil, errors.New("sharer cannot set explicit modeGiven")
 	}
 
-	// Make sure no one but the owner can do an ownership transfer
-	if modeGiven.IsOwner() && t.owner != asUid {
+	// Users of a role below admin cannot grant the management permissions or manage users of the same or higher rank.
+	if t.cat == types.TopicCatGrp && modeGiven != types.ModeUnset && !t.isOwner(asUid) {
+		if rank := t.rankOf(asUid); (modeGiven.IsAdmin() && rank < roleRanks[roleAdmin]) || t.rankOf(target) > rank {
+			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+			return nil, errors.New("attempt to manage a user of a higher rank")
+		}
+	}
+
+	// Make sure no one but an owner can offer ownership
+	if modeGiven.IsOwner() && !t.isOwner(asUid) {
 		sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 		return nil, errors.New("attempt to transfer ownership by non-owner")
 	}
@@ -2157,6 +2679,32 @@ func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid, asChan bo
 	// Saved subscription does not mean the user is allowed to post/read
 	userData, existingSub := t.perUser[target]
 	if !existingSub || userData.deleted {
+		if t.cat == types.TopicCatGrp && !t.userCan(asUid, capInvite) {
+			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+			return nil, errors.New("topic access denied; approver cannot invite")
+		}
+
+		// Users who blocked one another cannot add each other to topics.
+		if t.blockedBetween(asUid, target) {
+			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+			return nil, errors.New("invite between blocked users")
+		}
+
+		// Only members of the community are invited to its topics.
+		if !t.isCommunityMember(target) {
+			sess.queueOut(ErrPermissionDeniedReply(pkt, now))
+			return nil, errors.New("invitee is not a member of the community")
+		}
+
+		// Users of other tenants cannot be invited.
+		if tenant, err := userTenant(target); err != nil {
+			sess.queueOut(ErrUnknownReply(pkt, now))
+			return nil, err
+		} else if tenant != t.tenant {
+			sess.queueOut(ErrUserNotFoundReply(pkt, now))
+			return nil, errors.New("invitee of another tenant")
+		}
+
 		// Check if the max number of subscriptions is already reached.
 		if t.cat == types.TopicCatGrp && t.subsCount() >= globals.maxSubscriberCount {
 			sess.queueOut(ErrPolicyReply(pkt, now))
@@ -2247,15 +2795,21 @@ func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid, asChan bo
 		} else if modeGiven != userData.modeGiven {
 			// Changing the previously assigned value.
 
-			// Cannot strip owner of ownership or ban the owner.
-			if t.owner == target && (!modeGiven.IsOwner() || !modeGiven.IsJoiner()) {
+			// Cannot strip owners of ownership or ban an owner.
+			if t.isOwner(target) && (!modeGiven.IsOwner() || !modeGiven.IsJoiner()) {
 				sess.queueOut(ErrPermissionDeniedReply(pkt, now))
 				return nil, errors.New("cannot stip ownership or ban the owner")
 			}
 
+			update := map[string]any{"ModeGiven": modeGiven}
+			if !modeGiven.IsJoiner() && userData.role != "" {
+				// Banned users lose their roles.
+				update["Role"] = ""
+				userData.role = ""
+			}
+
 			// Save changed value to database
-			if err := store.Subs.Update(t.name, target,
-				map[string]any{"ModeGiven": modeGiven}); err != nil {
+			if err := store.Subs.Update(t.name, target, update); err != nil {
 				return nil, err
 			}
 
@@ -2279,6 +2833,14 @@ func (t *Topic) anotherUserSub(sess *Session, asUid, target types.Uid, asChan bo
 		}
 		t.notifySubChange(target, asUid, false,
 			oldWant, oldGiven, userData.modeWant, userData.modeGiven, sess.sid)
+		auditLog(&types.AuditRecord{
+			Event:      types.AuditAcsChange,
+			Actor:      asUid.UserId(),
+			Target:     target.UserId(),
+			Topic:      t.original(asUid),
+			RemoteAddr: sess.remoteAddr,
+			Details:    "given " + oldGiven.String() + " -> " + userData.modeGiven.String(),
+		})
 
 		modeChanged = &MsgAccessMode{
 			Given: userData.modeGiven.String(),
@@ -2323,6 +2885,9 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, _ bool, opts *MsgGe
 
 	if t.cat == types.TopicCatGrp {
 		desc.IsChan = t.isChan
+		desc.IsBroadcast = t.broadcast
+		desc.IsCommunity = t.community
+		desc.Parent = t.parent
 		desc.SubCnt = t.subCnt
 		logs.Info.Println("replyGetDesc: grp topic", t.name, "subs", t.subCnt)
 	}
@@ -2337,6 +2902,9 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, _ bool, opts *MsgGe
 			desc.Public = pud.public
 			desc.Trusted = pud.trusted
 		}
+		if t.cat == types.TopicCatMe {
+			desc.Status = statusToMsg(t.userStatus, now)
+		}
 	}
 
 	// Request may come from a subscriber (full == true) or a stranger.
@@ -2373,7 +2941,7 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, _ bool, opts *MsgGe
 				// because to stay in memory at least one of the users must be connected to topic.
 				// FIXME(gene): it breaks when user A stays active in one session and connects-disconnects
 				// from another session. The second session will not see correct LastSeen time and UserAgent.
-				if pud.lastSeen != nil {
+				if pud.lastSeen != nil && t.p2pLastSeenVisible(asUid) {
 					desc.LastSeen = &MsgLastSeenInfo{
 						When:      pud.lastSeen,
 						UserAgent: pud.lastUA,
@@ -2398,6 +2966,10 @@ func (t *Topic) replyGetDesc(sess *Session, asUid types.Uid, _ bool, opts *MsgGe
 			desc.DelId = max(pud.delID, t.delID)
 			desc.ReadSeqId = pud.readID
 			desc.RecvSeqId = max(pud.recvID, pud.readID)
+			desc.MsgTTL = t.msgTTL
+			desc.SlowMode = t.slowMode
+			desc.Frozen = t.frozen
+			desc.Pinned = t.pinned
 		} else {
 			// Send some sane value of touched.
 			desc.TouchedAt = &t.updated
@@ -2489,6 +3061,18 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 			err = assignAccess(core, set.Desc.DefaultAcs)
 			sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
 			sendCommon = assignGenericValues(core, "Trusted", t.trusted, set.Desc.Trusted) || sendCommon
+			if err == nil && set.Desc.Status != nil {
+				var status *types.UserStatus
+				if status, err = statusFromMsg(set.Desc.Status, now); err == nil &&
+					(status != nil || t.userStatus.IsActive(now)) {
+					// Nil interface to clear the status in DB.
+					core["Status"] = nil
+					if status != nil {
+						core["Status"] = status
+					}
+					sendCommon = true
+				}
+			}
 		case types.TopicCatFnd:
 			// set.Desc.DefaultAcs is ignored.
 			if set.Desc.Trusted != nil {
@@ -2506,10 +3090,13 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 			}
 		case types.TopicCatGrp:
 			// Update group topic
-			if t.owner == asUid {
+			if t.isOwner(asUid) {
 				err = assignAccess(core, set.Desc.DefaultAcs)
 				sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
 				sendCommon = assignGenericValues(core, "Trusted", t.trusted, set.Desc.Trusted) || sendCommon
+			} else if set.Desc.DefaultAcs == nil && set.Desc.Trusted == nil && t.userCan(asUid, capDesc) {
+				// Managers change only the public description.
+				sendCommon = assignGenericValues(core, "Public", t.public, set.Desc.Public)
 			} else if set.Desc.DefaultAcs != nil || set.Desc.Public != nil || set.Desc.Trusted != nil {
 				// This is a request from non-owner
 				sess.queueOut(ErrPermissionDeniedReply(msg, now))
@@ -2522,6 +3109,61 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 			return err
 		}
 
+		if ttl := set.Desc.MsgTTL; ttl != nil {
+			switch {
+			case t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp && t.cat != types.TopicCatSlf:
+				sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+				return errors.New("invalid topic category for message TTL")
+			case t.cat == types.TopicCatGrp && !t.isOwner(asUid):
+				// Only owners can change message TTL of a group topic, any party can in p2p topics.
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("attempt to change message TTL by non-owner")
+			case *ttl < 0:
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return errors.New("invalid message TTL")
+			case *ttl > 0 && globals.msgTTLMin == 0:
+				sess.queueOut(ErrNotImplementedReply(msg, now))
+				return errors.New("disappearing messages are disabled")
+			case *ttl > 0 && *ttl < globals.msgTTLMin:
+				sess.queueOut(ErrPolicyReply(msg, now))
+				return errors.New("message TTL is too short")
+			case *ttl != t.msgTTL:
+				core["MsgTTL"] = *ttl
+				sendCommon = true
+			}
+		}
+
+		if slow := set.Desc.SlowMode; slow != nil {
+			switch {
+			case t.cat != types.TopicCatGrp:
+				sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+				return errors.New("invalid topic category for slow mode")
+			case asChan || !t.userCan(asUid, capDesc):
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("attempt to change slow mode by non-manager")
+			case *slow < 0 || *slow > maxSlowMode:
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return errors.New("invalid slow mode interval")
+			case *slow != t.slowMode:
+				core["SlowMode"] = *slow
+				sendCommon = true
+			}
+		}
+
+		if frozen := set.Desc.Frozen; frozen != nil {
+			switch {
+			case t.cat != types.TopicCatGrp:
+				sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+				return errors.New("invalid topic category for freeze")
+			case asChan || (!t.userCan(asUid, capDesc) && authLevel != auth.LevelRoot):
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+				return errors.New("attempt to freeze topic by non-manager")
+			case *frozen != t.frozen:
+				core["Frozen"] = *frozen
+				sendCommon = true
+			}
+		}
+
 		sendPriv = assignGenericValues(sub, "Private", t.perUser[asUid].private, set.Desc.Private)
 	}
 
@@ -2579,6 +3221,19 @@ func (t *Topic) replySetDesc(sess *Session, asUid types.Uid, asChan bool,
 		// Assign per-session fnd.Public.
 		t.fndSetPublic(sess, core["Public"])
 	}
+	if ttl, ok := core["MsgTTL"]; ok {
+		t.msgTTL = ttl.(int)
+	}
+	if slow, ok := core["SlowMode"]; ok {
+		t.slowMode = slow.(int)
+	}
+	if frozen, ok := core["Frozen"]; ok {
+		t.frozen = frozen.(bool)
+	}
+	if status, ok := core["Status"]; ok {
+		t.userStatus, _ = status.(*types.UserStatus)
+		t.statusExpirySchedule()
+	}
 
 	pud := t.perUser[asUid]
 	mode := pud.modeGiven & pud.modeWant
@@ -2623,10 +3278,17 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 		req = msg.Get.Sub
 	}
 
-	if req != nil && (req.SinceId != 0 || req.BeforeId != 0) {
+	if req != nil && (req.SinceId != 0 || req.BeforeId != 0 ||
+		((req.Label != "" || req.Archived) && t.cat != types.TopicCatMe) ||
+		(req.Pending && (t.cat != types.TopicCatGrp || asChan))) {
 		sess.queueOut(ErrMalformedReply(msg, now))
 		return errors.New("invalid MsgGetOpts query")
 	}
+	if req != nil && req.Pending && !t.userCan(asUid, capInvite) {
+		// Only those who can approve requests see them.
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to list join requests by non-manager")
+	}
 
 	var err error
 
@@ -2653,7 +3315,16 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 		// Fetch user's subscriptions, with Topic.Public+Topic.Trusted denormalized into subscription.
 		if ifModified.IsZero() {
 			// No cache management. Skip deleted subscriptions.
-			subs, err = store.Users.GetTopics(asUid, msgOpts2storeOpts(req))
+			opts := msgOpts2storeOpts(req)
+			if opts == nil {
+				opts = &types.QueryOpt{}
+			}
+			if opts.Topic == "" {
+				// Archived subscriptions are listed only when requested.
+				archived := req != nil && req.Archived
+				opts.Archived = &archived
+			}
+			subs, err = store.Users.GetTopics(asUid, opts)
 		} else {
 			// User manages cache. Include deleted subscriptions too.
 			subs, err = store.Users.GetTopicsAny(asUid, msgOpts2storeOpts(req))
@@ -2712,13 +3383,17 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 
 					// Ordinary users: find only active topics and accounts.
 					// Root users: find all topics and accounts, including suspended and soft-deleted.
-					subs, err = store.Users.FindSubs(asUid, globals.aliasTagNS, req, opt, sess.authLvl != auth.LevelRoot)
+					subs, err = store.Users.FindSubs(asUid, t.tenant, globals.aliasTagNS, req, opt, sess.authLvl != auth.LevelRoot)
 					if err != nil {
 						sess.queueOut(decodeStoreErrorExplicitTs(err, id, msg.Original, now, incomingReqTs, nil))
 						return err
 					}
 				}
 			}
+			if err == nil && len(subs) > 0 && sess.authLvl != auth.LevelRoot {
+				// Users who blocked each other cannot find one another.
+				subs, err = filterBlockedSubs(asUid, subs)
+			}
 		}
 	case types.TopicCatP2P:
 		// TODO(gene): don't load subs from DB, use perUserData - it already contains subscriptions.
@@ -2749,6 +3424,9 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 			// User manages cache. Include deleted subscriptions too.
 			subs, err = store.Topics.GetUsersAny(topicName, msgOpts2storeOpts(req))
 		}
+		if err == nil && req != nil && req.Pending {
+			subs = filterPendingSubs(subs)
+		}
 		// Do nothing for all other topic types, like 'sys', 'slf'.
 	}
 
@@ -2771,6 +3449,12 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 	presencer := (userData.modeGiven & userData.modeWant).IsPresencer()
 	sharer := (userData.modeGiven & userData.modeWant).IsSharer()
 
+	var peerPresence map[types.Uid]*types.PresenceSettings
+	if t.cat == types.TopicCatMe {
+		// Other users of p2p subscriptions may hide the time when they were last online.
+		peerPresence = peersPresence(subs)
+	}
+
 	for i := range subs {
 		sub := &subs[i]
 		// Indicator if the requester has provided a cut off date for ts of pub & priv updates.
@@ -2831,7 +3515,7 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 				}
 
 				lastSeen := sub.GetLastSeen()
-				if lastSeen != nil && !mts.Online {
+				if lastSeen != nil && !mts.Online && peerLastSeenVisible(peerPresence, sub) {
 					mts.LastSeen = &MsgLastSeenInfo{
 						When:      lastSeen,
 						UserAgent: sub.GetUserAgent(),
@@ -2860,7 +3544,7 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 
 				if t.cat == types.TopicCatGrp {
 					pud := t.perUser[uid]
-					mts.Online = pud.online > 0 && presencer
+					mts.Online = pud.online > 0 && (!pud.presHidden || uid == asUid) && presencer
 				}
 			}
 		}
@@ -2884,6 +3568,12 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 					mts.Acs.Want = sub.ModeWant.String()
 					mts.Acs.Given = sub.ModeGiven.String()
 				}
+				// Roles are visible to everyone: members should know who moderates the topic.
+				mts.Role = t.roleOf(uid)
+				if sub.Request != "" && isJoinRequest(sub.ModeWant, sub.ModeGiven) &&
+					(uid == asUid || t.userCan(asUid, capInvite)) {
+					mts.Request = sub.Request
+				}
 			} else {
 				// Topic 'fnd'
 				// sub.ModeXXX may be defined by the plugin.
@@ -2909,9 +3599,13 @@ func (t *Topic) replyGetSub(sess *Session, asUid types.Uid, authLevel auth.Level
 				// 'sub' has nil 'public'/'trusted' in P2P topics which is OK.
 				mts.Public = sub.GetPublic()
 				mts.Trusted = sub.GetTrusted()
+				mts.Status = statusToMsg(sub.GetStatus(), now)
 				// Reporting 'private' only if it's user's own subscription.
 				if uid == asUid {
 					mts.Private = sub.Private
+					mts.Labels = sub.Labels
+					mts.Archived = sub.ArchivedAt
+					mts.Unarchive = sub.AutoUnarchive
 				}
 			}
 
@@ -2991,20 +3685,48 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, asChan bool, req *M
 		return errors.New("invalid MsgGetOpts query")
 	}
 
+	var lang string
+	if req != nil && req.Translate != "" {
+		var err error
+		if lang, err = translate.NormalizeLang(req.Translate); err != nil {
+			sess.queueOut(ErrMalformedReply(msg, now))
+			return err
+		}
+		if !translate.IsEnabled() {
+			sess.queueOut(ErrNotImplementedReply(msg, now))
+			return translate.ErrNotConfigured
+		}
+	}
+
 	// Check if the user has permission to read the topic data
 	count := 0
 	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
 		// Read messages from DB
-		messages, err := store.Messages.GetAll(t.name, asUid, msgOpts2storeOpts(req))
+		opts := msgOpts2storeOpts(req)
+		queryDone := storeQueryStart(msg.ctx, "Messages.GetAll", t.name, opts)
+		messages, err := store.Messages.GetAll(t.name, asUid, opts)
+		queryDone()
 		if err != nil {
-			sess.queueOut(ErrUnknownReply(msg, now))
+			// Search is not supported if the search index is disabled.
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
 			return err
 		}
 
+		// Drop messages scoped to other users and messages of blocked users.
+		messages = t.filterByMsgScope(messages, asUid)
+		messages = t.filterBlockedMessages(messages, asUid)
+
 		// Push the list of messages to the client as {data}.
 		if messages != nil {
 			count = len(messages)
 			if count > 0 {
+				reactions := reactionsForDelivery(t.name, asUid, messages)
+				polls := pollsForDelivery(t.name, asUid, messages)
+				var translations map[int]*MsgTranslation
+				var pending []pendingTranslation
+				if lang != "" {
+					translations, pending = translationsForDelivery(t.name, lang, messages)
+				}
 				outgoingMessages := make([]*ServerComMessage, count)
 				for i := range messages {
 					mm := &messages[i]
@@ -3013,17 +3735,33 @@ func (t *Topic) replyGetData(sess *Session, asUid types.Uid, asChan bool, req *M
 						// Don't show sender for channel readers
 						from = types.ParseUid(mm.From).UserId()
 					}
+					head, content := transformForDelivery(t.name, mm.SeqId, mm.Head, mm.Content)
 					outgoingMessages[i] = &ServerComMessage{
 						Data: &MsgServerData{
-							Topic:     toriginal,
-							Head:      mm.Head,
-							SeqId:     mm.SeqId,
-							From:      from,
-							Timestamp: mm.CreatedAt,
-							Content:   mm.Content,
+							Topic:       toriginal,
+							Head:        head,
+							SeqId:       mm.SeqId,
+							From:        from,
+							Timestamp:   mm.CreatedAt,
+							Content:     sess.downgradeContent(head, content),
+							Reactions:   reactions[mm.SeqId],
+							Poll:        polls[mm.SeqId],
+							Translation: translations[mm.SeqId],
 						},
 					}
 				}
+
+				if len(pending) > 0 {
+					// Waiting for the translation provider must not block the topic.
+					topic := t.name
+					go func() {
+						translatePending(topic, lang, pending, outgoingMessages)
+						sess.queueOutBatch(outgoingMessages)
+						sess.queueOut(NoErrDeliveredParams(msg.Id, msg.Original, now,
+							map[string]any{"what": "data", "count": count}))
+					}()
+					return nil
+				}
 				sess.queueOutBatch(outgoingMessages)
 			}
 		}
@@ -3058,7 +3796,7 @@ func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 				if subs == nil {
 					if prefix, _ := validateTag(tag); prefix != "" {
 						// Check only if a fully-qualified tag was sent. Otherwise ignore the request.
-						found, err = store.Users.FindOne(tag)
+						found, err = store.Users.FindOne(t.tenant, tag)
 					}
 				} else {
 					// The plugin returned a list of topics. Send the first one.
@@ -3093,7 +3831,7 @@ func (t *Topic) replyGetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
 		return errors.New("invalid topic category for getting tags")
 	}
-	if t.cat == types.TopicCatGrp && t.owner != asUid {
+	if t.cat == types.TopicCatGrp && !t.isOwner(asUid) {
 		sess.queueOut(ErrPermissionDeniedReply(msg, now))
 		return errors.New("request for tags from non-owner")
 	}
@@ -3125,7 +3863,7 @@ func (t *Topic) replySetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 		return errors.New("invalid topic category to assign tags")
 	}
 
-	if t.cat == types.TopicCatGrp && t.owner != asUid {
+	if t.cat == types.TopicCatGrp && !t.isOwner(asUid) {
 		sess.queueOut(ErrPermissionDeniedReply(msg, now))
 		return errors.New("tags update by non-owner")
 	}
@@ -3166,10 +3904,10 @@ func (t *Topic) replySetTags(sess *Session, asUid types.Uid, msg *ClientComMessa
 
 	// Remove unprefixed tags
 	if unique := filterTags(added, map[string]bool{globals.aliasTagNS: true}); len(unique) > 0 {
-		// Check for global uniqueness.
+		// Check for uniqueness within the tenant.
 		// It's not inside a transaction, so a race may happen.
 		for _, tag := range unique {
-			result, err := store.Users.FindOne(tag)
+			result, err := store.Users.FindOne(t.tenant, tag)
 
 			if err != nil {
 				sess.queueOut(ErrUnknownReply(msg, now))
@@ -3329,6 +4067,24 @@ func (t *Topic) replySetAux(sess *Session, asUid types.Uid, msg *ClientComMessag
 	}
 
 	if aux, changed := mergeMaps(copyMap(t.aux), msg.Set.Aux); changed {
+		if _, ok := msg.Set.Aux[auxModeration]; ok {
+			if err := validateTopicModeration(aux[auxModeration]); err != nil {
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return err
+			}
+		}
+		if _, ok := msg.Set.Aux[auxOnboarding]; ok {
+			if err := validateTopicOnboarding(aux[auxOnboarding]); err != nil {
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return err
+			}
+		}
+		if val, ok := aux[auxE2EE]; ok {
+			if _, ok := val.(bool); !ok {
+				sess.queueOut(ErrMalformedReply(msg, now))
+				return errors.New("invalid e2ee flag")
+			}
+		}
 		err := store.Topics.Update(t.name, map[string]any{"Aux": aux, "UpdatedAt": now})
 		if err == nil {
 			t.aux = aux
@@ -3359,7 +4115,10 @@ func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg
 
 	// Check if the user has permission to read the topic data and the request is valid.
 	if userData := t.perUser[asUid]; (userData.modeGiven & userData.modeWant).IsReader() {
-		ranges, delID, err := store.Messages.GetDeleted(t.name, asUid, msgOpts2storeOpts(req))
+		opts := msgOpts2storeOpts(req)
+		queryDone := storeQueryStart(msg.ctx, "Messages.GetDeleted", t.name, opts)
+		ranges, delID, err := store.Messages.GetDeleted(t.name, asUid, opts)
+		queryDone()
 		if err != nil {
 			sess.queueOut(ErrUnknownReply(msg, now))
 			return err
@@ -3386,6 +4145,59 @@ func (t *Topic) replyGetDel(sess *Session, asUid types.Uid, req *MsgGetOpts, msg
 	return nil
 }
 
+// replyGetEdits returns previous versions of edited messages.
+func (t *Topic) replyGetEdits(sess *Session, asUid types.Uid, req *MsgGetOpts, msg *ClientComMessage) error {
+	now := types.TimeNow()
+	toriginal := t.original(asUid)
+
+	if req != nil && (req.IfModifiedSince != nil || req.User != "" || req.Topic != "" || req.Search != "") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("invalid MsgGetOpts query")
+	}
+
+	if userData := t.perUser[asUid]; !(userData.modeGiven & userData.modeWant).IsReader() {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("attempt to get edit history by non-reader")
+	}
+
+	versions, err := store.Messages.GetEdits(t.name, asUid, msgOpts2storeOpts(req))
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	var edits []MsgMessageVersion
+	for i := range versions {
+		ver := &versions[i]
+		// Drop versions of messages scoped to other users.
+		if !t.userInMsgScope(msgScope(ver.Head), asUid) {
+			continue
+		}
+		edits = append(edits, MsgMessageVersion{
+			SeqId:      ver.SeqId,
+			Version:    ver.Version,
+			Timestamp:  ver.CreatedAt,
+			ReplacedAt: ver.ReplacedAt,
+			Content:    sess.downgradeContent(ver.Head, ver.Content),
+		})
+	}
+
+	if len(edits) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "edits"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     toriginal,
+			Timestamp: &now,
+			Edits:     edits,
+		},
+	})
+	return nil
+}
+
 // replyDelMsg deletes (soft or hard) messages in response to del.msg packet.
 func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *ClientComMessage) error {
 	now := types.TimeNow()
@@ -3407,13 +4219,13 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 	}
 	// Note: We allow hard delete for message owners even without D permission.
 	// The ownership check happens later when processing each message.
+	var count int
 
 	var err error
 	var ranges []types.Range
 	if len(del.DelSeq) == 0 {
 		err = errors.New("del.msg: no IDs to delete")
 	} else {
-		count := 0
 		for _, dq := range del.DelSeq {
 			if dq.LowId > t.lastID || dq.LowId < 0 || dq.HiId < 0 ||
 				(dq.HiId > 0 && dq.LowId > dq.HiId) ||
@@ -3459,6 +4271,14 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 	forUser := asUid
 	var age time.Duration
 	if del.Hard {
+		// In group topics, users without the capability to delete messages of others delete only their own.
+		if ok, err := t.canDeleteMessages(asUid, ranges, count); err != nil {
+			sess.queueOut(ErrUnknownReply(msg, now))
+			return err
+		} else if !ok {
+			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			return errors.New("del.msg: permission denied to delete messages of other users")
+		}
 		forUser = types.ZeroUid
 		age = globals.msgDeleteAge
 	}
@@ -3466,50 +4286,20 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 		sess.queueOut(ErrUnknownReply(msg, now))
 		return err
 	}
+	t.journalDelete(asUid, ranges, del.Hard, journalDelUser)
 
 	// Increment Delete transaction ID
 	t.delID++
-	dr := rangeDeserialize(ranges)
 	if del.Hard {
-		for uid, pud := range t.perUser {
-			pud.delID = t.delID
-			t.perUser[uid] = pud
-
-			// Update unread counters for all users who may have had these messages as unread
-			if (pud.modeGiven & pud.modeWant).IsReader() {
-				// Calculate how many unread messages were deleted for this user
-				unreadDeleted := calculateUnreadInRanges(pud.readID, t.lastID, ranges)
-				if unreadDeleted > 0 {
-					// Decrease unread count (negative value)
-					usersUpdateUnread(uid, -unreadDeleted, true)
-				}
-			}
-		}
-
-		// Broadcast the change to all, online and offline, exclude the session making the change.
-		params := &presParams{delID: t.delID, delSeq: dr, actor: asUid.UserId()}
-		filters := &presFilters{filterIn: types.ModeRead}
-		t.presSubsOnline("del", params.actor, params, filters, sess.sid)
-		t.presSubsOffline("del", params, filters, nilPresFilters, sess.sid, true)
-
-		// Also broadcast {info} message for delete (for clients that handle info messages)
-		info := &ServerComMessage{
-			Info: &MsgServerInfo{
-				What:  "del",
-				SeqId: ranges[0].Low, // First deleted message seq
-				From:  asUid.UserId(),
-				Topic: t.original(asUid),
-			},
-			SkipSid: sess.sid,
-		}
-		t.broadcastToSessions(info)
+		t.unpinDeleted(ranges)
+		t.broadcastHardDelete(ranges, asUid, t.original(asUid), sess.sid)
 	} else {
 		pud := t.perUser[asUid]
 		pud.delID = t.delID
 		t.perUser[asUid] = pud
 
 		// Notify user's other sessions
-		t.presPubMessageDelete(asUid, pud.modeGiven&pud.modeWant, t.delID, dr, sess.sid)
+		t.presPubMessageDelete(asUid, pud.modeGiven&pud.modeWant, t.delID, rangeDeserialize(ranges), sess.sid)
 	}
 
 	sess.queueOut(NoErrParamsReply(msg, now, map[string]int{"del": t.delID}))
@@ -3517,11 +4307,48 @@ func (t *Topic) replyDelMsg(sess *Session, asUid types.Uid, asChan bool, msg *Cl
 	return nil
 }
 
+// broadcastHardDelete updates subscriptions after the messages were hard-deleted by the delete
+// operation t.delID and informs subscribers about it, excluding the session which made the change.
+func (t *Topic) broadcastHardDelete(ranges []types.Range, actor types.Uid, topicName, skipSid string) {
+	for uid, pud := range t.perUser {
+		pud.delID = t.delID
+		t.perUser[uid] = pud
+
+		// Update unread counters for all users who may have had these messages as unread
+		if (pud.modeGiven & pud.modeWant).IsReader() {
+			// Calculate how many unread messages were deleted for this user
+			unreadDeleted := calculateUnreadInRanges(pud.readID, t.lastID, ranges)
+			if unreadDeleted > 0 {
+				// Decrease unread count (negative value)
+				usersUpdateUnread(uid, -unreadDeleted, true)
+			}
+		}
+	}
+
+	// Broadcast the change to all, online and offline, exclude the session making the change.
+	params := &presParams{delID: t.delID, delSeq: rangeDeserialize(ranges), actor: actor.UserId()}
+	filters := &presFilters{filterIn: types.ModeRead}
+	t.presSubsOnline("del", params.actor, params, filters, skipSid)
+	t.presSubsOffline("del", params, filters, nilPresFilters, skipSid, true)
+
+	// Also broadcast {info} message for delete (for clients that handle info messages)
+	info := &ServerComMessage{
+		Info: &MsgServerInfo{
+			What:  "del",
+			SeqId: ranges[0].Low, // First deleted message seq
+			From:  actor.UserId(),
+			Topic: topicName,
+		},
+		SkipSid: skipSid,
+	}
+	t.broadcastToSessions(info)
+}
+
 // Handle request to delete the topic {del what="topic"}.
-// 1. If requester is the owner then it should have been handled at the hub, log an error.
-// 2. If requester is not the owner, treat it like {leave unsub=true}.
+// 1. If requester is an owner then it should have been handled at the hub, log an error.
+// 2. If requester is not an owner, treat it like {leave unsub=true}.
 func (t *Topic) replyDelTopic(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
-	if t.owner != asUid {
+	if !t.isOwner(asUid) {
 		return t.replyLeaveUnsub(sess, msg, asUid)
 	}
 
@@ -3581,8 +4408,7 @@ func (t *Topic) replyDelSub(sess *Session, asUid types.Uid, msg *ClientComMessag
 	// Get ID of the affected user
 	uid := types.ParseUserId(del.User)
 
-	pud := t.perUser[asUid]
-	if !(pud.modeGiven & pud.modeWant).IsAdmin() {
+	if !t.userCan(asUid, capBan) {
 		err = errors.New("del.sub: permission denied")
 	} else if uid.IsZero() || uid == asUid {
 		// Cannot delete self-subscription. User [leave unsub] or [delete topic]
@@ -3606,6 +4432,8 @@ func (t *Topic) replyDelSub(sess *Session, asUid types.Uid, msg *ClientComMessag
 	// Check if the user being ejected is the owner.
 	if (pud.modeGiven & pud.modeWant).IsOwner() {
 		err = errors.New("del.sub: cannot evict topic owner")
+	} else if !t.isOwner(asUid) && t.rankOf(uid) > t.rankOf(asUid) {
+		err = errors.New("del.sub: cannot evict user of a higher rank")
 	} else if !pud.modeWant.IsJoiner() {
 		// If the user has banned the topic, subscription should not be deleted. Otherwise user may be re-invited
 		// which defeats the purpose of banning.
@@ -3660,11 +4488,24 @@ func (t *Topic) replyLeaveUnsub(sess *Session, msg *ClientComMessage, asUid type
 		panic("replyLeaveUnsub: zero asUid")
 	}
 
-	if t.owner == asUid {
-		if msg.init {
-			sess.queueOut(ErrPermissionDeniedReply(msg, now))
+	if t.isOwner(asUid) {
+		// Owners leave only while another owner remains.
+		if t.otherOwner(asUid).IsZero() {
+			if msg.init {
+				sess.queueOut(ErrPermissionDeniedReply(msg, now))
+			}
+			return errors.New("replyLeaveUnsub: the last owner cannot unsubscribe")
+		}
+		var remoteAddr string
+		if sess != nil {
+			remoteAddr = sess.remoteAddr
+		}
+		if err := t.stepDownOwner(asUid, remoteAddr); err != nil {
+			if msg.init {
+				sess.queueOut(ErrUnknownReply(msg, now))
+			}
+			return err
 		}
-		return errors.New("replyLeaveUnsub: owner cannot unsubscribe")
 	}
 
 	var err error
@@ -3806,6 +4647,16 @@ func (t *Topic) notifySubChange(uid, actor types.Uid, isChan bool,
 
 	unsub := newWant == types.ModeUnset || newGiven == types.ModeUnset
 
+	if t.community {
+		// Members who lost J leave topics of the community.
+		t.communityMembersChanged(uid, unsub || !(newWant&newGiven).IsJoiner())
+	}
+	if !isChan {
+		t.onboardingSubChange(uid, oldWant, oldGiven, newWant, newGiven)
+		t.webhookSubChange(uid, oldWant, oldGiven, newWant, newGiven)
+		t.matrixSubChange(uid, oldWant, oldGiven, newWant, newGiven)
+	}
+
 	target := uid.UserId()
 
 	dWant := types.ModeNone.String()
@@ -4132,6 +4983,7 @@ func (t *Topic) addSession(sess *Session, asUid types.Uid, isChanSub bool) {
 	} else {
 		t.sessions[s] = perSessionData{uid: asUid, isChanSub: isChanSub}
 	}
+	t.sessCount.Store(int64(len(t.sessions)))
 }
 
 // Disconnects session from topic if either one of the following is true:
@@ -4153,6 +5005,7 @@ func (t *Topic) remSession(sess *Session, asUid types.Uid) (*perSessionData, boo
 
 	if pssd.uid == asUid || asUid.IsZero() {
 		delete(t.sessions, s)
+		t.sessCount.Store(int64(len(t.sessions)))
 		return &pssd, true
 	}
 
@@ -4163,6 +5016,7 @@ func (t *Topic) remSession(sess *Session, asUid types.Uid) (*perSessionData, boo
 			t.sessions[s] = pssd
 			if len(pssd.muids) == 0 {
 				delete(t.sessions, s)
+				t.sessCount.Store(int64(len(t.sessions)))
 				return &pssd, true
 			}
 
@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -11,6 +19,7 @@ import (
 	"github.com/golang/mock/gomock"
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/sfu"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/mock_store"
 	"github.com/tinode/chat/server/store/types"
@@ -49,11 +58,29 @@ type TopicTestHelper struct {
 	uu *mock_store.MockUsersPersistenceInterface
 	tt *mock_store.MockTopicsPersistenceInterface
 	ss *mock_store.MockSubsPersistenceInterface
+	rr *mock_store.MockReactionsPersistenceInterface
+	pl *mock_store.MockPollsPersistenceInterface
+	th *mock_store.MockThreadsPersistenceInterface
+	sm *mock_store.MockScheduledPersistenceInterface
+	se *mock_store.MockSessionPersistenceInterface
+	ke *mock_store.MockKeysPersistenceInterface
+	ud *mock_store.MockUserDevicePersistenceInterface
+	dv *mock_store.MockDevicePersistenceInterface
+	ns *mock_store.MockNotifySettingsPersistenceInterface
+	mn *mock_store.MockMentionsPersistenceInterface
+	dr *mock_store.MockDraftsPersistenceInterface
+	st *mock_store.MockStarredPersistenceInterface
+	ct *mock_store.MockContactsPersistenceInterface
+	bl *mock_store.MockBlocksPersistenceInterface
+	fl *mock_store.MockFilePersistenceInterface
+	ca *mock_store.MockCallPersistenceInterface
+	pr *mock_store.MockPresenceSettingsPersistenceInterface
 }
 
 func (b *TopicTestHelper) finish() {
 	b.topic.killTimer.Stop()
 	b.topic.callEstablishmentTimer.Stop()
+	b.topic.typingTimer.Stop()
 	// Stop session write loops.
 	for _, s := range b.sessions {
 		close(s.send)
@@ -94,10 +121,51 @@ func (b *TopicTestHelper) setUp(t *testing.T, numUsers int, cat types.TopicCat,
 	b.uu = mock_store.NewMockUsersPersistenceInterface(b.ctrl)
 	b.tt = mock_store.NewMockTopicsPersistenceInterface(b.ctrl)
 	b.ss = mock_store.NewMockSubsPersistenceInterface(b.ctrl)
+	b.rr = mock_store.NewMockReactionsPersistenceInterface(b.ctrl)
+	b.pl = mock_store.NewMockPollsPersistenceInterface(b.ctrl)
+	b.th = mock_store.NewMockThreadsPersistenceInterface(b.ctrl)
+	b.sm = mock_store.NewMockScheduledPersistenceInterface(b.ctrl)
+	b.se = mock_store.NewMockSessionPersistenceInterface(b.ctrl)
+	b.ke = mock_store.NewMockKeysPersistenceInterface(b.ctrl)
+	b.ud = mock_store.NewMockUserDevicePersistenceInterface(b.ctrl)
+	b.dv = mock_store.NewMockDevicePersistenceInterface(b.ctrl)
+	b.ns = mock_store.NewMockNotifySettingsPersistenceInterface(b.ctrl)
+	b.mn = mock_store.NewMockMentionsPersistenceInterface(b.ctrl)
+	b.dr = mock_store.NewMockDraftsPersistenceInterface(b.ctrl)
+	b.st = mock_store.NewMockStarredPersistenceInterface(b.ctrl)
+	b.ct = mock_store.NewMockContactsPersistenceInterface(b.ctrl)
+	b.bl = mock_store.NewMockBlocksPersistenceInterface(b.ctrl)
+	b.fl = mock_store.NewMockFilePersistenceInterface(b.ctrl)
+	b.ca = mock_store.NewMockCallPersistenceInterface(b.ctrl)
+	b.pr = mock_store.NewMockPresenceSettingsPersistenceInterface(b.ctrl)
+	// Most tests don't involve blocked users.
+	b.bl.EXPECT().GetAll(gomock.Any()).Return(nil, nil).AnyTimes()
+	b.bl.EXPECT().GetBetween(gomock.Any()).Return(nil, nil).AnyTimes()
+	// Nor presence settings.
+	b.pr.EXPECT().Get(gomock.Any()).Return(nil, nil).AnyTimes()
+	b.pr.EXPECT().GetForUser(gomock.Any()).Return(nil, nil).AnyTimes()
+	b.pr.EXPECT().GetForTopic(gomock.Any()).Return(nil, nil).AnyTimes()
 	store.Messages = b.mm
 	store.Users = b.uu
 	store.Topics = b.tt
 	store.Subs = b.ss
+	store.Reactions = b.rr
+	store.Polls = b.pl
+	store.Threads = b.th
+	store.Scheduled = b.sm
+	store.Sessions = b.se
+	store.Keys = b.ke
+	store.UserDevices = b.ud
+	store.Devices = b.dv
+	store.NotifySettings = b.ns
+	store.Mentions = b.mn
+	store.Drafts = b.dr
+	store.Starred = b.st
+	store.Contacts = b.ct
+	store.Blocks = b.bl
+	store.Files = b.fl
+	store.Calls = b.ca
+	store.PresenceSettings = b.pr
 	// Sessions.
 	b.sessions = make([]*Session, b.numUsers)
 	b.results = make([]*responses, b.numUsers)
@@ -110,6 +178,7 @@ func (b *TopicTestHelper) setUp(t *testing.T, numUsers int, cat types.TopicCat,
 
 	// Hub.
 	b.hub = &Hub{
+		topics:   &sync.Map{},
 		routeCli: make(chan *ClientComMessage, 10),
 		routeSrv: make(chan *ServerComMessage, 10),
 	}
@@ -144,6 +213,9 @@ func (b *TopicTestHelper) setUp(t *testing.T, numUsers int, cat types.TopicCat,
 		sessions:               ps,
 		killTimer:              time.NewTimer(time.Hour),
 		callEstablishmentTimer: time.NewTimer(time.Second),
+		typingTimer:            time.NewTimer(time.Hour),
+		// Subscribers have not changed settings of notifications.
+		notify: make(map[types.Uid]*types.TopicNotifySettings),
 	}
 	if cat != types.TopicCatSys {
 		b.topic.accessAuth = getDefaultAccess(cat, true, false)
@@ -164,6 +236,23 @@ func (b *TopicTestHelper) tearDown() {
 	store.Users = nil
 	store.Topics = nil
 	store.Subs = nil
+	store.Reactions = nil
+	store.Polls = nil
+	store.Threads = nil
+	store.Scheduled = nil
+	store.Sessions = nil
+	store.Keys = nil
+	store.UserDevices = nil
+	store.Devices = nil
+	store.NotifySettings = nil
+	store.Mentions = nil
+	store.Drafts = nil
+	store.Starred = nil
+	store.Contacts = nil
+	store.Blocks = nil
+	store.Files = nil
+	store.Calls = nil
+	store.PresenceSettings = nil
 	b.ctrl.Finish()
 }
 
@@ -199,6 +288,7 @@ func TestHandleBroadcastDataP2P(t *testing.T) {
 	helper.setUp(t, numUsers, types.TopicCatP2P, "p2p-test" /*attach=*/, true)
 	defer helper.tearDown()
 	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
 
 	from := helper.uids[0].UserId()
 	msg := &ClientComMessage{
@@ -284,6 +374,13 @@ func TestHandleBroadcastCall(t *testing.T) {
 	helper.topic.lastID = 5
 	defer helper.tearDown()
 	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
+	helper.ca.EXPECT().Create(gomock.Any()).DoAndReturn(func(call *types.CallRecord) error {
+		if call.Topic != "p2p-test" || call.SeqId != 6 || call.Room != "" || call.Owner != helper.uids[0].String() {
+			t.Errorf("Unexpected call record %+v", call)
+		}
+		return nil
+	})
 
 	from := helper.uids[0].UserId()
 	msg := &ClientComMessage{
@@ -396,6 +493,7 @@ func TestHandleBroadcastDataGroup(t *testing.T) {
 		helper.tearDown()
 	}()
 	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
 
 	// User 3 isn't allowed to read.
 	pu3 := helper.topic.perUser[helper.uids[3]]
@@ -666,6 +764,7 @@ func TestHandleBroadcastInfoP2P(t *testing.T) {
 	to := helper.uids[1]
 
 	helper.ss.EXPECT().Update(topicName, from, map[string]any{"ReadSeqId": readId}).Return(nil)
+	helper.mn.EXPECT().Count(from, topicName, readId).Return(0, nil)
 
 	msg := &ClientComMessage{
 		AsUser: from.UserId(),
@@ -2079,9 +2178,9 @@ func TestRegisterSessionMetadataUpdateFails(t *testing.T) {
 	}
 }
 
-func TestRegisterSessionOwnerChangeDbCallFails(t *testing.T) {
+func TestRegisterSessionOwnerStepDownDbCallFails(t *testing.T) {
 	topicName := "grpTest"
-	numUsers := 1
+	numUsers := 2
 	helper := TopicTestHelper{}
 	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, false)
 	defer helper.tearDown()
@@ -2094,13 +2193,10 @@ func TestRegisterSessionOwnerChangeDbCallFails(t *testing.T) {
 	uid := helper.uids[0]
 	r := helper.results[0]
 
-	// User is the topic owner.
-	pud := helper.topic.perUser[uid]
-	pud.modeWant = types.ModeCPublic
-	helper.topic.perUser[uid] = pud
+	// User is the primary owner, uids[1] is another owner.
 
-	// Want ownership.
-	newWant := "JRWPASO"
+	// Step down.
+	newWant := "JRWPAS"
 	join := &ClientComMessage{
 		Original: topicName,
 		Sub: &MsgClientSub{
@@ -2116,9 +2212,9 @@ func TestRegisterSessionOwnerChangeDbCallFails(t *testing.T) {
 		AuthLvl: int(auth.LevelAuth),
 		sess:    s,
 	}
-	helper.ss.EXPECT().Update(topicName, uid, gomock.Any()).Return(nil).Times(2)
+	helper.ss.EXPECT().Update(topicName, uid, gomock.Any()).Return(nil)
 	// OwnerChange call fails.
-	helper.tt.EXPECT().OwnerChange(topicName, uid).Return(types.ErrInternal)
+	helper.tt.EXPECT().OwnerChange(topicName, helper.uids[1]).Return(types.ErrInternal)
 
 	helper.topic.registerSession(join)
 	helper.finish()
@@ -2390,6 +2486,14 @@ func TestUnregisterSessionOwnerCannotUnsubscribe(t *testing.T) {
 	s := helper.sessions[0]
 	r := helper.results[0]
 
+	// Other users are not owners: the owner is the last one.
+	for _, other := range helper.uids[1:] {
+		pud := helper.topic.perUser[other]
+		pud.modeWant = types.ModeCPublic
+		pud.modeGiven = types.ModeCPublic
+		helper.topic.perUser[other] = pud
+	}
+
 	leave := &ClientComMessage{
 		Leave: &MsgClientLeave{
 			Id:    "id456",
@@ -2875,6 +2979,7 @@ func TestHandleBroadcastDataWithAttachments(t *testing.T) {
 	helper.setUp(t, numUsers, types.TopicCatP2P, "p2p-test", true)
 	defer helper.tearDown()
 	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
 
 	from := helper.uids[0].UserId()
 	msg := &ClientComMessage{
@@ -3031,6 +3136,104 @@ func TestRegisterSessionWithComplexModeString(t *testing.T) {
 	registerSessionVerifyOutputs(t, r, []int{http.StatusOK})
 }
 
+func TestRegisterSessionOwnershipAccepted(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, false)
+	defer helper.tearDown()
+
+	owner, uid := helper.uids[0], helper.uids[1]
+	s := helper.sessions[1]
+	r := helper.results[1]
+
+	// The owner offered ownership to the user.
+	pud := helper.topic.perUser[uid]
+	pud.modeWant = types.ModeCPublic
+	helper.topic.perUser[uid] = pud
+	if helper.topic.isOwner(uid) {
+		t.Fatal("Expected the offer not to make the user an owner")
+	}
+
+	join := &ClientComMessage{
+		Original: topicName,
+		Sub: &MsgClientSub{
+			Id:    "id456",
+			Topic: topicName,
+			Set: &MsgSetQuery{
+				Sub: &MsgSetSub{
+					// Accept ownership.
+					Mode: "JRWPASDO",
+				},
+			},
+		},
+		AsUser:  uid.UserId(),
+		AuthLvl: int(auth.LevelAuth),
+		sess:    s,
+	}
+
+	// The old owner keeps ownership: no OwnerChange.
+	helper.ss.EXPECT().Update(topicName, uid, gomock.Any()).Return(nil)
+
+	helper.topic.registerSession(join)
+	helper.finish()
+
+	if errorMsgs, hasError := helper.hubMessages["__ERROR__"]; hasError {
+		t.Fatal(errorMsgs[0].Ctrl.Text)
+	}
+	registerSessionVerifyOutputs(t, r, []int{http.StatusOK})
+
+	if !helper.topic.isOwner(uid) || !helper.topic.isOwner(owner) {
+		t.Error("Expected both users to be owners")
+	}
+	if helper.topic.owner != owner {
+		t.Errorf("Expected the primary owner to remain %s, got %s", owner.UserId(), helper.topic.owner.UserId())
+	}
+	if role := helper.topic.roleOf(uid); role != roleOwner {
+		t.Errorf("Expected role '%s', got '%s'", roleOwner, role)
+	}
+}
+
+func TestOwnerSuccessor(t *testing.T) {
+	owner, coOwner, admin, member := types.Uid(1), types.Uid(2), types.Uid(3), types.Uid(4)
+	now := types.TimeNow()
+	sub := func(uid types.Uid, mode types.AccessMode, role string, created time.Time) types.Subscription {
+		s := types.Subscription{User: uid.String(), ModeWant: mode, ModeGiven: mode, Role: role}
+		s.CreatedAt = created
+		return s
+	}
+
+	subs := []types.Subscription{
+		sub(owner, types.ModeCFull, "", now.Add(-4*time.Hour)),
+		sub(member, types.ModeCPublic, "", now.Add(-3*time.Hour)),
+		sub(admin, types.ModeCPublic, roleAdmin, now.Add(-2*time.Hour)),
+		sub(coOwner, types.ModeCFull, "", now.Add(-time.Hour)),
+	}
+	if s := ownerSuccessor(subs, owner); s == nil || s.User != coOwner.String() {
+		t.Errorf("Expected the other owner to succeed, got %+v", s)
+	}
+
+	// The oldest admin succeeds when there are no other owners.
+	subs = []types.Subscription{
+		sub(owner, types.ModeCFull, "", now.Add(-4*time.Hour)),
+		sub(coOwner, types.ModeCPublic|types.ModeApprove, "", now.Add(-time.Hour)),
+		sub(admin, types.ModeCPublic, roleAdmin, now.Add(-2*time.Hour)),
+		sub(member, types.ModeCPublic, "", now.Add(-3*time.Hour)),
+	}
+	if s := ownerSuccessor(subs, owner); s == nil || s.User != admin.String() {
+		t.Errorf("Expected the oldest admin to succeed, got %+v", s)
+	}
+
+	// No successor: the topic is deleted.
+	subs = []types.Subscription{
+		sub(owner, types.ModeCFull, "", now.Add(-4*time.Hour)),
+		sub(member, types.ModeCPublic, "", now.Add(-3*time.Hour)),
+	}
+	if s := ownerSuccessor(subs, owner); s != nil {
+		t.Errorf("Expected no successor, got %+v", s)
+	}
+}
+
 func TestHandleBroadcastDataGroupWithMutedUser(t *testing.T) {
 	topicName := "grp-test"
 	numUsers := 4
@@ -3038,6 +3241,7 @@ func TestHandleBroadcastDataGroupWithMutedUser(t *testing.T) {
 	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
 	defer helper.tearDown()
 	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
 
 	// User 2 has muted the topic (no Pres permission)
 	pu2 := helper.topic.perUser[helper.uids[2]]
@@ -3102,6 +3306,12 @@ func TestUnregisterSessionWithPendingCall(t *testing.T) {
 		sess:         s,
 	}
 	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ca.EXPECT().End(&types.CallRecord{
+		Topic:        "p2p-test",
+		SeqId:        123,
+		Outcome:      "disconnected",
+		Participants: []string{uid.String()},
+	}).Return(nil)
 
 	leave := &ClientComMessage{
 		Leave: &MsgClientLeave{
@@ -3376,9 +3586,3778 @@ func TestCalculateUnreadInRanges(t *testing.T) {
 	}
 }
 
-func TestMain(m *testing.M) {
-	logs.Init(os.Stderr, "stdFlags")
-	// Set max subscriber count to effective infinity.
-	globals.maxSubscriberCount = 1_000_000_000
-	os.Exit(m.Run())
+func TestReplyGetMsgGroup(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	// The second user is an ordinary member.
+	uid := helper.uids[1]
+	pud := helper.topic.perUser[uid]
+	pud.modeGiven = types.ModeCPublic
+	pud.modeWant = types.ModeCPublic
+	helper.topic.perUser[uid] = pud
+
+	now := types.TimeNow()
+	helper.mm.EXPECT().Search(uid, gomock.Any()).DoAndReturn(
+		func(forUser types.Uid, query *types.MessageSearchQuery) ([]types.Message, error) {
+			if len(query.Topics) != 1 || query.Topics[0] != topicName || query.Query != "hello" || query.Limit != 10 {
+				t.Errorf("Unexpected search query: %+v", query)
+			}
+			return []types.Message{
+				{ObjHeader: types.ObjHeader{CreatedAt: now}, SeqId: 3, Topic: topicName,
+					From: helper.uids[0].String(), Content: "hello world"},
+				// Scoped to the other user.
+				{ObjHeader: types.ObjHeader{CreatedAt: now}, SeqId: 2, Topic: topicName,
+					From: helper.uids[0].String(), Content: "hello there",
+					Head: types.KVMap{"scope": []any{helper.uids[0].UserId()}}},
+			}, nil
+		})
+
+	meta := &ClientComMessage{
+		Get: &MsgClientGet{
+			Id:    "id789",
+			Topic: topicName,
+			MsgGetQuery: MsgGetQuery{
+				What: "msg",
+				Msg:  &MsgGetOpts{Search: "hello", Limit: 10},
+			},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaMsg,
+		sess:     helper.sessions[1],
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	r := helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Msgs) != 1 {
+		t.Fatalf("Expected meta with 1 message, got %+v", m)
+	}
+	if found := m.Meta.Msgs[0]; found.SeqId != 3 || found.Topic != topicName || found.Content != "hello world" {
+		t.Errorf("Unexpected search result: %+v", found)
+	}
+}
+
+func TestReplyGetMsgMalformed(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	for _, opts := range []*MsgGetOpts{nil, {Search: "  "}, {Search: "hello", Topic: "grpOther"}} {
+		meta := &ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          "id789",
+				Topic:       topicName,
+				MsgGetQuery: MsgGetQuery{What: "msg", Msg: opts},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaMsg,
+			sess:     helper.sessions[0],
+		}
+		helper.topic.handleMeta(meta)
+	}
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 3 {
+		t.Fatalf("responses received: expected 3, received %d", len(r.messages))
+	}
+	for _, msg := range r.messages {
+		if m := msg.(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 response, got %+v", m)
+		}
+	}
+}
+
+func TestReplyGetEdits(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[1]
+	pud := helper.topic.perUser[uid]
+	pud.modeGiven = types.ModeCPublic
+	pud.modeWant = types.ModeCPublic
+	helper.topic.perUser[uid] = pud
+
+	now := types.TimeNow()
+	helper.mm.EXPECT().GetEdits(topicName, uid, gomock.Any()).Return([]types.MessageVersion{
+		{Topic: topicName, SeqId: 5, Version: 1, CreatedAt: now, ReplacedAt: now, Content: "second"},
+		{Topic: topicName, SeqId: 5, Version: 0, CreatedAt: now, ReplacedAt: now, Content: "first"},
+		// Scoped to the other user.
+		{Topic: topicName, SeqId: 4, Version: 0, CreatedAt: now, ReplacedAt: now, Content: "secret",
+			Head: types.KVMap{"scope": []any{helper.uids[0].UserId()}}},
+	}, nil)
+
+	meta := &ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id123",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "edits", Edits: &MsgGetOpts{SinceId: 4, BeforeId: 6}},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaEdits,
+		sess:     helper.sessions[1],
+	}
+	helper.topic.handleMeta(meta)
+	helper.finish()
+
+	r := helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Edits) != 2 {
+		t.Fatalf("Expected meta with 2 versions, got %+v", m)
+	}
+	if m.Meta.Edits[0].Version != 1 || m.Meta.Edits[1].Content != "first" {
+		t.Errorf("Unexpected edit history: %+v", m.Meta.Edits)
+	}
+}
+
+func TestHandleReactBroadcast(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	from := helper.uids[0]
+	helper.mm.EXPECT().GetBySeqId(topicName, 5).Return(&types.Message{SeqId: 5}, nil).Times(2)
+	helper.rr.EXPECT().Add(topicName, 5, from, "👍").Return(2, true, nil)
+	helper.rr.EXPECT().Delete(topicName, 5, from, "👎").Return(0, false, nil)
+
+	react := func(id, what, reaction string) {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			AsUser:   from.UserId(),
+			Original: topicName,
+			RcptTo:   topicName,
+			React:    &MsgClientReact{Id: id, Topic: topicName, SeqId: 5, What: what, Reaction: reaction},
+			Id:       id,
+			sess:     helper.sessions[0],
+		})
+	}
+	react("id1", "add", "👍")
+	// Removing a reaction the user doesn't have changes nothing.
+	react("id2", "del", "👎")
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 2 {
+		t.Fatalf("Session 0: expected 2 responses, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK ||
+		m.Ctrl.Params.(map[string]any)["count"] != 2 {
+		t.Errorf("Expected ctrl 200 with count, got %+v", m.Ctrl)
+	}
+	if m := r.messages[1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusNotModified {
+		t.Errorf("Expected ctrl 304, got %+v", m.Ctrl)
+	}
+
+	r = helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("Session 1: expected 1 message, received %d", len(r.messages))
+	}
+	info := r.messages[0].(*ServerComMessage).Info
+	if info == nil || info.What != "react" || info.Event != "add" || info.Reaction != "👍" ||
+		info.Count != 2 || info.From != from.UserId() {
+		t.Errorf("Unexpected reaction info: %+v", info)
+	}
+}
+
+func TestHandleVoteBroadcast(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	voter, creator := helper.uids[0], helper.uids[1]
+	helper.mm.EXPECT().GetBySeqId(topicName, 5).Return(&types.Message{SeqId: 5}, nil).Times(2)
+	helper.pl.EXPECT().Vote(topicName, 5, voter, []int{1}).Return(&types.Poll{
+		SeqId: 5, From: creator.String(), Options: 2, Tally: []int{0, 1}, Mine: []int{1},
+	}, nil)
+	helper.pl.EXPECT().Get(topicName, 5, voter).Return(&types.Poll{
+		SeqId: 5, From: creator.String(), Options: 2, Tally: []int{0, 1}, Mine: []int{1},
+	}, nil)
+
+	vote := func(id, what string, options []int) {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			AsUser:   voter.UserId(),
+			Original: topicName,
+			RcptTo:   topicName,
+			Vote:     &MsgClientVote{Id: id, Topic: topicName, SeqId: 5, What: what, Options: options},
+			Id:       id,
+			sess:     helper.sessions[0],
+		})
+	}
+	vote("id1", "", []int{1})
+	// Only the creator can close the poll.
+	vote("id2", "close", nil)
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 2 {
+		t.Fatalf("Session 0: expected 2 responses, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK ||
+		!reflect.DeepEqual(m.Ctrl.Params.(map[string]any)["tally"], []int{0, 1}) {
+		t.Errorf("Expected ctrl 200 with tally, got %+v", m.Ctrl)
+	}
+	if m := r.messages[1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusForbidden {
+		t.Errorf("Expected ctrl 403, got %+v", m.Ctrl)
+	}
+
+	r = helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("Session 1: expected 1 message, received %d", len(r.messages))
+	}
+	info := r.messages[0].(*ServerComMessage).Info
+	if info == nil || info.What != "poll" || info.Event != "vote" || info.SeqId != 5 ||
+		!reflect.DeepEqual(info.Tally, []int{0, 1}) || info.From != voter.UserId() {
+		t.Errorf("Unexpected poll info: %+v", info)
+	}
+}
+
+func TestTranslationsForDelivery(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	tr := mock_store.NewMockTranslationsPersistenceInterface(ctrl)
+	store.Translations = tr
+	defer func() { store.Translations = nil }()
+
+	now := types.TimeNow()
+	messages := []types.Message{
+		{SeqId: 1, Content: "hello"},
+		{SeqId: 2, Head: map[string]any{"mime": "text/x-drafty"},
+			Content: map[string]any{"txt": "bold", "fmt": []any{map[string]any{"tp": "ST", "len": 4}}}},
+		{SeqId: 3, Content: "deleted", DeletedAt: &now},
+		{SeqId: 4, Head: map[string]any{"webrtc": "finished"}, Content: "call"},
+		{SeqId: 5, Content: ""},
+	}
+	tr.EXPECT().GetAll("grpTest", "es", []int{1, 2}).Return([]types.Translation{
+		{SeqId: 1, Lang: "es", Src: "en", Content: "hola"},
+	}, nil)
+
+	cached, pending := translationsForDelivery("grpTest", "es", messages)
+	if len(cached) != 1 || cached[1] == nil || cached[1].Txt != "hola" || cached[1].Src != "en" || cached[1].Lang != "es" {
+		t.Errorf("Unexpected cached translations %+v", cached)
+	}
+	if len(pending) != 1 || pending[0].seqId != 2 || pending[0].text != "bold" {
+		t.Errorf("Unexpected pending translations %+v", pending)
+	}
+}
+
+func TestHandlePubModeration(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 3
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	md := mock_store.NewMockModerationPersistenceInterface(helper.ctrl)
+	store.Moderation = md
+	defer func() { store.Moderation = nil }()
+
+	// Users 1 and 2 are not topic moderators.
+	for _, uid := range helper.uids[1:] {
+		pud := helper.topic.perUser[uid]
+		pud.modeWant, pud.modeGiven = types.ModeCPublic, types.ModeCPublic
+		helper.topic.perUser[uid] = pud
+	}
+	helper.topic.aux = map[string]any{
+		auxModeration: map[string]any{"action": "quarantine", "words": []any{"spam"}},
+	}
+
+	from := helper.uids[1]
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(msg *types.Message, attachments []string, readBySender bool) (error, bool) {
+			if !reflect.DeepEqual(msg.Head[msgHeadScope], []string{from.UserId()}) ||
+				msg.Head[msgHeadModeration] != "quarantine" {
+				t.Errorf("Expected quarantined message, got head %+v", msg.Head)
+			}
+			return nil, false
+		})
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
+	md.EXPECT().Log(gomock.Any()).DoAndReturn(func(rec *types.ModerationRecord) error {
+		if rec.Topic != topicName || rec.SeqId != 1 || rec.From != from.UserId() || rec.Action != "quarantine" ||
+			rec.Filter != topicModerationFilter {
+			t.Errorf("Unexpected moderation record: %+v", rec)
+		}
+		return nil
+	})
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:    from.UserId(),
+		Original:  topicName,
+		RcptTo:    topicName,
+		Pub:       &MsgClientPub{Topic: topicName, Content: "Buy SPAM now!"},
+		Id:        "id1",
+		Timestamp: types.TimeNow(),
+		sess:      helper.sessions[1],
+	})
+	helper.finish()
+
+	hasData := func(r *responses) bool {
+		for _, m := range r.messages {
+			if m.(*ServerComMessage).Data != nil {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasData(helper.results[0]) || !hasData(helper.results[1]) {
+		t.Error("Quarantined message must be delivered to the sender and the moderator")
+	}
+	if hasData(helper.results[2]) {
+		t.Error("Quarantined message must not be delivered to other users")
+	}
+
+	if err := validateTopicModeration(map[string]any{"action": "allow"}); err == nil {
+		t.Error("Action 'allow' must be rejected")
+	}
+	if err := validateTopicModeration(map[string]any{"words": []any{"two words"}}); err == nil {
+		t.Error("Multiple words must be rejected")
+	}
+	if err := validateTopicModeration(map[string]any{"action": "flag", "words": []any{"spam"}}); err != nil {
+		t.Errorf("Valid settings rejected: %v", err)
+	}
+}
+
+func TestReplyGetThreads(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	now := types.TimeNow()
+	helper.th.EXPECT().GetAll(topicName, uid, &types.QueryOpt{Limit: 10}).Return([]types.Thread{
+		{SeqId: 3, Count: 4, LastSeqId: 9, TouchedAt: now, ReadSeqId: 7, Unread: 2, Muted: true},
+	}, nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id123",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "threads", Threads: &MsgGetOpts{Limit: 10}},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaThreads,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("responses received: expected 1, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Threads) != 1 {
+		t.Fatalf("Expected meta with 1 thread, got %+v", m)
+	}
+	if th := m.Meta.Threads[0]; th.SeqId != 3 || th.LastSeqId != 9 || th.Unread != 2 || !th.Muted {
+		t.Errorf("Unexpected thread summary: %+v", th)
+	}
+}
+
+func TestHandleThreadRead(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 10
+
+	from := helper.uids[0]
+	// Topic read marker is not updated.
+	helper.th.EXPECT().SetRead(topicName, from, 3, 8).Return(nil)
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		RcptTo:   topicName,
+		Note:     &MsgClientNote{Topic: topicName, What: "read", SeqId: 8, Thread: 3},
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	if readId := helper.topic.perUser[from].readID; readId != 0 {
+		t.Errorf("Expected topic read marker unchanged, got %d", readId)
+	}
+	r := helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("Session 1: expected 1 message, received %d", len(r.messages))
+	}
+	if info := r.messages[0].(*ServerComMessage).Info; info == nil || info.What != "read" || info.Thread != 3 ||
+		info.SeqId != 8 {
+		t.Errorf("Unexpected info: %+v", info)
+	}
+}
+
+func TestHandlePubScheduled(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	globals.schedMsgMaxDelay = time.Hour
+	defer func() { globals.schedMsgMaxDelay = 0 }()
+
+	from := helper.uids[0]
+	sendAt := time.Now().Add(10 * time.Minute).UTC().Round(time.Second)
+	// The message is stored aside, not published.
+	helper.sm.EXPECT().Add(gomock.Any()).DoAndReturn(func(msg *types.ScheduledMessage) error {
+		if msg.Topic != topicName || msg.From != from.String() || !msg.SendAt.Equal(sendAt) ||
+			msg.Head["sendAt"] != nil || msg.Head["mime"] != "text/x-drafty" {
+			t.Errorf("Unexpected scheduled message: %+v", msg)
+		}
+		msg.Id = "sched1"
+		return nil
+	})
+
+	pub := func(id, at string) {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			AsUser:   from.UserId(),
+			Original: topicName,
+			RcptTo:   topicName,
+			Pub: &MsgClientPub{
+				Topic:   topicName,
+				Head:    map[string]any{"sendAt": at, "mime": "text/x-drafty"},
+				Content: "later",
+			},
+			Id:        id,
+			Timestamp: types.TimeNow(),
+			sess:      helper.sessions[0],
+		})
+	}
+	pub("id1", sendAt.Format(time.RFC3339))
+	// Time in the past.
+	pub("id2", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	// Too far in the future.
+	pub("id3", time.Now().Add(2*time.Hour).Format(time.RFC3339))
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 3 {
+		t.Fatalf("Session 0: expected 3 responses, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusAccepted ||
+		m.Ctrl.Params.(map[string]any)["sched"] != "sched1" {
+		t.Errorf("Expected ctrl 202 with scheduled message ID, got %+v", m.Ctrl)
+	}
+	if m := r.messages[1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusBadRequest {
+		t.Errorf("Expected ctrl 400, got %+v", m.Ctrl)
+	}
+	if m := r.messages[2].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected ctrl 422, got %+v", m.Ctrl)
+	}
+	if helper.topic.lastID != 0 {
+		t.Errorf("Expected no published messages, lastID=%d", helper.topic.lastID)
+	}
+	if len(helper.results[1].messages) != 0 {
+		t.Errorf("Session 1: expected no messages, received %d", len(helper.results[1].messages))
+	}
+}
+
+func TestHandleMsgExpired(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.lastID = 10
+	helper.topic.msgTTL = 3600
+	for uid, pud := range helper.topic.perUser {
+		pud.readID = 10
+		helper.topic.perUser[uid] = pud
+	}
+
+	// The reaper found expired messages up to seq 7.
+	helper.mm.EXPECT().DeleteList(topicName, 1, types.ZeroUid, time.Duration(0), []types.Range{{Low: 1, Hi: 8}}).Return(nil)
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		Del: &MsgClientDel{
+			Topic:  topicName,
+			What:   "msg",
+			DelSeq: []MsgRange{{LowId: 1, HiId: 8}},
+			Hard:   true,
+		},
+		RcptTo:    topicName,
+		Original:  topicName,
+		Timestamp: types.TimeNow(),
+	})
+	helper.finish()
+
+	if helper.topic.delID != 1 {
+		t.Errorf("Expected topic delID 1, got %d", helper.topic.delID)
+	}
+	for _, uid := range helper.uids {
+		if helper.topic.perUser[uid].delID != 1 {
+			t.Errorf("Expected %s delID 1, got %d", uid.UserId(), helper.topic.perUser[uid].delID)
+		}
+	}
+
+	pres := helper.hubMessages[topicName]
+	if len(pres) != 1 || pres[0].Pres == nil || pres[0].Pres.What != "del" {
+		t.Fatalf("Expected one {pres what=del} to topic subscribers, got %+v", pres)
+	}
+	if p := pres[0].Pres; p.DelId != 1 || p.Src != "" || len(p.DelSeq) != 1 ||
+		p.DelSeq[0].LowId != 1 || p.DelSeq[0].HiId != 8 {
+		t.Errorf("Unexpected {pres what=del}: %+v", p)
+	}
+	for i, r := range helper.results {
+		if len(r.messages) != 1 {
+			t.Fatalf("Session %d: expected 1 message, received %d", i, len(r.messages))
+		}
+		if m := r.messages[0].(*ServerComMessage); m.Info == nil || m.Info.What != "del" || m.Info.From != "" {
+			t.Errorf("Session %d: expected {info what=del} from the server, got %+v", i, m)
+		}
+	}
+}
+
+func TestReplySetPin(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	globals.maxPinnedCount = 1
+	defer func() { globals.maxPinnedCount = 0 }()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.lastID = 10
+	// The second user is not a manager.
+	pud := helper.topic.perUser[helper.uids[1]]
+	pud.modeGiven = types.ModeCPublic
+	helper.topic.perUser[helper.uids[1]] = pud
+
+	helper.mm.EXPECT().GetBySeqId(topicName, 5).Return(&types.Message{SeqId: 5, Content: "pin me"}, nil)
+	helper.tt.EXPECT().Update(topicName, gomock.Any()).DoAndReturn(
+		func(topic string, update map[string]any) error {
+			if pinned := update["Pinned"].([]int); len(pinned) != 1 || pinned[0] != 5 {
+				t.Errorf("Unexpected update of pinned messages: %+v", update)
+			}
+			return nil
+		})
+
+	pin := func(i, seq int) {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", seq),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Pin: &MsgSetPin{SeqId: seq}},
+			},
+			AsUser:   helper.uids[i].UserId(),
+			MetaWhat: constMsgMetaPin,
+			sess:     helper.sessions[i],
+		})
+	}
+	pin(0, 5)
+	// Already pinned.
+	pin(0, 5)
+	// Too many pinned messages.
+	pin(0, 6)
+	// Not a manager.
+	pin(1, 7)
+	helper.finish()
+
+	expected := []int{http.StatusOK, http.StatusNotModified, http.StatusUnprocessableEntity}
+	if r := helper.results[0]; len(r.messages) != len(expected) {
+		t.Fatalf("Session 0: expected %d responses, received %d", len(expected), len(r.messages))
+	} else {
+		for i, code := range expected {
+			if m := r.messages[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+				t.Errorf("Session 0 response %d: expected ctrl %d, got %+v", i, code, m)
+			}
+		}
+	}
+	if r := helper.results[1]; len(r.messages) != 1 {
+		t.Fatalf("Session 1: expected 1 response, received %d", len(r.messages))
+	} else if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusForbidden {
+		t.Errorf("Session 1: expected ctrl 403, got %+v", m)
+	}
+
+	if len(helper.topic.pinned) != 1 || helper.topic.pinned[0] != 5 {
+		t.Errorf("Expected pinned messages [5], got %v", helper.topic.pinned)
+	}
+	pres := helper.hubMessages[topicName]
+	if len(pres) != 1 || pres[0].Pres == nil || pres[0].Pres.What != "pin" || pres[0].Pres.SeqId != 5 {
+		t.Errorf("Expected one {pres what=pin seq=5}, got %+v", pres)
+	}
+}
+
+func TestReplyGetReceipts(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 3
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	globals.maxReceiptFanout = 2
+	defer func() { globals.maxReceiptFanout = 0 }()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.lastID = 10
+	pud := helper.topic.perUser[helper.uids[1]]
+	pud.recvID = 7
+	pud.readID = 3
+	helper.topic.perUser[helper.uids[1]] = pud
+
+	// The read notification is saved but not forwarded: the topic has too many subscribers.
+	helper.ss.EXPECT().Update(topicName, helper.uids[0], map[string]any{"ReadSeqId": 5}).Return(nil)
+	helper.mn.EXPECT().Count(helper.uids[0], topicName, 5).Return(0, nil)
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   helper.uids[0].UserId(),
+		Original: topicName,
+		RcptTo:   topicName,
+		Note:     &MsgClientNote{Topic: topicName, What: "read", SeqId: 5},
+		sess:     helper.sessions[0],
+	})
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id123",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "receipts", Receipts: &MsgGetOpts{SeqId: 5}},
+		},
+		AsUser:   helper.uids[2].UserId(),
+		MetaWhat: constMsgMetaReceipts,
+		sess:     helper.sessions[2],
+	})
+	helper.finish()
+
+	if len(helper.results[1].messages) != 0 {
+		t.Errorf("Session 1: expected no messages, received %d", len(helper.results[1].messages))
+	}
+	r := helper.results[2]
+	if len(r.messages) != 1 {
+		t.Fatalf("Session 2: expected 1 response, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Receipts == nil {
+		t.Fatalf("Expected {meta receipts}, got %+v", m)
+	}
+	rc := m.Meta.Receipts
+	if rc.SeqId != 5 || rc.ReadCount != 1 || rc.RecvCount != 1 ||
+		len(rc.ReadBy) != 1 || rc.ReadBy[0] != helper.uids[0].UserId() ||
+		len(rc.RecvBy) != 1 || rc.RecvBy[0] != helper.uids[1].UserId() {
+		t.Errorf("Unexpected receipts: %+v", rc)
+	}
+}
+
+func TestHandleNoteTyping(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 3
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	globals.typingMinInterval = time.Hour
+	globals.typingWindow = time.Hour
+	globals.typingAggregateOver = numUsers
+	defer func() {
+		globals.typingMinInterval = 0
+		globals.typingWindow = 0
+		globals.typingAggregateOver = 0
+	}()
+
+	helper.topic.xoriginal = topicName
+	kp := func(i int) {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			AsUser:   helper.uids[i].UserId(),
+			Original: topicName,
+			RcptTo:   topicName,
+			Note:     &MsgClientNote{Topic: topicName, What: "kp"},
+			sess:     helper.sessions[i],
+		})
+	}
+
+	// The topic is small: notifications are forwarded, the second one is rate-limited.
+	kp(0)
+	kp(0)
+
+	// The topic is large: notifications are aggregated.
+	globals.typingAggregateOver = 1
+	kp(1)
+	kp(2)
+	if len(helper.topic.typing) != 2 {
+		t.Errorf("Expected 2 typing users, got %d", len(helper.topic.typing))
+	}
+	helper.topic.flushTyping()
+	helper.finish()
+
+	expected := [][]string{{"typing"}, {"kp", "typing"}, {"kp", "typing"}}
+	for i, r := range helper.results {
+		if len(r.messages) != len(expected[i]) {
+			t.Fatalf("Session %d: expected %d messages, received %d", i, len(expected[i]), len(r.messages))
+		}
+		for j, what := range expected[i] {
+			m := r.messages[j].(*ServerComMessage)
+			if m.Info == nil || m.Info.What != what {
+				t.Fatalf("Session %d message %d: expected {info what=%s}, got %+v", i, j, what, m)
+			}
+			if what == "typing" && (m.Info.Count != 2 || m.Info.From != "") {
+				t.Errorf("Session %d: unexpected aggregated typing notification %+v", i, m.Info)
+			}
+		}
+	}
+}
+
+func TestHandleBroadcastDataBroadcastChannel(t *testing.T) {
+	topicName := "grpTest"
+	chanName := "chnTest"
+	numUsers := 5
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	globals.fanoutShardSize = 2
+	defer func() {
+		globals.fanoutShardSize = 0
+	}()
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+
+	helper.topic.isChan = true
+	helper.topic.broadcast = true
+	helper.topic.xoriginal = topicName
+	// Users 1..4 are channel readers.
+	for i := 1; i < numUsers; i++ {
+		uid := helper.uids[i]
+		pud := helper.topic.perUser[uid]
+		pud.modeGiven = types.ModeCChnReader
+		pud.modeWant = types.ModeCChnReader
+		pud.isChan = true
+		helper.topic.perUser[uid] = pud
+		pssd := helper.topic.sessions[helper.sessions[i]]
+		pssd.isChanSub = true
+		helper.topic.sessions[helper.sessions[i]] = pssd
+	}
+
+	from := helper.uids[0].UserId()
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   from,
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Content: "test",
+			NoEcho:  true,
+		},
+		sess: helper.sessions[0],
+	})
+	// Recv notifications of readers are ignored: no subscription update is expected.
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   helper.uids[1].UserId(),
+		Original: chanName,
+		Note:     &MsgClientNote{Topic: chanName, What: "recv", SeqId: 1},
+		sess:     helper.sessions[1],
+	})
+	helper.finish()
+
+	if errorMsgs, hasError := helper.hubMessages["__ERROR__"]; hasError {
+		t.Fatal(errorMsgs[0].Ctrl.Text)
+	}
+
+	if len(helper.results[0].messages) != 0 {
+		t.Fatalf("Uid0 is the sender: expected 0 messages, got %d", len(helper.results[0].messages))
+	}
+	for i := 1; i < numUsers; i++ {
+		m := helper.results[i]
+		if len(m.messages) != 1 {
+			t.Fatalf("Uid%d: expected 1 message, got %d", i, len(m.messages))
+		}
+		r := m.messages[0].(*ServerComMessage)
+		if r.Data == nil || r.Data.Topic != chanName || r.Data.From != "" {
+			t.Errorf("Uid%d: unexpected message %+v", i, r)
+		}
+	}
+
+	// Only the regular subscriber is notified on 'me'.
+	if len(helper.hubMessages) != 1 {
+		t.Fatalf("Hub expected exactly 1 recipient, got %d", len(helper.hubMessages))
+	}
+	if _, ok := helper.hubMessages[from]; !ok {
+		t.Error("Expected presence notification for the sender")
+	}
+}
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	// Set max subscriber count to effective infinity.
+	globals.maxSubscriberCount = 1_000_000_000
+	os.Exit(m.Run())
+}
+
+func TestHandleReportBroadcast(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 2
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	rp := mock_store.NewMockReportsPersistenceInterface(helper.ctrl)
+	store.Reports = rp
+	defer func() { store.Reports = nil }()
+	helper.topic.lastID = 10
+
+	reporter, author := helper.uids[0], helper.uids[1]
+	helper.mm.EXPECT().GetBySeqId(topicName, 5).Return(&types.Message{
+		SeqId: 5, From: author.String(), Content: "offensive",
+	}, nil).Times(2)
+	helper.mm.EXPECT().GetBySeqId(topicName, 6).Return(&types.Message{
+		SeqId: 6, From: reporter.String(), Content: "mine",
+	}, nil)
+	gomock.InOrder(
+		rp.EXPECT().Create(gomock.Any()).DoAndReturn(func(rpt *types.Report) error {
+			if rpt.Reporter != reporter.String() || rpt.Target != author.String() || rpt.Topic != topicName ||
+				rpt.SeqId != 5 || rpt.Reason != "spam" {
+				t.Errorf("Unexpected report: %+v", rpt)
+			}
+			if ev, _ := rpt.Evidence.(map[string]any); ev["content"] != "offensive" || ev["from"] != author.UserId() {
+				t.Errorf("Unexpected evidence: %+v", rpt.Evidence)
+			}
+			rpt.SetUid(types.Uid(100))
+			return nil
+		}),
+		rp.EXPECT().Create(gomock.Any()).Return(types.ErrDuplicate),
+	)
+	rp.EXPECT().Claim(types.Uid(100)).Return(true, nil)
+
+	report := func(id string, seq int) {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			AsUser:   reporter.UserId(),
+			Original: topicName,
+			RcptTo:   topicName,
+			Report:   &MsgClientReport{Id: id, Topic: topicName, SeqId: seq, Reason: "spam"},
+			Id:       id,
+			sess:     helper.sessions[0],
+		})
+	}
+	report("id1", 5)
+	// Repeated report.
+	report("id2", 5)
+	// Own message.
+	report("id3", 6)
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 3 {
+		t.Fatalf("Session 0: expected 3 responses, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK ||
+		m.Ctrl.Params.(map[string]any)["report"] != types.Uid(100).String() {
+		t.Errorf("Expected ctrl 200 with report ID, got %+v", m.Ctrl)
+	}
+	if m := r.messages[1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusNotModified {
+		t.Errorf("Expected ctrl 304, got %+v", m.Ctrl)
+	}
+	if m := r.messages[2].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusForbidden {
+		t.Errorf("Expected ctrl 403, got %+v", m.Ctrl)
+	}
+	if len(helper.results[1].messages) != 0 {
+		t.Errorf("Session 1: expected no messages, received %d", len(helper.results[1].messages))
+	}
+
+	// The report is posted to 'rpt' topic.
+	if len(helper.hub.routeCli) != 1 {
+		t.Fatalf("Expected 1 message routed to hub, got %d", len(helper.hub.routeCli))
+	}
+	pub := <-helper.hub.routeCli
+	if pub.RcptTo != rptTopic || pub.Pub == nil || pub.Pub.Head[msgHeadReport] != types.Uid(100).String() ||
+		pub.AsUser != reporter.UserId() {
+		t.Errorf("Unexpected report posting: %+v", pub)
+	}
+}
+
+func TestHandleReportAction(t *testing.T) {
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatSys, rptTopic, true)
+	defer helper.tearDown()
+	rp := mock_store.NewMockReportsPersistenceInterface(helper.ctrl)
+	store.Reports = rp
+	defer func() { store.Reports = nil }()
+	helper.topic.lastID = 3
+
+	moderator := helper.uids[0]
+	rptId := types.Uid(100)
+	helper.mm.EXPECT().GetBySeqId(rptTopic, 3).Return(&types.Message{
+		SeqId: 3, Head: map[string]any{msgHeadReport: rptId.String()},
+	}, nil)
+	rpt := &types.Report{Topic: "grpReported", SeqId: 7, Target: types.Uid(200).String(), Status: types.ReportOpen}
+	rpt.SetUid(rptId)
+	rp.EXPECT().Get(rptId).Return(rpt, nil)
+	rp.EXPECT().Resolve(rptId, types.ReportActioned, "delete", moderator).Return(true, nil)
+	helper.mm.EXPECT().DeleteList(rptTopic, 1, types.ZeroUid, gomock.Any(), []types.Range{{Low: 3, Hi: 4}}).Return(nil)
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   moderator.UserId(),
+		Original: rptTopic,
+		RcptTo:   rptTopic,
+		Report:   &MsgClientReport{Id: "id1", Topic: rptTopic, SeqId: 3, What: "delete"},
+		Id:       "id1",
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	var ctrl *MsgServerCtrl
+	for _, m := range helper.results[0].messages {
+		if c := m.(*ServerComMessage).Ctrl; c != nil {
+			ctrl = c
+		}
+	}
+	if ctrl == nil || ctrl.Code != http.StatusOK {
+		t.Errorf("Expected ctrl 200, got %+v", ctrl)
+	}
+
+	// The reported message is deleted by its topic.
+	if len(helper.hub.routeCli) != 1 {
+		t.Fatalf("Expected 1 message routed to hub, got %d", len(helper.hub.routeCli))
+	}
+	del := <-helper.hub.routeCli
+	if del.RcptTo != "grpReported" || del.Del == nil || del.Del.What != delWhatReported ||
+		!reflect.DeepEqual(del.Del.DelSeq, []MsgRange{{LowId: 7}}) {
+		t.Errorf("Unexpected deletion request: %+v", del)
+	}
+}
+
+func TestHandleMetaSessions(t *testing.T) {
+	topicName := "usrMe"
+	numUsers := 1
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+	globals.sessRecordMaxIdle = time.Hour
+	globals.sessRecordMaxCount = 8
+	globals.sessionStore = &SessionStore{sessCache: make(map[string]*Session)}
+	defer func() {
+		globals.sessRecordMaxIdle = 0
+		globals.sessRecordMaxCount = 0
+		globals.sessionStore = nil
+	}()
+
+	uid := helper.uids[0]
+	now := types.TimeNow()
+	records := []types.SessionRecord{
+		{Id: "sid0", User: uid.String(), LastSeen: now.Add(-time.Minute)},
+		{Id: "sidA", User: uid.String(), LastSeen: now.Add(-10 * time.Minute), UserAgent: "Firefox"},
+		// Inactive for too long.
+		{Id: "sidB", User: uid.String(), LastSeen: now.Add(-2 * time.Hour)},
+	}
+	helper.se.EXPECT().GetAll(uid).Return(records, nil).Times(3)
+	helper.se.EXPECT().Delete(uid, "sidA").Return(true, nil)
+	helper.se.EXPECT().Delete(uid, "sidB").Return(true, nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id1",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "sess"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaSess,
+		sess:     helper.sessions[0],
+	})
+	del := func(id, target string) {
+		helper.topic.handleMeta(&ClientComMessage{
+			Del: &MsgClientDel{
+				Id:    id,
+				Topic: topicName,
+				What:  "sess",
+				Sess:  target,
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgDelSess,
+			sess:     helper.sessions[0],
+		})
+	}
+	// The current session cannot be revoked.
+	del("id2", "sid0")
+	// Unknown session.
+	del("id3", "sidX")
+	del("id4", "*")
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 4 {
+		t.Fatalf("Session 0: expected 4 responses, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Sess) != 2 {
+		t.Fatalf("Expected meta with 2 sessions, got %+v", m)
+	}
+	if s := m.Meta.Sess[0]; s.Id != "sid0" || !s.Current || s.LastSeen.Before(now) {
+		t.Errorf("Expected the current session first, got %+v", s)
+	}
+	if s := m.Meta.Sess[1]; s.Id != "sidA" || s.Current || s.UserAgent != "Firefox" {
+		t.Errorf("Unexpected session %+v", s)
+	}
+	for i, code := range []int{http.StatusMethodNotAllowed, http.StatusNotFound, http.StatusOK} {
+		m := r.messages[i+1].(*ServerComMessage)
+		if m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i+1, code, m.Ctrl)
+		}
+	}
+	if m := r.messages[3].(*ServerComMessage); m.Ctrl != nil && m.Ctrl.Params.(map[string]any)["count"] != 2 {
+		t.Errorf("Expected 2 revoked sessions, got %+v", m.Ctrl.Params)
+	}
+}
+
+func TestHandleMetaE2EE(t *testing.T) {
+	topicName := "grpTest"
+	numUsers := 3
+	helper := TopicTestHelper{}
+	helper.setUp(t, numUsers, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	uids := helper.uids
+	helper.ke.EXPECT().AddSenderKeys(gomock.Len(2)).DoAndReturn(func(keys []types.SenderKey) error {
+		for _, sk := range keys {
+			if sk.Topic != topicName || sk.From != uids[0].String() || sk.FromDevice != "d0" {
+				t.Errorf("Unexpected sender key %+v", sk)
+			}
+		}
+		return nil
+	})
+	helper.ke.EXPECT().PopSenderKeys(topicName, uids[1], "d1").Return([]types.SenderKey{
+		{Topic: topicName, From: uids[0].String(), FromDevice: "d0", Data: []byte{1, 2}},
+	}, nil)
+	helper.ke.EXPECT().GetBundles(uids[2], true).Return([]types.KeyBundle{
+		{User: uids[2].String(), DeviceId: "d2", IdentityKey: []byte{3}, SignedPreKey: []byte{4},
+			OneTimeKeys: [][]byte{{5}}, OneTimeCount: 7},
+	}, nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Set: &MsgClientSet{
+			Id:    "id0",
+			Topic: topicName,
+			MsgSetQuery: MsgSetQuery{SKey: &MsgSetSenderKeys{
+				Dev: "d0",
+				Keys: []MsgSenderKey{
+					{User: uids[1].UserId(), Dev: "d1", Data: []byte{1, 2}},
+					{User: uids[2].UserId(), Dev: "d2", Data: []byte{3}},
+				},
+			}},
+		},
+		AsUser:   uids[0].UserId(),
+		MetaWhat: constMsgMetaSKey,
+		sess:     helper.sessions[0],
+	})
+	// Sender keys of the recipient's device.
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id1",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "skey", SKey: &MsgGetOpts{Dev: "d1"}},
+		},
+		AsUser:   uids[1].UserId(),
+		MetaWhat: constMsgMetaSKey,
+		sess:     helper.sessions[1],
+	})
+	// Keys of another member.
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id2",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "keys", Keys: &MsgGetOpts{User: uids[2].UserId()}},
+		},
+		AsUser:   uids[1].UserId(),
+		MetaWhat: constMsgMetaKeys,
+		sess:     helper.sessions[1],
+	})
+	helper.finish()
+
+	if r := helper.results[0]; len(r.messages) != 1 ||
+		r.messages[0].(*ServerComMessage).Ctrl == nil || r.messages[0].(*ServerComMessage).Ctrl.Code != http.StatusOK {
+		t.Errorf("Session 0: expected one ctrl 200, got %+v", r.messages)
+	}
+	for _, uid := range uids[1:] {
+		if msgs := helper.hubMessages[uid.UserId()]; len(msgs) != 1 || msgs[0].Info == nil ||
+			msgs[0].Info.What != "skey" || msgs[0].Info.Src != topicName {
+			t.Errorf("Expected skey notification to %s, got %+v", uid.UserId(), msgs)
+		}
+	}
+
+	r := helper.results[1]
+	if len(r.messages) != 2 {
+		t.Fatalf("Session 1: expected 2 responses, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Meta == nil || len(m.Meta.SKey) != 1 ||
+		m.Meta.SKey[0].User != uids[0].UserId() || m.Meta.SKey[0].Dev != "d0" {
+		t.Errorf("Expected sender key from %s, got %+v", uids[0].UserId(), m)
+	}
+	m := r.messages[1].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Keys) != 1 {
+		t.Fatalf("Expected meta with 1 key bundle, got %+v", m)
+	}
+	// The number of one-time keys is visible to the owner only.
+	if kb := m.Meta.Keys[0]; kb.User != uids[2].UserId() || kb.Dev != "d2" || len(kb.OneTimeKeys) != 1 || kb.OneTimeCount != 0 {
+		t.Errorf("Unexpected key bundle %+v", kb)
+	}
+}
+
+func TestNormalizeMsgE2EE(t *testing.T) {
+	topic := &Topic{aux: map[string]any{auxE2EE: true}}
+	if head := topic.normalizeMsgE2EE(nil); head[types.MsgHeadE2EE] != true {
+		t.Error("Message in E2EE topic is not marked", head)
+	}
+
+	topic.aux = nil
+	head := topic.normalizeMsgE2EE(map[string]any{types.MsgHeadE2EE: true, "mime": "text/plain"})
+	if _, ok := head[types.MsgHeadE2EE]; ok || head["mime"] != "text/plain" {
+		t.Error("Mark is not removed", head)
+	}
+}
+
+func TestHandleMetaDevices(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	sess := helper.sessions[0]
+	sess.deviceID = "token1"
+	sess.platf = "web"
+
+	devices := []types.UserDevice{
+		{Id: "d1", Name: "Laptop", Platform: "web", PushToken: "token1", Push: true, OneTimeKeys: 5, SenderKeys: 2},
+		{Id: "d2", Platform: "ios", PushToken: "token2", OneTimeKeys: -1},
+	}
+	helper.ud.EXPECT().GetAll(uid).Return(nil, nil)
+	helper.ud.EXPECT().Register(gomock.Any()).DoAndReturn(func(dev *types.UserDevice) error {
+		if dev.Id != "d1" || dev.User != uid.String() || dev.Name != "Laptop" || dev.Platform != "web" ||
+			dev.PushToken != "token1" || !dev.Push {
+			t.Errorf("Unexpected device %+v", dev)
+		}
+		return nil
+	})
+	helper.ud.EXPECT().GetAll(uid).Return(devices, nil).Times(2)
+	helper.ud.EXPECT().Delete(uid, "d2").Return(true, nil)
+	helper.dv.EXPECT().Delete(uid, "token2").Return(nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Set: &MsgClientSet{
+			Id:          "id0",
+			Topic:       "me",
+			MsgSetQuery: MsgSetQuery{Device: &MsgSetDevice{Id: "d1", Name: "Laptop", Current: true}},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaDevices,
+		sess:     sess,
+	})
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id1",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "devices"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaDevices,
+		sess:     sess,
+	})
+	helper.topic.handleMeta(&ClientComMessage{
+		Del: &MsgClientDel{
+			Id:    "id2",
+			Topic: "me",
+			What:  "device",
+			Dev:   "d2",
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgDelDevice,
+		sess:     sess,
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 3 {
+		t.Fatalf("Expected 3 responses, received %d", len(r.messages))
+	}
+	for _, i := range []int{0, 2} {
+		if m := r.messages[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK {
+			t.Errorf("Response %d: expected ctrl 200, got %+v", i, m)
+		}
+	}
+	m := r.messages[1].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Devices) != 2 {
+		t.Fatalf("Expected meta with 2 devices, got %+v", m)
+	}
+	if dev := m.Meta.Devices[0]; !dev.Current || !dev.Keys || dev.OneTimeCount != 5 || dev.SenderKeys != 2 || !dev.Token {
+		t.Errorf("Unexpected current device %+v", dev)
+	}
+	if dev := m.Meta.Devices[1]; dev.Current || dev.Keys || dev.Push || !dev.Token {
+		t.Errorf("Unexpected device %+v", dev)
+	}
+	if sess.registeredDevice() != "d1" {
+		t.Errorf("Session is not bound to the device, got '%s'", sess.registeredDevice())
+	}
+}
+
+func TestHandleMetaNotify(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	sess := helper.sessions[0]
+
+	helper.ns.EXPECT().Get(uid).Return(map[types.Uid]*types.NotifySettings{
+		uid: {User: uid.String(), Lang: "de"},
+	}, nil)
+	helper.ns.EXPECT().Update(gomock.Any()).DoAndReturn(func(ns *types.NotifySettings) error {
+		if ns.User != uid.String() || ns.Lang != "de" || !ns.NoPreview {
+			t.Errorf("Unexpected settings %+v", ns)
+		}
+		return nil
+	})
+	helper.ns.EXPECT().Get(uid).Return(nil, nil)
+
+	preview := false
+	helper.topic.handleMeta(&ClientComMessage{
+		Set: &MsgClientSet{
+			Id:          "id0",
+			Topic:       "me",
+			MsgSetQuery: MsgSetQuery{Notify: &MsgNotifySettings{Preview: &preview}},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaNotify,
+		sess:     sess,
+	})
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id1",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "notify"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaNotify,
+		sess:     sess,
+	})
+	lang := "not a language!"
+	helper.topic.handleMeta(&ClientComMessage{
+		Set: &MsgClientSet{
+			Id:          "id2",
+			Topic:       "me",
+			MsgSetQuery: MsgSetQuery{Notify: &MsgNotifySettings{Lang: &lang}},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaNotify,
+		sess:     sess,
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 3 {
+		t.Fatalf("Expected 3 responses, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK {
+		t.Errorf("Expected ctrl 200, got %+v", m)
+	}
+	m := r.messages[1].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Notify == nil || *m.Meta.Notify.Lang != "" || !*m.Meta.Notify.Preview {
+		t.Errorf("Expected default settings, got %+v", m.Meta)
+	}
+	if m := r.messages[2].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusBadRequest {
+		t.Errorf("Expected ctrl 400, got %+v", m)
+	}
+}
+
+func TestHandleMetaNotifyTopic(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.ns.EXPECT().UpdateForTopic(gomock.Any()).Return(nil).Times(2)
+
+	until := time.Now().Add(time.Hour)
+	mentions := true
+	for i, req := range []*MsgNotifySettings{{MuteUntil: &until}, {Mentions: &mentions}} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          "id0",
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Notify: req},
+			},
+			AsUser:   helper.uids[i+1].UserId(),
+			MetaWhat: constMsgMetaNotify,
+			sess:     helper.sessions[i+1],
+		})
+	}
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id1",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "notify"},
+		},
+		AsUser:   helper.uids[1].UserId(),
+		MetaWhat: constMsgMetaNotify,
+		sess:     helper.sessions[1],
+	})
+
+	// Users are not attached to the topic when the messages are sent.
+	for uid, pud := range helper.topic.perUser {
+		pud.online = 0
+		helper.topic.perUser[uid] = pud
+	}
+	mention := map[string]any{
+		"txt": "@user2 hi",
+		"fmt": []any{map[string]any{"at": 0, "len": 6, "key": 0}},
+		"ent": []any{map[string]any{"tp": "MN", "data": map[string]any{"val": helper.uids[2].UserId()}}},
+	}
+	helper.ns.EXPECT().Get(gomock.Any()).Return(map[types.Uid]*types.NotifySettings{
+		helper.uids[1]: {User: helper.uids[1].UserId(), Keywords: []string{"deploy"}},
+	}, nil).Times(2)
+	for _, tc := range []struct {
+		content any
+		muted   []bool
+	}{
+		{"hi all", []bool{false, true, true}},
+		{mention, []bool{false, true, false}},
+		{"Deploy is done", []bool{false, false, true}},
+	} {
+		mentioned := helper.topic.msgMentions(helper.uids[0], nil, tc.content)
+		rcpt := helper.topic.pushForData(helper.uids[0], &MsgServerData{
+			Topic:   topicName,
+			From:    helper.uids[0].UserId(),
+			SeqId:   1,
+			Content: tc.content,
+		}, false, mentioned)
+		for i, uid := range helper.uids {
+			if rcpt.To[uid].Muted != tc.muted[i] {
+				t.Errorf("Uid%d: expected muted %v, got %+v", i, tc.muted[i], rcpt.To[uid])
+			}
+			if _, found := mentioned[uid]; rcpt.To[uid].Mentioned != found {
+				t.Errorf("Uid%d: unexpected mention %+v", i, rcpt.To[uid])
+			}
+		}
+	}
+	helper.finish()
+
+	if m := helper.results[1].messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK {
+		t.Errorf("Expected ctrl 200, got %+v", m)
+	}
+	m := helper.results[1].messages[1].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Notify == nil || m.Meta.Notify.MuteUntil == nil || *m.Meta.Notify.Mentions {
+		t.Errorf("Expected muted topic, got %+v", m.Meta)
+	}
+}
+
+func TestHandleBroadcastDataMention(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	from := helper.uids[0]
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(map[types.Uid]*types.NotifySettings{
+		helper.uids[2]: {User: helper.uids[2].UserId(), Keywords: []string{"release"}},
+	}, nil)
+	helper.mn.EXPECT().Add(gomock.Any()).DoAndReturn(func(mentions []types.Mention) error {
+		if len(mentions) != 2 {
+			t.Fatalf("Expected 2 mentions, got %+v", mentions)
+		}
+		for _, mn := range mentions {
+			if mn.Topic != topicName || mn.SeqId != 1 || mn.From != from.String() {
+				t.Errorf("Unexpected mention %+v", mn)
+			}
+			if (mn.User == helper.uids[1].String() && mn.Keyword != "") ||
+				(mn.User == helper.uids[2].String() && mn.Keyword != "release") {
+				t.Errorf("Unexpected keyword %+v", mn)
+			}
+		}
+		return nil
+	})
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   from.UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic: topicName,
+			Head:  map[string]any{"mime": "text/x-drafty"},
+			Content: map[string]any{
+				"txt": "@user1 the release is out",
+				"fmt": []any{map[string]any{"at": 0, "len": 6, "key": 0}},
+				"ent": []any{map[string]any{"tp": "MN", "data": map[string]any{"val": helper.uids[1].UserId()}}},
+			},
+		},
+		sess: helper.sessions[0],
+	})
+	helper.finish()
+
+	// Both subscribers are notified on 'me' of the new unread count and the mention.
+	for i, uid := range helper.uids[1:] {
+		mm := helper.hubMessages[uid.UserId()]
+		if len(mm) != 1 || mm[0].Pres == nil || mm[0].Pres.What != "msg" {
+			t.Fatalf("Uid%d: expected pres msg, got %+v", i+1, mm)
+		}
+		if pres := mm[0].Pres; pres.Unread != 1 || !pres.Mention {
+			t.Errorf("Uid%d: unexpected pres %+v", i+1, pres)
+		}
+	}
+}
+
+func TestReplyGetUnread(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	helper.uu.EXPECT().GetUnreadByTopic(uid).Return([]types.TopicUnread{
+		{Topic: uid.P2PName(other), Unread: 3},
+		{Topic: "grpTest", Unread: 12, Mentions: 2},
+		{Topic: "grpChild", Parent: "grpComm", Unread: 4, Mentions: 1},
+		{Topic: "grpChild2", Parent: "grpComm", Unread: 1},
+	}, nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id0",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "unread"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaUnread,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Unread) != 5 {
+		t.Fatalf("Expected 5 topics, got %+v", m)
+	}
+	expected := []MsgTopicUnread{
+		{Topic: other.UserId(), Unread: 3},
+		{Topic: "grpTest", Unread: 12, Mentions: 2},
+		{Topic: "grpChild", Parent: "grpComm", Unread: 4, Mentions: 1},
+		{Topic: "grpChild2", Parent: "grpComm", Unread: 1},
+		// Total of the community.
+		{Topic: "grpComm", Unread: 5, Mentions: 1},
+	}
+	if !reflect.DeepEqual(m.Meta.Unread, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.Meta.Unread)
+	}
+}
+
+func TestReplyGetMentions(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	p2p := uid.P2PName(other)
+	now := types.TimeNow()
+	helper.uu.EXPECT().GetTopics(uid, gomock.Any()).Return([]types.Subscription{
+		{Topic: "grpTest", ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic},
+		{Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P},
+		// Not a reader.
+		{Topic: "grpBanned", ModeWant: types.ModeCPublic, ModeGiven: types.ModeNone},
+	}, nil)
+	helper.mn.EXPECT().GetAll(uid, gomock.Any(), gomock.Any(), 5).DoAndReturn(
+		func(forUser types.Uid, topics []string, before *time.Time, limit int) ([]types.Mention, error) {
+			sort.Strings(topics)
+			if !reflect.DeepEqual(topics, []string{"grpTest", p2p}) || before != nil {
+				t.Errorf("Unexpected query %v %v", topics, before)
+			}
+			return []types.Mention{
+				{User: uid.String(), Topic: p2p, SeqId: 7, From: other.String(), CreatedAt: now},
+				{User: uid.String(), Topic: "grpTest", SeqId: 3, From: other.String(), Keyword: "release", CreatedAt: now},
+			}, nil
+		})
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:    "id0",
+			Topic: "me",
+			MsgGetQuery: MsgGetQuery{
+				What:     "mentions",
+				Mentions: &MsgGetOpts{Limit: 5},
+			},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaMentions,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Mentions) != 2 {
+		t.Fatalf("Expected 2 mentions, got %+v", m)
+	}
+	if mn := m.Meta.Mentions[0]; mn.Topic != other.UserId() || mn.SeqId != 7 || mn.From != other.UserId() {
+		t.Errorf("Unexpected p2p mention %+v", mn)
+	}
+	if mn := m.Meta.Mentions[1]; mn.Topic != "grpTest" || mn.Keyword != "release" {
+		t.Errorf("Unexpected group mention %+v", mn)
+	}
+}
+
+func TestHandleMetaDrafts(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	sess := helper.sessions[0]
+	// Another session of the same user.
+	s, r := helper.newSession("sid1", uid)
+	helper.sessions = append(helper.sessions, s)
+	helper.results = append(helper.results, r)
+	helper.topic.sessions[s] = perSessionData{uid: uid}
+
+	ts := types.TimeNow().Add(-time.Second).Round(time.Millisecond)
+	helper.dr.EXPECT().Update(gomock.Any()).DoAndReturn(func(draft *types.Draft) (bool, error) {
+		if draft.User != uid.String() || draft.Topic != uid.P2PName(other) || draft.Content != "Hello" ||
+			!draft.UpdatedAt.Equal(ts) {
+			t.Errorf("Unexpected draft %+v", draft)
+		}
+		return true, nil
+	})
+	// A newer draft was saved by another device.
+	helper.dr.EXPECT().Update(gomock.Any()).Return(false, nil)
+	helper.dr.EXPECT().GetAll(uid, nil).Return([]types.Draft{
+		{User: uid.String(), Topic: uid.P2PName(other), Content: "Hello", UpdatedAt: ts},
+	}, nil)
+
+	for i, req := range []*MsgDraft{
+		{Topic: other.UserId(), Content: "Hello", Timestamp: &ts},
+		{Topic: "grpTest", Timestamp: &ts},
+		// Channel readers cannot write.
+		{Topic: "chnTest", Content: "Hello"},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "me",
+				MsgSetQuery: MsgSetQuery{Draft: req},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaDrafts,
+			sess:     sess,
+		})
+	}
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id3",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "drafts"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaDrafts,
+		sess:     sess,
+	})
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 4 {
+		t.Fatalf("Expected 4 responses, received %d", len(msgs))
+	}
+	for i, code := range []int{http.StatusOK, http.StatusConflict, http.StatusBadRequest} {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Expected ctrl %d, got %+v", code, m)
+		}
+	}
+	m := msgs[3].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Drafts) != 1 {
+		t.Fatalf("Expected 1 draft, got %+v", m)
+	}
+	if d := m.Meta.Drafts[0]; d.Topic != other.UserId() || d.Content != "Hello" || !d.Timestamp.Equal(ts) {
+		t.Errorf("Unexpected draft %+v", d)
+	}
+
+	// The other session is notified of the saved draft only.
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 notification, received %d", len(r.messages))
+	}
+	if info := r.messages[0].(*ServerComMessage).Info; info == nil || info.What != "draft" ||
+		info.Src != other.UserId() || info.Content != "Hello" {
+		t.Errorf("Unexpected notification %+v", r.messages[0])
+	}
+}
+
+func TestHandleMetaStar(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.topic.lastID = 5
+
+	uid, other := helper.uids[0], helper.uids[1]
+	// Not an admin: scoped messages of others are hidden.
+	pud := helper.topic.perUser[uid]
+	pud.modeWant, pud.modeGiven = types.ModeCPublic, types.ModeCPublic
+	helper.topic.perUser[uid] = pud
+	sent := types.TimeNow().Add(-time.Hour)
+	helper.mm.EXPECT().GetBySeqId(topicName, 3).Return(&types.Message{
+		ObjHeader: types.ObjHeader{CreatedAt: sent},
+		Topic:     topicName,
+		SeqId:     3,
+		From:      other.String(),
+		Content:   "Hello",
+	}, nil).Times(2)
+	helper.st.EXPECT().Add(gomock.Any()).DoAndReturn(func(msg *types.StarredMessage) (bool, error) {
+		if msg.User != uid.String() || msg.Topic != topicName || msg.SeqId != 3 || msg.From != other.String() ||
+			msg.Content != "Hello" || !msg.SentAt.Equal(sent) {
+			t.Errorf("Unexpected starred message %+v", msg)
+		}
+		return true, nil
+	})
+	// Already starred.
+	helper.st.EXPECT().Add(gomock.Any()).Return(false, nil)
+	helper.st.EXPECT().Delete(uid, topicName, 3).Return(true, nil)
+	// Addressed to the other user only.
+	helper.mm.EXPECT().GetBySeqId(topicName, 4).Return(&types.Message{
+		Topic: topicName,
+		SeqId: 4,
+		Head:  map[string]any{"scope": []any{other.UserId()}},
+	}, nil)
+
+	for i, star := range []*MsgSetStar{
+		{SeqId: 3},
+		{SeqId: 3},
+		{SeqId: 3, Unstar: true},
+		{SeqId: 4},
+		{SeqId: 6},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Star: star},
+			},
+			AsUser:   uid.UserId(),
+			Original: topicName,
+			MetaWhat: constMsgMetaStarred,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	codes := []int{http.StatusOK, http.StatusNotModified, http.StatusOK, http.StatusNotFound, http.StatusBadRequest}
+	if len(msgs) != len(codes) {
+		t.Fatalf("Expected %d responses, received %d", len(codes), len(msgs))
+	}
+	for i, code := range codes {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+
+	// User's other sessions are notified on 'me'.
+	infos := helper.hubMessages[uid.UserId()]
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 notifications, received %d", len(infos))
+	}
+	for i, event := range []string{"add", "del"} {
+		info := infos[i].Info
+		if info == nil || info.Topic != "me" || info.What != "star" || info.Src != topicName || info.SeqId != 3 ||
+			info.Event != event || infos[i].SkipSid != helper.sessions[0].sid {
+			t.Errorf("Unexpected notification %+v", infos[i])
+		}
+	}
+	if len(helper.results[1].messages) != 0 {
+		t.Errorf("Other user received %d messages", len(helper.results[1].messages))
+	}
+}
+
+func TestReplyGetStarred(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	p2p := uid.P2PName(other)
+	now := types.TimeNow()
+	helper.st.EXPECT().GetAll(uid, p2p, nil, 5).Return([]types.StarredMessage{
+		{User: uid.String(), Topic: p2p, SeqId: 7, From: other.String(), Content: "Hi", SentAt: now, CreatedAt: now},
+	}, nil)
+	// Messages of left topics are unstarred in 'me'.
+	helper.st.EXPECT().Delete(uid, "grpLeft", 3).Return(true, nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:    "id0",
+			Topic: "me",
+			MsgGetQuery: MsgGetQuery{
+				What:    "starred",
+				Starred: &MsgGetOpts{Topic: other.UserId(), Limit: 5},
+			},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaStarred,
+		sess:     helper.sessions[0],
+	})
+	for i, star := range []*MsgSetStar{
+		{Topic: "grpLeft", SeqId: 3, Unstar: true},
+		// Messages are starred in their topics.
+		{Topic: "grpLeft", SeqId: 3},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i+1),
+				Topic:       "me",
+				MsgSetQuery: MsgSetQuery{Star: star},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaStarred,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 responses, received %d", len(msgs))
+	}
+	m := msgs[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Starred) != 1 {
+		t.Fatalf("Expected 1 starred message, got %+v", m)
+	}
+	if sm := m.Meta.Starred[0]; sm.Topic != other.UserId() || sm.SeqId != 7 || sm.From != other.UserId() ||
+		sm.Content != "Hi" {
+		t.Errorf("Unexpected starred message %+v", sm)
+	}
+	for i, code := range []int{http.StatusOK, http.StatusBadRequest} {
+		if m := msgs[i+1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Expected ctrl %d, got %+v", code, m)
+		}
+	}
+}
+
+func TestReplyGetContacts(t *testing.T) {
+	topicName := "fnd"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatFnd, topicName, true)
+	defer helper.tearDown()
+
+	store.InitContactIndex("pepper")
+	defer store.InitContactIndex("")
+	globals.maxContactHashes = 2
+	globals.contactPrefixLength = 6
+	defer func() {
+		globals.maxContactHashes = 0
+		globals.contactPrefixLength = 0
+	}()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	hash := store.ContactHash("tel:+17025550001")
+	own := store.ContactHash("tel:+17025550002")
+	helper.ct.EXPECT().Find("", []string{hash, own}).Return([]types.ContactHash{
+		{Hash: hash, User: other.String()},
+		// The user's own contacts are skipped.
+		{Hash: own, User: uid.String()},
+	}, nil)
+	helper.ct.EXPECT().FindByPrefix("", []string{hash[:6]}).Return([]types.ContactHash{
+		{Hash: hash, User: other.String()},
+	}, nil)
+
+	for i, req := range []*MsgGetOpts{
+		{Hashes: []string{hash, own}},
+		{Prefixes: []string{hash[:6]}},
+		// Too many hashes.
+		{Hashes: []string{hash, own, hash}},
+		// Both hashes and prefixes.
+		{Hashes: []string{hash}, Prefixes: []string{hash[:6]}},
+		// Invalid hash.
+		{Hashes: []string{strings.ToUpper(hash)}},
+		// Invalid length of prefix.
+		{Prefixes: []string{hash[:4]}},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "fnd",
+				MsgGetQuery: MsgGetQuery{What: "contacts", Contacts: req},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaContacts,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 6 {
+		t.Fatalf("Expected 6 responses, received %d", len(msgs))
+	}
+	m := msgs[0].(*ServerComMessage)
+	expected := []MsgContact{{Hash: hash, User: other.UserId()}}
+	if m.Meta == nil || !reflect.DeepEqual(m.Meta.Contacts, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, m)
+	}
+
+	m = msgs[1].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Contacts) != 1 || m.Meta.Contacts[0].Prefix != hash[:6] {
+		t.Fatalf("Expected 1 sealed contact, got %+v", m)
+	}
+	// The client which knows the full hash decrypts the user ID.
+	key, _ := hex.DecodeString(hash)
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	sealed := m.Meta.Contacts[0].Sealed
+	if user, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil); err != nil ||
+		string(user) != other.UserId() {
+		t.Errorf("Failed to unseal user ID: %s %v", user, err)
+	}
+
+	for i := 2; i < len(msgs); i++ {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusBadRequest {
+			t.Errorf("Expected ctrl 400, got %+v", m)
+		}
+	}
+}
+
+func TestHandleBroadcastDataGroupBlocked(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
+
+	// Uid2 blocked uid0.
+	blocks := mock_store.NewMockBlocksPersistenceInterface(helper.ctrl)
+	blocks.EXPECT().GetBetween(gomock.Any()).Return([]types.Block{
+		{User: helper.uids[2].String(), Target: helper.uids[0].String()},
+	}, nil).AnyTimes()
+	store.Blocks = blocks
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   helper.uids[0].UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Content: "test",
+			NoEcho:  true,
+		},
+		sess: helper.sessions[0],
+	})
+	helper.finish()
+
+	if len(helper.results[1].messages) != 1 {
+		t.Errorf("Uid1: expected 1 message, got %d", len(helper.results[1].messages))
+	}
+	if len(helper.results[2].messages) != 0 {
+		t.Errorf("Uid2 blocked the sender: expected 0 messages, got %d", len(helper.results[2].messages))
+	}
+}
+
+func TestHandleMetaBlocks(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	// Another session of the same user.
+	s, r := helper.newSession("sid1", uid)
+	helper.sessions = append(helper.sessions, s)
+	helper.results = append(helper.results, r)
+	helper.topic.sessions[s] = perSessionData{uid: uid}
+
+	blocks := mock_store.NewMockBlocksPersistenceInterface(helper.ctrl)
+	blocks.EXPECT().Add(uid, other).Return(true, nil)
+	blocks.EXPECT().Add(uid, other).Return(false, nil)
+	blocks.EXPECT().GetAll(uid).Return([]types.Block{
+		{User: uid.String(), Target: other.String()},
+		// Blocks of the user by others are not listed.
+		{User: types.Uid(20).String(), Target: uid.String()},
+	}, nil)
+	store.Blocks = blocks
+
+	for i, req := range []*MsgSetBlock{
+		{User: other.UserId()},
+		// Already blocked.
+		{User: other.UserId()},
+		// Cannot block self.
+		{User: uid.UserId()},
+		{User: "x"},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "me",
+				MsgSetQuery: MsgSetQuery{Block: req},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaBlocks,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id4",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "blocks"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaBlocks,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 5 {
+		t.Fatalf("Expected 5 responses, received %d", len(msgs))
+	}
+	for i, code := range []int{http.StatusOK, http.StatusNotModified, http.StatusBadRequest, http.StatusBadRequest} {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+	m := msgs[4].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Blocks) != 1 || m.Meta.Blocks[0].User != other.UserId() {
+		t.Errorf("Expected 1 blocked user, got %+v", m)
+	}
+
+	// The other session is notified.
+	if msgs := helper.results[1].messages; len(msgs) != 1 {
+		t.Errorf("Expected 1 info, received %d", len(msgs))
+	} else if m := msgs[0].(*ServerComMessage); m.Info == nil || m.Info.What != "block" ||
+		m.Info.Src != other.UserId() || m.Info.Event != "add" {
+		t.Errorf("Unexpected info %+v", m)
+	}
+	// The blocked user sees the user offline.
+	if pres := helper.hubMessages[other.UserId()]; len(pres) != 1 || pres[0].Pres.What != "off" {
+		t.Errorf("Expected 'off' presence to the blocked user, got %+v", pres)
+	}
+}
+
+func TestHandleMetaLabels(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	sess := helper.sessions[0]
+	// Another session of the same user.
+	s, r := helper.newSession("sid1", uid)
+	helper.sessions = append(helper.sessions, s)
+	helper.results = append(helper.results, r)
+	helper.topic.sessions[s] = perSessionData{uid: uid}
+
+	p2p := uid.P2PName(other)
+	helper.ss.EXPECT().Get(p2p, uid, false).Return(&types.Subscription{Topic: p2p}, nil)
+	helper.ss.EXPECT().Update(p2p, uid, gomock.Any()).DoAndReturn(
+		func(topic string, user types.Uid, update map[string]any) error {
+			if labels, _ := update["Labels"].(types.StringSlice); !reflect.DeepEqual(labels, types.StringSlice{"work", "Family"}) {
+				t.Errorf("Unexpected update %+v", update)
+			}
+			return nil
+		})
+	helper.ss.EXPECT().Get("grpTest", uid, false).Return(&types.Subscription{Topic: "grpTest", Labels: types.StringSlice{"work"}}, nil)
+	helper.ss.EXPECT().Get("grpGone", uid, false).Return(nil, nil)
+
+	for i, req := range []*MsgSetLabels{
+		{Topic: other.UserId(), Labels: []string{" work", "Family", "work "}},
+		// Not changed.
+		{Topic: "grpTest", Labels: []string{"work"}},
+		{Topic: "grpGone", Labels: []string{"work"}},
+		{Topic: "grpTest", Labels: []string{""}},
+		{Topic: "x", Labels: []string{"work"}},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "me",
+				MsgSetQuery: MsgSetQuery{Labels: req},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaLabels,
+			sess:     sess,
+		})
+	}
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	codes := []int{http.StatusOK, http.StatusNotModified, http.StatusNotFound, http.StatusBadRequest, http.StatusBadRequest}
+	if len(msgs) != len(codes) {
+		t.Fatalf("Expected %d responses, received %d", len(codes), len(msgs))
+	}
+	for i, code := range codes {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+
+	// The other session is notified of the change.
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 notification, received %d", len(r.messages))
+	}
+	if pres := r.messages[0].(*ServerComMessage).Pres; pres == nil || pres.What != "upd" || pres.Src != other.UserId() {
+		t.Errorf("Unexpected notification %+v", r.messages[0])
+	}
+}
+
+func TestReplyGetSubLabel(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	helper.uu.EXPECT().GetTopics(uid, gomock.Any()).DoAndReturn(
+		func(uid types.Uid, opts *types.QueryOpt) ([]types.Subscription, error) {
+			if opts == nil || opts.Label != "work" {
+				t.Errorf("Unexpected query %+v", opts)
+			}
+			return []types.Subscription{{
+				User:      uid.String(),
+				Topic:     "grpTest",
+				ModeWant:  types.ModeCPublic,
+				ModeGiven: types.ModeCPublic,
+				Labels:    types.StringSlice{"work", "family"},
+			}}, nil
+		})
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:    "id0",
+			Topic: "me",
+			MsgGetQuery: MsgGetQuery{
+				What: "sub",
+				Sub:  &MsgGetOpts{Label: "work"},
+			},
+		},
+		AsUser:   uid.UserId(),
+		Original: "me",
+		MetaWhat: constMsgMetaSub,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Sub) != 1 {
+		t.Fatalf("Expected 1 subscription, got %+v", m)
+	}
+	if sub := m.Meta.Sub[0]; sub.Topic != "grpTest" || !reflect.DeepEqual(sub.Labels, []string{"work", "family"}) {
+		t.Errorf("Unexpected subscription %+v", sub)
+	}
+}
+
+func TestHandleMetaArchive(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	uids := helper.uids
+	helper.ss.EXPECT().Update(topicName, uids[0], gomock.Any()).DoAndReturn(
+		func(topic string, user types.Uid, update map[string]any) error {
+			if _, ok := update["ArchivedAt"].(time.Time); !ok || update["AutoUnarchive"] != true {
+				t.Errorf("Unexpected update %+v", update)
+			}
+			return nil
+		})
+	helper.ss.EXPECT().Update(topicName, uids[1], gomock.Any()).DoAndReturn(
+		func(topic string, user types.Uid, update map[string]any) error {
+			if _, ok := update["ArchivedAt"].(time.Time); !ok || update["AutoUnarchive"] != false {
+				t.Errorf("Unexpected update %+v", update)
+			}
+			return nil
+		})
+
+	for i, req := range []*MsgSetArchive{
+		{Archived: true, Unarchive: true},
+		// Not changed.
+		{Archived: true, Unarchive: true},
+		{Archived: true},
+	} {
+		user := i / 2
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Archive: req},
+			},
+			AsUser:   uids[user].UserId(),
+			MetaWhat: constMsgMetaArchive,
+			sess:     helper.sessions[user],
+		})
+	}
+
+	if muted := helper.topic.pushMutedBy(nil); !muted[uids[0]] || !muted[uids[1]] || muted[uids[2]] {
+		t.Errorf("Archived subscriptions must be muted, got %+v", muted)
+	}
+
+	// A new message unarchives the first subscription only.
+	helper.ss.EXPECT().Update(topicName, uids[0], map[string]any{"ArchivedAt": nil, "AutoUnarchive": false}).Return(nil)
+	helper.topic.unarchiveOnMessage(nil)
+	if pud := helper.topic.perUser[uids[0]]; pud.archived || pud.autoUnarchive {
+		t.Errorf("Subscription must be unarchived, got %+v", pud)
+	}
+	if pud := helper.topic.perUser[uids[1]]; !pud.archived {
+		t.Errorf("Subscription must remain archived, got %+v", pud)
+	}
+	helper.finish()
+
+	codes := []int{http.StatusOK, http.StatusNotModified}
+	for i, code := range codes {
+		if m := helper.results[0].messages[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+	if m := helper.results[1].messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusOK {
+		t.Errorf("Expected ctrl 200, got %+v", m)
+	}
+
+	// User's sessions are notified of archiving and unarchiving on 'me'.
+	for i, count := range []int{2, 1, 0} {
+		mm := helper.hubMessages[uids[i].UserId()]
+		if len(mm) != count {
+			t.Fatalf("Uid%d: expected %d notifications, received %d", i, count, len(mm))
+		}
+		for _, m := range mm {
+			if m.Pres == nil || m.Pres.Topic != "me" || m.Pres.What != "upd" || m.Pres.Src != topicName {
+				t.Errorf("Uid%d: unexpected notification %+v", i, m)
+			}
+		}
+	}
+}
+
+func TestReplyGetSubArchived(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	archivedAt := time.Now().UTC().Round(time.Millisecond)
+	var queries []*types.QueryOpt
+	helper.uu.EXPECT().GetTopics(uid, gomock.Any()).DoAndReturn(
+		func(uid types.Uid, opts *types.QueryOpt) ([]types.Subscription, error) {
+			queries = append(queries, opts)
+			return []types.Subscription{{
+				User:       uid.String(),
+				Topic:      "grpTest",
+				ModeWant:   types.ModeCPublic,
+				ModeGiven:  types.ModeCPublic,
+				ArchivedAt: &archivedAt,
+			}}, nil
+		}).Times(3)
+
+	for i, req := range []*MsgGetOpts{nil, {Archived: true}, {Topic: "grpTest"}} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "me",
+				MsgGetQuery: MsgGetQuery{What: "sub", Sub: req},
+			},
+			AsUser:   uid.UserId(),
+			Original: "me",
+			MetaWhat: constMsgMetaSub,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	if len(queries) != 3 {
+		t.Fatalf("Expected 3 queries, got %d", len(queries))
+	}
+	// Archived subscriptions are skipped by default, listed on request and when the topic is given.
+	if q := queries[0]; q == nil || q.Archived == nil || *q.Archived {
+		t.Errorf("Query 0: expected not archived only, got %+v", q)
+	}
+	if q := queries[1]; q == nil || q.Archived == nil || !*q.Archived {
+		t.Errorf("Query 1: expected archived only, got %+v", q)
+	}
+	if q := queries[2]; q == nil || q.Archived != nil {
+		t.Errorf("Query 2: expected all subscriptions, got %+v", q)
+	}
+
+	m := helper.results[0].messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Sub) != 1 {
+		t.Fatalf("Expected 1 subscription, got %+v", m)
+	}
+	if sub := m.Meta.Sub[0]; sub.Archived == nil || !sub.Archived.Equal(archivedAt) {
+		t.Errorf("Unexpected subscription %+v", sub)
+	}
+}
+
+func TestHandleMetaRoles(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.lastID = 10
+	owner, moderator, member := helper.uids[0], helper.uids[1], helper.uids[2]
+	helper.topic.owner = owner
+	for _, uid := range []types.Uid{moderator, member} {
+		pud := helper.topic.perUser[uid]
+		pud.modeGiven = types.ModeCPublic
+		helper.topic.perUser[uid] = pud
+	}
+
+	helper.ss.EXPECT().Update(topicName, moderator, map[string]any{"Role": roleModerator}).Return(nil)
+	// The member tries to hard-delete a message of the owner.
+	helper.mm.EXPECT().GetAll(topicName, types.ZeroUid, gomock.Any()).
+		Return([]types.Message{{SeqId: 3, From: owner.String()}}, nil)
+
+	setRole := func(i int, user, role string) {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          "id" + role,
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Role: &MsgSetRole{User: user, Role: role}},
+			},
+			AsUser:   helper.uids[i].UserId(),
+			MetaWhat: constMsgMetaRoles,
+			sess:     helper.sessions[i],
+		})
+	}
+	setRole(0, moderator.UserId(), roleModerator)
+	// Already a moderator.
+	setRole(0, moderator.UserId(), roleModerator)
+	// Ownership is not a role.
+	setRole(0, member.UserId(), roleOwner)
+	// Moderators cannot assign roles.
+	setRole(1, member.UserId(), roleMember)
+
+	err := helper.topic.replyDelMsg(helper.sessions[2], member, false, &ClientComMessage{
+		Del: &MsgClientDel{
+			Id:     "del",
+			Topic:  topicName,
+			What:   "msg",
+			DelSeq: []MsgRange{{LowId: 3}},
+			Hard:   true,
+		},
+		AsUser: member.UserId(),
+		sess:   helper.sessions[2],
+	})
+	if err == nil {
+		t.Error("Expected the member to be denied deleting messages of others")
+	}
+	helper.finish()
+
+	expected := []int{http.StatusOK, http.StatusNotModified, http.StatusBadRequest}
+	if r := helper.results[0]; len(r.messages) != len(expected) {
+		t.Fatalf("Session 0: expected %d responses, received %d", len(expected), len(r.messages))
+	} else {
+		for i, code := range expected {
+			if m := r.messages[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+				t.Errorf("Session 0 response %d: expected ctrl %d, got %+v", i, code, m)
+			}
+		}
+	}
+	for _, i := range []int{1, 2} {
+		if r := helper.results[i]; len(r.messages) != 1 {
+			t.Errorf("Session %d: expected 1 response, received %d", i, len(r.messages))
+		} else if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusForbidden {
+			t.Errorf("Session %d: expected ctrl 403, got %+v", i, m)
+		}
+	}
+
+	if !helper.topic.userCan(moderator, capPin) || !helper.topic.userCan(moderator, capBan) ||
+		helper.topic.userCan(moderator, capDesc) {
+		t.Error("Unexpected capabilities of the moderator")
+	}
+	if helper.topic.userCan(member, capPin) || !helper.topic.userCan(member, capInvite) {
+		t.Error("Unexpected capabilities of the member without a role")
+	}
+	pres := helper.hubMessages[topicName]
+	if len(pres) != 1 || pres[0].Pres == nil || pres[0].Pres.What != "role" || pres[0].Pres.Src != moderator.UserId() {
+		t.Errorf("Expected one {pres what=role}, got %+v", pres)
+	}
+}
+
+func TestRegisterSessionInviteExpired(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatGrp, topicName, false)
+	defer helper.tearDown()
+
+	uid := types.Uid(10001)
+	s, r := helper.newSession("test-sid", uid)
+	helper.sessions = append(helper.sessions, s)
+	helper.results = append(helper.results, r)
+
+	helper.ss.EXPECT().Get(topicName, uid, true).Return(nil, nil)
+	invites := mock_store.NewMockInvitesPersistenceInterface(helper.ctrl)
+	// The link has expired or was used up.
+	invites.EXPECT().Use(topicName, "token").Return(nil, nil)
+	store.Invites = invites
+
+	helper.topic.registerSession(&ClientComMessage{
+		Original: topicName,
+		Sub: &MsgClientSub{
+			Id:    "id456",
+			Topic: topicName,
+			Token: "token",
+		},
+		AsUser:  uid.UserId(),
+		AuthLvl: int(auth.LevelAuth),
+		sess:    s,
+	})
+	helper.finish()
+
+	if len(s.subs) != 0 {
+		t.Errorf("Session subscriptions: expected 0, found %d", len(s.subs))
+	}
+	if _, ok := helper.topic.perUser[uid]; ok {
+		t.Error("Expected the user not to be subscribed")
+	}
+	registerSessionVerifyOutputs(t, r, []int{http.StatusForbidden})
+}
+
+func TestHandleMetaInvites(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	manager := helper.uids[0]
+	// The second user cannot invite.
+	pud := helper.topic.perUser[helper.uids[1]]
+	pud.modeGiven = types.ModeCReadOnly
+	helper.topic.perUser[helper.uids[1]] = pud
+
+	expires := types.TimeNow().Add(time.Hour)
+	invites := mock_store.NewMockInvitesPersistenceInterface(helper.ctrl)
+	invites.EXPECT().GetAll(topicName).Return([]types.Invite{
+		// Used up links do not count towards the limit.
+		{Token: "old", Topic: topicName, CreatedBy: manager.String(), MaxUses: 1, Uses: 1},
+	}, nil)
+	invites.EXPECT().Create(gomock.Any()).DoAndReturn(func(inv *types.Invite) error {
+		if inv.Topic != topicName || inv.CreatedBy != manager.String() || inv.MaxUses != 5 ||
+			!inv.Approval || inv.ExpiresAt == nil || !inv.ExpiresAt.Equal(expires) {
+			t.Errorf("Unexpected invite %+v", inv)
+		}
+		inv.Token = "new"
+		return nil
+	})
+	invites.EXPECT().Delete(topicName, "old").Return(true, nil)
+	invites.EXPECT().Delete(topicName, "old").Return(false, nil)
+	store.Invites = invites
+
+	for i, req := range []*MsgSetInvite{
+		{Expires: &expires, MaxUses: 5, Approval: true},
+		{Token: "old", Revoke: true},
+		// Already revoked.
+		{Token: "old", Revoke: true},
+		{MaxUses: -1},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Invite: req},
+			},
+			AsUser:   manager.UserId(),
+			MetaWhat: constMsgMetaInvites,
+			sess:     helper.sessions[0],
+		})
+	}
+	// Not a manager.
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id4",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "invites"},
+		},
+		AsUser:   helper.uids[1].UserId(),
+		MetaWhat: constMsgMetaInvites,
+		sess:     helper.sessions[1],
+	})
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	expected := []int{http.StatusOK, http.StatusOK, http.StatusNotFound, http.StatusBadRequest}
+	if len(msgs) != len(expected) {
+		t.Fatalf("Expected %d responses, received %d", len(expected), len(msgs))
+	}
+	for i, code := range expected {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+	if params, _ := msgs[0].(*ServerComMessage).Ctrl.Params.(map[string]string); params["token"] != "new" {
+		t.Errorf("Expected the token of the new link, got %+v", msgs[0].(*ServerComMessage).Ctrl.Params)
+	}
+	registerSessionVerifyOutputs(t, helper.results[1], []int{http.StatusForbidden})
+}
+
+func TestHandleMetaJoinRequests(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 4, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	manager, approved, member, denied := helper.uids[0], helper.uids[1], helper.uids[2], helper.uids[3]
+	for _, uid := range []types.Uid{approved, member, denied} {
+		pud := helper.topic.perUser[uid]
+		pud.modeWant = types.ModeCPublic | types.ModeApprove
+		pud.modeGiven = types.ModeJoin
+		if uid == member {
+			pud.modeGiven = types.ModeCPublic
+		}
+		helper.topic.perUser[uid] = pud
+	}
+
+	helper.ss.EXPECT().Update(topicName, approved,
+		map[string]any{"ModeGiven": types.ModeCPublic, "Request": ""}).Return(nil)
+	helper.ss.EXPECT().Delete(topicName, denied).Return(nil)
+
+	for i, req := range []*MsgSetRequest{
+		{User: approved.UserId()},
+		// Already approved.
+		{User: approved.UserId()},
+		// Not a request.
+		{User: member.UserId()},
+		{User: denied.UserId(), Deny: true},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Request: req},
+			},
+			AsUser:   manager.UserId(),
+			MetaWhat: constMsgMetaRequest,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	expected := []int{http.StatusOK, http.StatusNotFound, http.StatusNotFound, http.StatusOK}
+	if r := helper.results[0]; len(r.messages) != len(expected) {
+		t.Fatalf("Expected %d responses, received %d", len(expected), len(r.messages))
+	} else {
+		for i, code := range expected {
+			if m := r.messages[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+				t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+			}
+		}
+	}
+
+	if pud := helper.topic.perUser[approved]; pud.modeGiven != types.ModeCPublic {
+		t.Errorf("Expected the approved user to be given %s, got %s", types.ModeCPublic, pud.modeGiven)
+	}
+	if _, ok := helper.topic.perUser[denied]; ok {
+		t.Error("Expected the subscription of the denied user to be removed")
+	}
+
+	// Requesters are notified on 'me'.
+	for uid, what := range map[types.Uid]string{approved: "acs", denied: "gone"} {
+		found := false
+		for _, m := range helper.hubMessages[uid.UserId()] {
+			if m.Pres != nil && m.Pres.What == what && m.Pres.Src == topicName {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected {pres what=%s} to %s, got %+v", what, uid.UserId(), helper.hubMessages[uid.UserId()])
+		}
+	}
+}
+
+func TestHandleMetaCommunityTopics(t *testing.T) {
+	topicName := "grpComm"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.community = true
+	member, requester := helper.uids[0], helper.uids[1]
+	pud := helper.topic.perUser[requester]
+	pud.modeWant = types.ModeCPublic
+	pud.modeGiven = types.ModeJoin
+	helper.topic.perUser[requester] = pud
+
+	open := types.DefaultAccess{Auth: types.ModeCPublic}
+	private := types.DefaultAccess{Auth: types.ModeNone}
+	helper.tt.EXPECT().GetChildren(topicName).Return([]types.Topic{
+		{ObjHeader: types.ObjHeader{Id: "grpOpen"}, Access: open, SubCnt: 3, Parent: topicName},
+		{ObjHeader: types.ObjHeader{Id: "grpHidden"}, Access: private, SubCnt: 2, Parent: topicName},
+		{ObjHeader: types.ObjHeader{Id: "grpPrivate"}, Access: private, SubCnt: 2, Parent: topicName},
+	}, nil)
+	helper.uu.EXPECT().GetUnreadByTopic(member).Return([]types.TopicUnread{
+		{Topic: "grpOpen", Parent: topicName, Unread: 2},
+		{Topic: "grpOther", Unread: 5},
+	}, nil)
+	helper.ss.EXPECT().Get("grpHidden", member, false).Return(nil, nil)
+	helper.ss.EXPECT().Get("grpPrivate", member, false).Return(&types.Subscription{}, nil)
+
+	for i, uid := range []types.Uid{member, requester} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgGetQuery: MsgGetQuery{What: "topics"},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaTopics,
+			sess:     helper.sessions[i],
+		})
+	}
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil {
+		t.Fatalf("Expected meta, got %+v", m)
+	}
+	expected := []MsgCommunityTopic{{Topic: "grpOpen", SubCnt: 3, Unread: 2}, {Topic: "grpPrivate", SubCnt: 2}}
+	if !reflect.DeepEqual(m.Meta.Topics, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.Meta.Topics)
+	}
+
+	// Requests to join are not members yet.
+	r = helper.results[1]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusForbidden {
+		t.Errorf("Expected ctrl %d, got %+v", http.StatusForbidden, m)
+	}
+}
+
+func TestCommunityRoles(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 4, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	// uids[0] is the owner of the topic.
+	moderator, member, outsider := helper.uids[1], helper.uids[2], helper.uids[3]
+	for _, uid := range helper.uids {
+		pud := helper.topic.perUser[uid]
+		pud.modeWant = types.ModeCPublic
+		pud.modeGiven = types.ModeCPublic
+		helper.topic.perUser[uid] = pud
+	}
+	helper.topic.parent = "grpComm"
+	helper.topic.members = &communityMembers{
+		roles:    map[types.Uid]string{moderator: roleModerator, member: ""},
+		version:  communityVersion.Load(),
+		loadedAt: time.Now(),
+	}
+
+	if !helper.topic.userCan(moderator, capBan) {
+		t.Error("Expected the moderator of the community to be able to ban")
+	}
+	if helper.topic.userCan(member, capBan) {
+		t.Error("Expected the member of the community not to be able to ban")
+	}
+	if !helper.topic.isCommunityMember(member) || helper.topic.isCommunityMember(outsider) {
+		t.Error("Expected members of the community only to be members")
+	}
+
+	// Own role in the topic overrides the role in the community.
+	pud := helper.topic.perUser[moderator]
+	pud.role = roleMember
+	helper.topic.perUser[moderator] = pud
+	if helper.topic.userCan(moderator, capBan) {
+		t.Error("Expected the own role in the topic to apply")
+	}
+}
+
+func TestHandleMetaSetDirectory(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	manager := helper.uids[0]
+	// The second user cannot publish the topic.
+	pud := helper.topic.perUser[helper.uids[1]]
+	pud.modeGiven = types.ModeCPublic
+	pud.modeWant = types.ModeCPublic
+	helper.topic.perUser[helper.uids[1]] = pud
+
+	directory := mock_store.NewMockDirectoryPersistenceInterface(helper.ctrl)
+	directory.EXPECT().Publish(gomock.Any()).DoAndReturn(func(entry *types.DirectoryEntry) error {
+		if entry.Topic != topicName || entry.Category != "sports" || entry.Description != "Football fans" {
+			t.Errorf("Unexpected entry %+v", entry)
+		}
+		return nil
+	})
+	directory.EXPECT().Unpublish(topicName).Return(true, nil)
+	directory.EXPECT().Unpublish(topicName).Return(false, nil)
+	store.Directory = directory
+
+	for i, req := range []*MsgSetDirectory{
+		{Category: "sports", Description: "Football fans"},
+		{Unlist: true},
+		// Already unlisted.
+		{Unlist: true},
+		// Invalid category.
+		{Category: "Sports"},
+		{Category: strings.Repeat("a", maxDirectoryCategoryLength+1)},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Directory: req},
+			},
+			AsUser:   manager.UserId(),
+			MetaWhat: constMsgMetaDirectory,
+			sess:     helper.sessions[0],
+		})
+	}
+	// Not a manager.
+	helper.topic.handleMeta(&ClientComMessage{
+		Set: &MsgClientSet{
+			Id:          "id5",
+			Topic:       topicName,
+			MsgSetQuery: MsgSetQuery{Directory: &MsgSetDirectory{Category: "sports"}},
+		},
+		AsUser:   helper.uids[1].UserId(),
+		MetaWhat: constMsgMetaDirectory,
+		sess:     helper.sessions[1],
+	})
+	// Topics which cannot be joined are not listed.
+	helper.topic.accessAuth = types.ModeNone
+	helper.topic.handleMeta(&ClientComMessage{
+		Set: &MsgClientSet{
+			Id:          "id6",
+			Topic:       topicName,
+			MsgSetQuery: MsgSetQuery{Directory: &MsgSetDirectory{Category: "sports"}},
+		},
+		AsUser:   manager.UserId(),
+		MetaWhat: constMsgMetaDirectory,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	registerSessionVerifyOutputs(t, helper.results[0], []int{http.StatusOK, http.StatusOK, http.StatusNotModified,
+		http.StatusBadRequest, http.StatusBadRequest, http.StatusUnprocessableEntity})
+	registerSessionVerifyOutputs(t, helper.results[1], []int{http.StatusForbidden})
+}
+
+func TestReplyGetDirectory(t *testing.T) {
+	topicName := "fnd"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatFnd, topicName, true)
+	defer helper.tearDown()
+
+	touched := types.TimeNow().Add(-time.Hour)
+	directory := mock_store.NewMockDirectoryPersistenceInterface(helper.ctrl)
+	directory.EXPECT().List("", "sports", 10, 5).Return([]types.DirectoryEntry{
+		{Topic: "grpBusy", Category: "sports", Description: "Busy", SubCnt: 20, TouchedAt: touched},
+		{Topic: "grpNews", Category: "sports", UseBt: true, SubCnt: 100},
+	}, nil)
+	directory.EXPECT().List("", "", 0, 0).Return(nil, nil)
+	store.Directory = directory
+
+	for i, req := range []*MsgGetOpts{
+		{Category: "sports", Offset: 10, Limit: 5},
+		nil,
+		// Invalid category.
+		{Category: "Sports!"},
+		// Too deep.
+		{Offset: maxDirectoryOffset + 1},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgGetQuery: MsgGetQuery{What: "directory", Directory: req},
+			},
+			AsUser:   helper.uids[0].UserId(),
+			MetaWhat: constMsgMetaDirectory,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 4 {
+		t.Fatalf("Expected 4 responses, received %d", len(msgs))
+	}
+	m := msgs[0].(*ServerComMessage)
+	expected := []MsgDirectoryTopic{
+		{Topic: "grpBusy", Category: "sports", Description: "Busy", SubCnt: 20, Touched: &touched},
+		// Channels are listed by their channel name.
+		{Topic: "chnNews", Category: "sports", SubCnt: 100},
+	}
+	if m.Meta == nil || !reflect.DeepEqual(m.Meta.Directory, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, m)
+	}
+	for i, code := range []int{http.StatusNoContent, http.StatusBadRequest, http.StatusBadRequest} {
+		if m := msgs[i+1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i+1, code, m)
+		}
+	}
+}
+
+func TestHandleBroadcastDataSlowMode(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.slowMode = 30
+	owner, member := helper.uids[0], helper.uids[1]
+	pud := helper.topic.perUser[member]
+	pud.modeWant = types.ModeCPublic
+	pud.modeGiven = types.ModeCPublic
+	helper.topic.perUser[member] = pud
+
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true).Times(3)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil).AnyTimes()
+
+	// The second message of the member is too soon, the owner is not limited.
+	now := types.TimeNow()
+	for i, sender := range []int{1, 1, 0, 0} {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			Id:        fmt.Sprintf("id%d", i),
+			AsUser:    helper.uids[sender].UserId(),
+			Original:  topicName,
+			Timestamp: now.Add(time.Duration(i) * time.Second),
+			Pub: &MsgClientPub{
+				Id:      fmt.Sprintf("id%d", i),
+				Topic:   topicName,
+				Content: "test",
+				NoEcho:  true,
+			},
+			sess: helper.sessions[sender],
+		})
+	}
+	helper.finish()
+
+	if helper.topic.lastID != 3 {
+		t.Errorf("Topic.lastID: expected 3, found %d", helper.topic.lastID)
+	}
+	var rejected *ServerComMessage
+	for _, m := range helper.results[1].messages {
+		if m := m.(*ServerComMessage); m.Ctrl != nil && m.Ctrl.Code == http.StatusTooManyRequests {
+			rejected = m
+		}
+	}
+	if rejected == nil {
+		t.Fatalf("Expected ctrl %d, got %+v", http.StatusTooManyRequests, helper.results[1].messages)
+	}
+	if params, _ := rejected.Ctrl.Params.(map[string]any); params["retry"] != 29000 {
+		t.Errorf("Expected retry in 29000 ms, got %+v", rejected.Ctrl.Params)
+	}
+	if _, ok := helper.topic.slowPosts[owner]; ok {
+		t.Error("Expected messages of the owner not to be recorded")
+	}
+}
+
+func TestHandleBroadcastDataFrozen(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.frozen = true
+	pud := helper.topic.perUser[helper.uids[1]]
+	pud.modeWant = types.ModeCPublic
+	pud.modeGiven = types.ModeCPublic
+	helper.topic.perUser[helper.uids[1]] = pud
+
+	// Only the message of the owner is saved.
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil).AnyTimes()
+
+	for i, sender := range []int{1, 0} {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			Id:        fmt.Sprintf("id%d", i),
+			AsUser:    helper.uids[sender].UserId(),
+			Original:  topicName,
+			Timestamp: types.TimeNow(),
+			Pub: &MsgClientPub{
+				Id:      fmt.Sprintf("id%d", i),
+				Topic:   topicName,
+				Content: "test",
+				NoEcho:  true,
+			},
+			sess: helper.sessions[sender],
+		})
+	}
+	helper.finish()
+
+	if helper.topic.lastID != 1 {
+		t.Errorf("Topic.lastID: expected 1, found %d", helper.topic.lastID)
+	}
+	var rejected bool
+	for _, m := range helper.results[1].messages {
+		if m := m.(*ServerComMessage); m.Ctrl != nil && m.Ctrl.Code == http.StatusLocked {
+			rejected = true
+		}
+	}
+	if !rejected {
+		t.Errorf("Expected ctrl %d, got %+v", http.StatusLocked, helper.results[1].messages)
+	}
+}
+
+func TestOnboardingMessages(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	helper.topic.xoriginal = topicName
+	helper.topic.public = map[string]any{"fn": "Football"}
+	helper.topic.aux = map[string]any{auxOnboarding: map[string]any{
+		"welcome": "Welcome to $topic, $user!",
+		"join":    "$user joined, $count members",
+		"leave":   "$user left $unknown",
+	}}
+	uid := helper.uids[1]
+	// Admins see messages scoped to other users.
+	pud := helper.topic.perUser[helper.uids[0]]
+	pud.modeWant = types.ModeCPublic
+	pud.modeGiven = types.ModeCPublic
+	helper.topic.perUser[helper.uids[0]] = pud
+
+	var saved []*types.Message
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), false).DoAndReturn(
+		func(msg *types.Message, _ []string, _ bool) (error, bool) {
+			saved = append(saved, msg)
+			return nil, false
+		}).Times(3)
+	helper.uu.EXPECT().Get(uid).Return(&types.User{Public: map[string]any{"fn": "Alice"}}, nil).Times(3)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil).AnyTimes()
+
+	helper.topic.onboardingSubChange(uid, types.ModeNone, types.ModeNone, types.ModeCPublic, types.ModeCPublic)
+	// Changes of access modes of members are not announced.
+	helper.topic.onboardingSubChange(uid, types.ModeCPublic, types.ModeCPublic, types.ModeCPublic, types.ModeCReadOnly)
+	helper.topic.onboardingSubChange(uid, types.ModeCPublic, types.ModeCReadOnly, types.ModeUnset, types.ModeUnset)
+	helper.finish()
+
+	expected := []struct {
+		event, text string
+		scoped      bool
+	}{
+		{serviceJoin, "Alice joined, 2 members", false},
+		{serviceWelcome, "Welcome to Football, Alice!", true},
+		{serviceLeave, "Alice left $unknown", false},
+	}
+	if len(saved) != len(expected) {
+		t.Fatalf("Expected %d messages, saved %d", len(expected), len(saved))
+	}
+	for i, exp := range expected {
+		msg := saved[i]
+		if msg.From != "" || msg.SeqId != i+1 || msg.Head[msgHeadService] != exp.event ||
+			msg.Head[msgHeadServiceUser] != uid.UserId() || msg.Content != exp.text {
+			t.Errorf("Message %d: unexpected %+v", i, msg)
+		}
+		if scope := msgScope(msg.Head); exp.scoped != (len(scope) == 1 && scope[0] == uid.UserId()) {
+			t.Errorf("Message %d: unexpected scope %v", i, scope)
+		}
+	}
+	if helper.topic.lastID != 3 {
+		t.Errorf("Topic.lastID: expected 3, found %d", helper.topic.lastID)
+	}
+	// The other subscriber received the join and leave notices only.
+	if n := len(helper.results[0].messages); n != 2 {
+		t.Errorf("Expected 2 messages delivered to the other subscriber, got %d", n)
+	}
+
+	for _, settings := range []any{
+		map[string]any{"welcome": "Hi"},
+		nil,
+	} {
+		if err := validateTopicOnboarding(settings); err != nil {
+			t.Errorf("Valid settings %v rejected: %v", settings, err)
+		}
+	}
+	for _, settings := range []any{
+		"welcome",
+		map[string]any{"hello": "Hi"},
+		map[string]any{"welcome": 1},
+		map[string]any{"leave": strings.Repeat("a", maxOnboardingTemplateLength+1)},
+	} {
+		if err := validateTopicOnboarding(settings); err == nil {
+			t.Errorf("Invalid settings %v accepted", settings)
+		}
+	}
+}
+
+func TestReplyGetUsage(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	globals.userMediaQuota = 1000
+	defer func() { globals.userMediaQuota = 0 }()
+
+	uid := helper.uids[0]
+	helper.fl.EXPECT().UserUsage(uid).Return(int64(250), nil)
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id0",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "usage"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaUsage,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Usage == nil || *m.Meta.Usage != (MsgStorageUsage{Used: 250, Limit: 1000}) {
+		t.Errorf("Expected usage 250 of 1000, got %+v", m)
+	}
+}
+
+func TestHandleBroadcastDataQuotaExceeded(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 2, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	globals.topicMediaQuota = 1000
+	defer func() { globals.topicMediaQuota = 0 }()
+
+	attachments := []string{"/v0/file/s/abcdef.jpeg"}
+	helper.fl.EXPECT().TopicUsage(topicName, attachments).Return(int64(1200), nil)
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		Id:        "id0",
+		AsUser:    helper.uids[0].UserId(),
+		Original:  topicName,
+		Timestamp: types.TimeNow(),
+		Pub: &MsgClientPub{
+			Id:      "id0",
+			Topic:   topicName,
+			Content: "test",
+		},
+		Extra: &MsgClientExtra{Attachments: attachments},
+		sess:  helper.sessions[0],
+	})
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Errorf("Topic.lastID: expected 0, found %d", helper.topic.lastID)
+	}
+	r := helper.results[0]
+	if len(r.messages) != 1 {
+		t.Fatalf("Expected 1 response, received %d", len(r.messages))
+	}
+	if m := r.messages[0].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected ctrl %d, got %+v", http.StatusRequestEntityTooLarge, m)
+	}
+}
+
+// testSFU records rooms created and deleted by the server.
+type testSFU struct {
+	rooms map[string]bool
+}
+
+func (s *testSFU) Init(jsonconf json.RawMessage) error {
+	s.rooms = make(map[string]bool)
+	return nil
+}
+
+func (s *testSFU) URL() string {
+	return "wss://sfu.example.com"
+}
+
+func (s *testSFU) CreateRoom(ctx context.Context, room string, maxParticipants int) error {
+	s.rooms[room] = true
+	return nil
+}
+
+func (s *testSFU) Token(room, identity, name string, ttl time.Duration) (string, error) {
+	return room + ":" + identity, nil
+}
+
+func (s *testSFU) DeleteRoom(ctx context.Context, room string) error {
+	delete(s.rooms, room)
+	return nil
+}
+
+var testSFUProvider = &testSFU{}
+
+func init() {
+	sfu.Register("test", testSFUProvider)
+}
+
+func TestHandleGroupCall(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	globals.iceServers = []iceServer{{Username: "dummy"}}
+	if _, err := sfu.Init(json.RawMessage(`{"use_sfu":"test","max_participants":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		globals.iceServers = nil
+		sfu.Init(nil)
+	}()
+
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, true).Times(2)
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil).AnyTimes()
+	helper.ca.EXPECT().Create(gomock.Any()).DoAndReturn(func(call *types.CallRecord) error {
+		if call.Topic != topicName || call.SeqId != 1 || call.Room != "grpTest-1" || call.Owner != helper.uids[0].String() {
+			t.Errorf("Unexpected call record %+v", call)
+		}
+		return nil
+	})
+	helper.ca.EXPECT().End(gomock.Any()).DoAndReturn(func(call *types.CallRecord) error {
+		if call.Topic != topicName || call.SeqId != 1 || call.Outcome != "finished" ||
+			!reflect.DeepEqual(call.Participants, []string{helper.uids[0].String(), helper.uids[1].String()}) {
+			t.Errorf("Unexpected call outcome %+v", call)
+		}
+		return nil
+	})
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:    helper.uids[0].UserId(),
+		Original:  topicName,
+		Timestamp: types.TimeNow(),
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Head:    map[string]any{"webrtc": "started"},
+			Content: "call",
+			NoEcho:  true,
+		},
+		sess: helper.sessions[0],
+	})
+	if !testSFUProvider.rooms["grpTest-1"] {
+		t.Fatal("Room was not created")
+	}
+
+	note := func(i int, event string) {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			AsUser:    helper.uids[i].UserId(),
+			Original:  topicName,
+			RcptTo:    topicName,
+			Timestamp: types.TimeNow(),
+			Note:      &MsgClientNote{Topic: topicName, What: "call", SeqId: 1, Event: event},
+			sess:      helper.sessions[i],
+		})
+	}
+	note(1, constCallEventJoin)
+	// The call is full.
+	note(2, constCallEventJoin)
+	note(1, constCallEventHangUp)
+	note(0, constCallEventHangUp)
+	helper.finish()
+
+	if helper.topic.currentCall != nil {
+		t.Error("Call is still in progress")
+	}
+	if len(testSFUProvider.rooms) != 0 {
+		t.Error("Room was not deleted")
+	}
+
+	events := func(i int) []string {
+		var result []string
+		for _, m := range helper.results[i].messages {
+			msg := m.(*ServerComMessage)
+			switch {
+			case msg.Data != nil:
+				result = append(result, "data:"+msg.Data.Head["webrtc"].(string))
+			case msg.Info != nil:
+				result = append(result, msg.Info.Event)
+				if msg.Info.Event == constCallEventToken {
+					var payload map[string]string
+					json.Unmarshal(msg.Info.Payload, &payload)
+					if payload["token"] != "grpTest-1:"+helper.uids[i].UserId() || payload["url"] != "wss://sfu.example.com" {
+						t.Errorf("Session %d: unexpected token payload %v", i, payload)
+					}
+				}
+			}
+		}
+		return result
+	}
+	expected := [][]string{
+		{"token", "joined", "left", "left", "data:finished", "hang-up"},
+		{"data:started", "joined", "token", "left", "left", "data:finished", "hang-up"},
+		{"data:started", "joined", "joined", "full", "left", "left", "data:finished", "hang-up"},
+	}
+	for i, exp := range expected {
+		if got := events(i); !reflect.DeepEqual(got, exp) {
+			t.Errorf("Session %d: expected %v, got %v", i, exp, got)
+		}
+	}
+}
+
+func TestReplyGetCalls(t *testing.T) {
+	topicName := "usrMe"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	other := types.Uid(10)
+	p2p := uid.P2PName(other)
+	now := types.TimeNow()
+	ended := now.Add(time.Minute)
+	helper.uu.EXPECT().GetTopics(uid, gomock.Any()).Return([]types.Subscription{
+		{Topic: "grpTest", ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic},
+		{Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P},
+	}, nil)
+	helper.ca.EXPECT().GetAll(gomock.Any(), gomock.Any(), 10).DoAndReturn(
+		func(topics []string, before *time.Time, limit int) ([]types.CallRecord, error) {
+			sort.Strings(topics)
+			if !reflect.DeepEqual(topics, []string{"grpTest", p2p}) || before != nil {
+				t.Errorf("Unexpected query %v %v", topics, before)
+			}
+			return []types.CallRecord{
+				{Topic: p2p, SeqId: 7, Owner: other.String(), CreatedAt: now, EndedAt: &ended,
+					Outcome: "missed", Participants: []string{other.String()}},
+				{Topic: "grpTest", SeqId: 3, Room: "grpTest-3", Owner: uid.String(), CreatedAt: now, EndedAt: &ended,
+					Outcome: "finished", Duration: 60000, Participants: []string{uid.String(), other.String()}},
+			}, nil
+		})
+
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:    "id0",
+			Topic: "me",
+			MsgGetQuery: MsgGetQuery{
+				What:  "calls",
+				Calls: &MsgGetOpts{Limit: 10},
+			},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaCalls,
+		sess:     helper.sessions[0],
+	})
+	// Call history is available in 'me' only.
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id1",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "calls", Calls: &MsgGetOpts{User: other.UserId()}},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaCalls,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	r := helper.results[0]
+	if len(r.messages) != 2 {
+		t.Fatalf("Expected 2 responses, received %d", len(r.messages))
+	}
+	m := r.messages[0].(*ServerComMessage)
+	if m.Meta == nil || len(m.Meta.Calls) != 2 {
+		t.Fatalf("Expected 2 calls, got %+v", m)
+	}
+	if call := m.Meta.Calls[0]; call.Topic != other.UserId() || call.SeqId != 7 || call.From != other.UserId() ||
+		call.Outcome != "missed" || call.Group || !reflect.DeepEqual(call.Participants, []string{other.UserId()}) {
+		t.Errorf("Unexpected p2p call %+v", call)
+	}
+	if call := m.Meta.Calls[1]; call.Topic != "grpTest" || call.From != uid.UserId() || call.Duration != 60000 ||
+		!call.Group || call.Ended == nil || len(call.Participants) != 2 {
+		t.Errorf("Unexpected group call %+v", call)
+	}
+	if m = r.messages[1].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != http.StatusBadRequest {
+		t.Errorf("Expected malformed request error, got %+v", m)
+	}
+}
+
+func TestPresUsersOfInterestInvisible(t *testing.T) {
+	topicName := types.Uid(1).UserId()
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	hidden, shown := types.Uid(10), types.Uid(11)
+	helper.topic.perSubs = map[string]perSubsData{
+		hidden.UserId(): {enabled: true, online: true},
+		shown.UserId():  {enabled: true, online: true},
+	}
+
+	presence := mock_store.NewMockPresenceSettingsPersistenceInterface(helper.ctrl)
+	presence.EXPECT().Get(uid).Return(map[types.Uid]*types.PresenceSettings{
+		uid: {User: uid.String(), Invisible: true},
+	}, nil)
+	presence.EXPECT().GetForUser(uid).Return(map[string]*types.TopicPresenceSettings{
+		uid.P2PName(shown): {Topic: uid.P2PName(shown), User: uid.String(), Share: types.PresenceShareShow},
+	}, nil)
+	store.PresenceSettings = presence
+
+	helper.topic.presUsersOfInterest("on", "ua1")
+	helper.topic.presUsersOfInterest("ua", "ua2")
+	// The contact is online and asks for the user's status.
+	helper.topic.handleServerMsg(&ServerComMessage{
+		AsUser: uid.UserId(),
+		RcptTo: uid.UserId(),
+		Pres: &MsgServerPres{
+			Topic:     "me",
+			Src:       hidden.UserId(),
+			What:      "?unkn",
+			WantReply: true,
+		},
+	})
+	helper.finish()
+
+	msgs := helper.hubMessages[hidden.UserId()]
+	if len(msgs) != 2 {
+		t.Fatalf("Hidden contact: expected 2 messages, got %d", len(msgs))
+	}
+	if pres := msgs[0].Pres; pres.What != "?unkn" || !pres.WantReply {
+		t.Errorf("Hidden contact: expected status request, got %+v", pres)
+	}
+	if pres := msgs[1].Pres; pres.What != "off" || pres.Src != uid.UserId() {
+		t.Errorf("Hidden contact: expected reply 'off', got %+v", pres)
+	}
+	msgs = helper.hubMessages[shown.UserId()]
+	if len(msgs) != 2 || msgs[0].Pres.What != "on" || msgs[1].Pres.What != "ua" {
+		t.Errorf("Contact with override: expected 'on' and 'ua', got %v", msgs)
+	}
+}
+
+func TestHandleMetaPresence(t *testing.T) {
+	topicName := types.Uid(1).UserId()
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	contact := types.Uid(10)
+	helper.topic.perSubs = map[string]perSubsData{
+		contact.UserId():     {enabled: true, online: true},
+		"grpSomeGroupTopic": {enabled: true, online: true},
+	}
+
+	var saved *types.PresenceSettings
+	presence := mock_store.NewMockPresenceSettingsPersistenceInterface(helper.ctrl)
+	presence.EXPECT().Get(uid).DoAndReturn(func(users ...types.Uid) (map[types.Uid]*types.PresenceSettings, error) {
+		if saved == nil {
+			return nil, nil
+		}
+		return map[types.Uid]*types.PresenceSettings{uid: saved}, nil
+	}).AnyTimes()
+	presence.EXPECT().GetForUser(uid).Return(nil, nil).AnyTimes()
+	presence.EXPECT().Update(gomock.Any()).DoAndReturn(func(ps *types.PresenceSettings) error {
+		if ps.User != uid.String() || !ps.Invisible || ps.LastSeen != types.PresenceSeenNobody {
+			t.Errorf("Unexpected settings %+v", ps)
+		}
+		saved = ps
+		return nil
+	})
+	store.PresenceSettings = presence
+
+	invisible := true
+	seen := types.PresenceSeenNobody
+	bogus := "friends"
+	for i, req := range []*MsgPresenceSettings{
+		{Invisible: &invisible, Seen: &seen},
+		{Seen: &bogus},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "me",
+				MsgSetQuery: MsgSetQuery{Presence: req},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaPresence,
+			sess:     helper.sessions[0],
+		})
+	}
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id2",
+			Topic:       "me",
+			MsgGetQuery: MsgGetQuery{What: "presence"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaPresence,
+		sess:     helper.sessions[0],
+	})
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 responses, received %d", len(msgs))
+	}
+	for i, code := range []int{http.StatusOK, http.StatusBadRequest} {
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+	m := msgs[2].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Presence == nil || !*m.Meta.Presence.Invisible || *m.Meta.Presence.Seen != seen {
+		t.Errorf("Expected updated settings, got %+v", m.Meta)
+	}
+
+	// The contact is told the user is offline now, group topics are not.
+	if msgs := helper.hubMessages[contact.UserId()]; len(msgs) != 1 || msgs[0].Pres.What != "off" {
+		t.Errorf("Contact: expected 'off', got %v", msgs)
+	}
+	if msgs := helper.hubMessages["grpSomeGroupTopic"]; len(msgs) != 0 {
+		t.Errorf("Group topic: expected no messages, got %v", msgs)
+	}
+}
+
+func TestHandleMetaPresenceTopic(t *testing.T) {
+	topicName := "grpTest"
+	helper := TopicTestHelper{}
+	helper.setUp(t, 3, types.TopicCatGrp, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[1]
+	helper.pr.EXPECT().UpdateForTopic(gomock.Any()).DoAndReturn(func(tps *types.TopicPresenceSettings) error {
+		if tps.Topic != topicName || tps.User != uid.String() || tps.Share != types.PresenceShareHide {
+			t.Errorf("Unexpected override %+v", tps)
+		}
+		return nil
+	})
+
+	hide := types.PresenceShareHide
+	invisible := true
+	for i, req := range []*MsgPresenceSettings{{Share: &hide}, {Invisible: &invisible}} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       topicName,
+				MsgSetQuery: MsgSetQuery{Presence: req},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaPresence,
+			sess:     helper.sessions[1],
+		})
+	}
+	helper.topic.handleMeta(&ClientComMessage{
+		Get: &MsgClientGet{
+			Id:          "id2",
+			Topic:       topicName,
+			MsgGetQuery: MsgGetQuery{What: "presence"},
+		},
+		AsUser:   uid.UserId(),
+		MetaWhat: constMsgMetaPresence,
+		sess:     helper.sessions[1],
+	})
+	helper.finish()
+
+	if !helper.topic.perUser[uid].presHidden {
+		t.Error("User is expected to appear offline in the topic")
+	}
+	msgs := helper.hubMessages[topicName]
+	if len(msgs) != 1 || msgs[0].Pres.What != "off" || msgs[0].Pres.Src != uid.UserId() {
+		t.Errorf("Expected 'off' to the topic, got %v", msgs)
+	}
+
+	r := helper.results[1]
+	if len(r.messages) != 3 {
+		t.Fatalf("Expected 3 responses, received %d", len(r.messages))
+	}
+	for i, code := range []int{http.StatusOK, http.StatusBadRequest} {
+		if m := r.messages[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+	m := r.messages[2].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Presence == nil || *m.Meta.Presence.Share != hide {
+		t.Errorf("Expected the override, got %+v", m.Meta)
+	}
+}
+
+func TestLastSeenVisible(t *testing.T) {
+	contact := func() bool { return true }
+	stranger := func() bool { return false }
+	for i, tc := range []struct {
+		settings  *types.PresenceSettings
+		isContact func() bool
+		visible   bool
+	}{
+		{nil, stranger, true},
+		{&types.PresenceSettings{}, stranger, true},
+		{&types.PresenceSettings{LastSeen: types.PresenceSeenContacts}, contact, true},
+		{&types.PresenceSettings{LastSeen: types.PresenceSeenContacts}, stranger, false},
+		{&types.PresenceSettings{LastSeen: types.PresenceSeenNobody}, contact, false},
+		{&types.PresenceSettings{Invisible: true}, contact, false},
+	} {
+		if visible := lastSeenVisible(tc.settings, tc.isContact); visible != tc.visible {
+			t.Errorf("%d: expected %t, got %t", i, tc.visible, visible)
+		}
+	}
+}
+
+func TestHandleMetaSetDescStatus(t *testing.T) {
+	topicName := types.Uid(1).UserId()
+	helper := TopicTestHelper{}
+	helper.setUp(t, 1, types.TopicCatMe, topicName, true)
+	defer helper.tearDown()
+
+	uid := helper.uids[0]
+	contact := types.Uid(10)
+	helper.topic.perSubs = map[string]perSubsData{
+		contact.UserId(): {enabled: true, online: true},
+	}
+
+	expires := types.TimeNow().Add(time.Hour)
+	gomock.InOrder(
+		helper.uu.EXPECT().Update(uid, gomock.Any()).DoAndReturn(func(_ types.Uid, upd map[string]any) error {
+			status, _ := upd["Status"].(*types.UserStatus)
+			if status == nil || status.Emoji != "🏖" || status.Text != "On vacation" || !status.ExpiresAt.Equal(expires) {
+				t.Errorf("Unexpected status %+v", upd["Status"])
+			}
+			return nil
+		}),
+		helper.uu.EXPECT().Update(uid, gomock.Any()).DoAndReturn(func(_ types.Uid, upd map[string]any) error {
+			if status, ok := upd["Status"]; !ok || status != nil {
+				t.Errorf("Expected the status cleared, got %+v", upd)
+			}
+			return nil
+		}),
+	)
+
+	past := types.TimeNow().Add(-time.Hour)
+	for i, status := range []*MsgUserStatus{
+		{Emoji: "🏖", Text: " On vacation ", Expires: &expires},
+		{Text: strings.Repeat("a", maxStatusTextLength+1)},
+		{Text: "Back soon", Expires: &past},
+		{},
+		{},
+	} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Set: &MsgClientSet{
+				Id:          fmt.Sprintf("id%d", i),
+				Topic:       "me",
+				MsgSetQuery: MsgSetQuery{Desc: &MsgSetDesc{Status: status}},
+			},
+			AsUser:   uid.UserId(),
+			MetaWhat: constMsgMetaDesc,
+			sess:     helper.sessions[0],
+		})
+		if i == 0 {
+			helper.topic.handleMeta(&ClientComMessage{
+				Get: &MsgClientGet{
+					Id:          "get",
+					Topic:       "me",
+					MsgGetQuery: MsgGetQuery{What: "desc"},
+				},
+				AsUser:   uid.UserId(),
+				MetaWhat: constMsgMetaDesc,
+				sess:     helper.sessions[0],
+			})
+		}
+	}
+	helper.finish()
+
+	msgs := helper.results[0].messages
+	if len(msgs) != 6 {
+		t.Fatalf("Expected 6 responses, received %d", len(msgs))
+	}
+	m := msgs[1].(*ServerComMessage)
+	if m.Meta == nil || m.Meta.Desc == nil || m.Meta.Desc.Status == nil || m.Meta.Desc.Status.Text != "On vacation" {
+		t.Errorf("Expected the status in desc, got %+v", m.Meta)
+	}
+	for i, code := range []int{http.StatusOK, 0, http.StatusBadRequest, http.StatusBadRequest, http.StatusOK,
+		http.StatusNotModified} {
+		if code == 0 {
+			continue
+		}
+		if m := msgs[i].(*ServerComMessage); m.Ctrl == nil || m.Ctrl.Code != code {
+			t.Errorf("Response %d: expected ctrl %d, got %+v", i, code, m)
+		}
+	}
+	if helper.topic.userStatus != nil {
+		t.Errorf("Expected the status cleared, got %+v", helper.topic.userStatus)
+	}
+
+	// The contact is notified of both changes.
+	if msgs := helper.hubMessages[contact.UserId()]; len(msgs) != 2 || msgs[0].Pres.What != "upd" {
+		t.Errorf("Contact: expected 'upd', got %v", msgs)
+	}
+}
+
+func TestStatusToMsg(t *testing.T) {
+	now := types.TimeNow()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+	for i, tc := range []struct {
+		status   *types.UserStatus
+		reported bool
+	}{
+		{nil, false},
+		{&types.UserStatus{Text: "Busy"}, true},
+		{&types.UserStatus{Text: "Busy", ExpiresAt: &future}, true},
+		{&types.UserStatus{Text: "Busy", ExpiresAt: &past}, false},
+	} {
+		if reported := statusToMsg(tc.status, now) != nil; reported != tc.reported {
+			t.Errorf("%d: expected %t, got %t", i, tc.reported, reported)
+		}
+	}
+}
+
+func TestUpdateFanoutMode(t *testing.T) {
+	globals.cluster = &Cluster{shardMinSessions: 4, shardBatchSize: 2}
+	defer func() {
+		globals.cluster = nil
+	}()
+
+	local := &Session{proto: WEBSOCK}
+	multi := &Session{proto: MULTIPLEX}
+	uid1, uid2 := types.Uid(1), types.Uid(2)
+	topic := &Topic{
+		name: "grpTest",
+		sessions: map[*Session]perSessionData{
+			local: {uid: uid1},
+			multi: {muids: []types.Uid{uid1, uid2}},
+		},
+	}
+
+	topic.updateFanoutMode()
+	if topic.shardedFanout || multi.batchFanout.Load() {
+		t.Fatal("Expected regular fanout with 3 sessions")
+	}
+
+	topic.addSession(&Session{proto: PROXY, multi: multi}, types.Uid(3), false)
+	topic.updateFanoutMode()
+	if !topic.shardedFanout || !multi.batchFanout.Load() {
+		t.Fatal("Expected sharded fanout with 4 sessions")
+	}
+	if local.batchFanout.Load() {
+		t.Error("Local session must not batch messages")
+	}
+
+	topic.remSession(&Session{proto: PROXY, multi: multi}, types.Uid(3))
+	topic.remSession(local, uid1)
+	topic.updateFanoutMode()
+	if topic.shardedFanout || multi.batchFanout.Load() {
+		t.Error("Expected regular fanout with 2 sessions")
+	}
+}
+
+// setUpScopeTest creates a group topic of 4 users: uid0 and uid3 are moderators, uid1 and uid2 are ordinary members.
+func setUpScopeTest(t *testing.T, helper *TopicTestHelper, topicName string) {
+	helper.setUp(t, 4, types.TopicCatGrp, topicName, true)
+	for _, uid := range helper.uids[1:3] {
+		pud := helper.topic.perUser[uid]
+		pud.modeWant = types.ModeCPublic
+		pud.modeGiven = types.ModeCPublic
+		helper.topic.perUser[uid] = pud
+	}
+}
+
+func TestHandleBroadcastDataScoped(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	setUpScopeTest(t, &helper, topicName)
+	defer helper.tearDown()
+
+	var saved *types.Message
+	helper.mm.EXPECT().Save(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(msg *types.Message, attachmentURLs []string, readBySender bool) (error, bool) {
+			saved = msg
+			return nil, true
+		})
+	helper.ns.EXPECT().Get(gomock.Any()).Return(nil, nil)
+
+	helper.topic.handleClientMsg(&ClientComMessage{
+		AsUser:   helper.uids[0].UserId(),
+		Original: topicName,
+		Pub: &MsgClientPub{
+			Topic:   topicName,
+			Head:    map[string]any{"scope": []any{helper.uids[1].UserId(), helper.uids[1].UserId()}},
+			Content: "test",
+			NoEcho:  true,
+		},
+		sess: helper.sessions[0],
+	})
+	helper.finish()
+
+	if saved == nil {
+		t.Fatal("Message not saved")
+	}
+	// The scope is deduplicated and includes the sender.
+	expected := []string{helper.uids[0].UserId(), helper.uids[1].UserId()}
+	sort.Strings(expected)
+	if scope := msgScope(saved.Head); !reflect.DeepEqual(scope, expected) {
+		t.Errorf("Saved scope: expected %v, got %v", expected, scope)
+	}
+
+	if len(helper.results[1].messages) != 1 {
+		t.Errorf("Uid1 is in scope: expected 1 message, got %d", len(helper.results[1].messages))
+	}
+	if len(helper.results[2].messages) != 0 {
+		t.Errorf("Uid2 is out of scope: expected 0 messages, got %d", len(helper.results[2].messages))
+	}
+	// Moderators see all messages.
+	if len(helper.results[3].messages) != 1 {
+		t.Errorf("Uid3 is a moderator: expected 1 message, got %d", len(helper.results[3].messages))
+	}
+}
+
+func TestHandleBroadcastDataScopeNotMember(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	setUpScopeTest(t, &helper, topicName)
+	defer helper.tearDown()
+
+	// Uid2 can't read the topic.
+	pud := helper.topic.perUser[helper.uids[2]]
+	pud.modeGiven = types.ModeJoin | types.ModeWrite
+	helper.topic.perUser[helper.uids[2]] = pud
+
+	for i, scope := range [][]any{
+		{types.Uid(100).UserId()},
+		{helper.uids[1].UserId(), helper.uids[2].UserId()},
+		{"not-a-user"},
+		{},
+	} {
+		helper.topic.handleClientMsg(&ClientComMessage{
+			Id:       fmt.Sprintf("id%d", i),
+			AsUser:   helper.uids[0].UserId(),
+			Original: topicName,
+			Pub: &MsgClientPub{
+				Topic:   topicName,
+				Head:    map[string]any{"scope": scope},
+				Content: "test",
+			},
+			sess: helper.sessions[0],
+		})
+	}
+	helper.finish()
+
+	if helper.topic.lastID != 0 {
+		t.Errorf("No messages expected to be published, lastID %d", helper.topic.lastID)
+	}
+	r := helper.results[0]
+	if len(r.messages) != 4 {
+		t.Fatalf("Responses received: expected 4, received %d", len(r.messages))
+	}
+	for i, msg := range r.messages {
+		m := msg.(*ServerComMessage)
+		if m.Ctrl == nil || m.Ctrl.Code != http.StatusBadRequest {
+			t.Errorf("Response %d: expected ctrl 400, got %+v", i, m)
+		}
+	}
+	for i := 1; i < 4; i++ {
+		if len(helper.results[i].messages) != 0 {
+			t.Errorf("Uid%d: expected 0 messages, got %d", i, len(helper.results[i].messages))
+		}
+	}
+}
+
+func TestPushForDataScoped(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	setUpScopeTest(t, &helper, topicName)
+	defer helper.tearDown()
+	helper.finish()
+
+	data := &MsgServerData{
+		Topic:   topicName,
+		From:    helper.uids[0].UserId(),
+		SeqId:   1,
+		Head:    map[string]any{"scope": []string{helper.uids[0].UserId(), helper.uids[1].UserId()}},
+		Content: "test",
+	}
+	receipt := helper.topic.pushForData(helper.uids[0], data, false, nil)
+	if receipt == nil {
+		t.Fatal("Expected a push receipt")
+	}
+	for i, expected := range []bool{true, true, false, true} {
+		if _, found := receipt.To[helper.uids[i]]; found != expected {
+			t.Errorf("Uid%d: push recipient expected %t, got %t", i, expected, found)
+		}
+	}
+}
+
+func TestReplyGetDataScoped(t *testing.T) {
+	topicName := "grp-test"
+	helper := TopicTestHelper{}
+	setUpScopeTest(t, &helper, topicName)
+	defer helper.tearDown()
+
+	now := types.TimeNow()
+	from := helper.uids[0].String()
+	messages := []types.Message{
+		{ObjHeader: types.ObjHeader{CreatedAt: now}, SeqId: 1, Topic: topicName, From: from, Content: "all"},
+		{ObjHeader: types.ObjHeader{CreatedAt: now}, SeqId: 2, Topic: topicName, From: from, Content: "uid1",
+			Head: types.KVMap{"scope": []any{helper.uids[0].UserId(), helper.uids[1].UserId()}}},
+		{ObjHeader: types.ObjHeader{CreatedAt: now}, SeqId: 3, Topic: topicName, From: from, Content: "uid2",
+			Head: types.KVMap{"scope": []any{helper.uids[0].UserId(), helper.uids[2].UserId()}}},
+	}
+	helper.mm.EXPECT().GetAll(topicName, gomock.Any(), gomock.Any()).DoAndReturn(
+		func(topic string, forUser types.Uid, opts *types.QueryOpt) ([]types.Message, error) {
+			// The result is filtered in place: return a copy.
+			return append([]types.Message(nil), messages...), nil
+		}).Times(2)
+	helper.rr.EXPECT().GetAll(topicName, gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+
+	for _, i := range []int{2, 3} {
+		helper.topic.handleMeta(&ClientComMessage{
+			Get: &MsgClientGet{
+				Id:          "id123",
+				Topic:       topicName,
+				MsgGetQuery: MsgGetQuery{What: "data", Data: &MsgGetOpts{}},
+			},
+			AsUser:   helper.uids[i].UserId(),
+			MetaWhat: constMsgMetaData,
+			sess:     helper.sessions[i],
+		})
+	}
+	helper.finish()
+
+	received := func(i int) []string {
+		var result []string
+		for _, msg := range helper.results[i].messages {
+			if m := msg.(*ServerComMessage); m.Data != nil {
+				result = append(result, m.Data.Content.(string))
+			}
+		}
+		return result
+	}
+	// Uid2 does not see the message scoped to uid1.
+	if got := received(2); !reflect.DeepEqual(got, []string{"all", "uid2"}) {
+		t.Errorf("Uid2: unexpected messages %v", got)
+	}
+	// Moderators see all messages.
+	if got := received(3); !reflect.DeepEqual(got, []string{"all", "uid1", "uid2"}) {
+		t.Errorf("Uid3: unexpected messages %v", got)
+	}
 }
@@ -0,0 +1,195 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Distributed tracing with OpenTelemetry. Every client message starts a
+ *    span when it's dispatched by the session. The context of the span is
+ *    carried with the message through the hub and the topic, where the store
+ *    queries and the push notifications are traced as child spans. Requests
+ *    forwarded to other cluster nodes carry the context in W3C Trace Context
+ *    format, so spans of the topic master join the trace of the originating
+ *    node. Spans are exported to an OpenTelemetry collector over OTLP/HTTP.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// Default name of the service reported with spans.
+	defaultTracingServiceName = "tinode"
+	// Time to wait for pending spans to be exported on shutdown.
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// Tracing config.
+type tracingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Address of the OTLP/HTTP collector, host:port.
+	Endpoint string `json:"endpoint"`
+	// Connect to the collector over HTTP instead of HTTPS.
+	Insecure bool `json:"insecure"`
+	// HTTP headers to send to the collector, e.g. authorization.
+	Headers map[string]string `json:"headers"`
+	// Name of the service reported with spans.
+	ServiceName string `json:"service_name"`
+	// Fraction of client messages to trace, 0..1. Messages from other nodes are traced if
+	// the originating node traced them.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Tracer of client messages, nil if tracing is disabled.
+var tracer trace.Tracer
+
+// Propagator of the trace context across cluster nodes.
+var tracePropagator = propagation.TraceContext{}
+
+// tracingInit configures the exporter of spans. Returns the function which flushes pending spans
+// and stops the exporter, nil if tracing is disabled.
+func tracingInit(config *tracingConfig, nodeName string) (func(), error) {
+	if config == nil || !config.Enabled {
+		return nil, nil
+	}
+	if config.Endpoint == "" {
+		return nil, errors.New("tracing: missing collector endpoint")
+	}
+	if config.SampleRatio <= 0 || config.SampleRatio > 1 {
+		return nil, errors.New("tracing: sample ratio must be in range (0, 1]")
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(currentVersion),
+	}
+	if nodeName != "" {
+		attrs = append(attrs, semconv.ServiceInstanceID(nodeName))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("github.com/tinode/chat/server")
+
+	logs.Info.Printf("Tracing enabled, exporting %g of messages to [%s]", config.SampleRatio, config.Endpoint)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logs.Warn.Println("tracing: failed to export pending spans", err)
+		}
+	}, nil
+}
+
+// traceStart starts a span as a child of the span in the context. Returns the context unchanged and
+// a no-op span if tracing is disabled.
+func traceStart(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if tracer == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// traceInject serializes the context of the span for sending to another node.
+// Returns nil if the message is not traced.
+func traceInject(ctx context.Context) map[string]string {
+	if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return carrier
+}
+
+// traceExtract restores the context of the span received from another node.
+func traceExtract(carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return nil
+	}
+	return tracePropagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+}
+
+// traceMsgName returns the name of the span of the client message, e.g. "pub" or "get".
+func traceMsgName(msg *ClientComMessage) string {
+	switch {
+	case msg.Pub != nil:
+		return "pub"
+	case msg.Sub != nil:
+		return "sub"
+	case msg.Leave != nil:
+		return "leave"
+	case msg.Hi != nil:
+		return "hi"
+	case msg.Login != nil:
+		return "login"
+	case msg.Get != nil:
+		return "get"
+	case msg.Set != nil:
+		return "set"
+	case msg.Del != nil:
+		return "del"
+	case msg.Acc != nil:
+		return "acc"
+	case msg.Note != nil:
+		return "note"
+	case msg.React != nil:
+		return "react"
+	case msg.Vote != nil:
+		return "vote"
+	case msg.Fwd != nil:
+		return "fwd"
+	case msg.Report != nil:
+		return "report"
+	case msg.Takeout != nil:
+		return "takeout"
+	}
+	return "unknown"
+}
+
+// traceMsgAttrs returns attributes of the span of the client message.
+func traceMsgAttrs(msg *ClientComMessage) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.String("tinode.topic", msg.Original)}
+	if msg.AsUser != "" {
+		attrs = append(attrs, attribute.String("tinode.user", msg.AsUser))
+	}
+	if msg.sess != nil {
+		attrs = append(attrs, attribute.String("tinode.sid", msg.sess.sid))
+	}
+	return attrs
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracePropagation(t *testing.T) {
+	// Tracing is disabled: spans are no-op, nothing is sent to other nodes.
+	ctx, span := traceStart(nil, "session.pub")
+	span.End()
+	if span.SpanContext().IsValid() || traceInject(ctx) != nil || traceExtract(nil) != nil {
+		t.Fatal("Expected no tracing when disabled")
+	}
+
+	tracer = sdktrace.NewTracerProvider().Tracer("test")
+	defer func() { tracer = nil }()
+
+	ctx, span = traceStart(nil, "session.pub", traceMsgAttrs(&ClientComMessage{Pub: &MsgClientPub{}, Original: "grpabc"})...)
+	defer span.End()
+	carrier := traceInject(ctx)
+	if carrier["traceparent"] == "" {
+		t.Fatalf("Missing traceparent: %v", carrier)
+	}
+
+	// Span at the other node is a child of the span at this node.
+	remote, child := traceStart(traceExtract(carrier), "topic.pub")
+	defer child.End()
+	parent := trace.SpanContextFromContext(ctx)
+	if sc := trace.SpanContextFromContext(remote); sc.TraceID() != parent.TraceID() || sc.SpanID() == parent.SpanID() {
+		t.Errorf("Span is not in the same trace: %v, %v", sc.TraceID(), parent.TraceID())
+	}
+}
@@ -0,0 +1,75 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Server-side transforms of message content applied on delivery.
+ *
+ *    Messages are persisted exactly as sent by the client. Transforms, such
+ *    as shortcode expansion, link previews or translations, are applied to
+ *    the copy being delivered, both live and when reading history. If the
+ *    transformed message exceeds the outbound size limit, the message is
+ *    delivered with as many transforms applied as fit, in the order of
+ *    registration, down to the original message as persisted.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// msgTransformFunc transforms message head and content for delivery. It must not modify its arguments
+// in place. The returned head and content replace the input. The topic is the name of the topic the
+// message belongs to.
+type msgTransformFunc func(topic string, head map[string]any, content any) (map[string]any, any, error)
+
+type msgTransform struct {
+	name string
+	fn   msgTransformFunc
+}
+
+// Registered transforms, applied in the order of registration.
+var msgTransforms []msgTransform
+
+// registerMsgTransform adds a transform to the delivery pipeline. Must be called at startup.
+func registerMsgTransform(name string, fn msgTransformFunc) {
+	msgTransforms = append(msgTransforms, msgTransform{name: name, fn: fn})
+}
+
+// deliverySize returns the size of the serialized message head and content.
+func deliverySize(head map[string]any, content any) int {
+	data, err := json.Marshal(&MsgServerData{Head: head, Content: content})
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// transformForDelivery applies registered transforms to the message head and content.
+// If a transform makes the message larger than the outbound limit, it and all subsequent
+// transforms are skipped. End-to-end encrypted messages are not transformed.
+func transformForDelivery(topic string, seq int, head map[string]any, content any) (map[string]any, any) {
+	if len(msgTransforms) == 0 || head[types.MsgHeadE2EE] == true {
+		return head, content
+	}
+
+	for _, tr := range msgTransforms {
+		newHead, newContent, err := tr.fn(topic, head, content)
+		if err != nil {
+			logs.Warn.Printf("topic[%s]: transform '%s' failed on seq %d: %s", topic, tr.name, seq, err)
+			continue
+		}
+		if globals.maxOutboundMessageSize > 0 {
+			if size := deliverySize(newHead, newContent); size > globals.maxOutboundMessageSize {
+				logs.Warn.Printf("topic[%s]: transform '%s' exceeded outbound size limit on seq %d (%d > %d), falling back",
+					topic, tr.name, seq, size, globals.maxOutboundMessageSize)
+				break
+			}
+		}
+		head, content = newHead, newContent
+	}
+	return head, content
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func setTestMsgTransforms(t *testing.T, maxSize int, transforms ...msgTransform) {
+	prevTransforms, prevSize := msgTransforms, globals.maxOutboundMessageSize
+	msgTransforms, globals.maxOutboundMessageSize = nil, maxSize
+	for _, tr := range transforms {
+		registerMsgTransform(tr.name, tr.fn)
+	}
+	t.Cleanup(func() {
+		msgTransforms, globals.maxOutboundMessageSize = prevTransforms, prevSize
+	})
+}
+
+// appendTransform appends the suffix to string content and records the name of the transform in the head.
+func appendTransform(name, suffix string) msgTransform {
+	return msgTransform{name: name, fn: func(topic string, head map[string]any, content any) (map[string]any, any, error) {
+		newHead := map[string]any{}
+		for k, v := range head {
+			newHead[k] = v
+		}
+		applied, _ := head["applied"].(string)
+		newHead["applied"] = applied + name
+		return newHead, content.(string) + suffix, nil
+	}}
+}
+
+func TestTransformForDelivery(t *testing.T) {
+	setTestMsgTransforms(t, 1024,
+		appendTransform("a", " a"),
+		msgTransform{name: "failing", fn: func(string, map[string]any, any) (map[string]any, any, error) {
+			return nil, nil, errors.New("failed")
+		}},
+		appendTransform("b", " b"))
+
+	head := map[string]any{"mime": "text/plain"}
+	newHead, content := transformForDelivery("grpTest", 1, head, "hello")
+	// The failing transform is skipped, subsequent transforms are applied.
+	if content != "hello a b" || newHead["applied"] != "ab" || newHead["mime"] != "text/plain" {
+		t.Errorf("Unexpected result: %v %v", newHead, content)
+	}
+	// The persisted message is not modified.
+	if !reflect.DeepEqual(head, map[string]any{"mime": "text/plain"}) {
+		t.Error("Original head modified", head)
+	}
+
+	// End-to-end encrypted messages are delivered as is.
+	head = map[string]any{types.MsgHeadE2EE: true}
+	if newHead, content = transformForDelivery("grpTest", 2, head, "ciphertext"); content != "ciphertext" ||
+		!reflect.DeepEqual(newHead, head) {
+		t.Errorf("Encrypted message transformed: %v %v", newHead, content)
+	}
+}
+
+func TestTransformForDeliverySizeLimit(t *testing.T) {
+	original := strings.Repeat("x", 100)
+	limit := deliverySize(nil, original+" a") + len(`"applied":"a"`) + 10
+	setTestMsgTransforms(t, limit,
+		appendTransform("a", " a"),
+		appendTransform("large", strings.Repeat("y", limit)),
+		appendTransform("b", " b"))
+
+	// The transform which exceeds the limit and all subsequent transforms are skipped.
+	head, content := transformForDelivery("grpTest", 1, nil, original)
+	if content != original+" a" || head["applied"] != "a" {
+		t.Errorf("Expected only the first transform applied, got %v %v", head, content)
+	}
+	if size := deliverySize(head, content); size > limit {
+		t.Errorf("Delivered message exceeds the limit: %d > %d", size, limit)
+	}
+
+	// Even the first transform does not fit: the original message is delivered.
+	head, content = transformForDelivery("grpTest", 2, nil, original+strings.Repeat("z", limit))
+	if content != original+strings.Repeat("z", limit) || head != nil {
+		t.Errorf("Expected the original message, got %v %v", head, content)
+	}
+
+	// Without a limit all transforms are applied.
+	globals.maxOutboundMessageSize = 0
+	if head, content = transformForDelivery("grpTest", 3, nil, original); head["applied"] != "alargeb" {
+		t.Errorf("Expected all transforms applied, got %v", head)
+	}
+}
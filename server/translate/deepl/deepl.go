@@ -0,0 +1,116 @@
+// Package deepl implements translation provider using DeepL API.
+package deepl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/tinode/chat/server/translate"
+)
+
+const (
+	providerName = "deepl"
+
+	defaultEndpoint = "https://api.deepl.com/v2/translate"
+	freeEndpoint    = "https://api-free.deepl.com/v2/translate"
+)
+
+type configType struct {
+	// Authentication key for DeepL API.
+	AuthKey string `json:"auth_key"`
+	// Use DeepL API Free endpoint.
+	Free bool `json:"free"`
+	// Endpoint of the API, optional. Overrides 'free'.
+	Endpoint string `json:"endpoint"`
+}
+
+type deeplProvider struct {
+	authKey  string
+	endpoint string
+	client   *http.Client
+}
+
+type request struct {
+	Text       []string `json:"text"`
+	TargetLang string   `json:"target_lang"`
+}
+
+type response struct {
+	Translations []struct {
+		DetectedSourceLanguage string `json:"detected_source_language"`
+		Text                   string `json:"text"`
+	} `json:"translations"`
+	Message string `json:"message"`
+}
+
+// Init initializes the provider.
+func (p *deeplProvider) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("deepl: failed to parse config: " + err.Error())
+	}
+	if config.AuthKey == "" {
+		return errors.New("deepl: missing auth key")
+	}
+
+	p.authKey = config.AuthKey
+	switch {
+	case config.Endpoint != "":
+		p.endpoint = config.Endpoint
+	case config.Free:
+		p.endpoint = freeEndpoint
+	default:
+		p.endpoint = defaultEndpoint
+	}
+	p.client = &http.Client{}
+	return nil
+}
+
+// Translate translates texts to the language.
+func (p *deeplProvider) Translate(ctx context.Context, texts []string, lang string) ([]translate.Translation, error) {
+	// DeepL uses upper case language codes, e.g. "PT-BR".
+	body, err := json.Marshal(&request{Text: texts, TargetLang: strings.ToUpper(lang)})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+p.authKey)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var result response
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Message != "" {
+			return nil, errors.New("deepl: " + result.Message)
+		}
+		return nil, errors.New("deepl: unexpected status " + resp.Status)
+	}
+
+	var result response
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.New("deepl: invalid response: " + err.Error())
+	}
+
+	translations := make([]translate.Translation, len(result.Translations))
+	for i, tr := range result.Translations {
+		translations[i] = translate.Translation{Text: tr.Text, Source: strings.ToLower(tr.DetectedSourceLanguage)}
+	}
+	return translations, nil
+}
+
+func init() {
+	translate.Register(providerName, &deeplProvider{})
+}
@@ -0,0 +1,111 @@
+// Package google implements translation provider using Google Cloud Translation API (v2).
+package google
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/tinode/chat/server/translate"
+)
+
+const (
+	providerName = "google"
+
+	defaultEndpoint = "https://translation.googleapis.com/language/translate/v2"
+)
+
+type configType struct {
+	// API key of the Google Cloud project.
+	APIKey string `json:"api_key"`
+	// Endpoint of the API, optional.
+	Endpoint string `json:"endpoint"`
+}
+
+type googleProvider struct {
+	apiKey   string
+	endpoint string
+	client   *http.Client
+}
+
+type request struct {
+	Q      []string `json:"q"`
+	Target string   `json:"target"`
+	Format string   `json:"format"`
+}
+
+type response struct {
+	Data struct {
+		Translations []struct {
+			TranslatedText         string `json:"translatedText"`
+			DetectedSourceLanguage string `json:"detectedSourceLanguage"`
+		} `json:"translations"`
+	} `json:"data"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Init initializes the provider.
+func (p *googleProvider) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("google: failed to parse config: " + err.Error())
+	}
+	if config.APIKey == "" {
+		return errors.New("google: missing API key")
+	}
+
+	p.apiKey = config.APIKey
+	p.endpoint = config.Endpoint
+	if p.endpoint == "" {
+		p.endpoint = defaultEndpoint
+	}
+	p.client = &http.Client{}
+	return nil
+}
+
+// Translate translates texts to the language.
+func (p *googleProvider) Translate(ctx context.Context, texts []string, lang string) ([]translate.Translation, error) {
+	body, err := json.Marshal(&request{Q: texts, Target: lang, Format: "text"})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		p.endpoint+"?key="+url.QueryEscape(p.apiKey), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result response
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.New("google: invalid response: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		if result.Error != nil {
+			return nil, errors.New("google: " + result.Error.Message)
+		}
+		return nil, errors.New("google: unexpected status " + resp.Status)
+	}
+
+	translations := make([]translate.Translation, len(result.Data.Translations))
+	for i, tr := range result.Data.Translations {
+		translations[i] = translate.Translation{Text: tr.TranslatedText, Source: tr.DetectedSourceLanguage}
+	}
+	return translations, nil
+}
+
+func init() {
+	translate.Register(providerName, &googleProvider{})
+}
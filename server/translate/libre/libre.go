@@ -0,0 +1,104 @@
+// Package libre implements translation provider using LibreTranslate API. The API is also
+// served by self-hosted translation models.
+package libre
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/tinode/chat/server/translate"
+)
+
+const providerName = "libre"
+
+type configType struct {
+	// URL of the translation endpoint, e.g. "http://localhost:5000/translate".
+	URL string `json:"url"`
+	// API key, optional.
+	APIKey string `json:"api_key"`
+}
+
+type libreProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+type request struct {
+	Q      []string `json:"q"`
+	Source string   `json:"source"`
+	Target string   `json:"target"`
+	Format string   `json:"format"`
+	APIKey string   `json:"api_key,omitempty"`
+}
+
+type response struct {
+	TranslatedText   []string `json:"translatedText"`
+	DetectedLanguage []struct {
+		Language string `json:"language"`
+	} `json:"detectedLanguage"`
+	Error string `json:"error"`
+}
+
+// Init initializes the provider.
+func (p *libreProvider) Init(jsonconf json.RawMessage) error {
+	var config configType
+	if err := json.Unmarshal(jsonconf, &config); err != nil {
+		return errors.New("libre: failed to parse config: " + err.Error())
+	}
+	if config.URL == "" {
+		return errors.New("libre: missing URL")
+	}
+
+	p.url = config.URL
+	p.apiKey = config.APIKey
+	p.client = &http.Client{}
+	return nil
+}
+
+// Translate translates texts to the language.
+func (p *libreProvider) Translate(ctx context.Context, texts []string, lang string) ([]translate.Translation, error) {
+	body, err := json.Marshal(&request{Q: texts, Source: "auto", Target: lang, Format: "text", APIKey: p.apiKey})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result response
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.New("libre: invalid response: " + err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		if result.Error != "" {
+			return nil, errors.New("libre: " + result.Error)
+		}
+		return nil, errors.New("libre: unexpected status " + resp.Status)
+	}
+
+	translations := make([]translate.Translation, len(result.TranslatedText))
+	for i, txt := range result.TranslatedText {
+		translations[i].Text = txt
+		if i < len(result.DetectedLanguage) {
+			translations[i].Source = result.DetectedLanguage[i].Language
+		}
+	}
+	return translations, nil
+}
+
+func init() {
+	translate.Register(providerName, &libreProvider{})
+}
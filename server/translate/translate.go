@@ -0,0 +1,140 @@
+// Package translate defines an interface which must be implemented by machine translation providers.
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+const (
+	// MaxTextLength is the maximum length of a text to translate in bytes. Longer texts are not translated.
+	MaxTextLength = 5000
+	// MaxBatchSize is the maximum number of texts translated in one request to the provider.
+	MaxBatchSize = 50
+
+	defaultTimeout = 10
+)
+
+// ErrNotConfigured is returned if no translation provider is enabled.
+var ErrNotConfigured = errors.New("translation provider not configured")
+
+// Translation is a translated text.
+type Translation struct {
+	// Translated text.
+	Text string
+	// Language of the original text as detected by the provider, if known.
+	Source string
+}
+
+// Provider is an interface which must be implemented by translation providers.
+type Provider interface {
+	// Init initializes the provider.
+	Init(jsonconf json.RawMessage) error
+
+	// Translate translates texts to the language given as a BCP 47 tag. Returns translations in
+	// the same order as the texts.
+	Translate(ctx context.Context, texts []string, lang string) ([]Translation, error)
+}
+
+type configType struct {
+	// Name of the provider to use. Translations are disabled if blank.
+	UseProvider string `json:"use_provider"`
+	// Timeout of one request to the provider (seconds).
+	Timeout int `json:"timeout"`
+	// Individual provider config params to pass to providers unchanged.
+	Providers map[string]json.RawMessage `json:"providers"`
+}
+
+var providers map[string]Provider
+
+// The provider in use.
+var provider Provider
+var timeout time.Duration
+
+// Register a translation provider.
+func Register(name string, p Provider) {
+	if providers == nil {
+		providers = make(map[string]Provider)
+	}
+
+	if p == nil {
+		panic("Register: translation provider is nil")
+	}
+	if _, dup := providers[name]; dup {
+		panic("Register: called twice for provider " + name)
+	}
+	providers[name] = p
+}
+
+// Init initializes the configured provider. Returns the name of the provider in use or an empty string
+// if translations are disabled.
+func Init(jsconfig json.RawMessage) (string, error) {
+	if len(jsconfig) == 0 {
+		return "", nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return "", errors.New("failed to parse config: " + err.Error())
+	}
+	if config.UseProvider == "" {
+		return "", nil
+	}
+
+	p := providers[config.UseProvider]
+	if p == nil {
+		return "", errors.New("unknown translation provider '" + config.UseProvider + "'")
+	}
+	if err := p.Init(config.Providers[config.UseProvider]); err != nil {
+		return "", err
+	}
+
+	provider = p
+	timeout = time.Second * time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = time.Second * defaultTimeout
+	}
+	return config.UseProvider, nil
+}
+
+// IsEnabled checks if a translation provider is configured.
+func IsEnabled() bool {
+	return provider != nil
+}
+
+// Translate translates texts to the language using the configured provider.
+func Translate(texts []string, lang string) ([]Translation, error) {
+	if provider == nil {
+		return nil, ErrNotConfigured
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := make([]Translation, 0, len(texts))
+	for start := 0; start < len(texts); start += MaxBatchSize {
+		batch := texts[start:min(start+MaxBatchSize, len(texts))]
+		translated, err := provider.Translate(ctx, batch, lang)
+		if err != nil {
+			return nil, err
+		}
+		if len(translated) != len(batch) {
+			return nil, errors.New("provider returned unexpected number of translations")
+		}
+		result = append(result, translated...)
+	}
+	return result, nil
+}
+
+// NormalizeLang validates the BCP 47 language tag and returns it in canonical form, e.g. "pt-BR".
+func NormalizeLang(lang string) (string, error) {
+	tag, err := language.Parse(lang)
+	if err != nil || tag == language.Und {
+		return "", errors.New("invalid language tag")
+	}
+	return tag.String(), nil
+}
@@ -0,0 +1,81 @@
+package translate
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testProvider returns texts in upper case and counts requests.
+type testProvider struct {
+	requests int
+}
+
+func (p *testProvider) Init(jsonconf json.RawMessage) error {
+	return nil
+}
+
+func (p *testProvider) Translate(ctx context.Context, texts []string, lang string) ([]Translation, error) {
+	p.requests++
+	result := make([]Translation, len(texts))
+	for i, text := range texts {
+		result[i] = Translation{Text: strings.ToUpper(text), Source: "en"}
+	}
+	return result, nil
+}
+
+func TestNormalizeLang(t *testing.T) {
+	cases := map[string]string{
+		"es":    "es",
+		"pt-br": "pt-BR",
+		"zh_TW": "zh-TW",
+		"":      "",
+		"und":   "",
+		"1234":  "",
+	}
+	for in, expect := range cases {
+		got, err := NormalizeLang(in)
+		if got != expect || (expect == "") != (err != nil) {
+			t.Errorf("NormalizeLang(%s): expected '%s', got '%s', %v", in, expect, got, err)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	if _, err := Translate([]string{"hello"}, "es"); err != ErrNotConfigured {
+		t.Errorf("Expected ErrNotConfigured, got %v", err)
+	}
+
+	p := &testProvider{}
+	providers = map[string]Provider{"test": p}
+	defer func() {
+		providers = nil
+		provider = nil
+	}()
+	if name, err := Init(json.RawMessage(`{"use_provider":"test"}`)); err != nil || name != "test" {
+		t.Fatalf("Init failed: %s, %v", name, err)
+	}
+	if !IsEnabled() {
+		t.Fatal("Provider is expected to be enabled")
+	}
+
+	texts := make([]string, MaxBatchSize+1)
+	for i := range texts {
+		texts[i] = "text"
+	}
+	result, err := Translate(texts, "es")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != len(texts) || result[MaxBatchSize].Text != "TEXT" {
+		t.Errorf("Unexpected translations %+v", result)
+	}
+	if p.requests != 2 {
+		t.Errorf("Expected 2 requests to the provider, got %d", p.requests)
+	}
+
+	if _, err := Init(json.RawMessage(`{"use_provider":"missing"}`)); err == nil {
+		t.Error("Unknown provider is expected to fail")
+	}
+}
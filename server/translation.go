@@ -0,0 +1,118 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Machine translation of messages on demand. {get what="data"
+ *    data={since:..., translate:"es"}} delivers messages with translations
+ *    of their text. Translations are made by the configured provider and
+ *    cached in the store per message and language. Cached translations are
+ *    delivered immediately. If some messages have to be translated, the
+ *    messages are delivered once the provider responds, so the topic is not
+ *    blocked while waiting.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/translate"
+)
+
+// pendingTranslation is the text of a message which is not translated yet.
+type pendingTranslation struct {
+	seqId int
+	text  string
+}
+
+// messageText returns the text of the message to translate or an empty string if the message
+// cannot be translated.
+func messageText(msg *types.Message) string {
+	if msg.DeletedAt != nil || msg.Head["webrtc"] != nil || msg.Head["unsent"] == true || msg.IsOpaque() {
+		return ""
+	}
+
+	// Formatting of Drafty documents cannot be carried over to the translation.
+	text := messageContentText(msg.Head, msg.Content)
+	if strings.TrimSpace(text) == "" || len(text) > translate.MaxTextLength {
+		return ""
+	}
+	return text
+}
+
+// translationsForDelivery returns cached translations of the messages keyed by message ID, and texts of
+// messages which are not translated yet. Errors are logged and not reported: messages are delivered without
+// translations.
+func translationsForDelivery(topic, lang string, messages []types.Message) (map[int]*MsgTranslation, []pendingTranslation) {
+	texts := map[int]string{}
+	var seqIds []int
+	for i := range messages {
+		if text := messageText(&messages[i]); text != "" {
+			texts[messages[i].SeqId] = text
+			seqIds = append(seqIds, messages[i].SeqId)
+		}
+	}
+	if len(seqIds) == 0 {
+		return nil, nil
+	}
+
+	cached, err := store.Translations.GetAll(topic, lang, seqIds)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to load translations: %v", topic, err)
+		return nil, nil
+	}
+
+	result := make(map[int]*MsgTranslation, len(cached))
+	for _, tr := range cached {
+		if text, ok := tr.Content.(string); ok {
+			result[tr.SeqId] = &MsgTranslation{Lang: lang, Src: tr.Src, Txt: text}
+		}
+	}
+
+	var pending []pendingTranslation
+	for _, seqId := range seqIds {
+		if result[seqId] == nil {
+			pending = append(pending, pendingTranslation{seqId: seqId, text: texts[seqId]})
+		}
+	}
+	return result, pending
+}
+
+// translatePending translates texts of the messages with the configured provider, caches the translations
+// and attaches them to the outgoing {data} messages. Called outside of the topic's goroutine.
+func translatePending(topic, lang string, pending []pendingTranslation, outgoing []*ServerComMessage) {
+	texts := make([]string, len(pending))
+	for i := range pending {
+		texts[i] = pending[i].text
+	}
+
+	translated, err := translate.Translate(texts, lang)
+	if err != nil {
+		logs.Warn.Printf("topic[%s]: failed to translate messages to '%s': %v", topic, lang, err)
+		return
+	}
+
+	result := make(map[int]*MsgTranslation, len(pending))
+	toCache := make([]types.Translation, len(pending))
+	for i := range pending {
+		result[pending[i].seqId] = &MsgTranslation{Lang: lang, Src: translated[i].Source, Txt: translated[i].Text}
+		toCache[i] = types.Translation{
+			SeqId:   pending[i].seqId,
+			Lang:    lang,
+			Src:     translated[i].Source,
+			Content: translated[i].Text,
+		}
+	}
+	if err = store.Translations.Save(topic, toCache); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to cache translations: %v", topic, err)
+	}
+
+	for _, msg := range outgoing {
+		if tr := result[msg.Data.SeqId]; tr != nil {
+			msg.Data.Translation = tr
+		}
+	}
+}
@@ -0,0 +1,133 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Time-limited TURN credentials. Instead of sharing static TURN passwords
+ *    with clients, the server mints credentials for authenticated users using
+ *    the TURN REST API scheme supported by coturn ('use-auth-secret'): the
+ *    username is the expiration time and the user ID, the password is the
+ *    HMAC-SHA1 of the username keyed with the secret shared with the TURN
+ *    server. Clients fetch credentials from the /v0/turn endpoint before
+ *    making a call.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Default lifetime of TURN credentials, seconds.
+	defaultTurnTTL = 86400
+)
+
+// TURN credentials config.
+type turnConfig struct {
+	// Secret shared with the TURN server, same as 'static-auth-secret' of coturn.
+	Secret string `json:"secret"`
+	// Lifetime of credentials, seconds.
+	TTL int `json:"ttl"`
+	// URLs of TURN servers which accept the credentials.
+	Urls []string `json:"urls"`
+}
+
+// turnCredentials mints TURN credentials.
+type turnCredentials struct {
+	secret []byte
+	ttl    time.Duration
+	urls   []string
+}
+
+func newTurnCredentials(conf *turnConfig) (*turnCredentials, error) {
+	if conf.Secret == "" {
+		return nil, errors.New("missing TURN secret")
+	}
+	if len(conf.Urls) == 0 {
+		return nil, errors.New("missing TURN server URLs")
+	}
+	ttl := conf.TTL
+	if ttl <= 0 {
+		ttl = defaultTurnTTL
+	}
+	return &turnCredentials{
+		secret: []byte(conf.Secret),
+		ttl:    time.Duration(ttl) * time.Second,
+		urls:   conf.Urls,
+	}, nil
+}
+
+// mint creates credentials for the user valid until the returned time.
+func (tc *turnCredentials) mint(uid types.Uid, now time.Time) (iceServer, time.Time) {
+	expires := now.Add(tc.ttl).Truncate(time.Second)
+	username := strconv.FormatInt(expires.Unix(), 10) + ":" + uid.UserId()
+	mac := hmac.New(sha1.New, tc.secret)
+	mac.Write([]byte(username))
+	return iceServer{
+		Username:   username,
+		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		Urls:       tc.urls,
+	}, expires
+}
+
+// serveTurnCredentials responds with ICE servers which include TURN credentials minted for the
+// authenticated user.
+func serveTurnCredentials(wrt http.ResponseWriter, req *http.Request) {
+	now := types.TimeNow()
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		// Credentials must not be cached.
+		wrt.Header().Set("Cache-Control", "no-store")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+		if err != nil {
+			logs.Warn.Println("turn:", err)
+		}
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), errors.New("method '"+req.Method+"' not allowed"))
+		return
+	}
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), errors.New("invalid or missing API key"))
+		return
+	}
+
+	authMethod, secret := getHttpAuth(req)
+	uid, challenge, err := authFileRequest(authMethod, secret, req.FormValue("sid"), getRemoteAddr(req))
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now, now), errors.New("user not authenticated"))
+		return
+	}
+
+	turn, expires := globals.turn.mint(uid, now)
+	servers := make([]iceServer, 0, len(globals.iceServers)+1)
+	servers = append(servers, globals.iceServers...)
+	servers = append(servers, turn)
+	writeHttpResponse(NoErrParams("", "", now, map[string]any{
+		"iceServers": servers,
+		"expires":    expires,
+	}), nil)
+}
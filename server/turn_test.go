@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestTurnCredentials(t *testing.T) {
+	if _, err := newTurnCredentials(&turnConfig{Urls: []string{"turn:turn.example.com"}}); err == nil {
+		t.Error("Expected error for missing secret")
+	}
+
+	tc, err := newTurnCredentials(&turnConfig{Secret: "north", TTL: 600, Urls: []string{"turn:turn.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid := types.Uid(1)
+	now := time.Unix(1700000000, 500)
+	srv, expires := tc.mint(uid, now)
+	if !expires.Equal(time.Unix(1700000600, 0)) {
+		t.Errorf("Unexpected expiration %s", expires)
+	}
+	if srv.Username != "1700000600:"+uid.UserId() || len(srv.Urls) != 1 {
+		t.Errorf("Unexpected username %+v", srv)
+	}
+	// Base64 of HMAC-SHA1 of the username with the key "north".
+	if srv.Credential != "yfG8+FbDls/x73+Nx1ItWWi6lqs=" {
+		t.Errorf("Unexpected credential %q", srv.Credential)
+	}
+	if other, _ := tc.mint(types.Uid(2), now); other.Credential == srv.Credential {
+		t.Error("Credentials of different users must differ")
+	}
+}
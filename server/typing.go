@@ -0,0 +1,74 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Rate limiting and aggregation of typing notifications {note what="kp"}.
+ *    Notifications sent by a session more often than configured are dropped.
+ *    In large group topics typing notifications are not forwarded one by one:
+ *    users typing during the aggregation window are counted and reported
+ *    once per window as {info what="typing" count=N}.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// typingRateLimited checks if the session sends typing notifications too often.
+// Records the time of the notification if it's accepted.
+func (t *Topic) typingRateLimited(sess *Session) bool {
+	if globals.typingMinInterval == 0 || sess == nil || sess.isMultiplex() {
+		// Multiplexing sessions carry notifications of many users and cannot be limited as a whole.
+		return false
+	}
+	pssd, ok := t.sessions[sess]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(pssd.typingAt) < globals.typingMinInterval {
+		return true
+	}
+	pssd.typingAt = now
+	t.sessions[sess] = pssd
+	return false
+}
+
+// typingAggregated checks if typing notifications in the topic are aggregated.
+func (t *Topic) typingAggregated() bool {
+	return t.cat == types.TopicCatGrp && globals.typingWindow > 0 && t.subsCount() > globals.typingAggregateOver
+}
+
+// aggregateTyping records that the user is typing. Typing users are reported when the window ends.
+func (t *Topic) aggregateTyping(uid types.Uid) {
+	if len(t.typing) == 0 {
+		// The first notification opens the window.
+		t.typingTimer.Reset(globals.typingWindow)
+	}
+	if t.typing == nil {
+		t.typing = make(map[types.Uid]bool)
+	}
+	t.typing[uid] = true
+}
+
+// flushTyping informs topic subscribers about the number of users who were typing during the window.
+func (t *Topic) flushTyping() {
+	if len(t.typing) == 0 {
+		return
+	}
+	count := len(t.typing)
+	clear(t.typing)
+
+	t.broadcastToSessions(&ServerComMessage{
+		Info: &MsgServerInfo{
+			Topic: t.xoriginal,
+			What:  "typing",
+			Count: count,
+		},
+		RcptTo:    t.name,
+		Timestamp: types.TimeNow(),
+	})
+}
@@ -0,0 +1,84 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Unread counts across topics. {get topic="me" what="unread"} returns the
+ *    numbers of unread messages and of unread mentions in every topic of the
+ *    user with unread messages in one call. The counts are kept up to date by
+ *    {pres what="msg"} on 'me' which reports the new number of unread messages
+ *    in the topic and whether the message mentions the user, and by
+ *    {pres what="read"} which reports the numbers left after the user has read
+ *    messages in another session.
+ *
+ *    Topics of communities report the community as 'parent'. Every community
+ *    is followed by an entry with the total counts of its topics.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// replyGetUnread returns the numbers of unread messages and mentions in topics of the user.
+func (t *Topic) replyGetUnread(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for unread counts")
+	}
+
+	counts, err := store.Users.GetUnreadByTopic(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	result := make([]MsgTopicUnread, 0, len(counts))
+	// Totals of communities in the order of appearance.
+	var communities []string
+	totals := make(map[string]*MsgTopicUnread)
+	for i := range counts {
+		tu := &counts[i]
+		topic := tu.Topic
+		if types.GetTopicCat(topic) == types.TopicCatP2P {
+			// The user sees P2P topics as IDs of the other users.
+			if topic, err = types.P2PNameForUser(asUid, topic); err != nil {
+				continue
+			}
+		}
+		result = append(result, MsgTopicUnread{Topic: topic, Parent: tu.Parent, Unread: tu.Unread, Mentions: tu.Mentions})
+		if tu.Parent != "" {
+			total := totals[tu.Parent]
+			if total == nil {
+				total = &MsgTopicUnread{Topic: tu.Parent}
+				totals[tu.Parent] = total
+				communities = append(communities, tu.Parent)
+			}
+			total.Unread += tu.Unread
+			total.Mentions += tu.Mentions
+		}
+	}
+	for _, community := range communities {
+		result = append(result, *totals[community])
+	}
+
+	if len(result) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "unread"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Unread:    result,
+		},
+	})
+	return nil
+}
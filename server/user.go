@@ -2,6 +2,7 @@ package main
 
 import (
 	"container/heap"
+	"errors"
 	"math/rand"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 	"github.com/tinode/chat/server/auth"
 	"github.com/tinode/chat/server/logs"
 	"github.com/tinode/chat/server/push"
+	"github.com/tinode/chat/server/regguard"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 )
@@ -40,6 +42,13 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		return
 	}
 
+	// New accounts belong to the tenant of the session.
+	if !tenantAuthAllowed(s.tenant, msg.Acc.Scheme) {
+		s.queueOut(ErrPermissionDenied(msg.Id, "", msg.Timestamp))
+		logs.Warn.Println("create user: auth scheme not allowed in tenant", s.tenant, "sid=", s.sid)
+		return
+	}
+
 	// Check if login is unique and compliance with the policy (not too long or too short).
 	if ok, err := authhdl.IsUnique(msg.Acc.Secret, s.remoteAddr); !ok {
 		logs.Warn.Println("create user: auth secret is not compliant", err, "sid=", s.sid)
@@ -48,7 +57,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		return
 	}
 
-	var user types.User
+	user := types.User{Tenant: s.tenant}
 	var private any
 
 	// If account state is being assigned, make sure the sender is a root user.
@@ -96,6 +105,30 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 		}
 	}
 
+	// Registration guards: CAPTCHA, limits of registrations per IP address, etc. Root can create accounts freely.
+	if auth.Level(msg.AuthLvl) != auth.LevelRoot {
+		req := &regguard.Request{RemoteAddr: s.remoteAddr}
+		for _, cr := range msg.Acc.Cred {
+			if cr.Method == "captcha" {
+				req.Captcha = cr.Response
+			}
+		}
+		for i := range creds {
+			req.Creds = append(req.Creds, regguard.Cred{Method: creds[i].Method, Value: creds[i].Value})
+		}
+		if guard, err := regguard.Check(req); err != nil {
+			logs.Warn.Println("create user: registration refused by", guard, err, "sid=", s.sid)
+			if errors.Is(err, regguard.ErrRejected) {
+				resp := ErrPolicyReply(msg, msg.Timestamp)
+				resp.Ctrl.Params = map[string]any{"what": guard}
+				s.queueOut(resp)
+			} else {
+				s.queueOut(ErrUnknownReply(msg, msg.Timestamp))
+			}
+			return
+		}
+	}
+
 	// Assign default access values in case the acc creator has not provided them
 	user.Access.Auth = getDefaultAccess(types.TopicCatP2P, true, false) |
 		getDefaultAccess(types.TopicCatGrp, true, false)
@@ -193,7 +226,7 @@ func replyCreateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	if msg.Acc.Login {
 		// Process user's login request.
 		_, missing, _ := stringSliceDelta(globals.authValidators[rec.AuthLevel], validated)
-		reply = s.onLogin(msg.Id, msg.Timestamp, rec, missing)
+		reply = s.onLogin(msg.Id, msg.Timestamp, msg.Acc.Scheme, rec, missing)
 	} else {
 		// Not using the new account for logging in.
 		reply = NoErrCreated(msg.Id, "", msg.Timestamp)
@@ -280,8 +313,15 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	}
 
 	var params map[string]any
-	if msg.Acc.Scheme != "" {
-		err = updateUserAuth(msg, user, rec, s.remoteAddr)
+	if msg.Acc.Auth != nil {
+		if rec != nil {
+			// Temporary authentication, e.g. for resetting the password, cannot change login methods.
+			err = types.ErrPermissionDenied
+		} else {
+			params, err = updateLoginMethods(s, user, msg.Acc.Auth)
+		}
+	} else if msg.Acc.Scheme != "" {
+		params, err = updateUserAuth(msg, user, rec, s.remoteAddr)
 	} else if len(msg.Acc.Cred) > 0 {
 		if authLvl == auth.LevelNone {
 			// msg.Acc.AuthLevel contains invalid data.
@@ -332,8 +372,8 @@ func replyUpdateUser(s *Session, msg *ClientComMessage, rec *auth.Rec) {
 	pluginAccount(user, plgActUpd)
 }
 
-// Authentication update
-func updateUserAuth(msg *ClientComMessage, user *types.User, _ *auth.Rec, remoteAddr string) error {
+// Authentication update. Returns authenticator-specific parameters for the client, if any.
+func updateUserAuth(msg *ClientComMessage, user *types.User, _ *auth.Rec, remoteAddr string) (map[string]any, error) {
 	authhdl := store.Store.GetLogicalAuthHandler(msg.Acc.Scheme)
 	if authhdl != nil {
 		// Request to update auth of an existing account. Only basic & rest auth are currently supported
@@ -342,7 +382,12 @@ func updateUserAuth(msg *ClientComMessage, user *types.User, _ *auth.Rec, remote
 
 		rec, err := authhdl.UpdateRecord(&auth.Rec{Uid: user.Uid(), Tags: user.Tags}, msg.Acc.Secret, remoteAddr)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		// Credentials changed: revoke reconnection and refresh tokens so a stolen token cannot be used anymore.
+		if err := revokeUserTokens(user.Uid(), false); err != nil {
+			logs.Warn.Println("updateUserAuth failed to revoke tokens:", err)
 		}
 
 		// Tags may have been changed by authhdl.UpdateRecord, reset them.
@@ -350,11 +395,11 @@ func updateUserAuth(msg *ClientComMessage, user *types.User, _ *auth.Rec, remote
 		if _, err = store.Users.UpdateTags(user.Uid(), nil, nil, rec.Tags); err != nil {
 			logs.Warn.Println("updateUserAuth tags update failed:", err)
 		}
-		return nil
+		return rec.Params, nil
 	}
 
 	// Invalid or unknown auth scheme
-	return types.ErrMalformed
+	return nil, types.ErrMalformed
 }
 
 // addCreds adds new credentials and re-send validation request for existing ones.
@@ -560,6 +605,12 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 		return false, types.ErrMalformed
 	}
 
+	return setUserState(uid, user, state)
+}
+
+// setUserState changes the state of the user account, e.g. suspends it, and terminates sessions of the
+// suspended user. Returns false if the state is unchanged.
+func setUserState(uid types.Uid, user *types.User, state types.ObjState) (bool, error) {
 	// State unchanged.
 	if user.State == state {
 		return false, nil
@@ -570,8 +621,7 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 		globals.sessionStore.EvictUser(uid, "")
 	}
 
-	err = store.Users.UpdateState(uid, state)
-	if err != nil {
+	if err := store.Users.UpdateState(uid, state); err != nil {
 		return false, err
 	}
 
@@ -579,7 +629,7 @@ func changeUserState(s *Session, uid types.Uid, user *types.User, msg *ClientCom
 	globals.hub.userStatus <- &userStatusReq{forUser: uid, state: state}
 	user.State = state
 
-	return true, err
+	return true, nil
 }
 
 // Request to delete a user:
@@ -617,6 +667,50 @@ func replyDelUser(s *Session, msg *ClientComMessage) {
 		return
 	}
 
+	erase := msg.Del.Hard && globals.eraseDeletedAccounts
+	if _, err := deleteUser(uid, msg.Del.Hard, erase, s.sid); err != nil {
+		if errors.Is(err, types.ErrUnsupported) {
+			// Authenticator refused to delete record: user account cannot be deleted.
+			s.queueOut(ErrOperationNotAllowed(msg.Id, "", msg.Timestamp))
+		} else {
+			s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
+		}
+		return
+	}
+
+	details := "soft"
+	if erase {
+		details = "erase"
+	} else if msg.Del.Hard {
+		details = "hard"
+	}
+	auditLog(&types.AuditRecord{
+		Event:      types.AuditAccountDelete,
+		Actor:      s.uid.UserId(),
+		Target:     uid.UserId(),
+		RemoteAddr: s.remoteAddr,
+		Details:    details,
+	})
+
+	s.queueOut(NoErr(msg.Id, "", msg.Timestamp))
+
+	if s.uid == uid && s.multi == nil {
+		// Evict the current session if it belongs to the deleted user.
+		// No need to send it to multiplexing session: remote node will be notified separately.
+		_, data := s.serialize(NoErrEvicted("", "", msg.Timestamp))
+		s.stopSession(data)
+	}
+}
+
+// deleteUser deletes the user account, terminates user's sessions except skipSid and stops user's topics.
+// If erase is true, the account is hard-deleted together with all data derived from the user: content
+// of user's messages in other users' topics, reactions, files, reports, references in logs.
+// Returns the count of erased records if erase is true.
+func deleteUser(uid types.Uid, hard, erase bool, skipSid string) (types.ErasureReport, error) {
+	if erase {
+		hard = true
+	}
+
 	// Disable all authenticators
 	authnames := store.Store.GetAuthNames()
 	for _, name := range authnames {
@@ -626,62 +720,78 @@ func replyDelUser(s *Session, msg *ClientComMessage) {
 		}
 		if err := hdl.DelRecords(uid); err != nil {
 			// This could be completely benign, i.e. authenticator exists but not used.
-			logs.Warn.Println("replyDelUser: failed to delete auth record", uid.UserId(), name, err, s.sid)
+			logs.Warn.Println("deleteUser: failed to delete auth record", uid.UserId(), name, err, skipSid)
 			if storeErr, ok := err.(types.StoreError); ok && storeErr == types.ErrUnsupported {
 				// Authenticator refused to delete record: user account cannot be deleted.
-				s.queueOut(ErrOperationNotAllowed(msg.Id, "", msg.Timestamp))
-				return
+				return nil, err
+			}
+		}
+	}
+
+	if erase {
+		// Unsubscribe user's devices from push notifications before the devices are deleted.
+		if devices, _, err := store.Devices.GetAll(uid); err == nil {
+			for _, dev := range devices[uid] {
+				userChannelsSubUnsub(uid, dev.DeviceId, false)
 			}
+		} else {
+			logs.Warn.Println("deleteUser: failed to get devices", uid.UserId(), err, skipSid)
 		}
 	}
 
 	// Terminate all sessions. Skip the current session so the requester gets a response.
-	globals.sessionStore.EvictUser(uid, s.sid)
+	globals.sessionStore.EvictUser(uid, skipSid)
 	// Remove user from cache and announce to cluster that the user is deleted.
-	usersRemoveUser(uid)
+	usersRemoveUser(uid, erase)
+
+	// Pass topics owned by the user to other owners or admins.
+	promoteOwners(uid, skipSid)
 
 	// Stop topics where the user is the owner and p2p topics.
 	done := make(chan bool)
-	globals.hub.unreg <- &topicUnreg{forUser: uid, del: msg.Del.Hard, done: done}
+	globals.hub.unreg <- &topicUnreg{forUser: uid, del: hard, erase: erase, done: done}
 	<-done
 
 	// Notify users of interest that the user is gone.
 	if uoi, err := store.Users.GetSubs(uid); err == nil {
 		presUsersOfInterestOffline(uid, uoi, "gone")
 	} else {
-		logs.Warn.Println("replyDelUser: failed to send notifications to users", err, s.sid)
+		logs.Warn.Println("deleteUser: failed to send notifications to users", err, skipSid)
 	}
 
 	// Notify subscribers of the group topics where the user was the owner that the topics were deleted.
 	if ownTopics, err := store.Users.GetOwnTopics(uid); err == nil {
 		for _, topicName := range ownTopics {
 			if subs, err := store.Topics.GetSubs(topicName, nil); err == nil {
-				presSubsOfflineOffline(topicName, types.TopicCatGrp, subs, "gone", &presParams{}, s.sid)
+				presSubsOfflineOffline(topicName, types.TopicCatGrp, subs, "gone", &presParams{}, skipSid)
 			} else {
-				logs.Warn.Println("replyDelUser: failed to notify topic subscribers", err, topicName, s.sid)
+				logs.Warn.Println("deleteUser: failed to notify topic subscribers", err, topicName, skipSid)
 			}
 		}
 	} else {
-		logs.Warn.Println("replyDelUser: failed to send notifications to owned topics", err, s.sid)
+		logs.Warn.Println("deleteUser: failed to send notifications to owned topics", err, skipSid)
 	}
 
 	// TODO: suspend all P2P topics with the user.
 
-	// Delete user's records from the database.
-	if err := store.Users.Delete(uid, msg.Del.Hard); err != nil {
-		logs.Warn.Println("replyDelUser: failed to delete user", err, s.sid)
-		s.queueOut(decodeStoreError(err, msg.Id, msg.Timestamp, nil))
-		return
+	var report types.ErasureReport
+	if erase {
+		// Erase user's data which is not removed with the account.
+		var err error
+		if report, err = store.Users.Erase(uid, false); err != nil {
+			logs.Warn.Println("deleteUser: failed to erase user's data", err, skipSid)
+			return nil, err
+		}
 	}
 
-	s.queueOut(NoErr(msg.Id, "", msg.Timestamp))
-
-	if s.uid == uid && s.multi == nil {
-		// Evict the current session if it belongs to the deleted user.
-		// No need to send it to multiplexing session: remote node will be notified separately.
-		_, data := s.serialize(NoErrEvicted("", "", msg.Timestamp))
-		s.stopSession(data)
+	// Delete user's records from the database.
+	if err := store.Users.Delete(uid, hard); err != nil {
+		logs.Warn.Println("deleteUser: failed to delete user", err, skipSid)
+		return nil, err
 	}
+	exportAccountDeleted(uid)
+
+	return report, nil
 }
 
 // Read user's state from DB.
@@ -723,6 +833,13 @@ type UserCacheReq struct {
 	Inc bool
 	// User is being deleted, remove user from cache.
 	Gone bool
+	// User's data is being erased, unload topics with the user (Gone is set).
+	Erase bool
+	// IDs of user's sessions to terminate.
+	Evict []string
+	// Terminate all user's sessions except the one with ID SkipSid.
+	EvictAll bool
+	SkipSid  string
 
 	// Optional push notification
 	PushRcpt *push.Receipt
@@ -846,12 +963,12 @@ func usersRegisterUser(uid types.Uid, add bool) {
 }
 
 // Stop tracking user and remove him from cache.
-func usersRemoveUser(uid types.Uid) {
+func usersRemoveUser(uid types.Uid, erase bool) {
 	if globals.usersUpdate == nil {
 		return
 	}
 
-	upd := &UserCacheReq{UserId: uid, Gone: true}
+	upd := &UserCacheReq{UserId: uid, Gone: true, Erase: erase}
 	if !globals.cluster.isRemoteTopic(uid.UserId()) {
 		select {
 		case globals.usersUpdate <- upd:
@@ -1052,6 +1169,7 @@ func userUpdater() {
 						rcpt.To[uid] = rcptTo
 					}
 				}
+				meterPushes(rcpt)
 				push.Push(rcpt)
 			}
 		case upd := <-globals.usersUpdate:
@@ -1098,6 +1216,7 @@ func userUpdater() {
 
 				if len(pendingUsers) == 0 {
 					// All data present in memory. Just send the push.
+					meterPushes(upd.PushRcpt)
 					push.Push(upd.PushRcpt)
 				} else {
 					// We are waiting for IO. Add this receipt to the queues.
@@ -1185,6 +1304,8 @@ func garbageCollectUsers(period time.Duration, blockSize, minAccountAgeHours int
 						for _, uid := range uids {
 							if err = store.Users.Delete(uid, true); err != nil {
 								logs.Warn.Printf("Stale account GC failed to delete %s: %+v", uid.UserId(), err)
+							} else {
+								exportAccountDeleted(uid)
 							}
 						}
 					}
@@ -0,0 +1,320 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Records of sessions where users logged in. A record is saved when the
+ *    session logs in and updated when the session ends, so it survives the
+ *    session. Users list their sessions with {get what="sess"} on 'me' and
+ *    revoke them with {del what="sess" sess="ID"}, or all sessions except
+ *    the current one with sess="*". Revoked sessions are terminated on all
+ *    cluster nodes, their reconnection tokens are revoked. A hard delete of
+ *    all sessions logs the user out everywhere: all tokens of the user are
+ *    revoked.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/auth/resume"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// saveSessionRecord saves the record of the session which has just logged in. The record replaces records
+// of earlier sessions of the same device or resumed with the same reconnection token. Records of inactive
+// sessions and the least recently active ones over the limit are deleted.
+func (s *Session) saveSessionRecord(now time.Time) {
+	if globals.sessRecordMaxIdle == 0 {
+		return
+	}
+
+	records, err := store.Sessions.GetAll(s.uid)
+	if err != nil {
+		logs.Warn.Println("s.saveSessionRecord: failed to load records", err, s.sid)
+		return
+	}
+
+	rec := &types.SessionRecord{
+		Id:         s.sid,
+		User:       s.uid.String(),
+		CreatedAt:  now,
+		LastSeen:   now,
+		RemoteAddr: s.remoteAddr,
+		UserAgent:  s.userAgent,
+		Platform:   s.platf,
+		DeviceId:   s.deviceID,
+		Resume:     s.resumeToken,
+	}
+
+	expire := now.Add(-globals.sessRecordMaxIdle)
+	// The new record counts towards the limit.
+	count := 1
+	for i := range records {
+		old := &records[i]
+		if old.Id == rec.Id {
+			continue
+		}
+		replaced := (old.DeviceId != "" && old.DeviceId == rec.DeviceId) ||
+			(old.Resume != "" && old.Resume == rec.Resume)
+		if replaced && old.Resume != "" && old.Resume == rec.Resume {
+			// The same session resumed on a new connection.
+			rec.CreatedAt = old.CreatedAt
+		}
+		if !replaced && !old.LastSeen.Before(expire) && count < globals.sessRecordMaxCount {
+			count++
+			continue
+		}
+		if _, err := store.Sessions.Delete(s.uid, old.Id); err != nil {
+			logs.Warn.Println("s.saveSessionRecord: failed to delete record", err, s.sid)
+			continue
+		}
+		if old.Resume != rec.Resume {
+			// The reconnection token of the deleted record cannot be revoked by the user anymore.
+			revokeResumeToken(old.Resume)
+		}
+	}
+
+	if err := store.Sessions.Upsert(rec); err != nil {
+		logs.Warn.Println("s.saveSessionRecord: failed to save record", err, s.sid)
+	}
+}
+
+// touchSessionRecord updates the time when the session was last active.
+func (s *Session) touchSessionRecord() {
+	if globals.sessRecordMaxIdle == 0 || s.uid.IsZero() || s.isCluster() {
+		return
+	}
+	if err := store.Sessions.Touch(s.sid, types.TimeNow()); err != nil {
+		logs.Warn.Println("s.touchSessionRecord: failed to update record", err, s.sid)
+	}
+}
+
+// revokeResumeToken revokes the reconnection token, if any.
+func revokeResumeToken(token string) {
+	if token == "" {
+		return
+	}
+	if err := resume.Revoke([]byte(token)); err != nil && err != types.ErrNotFound {
+		logs.Warn.Println("failed to revoke reconnection token", err)
+	}
+}
+
+// revokeUserTokens revokes all reconnection and refresh tokens of the user. Access tokens are
+// revoked too if access is true.
+func revokeUserTokens(uid types.Uid, access bool) error {
+	schemes := []string{"resume", "refresh"}
+	if access {
+		schemes = append(schemes, "token")
+	}
+	for _, name := range schemes {
+		hdl := store.Store.GetLogicalAuthHandler(name)
+		if hdl == nil || !hdl.IsInitialized() {
+			continue
+		}
+		if err := hdl.DelRecords(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionsEvict terminates the user's sessions with the given IDs on all cluster nodes.
+func sessionsEvict(uid types.Uid, sids []string) {
+	if len(sids) == 0 {
+		return
+	}
+
+	globals.sessionStore.EvictSessions(uid, sids)
+	if globals.cluster != nil {
+		if err := globals.cluster.routeUserReq(&UserCacheReq{UserId: uid, Evict: sids}); err != nil {
+			logs.Warn.Println("failed to evict sessions at cluster nodes", uid.UserId(), err)
+		}
+	}
+}
+
+// sessionsEvictAll terminates all sessions of the user except skipSid on all cluster nodes.
+func sessionsEvictAll(uid types.Uid, skipSid string) {
+	globals.sessionStore.EvictUser(uid, skipSid)
+	if globals.cluster != nil {
+		if err := globals.cluster.routeUserReq(&UserCacheReq{UserId: uid, EvictAll: true, SkipSid: skipSid}); err != nil {
+			logs.Warn.Println("failed to evict sessions at cluster nodes", uid.UserId(), err)
+		}
+	}
+}
+
+// replyGetSessions lists sessions of the user, the most recently active first.
+func (t *Topic) replyGetSessions(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return errors.New("invalid topic category for getting sessions")
+	}
+	if globals.sessRecordMaxIdle == 0 {
+		sess.queueOut(ErrNotImplementedReply(msg, now))
+		return nil
+	}
+
+	records, err := store.Sessions.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	expire := now.Add(-globals.sessRecordMaxIdle)
+	var result []MsgSession
+	for i := range records {
+		rec := &records[i]
+		current := rec.Id == sess.sid
+		if !current && rec.LastSeen.Before(expire) {
+			// Not deleted yet.
+			continue
+		}
+		ms := MsgSession{
+			Id:         rec.Id,
+			RemoteAddr: rec.RemoteAddr,
+			UserAgent:  rec.UserAgent,
+			Platform:   rec.Platform,
+			CreatedAt:  rec.CreatedAt,
+			LastSeen:   rec.LastSeen,
+			Current:    current,
+		}
+		if current {
+			ms.LastSeen = now
+		}
+		result = append(result, ms)
+	}
+
+	if len(result) == 0 {
+		sess.queueOut(NoContentParamsReply(msg, now, map[string]any{"what": "sess"}))
+		return nil
+	}
+
+	sess.queueOut(&ServerComMessage{
+		Meta: &MsgServerMeta{
+			Id:        msg.Id,
+			Topic:     t.original(asUid),
+			Timestamp: &now,
+			Sess:      result,
+		},
+	})
+	return nil
+}
+
+// replyDelSessions revokes a session of the user or all sessions except the current one.
+// A hard delete of all sessions logs the user out everywhere.
+func (t *Topic) replyDelSessions(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if t.cat != types.TopicCatMe {
+		sess.queueOut(ErrPermissionDeniedReply(msg, now))
+		return errors.New("del.sess: invalid topic category")
+	}
+
+	target := msg.Del.Sess
+	if target == "" || (msg.Del.Hard && target != "*") {
+		sess.queueOut(ErrMalformedReply(msg, now))
+		return errors.New("del.sess: missing or invalid session ID")
+	}
+	if msg.Del.Hard {
+		return t.replyLogoutEverywhere(sess, asUid, msg)
+	}
+	if globals.sessRecordMaxIdle == 0 {
+		sess.queueOut(ErrNotImplementedReply(msg, now))
+		return nil
+	}
+	if target == sess.sid {
+		// The current session ends by disconnecting.
+		sess.queueOut(ErrOperationNotAllowedReply(msg, now))
+		return nil
+	}
+
+	records, err := store.Sessions.GetAll(asUid)
+	if err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	var revoked []string
+	for i := range records {
+		rec := &records[i]
+		if rec.Id == sess.sid || (target != "*" && rec.Id != target) {
+			continue
+		}
+		deleted, err := store.Sessions.Delete(asUid, rec.Id)
+		if err != nil {
+			sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+			sessionsEvict(asUid, revoked)
+			return err
+		}
+		if deleted {
+			revokeResumeToken(rec.Resume)
+			revoked = append(revoked, rec.Id)
+		}
+	}
+
+	if target != "*" && len(revoked) == 0 {
+		sess.queueOut(ErrNotFoundReply(msg, now))
+		return nil
+	}
+
+	sessionsEvict(asUid, revoked)
+
+	auditLog(&types.AuditRecord{
+		Event:      types.AuditSessionRevoke,
+		Actor:      asUid.UserId(),
+		Target:     asUid.UserId(),
+		RemoteAddr: sess.remoteAddr,
+		Details:    target + ", " + strconv.Itoa(len(revoked)),
+	})
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"count": len(revoked)}))
+	return nil
+}
+
+// replyLogoutEverywhere revokes all tokens of the user, including those of the current session,
+// and terminates all sessions except the current one.
+func (t *Topic) replyLogoutEverywhere(sess *Session, asUid types.Uid, msg *ClientComMessage) error {
+	now := types.TimeNow()
+
+	if err := revokeUserTokens(asUid, true); err != nil {
+		sess.queueOut(decodeStoreErrorExplicitTs(err, msg.Id, msg.Original, now, msg.Timestamp, nil))
+		return err
+	}
+
+	count := 0
+	if globals.sessRecordMaxIdle > 0 {
+		records, err := store.Sessions.GetAll(asUid)
+		if err != nil {
+			logs.Warn.Println("del.sess: failed to load records", err, sess.sid)
+		}
+		for i := range records {
+			if records[i].Id == sess.sid {
+				continue
+			}
+			if deleted, err := store.Sessions.Delete(asUid, records[i].Id); err != nil {
+				logs.Warn.Println("del.sess: failed to delete record", err, sess.sid)
+			} else if deleted {
+				count++
+			}
+		}
+	}
+
+	sessionsEvictAll(asUid, sess.sid)
+
+	auditLog(&types.AuditRecord{
+		Event:      types.AuditSessionRevoke,
+		Actor:      asUid.UserId(),
+		Target:     asUid.UserId(),
+		RemoteAddr: sess.remoteAddr,
+		Details:    "everywhere, " + strconv.Itoa(count),
+	})
+
+	sess.queueOut(NoErrParamsReply(msg, now, map[string]any{"count": count}))
+	return nil
+}
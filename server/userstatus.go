@@ -0,0 +1,95 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Custom status of the user such as "🏖 On vacation until Friday". The
+ *    user sets the status with {set topic="me" desc={status: {emoji, text,
+ *    expires}}} and clears it with an empty status. The status is stored
+ *    with the user record, reported in 'me' desc and in subscriber listings
+ *    of 'me', p2p and group topics. Contacts are notified of changes with
+ *    {pres what="upd"} like changes of public.
+ *
+ *    Expired statuses are not reported. While 'me' is loaded, the status is
+ *    cleared when it expires and contacts are notified.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+const (
+	// Maximum length of the status emoji in bytes.
+	maxStatusEmojiLength = 32
+	// Maximum length of the status text in characters.
+	maxStatusTextLength = 140
+)
+
+// statusFromMsg validates the status set by the user. Returns nil if the status is cleared.
+func statusFromMsg(src *MsgUserStatus, now time.Time) (*types.UserStatus, error) {
+	emoji := strings.TrimSpace(src.Emoji)
+	text := strings.TrimSpace(src.Text)
+	if emoji == "" && text == "" {
+		return nil, nil
+	}
+	if len(emoji) > maxStatusEmojiLength || utf8.RuneCountInString(text) > maxStatusTextLength {
+		return nil, errors.New("status is too long")
+	}
+	if src.Expires != nil && !src.Expires.After(now) {
+		return nil, errors.New("status expires in the past")
+	}
+	return &types.UserStatus{Emoji: emoji, Text: text, ExpiresAt: src.Expires}, nil
+}
+
+// statusToMsg converts the status for reporting to clients. Returns nil if the status is not set or expired.
+func statusToMsg(us *types.UserStatus, now time.Time) *MsgUserStatus {
+	if !us.IsActive(now) {
+		return nil
+	}
+	return &MsgUserStatus{Emoji: us.Emoji, Text: us.Text, Expires: us.ExpiresAt}
+}
+
+// statusExpirySchedule restarts the timer which clears the status of the user when it expires, 'me' only.
+func (t *Topic) statusExpirySchedule() {
+	if t.statusTimer == nil {
+		// The topic is not running.
+		return
+	}
+	t.statusTimer.Stop()
+	if t.userStatus != nil && t.userStatus.ExpiresAt != nil {
+		t.statusTimer.Reset(time.Until(*t.userStatus.ExpiresAt))
+	}
+}
+
+// handleStatusExpired clears the expired status of the user and notifies contacts and user's sessions.
+func (t *Topic) handleStatusExpired() {
+	now := types.TimeNow()
+	if t.userStatus == nil {
+		return
+	}
+	if t.userStatus.IsActive(now) {
+		// The timer fired early.
+		t.statusExpirySchedule()
+		return
+	}
+
+	uid := types.ParseUserId(t.name)
+	if err := store.Users.Update(uid, map[string]any{"Status": nil, "UpdatedAt": now}); err != nil {
+		logs.Warn.Printf("topic[%s]: failed to clear expired status: %v", t.name, err)
+		return
+	}
+	t.userStatus = nil
+	t.updated = now
+
+	t.presUsersOfInterest("upd", "")
+	pud := t.perUser[uid]
+	t.presSingleUserOffline(uid, pud.modeGiven&pud.modeWant, "upd", nilPresParams, "", false)
+}
@@ -156,11 +156,42 @@ func msgOpts2storeOpts(req *MsgGetOpts) *types.QueryOpt {
 			Since:           req.SinceId,
 			Before:          req.BeforeId,
 			IdRanges:        rangeSerialize(req.IdRanges),
+			Search:          req.Search,
+			Thread:          req.Thread,
+			Label:           req.Label,
 		}
 	}
 	return opts
 }
 
+// topicCatOf returns the category of the topic named by the client. Unlike types.GetTopicCat
+// it does not panic on invalid names and returns false instead.
+func topicCatOf(name string) (types.TopicCat, bool) {
+	if len(name) < 3 {
+		return 0, false
+	}
+	switch name[:3] {
+	case "usr", "p2p", "grp", "chn", "fnd", "sys", "rpt", "slf":
+		return types.GetTopicCat(name), true
+	}
+	return 0, false
+}
+
+// messageContentText returns the plain text of a message: the content if it's a string or the text
+// of a Drafty document without formatting. Returns an empty string for other content.
+func messageContentText(head map[string]any, content any) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case map[string]any:
+		if mime, _ := head["mime"].(string); mime == "text/x-drafty" {
+			text, _ := content["txt"].(string)
+			return text
+		}
+	}
+	return ""
+}
+
 // Check if the interface contains a string with a single Unicode Del control character.
 func isNullValue(i any) bool {
 	if str, ok := i.(string); ok {
@@ -210,6 +241,8 @@ func decodeStoreErrorExplicitTs(err error, id, topic string, serverTs, incomingR
 			errmsg = ErrNotFoundExplicitTs(id, topic, serverTs, incomingReqTs)
 		case types.ErrInvalidResponse:
 			errmsg = ErrInvalidResponse(id, topic, serverTs, incomingReqTs)
+		case types.ErrQuotaExceeded:
+			errmsg = ErrQuotaExceededExplicitTs(id, topic, serverTs, incomingReqTs)
 		case types.ErrRedirected:
 			errmsg = InfoUseOther(id, topic, params["topic"].(string), serverTs, incomingReqTs)
 		default:
@@ -930,3 +963,29 @@ func isRoutableIP(ipStr string) bool {
 	}
 	return true
 }
+
+// draftyCapsFromList converts a list of Drafty formats supported by the client to a set.
+// Returns nil if the list is empty meaning all formats are supported.
+func draftyCapsFromList(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+	caps := make(map[string]bool, len(list))
+	for _, tp := range list {
+		caps[strings.ToUpper(tp)] = true
+	}
+	return caps
+}
+
+// draftyCapsToList is the inverse of draftyCapsFromList.
+func draftyCapsToList(caps map[string]bool) []string {
+	if caps == nil {
+		return nil
+	}
+	list := make([]string, 0, len(caps))
+	for tp := range caps {
+		list = append(list, tp)
+	}
+	sort.Strings(list)
+	return list
+}
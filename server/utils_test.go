@@ -530,3 +530,26 @@ func TestHasDuplicateNamespaceTags(t *testing.T) {
 		}
 	}
 }
+
+func TestTopicCatOf(t *testing.T) {
+	cases := []struct {
+		name string
+		cat  types.TopicCat
+		ok   bool
+	}{
+		{"usrAbCd", types.TopicCatMe, true},
+		{"grpAbCd", types.TopicCatGrp, true},
+		{"chnAbCd", types.TopicCatGrp, true},
+		{"slf", types.TopicCatSlf, true},
+		{"", 0, false},
+		{"x", 0, false},
+		{"xyzAbCd", 0, false},
+	}
+
+	for _, tc := range cases {
+		cat, ok := topicCatOf(tc.name)
+		if ok != tc.ok || (ok && cat != tc.cat) {
+			t.Errorf("topicCatOf(%q): expected (%v, %v), got (%v, %v)", tc.name, tc.cat, tc.ok, cat, ok)
+		}
+	}
+}
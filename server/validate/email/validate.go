@@ -16,6 +16,7 @@ import (
 	"net/mail"
 	"net/smtp"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	textt "text/template"
@@ -62,6 +63,12 @@ type validator struct {
 	TLSInsecureSkipVerify bool `json:"insecure_skip_verify"`
 	// Optional whitelist of email domains accepted for registration.
 	Domains []string `json:"domains"`
+	// Optional blacklist of email domains not accepted for registration. Subdomains are rejected too.
+	DenyDomains []string `json:"deny_domains"`
+	// Reject addresses at known disposable (temporary) email services.
+	BlockDisposable bool `json:"block_disposable"`
+	// Optional path to a file with additional disposable email domains, one per line.
+	DisposableList string `json:"disposable_list"`
 	// Length of secret numeric code to sent for validation.
 	CodeLength int `json:"code_length"`
 
@@ -73,6 +80,8 @@ type validator struct {
 	senderEmail     string
 	langMatcher     i18n.Matcher
 	maxCodeValue    *big.Int
+	// Denied and disposable domains.
+	deniedDomains map[string]struct{}
 }
 
 const (
@@ -211,9 +220,41 @@ func (v *validator) Init(jsonconf string) error {
 		v.SMTPPort = defaultPort
 	}
 
+	v.deniedDomains = make(map[string]struct{})
+	for _, domain := range v.DenyDomains {
+		v.deniedDomains[strings.ToLower(domain)] = struct{}{}
+	}
+	if v.BlockDisposable {
+		for _, domain := range disposableDomains {
+			v.deniedDomains[domain] = struct{}{}
+		}
+		if v.DisposableList != "" {
+			data, err := os.ReadFile(v.DisposableList)
+			if err != nil {
+				return err
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if domain := strings.ToLower(strings.TrimSpace(line)); domain != "" && !strings.HasPrefix(domain, "#") {
+					v.deniedDomains[domain] = struct{}{}
+				}
+			}
+		}
+	}
+
 	return nil
 }
 
+// isDomainDenied checks if the domain or any of its parent domains is denied.
+func (v *validator) isDomainDenied(domain string) bool {
+	for domain != "" {
+		if _, denied := v.deniedDomains[domain]; denied {
+			return true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return false
+}
+
 // IsInitialized returns true if the validator is initialized.
 func (v *validator) IsInitialized() bool {
 	return v.SMTPHeloHost != ""
@@ -236,14 +277,18 @@ func (v *validator) PreCheck(cred string, _ map[string]any) (string, error) {
 	addr.Address = strings.ToLower(addr.Address)
 
 	// If a whitelist of domains is provided, make sure the email belongs to the list.
-	if len(v.Domains) > 0 {
+	// Emails at denied or disposable domains are rejected.
+	if len(v.Domains) > 0 || len(v.deniedDomains) > 0 {
 		// Parse email into user and domain parts.
 		parts := strings.Split(addr.Address, "@")
 		if len(parts) != 2 {
 			return "", t.ErrMalformed
 		}
 
-		if !slices.Contains(v.Domains, parts[1]) {
+		if len(v.Domains) > 0 && !slices.Contains(v.Domains, parts[1]) {
+			return "", t.ErrPolicy
+		}
+		if v.isDomainDenied(parts[1]) {
 			return "", t.ErrPolicy
 		}
 	}
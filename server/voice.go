@@ -0,0 +1,107 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Voice messages. Duration and waveform of uploaded audio files are
+ *    extracted on upload, stored with the file record and returned in the
+ *    upload response. When a message with an audio attachment is published,
+ *    the server adds the duration and the waveform to the Drafty AU entity
+ *    which references the file, so clients can render the player without
+ *    downloading the file first.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/tinode/chat/server/drafty"
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Audio analysis config.
+type audioConfig struct {
+	Enabled bool `json:"enabled"`
+	// Configuration of the analyzer to pass unchanged.
+	Config json.RawMessage `json:"config"`
+}
+
+// analyzeAudio extracts duration and waveform of the audio file into fdef. Failures are not fatal:
+// the file is uploaded without them. The file is rewound.
+func analyzeAudio(fdef *types.FileDef, file io.ReadSeeker) error {
+	if globals.audioAnalyzer == nil || !strings.HasPrefix(fdef.MimeType, "audio/") {
+		return nil
+	}
+	info, err := globals.audioAnalyzer.Analyze(file)
+	if _, serr := file.Seek(0, io.SeekStart); serr != nil {
+		return serr
+	}
+	if err != nil {
+		logs.Info.Println("media upload: failed to analyze audio", fdef.Id, err)
+		return nil
+	}
+	fdef.Media = info
+	return nil
+}
+
+// audioUploadParams adds duration and waveform of the uploaded audio file to the upload response.
+func audioUploadParams(params map[string]any, fdef *types.FileDef) {
+	if fdef.Media == nil {
+		return
+	}
+	params["duration"] = fdef.Media.Duration
+	if len(fdef.Media.Waveform) > 0 {
+		// Same as 'preview' of AU entities.
+		params["preview"] = base64.StdEncoding.EncodeToString(fdef.Media.Waveform)
+	}
+}
+
+// fillAudioEntities adds duration and waveform of attached audio files to AU entities of the message
+// which reference them. Returns the content unchanged if there is nothing to add.
+func fillAudioEntities(head map[string]any, content any, attachments []string) any {
+	if len(attachments) == 0 || head[types.MsgHeadE2EE] == true {
+		return content
+	}
+	mh := store.Store.GetMediaHandler()
+	if mh == nil {
+		return content
+	}
+
+	attached := make(map[string]bool, len(attachments))
+	for _, url := range attachments {
+		attached[url] = true
+	}
+	result, err := drafty.UpdateEntities(content, "AU", func(data map[string]any) map[string]any {
+		ref, _ := data["ref"].(string)
+		if !attached[ref] {
+			return nil
+		}
+		fid := mh.GetIdFromUrl(ref)
+		if fid.IsZero() {
+			return nil
+		}
+		fd, err := store.Files.Get(fid.String())
+		if err != nil || fd == nil || fd.Media == nil {
+			return nil
+		}
+		updated := make(map[string]any, len(data)+2)
+		for key, val := range data {
+			updated[key] = val
+		}
+		// Values extracted by the server take precedence over the values provided by the client.
+		updated["duration"] = fd.Media.Duration
+		if len(fd.Media.Waveform) > 0 {
+			updated["preview"] = base64.StdEncoding.EncodeToString(fd.Media.Waveform)
+		}
+		return updated
+	})
+	if err != nil {
+		return content
+	}
+	return result
+}
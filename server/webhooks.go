@@ -0,0 +1,182 @@
+/******************************************************************************
+ *
+ *  Description:
+ *    Outgoing webhooks: events of topics are POSTed to HTTP endpoints
+ *    registered by the server operator through the admin API. Server-wide
+ *    webhooks receive events of all topics, webhooks of a topic receive
+ *    events of that topic only. Events:
+ *
+ *    - message.posted: a message is published to a p2p or group topic.
+ *    - subscriber.joined, subscriber.left: a user joins or leaves a group
+ *      topic, is approved, removed or banned.
+ *    - topic.created, topic.deleted: a p2p or group topic is created or
+ *      deleted. Webhooks of the topic are deleted with the topic, so
+ *      topic.deleted is sent to server-wide webhooks only.
+ *
+ *    Webhooks are cached by topics for webhooksCacheTTL: changes made through
+ *    the admin API of another cluster node are picked up when the cache
+ *    expires.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+	"github.com/tinode/chat/server/webhooks"
+)
+
+const (
+	// Webhooks of a topic are reloaded after this time.
+	webhooksCacheTTL = time.Minute
+	// Expired entries are purged from the cache when there are this many of them.
+	webhooksCachePurgeSize = 4096
+
+	// Maximum length of the URL of a webhook.
+	maxWebhookURLLength = 2048
+	// Maximum length of the secret of a webhook.
+	maxWebhookSecretLength = 256
+)
+
+// Events delivered to webhooks.
+const (
+	webhookMessagePosted    = "message.posted"
+	webhookSubscriberJoined = "subscriber.joined"
+	webhookSubscriberLeft   = "subscriber.left"
+	webhookTopicCreated     = "topic.created"
+	webhookTopicDeleted     = "topic.deleted"
+)
+
+var webhookEvents = []string{webhookMessagePosted, webhookSubscriberJoined, webhookSubscriberLeft,
+	webhookTopicCreated, webhookTopicDeleted}
+
+// webhooksCacheEntry is a list of webhooks of a topic loaded from the database.
+type webhooksCacheEntry struct {
+	hooks    []types.Webhook
+	loadedAt time.Time
+}
+
+// Webhooks of topics by topic name, server-wide webhooks are cached under an empty name.
+var webhooksCache struct {
+	sync.Mutex
+	entries map[string]*webhooksCacheEntry
+}
+
+// webhooksOf returns cached webhooks of the topic or server-wide webhooks if the topic is empty.
+func webhooksOf(topic string) []types.Webhook {
+	now := time.Now()
+
+	webhooksCache.Lock()
+	defer webhooksCache.Unlock()
+
+	if entry := webhooksCache.entries[topic]; entry != nil && now.Sub(entry.loadedAt) < webhooksCacheTTL {
+		return entry.hooks
+	}
+
+	hooks, err := store.Webhooks.GetAll(topic)
+	if err != nil {
+		logs.Warn.Printf("webhooks: failed to load webhooks of '%s': %v", topic, err)
+		return nil
+	}
+
+	if webhooksCache.entries == nil {
+		webhooksCache.entries = make(map[string]*webhooksCacheEntry)
+	} else if len(webhooksCache.entries) >= webhooksCachePurgeSize {
+		for name, entry := range webhooksCache.entries {
+			if now.Sub(entry.loadedAt) >= webhooksCacheTTL {
+				delete(webhooksCache.entries, name)
+			}
+		}
+	}
+	webhooksCache.entries[topic] = &webhooksCacheEntry{hooks: hooks, loadedAt: now}
+	return hooks
+}
+
+// webhooksInvalidate drops cached webhooks of the topic after they were changed.
+func webhooksInvalidate(topic string) {
+	webhooksCache.Lock()
+	delete(webhooksCache.entries, topic)
+	webhooksCache.Unlock()
+}
+
+// webhooksReset drops all cached webhooks.
+func webhooksReset() {
+	webhooksCache.Lock()
+	webhooksCache.entries = nil
+	webhooksCache.Unlock()
+}
+
+// webhookFire sends the event of the topic to the server-wide webhooks and the webhooks of the topic
+// which subscribe to the event.
+func webhookFire(topic, event string, user types.Uid, data any) {
+	if !webhooks.Enabled() {
+		return
+	}
+
+	ev := &webhooks.Event{
+		Event: event,
+		Ts:    types.TimeNow(),
+		Topic: topic,
+		Data:  data,
+	}
+	if !user.IsZero() {
+		ev.User = user.UserId()
+	}
+	names := []string{"", topic}
+	if event == webhookTopicDeleted {
+		// Webhooks of the topic are deleted together with the topic.
+		names = names[:1]
+		webhooksInvalidate(topic)
+	}
+	for _, name := range names {
+		hooks := webhooksOf(name)
+		for i := range hooks {
+			hook := &hooks[i]
+			if len(hook.Events) > 0 && !slices.Contains(hook.Events, event) {
+				continue
+			}
+			webhooks.Send(&webhooks.Hook{Id: hook.Id, URL: hook.URL, Secret: hook.Secret}, ev)
+		}
+	}
+}
+
+// webhookMessage sends the message accepted for delivery to webhooks.
+func (t *Topic) webhookMessage(data *MsgServerData) {
+	if t.cat != types.TopicCatP2P && t.cat != types.TopicCatGrp {
+		return
+	}
+	webhookFire(t.name, webhookMessagePosted, types.ParseUserId(data.From), map[string]any{
+		"seq":     data.SeqId,
+		"head":    data.Head,
+		"content": data.Content,
+	})
+}
+
+// webhookSubChange sends events of users joining or leaving the group topic to webhooks.
+func (t *Topic) webhookSubChange(uid types.Uid, oldWant, oldGiven, newWant, newGiven types.AccessMode) {
+	if t.cat != types.TopicCatGrp {
+		return
+	}
+
+	wasMember, isMember := isTopicMember(oldWant, oldGiven), isTopicMember(newWant, newGiven)
+	switch {
+	case !wasMember && isMember:
+		webhookFire(t.name, webhookSubscriberJoined, uid, nil)
+	case wasMember && !isMember:
+		webhookFire(t.name, webhookSubscriberLeft, uid, nil)
+	}
+}
+
+// webhookTopic sends creation or deletion of the topic to webhooks.
+func webhookTopic(topic string, event string, user types.Uid) {
+	if cat := topicCat(topic); cat != types.TopicCatP2P && cat != types.TopicCatGrp {
+		return
+	}
+	webhookFire(topic, event, user, nil)
+}
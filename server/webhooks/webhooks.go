@@ -0,0 +1,339 @@
+// Package webhooks delivers events of topics to external HTTP endpoints. Events are POSTed as JSON
+// by a pool of workers. Requests are signed with HMAC-SHA256 of the timestamp and the body keyed by
+// the secret of the webhook. Failed deliveries are retried with exponential backoff, events which
+// could not be delivered are logged as dead letters.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	mrand "math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+const (
+	defaultWorkers     = 4
+	defaultQueueSize   = 1024
+	defaultTimeout     = 5
+	defaultMaxAttempts = 6
+	defaultBackoff     = 2
+	defaultMaxBackoff  = 600
+	defaultUserAgent   = "TinodeWebhooks/1.0"
+
+	// Maximum number of bytes of the response to read: the response is ignored.
+	maxResponseSize = 1 << 12
+)
+
+// Headers of webhook requests.
+const (
+	// Name of the event.
+	HeaderEvent = "X-Tinode-Event"
+	// Unique ID of the event, the same in all attempts to deliver it.
+	HeaderDelivery = "X-Tinode-Delivery"
+	// Time of the attempt to deliver the event, seconds since the epoch.
+	HeaderTimestamp = "X-Tinode-Timestamp"
+	// Signature of the request, see Sign.
+	HeaderSignature = "X-Tinode-Signature"
+)
+
+// Hook is an endpoint to deliver events to.
+type Hook struct {
+	// ID of the webhook.
+	Id string
+	// URL of the endpoint.
+	URL string
+	// Secret used to sign requests.
+	Secret string
+}
+
+// Event is a payload of the webhook request.
+type Event struct {
+	// Unique ID of the event, assigned by Send.
+	Id string `json:"id"`
+	// Name of the event.
+	Event string `json:"event"`
+	// Time of the event.
+	Ts time.Time `json:"ts"`
+	// Topic of the event.
+	Topic string `json:"topic,omitempty"`
+	// User the event is about.
+	User string `json:"user,omitempty"`
+	// Event-specific data.
+	Data any `json:"data,omitempty"`
+}
+
+type configType struct {
+	Enabled bool `json:"enabled"`
+	// Number of workers delivering events.
+	Workers int `json:"workers"`
+	// Maximum number of events waiting to be delivered. Events over the limit are dead-lettered.
+	QueueSize int `json:"queue_size"`
+	// Timeout of one request (seconds).
+	Timeout int `json:"timeout"`
+	// Maximum number of attempts to deliver an event.
+	MaxAttempts int `json:"max_attempts"`
+	// Delay before the first retry (seconds), doubled with every attempt.
+	Backoff int `json:"backoff"`
+	// Maximum delay between retries (seconds).
+	MaxBackoff int `json:"max_backoff"`
+	// User-Agent header sent with requests.
+	UserAgent string `json:"user_agent"`
+}
+
+// delivery is an attempt to deliver an event to a webhook.
+type delivery struct {
+	hook    *Hook
+	event   *Event
+	body    []byte
+	attempt int
+}
+
+var errQueueFull = errors.New("queue full")
+
+// dispatcher delivers events to webhooks.
+type dispatcher struct {
+	client      *http.Client
+	userAgent   string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	work        chan *delivery
+	stop        chan struct{}
+	wg          sync.WaitGroup
+
+	// Retries waiting for their time.
+	lock    sync.Mutex
+	retries map[*time.Timer]*delivery
+}
+
+var disp *dispatcher
+
+// Init initializes webhooks. Returns false if webhooks are disabled in the config.
+func Init(jsconfig json.RawMessage) (bool, error) {
+	if len(jsconfig) == 0 {
+		return false, nil
+	}
+
+	var config configType
+	if err := json.Unmarshal(jsconfig, &config); err != nil {
+		return false, errors.New("failed to parse config: " + err.Error())
+	}
+	if !config.Enabled {
+		return false, nil
+	}
+
+	disp = newDispatcher(&config)
+	return true, nil
+}
+
+// Enabled checks if webhooks are enabled.
+func Enabled() bool {
+	return disp != nil
+}
+
+// Send queues the event for delivery to the webhook.
+func Send(hook *Hook, event *Event) {
+	if disp == nil {
+		return
+	}
+	if event.Id == "" {
+		event.Id = newEventId()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logs.Warn.Printf("webhooks: failed to serialize event %s: %v", event.Id, err)
+		return
+	}
+	disp.enqueue(&delivery{hook: hook, event: event, body: body, attempt: 1})
+}
+
+// Stop stops the workers. Events waiting to be delivered or retried are dead-lettered.
+func Stop() {
+	if disp == nil {
+		return
+	}
+	disp.shutdown()
+	disp = nil
+}
+
+// Sign returns the signature of the request: "sha256=" followed by the hex-encoded HMAC-SHA256 of the
+// timestamp, a dot and the body, keyed by the secret of the webhook.
+func Sign(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(ts, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDispatcher(config *configType) *dispatcher {
+	workers := valueOrDefault(config.Workers, defaultWorkers)
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	d := &dispatcher{
+		client:      &http.Client{Timeout: time.Second * time.Duration(valueOrDefault(config.Timeout, defaultTimeout))},
+		userAgent:   userAgent,
+		maxAttempts: valueOrDefault(config.MaxAttempts, defaultMaxAttempts),
+		backoff:     time.Second * time.Duration(valueOrDefault(config.Backoff, defaultBackoff)),
+		maxBackoff:  time.Second * time.Duration(valueOrDefault(config.MaxBackoff, defaultMaxBackoff)),
+		work:        make(chan *delivery, valueOrDefault(config.QueueSize, defaultQueueSize)),
+		stop:        make(chan struct{}),
+		retries:     make(map[*time.Timer]*delivery),
+	}
+
+	d.wg.Add(workers)
+	for range workers {
+		go d.worker()
+	}
+	return d
+}
+
+// enqueue adds the delivery to the queue or dead-letters it if the queue is full.
+func (d *dispatcher) enqueue(dl *delivery) {
+	select {
+	case <-d.stop:
+		deadLetter(dl, errors.New("shutting down"))
+		return
+	default:
+	}
+
+	select {
+	case d.work <- dl:
+	default:
+		deadLetter(dl, errQueueFull)
+	}
+}
+
+func (d *dispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case dl := <-d.work:
+			d.process(dl)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// process makes one attempt to deliver the event and schedules a retry if it failed.
+func (d *dispatcher) process(dl *delivery) {
+	retry, err := d.post(dl)
+	if err == nil {
+		return
+	}
+	if !retry || dl.attempt >= d.maxAttempts {
+		deadLetter(dl, err)
+		return
+	}
+
+	logs.Info.Printf("webhooks: attempt %d to deliver %s to '%s' failed: %v", dl.attempt, dl.event.Id,
+		dl.hook.Id, err)
+	delay := d.retryDelay(dl.attempt)
+	dl.attempt++
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		d.lock.Lock()
+		delete(d.retries, timer)
+		d.lock.Unlock()
+		d.enqueue(dl)
+	})
+	d.retries[timer] = dl
+}
+
+// post sends the event to the webhook. Returns true if a failed request may be retried.
+func (d *dispatcher) post(dl *delivery) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, dl.hook.URL, bytes.NewReader(dl.body))
+	if err != nil {
+		return false, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", d.userAgent)
+	req.Header.Set(HeaderEvent, dl.event.Event)
+	req.Header.Set(HeaderDelivery, dl.event.Id)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(dl.hook.Secret, ts, dl.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Server errors and throttling are temporary, other errors are not.
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout, errors.New("unexpected status " + resp.Status)
+}
+
+// retryDelay returns the delay before the next attempt: the backoff doubled with every attempt with
+// up to 10% of random jitter.
+func (d *dispatcher) retryDelay(attempt int) time.Duration {
+	delay := d.backoff << (attempt - 1)
+	if delay <= 0 || delay > d.maxBackoff {
+		delay = d.maxBackoff
+	}
+	return delay + time.Duration(mrand.Int64N(int64(delay)/10+1))
+}
+
+func (d *dispatcher) shutdown() {
+	close(d.stop)
+	d.wg.Wait()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for timer, dl := range d.retries {
+		if timer.Stop() {
+			deadLetter(dl, errors.New("shutting down"))
+		}
+	}
+	d.retries = nil
+	for {
+		select {
+		case dl := <-d.work:
+			deadLetter(dl, errors.New("shutting down"))
+		default:
+			return
+		}
+	}
+}
+
+// deadLetter logs the event which could not be delivered so it can be recovered from the log.
+func deadLetter(dl *delivery, err error) {
+	logs.Err.Printf("webhooks: dead letter, event %s to '%s' (%s) after %d attempt(s): %v; payload: %s",
+		dl.event.Id, dl.hook.Id, dl.hook.URL, dl.attempt, err, dl.body)
+}
+
+// newEventId generates a random ID of an event.
+func newEventId() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func valueOrDefault(val, def int) int {
+	if val <= 0 {
+		return def
+	}
+	return val
+}
@@ -0,0 +1,109 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(os.Stderr, "stdFlags")
+	os.Exit(m.Run())
+}
+
+func TestSign(t *testing.T) {
+	// echo -n '1700000000.{"id":"1"}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"
+	got := Sign("secret", 1700000000, []byte(`{"id":"1"}`))
+	if got != expected {
+		t.Fatalf("Sign: expected '%s', got '%s'", expected, got)
+	}
+	if got == Sign("other", 1700000000, []byte(`{"id":"1"}`)) {
+		t.Error("Sign: signature does not depend on the secret")
+	}
+	if got == Sign("secret", 1700000001, []byte(`{"id":"1"}`)) {
+		t.Error("Sign: signature does not depend on the timestamp")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := &dispatcher{backoff: time.Second, maxBackoff: 10 * time.Second}
+	cases := map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 5: 10 * time.Second,
+		70: 10 * time.Second}
+	for attempt, base := range cases {
+		if got := d.retryDelay(attempt); got < base || got > base+base/10 {
+			t.Errorf("retryDelay(%d): expected %s plus jitter, got %s", attempt, base, got)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		ts, _ := strconv.ParseInt(req.Header.Get(HeaderTimestamp), 10, 64)
+		if req.Header.Get(HeaderSignature) != Sign("secret", ts, body) {
+			wrt.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls.Add(1) < 3 {
+			// Fail the first two attempts.
+			wrt.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil || ev.Event != "message.posted" || ev.Topic != "grpTest" {
+			wrt.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- req
+	}))
+	defer srv.Close()
+
+	disp = newDispatcher(&configType{Workers: 1, MaxAttempts: 3})
+	disp.backoff = time.Millisecond
+	defer Stop()
+
+	Send(&Hook{Id: "hook", URL: srv.URL, Secret: "secret"},
+		&Event{Event: "message.posted", Ts: time.Now(), Topic: "grpTest"})
+
+	select {
+	case req := <-received:
+		if req.Header.Get(HeaderEvent) != "message.posted" || req.Header.Get(HeaderDelivery) == "" {
+			t.Errorf("Unexpected headers %v", req.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Event not delivered after %d attempts", calls.Load())
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Attempts: expected 3, got %d", calls.Load())
+	}
+}
+
+func TestDeliverPermanentFailure(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		wrt.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	d := newDispatcher(&configType{Workers: 1, MaxAttempts: 3})
+	d.backoff = time.Millisecond
+	dl := &delivery{hook: &Hook{Id: "hook", URL: srv.URL}, event: &Event{Id: "1"}, attempt: 1}
+	d.process(dl)
+	d.shutdown()
+
+	if calls.Load() != 1 || len(d.retries) != 0 {
+		t.Errorf("Client errors must not be retried: %d calls", calls.Load())
+	}
+}
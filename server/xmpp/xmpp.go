@@ -0,0 +1,361 @@
+// Package xmpp implements the XML stream layer of XMPP client connections (RFC 6120):
+// reading stanzas from the stream, writing stanzas and stream headers, STARTTLS
+// and JID parsing. Translation of stanzas to Tinode messages is done by the server.
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XML namespaces used by the gateway.
+const (
+	NSClient     = "jabber:client"
+	NSStream     = "http://etherx.jabber.org/streams"
+	NSStreams    = "urn:ietf:params:xml:ns:xmpp-streams"
+	NSTLS        = "urn:ietf:params:xml:ns:xmpp-tls"
+	NSSASL       = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NSBind       = "urn:ietf:params:xml:ns:xmpp-bind"
+	NSSession    = "urn:ietf:params:xml:ns:xmpp-session"
+	NSStanzas    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	NSRoster     = "jabber:iq:roster"
+	NSPing       = "urn:xmpp:ping"
+	NSDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	NSDiscoItems = "http://jabber.org/protocol/disco#items"
+	NSMUC        = "http://jabber.org/protocol/muc"
+	NSMUCUser    = "http://jabber.org/protocol/muc#user"
+	NSCarbons    = "urn:xmpp:carbons:2"
+	NSForward    = "urn:xmpp:forward:0"
+	NSDelay      = "urn:xmpp:delay"
+)
+
+// Time allowed to write a stanza to the client.
+const writeTimeout = 10 * time.Second
+
+// ErrTooLarge is returned by Stream.Next when a stanza exceeds the size limit.
+var ErrTooLarge = errors.New("stanza too large")
+
+// JID is an XMPP address local@domain/resource.
+type JID struct {
+	Local    string
+	Domain   string
+	Resource string
+}
+
+// ParseJID parses a string representation of a JID. It does not apply stringprep.
+func ParseJID(s string) JID {
+	var jid JID
+	if at := strings.IndexByte(s, '/'); at >= 0 {
+		jid.Resource = s[at+1:]
+		s = s[:at]
+	}
+	if at := strings.IndexByte(s, '@'); at >= 0 {
+		jid.Local = s[:at]
+		s = s[at+1:]
+	}
+	jid.Domain = strings.ToLower(s)
+	return jid
+}
+
+// Bare returns the JID without the resource.
+func (j JID) Bare() JID {
+	j.Resource = ""
+	return j
+}
+
+// String converts the JID to its string representation.
+func (j JID) String() string {
+	s := j.Domain
+	if j.Local != "" {
+		s = j.Local + "@" + s
+	}
+	if j.Resource != "" {
+		s += "/" + j.Resource
+	}
+	return s
+}
+
+// Element is an XML element of a stanza, either received from the client or built to be sent.
+type Element struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Text     string     `xml:",chardata"`
+	Children []*Element `xml:",any"`
+}
+
+// NewElement creates an element in the namespace with attributes given as name-value pairs.
+// Empty attributes are skipped.
+func NewElement(space, local string, attrs ...string) *Element {
+	el := &Element{XMLName: xml.Name{Space: space, Local: local}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		if attrs[i+1] != "" {
+			el.Attrs = append(el.Attrs, xml.Attr{Name: xml.Name{Local: attrs[i]}, Value: attrs[i+1]})
+		}
+	}
+	return el
+}
+
+// Add appends children to the element and returns the element.
+func (e *Element) Add(children ...*Element) *Element {
+	for _, child := range children {
+		if child != nil {
+			e.Children = append(e.Children, child)
+		}
+	}
+	return e
+}
+
+// SetText sets the text of the element and returns the element.
+func (e *Element) SetText(text string) *Element {
+	e.Text = text
+	return e
+}
+
+// Is checks the namespace and the name of the element.
+func (e *Element) Is(space, local string) bool {
+	return e != nil && e.XMLName.Space == space && e.XMLName.Local == local
+}
+
+// Attr returns the value of the attribute without a namespace.
+func (e *Element) Attr(name string) string {
+	for _, attr := range e.Attrs {
+		if attr.Name.Space == "" && attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// Child returns the first child with the given name in the namespace. Empty namespace matches any namespace.
+func (e *Element) Child(space, local string) *Element {
+	if e == nil {
+		return nil
+	}
+	for _, child := range e.Children {
+		if child.XMLName.Local == local && (space == "" || child.XMLName.Space == space) {
+			return child
+		}
+	}
+	return nil
+}
+
+// ChildText returns the text of the first child with the given name in the namespace.
+func (e *Element) ChildText(space, local string) string {
+	if child := e.Child(space, local); child != nil {
+		return child.Text
+	}
+	return ""
+}
+
+// String serializes the element as a top-level stanza of a client stream.
+func (e *Element) String() string {
+	var b strings.Builder
+	e.write(&b, NSClient)
+	return b.String()
+}
+
+func (e *Element) write(b *strings.Builder, parentSpace string) {
+	b.WriteByte('<')
+	b.WriteString(e.XMLName.Local)
+	if e.XMLName.Space != "" && e.XMLName.Space != parentSpace {
+		writeAttr(b, "xmlns", e.XMLName.Space)
+	}
+	for _, attr := range e.Attrs {
+		if attr.Name.Space != "" || attr.Name.Local == "xmlns" {
+			// Namespace declarations and prefixed attributes of received elements are not retained.
+			continue
+		}
+		writeAttr(b, attr.Name.Local, attr.Value)
+	}
+	if e.Text == "" && len(e.Children) == 0 {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteByte('>')
+	xml.EscapeText(b, []byte(e.Text))
+	space := e.XMLName.Space
+	if space == "" {
+		space = parentSpace
+	}
+	for _, child := range e.Children {
+		child.write(b, space)
+	}
+	b.WriteString("</")
+	b.WriteString(e.XMLName.Local)
+	b.WriteByte('>')
+}
+
+func writeAttr(b *strings.Builder, name, value string) {
+	b.WriteByte(' ')
+	b.WriteString(name)
+	b.WriteString("='")
+	xml.EscapeText(b, []byte(value))
+	b.WriteByte('\'')
+}
+
+// StanzaError creates an <error/> child of a stanza with the defined condition of RFC 6120, 8.3.3.
+func StanzaError(errType, condition, text string) *Element {
+	el := NewElement("", "error", "type", errType).Add(NewElement(NSStanzas, condition))
+	if text != "" {
+		el.Add(NewElement(NSStanzas, "text").SetText(text))
+	}
+	return el
+}
+
+// limitedReader fails reads beyond the limit.
+type limitedReader struct {
+	r io.Reader
+	// Number of bytes read.
+	n int64
+	// Offset in the input where reads fail.
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n >= l.limit {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.limit-l.n {
+		p = p[:l.limit-l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// Stream is an XML stream of a client connection. Next must be called from a single goroutine,
+// writes are safe for concurrent use.
+type Stream struct {
+	conn    net.Conn
+	reader  *limitedReader
+	dec     *xml.Decoder
+	idle    time.Duration
+	maxSize int64
+
+	wlock  sync.Mutex
+	closed bool
+}
+
+// NewStream creates a stream over the connection. Stanzas larger than maxSize are rejected,
+// the connection is considered dead if nothing is received for the idle time.
+func NewStream(conn net.Conn, maxSize int64, idle time.Duration) *Stream {
+	s := &Stream{idle: idle, maxSize: maxSize}
+	s.reset(conn)
+	return s
+}
+
+func (s *Stream) reset(conn net.Conn) {
+	s.conn = conn
+	s.reader = &limitedReader{r: conn}
+	s.dec = xml.NewDecoder(s.reader)
+}
+
+// IsSecure checks if the stream is encrypted.
+func (s *Stream) IsSecure() bool {
+	_, ok := s.conn.(*tls.Conn)
+	return ok
+}
+
+// Next reads the next top-level element of the stream. Opening of a (restarted) stream is returned
+// as an element with the name {NSStream, "stream"} and no children. It returns io.EOF when the
+// client closes the stream.
+func (s *Stream) Next() (*Element, error) {
+	// The decoder may have read ahead: the limit is counted from the start of the stanza.
+	s.reader.limit = s.dec.InputOffset() + s.maxSize
+	for {
+		if s.idle > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(s.idle))
+		}
+		tok, err := s.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space == NSStream && t.Name.Local == "stream" {
+				return &Element{XMLName: t.Name, Attrs: t.Attr}, nil
+			}
+			el := &Element{}
+			if err = s.dec.DecodeElement(el, &t); err != nil {
+				return nil, err
+			}
+			return el, nil
+		case xml.EndElement:
+			// Only </stream:stream> can be seen here.
+			return nil, io.EOF
+		}
+		// Whitespace keepalives, comments and processing instructions are skipped.
+	}
+}
+
+// Open writes the header of the response stream followed by the stream features.
+func (s *Stream) Open(id, from string, features ...*Element) error {
+	var b strings.Builder
+	b.WriteString("<?xml version='1.0'?><stream:stream xmlns='" + NSClient + "' xmlns:stream='" + NSStream + "'")
+	writeAttr(&b, "id", id)
+	writeAttr(&b, "from", from)
+	b.WriteString(" version='1.0' xml:lang='en'><stream:features>")
+	for _, f := range features {
+		f.write(&b, NSStream)
+	}
+	b.WriteString("</stream:features>")
+	return s.write(b.String())
+}
+
+// Send writes a stanza to the stream.
+func (s *Stream) Send(el *Element) error {
+	return s.write(el.String())
+}
+
+func (s *Stream) write(data string) error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	if s.closed {
+		return net.ErrClosed
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := io.WriteString(s.conn, data)
+	return err
+}
+
+// StartTLS upgrades the connection to TLS after <proceed/> was sent to the client.
+func (s *Stream) StartTLS(conf *tls.Config) error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	conn := tls.Server(s.conn, conf)
+	conn.SetDeadline(time.Now().Add(writeTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	s.reset(conn)
+	return nil
+}
+
+// Error sends a stream error with the condition of RFC 6120, 4.9.3 and closes the stream.
+func (s *Stream) Error(condition string) error {
+	s.write("<stream:error><" + condition + " xmlns='" + NSStreams + "'/></stream:error>")
+	return s.Close()
+}
+
+// Close closes the stream and the connection. It's safe to call Close more than once.
+func (s *Stream) Close() error {
+	s.wlock.Lock()
+	defer s.wlock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	io.WriteString(s.conn, "</stream:stream>")
+	return s.conn.Close()
+}
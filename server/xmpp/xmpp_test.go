@@ -0,0 +1,83 @@
+package xmpp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJID(t *testing.T) {
+	for in, expected := range map[string]JID{
+		"usrAbC@Example.com/phone": {Local: "usrAbC", Domain: "example.com", Resource: "phone"},
+		"example.com":              {Domain: "example.com"},
+		"grpX@conf.example.com":    {Local: "grpX", Domain: "conf.example.com"},
+		"a@b/c/d":                  {Local: "a", Domain: "b", Resource: "c/d"},
+	} {
+		jid := ParseJID(in)
+		if jid != expected {
+			t.Errorf("ParseJID(%s): got %+v", in, jid)
+		}
+	}
+	jid := ParseJID("usrAbC@example.com/phone")
+	if s := jid.String(); s != "usrAbC@example.com/phone" {
+		t.Errorf("String: got '%s'", s)
+	}
+	if s := jid.Bare().String(); s != "usrAbC@example.com" {
+		t.Errorf("Bare: got '%s'", s)
+	}
+}
+
+func TestElementString(t *testing.T) {
+	msg := NewElement("", "message", "type", "chat", "id", "", "to", "a@b").
+		Add(NewElement("", "body").SetText("1 < 2 & 'x'")).
+		Add(NewElement(NSCarbons, "sent").Add(NewElement(NSForward, "forwarded")))
+	expected := `<message type='chat' to='a@b'><body>1 &lt; 2 &amp; &#39;x&#39;</body>` +
+		`<sent xmlns='urn:xmpp:carbons:2'><forwarded xmlns='urn:xmpp:forward:0'/></sent></message>`
+	if s := msg.String(); s != expected {
+		t.Errorf("String: got\n%s\nexpected\n%s", s, expected)
+	}
+
+	if s := StanzaError("cancel", "item-not-found", "").String(); s !=
+		`<error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error>` {
+		t.Errorf("StanzaError: got '%s'", s)
+	}
+}
+
+func TestStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	stream := NewStream(server, 256, time.Second)
+	go func() {
+		io.WriteString(client, `<?xml version='1.0'?><stream:stream to='example.com' version='1.0' `+
+			`xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'> `+
+			`<iq type='get' id='1'><ping xmlns='urn:xmpp:ping'/></iq>`+
+			`<message to='usrX@example.com' type='chat'><body>hello</body></message>`+
+			`<message><body>`+strings.Repeat("x", 300)+`</body></message>`)
+	}()
+
+	el, err := stream.Next()
+	if err != nil || !el.Is(NSStream, "stream") || el.Attr("to") != "example.com" {
+		t.Fatalf("Header: got %+v, %v", el, err)
+	}
+
+	el, err = stream.Next()
+	if err != nil || !el.Is(NSClient, "iq") || el.Attr("id") != "1" || el.Child(NSPing, "ping") == nil {
+		t.Fatalf("Iq: got %+v, %v", el, err)
+	}
+
+	el, err = stream.Next()
+	if err != nil || !el.Is(NSClient, "message") || el.ChildText(NSClient, "body") != "hello" {
+		t.Fatalf("Message: got %+v, %v", el, err)
+	}
+	if jid := ParseJID(el.Attr("to")); jid.Local != "usrX" {
+		t.Errorf("Message: unexpected addressee %+v", jid)
+	}
+
+	if _, err = stream.Next(); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Large stanza: expected ErrTooLarge, got %v", err)
+	}
+}
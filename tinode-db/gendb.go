@@ -428,6 +428,7 @@ type photoStruct struct {
 type card struct {
 	Fn    string       `json:"fn" db:"fn"`
 	Photo *photoStruct `json:"photo,omitempty" db:"photo"`
+	Note  string       `json:"note,omitempty" db:"note"`
 }
 
 // {"fn": "Alice Johnson", "photo": "alice-128.jpg"}
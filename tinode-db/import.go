@@ -0,0 +1,539 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// Media handler config, same as in the server config.
+type mediaConfig struct {
+	// The name of the handler to use for attachments.
+	UseHandler string `json:"use_handler"`
+	// Individual handler config params to pass to handlers unchanged.
+	Handlers map[string]json.RawMessage `json:"handlers"`
+}
+
+// Save progress of the import after this many new users.
+const importCheckpoint = 100
+
+// importUser is an account in the source chat.
+type importUser struct {
+	Id      string
+	Name    string
+	Email   string
+	Deleted bool
+}
+
+// importRoom is a conversation in the source chat: a channel, a private group or a direct conversation.
+type importRoom struct {
+	Id      string
+	Name    string
+	Note    string
+	Created time.Time
+	// Source user ID of the owner.
+	Owner string
+	// Source user IDs of members.
+	Members  []string
+	Direct   bool
+	Private  bool
+	Archived bool
+}
+
+// importMessage is a message in the source chat.
+type importMessage struct {
+	Id   string
+	User string
+	Text string
+	Ts   time.Time
+	// Id of the root message of the thread if the message is a reply.
+	Thread string
+	Files  []importFile
+}
+
+// importFile is an attachment of a message.
+type importFile struct {
+	Name string
+	Mime string
+	open func() (io.ReadCloser, error)
+}
+
+// importSource reads data exported from another chat.
+type importSource interface {
+	users() ([]importUser, error)
+	rooms() ([]importRoom, error)
+	// messages calls fn for every message of the room in chronological order.
+	messages(room *importRoom, fn func(*importMessage) error) error
+	close()
+}
+
+// importedTopic is a conversation which is imported or being imported.
+type importedTopic struct {
+	Name string `json:"name"`
+	// SeqId of the topic before the import: messages of direct conversations are appended
+	// to existing p2p topics.
+	Base int `json:"base"`
+	// All messages are imported.
+	Done bool `json:"done"`
+}
+
+// importState is the progress of the import. Messages are imported in the same order every time,
+// so the import of a conversation resumes after the last message saved to the topic.
+type importState struct {
+	// Source user IDs mapped to user IDs.
+	Users map[string]string `json:"users"`
+	// Source conversation IDs mapped to topics.
+	Topics map[string]*importedTopic `json:"topics"`
+	path   string
+}
+
+func loadImportState(path string) *importState {
+	state := &importState{path: path}
+	if raw, err := os.ReadFile(path); err == nil {
+		if err = json.Unmarshal(raw, state); err != nil {
+			log.Fatalln("Failed to parse import state:", err)
+		}
+		log.Printf("Resuming import: %d users, %d conversations", len(state.Users), len(state.Topics))
+	} else if !os.IsNotExist(err) {
+		log.Fatalln("Failed to read import state:", err)
+	}
+	if state.Users == nil {
+		state.Users = make(map[string]string)
+	}
+	if state.Topics == nil {
+		state.Topics = make(map[string]*importedTopic)
+	}
+	return state
+}
+
+// save writes the state to a temporary file first: the state is not lost if interrupted.
+func (s *importState) save() {
+	raw, err := json.Marshal(s)
+	if err == nil {
+		tmp := s.path + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0600); err == nil {
+			err = os.Rename(tmp, s.path)
+		}
+	}
+	if err != nil {
+		log.Fatalln("Failed to save import state:", err)
+	}
+}
+
+func (s *importState) uid(id string) types.Uid {
+	return types.ParseUid(s.Users[id])
+}
+
+// importChat imports users, conversations and message history from the export of another chat.
+// If interrupted, the import can be restarted with the same state file.
+func importChat(format, from, statePath string, media *mediaConfig, p2pDel bool) {
+	var src importSource
+	var err error
+	switch format {
+	case "slack":
+		src, err = openSlackExport(from)
+	case "rocketchat":
+		src, err = openRocketChatDump(from)
+	default:
+		log.Fatalln("Unknown import format:", format)
+	}
+	if err != nil {
+		log.Fatalln("Failed to open import data:", err)
+	}
+	defer src.close()
+
+	if media != nil && media.UseHandler != "" {
+		var conf string
+		if params := media.Handlers[media.UseHandler]; params != nil {
+			conf = string(params)
+		}
+		if err = store.Store.UseMediaHandler(media.UseHandler, conf); err != nil {
+			log.Fatalf("Failed to init media handler '%s': %s", media.UseHandler, err)
+		}
+	} else {
+		log.Println("Media handler is not configured: attachments will be skipped.")
+	}
+
+	if statePath == "" {
+		statePath = filepath.Clean(from) + ".state"
+	}
+	state := loadImportState(statePath)
+
+	log.Println("Importing users...")
+	users, err := src.users()
+	if err != nil {
+		log.Fatalln("Failed to read users:", err)
+	}
+	var created int
+	for i := range users {
+		if _, ok := state.Users[users[i].Id]; ok {
+			continue
+		}
+		uid, isNew := importUserAccount(&users[i])
+		state.Users[users[i].Id] = uid.String()
+		if isNew {
+			created++
+			if created%importCheckpoint == 0 {
+				state.save()
+			}
+		}
+	}
+	state.save()
+	log.Printf("Users: %d in the export, %d created", len(users), created)
+
+	log.Println("Importing conversations...")
+	rooms, err := src.rooms()
+	if err != nil {
+		log.Fatalln("Failed to read conversations:", err)
+	}
+	var total int
+	for i := range rooms {
+		room := &rooms[i]
+		it := state.Topics[room.Id]
+		if it == nil {
+			if it = importRoomTopic(room, state, p2pDel); it == nil {
+				continue
+			}
+			state.Topics[room.Id] = it
+			state.save()
+		}
+		if it.Done {
+			continue
+		}
+		if err := importRoomMembers(room, it, state); err != nil {
+			log.Fatalln("Failed to subscribe members of", room.Name, "to", it.Name, err)
+		}
+		count, err := importRoomMessages(src, room, it, state)
+		if err != nil {
+			log.Fatalf("Failed to import messages of '%s' into %s: %s. Restart to resume.", room.Name, it.Name, err)
+		}
+		total += count
+		it.Done = true
+		state.save()
+		log.Printf("Conversation '%s' imported into %s: %d messages", room.Name, it.Name, count)
+	}
+	log.Printf("Import completed: %d messages imported", total)
+}
+
+// importUserAccount finds an existing account by the validated email or creates a new one.
+func importUserAccount(u *importUser) (types.Uid, bool) {
+	if u.Email != "" {
+		uid, err := store.Users.GetByCred("email", u.Email)
+		if err != nil {
+			log.Fatalln("Failed to find user by email:", err)
+		}
+		if !uid.IsZero() {
+			log.Printf("User '%s' matched to existing account %s", u.Name, uid.UserId())
+			return uid, false
+		}
+	}
+
+	user := types.User{
+		State: types.StateOK,
+		Access: types.DefaultAccess{
+			Auth: types.ModeCAuth,
+			Anon: types.ModeNone,
+		},
+		Public: &card{Fn: u.Name},
+	}
+	if u.Deleted {
+		user.State = types.StateSuspended
+	}
+	if u.Email != "" {
+		user.Tags = []string{"email:" + u.Email}
+	}
+	if _, err := store.Users.Create(&user, nil); err != nil {
+		log.Fatalln("Failed to create user:", err)
+	}
+	// The email is validated by the source chat. Users log in with a code sent to it or reset the password.
+	if u.Email != "" {
+		if _, err := store.Users.UpsertCred(&types.Credential{
+			User:   user.Id,
+			Method: "email",
+			Value:  u.Email,
+			Done:   true,
+		}); err != nil {
+			log.Fatalln("Failed to save user's email:", err)
+		}
+	}
+	return user.Uid(), true
+}
+
+// importRoomTopic creates the topic for the conversation. Direct conversations are imported into p2p
+// topics, existing topics are reused. Returns nil if the conversation is skipped.
+func importRoomTopic(room *importRoom, state *importState, p2pDel bool) *importedTopic {
+	if room.Direct {
+		if len(room.Members) != 2 {
+			log.Printf("Direct conversation '%s' skipped: %d members", room.Name, len(room.Members))
+			return nil
+		}
+		uid1, uid2 := state.uid(room.Members[0]), state.uid(room.Members[1])
+		if uid1.IsZero() || uid2.IsZero() || uid1 == uid2 {
+			log.Printf("Direct conversation '%s' skipped: unknown members", room.Name)
+			return nil
+		}
+		name := uid1.P2PName(uid2)
+		topic, err := store.Topics.Get(name)
+		if err != nil {
+			log.Fatalln("Failed to load topic", name, err)
+		}
+		if topic != nil {
+			return &importedTopic{Name: name, Base: topic.SeqId}
+		}
+
+		mode := types.ModeCP2P
+		if p2pDel {
+			mode = types.ModeCP2PD
+		}
+		if err = store.Topics.CreateP2P(
+			&types.Subscription{
+				ObjHeader: types.ObjHeader{CreatedAt: room.Created},
+				User:      uid1.String(),
+				Topic:     name,
+				ModeWant:  mode,
+				ModeGiven: mode,
+			},
+			&types.Subscription{
+				ObjHeader: types.ObjHeader{CreatedAt: room.Created},
+				User:      uid2.String(),
+				Topic:     name,
+				ModeWant:  mode,
+				ModeGiven: mode,
+			}); err != nil {
+			log.Fatalln("Failed to create p2p topic:", err)
+		}
+		return &importedTopic{Name: name}
+	}
+
+	owner := state.uid(room.Owner)
+	for i := 0; owner.IsZero() && i < len(room.Members); i++ {
+		owner = state.uid(room.Members[i])
+	}
+	// Private conversations are joined with the approval of a manager.
+	access := types.ModeCPublic
+	if room.Private {
+		access = types.ModeNone
+	}
+	topic := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: genTopicName(), CreatedAt: room.Created},
+		Access: types.DefaultAccess{
+			Auth: access,
+			Anon: types.ModeNone,
+		},
+		Public: &card{Fn: room.Name, Note: room.Note},
+	}
+	if !owner.IsZero() {
+		topic.GiveAccess(owner, types.ModeCFull, types.ModeCFull)
+	}
+	if err := store.Topics.Create(topic, owner, nil); err != nil {
+		log.Fatalln("Failed to create topic:", err)
+	}
+	// Archived conversations are read-only.
+	if room.Archived {
+		if err := store.Topics.Update(topic.Id, map[string]any{"Frozen": true}); err != nil {
+			log.Fatalln("Failed to freeze topic:", err)
+		}
+	}
+	return &importedTopic{Name: topic.Id}
+}
+
+// importRoomMembers subscribes members of the conversation to the group topic unless already subscribed.
+func importRoomMembers(room *importRoom, it *importedTopic, state *importState) error {
+	if room.Direct {
+		return nil
+	}
+	for _, id := range room.Members {
+		uid := state.uid(id)
+		if uid.IsZero() {
+			continue
+		}
+		if sub, err := store.Subs.Get(it.Name, uid, false); err != nil {
+			return err
+		} else if sub != nil {
+			continue
+		}
+		if err := store.Subs.Create(&types.Subscription{
+			ObjHeader: types.ObjHeader{CreatedAt: room.Created},
+			User:      uid.String(),
+			Topic:     it.Name,
+			ModeWant:  types.ModeCPublic,
+			ModeGiven: types.ModeCPublic,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importRoomMessages saves messages of the conversation after those already saved to the topic. Returns
+// the number of saved messages.
+func importRoomMessages(src importSource, room *importRoom, it *importedTopic, state *importState) (int, error) {
+	topic, err := store.Topics.Get(it.Name)
+	if err != nil {
+		return 0, err
+	}
+	if topic == nil {
+		return 0, errors.New("topic not found")
+	}
+	saved := topic.SeqId
+	if saved > it.Base {
+		log.Printf("Conversation '%s': resuming after %d messages", room.Name, saved-it.Base)
+	}
+
+	var count, skipped int
+	seq := it.Base
+	// SeqIds of the imported messages which may be roots of threads.
+	seqIds := make(map[string]int)
+	err = src.messages(room, func(msg *importMessage) error {
+		from := state.uid(msg.User)
+		if from.IsZero() {
+			skipped++
+			return nil
+		}
+		seq++
+		seqIds[msg.Id] = seq
+		if seq <= saved {
+			return nil
+		}
+
+		var urls []string
+		var ents []map[string]any
+		for i := range msg.Files {
+			url, size, err := importAttachment(from, &msg.Files[i])
+			if err != nil {
+				log.Printf("Attachment '%s' of message %s skipped: %s", msg.Files[i].Name, msg.Id, err)
+				continue
+			}
+			urls = append(urls, url)
+			ents = append(ents, map[string]any{
+				"tp": "EX",
+				"data": map[string]any{
+					"mime": msg.Files[i].Mime,
+					"name": msg.Files[i].Name,
+					"ref":  url,
+					"size": size,
+				},
+			})
+		}
+
+		head := types.KVMap{}
+		var content any = msg.Text
+		if len(ents) > 0 {
+			fmts := make([]map[string]any, len(ents))
+			for i := range ents {
+				fmts[i] = map[string]any{"at": -1, "len": 0, "key": i}
+			}
+			content = map[string]any{"txt": msg.Text, "fmt": fmts, "ent": ents}
+			head["mime"] = "text/x-drafty"
+		}
+		var thread int
+		if msg.Thread != "" && msg.Thread != msg.Id {
+			if thread = seqIds[msg.Thread]; thread > 0 {
+				head["thread"] = ":" + strconv.Itoa(thread)
+			}
+		}
+		if len(head) == 0 {
+			head = nil
+		}
+
+		if err, _ := store.Messages.Save(&types.Message{
+			ObjHeader: types.ObjHeader{CreatedAt: msg.Ts},
+			SeqId:     seq,
+			Topic:     it.Name,
+			From:      from.String(),
+			Head:      head,
+			Content:   content,
+			ThreadId:  thread,
+		}, urls, false); err != nil {
+			return err
+		}
+		count++
+		if count%1000 == 0 {
+			log.Printf("Conversation '%s': %d messages imported", room.Name, count)
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	if skipped > 0 {
+		log.Printf("Conversation '%s': %d messages of unknown users skipped", room.Name, skipped)
+	}
+
+	// The history is read by the members already.
+	subs, err := store.Topics.GetSubs(it.Name, nil)
+	if err != nil {
+		return count, err
+	}
+	for i := range subs {
+		if err = store.Subs.Update(it.Name, subs[i].Uid(),
+			map[string]any{"RecvSeqId": seq, "ReadSeqId": seq}); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// importAttachment uploads the attachment through the media handler. Returns the URL and the size of the file.
+func importAttachment(owner types.Uid, f *importFile) (string, int64, error) {
+	mh := store.Store.GetMediaHandler()
+	if mh == nil {
+		return "", 0, errors.New("media handler is not configured")
+	}
+	if f.Mime == "" {
+		f.Mime = mime.TypeByExtension(filepath.Ext(f.Name))
+		if f.Mime == "" {
+			f.Mime = "application/octet-stream"
+		}
+	}
+	file, err := f.open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	fdef := &types.FileDef{
+		ObjHeader: types.ObjHeader{
+			Id: store.Store.GetUidString(),
+		},
+		User:     owner.String(),
+		MimeType: f.Mime,
+	}
+	fdef.InitTimes()
+	url, size, err := mh.Upload(fdef, file)
+	if err != nil {
+		store.Files.FinishUpload(fdef, false, 0)
+		return "", 0, err
+	}
+	if _, err = store.Files.FinishUpload(fdef, true, size); err != nil {
+		mh.Delete([]string{fdef.Location})
+		return "", 0, err
+	}
+	return url, size, nil
+}
+
+// Client for downloading attachments which are not included in the export.
+var importHttpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// importDownload opens the file at the URL.
+func importDownload(url string) (io.ReadCloser, error) {
+	resp, err := importHttpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("download failed: " + resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/mock_store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+func TestImportUserAccount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	uu := mock_store.NewMockUsersPersistenceInterface(ctrl)
+	prevUsers := store.Users
+	store.Users = uu
+	defer func() {
+		store.Users = prevUsers
+		ctrl.Finish()
+	}()
+
+	// Users are matched to existing accounts by email.
+	existing := types.Uid(10)
+	uu.EXPECT().GetByCred("email", "alice@example.com").Return(existing, nil)
+	if uid, created := importUserAccount(&importUser{Id: "U01", Name: "Alice",
+		Email: "alice@example.com"}); uid != existing || created {
+		t.Errorf("Expected existing account %s, got %s %t", existing.UserId(), uid.UserId(), created)
+	}
+
+	// Deleted users are imported as suspended accounts with validated email.
+	uu.EXPECT().GetByCred("email", "bob@example.com").Return(types.ZeroUid, nil)
+	uu.EXPECT().Create(gomock.Any(), nil).DoAndReturn(func(user *types.User, _ map[string]any) (*types.User, error) {
+		if user.State != types.StateSuspended || len(user.Tags) != 1 || user.Tags[0] != "email:bob@example.com" ||
+			user.Public.(*card).Fn != "Bob" {
+			t.Errorf("Unexpected user %+v", user)
+		}
+		user.SetUid(types.Uid(11))
+		return user, nil
+	})
+	uu.EXPECT().UpsertCred(&types.Credential{User: types.Uid(11).String(), Method: "email",
+		Value: "bob@example.com", Done: true}).Return(true, nil)
+	if uid, created := importUserAccount(&importUser{Id: "U02", Name: "Bob", Email: "bob@example.com",
+		Deleted: true}); uid != types.Uid(11) || !created {
+		t.Errorf("Expected new account, got %s %t", uid.UserId(), created)
+	}
+}
+
+func TestImportRoomTopic(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ss := mock_store.NewMockPersistentStorageInterface(ctrl)
+	tt := mock_store.NewMockTopicsPersistenceInterface(ctrl)
+	prevStore, prevTopics := store.Store, store.Topics
+	store.Store, store.Topics = ss, tt
+	defer func() {
+		store.Store, store.Topics = prevStore, prevTopics
+		ctrl.Finish()
+	}()
+
+	alice, bob := types.Uid(10), types.Uid(11)
+	state := &importState{Users: map[string]string{"U01": alice.String(), "U02": bob.String()}}
+	created := time.Unix(1585000000, 0).UTC()
+
+	// Direct conversations are appended to existing p2p topics.
+	p2p := alice.P2PName(bob)
+	tt.EXPECT().Get(p2p).Return(&types.Topic{SeqId: 5}, nil)
+	dm := &importRoom{Id: "D01", Name: "D01", Created: created, Members: []string{"U01", "U02"}, Direct: true}
+	if it := importRoomTopic(dm, state, false); it == nil || it.Name != p2p || it.Base != 5 {
+		t.Errorf("Expected existing p2p topic, got %+v", it)
+	}
+	tt.EXPECT().Get(p2p).Return(nil, nil)
+	tt.EXPECT().CreateP2P(gomock.Any(), gomock.Any()).DoAndReturn(func(sub1, sub2 *types.Subscription) error {
+		if sub1.User != alice.String() || sub2.User != bob.String() || sub1.ModeWant != types.ModeCP2PD ||
+			!sub2.CreatedAt.Equal(created) {
+			t.Errorf("Unexpected subscriptions %+v %+v", sub1, sub2)
+		}
+		return nil
+	})
+	if it := importRoomTopic(dm, state, true); it == nil || it.Name != p2p || it.Base != 0 {
+		t.Errorf("Expected new p2p topic, got %+v", it)
+	}
+	// Direct conversations with unknown members are skipped.
+	for _, members := range [][]string{{"U01"}, {"U01", "U03"}, {"U01", "U01"}} {
+		if it := importRoomTopic(&importRoom{Name: "D02", Members: members, Direct: true}, state, false); it != nil {
+			t.Errorf("Members %v: conversation not skipped", members)
+		}
+	}
+
+	// Private channels require approval to join, archived channels are frozen. The first known member
+	// owns the topic if the creator is not imported.
+	ss.EXPECT().GetUidString().Return("AAAAAAAAAAA")
+	tt.EXPECT().Create(gomock.Any(), bob, nil).DoAndReturn(func(topic *types.Topic, owner types.Uid,
+		_ any) error {
+		if topic.Id != "grpAAAAAAAAAAA" || topic.Access.Auth != types.ModeNone || !topic.CreatedAt.Equal(created) ||
+			topic.Public.(*card).Fn != "secret" || topic.Public.(*card).Note != "Top secret" {
+			t.Errorf("Unexpected topic %+v", topic)
+		}
+		return nil
+	})
+	tt.EXPECT().Update("grpAAAAAAAAAAA", map[string]any{"Frozen": true}).Return(nil)
+	room := &importRoom{Id: "G01", Name: "secret", Note: "Top secret", Created: created, Owner: "U03",
+		Members: []string{"U03", "U02"}, Private: true, Archived: true}
+	if it := importRoomTopic(room, state, false); it == nil || it.Name != "grpAAAAAAAAAAA" {
+		t.Errorf("Expected new group topic, got %+v", it)
+	}
+}
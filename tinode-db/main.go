@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +18,13 @@ import (
 	_ "github.com/tinode/chat/server/db/mysql"
 	_ "github.com/tinode/chat/server/db/postgres"
 	_ "github.com/tinode/chat/server/db/rethinkdb"
+	_ "github.com/tinode/chat/server/db/sqlite"
+	_ "github.com/tinode/chat/server/kms/awskms"
+	_ "github.com/tinode/chat/server/kms/vault"
+	_ "github.com/tinode/chat/server/media/azure"
+	_ "github.com/tinode/chat/server/media/fs"
+	_ "github.com/tinode/chat/server/media/gcs"
+	_ "github.com/tinode/chat/server/media/s3"
 	"github.com/tinode/chat/server/store"
 	"github.com/tinode/chat/server/store/types"
 	jcr "github.com/tinode/jsonco"
@@ -25,6 +33,7 @@ import (
 type configType struct {
 	P2PDeleteEnabled bool            `json:"p2p_delete_enabled"`
 	StoreConfig      json.RawMessage `json:"store_config"`
+	Media            *mediaConfig    `json:"media"`
 }
 
 type theCard struct {
@@ -199,6 +208,14 @@ func main() {
 	makeRoot := flag.String("make_root", "", "promote ordinary user to ROOT, auth scheme 'basic'")
 	datafile := flag.String("data", "", "name of file with sample data to load")
 	conffile := flag.String("config", "./tinode.conf", "config of the database connection")
+	dedupP2P := flag.Bool("dedup_p2p", false, "find duplicate p2p topics and merge them into canonical topics")
+	dryRun := flag.Bool("dry_run", false, "with --dedup_p2p list duplicate topics but don't merge them")
+	reencrypt := flag.Bool("reencrypt", false, "encrypt plaintext messages and re-encrypt messages with the current key")
+	reencryptFrom := flag.Int64("reencrypt_from", 0, "with --reencrypt resume after the message with this ID")
+	reencryptBatch := flag.Int("reencrypt_batch", 500, "with --reencrypt number of messages to process in one batch")
+	importFrom := flag.String("import", "", "import users, conversations and messages from a Slack export or a Rocket.Chat dump")
+	importFormat := flag.String("import_format", "slack", "with --import format of the data: 'slack' or 'rocketchat'")
+	importState := flag.String("import_state", "", "with --import file to keep the progress of the import in, default: <import>.state")
 
 	flag.Parse()
 
@@ -353,7 +370,91 @@ func main() {
 		log.Printf("ROOT user created: '%s:%s'", uname, password)
 	}
 
+	// Find and merge duplicate p2p topics.
+	if *dedupP2P {
+		mergeDuplicateP2P(*dryRun)
+	}
+
+	// Encrypt existing messages.
+	if *reencrypt {
+		reencryptMessages(*reencryptFrom, *reencryptBatch)
+	}
+
+	// Import data from another chat.
+	if *importFrom != "" {
+		importChat(*importFormat, *importFrom, *importState, config.Media, config.P2PDeleteEnabled)
+	}
+
 	log.Println("All done.")
 
 	os.Exit(0)
 }
+
+// mergeDuplicateP2P merges duplicate p2p topics into the canonically named topic of the same pair of users.
+// The server must not be running while topics are merged.
+func mergeDuplicateP2P(dryRun bool) {
+	dupes, err := store.Topics.FindDuplicateP2P()
+	if err != nil {
+		log.Fatalln("Failed to find duplicate p2p topics:", err)
+	}
+	if len(dupes) == 0 {
+		log.Println("No duplicate p2p topics found.")
+		return
+	}
+
+	canonical := make([]string, 0, len(dupes))
+	for name := range dupes {
+		canonical = append(canonical, name)
+	}
+	sort.Strings(canonical)
+
+	for _, dst := range canonical {
+		if topic, err := store.Topics.Get(dst); err != nil {
+			log.Fatalln("Failed to load topic", dst, err)
+		} else if topic == nil {
+			// Not merging into a non-existent topic: it cannot be renamed.
+			log.Printf("Topic '%s' does not exist, skipping duplicates %v", dst, dupes[dst])
+			continue
+		}
+
+		for _, src := range dupes[dst] {
+			if dryRun {
+				log.Printf("Duplicate p2p topic '%s' -> '%s'", src, dst)
+				continue
+			}
+			if err := store.Topics.Merge(dst, src); err != nil {
+				log.Fatalln("Failed to merge topic", src, "into", dst, err)
+			}
+			log.Printf("Merged p2p topic '%s' into '%s'", src, dst)
+		}
+	}
+}
+
+// reencryptMessages walks all messages in batches starting after message ID fromId, encrypts plaintext
+// content and re-encrypts content which is encrypted with other than the current key. Progress is logged
+// after every batch; if interrupted, the run can be resumed from the last reported ID.
+func reencryptMessages(fromId int64, batchSize int) {
+	if !store.IsEncryptionEnabled() {
+		log.Fatalln("Message encryption is not configured: set 'encryption_key' or 'encryption_keys' in store_config")
+	}
+	if batchSize <= 0 {
+		log.Fatalln("Invalid batch size", batchSize)
+	}
+
+	var processed, total int
+	lastId := fromId
+	for {
+		next, count, err := store.Messages.ReencryptBatch(lastId, batchSize)
+		if err != nil {
+			log.Fatalf("Failed to re-encrypt messages after ID %d: %s. Resume with --reencrypt_from=%d", lastId, err, lastId)
+		}
+		if next == 0 {
+			break
+		}
+		lastId = next
+		processed++
+		total += count
+		log.Printf("Re-encrypt: batch %d, last message ID %d, %d messages rewritten (%d total)", processed, lastId, count, total)
+	}
+	log.Printf("Re-encryption completed: %d messages rewritten", total)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Rocket.Chat dump is a directory with collections exported by mongoexport, one document per line or
+as a JSON array:
+
+	users.json: {"_id": "u1", "username": "alice", "name": "Alice Johnson", "active": true,
+		"emails": [{"address": "alice@example.com", "verified": true}]}
+	rocketchat_room.json: {"_id": "r1", "t": "c", "name": "general", "fname": "General", "description": "...",
+		"u": {"_id": "u1"}, "ts": {"$date": "2020-03-23T10:00:00.000Z"}, "archived": false, "uids": ["u1", "u2"]}
+		't' is "c" for public channels, "p" for private groups, "d" for direct conversations.
+	rocketchat_subscription.json: members of rooms {"rid": "r1", "u": {"_id": "u1"}}
+	rocketchat_message.json: {"_id": "m1", "rid": "r1", "msg": "Hi", "ts": {"$date": ...}, "u": {"_id": "u1"},
+		"tmid": "m0", "files": [{"_id": "f1", "name": "cat.jpg", "type": "image/jpeg"}]}
+	uploads/<file id>: files of the FileSystem upload storage.
+*/
+
+// mongoDate is a date in MongoDB extended JSON: {"$date": "2020-03-23T10:00:00.000Z"},
+// {"$date": 1584957600000} or {"$date": {"$numberLong": "1584957600000"}}.
+type mongoDate time.Time
+
+func (d *mongoDate) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Date json.RawMessage `json:"$date"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var ms int64
+	var str string
+	var long struct {
+		Long string `json:"$numberLong"`
+	}
+	switch {
+	case json.Unmarshal(v.Date, &ms) == nil:
+	case json.Unmarshal(v.Date, &long) == nil && long.Long != "":
+		var err error
+		if ms, err = strconv.ParseInt(long.Long, 10, 64); err != nil {
+			return err
+		}
+	case json.Unmarshal(v.Date, &str) == nil:
+		t, err := time.Parse(time.RFC3339Nano, str)
+		if err != nil {
+			return err
+		}
+		*d = mongoDate(t.UTC())
+		return nil
+	default:
+		return errors.New("invalid date " + string(data))
+	}
+	*d = mongoDate(time.UnixMilli(ms).UTC())
+	return nil
+}
+
+type rocketRef struct {
+	Id string `json:"_id"`
+}
+
+type rocketUser struct {
+	Id       string `json:"_id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Active   bool   `json:"active"`
+	Emails   []struct {
+		Address  string `json:"address"`
+		Verified bool   `json:"verified"`
+	} `json:"emails"`
+}
+
+type rocketRoom struct {
+	Id          string    `json:"_id"`
+	T           string    `json:"t"`
+	Name        string    `json:"name"`
+	Fname       string    `json:"fname"`
+	Description string    `json:"description"`
+	U           rocketRef `json:"u"`
+	Ts          mongoDate `json:"ts"`
+	Archived    bool      `json:"archived"`
+	Uids        []string  `json:"uids"`
+	Usernames   []string  `json:"usernames"`
+}
+
+type rocketFile struct {
+	Id   string `json:"_id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type rocketMessage struct {
+	Id    string       `json:"_id"`
+	Rid   string       `json:"rid"`
+	Msg   string       `json:"msg"`
+	Ts    mongoDate    `json:"ts"`
+	T     string       `json:"t"`
+	U     rocketRef    `json:"u"`
+	Tmid  string       `json:"tmid"`
+	File  *rocketFile  `json:"file"`
+	Files []rocketFile `json:"files"`
+}
+
+// Location of a message in the dump.
+type rocketMessageRef struct {
+	ts     time.Time
+	offset int64
+	length int
+}
+
+type rocketDump struct {
+	dir     string
+	msgFile *os.File
+	// Messages of rooms in the order of the dump.
+	index map[string][]rocketMessageRef
+	// User IDs by username for rooms which list members by usernames.
+	userIds map[string]string
+}
+
+func openRocketChatDump(from string) (importSource, error) {
+	src := &rocketDump{dir: from, index: make(map[string][]rocketMessageRef), userIds: make(map[string]string)}
+	var err error
+	if src.msgFile, err = os.Open(filepath.Join(from, "rocketchat_message.json")); err != nil {
+		return nil, err
+	}
+	// Messages are not sorted in the dump. The dump may be large: only locations of messages are kept.
+	if err = readMongoExport(src.msgFile, func(raw json.RawMessage, end int64) error {
+		var msg rocketMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			return err
+		}
+		if msg.T != "" {
+			// System message, such as 'uj': user joined.
+			return nil
+		}
+		src.index[msg.Rid] = append(src.index[msg.Rid], rocketMessageRef{
+			ts:     time.Time(msg.Ts),
+			offset: end - int64(len(raw)),
+			length: len(raw),
+		})
+		return nil
+	}); err != nil {
+		src.msgFile.Close()
+		return nil, errors.New("rocketchat_message.json: " + err.Error())
+	}
+	return src, nil
+}
+
+func (src *rocketDump) close() {
+	src.msgFile.Close()
+}
+
+// readMongoExport calls fn for every document of the collection with the offset of the end of the document.
+func readMongoExport(file *os.File, fn func(raw json.RawMessage, end int64) error) error {
+	dec := json.NewDecoder(file)
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('[') {
+		// One document per line: start over.
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		dec = json.NewDecoder(file)
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := fn(raw, dec.InputOffset()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCollection calls fn for every document of the collection. Missing file is not an error.
+func (src *rocketDump) readCollection(name string, fn func(raw json.RawMessage) error) error {
+	file, err := os.Open(filepath.Join(src.dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	if err = readMongoExport(file, func(raw json.RawMessage, _ int64) error { return fn(raw) }); err != nil {
+		return errors.New(name + ": " + err.Error())
+	}
+	return nil
+}
+
+func (src *rocketDump) users() ([]importUser, error) {
+	var result []importUser
+	err := src.readCollection("users.json", func(raw json.RawMessage) error {
+		var u rocketUser
+		if err := json.Unmarshal(raw, &u); err != nil {
+			return err
+		}
+		src.userIds[u.Username] = u.Id
+		user := importUser{Id: u.Id, Name: u.Name, Deleted: !u.Active}
+		if user.Name == "" {
+			user.Name = u.Username
+		}
+		for _, email := range u.Emails {
+			if email.Verified {
+				user.Email = strings.ToLower(email.Address)
+				break
+			}
+		}
+		result = append(result, user)
+		return nil
+	})
+	return result, err
+}
+
+func (src *rocketDump) rooms() ([]importRoom, error) {
+	members := make(map[string][]string)
+	if err := src.readCollection("rocketchat_subscription.json", func(raw json.RawMessage) error {
+		var sub struct {
+			Rid string    `json:"rid"`
+			U   rocketRef `json:"u"`
+		}
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			return err
+		}
+		members[sub.Rid] = append(members[sub.Rid], sub.U.Id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var result []importRoom
+	err := src.readCollection("rocketchat_room.json", func(raw json.RawMessage) error {
+		var r rocketRoom
+		if err := json.Unmarshal(raw, &r); err != nil {
+			return err
+		}
+		if r.T != "c" && r.T != "p" && r.T != "d" {
+			// Livechat and other kinds of rooms.
+			return nil
+		}
+		room := importRoom{
+			Id:       r.Id,
+			Name:     r.Fname,
+			Note:     r.Description,
+			Created:  time.Time(r.Ts),
+			Owner:    r.U.Id,
+			Members:  members[r.Id],
+			Direct:   r.T == "d",
+			Private:  r.T == "p",
+			Archived: r.Archived,
+		}
+		if room.Name == "" {
+			room.Name = r.Name
+		}
+		if room.Direct {
+			room.Name = r.Id
+			room.Members = r.Uids
+		}
+		if len(room.Members) == 0 {
+			for _, username := range r.Usernames {
+				if id, ok := src.userIds[username]; ok {
+					room.Members = append(room.Members, id)
+				}
+			}
+		}
+		result = append(result, room)
+		return nil
+	})
+	return result, err
+}
+
+func (src *rocketDump) messages(room *importRoom, fn func(*importMessage) error) error {
+	refs := src.index[room.Id]
+	sort.SliceStable(refs, func(i, j int) bool {
+		return refs[i].ts.Before(refs[j].ts)
+	})
+	for _, ref := range refs {
+		raw := make([]byte, ref.length)
+		if _, err := src.msgFile.ReadAt(raw, ref.offset); err != nil {
+			return err
+		}
+		var m rocketMessage
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		msg := &importMessage{
+			Id:     m.Id,
+			User:   m.U.Id,
+			Text:   m.Msg,
+			Ts:     time.Time(m.Ts).Round(time.Millisecond),
+			Thread: m.Tmid,
+		}
+		files := m.Files
+		if len(files) == 0 && m.File != nil {
+			files = []rocketFile{*m.File}
+		}
+		for _, f := range files {
+			local := filepath.Join(src.dir, "uploads", f.Id)
+			msg.Files = append(msg.Files, importFile{
+				Name: f.Name,
+				Mime: f.Type,
+				open: func() (io.ReadCloser, error) { return os.Open(local) },
+			})
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMongoDate(t *testing.T) {
+	expected := time.Date(2020, 3, 23, 10, 0, 0, 0, time.UTC)
+	for _, raw := range []string{
+		`{"$date": "2020-03-23T10:00:00.000Z"}`,
+		`{"$date": "2020-03-23T12:00:00+02:00"}`,
+		`{"$date": 1584957600000}`,
+		`{"$date": {"$numberLong": "1584957600000"}}`,
+	} {
+		var d mongoDate
+		if err := json.Unmarshal([]byte(raw), &d); err != nil {
+			t.Errorf("%s: %v", raw, err)
+		} else if got := time.Time(d); !got.Equal(expected) || got.Location() != time.UTC {
+			t.Errorf("%s: expected %v, got %v", raw, expected, got)
+		}
+	}
+	for _, raw := range []string{`{"$date": true}`, `{"$date": "yesterday"}`, `{"$date": {"$numberLong": "x"}}`} {
+		var d mongoDate
+		if err := json.Unmarshal([]byte(raw), &d); err == nil {
+			t.Errorf("Invalid date %s accepted", raw)
+		}
+	}
+}
+
+func TestRocketChatDump(t *testing.T) {
+	dir := t.TempDir()
+	// Collections as JSON arrays and one document per line.
+	writeFixture(t, dir, map[string]string{
+		"users.json": `[
+			{"_id": "u1", "username": "alice", "name": "Alice Johnson", "active": true,
+				"emails": [{"address": "old@example.com"}, {"address": "Alice@Example.com", "verified": true}]},
+			{"_id": "u2", "username": "bob", "active": false}
+		]`,
+		"rocketchat_room.json": `{"_id": "r1", "t": "c", "name": "general", "fname": "General", "description": "All",
+	"u": {"_id": "u1"}, "ts": {"$date": "2020-03-23T10:00:00.000Z"}}
+{"_id": "r2", "t": "p", "name": "secret", "u": {"_id": "u2"}, "ts": {"$date": 1584957600000},
+	"archived": true, "usernames": ["bob", "nobody"]}
+{"_id": "u1u2", "t": "d", "ts": {"$date": 1584957600000}, "uids": ["u1", "u2"]}
+{"_id": "l1", "t": "l", "name": "livechat"}
+`,
+		"rocketchat_subscription.json": `[{"rid": "r1", "u": {"_id": "u1"}}, {"rid": "r1", "u": {"_id": "u2"}}]`,
+		"rocketchat_message.json": `{"_id": "m3", "rid": "r1", "msg": "Reply", "ts": {"$date": "2020-03-23T10:02:00.000Z"}, "u": {"_id": "u2"}, "tmid": "m1"}
+{"_id": "m2", "rid": "r1", "t": "uj", "msg": "bob", "ts": {"$date": "2020-03-23T10:01:00.000Z"}, "u": {"_id": "u2"}}
+{"_id": "m1", "rid": "r1", "msg": "Hi", "ts": {"$date": "2020-03-23T10:00:00.000Z"}, "u": {"_id": "u1"},
+	"file": {"_id": "f1", "name": "cat.jpg", "type": "image/jpeg"}}
+{"_id": "m4", "rid": "u1u2", "msg": "Psst", "ts": {"$date": {"$numberLong": "1584957660000"}}, "u": {"_id": "u1"}}
+`,
+		"uploads/f1": "meow",
+	})
+
+	src, err := openRocketChatDump(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.close()
+
+	users, err := src.users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUsers := []importUser{
+		{Id: "u1", Name: "Alice Johnson", Email: "alice@example.com"},
+		{Id: "u2", Name: "bob", Deleted: true},
+	}
+	if !reflect.DeepEqual(users, expectedUsers) {
+		t.Errorf("Users: expected %+v, got %+v", expectedUsers, users)
+	}
+
+	rooms, err := src.rooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2020, 3, 23, 10, 0, 0, 0, time.UTC)
+	expectedRooms := []importRoom{
+		{Id: "r1", Name: "General", Note: "All", Created: created, Owner: "u1", Members: []string{"u1", "u2"}},
+		{Id: "r2", Name: "secret", Created: created, Owner: "u2", Members: []string{"u2"}, Private: true,
+			Archived: true},
+		{Id: "u1u2", Name: "u1u2", Created: created, Members: []string{"u1", "u2"}, Direct: true},
+	}
+	if !reflect.DeepEqual(rooms, expectedRooms) {
+		t.Errorf("Rooms: expected %+v, got %+v", expectedRooms, rooms)
+	}
+
+	// Messages are sorted, system messages are skipped.
+	msgs := readMessages(t, src, &rooms[0])
+	if len(msgs) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(msgs))
+	}
+	if msgs[0].Id != "m1" || msgs[0].User != "u1" || msgs[0].Text != "Hi" || !msgs[0].Ts.Equal(created) {
+		t.Errorf("Unexpected message %+v", msgs[0])
+	}
+	if len(msgs[0].Files) != 1 || msgs[0].Files[0].Name != "cat.jpg" || msgs[0].Files[0].Mime != "image/jpeg" {
+		t.Fatalf("Unexpected files %+v", msgs[0].Files)
+	}
+	file, err := msgs[0].Files[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(file)
+	file.Close()
+	if string(content) != "meow" {
+		t.Errorf("Unexpected file content '%s'", content)
+	}
+	if msgs[1].Id != "m3" || msgs[1].Thread != "m1" {
+		t.Errorf("Unexpected reply %+v", msgs[1])
+	}
+
+	if msgs = readMessages(t, src, &rooms[2]); len(msgs) != 1 || msgs[0].Text != "Psst" {
+		t.Errorf("Unexpected messages of direct conversation %+v", msgs)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Slack export is a zip archive or a directory:
+
+	users.json: [{"id": "U01", "name": "alice", "real_name": "Alice Johnson", "deleted": false,
+		"profile": {"email": "alice@example.com", "display_name": "alice"}}]
+	channels.json, groups.json: public and private channels
+		[{"id": "C01", "name": "general", "created": 1585000000, "creator": "U01",
+		"members": ["U01", "U02"], "purpose": {"value": "..."}, "is_archived": false}]
+	mpims.json: group direct conversations, same as channels
+	dms.json: direct conversations [{"id": "D01", "created": 1585000000, "members": ["U01", "U02"]}]
+	general/2020-03-23.json: messages of a channel by day, the directory of a direct conversation is its ID
+		[{"type": "message", "user": "U01", "text": "Hi <@U02>", "ts": "1585000000.000100",
+		"thread_ts": "1585000000.000100", "files": [{"id": "F01", "name": "cat.jpg",
+		"mimetype": "image/jpeg", "url_private_download": "https://files.slack.com/..."}]}]
+
+Files are read from __uploads/<file id>/<name> of the export if present, or downloaded.
+*/
+
+type slackUser struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Deleted  bool   `json:"deleted"`
+	Profile  struct {
+		Email       string `json:"email"`
+		DisplayName string `json:"display_name"`
+	} `json:"profile"`
+}
+
+type slackChannel struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Created    int64    `json:"created"`
+	Creator    string   `json:"creator"`
+	Members    []string `json:"members"`
+	IsArchived bool     `json:"is_archived"`
+	Purpose    struct {
+		Value string `json:"value"`
+	} `json:"purpose"`
+}
+
+type slackFile struct {
+	Id                 string `json:"id"`
+	Name               string `json:"name"`
+	Mimetype           string `json:"mimetype"`
+	UrlPrivate         string `json:"url_private"`
+	UrlPrivateDownload string `json:"url_private_download"`
+}
+
+type slackMessage struct {
+	Type     string      `json:"type"`
+	Subtype  string      `json:"subtype"`
+	User     string      `json:"user"`
+	Text     string      `json:"text"`
+	Ts       string      `json:"ts"`
+	ThreadTs string      `json:"thread_ts"`
+	Files    []slackFile `json:"files"`
+}
+
+// Subtypes of messages written by users. Other subtypes are notifications, such as 'channel_join'.
+var slackUserSubtypes = map[string]bool{"": true, "bot_message": true, "file_share": true, "me_message": true,
+	"thread_broadcast": true}
+
+// Markup of mentions and links: <@U01>, <#C01|general>, <!here>, <https://example.com|example>.
+var slackMarkup = regexp.MustCompile(`<([@#!]?)([^>|]*)(?:\|([^>]*))?>`)
+
+type slackExport struct {
+	fsys fs.FS
+	zip  *zip.ReadCloser
+	// Names of users to replace mentions with.
+	names map[string]string
+	// Directories with messages of conversations.
+	dirs map[string]string
+}
+
+func openSlackExport(from string) (importSource, error) {
+	info, err := os.Stat(from)
+	if err != nil {
+		return nil, err
+	}
+	src := &slackExport{names: make(map[string]string), dirs: make(map[string]string)}
+	if info.IsDir() {
+		src.fsys = os.DirFS(from)
+	} else {
+		if src.zip, err = zip.OpenReader(from); err != nil {
+			return nil, err
+		}
+		src.fsys = src.zip
+	}
+	return src, nil
+}
+
+func (src *slackExport) close() {
+	if src.zip != nil {
+		src.zip.Close()
+	}
+}
+
+// readJSON parses a file of the export. Missing file is not an error.
+func (src *slackExport) readJSON(name string, v any) error {
+	raw, err := fs.ReadFile(src.fsys, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (src *slackExport) users() ([]importUser, error) {
+	var users []slackUser
+	if err := src.readJSON("users.json", &users); err != nil {
+		return nil, err
+	}
+	result := make([]importUser, 0, len(users))
+	for _, u := range users {
+		name := u.RealName
+		if name == "" {
+			name = u.Name
+		}
+		src.names[u.Id] = u.Name
+		if u.Profile.DisplayName != "" {
+			src.names[u.Id] = u.Profile.DisplayName
+		}
+		result = append(result, importUser{
+			Id:      u.Id,
+			Name:    name,
+			Email:   strings.ToLower(u.Profile.Email),
+			Deleted: u.Deleted,
+		})
+	}
+	return result, nil
+}
+
+func (src *slackExport) rooms() ([]importRoom, error) {
+	var result []importRoom
+	for _, list := range []struct {
+		file    string
+		private bool
+	}{{"channels.json", false}, {"groups.json", true}, {"mpims.json", true}} {
+		var channels []slackChannel
+		if err := src.readJSON(list.file, &channels); err != nil {
+			return nil, err
+		}
+		for _, ch := range channels {
+			src.dirs[ch.Id] = ch.Name
+			result = append(result, importRoom{
+				Id:       ch.Id,
+				Name:     ch.Name,
+				Note:     ch.Purpose.Value,
+				Created:  time.Unix(ch.Created, 0).UTC(),
+				Owner:    ch.Creator,
+				Members:  ch.Members,
+				Private:  list.private,
+				Archived: ch.IsArchived,
+			})
+		}
+	}
+
+	var dms []slackChannel
+	if err := src.readJSON("dms.json", &dms); err != nil {
+		return nil, err
+	}
+	for _, dm := range dms {
+		src.dirs[dm.Id] = dm.Id
+		result = append(result, importRoom{
+			Id:      dm.Id,
+			Name:    dm.Id,
+			Created: time.Unix(dm.Created, 0).UTC(),
+			Members: dm.Members,
+			Direct:  true,
+		})
+	}
+	return result, nil
+}
+
+func (src *slackExport) messages(room *importRoom, fn func(*importMessage) error) error {
+	dir := src.dirs[room.Id]
+	// Files of days: YYYY-MM-DD.json are sorted chronologically.
+	days, err := fs.Glob(src.fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(days)
+	for _, day := range days {
+		var msgs []slackMessage
+		if err := src.readJSON(day, &msgs); err != nil {
+			return errors.New(day + ": " + err.Error())
+		}
+		sort.SliceStable(msgs, func(i, j int) bool {
+			return slackTime(msgs[i].Ts).Before(slackTime(msgs[j].Ts))
+		})
+		for i := range msgs {
+			m := &msgs[i]
+			if m.Type != "message" || !slackUserSubtypes[m.Subtype] {
+				continue
+			}
+			msg := &importMessage{
+				Id:     m.Ts,
+				User:   m.User,
+				Text:   src.plainText(m.Text),
+				Ts:     slackTime(m.Ts),
+				Thread: m.ThreadTs,
+			}
+			for _, f := range m.Files {
+				if file := src.file(&f); file != nil {
+					msg.Files = append(msg.Files, *file)
+				}
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// file returns the attachment from the export or from Slack, nil if the file is not available,
+// e.g. deleted.
+func (src *slackExport) file(f *slackFile) *importFile {
+	local := path.Join("__uploads", f.Id, f.Name)
+	url := f.UrlPrivateDownload
+	if url == "" {
+		url = f.UrlPrivate
+	}
+	if _, err := fs.Stat(src.fsys, local); err != nil && url == "" {
+		return nil
+	}
+	return &importFile{
+		Name: f.Name,
+		Mime: f.Mimetype,
+		open: func() (io.ReadCloser, error) {
+			if file, err := src.fsys.Open(local); err == nil {
+				return file, nil
+			}
+			return importDownload(url)
+		},
+	}
+}
+
+// plainText replaces markup of mentions and links with plain text.
+func (src *slackExport) plainText(text string) string {
+	text = slackMarkup.ReplaceAllStringFunc(text, func(markup string) string {
+		parts := slackMarkup.FindStringSubmatch(markup)
+		kind, id, label := parts[1], parts[2], parts[3]
+		switch kind {
+		case "@":
+			if name, ok := src.names[id]; ok {
+				return "@" + name
+			}
+			if label != "" {
+				return "@" + label
+			}
+			return "@" + id
+		case "#":
+			if label != "" {
+				return "#" + label
+			}
+			return "#" + id
+		case "!":
+			// Special mentions, such as <!here>.
+			if label != "" {
+				return label
+			}
+			return "@" + id
+		}
+		if label == "" || label == id {
+			return id
+		}
+		return label + " (" + id + ")"
+	})
+	return html.UnescapeString(text)
+}
+
+// slackTime parses the message timestamp "1585000000.000100": seconds and microseconds.
+func slackTime(ts string) time.Time {
+	sec, frac, _ := strings.Cut(ts, ".")
+	s, _ := strconv.ParseInt(sec, 10, 64)
+	us, _ := strconv.ParseInt((frac + "000000")[:6], 10, 64)
+	return time.Unix(s, us*1000).UTC().Round(time.Millisecond)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeFixture creates files of the export with the given content in the directory.
+func writeFixture(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readMessages returns all messages of the room.
+func readMessages(t *testing.T, src importSource, room *importRoom) []*importMessage {
+	t.Helper()
+	var msgs []*importMessage
+	if err := src.messages(room, func(msg *importMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func TestSlackExport(t *testing.T) {
+	dir := t.TempDir()
+	writeFixture(t, dir, map[string]string{
+		"users.json": `[
+			{"id": "U01", "name": "alice", "real_name": "Alice Johnson",
+				"profile": {"email": "Alice@Example.com", "display_name": "ali"}},
+			{"id": "U02", "name": "bob", "deleted": true, "profile": {}}
+		]`,
+		"channels.json": `[{"id": "C01", "name": "general", "created": 1585000000, "creator": "U01",
+			"members": ["U01", "U02"], "purpose": {"value": "Company-wide"}}]`,
+		"groups.json": `[{"id": "G01", "name": "secret", "created": 1585000000, "creator": "U02",
+			"members": ["U02"], "is_archived": true}]`,
+		"dms.json": `[{"id": "D01", "created": 1585000000, "members": ["U01", "U02"]}]`,
+		"general/2020-03-24.json": `[
+			{"type": "message", "user": "U02", "text": "Later", "ts": "1585090000.000200"}
+		]`,
+		"general/2020-03-23.json": `[
+			{"type": "message", "user": "U02", "text": "Reply", "ts": "1585000100.000100",
+				"thread_ts": "1585000000.000100"},
+			{"type": "message", "subtype": "channel_join", "user": "U02", "text": "<@U02> has joined",
+				"ts": "1585000050.000000"},
+			{"type": "message", "user": "U01", "text": "Hi <@U02> &amp; <!here>, ask <@U01>, see <https://example.com|docs>",
+				"ts": "1585000000.000100", "files": [
+					{"id": "F01", "name": "cat.jpg", "mimetype": "image/jpeg"},
+					{"id": "F02", "name": "gone.txt", "mimetype": "text/plain"}
+				]}
+		]`,
+		"__uploads/F01/cat.jpg": "meow",
+		"D01/2020-03-23.json":   `[{"type": "message", "user": "U01", "text": "Psst", "ts": "1585000000.5"}]`,
+	})
+
+	src, err := openSlackExport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.close()
+
+	users, err := src.users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedUsers := []importUser{
+		{Id: "U01", Name: "Alice Johnson", Email: "alice@example.com"},
+		{Id: "U02", Name: "bob", Deleted: true},
+	}
+	if !reflect.DeepEqual(users, expectedUsers) {
+		t.Errorf("Users: expected %+v, got %+v", expectedUsers, users)
+	}
+
+	rooms, err := src.rooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Unix(1585000000, 0).UTC()
+	expectedRooms := []importRoom{
+		{Id: "C01", Name: "general", Note: "Company-wide", Created: created, Owner: "U01",
+			Members: []string{"U01", "U02"}},
+		{Id: "G01", Name: "secret", Created: created, Owner: "U02", Members: []string{"U02"},
+			Private: true, Archived: true},
+		{Id: "D01", Name: "D01", Created: created, Members: []string{"U01", "U02"}, Direct: true},
+	}
+	if !reflect.DeepEqual(rooms, expectedRooms) {
+		t.Errorf("Rooms: expected %+v, got %+v", expectedRooms, rooms)
+	}
+
+	msgs := readMessages(t, src, &rooms[0])
+	if len(msgs) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(msgs))
+	}
+	first := msgs[0]
+	if first.Id != "1585000000.000100" || first.User != "U01" ||
+		first.Text != "Hi @bob & @here, ask @ali, see docs (https://example.com)" ||
+		!first.Ts.Equal(time.Unix(1585000000, 0)) {
+		t.Errorf("Unexpected message %+v", first)
+	}
+	// The file missing from the export without a download link is skipped.
+	if len(first.Files) != 1 || first.Files[0].Name != "cat.jpg" || first.Files[0].Mime != "image/jpeg" {
+		t.Fatalf("Unexpected files %+v", first.Files)
+	}
+	file, err := first.Files[0].open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(file)
+	file.Close()
+	if string(content) != "meow" {
+		t.Errorf("Unexpected file content '%s'", content)
+	}
+	if msgs[1].Text != "Reply" || msgs[1].Thread != first.Id || msgs[2].Text != "Later" {
+		t.Errorf("Unexpected messages %+v %+v", msgs[1], msgs[2])
+	}
+
+	if msgs = readMessages(t, src, &rooms[2]); len(msgs) != 1 || msgs[0].Text != "Psst" ||
+		!msgs[0].Ts.Equal(time.Unix(1585000000, 500000000)) {
+		t.Errorf("Unexpected messages of direct conversation %+v", msgs)
+	}
+	if msgs = readMessages(t, src, &rooms[1]); len(msgs) != 0 {
+		t.Errorf("Unexpected messages of empty channel %+v", msgs)
+	}
+}
+
+func TestSlackTime(t *testing.T) {
+	for ts, expected := range map[string]time.Time{
+		"1585000000.000100": time.Unix(1585000000, 0),
+		"1585000000.0015":   time.Unix(1585000000, 2000000),
+		"1585000000":        time.Unix(1585000000, 0),
+	} {
+		if got := slackTime(ts); !got.Equal(expected) {
+			t.Errorf("%s: expected %v, got %v", ts, expected, got)
+		}
+	}
+}